@@ -46,7 +46,7 @@ CREATE TABLE IF NOT EXISTS inet(
     UUID TEXT UNIQUE NOT NULL,
     acct TEXT NOT NULL,               -- Account (username/email)
     srvr TEXT NOT NULL,               -- Server (domain)
-    ptcl INTEGER NOT NULL DEFAULT 0,  -- Protocol (HTTPS=443)
+    ptcl INTEGER NOT NULL DEFAULT 0,  -- Protocol name (https); older rows hold the port (443)
     port INTEGER NOT NULL DEFAULT 0,  -- Port
     path TEXT,                        -- URL path
     labl TEXT,                        -- Label
@@ -115,7 +115,7 @@ export function setupTripleLayerHandlers(): void {
         uuid,
         credential.account,
         credential.server,
-        credential.protocol || 443,
+        credential.protocol || 'https',
         credential.port || 443,
         credential.path || null,
         credential.label || null,
@@ -0,0 +1,65 @@
+import { HttpErrorResponse } from '@angular/common/http';
+
+/** What the client must do before a failed request can succeed */
+export type ApiResolution = 'reauthenticate' | 'pull_first' | 'reduce_batch' | 'contact_support';
+
+/**
+ * The error envelope of every failed API response. Decide on `code`,
+ * `retryable` and `resolution`; `error` is for display only.
+ */
+export interface ApiError {
+  status: number;
+  error: string;
+  code: string;
+  retryable: boolean;
+  retry_after_ms?: number;
+  resolution?: ApiResolution;
+}
+
+/** Reads the envelope from a failed request; network failures are retryable */
+export function toApiError(response: HttpErrorResponse): ApiError {
+  const body = response.error;
+  if (body && typeof body === 'object' && typeof body.code === 'string') {
+    return {
+      status: response.status,
+      error: body.error ?? response.statusText,
+      code: body.code,
+      retryable: body.retryable === true,
+      retry_after_ms: body.retry_after_ms,
+      resolution: body.resolution
+    };
+  }
+
+  const retryAfter = Number(response.headers?.get('Retry-After'));
+  return {
+    status: response.status,
+    error: response.message,
+    code: response.status === 0 ? 'network' : 'unknown',
+    retryable: response.status === 0 || response.status >= 500 || response.status === 429,
+    retry_after_ms: retryAfter > 0 ? retryAfter * 1000 : undefined
+  };
+}
+
+/**
+ * A numbered push the server did not apply (409 push_sequence_mismatch).
+ * A duplicate was applied before and can be dropped; otherwise send the
+ * push numbered `expected_sequence` first.
+ */
+export interface PushSequenceMismatch {
+  sequence: number;
+  expected_sequence: number;
+  duplicate: boolean;
+}
+
+/** Reads a push sequence mismatch from a failed push, or null for any other failure */
+export function toPushSequenceMismatch(response: HttpErrorResponse): PushSequenceMismatch | null {
+  const body = response.error;
+  if (response.status !== 409 || !body || body.code !== 'push_sequence_mismatch') {
+    return null;
+  }
+  return {
+    sequence: body.sequence,
+    expected_sequence: body.expected_sequence,
+    duplicate: body.duplicate === true
+  };
+}
@@ -0,0 +1,35 @@
+import { HttpErrorResponse, HttpInterceptorFn } from '@angular/common/http';
+import { retry, throwError, timer } from 'rxjs';
+import { toApiError } from './api-error';
+
+const MAX_RETRIES = 3;
+const DEFAULT_DELAY_MS = 1000;
+const MAX_DELAY_MS = 60_000;
+
+/**
+ * Retries API requests the server marks retryable, waiting retry_after_ms
+ * when given and backing off otherwise. Other errors reach the caller at
+ * once; toApiError() gives them typed guidance.
+ */
+export const retryInterceptor: HttpInterceptorFn = (req, next) => {
+  if (!req.url.includes('/api/')) {
+    return next(req);
+  }
+
+  return next(req).pipe(
+    retry({
+      count: MAX_RETRIES,
+      delay: (error: unknown, attempt: number) => {
+        if (!(error instanceof HttpErrorResponse)) {
+          return throwError(() => error);
+        }
+        const apiError = toApiError(error);
+        if (!apiError.retryable) {
+          return throwError(() => error);
+        }
+        const wait = apiError.retry_after_ms ?? DEFAULT_DELAY_MS * 2 ** (attempt - 1);
+        return timer(Math.min(wait, MAX_DELAY_MS));
+      }
+    })
+  );
+};
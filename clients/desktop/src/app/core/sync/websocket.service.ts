@@ -3,7 +3,16 @@ import { Subject, Observable } from 'rxjs';
 import { AuthService } from '../auth/auth.service';
 import { getWsUrl } from '../../../environments/environment';
 
+// Close codes the server sends when it ends a connection
+export const WS_CLOSE_REAUTHENTICATE = 4001; // Get a new token, then reconnect
+export const WS_CLOSE_REVOKED = 4003; // Device or account revoked; don't reconnect
+
+// Sent instead of a replay when the missed events are gone; run a full
+// manifest check
+export const WS_EVENT_RESYNC_REQUIRED = 'resync_required';
+
 export interface SyncEvent {
+  seq?: number; // Per-user sequence; absent on resync events
   type: string;
   user_id: string;
   zone: string;
@@ -20,6 +29,7 @@ export class WebSocketService {
   private reconnectTimeout: any = null;
   private isConnected = false;
   private currentZone: string | null = null;
+  private lastSeq: number | null = null; // Highest seq received, sent back on reconnect
   private readonly WS_URL = getWsUrl();
   private readonly RECONNECT_DELAY = 5000;
 
@@ -41,9 +51,15 @@ export class WebSocketService {
     }
 
     try {
+      if (this.currentZone !== zone) {
+        this.lastSeq = null; // A different zone starts fresh
+      }
       this.currentZone = zone;
       // Pass token as query parameter for authentication
-      const wsUrl = `${this.WS_URL}?zone=${zone}&token=${token}`;
+      let wsUrl = `${this.WS_URL}?zone=${zone}&token=${token}`;
+      if (this.lastSeq !== null) {
+        wsUrl += `&last_seq=${this.lastSeq}`;
+      }
 
       this.ws = new WebSocket(wsUrl);
 
@@ -56,6 +72,9 @@ export class WebSocketService {
         try {
           const syncEvent: SyncEvent = JSON.parse(event.data);
           console.log('📥 Received sync event:', syncEvent.type, 'gencount:', syncEvent.gencount);
+          if (syncEvent.seq && syncEvent.seq > (this.lastSeq ?? 0)) {
+            this.lastSeq = syncEvent.seq;
+          }
           this.syncEventSubject.next(syncEvent);
         } catch (error) {
           console.error('❌ Error parsing sync event:', error);
@@ -67,8 +86,11 @@ export class WebSocketService {
         this.handleDisconnect();
       };
 
-      this.ws.onclose = () => {
-        console.log('🔌 WebSocket disconnected');
+      this.ws.onclose = (event) => {
+        console.log('🔌 WebSocket disconnected', event.code, event.reason);
+        if (event.code === WS_CLOSE_REVOKED) {
+          this.currentZone = null; // Nothing to reconnect to
+        }
         this.handleDisconnect();
       };
     } catch (error) {
@@ -94,6 +116,7 @@ export class WebSocketService {
 
     this.isConnected = false;
     this.currentZone = null;
+    this.lastSeq = null;
     console.log('🔌 WebSocket disconnected');
   }
 
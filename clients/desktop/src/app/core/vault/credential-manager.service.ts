@@ -9,6 +9,7 @@ import { TripleLayerCryptoService } from '../crypto/triple-layer-crypto.service'
 import {
   CryptoKey,
   CredentialMetadata,
+  CredentialProtocol,
   SyncRecord,
   VaultCredential,
   DecryptedCredentialData,
@@ -20,7 +21,7 @@ export interface CreateCredentialRequest {
   server: string;
   account: string;
   password: string;
-  protocol?: number;
+  protocol?: CredentialProtocol;
   port?: number;
   path?: string;
   label?: string;
@@ -68,7 +69,7 @@ export class CredentialManagerService {
       uuid: credentialUUID,
       server: request.server,
       account: request.account,
-      protocol: request.protocol || 443,
+      protocol: request.protocol || 'https',
       port: request.port || 443,
       path: request.path,
       label: request.label || `${request.account}@${request.server}`,
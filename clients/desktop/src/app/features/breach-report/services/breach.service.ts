@@ -1,6 +1,6 @@
 import { Injectable } from '@angular/core';
-import { HttpClient } from '@angular/common/http';
-import { Observable } from 'rxjs';
+import { HttpClient, HttpResponse } from '@angular/common/http';
+import { Observable, of, switchMap, throwError, timer } from 'rxjs';
 import { getApiUrl } from '../../../../environments/environment';
 
 export interface CVEItemSimple {
@@ -16,10 +16,13 @@ export interface CompanyCVEData {
   highest_score: number;
   highest_level: string; // CRITICAL/HIGH/MEDIUM/LOW/NONE
   top_cves: CVEItemSimple[];
+  match_method: 'override' | 'cpe' | 'keyword'; // keyword matches are the least reliable
+  cpe?: string;
 }
 
 export interface LeakSource {
   source: string;
+  domain?: string;
   date: string;
   data_types: string[];
   description?: string;
@@ -35,6 +38,24 @@ export interface LeakResponse {
   leaked_data: LeakSource[];
 }
 
+// Answer to a check that is still waiting for the shared HIBP quota
+export interface QueuedCheck {
+  status: 'queued';
+  job_id: string;
+  position: number;
+  estimated_wait_ms: number;
+  poll_url: string;
+}
+
+// A CVE enrichment job, as started and as polled
+export interface EnrichmentJob {
+  job_id: string;
+  status: 'queued' | 'running' | 'done' | 'failed';
+  percent: number;
+  report?: LeakResponse;
+  error?: string;
+}
+
 @Injectable({
   providedIn: 'root'
 })
@@ -44,16 +65,46 @@ export class BreachService {
   constructor(private http: HttpClient) {}
 
   checkEmail(email: string): Observable<LeakResponse> {
-    return this.http.post<LeakResponse>(
+    return this.http.post<LeakResponse | QueuedCheck>(
       `${this.API_URL}/breach/check`,
-      { email }
-    );
+      { email },
+      { observe: 'response' }
+    ).pipe(switchMap(res => this.resolveCheck(res)));
   }
 
+  // Enrichment runs server-side in the background; poll its job until the
+  // enriched report is ready
   enrichWithCVE(email: string): Observable<LeakResponse> {
-    return this.http.post<LeakResponse>(
-      `${this.API_URL}/breach/enrich-cve`,
-      { email }
+    return this.http.post<EnrichmentJob>(`${this.API_URL}/breach/enrich`, { email }).pipe(
+      switchMap(job => this.resolveEnrichment(job))
+    );
+  }
+
+  private resolveEnrichment(job: EnrichmentJob): Observable<LeakResponse> {
+    if (job.status === 'done') {
+      return of(job.report as LeakResponse);
+    }
+    if (job.status === 'failed') {
+      return throwError(() => new Error(job.error || 'CVE enrichment failed'));
+    }
+    return timer(1000).pipe(
+      switchMap(() => this.http.get<EnrichmentJob>(`${this.API_URL}/breach/enrich/${job.job_id}`)),
+      switchMap(next => this.resolveEnrichment(next))
+    );
+  }
+
+  // A queued check answers 202; poll it until the report is ready
+  private resolveCheck(res: HttpResponse<LeakResponse | QueuedCheck>): Observable<LeakResponse> {
+    if (res.status !== 202) {
+      return of(res.body as LeakResponse);
+    }
+    const queued = res.body as QueuedCheck;
+    return timer(Math.max(queued.estimated_wait_ms, 1000)).pipe(
+      switchMap(() => this.http.get<LeakResponse | QueuedCheck>(
+        `${this.API_URL}/breach/checks/${queued.job_id}`,
+        { observe: 'response' }
+      )),
+      switchMap(next => this.resolveCheck(next))
     );
   }
 }
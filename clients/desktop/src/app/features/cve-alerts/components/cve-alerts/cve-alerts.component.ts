@@ -88,12 +88,12 @@ export class CveAlertsComponent {
 
   getCVESeverity(cve: CVEItem): string {
     const metric = cve.cve.metrics?.cvssMetricV31?.[0];
-    return metric?.cvssV3?.baseSeverity || 'UNKNOWN';
+    return metric?.cvssData?.baseSeverity || 'UNKNOWN';
   }
 
   getCVEScore(cve: CVEItem): number {
     const metric = cve.cve.metrics?.cvssMetricV31?.[0];
-    return metric?.cvssV3?.baseScore || 0;
+    return metric?.cvssData?.baseScore || 0;
   }
 
   getSeverityColor(severity: string): string {
@@ -4,7 +4,7 @@ import { Observable } from 'rxjs';
 import { getApiUrl } from '../../../../environments/environment';
 
 export interface CVEMetric {
-  cvssV3: {
+  cvssData: {
     baseScore: number;
     baseSeverity: string;
   };
@@ -35,6 +35,7 @@ export interface CVEResponse {
 export interface SearchCVERequest {
   keyword: string;
   limit?: number;
+  start_index?: number;
 }
 
 @Injectable({
@@ -45,16 +46,16 @@ export class CveService {
 
   constructor(private http: HttpClient) {}
 
-  searchCVEs(keyword: string, limit: number = 20): Observable<CVEResponse> {
+  searchCVEs(keyword: string, limit: number = 20, startIndex: number = 0): Observable<CVEResponse> {
     return this.http.post<CVEResponse>(
       `${this.API_URL}/cve/search`,
-      { keyword, limit }
+      { keyword, limit, start_index: startIndex }
     );
   }
 
-  getLatestCVEs(limit: number = 20): Observable<CVEResponse> {
+  getLatestCVEs(limit: number = 20, startIndex: number = 0): Observable<CVEResponse> {
     return this.http.get<CVEResponse>(
-      `${this.API_URL}/cve/latest?limit=${limit}`
+      `${this.API_URL}/cve/latest?limit=${limit}&start_index=${startIndex}`
     );
   }
 }
@@ -119,8 +119,9 @@ export class VaultListComponent implements OnInit, OnDestroy {
       this.syncSubscription = this.wsService.getSyncEvents().subscribe(async event => {
         console.log('📥 Sync event received:', event.type);
 
-        // Auto-refresh credentials when changes detected
-        if (event.type === 'credentials_changed') {
+        // Auto-refresh credentials when changes detected. resync_recommended
+        // replaces notifications the server could not deliver.
+        if (event.type === 'credentials_changed' || event.type === 'resync_recommended') {
           console.log('🔄 Auto-refreshing credentials due to sync event');
 
           try {
@@ -105,7 +105,7 @@ export class VaultService {
       server,
       account: username,
       password,
-      protocol: 443,
+      protocol: 'https',
       port: 443,
       path,
       label: `${username}@${server}`,
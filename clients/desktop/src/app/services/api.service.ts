@@ -1,6 +1,7 @@
 import { Injectable } from '@angular/core';
 import { HttpClient, HttpHeaders } from '@angular/common/http';
 import { Observable } from 'rxjs';
+import { CredentialProtocol } from '@shared/models';
 
 export interface Credential {
   uuid?: string;
@@ -14,6 +15,10 @@ export interface SyncManifest {
   gencount: number;
   digest: string;
   signer_id: string;
+  updated_at: string | null;
+  last_writer_device_id: string | null;
+  last_writer_device_name: string | null;
+  min_supported_enc_version: number | null;
 }
 
 export interface SyncPullRequest {
@@ -38,15 +43,48 @@ export interface TripleLayerPushRequest {
   keys: CryptoKeyDTO[];
   credential_metadata: CredentialMetadataDTO[];
   sync_records: SyncRecordDTO[];
+  // Numbers this device's pushes from 1 so a flush split over several
+  // requests is applied in order; see PushSequenceMismatch
+  sequence?: number;
+}
+
+export interface TripleLayerPushResponse {
+  gencount: number;
+  synced: number;
+  sequence?: number;
 }
 
 export interface TripleLayerPullResponse {
+  // Always all true here; a layer that was not requested is absent
+  included?: { keys: boolean; credential_metadata: boolean; sync_records: boolean };
   keys: CryptoKeyDTO[];
   credential_metadata: CredentialMetadataDTO[];
   sync_records: SyncRecordDTO[];
   gencount: number;
+  // Set on pulls from last_gencount 0: tombstones were left out, and
+  // gencount is where incremental pulls (which carry them) start
+  tombstones_suppressed?: boolean;
+  // Paged pulls only: send checkpoint back to fetch the next page
+  has_more?: boolean;
+  checkpoint?: string;
+}
+
+export interface ProbeItem {
+  item_uuid: string;
+  state: 'live' | 'tombstoned' | 'unknown';
+  // Absent for unknown items
+  layer?: 'crypto_key' | 'credential_metadata' | 'sync_record';
+  gencount?: number;
 }
 
+export interface ProbeResponse {
+  zone: string;
+  items: ProbeItem[];
+}
+
+// The server takes at most this many UUIDs per probe
+export const MAX_PROBE_ITEMS = 5000;
+
 export interface CryptoKeyDTO {
   item_uuid: string;
   key_class: number;
@@ -64,7 +102,7 @@ export interface CredentialMetadataDTO {
   item_uuid: string;
   server: string;
   account: string;
-  protocol: number;
+  protocol: CredentialProtocol | number; // Older clients sent the port (443)
   port: number;
   path?: string;
   label?: string;
@@ -160,8 +198,8 @@ export class ApiService {
     });
   }
 
-  pushTripleLayerSync(request: TripleLayerPushRequest): Observable<{ gencount: number; synced: number }> {
-    return this.http.post<{ gencount: number; synced: number }>(
+  pushTripleLayerSync(request: TripleLayerPushRequest): Observable<TripleLayerPushResponse> {
+    return this.http.post<TripleLayerPushResponse>(
       `${this.baseUrl}/api/v1/sync/push`,
       request,
       { headers: this.getHeaders() }
@@ -180,6 +218,16 @@ export class ApiService {
     );
   }
 
+  // Asks which of the given item UUIDs the zone still has, without
+  // pulling content. Send at most MAX_PROBE_ITEMS per call.
+  probeSync(zone: string, itemUUIDs: string[]): Observable<ProbeResponse> {
+    return this.http.post<ProbeResponse>(
+      `${this.baseUrl}/api/v1/sync/probe`,
+      { zone, item_uuids: itemUUIDs },
+      { headers: this.getHeaders() }
+    );
+  }
+
   listPeers(): Observable<TrustedPeer[]> {
     return this.http.get<TrustedPeer[]>(`${this.baseUrl}/api/v1/peers`);
   }
@@ -4,13 +4,19 @@
  * Stores credential information but references CryptoKey for actual password
  */
 
+/**
+ * What a credential logs in to. The server sends it by name; rows stored
+ * before it did hold the port instead (443 for https), which it still accepts.
+ */
+export type CredentialProtocol = 'https' | 'http' | 'ssh' | 'ftp' | 'smtp' | 'imap' | 'pop3' | 'ldap';
+
 export interface CredentialMetadata {
   uuid: string;
   
   // Server information
   server: string;
   account: string;
-  protocol: number;
+  protocol: CredentialProtocol | number;
   port: number;
   path?: string;
   
@@ -112,8 +112,8 @@ class _CveAlertsScreenState extends State<CveAlertsScreen> {
     if (cvssMetrics.isEmpty) return 'UNKNOWN';
 
     final metric = cvssMetrics[0] as Map<String, dynamic>;
-    final cvssV3 = metric['cvssV3'] as Map<String, dynamic>?;
-    return cvssV3?['baseSeverity'] ?? 'UNKNOWN';
+    final cvssData = metric['cvssData'] as Map<String, dynamic>?;
+    return cvssData?['baseSeverity'] ?? 'UNKNOWN';
   }
 
   double _getCVEScore(Map<String, dynamic> cve) {
@@ -127,8 +127,8 @@ class _CveAlertsScreenState extends State<CveAlertsScreen> {
     if (cvssMetrics.isEmpty) return 0.0;
 
     final metric = cvssMetrics[0] as Map<String, dynamic>;
-    final cvssV3 = metric['cvssV3'] as Map<String, dynamic>?;
-    return (cvssV3?['baseScore'] as num?)?.toDouble() ?? 0.0;
+    final cvssData = metric['cvssData'] as Map<String, dynamic>?;
+    return (cvssData?['baseScore'] as num?)?.toDouble() ?? 0.0;
   }
 
   Color _getSeverityColor(String severity) {
@@ -45,8 +45,10 @@ class _VaultListScreenState extends State<VaultListScreen> {
       _syncSubscription = _wsService.syncEvents.listen((event) {
         debugPrint('📥 Sync event received: ${event.type}');
 
-        // Auto-refresh credentials when changes detected
-        if (event.type == 'credentials_changed') {
+        // Auto-refresh credentials when changes detected. resync_recommended
+        // replaces notifications the server could not deliver.
+        if (event.type == 'credentials_changed' ||
+            event.type == 'resync_recommended') {
           debugPrint('🔄 Auto-refreshing credentials due to sync event');
           _loadCredentials();
 
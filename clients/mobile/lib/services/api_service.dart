@@ -118,6 +118,43 @@ class ApiService {
     }
   }
 
+  /// The server takes at most this many UUIDs per probe
+  static const int maxProbeItems = 5000;
+
+  /// Ask which of the given item UUIDs the zone still has, without pulling
+  /// content. Each item comes back with its state ("live", "tombstoned" or
+  /// "unknown") and, unless unknown, its layer and gencount. Larger lists
+  /// are sent in batches of [maxProbeItems].
+  static Future<List<Map<String, dynamic>>> probeSync({
+    String zone = 'default',
+    required List<String> itemUUIDs,
+  }) async {
+    final headers = await getAuthHeaders();
+    final items = <Map<String, dynamic>>[];
+
+    for (var start = 0; start < itemUUIDs.length; start += maxProbeItems) {
+      final end = start + maxProbeItems < itemUUIDs.length
+          ? start + maxProbeItems
+          : itemUUIDs.length;
+      final response = await http.post(
+        Uri.parse('$_baseUrl/sync/probe'),
+        headers: headers,
+        body: jsonEncode({
+          'zone': zone,
+          'item_uuids': itemUUIDs.sublist(start, end),
+        }),
+      );
+
+      if (response.statusCode != 200) {
+        final error = jsonDecode(response.body);
+        throw Exception(error['error'] ?? 'Probe failed');
+      }
+      final body = jsonDecode(response.body);
+      items.addAll((body['items'] as List).cast<Map<String, dynamic>>());
+    }
+    return items;
+  }
+
   /// Get sync manifest - Check current server gencount
   static Future<Map<String, dynamic>> getSyncManifest({
     String zone = 'default',
@@ -137,6 +174,34 @@ class ApiService {
     }
   }
 
+  /// Create a zone from a template ("empty" or "standard") and return its
+  /// initial manifest. The standard template needs the client-encrypted
+  /// metadata key in the same request. Throws if the zone already exists.
+  static Future<Map<String, dynamic>> createZone({
+    String zone = 'default',
+    String template = 'empty',
+    Map<String, dynamic>? metadataKey,
+  }) async {
+    final headers = await getAuthHeaders();
+
+    final response = await http.post(
+      Uri.parse('$_baseUrl/sync/zones'),
+      headers: headers,
+      body: jsonEncode({
+        'zone': zone,
+        'template': template,
+        if (metadataKey != null) 'metadata_key': metadataKey,
+      }),
+    );
+
+    if (response.statusCode == 201) {
+      return jsonDecode(response.body);
+    } else {
+      final error = jsonDecode(response.body);
+      throw Exception(error['error'] ?? 'Failed to create zone');
+    }
+  }
+
   /// Delete all credentials from server - Mark all as tombstoned
   static Future<Map<String, dynamic>> deleteAllCredentials({
     String zone = 'default',
@@ -156,13 +221,15 @@ class ApiService {
     }
   }
 
-  /// Check email for breaches using Have I Been Pwned
+  /// Check email for breaches using Have I Been Pwned. All users share
+  /// the server's HIBP quota: a busy server answers 202 with the queued
+  /// check, which is polled until the report is ready.
   static Future<Map<String, dynamic>> checkEmailBreach({
     required String email,
   }) async {
     final headers = await getAuthHeaders();
 
-    final response = await http.post(
+    var response = await http.post(
       Uri.parse('$_baseUrl/breach/check'),
       headers: headers,
       body: jsonEncode({
@@ -170,6 +237,16 @@ class ApiService {
       }),
     );
 
+    while (response.statusCode == 202) {
+      final queued = jsonDecode(response.body);
+      final waitMs = queued['estimated_wait_ms'] as int;
+      await Future.delayed(Duration(milliseconds: waitMs < 1000 ? 1000 : waitMs));
+      response = await http.get(
+        Uri.parse('$_baseUrl/breach/checks/${queued['job_id']}'),
+        headers: headers,
+      );
+    }
+
     if (response.statusCode == 200) {
       return jsonDecode(response.body);
     } else {
@@ -178,26 +255,41 @@ class ApiService {
     }
   }
 
-  /// Enrich breach report with CVE data
+  /// Enrich breach report with CVE data. Enrichment runs in the
+  /// background on the server: its job is polled until the enriched
+  /// report is ready.
   static Future<Map<String, dynamic>> enrichWithCVE({
     required String email,
   }) async {
     final headers = await getAuthHeaders();
 
-    final response = await http.post(
-      Uri.parse('$_baseUrl/breach/enrich-cve'),
+    var response = await http.post(
+      Uri.parse('$_baseUrl/breach/enrich'),
       headers: headers,
       body: jsonEncode({
         'email': email,
       }),
     );
-
-    if (response.statusCode == 200) {
-      return jsonDecode(response.body);
-    } else {
+    if (response.statusCode != 202) {
       final error = jsonDecode(response.body);
       throw Exception(error['error'] ?? 'Failed to enrich with CVE');
     }
+
+    final jobId = jsonDecode(response.body)['job_id'];
+    while (response.statusCode == 202) {
+      await Future.delayed(const Duration(seconds: 1));
+      response = await http.get(
+        Uri.parse('$_baseUrl/breach/enrich/$jobId'),
+        headers: headers,
+      );
+    }
+
+    final job = jsonDecode(response.body);
+    if (response.statusCode == 200 && job['status'] == 'done') {
+      return job['report'];
+    } else {
+      throw Exception(job['error'] ?? 'Failed to enrich with CVE');
+    }
   }
 
   /// Get latest CVEs from NIST
@@ -33,6 +33,10 @@ class SyncEvent {
   }
 }
 
+/// Close codes the server sends when it ends a connection
+const int wsCloseReauthenticate = 4001; // Get a new token, then reconnect
+const int wsCloseRevoked = 4003; // Device or account revoked; don't reconnect
+
 /// WebSocket Service - Handles real-time sync notifications
 class WebSocketService {
   static final String _baseWsUrl = Environment.wsUrl;
@@ -100,7 +104,11 @@ class WebSocketService {
           _handleDisconnect();
         },
         onDone: () {
-          debugPrint('🔌 WebSocket disconnected');
+          final closeCode = _channel?.closeCode;
+          debugPrint('🔌 WebSocket disconnected: code=$closeCode');
+          if (closeCode == wsCloseRevoked) {
+            _currentZone = null; // Nothing to reconnect to
+          }
           _handleDisconnect();
         },
       );
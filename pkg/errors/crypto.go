@@ -0,0 +1,19 @@
+package errors
+
+import "errors"
+
+var (
+	// ErrCiphertextTooShort means the input cannot even hold a nonce and an
+	// authentication tag: truncated or not ciphertext at all
+	ErrCiphertextTooShort = errors.New("ciphertext too short")
+	// ErrCiphertextTooLarge means the input exceeds the size limit and was
+	// rejected without being processed
+	ErrCiphertextTooLarge = errors.New("ciphertext too large")
+	// ErrDecryptionFailed means authentication failed: the wrong key, or
+	// ciphertext that was modified
+	ErrDecryptionFailed = errors.New("decryption failed: wrong key or tampered ciphertext")
+	ErrInvalidKeySize   = errors.New("invalid key size")
+	// ErrUnknownKeyID means a sealed value names a key the keyring no
+	// longer (or never) held
+	ErrUnknownKeyID = errors.New("unknown key id")
+)
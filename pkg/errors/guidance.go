@@ -0,0 +1,232 @@
+package errors
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Resolution tells a client what to do before a failed request can succeed
+type Resolution string
+
+const (
+	ResolutionReauthenticate Resolution = "reauthenticate"
+	ResolutionPullFirst      Resolution = "pull_first"
+	ResolutionReduceBatch    Resolution = "reduce_batch"
+	ResolutionContactSupport Resolution = "contact_support"
+)
+
+// Resolutions lists every defined resolution
+var Resolutions = []Resolution{
+	ResolutionReauthenticate,
+	ResolutionPullFirst,
+	ResolutionReduceBatch,
+	ResolutionContactSupport,
+}
+
+var (
+	ErrRateLimited   = errors.New("rate limit exceeded")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+)
+
+// Guidance is the retry semantics of an error code. Retryable means the same
+// request may succeed if sent again unchanged; Resolution, when set, is what
+// the client must do first otherwise.
+type Guidance struct {
+	Retryable  bool
+	RetryAfter time.Duration // Default wait when the response doesn't give one
+	Resolution Resolution
+}
+
+// Generic codes, used when a response doesn't carry a more specific one
+const (
+	CodeInvalidRequest  = "invalid_request"
+	CodeUnauthorized    = "unauthorized"
+	CodeForbidden       = "forbidden"
+	CodeNotFound        = "not_found"
+	CodeConflict        = "conflict"
+	CodeGenCountStale   = "gencount_stale"
+	CodePayloadTooLarge = "payload_too_large"
+	CodeRateLimited     = "rate_limited"
+	CodeQuotaExceeded   = "quota_exceeded"
+	CodeInternal        = "internal"
+	CodeUnavailable     = "unavailable"
+)
+
+// guidance maps every error code the API returns to its retry semantics
+var guidance = map[string]Guidance{
+	CodeInvalidRequest:  {},
+	CodeUnauthorized:    {Resolution: ResolutionReauthenticate},
+	CodeForbidden:       {},
+	CodeNotFound:        {},
+	CodeConflict:        {Resolution: ResolutionPullFirst},
+	CodeGenCountStale:   {Resolution: ResolutionPullFirst},
+	CodePayloadTooLarge: {Resolution: ResolutionReduceBatch},
+	CodeRateLimited:     {Retryable: true, RetryAfter: time.Second},
+	CodeQuotaExceeded:   {Resolution: ResolutionContactSupport},
+	CodeInternal:        {Retryable: true, RetryAfter: time.Second},
+	CodeUnavailable:     {Retryable: true, RetryAfter: time.Second},
+
+	// Specific codes returned by handlers
+	"invalid_item":              {},
+	"item_rejected":             {},
+	"invalid_setting":           {},
+	"invalid_checkpoint":        {},
+	"invalid_leaf":              {},
+	"invalid_bootstrap":         {},
+	"invalid_last_seq":          {},
+	"invalid_zone":              {},
+	"invalid_message":           {},
+	"unknown_message_type":      {},
+	"checkpoint_stale":          {Resolution: ResolutionPullFirst},
+	"push_sequence_mismatch":    {},
+	"push_conflict":             {Resolution: ResolutionPullFirst},
+	"invalid_conflict_strategy": {},
+	"invalid_resolution":        {},
+	"device_required":           {},
+	"enc_version_unsupported":   {},
+	"zone_exists":               {},
+	"email_exists":              {},
+	"invalid_current_password":  {},
+	"invalid_reset_token":       {},
+	"account_locked":            {Retryable: true, RetryAfter: 15 * time.Minute},
+	"unknown_template":          {},
+	"unknown_region":            {},
+	"too_many_devices":          {},
+	"device_revoked":            {Resolution: ResolutionReauthenticate},
+	"device_pending":            {Retryable: true, RetryAfter: 30 * time.Second},
+	"invalid_trust_level":       {},
+	"invalid_trust_change":      {},
+	"invalid_capabilities":      {},
+	"not_calling_device":        {},
+	"revoked":                   {Resolution: ResolutionReauthenticate},
+	"legal_hold":                {Resolution: ResolutionContactSupport},
+	"no_wipe":                   {},
+	"wipe_expired":              {},
+	"integrity_timeout":         {Resolution: ResolutionContactSupport},
+	"origin_not_allowed":        {},
+	"captcha_required":          {},
+	"captcha_failed":            {},
+	"captcha_unavailable":       {Retryable: true, RetryAfter: 5 * time.Second},
+	"timeout":                   {Retryable: true, RetryAfter: time.Second},
+	"unknown_export_version":    {},
+	"export_digest_mismatch":    {},
+	"account_not_empty":         {},
+	"invalid_prefix":            {},
+	"too_many_emails":           {},
+	"lookup_failed":             {Retryable: true, RetryAfter: time.Minute},
+}
+
+// GuidanceFor returns the guidance of a registered code
+func GuidanceFor(code string) (Guidance, bool) {
+	g, ok := guidance[code]
+	return g, ok
+}
+
+// Codes returns every registered code, sorted
+func Codes() []string {
+	codes := make([]string, 0, len(guidance))
+	for code := range guidance {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// StatusCode returns the generic code of an HTTP error status
+func StatusCode(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodePayloadTooLarge
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return CodeUnavailable
+	}
+	if status >= http.StatusInternalServerError {
+		return CodeInternal
+	}
+	return CodeInvalidRequest
+}
+
+// CodeFor returns the code of a known error, or "" for any other error
+func CodeFor(err error) string {
+	var appErr *AppError
+	if errors.As(err, &appErr) && appErr.Code != "" {
+		return appErr.Code
+	}
+	switch {
+	case errors.Is(err, ErrGenCountStale):
+		return CodeGenCountStale
+	case errors.Is(err, ErrSyncConflict), errors.Is(err, ErrDigestMismatch), errors.Is(err, ErrConflict):
+		return CodeConflict
+	case errors.Is(err, ErrRateLimited):
+		return CodeRateLimited
+	case errors.Is(err, ErrQuotaExceeded):
+		return CodeQuotaExceeded
+	case errors.Is(err, ErrCiphertextTooLarge):
+		return CodePayloadTooLarge
+	case errors.Is(err, ErrInvalidToken), errors.Is(err, ErrTokenExpired),
+		errors.Is(err, ErrUnauthorized), errors.Is(err, ErrInvalidCredentials):
+		return CodeUnauthorized
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrUserNotFound):
+		return CodeNotFound
+	case errors.Is(err, ErrInternal):
+		return CodeInternal
+	}
+	return ""
+}
+
+// APIError is the error envelope of every failed API response
+type APIError struct {
+	Status       int        `json:"-"`
+	Message      string     `json:"error"`
+	Code         string     `json:"code"`
+	Retryable    bool       `json:"retryable"`
+	RetryAfterMS int64      `json:"retry_after_ms,omitempty"`
+	Resolution   Resolution `json:"resolution,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// RetryAfter is how long to wait before retrying, zero if the server didn't
+// say
+func (e *APIError) RetryAfter() time.Duration {
+	return time.Duration(e.RetryAfterMS) * time.Millisecond
+}
+
+// ReadAPIError decodes the error envelope of a failed response. Responses
+// from servers predating the envelope get the guidance of their status.
+func ReadAPIError(resp *http.Response) *APIError {
+	apiErr := &APIError{Status: resp.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if json.Unmarshal(body, apiErr) != nil || apiErr.Code == "" {
+		apiErr.Code = StatusCode(resp.StatusCode)
+		g, _ := GuidanceFor(apiErr.Code)
+		apiErr.Retryable, apiErr.Resolution = g.Retryable, g.Resolution
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	if apiErr.RetryAfterMS == 0 {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			apiErr.RetryAfterMS = int64(seconds) * 1000
+		}
+	}
+	return apiErr
+}
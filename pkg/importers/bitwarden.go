@@ -0,0 +1,147 @@
+package importers
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// Bitwarden item types; only logins are imported
+const (
+	bitwardenTypeLogin = 1
+	bitwardenCSVLogin  = "login"
+)
+
+// parseBitwardenCSV reads Bitwarden's CSV export:
+// folder,favorite,type,name,notes,fields,reprompt,login_uri,login_username,login_password,login_totp
+// Organization exports have a collections column in place of folder.
+func parseBitwardenCSV(r io.Reader) (*Result, error) {
+	table, err := readCSV(FormatBitwardenCSV, r,
+		"type", "name", "login_uri", "login_username", "login_password")
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{}
+	err = table.each(res, func(row csvRow) {
+		name := row.get("name")
+		if itemType := row.get("type"); itemType != bitwardenCSVLogin {
+			res.skip(row.line, name, "unsupported item type "+itemType)
+			return
+		}
+
+		collection := row.get("folder")
+		if collection == "" {
+			// Items in several collections are imported into the first
+			collection, _, _ = strings.Cut(row.get("collections"), ",")
+		}
+
+		res.add(row.line, PlainCredential{
+			Name:       name,
+			URIs:       strings.Split(row.get("login_uri"), ","),
+			Username:   row.get("login_username"),
+			Password:   row.get("login_password"),
+			TOTP:       row.get("login_totp"),
+			Notes:      row.get("notes"),
+			Collection: collection,
+			Favorite:   parseBool(row.get("favorite")),
+			Fields:     parseBitwardenCSVFields(row.get("fields")),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// parseBitwardenCSVFields reads the fields column, one "name: value" per line
+func parseBitwardenCSVFields(value string) []Field {
+	var fields []Field
+	for _, line := range strings.Split(value, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(line, ":")
+		fields = append(fields, Field{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)})
+	}
+	return fields
+}
+
+type bitwardenExport struct {
+	Encrypted   bool              `json:"encrypted"`
+	Folders     []bitwardenFolder `json:"folders"`
+	Collections []bitwardenFolder `json:"collections"`
+	Items       []bitwardenItem   `json:"items"`
+}
+
+type bitwardenFolder struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type bitwardenItem struct {
+	Type          int      `json:"type"`
+	Name          string   `json:"name"`
+	Notes         string   `json:"notes"`
+	Favorite      bool     `json:"favorite"`
+	FolderID      string   `json:"folderId"`
+	CollectionIDs []string `json:"collectionIds"`
+	Login         *struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		TOTP     string `json:"totp"`
+		URIs     []struct {
+			URI string `json:"uri"`
+		} `json:"uris"`
+	} `json:"login"`
+	Fields []Field `json:"fields"`
+}
+
+// parseBitwardenJSON reads Bitwarden's unencrypted JSON export, personal or
+// organization
+func parseBitwardenJSON(r io.Reader) (*Result, error) {
+	var export bitwardenExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, &FormatError{Format: FormatBitwardenJSON, Reason: "invalid JSON: " + err.Error()}
+	}
+	if export.Encrypted {
+		return nil, ErrEncryptedExport
+	}
+
+	names := make(map[string]string, len(export.Folders)+len(export.Collections))
+	for _, folder := range append(export.Folders, export.Collections...) {
+		names[folder.ID] = folder.Name
+	}
+
+	res := &Result{}
+	for i, item := range export.Items {
+		entry := i + 1
+		if item.Type != bitwardenTypeLogin || item.Login == nil {
+			res.skip(entry, item.Name, "not a login item")
+			continue
+		}
+
+		collection := names[item.FolderID]
+		if collection == "" && len(item.CollectionIDs) > 0 {
+			collection = names[item.CollectionIDs[0]]
+		}
+
+		uris := make([]string, 0, len(item.Login.URIs))
+		for _, uri := range item.Login.URIs {
+			uris = append(uris, uri.URI)
+		}
+
+		res.add(entry, PlainCredential{
+			Name:       item.Name,
+			URIs:       uris,
+			Username:   item.Login.Username,
+			Password:   item.Login.Password,
+			TOTP:       item.Login.TOTP,
+			Notes:      item.Notes,
+			Collection: collection,
+			Favorite:   item.Favorite,
+			Fields:     item.Fields,
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,27 @@
+package importers
+
+import "io"
+
+// parseChromeCSV reads the CSV Chrome and other Chromium browsers export:
+// name,url,username,password[,note]
+func parseChromeCSV(r io.Reader) (*Result, error) {
+	table, err := readCSV(FormatChromeCSV, r, "url", "username", "password")
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{}
+	err = table.each(res, func(row csvRow) {
+		res.add(row.line, PlainCredential{
+			Name:     row.get("name"),
+			URIs:     []string{row.get("url")},
+			Username: row.get("username"),
+			Password: row.get("password"),
+			Notes:    row.get("note"),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,93 @@
+package importers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// csvTable is a CSV export with its header resolved to column indexes
+type csvTable struct {
+	format  string
+	columns map[string]int
+	width   int // Number of header fields
+	reader  *csv.Reader
+}
+
+// readCSV reads the header and checks the required columns are present.
+// Header names are matched case-insensitively.
+func readCSV(format string, r io.Reader, required ...string) (*csvTable, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1 // Ragged rows are skipped per row, not fatal
+	reader.LazyQuotes = true    // Exports are not always strict about quoting
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, &FormatError{Format: format, Reason: "file is empty"}
+	}
+	if err != nil {
+		return nil, &FormatError{Format: format, Reason: err.Error()}
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		if i == 0 {
+			name = strings.TrimPrefix(name, "\ufeff") // UTF-8 byte order mark
+		}
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range required {
+		if _, ok := columns[name]; !ok {
+			return nil, &FormatError{Format: format, Line: 1, Reason: fmt.Sprintf("missing column %q", name)}
+		}
+	}
+
+	return &csvTable{format: format, columns: columns, width: len(header), reader: reader}, nil
+}
+
+// csvRow is one data row of a csvTable
+type csvRow struct {
+	table  *csvTable
+	line   int
+	values []string
+}
+
+// each calls fn for every data row. Rows with fewer fields than the header
+// are reported as skipped; a CSV syntax error ends the file.
+func (t *csvTable) each(res *Result, fn func(row csvRow)) error {
+	for {
+		values, err := t.reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		line, _ := t.reader.FieldPos(0)
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				line = parseErr.Line
+			}
+			return &FormatError{Format: t.format, Line: line, Reason: err.Error()}
+		}
+
+		if len(values) == 1 && strings.TrimSpace(values[0]) == "" {
+			continue // Blank line
+		}
+		if len(values) < t.width {
+			res.skip(line, "", fmt.Sprintf("expected %d columns, found %d", t.width, len(values)))
+			continue
+		}
+		fn(csvRow{table: t, line: line, values: values})
+	}
+}
+
+// get returns the first of the named columns present in the header, or ""
+func (row csvRow) get(names ...string) string {
+	for _, name := range names {
+		if i, ok := row.table.columns[name]; ok {
+			return row.values[i]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,74 @@
+package importers
+
+import (
+	"encoding/json"
+
+	"github.com/google/uuid"
+)
+
+// Sync record settings for imported items
+const (
+	RecordEncVersion = 1
+	RecordContextID  = "default"
+)
+
+// Encryptor seals one item under a fresh content key and returns the
+// wrapped key and the ciphertext. LayeredCrypto implements it.
+type Encryptor interface {
+	EncryptCredential(data []byte) (wrappedKey, encItem []byte, err error)
+}
+
+// EncryptedRecord is a sync record in the /sync/push wire format
+type EncryptedRecord struct {
+	ItemUUID   string `json:"item_uuid"`
+	WrappedKey []byte `json:"wrapped_key"`
+	EncItem    []byte `json:"enc_item"`
+	EncVersion int    `json:"enc_version"`
+	ContextID  string `json:"context_id"`
+}
+
+// PushRequest is the body of POST /sync/push for an import. It carries sync
+// records only: the server gets no plaintext metadata for imported items.
+type PushRequest struct {
+	Zone        string             `json:"zone"`
+	SyncRecords []*EncryptedRecord `json:"sync_records"`
+}
+
+// Encrypt seals each credential, as JSON, into its own sync record
+func Encrypt(enc Encryptor, creds []PlainCredential) ([]*EncryptedRecord, error) {
+	records := make([]*EncryptedRecord, 0, len(creds))
+	for i := range creds {
+		plaintext, err := json.Marshal(&creds[i])
+		if err != nil {
+			return nil, err
+		}
+
+		wrappedKey, encItem, err := enc.EncryptCredential(plaintext)
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, &EncryptedRecord{
+			ItemUUID:   uuid.New().String(),
+			WrappedKey: wrappedKey,
+			EncItem:    encItem,
+			EncVersion: RecordEncVersion,
+			ContextID:  RecordContextID,
+		})
+	}
+	return records, nil
+}
+
+// Batches splits records into push requests of at most size records each,
+// so a large import does not become one huge request
+func Batches(zone string, records []*EncryptedRecord, size int) []*PushRequest {
+	if size <= 0 {
+		size = len(records)
+	}
+	var batches []*PushRequest
+	for start := 0; start < len(records); start += size {
+		end := min(start+size, len(records))
+		batches = append(batches, &PushRequest{Zone: zone, SyncRecords: records[start:end]})
+	}
+	return batches
+}
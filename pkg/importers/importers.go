@@ -0,0 +1,152 @@
+// Package importers converts other password managers' export files into
+// PlainCredential values. Exports are plaintext, so parsing and encryption
+// both happen on the importing machine: Encrypt turns credentials into sync
+// records, and only those encrypted records are pushed to the server.
+package importers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Supported export formats
+const (
+	FormatBitwardenCSV    = "bitwarden-csv"
+	FormatBitwardenJSON   = "bitwarden-json"
+	FormatOnePasswordCSV  = "1password-csv"
+	FormatOnePassword1PUX = "1password-1pux"
+	FormatLastPassCSV     = "lastpass-csv"
+	FormatChromeCSV       = "chrome-csv"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown import format")
+	// ErrEncryptedExport is returned for password-protected exports, which
+	// have to be re-exported unencrypted first
+	ErrEncryptedExport = errors.New("export is encrypted; export it again without a password")
+)
+
+// Field is a custom field carried over from the source item
+type Field struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// PlainCredential is one imported login, independent of the source format.
+// It is also the plaintext that Encrypt seals into a sync record.
+type PlainCredential struct {
+	Name       string   `json:"name"`
+	URIs       []string `json:"uris,omitempty"`
+	Username   string   `json:"username,omitempty"`
+	Password   string   `json:"password,omitempty"`
+	TOTP       string   `json:"totp,omitempty"` // Seed or otpauth:// URI, as exported
+	Notes      string   `json:"notes,omitempty"`
+	Collection string   `json:"collection,omitempty"` // Source folder, grouping or vault
+	Favorite   bool     `json:"favorite,omitempty"`
+	Fields     []Field  `json:"fields,omitempty"`
+}
+
+// Skipped records an entry that was left out of the import
+type Skipped struct {
+	Entry  int    `json:"entry"` // CSV line, or 1-based item index for JSON
+	Name   string `json:"name,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// Result is everything a parser recovered from one export. Entries that
+// cannot be imported are reported in Skipped rather than failing the file.
+type Result struct {
+	Credentials []PlainCredential `json:"credentials"`
+	Skipped     []Skipped         `json:"skipped,omitempty"`
+}
+
+// FormatError means the file as a whole does not match its format: a
+// missing header column, invalid JSON, unreadable CSV
+type FormatError struct {
+	Format string
+	Line   int // 0 when unknown
+	Reason string
+}
+
+func (e *FormatError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s: line %d: %s", e.Format, e.Line, e.Reason)
+	}
+	return fmt.Sprintf("%s: %s", e.Format, e.Reason)
+}
+
+type parser func(r io.Reader) (*Result, error)
+
+var parsers = map[string]parser{
+	FormatBitwardenCSV:    parseBitwardenCSV,
+	FormatBitwardenJSON:   parseBitwardenJSON,
+	FormatOnePasswordCSV:  parseOnePasswordCSV,
+	FormatOnePassword1PUX: parseOnePassword1PUX,
+	FormatLastPassCSV:     parseLastPassCSV,
+	FormatChromeCSV:       parseChromeCSV,
+}
+
+// Formats lists the supported format names
+func Formats() []string {
+	names := make([]string, 0, len(parsers))
+	for name := range parsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse reads an export in the given format
+func Parse(format string, r io.Reader) (*Result, error) {
+	parse, ok := parsers[format]
+	if !ok {
+		return nil, fmt.Errorf("%w %q (supported: %s)", ErrUnknownFormat, format, strings.Join(Formats(), ", "))
+	}
+	return parse(r)
+}
+
+// add normalizes a parsed credential and keeps it, or records why not
+func (res *Result) add(entry int, cred PlainCredential) {
+	cred.Name = strings.TrimSpace(cred.Name)
+	cred.Username = strings.TrimSpace(cred.Username)
+	cred.TOTP = strings.TrimSpace(cred.TOTP)
+	cred.Collection = strings.TrimSpace(cred.Collection)
+
+	uris := cred.URIs[:0]
+	for _, uri := range cred.URIs {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	cred.URIs = uris
+	if len(cred.URIs) == 0 {
+		cred.URIs = nil
+	}
+
+	// Passwords are kept byte for byte; surrounding spaces can be real
+	if cred.Username == "" && cred.Password == "" && cred.TOTP == "" {
+		res.skip(entry, cred.Name, "no username, password or TOTP")
+		return
+	}
+	if cred.Name == "" && len(cred.URIs) > 0 {
+		cred.Name = cred.URIs[0]
+	}
+
+	res.Credentials = append(res.Credentials, cred)
+}
+
+func (res *Result) skip(entry int, name, reason string) {
+	res.Skipped = append(res.Skipped, Skipped{Entry: entry, Name: name, Reason: reason})
+}
+
+// parseBool accepts the spellings exports use for flags
+func parseBool(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes", "y":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package importers
+
+import (
+	"html"
+	"io"
+)
+
+// LastPass exports secure notes as rows with this placeholder URL
+const lastPassSecureNoteURL = "http://sn"
+
+// parseLastPassCSV reads LastPass's CSV export:
+// url,username,password,totp,extra,name,grouping,fav
+// Values may be HTML-escaped ("Q&amp;A"), and grouping is the folder path.
+func parseLastPassCSV(r io.Reader) (*Result, error) {
+	table, err := readCSV(FormatLastPassCSV, r, "url", "username", "password", "name")
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{}
+	err = table.each(res, func(row csvRow) {
+		get := func(name string) string { return html.UnescapeString(row.get(name)) }
+
+		name := get("name")
+		url := get("url")
+		if url == lastPassSecureNoteURL {
+			res.skip(row.line, name, "secure notes are not imported")
+			return
+		}
+
+		res.add(row.line, PlainCredential{
+			Name:       name,
+			URIs:       []string{url},
+			Username:   get("username"),
+			Password:   get("password"),
+			TOTP:       get("totp"),
+			Notes:      get("extra"),
+			Collection: get("grouping"),
+			Favorite:   parseBool(get("fav")),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
@@ -0,0 +1,165 @@
+package importers
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// 1Password item categories that hold a login
+const (
+	onePasswordCategoryLogin    = "001"
+	onePasswordCategoryPassword = "005"
+)
+
+// parseOnePasswordCSV reads 1Password's CSV export. 1Password 7 writes
+// Title,Website,Username,Password,Notes,Type and 1Password 8 writes
+// Title,Url,Username,Password,OTPAuth,Favorite,Archived,Tags,Notes; both
+// are accepted.
+func parseOnePasswordCSV(r io.Reader) (*Result, error) {
+	table, err := readCSV(FormatOnePasswordCSV, r, "title", "username", "password")
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Result{}
+	err = table.each(res, func(row csvRow) {
+		title := row.get("title")
+		switch itemType := strings.ToLower(row.get("type")); itemType {
+		case "", "login", "password":
+		default:
+			res.skip(row.line, title, "unsupported item type "+row.get("type"))
+			return
+		}
+		if parseBool(row.get("archived")) {
+			res.skip(row.line, title, "archived")
+			return
+		}
+
+		res.add(row.line, PlainCredential{
+			Name:       title,
+			URIs:       strings.Split(row.get("url", "website", "urls"), ","),
+			Username:   row.get("username"),
+			Password:   row.get("password"),
+			TOTP:       row.get("otpauth"),
+			Notes:      row.get("notes", "notesplain"),
+			Collection: row.get("vault"),
+			Favorite:   parseBool(row.get("favorite")),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+type onePUXExport struct {
+	Accounts []struct {
+		Vaults []struct {
+			Attrs struct {
+				Name string `json:"name"`
+			} `json:"attrs"`
+			Items []onePUXItem `json:"items"`
+		} `json:"vaults"`
+	} `json:"accounts"`
+}
+
+type onePUXItem struct {
+	CategoryUUID string `json:"categoryUuid"`
+	FavIndex     int    `json:"favIndex"`
+	State        string `json:"state"`
+	Overview     struct {
+		Title string `json:"title"`
+		URL   string `json:"url"`
+		URLs  []struct {
+			URL string `json:"url"`
+		} `json:"urls"`
+	} `json:"overview"`
+	Details struct {
+		LoginFields []struct {
+			Value       string `json:"value"`
+			Designation string `json:"designation"`
+		} `json:"loginFields"`
+		NotesPlain string `json:"notesPlain"`
+		Password   string `json:"password"` // Password category items
+		Sections   []struct {
+			Fields []struct {
+				Title string `json:"title"`
+				// Keyed by field kind: {"totp": "..."}, {"string": "..."}, ...
+				Value map[string]json.RawMessage `json:"value"`
+			} `json:"fields"`
+		} `json:"sections"`
+	} `json:"details"`
+}
+
+// parseOnePassword1PUX reads export.data from a 1Password .1pux archive.
+// Every vault becomes a collection.
+func parseOnePassword1PUX(r io.Reader) (*Result, error) {
+	var export onePUXExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, &FormatError{Format: FormatOnePassword1PUX, Reason: "invalid JSON: " + err.Error()}
+	}
+
+	res := &Result{}
+	entry := 0
+	for _, account := range export.Accounts {
+		for _, vault := range account.Vaults {
+			for _, item := range vault.Items {
+				entry++
+				res.addOnePUXItem(entry, vault.Attrs.Name, &item)
+			}
+		}
+	}
+	return res, nil
+}
+
+func (res *Result) addOnePUXItem(entry int, vault string, item *onePUXItem) {
+	title := item.Overview.Title
+	if item.CategoryUUID != onePasswordCategoryLogin && item.CategoryUUID != onePasswordCategoryPassword {
+		res.skip(entry, title, "unsupported category "+item.CategoryUUID)
+		return
+	}
+	if item.State == "archived" {
+		res.skip(entry, title, "archived")
+		return
+	}
+
+	cred := PlainCredential{
+		Name:       title,
+		URIs:       []string{item.Overview.URL},
+		Password:   item.Details.Password,
+		Notes:      item.Details.NotesPlain,
+		Collection: vault,
+		Favorite:   item.FavIndex > 0,
+	}
+	for _, url := range item.Overview.URLs {
+		if url.URL != item.Overview.URL {
+			cred.URIs = append(cred.URIs, url.URL)
+		}
+	}
+	for _, field := range item.Details.LoginFields {
+		switch field.Designation {
+		case "username":
+			cred.Username = field.Value
+		case "password":
+			cred.Password = field.Value
+		}
+	}
+	for _, section := range item.Details.Sections {
+		for _, field := range section.Fields {
+			for kind, raw := range field.Value {
+				var value string
+				if json.Unmarshal(raw, &value) != nil {
+					continue // Structured values (addresses, dates) are not carried over
+				}
+				if kind == "totp" {
+					cred.TOTP = value
+				} else {
+					cred.Fields = append(cred.Fields, Field{Name: field.Title, Value: value})
+				}
+			}
+		}
+	}
+
+	res.add(entry, cred)
+}
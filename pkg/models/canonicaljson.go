@@ -0,0 +1,217 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Canonical JSON
+//
+// Signatures are computed over a byte-exact encoding of a value so that
+// clients in any language can reproduce it. The canonical form is:
+//
+//   - No insignificant whitespace.
+//   - Object keys sorted by the bytes of their UTF-8 encoding; duplicate keys
+//     are an error.
+//   - Numbers are integers only, written in base 10 with no leading zeros,
+//     no "+", no exponent, and "-" only for negative values ("-0" is "0").
+//     Any fraction or exponent is an error, even if integral ("1.0", "1e3").
+//   - Strings are UTF-8 (invalid UTF-8 is an error). Only '"' and '\' are
+//     escaped with a backslash, the control characters U+0008, U+0009,
+//     U+000A, U+000C and U+000D use \b \t \n \f \r, and other characters
+//     below U+0020 use \u00XX with lowercase hex. Everything else, including
+//     '<', '>', '&', U+2028 and U+2029, is written literally.
+//   - []byte fields are standard base64 with padding (RFC 4648 section 4),
+//     which is what encoding/json already produces.
+//   - true, false and null as literals.
+
+var (
+	ErrNotCanonical     = errors.New("canonicaljson: input is not in canonical form")
+	ErrNonIntegerNumber = errors.New("canonicaljson: numbers must be integers")
+	ErrDuplicateKey     = errors.New("canonicaljson: duplicate object key")
+	ErrInvalidUTF8      = errors.New("canonicaljson: invalid UTF-8 in string")
+)
+
+// MarshalCanonical encodes v (anything encoding/json accepts) canonically
+func MarshalCanonical(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return Canonicalize(data)
+}
+
+// Canonicalize re-encodes arbitrary JSON in canonical form
+func Canonicalize(data []byte) ([]byte, error) {
+	if !utf8.Valid(data) {
+		return nil, ErrInvalidUTF8
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var buf bytes.Buffer
+	if err := canonicalValue(dec, &buf); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("canonicaljson: trailing data after JSON value")
+	}
+	return buf.Bytes(), nil
+}
+
+// VerifyCanonical returns ErrNotCanonical unless data is already exactly in
+// canonical form, e.g. the signed bytes received from a client.
+func VerifyCanonical(data []byte) error {
+	canonical, err := Canonicalize(data)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(canonical, data) {
+		return ErrNotCanonical
+	}
+	return nil
+}
+
+func canonicalValue(dec *json.Decoder, buf *bytes.Buffer) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch t := token.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			return canonicalObject(dec, buf)
+		case '[':
+			return canonicalArray(dec, buf)
+		}
+		return fmt.Errorf("canonicaljson: unexpected %q", t)
+	case string:
+		return writeCanonicalString(buf, t)
+	case json.Number:
+		return writeCanonicalNumber(buf, t)
+	case bool:
+		buf.WriteString(strconv.FormatBool(t))
+	case nil:
+		buf.WriteString("null")
+	}
+	return nil
+}
+
+func canonicalObject(dec *json.Decoder, buf *bytes.Buffer) error {
+	members := make(map[string][]byte)
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key := token.(string)
+		if _, dup := members[key]; dup {
+			return fmt.Errorf("%w: %q", ErrDuplicateKey, key)
+		}
+
+		var value bytes.Buffer
+		if err := canonicalValue(dec, &value); err != nil {
+			return err
+		}
+		members[key] = value.Bytes()
+	}
+	if _, err := dec.Token(); err != nil { // '}'
+		return err
+	}
+
+	keys := make([]string, 0, len(members))
+	for key := range members {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // byte-wise on UTF-8
+
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := writeCanonicalString(buf, key); err != nil {
+			return err
+		}
+		buf.WriteByte(':')
+		buf.Write(members[key])
+	}
+	buf.WriteByte('}')
+	return nil
+}
+
+func canonicalArray(dec *json.Decoder, buf *bytes.Buffer) error {
+	buf.WriteByte('[')
+	for i := 0; dec.More(); i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if err := canonicalValue(dec, buf); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil { // ']'
+		return err
+	}
+	buf.WriteByte(']')
+	return nil
+}
+
+func writeCanonicalNumber(buf *bytes.Buffer, n json.Number) error {
+	// Arbitrary-size integers are allowed; the digits are kept as written
+	// apart from normalizing "-0".
+	value, ok := new(big.Int).SetString(n.String(), 10)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNonIntegerNumber, n)
+	}
+	buf.WriteString(value.String())
+	return nil
+}
+
+func writeCanonicalString(buf *bytes.Buffer, s string) error {
+	if !utf8.ValidString(s) {
+		return ErrInvalidUTF8
+	}
+
+	const hex = "0123456789abcdef"
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\r':
+			buf.WriteString(`\r`)
+		default:
+			if c < 0x20 {
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hex[c>>4])
+				buf.WriteByte(hex[c&0xf])
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return nil
+}
@@ -75,7 +75,7 @@ type CredentialMetadata struct {
 	Zone            string     `db:"zone" json:"zone"`
 	Server          string     `db:"server" json:"server"`
 	Account         string     `db:"account" json:"account"`
-	Protocol        int        `db:"protocol" json:"protocol"`
+	Protocol        Protocol   `db:"protocol" json:"protocol"`
 	Port            int        `db:"port" json:"port"`
 	Path            *string    `db:"path" json:"path,omitempty"`
 	Label           *string    `db:"label" json:"label,omitempty"`
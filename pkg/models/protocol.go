@@ -0,0 +1,109 @@
+package models
+
+import "fmt"
+
+// Protocol is what a credential logs in to, like Apple's kSecAttrProtocol.
+// It is stored as a small integer; the wire format is its name. It is not a
+// port: a credential's port is separate and defaults to the protocol's.
+type Protocol int
+
+const (
+	ProtocolUnspecified Protocol = 0
+	ProtocolHTTPS       Protocol = 1
+	ProtocolHTTP        Protocol = 2
+	ProtocolSSH         Protocol = 3
+	ProtocolFTP         Protocol = 4
+	ProtocolSMTP        Protocol = 5
+	ProtocolIMAP        Protocol = 6
+	ProtocolPOP3        Protocol = 7
+	ProtocolLDAP        Protocol = 8
+)
+
+var protocolNames = map[Protocol]string{
+	ProtocolHTTPS: "https",
+	ProtocolHTTP:  "http",
+	ProtocolSSH:   "ssh",
+	ProtocolFTP:   "ftp",
+	ProtocolSMTP:  "smtp",
+	ProtocolIMAP:  "imap",
+	ProtocolPOP3:  "pop3",
+	ProtocolLDAP:  "ldap",
+}
+
+var protocolPorts = map[Protocol]int{
+	ProtocolHTTPS: 443,
+	ProtocolHTTP:  80,
+	ProtocolSSH:   22,
+	ProtocolFTP:   21,
+	ProtocolSMTP:  587,
+	ProtocolIMAP:  993,
+	ProtocolPOP3:  995,
+	ProtocolLDAP:  389,
+}
+
+// legacyProtocols maps the ports clients sent as the protocol, before it
+// was an enum, to the protocol they stood for
+var legacyProtocols = map[int]Protocol{
+	443: ProtocolHTTPS,
+	80:  ProtocolHTTP,
+	22:  ProtocolSSH,
+	21:  ProtocolFTP,
+	25:  ProtocolSMTP,
+	465: ProtocolSMTP,
+	587: ProtocolSMTP,
+	143: ProtocolIMAP,
+	993: ProtocolIMAP,
+	110: ProtocolPOP3,
+	995: ProtocolPOP3,
+	389: ProtocolLDAP,
+	636: ProtocolLDAP,
+}
+
+// Valid reports whether p is a known protocol or unspecified
+func (p Protocol) Valid() bool {
+	_, ok := protocolNames[p]
+	return ok || p == ProtocolUnspecified
+}
+
+// String is the protocol's wire name; "" when unspecified
+func (p Protocol) String() string {
+	if name, ok := protocolNames[p]; ok {
+		return name
+	}
+	if p == ProtocolUnspecified {
+		return ""
+	}
+	return fmt.Sprintf("Protocol(%d)", int(p))
+}
+
+// DefaultPort is the port the protocol usually listens on; 0 when
+// unspecified
+func (p Protocol) DefaultPort() int {
+	return protocolPorts[p]
+}
+
+// LegacyNumber is what clients sent as p before it was an enum: its usual
+// port (443 for https), or p itself when it is not a known protocol
+func (p Protocol) LegacyNumber() int {
+	if port, ok := protocolPorts[p]; ok {
+		return port
+	}
+	return int(p)
+}
+
+// ParseProtocol returns the protocol named name, as String gives it
+func ParseProtocol(name string) (Protocol, error) {
+	for p, n := range protocolNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return ProtocolUnspecified, fmt.Errorf("unknown protocol %q", name)
+}
+
+// LegacyProtocol returns the protocol an older client meant by sending the
+// port number as the protocol, e.g. 443 for https
+func LegacyProtocol(port int) (Protocol, bool) {
+	p, ok := legacyProtocols[port]
+	return p, ok
+}
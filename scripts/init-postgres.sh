@@ -15,9 +15,9 @@ echo "Creating database..."
 psql -h $DB_HOST -p $DB_PORT -U $DB_USER -tc "SELECT 1 FROM pg_database WHERE datname = '$DB_NAME'" | grep -q 1 || \
   psql -h $DB_HOST -p $DB_PORT -U $DB_USER -c "CREATE DATABASE $DB_NAME"
 
-# Run schema
-echo "Running schema..."
-psql -h $DB_HOST -p $DB_PORT -U $DB_USER -d $DB_NAME -f internal/storage/postgres_schema.sql
+# Apply migrations
+echo "Running migrations..."
+go run ./server/cmd migrate -postgres="postgres://$DB_USER@$DB_HOST:$DB_PORT/$DB_NAME?sslmode=disable"
 
 echo "✅ Database initialized!"
 echo ""
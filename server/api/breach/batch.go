@@ -0,0 +1,176 @@
+package breach
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// BatchConfig bounds a batch breach check
+type BatchConfig struct {
+	MaxEmails int // Addresses one request may check
+	Workers   int // Addresses looked up at once
+}
+
+// DefaultBatchConfig fits a batch in one user's share of the scheduler's
+// queue (MaxQueuedPerUser)
+var DefaultBatchConfig = BatchConfig{
+	MaxEmails: 10,
+	Workers:   4,
+}
+
+var batchConfig = DefaultBatchConfig
+
+// SetBatchConfig sizes batch checks; zero fields keep their default
+func SetBatchConfig(cfg BatchConfig) {
+	if cfg.MaxEmails <= 0 {
+		cfg.MaxEmails = DefaultBatchConfig.MaxEmails
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultBatchConfig.Workers
+	}
+	batchConfig = cfg
+}
+
+type CheckBatchRequest struct {
+	Emails []string `json:"emails" binding:"required,min=1,dive,required,email"`
+}
+
+// BatchQueued is an address whose lookup is still queued when the batch
+// answers; it is polled like a single check
+type BatchQueued struct {
+	JobID   string `json:"job_id"`
+	PollURL string `json:"poll_url"`
+}
+
+// BatchError is an address whose lookup failed
+type BatchError struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// CheckBatchResponse holds every address of the batch, normalized, in
+// exactly one of its maps
+type CheckBatchResponse struct {
+	Results map[string]*LeakResponse `json:"results"`
+	Queued  map[string]BatchQueued   `json:"queued"`
+	Errors  map[string]BatchError    `json:"errors"`
+}
+
+// CheckBatch checks several addresses in one request, e.g. every member of
+// a family account. Each address is served from the cache or queued on the
+// scheduler like a single check, so the batch shares the HIBP rate with
+// everyone else; a few workers look the addresses up at once. The request
+// answers 200 once every address has a report or the scheduler's
+// InteractiveWait has passed: lookups still queued are listed with a job to
+// poll, and failed ones with their error, without failing the others.
+func CheckBatch(c *gin.Context) {
+	var req CheckBatchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	emails := make([]string, 0, len(req.Emails))
+	seen := make(map[string]bool, len(req.Emails))
+	for _, email := range req.Emails {
+		if email = NormalizeEmail(email); !seen[email] {
+			seen[email] = true
+			emails = append(emails, email)
+		}
+	}
+	if len(emails) > batchConfig.MaxEmails {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("a batch checks at most %d addresses", batchConfig.MaxEmails),
+			"code":  "too_many_emails",
+			"max":   batchConfig.MaxEmails,
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	if scheduler != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, scheduler.Config().InteractiveWait)
+		defer cancel()
+	}
+	userID := middleware.MustUserID(c)
+
+	resp := CheckBatchResponse{
+		Results: make(map[string]*LeakResponse),
+		Queued:  make(map[string]BatchQueued),
+		Errors:  make(map[string]BatchError),
+	}
+	var mu sync.Mutex
+	pending := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < min(batchConfig.Workers, len(emails)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for email := range pending {
+				report, job, err := batchLookup(ctx, userID, email)
+				mu.Lock()
+				switch {
+				case err != nil:
+					resp.Errors[email] = batchError(err)
+				case job != nil:
+					resp.Queued[email] = BatchQueued{JobID: job.ID, PollURL: "/api/v1/breach/checks/" + job.ID}
+				default:
+					resp.Results[email] = report
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, email := range emails {
+		pending <- email
+	}
+	close(pending)
+	wg.Wait()
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// batchLookup returns email's report from the cache or the scheduler. A
+// lookup still queued when ctx is done comes back as its job.
+func batchLookup(ctx context.Context, userID, email string) (*LeakResponse, *Job, error) {
+	cachedData, err := GetCachedBreachReport(email)
+	if err != nil {
+		fmt.Printf("Redis cache error (non-fatal): %v\n", err)
+	} else if cachedData != nil {
+		return cachedData, nil, nil
+	}
+
+	if scheduler == nil {
+		report, err := LookupHIBP(ctx, email)
+		return report, nil, err
+	}
+	job, err := scheduler.Submit(userID, email, PriorityInteractive)
+	if err != nil {
+		return nil, nil, err
+	}
+	select {
+	case <-job.Done():
+		report, err := job.Result()
+		if err != nil {
+			return nil, nil, err
+		}
+		return copyReport(report), nil, nil
+	case <-ctx.Done():
+		return nil, job, nil
+	}
+}
+
+func batchError(err error) BatchError {
+	if errors.Is(err, ErrQueueFull) {
+		return BatchError{Error: err.Error(), Code: "rate_limited"}
+	}
+	fmt.Printf("HIBP API error: %v\n", err)
+	return BatchError{Error: fmt.Sprintf("Failed to check email: %v", err), Code: "lookup_failed"}
+}
@@ -2,15 +2,29 @@ package breach
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log"
+	"strings"
 	"time"
 
+	"github.com/deeplyprofound/password-sync/server/api/cve"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/crypto"
+	"github.com/deeplyprofound/password-sync/server/metrics"
 	"github.com/redis/go-redis/v9"
 )
 
+// MetricCacheOpenFailed counts Redis values that did not decrypt and were
+// treated as misses
+const MetricCacheOpenFailed = "breach_cache_open_failed"
+
 var (
 	redisClient *redis.Client
+	cacheKeys   *crypto.CacheKeyring
 	ctx         = context.Background()
 )
 
@@ -25,6 +39,8 @@ func InitRedis(addr string) error {
 	// Test connection
 	_, err := redisClient.Ping(ctx).Result()
 	if err != nil {
+		redisClient.Close()
+		redisClient = nil
 		return fmt.Errorf("failed to connect to Redis: %v", err)
 	}
 
@@ -32,28 +48,118 @@ func InitRedis(addr string) error {
 	return nil
 }
 
-// CloseRedis closes the Redis connection
+// RedisClient returns the shared client, or nil if InitRedis was not called
+// or failed. Other caches (e.g. auth profiles) reuse it. Without it reports
+// are cached in memory (see features.BreachCache).
+func RedisClient() *redis.Client {
+	return redisClient
+}
+
+// SetCacheKeyring sets the keyring values are sealed with before they go to
+// Redis. Reports hold the user's email and breach history, so the server
+// sets it before InitRedis.
+func SetCacheKeyring(k *crypto.CacheKeyring) {
+	cacheKeys = k
+}
+
+// CacheKeyring returns the keyring set by SetCacheKeyring, for other caches
+// sharing Redis
+func CacheKeyring() *crypto.CacheKeyring {
+	return cacheKeys
+}
+
+// CloseRedis closes the Redis connection; reports are cached in memory
+// afterwards
 func CloseRedis() error {
 	if redisClient != nil {
-		return redisClient.Close()
+		client := redisClient
+		redisClient = nil
+		return client.Close()
 	}
 	return nil
 }
 
-// GetCachedBreachReport retrieves a cached breach report for an email
-func GetCachedBreachReport(email string) (*LeakResponse, error) {
+// cacheGet reads a cached value from Redis, or from the in-memory
+// substitute when Redis is not connected. A miss is ("", false, nil); so is
+// a Redis value that does not decrypt, since the caller can always fetch
+// the data again.
+func cacheGet(key string) (string, bool, error) {
 	if redisClient == nil {
-		return nil, fmt.Errorf("Redis client not initialized")
+		val, ok := memoryCache.get(key)
+		return val, ok, nil
 	}
 
-	key := fmt.Sprintf("breach:email:%s", email)
-	val, err := redisClient.Get(ctx, key).Result()
-
+	val, err := redisClient.Get(ctx, key).Bytes()
 	if err == redis.Nil {
-		// Cache miss
-		return nil, nil
-	} else if err != nil {
-		// Redis error
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if cacheKeys != nil {
+		if val, err = cacheKeys.Open(val, key); err != nil {
+			metrics.Inc(MetricCacheOpenFailed)
+			log.Printf("⚠️  Cached value %s did not decrypt, treating it as a miss: %v", key, err)
+			return "", false, nil
+		}
+	}
+	return string(val), true, nil
+}
+
+// cacheSet stores a value, sealed when it goes to Redis. The in-memory
+// substitute never leaves the process and keeps it as is.
+func cacheSet(key string, data []byte, ttl time.Duration) error {
+	if redisClient == nil {
+		memoryCache.set(key, string(data), ttl)
+		return nil
+	}
+	if cacheKeys != nil {
+		sealed, err := cacheKeys.Seal(data, key)
+		if err != nil {
+			return err
+		}
+		data = sealed
+	}
+	return redisClient.Set(ctx, key, data, ttl).Err()
+}
+
+func cacheDel(key string) error {
+	if redisClient == nil {
+		memoryCache.del(key)
+		return nil
+	}
+	return redisClient.Del(ctx, key).Err()
+}
+
+// NormalizeEmail is the form of an address reports are looked up and cached
+// under: trimmed and lowercased, so "User@Example.com " and
+// "user@example.com" share one report and one HIBP call
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// BreachCacheKey is the cache key of email's report: "breach:email:v2:"
+// and the hex HMAC-SHA256 of the normalized address, keyed from the JWT
+// secret, so Redis key names carry no address and can't be reversed by
+// hashing a list of them. Until this format, reports were cached under
+// "breach:email:" and the address as typed; those keys are no longer read
+// and expire within their 24 hour TTL.
+func BreachCacheKey(email string) string {
+	mac := hmac.New(sha256.New, auth.DeriveKey("breach-cache-key"))
+	mac.Write([]byte(NormalizeEmail(email)))
+	return "breach:email:v2:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// legacyBreachCacheKey is where reports were cached before BreachCacheKey
+func legacyBreachCacheKey(email string) string {
+	return "breach:email:" + email
+}
+
+// GetCachedBreachReport retrieves a cached breach report for an email
+func GetCachedBreachReport(email string) (*LeakResponse, error) {
+	key := BreachCacheKey(email)
+	val, ok, err := cacheGet(key)
+	if err != nil || !ok {
 		return nil, err
 	}
 
@@ -63,17 +169,13 @@ func GetCachedBreachReport(email string) (*LeakResponse, error) {
 		return nil, fmt.Errorf("failed to deserialize cached breach report: %v", err)
 	}
 
-	fmt.Printf("🔥 Redis cache HIT for %s\n", email)
+	fmt.Printf("🔥 Cache HIT for %s\n", email)
 	return &leakResp, nil
 }
 
-// CacheBreachReport stores a breach report in Redis with TTL
+// CacheBreachReport stores a breach report with TTL
 func CacheBreachReport(email string, leakResp *LeakResponse, ttl time.Duration) error {
-	if redisClient == nil {
-		return fmt.Errorf("Redis client not initialized")
-	}
-
-	key := fmt.Sprintf("breach:email:%s", email)
+	key := BreachCacheKey(email)
 
 	// Serialize to JSON
 	data, err := json.Marshal(leakResp)
@@ -86,45 +188,41 @@ func CacheBreachReport(email string, leakResp *LeakResponse, ttl time.Duration)
 		ttl = 24 * time.Hour
 	}
 
-	err = redisClient.Set(ctx, key, data, ttl).Err()
+	err = cacheSet(key, data, ttl)
 	if err != nil {
 		return fmt.Errorf("failed to cache breach report: %v", err)
 	}
 
-	fmt.Printf("💾 Redis cache SET for %s (TTL: %v)\n", email, ttl)
+	fmt.Printf("💾 Cache SET for %s (TTL: %v)\n", email, ttl)
 	return nil
 }
 
-// InvalidateBreachCache removes cached breach report for an email
+// InvalidateBreachCache removes the cached breach report of an email,
+// along with any still cached under the legacy key formats
 func InvalidateBreachCache(email string) error {
-	if redisClient == nil {
-		return fmt.Errorf("Redis client not initialized")
-	}
-
-	key := fmt.Sprintf("breach:email:%s", email)
-	err := redisClient.Del(ctx, key).Err()
-	if err != nil {
-		return fmt.Errorf("failed to invalidate cache: %v", err)
+	keys := []string{BreachCacheKey(email), legacyBreachCacheKey(email), legacyBreachCacheKey(NormalizeEmail(email))}
+	for _, key := range keys {
+		if err := cacheDel(key); err != nil {
+			return fmt.Errorf("failed to invalidate cache: %v", err)
+		}
 	}
 
-	fmt.Printf("🗑️  Redis cache INVALIDATED for %s\n", email)
+	fmt.Printf("🗑️  Cache INVALIDATED for %s\n", email)
 	return nil
 }
 
+// companyCVEKey is the cache key of a company's CVE data. Until results
+// recorded how they were matched they were cached under "cve:company:";
+// those keyword matches expire within their 7 day TTL.
+func companyCVEKey(company string) string {
+	return "cve:company:v2:" + company
+}
+
 // GetCachedCompanyCVE retrieves cached CVE data for a company
 func GetCachedCompanyCVE(company string) (*CompanyCVEData, error) {
-	if redisClient == nil {
-		return nil, fmt.Errorf("Redis client not initialized")
-	}
-
-	key := fmt.Sprintf("cve:company:%s", company)
-	val, err := redisClient.Get(ctx, key).Result()
-
-	if err == redis.Nil {
-		// Cache miss
-		return nil, nil
-	} else if err != nil {
-		// Redis error
+	key := companyCVEKey(company)
+	val, ok, err := cacheGet(key)
+	if err != nil || !ok {
 		return nil, err
 	}
 
@@ -134,17 +232,13 @@ func GetCachedCompanyCVE(company string) (*CompanyCVEData, error) {
 		return nil, fmt.Errorf("failed to deserialize cached CVE data: %v", err)
 	}
 
-	fmt.Printf("🔥 Redis cache HIT for company %s CVEs\n", company)
+	fmt.Printf("🔥 Cache HIT for company %s CVEs\n", company)
 	return &cveData, nil
 }
 
-// CacheCompanyCVE stores CVE data for a company in Redis
+// CacheCompanyCVE stores CVE data for a company
 func CacheCompanyCVE(company string, cveData *CompanyCVEData, ttl time.Duration) error {
-	if redisClient == nil {
-		return fmt.Errorf("Redis client not initialized")
-	}
-
-	key := fmt.Sprintf("cve:company:%s", company)
+	key := companyCVEKey(company)
 
 	// Serialize to JSON
 	data, err := json.Marshal(cveData)
@@ -157,11 +251,27 @@ func CacheCompanyCVE(company string, cveData *CompanyCVEData, ttl time.Duration)
 		ttl = 7 * 24 * time.Hour
 	}
 
-	err = redisClient.Set(ctx, key, data, ttl).Err()
+	err = cacheSet(key, data, ttl)
 	if err != nil {
 		return fmt.Errorf("failed to cache CVE data: %v", err)
 	}
 
-	fmt.Printf("💾 Redis cache SET for company %s CVEs (TTL: %v)\n", company, ttl)
+	fmt.Printf("💾 Cache SET for company %s CVEs (TTL: %v)\n", company, ttl)
 	return nil
 }
+
+// SharedCache returns the breach cache for the CVE searches to share:
+// Redis when connected, sealed with the cache keyring, else memory
+func SharedCache() cve.Cache {
+	return sharedCache{}
+}
+
+type sharedCache struct{}
+
+func (sharedCache) Get(key string) (string, bool, error) {
+	return cacheGet(key)
+}
+
+func (sharedCache) Set(key string, data []byte, ttl time.Duration) error {
+	return cacheSet(key, data, ttl)
+}
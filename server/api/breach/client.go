@@ -0,0 +1,158 @@
+package breach
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/cve"
+)
+
+// DefaultHIBPURL is the Have I Been Pwned v3 API
+const DefaultHIBPURL = "https://haveibeenpwned.com/api/v3"
+
+// ErrNotConfigured is a lookup made before SetBreachClient
+var ErrNotConfigured = errors.New("breach lookups are not configured")
+
+// ClientConfig is how to reach the HIBP API
+type ClientConfig struct {
+	BaseURL    string       // DefaultHIBPURL when empty
+	APIKey     string       // Required
+	HTTPClient *http.Client // A client with a 10s timeout when nil
+}
+
+// BreachClient calls the HIBP API with the deployment's own key
+type BreachClient struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+// NewBreachClient returns a client for cfg. It refuses a config without an
+// API key: every deployment brings its own.
+func NewBreachClient(cfg ClientConfig) (*BreachClient, error) {
+	if cfg.APIKey == "" {
+		return nil, errors.New("an HIBP API key is required (HIBP_API_KEY); buy one at https://haveibeenpwned.com/API/Key")
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = DefaultHIBPURL
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &BreachClient{baseURL: cfg.BaseURL, apiKey: cfg.APIKey, http: cfg.HTTPClient}, nil
+}
+
+var (
+	// hibpClient answers LookupHIBP; nil until SetBreachClient
+	hibpClient *BreachClient
+	// nistClient enriches reports with CVEs; nil until SetCVEClient
+	nistClient *cve.CVEClient
+)
+
+// SetBreachClient sets the client LookupHIBP calls
+func SetBreachClient(c *BreachClient) {
+	hibpClient = c
+}
+
+// SetCVEClient sets the client CVE enrichment calls
+func SetCVEClient(c *cve.CVEClient) {
+	nistClient = c
+}
+
+// Lookup fetches email's breaches. An upstream 429 is a *RateLimitedError.
+func (c *BreachClient) Lookup(ctx context.Context, email string) (*LeakResponse, error) {
+	email = NormalizeEmail(email)
+	// Construct HIBP API URL with truncateResponse=false to get full details
+	url := fmt.Sprintf("%s/breachedaccount/%s?truncateResponse=false", c.baseURL, url.PathEscape(email))
+
+	// Create HTTP request
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set required headers
+	req.Header.Set("hibp-api-key", c.apiKey)
+	req.Header.Set("User-Agent", "PasswordSync-BreachChecker")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// Read response
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("HIBP API status: %d\n", resp.StatusCode)
+
+	// Handle different status codes
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Email found in breaches - parse response
+		var breaches []HIBPBreach
+		if err := json.Unmarshal(body, &breaches); err != nil {
+			return nil, fmt.Errorf("failed to parse HIBP response: %v", err)
+		}
+
+		// Convert to our format
+		leakResp := &LeakResponse{
+			Email:      email,
+			Sources:    []string{},
+			TotalLeaks: len(breaches),
+			LeakedData: []LeakSource{},
+		}
+
+		for _, breach := range breaches {
+			leakResp.Sources = append(leakResp.Sources, breach.Name)
+			leakResp.LeakedData = append(leakResp.LeakedData, LeakSource{
+				Source:      breach.Name,
+				Domain:      breach.Domain,
+				Date:        breach.BreachDate,
+				DataTypes:   breach.DataClasses,
+				Description: breach.Description,
+				PwnCount:    breach.PwnCount,
+				IsVerified:  breach.IsVerified,
+			})
+		}
+
+		fmt.Printf("✅ Found %d breaches for %s\n", len(breaches), email)
+		return leakResp, nil
+
+	case http.StatusNotFound:
+		// Email not found in any breaches - good news!
+		fmt.Printf("✅ No breaches found for %s\n", email)
+		return &LeakResponse{
+			Email:      email,
+			Sources:    []string{},
+			TotalLeaks: 0,
+			LeakedData: []LeakSource{},
+		}, nil
+
+	case http.StatusBadRequest:
+		return nil, fmt.Errorf("invalid email format")
+
+	case http.StatusUnauthorized:
+		return nil, fmt.Errorf("invalid HIBP API key")
+
+	case http.StatusTooManyRequests:
+		limited := &RateLimitedError{}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			limited.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, limited
+
+	default:
+		return nil, fmt.Errorf("HIBP API returned status %d: %s", resp.StatusCode, string(body))
+	}
+}
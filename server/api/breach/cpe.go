@@ -0,0 +1,158 @@
+package breach
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/deeplyprofound/password-sync/server/api/cve"
+)
+
+// How a breach was matched to its company's CVEs, most trustworthy first
+const (
+	MatchOverride = "override" // The operator's mapping file named the CPE
+	MatchCPE      = "cpe"      // The NVD's CPE dictionary lists the company as a vendor
+	MatchKeyword  = "keyword"  // A keyword search, which can match unrelated products
+)
+
+// cpePrefix starts every CPE 2.3 name and match string
+const cpePrefix = "cpe:2.3:"
+
+// companyCPEs maps normalized breach names to the CPE match strings the
+// operator chose for them; nil until SetCompanyCPEs
+var companyCPEs map[string]string
+
+// LoadCompanyCPEs reads a mapping file: a JSON object from breach names,
+// as HIBP names them, or server hosts to a CPE match string such as
+// "cpe:2.3:a:canva", or to "" for one with no product to match (e.g. a
+// combo list)
+func LoadCompanyCPEs(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	mapping := make(map[string]string, len(raw))
+	for company, match := range raw {
+		if match != "" && !strings.HasPrefix(match, cpePrefix) {
+			return nil, fmt.Errorf("%s: %q maps to %q, not a CPE 2.3 match string", path, company, match)
+		}
+		mapping[normalizeCompany(company)] = match
+	}
+	return mapping, nil
+}
+
+// SetCompanyCPEs sets the operator's mapping, consulted before the CPE
+// dictionary
+func SetCompanyCPEs(mapping map[string]string) {
+	companyCPEs = mapping
+}
+
+func normalizeCompany(company string) string {
+	return strings.ToLower(strings.TrimSpace(company))
+}
+
+// cpeVendor is company as the CPE dictionary would name it as a vendor:
+// lowercased, with words joined by underscores and other punctuation
+// dropped, so "Adobe Systems" is adobe_systems
+func cpeVendor(company string) string {
+	var words []string
+	for _, word := range strings.Fields(strings.ToLower(company)) {
+		word = strings.Map(func(r rune) rune {
+			if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+				return r
+			}
+			return -1
+		}, word)
+		if word != "" {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, "_")
+}
+
+// companyMatch is how a company's CVEs are searched for
+type companyMatch struct {
+	Method string
+	CPE    string // CPE match string, unless Method is MatchKeyword
+}
+
+// matchCompany chooses how to search for company's CVEs: by the CPE the
+// operator mapped it to, else by its vendor in the NVD's CPE dictionary,
+// else by keyword. Only a rate limit from the CPE API is returned as an
+// error; any other failure falls back to the keyword search.
+func matchCompany(ctx context.Context, company string) (companyMatch, error) {
+	if match, ok := companyCPEs[normalizeCompany(company)]; ok {
+		return companyMatch{Method: MatchOverride, CPE: match}, nil
+	}
+
+	vendor := cpeVendor(company)
+	if vendor == "" {
+		return companyMatch{Method: MatchKeyword}, nil
+	}
+	query := url.Values{
+		"cpeMatchString": {cpePrefix + "*:" + vendor},
+		"resultsPerPage": {"20"},
+	}
+	var resp cve.CPEResponse
+	if err := nistClient.GetCPEs(ctx, query, &resp); err != nil {
+		var status *cve.StatusError
+		if errors.As(err, &status) && status.RateLimited() {
+			return companyMatch{}, err
+		}
+		fmt.Printf("NVD CPE lookup failed for %s, searching by keyword: %v\n", company, err)
+		return companyMatch{Method: MatchKeyword}, nil
+	}
+
+	for _, product := range resp.Products {
+		// cpe:2.3:part:vendor:product:...
+		fields := strings.Split(product.CPE.CPEName, ":")
+		if product.CPE.Deprecated || len(fields) < 5 || fields[3] != vendor {
+			continue
+		}
+		return companyMatch{Method: MatchCPE, CPE: cpePrefix + fields[2] + ":" + vendor}, nil
+	}
+	return companyMatch{Method: MatchKeyword}, nil
+}
+
+// HostProduct names the product behind a server login's host, to match its
+// CVEs as a breached company's are: the host or its closest parent domain
+// when the operator's mapping lists it, else the label before the
+// top-level domain, so git.example.com is example. "" for an IP address or
+// a bare host name.
+func HostProduct(host string) string {
+	host = strings.Trim(normalizeCompany(host), ".")
+	if host == "" || net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return ""
+	}
+	labels := strings.Split(host, ".")
+	for i := range labels {
+		if _, ok := companyCPEs[strings.Join(labels[i:], ".")]; ok {
+			return strings.Join(labels[i:], ".")
+		}
+	}
+	if len(labels) < 2 {
+		return ""
+	}
+	return labels[len(labels)-2]
+}
+
+// GetCVEDataForHost returns the CVE data of the product behind host,
+// cached like a breached company's; nil when the host names no product or
+// the NVD couldn't be asked
+func GetCVEDataForHost(ctx context.Context, host string) *CompanyCVEData {
+	product := HostProduct(host)
+	if product == "" {
+		return nil
+	}
+	return getCVEDataForCompany(ctx, product)
+}
@@ -1,52 +1,18 @@
 package breach
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"net/http"
+	"net/url"
 	"sort"
-	"strings"
 	"time"
-)
-
-// NIST CVE API Response structures
-type NISTCVEItem struct {
-	CVE struct {
-		ID           string `json:"id"`
-		Descriptions []struct {
-			Lang  string `json:"lang"`
-			Value string `json:"value"`
-		} `json:"descriptions"`
-		Published    string `json:"published"`
-		LastModified string `json:"lastModified"`
-		Metrics      struct {
-			CVSSMetricV31 []struct {
-				CVSSV3 struct {
-					BaseScore    float64 `json:"baseScore"`
-					BaseSeverity string  `json:"baseSeverity"`
-				} `json:"cvssData"`
-			} `json:"cvssMetricV31"`
-			CVSSMetricV2 []struct {
-				CVSSV2 struct {
-					BaseScore float64 `json:"baseScore"`
-				} `json:"cvssData"`
-				BaseSeverity string `json:"baseSeverity"`
-			} `json:"cvssMetricV2"`
-		} `json:"metrics"`
-	} `json:"cve"`
-}
 
-type NISTResponse struct {
-	ResultsPerPage int            `json:"resultsPerPage"`
-	TotalResults   int            `json:"totalResults"`
-	Vulnerabilities []struct {
-		CVE NISTCVEItem `json:"cve"`
-	} `json:"vulnerabilities"`
-}
+	"github.com/deeplyprofound/password-sync/server/api/cve"
+)
 
 // getCVEDataForCompany fetches CVE data from NIST for a company
-func getCVEDataForCompany(company string) *CompanyCVEData {
+func getCVEDataForCompany(ctx context.Context, company string) *CompanyCVEData {
 	// Try cache first
 	cached, err := GetCachedCompanyCVE(company)
 	if err == nil && cached != nil {
@@ -54,7 +20,7 @@ func getCVEDataForCompany(company string) *CompanyCVEData {
 	}
 
 	// Call NIST API
-	cveData := callNISTAPIForCompany(company)
+	cveData := callNISTAPIForCompany(ctx, company)
 	if cveData == nil {
 		return nil
 	}
@@ -66,113 +32,70 @@ func getCVEDataForCompany(company string) *CompanyCVEData {
 }
 
 // callNISTAPIForCompany calls NIST CVE API to get vulnerabilities for a company
-func callNISTAPIForCompany(company string) *CompanyCVEData {
-	apiKey := "db4b1c7e-5a24-4d08-9a95-97f177070b43"
-	apiURL := "https://services.nvd.nist.gov/rest/json/cves/2.0"
-
-	// Search for company name + common software terms to find relevant CVEs
-	searchTerms := fmt.Sprintf("%s vulnerability", company)
-	url := fmt.Sprintf("%s?keywordSearch=%s&resultsPerPage=10", apiURL, searchTerms)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		fmt.Printf("Failed to create NIST request for %s: %v\n", company, err)
+func callNISTAPIForCompany(ctx context.Context, company string) *CompanyCVEData {
+	if nistClient == nil {
+		fmt.Printf("CVE enrichment skipped for %s: %v\n", company, cve.ErrNotConfigured)
 		return nil
 	}
 
-	req.Header.Set("apiKey", apiKey)
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	match, err := matchCompany(ctx, company)
 	if err != nil {
-		fmt.Printf("NIST API error for %s: %v\n", company, err)
+		fmt.Printf("⚠️  NIST API rate limit exceeded for %s\n", company)
 		return nil
 	}
-	defer resp.Body.Close()
+	query := url.Values{"resultsPerPage": {"10"}}
+	switch {
+	case match.Method == MatchKeyword:
+		// Search for company name + common software terms to find relevant CVEs
+		query.Set("keywordSearch", fmt.Sprintf("%s vulnerability", company))
+	case match.CPE == "":
+		// Mapped to no product: nothing to search for
+		return emptyCVEData(match)
+	default:
+		query.Set("virtualMatchString", match.CPE)
+	}
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		if resp.StatusCode == 403 {
-			fmt.Printf("⚠️  NIST API rate limit exceeded - waiting 6 seconds...\n")
-			time.Sleep(6 * time.Second)
+	var nistResp cve.CVEResponse
+	if err := nistClient.Get(ctx, query, &nistResp); err != nil {
+		var status *cve.StatusError
+		if !errors.As(err, &status) {
+			fmt.Printf("NIST API error for %s: %v\n", company, err)
 			return nil
 		}
-		fmt.Printf("NIST API returned %d for %s: %s\n", resp.StatusCode, company, string(body))
-		// Return empty result instead of nil to avoid re-querying
-		return &CompanyCVEData{
-			TotalCVEs:    0,
-			HighestScore: 0,
-			HighestLevel: "NONE",
-			TopCVEs:      []CVEItemSimple{},
+		if status.RateLimited() {
+			// Still limited after the client's retries: leave it uncached
+			fmt.Printf("⚠️  NIST API rate limit exceeded for %s\n", company)
+			return nil
 		}
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil
-	}
-
-	var nistResp NISTResponse
-	if err := json.Unmarshal(body, &nistResp); err != nil {
-		fmt.Printf("Failed to parse NIST response for %s: %v\n", company, err)
-		return nil
+		fmt.Printf("NIST API returned %d for %s: %s\n", status.StatusCode, company, status.Body)
+		// Return empty result instead of nil to avoid re-querying
+		return emptyCVEData(match)
 	}
 
 	// No CVEs found
 	if len(nistResp.Vulnerabilities) == 0 {
 		fmt.Printf("📊 No CVEs found for %s\n", company)
-		return &CompanyCVEData{
-			TotalCVEs:    0,
-			HighestScore: 0,
-			HighestLevel: "NONE",
-			TopCVEs:      []CVEItemSimple{},
-		}
+		return emptyCVEData(match)
 	}
 
 	// Convert to our simplified format and sort by score
 	var cves []CVEItemSimple
 	for _, vuln := range nistResp.Vulnerabilities {
-		// Get description
-		desc := "No description available"
-		for _, d := range vuln.CVE.CVE.Descriptions {
-			if d.Lang == "en" {
-				desc = d.Value
-				// Truncate long descriptions
-				if len(desc) > 200 {
-					desc = desc[:200] + "..."
-				}
-				break
-			}
-		}
-
-		// Get score and severity (try v3.1 first, then fall back to v2.0)
-		score := 0.0
-		severity := "UNKNOWN"
-		if len(vuln.CVE.CVE.Metrics.CVSSMetricV31) > 0 {
-			score = vuln.CVE.CVE.Metrics.CVSSMetricV31[0].CVSSV3.BaseScore
-			severity = vuln.CVE.CVE.Metrics.CVSSMetricV31[0].CVSSV3.BaseSeverity
-		} else if len(vuln.CVE.CVE.Metrics.CVSSMetricV2) > 0 {
-			// Fallback to CVSS v2
-			score = vuln.CVE.CVE.Metrics.CVSSMetricV2[0].CVSSV2.BaseScore
-			severity = vuln.CVE.CVE.Metrics.CVSSMetricV2[0].BaseSeverity
-			// CVSS v2 uses different severity labels, normalize them
-			if severity == "" {
-				if score >= 7.0 {
-					severity = "HIGH"
-				} else if score >= 4.0 {
-					severity = "MEDIUM"
-				} else {
-					severity = "LOW"
-				}
-			}
+		desc := vuln.CVE.Description()
+		if desc == "" {
+			desc = "No description available"
+		} else if len(desc) > 200 {
+			// Truncate long descriptions
+			desc = desc[:200] + "..."
 		}
+		score, severity := vuln.CVE.Score()
 
 		cves = append(cves, CVEItemSimple{
-			ID:          vuln.CVE.CVE.ID,
+			ID:          vuln.CVE.ID,
 			Description: desc,
-			Published:   vuln.CVE.CVE.Published,
+			Published:   vuln.CVE.Published,
 			Score:       score,
-			Severity:    strings.ToUpper(severity),
+			Severity:    severity,
 		})
 	}
 
@@ -195,34 +118,53 @@ func callNISTAPIForCompany(company string) *CompanyCVEData {
 		highestLevel = cves[0].Severity
 	}
 
-	fmt.Printf("📊 Found %d CVEs for %s (highest: %s %.1f)\n", len(cves), company, highestLevel, highestScore)
+	fmt.Printf("📊 Found %d CVEs for %s by %s (highest: %s %.1f)\n", len(cves), company, match.Method, highestLevel, highestScore)
 
 	return &CompanyCVEData{
 		TotalCVEs:    nistResp.TotalResults,
 		HighestScore: highestScore,
 		HighestLevel: highestLevel,
 		TopCVEs:      topCVEs,
+		MatchMethod:  match.Method,
+		CPE:          match.CPE,
+	}
+}
+
+// emptyCVEData is the result for a company without CVEs
+func emptyCVEData(match companyMatch) *CompanyCVEData {
+	return &CompanyCVEData{
+		TotalCVEs:    0,
+		HighestScore: 0,
+		HighestLevel: "NONE",
+		TopCVEs:      []CVEItemSimple{},
+		MatchMethod:  match.Method,
+		CPE:          match.CPE,
 	}
 }
 
-// enrichLeaksWithCVEData enriches breach data with CVE information
-func enrichLeaksWithCVEData(leakResp *LeakResponse) {
+// enrichLeaksWithCVEData enriches breach data with CVE information, calling
+// progress with the number of breaches enriched so far after each one. It
+// stops early, returning the context's error, once ctx is done.
+func enrichLeaksWithCVEData(ctx context.Context, leakResp *LeakResponse, progress func(enriched int)) error {
 	if len(leakResp.LeakedData) == 0 {
-		return
+		return nil
 	}
 
-	// NIST API rate limit: 5 requests per 30 seconds without API key
-	// Process sequentially with delay to avoid rate limits
+	// Sequential: the NVD client's limiter, shared with the CVE endpoints,
+	// paces the calls; cached companies don't wait at all
 	for i := range leakResp.LeakedData {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		company := leakResp.LeakedData[i].Source
-		cveData := getCVEDataForCompany(company)
+		cveData := getCVEDataForCompany(ctx, company)
 		leakResp.LeakedData[i].CVEData = cveData
-
-		// Wait 6 seconds between requests to stay under NIST rate limit (10 requests/60s with API key)
-		if i < len(leakResp.LeakedData)-1 {
-			time.Sleep(6 * time.Second)
-		}
+		progress(i + 1)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
 	fmt.Printf("✅ Enriched %d breaches with CVE data\n", len(leakResp.LeakedData))
+	return nil
 }
@@ -0,0 +1,318 @@
+package breach
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// States of an enrichment job
+const (
+	EnrichQueued  = "queued"
+	EnrichRunning = "running"
+	EnrichDone    = "done"
+	EnrichFailed  = "failed"
+)
+
+// EnrichConfig sizes the CVE enrichment worker pool
+type EnrichConfig struct {
+	Workers   int           // Reports enriched at once
+	MaxQueued int           // Jobs waiting for a worker
+	ResultTTL time.Duration // How long a job can be polled after its last update
+}
+
+// DefaultEnrichConfig runs few jobs at once: they all wait on the one NVD
+// rate limiter anyway
+var DefaultEnrichConfig = EnrichConfig{
+	Workers:   2,
+	MaxQueued: 100,
+	ResultTTL: time.Hour,
+}
+
+// EnrichStatus is an enrichment job as polled: its progress, then the
+// enriched report or why it failed
+type EnrichStatus struct {
+	JobID    string        `json:"job_id"`
+	Status   string        `json:"status"`
+	Percent  int           `json:"percent"`
+	Enriched int           `json:"enriched"` // Breaches enriched so far
+	Total    int           `json:"total"`    // Breaches in the report, once fetched
+	Report   *LeakResponse `json:"report,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// enrichRecord is what is stored of a job: its status and the users who
+// asked for it, who alone may poll it
+type enrichRecord struct {
+	EnrichStatus
+	Users []string `json:"users"`
+}
+
+// enrichJob is a job of this instance, until it finishes
+type enrichJob struct {
+	email  string
+	mu     sync.Mutex
+	record enrichRecord
+}
+
+// Enricher runs CVE enrichment in the background. Jobs are held in this
+// instance's pool, with their progress in the cache (Redis when connected)
+// so any instance can answer a poll. Requests for an address already being
+// enriched here join its job.
+type Enricher struct {
+	cfg      EnrichConfig
+	queue    chan *enrichJob
+	mu       sync.Mutex
+	inflight map[string]*enrichJob // By normalized address
+}
+
+func NewEnricher(cfg EnrichConfig) *Enricher {
+	if cfg.Workers <= 0 {
+		cfg.Workers = DefaultEnrichConfig.Workers
+	}
+	if cfg.MaxQueued <= 0 {
+		cfg.MaxQueued = DefaultEnrichConfig.MaxQueued
+	}
+	if cfg.ResultTTL <= 0 {
+		cfg.ResultTTL = DefaultEnrichConfig.ResultTTL
+	}
+	return &Enricher{
+		cfg:      cfg,
+		queue:    make(chan *enrichJob, cfg.MaxQueued),
+		inflight: make(map[string]*enrichJob),
+	}
+}
+
+// enricher runs enrichment jobs; nil refuses them
+var enricher *Enricher
+
+// SetEnricher routes enrichment requests to e
+func SetEnricher(e *Enricher) {
+	enricher = e
+}
+
+// Run starts the workers; they stop when ctx is cancelled
+func (e *Enricher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < e.cfg.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case job := <-e.queue:
+					e.execute(ctx, job)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Submit starts enriching email's report for userID, or joins the job
+// already enriching it. It returns ErrQueueFull when every worker is busy
+// and the queue is at its cap.
+func (e *Enricher) Submit(userID, email string) (EnrichStatus, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if job, ok := e.inflight[email]; ok {
+		job.mu.Lock()
+		defer job.mu.Unlock()
+		if !containsUser(job.record.Users, userID) {
+			job.record.Users = append(job.record.Users, userID)
+			e.save(job)
+		}
+		return job.record.EnrichStatus, nil
+	}
+
+	job := &enrichJob{email: email, record: enrichRecord{
+		EnrichStatus: EnrichStatus{JobID: uuid.NewString(), Status: EnrichQueued},
+		Users:        []string{userID},
+	}}
+	select {
+	case e.queue <- job:
+	default:
+		return EnrichStatus{}, ErrQueueFull
+	}
+	e.inflight[email] = job
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	e.save(job)
+	return job.record.EnrichStatus, nil
+}
+
+// Status returns a job one of its users asked for
+func (e *Enricher) Status(userID, id string) (EnrichStatus, error) {
+	val, ok, err := cacheGet(enrichJobKey(id))
+	if err != nil {
+		return EnrichStatus{}, err
+	}
+	var record enrichRecord
+	if !ok || json.Unmarshal([]byte(val), &record) != nil || !containsUser(record.Users, userID) {
+		return EnrichStatus{}, ErrJobNotFound
+	}
+	return record.EnrichStatus, nil
+}
+
+// execute fetches the report, from the cache or HIBP, enriches it and
+// caches the enriched report in its place
+func (e *Enricher) execute(ctx context.Context, job *enrichJob) {
+	job.update(e, func(status *EnrichStatus) { status.Status = EnrichRunning })
+
+	report, err := e.report(ctx, job)
+	if err == nil {
+		job.update(e, func(status *EnrichStatus) { status.Total = len(report.LeakedData) })
+		err = enrichLeaksWithCVEData(ctx, report, func(enriched int) {
+			job.update(e, func(status *EnrichStatus) {
+				status.Enriched = enriched
+				status.Percent = enriched * 100 / status.Total
+			})
+		})
+	}
+	if err == nil {
+		if cacheErr := CacheBreachReport(job.email, report, 24*time.Hour); cacheErr != nil {
+			fmt.Printf("Failed to cache enriched breach report (non-fatal): %v\n", cacheErr)
+		}
+	}
+
+	e.mu.Lock()
+	delete(e.inflight, job.email)
+	e.mu.Unlock()
+	job.update(e, func(status *EnrichStatus) {
+		if err != nil {
+			status.Status, status.Error = EnrichFailed, err.Error()
+			return
+		}
+		status.Status, status.Percent, status.Report = EnrichDone, 100, report
+	})
+}
+
+// report returns the job's report from the cache or, on a miss, from HIBP
+// through the scheduler as a background lookup of its first user
+func (e *Enricher) report(ctx context.Context, job *enrichJob) (*LeakResponse, error) {
+	cachedData, err := GetCachedBreachReport(job.email)
+	if err != nil {
+		fmt.Printf("Redis cache error (non-fatal): %v\n", err)
+	} else if cachedData != nil {
+		return cachedData, nil
+	}
+
+	if scheduler == nil {
+		return LookupHIBP(ctx, job.email)
+	}
+	job.mu.Lock()
+	userID := job.record.Users[0]
+	job.mu.Unlock()
+	lookup, err := scheduler.Submit(userID, job.email, PriorityBackground)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-lookup.Done():
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	report, err := lookup.Result()
+	if err != nil {
+		return nil, err
+	}
+	return copyReport(report), nil
+}
+
+// update changes the job's status and stores it
+func (j *enrichJob) update(e *Enricher, change func(*EnrichStatus)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	change(&j.record.EnrichStatus)
+	e.save(j)
+}
+
+// save stores the job's record; the caller holds j.mu
+func (e *Enricher) save(j *enrichJob) {
+	data, err := json.Marshal(j.record)
+	if err == nil {
+		err = cacheSet(enrichJobKey(j.record.JobID), data, e.cfg.ResultTTL)
+	}
+	if err != nil {
+		fmt.Printf("Failed to store enrichment job %s: %v\n", j.record.JobID, err)
+	}
+}
+
+func enrichJobKey(id string) string {
+	return "breach:enrich:" + id
+}
+
+func containsUser(users []string, userID string) bool {
+	for _, user := range users {
+		if user == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// StartEnrichment queues CVE enrichment of an email's breach report and
+// answers 202 with the job to poll at once: behind the NVD's rate limit a
+// large report can take minutes.
+func StartEnrichment(c *gin.Context) {
+	var req CheckEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if enricher == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "CVE enrichment is not available"})
+		return
+	}
+
+	status, err := enricher.Submit(middleware.MustUserID(c), NormalizeEmail(req.Email))
+	if errors.Is(err, ErrQueueFull) {
+		c.Header("Retry-After", retryAfterSeconds(time.Minute))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many enrichments queued, try again later", "code": "rate_limited"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"job_id":   status.JobID,
+		"status":   status.Status,
+		"percent":  status.Percent,
+		"poll_url": "/api/v1/breach/enrich/" + status.JobID,
+	})
+}
+
+// GetEnrichment polls an enrichment job: 202 with its progress while it
+// runs, then 200 with the enriched report, or the error it failed with
+func GetEnrichment(c *gin.Context) {
+	if enricher == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrJobNotFound.Error()})
+		return
+	}
+
+	status, err := enricher.Status(middleware.MustUserID(c), c.Param("job_id"))
+	if errors.Is(err, ErrJobNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read enrichment job: %v", err)})
+		return
+	}
+
+	switch status.Status {
+	case EnrichDone, EnrichFailed:
+		c.JSON(http.StatusOK, status)
+	default:
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusAccepted, status)
+	}
+}
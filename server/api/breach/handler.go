@@ -1,30 +1,12 @@
 package breach
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
-	"os"
-	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-func getHIBPAPIKey() string {
-	if key := os.Getenv("HIBP_API_KEY"); key != "" {
-		return key
-	}
-	return "8fc653bd98934b58beb09577d41a589c" // Fallback
-}
-
-func getHIBPAPIURL() string {
-	if url := os.Getenv("HIBP_API_URL"); url != "" {
-		return url
-	}
-	return "https://haveibeenpwned.com/api/v3"
-}
-
 type CheckEmailRequest struct {
 	Email string `json:"email" binding:"required,email"`
 }
@@ -70,11 +52,14 @@ type CompanyCVEData struct {
 	HighestScore float64         `json:"highest_score"`
 	HighestLevel string          `json:"highest_level"` // CRITICAL/HIGH/MEDIUM/LOW
 	TopCVEs      []CVEItemSimple `json:"top_cves"`      // Top 3 by severity
+	MatchMethod  string          `json:"match_method"`  // override, cpe or keyword: how far to trust the match
+	CPE          string          `json:"cpe,omitempty"` // CPE match string searched, unless by keyword
 }
 
 // Our unified response format
 type LeakSource struct {
 	Source      string          `json:"source"`
+	Domain      string          `json:"domain,omitempty"` // The breached site, if HIBP names one
 	Date        string          `json:"date"`
 	DataTypes   []string        `json:"data_types"`
 	Description string          `json:"description"`
@@ -97,6 +82,8 @@ func CheckEmail(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// One cache entry, queued lookup and HIBP call per address, however typed
+	req.Email = NormalizeEmail(req.Email)
 
 	// Try to get from Redis cache first
 	cachedData, err := GetCachedBreachReport(req.Email)
@@ -108,147 +95,11 @@ func CheckEmail(c *gin.Context) {
 		return
 	}
 
-	// Cache miss - call HIBP API
-	leakData, err := callHIBPAPI(req.Email)
-	if err != nil {
-		fmt.Printf("HIBP API error: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to check email: %v", err)})
+	// Cache miss - queue an HIBP lookup; a long queue answers 202
+	leakData := lookupReport(c, req.Email)
+	if leakData == nil {
 		return
 	}
 
-	// Cache the result for 24 hours (without CVE data for faster response)
-	if err := CacheBreachReport(req.Email, leakData, 24*time.Hour); err != nil {
-		fmt.Printf("Failed to cache breach report (non-fatal): %v\n", err)
-	}
-
 	c.JSON(http.StatusOK, leakData)
 }
-
-// EnrichWithCVE enriches existing breach report with CVE data
-func EnrichWithCVE(c *gin.Context) {
-	var req CheckEmailRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	// Get breach data from cache or HIBP
-	cachedData, err := GetCachedBreachReport(req.Email)
-	if err != nil {
-		fmt.Printf("Redis cache error (non-fatal): %v\n", err)
-	}
-
-	var leakData *LeakResponse
-	if cachedData != nil {
-		leakData = cachedData
-	} else {
-		// If not cached, fetch from HIBP
-		leakData, err = callHIBPAPI(req.Email)
-		if err != nil {
-			fmt.Printf("HIBP API error: %v\n", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to check email: %v", err)})
-			return
-		}
-	}
-
-	// Enrich with CVE data
-	if len(leakData.LeakedData) > 0 {
-		fmt.Printf("🔍 Enriching %d breaches with CVE data...\n", len(leakData.LeakedData))
-		enrichLeaksWithCVEData(leakData)
-	}
-
-	// Update cache with enriched data
-	if err := CacheBreachReport(req.Email, leakData, 24*time.Hour); err != nil {
-		fmt.Printf("Failed to cache enriched breach report (non-fatal): %v\n", err)
-	}
-
-	c.JSON(http.StatusOK, leakData)
-}
-
-func callHIBPAPI(email string) (*LeakResponse, error) {
-	// Construct HIBP API URL with truncateResponse=false to get full details
-	url := fmt.Sprintf("%s/breachedaccount/%s?truncateResponse=false", getHIBPAPIURL(), email)
-
-	// Create HTTP request
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	// Set required headers
-	req.Header.Set("hibp-api-key", getHIBPAPIKey())
-	req.Header.Set("User-Agent", "PasswordSync-BreachChecker")
-
-	// Send request with timeout
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	// Read response
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	fmt.Printf("HIBP API status: %d\n", resp.StatusCode)
-
-	// Handle different status codes
-	switch resp.StatusCode {
-	case http.StatusOK:
-		// Email found in breaches - parse response
-		var breaches []HIBPBreach
-		if err := json.Unmarshal(body, &breaches); err != nil {
-			return nil, fmt.Errorf("failed to parse HIBP response: %v", err)
-		}
-
-		// Convert to our format
-		leakResp := &LeakResponse{
-			Email:      email,
-			Sources:    []string{},
-			TotalLeaks: len(breaches),
-			LeakedData: []LeakSource{},
-		}
-
-		for _, breach := range breaches {
-			leakResp.Sources = append(leakResp.Sources, breach.Name)
-			leakResp.LeakedData = append(leakResp.LeakedData, LeakSource{
-				Source:      breach.Name,
-				Date:        breach.BreachDate,
-				DataTypes:   breach.DataClasses,
-				Description: breach.Description,
-				PwnCount:    breach.PwnCount,
-				IsVerified:  breach.IsVerified,
-			})
-		}
-
-		fmt.Printf("✅ Found %d breaches for %s\n", len(breaches), email)
-		return leakResp, nil
-
-	case http.StatusNotFound:
-		// Email not found in any breaches - good news!
-		fmt.Printf("✅ No breaches found for %s\n", email)
-		return &LeakResponse{
-			Email:      email,
-			Sources:    []string{},
-			TotalLeaks: 0,
-			LeakedData: []LeakSource{},
-		}, nil
-
-	case http.StatusBadRequest:
-		return nil, fmt.Errorf("invalid email format")
-
-	case http.StatusUnauthorized:
-		return nil, fmt.Errorf("invalid HIBP API key")
-
-	case http.StatusTooManyRequests:
-		return nil, fmt.Errorf("rate limit exceeded - please wait and try again")
-
-	default:
-		return nil, fmt.Errorf("HIBP API returned status %d: %s", resp.StatusCode, string(body))
-	}
-}
@@ -0,0 +1,80 @@
+package breach
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// memoryCacheSize bounds the in-memory substitute; the least recently used
+// report is dropped first
+const memoryCacheSize = 1000
+
+// memoryCache stands in for Redis when it is not connected. It is per
+// instance and lost on restart.
+var memoryCache = newTTLCache(memoryCacheSize)
+
+// ttlCache is a small LRU whose entries also expire
+type ttlCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type ttlEntry struct {
+	key       string
+	value     string
+	expiresAt time.Time
+}
+
+func newTTLCache(size int) *ttlCache {
+	return &ttlCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *ttlCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := element.Value.(*ttlEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return "", false
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+func (c *ttlCache) set(key, value string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &ttlEntry{key: key, value: value, expiresAt: time.Now().Add(ttl)}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*ttlEntry).key)
+	}
+}
+
+func (c *ttlCache) del(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,242 @@
+package breach
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// MonitorConfig bounds breach monitoring
+type MonitorConfig struct {
+	MaxPerUser int // Addresses one user may monitor
+	MaxAlerts  int // Alerts GET /breach/alerts returns
+}
+
+var DefaultMonitorConfig = MonitorConfig{
+	MaxPerUser: 5,
+	MaxAlerts:  100,
+}
+
+var monitorConfig = DefaultMonitorConfig
+
+// SetMonitorConfig sizes breach monitoring; zero fields keep their default
+func SetMonitorConfig(cfg MonitorConfig) {
+	if cfg.MaxPerUser <= 0 {
+		cfg.MaxPerUser = DefaultMonitorConfig.MaxPerUser
+	}
+	if cfg.MaxAlerts <= 0 {
+		cfg.MaxAlerts = DefaultMonitorConfig.MaxAlerts
+	}
+	monitorConfig = cfg
+}
+
+// MonitorStore keeps the monitored addresses and their alerts
+type MonitorStore interface {
+	CreateBreachMonitor(ctx context.Context, userID, email string, limit int) (*storage.BreachMonitor, bool, error)
+	ListBreachMonitors(ctx context.Context, userID string) ([]*storage.BreachMonitor, error)
+	DeleteBreachMonitor(ctx context.Context, userID, id string) error
+	RecordBreachCheck(ctx context.Context, monitor *storage.BreachMonitor, breaches []string, alerts []*storage.BreachAlert, at time.Time) error
+	ListBreachAlerts(ctx context.Context, userID string, limit int) ([]*storage.BreachAlert, error)
+}
+
+// monitorStore backs the monitoring endpoints; nil until SetMonitorStore
+var monitorStore MonitorStore
+
+// SetMonitorStore enables breach monitoring
+func SetMonitorStore(s MonitorStore) {
+	monitorStore = s
+}
+
+// MonitorLookup is the breach monitor job's lookup: email's breaches from
+// the cache, else from HIBP at background priority, so interactive checks
+// go first and the monitor shares the plan's rate with them
+func MonitorLookup(ctx context.Context, userID, email string) ([]*storage.BreachAlert, error) {
+	report, err := GetCachedBreachReport(email)
+	if err != nil {
+		fmt.Printf("Redis cache error (non-fatal): %v\n", err)
+	}
+	if report == nil {
+		if report, err = backgroundLookup(ctx, userID, email); err != nil {
+			return nil, err
+		}
+	}
+	return reportBreaches(report), nil
+}
+
+func backgroundLookup(ctx context.Context, userID, email string) (*LeakResponse, error) {
+	if scheduler == nil {
+		return LookupHIBP(ctx, email)
+	}
+	job, err := scheduler.Submit(userID, email, PriorityBackground)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-job.Done():
+		return job.Result()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// reportBreaches is one unsaved alert per breach of report
+func reportBreaches(report *LeakResponse) []*storage.BreachAlert {
+	alerts := make([]*storage.BreachAlert, 0, len(report.LeakedData))
+	for _, leak := range report.LeakedData {
+		alerts = append(alerts, &storage.BreachAlert{
+			Email:      report.Email,
+			Breach:     leak.Source,
+			BreachDate: leak.Date,
+			DataTypes:  leak.DataTypes,
+		})
+	}
+	return alerts
+}
+
+type BreachMonitorResponse struct {
+	ID        string     `json:"id"`
+	Email     string     `json:"email"`
+	Breaches  []string   `json:"breaches"` // Known at the last check
+	CreatedAt time.Time  `json:"created_at"`
+	CheckedAt *time.Time `json:"checked_at"` // null until the first check
+}
+
+type BreachAlertResponse struct {
+	ID         string    `json:"id"`
+	Email      string    `json:"email"`
+	Breach     string    `json:"breach"`
+	BreachDate string    `json:"breach_date"`
+	DataTypes  []string  `json:"data_types"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func monitorResponse(m *storage.BreachMonitor) BreachMonitorResponse {
+	return BreachMonitorResponse{ID: m.ID, Email: m.Email, Breaches: m.Breaches, CreatedAt: m.CreatedAt, CheckedAt: m.CheckedAt}
+}
+
+// requireMonitorStore answers 503 when monitoring isn't enabled
+func requireMonitorStore(c *gin.Context) bool {
+	if monitorStore == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "breach monitoring is not available"})
+		return false
+	}
+	return true
+}
+
+// Subscribe monitors an address for the user: 201 with the new monitor, or
+// 200 with the one the user already has. The address is re-checked daily
+// and each breach found after this one raises an alert. A user at the
+// MaxPerUser limit gets 403 quota_exceeded.
+func Subscribe(c *gin.Context) {
+	var req CheckEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !requireMonitorStore(c) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	email := NormalizeEmail(req.Email)
+	monitor, created, err := monitorStore.CreateBreachMonitor(ctx, middleware.MustUserID(c), email, monitorConfig.MaxPerUser)
+	if errors.Is(err, storage.ErrTooManyMonitors) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": fmt.Sprintf("at most %d addresses can be monitored", monitorConfig.MaxPerUser),
+			"code":  "quota_exceeded",
+			"limit": monitorConfig.MaxPerUser,
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to monitor email: %v", err)})
+		return
+	}
+	if !created {
+		c.JSON(http.StatusOK, monitorResponse(monitor))
+		return
+	}
+
+	// A report the user just checked is the baseline; otherwise the job's
+	// first check sets it
+	if report, err := GetCachedBreachReport(email); err == nil && report != nil {
+		breaches := make([]string, 0, len(report.LeakedData))
+		for _, leak := range report.LeakedData {
+			breaches = append(breaches, leak.Source)
+		}
+		now := clock.System.Now().UTC()
+		if err := monitorStore.RecordBreachCheck(ctx, monitor, breaches, nil, now); err != nil {
+			fmt.Printf("Failed to record breach monitor baseline (non-fatal): %v\n", err)
+		} else {
+			monitor.Breaches, monitor.CheckedAt = breaches, &now
+		}
+	}
+	c.JSON(http.StatusCreated, monitorResponse(monitor))
+}
+
+// ListMonitors lists the user's monitored addresses, oldest first
+func ListMonitors(c *gin.Context) {
+	if !requireMonitorStore(c) {
+		return
+	}
+	monitors, err := monitorStore.ListBreachMonitors(c.Request.Context(), middleware.MustUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list monitors: %v", err)})
+		return
+	}
+	resp := make([]BreachMonitorResponse, 0, len(monitors))
+	for _, monitor := range monitors {
+		resp = append(resp, monitorResponse(monitor))
+	}
+	c.JSON(http.StatusOK, gin.H{"monitors": resp, "max": monitorConfig.MaxPerUser})
+}
+
+// Unsubscribe stops monitoring an address. The alerts it raised are kept.
+func Unsubscribe(c *gin.Context) {
+	if !requireMonitorStore(c) {
+		return
+	}
+	err := monitorStore.DeleteBreachMonitor(c.Request.Context(), middleware.MustUserID(c), c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "breach monitor not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to delete monitor: %v", err)})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListAlerts returns the user's latest breach alerts, newest first. Each
+// was also pushed as a breach_alert WebSocket event when it was raised.
+func ListAlerts(c *gin.Context) {
+	if !requireMonitorStore(c) {
+		return
+	}
+	alerts, err := monitorStore.ListBreachAlerts(c.Request.Context(), middleware.MustUserID(c), monitorConfig.MaxAlerts)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to list alerts: %v", err)})
+		return
+	}
+	resp := make([]BreachAlertResponse, 0, len(alerts))
+	for _, alert := range alerts {
+		resp = append(resp, BreachAlertResponse{
+			ID:         alert.ID,
+			Email:      alert.Email,
+			Breach:     alert.Breach,
+			BreachDate: alert.BreachDate,
+			DataTypes:  alert.DataTypes,
+			CreatedAt:  alert.CreatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"alerts": resp})
+}
@@ -0,0 +1,168 @@
+package breach
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultPasswordRangeTTL is how long a Pwned Passwords range is cached
+// unless SetPasswordRangeTTL says otherwise
+const DefaultPasswordRangeTTL = 24 * time.Hour
+
+// PasswordPrefixLength is how many hex characters of a password's SHA-1 a
+// client sends: the range it gets back holds every hash sharing them
+const PasswordPrefixLength = 5
+
+var passwordRangeTTL = DefaultPasswordRangeTTL
+
+// SetPasswordRangeTTL sets how long a range fetched from Pwned Passwords
+// is cached
+func SetPasswordRangeTTL(ttl time.Duration) {
+	if ttl > 0 {
+		passwordRangeTTL = ttl
+	}
+}
+
+func getPwnedPasswordsURL() string {
+	if url := os.Getenv("PWNED_PASSWORDS_API_URL"); url != "" {
+		return url
+	}
+	return "https://api.pwnedpasswords.com"
+}
+
+type PasswordRangeRequest struct {
+	Prefix string `json:"prefix" binding:"required"`
+}
+
+// PasswordSuffix is a hash in the Pwned Passwords corpus: the 35 hex
+// characters after the prefix and how many breaches it appeared in
+type PasswordSuffix struct {
+	Suffix string `json:"suffix"`
+	Count  int    `json:"count"`
+}
+
+type PasswordRangeResponse struct {
+	Prefix   string           `json:"prefix"`
+	Suffixes []PasswordSuffix `json:"suffixes"`
+}
+
+// CheckPassword answers the Pwned Passwords range of a SHA-1 prefix, so
+// the client can look for the rest of its hash locally (k-anonymity). Only
+// the 5 hex character prefix is accepted; the request is refused, without
+// the value being echoed or logged, for anything longer, so a full hash or
+// a password never reaches the logs.
+func CheckPassword(c *gin.Context) {
+	var req PasswordRangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "prefix is required"})
+		return
+	}
+	prefix, ok := passwordPrefix(req.Prefix)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("prefix must be the first %d hex characters of the password's SHA-1", PasswordPrefixLength),
+			"code":  "invalid_prefix",
+		})
+		return
+	}
+
+	suffixes, err := passwordRange(c.Request.Context(), prefix)
+	if err != nil {
+		fmt.Printf("Pwned Passwords API error: %v\n", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "failed to check password"})
+		return
+	}
+	c.JSON(http.StatusOK, PasswordRangeResponse{Prefix: prefix, Suffixes: suffixes})
+}
+
+// passwordPrefix returns prefix in upper case, as the API serves ranges,
+// if it is a valid one
+func passwordPrefix(prefix string) (string, bool) {
+	if len(prefix) != PasswordPrefixLength {
+		return "", false
+	}
+	for _, r := range prefix {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return "", false
+		}
+	}
+	return strings.ToUpper(prefix), true
+}
+
+// passwordRange returns the range of prefix from the cache, fetching and
+// caching it on a miss
+func passwordRange(ctx context.Context, prefix string) ([]PasswordSuffix, error) {
+	key := "pwned:range:" + prefix
+	if val, ok, err := cacheGet(key); err != nil {
+		fmt.Printf("Redis cache error (non-fatal): %v\n", err)
+	} else if ok {
+		var suffixes []PasswordSuffix
+		if err := json.Unmarshal([]byte(val), &suffixes); err == nil {
+			return suffixes, nil
+		}
+	}
+
+	suffixes, err := callPwnedPasswordsAPI(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(suffixes)
+	if err != nil {
+		return nil, err
+	}
+	if err := cacheSet(key, data, passwordRangeTTL); err != nil {
+		fmt.Printf("Failed to cache password range (non-fatal): %v\n", err)
+	}
+	return suffixes, nil
+}
+
+// callPwnedPasswordsAPI fetches a range. It asks for padding, so the size
+// of the answer on the wire doesn't narrow down the prefix, and drops the
+// padding entries (count 0) from what it returns.
+func callPwnedPasswordsAPI(ctx context.Context, prefix string) ([]PasswordSuffix, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, getPwnedPasswordsURL()+"/range/"+prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Add-Padding", "true")
+	req.Header.Set("User-Agent", "PasswordSync-BreachChecker")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("range request answered %d", resp.StatusCode)
+	}
+
+	suffixes := []PasswordSuffix{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		suffix, count, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return nil, fmt.Errorf("malformed range line: %v", err)
+		}
+		if n > 0 {
+			suffixes = append(suffixes, PasswordSuffix{Suffix: suffix, Count: n})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return suffixes, nil
+}
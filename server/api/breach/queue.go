@@ -0,0 +1,150 @@
+package breach
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/gin-gonic/gin"
+)
+
+// scheduler throttles HIBP lookups; nil sends them upstream directly
+var scheduler *Scheduler
+
+// SetScheduler routes HIBP lookups through s
+func SetScheduler(s *Scheduler) {
+	scheduler = s
+}
+
+// LookupHIBP fetches an email's report from HIBP and caches it. It is the
+// scheduler's LookupFunc.
+func LookupHIBP(ctx context.Context, email string) (*LeakResponse, error) {
+	if hibpClient == nil {
+		return nil, ErrNotConfigured
+	}
+	leakData, err := hibpClient.Lookup(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cache the result for 24 hours (without CVE data for faster response)
+	if err := CacheBreachReport(email, leakData, 24*time.Hour); err != nil {
+		fmt.Printf("Failed to cache breach report (non-fatal): %v\n", err)
+	}
+	return leakData, nil
+}
+
+// lookupReport fetches email's report through the scheduler, waiting up to
+// its InteractiveWait. If the lookup is still queued after that, or failed,
+// it answers the request itself and returns nil.
+func lookupReport(c *gin.Context, email string) *LeakResponse {
+	if scheduler == nil {
+		leakData, err := LookupHIBP(c.Request.Context(), email)
+		if err != nil {
+			respondLookupError(c, err)
+			return nil
+		}
+		return leakData
+	}
+
+	job, err := scheduler.Submit(middleware.MustUserID(c), email, PriorityInteractive)
+	if errors.Is(err, ErrQueueFull) {
+		c.Header("Retry-After", retryAfterSeconds(scheduler.Config().InteractiveWait))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error(), "code": "rate_limited"})
+		return nil
+	}
+
+	timer := time.NewTimer(scheduler.Config().InteractiveWait)
+	defer timer.Stop()
+	select {
+	case <-job.Done():
+	case <-timer.C:
+	case <-c.Request.Context().Done():
+	}
+
+	select {
+	case <-job.Done():
+		return jobResult(c, job)
+	default:
+		respondQueued(c, job)
+		return nil
+	}
+}
+
+// jobResult returns a copy of a finished job's report, so callers that
+// enrich it don't share it with other pollers
+func jobResult(c *gin.Context, job *Job) *LeakResponse {
+	leakData, err := job.Result()
+	if err != nil {
+		respondLookupError(c, err)
+		return nil
+	}
+	return copyReport(leakData)
+}
+
+func copyReport(leakData *LeakResponse) *LeakResponse {
+	copied := *leakData
+	copied.LeakedData = append([]LeakSource(nil), leakData.LeakedData...)
+	return &copied
+}
+
+func respondLookupError(c *gin.Context, err error) {
+	fmt.Printf("HIBP API error: %v\n", err)
+	status := http.StatusInternalServerError
+	if errors.Is(err, ErrNotConfigured) {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{"error": fmt.Sprintf("Failed to check email: %v", err)})
+}
+
+// respondQueued answers 202 with the job's place in line and where to
+// fetch the result. A breach_check_complete WebSocket event follows when it
+// is ready.
+func respondQueued(c *gin.Context, job *Job) {
+	status := scheduler.Status(job)
+	c.Header("Retry-After", retryAfterSeconds(status.EstimatedWait))
+	c.JSON(http.StatusAccepted, gin.H{
+		"status":            "queued",
+		"job_id":            job.ID,
+		"position":          status.Position,
+		"estimated_wait_ms": status.EstimatedWait.Milliseconds(),
+		"poll_url":          "/api/v1/breach/checks/" + job.ID,
+	})
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds, at least one
+func retryAfterSeconds(wait time.Duration) string {
+	seconds := int64((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+// GetCheck polls a queued breach check: 202 while it waits, then the
+// report. Results are kept for the scheduler's ResultTTL.
+func GetCheck(c *gin.Context) {
+	if scheduler == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrJobNotFound.Error()})
+		return
+	}
+
+	job, err := scheduler.Job(middleware.MustUserID(c), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+
+	select {
+	case <-job.Done():
+		if leakData := jobResult(c, job); leakData != nil {
+			c.JSON(http.StatusOK, leakData)
+		}
+	default:
+		respondQueued(c, job)
+	}
+}
@@ -0,0 +1,465 @@
+package breach
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/google/uuid"
+)
+
+// Metrics of the HIBP scheduler
+const (
+	MetricHIBPQueueDepth    = "hibp_queue_depth"    // Gauge: lookups waiting
+	MetricHIBPQueueRejected = "hibp_queue_rejected" // Lookups refused with ErrQueueFull
+	MetricHIBPRequests      = "hibp_requests"       // Requests sent upstream
+	MetricHIBPUpstream429   = "hibp_upstream_429"   // Upstream answered 429
+	MetricHIBPQueueWait     = "hibp_queue_wait"     // Time from submit to result
+)
+
+// Priority orders queued lookups. Interactive checks go ahead of
+// background re-checks.
+type Priority int
+
+const (
+	PriorityInteractive Priority = iota
+	PriorityBackground
+	numPriorities
+)
+
+var (
+	ErrQueueFull   = errors.New("too many breach checks queued, try again later")
+	ErrJobNotFound = errors.New("breach check not found")
+)
+
+// RateLimitedError is an upstream 429. The scheduler pauses for RetryAfter
+// and tries the lookup again.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("HIBP rate limit exceeded, retry after %v", e.RetryAfter)
+}
+
+// SchedulerConfig sizes the scheduler to the HIBP plan. The rate is per
+// instance: split the plan's rate between instances that share the key.
+type SchedulerConfig struct {
+	RatePerMinute    int           // Requests per minute the plan allows
+	Burst            int           // Requests sent back to back after a quiet spell
+	MaxQueued        int           // Lookups waiting across all users
+	MaxQueuedPerUser int           // Lookups one user may have waiting
+	InteractiveWait  time.Duration // How long a request waits before answering 202
+	ResultTTL        time.Duration // How long finished lookups can be polled
+}
+
+// DefaultSchedulerConfig matches the entry-level HIBP plan (10 requests a
+// minute)
+var DefaultSchedulerConfig = SchedulerConfig{
+	RatePerMinute:    10,
+	Burst:            1,
+	MaxQueued:        1000,
+	MaxQueuedPerUser: 10,
+	InteractiveWait:  2 * time.Second,
+	ResultTTL:        10 * time.Minute,
+}
+
+// LookupFunc fetches one email's breach report from upstream
+type LookupFunc func(ctx context.Context, email string) (*LeakResponse, error)
+
+// Job is one queued lookup
+type Job struct {
+	ID       string
+	UserID   string
+	Email    string
+	Priority Priority
+
+	queuedAt   time.Time
+	finishedAt time.Time
+	done       chan struct{}
+	result     *LeakResponse
+	err        error
+}
+
+// Done is closed once the lookup finished
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Result returns the lookup's outcome; only valid after Done is closed
+func (j *Job) Result() (*LeakResponse, error) {
+	return j.result, j.err
+}
+
+// JobStatus is a queued job's place in line
+type JobStatus struct {
+	Position      int // Lookups that run before this one
+	EstimatedWait time.Duration
+}
+
+// Scheduler sends HIBP lookups upstream no faster than the plan allows. The
+// next lookup comes from the highest priority with work, and within a
+// priority users take turns, so one user's burst can't starve the others.
+type Scheduler struct {
+	cfg      SchedulerConfig
+	lookup   LookupFunc
+	clock    clock.Clock
+	interval time.Duration
+
+	mu          sync.Mutex
+	queues      [numPriorities]*userQueues
+	jobs        map[string]*Job
+	queued      int
+	tokens      float64
+	refilled    time.Time
+	pausedUntil time.Time
+	onComplete  func(*Job)
+
+	wake chan struct{}
+}
+
+func NewScheduler(cfg SchedulerConfig, lookup LookupFunc) *Scheduler {
+	if cfg.RatePerMinute <= 0 {
+		cfg.RatePerMinute = DefaultSchedulerConfig.RatePerMinute
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = 1
+	}
+	s := &Scheduler{
+		cfg:      cfg,
+		lookup:   lookup,
+		clock:    clock.System,
+		interval: time.Minute / time.Duration(cfg.RatePerMinute),
+		jobs:     make(map[string]*Job),
+		tokens:   float64(cfg.Burst),
+		refilled: clock.System.Now(),
+		wake:     make(chan struct{}, 1),
+	}
+	for i := range s.queues {
+		s.queues[i] = newUserQueues()
+	}
+	return s
+}
+
+// SetClock replaces the system clock; for tests. The bucket starts full.
+func (s *Scheduler) SetClock(c clock.Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = c
+	s.refilled = c.Now()
+}
+
+// Config returns the scheduler's configuration
+func (s *Scheduler) Config() SchedulerConfig {
+	return s.cfg
+}
+
+// OnComplete registers a callback run after every finished lookup
+func (s *Scheduler) OnComplete(fn func(*Job)) {
+	s.mu.Lock()
+	s.onComplete = fn
+	s.mu.Unlock()
+}
+
+// Submit queues a lookup. A user who already has the same email queued gets
+// that job back. It returns ErrQueueFull when the user or the whole queue
+// is at its cap.
+func (s *Scheduler) Submit(userID, email string, priority Priority) (*Job, error) {
+	if priority < 0 || priority >= numPriorities {
+		priority = PriorityBackground
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	userQueued := 0
+	for _, q := range s.queues {
+		for _, job := range q.pending[userID] {
+			if job.Email == email {
+				return job, nil
+			}
+			userQueued++
+		}
+	}
+	if userQueued >= s.cfg.MaxQueuedPerUser || s.queued >= s.cfg.MaxQueued {
+		metrics.Inc(MetricHIBPQueueRejected)
+		return nil, ErrQueueFull
+	}
+
+	job := &Job{
+		ID:       uuid.NewString(),
+		UserID:   userID,
+		Email:    email,
+		Priority: priority,
+		queuedAt: s.clock.Now(),
+		done:     make(chan struct{}),
+	}
+	s.jobs[job.ID] = job
+	s.queues[priority].push(job)
+	s.queued++
+	metrics.Set(MetricHIBPQueueDepth, int64(s.queued))
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Job returns one of the user's queued or recently finished lookups
+func (s *Scheduler) Job(userID, id string) (*Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok || job.UserID != userID {
+		return nil, ErrJobNotFound
+	}
+	return job, nil
+}
+
+// Status estimates when a queued job runs. Lookups submitted later at a
+// higher priority can still move ahead of it.
+func (s *Scheduler) Status(job *Job) JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	s.refill(now)
+
+	position := -1
+	for i, queued := range s.order() {
+		if queued == job {
+			position = i
+			break
+		}
+	}
+	if position < 0 {
+		// Running or finished
+		return JobStatus{}
+	}
+
+	// Tokens needed before this job's turn, plus any upstream pause
+	var wait time.Duration
+	if needed := float64(position+1) - s.tokens; needed > 0 {
+		wait = time.Duration(needed * float64(s.interval))
+	}
+	if s.pausedUntil.After(now) {
+		wait += s.pausedUntil.Sub(now)
+	}
+	return JobStatus{Position: position, EstimatedWait: wait}
+}
+
+// Run sends queued lookups upstream until ctx is cancelled
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		job, wait := s.next()
+		if job != nil {
+			s.execute(ctx, job)
+			continue
+		}
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-s.wake:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// next takes the job whose turn it is if the rate allows a request now.
+// Otherwise it returns how long to wait, 0 meaning until a submit.
+func (s *Scheduler) next() (*Job, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	s.refill(now)
+	s.expire(now)
+
+	if s.queued == 0 {
+		return nil, 0
+	}
+	if s.pausedUntil.After(now) {
+		return nil, s.pausedUntil.Sub(now)
+	}
+	if s.tokens < 1 {
+		return nil, time.Duration((1 - s.tokens) * float64(s.interval))
+	}
+
+	for _, q := range s.queues {
+		if job := q.pop(); job != nil {
+			s.tokens--
+			s.queued--
+			metrics.Set(MetricHIBPQueueDepth, int64(s.queued))
+			return job, 0
+		}
+	}
+	return nil, 0
+}
+
+func (s *Scheduler) execute(ctx context.Context, job *Job) {
+	metrics.Inc(MetricHIBPRequests)
+	result, err := s.lookup(ctx, job.Email)
+
+	var limited *RateLimitedError
+	if errors.As(err, &limited) && ctx.Err() == nil {
+		metrics.Inc(MetricHIBPUpstream429)
+		s.requeue(job, limited.RetryAfter)
+		return
+	}
+
+	s.mu.Lock()
+	job.result, job.err = result, err
+	job.finishedAt = s.clock.Now()
+	onComplete := s.onComplete
+	s.mu.Unlock()
+
+	metrics.Observe(MetricHIBPQueueWait, job.finishedAt.Sub(job.queuedAt))
+	close(job.done)
+	if onComplete != nil {
+		onComplete(job)
+	}
+}
+
+// requeue puts a rate-limited job back at the head of its user's line and
+// stops all requests for the upstream's Retry-After (one interval if it
+// gave none)
+func (s *Scheduler) requeue(job *Job, retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = s.interval
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pausedUntil = s.clock.Now().Add(retryAfter)
+	s.tokens = 0
+	s.queues[job.Priority].pushFront(job)
+	s.queued++
+	metrics.Set(MetricHIBPQueueDepth, int64(s.queued))
+}
+
+// refill adds the tokens earned since the last refill, up to the burst
+func (s *Scheduler) refill(now time.Time) {
+	if elapsed := now.Sub(s.refilled); elapsed > 0 {
+		s.tokens += float64(elapsed) / float64(s.interval)
+		if s.tokens > float64(s.cfg.Burst) {
+			s.tokens = float64(s.cfg.Burst)
+		}
+	}
+	s.refilled = now
+}
+
+// expire forgets finished jobs nobody polled within the result TTL
+func (s *Scheduler) expire(now time.Time) {
+	for id, job := range s.jobs {
+		if !job.finishedAt.IsZero() && now.Sub(job.finishedAt) > s.cfg.ResultTTL {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// order lists the queued jobs in the order they will run
+func (s *Scheduler) order() []*Job {
+	var jobs []*Job
+	for _, q := range s.queues {
+		jobs = append(jobs, q.order()...)
+	}
+	return jobs
+}
+
+// userQueues holds one priority's jobs as a line per user; users take
+// turns in the order they first queued
+type userQueues struct {
+	users   []string
+	next    int
+	pending map[string][]*Job
+}
+
+func newUserQueues() *userQueues {
+	return &userQueues{pending: make(map[string][]*Job)}
+}
+
+func (q *userQueues) push(job *Job) {
+	if _, ok := q.pending[job.UserID]; !ok {
+		q.users = append(q.users, job.UserID)
+	}
+	q.pending[job.UserID] = append(q.pending[job.UserID], job)
+}
+
+// pushFront puts a job back first in its user's line, and that user next
+// in turn
+func (q *userQueues) pushFront(job *Job) {
+	if _, ok := q.pending[job.UserID]; !ok {
+		if q.next > len(q.users) {
+			q.next = len(q.users)
+		}
+		q.users = append(q.users[:q.next], append([]string{job.UserID}, q.users[q.next:]...)...)
+	} else {
+		for i, user := range q.users {
+			if user == job.UserID {
+				q.next = i
+				break
+			}
+		}
+	}
+	q.pending[job.UserID] = append([]*Job{job}, q.pending[job.UserID]...)
+}
+
+func (q *userQueues) pop() *Job {
+	if len(q.users) == 0 {
+		return nil
+	}
+	if q.next >= len(q.users) {
+		q.next = 0
+	}
+
+	user := q.users[q.next]
+	line := q.pending[user]
+	job := line[0]
+	if len(line) == 1 {
+		delete(q.pending, user)
+		q.users = append(q.users[:q.next], q.users[q.next+1:]...)
+	} else {
+		q.pending[user] = line[1:]
+		q.next++
+	}
+	return job
+}
+
+// order is the sequence pop would produce
+func (q *userQueues) order() []*Job {
+	taken := make(map[string]int, len(q.users))
+	var jobs []*Job
+	for remaining := len(q.users); remaining > 0; {
+		remaining = 0
+		for i := range q.users {
+			user := q.users[(q.next+i)%len(q.users)]
+			if line := q.pending[user]; taken[user] < len(line) {
+				jobs = append(jobs, line[taken[user]])
+				taken[user]++
+				if taken[user] < len(line) {
+					remaining++
+				}
+			}
+		}
+	}
+	return jobs
+}
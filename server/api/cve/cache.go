@@ -0,0 +1,85 @@
+package cve
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCacheTTL is how long a search is answered from the cache. The NVD
+// publishes and rescores CVEs throughout the day, so it is short.
+const DefaultCacheTTL = time.Hour
+
+// Cache stores search results. The server sets the breach package's cache,
+// so they land in Redis, sealed, next to breach reports.
+type Cache interface {
+	Get(key string) (string, bool, error)
+	Set(key string, data []byte, ttl time.Duration) error
+}
+
+var (
+	// cache holds search results; nil sends every search upstream
+	cache    Cache
+	cacheTTL = DefaultCacheTTL
+)
+
+// SetCache sets where search results are cached
+func SetCache(c Cache) {
+	cache = c
+}
+
+// SetCacheTTL sets how long search results are cached; 0 restores the default
+func SetCacheTTL(ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	cacheTTL = ttl
+}
+
+// NormalizeKeyword is the form of a keyword searches are cached under:
+// trimmed, lowercased and with runs of whitespace collapsed, so "OpenSSL "
+// and "openssl" share one NVD call. The NVD's keyword search ignores case.
+func NormalizeKeyword(keyword string) string {
+	return strings.ToLower(strings.Join(strings.Fields(keyword), " "))
+}
+
+// SearchCacheKey is the cache key of one page of a search
+func SearchCacheKey(keyword string, limit, startIndex int) string {
+	return "cve:search:v1:" + strconv.Itoa(limit) + ":" + strconv.Itoa(startIndex) + ":" + NormalizeKeyword(keyword)
+}
+
+// getCachedSearch returns a cached page, nil on a miss. Cache errors are
+// logged and treated as misses: the NVD can always be asked again.
+func getCachedSearch(key string) *CVEResponse {
+	if cache == nil {
+		return nil
+	}
+	val, ok, err := cache.Get(key)
+	if err != nil {
+		fmt.Printf("CVE cache error (non-fatal): %v\n", err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	var resp CVEResponse
+	if err := json.Unmarshal([]byte(val), &resp); err != nil {
+		return nil
+	}
+	return &resp
+}
+
+func cacheSearch(key string, resp *CVEResponse) {
+	if cache == nil {
+		return
+	}
+	data, err := json.Marshal(resp)
+	if err == nil {
+		err = cache.Set(key, data, cacheTTL)
+	}
+	if err != nil {
+		fmt.Printf("Failed to cache CVE search (non-fatal): %v\n", err)
+	}
+}
@@ -0,0 +1,155 @@
+package cve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/metrics"
+)
+
+// DefaultNISTURL is the NVD CVE API
+const DefaultNISTURL = "https://services.nvd.nist.gov/rest/json/cves/2.0"
+
+// DefaultCPEURL is the NVD CPE API, naming the products CVEs apply to
+const DefaultCPEURL = "https://services.nvd.nist.gov/rest/json/cpes/2.0"
+
+// ErrNotConfigured is a lookup made before SetClient
+var ErrNotConfigured = errors.New("CVE lookups are not configured")
+
+// ClientConfig is how to reach the NVD CVE API
+type ClientConfig struct {
+	BaseURL    string       // DefaultNISTURL when empty
+	CPEURL     string       // DefaultCPEURL when empty
+	APIKey     string       // Required
+	HTTPClient *http.Client // A client with a 10s timeout when nil
+	Limiter    *Limiter     // A limiter of its own with DefaultLimiterConfig when nil
+}
+
+// CVEClient calls the NVD CVE API with the deployment's own key. Every
+// request waits on its limiter, and one the upstream rate limits is retried
+// once the limiter's pause is over.
+type CVEClient struct {
+	baseURL string
+	cpeURL  string
+	apiKey  string
+	http    *http.Client
+	limiter *Limiter
+}
+
+// NewCVEClient returns a client for cfg. It refuses a config without an API
+// key: every deployment brings its own.
+func NewCVEClient(cfg ClientConfig) (*CVEClient, error) {
+	if cfg.APIKey == "" {
+		return nil, errors.New("an NVD API key is required (NIST_API_KEY); request one at https://nvd.nist.gov/developers/request-an-api-key")
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = DefaultNISTURL
+	}
+	if cfg.CPEURL == "" {
+		cfg.CPEURL = DefaultCPEURL
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if cfg.Limiter == nil {
+		cfg.Limiter = NewLimiter(DefaultLimiterConfig)
+	}
+	return &CVEClient{baseURL: cfg.BaseURL, cpeURL: cfg.CPEURL, apiKey: cfg.APIKey, http: cfg.HTTPClient, limiter: cfg.Limiter}, nil
+}
+
+// StatusError is an answer other than 200 from the API
+type StatusError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration // From the Retry-After header, if any
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("API returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// RateLimited reports whether the API refused the request for its rate:
+// the NVD answers 403 when over it, and 429 in front of its gateway
+func (e *StatusError) RateLimited() bool {
+	return e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Get queries the CVE API and decodes its answer into out. A rate limited
+// request pauses the limiter, for the upstream's Retry-After or a jittered
+// backoff, and is retried up to the limiter's MaxRetries; after that its
+// *StatusError is returned.
+func (c *CVEClient) Get(ctx context.Context, query url.Values, out interface{}) error {
+	return c.query(ctx, c.baseURL, query, out)
+}
+
+// GetCPEs queries the CPE API as Get does the CVE API, on the same key and
+// limiter
+func (c *CVEClient) GetCPEs(ctx context.Context, query url.Values, out interface{}) error {
+	return c.query(ctx, c.cpeURL, query, out)
+}
+
+func (c *CVEClient) query(ctx context.Context, base string, query url.Values, out interface{}) error {
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.Wait(ctx); err != nil {
+			return err
+		}
+		metrics.Inc(MetricNISTRequests)
+		err := c.get(ctx, base, query, out)
+
+		var status *StatusError
+		if !errors.As(err, &status) || !status.RateLimited() {
+			return err
+		}
+		metrics.Inc(MetricNISTRateLimited)
+		if attempt >= c.limiter.Config().MaxRetries {
+			return err
+		}
+		wait := status.RetryAfter
+		if wait <= 0 {
+			wait = c.limiter.backoff(attempt)
+		}
+		c.limiter.Pause(wait)
+	}
+}
+
+func (c *CVEClient) get(ctx context.Context, base string, query url.Values, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apiKey", c.apiKey)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		status := &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			status.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return status
+	}
+	return json.Unmarshal(body, out)
+}
+
+// client serves the handlers; nil until SetClient
+var client *CVEClient
+
+// SetClient sets the client the handlers query
+func SetClient(c *CVEClient) {
+	client = c
+}
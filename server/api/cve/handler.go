@@ -1,44 +1,24 @@
 package cve
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-const (
-	NISTAPIKEY = "db4b1c7e-5a24-4d08-9a95-97f177070b43"
-	NISTAPIURL = "https://services.nvd.nist.gov/rest/json/cves/2.0"
-)
-
-type CVEMetric struct {
-	CVSSV3 struct {
-		BaseScore    float64 `json:"baseScore"`
-		BaseSeverity string  `json:"baseSeverity"`
-	} `json:"cvssV3"`
-}
-
-type CVEItem struct {
-	ID          string `json:"id"`
-	Description string `json:"description"`
-	Published   string `json:"published"`
-	Modified    string `json:"lastModified"`
-	Metrics     struct {
-		CVSSMetricV31 []CVEMetric `json:"cvssMetricV31"`
-	} `json:"metrics"`
-}
-
-type CVEResponse struct {
-	TotalResults int       `json:"totalResults"`
-	CVEs         []CVEItem `json:"vulnerabilities"`
-}
+// MaxResultsPerPage is the largest page the NVD serves
+const MaxResultsPerPage = 2000
 
 type SearchCVERequest struct {
-	Keyword string `json:"keyword"`
-	Limit   int    `json:"limit"`
+	Keyword    string `json:"keyword"`
+	Limit      int    `json:"limit"`
+	StartIndex int    `json:"start_index"` // Offset of the page in the NVD's results
 }
 
 // SearchCVEs searches for CVEs using NIST API
@@ -52,11 +32,14 @@ func SearchCVEs(c *gin.Context) {
 	if req.Limit == 0 {
 		req.Limit = 10
 	}
+	if !validPage(c, req.Limit, req.StartIndex) {
+		return
+	}
 
 	// Call NIST API
-	cveData, err := callNISTAPI(req.Keyword, req.Limit)
+	cveData, err := searchNIST(c.Request.Context(), req.Keyword, req.Limit, req.StartIndex)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to search CVEs: %v", err)})
+		respondNISTError(c, "search CVEs", err)
 		return
 	}
 
@@ -65,58 +48,91 @@ func SearchCVEs(c *gin.Context) {
 
 // GetLatestCVEs gets the latest CVEs
 func GetLatestCVEs(c *gin.Context) {
-	limit := 20
-	if limitParam := c.Query("limit"); limitParam != "" {
-		fmt.Sscanf(limitParam, "%d", &limit)
+	limit, startIndex := 20, 0
+	for param, value := range map[string]*int{"limit": &limit, "start_index": &startIndex} {
+		if raw := c.Query(param); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be a number", param)})
+				return
+			}
+			*value = n
+		}
+	}
+	if !validPage(c, limit, startIndex) {
+		return
 	}
 
-	cveData, err := callNISTAPI("", limit)
+	cveData, err := searchNIST(c.Request.Context(), "", limit, startIndex)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to get CVEs: %v", err)})
+		respondNISTError(c, "get CVEs", err)
 		return
 	}
 
 	c.JSON(http.StatusOK, cveData)
 }
 
-func callNISTAPI(keyword string, limit int) (map[string]interface{}, error) {
-	url := fmt.Sprintf("%s?resultsPerPage=%d", NISTAPIURL, limit)
-
-	if keyword != "" {
-		url += fmt.Sprintf("&keywordSearch=%s", keyword)
+// validPage answers 400 to a page the NVD would refuse
+func validPage(c *gin.Context, limit, startIndex int) bool {
+	if limit < 1 || limit > MaxResultsPerPage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", MaxResultsPerPage)})
+		return false
 	}
-
-	// Create HTTP request
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
+	if startIndex < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "start_index must not be negative"})
+		return false
 	}
+	return true
+}
 
-	req.Header.Set("apiKey", NISTAPIKEY)
+// searchNIST returns a page of the CVEs matching keyword, all CVEs when it
+// is empty, from the cache or the NVD
+func searchNIST(ctx context.Context, keyword string, limit, startIndex int) (*CVEResponse, error) {
+	key := SearchCacheKey(keyword, limit, startIndex)
+	if cached := getCachedSearch(key); cached != nil {
+		return cached, nil
+	}
+	if client == nil {
+		return nil, ErrNotConfigured
+	}
 
-	// Send request
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	query := url.Values{
+		"resultsPerPage": {strconv.Itoa(limit)},
+		"startIndex":     {strconv.Itoa(startIndex)},
+	}
+	if keyword := NormalizeKeyword(keyword); keyword != "" {
+		query.Set("keywordSearch", keyword)
 	}
-	defer resp.Body.Close()
 
-	// Read response
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
+	var result CVEResponse
+	if err := client.Get(ctx, query, &result); err != nil {
 		return nil, err
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API returned status %d: %s", resp.StatusCode, string(body))
+	if result.Vulnerabilities == nil {
+		result.Vulnerabilities = []Vulnerability{}
 	}
+	cacheSearch(key, &result)
+	return &result, nil
+}
 
-	// Parse response
-	var result map[string]interface{}
-	if err := json.Unmarshal(body, &result); err != nil {
-		return nil, err
+// respondNISTError answers 429 while the NVD rate limits us, telling the
+// client when to retry, 503 when lookups are not configured and 500
+// otherwise
+func respondNISTError(c *gin.Context, what string, err error) {
+	var status *StatusError
+	if errors.As(err, &status) && status.RateLimited() {
+		wait := status.RetryAfter
+		if wait <= 0 {
+			wait = client.limiter.Config().Backoff
+		}
+		c.Header("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "the NVD is rate limiting CVE lookups, try again later", "code": "rate_limited"})
+		return
 	}
 
-	return result, nil
+	code := http.StatusInternalServerError
+	if errors.Is(err, ErrNotConfigured) {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, gin.H{"error": fmt.Sprintf("Failed to %s: %v", what, err)})
 }
@@ -0,0 +1,178 @@
+package cve
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+)
+
+// Metrics of the NVD rate limiter
+const (
+	MetricNISTRequests    = "nist_requests"     // Requests sent upstream
+	MetricNISTRateLimited = "nist_rate_limited" // Upstream answered 403 or 429
+	MetricNISTThrottled   = "nist_throttled"    // Time requests waited for the limiter
+)
+
+// LimiterConfig sizes the limiter to the NVD's rate. The rate is per
+// instance: split it between instances that share the key.
+type LimiterConfig struct {
+	Requests   int           // Requests allowed per Window
+	Window     time.Duration // 30s at the NVD
+	Burst      int           // Requests sent back to back after a quiet spell
+	MaxRetries int           // Retries of a request the upstream rate limited
+	Backoff    time.Duration // First wait after a rate limit without Retry-After; doubles per retry
+}
+
+// DefaultLimiterConfig matches the NVD's rate with an API key: 50 requests
+// in a rolling 30 seconds
+var DefaultLimiterConfig = LimiterConfig{
+	Requests:   50,
+	Window:     30 * time.Second,
+	Burst:      5,
+	MaxRetries: 3,
+	Backoff:    6 * time.Second,
+}
+
+// Limiter is a token bucket every NVD request waits on. One limiter serves
+// the whole process (the CVE endpoints and breach enrichment share the
+// client holding it), and a rate limit answered upstream pauses it for
+// every caller.
+type Limiter struct {
+	cfg      LimiterConfig
+	interval time.Duration
+	clock    clock.Clock
+	sleep    func(ctx context.Context, d time.Duration) error
+
+	mu          sync.Mutex
+	tokens      float64
+	refilled    time.Time
+	pausedUntil time.Time
+}
+
+func NewLimiter(cfg LimiterConfig) *Limiter {
+	if cfg.Requests <= 0 {
+		cfg.Requests = DefaultLimiterConfig.Requests
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = DefaultLimiterConfig.Window
+	}
+	if cfg.Burst <= 0 {
+		cfg.Burst = 1
+	}
+	if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = DefaultLimiterConfig.Backoff
+	}
+	return &Limiter{
+		cfg:      cfg,
+		interval: cfg.Window / time.Duration(cfg.Requests),
+		clock:    clock.System,
+		sleep:    sleepContext,
+		tokens:   float64(cfg.Burst),
+		refilled: clock.System.Now(),
+	}
+}
+
+// SetClock replaces the system clock and sleep replaces waiting on timers;
+// for tests. The bucket starts full.
+func (l *Limiter) SetClock(c clock.Clock, sleep func(ctx context.Context, d time.Duration) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = c
+	l.sleep = sleep
+	l.tokens = float64(l.cfg.Burst)
+	l.refilled = c.Now()
+}
+
+// Config returns the limiter's configuration
+func (l *Limiter) Config() LimiterConfig {
+	return l.cfg
+}
+
+// Wait blocks until a request may be sent, or ctx is done
+func (l *Limiter) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var waited time.Duration
+	for {
+		wait := l.reserve()
+		if wait <= 0 {
+			if waited > 0 {
+				metrics.Observe(MetricNISTThrottled, waited)
+			}
+			return nil
+		}
+		if err := l.sleep(ctx, wait); err != nil {
+			return err
+		}
+		waited += wait
+	}
+}
+
+// reserve takes a token if one is free, otherwise returns how long until
+// one may be
+func (l *Limiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	l.refill(now)
+	if l.pausedUntil.After(now) {
+		return l.pausedUntil.Sub(now)
+	}
+	if l.tokens < 1 {
+		return time.Duration((1 - l.tokens) * float64(l.interval))
+	}
+	l.tokens--
+	return 0
+}
+
+// Pause stops every request for d, after the upstream rate limited one
+func (l *Limiter) Pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	l.refill(now)
+	if until := now.Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	l.tokens = 0
+}
+
+// backoff is the wait before retry attempt (0 for the first retry) when the
+// upstream gave no Retry-After: Backoff doubled per attempt plus up to half
+// again of jitter, so instances limited together don't retry together
+func (l *Limiter) backoff(attempt int) time.Duration {
+	wait := l.cfg.Backoff << attempt
+	return wait + rand.N(wait/2+1)
+}
+
+// refill adds the tokens earned since the last refill, up to the burst
+func (l *Limiter) refill(now time.Time) {
+	if elapsed := now.Sub(l.refilled); elapsed > 0 {
+		l.tokens += float64(elapsed) / float64(l.interval)
+		if l.tokens > float64(l.cfg.Burst) {
+			l.tokens = float64(l.cfg.Burst)
+		}
+	}
+	l.refilled = now
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
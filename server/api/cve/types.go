@@ -0,0 +1,112 @@
+package cve
+
+import "strings"
+
+// CVEResponse is a page of the NVD CVE API 2.0, in its own field names
+type CVEResponse struct {
+	ResultsPerPage  int             `json:"resultsPerPage"`
+	StartIndex      int             `json:"startIndex"`
+	TotalResults    int             `json:"totalResults"`
+	Timestamp       string          `json:"timestamp,omitempty"`
+	Vulnerabilities []Vulnerability `json:"vulnerabilities"`
+}
+
+type Vulnerability struct {
+	CVE CVEItem `json:"cve"`
+}
+
+type CVEItem struct {
+	ID           string        `json:"id"`
+	Published    string        `json:"published"`
+	LastModified string        `json:"lastModified"`
+	VulnStatus   string        `json:"vulnStatus,omitempty"`
+	Descriptions []Description `json:"descriptions"`
+	Metrics      Metrics       `json:"metrics"`
+	References   []Reference   `json:"references,omitempty"`
+}
+
+type Description struct {
+	Lang  string `json:"lang"`
+	Value string `json:"value"`
+}
+
+type Reference struct {
+	URL    string `json:"url"`
+	Source string `json:"source,omitempty"`
+}
+
+// Metrics holds a CVE's CVSS scores, one list per CVSS version
+type Metrics struct {
+	CVSSMetricV31 []CVSSMetric `json:"cvssMetricV31,omitempty"`
+	CVSSMetricV30 []CVSSMetric `json:"cvssMetricV30,omitempty"`
+	CVSSMetricV2  []CVSSMetric `json:"cvssMetricV2,omitempty"`
+}
+
+type CVSSMetric struct {
+	Source       string   `json:"source,omitempty"`
+	Type         string   `json:"type,omitempty"` // Primary or Secondary
+	CVSSData     CVSSData `json:"cvssData"`
+	BaseSeverity string   `json:"baseSeverity,omitempty"` // CVSS v2 only; v3 has it in CVSSData
+}
+
+type CVSSData struct {
+	Version      string  `json:"version"`
+	VectorString string  `json:"vectorString,omitempty"`
+	BaseScore    float64 `json:"baseScore"`
+	BaseSeverity string  `json:"baseSeverity,omitempty"`
+}
+
+// CPEResponse is a page of the NVD CPE API 2.0
+type CPEResponse struct {
+	ResultsPerPage int          `json:"resultsPerPage"`
+	StartIndex     int          `json:"startIndex"`
+	TotalResults   int          `json:"totalResults"`
+	Products       []CPEProduct `json:"products"`
+}
+
+type CPEProduct struct {
+	CPE CPEName `json:"cpe"`
+}
+
+type CPEName struct {
+	CPEName    string `json:"cpeName"` // e.g. cpe:2.3:a:canva:canva:1.0:*:*:*:*:*:*:*
+	CPENameID  string `json:"cpeNameId"`
+	Deprecated bool   `json:"deprecated"`
+}
+
+// Description returns the English description, "" if there is none
+func (c CVEItem) Description() string {
+	for _, d := range c.Descriptions {
+		if d.Lang == "en" {
+			return d.Value
+		}
+	}
+	return ""
+}
+
+// Score returns the CVE's base score and severity (CRITICAL, HIGH, MEDIUM,
+// LOW), from CVSS v3.1, else v3.0, else v2; UNKNOWN when it is unscored
+func (c CVEItem) Score() (float64, string) {
+	for _, metrics := range [][]CVSSMetric{c.Metrics.CVSSMetricV31, c.Metrics.CVSSMetricV30} {
+		if len(metrics) > 0 {
+			return metrics[0].CVSSData.BaseScore, strings.ToUpper(metrics[0].CVSSData.BaseSeverity)
+		}
+	}
+	if len(c.Metrics.CVSSMetricV2) > 0 {
+		metric := c.Metrics.CVSSMetricV2[0]
+		score, severity := metric.CVSSData.BaseScore, metric.BaseSeverity
+		// CVSS v2 has no CRITICAL; derive a label when the NVD gave none
+		if severity == "" {
+			switch {
+			case score >= 7.0:
+				severity = "HIGH"
+			case score >= 4.0:
+				severity = "MEDIUM"
+			default:
+				severity = "LOW"
+			}
+		}
+		return score, strings.ToUpper(severity)
+	}
+	return 0, "UNKNOWN"
+}
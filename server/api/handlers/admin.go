@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+type AdminHandler struct {
+	store  storage.Store
+	runner *jobs.Runner
+	hub    *websocket.Hub
+	clock  clock.Clock
+
+	inactivity *jobs.AccountInactivityJob
+}
+
+func NewAdminHandler(store storage.Store, runner *jobs.Runner) *AdminHandler {
+	return &AdminHandler{store: store, runner: runner, clock: clock.System}
+}
+
+// SetClock replaces the clock used for event timestamps
+func (h *AdminHandler) SetClock(c clock.Clock) {
+	h.clock = c
+}
+
+// SetHub sets the WebSocket hub so repairs can notify the user's devices
+// and deactivation or token revocation closes their connections
+func (h *AdminHandler) SetHub(hub *websocket.Hub) {
+	h.hub = hub
+}
+
+type RunJobRequest struct {
+	DryRun     bool   `json:"dry_run"`
+	UserID     string `json:"user_id"`
+	SampleSize int    `json:"sample_size"`
+}
+
+// ListJobs returns the names of the registered maintenance jobs
+func (h *AdminHandler) ListJobs(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"jobs": h.runner.Jobs()})
+}
+
+// RunJob runs a maintenance job. With dry_run=true it reports per-user counts
+// and sample item UUIDs of what would be affected without changing anything.
+func (h *AdminHandler) RunJob(c *gin.Context) {
+	h.runJob(c, c.Param("name"))
+}
+
+// Compact purges tombstones past the retention window, taking the same
+// body as RunJob; user_id limits it to one account
+func (h *AdminHandler) Compact(c *gin.Context) {
+	h.runJob(c, jobs.TombstonePurgeJobName)
+}
+
+func (h *AdminHandler) runJob(c *gin.Context, name string) {
+	var req RunJobRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if c.Query("dry_run") == "true" {
+		req.DryRun = true
+	}
+
+	report, err := h.runner.Run(c.Request.Context(), name, jobs.RunOptions{
+		DryRun:     req.DryRun,
+		UserID:     req.UserID,
+		SampleSize: req.SampleSize,
+	})
+	if errors.Is(err, jobs.ErrUnknownJob) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// ListJobReports returns recent persisted job reports (optionally ?job=name)
+func (h *AdminHandler) ListJobReports(c *gin.Context) {
+	limit := 50
+	if limitParam := c.Query("limit"); limitParam != "" {
+		if parsed, err := strconv.Atoi(limitParam); err == nil && parsed > 0 && parsed <= 500 {
+			limit = parsed
+		}
+	}
+
+	rows, err := h.store.ListJobReports(c.Query("job"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	reports := make([]*jobs.Report, 0, len(rows))
+	for _, row := range rows {
+		report, err := jobs.ReportFromStorage(row)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		reports = append(reports, report)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reports": reports})
+}
+
+func (h *AdminHandler) GetJobReport(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid report id"})
+		return
+	}
+
+	row, err := h.store.GetJobReport(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "report not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	report, err := jobs.ReportFromStorage(row)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// RepairManifest recomputes a user's manifest digest from their live sync
+// items and, if it drifted from sync_state, rewrites it. Connected devices
+// are told to re-check their manifest.
+func (h *AdminHandler) RepairManifest(c *gin.Context) {
+	userID := c.Param("id")
+	zone := c.DefaultQuery("zone", "default")
+
+	if _, err := h.store.GetUserByID(userID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	check, err := jobs.CheckManifest(c.Request.Context(), h.store, userID, zone, true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "check": check})
+		return
+	}
+
+	if check.Repaired {
+		event := newAuditEvent(c, userID, service.AuditActionManifestFix)
+		event.Zone = &zone
+		event.Details = auditDetails(gin.H{
+			"gencount":        check.GenCount,
+			"leaf_count":      check.LeafCount,
+			"stored_digest":   check.StoredDigest,
+			"computed_digest": check.ComputedDigest,
+		})
+		recordAudit(h.store, event)
+
+		broadcast(h.hub, &websocket.SyncEvent{
+			Type:      "manifest_repaired",
+			UserID:    userID,
+			Zone:      zone,
+			GenCount:  check.GenCount,
+			Timestamp: h.clock.Now().Unix(),
+		})
+	}
+
+	c.JSON(http.StatusOK, check)
+}
+
+type SetTierRequest struct {
+	Tier string `json:"tier" binding:"required"`
+}
+
+// SetLegalHoldRequest places or lifts a legal hold. The reason is only
+// recorded in the audit log.
+type SetLegalHoldRequest struct {
+	LegalHold *bool  `json:"legal_hold" binding:"required"`
+	Reason    string `json:"reason"`
+}
+
+// AdminUserResponse is the operator's view of an account
+type AdminUserResponse struct {
+	ID               string    `json:"id"`
+	Email            string    `json:"email"`
+	SubscriptionTier string    `json:"subscription_tier"`
+	EmailVerified    bool      `json:"email_verified"`
+	IsAdmin          bool      `json:"is_admin"`
+	IsActive         bool      `json:"is_active"`
+	TokenVersion     int       `json:"token_version"`
+	LegalHold        bool      `json:"legal_hold"`
+	HashVersion      int       `json:"hash_version"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+func (h *AdminHandler) GetUser(c *gin.Context) {
+	userID := c.Param("id")
+	if _, err := uuid.Parse(userID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	user, err := h.store.GetUserByID(userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, AdminUserResponse{
+		ID:               user.ID,
+		Email:            user.Email,
+		SubscriptionTier: user.SubscriptionTier,
+		EmailVerified:    user.EmailVerified,
+		IsAdmin:          user.IsAdmin,
+		IsActive:         user.IsActive,
+		TokenVersion:     user.TokenVersion,
+		LegalHold:        user.LegalHold,
+		HashVersion:      user.HashVersion,
+		CreatedAt:        user.CreatedAt,
+		UpdatedAt:        user.UpdatedAt,
+	})
+}
+
+// SetLegalHold freezes the account's data: deletes and purges get a 423
+// and background jobs skip the user until the hold is lifted
+func (h *AdminHandler) SetLegalHold(c *gin.Context) {
+	var req SetLegalHoldRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	details := gin.H{"legal_hold": *req.LegalHold, "reason": req.Reason}
+	h.updateUser(c, service.AuditActionLegalHold, details, func(userID string) error {
+		return h.store.SetLegalHold(userID, *req.LegalHold)
+	})
+}
+
+// DeactivateUser blocks the account; its outstanding tokens stop working
+// as soon as the cached auth profile is invalidated.
+// DeactivateUser disables the account and closes its open WebSockets with
+// websocket.CloseRevoked
+func (h *AdminHandler) DeactivateUser(c *gin.Context) {
+	h.updateUser(c, service.AuditActionUserDisable, nil, func(userID string) error {
+		if err := h.store.SetUserActive(userID, false); err != nil {
+			return err
+		}
+		h.disconnect(userID, websocket.CloseRevoked)
+		return nil
+	})
+}
+
+func (h *AdminHandler) ActivateUser(c *gin.Context) {
+	h.updateUser(c, service.AuditActionUserEnable, nil, func(userID string) error {
+		return h.store.SetUserActive(userID, true)
+	})
+}
+
+// RevokeTokens bumps the user's token version, invalidating every access
+// token issued so far. Refresh tokens keep working and mint new ones, so
+// open WebSockets are closed with websocket.CloseReauthenticate.
+func (h *AdminHandler) RevokeTokens(c *gin.Context) {
+	h.updateUser(c, service.AuditActionTokenRevoke, nil, func(userID string) error {
+		if err := h.store.BumpTokenVersion(userID); err != nil {
+			return err
+		}
+		h.disconnect(userID, websocket.CloseReauthenticate)
+		return nil
+	})
+}
+
+func (h *AdminHandler) disconnect(userID string, reason websocket.CloseReason) {
+	if h.hub != nil {
+		h.hub.DisconnectUser(userID, reason)
+	}
+}
+
+func (h *AdminHandler) SetTier(c *gin.Context) {
+	var req SetTierRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.updateUser(c, service.AuditActionTierChange, gin.H{"tier": req.Tier}, func(userID string) error {
+		return h.store.SetSubscriptionTier(userID, req.Tier)
+	})
+}
+
+func (h *AdminHandler) updateUser(c *gin.Context, action string, details gin.H, update func(userID string) error) {
+	userID := c.Param("id")
+	if _, err := uuid.Parse(userID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	err := update(userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	event := newAuditEvent(c, userID, action)
+	if details != nil {
+		event.Details = auditDetails(details)
+	}
+	recordAudit(h.store, event)
+
+	c.Status(http.StatusNoContent)
+}
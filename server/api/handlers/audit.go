@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultAuditExportRows = 10000
+	maxAuditExportRows     = 100000
+	auditExportFlushEvery  = 500
+)
+
+// newAuditEvent builds an audit event for userID, filling actor, device,
+// and client IP from the request context. Invalid device IDs are dropped
+// rather than failing the insert.
+func newAuditEvent(c *gin.Context, userID, action string) *storage.AuditEvent {
+	return callerFrom(c).AuditEvent(userID, action)
+}
+
+// recordAudit writes audit events, logging (not failing the request) on error
+func recordAudit(store storage.Store, events ...*storage.AuditEvent) {
+	service.RecordAudit(store, events...)
+}
+
+func auditDetails(details gin.H) []byte {
+	return service.AuditDetails(details)
+}
+
+type AuditHandler struct {
+	store storage.Store
+}
+
+func NewAuditHandler(store storage.Store) *AuditHandler {
+	return &AuditHandler{store: store}
+}
+
+// AuditEventRecord is the exported representation of an audit event
+type AuditEventRecord struct {
+	ID        int64           `json:"id"`
+	CreatedAt string          `json:"created_at"`
+	UserID    string          `json:"user_id"`
+	ActorID   *string         `json:"actor_id"`
+	DeviceID  *string         `json:"device_id"`
+	Action    string          `json:"action"`
+	Zone      *string         `json:"zone"`
+	ItemUUID  *string         `json:"item_uuid"`
+	IPAddress string          `json:"ip_address"`
+	Details   json.RawMessage `json:"details"`
+}
+
+var auditCSVHeader = []string{
+	"id", "created_at", "user_id", "actor_id", "device_id",
+	"action", "zone", "item_uuid", "ip_address", "details",
+}
+
+func toAuditEventRecord(event *storage.AuditEvent) AuditEventRecord {
+	record := AuditEventRecord{
+		ID:        event.ID,
+		CreatedAt: event.CreatedAt.UTC().Format(time.RFC3339),
+		UserID:    event.UserID,
+		ActorID:   event.ActorID,
+		DeviceID:  event.DeviceID,
+		Action:    event.Action,
+		Zone:      event.Zone,
+		ItemUUID:  event.ItemUUID,
+		IPAddress: event.IPAddress,
+	}
+	if len(event.Details) > 0 {
+		record.Details = json.RawMessage(event.Details)
+	}
+	return record
+}
+
+func (r AuditEventRecord) csvRow() []string {
+	return []string{
+		strconv.FormatInt(r.ID, 10), r.CreatedAt, r.UserID,
+		ptrToString(r.ActorID), ptrToString(r.DeviceID), r.Action,
+		ptrToString(r.Zone), ptrToString(r.ItemUUID), r.IPAddress,
+		string(r.Details),
+	}
+}
+
+func encodeAuditCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+func decodeAuditCursor(cursor string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(raw), 10, 64)
+}
+
+func parseAuditTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// ExportAuditLog streams the caller's audit log as CSV (RFC 4180) or JSON Lines.
+// Admins may export another account with user_id. Pages are capped at limit rows;
+// when more rows exist the X-Next-Cursor header carries the continuation token.
+func (h *AuditHandler) ExportAuditLog(c *gin.Context) {
+	userID := middleware.UserID(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	targetUserID := userID
+	if requested := c.Query("user_id"); requested != "" && requested != targetUserID {
+		caller, err := h.store.GetUserByID(targetUserID)
+		if err != nil || !caller.IsAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only admins can export another user's audit log"})
+			return
+		}
+		if _, err := uuid.Parse(requested); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user_id"})
+			return
+		}
+		targetUserID = requested
+	}
+
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "jsonl" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or jsonl"})
+		return
+	}
+
+	to, err := parseAuditTime(c.Query("to"), time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid to: use RFC3339 or YYYY-MM-DD"})
+		return
+	}
+	from, err := parseAuditTime(c.Query("from"), to.AddDate(0, -1, 0))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid from: use RFC3339 or YYYY-MM-DD"})
+		return
+	}
+	if !from.Before(to) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from must be before to"})
+		return
+	}
+
+	limit := defaultAuditExportRows
+	if limitParam := c.Query("limit"); limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 || limit > maxAuditExportRows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxAuditExportRows)})
+			return
+		}
+	}
+
+	filter := storage.AuditEventFilter{
+		UserID:       targetUserID,
+		From:         from,
+		To:           to,
+		IncludeItems: c.Query("include_items") == "true",
+		Limit:        limit,
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		filter.AfterID, err = decodeAuditCursor(cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+	}
+
+	nextID, hasMore, err := h.store.NextAuditCursor(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to query audit log: " + err.Error()})
+		return
+	}
+
+	// The export itself is an auditable action on the exported account
+	exportEvent := newAuditEvent(c, targetUserID, service.AuditActionAuditExport)
+	exportEvent.Details = auditDetails(gin.H{
+		"format": format,
+		"from":   from.UTC().Format(time.RFC3339),
+		"to":     to.UTC().Format(time.RFC3339),
+	})
+	recordAudit(h.store, exportEvent)
+
+	filename := fmt.Sprintf("audit-%s-%s.%s", from.UTC().Format("20060102"), to.UTC().Format("20060102"), format)
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if hasMore {
+		c.Header("X-Next-Cursor", encodeAuditCursor(nextID))
+	}
+	c.Status(http.StatusOK)
+
+	var write func(AuditEventRecord) error
+	var flush func()
+	if format == "csv" {
+		w := csv.NewWriter(c.Writer)
+		if err := w.Write(auditCSVHeader); err != nil {
+			return
+		}
+		write = func(r AuditEventRecord) error { return w.Write(r.csvRow()) }
+		flush = w.Flush
+	} else {
+		enc := json.NewEncoder(c.Writer)
+		write = func(r AuditEventRecord) error { return enc.Encode(r) }
+		flush = func() {}
+	}
+
+	rows := 0
+	err = h.store.StreamAuditEvents(filter, func(event *storage.AuditEvent) error {
+		if err := write(toAuditEventRecord(event)); err != nil {
+			return err
+		}
+		rows++
+		if rows%auditExportFlushEvery == 0 {
+			flush()
+			c.Writer.Flush()
+		}
+		return nil
+	})
+	flush()
+	c.Writer.Flush()
+
+	if err != nil {
+		// Headers are already sent; the truncated body is all we can do
+		log.Printf("❌ Audit export for user=%s aborted after %d rows: %v", targetUserID, rows, err)
+	}
+}
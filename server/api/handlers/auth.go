@@ -1,40 +1,90 @@
 package handlers
 
 import (
+	"errors"
+	"log"
 	"net/http"
-	"time"
 
+	"github.com/deeplyprofound/password-sync/server/clock"
 	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/mail"
+	authservice "github.com/deeplyprofound/password-sync/server/service/auth"
 	"github.com/deeplyprofound/password-sync/server/storage"
 	"github.com/gin-gonic/gin"
 )
 
+// AuthService serves the auth routes from an authservice.Service; the
+// registration captcha is checked here, before the service is called
 type AuthService struct {
-	pgStore *storage.PostgresStore
+	service *authservice.Service
+	captcha auth.CaptchaVerifier // nil: registration is open
 }
 
-func NewAuthService(pgStore *storage.PostgresStore) *AuthService {
-	return &AuthService{pgStore: pgStore}
+func NewAuthService(store storage.Store) *AuthService {
+	return &AuthService{service: authservice.NewService(store)}
+}
+
+// NewAuthServiceWithService serves the auth routes from svc
+func NewAuthServiceWithService(svc *authservice.Service) *AuthService {
+	return &AuthService{service: svc}
+}
+
+// SetClock replaces the clock used for refresh token expiry
+func (s *AuthService) SetClock(c clock.Clock) {
+	s.service.SetClock(c)
+}
+
+// SetLockout replaces the policy locking accounts after failed logins
+func (s *AuthService) SetLockout(policy authservice.LockoutPolicy) {
+	s.service.SetLockout(policy)
+}
+
+// SetMailer sets what sends password reset emails
+func (s *AuthService) SetMailer(m mail.Mailer) {
+	s.service.SetMailer(m)
+}
+
+// OnAccountDeleted registers fn to run after DELETE /account deleted the
+// account of user
+func (s *AuthService) OnAccountDeleted(fn func(user *storage.User)) {
+	s.service.OnAccountDeleted(fn)
+}
+
+// SetCaptchaVerifier makes registration require a solved challenge
+func (s *AuthService) SetCaptchaVerifier(v auth.CaptchaVerifier) {
+	s.captcha = v
 }
 
 // Request/Response types
 
 type RegisterRequest struct {
-	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=8"`
+	Email     string             `json:"email" binding:"required,email"`
+	Password  string             `json:"password" binding:"required,min=8"`
+	Bootstrap *CreateZoneRequest `json:"bootstrap,omitempty"` // Create a first zone with the account
+	// Region whose database keeps the account's data; the primary when
+	// empty. It can't be changed afterwards except by an operator migration.
+	Region string `json:"region,omitempty"`
+
+	// Required when a captcha provider is configured; see
+	// GET /auth/register/challenge
+	Captcha *auth.CaptchaResponse `json:"captcha,omitempty"`
 }
 
 type RegisterResponse struct {
-	UserID       string `json:"user_id"`
-	Email        string `json:"email"`
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
+	UserID       string        `json:"user_id"`
+	Email        string        `json:"email"`
+	Region       string        `json:"region"`
+	AccessToken  string        `json:"access_token"`
+	RefreshToken string        `json:"refresh_token"`
+	Zone         *ZoneResponse `json:"zone,omitempty"`
 }
 
 type LoginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required"`
 	DeviceID string `json:"device_id,omitempty"`
+	// Highest enc_version the device can decrypt, recorded on its devices row
+	MaxEncVersion int `json:"max_enc_version,omitempty" binding:"min=0"`
 }
 
 type LoginResponse struct {
@@ -48,6 +98,42 @@ type RefreshRequest struct {
 	RefreshToken string `json:"refresh_token" binding:"required"`
 }
 
+// LogoutRequest revokes RefreshToken, or with AllDevices every refresh
+// token of its user
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+	AllDevices   bool   `json:"all_devices"`
+}
+
+// ChangePasswordRequest replaces the caller's password; NewPassword follows
+// the registration rules
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=8"`
+}
+
+// DeleteAccountRequest confirms an account deletion with the password
+type DeleteAccountRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// PasswordResetRequest asks for a reset token to be emailed to Email
+type PasswordResetRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+// PasswordResetConfirmRequest sets a new password with an emailed token;
+// NewPassword follows the registration rules
+type PasswordResetConfirmRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,min=8"`
+}
+
+type PasswordResetConfirmResponse struct {
+	RevokedSessions int64    `json:"revoked_sessions"`
+	Warnings        []string `json:"warnings"`
+}
+
 type RefreshResponse struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
@@ -62,163 +148,241 @@ func (s *AuthService) Register(c *gin.Context) {
 		return
 	}
 
-	// Check if user already exists
-	existingUser, _ := s.pgStore.GetUserByEmail(req.Email)
-	if existingUser != nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "user already exists"})
+	// Challenge before anything else, so bots can't probe for accounts
+	if !s.verifyCaptcha(c, req.Captcha) {
 		return
 	}
 
-	// Generate salt and hash password
-	salt, err := auth.GenerateSalt()
+	in := authservice.RegisterInput{Email: req.Email, Password: req.Password, Region: req.Region}
+	if req.Bootstrap != nil {
+		spec := req.Bootstrap.spec()
+		in.Bootstrap = &spec
+	}
+	result, err := s.service.Register(c.Request.Context(), callerFrom(c), in)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate salt"})
+		respondError(c, err)
 		return
 	}
 
-	passwordHash := auth.HashPassword(req.Password, salt)
-
-	// Create user
-	user, err := s.pgStore.CreateUser(req.Email, passwordHash, salt)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create user"})
-		return
+	resp := RegisterResponse{
+		UserID:       result.User.ID,
+		Email:        result.User.Email,
+		Region:       result.Region,
+		AccessToken:  result.AccessToken,
+		RefreshToken: result.RefreshToken,
+	}
+	if result.Zone != nil {
+		resp.Zone = newZoneResponse(result.Zone)
 	}
+	c.JSON(http.StatusCreated, resp)
+}
 
-	// Generate JWT access token
-	accessToken, err := auth.GenerateAccessToken(user.ID, user.Email, "")
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+func (s *AuthService) Login(c *gin.Context) {
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Generate refresh token (30 days)
-	refreshToken, err := s.pgStore.CreateRefreshToken(
-		user.ID,
-		nil,
-		time.Now().Add(30*24*time.Hour),
-	)
+	result, err := s.service.Login(c.Request.Context(), callerFrom(c), authservice.LoginInput{
+		Email:         req.Email,
+		Password:      req.Password,
+		DeviceID:      req.DeviceID,
+		MaxEncVersion: req.MaxEncVersion,
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create refresh token"})
+		respondError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, RegisterResponse{
-		UserID:       user.ID,
-		Email:        user.Email,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken.Token,
+	c.JSON(http.StatusOK, LoginResponse{
+		UserID:       result.User.ID,
+		Email:        result.User.Email,
+		AccessToken:  result.AccessToken,
+		RefreshToken: result.RefreshToken,
 	})
 }
 
-func (s *AuthService) Login(c *gin.Context) {
-	var req LoginRequest
+func (s *AuthService) RefreshToken(c *gin.Context) {
+	var req RefreshRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Get user by email
-	user, err := s.pgStore.GetUserByEmail(req.Email)
+	tokens, err := s.service.Refresh(c.Request.Context(), callerFrom(c), req.RefreshToken)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+		respondError(c, err)
 		return
 	}
 
-	// Verify password
-	if !auth.VerifyPassword(req.Password, user.Salt, user.PasswordHash) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+	c.JSON(http.StatusOK, RefreshResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+	})
+}
+
+// Logout revokes the caller's refresh token; see authservice.Service.Logout
+func (s *AuthService) Logout(c *gin.Context) {
+	var req LogoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Generate JWT access token
-	accessToken, err := auth.GenerateAccessToken(user.ID, user.Email, req.DeviceID)
+	err := s.service.Logout(c.Request.Context(), callerFrom(c), authservice.LogoutInput{
+		RefreshToken: req.RefreshToken,
+		AllDevices:   req.AllDevices,
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		respondError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ChangePassword replaces the caller's password, signing out their other
+// devices; the response is a fresh token pair for this session
+func (s *AuthService) ChangePassword(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
 		return
 	}
 
-	// Generate refresh token
-	var deviceID *string
-	if req.DeviceID != "" {
-		deviceID = &req.DeviceID
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	refreshToken, err := s.pgStore.CreateRefreshToken(
-		user.ID,
-		deviceID,
-		time.Now().Add(30*24*time.Hour),
-	)
+	tokens, err := s.service.ChangePassword(c.Request.Context(), caller, authservice.ChangePasswordInput{
+		CurrentPassword: req.CurrentPassword,
+		NewPassword:     req.NewPassword,
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create refresh token"})
+		respondError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, LoginResponse{
-		UserID:       user.ID,
-		Email:        user.Email,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken.Token,
+	c.JSON(http.StatusOK, RefreshResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
 	})
 }
 
-func (s *AuthService) RefreshToken(c *gin.Context) {
-	var req RefreshRequest
+// DeleteAccount deletes the caller's account and all its data, confirmed
+// with the password. Its tokens stop working and its connections close.
+func (s *AuthService) DeleteAccount(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var req DeleteAccountRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Validate refresh token
-	refreshToken, err := s.pgStore.GetRefreshToken(req.RefreshToken)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+	if err := s.service.DeleteAccount(c.Request.Context(), caller, req.Password); err != nil {
+		respondError(c, err)
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{"message": "account and all its data deleted"})
+}
 
-	// Check if revoked or expired
-	if refreshToken.Revoked || time.Now().After(refreshToken.ExpiresAt) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token expired or revoked"})
+// RequestPasswordReset emails a reset token. The answer is the same
+// whether or not the email has an account.
+func (s *AuthService) RequestPasswordReset(c *gin.Context) {
+	var req PasswordResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Get user
-	user, err := s.pgStore.GetUserByID(refreshToken.UserID)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+	if err := s.service.RequestPasswordReset(c.Request.Context(), callerFrom(c), req.Email); err != nil {
+		respondError(c, err)
 		return
 	}
 
-	// Generate new access token
-	deviceID := ""
-	if refreshToken.DeviceID != nil {
-		deviceID = *refreshToken.DeviceID
+	c.JSON(http.StatusOK, gin.H{"message": "if an account exists for this email, a reset code was sent to it"})
+}
+
+// ConfirmPasswordReset sets a new password with an emailed token, signing
+// out every device of the account. The vault's master key is unchanged,
+// which the warnings say.
+func (s *AuthService) ConfirmPasswordReset(c *gin.Context) {
+	var req PasswordResetConfirmRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	accessToken, err := auth.GenerateAccessToken(user.ID, user.Email, deviceID)
+	result, err := s.service.ResetPassword(c.Request.Context(), callerFrom(c), authservice.ResetPasswordInput{
+		Token:       req.Token,
+		NewPassword: req.NewPassword,
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		respondError(c, err)
 		return
 	}
 
-	// Rotate refresh token
-	if err := s.pgStore.RevokeRefreshToken(req.RefreshToken); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke old token"})
+	c.JSON(http.StatusOK, PasswordResetConfirmResponse{
+		RevokedSessions: result.Revoked,
+		Warnings:        result.Warnings,
+	})
+}
+
+// RegisterChallenge tells clients what registration requires. With the
+// proof-of-work provider it also issues a fresh puzzle.
+func (s *AuthService) RegisterChallenge(c *gin.Context) {
+	if s.captcha == nil {
+		c.JSON(http.StatusOK, gin.H{"required": false})
 		return
 	}
 
-	newRefreshToken, err := s.pgStore.CreateRefreshToken(
-		user.ID,
-		refreshToken.DeviceID,
-		time.Now().Add(30*24*time.Hour),
-	)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create refresh token"})
-		return
+	resp := gin.H{"required": true, "captcha": s.captcha.Requirements()}
+	if pow, ok := s.captcha.(*auth.ProofOfWork); ok {
+		challenge, err := pow.Issue()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to issue challenge"})
+			return
+		}
+		resp["challenge"] = challenge
 	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, resp)
+}
 
-	c.JSON(http.StatusOK, RefreshResponse{
-		AccessToken:  accessToken,
-		RefreshToken: newRefreshToken.Token,
+// verifyCaptcha checks a registration's challenge response, answering the
+// request itself when it fails. Failures carry the requirements so the
+// client can retry.
+func (s *AuthService) verifyCaptcha(c *gin.Context, resp *auth.CaptchaResponse) bool {
+	if s.captcha == nil {
+		return true
+	}
+	if resp == nil {
+		resp = &auth.CaptchaResponse{}
+	}
+
+	err := s.captcha.Verify(c.Request.Context(), *resp, c.ClientIP())
+	if err == nil {
+		return true
+	}
+
+	status, code := http.StatusForbidden, "captcha_failed"
+	switch {
+	case errors.Is(err, auth.ErrCaptchaRequired):
+		code = "captcha_required"
+	case errors.Is(err, auth.ErrCaptchaUnavailable):
+		log.Printf("⚠️  Captcha verification unavailable: %v", err)
+		status, code = http.StatusServiceUnavailable, "captcha_unavailable"
+	}
+	c.JSON(status, gin.H{
+		"error":   err.Error(),
+		"code":    code,
+		"captcha": s.captcha.Requirements(),
 	})
+	return false
 }
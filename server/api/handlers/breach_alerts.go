@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"log"
+
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+// EventBreachAlert tells a user's clients that a monitored address appeared
+// in new breaches; they fetch the alerts from /breach/alerts
+const EventBreachAlert = "breach_alert"
+
+// BreachAlertNotifier implements jobs.BreachAlertNotifier by pushing a
+// breach_alert event to the user's connected clients. Users offline at the
+// time find the alerts stored.
+type BreachAlertNotifier struct {
+	hub *websocket.Hub
+}
+
+func NewBreachAlertNotifier(hub *websocket.Hub) *BreachAlertNotifier {
+	return &BreachAlertNotifier{hub: hub}
+}
+
+// BreachAlerts implements jobs.BreachAlertNotifier
+func (n *BreachAlertNotifier) BreachAlerts(monitor *storage.BreachMonitor, alerts []*storage.BreachAlert) {
+	breaches := make([]string, len(alerts))
+	for i, alert := range alerts {
+		breaches[i] = alert.Breach
+	}
+	log.Printf("🚨 Breach monitor %s of user %s: %d new breach(es)", monitor.ID, monitor.UserID, len(alerts))
+
+	if n.hub == nil {
+		return
+	}
+	err := n.hub.BroadcastSyncEvent(&websocket.SyncEvent{
+		Type:      EventBreachAlert,
+		UserID:    monitor.UserID,
+		JobID:     monitor.ID,
+		Email:     monitor.Email,
+		Breaches:  breaches,
+		Timestamp: clock.System.Now().Unix(),
+	})
+	if err != nil {
+		log.Printf("⚠️  Failed to broadcast breach alert of monitor %s: %v", monitor.ID, err)
+	}
+}
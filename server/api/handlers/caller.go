@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/gin-gonic/gin"
+)
+
+// callerFrom is the service.Caller of a request, as the auth middleware
+// left it in the context. UserID is "" on public routes.
+func callerFrom(c *gin.Context) service.Caller {
+	caller := service.Caller{
+		UserID:   middleware.UserID(c),
+		DeviceID: middleware.DeviceID(c),
+		IP:       c.ClientIP(),
+	}
+	if hold, _ := c.Get("legal_hold"); hold == true {
+		caller.LegalHold = true
+	}
+	if tier, ok := c.Get("tier"); ok {
+		caller.Tier, _ = tier.(string)
+	}
+	return caller
+}
+
+// requireCaller returns the authenticated caller, answering 401 itself
+// when there is none
+func requireCaller(c *gin.Context) (service.Caller, bool) {
+	if middleware.UserID(c) == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return service.Caller{}, false
+	}
+	return callerFrom(c), true
+}
+
+// serviceErrorStatus maps a service.Kind to its HTTP status
+var serviceErrorStatus = map[service.Kind]int{
+	service.KindInternal:     http.StatusInternalServerError,
+	service.KindInvalid:      http.StatusBadRequest,
+	service.KindUnauthorized: http.StatusUnauthorized,
+	service.KindForbidden:    http.StatusForbidden,
+	service.KindNotFound:     http.StatusNotFound,
+	service.KindConflict:     http.StatusConflict,
+	service.KindLocked:       http.StatusLocked,
+	service.KindUnavailable:  http.StatusServiceUnavailable,
+	service.KindGone:         http.StatusGone,
+	service.KindRateLimited:  http.StatusTooManyRequests,
+}
+
+// statusClientClosedRequest (nginx's 499) answers a request whose client
+// hung up before it finished
+const statusClientClosedRequest = 499
+
+// respondError answers a failed service call. A *service.Error renders as
+// its message, code and fields; anything else is a 500. When the client
+// hung up, the store gave up on the query and nobody reads the answer: the
+// request ends with a bare 499 rather than counting as a server error.
+func respondError(c *gin.Context, err error) {
+	if errors.Is(c.Request.Context().Err(), context.Canceled) {
+		c.AbortWithStatus(statusClientClosedRequest)
+		return
+	}
+
+	var serviceErr *service.Error
+	if !errors.As(err, &serviceErr) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	body := gin.H{"error": serviceErr.Message}
+	if serviceErr.Code != "" {
+		body["code"] = serviceErr.Code
+	}
+	for key, value := range serviceErr.Fields {
+		body[key] = value
+	}
+	c.JSON(serviceErrorStatus[serviceErr.Kind], body)
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	syncservice "github.com/deeplyprofound/password-sync/server/service/sync"
+	"github.com/gin-gonic/gin"
+)
+
+type ResolveConflictRequest struct {
+	// client_wins keeps the record the push held back, server_wins the
+	// stored one
+	Resolution string `json:"resolution" binding:"required"`
+}
+
+// ListConflicts returns the pending manual conflicts of ?zone= (default
+// "default"), each with the pushed and the stored version of its item
+func (h *SyncHandler) ListConflicts(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	zone := c.DefaultQuery("zone", "default")
+	conflicts, err := h.service.Conflicts(c.Request.Context(), caller, zone)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	entries := make([]gin.H, 0, len(conflicts))
+	for _, conflict := range conflicts {
+		pushed := mapping.FromSyncRecord(conflict.Pushed)
+		pushed.GenCount = conflict.BaseGenCount
+		var stored *mapping.SyncRecordDTO
+		if conflict.Stored != nil {
+			dto := mapping.FromSyncRecord(conflict.Stored)
+			stored = &dto
+		}
+		entries = append(entries, gin.H{
+			"id":              conflict.ID,
+			"item_uuid":       conflict.ItemUUID.String(),
+			"device_id":       conflict.DeviceID,
+			"base_gencount":   conflict.BaseGenCount,
+			"stored_gencount": conflict.StoredGenCount,
+			"created_at":      conflict.CreatedAt.UTC().Format(time.RFC3339),
+			"pushed":          pushed,
+			"stored":          stored,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"zone": zone, "conflicts": entries})
+}
+
+// ResolveConflict keeps one version of a conflicting item of ?zone=
+// (default "default"); see syncservice.Service.ResolveConflict
+func (h *SyncHandler) ResolveConflict(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var req ResolveConflictRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	zone := c.DefaultQuery("zone", "default")
+	result, err := h.service.ResolveConflict(c.Request.Context(), caller, syncservice.ResolveConflictInput{
+		Zone:       zone,
+		ConflictID: c.Param("id"),
+		Resolution: req.Resolution,
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":         c.Param("id"),
+		"zone":       zone,
+		"item_uuid":  result.ItemUUID,
+		"resolution": result.Resolution,
+		"gencount":   result.GenCount,
+	})
+}
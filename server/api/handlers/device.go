@@ -1,37 +1,168 @@
 package handlers
 
 import (
+	"encoding/json"
 	"net/http"
 
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	"github.com/deeplyprofound/password-sync/server/service/device"
 	"github.com/deeplyprofound/password-sync/server/storage"
 	"github.com/gin-gonic/gin"
 )
 
+// EventDeviceInactive warns a user's devices that one of them will be
+// deactivated for inactivity; device_id names it, timestamp is the deadline
+const EventDeviceInactive = device.EventDeviceInactive
+
+// DeviceHandler serves the device routes from a device.Service. The service
+// also implements jobs.DeviceNotifier; see Service.
 type DeviceHandler struct {
-	pgStore *storage.PostgresStore
+	service *device.Service
+}
+
+func NewDeviceHandler(store storage.Store) *DeviceHandler {
+	return &DeviceHandler{service: device.NewService(store)}
+}
+
+// NewDeviceHandlerWithService serves the device routes from svc
+func NewDeviceHandlerWithService(svc *device.Service) *DeviceHandler {
+	return &DeviceHandler{service: svc}
 }
 
-func NewDeviceHandler(pgStore *storage.PostgresStore) *DeviceHandler {
-	return &DeviceHandler{pgStore: pgStore}
+// Service returns the device service the handler calls
+func (h *DeviceHandler) Service() *device.Service {
+	return h.service
+}
+
+// SetClock replaces the clock stale-device thresholds are measured from
+func (h *DeviceHandler) SetClock(c clock.Clock) {
+	h.service.SetClock(c)
+}
+
+// SetHub sets the WebSocket hub so revoked devices are disconnected
+func (h *DeviceHandler) SetHub(hub *websocket.Hub) {
+	if hub != nil {
+		h.service.SetHub(hub)
+	}
 }
 
 type RegisterDeviceRequest struct {
 	DeviceName string `json:"device_name" binding:"required"`
 	DeviceType string `json:"device_type" binding:"required"`
 	PublicKey  []byte `json:"public_key,omitempty"`
+	// Highest enc_version the device can decrypt; omitted by older clients
+	MaxEncVersion int `json:"max_enc_version,omitempty" binding:"min=0"`
+	// What the device can handle, a peer.Capabilities object; its
+	// enc_versions take precedence over max_enc_version
+	Capabilities json.RawMessage `json:"capabilities,omitempty"`
+	// Stable ID the client keeps across restarts; registering it again
+	// updates that device instead of adding one
+	DeviceFingerprint string `json:"device_fingerprint,omitempty"`
+}
+
+// UpdateDeviceRequest is the body of PATCH /devices/:id, with at least one
+// of its fields. DeviceName renames the device. Capabilities is merged into
+// the device's: each key replaces the stored one and a null removes it.
+type UpdateDeviceRequest struct {
+	DeviceName   *string         `json:"device_name,omitempty"`
+	Capabilities json.RawMessage `json:"capabilities,omitempty"`
 }
 
 type DeviceResponse struct {
-	ID         string `json:"id"`
-	DeviceName string `json:"device_name"`
-	DeviceType string `json:"device_type"`
-	CreatedAt  string `json:"created_at"`
+	ID            string  `json:"id"`
+	DeviceName    string  `json:"device_name"`
+	DeviceType    string  `json:"device_type"`
+	CreatedAt     string  `json:"created_at"`
+	LastSync      *string `json:"last_sync"`
+	MaxEncVersion int     `json:"max_enc_version,omitempty"`
+	TrustLevel    string  `json:"trust_level"` // pending, trusted or revoked
+
+	Capabilities json.RawMessage `json:"capabilities"` // {} when the device never sent any
+}
+
+// RegisterDeviceResponse is a registered device. Created is false when
+// the fingerprint matched a device registered before, whose ID the client
+// should keep using.
+type RegisterDeviceResponse struct {
+	DeviceResponse
+	Created bool `json:"created"`
+}
+
+// DeviceCapabilitiesResponse summarises what the caller's active devices
+// can handle
+type DeviceCapabilitiesResponse struct {
+	Devices       int            `json:"devices"`
+	MinEncVersion int            `json:"min_enc_version"` // Every active device reads up to this
+	MaxEncVersion int            `json:"max_enc_version"` // The newest any of them reads
+	MsgPack       int            `json:"msgpack"`         // Devices preferring MessagePack
+	PushPlatforms map[string]int `json:"push_platforms"`
+
+	// The capabilities version the server understands
+	CapabilitiesVersion int                     `json:"capabilities_version"`
+	Lagging             []LaggingDeviceResponse `json:"lagging"`
+}
+
+// LaggingDeviceResponse is a device that reads fewer enc_versions than the
+// account's newest, or advertised an older capabilities version (0 for
+// none at all)
+type LaggingDeviceResponse struct {
+	Device              DeviceResponse `json:"device"`
+	MaxEncVersion       int            `json:"max_enc_version"`
+	CapabilitiesVersion int            `json:"capabilities_version"`
+}
+
+// SetDeviceTrustRequest approves a pending device ("trusted") or revokes
+// one ("revoked")
+type SetDeviceTrustRequest struct {
+	TrustLevel string `json:"trust_level" binding:"required"`
+}
+
+// CleanupDevicesRequest selects the caller's devices that have not synced
+// for InactiveDays. The device making the request is never included.
+type CleanupDevicesRequest struct {
+	InactiveDays int  `json:"inactive_days" binding:"required,min=1"`
+	DryRun       bool `json:"dry_run"`
+}
+
+type CleanupDevicesResponse struct {
+	DryRun  bool             `json:"dry_run"`
+	Devices []DeviceResponse `json:"devices"` // Deactivated, or that would be on a dry run
+}
+
+type BulkRevokeDevicesRequest struct {
+	DeviceIDs []string `json:"device_ids" binding:"required,min=1"`
+}
+
+type BulkRevokeDevicesResponse struct {
+	Revoked  []string `json:"revoked"`
+	NotFound []string `json:"not_found"` // Unknown, another user's, or already inactive
+}
+
+func newDeviceResponse(device *storage.Device) DeviceResponse {
+	resp := DeviceResponse{
+		ID:            device.ID,
+		DeviceName:    device.DeviceName,
+		DeviceType:    device.DeviceType,
+		CreatedAt:     device.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		MaxEncVersion: device.MaxEncVersion,
+		TrustLevel:    peer.TrustLevel(device.TrustLevel).String(),
+		Capabilities:  json.RawMessage(device.Capabilities),
+	}
+	if len(resp.Capabilities) == 0 {
+		resp.Capabilities = json.RawMessage("{}")
+	}
+	if device.LastSync != nil {
+		lastSync := device.LastSync.UTC().Format("2006-01-02T15:04:05Z")
+		resp.LastSync = &lastSync
+	}
+	return resp
 }
 
 func (h *DeviceHandler) RegisterDevice(c *gin.Context) {
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+	caller, ok := requireCaller(c)
+	if !ok {
 		return
 	}
 
@@ -41,47 +172,224 @@ func (h *DeviceHandler) RegisterDevice(c *gin.Context) {
 		return
 	}
 
-	device, err := h.pgStore.CreateDevice(
-		userID.(string),
-		req.DeviceName,
-		req.DeviceType,
-		req.PublicKey,
-	)
+	registered, err := h.service.Register(c.Request.Context(), caller, device.RegisterInput{
+		Name:          req.DeviceName,
+		Type:          req.DeviceType,
+		PublicKey:     req.PublicKey,
+		MaxEncVersion: req.MaxEncVersion,
+		Capabilities:  capabilitiesBody(req.Capabilities),
+		Fingerprint:   req.DeviceFingerprint,
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusCreated, DeviceResponse{
-		ID:         device.ID,
-		DeviceName: device.DeviceName,
-		DeviceType: device.DeviceType,
-		CreatedAt:  device.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	status := http.StatusCreated
+	if !registered.Created {
+		status = http.StatusOK
+	}
+	c.JSON(status, RegisterDeviceResponse{
+		DeviceResponse: newDeviceResponse(registered.Device),
+		Created:        registered.Created,
 	})
 }
 
 func (h *DeviceHandler) ListDevices(c *gin.Context) {
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+	caller, ok := requireCaller(c)
+	if !ok {
 		return
 	}
 
-	devices, err := h.pgStore.GetDevicesByUserID(userID.(string))
+	devices, err := h.service.List(c.Request.Context(), caller)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	result := make([]DeviceResponse, len(devices))
-	for i, device := range devices {
-		result[i] = DeviceResponse{
-			ID:         device.ID,
-			DeviceName: device.DeviceName,
-			DeviceType: device.DeviceType,
-			CreatedAt:  device.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	c.JSON(http.StatusOK, newDeviceResponses(devices))
+}
+
+// RevokeDevice deactivates one of the caller's devices; see
+// device.Service.Revoke
+func (h *DeviceHandler) RevokeDevice(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	if err := h.service.Revoke(c.Request.Context(), caller, c.Param("id")); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// UpdateDevice renames one of the caller's devices, or changes what the
+// calling device advertises about itself; see device.Service.Rename and
+// device.Service.UpdateCapabilities. Capabilities go first, so a request
+// refused for them renames nothing.
+func (h *DeviceHandler) UpdateDevice(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var req UpdateDeviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	hasCapabilities := len(req.Capabilities) > 0 && string(req.Capabilities) != "null"
+	if req.DeviceName == nil && !hasCapabilities {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "device_name or capabilities is required"})
+		return
+	}
+
+	var updated *storage.Device
+	var err error
+	if hasCapabilities {
+		updated, err = h.service.UpdateCapabilities(c.Request.Context(), caller, c.Param("id"), req.Capabilities)
+	}
+	if err == nil && req.DeviceName != nil {
+		updated, err = h.service.Rename(c.Request.Context(), caller, c.Param("id"), *req.DeviceName)
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newDeviceResponse(updated))
+}
+
+// GetDeviceCapabilities summarises what the caller's active devices can
+// handle, listing the ones behind the rest so a client can warn about them
+func (h *DeviceHandler) GetDeviceCapabilities(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	summary, err := h.service.Capabilities(c.Request.Context(), caller)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	resp := DeviceCapabilitiesResponse{
+		Devices:             summary.Devices,
+		MinEncVersion:       summary.MinEncVersion,
+		MaxEncVersion:       summary.MaxEncVersion,
+		MsgPack:             summary.MsgPack,
+		PushPlatforms:       summary.PushPlatforms,
+		CapabilitiesVersion: peer.CapabilitiesVersion,
+		Lagging:             make([]LaggingDeviceResponse, len(summary.Lagging)),
+	}
+	for i, lagging := range summary.Lagging {
+		resp.Lagging[i] = LaggingDeviceResponse{
+			Device:              newDeviceResponse(lagging.Device),
+			MaxEncVersion:       lagging.MaxEncVersion,
+			CapabilitiesVersion: lagging.SchemaVersion,
 		}
 	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// SetDeviceTrust approves, rejects or revokes one of the caller's devices;
+// see device.Service.SetTrust
+func (h *DeviceHandler) SetDeviceTrust(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var req SetDeviceTrustRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	level, err := peer.ParseTrustLevel(req.TrustLevel)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_trust_level"})
+		return
+	}
+
+	updated, err := h.service.SetTrust(c.Request.Context(), caller, c.Param("id"), level)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newDeviceResponse(updated))
+}
+
+// RevokeDevices is the bulk form of RevokeDevice. IDs that are not the
+// caller's active devices are reported back rather than failing the request.
+func (h *DeviceHandler) RevokeDevices(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var req BulkRevokeDevicesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := h.service.RevokeMany(c.Request.Context(), caller, req.DeviceIDs)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, BulkRevokeDevicesResponse{Revoked: result.Revoked, NotFound: result.NotFound})
+}
+
+// CleanupDevices deactivates the caller's devices that have not synced for
+// inactive_days, revoking them like RevokeDevice. With dry_run (in the body
+// or ?dry_run=true) it only lists them, so a client can confirm first.
+func (h *DeviceHandler) CleanupDevices(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var req CleanupDevicesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if c.Query("dry_run") == "true" {
+		req.DryRun = true
+	}
+
+	devices, err := h.service.Cleanup(c.Request.Context(), caller, device.CleanupInput{
+		InactiveDays: req.InactiveDays,
+		DryRun:       req.DryRun,
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
 
-	c.JSON(http.StatusOK, result)
+	c.JSON(http.StatusOK, CleanupDevicesResponse{DryRun: req.DryRun, Devices: newDeviceResponses(devices)})
+}
+
+// capabilitiesBody is a request's capabilities object, nil when it sent
+// none or null
+func capabilitiesBody(raw json.RawMessage) []byte {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	return raw
+}
+
+func newDeviceResponses(devices []*storage.Device) []DeviceResponse {
+	result := make([]DeviceResponse, len(devices))
+	for i, device := range devices {
+		result[i] = newDeviceResponse(device)
+	}
+	return result
 }
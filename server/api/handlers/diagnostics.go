@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	diagnosticsRecentEvents  = 20
+	diagnosticsMaxViolations = 100
+)
+
+// ManifestDiagnostics compares a zone's stored manifest with one
+// recomputed from its live items
+type ManifestDiagnostics struct {
+	GenCount           int64   `json:"gencount"`
+	StoredDigest       []byte  `json:"stored_digest"`
+	ComputedDigest     []byte  `json:"computed_digest"`
+	LeafCount          int     `json:"leaf_count"`
+	Drift              bool    `json:"drift"`
+	UpdatedAt          string  `json:"updated_at,omitempty"`
+	LastWriterDeviceID *string `json:"last_writer_device_id"`
+}
+
+// DeviceDiagnostics is one of the user's active devices
+type DeviceDiagnostics struct {
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	Type          string  `json:"type"`
+	LastSync      *string `json:"last_sync"`
+	MaxEncVersion int     `json:"max_enc_version,omitempty"`
+}
+
+// SyncDiagnostics is everything support needs to triage devices that
+// disagree about a zone. It never holds encrypted content or credential
+// metadata, only counts, digests and identifiers.
+type SyncDiagnostics struct {
+	UserID              string                       `json:"user_id"`
+	Zone                string                       `json:"zone"`
+	GeneratedAt         string                       `json:"generated_at"`
+	Manifest            ManifestDiagnostics          `json:"manifest"`
+	Layers              []storage.LayerCount         `json:"layers"`
+	Devices             []DeviceDiagnostics          `json:"devices"`
+	RecentEvents        []AuditEventRecord           `json:"recent_events"`
+	ReferenceViolations []storage.ReferenceViolation `json:"reference_violations"`
+	// More violations exist than were returned
+	ViolationsTruncated bool `json:"violations_truncated"`
+}
+
+// UserDiagnosticsDevice is a device as the user's own report shows it
+type UserDiagnosticsDevice struct {
+	ID            string  `json:"id"`
+	Type          string  `json:"type"`
+	LastSync      *string `json:"last_sync"`
+	MaxEncVersion int     `json:"max_enc_version,omitempty"`
+}
+
+// UserDiagnosticsEvent is an audit event as the user's own report shows it
+type UserDiagnosticsEvent struct {
+	Action    string  `json:"action"`
+	DeviceID  *string `json:"device_id"`
+	Zone      *string `json:"zone"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// UserSyncDiagnostics is the reduced report a client attaches to a bug
+// report. It leaves out what identifies the user or their items to whoever
+// reads the report: device names, IP addresses, operators acting on the
+// account and item UUIDs.
+type UserSyncDiagnostics struct {
+	Zone                string                  `json:"zone"`
+	GeneratedAt         string                  `json:"generated_at"`
+	Manifest            ManifestDiagnostics     `json:"manifest"`
+	Layers              []storage.LayerCount    `json:"layers"`
+	Devices             []UserDiagnosticsDevice `json:"devices"`
+	RecentEvents        []UserDiagnosticsEvent  `json:"recent_events"`
+	ReferenceViolations map[string]int          `json:"reference_violations"` // By kind
+}
+
+// NewUserSyncDiagnostics reduces a full report to the user's version
+func NewUserSyncDiagnostics(d *SyncDiagnostics) *UserSyncDiagnostics {
+	reduced := &UserSyncDiagnostics{
+		Zone:                d.Zone,
+		GeneratedAt:         d.GeneratedAt,
+		Manifest:            d.Manifest,
+		Layers:              d.Layers,
+		Devices:             make([]UserDiagnosticsDevice, 0, len(d.Devices)),
+		RecentEvents:        make([]UserDiagnosticsEvent, 0, len(d.RecentEvents)),
+		ReferenceViolations: map[string]int{},
+	}
+	for _, device := range d.Devices {
+		reduced.Devices = append(reduced.Devices, UserDiagnosticsDevice{
+			ID:            device.ID,
+			Type:          device.Type,
+			LastSync:      device.LastSync,
+			MaxEncVersion: device.MaxEncVersion,
+		})
+	}
+	for _, event := range d.RecentEvents {
+		reduced.RecentEvents = append(reduced.RecentEvents, UserDiagnosticsEvent{
+			Action:    event.Action,
+			DeviceID:  event.DeviceID,
+			Zone:      event.Zone,
+			CreatedAt: event.CreatedAt,
+		})
+	}
+	for _, violation := range d.ReferenceViolations {
+		reduced.ReferenceViolations[violation.Violation]++
+	}
+	return reduced
+}
+
+// collectDiagnostics builds the full report for one of a user's zones.
+// It only reads.
+func collectDiagnostics(ctx context.Context, store storage.Store, userID, zone string, now time.Time) (*SyncDiagnostics, error) {
+	state, err := store.GetSyncStateContext(ctx, userID, zone)
+	if err != nil {
+		return nil, err
+	}
+	computed, err := store.ComputeManifest(ctx, userID, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &SyncDiagnostics{
+		UserID:      userID,
+		Zone:        zone,
+		GeneratedAt: now.UTC().Format(time.RFC3339),
+		Manifest: ManifestDiagnostics{
+			GenCount:           state.GenCount,
+			StoredDigest:       state.Digest,
+			ComputedDigest:     computed.Digest,
+			LeafCount:          computed.LeafCount,
+			Drift:              jobs.ManifestDrifted(state, computed),
+			LastWriterDeviceID: state.LastWriterDeviceID,
+		},
+		Devices:      []DeviceDiagnostics{},
+		RecentEvents: []AuditEventRecord{},
+	}
+	if !state.UpdatedAt.IsZero() {
+		d.Manifest.UpdatedAt = state.UpdatedAt.UTC().Format(time.RFC3339)
+	}
+
+	if d.Layers, err = store.CountLayerItems(ctx, userID, zone); err != nil {
+		return nil, err
+	}
+
+	devices, err := store.GetDevicesByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		entry := DeviceDiagnostics{
+			ID:            device.ID,
+			Name:          device.DeviceName,
+			Type:          device.DeviceType,
+			MaxEncVersion: device.MaxEncVersion,
+		}
+		if device.LastSync != nil {
+			lastSync := device.LastSync.UTC().Format(time.RFC3339)
+			entry.LastSync = &lastSync
+		}
+		d.Devices = append(d.Devices, entry)
+	}
+
+	events, err := store.ListRecentAuditEvents(ctx, userID, diagnosticsRecentEvents)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		d.RecentEvents = append(d.RecentEvents, toAuditEventRecord(event))
+	}
+
+	// One extra row tells whether the list was cut short
+	violations, err := store.FindReferenceViolations(ctx, userID, zone, diagnosticsMaxViolations+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(violations) > diagnosticsMaxViolations {
+		violations = violations[:diagnosticsMaxViolations]
+		d.ViolationsTruncated = true
+	}
+	d.ReferenceViolations = violations
+
+	return d, nil
+}
+
+// GetUserDiagnostics returns the full sync diagnostics of one of a user's
+// zones (?zone=, default "default") for support. Reading them is audited.
+func (h *AdminHandler) GetUserDiagnostics(c *gin.Context) {
+	userID := c.Param("id")
+	if _, err := uuid.Parse(userID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	zone := c.DefaultQuery("zone", "default")
+
+	if _, err := h.store.GetUserByID(userID); err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	diagnostics, err := collectDiagnostics(c.Request.Context(), h.store, userID, zone, h.clock.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to collect diagnostics: " + err.Error()})
+		return
+	}
+
+	event := newAuditEvent(c, userID, service.AuditActionDiagnostics)
+	event.Zone = &zone
+	recordAudit(h.store, event)
+
+	c.JSON(http.StatusOK, diagnostics)
+}
+
+// GetDiagnostics returns the reduced sync diagnostics of one of the
+// caller's zones, for the client to attach to a bug report
+func (h *SyncHandler) GetDiagnostics(c *gin.Context) {
+	userID := middleware.UserID(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+	zone := c.DefaultQuery("zone", "default")
+
+	diagnostics, err := collectDiagnostics(c.Request.Context(), h.store, userID, zone, h.clock.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to collect diagnostics: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, NewUserSyncDiagnostics(diagnostics))
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	syncservice "github.com/deeplyprofound/password-sync/server/service/sync"
+	"github.com/gin-gonic/gin"
+)
+
+// MaxDiffLeaves caps the leaves of one diff request
+const MaxDiffLeaves = 100000
+
+// MaxPullItems caps the item_uuids of one targeted pull
+const MaxPullItems = 1000
+
+type DiffSyncRequest struct {
+	Zone    string   `json:"zone"`
+	LeafIDs []string `json:"leaf_ids" binding:"required"`
+}
+
+// DiffSync compares the leaves of a device's copy of a zone with the
+// server's: added and modified items are pulled by item_uuids, removed ones
+// dropped. A device whose digest diverged uses it instead of pulling every
+// change since its last gencount.
+func (h *SyncHandler) DiffSync(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var req DiffSyncRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.LeafIDs) > MaxDiffLeaves {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("a diff takes at most %d leaf_ids", MaxDiffLeaves),
+			"code":  "payload_too_large",
+		})
+		return
+	}
+
+	diff, err := h.service.Diff(c.Request.Context(), caller, syncservice.DiffInput{
+		Zone:   req.Zone,
+		Leaves: req.LeafIDs,
+	})
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"zone":           diff.Zone,
+		"gencount":       diff.GenCount,
+		"digest":         diff.Digest,
+		"digest_version": sync.DigestVersion,
+		"added":          diff.Added,
+		"removed":        diff.Removed,
+		"modified":       diff.Modified,
+	})
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	syncservice "github.com/deeplyprofound/password-sync/server/service/sync"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// ExportFormat names the document ExportVault writes
+const ExportFormat = "password-sync-vault"
+
+// exportFlushEvery is how many items ExportVault writes between flushes
+const exportFlushEvery = 200
+
+// exportSections are a zone's item arrays in an export, in the order they
+// are written
+var exportSections = []string{"crypto_keys", "credential_metadata", "sync_records"}
+
+// ExportVault streams the caller's vault as one JSON document for an
+// offline backup:
+//
+//	{"format": "password-sync-vault", "version": 1, "exported_at": "...",
+//	 "zones": [{<manifest>, "crypto_keys": [...], "credential_metadata": [...],
+//	            "sync_records": [...], "items": 3}, ...],
+//	 "items": 3}
+//
+// Each zone carries its manifest as GET /sync/manifest returns it, and its
+// live items in the push DTO shape with their ciphertext as stored, so an
+// import can check them against the digest. The document is written while
+// it is read; one cut short is not valid JSON.
+func (h *SyncHandler) ExportVault(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	stream := &exportStream{c: c}
+	result, err := h.service.Export(c.Request.Context(), caller, stream)
+	if err == nil {
+		err = stream.write([]byte(`],"items":` + strconv.Itoa(result.Items) + "}\n"))
+	}
+	if err != nil {
+		if !stream.began {
+			respondError(c, err)
+			return
+		}
+		// Headers are already sent; the unterminated document tells the
+		// client the export is incomplete
+		log.Printf("❌ Export for user=%s aborted after %d items: %v", caller.UserID, stream.items, err)
+	}
+	c.Writer.Flush()
+}
+
+// exportStream writes an export document to the response as it is read
+type exportStream struct {
+	c       *gin.Context
+	began   bool
+	zones   int
+	section int  // Index in exportSections of the open array; -1 for none
+	first   bool // Nothing written to the open array yet
+	items   int
+}
+
+func (s *exportStream) Begin(header *syncservice.ExportHeader) error {
+	filename := "vault-export-" + header.ExportedAt.Format("20060102-150405") + ".json"
+	s.c.Header("Content-Type", "application/json")
+	s.c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	s.c.Header("Cache-Control", "no-store")
+	s.c.Status(http.StatusOK)
+	s.began = true
+
+	opening, err := json.Marshal(gin.H{
+		"format":      ExportFormat,
+		"version":     header.Version,
+		"exported_at": header.ExportedAt,
+	})
+	if err != nil {
+		return err
+	}
+	return s.write(append(bytes.TrimSuffix(opening, []byte("}")), `,"zones":[`...))
+}
+
+func (s *exportStream) BeginZone(state *storage.SyncState) error {
+	manifest, err := json.Marshal(manifestJSON(state))
+	if err != nil {
+		return err
+	}
+	if s.zones > 0 {
+		manifest = append([]byte(","), manifest...)
+	}
+	s.zones++
+	s.section = -1
+	return s.write(bytes.TrimSuffix(manifest, []byte("}")))
+}
+
+func (s *exportStream) Key(key *models.CryptoKey) error {
+	return s.item(0, mapping.FromCryptoKey(key))
+}
+
+func (s *exportStream) Metadata(cred *models.CredentialMetadata) error {
+	return s.item(1, mapping.FromCredentialMetadata(cred, mapping.LegacySyncSchemaVersion))
+}
+
+func (s *exportStream) Record(record *models.SyncRecord) error {
+	return s.item(2, mapping.FromSyncRecord(record))
+}
+
+func (s *exportStream) EndZone(items int) error {
+	if err := s.open(len(exportSections) - 1); err != nil {
+		return err
+	}
+	return s.write([]byte(`],"items":` + strconv.Itoa(items) + "}"))
+}
+
+// item appends one item to the zone's array for section
+func (s *exportStream) item(section int, item interface{}) error {
+	if err := s.open(section); err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if !s.first {
+		encoded = append([]byte(","), encoded...)
+	}
+	s.first = false
+	if err := s.write(encoded); err != nil {
+		return err
+	}
+	s.items++
+	if s.items%exportFlushEvery == 0 {
+		s.c.Writer.Flush()
+	}
+	return nil
+}
+
+// open closes the zone's open array and opens the ones up to section, so
+// every zone has all three even when they are empty
+func (s *exportStream) open(section int) error {
+	for s.section < section {
+		var next []byte
+		if s.section >= 0 {
+			next = append(next, ']')
+		}
+		s.section++
+		next = append(next, `,"`+exportSections[s.section]+`":[`...)
+		s.first = true
+		if err := s.write(next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *exportStream) write(b []byte) error {
+	_, err := s.c.Writer.Write(b)
+	return err
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/features"
+	"github.com/gin-gonic/gin"
+)
+
+// healthPingTimeout bounds each dependency check, so a database that hangs
+// instead of refusing connections still fails the health check in time
+const healthPingTimeout = 2 * time.Second
+
+// Dependency is a service the server can't work without, checked on every
+// health request
+type Dependency struct {
+	Name string
+	Ping func(ctx context.Context) error
+}
+
+// Health reports liveness plus the resolved backend mode. Capabilities on
+// in-memory substitutes are listed under "degraded"; the server is still
+// healthy, so the status stays 200. A dependency that doesn't answer its
+// ping makes it 503, with the status of each under "dependencies".
+func Health(feats *features.Features, deps ...Dependency) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		degraded := []string{}
+		for _, capability := range feats.Degraded() {
+			degraded = append(degraded, capability.Name)
+		}
+
+		status, httpStatus := "ok", http.StatusOK
+		dependencies := map[string]string{}
+		for _, dep := range deps {
+			ctx, cancel := context.WithTimeout(c.Request.Context(), healthPingTimeout)
+			err := dep.Ping(ctx)
+			cancel()
+
+			dependencies[dep.Name] = "ok"
+			if err != nil {
+				// The error may name hosts; it goes to the log, not the
+				// unauthenticated response
+				log.Printf("⚠️  Health check: %s is down: %v", dep.Name, err)
+				dependencies[dep.Name] = "down"
+				status, httpStatus = "unavailable", http.StatusServiceUnavailable
+			}
+		}
+
+		c.JSON(httpStatus, gin.H{
+			"status":       status,
+			"mode":         "multi-tenant",
+			"encryption":   "zero-knowledge",
+			"backend_mode": feats.Mode(),
+			"capabilities": feats.All(),
+			"degraded":     degraded,
+			"dependencies": dependencies,
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	syncservice "github.com/deeplyprofound/password-sync/server/service/sync"
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultImportMaxBytes caps the body of POST /sync/import unless
+// SetImportMaxBytes says otherwise
+const DefaultImportMaxBytes = 64 << 20
+
+// ImportVaultRequest is a document ExportVault wrote
+type ImportVaultRequest struct {
+	Format  string              `json:"format" binding:"required"`
+	Version int                 `json:"version" binding:"required"`
+	Zones   []ImportZoneRequest `json:"zones"`
+}
+
+// ImportZoneRequest is a zone of an export: the manifest fields an import
+// checks, and its items
+type ImportZoneRequest struct {
+	Zone               string                  `json:"zone"`
+	Digest             []byte                  `json:"digest"`
+	DigestVersion      int                     `json:"digest_version"`
+	Keys               []CryptoKeyDTO          `json:"crypto_keys"`
+	CredentialMetadata []CredentialMetadataDTO `json:"credential_metadata"`
+	SyncRecords        []SyncRecordDTO         `json:"sync_records"`
+}
+
+// SetImportMaxBytes sets the largest body POST /sync/import reads
+func (h *SyncHandler) SetImportMaxBytes(n int64) {
+	if n > 0 {
+		h.importMaxBytes = n
+	}
+}
+
+// ImportVault restores a document from GET /sync/export. Each zone's items
+// must match its digest, and are written in one transaction with new
+// gencounts. The vault must hold no live items unless ?merge=true, under
+// which items the zone already holds at another version are settled like
+// conflicting pushes. Bodies over the configured cap are refused with 413.
+func (h *SyncHandler) ImportVault(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	maxBytes := h.importMaxBytes
+	if maxBytes == 0 {
+		maxBytes = DefaultImportMaxBytes
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+	var req ImportVaultRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"error": fmt.Sprintf("an import takes at most %d bytes", maxBytes),
+				"code":  "payload_too_large",
+			})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Format != ExportFormat {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("not a %s document", ExportFormat)})
+		return
+	}
+
+	in := syncservice.ImportInput{Version: req.Version, Merge: c.Query("merge") == "true"}
+	for _, zone := range req.Zones {
+		in.Zones = append(in.Zones, syncservice.ImportZone{
+			Zone:          zone.Zone,
+			Digest:        zone.Digest,
+			DigestVersion: zone.DigestVersion,
+			Keys:          zone.Keys,
+			Metadata:      zone.CredentialMetadata,
+			Records:       zone.SyncRecords,
+		})
+	}
+	result, err := h.service.Import(c.Request.Context(), caller, in)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	zones := make([]gin.H, 0, len(result.Zones))
+	for _, zone := range result.Zones {
+		zones = append(zones, gin.H{
+			"zone":       zone.Zone,
+			"gencount":   zone.GenCount,
+			"imported":   zone.Imported,
+			"skipped":    zone.Skipped,
+			"conflicted": zone.Conflicted,
+		})
+	}
+	conflicts := make([]gin.H, 0, len(result.Conflicts))
+	for _, conflict := range result.Conflicts {
+		conflicts = append(conflicts, gin.H{
+			"zone":             conflict.Zone,
+			"layer":            conflict.Layer,
+			"item_uuid":        conflict.ItemUUID,
+			"resolution":       conflict.Resolution,
+			"outcome":          conflict.Outcome,
+			"winning_gencount": conflict.WinningGenCount,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"imported":   result.Imported,
+		"skipped":    result.Skipped,
+		"conflicted": result.Conflicted,
+		"zones":      zones,
+		"conflicts":  conflicts,
+	})
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/mail"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+)
+
+const defaultUpcomingDeletionsWindow = 30 * 24 * time.Hour
+
+// inactivityAuditActions is the audit action of entering each stage
+var inactivityAuditActions = map[string]string{
+	storage.InactivityActive:         service.AuditActionActiveAgain,
+	storage.InactivityWarned:         service.AuditActionInactivityWarn,
+	storage.InactivityDormant:        service.AuditActionDormant,
+	storage.InactivityDeletionWarned: service.AuditActionDeletionWarn,
+	storage.InactivityDeletionQueued: service.AuditActionDeletionQueued,
+}
+
+// InactivityNotifier implements jobs.AccountNotifier: every stage goes into
+// the user's audit log and both warnings are emailed. Deleted accounts take
+// their audit log with them; the job report keeps their IDs.
+type InactivityNotifier struct {
+	store  storage.Store
+	mailer mail.Mailer
+	hub    *websocket.Hub
+}
+
+func NewInactivityNotifier(store storage.Store, mailer mail.Mailer) *InactivityNotifier {
+	return &InactivityNotifier{store: store, mailer: mailer}
+}
+
+// SetHub sets the WebSocket hub so accounts queued for deletion or deleted
+// lose their connections
+func (n *InactivityNotifier) SetHub(hub *websocket.Hub) {
+	n.hub = hub
+}
+
+// InactivityStageChanged implements jobs.AccountNotifier
+func (n *InactivityNotifier) InactivityStageChanged(account *storage.InactiveAccount, stage string, deadline time.Time) {
+	details := gin.H{
+		"from":        account.Stage,
+		"last_active": account.LastActive.UTC().Format(time.RFC3339),
+	}
+	if !deadline.IsZero() {
+		details["deadline"] = deadline.UTC().Format(time.RFC3339)
+	}
+	recordAudit(n.store, &storage.AuditEvent{
+		UserID:  account.UserID,
+		Action:  inactivityAuditActions[stage],
+		Details: auditDetails(details),
+	})
+
+	if msg, ok := inactivityEmail(account, stage, deadline); ok {
+		if err := n.mailer.Send(context.Background(), msg); err != nil {
+			log.Printf("❌ Failed to email inactivity warning to user %s: %v", account.UserID, err)
+		}
+	}
+
+	// The authorizer now refuses the deactivated account
+	if stage == storage.InactivityDeletionQueued && n.hub != nil {
+		n.hub.RefreshClientAuthorization(account.UserID)
+	}
+	log.Printf("💤 Account %s inactive since %s: %s -> %s",
+		account.UserID, account.LastActive.UTC().Format(time.RFC3339), account.Stage, stage)
+}
+
+// AccountDeleted implements jobs.AccountNotifier
+func (n *InactivityNotifier) AccountDeleted(account *storage.InactiveAccount) {
+	if n.hub != nil {
+		n.hub.DisconnectUser(account.UserID, websocket.CloseRevoked)
+	}
+	log.Printf("🗑️  Deleted account %s, inactive since %s",
+		account.UserID, account.LastActive.UTC().Format(time.RFC3339))
+}
+
+// inactivityEmail is the warning sent on entering stage, if it has one
+func inactivityEmail(account *storage.InactiveAccount, stage string, deadline time.Time) (mail.Message, bool) {
+	lastActive := account.LastActive.UTC().Format("January 2, 2006")
+	date := deadline.UTC().Format("January 2, 2006")
+
+	switch stage {
+	case storage.InactivityWarned:
+		return mail.Message{
+			To:      account.Email,
+			Subject: "Your Password Sync account will be signed out",
+			Body: fmt.Sprintf("Your Password Sync account has not been used since %s.\n\n"+
+				"On %s your devices will be signed out and need your password to sign in again. "+
+				"Your data is kept.\n\nSigning in before then keeps the account active.\n", lastActive, date),
+		}, true
+	case storage.InactivityDeletionWarned:
+		return mail.Message{
+			To:      account.Email,
+			Subject: "Your Password Sync account will be deleted",
+			Body: fmt.Sprintf("Your Password Sync account has not been used since %s.\n\n"+
+				"On %s the account and everything stored in it will be deleted for good.\n\n"+
+				"Sign in before then to keep it.\n", lastActive, date),
+		}, true
+	}
+	return mail.Message{}, false
+}
+
+// SetInactivityJob enables the upcoming deletions endpoint
+func (h *AdminHandler) SetInactivityJob(job *jobs.AccountInactivityJob) {
+	h.inactivity = job
+}
+
+// ListUpcomingDeletions lists the accounts the inactivity lifecycle deletes
+// within ?within= (a duration, default 720h) unless they are used again
+func (h *AdminHandler) ListUpcomingDeletions(c *gin.Context) {
+	if h.inactivity == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "account inactivity lifecycle not configured"})
+		return
+	}
+
+	within := defaultUpcomingDeletionsWindow
+	if value := c.Query("within"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "within must be a positive duration such as 720h"})
+			return
+		}
+		within = d
+	}
+
+	deletions, err := h.inactivity.UpcomingDeletions(within)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list upcoming deletions: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"within":    within.String(),
+		"deletions": deletions,
+	})
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	syncservice "github.com/deeplyprofound/password-sync/server/service/sync"
+	"github.com/gin-gonic/gin"
+)
+
+// IntegrityFinding is one problem of a zone, with the items to repair
+type IntegrityFinding struct {
+	Check     string   `json:"check"`
+	Severity  string   `json:"severity"` // error, warning or info
+	Count     int64    `json:"count"`
+	ItemUUIDs []string `json:"item_uuids"`
+	KeyUUIDs  []string `json:"key_uuids,omitempty"`
+	Truncated bool     `json:"truncated"`
+	Repair    string   `json:"repair,omitempty"`
+}
+
+// IntegrityReport answers GET /sync/integrity
+type IntegrityReport struct {
+	Zone          string             `json:"zone"`
+	GeneratedAt   string             `json:"generated_at"`
+	GenCount      int64              `json:"gencount"`
+	LeafCount     int                `json:"leaf_count"`
+	MinEncVersion *int               `json:"min_enc_version"`
+	Healthy       bool               `json:"healthy"`
+	Findings      []IntegrityFinding `json:"findings"`
+	RunsLeft      int                `json:"runs_left"`
+}
+
+// NewIntegrityReport renders a service report
+func NewIntegrityReport(r *syncservice.IntegrityReport) *IntegrityReport {
+	report := &IntegrityReport{
+		Zone:          r.Zone,
+		GeneratedAt:   r.GeneratedAt.UTC().Format(time.RFC3339),
+		GenCount:      r.GenCount,
+		LeafCount:     r.LeafCount,
+		MinEncVersion: r.MinEncVersion,
+		Healthy:       r.Healthy(),
+		Findings:      make([]IntegrityFinding, 0, len(r.Findings)),
+		RunsLeft:      r.RunsLeft,
+	}
+	for _, f := range r.Findings {
+		report.Findings = append(report.Findings, IntegrityFinding{
+			Check:     f.Check,
+			Severity:  f.Severity,
+			Count:     f.Count,
+			ItemUUIDs: f.ItemUUIDs,
+			KeyUUIDs:  f.KeyUUIDs,
+			Truncated: f.Truncated,
+			Repair:    f.Repair,
+		})
+	}
+	return report
+}
+
+// SetIntegrityLimits sets how many times a day each user may call GET
+// /sync/integrity and the statement timeout of its queries
+func (h *SyncHandler) SetIntegrityLimits(runsPerDay int, timeout time.Duration) {
+	h.service.SetIntegrityLimits(syncservice.IntegrityLimits{RunsPerDay: runsPerDay, Timeout: timeout})
+}
+
+// GetIntegrity checks one of the caller's zones (?zone=, default
+// "default") for broken key references, digest drift, unreferenced keys and
+// records some active device can't read, so the client can repair just
+// those items. Runs are rate limited per user.
+func (h *SyncHandler) GetIntegrity(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	zone := c.DefaultQuery("zone", "default")
+	if err := sync.ValidateZoneName(zone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_zone"})
+		return
+	}
+
+	report, err := h.service.Integrity(c.Request.Context(), caller, zone)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, NewIntegrityReport(report))
+}
@@ -0,0 +1,16 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// JWKS publishes the public keys access tokens are signed with, for
+// services checking them on their own. The set is empty while tokens are
+// signed with the shared secret.
+func JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, auth.JWKS())
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/deeplyprofound/password-sync/server/domain/limits"
+	"github.com/gin-gonic/gin"
+)
+
+// SetTierPolicy sets the limits of each subscription tier, which pushes and
+// imports are held to
+func (h *SyncHandler) SetTierPolicy(policy limits.Policy) {
+	h.service.SetTierPolicy(policy)
+}
+
+// SetTierPolicy sets the limits of each subscription tier, which device
+// registrations are held to
+func (h *DeviceHandler) SetTierPolicy(policy limits.Policy) {
+	h.service.SetTierPolicy(policy)
+}
+
+// SetTierPolicy sets the limits GET /account/limits reports
+func (h *SettingsHandler) SetTierPolicy(policy limits.Policy) {
+	h.tiers = policy
+}
+
+// LimitResponse is an account's usage of one resource. Limit is null when
+// the tier leaves the resource unlimited.
+type LimitResponse struct {
+	Used  int64  `json:"used"`
+	Limit *int64 `json:"limit"`
+}
+
+type LimitsResponse struct {
+	Tier        string        `json:"tier"`
+	Credentials LimitResponse `json:"credentials"` // Live credentials, across zones
+	Devices     LimitResponse `json:"devices"`     // Active devices
+}
+
+// GetLimits reports the caller's subscription tier and how much of each
+// resource it limits the account uses
+func (h *SettingsHandler) GetLimits(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	usage, err := h.store.GetAccountUsage(c.Request.Context(), caller.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to count usage: " + err.Error()})
+		return
+	}
+
+	tierLimits := h.tiers.For(caller.Tier)
+	c.JSON(http.StatusOK, LimitsResponse{
+		Tier:        h.tiers.Tier(caller.Tier),
+		Credentials: newLimitResponse(usage.Credentials, tierLimits.Credentials),
+		Devices:     newLimitResponse(usage.Devices, tierLimits.Devices),
+	})
+}
+
+func newLimitResponse(used, max int64) LimitResponse {
+	response := LimitResponse{Used: used}
+	if max > 0 {
+		response.Limit = &max
+	}
+	return response
+}
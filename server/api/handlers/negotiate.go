@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gin-gonic/gin/render"
+)
+
+// renderNegotiated writes obj as JSON or MessagePack, whichever the Accept
+// header asks for. Without one, or with a wildcard, preferMsgPack (the
+// calling device's capabilities) decides. Anything else gets JSON.
+func renderNegotiated(c *gin.Context, code int, obj interface{}, preferMsgPack bool) {
+	offers := []string{binding.MIMEJSON, binding.MIMEMSGPACK, binding.MIMEMSGPACK2}
+	if preferMsgPack {
+		offers = []string{binding.MIMEMSGPACK, binding.MIMEMSGPACK2, binding.MIMEJSON}
+	}
+
+	switch c.NegotiateFormat(offers...) {
+	case binding.MIMEMSGPACK, binding.MIMEMSGPACK2:
+		c.Render(code, render.MsgPack{Data: obj})
+	default:
+		c.JSON(code, obj)
+	}
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/mail"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultDeprecatedHashLimit = 100
+	maxDeprecatedHashLimit     = 1000
+)
+
+// HashUpgradeNotifier implements jobs.HashUpgradeNotifier: both steps go
+// into the user's audit log and the request is emailed
+type HashUpgradeNotifier struct {
+	store  storage.Store
+	mailer mail.Mailer
+	hub    *websocket.Hub
+}
+
+func NewHashUpgradeNotifier(store storage.Store, mailer mail.Mailer) *HashUpgradeNotifier {
+	return &HashUpgradeNotifier{store: store, mailer: mailer}
+}
+
+// SetHub sets the WebSocket hub so enforced accounts' devices reconnect
+// through a login
+func (n *HashUpgradeNotifier) SetHub(hub *websocket.Hub) {
+	n.hub = hub
+}
+
+// HashUpgradeRequested implements jobs.HashUpgradeNotifier
+func (n *HashUpgradeNotifier) HashUpgradeRequested(account *storage.HashUpgradeAccount) {
+	deadline := account.Deadline.UTC()
+	recordAudit(n.store, &storage.AuditEvent{
+		UserID: account.UserID,
+		Action: service.AuditActionHashUpgradeAsk,
+		Details: auditDetails(gin.H{
+			"hash_version": account.HashVersion,
+			"deadline":     deadline.Format(time.RFC3339),
+		}),
+	})
+
+	msg := mail.Message{
+		To:      account.Email,
+		Subject: "Sign in to Password Sync to update your account security",
+		Body: fmt.Sprintf("We have strengthened how Password Sync protects account passwords. "+
+			"Yours is updated the next time you sign in with it.\n\n"+
+			"Please sign in before %s. After that your devices are signed out "+
+			"and need your password to sign in again.\n", deadline.Format("January 2, 2006")),
+	}
+	if err := n.mailer.Send(context.Background(), msg); err != nil {
+		log.Printf("❌ Failed to email hash upgrade request to user %s: %v", account.UserID, err)
+	}
+}
+
+// HashUpgradeEnforced implements jobs.HashUpgradeNotifier
+func (n *HashUpgradeNotifier) HashUpgradeEnforced(account *storage.HashUpgradeAccount) {
+	recordAudit(n.store, &storage.AuditEvent{
+		UserID:  account.UserID,
+		Action:  service.AuditActionHashUpgradeDue,
+		Details: auditDetails(gin.H{"hash_version": account.HashVersion}),
+	})
+	if n.hub != nil {
+		n.hub.DisconnectUser(account.UserID, websocket.CloseReauthenticate)
+	}
+	log.Printf("🔑 Revoked refresh tokens of user %s, still on password hash version %d",
+		account.UserID, account.HashVersion)
+}
+
+type StartHashUpgradeCampaignRequest struct {
+	Deadline time.Time `json:"deadline" binding:"required"`
+}
+
+// GetPasswordHashStats counts accounts per password hash version and those
+// in an upgrade campaign
+func (h *AdminHandler) GetPasswordHashStats(c *gin.Context) {
+	stats, err := h.store.PasswordHashStats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to count password hashes: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"current_version": auth.CurrentHashVersion,
+		"versions":        stats.Versions,
+		"flagged":         stats.Flagged,
+		"notified":        stats.Notified,
+		"enforced":        stats.Enforced,
+	})
+}
+
+// ListDeprecatedHashes lists up to ?limit= (default 100) active accounts
+// whose password hash is in a deprecated format
+func (h *AdminHandler) ListDeprecatedHashes(c *gin.Context) {
+	limit := defaultDeprecatedHashLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxDeprecatedHashLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxDeprecatedHashLimit)})
+			return
+		}
+		limit = n
+	}
+
+	accounts, err := h.store.ListDeprecatedHashAccounts(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list deprecated hashes: " + err.Error()})
+		return
+	}
+	if accounts == nil {
+		accounts = []*storage.HashUpgradeAccount{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"current_version": auth.CurrentHashVersion,
+		"users":           accounts,
+	})
+}
+
+// StartHashUpgradeCampaign gives every active account on a deprecated hash
+// until the deadline to log in. The password_hash_upgrade job notifies
+// them and, past the deadline, revokes their refresh tokens.
+func (h *AdminHandler) StartHashUpgradeCampaign(c *gin.Context) {
+	var req StartHashUpgradeCampaignRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !req.Deadline.After(h.clock.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "deadline must be in the future"})
+		return
+	}
+
+	flagged, err := h.store.StartHashUpgradeCampaign(req.Deadline)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start campaign: " + err.Error()})
+		return
+	}
+	log.Printf("🔑 Password hash upgrade campaign: %d accounts must log in before %s",
+		flagged, req.Deadline.UTC().Format(time.RFC3339))
+
+	c.JSON(http.StatusOK, gin.H{
+		"flagged":  flagged,
+		"deadline": req.Deadline,
+	})
+}
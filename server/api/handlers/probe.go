@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// MaxProbeItems caps the item UUIDs of one probe
+const MaxProbeItems = 5000
+
+// States of a probed item
+const (
+	ProbeStateLive       = "live"
+	ProbeStateTombstoned = "tombstoned"
+	ProbeStateUnknown    = "unknown"
+)
+
+type ProbeSyncRequest struct {
+	Zone      string   `json:"zone"`
+	ItemUUIDs []string `json:"item_uuids" binding:"required"`
+}
+
+// ProbeItem is the server's view of one probed item. Layer and gencount
+// are empty for unknown items.
+type ProbeItem struct {
+	ItemUUID string `json:"item_uuid"`
+	State    string `json:"state"`
+	Layer    string `json:"layer,omitempty"`
+	GenCount int64  `json:"gencount,omitempty"`
+}
+
+// NewProbeItems answers a probe in request order, one entry per distinct
+// UUID
+func NewProbeItems(ids []uuid.UUID, states storage.ItemStates) []ProbeItem {
+	items := make([]ProbeItem, 0, len(ids))
+	for _, id := range ids {
+		item := ProbeItem{ItemUUID: id.String(), State: ProbeStateUnknown}
+		if state, ok := states[id]; ok {
+			item.State = ProbeStateLive
+			if state.Tombstone {
+				item.State = ProbeStateTombstoned
+			}
+			item.Layer = state.Layer
+			item.GenCount = state.GenCount
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// parseProbeUUIDs validates and de-duplicates the probed UUIDs, keeping
+// their first-seen order
+func parseProbeUUIDs(values []string) ([]uuid.UUID, error) {
+	seen := make(map[uuid.UUID]bool, len(values))
+	ids := make([]uuid.UUID, 0, len(values))
+	for i, value := range values {
+		id, err := uuid.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("item_uuids[%d] is not a valid UUID", i)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// ProbeSync reports the current state of items a client holds without
+// returning their content: live or tombstoned with the gencount of the last
+// write, or unknown if the zone doesn't have it. A returning client uses it
+// to find items deleted while it was away and items the server lost.
+func (h *SyncHandler) ProbeSync(c *gin.Context) {
+	userID := middleware.UserID(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	var req ProbeSyncRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Zone == "" {
+		req.Zone = "default"
+	}
+	if len(req.ItemUUIDs) > MaxProbeItems {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("a probe takes at most %d item_uuids", MaxProbeItems),
+			"code":  "payload_too_large",
+		})
+		return
+	}
+	ids, err := parseProbeUUIDs(req.ItemUUIDs)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.service.CheckDevice(c.Request.Context(), callerFrom(c), false); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	states, err := h.store.ProbeItems(c.Request.Context(), storage.ItemProbe{
+		UserID:    userID,
+		Zone:      req.Zone,
+		ItemUUIDs: ids,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to probe items: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"zone":  req.Zone,
+		"items": NewProbeItems(ids, states),
+	})
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/domain/vault"
+	"github.com/gin-gonic/gin"
+)
+
+type SearchResult struct {
+	ItemUUID string `json:"item_uuid"`
+	Server   string `json:"server"`
+	Account  string `json:"account"`
+	Label    string `json:"label"`
+	GenCount int64  `json:"gencount"`
+}
+
+// SearchCredentials searches live credential metadata by server, account, or label.
+// With group_by=server, results are nested as servers → accounts → item UUIDs so
+// multiple accounts on one server stay distinct.
+func (h *SyncHandler) SearchCredentials(c *gin.Context) {
+	userID := middleware.UserID(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+	if err := h.service.CheckDevice(c.Request.Context(), callerFrom(c), false); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	zone := c.DefaultQuery("zone", "default")
+	query := c.Query("q")
+	groupBy := c.Query("group_by")
+	if groupBy != "" && groupBy != "server" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group_by must be 'server'"})
+		return
+	}
+
+	creds, err := h.store.SearchCredentialMetadata(userID, zone, query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to search credentials: " + err.Error()})
+		return
+	}
+
+	if groupBy == "server" {
+		c.JSON(http.StatusOK, gin.H{
+			"zone":    zone,
+			"servers": vault.GroupByServer(creds),
+		})
+		return
+	}
+
+	results := make([]SearchResult, 0, len(creds))
+	for _, cred := range creds {
+		results = append(results, SearchResult{
+			ItemUUID: cred.ItemUUID.String(),
+			Server:   cred.Server,
+			Account:  cred.Account,
+			Label:    ptrToString(cred.Label),
+			GenCount: cred.GenCount,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"zone":    zone,
+		"results": results,
+	})
+}
+
+// GetDuplicates lists live credentials sharing the same normalized server and account
+func (h *SyncHandler) GetDuplicates(c *gin.Context) {
+	userID := middleware.UserID(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+	if err := h.service.CheckDevice(c.Request.Context(), callerFrom(c), false); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	zone := c.DefaultQuery("zone", "default")
+
+	creds, err := h.store.GetCredentialMetadataByUserWithFilter(userID, zone, 0, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get credential metadata: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"zone":       zone,
+		"duplicates": vault.FindDuplicates(creds),
+	})
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/domain/limits"
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+)
+
+type SettingsHandler struct {
+	store storage.Store
+	tiers limits.Policy
+}
+
+func NewSettingsHandler(store storage.Store) *SettingsHandler {
+	return &SettingsHandler{store: store, tiers: limits.DefaultPolicy()}
+}
+
+type SettingsResponse struct {
+	EncVersionPolicy         string `json:"enc_version_policy"`
+	DeviceAutoDeactivateDays int    `json:"device_auto_deactivate_days"` // 0 = off
+	DeviceApproval           string `json:"device_approval"`             // off, read_only or required
+}
+
+// UpdateSettingsRequest changes only the settings present in the body
+type UpdateSettingsRequest struct {
+	EncVersionPolicy         *string `json:"enc_version_policy"`
+	DeviceAutoDeactivateDays *int    `json:"device_auto_deactivate_days"`
+	DeviceApproval           *string `json:"device_approval"`
+}
+
+func newSettingsResponse(settings *storage.UserSettings) SettingsResponse {
+	return SettingsResponse{
+		EncVersionPolicy:         settings.EncVersionPolicy,
+		DeviceAutoDeactivateDays: settings.DeviceAutoDeactivateDays,
+		DeviceApproval:           settings.DeviceApproval,
+	}
+}
+
+func (h *SettingsHandler) GetSettings(c *gin.Context) {
+	userID := middleware.UserID(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	settings, err := h.store.GetUserSettings(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load settings: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, newSettingsResponse(settings))
+}
+
+func (h *SettingsHandler) UpdateSettings(c *gin.Context) {
+	userID := middleware.UserID(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	// Pending devices may not loosen their own approval
+	if err := service.CheckDeviceTrust(c.Request.Context(), h.store, callerFrom(c), true); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	var req UpdateSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	settings, err := h.store.GetUserSettings(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load settings: " + err.Error()})
+		return
+	}
+
+	changed := gin.H{}
+	if req.EncVersionPolicy != nil {
+		if !sync.ValidEncVersionPolicy(*req.EncVersionPolicy) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": sync.ErrUnknownEncVersionPolicy.Error(),
+				"code":  "invalid_setting",
+				"field": "enc_version_policy",
+			})
+			return
+		}
+		settings.EncVersionPolicy = *req.EncVersionPolicy
+		changed["enc_version_policy"] = settings.EncVersionPolicy
+	}
+	if days := req.DeviceAutoDeactivateDays; days != nil {
+		if *days != 0 && *days < jobs.MinAutoDeactivateDays {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("device_auto_deactivate_days must be 0 (off) or at least %d", jobs.MinAutoDeactivateDays),
+				"code":  "invalid_setting",
+				"field": "device_auto_deactivate_days",
+			})
+			return
+		}
+		settings.DeviceAutoDeactivateDays = *days
+		changed["device_auto_deactivate_days"] = settings.DeviceAutoDeactivateDays
+	}
+	if req.DeviceApproval != nil {
+		if !peer.ValidDeviceApproval(*req.DeviceApproval) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": peer.ErrUnknownApproval.Error(),
+				"code":  "invalid_setting",
+				"field": "device_approval",
+			})
+			return
+		}
+		settings.DeviceApproval = *req.DeviceApproval
+		changed["device_approval"] = settings.DeviceApproval
+	}
+
+	if len(changed) > 0 {
+		if err := h.store.UpdateUserSettings(c.Request.Context(), userID, settings); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to save settings: " + err.Error()})
+			return
+		}
+
+		event := newAuditEvent(c, userID, service.AuditActionSettings)
+		event.Details = auditDetails(changed)
+		recordAudit(h.store, event)
+	}
+
+	c.JSON(http.StatusOK, newSettingsResponse(settings))
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	syncservice "github.com/deeplyprofound/password-sync/server/service/sync"
+	"github.com/gin-gonic/gin"
+)
+
+// snapshotFlushEvery is how many lines GetSnapshot writes between flushes
+const snapshotFlushEvery = 200
+
+// SnapshotRequest is the query of GET /sync/snapshot. Layers are left out
+// unless asked for; a resumed snapshot sends only the checkpoint (and
+// optionally a limit).
+type SnapshotRequest struct {
+	IncludeKeys     bool   `form:"include_keys"`
+	IncludeMetadata bool   `form:"include_metadata"`
+	IncludeRecords  bool   `form:"include_records"`
+	Limit           int    `form:"limit" binding:"omitempty,min=1,max=5000"`
+	Checkpoint      string `form:"checkpoint"`
+}
+
+// GetSnapshot serves a cold-starting client the whole account as of one
+// moment, as JSON Lines: a "snapshot" line with every zone's gencount (and,
+// on the first page, manifest), a "key", "credential_metadata" or
+// "sync_record" line per live item, and an "end" line with the page's
+// checkpoint. A response without the end line was cut short.
+func (h *SyncHandler) GetSnapshot(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+
+	var req SnapshotRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	stream := &snapshotStream{c: c, enc: json.NewEncoder(c.Writer)}
+	result, err := h.service.Snapshot(c.Request.Context(), caller, syncservice.SnapshotInput{
+		Layers: mapping.PullLayers{
+			Keys:     req.IncludeKeys,
+			Metadata: req.IncludeMetadata,
+			Records:  req.IncludeRecords,
+		},
+		Limit:      req.Limit,
+		Checkpoint: req.Checkpoint,
+	}, stream)
+	if err != nil {
+		if !stream.began {
+			respondError(c, err)
+			return
+		}
+		// Headers are already sent; the missing end line tells the client
+		// the page is incomplete
+		c.Writer.Flush()
+		log.Printf("❌ Snapshot for user=%s aborted after %d lines: %v", caller.UserID, stream.lines, err)
+		return
+	}
+
+	end := gin.H{"type": "end", "items": result.Items, "has_more": result.HasMore}
+	if result.Checkpoint != "" {
+		end["checkpoint"] = result.Checkpoint
+	}
+	if err := stream.write(end); err != nil {
+		log.Printf("❌ Snapshot for user=%s aborted after %d lines: %v", caller.UserID, stream.lines, err)
+	}
+	c.Writer.Flush()
+}
+
+// snapshotStream writes a snapshot page to the response as it is read
+type snapshotStream struct {
+	c      *gin.Context
+	enc    *json.Encoder
+	began  bool
+	lines  int
+	schema int // The sync schema version of the items
+}
+
+func (s *snapshotStream) Begin(header *syncservice.SnapshotHeader) error {
+	s.c.Header("Content-Type", "application/x-ndjson")
+	s.c.Header("Cache-Control", "no-store")
+	s.c.Status(http.StatusOK)
+	s.began = true
+	s.schema = header.SyncSchema
+
+	line := gin.H{"type": "snapshot", "gencounts": header.GenCounts, "included": header.Included}
+	if header.Zones != nil {
+		zones := make([]gin.H, 0, len(header.Zones))
+		for _, state := range header.Zones {
+			zones = append(zones, manifestJSON(state))
+		}
+		line["zones"] = zones
+	}
+	return s.write(line)
+}
+
+func (s *snapshotStream) Key(key *models.CryptoKey) error {
+	return s.write(gin.H{"type": "key", "zone": key.Zone, "item": mapping.FromCryptoKey(key)})
+}
+
+func (s *snapshotStream) Metadata(cred *models.CredentialMetadata) error {
+	return s.write(gin.H{"type": "credential_metadata", "zone": cred.Zone, "item": mapping.FromCredentialMetadata(cred, s.schema)})
+}
+
+func (s *snapshotStream) Record(record *models.SyncRecord) error {
+	return s.write(gin.H{"type": "sync_record", "zone": record.Zone, "item": mapping.FromSyncRecord(record)})
+}
+
+func (s *snapshotStream) write(line gin.H) error {
+	if err := s.enc.Encode(line); err != nil {
+		return err
+	}
+	s.lines++
+	if s.lines%snapshotFlushEvery == 0 {
+		s.c.Writer.Flush()
+	}
+	return nil
+}
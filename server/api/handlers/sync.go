@@ -1,35 +1,100 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
-	"github.com/deeplyprofound/password-sync/pkg/models"
+	apperrors "github.com/deeplyprofound/password-sync/pkg/errors"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
 	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/clock"
 	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/postcommit"
+	"github.com/deeplyprofound/password-sync/server/service"
+	syncservice "github.com/deeplyprofound/password-sync/server/service/sync"
 	"github.com/deeplyprofound/password-sync/server/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
+// SyncHandler serves the sync routes. Manifests, pulls, pushes and deletes
+// go through a syncservice.Service; zone creation, probes, search and
+// diagnostics still read the store directly.
 type SyncHandler struct {
-	pgStore *storage.PostgresStore
-	hub     *websocket.Hub
+	store   storage.Store
+	engines *sync.Registry
+	clock   clock.Clock
+	service *syncservice.Service
+
+	importMaxBytes int64         // Body cap of POST /sync/import; 0 for DefaultImportMaxBytes
+	staleAge       time.Duration // Health report age threshold; 0 for DefaultStaleCredentialAge
+}
+
+func NewSyncHandler(store storage.Store, engines *sync.Registry) *SyncHandler {
+	return &SyncHandler{
+		store:   store,
+		engines: engines,
+		clock:   clock.System,
+		service: syncservice.NewService(store, engines),
+	}
+}
+
+// NewSyncHandlerWithService serves the routes that go through svc, e.g.
+// against an in-memory store in tests. Routes that still read the store
+// directly are not available.
+func NewSyncHandlerWithService(svc *syncservice.Service) *SyncHandler {
+	return &SyncHandler{clock: clock.System, service: svc}
 }
 
-func NewSyncHandler(pgStore *storage.PostgresStore) *SyncHandler {
-	return &SyncHandler{pgStore: pgStore}
+// Service returns the sync service the handler calls
+func (sh *SyncHandler) Service() *syncservice.Service {
+	return sh.service
 }
 
 func (sh *SyncHandler) SetHub(hub *websocket.Hub) {
-	sh.hub = hub
+	if hub != nil {
+		sh.service.SetHub(hub)
+	}
 }
 
-func stringToPtr(s string) *string {
-	if s == "" {
-		return nil
+// SetPostCommitQueue defers a push's digest and event work to q. Without
+// one that work runs before the response.
+func (sh *SyncHandler) SetPostCommitQueue(q *postcommit.Queue) {
+	sh.service.SetPostCommitQueue(q)
+}
+
+// SetConflictStrategy sets how pushes settle records made from older
+// versions than the stored ones, unless a push asks for another
+func (sh *SyncHandler) SetConflictStrategy(strategy sync.ConflictResolutionStrategy) {
+	sh.service.SetConflictStrategy(strategy)
+}
+
+// SetTombstonePolicy sets how a delete and an edit of the same item are
+// settled
+func (sh *SyncHandler) SetTombstonePolicy(policy sync.TombstonePolicy) {
+	sh.service.SetTombstonePolicy(policy)
+}
+
+// SetRecoveryWindow sets how long DELETE /sync/credentials can be undone
+func (sh *SyncHandler) SetRecoveryWindow(d time.Duration) {
+	sh.service.SetRecoveryWindow(d)
+}
+
+// SetClock replaces the clock used for event timestamps
+func (sh *SyncHandler) SetClock(c clock.Clock) {
+	sh.clock = c
+	sh.service.SetClock(c)
+}
+
+// broadcast notifies the user's connected devices; see service.Broadcast
+func broadcast(hub *websocket.Hub, event *websocket.SyncEvent) {
+	if hub == nil {
+		return
 	}
-	return &s
+	service.Broadcast(hub, event)
 }
 
 func ptrToString(s *string) string {
@@ -39,10 +104,41 @@ func ptrToString(s *string) string {
 	return *s
 }
 
+// PullSyncRequest selects a zone's changes since LastGenCount. The include
+// flags skip whole layers (e.g. autofill needs only metadata); omitted
+// flags default to true.
 type PullSyncRequest struct {
 	Zone              string `json:"zone"`
 	LastGenCount      int64  `json:"last_gencount"`
 	IncludeTombstoned bool   `json:"include_tombstoned"`
+	IncludeKeys       *bool  `json:"include_keys"`
+	IncludeMetadata   *bool  `json:"include_metadata"`
+	IncludeRecords    *bool  `json:"include_records"`
+
+	// Limit pages the pull: each response holds at most Limit items and,
+	// while more remain, a checkpoint token for the next page. A resumed
+	// pull sends only the checkpoint (and optionally a limit).
+	Limit      int    `json:"limit" binding:"omitempty,min=1,max=1000"`
+	Checkpoint string `json:"checkpoint"`
+
+	// ItemUUIDs pulls only these items, e.g. the added and modified ones
+	// of a diff. Such a pull is not paged.
+	ItemUUIDs []string `json:"item_uuids"`
+}
+
+// PushItemResult is what became of one item of a push: "synced" with its
+// gencount, or "failed" with a code (invalid_item, with the field, or
+// item_rejected) and an error. Failed items were not written; the rest of
+// the push was.
+type PushItemResult struct {
+	Layer    string `json:"layer"`
+	Index    int    `json:"index"` // Position in the request's list of that layer
+	ItemUUID string `json:"item_uuid"`
+	Status   string `json:"status"`
+	GenCount int64  `json:"gencount,omitempty"`
+	Code     string `json:"code,omitempty"`
+	Field    string `json:"field,omitempty"`
+	Error    string `json:"error,omitempty"`
 }
 
 type PushSyncRequest struct {
@@ -50,476 +146,370 @@ type PushSyncRequest struct {
 	Keys               []CryptoKeyDTO          `json:"keys"`
 	CredentialMetadata []CredentialMetadataDTO `json:"credential_metadata"`
 	SyncRecords        []SyncRecordDTO         `json:"sync_records"`
-}
 
-type CryptoKeyDTO struct {
-	ItemUUID  string `json:"item_uuid" binding:"required"`
-	KeyClass  int    `json:"key_class" binding:"required"`
-	KeyType   int    `json:"key_type" binding:"required"`
-	Label     string `json:"label"`
-	AppLabel  string `json:"application_label"`
-	Data      []byte `json:"data" binding:"required"`
-	Flags     []byte `json:"usage_flags" binding:"required"`
-	AccGroup  string `json:"access_group"`
-	GenCount  int64  `json:"gencount"`
-	Tombstone bool   `json:"tombstone"`
-}
+	// Sequence numbers the pushes of one device from 1, e.g. the requests
+	// of an offline flush split by the size caps. A numbered push is
+	// applied only right after the device's previous one; omit it for
+	// pushes that need no ordering.
+	Sequence int64 `json:"sequence" binding:"omitempty,min=1"`
 
-type CredentialMetadataDTO struct {
-	ItemUUID        string `json:"item_uuid" binding:"required"`
-	Server          string `json:"server" binding:"required"`
-	Account         string `json:"account" binding:"required"`
-	Protocol        int    `json:"protocol"`
-	Port            int    `json:"port"`
-	Path            string `json:"path"`
-	Label           string `json:"label"`
-	AccGroup        string `json:"access_group"`
-	PasswordKeyUUID string `json:"password_key_uuid" binding:"required"`
-	MetadataKeyUUID string `json:"metadata_key_uuid"`
-	GenCount        int64  `json:"gencount"`
-	Tombstone       bool   `json:"tombstone"`
+	// ConflictStrategy settles records made from older versions than the
+	// stored ones for this push: last_write_wins, highest_gencount_wins or
+	// manual. The server's CONFLICT_STRATEGY when omitted.
+	ConflictStrategy string `json:"conflict_strategy"`
 }
 
-type SyncRecordDTO struct {
-	ItemUUID      string `json:"item_uuid" binding:"required"`
-	ParentKeyUUID string `json:"parent_key_uuid"`
-	WrappedKey    []byte `json:"wrapped_key" binding:"required"`
-	EncItem       []byte `json:"enc_item" binding:"required"`
-	EncVersion    int    `json:"enc_version"`
-	ContextID     string `json:"context_id"`
-	GenCount      int64  `json:"gencount"`
-	Tombstone     bool   `json:"tombstone"`
+// PushConflictResult is how a record pushed from an older version of its
+// item than the stored one was settled: client_wins when it replaced the
+// stored record, server_wins when the stored one stays. Outcome says why:
+// ordered, delete_wins, edit_wins or both_deleted.
+type PushConflictResult struct {
+	ItemUUID        string `json:"item_uuid"`
+	Resolution      string `json:"resolution"`
+	Outcome         string `json:"outcome"`
+	WinningGenCount int64  `json:"winning_gencount"`
 }
 
+// The item DTOs live in the mapping package with their conversions
+type (
+	CryptoKeyDTO          = mapping.CryptoKeyDTO
+	CredentialMetadataDTO = mapping.CredentialMetadataDTO
+	SyncRecordDTO         = mapping.SyncRecordDTO
+)
+
 func (h *SyncHandler) GetManifest(c *gin.Context) {
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+	caller, ok := requireCaller(c)
+	if !ok {
 		return
 	}
 
-	zone := c.DefaultQuery("zone", "default")
-
-	syncState, err := h.pgStore.GetSyncState(userID.(string), zone)
+	manifest, err := h.service.Manifest(c.Request.Context(), caller, c.DefaultQuery("zone", "default"))
 	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if manifest.State == nil {
 		c.JSON(http.StatusOK, gin.H{
-			"zone":      zone,
-			"gencount":  0,
-			"digest":    nil,
-			"signer_id": "",
+			"zone":                      manifest.Zone,
+			"gencount":                  0,
+			"digest":                    nil,
+			"digest_version":            manifest.DigestVersion,
+			"signer_id":                 "",
+			"updated_at":                nil,
+			"last_writer_device_id":     nil,
+			"last_writer_device_name":   nil,
+			"min_supported_enc_version": nil,
 		})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"zone":      syncState.Zone,
-		"gencount":  syncState.GenCount,
-		"digest":    syncState.Digest,
-		"signer_id": "",
-	})
+	resp := manifestJSON(manifest.State)
+	resp["digest_version"] = manifest.DigestVersion
+	resp["min_supported_enc_version"] = manifest.MinSupportedEncVersion
+	if len(manifest.PendingConflicts) > 0 {
+		resp["pending_conflicts"] = manifest.PendingConflicts
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
-func (h *SyncHandler) PullSync(c *gin.Context) {
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
-		return
+// ReadManifest is the hub's websocket.ManifestReader: it answers a
+// manifest_request message as GetManifest would the same caller. Errors
+// meant for the client reach it with their code.
+func (h *SyncHandler) ReadManifest(ctx context.Context, userID, deviceID, zone string) (int64, []byte, error) {
+	manifest, err := h.service.Manifest(ctx, service.Caller{UserID: userID, DeviceID: deviceID}, zone)
+	var serviceErr *service.Error
+	if errors.As(err, &serviceErr) && serviceErr.Kind != service.KindInternal {
+		code := serviceErr.Code
+		if code == "" {
+			code = apperrors.StatusCode(serviceErrorStatus[serviceErr.Kind])
+		}
+		return 0, nil, &websocket.MessageError{Code: code, Message: serviceErr.Message}
 	}
-
-	var req PullSyncRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+	if err != nil {
+		return 0, nil, err
+	}
+	if manifest.State == nil {
+		return 0, nil, nil
 	}
+	return manifest.State.GenCount, manifest.State.Digest, nil
+}
 
-	if req.Zone == "" {
-		req.Zone = "default"
+// manifestJSON is a zone's manifest as GetManifest and ListZones report it.
+// The last writer fields are null when the zone was never written, or last
+// written by a client without a device claim. The digest is the stored one,
+// of sync.DigestVersion.
+func manifestJSON(state *storage.SyncState) gin.H {
+	var updatedAt *time.Time
+	if !state.UpdatedAt.IsZero() {
+		updatedAt = &state.UpdatedAt
+	}
+	return gin.H{
+		"zone":                    state.Zone,
+		"gencount":                state.GenCount,
+		"digest":                  state.Digest,
+		"digest_version":          sync.DigestVersion,
+		"signer_id":               "",
+		"updated_at":              updatedAt,
+		"last_writer_device_id":   state.LastWriterDeviceID,
+		"last_writer_device_name": state.LastWriterDeviceName,
 	}
+}
 
-	// Use filtered queries to exclude tombstoned records unless explicitly requested
-	cryptoKeys, err := h.pgStore.GetCryptoKeysByUserWithFilter(userID.(string), req.Zone, req.LastGenCount, req.IncludeTombstoned)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get crypto keys: " + err.Error()})
+// ListZones returns the manifest of every zone the user has written with
+// how many live items it holds, so a new device knows which zones to pull
+func (h *SyncHandler) ListZones(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
 		return
 	}
 
-	credMetadata, err := h.pgStore.GetCredentialMetadataByUserWithFilter(userID.(string), req.Zone, req.LastGenCount, req.IncludeTombstoned)
+	summaries, err := h.service.Zones(c.Request.Context(), caller)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get credential metadata: " + err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	syncRecords, err := h.pgStore.GetSyncRecordsByUserWithFilter(userID.(string), req.Zone, req.LastGenCount, req.IncludeTombstoned)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get sync records: " + err.Error()})
-		return
+	zones := make([]gin.H, 0, len(summaries))
+	for _, summary := range summaries {
+		zone := manifestJSON(&summary.SyncState)
+		zone["items"] = gin.H{
+			"keys":     summary.Keys,
+			"metadata": summary.Metadata,
+			"records":  summary.Records,
+		}
+		zones = append(zones, zone)
 	}
+	c.JSON(http.StatusOK, gin.H{"zones": zones})
+}
 
-	syncState, err := h.pgStore.GetSyncState(userID.(string), req.Zone)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+func (h *SyncHandler) PullSync(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
 		return
 	}
 
-	var keys []gin.H
-	for _, key := range cryptoKeys {
-		keys = append(keys, gin.H{
-			"item_uuid":         key.ItemUUID.String(),
-			"key_class":         int(key.KeyClass),
-			"key_type":          int(key.KeyType),
-			"label":             ptrToString(key.Label),
-			"application_label": ptrToString(key.AppLabel),
-			"data":              key.Data,
-			"usage_flags":       key.Flags,
-			"access_group":      key.AccGroup,
-			"gencount":          key.GenCount,
-			"tombstone":         key.Tombstone,
+	var req PullSyncRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.ItemUUIDs) > MaxPullItems {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("a pull takes at most %d item_uuids", MaxPullItems),
+			"code":  "payload_too_large",
 		})
+		return
 	}
-
-	var metadata []gin.H
-	for _, cred := range credMetadata {
-		var metadataKeyUUID *string
-		if cred.MetadataKeyUUID != nil {
-			s := cred.MetadataKeyUUID.String()
-			metadataKeyUUID = &s
+	var itemUUIDs []uuid.UUID
+	if req.ItemUUIDs != nil {
+		ids, err := parseProbeUUIDs(req.ItemUUIDs)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
-
-		metadata = append(metadata, gin.H{
-			"item_uuid":         cred.ItemUUID.String(),
-			"server":            cred.Server,
-			"account":           cred.Account,
-			"protocol":          cred.Protocol,
-			"port":              cred.Port,
-			"path":              ptrToString(cred.Path),
-			"label":             ptrToString(cred.Label),
-			"access_group":      cred.AccGroup,
-			"password_key_uuid": cred.PasswordKeyUUID.String(),
-			"metadata_key_uuid": metadataKeyUUID,
-			"gencount":          cred.GenCount,
-			"tombstone":         cred.Tombstone,
-		})
+		itemUUIDs = ids
+	}
+
+	result, err := h.service.Pull(c.Request.Context(), caller, syncservice.PullInput{
+		Zone:              req.Zone,
+		LastGenCount:      req.LastGenCount,
+		IncludeTombstoned: req.IncludeTombstoned,
+		IncludeKeys:       req.IncludeKeys,
+		IncludeMetadata:   req.IncludeMetadata,
+		IncludeRecords:    req.IncludeRecords,
+		Limit:             req.Limit,
+		Checkpoint:        req.Checkpoint,
+		ItemUUIDs:         itemUUIDs,
+	})
+	if err != nil {
+		respondError(c, err)
+		return
 	}
 
-	var records []gin.H
-	for _, record := range syncRecords {
-		var parentKeyUUID *string
-		if record.ParentKeyUUID != nil {
-			s := record.ParentKeyUUID.String()
-			parentKeyUUID = &s
+	resp := gin.H{"included": result.Included, "gencount": result.GenCount}
+	if result.TombstonesSuppressed {
+		resp["tombstones_suppressed"] = true
+	}
+	if result.Paged {
+		resp["has_more"] = result.HasMore
+		if result.Checkpoint != "" {
+			resp["checkpoint"] = result.Checkpoint
 		}
+	}
 
-		records = append(records, gin.H{
-			"item_uuid":       record.ItemUUID.String(),
-			"parent_key_uuid": parentKeyUUID,
-			"wrapped_key":     record.WrappedKey,
-			"enc_item":        record.EncItem,
-			"enc_version":     record.EncVersion,
-			"context_id":      record.ContextID,
-			"gencount":        record.GenCount,
-			"tombstone":       record.Tombstone,
-		})
+	// Skipped layers are not in the response. Included layers with nothing
+	// in this page are null.
+	if result.Included.Keys {
+		var keys []CryptoKeyDTO
+		for _, key := range result.Keys {
+			keys = append(keys, mapping.FromCryptoKey(key))
+		}
+		resp["keys"] = keys
+	}
+	if result.Included.Metadata {
+		var metadata []CredentialMetadataDTO
+		for _, cred := range result.Metadata {
+			metadata = append(metadata, mapping.FromCredentialMetadata(cred, result.SyncSchema))
+		}
+		resp["credential_metadata"] = metadata
+	}
+	if result.Included.Records {
+		var records []SyncRecordDTO
+		for _, record := range result.Records {
+			records = append(records, mapping.FromSyncRecord(record))
+		}
+		resp["sync_records"] = records
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"keys":                keys,
-		"credential_metadata": metadata,
-		"sync_records":        records,
-		"gencount":            syncState.GenCount,
-	})
+	renderNegotiated(c, http.StatusOK, resp, result.MsgPack)
 }
 
 func (h *SyncHandler) DeleteAllCredentials(c *gin.Context) {
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+	caller, ok := requireCaller(c)
+	if !ok {
 		return
 	}
 
-	zone := c.DefaultQuery("zone", "default")
-
-	// Get all credential metadata for this user
-	credMetadata, err := h.pgStore.GetCredentialMetadataByUser(userID.(string), zone, 0)
+	result, err := h.service.DeleteAll(c.Request.Context(), caller, c.DefaultQuery("zone", "default"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get credentials: " + err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	// Get all crypto keys for this user
-	cryptoKeys, err := h.pgStore.GetCryptoKeysByUser(userID.(string), zone, 0)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get crypto keys: " + err.Error()})
-		return
+	resp := deleteAllJSON(result)
+	resp["message"] = "All credentials marked as deleted"
+	if result.RecoverUntil != nil {
+		resp["message"] = "All credentials moved to the trash; POST /sync/credentials/undo-wipe restores them until recover_until"
 	}
+	c.JSON(http.StatusOK, resp)
+}
 
-	// Get all sync records for this user
-	syncRecords, err := h.pgStore.GetSyncRecordsByUser(userID.(string), zone, 0)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get sync records: " + err.Error()})
+// DeleteCredential tombstones one credential of ?zone= (default
+// "default") with its sync record and the keys only it used; see
+// syncservice.Service.DeleteCredential
+func (h *SyncHandler) DeleteCredential(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
 		return
 	}
 
-	syncState, err := h.pgStore.GetSyncState(userID.(string), zone)
+	zone := c.DefaultQuery("zone", "default")
+	result, err := h.service.DeleteCredential(c.Request.Context(), caller, zone, c.Param("item_uuid"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	currentGenCount := syncState.GenCount
-	var deletedCount int
-
-	// Mark all credential metadata as tombstoned
-	for i := range credMetadata {
-		credMetadata[i].Tombstone = true
-		currentGenCount++
-		credMetadata[i].GenCount = currentGenCount
+	c.JSON(http.StatusOK, gin.H{
+		"item_uuid": c.Param("item_uuid"),
+		"zone":      zone,
+		"gencount":  result.GenCount,
+		"items":     deletedItemsJSON(result.DeletedItems),
+	})
+}
 
-		if err := h.pgStore.CreateCredentialMetadata(userID.(string), credMetadata[i].ItemUUID.String(), credMetadata[i]); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to tombstone credential: " + err.Error()})
-			return
-		}
-		deletedCount++
+// deleteAllJSON renders a zone's bulk wipe with what it removed per layer
+func deleteAllJSON(result *syncservice.DeleteAllResult) gin.H {
+	resp := gin.H{
+		"gencount": result.GenCount,
+		"deleted":  result.Deleted,
+		"items":    deletedItemsJSON(result.DeletedItems),
 	}
-
-	// Mark all crypto keys as tombstoned
-	for i := range cryptoKeys {
-		cryptoKeys[i].Tombstone = true
-		currentGenCount++
-		cryptoKeys[i].GenCount = currentGenCount
-
-		if err := h.pgStore.CreateCryptoKey(userID.(string), cryptoKeys[i].ItemUUID.String(), cryptoKeys[i]); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to tombstone key: " + err.Error()})
-			return
-		}
-		deletedCount++
+	if result.RecoverUntil != nil {
+		resp["recover_until"] = result.RecoverUntil.UTC().Format(time.RFC3339)
 	}
+	return resp
+}
 
-	// Mark all sync records as tombstoned
-	for i := range syncRecords {
-		syncRecords[i].Tombstone = true
-		currentGenCount++
-		syncRecords[i].GenCount = currentGenCount
-
-		if err := h.pgStore.CreateSyncRecord(userID.(string), syncRecords[i].ItemUUID.String(), syncRecords[i]); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to tombstone sync record: " + err.Error()})
-			return
-		}
-		deletedCount++
+func deletedItemsJSON(items syncservice.DeletedItems) gin.H {
+	return gin.H{
+		"keys":     items.Keys,
+		"metadata": items.Metadata,
+		"records":  items.Records,
 	}
+}
 
-	// Update sync state
-	syncEngine := sync.NewSyncEngine(zone)
-	digest := syncEngine.UpdateManifestDigest([]string{}) // Empty manifest since all deleted
-
-	if err := h.pgStore.UpsertSyncState(userID.(string), zone, currentGenCount, digest); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+// UndoWipe restores the zone's most recent DELETE /sync/credentials while
+// its recovery window lasts
+func (h *SyncHandler) UndoWipe(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
 		return
 	}
 
-	// Broadcast sync event to connected clients
-	if h.hub != nil && deletedCount > 0 {
-		h.hub.BroadcastSyncEvent(&websocket.SyncEvent{
-			Type:      "credentials_changed",
-			UserID:    userID.(string),
-			Zone:      zone,
-			GenCount:  currentGenCount,
-			Timestamp: time.Now().Unix(),
-		})
+	result, err := h.service.UndoWipe(c.Request.Context(), caller, c.DefaultQuery("zone", "default"))
+	if err != nil {
+		respondError(c, err)
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"gencount": currentGenCount,
-		"deleted":  deletedCount,
-		"message":  "All credentials marked as deleted",
+		"gencount": result.GenCount,
+		"restored": result.Restored,
+		"wiped_at": result.WipedAt.UTC().Format(time.RFC3339),
 	})
 }
 
 func (h *SyncHandler) PushSync(c *gin.Context) {
-	userID, exists := c.Get("user_id")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+	caller, ok := requireCaller(c)
+	if !ok {
 		return
 	}
 
+	received := time.Now()
 	var req PushSyncRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if req.Zone == "" {
-		req.Zone = "default"
-	}
+	result, err := h.service.Push(c.Request.Context(), caller, syncservice.PushInput{
+		Zone:     req.Zone,
+		Keys:     req.Keys,
+		Metadata: req.CredentialMetadata,
+		Records:  req.SyncRecords,
+		Sequence: req.Sequence,
+		Received: received,
 
-	syncState, err := h.pgStore.GetSyncState(userID.(string), req.Zone)
+		ConflictStrategy: req.ConflictStrategy,
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, err)
 		return
 	}
 
-	currentGenCount := syncState.GenCount
-	var pushedCount int
-
-	// Triple-layer architecture: Process Keys, Metadata, and Sync Records
-
-	// Layer 1: Process CryptoKeys
-	for _, keyDTO := range req.Keys {
-		currentGenCount++
-
-		itemID, _ := uuid.Parse(keyDTO.ItemUUID)
-		userIDParsed, _ := uuid.Parse(userID.(string))
-
-		key := &models.CryptoKey{
-			UserID:    userIDParsed,
-			ItemUUID:  itemID,
-			Zone:      req.Zone,
-			KeyClass:  models.KeyClass(keyDTO.KeyClass),
-			KeyType:   models.KeyType(keyDTO.KeyType),
-			Label:     stringToPtr(keyDTO.Label),
-			AppLabel:  stringToPtr(keyDTO.AppLabel),
-			Data:      keyDTO.Data,
-			Flags:     keyDTO.Flags,
-			AccGroup:  keyDTO.AccGroup,
-			GenCount:  currentGenCount,
-			Tombstone: keyDTO.Tombstone,
-		}
-
-		if key.AccGroup == "" {
-			key.AccGroup = "default"
+	results := make([]PushItemResult, len(result.Results))
+	for i, item := range result.Results {
+		results[i] = PushItemResult{
+			Layer:    item.Layer,
+			Index:    item.Index,
+			ItemUUID: item.ItemUUID,
+			Status:   item.Status,
+			GenCount: item.GenCount,
+			Code:     item.Code,
+			Field:    item.Field,
+			Error:    item.Error,
 		}
-
-		if err := h.pgStore.CreateCryptoKey(userID.(string), keyDTO.ItemUUID, key); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create crypto key: " + err.Error()})
-			return
-		}
-
-		pushedCount++
 	}
-
-	// Layer 2: Process CredentialMetadata
-	for _, credDTO := range req.CredentialMetadata {
-		currentGenCount++
-
-		itemID, _ := uuid.Parse(credDTO.ItemUUID)
-		userIDParsed, _ := uuid.Parse(userID.(string))
-		passwordKeyID, _ := uuid.Parse(credDTO.PasswordKeyUUID)
-
-		var metadataKeyID *uuid.UUID
-		if credDTO.MetadataKeyUUID != "" {
-			parsed, _ := uuid.Parse(credDTO.MetadataKeyUUID)
-			metadataKeyID = &parsed
-		}
-
-		cred := &models.CredentialMetadata{
-			UserID:          userIDParsed,
-			ItemUUID:        itemID,
-			Zone:            req.Zone,
-			Server:          credDTO.Server,
-			Account:         credDTO.Account,
-			Protocol:        credDTO.Protocol,
-			Port:            credDTO.Port,
-			Path:            stringToPtr(credDTO.Path),
-			Label:           stringToPtr(credDTO.Label),
-			AccGroup:        credDTO.AccGroup,
-			PasswordKeyUUID: passwordKeyID,
-			MetadataKeyUUID: metadataKeyID,
-			GenCount:        currentGenCount,
-			Tombstone:       credDTO.Tombstone,
-		}
-
-		if cred.AccGroup == "" {
-			cred.AccGroup = "default"
-		}
-		if cred.Protocol == 0 {
-			cred.Protocol = 443
-		}
-		if cred.Port == 0 {
-			cred.Port = 443
-		}
-
-		if err := h.pgStore.CreateCredentialMetadata(userID.(string), credDTO.ItemUUID, cred); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create credential metadata: " + err.Error()})
-			return
-		}
-
-		pushedCount++
+	resp := gin.H{
+		"gencount":       result.GenCount,
+		"synced":         result.Synced,
+		"failed_count":   result.FailedCount,
+		"results":        results,
+		"events_pending": result.EventsPending,
 	}
-
-	// Layer 3: Process SyncRecords (encrypted blobs for sync)
-	for _, dto := range req.SyncRecords {
-		currentGenCount++
-
-		var parentKeyUUID *uuid.UUID
-		if dto.ParentKeyUUID != "" {
-			parsed, _ := uuid.Parse(dto.ParentKeyUUID)
-			parentKeyUUID = &parsed
-		}
-
-		itemID, _ := uuid.Parse(dto.ItemUUID)
-		userIDParsed, _ := uuid.Parse(userID.(string))
-
-		record := &models.SyncRecord{
-			UserID:        userIDParsed,
-			ItemUUID:      itemID,
-			Zone:          req.Zone,
-			ParentKeyUUID: parentKeyUUID,
-			WrappedKey:    dto.WrappedKey,
-			EncItem:       dto.EncItem,
-			EncVersion:    dto.EncVersion,
-			ContextID:     dto.ContextID,
-			GenCount:      currentGenCount,
-			Tombstone:     dto.Tombstone,
-		}
-
-		if record.ContextID == "" {
-			record.ContextID = "default"
-		}
-		if record.EncVersion == 0 {
-			record.EncVersion = 1
-		}
-
-		if err := h.pgStore.CreateSyncRecord(userID.(string), dto.ItemUUID, record); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create sync record: " + err.Error()})
-			return
-		}
-
-		pushedCount++
+	if result.Sequence > 0 {
+		resp["sequence"] = result.Sequence
 	}
-
-	// Calculate manifest digest for quick sync check
-	allRecords, err := h.pgStore.GetAllSyncRecordsByUser(userID.(string), req.Zone)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	if len(result.Warnings) > 0 {
+		resp["warnings"] = result.Warnings
 	}
-
-	syncEngine := sync.NewSyncEngine(req.Zone)
-	leafIDs := make([]string, 0, len(allRecords))
-	for _, record := range allRecords {
-		if !record.Tombstone {
-			leafIDs = append(leafIDs, record.ItemUUID.String())
+	if len(result.Conflicts) > 0 {
+		conflicts := make([]PushConflictResult, len(result.Conflicts))
+		for i, conflict := range result.Conflicts {
+			conflicts[i] = PushConflictResult(conflict)
 		}
+		resp["conflicts"] = conflicts
 	}
-	digest := syncEngine.UpdateManifestDigest(leafIDs)
-
-	if err := h.pgStore.UpsertSyncState(userID.(string), req.Zone, currentGenCount, digest); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	// Broadcast sync event to connected clients
-	if h.hub != nil && pushedCount > 0 {
-		h.hub.BroadcastSyncEvent(&websocket.SyncEvent{
-			Type:      "credentials_changed",
-			UserID:    userID.(string),
-			Zone:      req.Zone,
-			GenCount:  currentGenCount,
-			Timestamp: time.Now().Unix(),
-		})
-	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"gencount": currentGenCount,
-		"synced":   pushedCount,
-	})
+	c.JSON(http.StatusOK, resp)
 }
@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api/breach"
+	"github.com/deeplyprofound/password-sync/server/domain/vault"
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultStaleCredentialAge is how long a credential may go unchanged
+// before the health report lists it
+const DefaultStaleCredentialAge = 365 * 24 * time.Hour
+
+// SetStaleCredentialAge sets the health report's default age threshold
+func (h *SyncHandler) SetStaleCredentialAge(age time.Duration) {
+	h.staleAge = age
+}
+
+// GetHealthReport reports on the whole vault from credential metadata:
+// web logins on a site breached in the cached breach reports of the user's
+// addresses (the account's and the monitored ones), with ?cves=true server
+// logins with the CVEs of their host's product, credentials unchanged for
+// ?older_than= (a duration, default the handler's threshold) and duplicate
+// logins. Breaches are not looked up upstream: addresses without a cached
+// report don't count. CVEs are, through the breach package's CPE matching
+// and its cache.
+func (h *SyncHandler) GetHealthReport(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+	if err := h.service.CheckDevice(ctx, caller, false); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	age := h.staleAge
+	if age <= 0 {
+		age = DefaultStaleCredentialAge
+	}
+	if value := c.Query("older_than"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "older_than must be a positive duration, e.g. 4380h"})
+			return
+		}
+		age = parsed
+	}
+
+	zones, err := h.store.GetZonesByUser(ctx, caller.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to list zones: " + err.Error()})
+		return
+	}
+	var creds []*models.CredentialMetadata
+	for _, zone := range zones {
+		zoneCreds, err := h.store.GetCredentialMetadataByUserWithFilter(caller.UserID, zone.Zone, 0, false)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get credential metadata: " + err.Error()})
+			return
+		}
+		creds = append(creds, zoneCreds...)
+	}
+
+	emails, err := h.reportEmails(c, caller.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to read the addresses to check: %v", err)})
+		return
+	}
+	var breaches []vault.Breach
+	reports := 0
+	for _, email := range emails {
+		report, err := breach.GetCachedBreachReport(email)
+		if err != nil {
+			log.Printf("⚠️  Health report skips the breach report of user %s: %v", caller.UserID, err)
+			continue
+		}
+		if report == nil {
+			continue
+		}
+		reports++
+		for _, leak := range report.LeakedData {
+			breaches = append(breaches, vault.Breach{Name: leak.Source, Domain: leak.Domain, Date: leak.Date})
+		}
+	}
+
+	var cves vault.CVELookup
+	if c.Query("cves") == "true" {
+		cves = func(host string) (*vault.CVESummary, string) {
+			product := breach.HostProduct(host)
+			if product == "" {
+				return nil, vault.SkipNoProduct
+			}
+			data := breach.GetCVEDataForHost(ctx, host)
+			if data == nil {
+				return nil, vault.SkipCVEsUnavailable
+			}
+			return cveSummary(product, data), ""
+		}
+	}
+
+	now := h.clock.Now()
+	report := vault.BuildHealthReport(creds, breaches, now.Add(-age), cves)
+	c.JSON(http.StatusOK, gin.H{
+		"generated_at":  now.UTC().Format(time.RFC3339),
+		"credentials":   report.Credentials,
+		"match_methods": report.MatchMethods,
+		"breach_emails": len(emails),
+		"breach_cached": reports,
+		"breached":      gin.H{"count": len(report.Breached), "items": report.Breached},
+		"servers":       gin.H{"count": len(report.Servers), "items": report.Servers},
+		"skipped":       gin.H{"count": len(report.Skipped), "items": report.Skipped},
+		"stale":         gin.H{"count": len(report.Stale), "older_than": age.String(), "items": report.Stale},
+		"duplicates":    gin.H{"count": len(report.Duplicates), "groups": report.Duplicates},
+	})
+}
+
+// cveSummary is the health report's summary of a product's CVE data
+func cveSummary(product string, data *breach.CompanyCVEData) *vault.CVESummary {
+	summary := &vault.CVESummary{
+		Product:      product,
+		TotalCVEs:    data.TotalCVEs,
+		HighestScore: data.HighestScore,
+		HighestLevel: data.HighestLevel,
+		TopCVEs:      []string{},
+		Match:        data.MatchMethod,
+		CPE:          data.CPE,
+	}
+	for _, item := range data.TopCVEs {
+		summary.TopCVEs = append(summary.TopCVEs, item.ID)
+	}
+	return summary
+}
+
+// reportEmails returns the user's addresses whose breach reports count:
+// the account's own and every monitored one
+func (h *SyncHandler) reportEmails(c *gin.Context, userID string) ([]string, error) {
+	var emails []string
+	seen := map[string]bool{}
+	add := func(email string) {
+		if email = breach.NormalizeEmail(email); email != "" && !seen[email] {
+			seen[email] = true
+			emails = append(emails, email)
+		}
+	}
+
+	user, err := h.store.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	add(user.Email)
+	monitors, err := h.store.ListBreachMonitors(c.Request.Context(), userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, monitor := range monitors {
+		add(monitor.Email)
+	}
+	return emails, nil
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/features"
+	"github.com/deeplyprofound/password-sync/server/version"
+	"github.com/gin-gonic/gin"
+)
+
+// ProtocolVersions are the wire formats this server speaks
+type ProtocolVersions struct {
+	SyncSchema    int `json:"sync_schema"`
+	MaxEncVersion int `json:"max_enc_version"`
+	EventSchema   int `json:"event_schema"`
+}
+
+type VersionResponse struct {
+	version.Info
+	Protocols ProtocolVersions `json:"protocols"`
+	Features  map[string]bool  `json:"features"` // Optional features this server offers
+}
+
+// Version reports the build, protocol versions and optional features. It
+// is public so clients and load balancers can check what they talk to.
+func Version(feats *features.Features) gin.HandlerFunc {
+	resp := VersionResponse{
+		Info: version.Get(),
+		Protocols: ProtocolVersions{
+			SyncSchema:    mapping.SyncSchemaVersion,
+			MaxEncVersion: mapping.MaxEncVersion,
+			EventSchema:   websocket.EventSchemaVersion,
+		},
+		Features: map[string]bool{
+			"breach": true,
+			"cve":    true,
+			// Events reach only the instance a client is connected to; a
+			// Redis backplane would fan them out
+			"websocket_backplane": false,
+			"redis":               feats.Redis,
+		},
+	}
+
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, resp)
+	}
+}
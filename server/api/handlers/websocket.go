@@ -1,48 +1,131 @@
 package handlers
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
 	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
 	"github.com/gin-gonic/gin"
 	ws "github.com/gorilla/websocket"
 )
 
-var upgrader = ws.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins for development
-		// TODO: Restrict origins in production
-		return true
-	},
+type WebSocketHandler struct {
+	hub      *websocket.Hub
+	upgrader ws.Upgrader
+	devices  DeviceReader
 }
 
-type WebSocketHandler struct {
-	hub *websocket.Hub
+// DeviceReader reads the device a connection's token was issued to
+type DeviceReader interface {
+	GetDevice(ctx context.Context, userID, deviceID string) (*storage.Device, error)
 }
 
-func NewWebSocketHandler(hub *websocket.Hub) *WebSocketHandler {
+// NewWebSocketHandler creates a handler whose upgrader only accepts origins
+// allowed by the given policy (the same one CORS uses).
+func NewWebSocketHandler(hub *websocket.Hub, origins *middleware.OriginPolicy) *WebSocketHandler {
 	return &WebSocketHandler{
 		hub: hub,
+		upgrader: ws.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     origins.CheckOrigin,
+		},
+	}
+}
+
+// SetDevices sets where connecting devices' capabilities are read from.
+// Without it every client gets JSON events.
+func (h *WebSocketHandler) SetDevices(devices DeviceReader) {
+	h.devices = devices
+}
+
+// ClientAuthStore is what ClientAuthorizer reads
+type ClientAuthStore interface {
+	GetAuthProfile(id string) (*auth.Profile, error)
+	service.DeviceTrustReader
+}
+
+// ClientAuthorizer is the hub's websocket.Authorizer: a connection may stay
+// open while the account is active and the device its token was issued to
+// may read, as service.CheckDeviceTrust decides. A device refused for its
+// trust level is ErrClientRevoked wrapping the service.Error. Zone
+// permissions are checked here once they exist.
+func ClientAuthorizer(store ClientAuthStore) websocket.Authorizer {
+	return func(userID, deviceID, zone string) error {
+		profile, err := store.GetAuthProfile(userID)
+		if err == sql.ErrNoRows {
+			return websocket.ErrClientRevoked
+		}
+		if err != nil {
+			return err
+		}
+		if !profile.Active {
+			return websocket.ErrClientRevoked
+		}
+
+		err = service.CheckDeviceTrust(context.Background(), store, service.Caller{UserID: userID, DeviceID: deviceID}, false)
+		var serviceErr *service.Error
+		if errors.As(err, &serviceErr) && serviceErr.Kind == service.KindForbidden {
+			return fmt.Errorf("%w: %w", websocket.ErrClientRevoked, serviceErr)
+		}
+		return err
 	}
 }
 
-// HandleWebSocket upgrades HTTP connection to WebSocket and registers client
+// HandleWebSocket upgrades HTTP connection to WebSocket and registers client.
+// A client reconnecting with ?last_seq= (the highest seq it received) first
+// gets the events it missed, or a resync_required event, then live ones.
 func (h *WebSocketHandler) HandleWebSocket(c *gin.Context) {
 	// Get user ID from context (set by auth middleware)
-	userID, exists := c.Get("user_id")
-	if !exists {
+	userID := middleware.UserID(c)
+	if userID == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	// Get zone from query params
+	// Get zone from query params; "*" receives every zone
 	zone := c.DefaultQuery("zone", "default")
+	if err := sync.ValidateZoneName(zone); err != nil && zone != sync.AllZones {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_zone"})
+		return
+	}
+	deviceID := middleware.DeviceID(c)
+
+	resume := c.Query("last_seq") != ""
+	lastSeq, err := strconv.ParseInt(c.Query("last_seq"), 10, 64)
+	if resume && (err != nil || lastSeq < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "last_seq must be a non-negative integer", "code": "invalid_last_seq"})
+		return
+	}
+
+	// Refuse before upgrading so the client gets a plain HTTP status
+	if err := h.hub.Authorize(userID, deviceID, zone); err != nil {
+		var serviceErr *service.Error
+		if errors.As(err, &serviceErr) {
+			respondError(c, serviceErr)
+			return
+		}
+		if errors.Is(err, websocket.ErrClientRevoked) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "device or account access revoked", "code": "revoked"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to authorize connection"})
+		return
+	}
 
 	// Upgrade connection to WebSocket
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("❌ WebSocket upgrade error: %v", err)
 		return
@@ -50,19 +133,49 @@ func (h *WebSocketHandler) HandleWebSocket(c *gin.Context) {
 
 	// Create client
 	client := &websocket.Client{
-		Hub:    h.hub,
-		Conn:   conn,
-		Send:   make(chan []byte, 256),
-		UserID: userID.(string),
-		Zone:   zone,
+		Hub:      h.hub,
+		Conn:     conn,
+		Send:     make(chan []byte, 256),
+		UserID:   userID,
+		Zone:     zone,
+		DeviceID: deviceID,
+		Format:   h.eventFormat(c.Request.Context(), userID, deviceID),
+	}
+
+	// Register client with hub; a stopping server turns it away
+	if err := h.hub.AddClient(client); err != nil {
+		websocket.CloseShutdown(conn)
+		return
 	}
 
-	// Register client with hub
-	h.hub.Register <- client
+	// Registered first, so nothing falls between the replay and live events
+	if resume {
+		if err := client.Replay(c.Request.Context(), h.hub.EventLog(), lastSeq); err != nil {
+			log.Printf("❌ WebSocket replay error: user=%s: %v", userID, err)
+		}
+	}
 
 	// Start read and write pumps
 	go client.WritePump()
 	go client.ReadPump()
 
-	log.Printf("✅ WebSocket connection established: user=%s, zone=%s", userID, zone)
+	log.Printf("✅ WebSocket connection established: user=%s, device=%s, zone=%s", userID, deviceID, zone)
+}
+
+// eventFormat is the frame format the device asked for in its
+// capabilities: MessagePack if it prefers it, JSON otherwise
+func (h *WebSocketHandler) eventFormat(ctx context.Context, userID, deviceID string) string {
+	if h.devices == nil || deviceID == "" {
+		return websocket.FormatJSON
+	}
+	device, err := h.devices.GetDevice(ctx, userID, deviceID)
+	if err != nil {
+		log.Printf("⚠️  Failed to read capabilities of device %s: %v", deviceID, err)
+		return websocket.FormatJSON
+	}
+	caps, err := peer.ParseCapabilities(device.Capabilities)
+	if err != nil || !caps.MsgPack {
+		return websocket.FormatJSON
+	}
+	return websocket.FormatMsgPack
 }
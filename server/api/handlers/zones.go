@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultZoneActivityLimit = 50
+	maxZoneActivityLimit     = 200
+)
+
+// ZoneActivityActions are the audit actions shown in a zone's activity
+// feed: item writes and deletions, credential deletes, conflict
+// resolutions, and whole-zone deletes and their undos
+var ZoneActivityActions = []string{
+	service.AuditActionItemPush,
+	service.AuditActionItemTombstone,
+	service.AuditActionSyncDeleteAll,
+	service.AuditActionSyncDeleteItem,
+	service.AuditActionSyncResolve,
+	service.AuditActionSyncUndoWipe,
+}
+
+// ZoneActivityEntry is one row of a zone's activity feed. It names who did
+// what to which item, never the item's content or the actor's IP address.
+type ZoneActivityEntry struct {
+	ID        int64   `json:"id"`
+	ActorID   string  `json:"actor_id"`
+	DeviceID  *string `json:"device_id"`
+	Action    string  `json:"action"`
+	ItemUUID  *string `json:"item_uuid"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// NewZoneActivityEntry builds a feed row from an audit event. The actor is
+// the account owner unless someone else acted on it.
+func NewZoneActivityEntry(event *storage.AuditEvent) ZoneActivityEntry {
+	actor := event.UserID
+	if event.ActorID != nil {
+		actor = *event.ActorID
+	}
+	return ZoneActivityEntry{
+		ID:        event.ID,
+		ActorID:   actor,
+		DeviceID:  event.DeviceID,
+		Action:    event.Action,
+		ItemUUID:  event.ItemUUID,
+		CreatedAt: event.CreatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// CreateZoneRequest creates a zone from a template. It is the body of
+// POST /sync/zones and the optional "bootstrap" block of /auth/register.
+type CreateZoneRequest struct {
+	Zone        string        `json:"zone"`
+	Template    string        `json:"template"`
+	MetadataKey *CryptoKeyDTO `json:"metadata_key,omitempty"` // Required by the standard template
+}
+
+type ZoneResponse struct {
+	Zone            string `json:"zone"`
+	Template        string `json:"template"`
+	GenCount        int64  `json:"gencount"`
+	Digest          []byte `json:"digest"`
+	DigestVersion   int    `json:"digest_version"`
+	MetadataKeyUUID string `json:"metadata_key_uuid,omitempty"`
+}
+
+// spec is the zone the request asks for
+func (req *CreateZoneRequest) spec() service.ZoneSpec {
+	return service.ZoneSpec{Zone: req.Zone, Template: req.Template, MetadataKey: req.MetadataKey}
+}
+
+func newZoneResponse(bootstrap *sync.ZoneBootstrap) *ZoneResponse {
+	resp := &ZoneResponse{
+		Zone:          bootstrap.Manifest.Zone,
+		Template:      bootstrap.Template,
+		GenCount:      bootstrap.Manifest.GenCount,
+		Digest:        bootstrap.Manifest.Digest,
+		DigestVersion: sync.DigestVersion,
+	}
+	if bootstrap.MetadataKey != nil {
+		resp.MetadataKeyUUID = bootstrap.MetadataKey.ItemUUID.String()
+	}
+	return resp
+}
+
+// respondZoneError maps zone bootstrap failures to 400/409 responses. It
+// returns false for errors it does not recognize.
+func respondZoneError(c *gin.Context, err error) bool {
+	zoneErr := service.ZoneError(err)
+	if zoneErr == nil {
+		return false
+	}
+	respondError(c, zoneErr)
+	return true
+}
+
+// CreateZone bootstraps a zone from a template and returns its initial
+// manifest. Creating a zone that already has sync state is a 409.
+func (h *SyncHandler) CreateZone(c *gin.Context) {
+	userID := middleware.UserID(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	var req CreateZoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	bootstrap, err := req.spec().Bootstrap(userID)
+	if err == nil {
+		err = h.store.CreateZone(userID, bootstrap)
+	}
+	if err != nil {
+		if !respondZoneError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create zone: " + err.Error()})
+		}
+		return
+	}
+
+	// Engines loaded before the zone existed started from gencount 0
+	zone := bootstrap.Manifest.Zone
+	h.engines.Reset(userID, zone)
+
+	zoneEvent := newAuditEvent(c, userID, service.AuditActionZoneCreate)
+	zoneEvent.Zone = &zone
+	zoneEvent.Details = auditDetails(gin.H{"template": bootstrap.Template})
+	recordAudit(h.store, zoneEvent)
+
+	c.JSON(http.StatusCreated, newZoneResponse(bootstrap))
+}
+
+// DeleteZone tombstones every item of the zone in one transaction, like
+// DELETE /sync/credentials?zone=, reporting what it removed per layer.
+// POST /sync/credentials/undo-wipe?zone= restores them until recover_until.
+func (h *SyncHandler) DeleteZone(c *gin.Context) {
+	caller, ok := requireCaller(c)
+	if !ok {
+		return
+	}
+	zone := c.Param("zone")
+	if err := sync.ValidateZoneName(zone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": "invalid_zone"})
+		return
+	}
+
+	result, err := h.service.DeleteAll(c.Request.Context(), caller, zone)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	resp := deleteAllJSON(result)
+	resp["zone"] = zone
+	c.JSON(http.StatusOK, resp)
+}
+
+// zoneActivityOwner returns the account whose audit log holds the zone's
+// activity. Zones are not shared yet: the only
+// member with read access is the owner, so every zone a caller can name is
+// their own. Revoked tokens never get this far; the auth middleware
+// rejects them.
+func zoneActivityOwner(callerID, zone string) string {
+	return callerID
+}
+
+// GetZoneActivity returns a page of the zone's activity feed, newest first.
+// When more rows exist the response carries next_cursor.
+func (h *SyncHandler) GetZoneActivity(c *gin.Context) {
+	userID := middleware.UserID(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not authenticated"})
+		return
+	}
+
+	zone := c.Param("zone")
+	filter := storage.ZoneActivityFilter{
+		UserID:  zoneActivityOwner(userID, zone),
+		Zone:    zone,
+		Actions: ZoneActivityActions,
+		Limit:   defaultZoneActivityLimit,
+	}
+	if limitParam := c.Query("limit"); limitParam != "" {
+		limit, err := strconv.Atoi(limitParam)
+		if err != nil || limit <= 0 || limit > maxZoneActivityLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxZoneActivityLimit)})
+			return
+		}
+		filter.Limit = limit
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		beforeID, err := decodeAuditCursor(cursor)
+		if err != nil || beforeID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		filter.BeforeID = beforeID
+	}
+
+	// One extra row tells whether there is a next page
+	filter.Limit++
+	events, err := h.store.ListZoneActivity(c.Request.Context(), filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get zone activity: " + err.Error()})
+		return
+	}
+
+	resp := gin.H{"zone": zone}
+	if len(events) == filter.Limit {
+		events = events[:len(events)-1]
+		resp["next_cursor"] = encodeAuditCursor(events[len(events)-1].ID)
+	}
+	activity := make([]ZoneActivityEntry, 0, len(events))
+	for _, event := range events {
+		activity = append(activity, NewZoneActivityEntry(event))
+	}
+	resp["activity"] = activity
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,160 @@
+package mapping
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+)
+
+// Wire format of the triple-layer sync items. The same DTOs are accepted by
+// /sync/push and returned by /sync/pull.
+
+type CryptoKeyDTO struct {
+	ItemUUID  string `json:"item_uuid" binding:"required"`
+	KeyClass  int    `json:"key_class" binding:"required"`
+	KeyType   int    `json:"key_type" binding:"required"`
+	Label     string `json:"label"`
+	AppLabel  string `json:"application_label"`
+	Data      []byte `json:"data" binding:"required"`
+	Flags     []byte `json:"usage_flags" binding:"required"`
+	AccGroup  string `json:"access_group"`
+	GenCount  int64  `json:"gencount"`
+	Tombstone bool   `json:"tombstone"`
+}
+
+type CredentialMetadataDTO struct {
+	ItemUUID        string        `json:"item_uuid" binding:"required"`
+	Server          string        `json:"server" binding:"required"`
+	Account         string        `json:"account" binding:"required"`
+	Protocol        ProtocolValue `json:"protocol"`
+	Port            int           `json:"port"`
+	Path            string        `json:"path"`
+	Label           string        `json:"label"`
+	AccGroup        string        `json:"access_group"`
+	PasswordKeyUUID string        `json:"password_key_uuid" binding:"required"`
+	MetadataKeyUUID *string       `json:"metadata_key_uuid"` // null when unset
+	GenCount        int64         `json:"gencount"`
+	Tombstone       bool          `json:"tombstone"`
+}
+
+// ProtocolValue is a credential's protocol on the wire. Pulls send its name
+// ("https") to devices reading sync schema 2 and the port it stood for
+// (443) to the rest; pushes may send either. ToCredentialMetadata
+// validates it, so an unknown one fails its item rather than the push.
+type ProtocolValue struct {
+	Name   string
+	Legacy int
+}
+
+// WireProtocol is the wire value of p in the given sync schema version: its
+// name from version 2, before that (or for one this server doesn't know)
+// its legacy number
+func WireProtocol(p models.Protocol, schema int) ProtocolValue {
+	if schema < SyncSchemaVersion || !p.Valid() {
+		return ProtocolValue{Legacy: p.LegacyNumber()}
+	}
+	return ProtocolValue{Name: p.String()}
+}
+
+func (v ProtocolValue) MarshalJSON() ([]byte, error) {
+	if v.Name == "" && v.Legacy != 0 {
+		return json.Marshal(v.Legacy)
+	}
+	return json.Marshal(v.Name)
+}
+
+func (v *ProtocolValue) UnmarshalJSON(data []byte) error {
+	*v = ProtocolValue{}
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		return nil
+	case len(data) > 0 && data[0] == '"':
+		return json.Unmarshal(data, &v.Name)
+	}
+	if err := json.Unmarshal(data, &v.Legacy); err != nil {
+		return fmt.Errorf("protocol must be a name or a number: %s", data)
+	}
+	return nil
+}
+
+// Protocol resolves the value; false when it names no known protocol.
+// Empty is models.ProtocolUnspecified.
+func (v ProtocolValue) Protocol() (models.Protocol, bool) {
+	if v.Name != "" {
+		p, err := models.ParseProtocol(v.Name)
+		return p, err == nil
+	}
+	if v.Legacy != 0 {
+		return models.LegacyProtocol(v.Legacy)
+	}
+	return models.ProtocolUnspecified, true
+}
+
+type SyncRecordDTO struct {
+	ItemUUID      string  `json:"item_uuid" binding:"required"`
+	ParentKeyUUID *string `json:"parent_key_uuid"` // null when unset
+	WrappedKey    []byte  `json:"wrapped_key" binding:"required"`
+	EncItem       []byte  `json:"enc_item" binding:"required"`
+	EncVersion    int     `json:"enc_version"`
+	ContextID     string  `json:"context_id"`
+	GenCount      int64   `json:"gencount"`
+	Tombstone     bool    `json:"tombstone"`
+}
+
+// PullLayers says which layers a /sync/pull returns. The response echoes it
+// as "included", so a layer that was skipped is never mistaken for an empty
+// one.
+type PullLayers struct {
+	Keys     bool `json:"keys"`
+	Metadata bool `json:"credential_metadata"`
+	Records  bool `json:"sync_records"`
+}
+
+// NewPullLayers resolves a pull's include flags; an omitted flag (nil)
+// includes its layer
+func NewPullLayers(keys, metadata, records *bool) PullLayers {
+	include := func(flag *bool) bool { return flag == nil || *flag }
+	return PullLayers{
+		Keys:     include(keys),
+		Metadata: include(metadata),
+		Records:  include(records),
+	}
+}
+
+// Mask packs the layers into sync.PullLayer* bits for a pull checkpoint
+func (l PullLayers) Mask() int {
+	var mask int
+	if l.Keys {
+		mask |= sync.PullLayerKeys
+	}
+	if l.Metadata {
+		mask |= sync.PullLayerMetadata
+	}
+	if l.Records {
+		mask |= sync.PullLayerRecords
+	}
+	return mask
+}
+
+// PullLayersFromMask is the inverse of Mask
+func PullLayersFromMask(mask int) PullLayers {
+	return PullLayers{
+		Keys:     mask&sync.PullLayerKeys != 0,
+		Metadata: mask&sync.PullLayerMetadata != 0,
+		Records:  mask&sync.PullLayerRecords != 0,
+	}
+}
+
+// Order lists the included layers in the order a paginated pull walks them
+func (l PullLayers) Order() []int {
+	var order []int
+	for _, layer := range []int{sync.PullLayerKeys, sync.PullLayerMetadata, sync.PullLayerRecords} {
+		if l.Mask()&layer != 0 {
+			order = append(order, layer)
+		}
+	}
+	return order
+}
@@ -0,0 +1,357 @@
+// Package mapping converts between the sync API DTOs and the storage models.
+// All validation and defaulting of pushed items lives here so every
+// transport (REST today) applies the same rules.
+package mapping
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/google/uuid"
+)
+
+// SyncSchemaVersion is the version of the triple-layer wire format above.
+// Bump it when a change would break clients written against the old one.
+// Version 2 pulls credential protocols by name rather than number; devices
+// get it by advertising sync_schema 2 in their capabilities.
+const SyncSchemaVersion = 2
+
+// LegacySyncSchemaVersion is the wire format of devices that advertise no
+// sync_schema, and of exports
+const LegacySyncSchemaVersion = 1
+
+// MaxEncVersion is the highest enc_version a sync record may carry. The
+// server stores records opaquely, so this is a range limit (SMALLINT), not
+// a list of formats it understands.
+const MaxEncVersion = 32767
+
+// Defaults applied to pushed items that leave a field empty. A credential's
+// port defaults to its protocol's.
+const (
+	DefaultAccessGroup = "default"
+	DefaultProtocol    = models.ProtocolHTTPS
+	DefaultEncVersion  = 1
+	DefaultContextID   = "default"
+)
+
+// Layer names used in FieldError and audit details
+const (
+	LayerCryptoKey          = "crypto_key"
+	LayerCredentialMetadata = "credential_metadata"
+	LayerSyncRecord         = "sync_record"
+)
+
+// FieldError is the only error type returned by the To* conversions
+type FieldError struct {
+	Layer  string `json:"layer"`
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s.%s: %s", e.Layer, e.Field, e.Reason)
+}
+
+// ReasonInvalidUUID is the FieldError reason of an ID that does not parse
+const ReasonInvalidUUID = "not a valid UUID"
+
+func fieldError(layer, field, reason string) *FieldError {
+	return &FieldError{Layer: layer, Field: field, Reason: reason}
+}
+
+func parseUUID(layer, field, value string) (uuid.UUID, error) {
+	if value == "" {
+		return uuid.Nil, fieldError(layer, field, "required")
+	}
+	id, err := uuid.Parse(value)
+	if err != nil {
+		return uuid.Nil, fieldError(layer, field, ReasonInvalidUUID)
+	}
+	return id, nil
+}
+
+// parseOptionalUUID treats both null and "" as unset
+func parseOptionalUUID(layer, field string, value *string) (*uuid.UUID, error) {
+	if value == nil || *value == "" {
+		return nil, nil
+	}
+	id, err := parseUUID(layer, field, *value)
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+func stringToPtr(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func ptrToString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func uuidToPtr(id *uuid.UUID) *string {
+	if id == nil {
+		return nil
+	}
+	s := id.String()
+	return &s
+}
+
+// ApplyCryptoKeyDefaults fills the access group, and gives tombstones that
+// were pushed without key material the empty values the NOT NULL columns need.
+func ApplyCryptoKeyDefaults(key *models.CryptoKey) {
+	if key.AccGroup == "" {
+		key.AccGroup = DefaultAccessGroup
+	}
+	if key.Data == nil {
+		key.Data = []byte{}
+	}
+	if len(key.Flags) == 0 {
+		key.Flags = []byte("{}")
+	}
+}
+
+// ApplyCredentialMetadataDefaults fills the access group, the HTTPS
+// protocol clients omit for ordinary website logins, and the protocol's
+// usual port.
+func ApplyCredentialMetadataDefaults(cred *models.CredentialMetadata) {
+	if cred.AccGroup == "" {
+		cred.AccGroup = DefaultAccessGroup
+	}
+	if cred.Protocol == models.ProtocolUnspecified {
+		cred.Protocol = DefaultProtocol
+	}
+	if cred.Port == 0 {
+		cred.Port = cred.Protocol.DefaultPort()
+	}
+}
+
+// ApplySyncRecordDefaults fills the encryption version and context, and gives
+// tombstones pushed without blobs the empty values the NOT NULL columns need.
+func ApplySyncRecordDefaults(record *models.SyncRecord) {
+	if record.EncVersion == 0 {
+		record.EncVersion = DefaultEncVersion
+	}
+	if record.ContextID == "" {
+		record.ContextID = DefaultContextID
+	}
+	if record.WrappedKey == nil {
+		record.WrappedKey = []byte{}
+	}
+	if record.EncItem == nil {
+		record.EncItem = []byte{}
+	}
+}
+
+// ToCryptoKey validates a pushed key and converts it into the stored model
+// with the server-assigned gencount. Live keys must carry key material and
+// JSON usage flags; tombstones may omit both.
+func ToCryptoKey(dto CryptoKeyDTO, userID, zone string, genCount int64) (*models.CryptoKey, error) {
+	const layer = LayerCryptoKey
+
+	owner, err := parseUUID(layer, "user_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	itemID, err := parseUUID(layer, "item_uuid", dto.ItemUUID)
+	if err != nil {
+		return nil, err
+	}
+	if dto.KeyClass < 0 {
+		return nil, fieldError(layer, "key_class", "must not be negative")
+	}
+	if dto.KeyType < 0 {
+		return nil, fieldError(layer, "key_type", "must not be negative")
+	}
+	if !dto.Tombstone {
+		if len(dto.Data) == 0 {
+			return nil, fieldError(layer, "data", "required")
+		}
+		if len(dto.Flags) == 0 {
+			return nil, fieldError(layer, "usage_flags", "required")
+		}
+	}
+	if len(dto.Flags) > 0 && !json.Valid(dto.Flags) {
+		return nil, fieldError(layer, "usage_flags", "must be JSON")
+	}
+
+	key := &models.CryptoKey{
+		UserID:    owner,
+		ItemUUID:  itemID,
+		Zone:      zone,
+		KeyClass:  models.KeyClass(dto.KeyClass),
+		KeyType:   models.KeyType(dto.KeyType),
+		Label:     stringToPtr(dto.Label),
+		AppLabel:  stringToPtr(dto.AppLabel),
+		Data:      dto.Data,
+		Flags:     dto.Flags,
+		AccGroup:  dto.AccGroup,
+		GenCount:  genCount,
+		Tombstone: dto.Tombstone,
+	}
+	ApplyCryptoKeyDefaults(key)
+
+	return key, nil
+}
+
+// ToCredentialMetadata validates pushed metadata and converts it into the
+// stored model with the server-assigned gencount.
+func ToCredentialMetadata(dto CredentialMetadataDTO, userID, zone string, genCount int64) (*models.CredentialMetadata, error) {
+	const layer = LayerCredentialMetadata
+
+	owner, err := parseUUID(layer, "user_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	itemID, err := parseUUID(layer, "item_uuid", dto.ItemUUID)
+	if err != nil {
+		return nil, err
+	}
+	passwordKeyID, err := parseUUID(layer, "password_key_uuid", dto.PasswordKeyUUID)
+	if err != nil {
+		return nil, err
+	}
+	metadataKeyID, err := parseOptionalUUID(layer, "metadata_key_uuid", dto.MetadataKeyUUID)
+	if err != nil {
+		return nil, err
+	}
+	if !dto.Tombstone {
+		if dto.Server == "" {
+			return nil, fieldError(layer, "server", "required")
+		}
+		if dto.Account == "" {
+			return nil, fieldError(layer, "account", "required")
+		}
+	}
+	protocol, ok := dto.Protocol.Protocol()
+	if !ok {
+		return nil, fieldError(layer, "protocol", "unknown protocol")
+	}
+	if dto.Port < 0 || dto.Port > 65535 {
+		return nil, fieldError(layer, "port", "out of range")
+	}
+
+	cred := &models.CredentialMetadata{
+		UserID:          owner,
+		ItemUUID:        itemID,
+		Zone:            zone,
+		Server:          dto.Server,
+		Account:         dto.Account,
+		Protocol:        protocol,
+		Port:            dto.Port,
+		Path:            stringToPtr(dto.Path),
+		Label:           stringToPtr(dto.Label),
+		AccGroup:        dto.AccGroup,
+		PasswordKeyUUID: passwordKeyID,
+		MetadataKeyUUID: metadataKeyID,
+		GenCount:        genCount,
+		Tombstone:       dto.Tombstone,
+	}
+	ApplyCredentialMetadataDefaults(cred)
+
+	return cred, nil
+}
+
+// ToSyncRecord validates a pushed record and converts it into the stored
+// model with the server-assigned gencount. Live records must carry both
+// encrypted blobs; tombstones may omit them.
+func ToSyncRecord(dto SyncRecordDTO, userID, zone string, genCount int64) (*models.SyncRecord, error) {
+	const layer = LayerSyncRecord
+
+	owner, err := parseUUID(layer, "user_id", userID)
+	if err != nil {
+		return nil, err
+	}
+	itemID, err := parseUUID(layer, "item_uuid", dto.ItemUUID)
+	if err != nil {
+		return nil, err
+	}
+	parentKeyID, err := parseOptionalUUID(layer, "parent_key_uuid", dto.ParentKeyUUID)
+	if err != nil {
+		return nil, err
+	}
+	if !dto.Tombstone {
+		if len(dto.WrappedKey) == 0 {
+			return nil, fieldError(layer, "wrapped_key", "required")
+		}
+		if len(dto.EncItem) == 0 {
+			return nil, fieldError(layer, "enc_item", "required")
+		}
+	}
+	if dto.EncVersion < 0 || dto.EncVersion > MaxEncVersion {
+		return nil, fieldError(layer, "enc_version", "out of range")
+	}
+
+	record := &models.SyncRecord{
+		UserID:        owner,
+		ItemUUID:      itemID,
+		Zone:          zone,
+		ParentKeyUUID: parentKeyID,
+		WrappedKey:    dto.WrappedKey,
+		EncItem:       dto.EncItem,
+		EncVersion:    dto.EncVersion,
+		ContextID:     dto.ContextID,
+		GenCount:      genCount,
+		Tombstone:     dto.Tombstone,
+	}
+	ApplySyncRecordDefaults(record)
+
+	return record, nil
+}
+
+// FromCryptoKey converts a stored key into its pull response shape
+func FromCryptoKey(key *models.CryptoKey) CryptoKeyDTO {
+	return CryptoKeyDTO{
+		ItemUUID:  key.ItemUUID.String(),
+		KeyClass:  int(key.KeyClass),
+		KeyType:   int(key.KeyType),
+		Label:     ptrToString(key.Label),
+		AppLabel:  ptrToString(key.AppLabel),
+		Data:      key.Data,
+		Flags:     key.Flags,
+		AccGroup:  key.AccGroup,
+		GenCount:  key.GenCount,
+		Tombstone: key.Tombstone,
+	}
+}
+
+// FromCredentialMetadata converts stored metadata into its pull response
+// shape in the given sync schema version
+func FromCredentialMetadata(cred *models.CredentialMetadata, schema int) CredentialMetadataDTO {
+	return CredentialMetadataDTO{
+		ItemUUID:        cred.ItemUUID.String(),
+		Server:          cred.Server,
+		Account:         cred.Account,
+		Protocol:        WireProtocol(cred.Protocol, schema),
+		Port:            cred.Port,
+		Path:            ptrToString(cred.Path),
+		Label:           ptrToString(cred.Label),
+		AccGroup:        cred.AccGroup,
+		PasswordKeyUUID: cred.PasswordKeyUUID.String(),
+		MetadataKeyUUID: uuidToPtr(cred.MetadataKeyUUID),
+		GenCount:        cred.GenCount,
+		Tombstone:       cred.Tombstone,
+	}
+}
+
+// FromSyncRecord converts a stored record into its pull response shape
+func FromSyncRecord(record *models.SyncRecord) SyncRecordDTO {
+	return SyncRecordDTO{
+		ItemUUID:      record.ItemUUID.String(),
+		ParentKeyUUID: uuidToPtr(record.ParentKeyUUID),
+		WrappedKey:    record.WrappedKey,
+		EncItem:       record.EncItem,
+		EncVersion:    record.EncVersion,
+		ContextID:     record.ContextID,
+		GenCount:      record.GenCount,
+		Tombstone:     record.Tombstone,
+	}
+}
@@ -1,14 +1,18 @@
 package middleware
 
 import (
+	"database/sql"
 	"net/http"
 	"strings"
 
 	"github.com/deeplyprofound/password-sync/server/domain/auth"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+// AuthMiddleware validates the JWT and, when profiles is set, rejects tokens
+// of deactivated accounts or with a stale token version.
+func AuthMiddleware(profiles *auth.ProfileCache) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var token string
 
@@ -38,12 +42,80 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		c.Set("user_id", claims.UserID)
-		c.Set("email", claims.Email)
-		if claims.DeviceID != "" {
-			c.Set("device_id", claims.DeviceID)
+		if profiles != nil {
+			profile, err := profiles.Get(c.Request.Context(), claims.UserID)
+			if err == sql.ErrNoRows {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+				c.Abort()
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "failed to verify account"})
+				c.Abort()
+				return
+			}
+			if err := profile.Check(claims); err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				c.Abort()
+				return
+			}
+			c.Set("tier", profile.Tier)
+			c.Set("legal_hold", profile.LegalHold)
 		}
 
+		SetClaims(c, claims)
 		c.Next()
 	}
 }
+
+// claimsKey is where AuthMiddleware leaves the access token's claims
+const claimsKey = "auth_claims"
+
+// SetClaims stores the claims of the request's access token, as
+// AuthMiddleware does; for tests and routes authenticated another way
+func SetClaims(c *gin.Context, claims *auth.Claims) {
+	c.Set(claimsKey, claims)
+}
+
+// Claims returns the claims of the request's access token; false on routes
+// AuthMiddleware doesn't guard
+func Claims(c *gin.Context) (*auth.Claims, bool) {
+	value, ok := c.Get(claimsKey)
+	if !ok {
+		return nil, false
+	}
+	claims, ok := value.(*auth.Claims)
+	return claims, ok && claims != nil
+}
+
+// UserID returns the authenticated user, or "" on routes AuthMiddleware
+// doesn't guard
+func UserID(c *gin.Context) string {
+	if claims, ok := Claims(c); ok {
+		return claims.UserID
+	}
+	return ""
+}
+
+// MustUserID returns the authenticated user of a route AuthMiddleware
+// guards. Calling it on any other route is a bug, and panics.
+func MustUserID(c *gin.Context) string {
+	userID := UserID(c)
+	if userID == "" {
+		panic("middleware.MustUserID called on a route without AuthMiddleware")
+	}
+	return userID
+}
+
+// DeviceID returns the device claim of the access token, or "" when the
+// token has none or it is not a device UUID (older clients)
+func DeviceID(c *gin.Context) string {
+	claims, ok := Claims(c)
+	if !ok {
+		return ""
+	}
+	if _, err := uuid.Parse(claims.DeviceID); err != nil {
+		return ""
+	}
+	return claims.DeviceID
+}
@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	apperrors "github.com/deeplyprofound/password-sync/pkg/errors"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrorEnvelope completes every JSON error response with its retry
+// guidance: a code (from the handler, an error attached to the context, or
+// the status), retryable, retry_after_ms and resolution. Handlers keep
+// writing {"error": ...}; clients rely on the code and guidance, never on
+// the message.
+func ErrorEnvelope() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		original := c.Writer
+		w := &envelopeWriter{ResponseWriter: original}
+		c.Writer = w
+		defer func() {
+			c.Writer = original
+			if w.status != 0 {
+				writeEnvelope(c, original, w.status, w.body.Bytes())
+			}
+		}()
+		c.Next()
+	}
+}
+
+// envelopeWriter holds back error responses so their body can be completed;
+// anything else passes straight through
+type envelopeWriter struct {
+	gin.ResponseWriter
+	status int // Held back error status, 0 when passing through
+	body   bytes.Buffer
+}
+
+func (w *envelopeWriter) WriteHeader(code int) {
+	if code >= http.StatusBadRequest && !w.ResponseWriter.Written() {
+		w.status = code
+		return
+	}
+	w.status = 0
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *envelopeWriter) WriteHeaderNow() {
+	if w.status == 0 {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *envelopeWriter) Write(data []byte) (int, error) {
+	if w.status != 0 {
+		return w.body.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *envelopeWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *envelopeWriter) Status() int {
+	if w.status != 0 {
+		return w.status
+	}
+	return w.ResponseWriter.Status()
+}
+
+func (w *envelopeWriter) Written() bool {
+	return w.status != 0 || w.ResponseWriter.Written()
+}
+
+func (w *envelopeWriter) Size() int {
+	if w.status != 0 {
+		return w.body.Len()
+	}
+	return w.ResponseWriter.Size()
+}
+
+func (w *envelopeWriter) Flush() {
+	if w.status == 0 {
+		w.ResponseWriter.Flush()
+	}
+}
+
+func writeEnvelope(c *gin.Context, w gin.ResponseWriter, status int, body []byte) {
+	envelope := map[string]any{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&envelope); err != nil || envelope == nil {
+			// Not a JSON object: leave it as the handler wrote it
+			w.WriteHeader(status)
+			w.Write(body)
+			return
+		}
+	}
+
+	if _, ok := envelope["error"]; !ok {
+		envelope["error"] = http.StatusText(status)
+	}
+	code, _ := envelope["code"].(string)
+	if code == "" {
+		for _, err := range c.Errors {
+			if code = apperrors.CodeFor(err.Err); code != "" {
+				break
+			}
+		}
+	}
+	guidance, ok := apperrors.GuidanceFor(code)
+	if !ok {
+		code = apperrors.StatusCode(status)
+		guidance, _ = apperrors.GuidanceFor(code)
+	}
+	envelope["code"] = code
+	envelope["retryable"] = guidance.Retryable
+	if guidance.Resolution != "" {
+		envelope["resolution"] = guidance.Resolution
+	}
+
+	// A wait given by the handler wins over the code's default
+	retryAfterMS := int64(0)
+	if given, ok := envelope["retry_after_ms"].(json.Number); ok {
+		retryAfterMS, _ = given.Int64()
+	} else if seconds, err := strconv.Atoi(w.Header().Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfterMS = int64(seconds) * 1000
+	} else if guidance.Retryable {
+		retryAfterMS = guidance.RetryAfter.Milliseconds()
+	}
+	if retryAfterMS > 0 {
+		envelope["retry_after_ms"] = retryAfterMS
+		if w.Header().Get("Retry-After") == "" {
+			w.Header().Set("Retry-After", strconv.FormatInt((retryAfterMS+999)/1000, 10))
+		}
+	}
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		w.WriteHeader(status)
+		w.Write(body)
+		return
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,255 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+)
+
+// Rate limiter metric names
+const (
+	MetricRateLimited         = "auth_rate_limited"           // Requests refused with 429
+	MetricRateLimitRedisError = "auth_rate_limit_redis_error" // Redis calls answered from memory instead
+)
+
+const (
+	DefaultRateLimitIPAttempts    = 20
+	DefaultRateLimitEmailAttempts = 5
+	DefaultRateLimitWindow        = 15 * time.Minute
+
+	rateLimitKeyPrefix = "auth:ratelimit:"
+	// Buckets kept in memory before full ones are swept
+	rateLimitSweepSize = 10000
+	// Largest body read to find the email; auth bodies are much smaller
+	rateLimitBodyLimit = 64 * 1024
+)
+
+type RateLimitOptions struct {
+	IPAttempts    int // Failed requests one IP address may make per window
+	EmailAttempts int // Failed requests naming one email per window
+	Window        time.Duration
+	Redis         *redis.Client // Optional; memory is used when nil or unreachable
+	Now           func() time.Time
+}
+
+// RateLimiter counts failed attempts per IP address and per email. With
+// Redis every instance shares the counts, in fixed windows; the in-memory
+// fallback is a token bucket per key refilling over the window, per
+// instance.
+type RateLimiter struct {
+	ipAttempts    int
+	emailAttempts int
+	window        time.Duration
+	redis         *redis.Client
+	now           func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewRateLimiter(opts RateLimitOptions) *RateLimiter {
+	if opts.IPAttempts <= 0 {
+		opts.IPAttempts = DefaultRateLimitIPAttempts
+	}
+	if opts.EmailAttempts <= 0 {
+		opts.EmailAttempts = DefaultRateLimitEmailAttempts
+	}
+	if opts.Window <= 0 {
+		opts.Window = DefaultRateLimitWindow
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &RateLimiter{
+		ipAttempts:    opts.IPAttempts,
+		emailAttempts: opts.EmailAttempts,
+		window:        opts.Window,
+		redis:         opts.Redis,
+		now:           opts.Now,
+		buckets:       make(map[string]*tokenBucket),
+	}
+}
+
+// rateLimitKey is one counter a request is checked against
+type rateLimitKey struct {
+	key   string
+	limit int
+}
+
+// RateLimit refuses requests from an IP address, or naming an email (the
+// "email" field of a JSON body), that had too many failed attempts within
+// the window: 429 rate_limited with a Retry-After header. Every 4xx answer
+// other than 429 counts as a failure against both; a 2xx answer clears the
+// email's count, so a user who finally gets their password right starts
+// over.
+func RateLimit(limiter *RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		keys := []rateLimitKey{{key: "ip:" + c.ClientIP(), limit: limiter.ipAttempts}}
+		email := requestEmail(c)
+		if email != "" {
+			keys = append(keys, rateLimitKey{key: "email:" + email, limit: limiter.emailAttempts})
+		}
+
+		var wait time.Duration
+		for _, k := range keys {
+			wait = max(wait, limiter.blocked(ctx, k))
+		}
+		if wait > 0 {
+			metrics.Inc(MetricRateLimited)
+			c.Header("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error": "too many failed attempts, try again later",
+				"code":  "rate_limited",
+			})
+			return
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		switch {
+		case status >= 200 && status < 300 && email != "":
+			limiter.reset(ctx, keys[1])
+		case status >= 400 && status < 500 && status != http.StatusTooManyRequests:
+			for _, k := range keys {
+				limiter.fail(ctx, k)
+			}
+		}
+	}
+}
+
+// requestEmail returns the normalized email of a JSON body, hashed so it
+// never reaches Redis, or "" without one. The body is left for the handler.
+func requestEmail(c *gin.Context) string {
+	if c.Request.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, rateLimitBodyLimit))
+	c.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), c.Request.Body))
+	if err != nil {
+		return ""
+	}
+
+	var fields struct {
+		Email string `json:"email"`
+	}
+	if json.Unmarshal(body, &fields) != nil {
+		return ""
+	}
+	email := strings.ToLower(strings.TrimSpace(fields.Email))
+	if email == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(email))
+	return hex.EncodeToString(sum[:])
+}
+
+// blocked returns how long the key stays over its limit; 0 when it isn't
+func (l *RateLimiter) blocked(ctx context.Context, k rateLimitKey) time.Duration {
+	if l.redis != nil {
+		count, err := l.redis.Get(ctx, rateLimitKeyPrefix+k.key).Int()
+		if err == redis.Nil || (err == nil && count < k.limit) {
+			return 0
+		}
+		if err == nil {
+			ttl, err := l.redis.PTTL(ctx, rateLimitKeyPrefix+k.key).Result()
+			if err == nil {
+				return max(ttl, time.Second)
+			}
+		}
+		metrics.Inc(MetricRateLimitRedisError)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket := l.refill(k)
+	if bucket == nil || bucket.tokens >= 1 {
+		return 0
+	}
+	rate := float64(k.limit) / float64(l.window)
+	return time.Duration((1 - bucket.tokens) / rate)
+}
+
+// fail counts one failed attempt against the key
+func (l *RateLimiter) fail(ctx context.Context, k rateLimitKey) {
+	if l.redis != nil {
+		key := rateLimitKeyPrefix + k.key
+		count, err := l.redis.Incr(ctx, key).Result()
+		if err == nil && count == 1 {
+			err = l.redis.PExpire(ctx, key, l.window).Err()
+		}
+		if err == nil {
+			return
+		}
+		metrics.Inc(MetricRateLimitRedisError)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket := l.refill(k)
+	if bucket == nil {
+		if len(l.buckets) >= rateLimitSweepSize {
+			l.sweep()
+		}
+		bucket = &tokenBucket{tokens: float64(k.limit), updated: l.now()}
+		l.buckets[k.key] = bucket
+	}
+	bucket.tokens--
+}
+
+// reset forgets the key's failed attempts
+func (l *RateLimiter) reset(ctx context.Context, k rateLimitKey) {
+	if l.redis != nil {
+		if err := l.redis.Del(ctx, rateLimitKeyPrefix+k.key).Err(); err != nil {
+			metrics.Inc(MetricRateLimitRedisError)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, k.key)
+}
+
+// refill tops up the key's bucket for the time since it was last touched.
+// It returns nil for keys without one. Called with mu held.
+func (l *RateLimiter) refill(k rateLimitKey) *tokenBucket {
+	bucket, ok := l.buckets[k.key]
+	if !ok {
+		return nil
+	}
+	now := l.now()
+	rate := float64(k.limit) / float64(l.window)
+	bucket.tokens = min(float64(k.limit), bucket.tokens+float64(now.Sub(bucket.updated))*rate)
+	bucket.updated = now
+	return bucket
+}
+
+// sweep drops the buckets that refilled completely; they hold nothing a new
+// bucket wouldn't. Called with mu held.
+func (l *RateLimiter) sweep() {
+	now := l.now()
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.updated) >= l.window {
+			delete(l.buckets, key)
+		}
+	}
+}
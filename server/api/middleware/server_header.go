@@ -0,0 +1,11 @@
+package middleware
+
+import "github.com/gin-gonic/gin"
+
+// ServerHeader sets the Server response header on every request
+func ServerHeader(value string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("Server", value)
+		c.Next()
+	}
+}
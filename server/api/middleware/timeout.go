@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/gin-gonic/gin"
+)
+
+// MetricRequestTimeout counts requests answered with 504 by Timeout
+const MetricRequestTimeout = "request_timeout"
+
+// Timeout puts a deadline of d on the request context. Handlers pass that
+// context to the store and to upstream calls, which give up once it
+// expires. The response is held back until the handler returns: if the
+// deadline passed and the handler produced an error (or nothing), the
+// client gets a clean 504 instead of whatever the interrupted handler wrote,
+// headers included.
+// A successful response always goes out as written. Zero disables the
+// deadline, for WebSockets and streams.
+func Timeout(d time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if d <= 0 {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), d)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		original := c.Writer
+		w := &timeoutWriter{ResponseWriter: original, holding: true, header: original.Header().Clone()}
+		c.Writer = w
+		defer func() { c.Writer = original }()
+
+		c.Next()
+		c.Writer = original
+
+		if !w.holding {
+			// The handler flushed: the response is already on its way
+			return
+		}
+		status := w.Status()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && (w.status == 0 || status >= http.StatusInternalServerError) {
+			metrics.Inc(MetricRequestTimeout)
+			original.Header().Set("Content-Type", "application/json; charset=utf-8")
+			c.JSON(http.StatusGatewayTimeout, gin.H{"error": "request timed out", "code": "timeout"})
+			return
+		}
+		w.release()
+	}
+}
+
+// timeoutWriter holds the headers, status and body back until the handler
+// returns, or until it flushes. header starts as a copy of the headers set
+// before the handler, so an interrupted handler's never reach the client.
+type timeoutWriter struct {
+	gin.ResponseWriter
+	holding bool
+	header  http.Header
+	status  int
+	body    bytes.Buffer
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	if w.holding {
+		return w.header
+	}
+	return w.ResponseWriter.Header()
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	if !w.holding {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+}
+
+func (w *timeoutWriter) WriteHeaderNow() {
+	if !w.holding {
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+}
+
+func (w *timeoutWriter) Write(data []byte) (int, error) {
+	if !w.holding {
+		return w.ResponseWriter.Write(data)
+	}
+	w.WriteHeaderNow()
+	return w.body.Write(data)
+}
+
+func (w *timeoutWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *timeoutWriter) Status() int {
+	if w.holding && w.status != 0 {
+		return w.status
+	}
+	return w.ResponseWriter.Status()
+}
+
+func (w *timeoutWriter) Written() bool {
+	if w.holding {
+		return w.status != 0
+	}
+	return w.ResponseWriter.Written()
+}
+
+func (w *timeoutWriter) Size() int {
+	if w.holding {
+		if w.status == 0 {
+			return -1
+		}
+		return w.body.Len()
+	}
+	return w.ResponseWriter.Size()
+}
+
+// Flush sends what was held and lets the rest of the response stream
+func (w *timeoutWriter) Flush() {
+	w.release()
+	w.ResponseWriter.Flush()
+}
+
+// release writes what was held and stops holding
+func (w *timeoutWriter) release() {
+	if !w.holding {
+		return
+	}
+	w.holding = false
+	header := w.ResponseWriter.Header()
+	for key := range header {
+		delete(header, key)
+	}
+	for key, values := range w.header {
+		header[key] = values
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.WriteHeaderNow()
+	}
+	if w.body.Len() > 0 {
+		w.ResponseWriter.Write(w.body.Bytes())
+	}
+}
@@ -1,7 +1,11 @@
 package api
 
 import (
+	"context"
+	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/deeplyprofound/password-sync/server/api/breach"
@@ -9,51 +13,233 @@ import (
 	"github.com/deeplyprofound/password-sync/server/api/handlers"
 	"github.com/deeplyprofound/password-sync/server/api/middleware"
 	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/limits"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/features"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/mail"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/deeplyprofound/password-sync/server/postcommit"
+	authservice "github.com/deeplyprofound/password-sync/server/service/auth"
 	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/deeplyprofound/password-sync/server/version"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
+// Background manifest drift check: every hour, ~1% of user zones (capped)
+const (
+	manifestDriftInterval       = time.Hour
+	manifestDriftSampleFraction = 0.01
+	manifestDriftSampleLimit    = 500
+)
+
+// Devices of users who opted in are checked for inactivity once a day
+const deviceDeactivationInterval = 24 * time.Hour
+
+// Idle accounts move through the inactivity lifecycle once a day, when
+// ACCOUNT_INACTIVITY_ENABLED is set
+const accountInactivityInterval = 24 * time.Hour
+
+// Password hash upgrade campaigns are carried out hourly; without one the
+// job finds nobody
+const passwordHashUpgradeInterval = time.Hour
+
+// Bulk wipes past their recovery window become plain tombstones hourly
+const bulkWipeExpiryInterval = time.Hour
+
+// Tombstones past TOMBSTONE_RETENTION are purged once a day
+const tombstonePurgeInterval = 24 * time.Hour
+
+// Monitored addresses are re-checked once a day (jobs.BreachRecheckInterval);
+// the job looks hourly for the ones due, so a backlog drains in batches
+const breachMonitorInterval = time.Hour
+
+// Keys nothing refers to are tombstoned once a day, when
+// ORPHANED_KEY_RECONCILE_ENABLED is set
+const orphanedKeyInterval = 24 * time.Hour
+
 type Server struct {
-	pgStore         *storage.PostgresStore
+	store           storage.Store
 	authHandler     *handlers.AuthService
 	syncHandler     *handlers.SyncHandler
 	deviceHandler   *handlers.DeviceHandler
+	settingsHandler *handlers.SettingsHandler
 	wsHandler       *handlers.WebSocketHandler
+	auditHandler    *handlers.AuditHandler
+	adminHandler    *handlers.AdminHandler
+	Jobs            *jobs.Runner
+	origins         *middleware.OriginPolicy
+	profiles        *auth.ProfileCache
 	router          *gin.Engine
 	Hub             *websocket.Hub
+	Features        *features.Features
 }
 
-func NewServerWithAuth(pgStore *storage.PostgresStore) *Server {
+func NewServerWithAuth(store storage.Store) *Server {
+	// Which optional subsystems run on Redis and which on their in-memory
+	// substitutes; reported at startup and on /health
+	feats := features.Resolve(breach.RedisClient() != nil)
+
 	// Create WebSocket hub and start it
 	hub := websocket.NewHub()
+	hub.SetAuthorizer(handlers.ClientAuthorizer(store))
+	// Sequences must be shared by every instance a client may reconnect to
+	if redisClient := breach.RedisClient(); redisClient != nil {
+		hub.SetEventLog(websocket.NewRedisEventLog(redisClient, websocket.DefaultEventLogSize))
+	} else {
+		hub.SetEventLog(websocket.NewMemoryEventLog(websocket.DefaultEventLogSize))
+	}
 	go hub.Run()
 
-	authHandler := handlers.NewAuthService(pgStore)
-	syncHandler := handlers.NewSyncHandler(pgStore)
+	// Auth profiles (active flag, tier, token version) are checked on every
+	// request; cache them and drop the entry whenever the user row changes.
+	profiles := auth.NewProfileCache(store, auth.ProfileCacheOptions{
+		TTL:   profileCacheTTL(),
+		Redis: breach.RedisClient(),
+		Keys:  breach.CacheKeyring(),
+	})
+	store.OnUserChanged(func(userID string) {
+		profiles.Invalidate(context.Background(), userID)
+	})
+
+	// One SyncEngine per active user zone instead of one per request. With
+	// Redis, instances tell each other to drop engines whose state they
+	// changed; without it the server must run as a single instance.
+	engines := sync.NewRegistry(store, sync.DefaultRegistrySize)
+	if redisClient := breach.RedisClient(); redisClient != nil {
+		if err := engines.UseRedis(context.Background(), redisClient); err != nil {
+			log.Printf("⚠️  Sync engine invalidation disabled, Redis subscribe failed: %v", err)
+			feats.Fallback(features.EngineInvalidation)
+		}
+	}
+	feats.Log()
+
+	// Every user shares one HIBP key: lookups queue behind the plan's rate
+	hibp := breach.NewScheduler(hibpSchedulerConfig(), breach.LookupHIBP)
+	hibp.OnComplete(func(job *breach.Job) {
+		broadcastBreachCheck(hub, job)
+	})
+	breach.SetScheduler(hibp)
+	go hibp.Run(context.Background())
+	// CVE enrichment paces its NVD calls, so it runs in the background
+	enricher := breach.NewEnricher(breach.EnrichConfig{
+		Workers:   intEnv("CVE_ENRICH_WORKERS", breach.DefaultEnrichConfig.Workers),
+		MaxQueued: intEnv("CVE_ENRICH_MAX_QUEUED", breach.DefaultEnrichConfig.MaxQueued),
+		ResultTTL: durationEnv("CVE_ENRICH_RESULT_TTL", breach.DefaultEnrichConfig.ResultTTL),
+	})
+	breach.SetEnricher(enricher)
+	go enricher.Run(context.Background())
+	breach.SetBatchConfig(breach.BatchConfig{
+		MaxEmails: intEnv("BREACH_BATCH_MAX_EMAILS", breach.DefaultBatchConfig.MaxEmails),
+		Workers:   intEnv("BREACH_BATCH_WORKERS", breach.DefaultBatchConfig.Workers),
+	})
+	breach.SetPasswordRangeTTL(durationEnv("PWNED_PASSWORDS_CACHE_TTL", breach.DefaultPasswordRangeTTL))
+	cve.SetCache(breach.SharedCache())
+	cve.SetCacheTTL(durationEnv("CVE_CACHE_TTL", cve.DefaultCacheTTL))
+
+	authHandler := handlers.NewAuthService(store)
+	authHandler.SetLockout(authservice.LockoutPolicy{
+		Attempts: intEnv("AUTH_LOCKOUT_ATTEMPTS", authservice.DefaultLockoutAttempts),
+		Duration: durationEnv("AUTH_LOCKOUT_DURATION", authservice.DefaultLockoutDuration),
+	})
+	syncHandler := handlers.NewSyncHandler(store, engines)
 	syncHandler.SetHub(hub) // Connect sync handler to WebSocket hub for broadcasting
-	deviceHandler := handlers.NewDeviceHandler(pgStore)
-	wsHandler := handlers.NewWebSocketHandler(hub)
+	hub.SetManifestReader(syncHandler.ReadManifest)
+	// Pushes answer once their write commits; digest and event work for
+	// each zone follows in order on a bounded worker pool
+	syncHandler.SetPostCommitQueue(postcommit.NewQueue(postcommit.DefaultWorkers, postcommit.DefaultDepth))
+	syncHandler.SetRecoveryWindow(durationEnv("BULK_WIPE_RECOVERY_WINDOW", sync.DefaultWipeRecoveryWindow))
+	syncHandler.SetConflictStrategy(conflictStrategy())
+	syncHandler.SetTombstonePolicy(tombstonePolicy())
+	syncHandler.SetIntegrityLimits(
+		intEnv("INTEGRITY_CHECKS_PER_DAY", sync.DefaultIntegrityRunsPerDay),
+		durationEnv("INTEGRITY_CHECK_TIMEOUT", sync.DefaultIntegrityTimeout),
+	)
+	syncHandler.SetImportMaxBytes(int64(intEnv("IMPORT_MAX_BODY_BYTES", handlers.DefaultImportMaxBytes)))
+	syncHandler.SetStaleCredentialAge(durationEnv("STALE_CREDENTIAL_AGE", handlers.DefaultStaleCredentialAge))
+	tiers := tierPolicy()
+	syncHandler.SetTierPolicy(tiers)
+	deviceHandler := handlers.NewDeviceHandler(store)
+	deviceHandler.SetHub(hub)
+	deviceHandler.SetTierPolicy(tiers)
+	settingsHandler := handlers.NewSettingsHandler(store)
+	settingsHandler.SetTierPolicy(tiers)
+
+	// One origin policy for CORS and WebSocket upgrades. ALLOWED_ORIGINS is a
+	// comma-separated list (wildcards like https://*.example.com allowed);
+	// unset means same-origin only, except in debug mode which allows all.
+	origins := middleware.NewOriginPolicy(
+		middleware.ParseOrigins(os.Getenv("ALLOWED_ORIGINS")),
+		gin.Mode() == gin.DebugMode,
+	)
+	wsHandler := handlers.NewWebSocketHandler(hub, origins)
+	wsHandler.SetDevices(store)
+	auditHandler := handlers.NewAuditHandler(store)
+
+	// Maintenance jobs, runnable (and dry-runnable) via the admin API
+	jobRunner := jobs.NewRunner(store)
+	jobRunner.Register(jobs.NewTombstonePurgeJob(store, durationEnv("TOMBSTONE_RETENTION", jobs.DefaultTombstoneRetention)))
+	jobRunner.Register(jobs.NewBulkWipeExpiryJob(store))
+	jobRunner.Register(jobs.NewManifestDriftJob(store, manifestDriftSampleFraction, manifestDriftSampleLimit))
+	jobRunner.Register(jobs.NewDeviceDeactivationJob(store, deviceHandler.Service()))
+	jobRunner.Register(jobs.NewOrphanedKeyJob(store, syncHandler.Service(), durationEnv("ORPHANED_KEY_MIN_AGE", jobs.DefaultOrphanedKeyMinAge)))
+	mailer := mail.FromEnv()
+	authHandler.SetMailer(mailer)
+	authHandler.OnAccountDeleted(func(user *storage.User) {
+		hub.DisconnectUser(user.ID, websocket.CloseRevoked)
+		if err := breach.InvalidateBreachCache(user.Email); err != nil {
+			log.Printf("⚠️  Breach report of deleted user %s still cached: %v", user.ID, err)
+		}
+	})
+	inactivityNotifier := handlers.NewInactivityNotifier(store, mailer)
+	inactivityNotifier.SetHub(hub)
+	inactivityJob := jobs.NewAccountInactivityJob(store, inactivityNotifier, inactivityPolicy())
+	jobRunner.Register(inactivityJob)
+	hashUpgradeNotifier := handlers.NewHashUpgradeNotifier(store, mailer)
+	hashUpgradeNotifier.SetHub(hub)
+	jobRunner.Register(jobs.NewPasswordHashUpgradeJob(store, hashUpgradeNotifier))
+	breach.SetMonitorStore(store)
+	breach.SetMonitorConfig(breach.MonitorConfig{
+		MaxPerUser: intEnv("BREACH_MONITOR_MAX_PER_USER", breach.DefaultMonitorConfig.MaxPerUser),
+		MaxAlerts:  breach.DefaultMonitorConfig.MaxAlerts,
+	})
+	jobRunner.Register(jobs.NewBreachMonitorJob(store, breach.MonitorLookup, handlers.NewBreachAlertNotifier(hub),
+		intEnv("BREACH_MONITOR_BATCH", jobs.DefaultBreachMonitorBatch)))
+	adminHandler := handlers.NewAdminHandler(store, jobRunner)
+	adminHandler.SetHub(hub)
+	adminHandler.SetInactivityJob(inactivityJob)
 
 	router := gin.Default()
+	router.Use(middleware.ServerHeader(version.ServerHeader()))
+	router.Use(middleware.ErrorEnvelope())
 
 	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"http://localhost:4200", "https://localhost:4200"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
+		AllowOriginWithContextFunc: origins.CORSOriginFunc,
+		AllowMethods:               []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:               []string{"Origin", "Content-Type", "Accept", "Authorization"},
+		ExposeHeaders:              []string{"Content-Length"},
+		AllowCredentials:           true,
+		MaxAge:                     12 * time.Hour,
 	}))
 
 	s := &Server{
-		pgStore:       pgStore,
-		authHandler:   authHandler,
-		syncHandler:   syncHandler,
-		deviceHandler: deviceHandler,
-		wsHandler:     wsHandler,
-		router:        router,
-		Hub:           hub,
+		store:           store,
+		authHandler:     authHandler,
+		syncHandler:     syncHandler,
+		deviceHandler:   deviceHandler,
+		settingsHandler: settingsHandler,
+		wsHandler:       wsHandler,
+		auditHandler:    auditHandler,
+		adminHandler:    adminHandler,
+		Jobs:            jobRunner,
+		origins:         origins,
+		profiles:        profiles,
+		router:          router,
+		Hub:             hub,
+		Features:        feats,
 	}
 
 	s.setupRoutes()
@@ -63,45 +249,324 @@ func NewServerWithAuth(pgStore *storage.PostgresStore) *Server {
 func (s *Server) setupRoutes() {
 	api := s.router.Group("/api/v1")
 
+	// Request deadlines per route group; WebSockets and streamed exports
+	// have none
+	apiTimeout := middleware.Timeout(durationEnv("REQUEST_TIMEOUT", defaultRequestTimeout))
+	upstreamTimeout := middleware.Timeout(durationEnv("UPSTREAM_REQUEST_TIMEOUT", defaultUpstreamRequestTimeout))
+
+	// Failed logins and registrations per IP and email, shared through Redis.
+	// Reset requests always succeed, which would clear an email's count, so
+	// only the guesses of reset tokens go through it.
+	authLimit := middleware.RateLimit(middleware.NewRateLimiter(authRateLimitOptions()))
+
 	// Public routes (no auth required)
-	api.POST("/auth/register", s.authHandler.Register)
-	api.POST("/auth/login", s.authHandler.Login)
-	api.POST("/auth/refresh", s.authHandler.RefreshToken)
-
-	api.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":     "ok",
-			"mode":       "multi-tenant",
-			"encryption": "zero-knowledge",
-		})
-	})
+	public := api.Group("/", apiTimeout)
+	{
+		public.POST("/auth/register", authLimit, s.authHandler.Register)
+		public.GET("/auth/register/challenge", s.authHandler.RegisterChallenge)
+		public.POST("/auth/login", authLimit, s.authHandler.Login)
+		public.POST("/auth/refresh", s.authHandler.RefreshToken)
+		public.POST("/auth/logout", s.authHandler.Logout)
+		public.POST("/auth/reset/request", s.authHandler.RequestPasswordReset)
+		public.POST("/auth/reset/confirm", authLimit, s.authHandler.ConfirmPasswordReset)
+
+		public.GET("/health", handlers.Health(s.Features, s.dependencies()...))
+		public.GET("/version", handlers.Version(s.Features))
+		public.GET("/.well-known/jwks.json", handlers.JWKS)
+	}
 
 	// Protected routes (require JWT)
-	protected := api.Group("/", middleware.AuthMiddleware())
+	protected := api.Group("/", middleware.AuthMiddleware(s.profiles))
 	{
-		// Sync endpoints (main functionality)
-		protected.GET("/sync/manifest", s.syncHandler.GetManifest)
-		protected.POST("/sync/pull", s.syncHandler.PullSync)
-		protected.POST("/sync/push", s.syncHandler.PushSync)
-		protected.DELETE("/sync/credentials", s.syncHandler.DeleteAllCredentials)
+		bounded := protected.Group("/", apiTimeout)
 
-		// WebSocket for real-time sync
-		protected.GET("/sync/live", s.wsHandler.HandleWebSocket)
+		// Sync endpoints (main functionality)
+		bounded.GET("/sync/manifest", s.syncHandler.GetManifest)
+		bounded.POST("/sync/pull", s.syncHandler.PullSync)
+		bounded.POST("/sync/push", s.syncHandler.PushSync)
+		bounded.POST("/sync/probe", s.syncHandler.ProbeSync)
+		bounded.POST("/sync/diff", s.syncHandler.DiffSync)
+		bounded.GET("/sync/conflicts", s.syncHandler.ListConflicts)
+		bounded.POST("/sync/conflicts/:id/resolve", s.syncHandler.ResolveConflict)
+		bounded.GET("/sync/diagnostics", s.syncHandler.GetDiagnostics)
+		bounded.GET("/sync/integrity", s.syncHandler.GetIntegrity)
+		bounded.GET("/sync/zones", s.syncHandler.ListZones)
+		bounded.POST("/sync/zones", s.syncHandler.CreateZone)
+		bounded.DELETE("/sync/zones/:zone", s.syncHandler.DeleteZone)
+		bounded.GET("/sync/zones/:zone/activity", s.syncHandler.GetZoneActivity)
+		bounded.DELETE("/sync/credentials", s.syncHandler.DeleteAllCredentials)
+		bounded.POST("/sync/credentials/undo-wipe", s.syncHandler.UndoWipe)
+		bounded.DELETE("/sync/credentials/:item_uuid", s.syncHandler.DeleteCredential)
+		bounded.GET("/sync/search", s.syncHandler.SearchCredentials)
+		bounded.GET("/sync/duplicates", s.syncHandler.GetDuplicates)
+		bounded.GET("/report/health", s.syncHandler.GetHealthReport)
 
 		// Device management
-		protected.GET("/devices", s.deviceHandler.ListDevices)
-		protected.POST("/devices", s.deviceHandler.RegisterDevice)
+		bounded.GET("/devices", s.deviceHandler.ListDevices)
+		bounded.POST("/devices", s.deviceHandler.RegisterDevice)
+		bounded.DELETE("/devices", s.deviceHandler.RevokeDevices)
+		bounded.DELETE("/devices/:id", s.deviceHandler.RevokeDevice)
+		bounded.PATCH("/devices/:id", s.deviceHandler.UpdateDevice)
+		bounded.PUT("/devices/:id/trust", s.deviceHandler.SetDeviceTrust)
+		bounded.GET("/devices/capabilities", s.deviceHandler.GetDeviceCapabilities)
+		bounded.POST("/devices/cleanup", s.deviceHandler.CleanupDevices)
+
+		// Account settings
+		bounded.GET("/settings", s.settingsHandler.GetSettings)
+		bounded.PATCH("/settings", s.settingsHandler.UpdateSettings)
+		bounded.GET("/account/limits", s.settingsHandler.GetLimits)
+		bounded.DELETE("/account", s.authHandler.DeleteAccount)
+
+		bounded.POST("/auth/change-password", s.authHandler.ChangePassword)
+
+		// Audit log export (CSV / JSON Lines)
+		protected.GET("/auth/audit/export", s.auditHandler.ExportAuditLog)
+
+		// Account snapshot for a cold start, streamed as JSON Lines
+		protected.GET("/sync/snapshot", s.syncHandler.GetSnapshot)
+
+		// Whole-vault backup, streamed as one JSON document, and its restore
+		protected.GET("/sync/export", s.syncHandler.ExportVault)
+		protected.POST("/sync/import", s.syncHandler.ImportVault)
+
+		// Breach monitoring: the breach_monitor job re-checks the addresses
+		protected.POST("/breach/monitor", breach.Subscribe)
+		protected.GET("/breach/monitors", breach.ListMonitors)
+		protected.DELETE("/breach/monitor/:id", breach.Unsubscribe)
+		protected.GET("/breach/alerts", breach.ListAlerts)
+
+		upstream := protected.Group("/", upstreamTimeout)
 
 		// Breach Report (LeakOSINT)
-		protected.POST("/breach/check", breach.CheckEmail)
-		protected.POST("/breach/enrich-cve", breach.EnrichWithCVE)
+		upstream.POST("/breach/check", breach.CheckEmail)
+		upstream.POST("/breach/check-batch", breach.CheckBatch)
+		upstream.POST("/breach/enrich", breach.StartEnrichment)
+		upstream.GET("/breach/enrich/:job_id", breach.GetEnrichment)
+		upstream.GET("/breach/checks/:id", breach.GetCheck)
+		upstream.POST("/breach/password", breach.CheckPassword)
 
 		// CVE Security Alerts (NIST)
-		protected.POST("/cve/search", cve.SearchCVEs)
-		protected.GET("/cve/latest", cve.GetLatestCVEs)
+		upstream.POST("/cve/search", cve.SearchCVEs)
+		upstream.GET("/cve/latest", cve.GetLatestCVEs)
 	}
+
+	// Operator routes (require JWT of an is_admin user). Jobs and backups
+	// run as long as they need.
+	admin := api.Group("/admin", middleware.AuthMiddleware(s.profiles), middleware.AdminMiddleware(s.store))
+	{
+		admin.GET("/jobs", s.adminHandler.ListJobs)
+		admin.POST("/jobs/:name/run", s.adminHandler.RunJob)
+		admin.GET("/jobs/reports", s.adminHandler.ListJobReports)
+		admin.GET("/jobs/reports/:id", s.adminHandler.GetJobReport)
+		admin.POST("/users/:id/repair-manifest", s.adminHandler.RepairManifest)
+		admin.POST("/users/:id/deactivate", s.adminHandler.DeactivateUser)
+		admin.POST("/users/:id/activate", s.adminHandler.ActivateUser)
+		admin.POST("/users/:id/revoke-tokens", s.adminHandler.RevokeTokens)
+		admin.PUT("/users/:id/tier", s.adminHandler.SetTier)
+		admin.GET("/users/:id", s.adminHandler.GetUser)
+		admin.GET("/users/:id/diagnostics", s.adminHandler.GetUserDiagnostics)
+		admin.PUT("/users/:id/legal-hold", s.adminHandler.SetLegalHold)
+		admin.POST("/backup", s.adminHandler.ExportBackup)
+		admin.GET("/inactivity/deletions", s.adminHandler.ListUpcomingDeletions)
+		admin.GET("/password-hashes", s.adminHandler.GetPasswordHashStats)
+		admin.GET("/password-hashes/deprecated", s.adminHandler.ListDeprecatedHashes)
+		admin.POST("/password-hashes/campaign", s.adminHandler.StartHashUpgradeCampaign)
+		admin.GET("/metrics", gin.WrapH(metrics.Handler()))
+	}
+
+	// WebSocket for real-time sync. The origin is checked before the token,
+	// so a disallowed page learns nothing about its credentials.
+	api.GET("/sync/live", middleware.RequireAllowedOrigin(s.origins), middleware.AuthMiddleware(s.profiles), s.wsHandler.HandleWebSocket)
+
+	// Operators compact every user's zones (or one with user_id)
+	api.POST("/sync/compact", middleware.AuthMiddleware(s.profiles), middleware.AdminMiddleware(s.store), s.adminHandler.Compact)
+}
+
+// Default request deadlines: most routes only touch Postgres and Redis;
+// breach and CVE lookups wait on third-party APIs
+const (
+	defaultRequestTimeout         = 10 * time.Second
+	defaultUpstreamRequestTimeout = 30 * time.Second
+)
+
+// durationEnv reads a duration such as "15s" from the environment. "0"
+// disables the deadline; unset or invalid values use the fallback.
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	if value := os.Getenv(name); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			return d
+		}
+	}
+	return fallback
+}
+
+// hibpSchedulerConfig reads the HIBP plan's rate (HIBP_RATE_PER_MINUTE,
+// HIBP_BURST) and the queue caps from the environment
+func hibpSchedulerConfig() breach.SchedulerConfig {
+	cfg := breach.DefaultSchedulerConfig
+	cfg.RatePerMinute = intEnv("HIBP_RATE_PER_MINUTE", cfg.RatePerMinute)
+	cfg.Burst = intEnv("HIBP_BURST", cfg.Burst)
+	cfg.MaxQueued = intEnv("HIBP_MAX_QUEUED", cfg.MaxQueued)
+	cfg.MaxQueuedPerUser = intEnv("HIBP_MAX_QUEUED_PER_USER", cfg.MaxQueuedPerUser)
+	cfg.InteractiveWait = durationEnv("HIBP_INTERACTIVE_WAIT", cfg.InteractiveWait)
+	return cfg
+}
+
+// intEnv reads a positive integer from the environment; unset or invalid
+// values use the fallback
+func intEnv(name string, fallback int) int {
+	if value := os.Getenv(name); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+	}
+	return fallback
+}
+
+// authRateLimitOptions reads the failed attempts allowed per window on the
+// login and registration routes (AUTH_RATE_LIMIT_*)
+func authRateLimitOptions() middleware.RateLimitOptions {
+	return middleware.RateLimitOptions{
+		IPAttempts:    intEnv("AUTH_RATE_LIMIT_IP_ATTEMPTS", middleware.DefaultRateLimitIPAttempts),
+		EmailAttempts: intEnv("AUTH_RATE_LIMIT_EMAIL_ATTEMPTS", middleware.DefaultRateLimitEmailAttempts),
+		Window:        durationEnv("AUTH_RATE_LIMIT_WINDOW", middleware.DefaultRateLimitWindow),
+		Redis:         breach.RedisClient(),
+	}
+}
+
+// inactivityPolicy reads the account inactivity thresholds (durations such
+// as "4320h"): INACTIVITY_WARN_AFTER, INACTIVITY_DORMANT_AFTER,
+// INACTIVITY_DELETION_WARN_AFTER, INACTIVITY_DELETE_AFTER and
+// INACTIVITY_DELETION_GRACE. Thresholds out of order fall back to the
+// defaults altogether.
+func inactivityPolicy() jobs.InactivityPolicy {
+	policy := jobs.DefaultInactivityPolicy
+	policy.WarnAfter = durationEnv("INACTIVITY_WARN_AFTER", policy.WarnAfter)
+	policy.DormantAfter = durationEnv("INACTIVITY_DORMANT_AFTER", policy.DormantAfter)
+	policy.DeletionWarnAfter = durationEnv("INACTIVITY_DELETION_WARN_AFTER", policy.DeletionWarnAfter)
+	policy.DeleteAfter = durationEnv("INACTIVITY_DELETE_AFTER", policy.DeleteAfter)
+	policy.DeletionGrace = durationEnv("INACTIVITY_DELETION_GRACE", policy.DeletionGrace)
+	if err := policy.Validate(); err != nil {
+		log.Printf("⚠️  Ignoring INACTIVITY_* settings: %v", err)
+		return jobs.DefaultInactivityPolicy
+	}
+	return policy
+}
+
+// tierPolicy reads the free tier's limits from FREE_TIER_MAX_CREDENTIALS
+// and FREE_TIER_MAX_DEVICES; premium accounts are unlimited
+func tierPolicy() limits.Policy {
+	policy := limits.DefaultPolicy()
+	policy[limits.TierFree] = limits.Limits{
+		Credentials: int64(intEnv("FREE_TIER_MAX_CREDENTIALS", limits.DefaultFreeCredentials)),
+		Devices:     int64(intEnv("FREE_TIER_MAX_DEVICES", limits.DefaultFreeDevices)),
+	}
+	return policy
+}
+
+// conflictStrategy reads CONFLICT_STRATEGY, how pushes settle records made
+// from older versions than the stored ones: last_write_wins (the default),
+// highest_gencount_wins or manual
+func conflictStrategy() sync.ConflictResolutionStrategy {
+	name := os.Getenv("CONFLICT_STRATEGY")
+	if name == "" {
+		return sync.LastWriteWins
+	}
+	strategy, err := sync.ParseConflictStrategy(name)
+	if err != nil {
+		log.Printf("⚠️  Ignoring CONFLICT_STRATEGY: %v", err)
+		return sync.LastWriteWins
+	}
+	return strategy
+}
+
+// tombstonePolicy reads TOMBSTONE_POLICY, how conflicts between a delete
+// and an edit of the same item are settled: edit_wins (the default) or
+// delete_wins
+func tombstonePolicy() sync.TombstonePolicy {
+	name := os.Getenv("TOMBSTONE_POLICY")
+	if name == "" {
+		return sync.EditWins
+	}
+	policy, err := sync.ParseTombstonePolicy(name)
+	if err != nil {
+		log.Printf("⚠️  Ignoring TOMBSTONE_POLICY: %v", err)
+		return sync.EditWins
+	}
+	return policy
+}
+
+// broadcastBreachCheck tells the user's clients that a queued breach check
+// finished; they fetch it from /breach/checks/:id. Background re-checks
+// have nobody waiting on them.
+func broadcastBreachCheck(hub *websocket.Hub, job *breach.Job) {
+	if job.Priority == breach.PriorityBackground {
+		return
+	}
+	err := hub.BroadcastSyncEvent(&websocket.SyncEvent{
+		Type:      "breach_check_complete",
+		UserID:    job.UserID,
+		JobID:     job.ID,
+		Timestamp: clock.System.Now().Unix(),
+	})
+	if err != nil {
+		log.Printf("⚠️  Failed to broadcast breach check %s: %v", job.ID, err)
+	}
+}
+
+// profileCacheTTL reads AUTH_PROFILE_CACHE_TTL (e.g. "30s"). It bounds how
+// long a change can go unnoticed if an invalidation is missed.
+func profileCacheTTL() time.Duration {
+	if value := os.Getenv("AUTH_PROFILE_CACHE_TTL"); value != "" {
+		if ttl, err := time.ParseDuration(value); err == nil && ttl > 0 {
+			return ttl
+		}
+	}
+	return auth.DefaultProfileCacheTTL
+}
+
+// StartBackgroundJobs starts the scheduled maintenance jobs. They stop when
+// ctx is cancelled.
+func (s *Server) StartBackgroundJobs(ctx context.Context) {
+	go s.Jobs.Every(ctx, jobs.ManifestDriftJobName, manifestDriftInterval, jobs.RunOptions{})
+	go s.Jobs.Every(ctx, jobs.DeviceDeactivationJobName, deviceDeactivationInterval, jobs.RunOptions{})
+	go s.Jobs.Every(ctx, jobs.PasswordHashUpgradeJobName, passwordHashUpgradeInterval, jobs.RunOptions{})
+	go s.Jobs.Every(ctx, jobs.BulkWipeExpiryJobName, bulkWipeExpiryInterval, jobs.RunOptions{})
+	go s.Jobs.Every(ctx, jobs.TombstonePurgeJobName, tombstonePurgeInterval, jobs.RunOptions{})
+	go s.Jobs.Every(ctx, jobs.BreachMonitorJobName, breachMonitorInterval, jobs.RunOptions{})
+	// Deletes accounts: opt-in, so upgrading never starts deleting on its own
+	if enabled, _ := strconv.ParseBool(os.Getenv("ACCOUNT_INACTIVITY_ENABLED")); enabled {
+		go s.Jobs.Every(ctx, jobs.AccountInactivityJobName, accountInactivityInterval, jobs.RunOptions{})
+	}
+	// Also opt-in: operators review a dry run's keys before enabling it
+	if enabled, _ := strconv.ParseBool(os.Getenv("ORPHANED_KEY_RECONCILE_ENABLED")); enabled {
+		go s.Jobs.Every(ctx, jobs.OrphanedKeyJobName, orphanedKeyInterval, jobs.RunOptions{})
+	}
+}
+
+// dependencies are what /health pings: the database, and Redis when the
+// server runs on it
+func (s *Server) dependencies() []handlers.Dependency {
+	deps := []handlers.Dependency{{Name: "database", Ping: s.store.Ping}}
+	if redisClient := breach.RedisClient(); redisClient != nil {
+		deps = append(deps, handlers.Dependency{Name: "redis", Ping: func(ctx context.Context) error {
+			return redisClient.Ping(ctx).Err()
+		}})
+	}
+	return deps
+}
+
+// SetCaptchaVerifier makes /auth/register require a solved challenge
+func (s *Server) SetCaptchaVerifier(v auth.CaptchaVerifier) {
+	s.authHandler.SetCaptchaVerifier(v)
 }
 
 func (s *Server) Run(addr string) error {
 	return s.router.Run(addr)
 }
+
+// Handler returns the router, for serving the API from an httptest server
+// or a test's ServeHTTP calls
+func (s *Server) Handler() http.Handler {
+	return s.router
+}
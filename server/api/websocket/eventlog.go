@@ -0,0 +1,194 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultEventLogSize is how many recent events are kept per user for
+// reconnecting clients
+const DefaultEventLogSize = 1000
+
+// ErrSequenceTrimmed means events after the requested sequence are no
+// longer (or were never) in the log; the client must resync
+var ErrSequenceTrimmed = errors.New("event sequence no longer available")
+
+// EventLog numbers each user's events and keeps the most recent ones, so a
+// client reconnecting with the last sequence it saw can be sent what it
+// missed. Sequences start at 1 and increase by one per event of the user,
+// across every server instance sharing the log.
+type EventLog interface {
+	// Append assigns the event its sequence number and records it
+	Append(ctx context.Context, event *SyncEvent) error
+	// Since returns the user's events after seq, oldest first, or
+	// ErrSequenceTrimmed if any of them was dropped
+	Since(ctx context.Context, userID string, seq int64) ([]*SyncEvent, error)
+}
+
+// MemoryEventLog is the single-instance EventLog
+type MemoryEventLog struct {
+	size int
+
+	mu    sync.Mutex
+	users map[string]*userEvents
+}
+
+type userEvents struct {
+	seq    int64
+	events []*SyncEvent // At most size, oldest first
+}
+
+func NewMemoryEventLog(size int) *MemoryEventLog {
+	if size <= 0 {
+		size = DefaultEventLogSize
+	}
+	return &MemoryEventLog{size: size, users: make(map[string]*userEvents)}
+}
+
+func (l *MemoryEventLog) Append(ctx context.Context, event *SyncEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	user := l.users[event.UserID]
+	if user == nil {
+		user = &userEvents{}
+		l.users[event.UserID] = user
+	}
+	user.seq++
+	event.Seq = user.seq
+
+	stored := *event
+	user.events = append(user.events, &stored)
+	if len(user.events) > l.size {
+		user.events = user.events[len(user.events)-l.size:]
+	}
+	return nil
+}
+
+func (l *MemoryEventLog) Since(ctx context.Context, userID string, seq int64) ([]*SyncEvent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	user := l.users[userID]
+	if user == nil {
+		user = &userEvents{}
+	}
+	switch {
+	case seq == user.seq:
+		return nil, nil
+	case seq > user.seq:
+		// A sequence this instance never issued (restart, another instance)
+		return nil, ErrSequenceTrimmed
+	case seq+1 < user.events[0].Seq:
+		return nil, ErrSequenceTrimmed
+	}
+
+	var events []*SyncEvent
+	for _, event := range user.events[seq+1-user.events[0].Seq:] {
+		copied := *event
+		events = append(events, &copied)
+	}
+	return events, nil
+}
+
+// Redis keys of the shared event log
+const (
+	eventSeqKeyPrefix = "ws:seq:"
+	eventLogKeyPrefix = "ws:events:"
+)
+
+// appendEvent allocates the next sequence and records the event in one
+// step, so no reader can see sequence n+1 before n is in the log. Members
+// are prefixed with the sequence to keep identical events apart.
+// KEYS: seq, log. ARGV: event JSON, size.
+var appendEvent = redis.NewScript(`
+local seq = redis.call('INCR', KEYS[1])
+redis.call('ZADD', KEYS[2], seq, seq .. ' ' .. ARGV[1])
+redis.call('ZREMRANGEBYRANK', KEYS[2], 0, -tonumber(ARGV[2]) - 1)
+return seq
+`)
+
+// RedisEventLog shares sequences and events between server instances:
+// INCR allocates the sequence and a sorted set scored by it holds the most
+// recent events
+type RedisEventLog struct {
+	client *redis.Client
+	size   int
+}
+
+func NewRedisEventLog(client *redis.Client, size int) *RedisEventLog {
+	if size <= 0 {
+		size = DefaultEventLogSize
+	}
+	return &RedisEventLog{client: client, size: size}
+}
+
+func (l *RedisEventLog) Append(ctx context.Context, event *SyncEvent) error {
+	unnumbered := *event
+	unnumbered.Seq = 0
+	data, err := json.Marshal(&unnumbered)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{eventSeqKeyPrefix + event.UserID, eventLogKeyPrefix + event.UserID}
+	seq, err := appendEvent.Run(ctx, l.client, keys, data, l.size).Int64()
+	if err != nil {
+		return err
+	}
+	event.Seq = seq
+	return nil
+}
+
+func (l *RedisEventLog) Since(ctx context.Context, userID string, seq int64) ([]*SyncEvent, error) {
+	// One MULTI so the counter and the log are read at the same point
+	var current *redis.StringCmd
+	var stored *redis.ZSliceCmd
+	_, err := l.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		current = pipe.Get(ctx, eventSeqKeyPrefix+userID)
+		stored = pipe.ZRangeByScoreWithScores(ctx, eventLogKeyPrefix+userID, &redis.ZRangeBy{
+			Min: "(" + strconv.FormatInt(seq, 10),
+			Max: "+inf",
+		})
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	latest, err := current.Int64()
+	if errors.Is(err, redis.Nil) {
+		latest = 0
+	} else if err != nil {
+		return nil, err
+	}
+	if seq > latest {
+		return nil, ErrSequenceTrimmed
+	}
+	if seq == latest {
+		return nil, nil
+	}
+
+	members := stored.Val()
+	if len(members) == 0 || int64(members[0].Score) != seq+1 {
+		return nil, ErrSequenceTrimmed
+	}
+
+	events := make([]*SyncEvent, 0, len(members))
+	for _, member := range members {
+		_, data, _ := strings.Cut(member.Member.(string), " ")
+		var event SyncEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, err
+		}
+		event.Seq = int64(member.Score)
+		events = append(events, &event)
+	}
+	return events, nil
+}
@@ -1,20 +1,147 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	syncdomain "github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/metrics"
 	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
 )
 
+// EventSchemaVersion is the version of the SyncEvent JSON shape
+const EventSchemaVersion = 1
+
+// EventResyncRecommended replaces notifications the hub could not deliver.
+// Clients receiving it should run a full manifest check for every zone.
+const EventResyncRecommended = "resync_recommended"
+
+// EventResyncRequired answers a resumption whose last_seq is no longer in
+// the event log. Nothing was replayed; the client must run a full manifest
+// check before relying on live events.
+const EventResyncRequired = "resync_required"
+
+// EventPullRequired replaces an event whose encoding exceeds the hub's
+// maximum event size. It keeps the sequence, zone and gencount; clients
+// receiving it should pull the zone.
+const EventPullRequired = "pull_required"
+
+// Events reporting a change to a zone's items. Their DeviceID is the device
+// that made it; the hub doesn't deliver them to that device's connections,
+// which have the change already.
+const (
+	EventCredentialsChanged = "credentials_changed"
+	EventCredentialDeleted  = "credential_deleted"
+	EventZoneWiped          = "zone_wiped"
+	EventZoneWipeUndone     = "zone_wipe_undone"
+)
+
+// Hub metric names
+const (
+	MetricBroadcastOverflow = "ws_broadcast_overflow"  // Publisher timed out on a full queue
+	MetricClientOverflow    = "ws_client_overflow"     // A client's send buffer was full
+	MetricEventsCoalesced   = "ws_events_coalesced"    // Events merged into a later one
+	MetricResyncSent        = "ws_resync_recommended"  // Resync events delivered
+	MetricEventsSent        = "ws_events_sent"         // Messages handed to clients
+	MetricClientsClosed     = "ws_clients_closed"      // Connections the server closed with a reason
+	MetricEventsReplayed    = "ws_events_replayed"     // Missed events sent to resuming clients
+	MetricResyncRequired    = "ws_resync_required"     // Resumptions the log could not serve
+	MetricEventLogError     = "ws_event_log_error"     // Events the log failed to record
+	MetricEventsDowngraded  = "ws_events_downgraded"   // Oversized events sent as pull_required
+	MetricZoneRejected      = "ws_zone_rejected"       // Subscriptions refused for their zone name or count
+	MetricReadLimitExceeded = "ws_read_limit_exceeded" // Connections closed for an oversized client message
+)
+
+var (
+	ErrHubOverloaded = errors.New("websocket hub is overloaded")
+	ErrHubStopped    = errors.New("websocket hub is stopped")
+
+	// ErrClientRevoked is returned by an Authorizer when the client must not
+	// reconnect; any other error only asks it to re-authenticate
+	ErrClientRevoked = errors.New("websocket client access revoked")
+
+	// ErrTooManyZones is returned by Subscribe past the per-client limit
+	ErrTooManyZones = errors.New("too many zone subscriptions")
+)
+
+// CloseReason is sent in the close frame when the server ends a connection,
+// so clients can tell whether reconnecting is worth it
+type CloseReason struct {
+	Code int
+	Text string
+}
+
+var (
+	// CloseReauthenticate asks the client to get a new access token and
+	// reconnect; its credentials changed but it may still have access
+	CloseReauthenticate = CloseReason{Code: 4001, Text: "reauthenticate"}
+	// CloseRevoked tells the client its device or account lost access for
+	// good; it should not reconnect
+	CloseRevoked = CloseReason{Code: 4003, Text: "revoked"}
+	// CloseInvalidZone ends a connection that subscribed to a zone name no
+	// zone can have
+	CloseInvalidZone = CloseReason{Code: 4008, Text: "invalid zone"}
+	// CloseTooManyZones ends a connection that subscribed to more zones
+	// than the hub allows per client
+	CloseTooManyZones = CloseReason{Code: 4009, Text: "too many zones"}
+
+	closeShutdown = CloseReason{Code: websocket.CloseGoingAway, Text: "server shutting down"}
+)
+
+// Authorizer decides whether a client may keep receiving a zone's events.
+// deviceID is empty for tokens without a device claim.
+type Authorizer func(userID, deviceID, zone string) error
+
+const (
+	DefaultQueueSize        = 256
+	DefaultFlushInterval    = 50 * time.Millisecond
+	DefaultBroadcastTimeout = 100 * time.Millisecond
+
+	DefaultMaxZonesPerClient = 32
+	DefaultMaxEventSize      = 16 * 1024 // Well under common proxy frame limits
+	DefaultReadLimit         = 4 * 1024  // Clients only send small control messages
+
+	writeTimeout = 10 * time.Second
+)
+
+// Frame formats a client's events are sent in
+const (
+	FormatJSON    = "json"    // Text frames; the default
+	FormatMsgPack = "msgpack" // Binary frames with the same fields in MessagePack
+)
+
+var msgpackHandle codec.MsgpackHandle
+
 // SyncEvent represents a sync notification
 type SyncEvent struct {
-	Type      string `json:"type"`       // "credentials_changed", "credential_deleted", etc.
-	UserID    string `json:"user_id"`
-	Zone      string `json:"zone"`
-	GenCount  int64  `json:"gencount"`
-	Timestamp int64  `json:"timestamp"`
+	Seq       int64   `json:"seq,omitempty"` // Per-user sequence from the EventLog; resume with ?last_seq=
+	Type      string  `json:"type"`          // EventCredentialsChanged, EventZoneWiped, etc.
+	UserID    string  `json:"user_id"`
+	Zone      string  `json:"zone"`
+	GenCount  int64   `json:"gencount"`
+	DeviceID  *string `json:"device_id"`        // Device that made the change; null if unknown
+	JobID     string  `json:"job_id,omitempty"` // The finished job of a breach_check_complete event, the monitor of a breach_alert
+	Timestamp int64   `json:"timestamp"`
+
+	// The device's new trust level in a device_trust_changed event
+	TrustLevel string `json:"trust_level,omitempty"`
+	// The deleted credential of a credential_deleted event
+	ItemUUID string `json:"item_uuid,omitempty"`
+	// The monitored address and its new breaches of a breach_alert event
+	Email    string   `json:"email,omitempty"`
+	Breaches []string `json:"breaches,omitempty"`
+
+	// The zone digest of a manifest event
+	Digest []byte `json:"digest,omitempty"`
+	// Why an error event refused a client message
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
 }
 
 // Client represents a connected WebSocket client
@@ -23,7 +150,38 @@ type Client struct {
 	Conn   *websocket.Conn
 	Send   chan []byte
 	UserID string
-	Zone   string
+	Zone   string // Events of other zones are not delivered; empty or "*" means all
+	// From the access token's device claim; empty if it had none
+	DeviceID string
+	Format   string // FormatJSON when empty
+
+	// Set by the hub when a notification could not be queued; the client
+	// gets one resync event as soon as its buffer has room again
+	resync bool
+
+	// Set by the hub before it closes Send; WritePump sends it in the
+	// close frame
+	closeReason *CloseReason
+
+	// Highest sequence Replay sent; WritePump skips queued live events
+	// up to it
+	replayedThrough int64
+
+	// Zones added by Subscribe besides Zone; guarded by the hub's mu
+	zones map[string]bool
+
+	// Highest gencount acknowledged per zone; guarded by the hub's mu
+	acked map[string]int64
+}
+
+type HubOptions struct {
+	QueueSize        int           // Capacity of the broadcast queue
+	FlushInterval    time.Duration // How long events are batched before delivery
+	BroadcastTimeout time.Duration // How long a publisher waits on a full queue
+
+	MaxZonesPerClient int   // Zones one connection may subscribe to
+	MaxEventSize      int   // Encoded size above which events become pull_required
+	ReadLimit         int64 // Largest message a client may send
 }
 
 // Hub manages WebSocket connections and broadcasts
@@ -40,32 +198,123 @@ type Hub struct {
 	// Broadcast messages to clients
 	Broadcast chan *SyncEvent
 
+	flushInterval    time.Duration
+	broadcastTimeout time.Duration
+
+	maxZonesPerClient int
+	maxEventSize      int
+	readLimit         int64
+
+	authorize    Authorizer
+	events       EventLog
+	readManifest ManifestReader
+
+	// Users whose events were dropped at the queue; owed a resync
+	overflowMu sync.Mutex
+	overflowed map[string]bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	running  atomic.Bool // Set once Run starts; Stop only waits for a Run
+
 	mu sync.RWMutex
 }
 
-// NewHub creates a new WebSocket hub
+// NewHub creates a new WebSocket hub with default options
 func NewHub() *Hub {
+	return NewHubWithOptions(HubOptions{})
+}
+
+func NewHubWithOptions(opts HubOptions) *Hub {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.BroadcastTimeout <= 0 {
+		opts.BroadcastTimeout = DefaultBroadcastTimeout
+	}
+	if opts.MaxZonesPerClient <= 0 {
+		opts.MaxZonesPerClient = DefaultMaxZonesPerClient
+	}
+	if opts.MaxEventSize <= 0 {
+		opts.MaxEventSize = DefaultMaxEventSize
+	}
+	if opts.ReadLimit <= 0 {
+		opts.ReadLimit = DefaultReadLimit
+	}
 	return &Hub{
-		clients:    make(map[string]map[*Client]bool),
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
-		Broadcast:  make(chan *SyncEvent, 256),
+		clients:           make(map[string]map[*Client]bool),
+		Register:          make(chan *Client),
+		Unregister:        make(chan *Client),
+		Broadcast:         make(chan *SyncEvent, opts.QueueSize),
+		flushInterval:     opts.FlushInterval,
+		broadcastTimeout:  opts.BroadcastTimeout,
+		maxZonesPerClient: opts.MaxZonesPerClient,
+		maxEventSize:      opts.MaxEventSize,
+		readLimit:         opts.ReadLimit,
+		overflowed:        make(map[string]bool),
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+}
+
+// SetAuthorizer sets the check run by Authorize and
+// RefreshClientAuthorization. Without one every client is allowed.
+func (h *Hub) SetAuthorizer(authorize Authorizer) {
+	h.authorize = authorize
+}
+
+// SetEventLog numbers every broadcast event and keeps it for resuming
+// clients. Without one events carry no sequence and resumption always
+// answers EventResyncRequired.
+func (h *Hub) SetEventLog(events EventLog) {
+	h.events = events
+}
+
+// EventLog returns the log set by SetEventLog, or nil
+func (h *Hub) EventLog() EventLog {
+	return h.events
+}
+
+// Authorize runs the authorizer for a client about to connect
+func (h *Hub) Authorize(userID, deviceID, zone string) error {
+	if h.authorize == nil {
+		return nil
 	}
+	return h.authorize(userID, deviceID, zone)
 }
 
-// Run starts the hub's main loop
+// Run starts the hub's main loop. Events are collected and delivered once
+// per flush interval, so a burst of pushes reaches each client as one
+// notification per event type and zone.
 func (h *Hub) Run() {
+	h.running.Store(true)
+	defer close(h.done)
+
+	ticker := time.NewTicker(h.flushInterval)
+	defer ticker.Stop()
+
+	pending := make(map[string][]*SyncEvent)
+
 	for {
 		select {
+		case <-h.stop:
+			h.closeClients()
+			return
+
 		case client := <-h.Register:
 			h.mu.Lock()
 			if h.clients[client.UserID] == nil {
 				h.clients[client.UserID] = make(map[*Client]bool)
 			}
 			h.clients[client.UserID][client] = true
+			connections := len(h.clients[client.UserID])
 			h.mu.Unlock()
 			log.Printf("📱 Client connected: user=%s, total_connections=%d",
-				client.UserID, len(h.clients[client.UserID]))
+				client.UserID, connections)
 
 		case client := <-h.Unregister:
 			h.mu.Lock()
@@ -84,69 +333,556 @@ func (h *Hub) Run() {
 			log.Printf("📱 Client disconnected: user=%s", client.UserID)
 
 		case event := <-h.Broadcast:
-			h.mu.RLock()
-			clients := h.clients[event.UserID]
-			h.mu.RUnlock()
-
-			if clients != nil {
-				message, err := json.Marshal(event)
-				if err != nil {
-					log.Printf("❌ Error marshaling sync event: %v", err)
-					continue
-				}
+			pending[event.UserID] = append(pending[event.UserID], event)
 
-				// Broadcast to all clients for this user
-				for client := range clients {
-					select {
-					case client.Send <- message:
-						log.Printf("📤 Sent sync event to client: user=%s, type=%s",
-							event.UserID, event.Type)
-					default:
-						// Client buffer full, disconnect
-						close(client.Send)
-						delete(clients, client)
-					}
-				}
+		case <-ticker.C:
+			h.flush(pending)
+			pending = make(map[string][]*SyncEvent)
+		}
+	}
+}
+
+// Stop ends Run and closes every client's send channel. It may be called
+// more than once, and on a hub whose Run never started.
+func (h *Hub) Stop() {
+	h.stopOnce.Do(func() { close(h.stop) })
+	if h.running.Load() {
+		<-h.done
+	}
+}
+
+// AddClient registers a client with the running hub. Once the hub is
+// stopped it returns ErrHubStopped instead of blocking; the caller then
+// closes the connection itself.
+func (h *Hub) AddClient(client *Client) error {
+	select {
+	case h.Register <- client:
+		return nil
+	case <-h.stop:
+		return ErrHubStopped
+	}
+}
+
+// CloseShutdown sends the close frame a stopping hub gives its clients on a
+// connection that never got registered, and closes it
+func CloseShutdown(conn *websocket.Conn) {
+	frame := websocket.FormatCloseMessage(closeShutdown.Code, closeShutdown.Text)
+	conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(writeTimeout))
+	conn.Close()
+}
+
+// DisconnectUser closes every connection of the user with the given reason
+// and returns how many were closed
+func (h *Hub) DisconnectUser(userID string, reason CloseReason) int {
+	return h.disconnect(userID, func(*Client) (CloseReason, bool) {
+		return reason, true
+	})
+}
+
+// DisconnectUserDevice closes the connections opened with one device's
+// tokens and returns how many were closed
+func (h *Hub) DisconnectUserDevice(userID, deviceID string, reason CloseReason) int {
+	return h.disconnect(userID, func(client *Client) (CloseReason, bool) {
+		return reason, client.DeviceID == deviceID
+	})
+}
+
+// RefreshClientAuthorization re-runs the authorizer for each of the user's
+// connections and closes the ones it now denies: with CloseRevoked for
+// ErrClientRevoked, CloseReauthenticate otherwise. Call it whenever the
+// user's devices, zone access or account state change. It returns how many
+// connections were closed.
+func (h *Hub) RefreshClientAuthorization(userID string) int {
+	if h.authorize == nil {
+		return 0
+	}
+
+	h.mu.RLock()
+	subscriptions := make(map[*Client][]string, len(h.clients[userID]))
+	for client := range h.clients[userID] {
+		subscriptions[client] = client.subscribedZones()
+	}
+	h.mu.RUnlock()
+
+	// The authorizer may hit the database; don't hold the lock meanwhile
+	denied := make(map[*Client]CloseReason)
+	for client, zones := range subscriptions {
+		for _, zone := range zones {
+			err := h.authorize(userID, client.DeviceID, zone)
+			if err == nil {
+				continue
 			}
+			denied[client] = denialReason(err)
+			break
 		}
 	}
+	if len(denied) == 0 {
+		return 0
+	}
+
+	return h.disconnect(userID, func(client *Client) (CloseReason, bool) {
+		reason, ok := denied[client]
+		return reason, ok
+	})
+}
+
+// denialReason is the close reason for an authorizer's error
+func denialReason(err error) CloseReason {
+	if errors.Is(err, ErrClientRevoked) {
+		return CloseRevoked
+	}
+	return CloseReauthenticate
+}
+
+// Subscribe adds a zone to the events a connected client receives. A name
+// the zone validator rejects, or a zone past the per-client limit, closes
+// the connection with CloseInvalidZone or CloseTooManyZones and returns
+// the error. Subscribing to syncdomain.AllZones delivers every zone; a
+// client with no zone receives them already.
+func (h *Hub) Subscribe(client *Client, zone string) error {
+	if err := syncdomain.ValidateZoneName(zone); err != nil && zone != syncdomain.AllZones {
+		h.rejectZone(client, CloseInvalidZone)
+		return err
+	}
+
+	h.mu.Lock()
+	if client.allZones() || client.Zone == zone || client.zones[zone] {
+		h.mu.Unlock()
+		return nil
+	}
+	// Zone counts towards the limit
+	if 1+len(client.zones) >= h.maxZonesPerClient {
+		h.mu.Unlock()
+		h.rejectZone(client, CloseTooManyZones)
+		return ErrTooManyZones
+	}
+	if client.zones == nil {
+		client.zones = make(map[string]bool)
+	}
+	client.zones[zone] = true
+	h.mu.Unlock()
+	return nil
 }
 
-// BroadcastSyncEvent sends a sync event to all connected clients for a user
-func (h *Hub) BroadcastSyncEvent(event *SyncEvent) {
-	h.Broadcast <- event
+// subscribedZones returns Zone followed by the zones added by Subscribe
+func (c *Client) subscribedZones() []string {
+	zones := make([]string, 0, 1+len(c.zones))
+	zones = append(zones, c.Zone)
+	for zone := range c.zones {
+		zones = append(zones, zone)
+	}
+	return zones
 }
 
-// ReadPump reads messages from the WebSocket connection
+// receives reports whether the client gets events of the zone. Events
+// without a zone (account-wide ones) go to everyone.
+func (c *Client) receives(zone string) bool {
+	return c.allZones() || zone == "" || zone == c.Zone || c.zones[zone]
+}
+
+func (c *Client) allZones() bool {
+	return c.Zone == "" || c.Zone == syncdomain.AllZones || c.zones[syncdomain.AllZones]
+}
+
+func (h *Hub) rejectZone(client *Client, reason CloseReason) {
+	metrics.Inc(MetricZoneRejected)
+	h.disconnect(client.UserID, func(c *Client) (CloseReason, bool) {
+		return reason, c == client
+	})
+}
+
+// disconnect removes the matching clients and closes their send channels.
+// Removal happens under the same lock flush delivers under, so once it
+// returns no further event reaches them; their later Unregister is a no-op.
+func (h *Hub) disconnect(userID string, match func(*Client) (CloseReason, bool)) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	clients := h.clients[userID]
+	closed := 0
+	for client := range clients {
+		reason, ok := match(client)
+		if !ok {
+			continue
+		}
+		client.closeReason = &reason
+		delete(clients, client)
+		close(client.Send)
+		closed++
+		log.Printf("📱 Client closed by server: user=%s, device=%s, reason=%s",
+			userID, client.DeviceID, reason.Text)
+	}
+	if len(clients) == 0 {
+		delete(h.clients, userID)
+	}
+
+	metrics.Add(MetricClientsClosed, int64(closed))
+	return closed
+}
+
+// BroadcastSyncEvent records the event in the event log, which assigns its
+// sequence, and queues it for all connected clients of the user. If the
+// queue stays full for the broadcast timeout the event is dropped, the
+// user's clients are told to resync instead, and ErrHubOverloaded is
+// returned. An event the log failed to record is still delivered, and the
+// user's clients are told to resync as well, since resuming can't
+// recover it.
+func (h *Hub) BroadcastSyncEvent(event *SyncEvent) error {
+	select {
+	case <-h.stop:
+		return ErrHubStopped
+	default:
+	}
+
+	if h.events != nil {
+		if err := h.events.Append(context.Background(), event); err != nil {
+			log.Printf("⚠️  Failed to record sync event for user=%s: %v", event.UserID, err)
+			metrics.Inc(MetricEventLogError)
+			h.owe(event.UserID)
+		}
+	}
+
+	select {
+	case h.Broadcast <- event:
+		return nil
+	default:
+	}
+
+	timer := time.NewTimer(h.broadcastTimeout)
+	defer timer.Stop()
+
+	select {
+	case h.Broadcast <- event:
+		return nil
+	case <-h.stop:
+		return ErrHubStopped
+	case <-timer.C:
+		metrics.Inc(MetricBroadcastOverflow)
+		h.owe(event.UserID)
+		return ErrHubOverloaded
+	}
+}
+
+// owe marks the user's clients for a resync on the next flush
+func (h *Hub) owe(userID string) {
+	h.overflowMu.Lock()
+	h.overflowed[userID] = true
+	h.overflowMu.Unlock()
+}
+
+// flush delivers one tick's worth of events
+func (h *Hub) flush(pending map[string][]*SyncEvent) {
+	h.overflowMu.Lock()
+	overflowed := h.overflowed
+	h.overflowed = make(map[string]bool)
+	h.overflowMu.Unlock()
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for userID := range overflowed {
+		for client := range h.clients[userID] {
+			client.resync = true
+		}
+	}
+
+	for userID, clients := range h.clients {
+		messages := h.marshalEvents(coalesce(pending[userID]))
+		for client := range clients {
+			if client.resync {
+				h.sendResync(client)
+				continue
+			}
+			h.sendMessages(client, messages)
+		}
+	}
+}
+
+// zoneMessage is an encoded event, the zone it belongs to and, for a
+// change, the device that made it
+type zoneMessage struct {
+	zone   string
+	origin string
+	data   []byte
+}
+
+// origin returns the device that made the change an event reports, or ""
+// for events that aren't changes or whose device is unknown
+func origin(event *SyncEvent) string {
+	switch event.Type {
+	case EventCredentialsChanged, EventCredentialDeleted, EventZoneWiped, EventZoneWipeUndone:
+		if event.DeviceID != nil {
+			return *event.DeviceID
+		}
+	}
+	return ""
+}
+
+// madeChange reports whether the client's device made the change; events
+// without an origin go to everyone
+func (c *Client) madeChange(origin string) bool {
+	return origin != "" && origin == c.DeviceID
+}
+
+// coalesce keeps the newest event per type, zone and job (or breach
+// monitor); a client that learns about gencount 12 does not need to hear
+// about 10 and 11 as well.
+// Events merged from different devices lose their DeviceID, so no device
+// skips the changes of another.
+func coalesce(events []*SyncEvent) []*SyncEvent {
+	if len(events) < 2 {
+		return events
+	}
+
+	type eventKey struct{ Type, Zone, JobID string }
+	latest := make(map[eventKey]int, len(events))
+	kept := make([]*SyncEvent, 0, len(events))
+	for _, event := range events {
+		key := eventKey{event.Type, event.Zone, event.JobID}
+		if i, ok := latest[key]; ok {
+			mixed := !sameDevice(event.DeviceID, kept[i].DeviceID)
+			if event.GenCount >= kept[i].GenCount {
+				kept[i] = event
+			}
+			if mixed && kept[i].DeviceID != nil {
+				merged := *kept[i]
+				merged.DeviceID = nil
+				kept[i] = &merged
+			}
+			continue
+		}
+		latest[key] = len(kept)
+		kept = append(kept, event)
+	}
+
+	metrics.Add(MetricEventsCoalesced, int64(len(events)-len(kept)))
+	return kept
+}
+
+func sameDevice(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func (h *Hub) marshalEvents(events []*SyncEvent) []zoneMessage {
+	messages := make([]zoneMessage, 0, len(events))
+	for _, event := range events {
+		message, err := h.encodeEvent(event)
+		if err != nil {
+			log.Printf("❌ Error marshaling sync event: %v", err)
+			continue
+		}
+		messages = append(messages, zoneMessage{zone: event.Zone, origin: origin(event), data: message})
+	}
+	return messages
+}
+
+// encodeEvent marshals an event. One larger than the maximum event size,
+// which proxies between the server and clients may refuse to carry, is
+// replaced with an EventPullRequired stub of it.
+func (h *Hub) encodeEvent(event *SyncEvent) ([]byte, error) {
+	message, err := json.Marshal(event)
+	if err != nil || len(message) <= h.maxEventSize {
+		return message, err
+	}
+
+	metrics.Inc(MetricEventsDowngraded)
+	log.Printf("⚠️  Sync event of %d bytes sent as %s: user=%s, type=%s, zone=%s",
+		len(message), EventPullRequired, event.UserID, event.Type, event.Zone)
+	return json.Marshal(&SyncEvent{
+		Seq:       event.Seq,
+		Type:      EventPullRequired,
+		UserID:    event.UserID,
+		Zone:      event.Zone,
+		GenCount:  event.GenCount,
+		Timestamp: event.Timestamp,
+	})
+}
+
+func (h *Hub) sendMessages(client *Client, messages []zoneMessage) {
+	for _, message := range messages {
+		if !client.receives(message.zone) || client.madeChange(message.origin) {
+			continue
+		}
+		select {
+		case client.Send <- message.data:
+			metrics.Inc(MetricEventsSent)
+		default:
+			// Slow consumer: rather than dropping an arbitrary subset of
+			// notifications, owe it a single resync
+			metrics.Inc(MetricClientOverflow)
+			client.resync = true
+			return
+		}
+	}
+}
+
+func (h *Hub) sendResync(client *Client) {
+	message, _ := json.Marshal(&SyncEvent{
+		Type:      EventResyncRecommended,
+		UserID:    client.UserID,
+		Timestamp: time.Now().Unix(),
+	})
+
+	select {
+	case client.Send <- message:
+		client.resync = false
+		metrics.Inc(MetricResyncSent)
+		metrics.Inc(MetricEventsSent)
+	default:
+		// Still full; try again next tick
+	}
+}
+
+// Replay sends a resuming client the events it missed after lastSeq, or
+// EventResyncRequired if the log no longer has them all. Call it after the
+// client is registered and before WritePump starts: events broadcast in
+// between are both replayed and queued, and WritePump drops the copies.
+func (c *Client) Replay(ctx context.Context, events EventLog, lastSeq int64) error {
+	missed := []*SyncEvent{}
+	err := ErrSequenceTrimmed
+	if events != nil {
+		missed, err = events.Since(ctx, c.UserID, lastSeq)
+	}
+	if err != nil {
+		if !errors.Is(err, ErrSequenceTrimmed) {
+			log.Printf("⚠️  Event log unavailable for user=%s: %v", c.UserID, err)
+		}
+		metrics.Inc(MetricResyncRequired)
+		return c.writeEvent(&SyncEvent{
+			Type:      EventResyncRequired,
+			UserID:    c.UserID,
+			Timestamp: time.Now().Unix(),
+		})
+	}
+
+	for _, event := range missed {
+		c.replayedThrough = event.Seq
+		if !c.receives(event.Zone) || c.madeChange(origin(event)) {
+			continue
+		}
+		if err := c.writeEvent(event); err != nil {
+			return err
+		}
+		metrics.Inc(MetricEventsReplayed)
+	}
+	return nil
+}
+
+func (c *Client) writeEvent(event *SyncEvent) error {
+	message, err := c.Hub.encodeEvent(event)
+	if err != nil {
+		return err
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.Conn.WriteMessage(websocket.TextMessage, message)
+}
+
+// replayed reports whether a queued message is an event Replay already sent
+func (c *Client) replayed(message []byte) bool {
+	if c.replayedThrough == 0 {
+		return false
+	}
+	var event struct {
+		Seq int64 `json:"seq"`
+	}
+	if err := json.Unmarshal(message, &event); err != nil {
+		return false
+	}
+	return event.Seq != 0 && event.Seq <= c.replayedThrough
+}
+
+// frame turns a queued event, which is always JSON, into a frame in the
+// client's format
+func (c *Client) frame(message []byte) (int, []byte, error) {
+	if c.Format != FormatMsgPack {
+		return websocket.TextMessage, message, nil
+	}
+	var event SyncEvent
+	if err := json.Unmarshal(message, &event); err != nil {
+		return 0, nil, err
+	}
+	var frame []byte
+	if err := codec.NewEncoderBytes(&frame, &msgpackHandle).Encode(&event); err != nil {
+		return 0, nil, err
+	}
+	return websocket.BinaryMessage, frame, nil
+}
+
+func (h *Hub) closeClients() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for userID, clients := range h.clients {
+		for client := range clients {
+			client.closeReason = &closeShutdown
+			close(client.Send)
+		}
+		delete(h.clients, userID)
+	}
+}
+
+// ReadPump reads messages from the WebSocket connection and hands them to
+// the hub (see ClientMessage). A message larger than the hub's read limit
+// ends the connection with close code 1009 (message too big).
 func (c *Client) ReadPump() {
 	defer func() {
-		c.Hub.Unregister <- c
+		select {
+		case c.Hub.Unregister <- c:
+		case <-c.Hub.done:
+		}
 		c.Conn.Close()
 	}()
 
+	c.Conn.SetReadLimit(c.Hub.readLimit)
 	for {
-		_, _, err := c.Conn.ReadMessage()
+		frameType, data, err := c.Conn.ReadMessage()
+		if errors.Is(err, websocket.ErrReadLimit) {
+			// The connection already sent the close frame
+			metrics.Inc(MetricReadLimitExceeded)
+			log.Printf("📱 Client closed for an oversized message: user=%s, device=%s", c.UserID, c.DeviceID)
+			break
+		}
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
 			}
 			break
 		}
-		// We don't expect messages from clients, just keep connection alive
+		c.Hub.handleMessage(c, frameType, data)
 	}
 }
 
-// WritePump writes messages to the WebSocket connection
+// WritePump writes messages to the WebSocket connection. When the hub
+// closes Send with a reason, the reason goes out as the close frame.
 func (c *Client) WritePump() {
 	defer func() {
 		c.Conn.Close()
 	}()
 
 	for message := range c.Send {
-		err := c.Conn.WriteMessage(websocket.TextMessage, message)
+		if c.replayed(message) {
+			continue
+		}
+		frameType, frame, err := c.frame(message)
+		if err != nil {
+			log.Printf("WebSocket encode error: %v", err)
+			continue
+		}
+		// A peer that stops reading must not pin this goroutine forever
+		c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		err = c.Conn.WriteMessage(frameType, frame)
 		if err != nil {
 			log.Printf("WebSocket write error: %v", err)
 			return
 		}
 	}
+
+	// Send was closed after closeReason was set, so reading it here is safe
+	if reason := c.closeReason; reason != nil {
+		frame := websocket.FormatCloseMessage(reason.Code, reason.Text)
+		c.Conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(writeTimeout))
+	}
 }
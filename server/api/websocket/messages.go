@@ -0,0 +1,218 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	syncdomain "github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+// Types of the messages a client may send
+const (
+	// MessageSubscribe adds Zone to the zones the connection receives
+	MessageSubscribe = "subscribe"
+	// MessageManifestRequest asks for the gencount and digest of Zone, or
+	// of the connection's zone when empty
+	MessageManifestRequest = "manifest_request"
+	// MessageAck reports the client has pulled Zone (or the connection's
+	// zone) up to GenCount
+	MessageAck = "ack"
+)
+
+// Types of the events answering client messages
+const (
+	EventSubscribed = "subscribed" // A subscribe succeeded
+	EventManifest   = "manifest"   // Answers manifest_request with gencount and digest
+	EventError      = "error"      // The message was refused; carries code and error
+)
+
+// Metric of client messages answered with an error event
+const MetricClientMessageRejected = "ws_client_message_rejected"
+
+// How long a manifest_request may wait on the reader
+const manifestRequestTimeout = 10 * time.Second
+
+// ClientMessage is a message sent by a client: JSON in text frames,
+// MessagePack in binary ones
+type ClientMessage struct {
+	Type     string `json:"type"`
+	Zone     string `json:"zone,omitempty"`
+	GenCount int64  `json:"gencount,omitempty"`
+}
+
+// ManifestReader returns a zone's gencount and digest for a connected
+// client; 0 and nil for a zone never written. deviceID is empty for tokens
+// without a device claim.
+type ManifestReader func(ctx context.Context, userID, deviceID, zone string) (genCount int64, digest []byte, err error)
+
+// MessageError is an error a ManifestReader wants the client to see as is.
+// Any other error is reported with code "internal".
+type MessageError struct {
+	Code    string
+	Message string
+}
+
+func (e *MessageError) Error() string {
+	return e.Message
+}
+
+// SetManifestReader sets what answers manifest_request messages. Without
+// one they get an error event with code "unavailable".
+func (h *Hub) SetManifestReader(read ManifestReader) {
+	h.readManifest = read
+}
+
+// CaughtUp returns how many of the user's connections receiving the zone
+// acknowledged at least genCount, and how many receive it
+func (h *Hub) CaughtUp(userID, zone string, genCount int64) (caughtUp, connected int) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for client := range h.clients[userID] {
+		if !client.receives(zone) {
+			continue
+		}
+		connected++
+		if client.acked[zone] >= genCount {
+			caughtUp++
+		}
+	}
+	return caughtUp, connected
+}
+
+// handleMessage decodes and carries out one client message. Messages that
+// can't be carried out are answered with an EventError.
+func (h *Hub) handleMessage(client *Client, frameType int, data []byte) {
+	var msg ClientMessage
+	var err error
+	if frameType == websocket.BinaryMessage {
+		err = codec.NewDecoderBytes(data, &msgpackHandle).Decode(&msg)
+	} else {
+		err = json.Unmarshal(data, &msg)
+	}
+	if err != nil {
+		h.replyError(client, &MessageError{Code: "invalid_message", Message: "message is not a valid client message"})
+		return
+	}
+
+	switch msg.Type {
+	case MessageSubscribe:
+		h.handleSubscribe(client, msg.Zone)
+	case MessageManifestRequest:
+		h.handleManifestRequest(client, msg.Zone)
+	case MessageAck:
+		h.handleAck(client, msg.Zone, msg.GenCount)
+	default:
+		h.replyError(client, &MessageError{Code: "unknown_message_type", Message: "unknown message type: " + msg.Type})
+	}
+}
+
+// handleSubscribe authorizes the zone before subscribing, closing the
+// connection as RefreshClientAuthorization would when it is denied.
+// Subscribe checks the name and closes the connection for one it refuses.
+func (h *Hub) handleSubscribe(client *Client, zone string) {
+	if err := h.Authorize(client.UserID, client.DeviceID, zone); err != nil {
+		reason := denialReason(err)
+		h.disconnect(client.UserID, func(c *Client) (CloseReason, bool) {
+			return reason, c == client
+		})
+		return
+	}
+	if err := h.Subscribe(client, zone); err != nil {
+		return
+	}
+	h.reply(client, &SyncEvent{Type: EventSubscribed, UserID: client.UserID, Zone: zone})
+}
+
+func (h *Hub) handleManifestRequest(client *Client, zone string) {
+	zone, ok := h.messageZone(client, zone)
+	if !ok {
+		return
+	}
+	if h.readManifest == nil {
+		h.replyError(client, &MessageError{Code: "unavailable", Message: "manifests are not available over this connection"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), manifestRequestTimeout)
+	defer cancel()
+	genCount, digest, err := h.readManifest(ctx, client.UserID, client.DeviceID, zone)
+	if err != nil {
+		var messageErr *MessageError
+		if !errors.As(err, &messageErr) {
+			log.Printf("❌ WebSocket manifest_request failed: user=%s, zone=%s: %v", client.UserID, zone, err)
+			messageErr = &MessageError{Code: "internal", Message: "failed to get manifest"}
+		}
+		h.replyError(client, messageErr)
+		return
+	}
+	h.reply(client, &SyncEvent{Type: EventManifest, UserID: client.UserID, Zone: zone, GenCount: genCount, Digest: digest})
+}
+
+func (h *Hub) handleAck(client *Client, zone string, genCount int64) {
+	zone, ok := h.messageZone(client, zone)
+	if !ok {
+		return
+	}
+	if genCount < 0 {
+		h.replyError(client, &MessageError{Code: "invalid_message", Message: "gencount must be non-negative"})
+		return
+	}
+
+	h.mu.Lock()
+	if genCount > client.acked[zone] {
+		if client.acked == nil {
+			client.acked = make(map[string]int64)
+		}
+		client.acked[zone] = genCount
+	}
+	h.mu.Unlock()
+}
+
+// messageZone returns the zone a message is about: its own, or the
+// connection's. A connection receiving every zone must name one.
+func (h *Hub) messageZone(client *Client, zone string) (string, bool) {
+	if zone == "" {
+		zone = client.Zone
+	}
+	if err := syncdomain.ValidateZoneName(zone); err != nil {
+		h.replyError(client, &MessageError{Code: "invalid_zone", Message: err.Error()})
+		return "", false
+	}
+	return zone, true
+}
+
+func (h *Hub) replyError(client *Client, err *MessageError) {
+	metrics.Inc(MetricClientMessageRejected)
+	h.reply(client, &SyncEvent{Type: EventError, UserID: client.UserID, Code: err.Code, Error: err.Message})
+}
+
+// reply queues an event for one client. A client the hub has closed, or
+// whose buffer is full, doesn't get it.
+func (h *Hub) reply(client *Client, event *SyncEvent) {
+	event.Timestamp = time.Now().Unix()
+	message, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("❌ Error marshaling WebSocket reply: %v", err)
+		return
+	}
+
+	// Under the lock disconnect closes Send under, so Send is still open
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if !h.clients[client.UserID][client] {
+		return
+	}
+	select {
+	case client.Send <- message:
+		metrics.Inc(MetricEventsSent)
+	default:
+		metrics.Inc(MetricClientOverflow)
+	}
+}
@@ -0,0 +1,358 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+)
+
+// FormatVersion is written into every header; readers reject other versions
+const FormatVersion = 1
+
+// DefaultChunkSize is the number of rows per hashed chunk
+const DefaultChunkSize = 500
+
+// Line types of the stream
+const (
+	LineHeader   = "header"
+	LineRow      = "row"
+	LineChunk    = "chunk"
+	LineManifest = "manifest"
+)
+
+// Tables a row can belong to
+const (
+	TableCryptoKeys         = "crypto_keys"
+	TableCredentialMetadata = "credential_metadata"
+	TableSyncRecords        = "sync_records"
+)
+
+var (
+	ErrCorrupt            = errors.New("backup is corrupt")
+	ErrUnsupportedVersion = errors.New("unsupported backup format version")
+	ErrOutOfOrder         = errors.New("incremental backup does not follow the previous one")
+)
+
+// Manifest maps user ID -> zone -> the highest gencount a backup covers.
+// The manifest of one backup is the base of the next incremental.
+type Manifest map[string]map[string]int64
+
+// Watermark returns the zone's gencount, or fallback if the manifest
+// doesn't list the zone
+func (m Manifest) Watermark(userID, zone string, fallback int64) int64 {
+	if gen, ok := m[userID][zone]; ok {
+		return gen
+	}
+	return fallback
+}
+
+// Raise sets the zone's gencount unless the manifest already has a higher one
+func (m Manifest) Raise(userID, zone string, genCount int64) {
+	zones, ok := m[userID]
+	if !ok {
+		zones = make(map[string]int64)
+		m[userID] = zones
+	}
+	if current, ok := zones[zone]; !ok || genCount > current {
+		zones[zone] = genCount
+	}
+}
+
+func (m Manifest) clone() Manifest {
+	out := make(Manifest, len(m))
+	for userID, zones := range m {
+		for zone, gen := range zones {
+			out.Raise(userID, zone, gen)
+		}
+	}
+	return out
+}
+
+// Equal reports whether both manifests list the same zones at the same
+// gencounts
+func (m Manifest) Equal(other Manifest) bool {
+	count := 0
+	for userID, zones := range m {
+		for zone, gen := range zones {
+			theirs, ok := other[userID][zone]
+			if !ok || theirs != gen {
+				return false
+			}
+			count++
+		}
+	}
+	for _, zones := range other {
+		count -= len(zones)
+	}
+	return count == 0
+}
+
+// Header opens every backup. A full backup has Since 0 and no Base.
+type Header struct {
+	Version   int       `json:"version"`
+	Since     int64     `json:"since"`              // Exclusive watermark for zones Base doesn't list
+	Base      Manifest  `json:"base,omitempty"`     // Manifest of the backup this one continues
+	UserIDs   []string  `json:"user_ids,omitempty"` // Empty means all users
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Row is one row of a sync table; exactly one of the layers is set
+type Row struct {
+	Table    string                     `json:"table"`
+	Key      *models.CryptoKey          `json:"key,omitempty"`
+	Metadata *models.CredentialMetadata `json:"metadata,omitempty"`
+	Record   *models.SyncRecord         `json:"record,omitempty"`
+}
+
+// zone returns the row's owner, zone and gencount
+func (r *Row) zone() (string, string, int64, error) {
+	switch {
+	case r.Table == TableCryptoKeys && r.Key != nil:
+		return r.Key.UserID.String(), r.Key.Zone, r.Key.GenCount, nil
+	case r.Table == TableCredentialMetadata && r.Metadata != nil:
+		return r.Metadata.UserID.String(), r.Metadata.Zone, r.Metadata.GenCount, nil
+	case r.Table == TableSyncRecords && r.Record != nil:
+		return r.Record.UserID.String(), r.Record.Zone, r.Record.GenCount, nil
+	}
+	return "", "", 0, fmt.Errorf("%w: row of table %q has no data", ErrCorrupt, r.Table)
+}
+
+// Chunk closes a run of rows with their count and the SHA-256 of their
+// lines, exactly as written
+type Chunk struct {
+	Seq    int    `json:"seq"`
+	Rows   int    `json:"rows"`
+	SHA256 string `json:"sha256"`
+}
+
+// Trailer ends a complete backup
+type Trailer struct {
+	Manifest Manifest `json:"manifest"`
+	Chunks   int      `json:"chunks"`
+	Rows     int64    `json:"rows"`
+}
+
+// line is the envelope of every line of the stream
+type line struct {
+	Type     string   `json:"type"`
+	Header   *Header  `json:"header,omitempty"`
+	Row      *Row     `json:"row,omitempty"`
+	Chunk    *Chunk   `json:"chunk,omitempty"`
+	Manifest *Trailer `json:"manifest,omitempty"`
+}
+
+// Writer writes a backup stream: the header, rows in hashed chunks, and
+// the trailer with the manifest
+type Writer struct {
+	w         *bufio.Writer
+	chunkSize int
+	pending   bytes.Buffer
+	rows      int
+	chunks    int
+	total     int64
+}
+
+func NewWriter(w io.Writer, header Header, chunkSize int) (*Writer, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	header.Version = FormatVersion
+
+	bw := &Writer{w: bufio.NewWriter(w), chunkSize: chunkSize}
+	if err := bw.writeLine(&line{Type: LineHeader, Header: &header}); err != nil {
+		return nil, err
+	}
+	return bw, nil
+}
+
+func (w *Writer) writeLine(l *line) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if _, err := w.w.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteRow adds a row, closing the chunk when it is full
+func (w *Writer) WriteRow(row *Row) error {
+	data, err := json.Marshal(&line{Type: LineRow, Row: row})
+	if err != nil {
+		return err
+	}
+	w.pending.Write(data)
+	w.pending.WriteByte('\n')
+	w.rows++
+	if w.rows >= w.chunkSize {
+		return w.flushChunk()
+	}
+	return nil
+}
+
+func (w *Writer) flushChunk() error {
+	if w.rows == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(w.pending.Bytes())
+	if _, err := w.w.Write(w.pending.Bytes()); err != nil {
+		return err
+	}
+	w.chunks++
+	w.total += int64(w.rows)
+	chunk := &Chunk{Seq: w.chunks, Rows: w.rows, SHA256: hex.EncodeToString(sum[:])}
+	w.pending.Reset()
+	w.rows = 0
+
+	if err := w.writeLine(&line{Type: LineChunk, Chunk: chunk}); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// Close writes the last chunk and the trailer. A stream without the
+// trailer is incomplete and is rejected on restore.
+func (w *Writer) Close(manifest Manifest) (*Trailer, error) {
+	if err := w.flushChunk(); err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		manifest = Manifest{}
+	}
+	trailer := &Trailer{Manifest: manifest, Chunks: w.chunks, Rows: w.total}
+	if err := w.writeLine(&line{Type: LineManifest, Manifest: trailer}); err != nil {
+		return nil, err
+	}
+	return trailer, w.w.Flush()
+}
+
+// Reader reads a backup stream chunk by chunk, verifying each chunk's hash
+// before handing out its rows
+type Reader struct {
+	r       *bufio.Reader
+	header  Header
+	trailer *Trailer
+	chunks  int
+	total   int64
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	br := &Reader{r: bufio.NewReader(r)}
+	raw, l, err := br.next()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: empty stream", ErrCorrupt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if l.Type != LineHeader || l.Header == nil {
+		return nil, fmt.Errorf("%w: expected a header, got %.40q", ErrCorrupt, raw)
+	}
+	if l.Header.Version != FormatVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, l.Header.Version)
+	}
+	br.header = *l.Header
+	return br, nil
+}
+
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Trailer is set once NextChunk has returned io.EOF
+func (r *Reader) Trailer() *Trailer {
+	return r.trailer
+}
+
+func (r *Reader) next() ([]byte, *line, error) {
+	raw, err := r.r.ReadBytes('\n')
+	if err == io.EOF && len(raw) > 0 {
+		return nil, nil, fmt.Errorf("%w: truncated line", ErrCorrupt)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var l line
+	if err := json.Unmarshal(raw, &l); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+	}
+	return raw, &l, nil
+}
+
+// NextChunk returns the rows of the next chunk once its hash checks out,
+// or io.EOF after the trailer
+func (r *Reader) NextChunk() ([]*Row, error) {
+	if r.trailer != nil {
+		return nil, io.EOF
+	}
+
+	hash := sha256.New()
+	var rows []*Row
+	for {
+		raw, l, err := r.next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: stream ends without a manifest", ErrCorrupt)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch l.Type {
+		case LineRow:
+			if l.Row == nil {
+				return nil, fmt.Errorf("%w: empty row", ErrCorrupt)
+			}
+			hash.Write(raw)
+			rows = append(rows, l.Row)
+
+		case LineChunk:
+			if l.Chunk == nil || l.Chunk.Seq != r.chunks+1 || l.Chunk.Rows != len(rows) {
+				return nil, fmt.Errorf("%w: chunk %d out of sequence", ErrCorrupt, r.chunks+1)
+			}
+			if hex.EncodeToString(hash.Sum(nil)) != l.Chunk.SHA256 {
+				return nil, fmt.Errorf("%w: chunk %d hash mismatch", ErrCorrupt, l.Chunk.Seq)
+			}
+			r.chunks++
+			r.total += int64(len(rows))
+			return rows, nil
+
+		case LineManifest:
+			if len(rows) > 0 {
+				return nil, fmt.Errorf("%w: %d rows after the last chunk", ErrCorrupt, len(rows))
+			}
+			if l.Manifest == nil || l.Manifest.Chunks != r.chunks || l.Manifest.Rows != r.total {
+				return nil, fmt.Errorf("%w: manifest counts don't match the chunks read", ErrCorrupt)
+			}
+			r.trailer = l.Manifest
+			return nil, io.EOF
+
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q line", ErrCorrupt, l.Type)
+		}
+	}
+}
+
+// ReadManifest verifies a whole backup and returns its manifest, the base
+// for the next incremental
+func ReadManifest(r io.Reader) (Manifest, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, err := reader.NextChunk(); err == io.EOF {
+			return reader.Trailer().Manifest, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
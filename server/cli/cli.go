@@ -0,0 +1,118 @@
+// Package cli is the password-sync command line: the API server and the
+// operator subcommands
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/deeplyprofound/password-sync/server/version"
+)
+
+// Exit codes
+const (
+	exitOK      = 0
+	exitFailure = 1 // The command failed or was aborted at its prompt
+	exitUsage   = 2 // Bad command line
+)
+
+// CLI runs commands with its own standard streams
+type CLI struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// OpenStore, when set, replaces the -postgres connection of the
+	// commands that only manage users and zones: user (but
+	// migrate-region), manifest and purge-tombstones
+	OpenStore func() (storage.Store, error)
+
+	in *bufio.Reader // Stdin, shared by every prompt
+}
+
+// command is one operator subcommand. run receives the arguments after the
+// command name and returns the process exit code.
+type command struct {
+	usage string
+	run   func(c *CLI, args []string) int
+}
+
+var commands = map[string]command{
+	"serve":            {"Run the API server (default)", (*CLI).runServe},
+	"migrate":          {"Apply pending Postgres schema migrations, or revert to a version with -to", (*CLI).runMigrate},
+	"seed":             {"Create development users with generated vaults", (*CLI).runSeed},
+	"user":             {"Manage users: create | deactivate | activate | set-tier | migrate-region", (*CLI).runUser},
+	"manifest":         {"Manifest maintenance: repair", (*CLI).runManifest},
+	"purge-tombstones": {"Hard-delete tombstones past the retention window", (*CLI).runPurgeTombstones},
+	"jwt":              {"JWT secret management: rotate", (*CLI).runJWT},
+	"backup":           {"Export the sync tables, in full or since an earlier backup", (*CLI).runBackup},
+	"restore":          {"Apply a full backup and its incrementals", (*CLI).runRestore},
+	"import":           {"Encrypt another password manager's export and push it", (*CLI).runImport},
+	"version":          {"Print the build version", (*CLI).runVersion},
+}
+
+// Run runs the command args name, reading prompts from stdin, and returns
+// the process exit code: 0 on success, 1 on failure or an aborted prompt,
+// 2 for a bad command line
+func Run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	return (&CLI{Stdin: stdin, Stdout: stdout, Stderr: stderr}).Run(args)
+}
+
+// Run runs the command args name and returns the process exit code
+func (c *CLI) Run(args []string) int {
+	// A bare invocation, or one starting with flags, is the old serve-only CLI
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return c.runServe(args)
+	}
+
+	name := args[0]
+	if name == "help" || name == "-h" || name == "--help" {
+		c.printUsage()
+		return exitOK
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(c.Stderr, "unknown command %q\n\n", name)
+		c.printUsage()
+		return exitUsage
+	}
+	return cmd.run(c, args[1:])
+}
+
+func (c *CLI) runVersion(args []string) int {
+	info := version.Get()
+	fmt.Fprintf(c.Stdout, "%s %s (commit %s, built %s)\n", version.Product, info.Version, info.Commit, info.BuildDate)
+	return exitOK
+}
+
+func (c *CLI) printUsage() {
+	fmt.Fprintln(c.Stderr, "Usage: password-sync [command] [flags]")
+	fmt.Fprintln(c.Stderr, "\nCommands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(c.Stderr, "  %-18s %s\n", name, commands[name].usage)
+	}
+	fmt.Fprintln(c.Stderr, "\nRun 'password-sync <command> -h' for the command's flags.")
+}
+
+// readLine reads one line of Stdin, without its line ending
+func (c *CLI) readLine() (string, error) {
+	if c.in == nil {
+		c.in = bufio.NewReader(c.Stdin)
+	}
+	line, err := c.in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
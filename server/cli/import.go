@@ -0,0 +1,150 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	apperrors "github.com/deeplyprofound/password-sync/pkg/errors"
+	"github.com/deeplyprofound/password-sync/pkg/importers"
+	"github.com/deeplyprofound/password-sync/server/domain/crypto"
+)
+
+const (
+	importBatchSize = 200
+	// importAttempts bounds the tries of a batch the server says is retryable
+	importAttempts = 5
+)
+
+// runImport converts another password manager's export and pushes it to a
+// server through the sync API. Everything is encrypted locally with the
+// vault password; the server only receives sync records.
+func (c *CLI) runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "", "Export format: "+strings.Join(importers.Formats(), ", "))
+	file := fs.String("file", "", "Export file to import")
+	server := fs.String("server", envOr("PASSWORD_SYNC_URL", "http://localhost:8080"), "Server base URL")
+	token := fs.String("token", os.Getenv("PASSWORD_SYNC_TOKEN"), "Access token (defaults to env PASSWORD_SYNC_TOKEN)")
+	zone := fs.String("zone", "default", "Zone to import into")
+	saltHex := fs.String("vault-salt", os.Getenv("PASSWORD_SYNC_VAULT_SALT"), "Hex vault key salt (defaults to env PASSWORD_SYNC_VAULT_SALT)")
+	dryRun := fs.Bool("dry-run", false, "Parse and report without pushing")
+	if !c.parseFlags(fs, args) {
+		return exitUsage
+	}
+	if *format == "" || *file == "" {
+		fmt.Fprintln(c.Stderr, "Usage: password-sync import -format <format> -file <export> [-zone default] [-dry-run]")
+		return exitUsage
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return c.fail("%v", err)
+	}
+	result, err := importers.Parse(*format, f)
+	f.Close()
+	if err != nil {
+		return c.fail("%v", err)
+	}
+
+	for _, skipped := range result.Skipped {
+		fmt.Fprintf(c.Stdout, "⚠️  Skipped entry %d %s: %s\n", skipped.Entry, skipped.Name, skipped.Reason)
+	}
+	fmt.Fprintf(c.Stdout, "📥 %d credentials parsed, %d skipped\n", len(result.Credentials), len(result.Skipped))
+	if *dryRun || len(result.Credentials) == 0 {
+		return exitOK
+	}
+
+	if *token == "" {
+		return c.fail("an access token is required. Use -token or set PASSWORD_SYNC_TOKEN")
+	}
+	salt, err := hex.DecodeString(*saltHex)
+	if err != nil || len(salt) == 0 {
+		return c.fail("a hex vault salt is required. Use -vault-salt or set PASSWORD_SYNC_VAULT_SALT")
+	}
+
+	vaultPassword := os.Getenv("PASSWORD_SYNC_VAULT_PASSWORD")
+	if vaultPassword == "" {
+		fmt.Fprint(c.Stdout, "Vault ")
+		if vaultPassword, err = c.readPassword(); err != nil {
+			return c.fail("failed to read vault password: %v", err)
+		}
+	}
+
+	lc, err := crypto.NewLayeredCrypto(vaultPassword, salt)
+	if err != nil {
+		return c.fail("%v", err)
+	}
+	records, err := importers.Encrypt(lc, result.Credentials)
+	if err != nil {
+		return c.fail("encryption failed: %v", err)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	pushed := 0
+	for _, batch := range importers.Batches(*zone, records, importBatchSize) {
+		genCount, err := c.pushImportBatchWithRetry(client, *server, *token, batch)
+		if err != nil {
+			return c.fail("push failed after %d of %d records: %v", pushed, len(records), err)
+		}
+		pushed += len(batch.SyncRecords)
+		fmt.Fprintf(c.Stdout, "   pushed %d/%d (gencount %d)\n", pushed, len(records), genCount)
+	}
+
+	fmt.Fprintf(c.Stdout, "✅ Imported %d credentials into zone %s\n", pushed, *zone)
+	return exitOK
+}
+
+// pushImportBatchWithRetry resends a batch while the server reports a
+// retryable error, waiting as long as it asks
+func (c *CLI) pushImportBatchWithRetry(client *http.Client, server, token string, batch *importers.PushRequest) (int64, error) {
+	for attempt := 1; ; attempt++ {
+		genCount, err := pushImportBatch(client, server, token, batch)
+		apiErr, ok := err.(*apperrors.APIError)
+		if !ok || !apiErr.Retryable || attempt == importAttempts {
+			return genCount, err
+		}
+		wait := apiErr.RetryAfter()
+		if wait <= 0 {
+			wait = time.Duration(attempt) * time.Second
+		}
+		fmt.Fprintf(c.Stdout, "   %v; retrying in %v\n", apiErr, wait)
+		time.Sleep(wait)
+	}
+}
+
+func pushImportBatch(client *http.Client, server, token string, batch *importers.PushRequest) (int64, error) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(server, "/")+"/api/v1/sync/push", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, apperrors.ReadAPIError(resp)
+	}
+	var out struct {
+		GenCount int64 `json:"gencount"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, err
+	}
+	return out.GenCount, nil
+}
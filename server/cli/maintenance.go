@@ -0,0 +1,148 @@
+package cli
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/service"
+)
+
+func (c *CLI) runManifest(args []string) int {
+	if len(args) == 0 || args[0] != "repair" {
+		fmt.Fprintln(c.Stderr, "Usage: password-sync manifest repair -id <user> [-zone default] [-dry-run]")
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet("manifest repair", flag.ContinueOnError)
+	cfg := registerConfigFlags(fs)
+	selector := registerUserSelector(fs)
+	zone := fs.String("zone", "default", "Zone to check")
+	dryRun := fs.Bool("dry-run", false, "Only report drift")
+	if !c.parseFlags(fs, args[1:]) {
+		return exitUsage
+	}
+
+	store, err := c.openUserStore(cfg)
+	if err != nil {
+		return c.fail("%v", err)
+	}
+	defer store.Close()
+
+	user, err := selector.lookup(store)
+	if err != nil {
+		return c.fail("%v", err)
+	}
+
+	check, err := jobs.CheckManifest(context.Background(), store, user.ID, *zone, !*dryRun)
+	if err != nil {
+		return c.fail("manifest check failed: %v", err)
+	}
+
+	fmt.Fprintf(c.Stdout, "Zone %s: %d live items, gencount %d\n", *zone, check.LeafCount, check.GenCount)
+	fmt.Fprintf(c.Stdout, "   stored digest:   %x\n", check.StoredDigest)
+	fmt.Fprintf(c.Stdout, "   computed digest: %x\n", check.ComputedDigest)
+
+	switch {
+	case !check.Drift:
+		fmt.Fprintln(c.Stdout, "✅ No drift")
+	case check.Repaired:
+		c.recordCLIAudit(store, user.ID, service.AuditActionManifestFix, map[string]interface{}{
+			"zone":       *zone,
+			"gencount":   check.GenCount,
+			"leaf_count": check.LeafCount,
+		})
+		fmt.Fprintln(c.Stdout, "✅ Drift repaired (connected devices notice on their next manifest check)")
+	default:
+		fmt.Fprintln(c.Stdout, "⚠️  Drift detected (dry run, nothing changed)")
+	}
+	return exitOK
+}
+
+func (c *CLI) runPurgeTombstones(args []string) int {
+	fs := flag.NewFlagSet("purge-tombstones", flag.ContinueOnError)
+	cfg := registerConfigFlags(fs)
+	userID := fs.String("user", "", "Restrict to one user ID (default: all users)")
+	retention := fs.Duration("retention", jobs.DefaultTombstoneRetention, "Keep tombstones newer than this")
+	dryRun := fs.Bool("dry-run", false, "Report what would be purged without deleting")
+	yes := fs.Bool("yes", false, "Skip the confirmation prompt")
+	if !c.parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	store, err := c.openUserStore(cfg)
+	if err != nil {
+		return c.fail("%v", err)
+	}
+	defer store.Close()
+
+	runner := jobs.NewRunner(store)
+	runner.Register(jobs.NewTombstonePurgeJob(store, *retention))
+
+	if !*dryRun {
+		// Always show the estimate before asking
+		estimate, err := runner.Run(context.Background(), jobs.TombstonePurgeJobName, jobs.RunOptions{DryRun: true, UserID: *userID})
+		if err != nil {
+			return c.fail("dry run failed: %v", err)
+		}
+		if estimate.TotalAffected == 0 {
+			fmt.Fprintln(c.Stdout, "✅ Nothing to purge")
+			return exitOK
+		}
+		prompt := fmt.Sprintf("Permanently delete %d tombstoned rows for %d user zone(s) older than %s?",
+			estimate.TotalAffected, len(estimate.Users), *retention)
+		if !c.confirm(prompt, *yes) {
+			return exitFailure
+		}
+	}
+
+	report, err := runner.Run(context.Background(), jobs.TombstonePurgeJobName, jobs.RunOptions{DryRun: *dryRun, UserID: *userID})
+	if err != nil {
+		return c.fail("purge failed (report %d): %v", report.ID, err)
+	}
+
+	for _, impact := range report.Users {
+		fmt.Fprintf(c.Stdout, "   %s/%s: %d\n", impact.UserID, impact.Zone, impact.Count)
+	}
+	verb := "Purged"
+	if *dryRun {
+		verb = "Would purge"
+	}
+	fmt.Fprintf(c.Stdout, "✅ %s %d rows (report %d)\n", verb, report.TotalAffected, report.ID)
+	return exitOK
+}
+
+// runJWT generates a new JWT signing secret. Tokens are verified against a
+// single secret, so rotating means deploying the new value as JWT_SECRET:
+// outstanding access tokens stop working and clients fall back to their
+// refresh tokens, which are stored server-side and unaffected.
+func (c *CLI) runJWT(args []string) int {
+	if len(args) == 0 || args[0] != "rotate" {
+		fmt.Fprintln(c.Stderr, "Usage: password-sync jwt rotate")
+		return exitUsage
+	}
+
+	fs := flag.NewFlagSet("jwt rotate", flag.ContinueOnError)
+	if !c.parseFlags(fs, args[1:]) {
+		return exitUsage
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return c.fail("failed to generate secret: %v", err)
+	}
+
+	fmt.Fprintln(c.Stdout, "New JWT secret (256-bit):")
+	fmt.Fprintln(c.Stdout)
+	fmt.Fprintln(c.Stdout, base64.StdEncoding.EncodeToString(secret))
+	fmt.Fprintln(c.Stdout)
+	fmt.Fprintln(c.Stdout, "Set it as JWT_SECRET on every server and restart them. Access tokens signed")
+	fmt.Fprintf(c.Stdout, "with the old secret are rejected afterwards (they expire within 15 minutes\n")
+	fmt.Fprintln(c.Stdout, "anyway); clients recover by refreshing.")
+	fmt.Fprintf(c.Stdout, "Generated at %s\n", time.Now().UTC().Format(time.RFC3339))
+	return exitOK
+}
@@ -0,0 +1,252 @@
+package cli
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/crypto"
+	"github.com/deeplyprofound/password-sync/server/fixtures"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/deeplyprofound/password-sync/server/storage/migrations"
+)
+
+// runMigrate applies the pending schema migrations to every region, or with
+// -to moves the databases to that version, reverting the migrations above it
+func (c *CLI) runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	cfg := registerConfigFlags(fs)
+	to := fs.Int("to", migrations.Latest(), "Schema version to migrate to; lower than the current one reverts migrations (0 drops every table)")
+	yes := fs.Bool("yes", false, "Skip the confirmation prompt before reverting migrations")
+	if !c.parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	pgStore, err := cfg.openStore()
+	if err != nil {
+		return c.fail("%v", err)
+	}
+	defer pgStore.Close()
+
+	ctx := context.Background()
+	versions, err := pgStore.SchemaVersions(ctx)
+	if err != nil {
+		return c.fail("failed to read schema versions: %v", err)
+	}
+	var reverting []string
+	for region, version := range versions {
+		if version > *to {
+			reverting = append(reverting, fmt.Sprintf("%s (version %d)", region, version))
+		}
+	}
+	if len(reverting) > 0 {
+		sort.Strings(reverting)
+		prompt := fmt.Sprintf("Reverting %s to schema version %d drops what the later migrations added, data included.", strings.Join(reverting, ", "), *to)
+		if !c.confirm(prompt, *yes) {
+			return exitFailure
+		}
+	}
+
+	steps, err := pgStore.MigrateTo(ctx, *to)
+	for _, step := range steps {
+		verb := "Applied"
+		if step.Down {
+			verb = "Reverted"
+		}
+		fmt.Fprintf(c.Stdout, "   %s %04d_%s (region %s)\n", verb, step.Version, step.Name, step.Region)
+	}
+	if err != nil {
+		return c.fail("migration failed: %v", err)
+	}
+
+	fmt.Fprintf(c.Stdout, "✅ Schema is at version %d\n", *to)
+	return exitOK
+}
+
+// runSeed creates development users, each with a device and a vault of
+// keys, credentials and encrypted sync records in several zones. The items
+// are validated and committed by the same code as /sync/push, and the
+// records decrypt with the vault password and the salt printed per user.
+func (c *CLI) runSeed(args []string) int {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	cfg := registerConfigFlags(fs)
+	email := fs.String("email", "test@example.com", "Email of the first user; the others get +1, +2... tags")
+	password := fs.String("password", "password123", "Login password of every user")
+	vaultPassword := fs.String("vault-password", "", "Vault (master) password of every user (default: the login password)")
+	users := fs.Int("users", 1, "Number of users")
+	zones := fs.String("zones", "default,work", "Comma-separated zones to fill")
+	keys := fs.Int("keys", 2, "Crypto keys per user and zone")
+	credentials := fs.Int("credentials", 20, "Credential metadata items per user and zone")
+	records := fs.Int("records", 20, "Encrypted sync records per user and zone")
+	seed := fs.Uint64("seed", 1, "Random seed; the same seed gives the same dataset")
+	wipe := fs.Bool("wipe", false, "Delete the users, and everything they own, before seeding them again")
+	yes := fs.Bool("yes", false, "Skip the -wipe confirmation prompt")
+	if !c.parseFlags(fs, args) {
+		return exitUsage
+	}
+	if *users < 1 || *keys < 0 || *credentials < 0 || *records < 0 {
+		fmt.Fprintln(c.Stderr, "-users must be positive and the item counts not negative")
+		return exitUsage
+	}
+	if *vaultPassword == "" {
+		*vaultPassword = *password
+	}
+
+	var zoneNames []string
+	for _, zone := range strings.Split(*zones, ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			zoneNames = append(zoneNames, zone)
+		}
+	}
+
+	opts := fixtures.Options{
+		Users:       *users,
+		Email:       *email,
+		Zones:       zoneNames,
+		Keys:        *keys,
+		Credentials: *credentials,
+		Records:     *records,
+		Seed:        *seed,
+	}
+	dataset, err := fixtures.Generate(opts, func(salt []byte) (fixtures.Encryptor, error) {
+		return crypto.NewLayeredCrypto(*vaultPassword, salt)
+	})
+	if err != nil {
+		return c.fail("%v", err)
+	}
+
+	fmt.Fprintln(c.Stdout, "🌱 Seeding database...")
+
+	pgStore, err := cfg.openStore()
+	if err != nil {
+		return c.fail("%v", err)
+	}
+	defer pgStore.Close()
+
+	if *wipe {
+		prompt := fmt.Sprintf("Delete %d user(s) from %s on, with all their data?", *users, *email)
+		if !c.confirm(prompt, *yes) {
+			return exitFailure
+		}
+		for _, user := range dataset {
+			existing, _ := pgStore.GetUserByEmail(user.Email)
+			if existing == nil {
+				continue
+			}
+			if err := pgStore.DeleteUserCascade(context.Background(), existing.ID); err == sql.ErrNoRows {
+				return c.fail("%s is on legal hold and cannot be wiped", user.Email)
+			} else if err != nil {
+				return c.fail("failed to delete %s: %v", user.Email, err)
+			}
+			fmt.Fprintf(c.Stdout, "🗑️  Deleted %s\n", user.Email)
+		}
+	}
+
+	for _, user := range dataset {
+		if existing, _ := pgStore.GetUserByEmail(user.Email); existing != nil {
+			fmt.Fprintf(c.Stdout, "✅ User already exists, left as is (use -wipe to recreate): %s\n", user.Email)
+			continue
+		}
+		if code := c.seedUser(pgStore, user, *password); code != exitOK {
+			return code
+		}
+	}
+
+	fmt.Fprintln(c.Stdout, "\n🎉 Seeding complete!")
+	fmt.Fprintln(c.Stdout, "\nYou can now login with:")
+	fmt.Fprintf(c.Stdout, "  Email: %s\n", *email)
+	fmt.Fprintf(c.Stdout, "  Password: %s\n", *password)
+	fmt.Fprintf(c.Stdout, "  Vault password: %s\n", *vaultPassword)
+	return exitOK
+}
+
+func (c *CLI) seedUser(pgStore *storage.PostgresStore, fixture *fixtures.User, password string) int {
+	salt, err := auth.GenerateSalt()
+	if err != nil {
+		return c.fail("Failed to generate salt: %v", err)
+	}
+
+	user, err := pgStore.CreateUser(fixture.Email, auth.HashPassword(password, salt), salt, storage.DefaultRegion)
+	if err != nil {
+		return c.fail("Failed to create user: %v", err)
+	}
+	device, err := pgStore.CreateDevice(user.ID, "Test Desktop", "desktop", nil, 0, nil)
+	if err != nil {
+		return c.fail("Failed to create device: %v", err)
+	}
+
+	fmt.Fprintf(c.Stdout, "✅ Created %s\n", user.Email)
+	fmt.Fprintf(c.Stdout, "   User ID: %s\n", user.ID)
+	fmt.Fprintf(c.Stdout, "   Device ID: %s\n", device.ID)
+	fmt.Fprintf(c.Stdout, "   Vault salt: %s\n", hex.EncodeToString(fixture.VaultSalt))
+
+	for _, zone := range fixture.Zones {
+		if zone.Items() == 0 {
+			continue
+		}
+		genCount, err := c.seedZone(pgStore, user.ID, device.ID, zone)
+		if err != nil {
+			return c.fail("zone %s of %s: %v", zone.Name, user.Email, err)
+		}
+		fmt.Fprintf(c.Stdout, "   Zone %s: %d keys, %d credentials, %d records (gencount %d)\n",
+			zone.Name, len(zone.Keys), len(zone.Credentials), len(zone.Records), genCount)
+	}
+	return exitOK
+}
+
+// seedZone pushes a zone's fixtures the way /sync/push does: each item is
+// validated and converted by the mapping package, numbered in push order,
+// committed in one transaction, and the manifest digest is rebuilt
+func (c *CLI) seedZone(pgStore *storage.PostgresStore, userID, deviceID string, zone *fixtures.Zone) (int64, error) {
+	state, err := pgStore.GetSyncState(userID, zone.Name)
+	if err != nil {
+		return 0, err
+	}
+	genCount := state.GenCount
+
+	batch := &storage.PushBatch{Zone: zone.Name, DeviceID: deviceID}
+	for _, dto := range zone.Keys {
+		genCount++
+		key, err := mapping.ToCryptoKey(dto, userID, zone.Name, genCount)
+		if err != nil {
+			return 0, err
+		}
+		batch.Keys = append(batch.Keys, key)
+	}
+	for _, dto := range zone.Credentials {
+		genCount++
+		cred, err := mapping.ToCredentialMetadata(dto, userID, zone.Name, genCount)
+		if err != nil {
+			return 0, err
+		}
+		batch.Metadata = append(batch.Metadata, cred)
+	}
+	for _, dto := range zone.Records {
+		genCount++
+		record, err := mapping.ToSyncRecord(dto, userID, zone.Name, genCount)
+		if err != nil {
+			return 0, err
+		}
+		batch.Records = append(batch.Records, record)
+	}
+	batch.GenCount = genCount
+
+	rejected, err := pgStore.CommitPush(context.Background(), userID, batch)
+	if err != nil {
+		return 0, err
+	}
+	if len(rejected) > 0 {
+		return 0, rejected[0]
+	}
+	if _, err := jobs.CheckManifest(context.Background(), pgStore, userID, zone.Name, true); err != nil {
+		return 0, err
+	}
+	return genCount, nil
+}
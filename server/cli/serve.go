@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/deeplyprofound/password-sync/server/api"
+	"github.com/deeplyprofound/password-sync/server/api/breach"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/version"
+)
+
+func (c *CLI) runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	cfg := registerConfigFlags(fs)
+	registerStorageFlags(fs, cfg)
+	port := fs.String("port", "8080", "Server port")
+	captchaCfg := registerCaptchaFlags(fs)
+	jwtCfg := registerJWTFlags(fs)
+	upstreamCfg := registerUpstreamFlags(fs)
+	if !c.parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	secret, err := c.jwtSecret(cfg)
+	if err != nil {
+		return c.fail("%v", err)
+	}
+	if err := jwtCfg.apply(secret); err != nil {
+		return c.fail("invalid access token config: %v", err)
+	}
+
+	if err := upstreamCfg.apply(); err != nil {
+		return c.fail("invalid breach/CVE config: %v", err)
+	}
+
+	// Derives its key from the JWT secret, so it comes after it
+	captcha, err := auth.NewCaptchaVerifier(*captchaCfg)
+	if err != nil {
+		return c.fail("invalid captcha config: %v", err)
+	}
+
+	// Sensitive cache values are sealed before they reach Redis
+	cacheKeys, err := cfg.cacheKeyring()
+	if err != nil {
+		return c.fail("invalid -cache-keys: %v", err)
+	}
+	breach.SetCacheKeyring(cacheKeys)
+
+	// Postgres for a multi-tenant server, SQLite for a self-hosted one
+	store, err := c.openServerStore(cfg)
+	if err != nil {
+		return c.fail("%v", err)
+	}
+	defer store.Close()
+
+	// Redis is optional: without it the server runs in single-binary mode
+	// with in-memory substitutes (logged below, reported on /health)
+	if err := breach.InitRedis(cfg.RedisAddr); err != nil {
+		fmt.Fprintf(c.Stdout, "WARNING: Redis not available - running in single-binary mode: %v\n", err)
+	} else {
+		defer breach.CloseRedis()
+	}
+
+	server := api.NewServerWithAuth(store)
+	server.SetCaptchaVerifier(captcha)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server.StartBackgroundJobs(ctx)
+
+	fmt.Fprintf(c.Stdout, "\n🚀 Starting Password Sync Server (Multi-Tenant)\n")
+	fmt.Fprintf(c.Stdout, "   Version: %s\n", version.ServerHeader())
+	fmt.Fprintf(c.Stdout, "   Port: %s\n", *port)
+	if cfg.Storage == storageSQLite {
+		fmt.Fprintf(c.Stdout, "   SQLite: %s ✅\n", cfg.SQLitePath)
+	} else {
+		fmt.Fprintf(c.Stdout, "   Postgres: Connected ✅\n")
+	}
+	fmt.Fprintf(c.Stdout, "   Backend mode: %s\n", server.Features.Mode())
+	fmt.Fprintf(c.Stdout, "   Access tokens: %s, issuer %q, %d public keys\n",
+		auth.JWTConfig().AccessTokenTTL, auth.JWTConfig().Issuer, len(auth.JWKS().Keys))
+	if captcha != nil {
+		fmt.Fprintf(c.Stdout, "   Registration challenge: %s\n", captchaCfg.Provider)
+	} else {
+		fmt.Fprintf(c.Stdout, "   Registration challenge: disabled\n")
+	}
+	fmt.Fprintf(c.Stdout, "   Zero-Knowledge: Enabled ✅\n")
+	fmt.Fprintf(c.Stdout, "\n")
+
+	if err := server.Run(":" + *port); err != nil {
+		return c.fail("Server failed: %v", err)
+	}
+	return exitOK
+}
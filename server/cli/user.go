@@ -0,0 +1,308 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"golang.org/x/term"
+)
+
+const minPasswordLength = 8 // Same rule as /auth/register
+
+func (c *CLI) runUser(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(c.Stderr, "Usage: password-sync user <create|deactivate|activate|set-tier|migrate-region> [flags]")
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "create":
+		return c.runUserCreate(args[1:])
+	case "deactivate":
+		return c.runUserSetActive(args[1:], false)
+	case "activate":
+		return c.runUserSetActive(args[1:], true)
+	case "set-tier":
+		return c.runUserSetTier(args[1:])
+	case "migrate-region":
+		return c.runUserMigrateRegion(args[1:])
+	}
+
+	fmt.Fprintf(c.Stderr, "unknown user command %q\n", args[0])
+	return exitUsage
+}
+
+func (c *CLI) runUserCreate(args []string) int {
+	fs := flag.NewFlagSet("user create", flag.ContinueOnError)
+	cfg := registerConfigFlags(fs)
+	email := fs.String("email", "", "Email of the new user (required)")
+	admin := fs.Bool("admin", false, "Grant operator (is_admin) access")
+	region := fs.String("region", storage.DefaultRegion, "Region whose database keeps the user's data")
+	if !c.parseFlags(fs, args) {
+		return exitUsage
+	}
+	if *email == "" {
+		fmt.Fprintln(c.Stderr, "-email is required")
+		return exitUsage
+	}
+
+	password, err := c.readPassword()
+	if err != nil {
+		return c.fail("failed to read password: %v", err)
+	}
+	if len(password) < minPasswordLength {
+		return c.fail("password must be at least %d characters", minPasswordLength)
+	}
+
+	store, err := c.openUserStore(cfg)
+	if err != nil {
+		return c.fail("%v", err)
+	}
+	defer store.Close()
+
+	if !store.HasRegion(*region) {
+		return c.fail("unknown region %q (configured: %s)", *region, strings.Join(regionsOf(store), ", "))
+	}
+	if existing, _ := store.GetUserByEmail(*email); existing != nil {
+		return c.fail("user already exists: %s", *email)
+	}
+
+	salt, err := auth.GenerateSalt()
+	if err != nil {
+		return c.fail("failed to generate salt: %v", err)
+	}
+
+	user, err := store.CreateUser(*email, auth.HashPassword(password, salt), salt, *region)
+	if err != nil {
+		return c.fail("failed to create user: %v", err)
+	}
+	c.recordCLIAudit(store, user.ID, service.AuditActionRegister, map[string]interface{}{"admin": *admin, "region": *region})
+
+	if *admin {
+		if err := store.SetUserAdmin(user.ID, true); err != nil {
+			return c.fail("user %s created but granting admin failed: %v", user.ID, err)
+		}
+	}
+
+	fmt.Fprintf(c.Stdout, "✅ Created user %s\n", user.Email)
+	fmt.Fprintf(c.Stdout, "   User ID: %s\n", user.ID)
+	fmt.Fprintf(c.Stdout, "   Region: %s\n", *region)
+	fmt.Fprintf(c.Stdout, "   Admin: %v\n", *admin)
+	return exitOK
+}
+
+func (c *CLI) runUserSetActive(args []string, active bool) int {
+	name := "user deactivate"
+	if active {
+		name = "user activate"
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	cfg := registerConfigFlags(fs)
+	selector := registerUserSelector(fs)
+	yes := fs.Bool("yes", false, "Skip the confirmation prompt")
+	if !c.parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	store, err := c.openUserStore(cfg)
+	if err != nil {
+		return c.fail("%v", err)
+	}
+	defer store.Close()
+
+	user, err := selector.lookup(store)
+	if err != nil {
+		return c.fail("%v", err)
+	}
+
+	if !active && !c.confirm(fmt.Sprintf("Deactivate %s (%s)? All of their sessions stop working.", user.Email, user.ID), *yes) {
+		return exitFailure
+	}
+
+	c.invalidateServerCaches(cfg, store)
+	if err := store.SetUserActive(user.ID, active); err != nil {
+		return c.fail("failed to update user: %v", err)
+	}
+
+	action := service.AuditActionUserDisable
+	if active {
+		action = service.AuditActionUserEnable
+	}
+	c.recordCLIAudit(store, user.ID, action, nil)
+
+	fmt.Fprintf(c.Stdout, "✅ %s is now %s\n", user.Email, map[bool]string{true: "active", false: "deactivated"}[active])
+	return exitOK
+}
+
+func (c *CLI) runUserSetTier(args []string) int {
+	fs := flag.NewFlagSet("user set-tier", flag.ContinueOnError)
+	cfg := registerConfigFlags(fs)
+	selector := registerUserSelector(fs)
+	tier := fs.String("tier", "", "Subscription tier, e.g. free (required)")
+	if !c.parseFlags(fs, args) {
+		return exitUsage
+	}
+	if *tier == "" {
+		fmt.Fprintln(c.Stderr, "-tier is required")
+		return exitUsage
+	}
+
+	store, err := c.openUserStore(cfg)
+	if err != nil {
+		return c.fail("%v", err)
+	}
+	defer store.Close()
+
+	user, err := selector.lookup(store)
+	if err != nil {
+		return c.fail("%v", err)
+	}
+
+	c.invalidateServerCaches(cfg, store)
+	if err := store.SetSubscriptionTier(user.ID, *tier); err != nil {
+		return c.fail("failed to update tier: %v", err)
+	}
+	c.recordCLIAudit(store, user.ID, service.AuditActionTierChange, map[string]interface{}{
+		"tier":     *tier,
+		"previous": user.SubscriptionTier,
+	})
+
+	fmt.Fprintf(c.Stdout, "✅ %s: tier %s → %s\n", user.Email, user.SubscriptionTier, *tier)
+	return exitOK
+}
+
+// runUserMigrateRegion moves a deactivated user's data to another region's
+// database. The user is reactivated separately, once servers have stopped
+// routing them to the old region.
+func (c *CLI) runUserMigrateRegion(args []string) int {
+	fs := flag.NewFlagSet("user migrate-region", flag.ContinueOnError)
+	cfg := registerConfigFlags(fs)
+	selector := registerUserSelector(fs)
+	to := fs.String("to", "", "Region to move the user to (required)")
+	yes := fs.Bool("yes", false, "Skip the confirmation prompt")
+	if !c.parseFlags(fs, args) {
+		return exitUsage
+	}
+	if *to == "" {
+		fmt.Fprintln(c.Stderr, "-to is required")
+		return exitUsage
+	}
+
+	pgStore, err := cfg.openStore()
+	if err != nil {
+		return c.fail("%v", err)
+	}
+	defer pgStore.Close()
+
+	if !pgStore.HasRegion(*to) {
+		return c.fail("unknown region %q (configured: %s)", *to, strings.Join(pgStore.Regions(), ", "))
+	}
+	user, err := selector.lookup(pgStore)
+	if err != nil {
+		return c.fail("%v", err)
+	}
+	from, err := pgStore.UserRegion(user.ID)
+	if err != nil {
+		return c.fail("failed to look up the user's region: %v", err)
+	}
+
+	if !c.confirm(fmt.Sprintf("Move %s (%s) from %s to %s? Their rows are deleted from %s afterwards.", user.Email, user.ID, from, *to, from), *yes) {
+		return exitFailure
+	}
+
+	migration, err := pgStore.MigrateUser(context.Background(), user.ID, *to)
+	if errors.Is(err, storage.ErrUserActive) {
+		return c.fail("%v: password-sync user deactivate -id %s", err, user.ID)
+	}
+	if err != nil {
+		return c.fail("migration failed: %v", err)
+	}
+	c.recordCLIAudit(pgStore, user.ID, service.AuditActionRegionMigrate, map[string]interface{}{
+		"from":   migration.From,
+		"to":     migration.To,
+		"tables": migration.Tables,
+	})
+
+	fmt.Fprintf(c.Stdout, "✅ %s moved from %s to %s\n", user.Email, migration.From, migration.To)
+	for _, table := range migration.Tables {
+		fmt.Fprintf(c.Stdout, "   %-20s %d rows\n", table.Table, table.Rows)
+	}
+	fmt.Fprintf(c.Stdout, "Running servers pick the new region up within %s; reactivate the user after that:\n", storage.RegionCacheTTL)
+	fmt.Fprintf(c.Stdout, "   password-sync user activate -id %s\n", user.ID)
+	return exitOK
+}
+
+// userSelector identifies a user by -id or -email
+type userSelector struct {
+	id    *string
+	email *string
+}
+
+func registerUserSelector(fs *flag.FlagSet) *userSelector {
+	return &userSelector{
+		id:    fs.String("id", "", "User ID"),
+		email: fs.String("email", "", "User email"),
+	}
+}
+
+func (s *userSelector) lookup(store storage.Store) (*storage.User, error) {
+	switch {
+	case *s.id != "":
+		user, err := store.GetUserByID(*s.id)
+		if err != nil {
+			return nil, fmt.Errorf("user %s not found: %v", *s.id, err)
+		}
+		return user, nil
+	case *s.email != "":
+		user, err := store.GetUserByEmail(*s.email)
+		if err != nil {
+			return nil, fmt.Errorf("user %s not found: %v", *s.email, err)
+		}
+		return user, nil
+	}
+	return nil, fmt.Errorf("one of -id or -email is required")
+}
+
+// readPassword prompts without echo when Stdin is a terminal, or reads one
+// line from it so scripts can pipe the password in.
+func (c *CLI) readPassword() (string, error) {
+	if f, ok := c.Stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(c.Stdout, "Password: ")
+		password, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(c.Stdout)
+		return string(password), err
+	}
+	return c.readLine()
+}
+
+// recordCLIAudit writes an audit event for an operator action run from the CLI
+func (c *CLI) recordCLIAudit(store storage.Store, userID, action string, details map[string]interface{}) {
+	if details == nil {
+		details = map[string]interface{}{}
+	}
+	details["source"] = "cli"
+	data, _ := json.Marshal(details)
+
+	event := &storage.AuditEvent{UserID: userID, Action: action, Details: data}
+	if err := store.RecordAuditEvent(event); err != nil {
+		fmt.Fprintf(c.Stderr, "WARNING: failed to record audit event: %v\n", err)
+	}
+}
+
+// regionsOf lists the regions a store has configured, for error messages;
+// only Postgres knows more than the default one
+func regionsOf(store storage.Store) []string {
+	if pgStore, ok := store.(*storage.PostgresStore); ok {
+		return pgStore.Regions()
+	}
+	return []string{storage.DefaultRegion}
+}
@@ -0,0 +1,29 @@
+// Package clock is the single source of wall-clock time for the server.
+// Everything it returns is UTC, so timestamps written by different
+// instances compare and serialize the same regardless of host timezone.
+//
+// Time is for display and expiry only. Ordering between writes always uses
+// gencounts, which are monotonic per zone; never break a tie on timestamps.
+package clock
+
+import "time"
+
+type Clock interface {
+	Now() time.Time
+}
+
+// System reads the host clock, converted to UTC
+var System Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+// Frozen always returns the same instant (in UTC); for tests
+type Frozen time.Time
+
+func (f Frozen) Now() time.Time {
+	return time.Time(f).UTC()
+}
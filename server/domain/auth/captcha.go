@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/deeplyprofound/password-sync/server/outbound"
+)
+
+// Captcha providers, selected by CaptchaConfig.Provider
+const (
+	CaptchaDisabled    = ""
+	CaptchaHCaptcha    = "hcaptcha"
+	CaptchaTurnstile   = "turnstile"
+	CaptchaProofOfWork = "pow"
+)
+
+// Provider verification endpoints
+const (
+	HCaptchaVerifyURL  = "https://api.hcaptcha.com/siteverify"
+	TurnstileVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+)
+
+var (
+	ErrCaptchaRequired    = errors.New("captcha required")
+	ErrCaptchaFailed      = errors.New("captcha verification failed")
+	ErrCaptchaUnavailable = errors.New("captcha provider unavailable")
+	ErrUnknownCaptcha     = errors.New("unknown captcha provider")
+)
+
+// CaptchaResponse is what the client submits with its registration
+type CaptchaResponse struct {
+	Token    string `json:"token"`              // Provider token, or the issued proof-of-work challenge
+	Solution string `json:"solution,omitempty"` // Proof of work only
+}
+
+// CaptchaRequirements tell a client what it must solve. They are returned
+// with every failed verification.
+type CaptchaRequirements struct {
+	Provider     string `json:"provider"`
+	SiteKey      string `json:"site_key,omitempty"`
+	ChallengeURL string `json:"challenge_url,omitempty"` // Where proof-of-work puzzles are issued
+	Difficulty   int    `json:"difficulty,omitempty"`    // Leading zero bits a proof of work needs
+}
+
+// CaptchaVerifier decides whether a registration came from a human (or at
+// least from someone willing to pay for it). Verify returns
+// ErrCaptchaRequired, ErrCaptchaFailed or ErrCaptchaUnavailable.
+type CaptchaVerifier interface {
+	Verify(ctx context.Context, resp CaptchaResponse, remoteIP string) error
+	Requirements() CaptchaRequirements
+}
+
+// CaptchaConfig selects and configures a verifier
+type CaptchaConfig struct {
+	Provider   string
+	Secret     string       // hCaptcha / Turnstile secret key
+	SiteKey    string       // Public site key, passed on to clients
+	Difficulty int          // Proof of work; 0 means DefaultPoWDifficulty
+	Client     *http.Client // nil means outbound.Client()
+}
+
+// NewCaptchaVerifier builds the configured verifier; nil when disabled
+func NewCaptchaVerifier(cfg CaptchaConfig) (CaptchaVerifier, error) {
+	switch cfg.Provider {
+	case CaptchaDisabled:
+		return nil, nil
+	case CaptchaHCaptcha, CaptchaTurnstile:
+		if cfg.Secret == "" {
+			return nil, fmt.Errorf("%s requires a secret key", cfg.Provider)
+		}
+		if cfg.Client == nil {
+			cfg.Client = outbound.Client()
+		}
+		endpoint := HCaptchaVerifyURL
+		if cfg.Provider == CaptchaTurnstile {
+			endpoint = TurnstileVerifyURL
+		}
+		return NewSiteVerifier(cfg.Provider, endpoint, cfg.Secret, cfg.SiteKey, cfg.Client), nil
+	case CaptchaProofOfWork:
+		return NewProofOfWork(cfg.Difficulty, DeriveKey("register-pow"))
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCaptcha, cfg.Provider)
+	}
+}
+
+// SiteVerifier checks a client token against a provider's siteverify
+// endpoint. hCaptcha and Turnstile share the protocol.
+type SiteVerifier struct {
+	provider string
+	endpoint string
+	secret   string
+	siteKey  string
+	client   *http.Client
+}
+
+func NewSiteVerifier(provider, endpoint, secret, siteKey string, client *http.Client) *SiteVerifier {
+	return &SiteVerifier{
+		provider: provider,
+		endpoint: endpoint,
+		secret:   secret,
+		siteKey:  siteKey,
+		client:   client,
+	}
+}
+
+func (v *SiteVerifier) Requirements() CaptchaRequirements {
+	return CaptchaRequirements{Provider: v.provider, SiteKey: v.siteKey}
+}
+
+type siteVerifyResponse struct {
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+func (v *SiteVerifier) Verify(ctx context.Context, resp CaptchaResponse, remoteIP string) error {
+	if resp.Token == "" {
+		return ErrCaptchaRequired
+	}
+
+	form := url.Values{"secret": {v.secret}, "response": {resp.Token}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	if v.siteKey != "" {
+		form.Set("sitekey", v.siteKey)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	httpResp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrCaptchaUnavailable, err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %d", ErrCaptchaUnavailable, v.provider, httpResp.StatusCode)
+	}
+
+	var result siteVerifyResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("%w: %v", ErrCaptchaUnavailable, err)
+	}
+	if !result.Success {
+		return fmt.Errorf("%w: %s", ErrCaptchaFailed, strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
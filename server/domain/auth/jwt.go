@@ -1,53 +1,95 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"errors"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+const (
+	DefaultAccessTokenTTL = 15 * time.Minute
+	DefaultIssuer         = "password-sync"
+)
+
 var (
 	// TODO: Move to environment variable in production
-	jwtSecret = []byte("your-secret-key-change-this-in-production")
+	jwtConfig = Config{
+		Secret:         []byte("your-secret-key-change-this-in-production"),
+		AccessTokenTTL: DefaultAccessTokenTTL,
+		Issuer:         DefaultIssuer,
+	}
 
 	ErrInvalidToken = errors.New("invalid token")
 	ErrExpiredToken = errors.New("token has expired")
 )
 
+// Config is how access tokens are signed and checked. Deployments behind
+// an API gateway may need their own lifetime, issuer and audience.
+type Config struct {
+	Secret         []byte        // Kept as is when empty
+	AccessTokenTTL time.Duration // DefaultAccessTokenTTL when 0
+	Issuer         string        // DefaultIssuer when empty
+	Audience       string        // Neither set nor checked when empty
+	// With signing keys (see SetJWTKeys), tokens signed with Secret are
+	// still accepted until then; the zero time refuses them at once
+	HMACGraceUntil time.Time
+}
+
 type Claims struct {
 	UserID   string `json:"user_id"`
 	Email    string `json:"email"`
 	DeviceID string `json:"device_id,omitempty"`
+	// TokenVersion must be >= the user's current token_version to be accepted
+	TokenVersion int `json:"tv,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// GenerateAccessToken creates a short-lived JWT access token (15 minutes)
-func GenerateAccessToken(userID, email, deviceID string) (string, error) {
+// GenerateAccessToken creates a short-lived JWT access token, valid for the
+// configured lifetime
+func GenerateAccessToken(userID, email, deviceID string, tokenVersion int) (string, error) {
+	now := time.Now()
 	claims := Claims{
-		UserID:   userID,
-		Email:    email,
-		DeviceID: deviceID,
+		UserID:       userID,
+		Email:        email,
+		DeviceID:     deviceID,
+		TokenVersion: tokenVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(15 * time.Minute)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			Issuer:    "password-sync",
+			ExpiresAt: jwt.NewNumericDate(now.Add(jwtConfig.AccessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    jwtConfig.Issuer,
 		},
 	}
+	if jwtConfig.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{jwtConfig.Audience}
+	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	method, key, kid := signingKey()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	return token.SignedString(key)
 }
 
-// ValidateToken validates and parses a JWT token
+// ValidateToken validates and parses a JWT token. It must come from the
+// configured issuer and, when one is configured, name the audience. HS256
+// tokens are checked with the secret, and accepted with signing keys only
+// until the HMAC grace period ends; RS256 and EdDSA ones with the public
+// key their kid names (see SetJWTKeys).
 func ValidateToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, ErrInvalidToken
-		}
-		return jwtSecret, nil
-	})
+	options := []jwt.ParserOption{
+		jwt.WithIssuer(jwtConfig.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithValidMethods(validMethods()),
+	}
+	if jwtConfig.Audience != "" {
+		options = append(options, jwt.WithAudience(jwtConfig.Audience))
+	}
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, verificationKey, options...)
 
 	if err != nil {
 		if errors.Is(err, jwt.ErrTokenExpired) {
@@ -63,7 +105,41 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	return nil, ErrInvalidToken
 }
 
-// SetJWTSecret sets the JWT secret (call this on app startup with env var)
+// SetJWTConfig replaces how access tokens are signed and checked (call this
+// on app startup). Tokens issued under another issuer or audience stop
+// being accepted.
+func SetJWTConfig(cfg Config) error {
+	if cfg.AccessTokenTTL < 0 {
+		return errors.New("access token lifetime must not be negative")
+	}
+	if len(cfg.Secret) == 0 {
+		cfg.Secret = jwtConfig.Secret
+	}
+	if cfg.AccessTokenTTL == 0 {
+		cfg.AccessTokenTTL = DefaultAccessTokenTTL
+	}
+	if cfg.Issuer == "" {
+		cfg.Issuer = DefaultIssuer
+	}
+	jwtConfig = cfg
+	return nil
+}
+
+// JWTConfig returns the current access token configuration
+func JWTConfig() Config {
+	return jwtConfig
+}
+
+// SetJWTSecret sets the JWT secret (call this on app startup with env var),
+// keeping the rest of the configuration
 func SetJWTSecret(secret []byte) {
-	jwtSecret = secret
+	jwtConfig.Secret = secret
+}
+
+// DeriveKey returns a key for signing something other than JWTs, derived
+// from the JWT secret so there is still only one secret to configure
+func DeriveKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, jwtConfig.Secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
 }
@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Asymmetric signing keys let services other than this server check access
+// tokens with a public key instead of the shared HMAC secret. One private
+// key signs; every public key, the signer's and those of earlier keys still
+// in rotation, verifies tokens naming it by kid.
+
+// Minimum size of an RSA signing key
+const minRSAKeyBits = 2048
+
+var ErrUnsupportedKey = errors.New("unsupported key: want RSA or Ed25519")
+
+// jwtKeys is nil while tokens are signed with the HMAC secret
+var jwtKeys *keySet
+
+type keySet struct {
+	signer crypto.Signer
+	kid    string // The signer's
+	method jwt.SigningMethod
+	public map[string]crypto.PublicKey // By kid, the signer's included
+	order  []string                    // kids, the signer's first
+}
+
+// JSONWebKey is a public key of a JWKS document (RFC 7517)
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// SetJWTKeys signs access tokens with private (RS256 for RSA, EdDSA for
+// Ed25519) from now on. Tokens are also accepted when signed by one of the
+// other public keys, so keys can be rotated. Tokens signed with the HMAC
+// secret, issued before the switch, are accepted only until the config's
+// HMACGraceUntil, and refused at once without one. A nil private key goes
+// back to HMAC signing.
+func SetJWTKeys(private crypto.Signer, public ...crypto.PublicKey) error {
+	if private == nil {
+		jwtKeys = nil
+		return nil
+	}
+
+	method, err := keyMethod(private.Public())
+	if err != nil {
+		return err
+	}
+	keys := &keySet{signer: private, method: method, public: map[string]crypto.PublicKey{}}
+	for _, key := range append([]crypto.PublicKey{private.Public()}, public...) {
+		if _, err := keyMethod(key); err != nil {
+			return err
+		}
+		kid, err := KeyID(key)
+		if err != nil {
+			return err
+		}
+		if _, dup := keys.public[kid]; dup {
+			continue
+		}
+		keys.public[kid] = key
+		keys.order = append(keys.order, kid)
+	}
+	keys.kid = keys.order[0]
+	jwtKeys = keys
+	return nil
+}
+
+// LoadJWTKeys sets the signing key from a PEM private key (PKCS#1 or
+// PKCS#8) and the other accepted keys from PEM public keys (PKIX), as many
+// blocks as there are keys
+func LoadJWTKeys(privatePEM, publicPEM []byte) error {
+	private, err := ParsePrivateKeyPEM(privatePEM)
+	if err != nil {
+		return err
+	}
+	public, err := ParsePublicKeysPEM(publicPEM)
+	if err != nil {
+		return err
+	}
+	return SetJWTKeys(private, public...)
+}
+
+// ParsePrivateKeyPEM parses an RSA or Ed25519 private key
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("private key: no PEM block")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("private key: unexpected PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("private key: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+	if _, err := keyMethod(signer.Public()); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// ParsePublicKeysPEM parses every PUBLIC KEY block of data
+func ParsePublicKeysPEM(data []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return keys, nil
+		}
+		if block.Type != "PUBLIC KEY" {
+			return nil, fmt.Errorf("public key: unexpected PEM block %q", block.Type)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("public key: %w", err)
+		}
+		if _, err := keyMethod(key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+}
+
+// KeyID returns the kid of a public key: its RFC 7638 thumbprint, so every
+// service computes the same one
+func KeyID(key crypto.PublicKey) (string, error) {
+	var members string
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		members = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, rsaExponent(k), b64(k.N.Bytes()))
+	case ed25519.PublicKey:
+		members = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, b64(k))
+	default:
+		return "", ErrUnsupportedKey
+	}
+	sum := sha256.Sum256([]byte(members))
+	return b64(sum[:]), nil
+}
+
+// JWKS returns the public keys access tokens may be signed with, the active
+// one first; none while tokens are signed with the HMAC secret
+func JWKS() JSONWebKeySet {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	keys := jwtKeys
+	if keys == nil {
+		return set
+	}
+
+	for _, kid := range keys.order {
+		switch k := keys.public[kid].(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, JSONWebKey{
+				Kty: "RSA", Kid: kid, Use: "sig", Alg: jwt.SigningMethodRS256.Alg(),
+				N: b64(k.N.Bytes()), E: rsaExponent(k),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, JSONWebKey{
+				Kty: "OKP", Kid: kid, Use: "sig", Alg: jwt.SigningMethodEdDSA.Alg(),
+				Crv: "Ed25519", X: b64(k),
+			})
+		}
+	}
+	return set
+}
+
+// signingKey returns how new tokens are signed, and their kid ("" for HMAC)
+func signingKey() (jwt.SigningMethod, any, string) {
+	if keys := jwtKeys; keys != nil {
+		return keys.method, keys.signer, keys.kid
+	}
+	return jwt.SigningMethodHS256, jwtConfig.Secret, ""
+}
+
+// verificationKey returns the key a token must be signed with. The key's
+// type follows the token's alg, and each alg gets only its own kind of key:
+// HMAC tokens the secret, never public key bytes, and only while HMAC
+// tokens are accepted.
+func verificationKey(token *jwt.Token) (any, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if !acceptsHMAC() {
+			return nil, ErrInvalidToken
+		}
+		return jwtConfig.Secret, nil
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodEd25519:
+	default:
+		return nil, ErrInvalidToken
+	}
+
+	keys := jwtKeys
+	if keys == nil {
+		return nil, ErrInvalidToken
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, ok := keys.public[kid]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	method, err := keyMethod(key)
+	if err != nil || method.Alg() != token.Method.Alg() {
+		return nil, ErrInvalidToken
+	}
+	return key, nil
+}
+
+// validMethods are the algs ValidateToken accepts
+func validMethods() []string {
+	methods := []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+	if acceptsHMAC() {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	return methods
+}
+
+// acceptsHMAC reports whether tokens signed with the secret are accepted:
+// always without signing keys, with them until the HMAC grace period ends
+func acceptsHMAC() bool {
+	return jwtKeys == nil || time.Now().Before(jwtConfig.HMACGraceUntil)
+}
+
+// keyMethod returns the signing method of a public key
+func keyMethod(key crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minRSAKeyBits {
+			return nil, fmt.Errorf("RSA key must have at least %d bits", minRSAKeyBits)
+		}
+		return jwt.SigningMethodRS256, nil
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+func rsaExponent(k *rsa.PublicKey) string {
+	return b64(big.NewInt(int64(k.E)).Bytes())
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 
 	"crypto/sha256"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/pbkdf2"
 )
 
@@ -16,6 +17,21 @@ const (
 	HashKeyLen     = 32     // Output key length
 )
 
+// Account password hash formats, stored per user as users.hash_version.
+// Older formats still verify; a login rehashes them to CurrentHashVersion.
+const (
+	HashVersionPBKDF2   = 1 // PBKDF2-SHA256 with HashIterations rounds
+	HashVersionArgon2id = 2
+	CurrentHashVersion  = HashVersionArgon2id
+)
+
+// Argon2id cost (RFC 9106's second recommended option)
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+)
+
 var (
 	ErrInvalidPassword = errors.New("invalid password")
 )
@@ -29,16 +45,35 @@ func GenerateSalt() ([]byte, error) {
 	return salt, nil
 }
 
-// HashPassword creates a PBKDF2 hash of the password with salt
+// HashPassword hashes the password with salt in CurrentHashVersion's format
 // This is used for ACCOUNT authentication (login), NOT master password
 func HashPassword(password string, salt []byte) []byte {
-	return pbkdf2.Key([]byte(password), salt, HashIterations, HashKeyLen, sha256.New)
+	return HashPasswordVersion(password, salt, CurrentHashVersion)
+}
+
+// HashPasswordVersion hashes the password in the given format; nil for an
+// unknown version
+func HashPasswordVersion(password string, salt []byte, version int) []byte {
+	switch version {
+	case HashVersionPBKDF2:
+		return pbkdf2.Key([]byte(password), salt, HashIterations, HashKeyLen, sha256.New)
+	case HashVersionArgon2id:
+		return argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, HashKeyLen)
+	}
+	return nil
+}
+
+// VerifyPassword checks if the provided password matches the stored hash,
+// which is in the given version's format
+func VerifyPassword(password string, salt, hash []byte, version int) bool {
+	expectedHash := HashPasswordVersion(password, salt, version)
+	return expectedHash != nil && subtle.ConstantTimeCompare(expectedHash, hash) == 1
 }
 
-// VerifyPassword checks if the provided password matches the stored hash
-func VerifyPassword(password string, salt, hash []byte) bool {
-	expectedHash := HashPassword(password, salt)
-	return subtle.ConstantTimeCompare(expectedHash, hash) == 1
+// HashDeprecated reports whether a hash of the given version should be
+// upgraded to CurrentHashVersion
+func HashDeprecated(version int) bool {
+	return version < CurrentHashVersion
 }
 
 // EncodeToString encodes bytes to base64 string for storage
@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/clock"
+)
+
+const (
+	// DefaultPoWDifficulty takes about a million hashes, around a second
+	// in a browser
+	DefaultPoWDifficulty = 20
+	MaxPoWDifficulty     = 32
+
+	// PoWChallengeTTL is how long an issued puzzle can be solved and used
+	PoWChallengeTTL = 5 * time.Minute
+
+	// PoWChallengePath is where clients fetch puzzles
+	PoWChallengePath = "/api/v1/auth/register/challenge"
+)
+
+// PoWChallenge is a puzzle issued by GET /auth/register/challenge. The
+// client finds a Solution such that SHA-256(Token + ":" + Solution) starts
+// with Difficulty zero bits, and registers with both.
+type PoWChallenge struct {
+	Token      string    `json:"token"`
+	Algorithm  string    `json:"algorithm"`
+	Difficulty int       `json:"difficulty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type powClaims struct {
+	Nonce      []byte `json:"n"`
+	Difficulty int    `json:"d"`
+	ExpiresAt  int64  `json:"e"`
+}
+
+// ProofOfWork is the self-hosted CaptchaVerifier: no third party, the
+// client pays in CPU time instead. Challenges are HMAC-signed, so the server
+// keeps only the ones already used, until they expire.
+type ProofOfWork struct {
+	difficulty int
+	key        []byte
+	clock      clock.Clock
+
+	mu   sync.Mutex
+	used map[string]time.Time // Token -> expiry
+}
+
+func NewProofOfWork(difficulty int, key []byte) (*ProofOfWork, error) {
+	if difficulty == 0 {
+		difficulty = DefaultPoWDifficulty
+	}
+	if difficulty < 1 || difficulty > MaxPoWDifficulty {
+		return nil, fmt.Errorf("proof-of-work difficulty must be 1-%d", MaxPoWDifficulty)
+	}
+	return &ProofOfWork{
+		difficulty: difficulty,
+		key:        key,
+		clock:      clock.System,
+		used:       make(map[string]time.Time),
+	}, nil
+}
+
+// SetClock replaces the clock used for challenge expiry
+func (p *ProofOfWork) SetClock(c clock.Clock) {
+	p.clock = c
+}
+
+func (p *ProofOfWork) Requirements() CaptchaRequirements {
+	return CaptchaRequirements{
+		Provider:     CaptchaProofOfWork,
+		ChallengeURL: PoWChallengePath,
+		Difficulty:   p.difficulty,
+	}
+}
+
+// Issue creates a new puzzle
+func (p *ProofOfWork) Issue() (*PoWChallenge, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	expiresAt := p.clock.Now().Add(PoWChallengeTTL).Truncate(time.Second)
+	payload, err := json.Marshal(powClaims{Nonce: nonce, Difficulty: p.difficulty, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return nil, err
+	}
+
+	enc := base64.RawURLEncoding
+	return &PoWChallenge{
+		Token:      enc.EncodeToString(payload) + "." + enc.EncodeToString(p.sign(payload)),
+		Algorithm:  "sha256",
+		Difficulty: p.difficulty,
+		ExpiresAt:  expiresAt,
+	}, nil
+}
+
+func (p *ProofOfWork) Verify(ctx context.Context, resp CaptchaResponse, remoteIP string) error {
+	if resp.Token == "" || resp.Solution == "" {
+		return ErrCaptchaRequired
+	}
+
+	claims, err := p.decode(resp.Token)
+	if err != nil {
+		return err
+	}
+	now := p.clock.Now()
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	if !now.Before(expiresAt) {
+		return fmt.Errorf("%w: challenge expired", ErrCaptchaFailed)
+	}
+	if !SolvesPoW(resp.Token, resp.Solution, claims.Difficulty) {
+		return fmt.Errorf("%w: solution does not meet difficulty %d", ErrCaptchaFailed, claims.Difficulty)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for token, expiry := range p.used {
+		if !now.Before(expiry) {
+			delete(p.used, token)
+		}
+	}
+	if _, seen := p.used[resp.Token]; seen {
+		return fmt.Errorf("%w: challenge already used", ErrCaptchaFailed)
+	}
+	p.used[resp.Token] = expiresAt
+	return nil
+}
+
+func (p *ProofOfWork) decode(token string) (*powClaims, error) {
+	encPayload, encMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed challenge", ErrCaptchaFailed)
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(encPayload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed challenge", ErrCaptchaFailed)
+	}
+	mac, err := enc.DecodeString(encMAC)
+	if err != nil || !hmac.Equal(mac, p.sign(payload)) {
+		return nil, fmt.Errorf("%w: challenge was not issued by this server", ErrCaptchaFailed)
+	}
+
+	var claims powClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed challenge", ErrCaptchaFailed)
+	}
+	return &claims, nil
+}
+
+func (p *ProofOfWork) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// SolvesPoW reports whether SHA-256(token + ":" + solution) starts with
+// difficulty zero bits
+func SolvesPoW(token, solution string, difficulty int) bool {
+	sum := sha256.Sum256([]byte(token + ":" + solution))
+	zeros := 0
+	for _, b := range sum {
+		if b != 0 {
+			zeros += bits.LeadingZeros8(b)
+			break
+		}
+		zeros += 8
+	}
+	return zeros >= difficulty
+}
@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/domain/crypto"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrAccountInactive = errors.New("account is deactivated")
+	ErrTokenRevoked    = errors.New("token has been revoked")
+)
+
+// Profile is the slice of a user row checked on every authenticated request
+type Profile struct {
+	UserID       string `json:"id"`
+	Email        string `json:"email"`
+	Tier         string `json:"tier"`
+	TokenVersion int    `json:"token_version"`
+	Active       bool   `json:"active"`
+	LegalHold    bool   `json:"legal_hold"` // Destructive requests get a 423
+}
+
+// Check rejects tokens of deactivated accounts and tokens issued before the
+// last token-version bump.
+func (p *Profile) Check(claims *Claims) error {
+	if !p.Active {
+		return ErrAccountInactive
+	}
+	if claims.TokenVersion < p.TokenVersion {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+type ProfileSource interface {
+	GetAuthProfile(userID string) (*Profile, error)
+}
+
+// Cache metric names
+const (
+	MetricProfileCacheHit   = "auth_profile_cache_hit"
+	MetricProfileCacheMiss  = "auth_profile_cache_miss"
+	MetricProfileCacheError = "auth_profile_cache_redis_error"
+	// A Redis entry that did not decrypt, treated as a miss
+	MetricProfileCacheOpenFailed = "auth_profile_cache_open_failed"
+)
+
+const (
+	DefaultProfileCacheTTL  = 30 * time.Second
+	DefaultProfileCacheSize = 10000
+	profileCacheKeyPrefix   = "auth:profile:"
+)
+
+type ProfileCacheOptions struct {
+	TTL   time.Duration // How stale a profile may get without invalidation
+	Size  int           // In-memory LRU capacity
+	Redis *redis.Client // Optional; the LRU is used when nil or unreachable
+	// Seals profiles, which carry the email, before they go to Redis.
+	// Stored as plain JSON when nil.
+	Keys *crypto.CacheKeyring
+	Now  func() time.Time
+}
+
+// ProfileCache is a read-through cache of auth profiles. Redis is shared by
+// every server instance, so an invalidation takes effect everywhere at once.
+// The in-memory LRU only serves while Redis is missing or failing; entries
+// there are per-instance and bounded by the TTL.
+type ProfileCache struct {
+	source ProfileSource
+	redis  *redis.Client
+	keys   *crypto.CacheKeyring
+	ttl    time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	size    int
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type profileEntry struct {
+	profile   Profile
+	expiresAt time.Time
+}
+
+func NewProfileCache(source ProfileSource, opts ProfileCacheOptions) *ProfileCache {
+	if opts.TTL <= 0 {
+		opts.TTL = DefaultProfileCacheTTL
+	}
+	if opts.Size <= 0 {
+		opts.Size = DefaultProfileCacheSize
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &ProfileCache{
+		source:  source,
+		redis:   opts.Redis,
+		keys:    opts.Keys,
+		ttl:     opts.TTL,
+		now:     opts.Now,
+		size:    opts.Size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the user's profile, loading it from the source on a miss
+func (c *ProfileCache) Get(ctx context.Context, userID string) (*Profile, error) {
+	if profile, ok := c.lookup(ctx, userID); ok {
+		metrics.Inc(MetricProfileCacheHit)
+		return profile, nil
+	}
+	metrics.Inc(MetricProfileCacheMiss)
+
+	profile, err := c.source.GetAuthProfile(userID)
+	if err != nil {
+		return nil, err
+	}
+	c.store(ctx, profile)
+	return profile, nil
+}
+
+// Invalidate drops a user's cached profile. Call it after any change to the
+// active flag, tier, token version or password.
+func (c *ProfileCache) Invalidate(ctx context.Context, userID string) {
+	if c.redis != nil {
+		if err := c.redis.Del(ctx, profileCacheKeyPrefix+userID).Err(); err != nil {
+			metrics.Inc(MetricProfileCacheError)
+			log.Printf("⚠️  Failed to invalidate cached auth profile for %s: %v", userID, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[userID]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, userID)
+	}
+}
+
+func (c *ProfileCache) lookup(ctx context.Context, userID string) (*Profile, bool) {
+	if c.redis != nil {
+		key := profileCacheKeyPrefix + userID
+		data, err := c.redis.Get(ctx, key).Bytes()
+		if err == nil && c.keys != nil {
+			if data, err = c.keys.Open(data, key); err != nil {
+				metrics.Inc(MetricProfileCacheOpenFailed)
+				return nil, false
+			}
+		}
+		if err == nil {
+			var profile Profile
+			if json.Unmarshal(data, &profile) == nil {
+				return &profile, true
+			}
+		}
+		if err == nil || errors.Is(err, redis.Nil) {
+			return nil, false
+		}
+		metrics.Inc(MetricProfileCacheError)
+	}
+	return c.lookupLocal(userID)
+}
+
+func (c *ProfileCache) store(ctx context.Context, profile *Profile) {
+	if c.redis != nil {
+		key := profileCacheKeyPrefix + profile.UserID
+		data, err := json.Marshal(profile)
+		if err == nil && c.keys != nil {
+			data, err = c.keys.Seal(data, key)
+		}
+		if err == nil {
+			err = c.redis.Set(ctx, key, data, c.ttl).Err()
+		}
+		if err == nil {
+			return
+		}
+		metrics.Inc(MetricProfileCacheError)
+	}
+	c.storeLocal(profile)
+}
+
+func (c *ProfileCache) lookupLocal(userID string) (*Profile, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[userID]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*profileEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.entries, userID)
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	profile := entry.profile
+	return &profile, true
+}
+
+func (c *ProfileCache) storeLocal(profile *Profile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &profileEntry{profile: *profile, expiresAt: c.now().Add(c.ttl)}
+	if elem, ok := c.entries[profile.UserID]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[profile.UserID] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*profileEntry).profile.UserID)
+	}
+}
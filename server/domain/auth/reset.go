@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// ResetTokenSize is the number of random bytes in a password reset token
+const ResetTokenSize = 32
+
+// GenerateResetToken creates a password reset token to email, and the hash
+// to store in its place
+func GenerateResetToken() (token string, hash []byte, err error) {
+	raw := make([]byte, ResetTokenSize)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	token = base64.RawURLEncoding.EncodeToString(raw)
+	return token, HashResetToken(token), nil
+}
+
+// HashResetToken returns the hash a reset token is stored and looked up
+// by. Tokens are random, so a plain SHA-256 is enough.
+func HashResetToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
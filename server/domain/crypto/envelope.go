@@ -0,0 +1,148 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	apperrors "github.com/deeplyprofound/password-sync/pkg/errors"
+)
+
+// Cache envelope format.
+//
+// Values kept in shared caches (Redis) are sealed under a server-side key:
+//
+//	{"v":1,"kid":"<key id>","n":<nonce>,"ct":<AES-256-GCM ciphertext>}
+//
+// The version, key ID and the caller's context (the cache key) are the GCM
+// additional data, so an envelope opens neither under another key nor when
+// copied to another cache key. The key ID picks the key on open, so values
+// sealed before a rotation stay readable while the old key is kept.
+const CacheEnvelopeVersion = 1
+
+// CacheKeySize is the size of a cache key: AES-256
+const CacheKeySize = 32
+
+type cacheEnvelope struct {
+	Version    int    `json:"v"`
+	KeyID      string `json:"kid"`
+	Nonce      []byte `json:"n"`
+	Ciphertext []byte `json:"ct"`
+}
+
+// CacheKeyring seals cache values under its current key and opens them
+// under any key it holds
+type CacheKeyring struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewCacheKeyring builds a keyring from keys by ID; current must be one of
+// them
+func NewCacheKeyring(current string, keys map[string][]byte) (*CacheKeyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("%w: %q", apperrors.ErrUnknownKeyID, current)
+	}
+	k := &CacheKeyring{current: current, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if id == "" || strings.ContainsAny(id, ":,") {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+		if len(key) != CacheKeySize {
+			return nil, fmt.Errorf("key %q: %w", id, apperrors.ErrInvalidKeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+// ParseCacheKeyring reads "id:base64key,id:base64key". The first key is
+// the current one; the others only open values sealed before a rotation.
+func ParseCacheKeyring(spec string) (*CacheKeyring, error) {
+	var current string
+	keys := map[string][]byte{}
+	for _, entry := range strings.Split(spec, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid cache key %q: want id:base64key", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("cache key %q: %w", id, err)
+		}
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("duplicate cache key id %q", id)
+		}
+		if current == "" {
+			current = id
+		}
+		keys[id] = key
+	}
+	return NewCacheKeyring(current, keys)
+}
+
+// CurrentKeyID is the ID new values are sealed under
+func (k *CacheKeyring) CurrentKeyID() string {
+	return k.current
+}
+
+// Seal encrypts plaintext into an envelope bound to context
+func (k *CacheKeyring) Seal(plaintext []byte, context string) ([]byte, error) {
+	aead := k.aeads[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&cacheEnvelope{
+		Version:    CacheEnvelopeVersion,
+		KeyID:      k.current,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, cacheAdditionalData(CacheEnvelopeVersion, k.current, context)),
+	})
+}
+
+// Open decrypts an envelope sealed with the same context. Anything that is
+// not an intact envelope under a held key fails, including values cached
+// before sealing was introduced.
+func (k *CacheKeyring) Open(sealed []byte, context string) ([]byte, error) {
+	if len(sealed) > MaxCiphertextSize {
+		return nil, apperrors.ErrCiphertextTooLarge
+	}
+	var envelope cacheEnvelope
+	if err := json.Unmarshal(sealed, &envelope); err != nil {
+		return nil, apperrors.ErrDecryptionFailed
+	}
+	if envelope.Version != CacheEnvelopeVersion {
+		return nil, fmt.Errorf("unsupported cache envelope version %d", envelope.Version)
+	}
+	aead, ok := k.aeads[envelope.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", apperrors.ErrUnknownKeyID, envelope.KeyID)
+	}
+	if len(envelope.Nonce) != aead.NonceSize() {
+		return nil, apperrors.ErrCiphertextTooShort
+	}
+	plaintext, err := aead.Open(nil, envelope.Nonce, envelope.Ciphertext,
+		cacheAdditionalData(envelope.Version, envelope.KeyID, context))
+	if err != nil {
+		return nil, apperrors.ErrDecryptionFailed
+	}
+	return plaintext, nil
+}
+
+func cacheAdditionalData(version int, keyID, context string) []byte {
+	return []byte(strconv.Itoa(version) + "\x00" + keyID + "\x00" + context)
+}
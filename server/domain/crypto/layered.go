@@ -5,12 +5,43 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
-	"errors"
+	"crypto/subtle"
+	"io"
 
+	apperrors "github.com/deeplyprofound/password-sync/pkg/errors"
 	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/pbkdf2"
 )
 
+// MaxCiphertextSize bounds what decrypt will process. Sync items are small;
+// anything larger is rejected before it is buffered into GCM.
+const MaxCiphertextSize = 16 << 20
+
+// Wrapped key formats.
+//
+// v1: nonce(12) || AES-256-GCM(master key) ciphertext || tag(16)
+//
+// v2: 0x02 || salt(32) || commitment(32) || nonce(12) || ciphertext || tag(16)
+// HKDF-SHA256 over the master key with the per-wrap salt and info
+// wrapV2Info yields 64 bytes: the AES-256-GCM key, then the commitment.
+// The header before the nonce is the GCM additional data. A fresh key per
+// wrap keeps nonce collisions under one key out of reach, and checking the
+// commitment first means a blob only opens under the key that made it,
+// which GCM alone does not guarantee.
+const (
+	WrapFormatV1      = 1
+	WrapFormatV2      = 2
+	CurrentWrapFormat = WrapFormatV2
+)
+
+const (
+	wrapV2Info      = "password-sync wrap v2"
+	wrapSaltSize    = 32
+	wrapCommitSize  = 32
+	wrapV2HeaderLen = 1 + wrapSaltSize + wrapCommitSize
+	wrapV2Overhead  = wrapV2HeaderLen + 12 + 16 // Header, nonce and tag
+)
+
 type LayeredCrypto struct {
 	masterKey []byte
 }
@@ -30,12 +61,53 @@ func NewLayeredCrypto(password string, salt []byte) (*LayeredCrypto, error) {
 	}, nil
 }
 
+// WrapKey wraps a content key in the current (v2) format
 func (lc *LayeredCrypto) WrapKey(contentKey []byte) ([]byte, error) {
-	return lc.encrypt(contentKey, lc.masterKey)
+	return lc.wrapV2(contentKey)
 }
 
+// UnwrapKey unwraps a key in either wrap format
 func (lc *LayeredCrypto) UnwrapKey(wrappedKey []byte) ([]byte, error) {
-	return lc.decrypt(wrappedKey, lc.masterKey)
+	contentKey, _, err := lc.UnwrapKeyVersion(wrappedKey)
+	return contentKey, err
+}
+
+// UnwrapKeyVersion unwraps a key and reports the format it was wrapped in,
+// so callers can find blobs still in WrapFormatV1.
+//
+// v1 blobs carry no version byte, so a v1 blob whose random nonce happens
+// to start with WrapFormatV2 is first tried as v2. That attempt fails
+// authentication and the blob is then read as v1.
+func (lc *LayeredCrypto) UnwrapKeyVersion(wrappedKey []byte) (contentKey []byte, version int, err error) {
+	if len(wrappedKey) >= wrapV2Overhead && wrappedKey[0] == WrapFormatV2 {
+		if contentKey, err := lc.unwrapV2(wrappedKey); err == nil {
+			return contentKey, WrapFormatV2, nil
+		}
+	}
+
+	contentKey, err = lc.decrypt(wrappedKey, lc.masterKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	return contentKey, WrapFormatV1, nil
+}
+
+// UpgradeWrappedKey rewraps a v1 blob in the current format. Blobs already
+// current are returned unchanged with changed false.
+func (lc *LayeredCrypto) UpgradeWrappedKey(wrappedKey []byte) (upgraded []byte, changed bool, err error) {
+	contentKey, version, err := lc.UnwrapKeyVersion(wrappedKey)
+	if err != nil {
+		return nil, false, err
+	}
+	if version == CurrentWrapFormat {
+		return wrappedKey, false, nil
+	}
+
+	upgraded, err = lc.WrapKey(contentKey)
+	if err != nil {
+		return nil, false, err
+	}
+	return upgraded, true, nil
 }
 
 func (lc *LayeredCrypto) EncryptItem(data []byte, contentKey []byte) ([]byte, error) {
@@ -83,39 +155,106 @@ func (lc *LayeredCrypto) DeriveSubKey(context string) ([]byte, error) {
 	return key, nil
 }
 
-func (lc *LayeredCrypto) encrypt(plaintext, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
+func (lc *LayeredCrypto) wrapV2(contentKey []byte) ([]byte, error) {
+	blob := make([]byte, wrapV2HeaderLen, wrapV2Overhead+len(contentKey))
+	blob[0] = WrapFormatV2
+	salt := blob[1 : 1+wrapSaltSize]
+	if _, err := rand.Read(salt); err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	key, commitment, err := lc.wrapV2Keys(salt)
 	if err != nil {
 		return nil, err
 	}
+	copy(blob[1+wrapSaltSize:], commitment)
 
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
 	nonce := make([]byte, gcm.NonceSize())
 	if _, err := rand.Read(nonce); err != nil {
 		return nil, err
 	}
 
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+	blob = append(blob, nonce...)
+	return gcm.Seal(blob, nonce, contentKey, blob[:wrapV2HeaderLen]), nil
 }
 
-func (lc *LayeredCrypto) decrypt(ciphertext, key []byte) ([]byte, error) {
+func (lc *LayeredCrypto) unwrapV2(blob []byte) ([]byte, error) {
+	if len(blob) > MaxCiphertextSize {
+		return nil, apperrors.ErrCiphertextTooLarge
+	}
+	header := blob[:wrapV2HeaderLen]
+	salt := header[1 : 1+wrapSaltSize]
+
+	key, commitment, err := lc.wrapV2Keys(salt)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(commitment, header[1+wrapSaltSize:]) != 1 {
+		return nil, apperrors.ErrDecryptionFailed
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := blob[wrapV2HeaderLen : wrapV2HeaderLen+gcm.NonceSize()]
+	contentKey, err := gcm.Open(nil, nonce, blob[wrapV2HeaderLen+gcm.NonceSize():], header)
+	if err != nil {
+		return nil, apperrors.ErrDecryptionFailed
+	}
+	return contentKey, nil
+}
+
+// wrapV2Keys derives the per-wrap encryption key and commitment
+func (lc *LayeredCrypto) wrapV2Keys(salt []byte) (key, commitment []byte, err error) {
+	okm := make([]byte, 32+wrapCommitSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, lc.masterKey, salt, []byte(wrapV2Info)), okm); err != nil {
+		return nil, nil, err
+	}
+	return okm[:32], okm[32:], nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
+		return nil, apperrors.ErrInvalidKeySize
+	}
+	return cipher.NewGCM(block)
+}
+
+func (lc *LayeredCrypto) encrypt(plaintext, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
+	return ciphertext, nil
+}
+
+// decrypt opens nonce || ciphertext || tag. Errors are typed so callers can
+// tell a truncated or oversized blob (ErrCiphertextTooShort/TooLarge) from
+// a wrong key or tampering (ErrDecryptionFailed).
+func (lc *LayeredCrypto) decrypt(ciphertext, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(ciphertext) < gcm.NonceSize() {
-		return nil, errors.New("ciphertext too short")
+	if len(ciphertext) > MaxCiphertextSize {
+		return nil, apperrors.ErrCiphertextTooLarge
+	}
+	if len(ciphertext) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, apperrors.ErrCiphertextTooShort
 	}
 
 	nonce := ciphertext[:gcm.NonceSize()]
@@ -123,7 +262,7 @@ func (lc *LayeredCrypto) decrypt(ciphertext, key []byte) ([]byte, error) {
 
 	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
-		return nil, err
+		return nil, apperrors.ErrDecryptionFailed
 	}
 
 	return plaintext, nil
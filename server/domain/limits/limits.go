@@ -0,0 +1,92 @@
+// Package limits is what each subscription tier may store: how many live
+// credentials and active devices an account of the tier can have
+package limits
+
+import "fmt"
+
+// Subscription tiers
+const (
+	TierFree    = "free"
+	TierPremium = "premium"
+)
+
+// Default limits of the free tier
+const (
+	DefaultFreeCredentials = 50
+	DefaultFreeDevices     = 2
+)
+
+// What a limit counts
+const (
+	ResourceCredentials = "credentials" // Live credential metadata, across zones
+	ResourceDevices     = "devices"     // Active devices
+)
+
+// Limits caps an account of one tier; 0 leaves a resource unlimited
+type Limits struct {
+	Credentials int64
+	Devices     int64
+}
+
+// Max returns the limit on resource, 0 for none
+func (l Limits) Max(resource string) int64 {
+	switch resource {
+	case ResourceCredentials:
+		return l.Credentials
+	case ResourceDevices:
+		return l.Devices
+	}
+	return 0
+}
+
+// Policy maps tiers to their limits
+type Policy map[string]Limits
+
+// DefaultPolicy limits the free tier to DefaultFreeCredentials and
+// DefaultFreeDevices; premium is unlimited
+func DefaultPolicy() Policy {
+	return Policy{
+		TierFree:    {Credentials: DefaultFreeCredentials, Devices: DefaultFreeDevices},
+		TierPremium: {},
+	}
+}
+
+// Tier returns the tier the policy applies to an account of tier: tier
+// itself when the policy knows it, otherwise free, so a typo in a user row
+// never lifts the limits
+func (p Policy) Tier(tier string) string {
+	if _, ok := p[tier]; ok {
+		return tier
+	}
+	return TierFree
+}
+
+// For returns the limits of tier; see Tier
+func (p Policy) For(tier string) Limits {
+	return p[p.Tier(tier)]
+}
+
+// Check refuses adding to an account that has used of resource, when the
+// total would exceed the tier's limit. Adding nothing always passes, so an
+// account over its limit after a downgrade can still edit and delete.
+func (p Policy) Check(tier, resource string, used, adding int64) error {
+	max := p.For(tier).Max(resource)
+	if max == 0 || adding <= 0 || used+adding <= max {
+		return nil
+	}
+	return &LimitError{Tier: p.Tier(tier), Resource: resource, Limit: max, Used: used, Adding: adding}
+}
+
+// LimitError is a write that would take an account past a limit of its tier
+type LimitError struct {
+	Tier     string
+	Resource string
+	Limit    int64
+	Used     int64
+	Adding   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("the %s tier allows %d %s; the account has %d and this would add %d",
+		e.Tier, e.Limit, e.Resource, e.Used, e.Adding)
+}
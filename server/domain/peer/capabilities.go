@@ -0,0 +1,229 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// CapabilitiesVersion is the newest capabilities schema the server knows.
+// Keys it does not know, from newer schemas or a client's own, are kept as
+// the device sent them.
+const CapabilitiesVersion = 1
+
+// Limits on what a device may advertise
+const (
+	MaxCapabilitiesSize      = 4096  // Bytes of one device's encoded capabilities
+	MaxCapabilityEncVersion  = 32767 // Same as mapping.MaxEncVersion
+	MaxCapabilityEncVersions = 32    // Entries in enc_versions
+	MaxCapabilityPageSize    = 1000  // Same as the pull limit
+	MaxCapabilityExtraKeys   = 32
+)
+
+// Push notification platforms a device may name
+const (
+	PushPlatformAPNs    = "apns"
+	PushPlatformFCM     = "fcm"
+	PushPlatformWebPush = "webpush"
+)
+
+var ErrInvalidCapabilities = errors.New("invalid device capabilities")
+
+// Capabilities is what a device advertises about itself so the server can
+// pick formats and limits it handles. The zero value, or a device that
+// never reported any, asks for the defaults: JSON, the server's page sizes
+// and BaseEncVersion.
+type Capabilities struct {
+	Version      int    `json:"version"`
+	EncVersions  []int  `json:"enc_versions,omitempty"`  // enc_versions the device can decrypt
+	MsgPack      bool   `json:"msgpack,omitempty"`       // Prefers MessagePack responses and events
+	MaxPageSize  int    `json:"max_page_size,omitempty"` // Largest pull page it wants; 0 for the server's
+	PushPlatform string `json:"push_platform,omitempty"` // apns, fcm or webpush; empty for none
+	// Newest manifest digest version it computes; 0 for the first
+	DigestVersion int `json:"digest_version,omitempty"`
+	// Newest sync wire format it reads; 0 for the first
+	SyncSchema int `json:"sync_schema,omitempty"`
+
+	extra map[string]json.RawMessage
+}
+
+// ParseCapabilities validates a device's capabilities object. Known keys
+// must have their documented types and ranges; unknown keys are kept. An
+// empty document is an empty object.
+func ParseCapabilities(data []byte) (*Capabilities, error) {
+	fields, err := capabilityFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Capabilities{Version: CapabilitiesVersion}
+	for key, value := range fields {
+		switch key {
+		case "version":
+			err = decodeCapability(key, value, &c.Version)
+			if err == nil && c.Version < 1 {
+				err = capabilityError(key, "must be at least 1")
+			}
+		case "enc_versions":
+			err = decodeCapability(key, value, &c.EncVersions)
+			if err == nil {
+				err = checkEncVersions(c.EncVersions)
+			}
+		case "msgpack":
+			err = decodeCapability(key, value, &c.MsgPack)
+		case "max_page_size":
+			err = decodeCapability(key, value, &c.MaxPageSize)
+			if err == nil && (c.MaxPageSize < 1 || c.MaxPageSize > MaxCapabilityPageSize) {
+				err = capabilityError(key, fmt.Sprintf("must be between 1 and %d", MaxCapabilityPageSize))
+			}
+		case "digest_version":
+			err = decodeCapability(key, value, &c.DigestVersion)
+			if err == nil && c.DigestVersion < 1 {
+				err = capabilityError(key, "must be at least 1")
+			}
+		case "sync_schema":
+			err = decodeCapability(key, value, &c.SyncSchema)
+			if err == nil && c.SyncSchema < 1 {
+				err = capabilityError(key, "must be at least 1")
+			}
+		case "push_platform":
+			err = decodeCapability(key, value, &c.PushPlatform)
+			if err == nil && !validPushPlatform(c.PushPlatform) {
+				err = capabilityError(key, "must be one of: apns, fcm, webpush")
+			}
+		default:
+			if c.extra == nil {
+				c.extra = make(map[string]json.RawMessage)
+			}
+			c.extra[key] = value
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(c.extra) > MaxCapabilityExtraKeys {
+		return nil, fmt.Errorf("%w: at most %d unknown keys", ErrInvalidCapabilities, MaxCapabilityExtraKeys)
+	}
+	return c, nil
+}
+
+// MergeCapabilities applies a patch to a device's stored capabilities: each
+// top-level key of the patch replaces the stored one, and a null removes it.
+// The result is validated as a whole.
+func MergeCapabilities(current, patch []byte) (*Capabilities, error) {
+	merged, err := capabilityFields(current)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := capabilityFields(patch)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range changes {
+		if bytes.Equal(value, []byte("null")) {
+			delete(merged, key)
+			continue
+		}
+		merged[key] = value
+	}
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCapabilities(data)
+}
+
+// MarshalJSON writes the known keys next to the unknown ones
+func (c *Capabilities) MarshalJSON() ([]byte, error) {
+	type known Capabilities
+	data, err := json.Marshal((*known)(c))
+	if err != nil || len(c.extra) == 0 {
+		return data, err
+	}
+
+	fields := make(map[string]json.RawMessage, len(c.extra)+5)
+	for key, value := range c.extra {
+		fields[key] = value
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// Extra returns the unknown keys as the device sent them
+func (c *Capabilities) Extra() map[string]json.RawMessage {
+	return c.extra
+}
+
+// MaxEncVersion is the highest enc_version in EncVersions, or 0 when the
+// device did not list any
+func (c *Capabilities) MaxEncVersion() int {
+	highest := 0
+	for _, version := range c.EncVersions {
+		highest = max(highest, version)
+	}
+	return highest
+}
+
+// PageSize is the pull page size for a request asking for limit (0 for
+// none): the device's max_page_size caps it and stands in for a missing one
+func (c *Capabilities) PageSize(limit int) int {
+	if c.MaxPageSize == 0 {
+		return limit
+	}
+	if limit == 0 {
+		return c.MaxPageSize
+	}
+	return min(limit, c.MaxPageSize)
+}
+
+func capabilityFields(data []byte) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if len(bytes.TrimSpace(data)) == 0 {
+		return fields, nil
+	}
+	if len(data) > MaxCapabilitiesSize {
+		return nil, fmt.Errorf("%w: larger than %d bytes", ErrInvalidCapabilities, MaxCapabilitiesSize)
+	}
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return nil, fmt.Errorf("%w: must be a JSON object", ErrInvalidCapabilities)
+	}
+	return fields, nil
+}
+
+func decodeCapability(key string, value json.RawMessage, dest interface{}) error {
+	if bytes.Equal(value, []byte("null")) {
+		return capabilityError(key, "must not be null")
+	}
+	if err := json.Unmarshal(value, dest); err != nil {
+		return capabilityError(key, "has the wrong type")
+	}
+	return nil
+}
+
+func checkEncVersions(versions []int) error {
+	if len(versions) == 0 || len(versions) > MaxCapabilityEncVersions {
+		return capabilityError("enc_versions", fmt.Sprintf("must list 1 to %d versions", MaxCapabilityEncVersions))
+	}
+	for _, version := range versions {
+		if version < 1 || version > MaxCapabilityEncVersion {
+			return capabilityError("enc_versions", fmt.Sprintf("versions must be between 1 and %d", MaxCapabilityEncVersion))
+		}
+	}
+	return nil
+}
+
+func validPushPlatform(platform string) bool {
+	switch platform {
+	case PushPlatformAPNs, PushPlatformFCM, PushPlatformWebPush:
+		return true
+	}
+	return false
+}
+
+func capabilityError(key, problem string) error {
+	return fmt.Errorf("%w: %s %s", ErrInvalidCapabilities, key, problem)
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/clock"
 )
 
 type TrustLevel int
@@ -19,12 +20,17 @@ const (
 	TrustLevelRevoked
 )
 
+// TrustListener is told about every trust level change, e.g. to keep the
+// peer's device record in step
+type TrustListener func(peerID string, from, to TrustLevel)
+
 type PeerManager struct {
 	mu         sync.RWMutex
 	peers      map[string]*models.TrustedPeer
 	privateKey ed25519.PrivateKey
 	publicKey  ed25519.PublicKey
 	deviceID   string
+	listener   TrustListener
 }
 
 func NewPeerManager(deviceID string) (*PeerManager, error) {
@@ -43,7 +49,7 @@ func NewPeerManager(deviceID string) (*PeerManager, error) {
 	pm.peers[deviceID] = &models.TrustedPeer{
 		PeerID:          deviceID,
 		PublicKey:       pubKey,
-		LastSeen:        time.Now(),
+		LastSeen:        clock.System.Now(),
 		IsCurrentDevice: true,
 		TrustLevel:      int(TrustLevelTrusted),
 	}
@@ -51,6 +57,25 @@ func NewPeerManager(deviceID string) (*PeerManager, error) {
 	return pm, nil
 }
 
+// SetTrustListener sets the listener trust changes are reported to. It is
+// called after the change, without the manager's lock held.
+func (pm *PeerManager) SetTrustListener(listener TrustListener) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.listener = listener
+}
+
+// notify reports a change to the listener, if there is one and something
+// changed
+func (pm *PeerManager) notify(peerID string, from, to TrustLevel) {
+	pm.mu.RLock()
+	listener := pm.listener
+	pm.mu.RUnlock()
+	if listener != nil && from != to {
+		listener(peerID, from, to)
+	}
+}
+
 func (pm *PeerManager) GetDeviceID() string {
 	return pm.deviceID
 }
@@ -76,45 +101,100 @@ func (pm *PeerManager) VerifyChallenge(challenge, signature []byte, publicKey ed
 	return ed25519.Verify(publicKey, challenge, signature)
 }
 
+// EstablishTrust trusts a new or pending peer. A revoked peer stays
+// revoked.
 func (pm *PeerManager) EstablishTrust(peerID string, publicKey ed25519.PublicKey) error {
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
+	from, err := pm.setPeer(peerID, publicKey, TrustLevelTrusted)
+	if err != nil {
+		return err
+	}
+	pm.notify(peerID, from, TrustLevelTrusted)
+	return nil
+}
 
-	challenge, err := pm.GenerateChallenge()
+// AddPendingPeer records a peer that waits for approval through
+// EstablishTrust
+func (pm *PeerManager) AddPendingPeer(peerID string, publicKey ed25519.PublicKey) error {
+	from, err := pm.setPeer(peerID, publicKey, TrustLevelPending)
 	if err != nil {
 		return err
 	}
+	pm.notify(peerID, from, TrustLevelPending)
+	return nil
+}
 
-	_ = challenge
+// LoadPeer mirrors a peer whose trust level is already recorded elsewhere,
+// e.g. its device record, without telling the listener
+func (pm *PeerManager) LoadPeer(peerID string, publicKey ed25519.PublicKey, level TrustLevel) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.peers[peerID] = &models.TrustedPeer{
+		PeerID:     peerID,
+		PublicKey:  publicKey,
+		LastSeen:   clock.System.Now(),
+		TrustLevel: int(level),
+	}
+}
+
+// setPeer moves a peer to level, returning its previous level
+func (pm *PeerManager) setPeer(peerID string, publicKey ed25519.PublicKey, level TrustLevel) (TrustLevel, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	from := TrustLevelNone
+	if existing, ok := pm.peers[peerID]; ok {
+		from = TrustLevel(existing.TrustLevel)
+	}
+	if from != level && !ValidTransition(from, level) {
+		if from == TrustLevelRevoked {
+			return from, ErrPeerRevoked
+		}
+		return from, ErrInvalidTrustChange
+	}
 
 	pm.peers[peerID] = &models.TrustedPeer{
 		PeerID:          peerID,
 		PublicKey:       publicKey,
-		LastSeen:        time.Now(),
+		LastSeen:        clock.System.Now(),
 		IsCurrentDevice: false,
-		TrustLevel:      int(TrustLevelTrusted),
+		TrustLevel:      int(level),
 	}
-
-	return nil
+	return from, nil
 }
 
 func (pm *PeerManager) RevokeTrust(peerID string) error {
 	pm.mu.Lock()
-	defer pm.mu.Unlock()
-
 	peer, exists := pm.peers[peerID]
 	if !exists {
+		pm.mu.Unlock()
 		return errors.New("peer not found")
 	}
 
 	if peer.IsCurrentDevice {
-		return errors.New("cannot revoke current device")
+		pm.mu.Unlock()
+		return ErrRevokeCurrentDevice
 	}
 
+	from := TrustLevel(peer.TrustLevel)
 	peer.TrustLevel = int(TrustLevelRevoked)
+	pm.mu.Unlock()
+
+	pm.notify(peerID, from, TrustLevelRevoked)
 	return nil
 }
 
+// TrustLevelOf returns a peer's trust level; TrustLevelNone if unknown
+func (pm *PeerManager) TrustLevelOf(peerID string) TrustLevel {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	if peer, ok := pm.peers[peerID]; ok {
+		return TrustLevel(peer.TrustLevel)
+	}
+	return TrustLevelNone
+}
+
 func (pm *PeerManager) GetTrustedPeers() []*models.TrustedPeer {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
@@ -150,7 +230,7 @@ func (pm *PeerManager) UpdatePeerActivity(peerID string) error {
 		return errors.New("peer not found")
 	}
 
-	peer.LastSeen = time.Now()
+	peer.LastSeen = clock.System.Now()
 	return nil
 }
 
@@ -0,0 +1,94 @@
+package peer
+
+import "errors"
+
+// How an account treats devices it has not approved yet
+const (
+	DeviceApprovalOff      = "off"       // New devices are trusted right away
+	DeviceApprovalReadOnly = "read_only" // New devices are pending and may only read until approved
+	DeviceApprovalRequired = "required"  // New devices are pending and get no access until approved
+)
+
+var (
+	ErrPeerRevoked         = errors.New("device trust has been revoked")
+	ErrPeerPending         = errors.New("device is waiting for approval from a trusted device")
+	ErrUnknownTrustLevel   = errors.New("trust level must be one of: pending, trusted, revoked")
+	ErrUnknownApproval     = errors.New("device approval must be one of: off, read_only, required")
+	ErrInvalidTrustChange  = errors.New("trust level cannot change that way")
+	ErrRevokeCurrentDevice = errors.New("cannot revoke current device")
+)
+
+var trustLevelNames = map[TrustLevel]string{
+	TrustLevelNone:    "none",
+	TrustLevelPending: "pending",
+	TrustLevelTrusted: "trusted",
+	TrustLevelRevoked: "revoked",
+}
+
+// String is the level's name in API responses, events and audit details
+func (l TrustLevel) String() string {
+	if name, ok := trustLevelNames[l]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseTrustLevel is the inverse of String for the levels a device can be
+// moved to
+func ParseTrustLevel(name string) (TrustLevel, error) {
+	for level, levelName := range trustLevelNames {
+		if level != TrustLevelNone && levelName == name {
+			return level, nil
+		}
+	}
+	return TrustLevelNone, ErrUnknownTrustLevel
+}
+
+func ValidDeviceApproval(approval string) bool {
+	switch approval {
+	case DeviceApprovalOff, DeviceApprovalReadOnly, DeviceApprovalRequired:
+		return true
+	}
+	return false
+}
+
+// InitialTrustLevel is the trust level of a device registered under the
+// account's approval setting
+func InitialTrustLevel(approval string) TrustLevel {
+	if approval == DeviceApprovalReadOnly || approval == DeviceApprovalRequired {
+		return TrustLevelPending
+	}
+	return TrustLevelTrusted
+}
+
+// CheckAccess decides whether a device at level may sync; write says the
+// operation changes the vault. Revoked devices get nothing. Pending devices
+// may read unless the account requires approval first, including devices
+// left pending after approval was turned off. TrustLevelNone is a caller
+// without a device record, e.g. an older client; it is not restricted.
+func CheckAccess(level TrustLevel, approval string, write bool) error {
+	switch level {
+	case TrustLevelRevoked:
+		return ErrPeerRevoked
+	case TrustLevelPending:
+		if write || approval == DeviceApprovalRequired {
+			return ErrPeerPending
+		}
+	}
+	return nil
+}
+
+// ValidTransition reports whether a device may move from one trust level to
+// another: pending devices are approved or rejected, trusted ones revoked.
+// Revocation is final; a revoked device registers again.
+func ValidTransition(from, to TrustLevel) bool {
+	switch from {
+	case TrustLevelNone:
+		return to == TrustLevelPending || to == TrustLevelTrusted
+	case TrustLevelPending:
+		return to == TrustLevelTrusted || to == TrustLevelRevoked
+	case TrustLevelTrusted:
+		return to == TrustLevelRevoked
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package sync
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrInvalidCheckpoint = errors.New("invalid pull checkpoint")
+	ErrCheckpointStale   = errors.New("zone changed since the pull began; restart from last_gencount")
+	ErrSnapshotStale     = errors.New("zone changed since the snapshot began; start the snapshot over")
+)
+
+// Pull layers, in the order a paginated pull walks them. Keys come first so
+// a client never receives items before the keys that decrypt them.
+const (
+	PullLayerKeys = 1 << iota
+	PullLayerMetadata
+	PullLayerRecords
+)
+
+// PullWindow is the zone state a paginated pull is pinned to
+type PullWindow struct {
+	GenCount int64  // Zone gencount when the pull began; the watermark
+	Digest   []byte // Manifest digest when the pull began
+	Items    int    // Items between the pull's base gencount and the watermark
+}
+
+// PullCheckpoint is a position inside a paginated pull. It carries the whole
+// query, so a resumed pull needs nothing but the token.
+type PullCheckpoint struct {
+	Zone              string `json:"z"`
+	Since             int64  `json:"s"` // last_gencount the pull started from
+	Layers            int    `json:"l"` // PullLayer* bits
+	IncludeTombstoned bool   `json:"t,omitempty"`
+	Watermark         int64  `json:"w"`
+	Digest            []byte `json:"d"`
+	Items             int    `json:"n"`
+	Offset            int    `json:"o"` // Items already delivered
+}
+
+// Window returns the zone state the checkpoint was issued against
+func (cp *PullCheckpoint) Window() PullWindow {
+	return PullWindow{GenCount: cp.Watermark, Digest: cp.Digest, Items: cp.Items}
+}
+
+// Check returns ErrCheckpointStale unless the zone still matches the state
+// the pull began with. Any push advances the gencount and any change to the
+// live set changes the digest; purged tombstones do neither, so the item
+// count catches them.
+func (cp *PullCheckpoint) Check(current PullWindow) error {
+	if current.GenCount != cp.Watermark ||
+		!bytes.Equal(current.Digest, cp.Digest) ||
+		current.Items != cp.Items {
+		return ErrCheckpointStale
+	}
+	return nil
+}
+
+// PageSpan is the part of one layer a page covers
+type PageSpan struct {
+	Layer  int
+	Offset int
+	Limit  int
+}
+
+// PlanPage maps a page of the pull (offset and limit across all layers) onto
+// the layers it touches. counts holds each included layer's window size, in
+// pull order.
+func PlanPage(layers []int, counts []int, offset, limit int) []PageSpan {
+	var spans []PageSpan
+	for i, layer := range layers {
+		if limit <= 0 {
+			break
+		}
+		if offset >= counts[i] {
+			offset -= counts[i]
+			continue
+		}
+		n := min(counts[i]-offset, limit)
+		spans = append(spans, PageSpan{Layer: layer, Offset: offset, Limit: n})
+		offset = 0
+		limit -= n
+	}
+	return spans
+}
+
+// SnapshotZone is one zone's entry in a snapshot's gencount vector
+type SnapshotZone struct {
+	Zone     string `json:"z"`
+	GenCount int64  `json:"g"`
+	Digest   []byte `json:"d"`
+}
+
+// SnapshotCheckpoint is a position inside a paginated account snapshot. It
+// carries the vector the snapshot began with, so every page is checked
+// against it and the client's baseline stays the one of the first page.
+type SnapshotCheckpoint struct {
+	Zones  []SnapshotZone `json:"v"` // Every zone when the snapshot began, by name
+	Layers int            `json:"l"` // PullLayer* bits
+	Zone   int            `json:"i"` // Index into Zones of the zone being delivered
+	Layer  int            `json:"y"` // PullLayer* bit being delivered
+	Offset int            `json:"o"` // That layer's items already delivered
+}
+
+// Check returns ErrSnapshotStale unless every zone still to be delivered is
+// as the snapshot began. Zones already delivered may move on: the client
+// pulls their changes from the vector's gencounts.
+func (cp *SnapshotCheckpoint) Check(current []SnapshotZone) error {
+	byName := make(map[string]SnapshotZone, len(current))
+	for _, zone := range current {
+		byName[zone.Zone] = zone
+	}
+	for _, want := range cp.Zones[cp.Zone:] {
+		got, ok := byName[want.Zone]
+		if !ok || got.GenCount != want.GenCount || !bytes.Equal(got.Digest, want.Digest) {
+			return ErrSnapshotStale
+		}
+	}
+	return nil
+}
+
+// CheckpointCodec signs pull and snapshot checkpoints so clients can't
+// forge positions or replay another user's token
+type CheckpointCodec struct {
+	key []byte
+}
+
+func NewCheckpointCodec(key []byte) *CheckpointCodec {
+	return &CheckpointCodec{key: key}
+}
+
+// Encode returns the opaque token for a checkpoint: the payload and its
+// HMAC, both base64url, joined by a dot
+func (cc *CheckpointCodec) Encode(userID string, cp *PullCheckpoint) (string, error) {
+	return cc.seal(userID, cp)
+}
+
+// Decode verifies a token issued to userID and returns its checkpoint
+func (cc *CheckpointCodec) Decode(userID, token string) (*PullCheckpoint, error) {
+	var cp PullCheckpoint
+	if err := cc.open(userID, token, &cp); err != nil {
+		return nil, err
+	}
+	if cp.Offset < 0 || cp.Offset > cp.Items {
+		return nil, ErrInvalidCheckpoint
+	}
+	return &cp, nil
+}
+
+// EncodeSnapshot is Encode for a snapshot checkpoint. Give snapshots a codec
+// of their own, so a pull token is never taken for one.
+func (cc *CheckpointCodec) EncodeSnapshot(userID string, cp *SnapshotCheckpoint) (string, error) {
+	return cc.seal(userID, cp)
+}
+
+// DecodeSnapshot is Decode for a snapshot checkpoint
+func (cc *CheckpointCodec) DecodeSnapshot(userID, token string) (*SnapshotCheckpoint, error) {
+	var cp SnapshotCheckpoint
+	if err := cc.open(userID, token, &cp); err != nil {
+		return nil, err
+	}
+	if cp.Zone < 0 || cp.Zone >= len(cp.Zones) || cp.Offset < 0 {
+		return nil, ErrInvalidCheckpoint
+	}
+	return &cp, nil
+}
+
+func (cc *CheckpointCodec) seal(userID string, cp interface{}) (string, error) {
+	payload, err := json.Marshal(cp)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(cc.sign(userID, payload)), nil
+}
+
+func (cc *CheckpointCodec) open(userID, token string, cp interface{}) error {
+	encPayload, encMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return ErrInvalidCheckpoint
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(encPayload)
+	if err != nil {
+		return ErrInvalidCheckpoint
+	}
+	mac, err := enc.DecodeString(encMAC)
+	if err != nil || !hmac.Equal(mac, cc.sign(userID, payload)) {
+		return ErrInvalidCheckpoint
+	}
+	if err := json.Unmarshal(payload, cp); err != nil {
+		return ErrInvalidCheckpoint
+	}
+	return nil
+}
+
+func (cc *CheckpointCodec) sign(userID string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, cc.key)
+	mac.Write([]byte(userID))
+	mac.Write([]byte{0})
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
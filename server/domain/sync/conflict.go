@@ -0,0 +1,155 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+)
+
+// Names of the conflict resolution strategies in configuration and requests
+const (
+	StrategyLastWriteWins       = "last_write_wins"
+	StrategyHighestGenCountWins = "highest_gencount_wins"
+	StrategyManualResolve       = "manual"
+)
+
+// Outcomes of a push conflict
+const (
+	ResolutionClientWins = "client_wins" // The pushed record replaced the stored one
+	ResolutionServerWins = "server_wins" // The stored record was kept
+)
+
+// TombstonePolicy settles a conflict between a delete and an edit of the
+// same item, whatever the strategy orders: gencounts say which write came
+// last, not whether the other device meant to keep the item.
+type TombstonePolicy int
+
+const (
+	// EditWins keeps the edit and undeletes the item. The default: seeing a
+	// deleted password again is cheaper than losing a changed one.
+	EditWins TombstonePolicy = iota
+	// DeleteWins keeps the tombstone and discards the edit
+	DeleteWins
+)
+
+// Names of the tombstone policies in configuration
+const (
+	TombstoneEditWins   = "edit_wins"
+	TombstoneDeleteWins = "delete_wins"
+)
+
+var tombstonePolicyNames = map[TombstonePolicy]string{
+	EditWins:   TombstoneEditWins,
+	DeleteWins: TombstoneDeleteWins,
+}
+
+func (p TombstonePolicy) String() string {
+	if name, ok := tombstonePolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("tombstone_policy(%d)", int(p))
+}
+
+// ParseTombstonePolicy reads a tombstone policy's name
+func ParseTombstonePolicy(name string) (TombstonePolicy, error) {
+	for policy, policyName := range tombstonePolicyNames {
+		if name == policyName {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown tombstone policy %q", name)
+}
+
+// How ResolveConflict settled a conflict
+const (
+	OutcomeOrdered     = "ordered"      // Two edits, ordered by the strategy
+	OutcomeBothDeleted = "both_deleted" // Two deletes; the item stays deleted
+	OutcomeDeleteWins  = "delete_wins"  // A delete beat an edit, which is discarded
+	OutcomeEditWins    = "edit_wins"    // An edit beat a delete, undeleting the item
+)
+
+// ConflictResolution describes how ResolveConflict settled a conflict
+type ConflictResolution struct {
+	Winner  *models.SyncRecord // The version kept
+	Loser   *models.SyncRecord // The version dropped
+	Outcome string             // One of the Outcome constants
+}
+
+func newConflictResolution(winner, local, remote *models.SyncRecord, outcome string) *ConflictResolution {
+	loser := remote
+	if winner == remote {
+		loser = local
+	}
+	return &ConflictResolution{Winner: winner, Loser: loser, Outcome: outcome}
+}
+
+var strategyNames = map[ConflictResolutionStrategy]string{
+	LastWriteWins:       StrategyLastWriteWins,
+	HighestGenCountWins: StrategyHighestGenCountWins,
+	ManualResolve:       StrategyManualResolve,
+}
+
+func (s ConflictResolutionStrategy) String() string {
+	if name, ok := strategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("strategy(%d)", int(s))
+}
+
+// ParseConflictStrategy reads a strategy's name
+func ParseConflictStrategy(name string) (ConflictResolutionStrategy, error) {
+	for strategy, strategyName := range strategyNames {
+		if name == strategyName {
+			return strategy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown conflict strategy %q", name)
+}
+
+// ErrManualResolve is ResolvePush's error under ManualResolve
+var ErrManualResolve = errors.New("manual conflict resolution required")
+
+// PushConflict is a pushed record made from an older version of the item
+// than the stored one: another device wrote it in between
+type PushConflict struct {
+	ItemUUID       string
+	BaseGenCount   int64 // The version the device edited
+	StoredGenCount int64
+	Resolution     string // ResolutionClientWins or ResolutionServerWins
+	Outcome        string // How it was settled; see ConflictResolution
+}
+
+// ResolvePush settles a push conflict between the stored record and one
+// pushed from an older version. LastWriteWins orders the writes, and the
+// push is the later one; HighestGenCountWins orders the versions they were
+// made from, so the stored record stays. A delete against an edit is
+// settled by the engine's TombstonePolicy under either. ManualResolve
+// leaves it to the device: ErrManualResolve.
+func (se *SyncEngine) ResolvePush(strategy ConflictResolutionStrategy, stored, pushed *models.SyncRecord, base int64) (*PushConflict, error) {
+	conflict := &PushConflict{
+		ItemUUID:       pushed.ItemUUID.String(),
+		BaseGenCount:   base,
+		StoredGenCount: stored.GenCount,
+	}
+
+	remote := *pushed
+	switch strategy {
+	case LastWriteWins:
+		remote.GenCount = stored.GenCount + 1
+	case ManualResolve:
+		return conflict, ErrManualResolve
+	default:
+		remote.GenCount = base
+	}
+	resolution, err := se.ResolveConflictWith(strategy, stored, &remote)
+	if err != nil {
+		return conflict, err
+	}
+	conflict.Outcome = resolution.Outcome
+	conflict.Resolution = ResolutionServerWins
+	if resolution.Winner == &remote {
+		conflict.Resolution = ResolutionClientWins
+	}
+	return conflict, nil
+}
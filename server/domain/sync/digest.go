@@ -0,0 +1,132 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Manifest digest versions. Version 1 hashed the UUIDs of a zone's live sync
+// records only, so a changed key or credential left it as it was; version 2
+// covers every live item of the three layers with its gencount. Devices
+// advertise the version they compute in their capabilities.
+const (
+	LegacyDigestVersion = 1
+	DigestVersion       = 2
+)
+
+// Layers of a manifest leaf
+const (
+	LeafCryptoKey          = "crypto_key"
+	LeafCredentialMetadata = "credential_metadata"
+	LeafSyncRecord         = "sync_record"
+)
+
+// ManifestLeafLayers is the order ManifestHasher takes a zone's layers in:
+// their names sorted
+var ManifestLeafLayers = []string{LeafCredentialMetadata, LeafCryptoKey, LeafSyncRecord}
+
+// ManifestLeaf is one live item of a zone as its digest sees it
+type ManifestLeaf struct {
+	Layer    string
+	ItemUUID string
+	GenCount int64
+}
+
+// String is the leaf's "layer:uuid:gencount" tuple
+func (l ManifestLeaf) String() string {
+	return l.Layer + ":" + l.ItemUUID + ":" + strconv.FormatInt(l.GenCount, 10)
+}
+
+// ParseManifestLeaf reads a "layer:uuid:gencount" tuple, as a device lists
+// the leaves of its copy of a zone
+func ParseManifestLeaf(tuple string) (ManifestLeaf, error) {
+	parts := strings.Split(tuple, ":")
+	if len(parts) != 3 {
+		return ManifestLeaf{}, fmt.Errorf("leaf %q is not layer:uuid:gencount", tuple)
+	}
+	layer := parts[0]
+	if layer != LeafCryptoKey && layer != LeafCredentialMetadata && layer != LeafSyncRecord {
+		return ManifestLeaf{}, fmt.Errorf("leaf %q has unknown layer %q", tuple, layer)
+	}
+	itemUUID, err := uuid.Parse(parts[1])
+	if err != nil {
+		return ManifestLeaf{}, fmt.Errorf("leaf %q has invalid item UUID", tuple)
+	}
+	genCount, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || genCount < 0 {
+		return ManifestLeaf{}, fmt.Errorf("leaf %q has invalid gencount", tuple)
+	}
+	return ManifestLeaf{Layer: layer, ItemUUID: itemUUID.String(), GenCount: genCount}, nil
+}
+
+// ManifestDigest is the DigestVersion digest of a zone's live items: a
+// SHA-256 hash of their tuples, sorted
+func ManifestDigest(leaves []ManifestLeaf) []byte {
+	tuples := make([]string, len(leaves))
+	for i, leaf := range leaves {
+		tuples[i] = leaf.String()
+	}
+	if !sort.StringsAreSorted(tuples) {
+		sort.Strings(tuples)
+	}
+
+	hasher := sha256.New()
+	for _, tuple := range tuples {
+		hasher.Write([]byte(tuple))
+		hasher.Write([]byte("|")) // Separator to prevent collision
+	}
+	return hasher.Sum(nil)
+}
+
+// ManifestHasher computes ManifestDigest one leaf at a time, so a store can
+// hash a zone's items as it reads them. Leaves must come layer by layer in
+// ManifestLeafLayers order, each layer sorted by item UUID; a layer holds an
+// item UUID once, so that is the order of their tuples.
+type ManifestHasher struct {
+	hash  hash.Hash
+	count int
+}
+
+func NewManifestHasher() *ManifestHasher {
+	return &ManifestHasher{hash: sha256.New()}
+}
+
+func (h *ManifestHasher) Add(leaf ManifestLeaf) {
+	h.hash.Write([]byte(leaf.String()))
+	h.hash.Write([]byte("|"))
+	h.count++
+}
+
+// Count is the number of leaves added
+func (h *ManifestHasher) Count() int {
+	return h.count
+}
+
+func (h *ManifestHasher) Sum() []byte {
+	return h.hash.Sum(nil)
+}
+
+// LegacyManifestDigest is the LegacyDigestVersion digest of a zone, from the
+// UUIDs of its live sync records, for devices that compute no other. IDs
+// already sorted, as stores read them, are hashed without a copy.
+func LegacyManifestDigest(leafIDs []string) []byte {
+	sortedIDs := leafIDs
+	if !sort.StringsAreSorted(leafIDs) {
+		sortedIDs = make([]string, len(leafIDs))
+		copy(sortedIDs, leafIDs)
+		sort.Strings(sortedIDs)
+	}
+
+	hasher := sha256.New()
+	for _, id := range sortedIDs {
+		hasher.Write([]byte(id))
+		hasher.Write([]byte("|"))
+	}
+	return hasher.Sum(nil)
+}
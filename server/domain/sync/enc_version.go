@@ -0,0 +1,64 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+)
+
+// What PushSync does with records newer than every active device can read
+const (
+	EncVersionPolicyWarn   = "warn"   // Accept the push and return a warning
+	EncVersionPolicyReject = "reject" // Refuse the push
+)
+
+// BaseEncVersion is what every client can decrypt. Devices that never
+// reported their max enc_version are assumed to support only this.
+const BaseEncVersion = 1
+
+var (
+	ErrEncVersionUnsupported   = errors.New("enc_version is newer than some active devices support")
+	ErrUnknownEncVersionPolicy = errors.New("enc_version policy must be warn or reject")
+)
+
+// ValidEncVersionPolicy reports whether policy is a known policy name
+func ValidEncVersionPolicy(policy string) bool {
+	return policy == EncVersionPolicyWarn || policy == EncVersionPolicyReject
+}
+
+// MinSupportedEncVersion is the highest enc_version every active device can
+// read, given each device's reported maximum (0 when never reported). ok is
+// false when the user has no active devices and nothing constrains pushes.
+func MinSupportedEncVersion(deviceMax []int) (lowest int, ok bool) {
+	for _, version := range deviceMax {
+		version = max(version, BaseEncVersion)
+		if !ok || version < lowest {
+			lowest, ok = version, true
+		}
+	}
+	return lowest, ok
+}
+
+// EncVersionConflict describes a push some active device could not decrypt
+type EncVersionConflict struct {
+	Pushed       int // Highest enc_version in the push
+	MinSupported int
+}
+
+func (e *EncVersionConflict) Error() string {
+	return fmt.Sprintf("pushed enc_version %d but an active device supports only up to %d",
+		e.Pushed, e.MinSupported)
+}
+
+func (e *EncVersionConflict) Unwrap() error { return ErrEncVersionUnsupported }
+
+// CheckEncVersion compares the highest enc_version in a push with what the
+// user's active devices support. It returns nil when every device can read
+// the push. Otherwise it returns the conflict, and reject reports whether
+// the policy refuses the push or only warns.
+func CheckEncVersion(pushed int, deviceMax []int, policy string) (conflict *EncVersionConflict, reject bool) {
+	lowest, ok := MinSupportedEncVersion(deviceMax)
+	if !ok || pushed <= lowest {
+		return nil, false
+	}
+	return &EncVersionConflict{Pushed: pushed, MinSupported: lowest}, policy == EncVersionPolicyReject
+}
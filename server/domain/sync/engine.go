@@ -1,13 +1,15 @@
 package sync
 
 import (
-	"crypto/sha256"
 	"encoding/json"
-	"errors"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/google/uuid"
 )
 
 type ConflictResolutionStrategy int
@@ -22,9 +24,12 @@ type SyncEngine struct {
 	mu              sync.RWMutex
 	currentGenCount int64
 	manifestDigest  []byte
-	leafIDs         []string
 	zone            string
 	strategy        ConflictResolutionStrategy
+	tombstones      TombstonePolicy
+	lastWriter      string // Device ID of the last write; empty when unknown
+	dirty           bool   // State changed since it was last loaded or persisted
+	clock           clock.Clock
 }
 
 func NewSyncEngine(zone string) *SyncEngine {
@@ -32,87 +37,220 @@ func NewSyncEngine(zone string) *SyncEngine {
 		currentGenCount: 0,
 		zone:            zone,
 		strategy:        LastWriteWins,
-		leafIDs:         make([]string, 0),
+		clock:           clock.System,
 	}
 }
 
+// SetClock replaces the clock used for operation and manifest timestamps
+func (se *SyncEngine) SetClock(c clock.Clock) {
+	se.clock = c
+}
+
+// SetStrategy sets how ResolveConflict and pushes to the zone settle
+// conflicts
+func (se *SyncEngine) SetStrategy(strategy ConflictResolutionStrategy) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	se.strategy = strategy
+}
+
+// SetTombstonePolicy sets how a delete and an edit of the same item are
+// settled
+func (se *SyncEngine) SetTombstonePolicy(policy TombstonePolicy) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	se.tombstones = policy
+}
+
+// TombstonePolicy returns the engine's tombstone policy
+func (se *SyncEngine) TombstonePolicy() TombstonePolicy {
+	se.mu.RLock()
+	defer se.mu.RUnlock()
+	return se.tombstones
+}
+
+// Strategy returns the engine's conflict resolution strategy
+func (se *SyncEngine) Strategy() ConflictResolutionStrategy {
+	se.mu.RLock()
+	defer se.mu.RUnlock()
+	return se.strategy
+}
+
 func (se *SyncEngine) IncrementGenCount() int64 {
 	se.mu.Lock()
 	defer se.mu.Unlock()
 
 	se.currentGenCount++
+	se.dirty = true
+	return se.currentGenCount
+}
+
+// ReserveGenCounts advances the gencount by n in one step and returns the new
+// value. The caller owns gencounts (returned-n, returned], so concurrent
+// pushes to the same engine never hand out the same gencount twice.
+func (se *SyncEngine) ReserveGenCounts(n int64) int64 {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	se.currentGenCount += n
+	if n > 0 {
+		se.dirty = true
+	}
 	return se.currentGenCount
 }
 
+// CatchUp raises the gencount to genCount, the highest a store handed out
+// for a write. It never moves it backwards.
+func (se *SyncEngine) CatchUp(genCount int64) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	if genCount > se.currentGenCount {
+		se.currentGenCount = genCount
+		se.dirty = true
+	}
+}
+
 func (se *SyncEngine) GetCurrentGenCount() int64 {
 	se.mu.RLock()
 	defer se.mu.RUnlock()
 	return se.currentGenCount
 }
 
-// UpdateManifestDigest calculates a Merkle-tree style digest from leaf IDs
+// UpdateManifestDigest calculates the zone's digest from its live items
 // This implements Apple's pattern for quick divergence detection
-// The digest is a SHA-256 hash of all leaf IDs sorted alphabetically
-func (se *SyncEngine) UpdateManifestDigest(leafIDs []string) []byte {
+func (se *SyncEngine) UpdateManifestDigest(leaves []ManifestLeaf) []byte {
+	return se.SetManifestDigest(ManifestDigest(leaves))
+}
+
+// SetManifestDigest records a digest the store computed (see
+// ManifestHasher) and returns it
+func (se *SyncEngine) SetManifestDigest(digest []byte) []byte {
 	se.mu.Lock()
 	defer se.mu.Unlock()
 
-	se.leafIDs = leafIDs
+	se.manifestDigest = digest
+	se.dirty = true
+	return se.manifestDigest
+}
 
-	// Sort leaf IDs for consistent digest calculation
-	sortedIDs := make([]string, len(leafIDs))
-	copy(sortedIDs, leafIDs)
-	sortStrings(sortedIDs)
+// RecordWriter notes the device that made the latest change. An empty
+// device ID (a client without a device claim) clears it rather than
+// crediting the change to the previous writer.
+func (se *SyncEngine) RecordWriter(deviceID string) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
 
-	hasher := sha256.New()
-	for _, id := range sortedIDs {
-		hasher.Write([]byte(id))
-		hasher.Write([]byte("|")) // Separator to prevent collision
-	}
+	se.lastWriter = deviceID
+	se.dirty = true
+}
 
-	se.manifestDigest = hasher.Sum(nil)
-	return se.manifestDigest
+// EngineState is the persisted part of a SyncEngine (the sync_state row)
+type EngineState struct {
+	GenCount   int64
+	Digest     []byte
+	LastWriter string
 }
 
-// Helper function to sort strings
-func sortStrings(strs []string) {
-	n := len(strs)
-	for i := 0; i < n; i++ {
-		for j := i + 1; j < n; j++ {
-			if strs[i] > strs[j] {
-				strs[i], strs[j] = strs[j], strs[i]
-			}
-		}
+// Restore replaces the engine's gencount and digest with persisted state
+func (se *SyncEngine) Restore(state *EngineState) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	se.currentGenCount = state.GenCount
+	se.manifestDigest = state.Digest
+	se.lastWriter = state.LastWriter
+	se.dirty = false
+}
+
+// Snapshot returns the engine's current state and whether it has changed
+// since it was last restored or persisted.
+func (se *SyncEngine) Snapshot() (state EngineState, dirty bool) {
+	se.mu.RLock()
+	defer se.mu.RUnlock()
+
+	digest := make([]byte, len(se.manifestDigest))
+	copy(digest, se.manifestDigest)
+	return EngineState{GenCount: se.currentGenCount, Digest: digest, LastWriter: se.lastWriter}, se.dirty
+}
+
+// markPersisted clears the dirty flag unless the engine moved on after the
+// snapshot that was written.
+func (se *SyncEngine) markPersisted(state EngineState) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+
+	if se.currentGenCount == state.GenCount && string(se.manifestDigest) == string(state.Digest) &&
+		se.lastWriter == state.LastWriter {
+		se.dirty = false
 	}
 }
 
 func (se *SyncEngine) DetectConflict(localRecord, remoteRecord *models.SyncRecord) bool {
 	if localRecord.GenCount == remoteRecord.GenCount {
-		return localRecord.ParentKeyUUID != remoteRecord.ParentKeyUUID
+		return !sameParent(localRecord.ParentKeyUUID, remoteRecord.ParentKeyUUID)
 	}
 
 	return true
 }
 
-func (se *SyncEngine) ResolveConflict(local, remote *models.SyncRecord) (*models.SyncRecord, error) {
-	switch se.strategy {
+// sameParent compares parent key UUIDs by value (nil means no parent)
+func sameParent(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// ResolveConflict settles a conflict between two versions of an item.
+// Edits are ordered by gencount only: timestamps come from different
+// instances' clocks and are never compared. A delete against an edit is
+// settled by the tombstone policy instead, whatever the gencounts.
+func (se *SyncEngine) ResolveConflict(local, remote *models.SyncRecord) (*ConflictResolution, error) {
+	return se.ResolveConflictWith(se.Strategy(), local, remote)
+}
+
+// ResolveConflictWith is ResolveConflict under strategy instead of the
+// engine's, e.g. one a request asked for
+func (se *SyncEngine) ResolveConflictWith(strategy ConflictResolutionStrategy, local, remote *models.SyncRecord) (*ConflictResolution, error) {
+	if strategy == ManualResolve {
+		return nil, ErrManualResolve
+	}
+
+	switch {
+	case local.Tombstone && remote.Tombstone:
+		return newConflictResolution(orderWrites(strategy, local, remote), local, remote, OutcomeBothDeleted), nil
+	case local.Tombstone != remote.Tombstone:
+		deleted, edited := local, remote
+		if remote.Tombstone {
+			deleted, edited = remote, local
+		}
+		if se.TombstonePolicy() == DeleteWins {
+			return newConflictResolution(deleted, local, remote, OutcomeDeleteWins), nil
+		}
+		return newConflictResolution(edited, local, remote, OutcomeEditWins), nil
+	default:
+		return newConflictResolution(orderWrites(strategy, local, remote), local, remote, OutcomeOrdered), nil
+	}
+}
+
+// orderWrites picks the version strategy keeps of two of the same kind
+func orderWrites(strategy ConflictResolutionStrategy, local, remote *models.SyncRecord) *models.SyncRecord {
+	switch strategy {
 	case LastWriteWins:
 		if local.GenCount > remote.GenCount {
-			return local, nil
+			return local
 		}
-		return remote, nil
+		return remote
 
 	case HighestGenCountWins:
 		if local.GenCount >= remote.GenCount {
-			return local, nil
+			return local
 		}
-		return remote, nil
-
-	case ManualResolve:
-		return nil, errors.New("manual conflict resolution required")
+		return remote
 
 	default:
-		return local, nil
+		return local
 	}
 }
 
@@ -123,7 +261,7 @@ func (se *SyncEngine) CreateSyncOperation(uuid string, previousGen int64) *SyncO
 		UUID:             uuid,
 		GenCount:         genCount,
 		PreviousGenCount: previousGen,
-		Timestamp:        time.Now(),
+		Timestamp:        se.clock.Now(),
 		Tombstone:        false,
 	}
 }
@@ -134,7 +272,7 @@ func (se *SyncEngine) MarkTombstone(uuid string) *SyncOperation {
 	return &SyncOperation{
 		UUID:      uuid,
 		GenCount:  genCount,
-		Timestamp: time.Now(),
+		Timestamp: se.clock.Now(),
 		Tombstone: true,
 	}
 }
@@ -143,7 +281,7 @@ type SyncOperation struct {
 	UUID             string
 	GenCount         int64
 	PreviousGenCount int64
-	Timestamp        time.Time
+	Timestamp        time.Time // UTC, informational only
 	Tombstone        bool
 }
 
@@ -198,6 +336,51 @@ func (se *SyncEngine) ComputeManifestDiff(localLeafIDs, remoteLeafIDs []string)
 	return diff
 }
 
+// DiffLeaves compares a device's leaves (local) with the server's (remote)
+// by item: Added items are only on the server, Removed only on the device,
+// and Modified on both at different gencounts. Each list holds item UUIDs,
+// sorted.
+func (se *SyncEngine) DiffLeaves(localLeaves, remoteLeaves []ManifestLeaf) *ManifestDiff {
+	itemKey := func(leaf ManifestLeaf) string {
+		return leaf.Layer + ":" + leaf.ItemUUID
+	}
+	keys := func(leaves []ManifestLeaf) ([]string, map[string]ManifestLeaf) {
+		ids := make([]string, len(leaves))
+		byKey := make(map[string]ManifestLeaf, len(leaves))
+		for i, leaf := range leaves {
+			ids[i] = itemKey(leaf)
+			byKey[ids[i]] = leaf
+		}
+		return ids, byKey
+	}
+	localIDs, local := keys(localLeaves)
+	remoteIDs, remote := keys(remoteLeaves)
+
+	byItem := se.ComputeManifestDiff(localIDs, remoteIDs)
+	uuids := func(ids []string, keep func(string) bool) []string {
+		seen := make(map[string]bool, len(ids))
+		items := make([]string, 0, len(ids))
+		for _, id := range ids {
+			itemUUID := id[strings.IndexByte(id, ':')+1:]
+			if keep(id) && !seen[itemUUID] {
+				seen[itemUUID] = true
+				items = append(items, itemUUID)
+			}
+		}
+		sort.Strings(items)
+		return items
+	}
+	all := func(string) bool { return true }
+
+	return &ManifestDiff{
+		Added:   uuids(byItem.Added, all),
+		Removed: uuids(byItem.Removed, all),
+		Modified: uuids(byItem.Modified, func(id string) bool {
+			return local[id].GenCount != remote[id].GenCount
+		}),
+	}
+}
+
 // HasDiverged compares two manifest digests to determine if sync is needed
 // This is an O(1) operation (just comparing 32-byte SHA-256 hashes)
 // Much faster than comparing all records individually
@@ -220,11 +403,15 @@ func (se *SyncEngine) HasDiverged(localDigest, remoteDigest []byte) bool {
 	return false
 }
 
-// BuildManifest creates a SyncManifest from a list of leaf IDs and gencount
+// BuildManifest creates a SyncManifest from a zone's live items and gencount
 // This is the complete manifest that includes the Merkle digest
-func (se *SyncEngine) BuildManifest(leafIDs []string, genCount int64) (*models.SyncManifest, error) {
-	digest := se.UpdateManifestDigest(leafIDs)
+func (se *SyncEngine) BuildManifest(leaves []ManifestLeaf, genCount int64) (*models.SyncManifest, error) {
+	digest := se.UpdateManifestDigest(leaves)
 
+	leafIDs := make([]string, len(leaves))
+	for i, leaf := range leaves {
+		leafIDs[i] = leaf.String()
+	}
 	leafIDsJSON, err := json.Marshal(leafIDs)
 	if err != nil {
 		return nil, err
@@ -235,20 +422,21 @@ func (se *SyncEngine) BuildManifest(leafIDs []string, genCount int64) (*models.S
 		GenCount:  genCount,
 		Digest:    digest,
 		LeafIDs:   leafIDsJSON,
-		UpdatedAt: time.Now(),
+		UpdatedAt: se.clock.Now(),
 	}, nil
 }
 
 // CalculateDigestFromRecords is a convenience function to calculate digest from sync records
-// Useful when you have records but not leaf IDs yet
+// Useful when you have records but not leaves yet; keys and credentials
+// are left out
 func (se *SyncEngine) CalculateDigestFromRecords(records []*models.SyncRecord) []byte {
-	leafIDs := make([]string, 0, len(records))
+	leaves := make([]ManifestLeaf, 0, len(records))
 	for _, record := range records {
 		if !record.IsDeleted() {
-			leafIDs = append(leafIDs, record.ItemUUID.String())
+			leaves = append(leaves, ManifestLeaf{Layer: LeafSyncRecord, ItemUUID: record.ItemUUID.String(), GenCount: record.GenCount})
 		}
 	}
-	return se.UpdateManifestDigest(leafIDs)
+	return se.UpdateManifestDigest(leaves)
 }
 
 // QuickSyncCheck performs a fast O(1) check to see if sync is needed
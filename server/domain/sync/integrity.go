@@ -0,0 +1,40 @@
+package sync
+
+import (
+	"errors"
+	"time"
+)
+
+// Severities of an integrity finding
+const (
+	IntegrityError   = "error"   // Some items cannot be decrypted or placed
+	IntegrityWarning = "warning" // Items sync, but not every device sees the same vault
+	IntegrityInfo    = "info"    // Harmless leftovers
+)
+
+// Kinds of integrity finding
+const (
+	FindingMissingKey        = "missing_key"        // A credential points at a key the zone never had
+	FindingTombstonedKey     = "tombstoned_key"     // A credential points at a deleted key
+	FindingMissingParent     = "missing_parent"     // A sync record's parent key is missing or deleted
+	FindingDigestMismatch    = "digest_mismatch"    // The stored manifest digest disagrees with the records
+	FindingOrphanedKey       = "orphaned_key"       // A live key nothing refers to
+	FindingUnsupportedRecord = "unsupported_record" // A record newer than some active device can read
+)
+
+// Repairs a client can offer for a finding
+const (
+	RepairPushKeys      = "push_keys"      // Push the referenced keys again
+	RepairTombstoneKeys = "tombstone_keys" // Delete the unreferenced keys
+	RepairReencrypt     = "reencrypt"      // Push the records again at an older enc_version, or update the devices
+)
+
+// Integrity checks read every item of a zone, so a user may only run them a
+// few times a day, and each query is cut off well within the request
+// deadline
+const (
+	DefaultIntegrityRunsPerDay = 2
+	DefaultIntegrityTimeout    = 5 * time.Second
+)
+
+var ErrIntegrityTimeout = errors.New("integrity checks took too long for this zone")
@@ -0,0 +1,43 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A device flushing offline changes over several pushes numbers them 1, 2,
+// 3, ... The server applies each only after the one before it, so a flush
+// can be retried in any order without later changes landing first.
+
+var ErrPushSequence = errors.New("push is out of sequence")
+
+// PushSequenceError is a numbered push the server did not apply
+type PushSequenceError struct {
+	Expected int64 // The sequence the device's next push must carry
+	Received int64
+}
+
+func (e *PushSequenceError) Error() string {
+	if e.Duplicate() {
+		return fmt.Sprintf("push sequence %d was already applied; next expected is %d", e.Received, e.Expected)
+	}
+	return fmt.Sprintf("push sequence %d is out of order; next expected is %d", e.Received, e.Expected)
+}
+
+func (e *PushSequenceError) Unwrap() error { return ErrPushSequence }
+
+// Duplicate reports whether the push was applied before, so the device can
+// drop it rather than resend it
+func (e *PushSequenceError) Duplicate() bool {
+	return e.Received < e.Expected
+}
+
+// CheckPushSequence checks a push numbered received against the last one
+// applied for the device (0 when none was). It returns nil when received
+// comes next.
+func CheckPushSequence(last, received int64) error {
+	if received == last+1 {
+		return nil
+	}
+	return &PushSequenceError{Expected: last + 1, Received: received}
+}
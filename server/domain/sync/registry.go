@@ -0,0 +1,282 @@
+package sync
+
+import (
+	"container/list"
+	"log"
+	"sync"
+
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"golang.org/x/sync/singleflight"
+)
+
+// Registry metric names. Hit rate is hits / (hits + misses).
+const (
+	MetricRegistrySize          = "sync_engine_registry_size"
+	MetricRegistryHit           = "sync_engine_registry_hit"
+	MetricRegistryMiss          = "sync_engine_registry_miss"
+	MetricRegistryEviction      = "sync_engine_registry_evictions"
+	MetricRegistryPersistError  = "sync_engine_registry_persist_errors"
+	MetricRegistryInvalidations = "sync_engine_registry_invalidations"
+)
+
+const DefaultRegistrySize = 10000
+
+// EngineStore loads and persists engine state. The Postgres store implements
+// it on top of the sync_state table.
+type EngineStore interface {
+	LoadEngineState(userID, zone string) (*EngineState, error)
+	SaveEngineState(userID, zone string, state *EngineState) error
+}
+
+// Registry keeps one SyncEngine per user and zone so requests stop rebuilding
+// state from the database. Concurrent misses for the same key share a single
+// load, and the least recently used engine is evicted once maxEntries is
+// reached; an evicted engine with unpersisted changes is saved first.
+type Registry struct {
+	store      EngineStore
+	maxEntries int
+	loads      singleflight.Group
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	// evicting holds engines that left the LRU but are still being saved, so
+	// a request arriving meanwhile picks the engine back up instead of
+	// loading state that is about to be overwritten.
+	evicting map[string]*SyncEngine
+
+	notify     func(userID, zone string) // Set by UseRedis
+	clock      clock.Clock
+	strategy   ConflictResolutionStrategy
+	tombstones TombstonePolicy
+}
+
+type registryEntry struct {
+	key    string
+	userID string
+	zone   string
+	engine *SyncEngine
+}
+
+func NewRegistry(store EngineStore, maxEntries int) *Registry {
+	if maxEntries <= 0 {
+		maxEntries = DefaultRegistrySize
+	}
+	return &Registry{
+		store:      store,
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+		evicting:   make(map[string]*SyncEngine),
+		clock:      clock.System,
+	}
+}
+
+// SetClock sets the clock given to engines loaded from now on
+func (r *Registry) SetClock(c clock.Clock) {
+	r.clock = c
+}
+
+// SetStrategy sets the conflict resolution strategy of the engines held and
+// of those loaded from now on. The default is LastWriteWins.
+func (r *Registry) SetStrategy(strategy ConflictResolutionStrategy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.strategy = strategy
+	for elem := r.order.Front(); elem != nil; elem = elem.Next() {
+		elem.Value.(*registryEntry).engine.SetStrategy(strategy)
+	}
+	for _, engine := range r.evicting {
+		engine.SetStrategy(strategy)
+	}
+}
+
+// SetTombstonePolicy sets how the engines held and those loaded from now on
+// settle a delete against an edit. The default is EditWins.
+func (r *Registry) SetTombstonePolicy(policy TombstonePolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tombstones = policy
+	for elem := r.order.Front(); elem != nil; elem = elem.Next() {
+		elem.Value.(*registryEntry).engine.SetTombstonePolicy(policy)
+	}
+	for _, engine := range r.evicting {
+		engine.SetTombstonePolicy(policy)
+	}
+}
+
+func (r *Registry) loadPolicies() (ConflictResolutionStrategy, TombstonePolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.strategy, r.tombstones
+}
+
+func registryKey(userID, zone string) string {
+	return userID + "/" + zone
+}
+
+// GetOrLoad returns the user's engine for zone, loading its state on a miss
+func (r *Registry) GetOrLoad(userID, zone string) (*SyncEngine, error) {
+	key := registryKey(userID, zone)
+	if engine, ok := r.lookup(key); ok {
+		metrics.Inc(MetricRegistryHit)
+		return engine, nil
+	}
+	metrics.Inc(MetricRegistryMiss)
+
+	value, err, _ := r.loads.Do(key, func() (interface{}, error) {
+		// Another caller may have finished loading while this one waited
+		if engine, ok := r.lookup(key); ok {
+			return engine, nil
+		}
+
+		state, err := r.store.LoadEngineState(userID, zone)
+		if err != nil {
+			return nil, err
+		}
+		engine := NewSyncEngine(zone)
+		engine.SetClock(r.clock)
+		strategy, tombstones := r.loadPolicies()
+		engine.SetStrategy(strategy)
+		engine.SetTombstonePolicy(tombstones)
+		engine.Restore(state)
+		return r.insert(key, userID, zone, engine), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*SyncEngine), nil
+}
+
+// Persist saves the engine's state if it has unpersisted changes and tells
+// other instances to drop their copy.
+func (r *Registry) Persist(userID, zone string, engine *SyncEngine) error {
+	if err := r.save(userID, zone, engine); err != nil {
+		return err
+	}
+	if r.notify != nil {
+		r.notify(userID, zone)
+	}
+	return nil
+}
+
+// Invalidate drops the cached engine without persisting it. Call it when the
+// state changed elsewhere (another instance or a direct sync_state write).
+func (r *Registry) Invalidate(userID, zone string) {
+	key := registryKey(userID, zone)
+	r.loads.Forget(key)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if elem, ok := r.entries[key]; ok {
+		r.order.Remove(elem)
+		delete(r.entries, key)
+		metrics.Inc(MetricRegistryInvalidations)
+	}
+	delete(r.evicting, key)
+	metrics.Set(MetricRegistrySize, int64(r.order.Len()))
+}
+
+// Reset drops the engine on this and every other instance. Call it after
+// writing sync_state outside the registry.
+func (r *Registry) Reset(userID, zone string) {
+	r.Invalidate(userID, zone)
+	if r.notify != nil {
+		r.notify(userID, zone)
+	}
+}
+
+// Flush persists every engine with unpersisted changes
+func (r *Registry) Flush() error {
+	r.mu.Lock()
+	entries := make([]*registryEntry, 0, r.order.Len())
+	for elem := r.order.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, elem.Value.(*registryEntry))
+	}
+	r.mu.Unlock()
+
+	var firstErr error
+	for _, entry := range entries {
+		if err := r.save(entry.userID, entry.zone, entry.engine); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Len returns the number of cached engines
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.order.Len()
+}
+
+func (r *Registry) lookup(key string) (*SyncEngine, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if elem, ok := r.entries[key]; ok {
+		r.order.MoveToFront(elem)
+		return elem.Value.(*registryEntry).engine, true
+	}
+	return nil, false
+}
+
+// insert adds a loaded engine, evicting the least recently used entries over
+// capacity. It returns the engine callers should use: one revived from
+// eviction wins over the freshly loaded copy.
+func (r *Registry) insert(key, userID, zone string, engine *SyncEngine) *SyncEngine {
+	r.mu.Lock()
+	if elem, ok := r.entries[key]; ok {
+		// A load that raced an Invalidate got here first
+		r.order.MoveToFront(elem)
+		r.mu.Unlock()
+		return elem.Value.(*registryEntry).engine
+	}
+	if pending, ok := r.evicting[key]; ok {
+		engine = pending
+	}
+	r.entries[key] = r.order.PushFront(&registryEntry{key: key, userID: userID, zone: zone, engine: engine})
+
+	var evicted []*registryEntry
+	for r.order.Len() > r.maxEntries {
+		oldest := r.order.Back()
+		entry := oldest.Value.(*registryEntry)
+		r.order.Remove(oldest)
+		delete(r.entries, entry.key)
+		r.evicting[entry.key] = entry.engine
+		evicted = append(evicted, entry)
+	}
+	metrics.Set(MetricRegistrySize, int64(r.order.Len()))
+	r.mu.Unlock()
+
+	for _, entry := range evicted {
+		metrics.Inc(MetricRegistryEviction)
+		if err := r.save(entry.userID, entry.zone, entry.engine); err != nil {
+			log.Printf("⚠️  Failed to persist evicted sync engine %s: %v", entry.key, err)
+		}
+
+		r.mu.Lock()
+		if r.evicting[entry.key] == entry.engine {
+			delete(r.evicting, entry.key)
+		}
+		r.mu.Unlock()
+	}
+	return engine
+}
+
+func (r *Registry) save(userID, zone string, engine *SyncEngine) error {
+	state, dirty := engine.Snapshot()
+	if !dirty {
+		return nil
+	}
+	if err := r.store.SaveEngineState(userID, zone, &state); err != nil {
+		metrics.Inc(MetricRegistryPersistError)
+		return err
+	}
+	engine.markPersisted(state)
+	return nil
+}
@@ -0,0 +1,58 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const registryInvalidateChannel = "sync:engine:invalidate"
+
+type invalidation struct {
+	Origin string `json:"origin"`
+	UserID string `json:"user_id"`
+	Zone   string `json:"zone"`
+}
+
+// UseRedis shares invalidations between server instances: every Persist is
+// published, and every other instance drops its cached engine for that user
+// and zone. It returns once subscribed; the subscription ends with ctx.
+func (r *Registry) UseRedis(ctx context.Context, client *redis.Client) error {
+	pubsub := client.Subscribe(ctx, registryInvalidateChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	origin := uuid.NewString()
+	r.notify = func(userID, zone string) {
+		data, _ := json.Marshal(invalidation{Origin: origin, UserID: userID, Zone: zone})
+		if err := client.Publish(context.Background(), registryInvalidateChannel, data).Err(); err != nil {
+			log.Printf("⚠️  Failed to publish sync engine invalidation for %s/%s: %v", userID, zone, err)
+		}
+	}
+
+	go func() {
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				var inv invalidation
+				if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil || inv.Origin == origin {
+					continue
+				}
+				r.Invalidate(inv.UserID, inv.Zone)
+			}
+		}
+	}()
+	return nil
+}
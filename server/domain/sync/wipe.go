@@ -0,0 +1,16 @@
+package sync
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultWipeRecoveryWindow is how long a bulk wipe of a zone can be undone.
+// Until then its items are trashed: tombstones to clients, restorable on
+// the server. Afterwards they are plain tombstones.
+const DefaultWipeRecoveryWindow = 7 * 24 * time.Hour
+
+var (
+	ErrNoWipe      = errors.New("no bulk wipe to undo")
+	ErrWipeExpired = errors.New("the recovery window of the last bulk wipe has passed")
+)
@@ -0,0 +1,86 @@
+package sync
+
+import (
+	"errors"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+)
+
+// Zone templates a new zone can be created from
+const (
+	// ZoneTemplateEmpty creates only the sync state: gencount 0, empty manifest
+	ZoneTemplateEmpty = "empty"
+	// ZoneTemplateStandard also stores the client's metadata key, so every
+	// client starts from the same key instead of racing to create one
+	ZoneTemplateStandard = "standard"
+)
+
+const maxZoneNameLength = 100 // sync_state.zone is VARCHAR(100)
+
+// AllZones subscribes a WebSocket client to the events of every zone, so
+// no zone can be named after it
+const AllZones = "*"
+
+var (
+	ErrZoneExists           = errors.New("zone already exists")
+	ErrUnknownZoneTemplate  = errors.New("unknown zone template")
+	ErrInvalidZoneName      = errors.New(`zone name must be 1-100 characters and not "*"`)
+	ErrMetadataKeyRequired  = errors.New("the standard template requires a metadata key")
+	ErrMetadataKeyForbidden = errors.New("the empty template does not take a metadata key")
+)
+
+// ValidateZoneName returns ErrInvalidZoneName for a name no zone can have
+func ValidateZoneName(zone string) error {
+	if zone == "" || zone == AllZones || len(zone) > maxZoneNameLength {
+		return ErrInvalidZoneName
+	}
+	return nil
+}
+
+// ZoneBootstrap is everything written when a zone is created
+type ZoneBootstrap struct {
+	Template    string
+	Manifest    *models.SyncManifest
+	MetadataKey *models.CryptoKey // nil for the empty template
+}
+
+// BootstrapZone validates a zone creation request and builds its initial
+// state. The metadata key is encrypted by the client; the server only stores
+// it as the zone's first item, at gencount 1. An empty template name means
+// ZoneTemplateEmpty.
+func BootstrapZone(template, zone string, metadataKey *models.CryptoKey) (*ZoneBootstrap, error) {
+	if err := ValidateZoneName(zone); err != nil {
+		return nil, err
+	}
+
+	var genCount int64
+	leaves := []ManifestLeaf{}
+	switch template {
+	case "", ZoneTemplateEmpty:
+		template = ZoneTemplateEmpty
+		if metadataKey != nil {
+			return nil, ErrMetadataKeyForbidden
+		}
+	case ZoneTemplateStandard:
+		if metadataKey == nil || metadataKey.Tombstone || len(metadataKey.Data) == 0 {
+			return nil, ErrMetadataKeyRequired
+		}
+		genCount = 1
+		metadataKey.Zone = zone
+		metadataKey.GenCount = genCount
+		leaves = append(leaves, ManifestLeaf{Layer: LeafCryptoKey, ItemUUID: metadataKey.ItemUUID.String(), GenCount: genCount})
+	default:
+		return nil, ErrUnknownZoneTemplate
+	}
+
+	manifest, err := NewSyncEngine(zone).BuildManifest(leaves, genCount)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ZoneBootstrap{
+		Template:    template,
+		Manifest:    manifest,
+		MetadataKey: metadataKey,
+	}, nil
+}
@@ -0,0 +1,253 @@
+package vault
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+)
+
+// Breach is a breach of one of the user's addresses, from their cached
+// breach reports
+type Breach struct {
+	Name   string
+	Domain string // The breached site, e.g. adobe.com; "" when HIBP has none
+	Date   string
+}
+
+// How a credential is checked, by its protocol: there is no item kind
+// beyond it
+const (
+	MatchHIBPDomain = "hibp_domain" // A web login, on the domains of breached sites
+	MatchCVE        = "cve"         // A server login, on the CVEs of the product behind its host
+	MatchNone       = "none"        // Not checked; see the skip reason
+)
+
+// Why a credential was not checked
+const (
+	SkipMailProtocol    = "mail_protocol"      // smtp, imap or pop3: the address's own breach report covers it
+	SkipUnknownProtocol = "unknown_protocol"   // A protocol this server doesn't know
+	SkipCVEsOff         = "cves_not_requested" // A server login, without CVE summaries asked for
+	SkipNoProduct       = "no_product"         // A server login whose host names no product, e.g. an IP address
+	SkipCVEsUnavailable = "cves_unavailable"   // The CVE lookup failed or isn't configured
+)
+
+// CVESummary sums up the CVEs of the product behind a server login's host
+type CVESummary struct {
+	Product      string   `json:"product"`
+	TotalCVEs    int      `json:"total_cves"`
+	HighestScore float64  `json:"highest_score"`
+	HighestLevel string   `json:"highest_level"`
+	TopCVEs      []string `json:"top_cves"`
+	Match        string   `json:"match"`         // override, cpe or keyword: how far to trust it
+	CPE          string   `json:"cpe,omitempty"` // CPE match string searched, unless by keyword
+}
+
+// CVELookup returns the CVE summary for a server login's host, or nil and
+// the skip reason when there is none
+type CVELookup func(host string) (*CVESummary, string)
+
+// BreachedCredential is a credential whose server belongs to a breached site
+type BreachedCredential struct {
+	ItemUUID    string   `json:"item_uuid"`
+	Zone        string   `json:"zone"`
+	Server      string   `json:"server"`
+	Account     string   `json:"account"`
+	MatchMethod string   `json:"match_method"`
+	Breaches    []string `json:"breaches"`
+}
+
+// ServerCredential is a server login with the CVE summary of its host
+type ServerCredential struct {
+	ItemUUID    string      `json:"item_uuid"`
+	Zone        string      `json:"zone"`
+	Server      string      `json:"server"`
+	Account     string      `json:"account"`
+	Protocol    string      `json:"protocol"`
+	MatchMethod string      `json:"match_method"`
+	CVEs        *CVESummary `json:"cves"`
+}
+
+// SkippedCredential is a credential neither breach nor CVE matching applies
+// to, with the reason
+type SkippedCredential struct {
+	ItemUUID    string `json:"item_uuid"`
+	Zone        string `json:"zone"`
+	Server      string `json:"server"`
+	Account     string `json:"account"`
+	Protocol    string `json:"protocol"`
+	MatchMethod string `json:"match_method"`
+	Reason      string `json:"reason"`
+}
+
+// StaleCredential is a credential not updated for longer than the report's
+// age threshold
+type StaleCredential struct {
+	ItemUUID  string    `json:"item_uuid"`
+	Zone      string    `json:"zone"`
+	Server    string    `json:"server"`
+	Account   string    `json:"account"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// HealthReport sums up a vault from its metadata alone: the server never
+// sees passwords, so weak or reused ones are for the clients to find
+type HealthReport struct {
+	Credentials  int                  `json:"credentials"`
+	MatchMethods map[string]int       `json:"match_methods"` // Live credentials by match method
+	Breached     []BreachedCredential `json:"breached"`
+	Servers      []ServerCredential   `json:"servers"`
+	Skipped      []SkippedCredential  `json:"skipped"`
+	Stale        []StaleCredential    `json:"stale"`
+	Duplicates   []DuplicateGroup     `json:"duplicates"`
+}
+
+// MatchMethodFor is how a credential of protocol is checked: web logins
+// (and those with no protocol, which default to https) against breached
+// domains, ssh, ftp and ldap logins against CVEs, the rest not at all
+func MatchMethodFor(protocol models.Protocol) (method, skipReason string) {
+	switch protocol {
+	case models.ProtocolUnspecified, models.ProtocolHTTPS, models.ProtocolHTTP:
+		return MatchHIBPDomain, ""
+	case models.ProtocolSSH, models.ProtocolFTP, models.ProtocolLDAP:
+		return MatchCVE, ""
+	case models.ProtocolSMTP, models.ProtocolIMAP, models.ProtocolPOP3:
+		return MatchNone, SkipMailProtocol
+	default:
+		return MatchNone, SkipUnknownProtocol
+	}
+}
+
+// HostOf reduces a server field to its bare host: normalized as by
+// NormalizeServer, with any port removed
+func HostOf(server string) string {
+	s := NormalizeServer(server)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return strings.Trim(s, "[]")
+}
+
+// MatchesDomain reports whether server is on a breached site's domain: the
+// domain itself or any subdomain of it, on any port. mail.adobe.com and
+// adobe.com:8443 match adobe.com; notadobe.com does not.
+func MatchesDomain(server, domain string) bool {
+	host, domain := HostOf(server), HostOf(domain)
+	if host == "" || domain == "" {
+		return false
+	}
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// BuildHealthReport reports on the live credentials: web logins on a
+// breached site, server logins with the CVE summary of their host (looked
+// up once per host, and skipped when cves is nil), those last updated
+// before staleBefore, and duplicate logins. Every credential counts towards
+// staleness and duplicates, whatever its protocol.
+func BuildHealthReport(creds []*models.CredentialMetadata, breaches []Breach, staleBefore time.Time, cves CVELookup) *HealthReport {
+	report := &HealthReport{
+		MatchMethods: map[string]int{MatchHIBPDomain: 0, MatchCVE: 0, MatchNone: 0},
+		Breached:     []BreachedCredential{},
+		Servers:      []ServerCredential{},
+		Skipped:      []SkippedCredential{},
+		Stale:        []StaleCredential{},
+		Duplicates:   FindDuplicates(creds),
+	}
+	type hostCVEs struct {
+		summary *CVESummary
+		reason  string
+	}
+	looked := map[string]hostCVEs{}
+
+	for _, cred := range creds {
+		if cred.Tombstone {
+			continue
+		}
+		report.Credentials++
+
+		method, reason := MatchMethodFor(cred.Protocol)
+		if method == MatchCVE {
+			host := HostOf(cred.Server)
+			found, ok := looked[host]
+			if !ok {
+				found.reason = SkipCVEsOff
+				if cves != nil {
+					found.summary, found.reason = cves(host)
+				}
+				looked[host] = found
+			}
+			if found.summary == nil {
+				method, reason = MatchNone, found.reason
+			} else {
+				report.Servers = append(report.Servers, ServerCredential{
+					ItemUUID:    cred.ItemUUID.String(),
+					Zone:        cred.Zone,
+					Server:      cred.Server,
+					Account:     cred.Account,
+					Protocol:    cred.Protocol.String(),
+					MatchMethod: method,
+					CVEs:        found.summary,
+				})
+			}
+		}
+		report.MatchMethods[method]++
+
+		switch method {
+		case MatchHIBPDomain:
+			var names []string
+			for _, breach := range breaches {
+				if MatchesDomain(cred.Server, breach.Domain) && !contains(names, breach.Name) {
+					names = append(names, breach.Name)
+				}
+			}
+			if len(names) > 0 {
+				sort.Strings(names)
+				report.Breached = append(report.Breached, BreachedCredential{
+					ItemUUID:    cred.ItemUUID.String(),
+					Zone:        cred.Zone,
+					Server:      cred.Server,
+					Account:     cred.Account,
+					MatchMethod: method,
+					Breaches:    names,
+				})
+			}
+		case MatchNone:
+			report.Skipped = append(report.Skipped, SkippedCredential{
+				ItemUUID:    cred.ItemUUID.String(),
+				Zone:        cred.Zone,
+				Server:      cred.Server,
+				Account:     cred.Account,
+				Protocol:    cred.Protocol.String(),
+				MatchMethod: method,
+				Reason:      reason,
+			})
+		}
+
+		if cred.UpdatedAt.Before(staleBefore) {
+			report.Stale = append(report.Stale, StaleCredential{
+				ItemUUID:  cred.ItemUUID.String(),
+				Zone:      cred.Zone,
+				Server:    cred.Server,
+				Account:   cred.Account,
+				UpdatedAt: cred.UpdatedAt,
+			})
+		}
+	}
+
+	// Longest unchanged first
+	sort.SliceStable(report.Stale, func(i, j int) bool {
+		return report.Stale[i].UpdatedAt.Before(report.Stale[j].UpdatedAt)
+	})
+	return report
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
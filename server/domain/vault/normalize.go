@@ -0,0 +1,158 @@
+package vault
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+)
+
+// NormalizeServer reduces a credential's server field to a comparable host.
+// Scheme, userinfo, path, query, default ports (80/443), a trailing dot, and
+// a leading "www." are removed and the result is lowercased. Other subdomains
+// are preserved: login.example.com and example.com are different servers.
+func NormalizeServer(server string) string {
+	s := strings.ToLower(strings.TrimSpace(server))
+
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+3:]
+	}
+	if i := strings.IndexAny(s, "/?#"); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		s = s[i+1:]
+	}
+
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		if port == "80" || port == "443" {
+			s = host
+		}
+	}
+
+	s = strings.TrimSuffix(s, ".")
+	s = strings.TrimPrefix(s, "www.")
+	return s
+}
+
+// NormalizeAccount compares account names case-insensitively, ignoring
+// surrounding whitespace ("Alice@Example.com" and "alice@example.com" are
+// the same login).
+func NormalizeAccount(account string) string {
+	return strings.ToLower(strings.TrimSpace(account))
+}
+
+// DedupeKey identifies a login: two credentials are duplicates only when both
+// the normalized server and the normalized account match.
+type DedupeKey struct {
+	Server  string
+	Account string
+}
+
+func KeyFor(cred *models.CredentialMetadata) DedupeKey {
+	return DedupeKey{
+		Server:  NormalizeServer(cred.Server),
+		Account: NormalizeAccount(cred.Account),
+	}
+}
+
+type DuplicateGroup struct {
+	Server    string   `json:"server"`
+	Account   string   `json:"account"`
+	ItemUUIDs []string `json:"item_uuids"`
+}
+
+// FindDuplicates returns every (server, account) pair held by more than one
+// live credential. Different accounts on the same server are never merged.
+func FindDuplicates(creds []*models.CredentialMetadata) []DuplicateGroup {
+	byKey := make(map[DedupeKey][]string)
+	for _, cred := range creds {
+		if cred.Tombstone {
+			continue
+		}
+		key := KeyFor(cred)
+		byKey[key] = append(byKey[key], cred.ItemUUID.String())
+	}
+
+	groups := make([]DuplicateGroup, 0)
+	for key, items := range byKey {
+		if len(items) < 2 {
+			continue
+		}
+		sort.Strings(items)
+		groups = append(groups, DuplicateGroup{
+			Server:    key.Server,
+			Account:   key.Account,
+			ItemUUIDs: items,
+		})
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Server != groups[j].Server {
+			return groups[i].Server < groups[j].Server
+		}
+		return groups[i].Account < groups[j].Account
+	})
+	return groups
+}
+
+type AccountEntry struct {
+	Account   string   `json:"account"`
+	ItemUUIDs []string `json:"item_uuids"`
+}
+
+type ServerGroup struct {
+	Server   string         `json:"server"`
+	Accounts []AccountEntry `json:"accounts"`
+}
+
+// GroupByServer nests live credentials under their normalized server, with
+// one entry per distinct account. The account keeps the spelling of the
+// first credential seen for it.
+func GroupByServer(creds []*models.CredentialMetadata) []ServerGroup {
+	type accountItems struct {
+		display string
+		items   []string
+	}
+	servers := make(map[string]map[string]*accountItems)
+
+	for _, cred := range creds {
+		if cred.Tombstone {
+			continue
+		}
+		key := KeyFor(cred)
+		accounts, ok := servers[key.Server]
+		if !ok {
+			accounts = make(map[string]*accountItems)
+			servers[key.Server] = accounts
+		}
+		entry, ok := accounts[key.Account]
+		if !ok {
+			entry = &accountItems{display: strings.TrimSpace(cred.Account)}
+			accounts[key.Account] = entry
+		}
+		entry.items = append(entry.items, cred.ItemUUID.String())
+	}
+
+	groups := make([]ServerGroup, 0, len(servers))
+	for server, accounts := range servers {
+		group := ServerGroup{Server: server, Accounts: make([]AccountEntry, 0, len(accounts))}
+		for _, entry := range accounts {
+			sort.Strings(entry.items)
+			group.Accounts = append(group.Accounts, AccountEntry{
+				Account:   entry.display,
+				ItemUUIDs: entry.items,
+			})
+		}
+		sort.Slice(group.Accounts, func(i, j int) bool {
+			return NormalizeAccount(group.Accounts[i].Account) < NormalizeAccount(group.Accounts[j].Account)
+		})
+		groups = append(groups, group)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Server < groups[j].Server
+	})
+	return groups
+}
@@ -0,0 +1,129 @@
+// Package features records, once at startup, which optional subsystems run
+// on a real backend and which fell back to an in-memory substitute. The
+// server works without Redis; this is where the cost of that is spelled out.
+package features
+
+import "log"
+
+// Backends a capability can run on
+const (
+	BackendRedis  = "redis"
+	BackendMemory = "memory"
+)
+
+// Capabilities with a Redis backend and an in-memory substitute
+const (
+	BreachCache        = "breach_cache"             // HIBP and NIST lookups
+	ProfileCache       = "auth_profile_cache"       // Auth profiles checked on every request
+	EngineInvalidation = "sync_engine_invalidation" // Dropping other instances' cached sync engines
+	EventLog           = "ws_event_log"             // Event sequences for resuming WebSocket clients
+	AuthRateLimit      = "auth_rate_limit"          // Failed login and registration attempts
+)
+
+// Modes reported by Features.Mode
+const (
+	ModeRedis        = "redis"         // Every capability has its real backend
+	ModeSingleBinary = "single-binary" // No Redis; everything runs in memory
+	ModeDegraded     = "degraded"      // Redis is up but some capability fell back
+)
+
+// caveats describes what each in-memory substitute gives up
+var caveats = map[string]string{
+	BreachCache: "per instance and lost on restart; lookups are repeated " +
+		"against the upstream APIs by every instance",
+	ProfileCache: "per instance; account deactivation and token revocation " +
+		"reach other instances only after the profile cache TTL",
+	EngineInvalidation: "no cross-instance invalidation; run a single server " +
+		"instance or instances will serve stale gencounts",
+	EventLog: "per instance and lost on restart; clients resuming on " +
+		"another instance are told to resync",
+	AuthRateLimit: "per instance and lost on restart; every instance allows " +
+		"the full number of failed attempts",
+}
+
+// order is the order capabilities are listed in
+var order = []string{BreachCache, ProfileCache, EngineInvalidation, EventLog, AuthRateLimit}
+
+type Capability struct {
+	Name    string `json:"name"`
+	Backend string `json:"backend"`
+	Caveat  string `json:"caveat,omitempty"` // Set when running on a substitute
+}
+
+// Degraded reports whether the capability runs on its in-memory substitute
+func (c Capability) Degraded() bool {
+	return c.Backend != BackendRedis
+}
+
+// Features is the resolved backend of every optional capability
+type Features struct {
+	Redis        bool
+	capabilities map[string]Capability
+}
+
+// Resolve picks Redis for every capability when it is available and the
+// in-memory substitute otherwise
+func Resolve(redisAvailable bool) *Features {
+	f := &Features{Redis: redisAvailable, capabilities: make(map[string]Capability, len(order))}
+	for _, name := range order {
+		if redisAvailable {
+			f.capabilities[name] = Capability{Name: name, Backend: BackendRedis}
+		} else {
+			f.Fallback(name)
+		}
+	}
+	return f
+}
+
+// Fallback records that one capability runs on its in-memory substitute,
+// e.g. because its Redis subscription failed even though Redis is up
+func (f *Features) Fallback(name string) {
+	f.capabilities[name] = Capability{Name: name, Backend: BackendMemory, Caveat: caveats[name]}
+}
+
+// Get returns one capability; unknown names report the memory backend
+func (f *Features) Get(name string) Capability {
+	if capability, ok := f.capabilities[name]; ok {
+		return capability
+	}
+	return Capability{Name: name, Backend: BackendMemory}
+}
+
+// All returns every capability in a stable order
+func (f *Features) All() []Capability {
+	all := make([]Capability, 0, len(order))
+	for _, name := range order {
+		all = append(all, f.capabilities[name])
+	}
+	return all
+}
+
+// Degraded returns the capabilities running on in-memory substitutes
+func (f *Features) Degraded() []Capability {
+	degraded := []Capability{}
+	for _, capability := range f.All() {
+		if capability.Degraded() {
+			degraded = append(degraded, capability)
+		}
+	}
+	return degraded
+}
+
+func (f *Features) Mode() string {
+	switch {
+	case !f.Redis:
+		return ModeSingleBinary
+	case len(f.Degraded()) > 0:
+		return ModeDegraded
+	default:
+		return ModeRedis
+	}
+}
+
+// Log prints the resolved mode and the caveat of every substitute in use
+func (f *Features) Log() {
+	log.Printf("⚙️  Backend mode: %s", f.Mode())
+	for _, capability := range f.Degraded() {
+		log.Printf("⚠️  %s uses the in-memory substitute: %s", capability.Name, capability.Caveat)
+	}
+}
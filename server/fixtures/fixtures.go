@@ -0,0 +1,224 @@
+// Package fixtures generates development vaults: users with keys,
+// credential metadata and encrypted sync records in several zones. The
+// items are push DTOs, so they go through the same validation and storage
+// as a real push, and the records decrypt with the vault password and salt
+// reported for each user.
+//
+// Everything but the ciphertext is a function of the seed: emails, salts,
+// item UUIDs, content keys and the plaintext credentials. Encryption draws
+// fresh nonces, so only the ciphertext bytes differ between runs.
+package fixtures
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/deeplyprofound/password-sync/pkg/importers"
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/google/uuid"
+)
+
+// VaultSaltSize is the length of each user's vault key salt
+const VaultSaltSize = 32
+
+var ErrNoKeys = errors.New("credentials and sync records need at least one key per zone")
+
+// Options sizes a dataset. The counts are per user and zone.
+type Options struct {
+	Users       int
+	Email       string // First user's email; the others get +1, +2... tags
+	Zones       []string
+	Keys        int
+	Credentials int
+	Records     int
+	Seed        uint64
+}
+
+// Encryptor seals items under a user's vault key. LayeredCrypto
+// implements it.
+type Encryptor interface {
+	WrapKey(contentKey []byte) ([]byte, error)
+	EncryptCredential(data []byte) (wrappedKey, encItem []byte, err error)
+}
+
+// User is one generated account and its vault
+type User struct {
+	Email     string
+	VaultSalt []byte
+	Zones     []*Zone
+}
+
+// Zone holds one zone's items in push order
+type Zone struct {
+	Name        string
+	Keys        []mapping.CryptoKeyDTO
+	Credentials []mapping.CredentialMetadataDTO
+	Records     []mapping.SyncRecordDTO
+	Plaintext   []importers.PlainCredential // Plaintext[i] is sealed in Records[i]
+}
+
+// Items is the zone's item count across the three layers
+func (z *Zone) Items() int {
+	return len(z.Keys) + len(z.Credentials) + len(z.Records)
+}
+
+// UserEmail returns the email of user i: the base address, then
+// local+i@domain
+func UserEmail(base string, i int) string {
+	if i == 0 {
+		return base
+	}
+	local, domain, ok := strings.Cut(base, "@")
+	if !ok {
+		return fmt.Sprintf("%s+%d", base, i)
+	}
+	return fmt.Sprintf("%s+%d@%s", local, i, domain)
+}
+
+// Generate builds the dataset. encryptor returns the vault encryptor of a
+// user from their salt.
+func Generate(opts Options, encryptor func(salt []byte) (Encryptor, error)) ([]*User, error) {
+	if (opts.Credentials > 0 || opts.Records > 0) && opts.Keys == 0 {
+		return nil, ErrNoKeys
+	}
+	g := &generator{rng: rand.New(rand.NewPCG(opts.Seed, 0))}
+
+	users := make([]*User, 0, opts.Users)
+	for i := 0; i < opts.Users; i++ {
+		user := &User{Email: UserEmail(opts.Email, i), VaultSalt: g.bytes(VaultSaltSize)}
+		enc, err := encryptor(user.VaultSalt)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range opts.Zones {
+			zone, err := g.zone(name, opts, enc)
+			if err != nil {
+				return nil, fmt.Errorf("%s/%s: %w", user.Email, name, err)
+			}
+			user.Zones = append(user.Zones, zone)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+type generator struct {
+	rng *rand.Rand
+}
+
+func (g *generator) bytes(n int) []byte {
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = byte(g.rng.Uint32())
+	}
+	return out
+}
+
+func (g *generator) uuid() string {
+	id, _ := uuid.FromBytes(g.bytes(16))
+	// Version 4 layout, so the IDs look like the clients' own
+	id[6] = (id[6] & 0x0f) | 0x40
+	id[8] = (id[8] & 0x3f) | 0x80
+	return id.String()
+}
+
+func (g *generator) pick(words []string) string {
+	return words[g.rng.IntN(len(words))]
+}
+
+func (g *generator) password() string {
+	const alphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789!@#$%^&*"
+	out := make([]byte, 12+g.rng.IntN(12))
+	for i := range out {
+		out[i] = alphabet[g.rng.IntN(len(alphabet))]
+	}
+	return string(out)
+}
+
+func (g *generator) zone(name string, opts Options, enc Encryptor) (*Zone, error) {
+	zone := &Zone{Name: name}
+
+	for i := 0; i < opts.Keys; i++ {
+		wrapped, err := enc.WrapKey(g.bytes(32))
+		if err != nil {
+			return nil, err
+		}
+		zone.Keys = append(zone.Keys, mapping.CryptoKeyDTO{
+			ItemUUID: g.uuid(),
+			KeyClass: int(models.KeyClassSymmetric),
+			KeyType:  int(models.KeyTypeAES256GCM),
+			Label:    fmt.Sprintf("%s key %d", name, i+1),
+			Data:     wrapped,
+			Flags:    []byte(`{"encrypt":true,"decrypt":true}`),
+		})
+	}
+
+	for i := 0; i < opts.Credentials; i++ {
+		site := g.pick(sites)
+		zone.Credentials = append(zone.Credentials, mapping.CredentialMetadataDTO{
+			ItemUUID:        g.uuid(),
+			Server:          site,
+			Account:         g.pick(accounts) + "@example.com",
+			Label:           strings.TrimPrefix(site, "www."),
+			PasswordKeyUUID: zone.Keys[g.rng.IntN(len(zone.Keys))].ItemUUID,
+		})
+	}
+
+	for i := 0; i < opts.Records; i++ {
+		site := g.pick(sites)
+		cred := importers.PlainCredential{
+			Name:       strings.TrimPrefix(site, "www."),
+			URIs:       []string{"https://" + site + "/login"},
+			Username:   g.pick(accounts),
+			Password:   g.password(),
+			Collection: name,
+			Favorite:   g.rng.IntN(5) == 0,
+		}
+		if g.rng.IntN(3) == 0 {
+			cred.Notes = g.pick(notes)
+		}
+		plaintext, err := json.Marshal(&cred)
+		if err != nil {
+			return nil, err
+		}
+		wrappedKey, encItem, err := enc.EncryptCredential(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		parent := zone.Keys[g.rng.IntN(len(zone.Keys))].ItemUUID
+		zone.Records = append(zone.Records, mapping.SyncRecordDTO{
+			ItemUUID:      g.uuid(),
+			ParentKeyUUID: &parent,
+			WrappedKey:    wrappedKey,
+			EncItem:       encItem,
+			EncVersion:    importers.RecordEncVersion,
+			ContextID:     importers.RecordContextID,
+		})
+		zone.Plaintext = append(zone.Plaintext, cred)
+	}
+	return zone, nil
+}
+
+var (
+	sites = []string{
+		"github.com", "gitlab.com", "www.google.com", "mail.example.org",
+		"www.amazon.com", "news.ycombinator.com", "www.reddit.com",
+		"bank.example.com", "www.netflix.com", "jira.example.net",
+		"www.linkedin.com", "aws.amazon.com", "www.dropbox.com",
+		"shop.example.com", "login.microsoftonline.com",
+	}
+	accounts = []string{
+		"alice", "bob", "carol", "dave", "erin", "frank", "grace",
+		"heidi", "ivan", "judy", "mallory", "oscar", "peggy", "trent",
+	}
+	notes = []string{
+		"Recovery codes are in the safe",
+		"Shared with the team",
+		"Rotate every 90 days",
+		"Security question: first pet",
+	}
+)
@@ -0,0 +1,300 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+const AccountInactivityJobName = "account_inactivity"
+
+// InactivityDeleted follows storage.InactivityDeletionQueued: the account
+// and everything it owns are deleted
+const InactivityDeleted = "deleted"
+
+// InactivityPolicy says how long a free account may stay idle before each
+// stage of the lifecycle. Every stage also waits, after the one before it,
+// at least the difference between the two thresholds, so each warning
+// runs its full length even when the job ran late or the policy changed.
+type InactivityPolicy struct {
+	WarnAfter         time.Duration // Warned the account will go dormant
+	DormantAfter      time.Duration // Refresh tokens revoked, data kept
+	DeletionWarnAfter time.Duration // Warned the account will be deleted
+	DeleteAfter       time.Duration // Deactivated and queued for deletion
+	DeletionGrace     time.Duration // How long a queued account waits before it is deleted
+}
+
+const day = 24 * time.Hour
+
+var DefaultInactivityPolicy = InactivityPolicy{
+	WarnAfter:         180 * day,
+	DormantAfter:      210 * day,
+	DeletionWarnAfter: 700 * day,
+	DeleteAfter:       730 * day,
+	DeletionGrace:     7 * day,
+}
+
+// Validate checks that every threshold is positive and later than the one
+// before it
+func (p InactivityPolicy) Validate() error {
+	thresholds := []time.Duration{0, p.WarnAfter, p.DormantAfter, p.DeletionWarnAfter, p.DeleteAfter}
+	for i := 1; i < len(thresholds); i++ {
+		if thresholds[i] <= thresholds[i-1] {
+			return fmt.Errorf("inactivity thresholds must increase: warn < dormant < deletion warning < delete")
+		}
+	}
+	if p.DeletionGrace <= 0 {
+		return fmt.Errorf("inactivity deletion grace must be positive")
+	}
+	return nil
+}
+
+var nextInactivityStage = map[string]string{
+	storage.InactivityActive:         storage.InactivityWarned,
+	storage.InactivityWarned:         storage.InactivityDormant,
+	storage.InactivityDormant:        storage.InactivityDeletionWarned,
+	storage.InactivityDeletionWarned: storage.InactivityDeletionQueued,
+	storage.InactivityDeletionQueued: InactivityDeleted,
+}
+
+// threshold is how long an account is idle before it enters stage
+func (p InactivityPolicy) threshold(stage string) time.Duration {
+	switch stage {
+	case storage.InactivityWarned:
+		return p.WarnAfter
+	case storage.InactivityDormant:
+		return p.DormantAfter
+	case storage.InactivityDeletionWarned:
+		return p.DeletionWarnAfter
+	case storage.InactivityDeletionQueued:
+		return p.DeleteAfter
+	case InactivityDeleted:
+		return p.DeleteAfter + p.DeletionGrace
+	}
+	return 0
+}
+
+// Next returns the stage an account in stage (entered at stageAt, nil while
+// active) goes to next and when. It returns "" after the last stage.
+func (p InactivityPolicy) Next(stage string, stageAt *time.Time, lastActive time.Time) (string, time.Time) {
+	next, ok := nextInactivityStage[stage]
+	if !ok {
+		return "", time.Time{}
+	}
+	at := lastActive.Add(p.threshold(next))
+	if stageAt != nil {
+		at = latest(at, stageAt.Add(p.threshold(next)-p.threshold(stage)))
+	}
+	return next, at
+}
+
+// DeletionAt projects when the account is deleted if it stays idle and the
+// job runs on schedule from now on
+func (p InactivityPolicy) DeletionAt(account *storage.InactiveAccount, now time.Time) time.Time {
+	stage, stageAt := account.Stage, account.StageAt
+	for {
+		next, at := p.Next(stage, stageAt, account.LastActive)
+		if next == "" {
+			return time.Time{}
+		}
+		at = latest(at, now)
+		if next == InactivityDeleted {
+			return at
+		}
+		stage, stageAt = next, &at
+	}
+}
+
+// Exempt reports whether the lifecycle leaves the account alone: paying
+// accounts and accounts on legal hold, whatever their activity
+func (p InactivityPolicy) Exempt(account *storage.InactiveAccount) bool {
+	return account.LegalHold || account.Tier != storage.FreeTier
+}
+
+type AccountInactivityStore interface {
+	FindInactiveAccounts(idleBefore time.Time, userID string) ([]*storage.InactiveAccount, error)
+	SetInactivityStage(userID, from, to string, at time.Time) (bool, error)
+	DeleteUserCascade(ctx context.Context, id string) error
+}
+
+// AccountNotifier tells users and operators about the lifecycle. Neither
+// method is called on a dry run.
+type AccountNotifier interface {
+	// InactivityStageChanged runs after the account (still holding the
+	// stage it left) entered stage. deadline is when it goes dormant, for
+	// InactivityWarned, or is deleted, for the later stages; zero for
+	// storage.InactivityActive.
+	InactivityStageChanged(account *storage.InactiveAccount, stage string, deadline time.Time)
+	// AccountDeleted runs after the account was deleted
+	AccountDeleted(account *storage.InactiveAccount)
+}
+
+// AccountInactivityJob moves idle free accounts through the inactivity
+// stages, one stage per run, and deletes them at the end. Accounts that
+// were active since entering their stage, or became exempt, are moved back
+// to active.
+type AccountInactivityJob struct {
+	store    AccountInactivityStore
+	notifier AccountNotifier
+	policy   InactivityPolicy
+	clock    clock.Clock
+}
+
+func NewAccountInactivityJob(store AccountInactivityStore, notifier AccountNotifier, policy InactivityPolicy) *AccountInactivityJob {
+	return &AccountInactivityJob{store: store, notifier: notifier, policy: policy, clock: clock.System}
+}
+
+// SetClock replaces the clock idle times are measured with
+func (j *AccountInactivityJob) SetClock(c clock.Clock) {
+	j.clock = c
+}
+
+// Policy returns the thresholds the job runs with
+func (j *AccountInactivityJob) Policy() InactivityPolicy {
+	return j.policy
+}
+
+func (j *AccountInactivityJob) Name() string {
+	return AccountInactivityJobName
+}
+
+func (j *AccountInactivityJob) Run(ctx context.Context, opts RunOptions) (*Report, error) {
+	now := j.clock.Now()
+	accounts, err := j.store.FindInactiveAccounts(now.Add(-j.policy.WarnAfter), opts.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Users: []UserImpact{}}
+	for _, account := range accounts {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		stage, due := j.transition(account, now)
+		if !due {
+			continue
+		}
+		if !opts.DryRun {
+			done, err := j.apply(ctx, account, stage, now)
+			if err != nil {
+				return report, err
+			}
+			if !done {
+				continue
+			}
+		}
+		report.TotalAffected++
+		report.Users = append(report.Users, UserImpact{UserID: account.UserID, Count: 1, Stage: stage})
+	}
+
+	return report, nil
+}
+
+// resumed reports whether the account was active since entering its stage
+func resumed(account *storage.InactiveAccount) bool {
+	return account.StageAt != nil && account.LastActive.After(*account.StageAt)
+}
+
+// transition returns the stage the account is due to enter now, if any
+func (j *AccountInactivityJob) transition(account *storage.InactiveAccount, now time.Time) (string, bool) {
+	if account.Stage != storage.InactivityActive && (j.policy.Exempt(account) || resumed(account)) {
+		return storage.InactivityActive, true
+	}
+	if j.policy.Exempt(account) {
+		return "", false
+	}
+	next, at := j.policy.Next(account.Stage, account.StageAt, account.LastActive)
+	if next == "" || now.Before(at) {
+		return "", false
+	}
+	return next, true
+}
+
+// apply moves the account to stage. It returns false when the account
+// changed since it was read and was left alone.
+func (j *AccountInactivityJob) apply(ctx context.Context, account *storage.InactiveAccount, stage string, now time.Time) (bool, error) {
+	if stage == InactivityDeleted {
+		err := j.store.DeleteUserCascade(ctx, account.UserID)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Put on legal hold (or deleted) since it was read
+			metrics.Inc(MetricLegalHoldSkipped)
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		j.notifier.AccountDeleted(account)
+		return true, nil
+	}
+
+	moved, err := j.store.SetInactivityStage(account.UserID, account.Stage, stage, now)
+	if err != nil || !moved {
+		return false, err
+	}
+
+	var deadline time.Time
+	switch stage {
+	case storage.InactivityActive:
+	case storage.InactivityWarned:
+		_, deadline = j.policy.Next(stage, &now, account.LastActive)
+	default:
+		entered := *account
+		entered.Stage, entered.StageAt = stage, &now
+		deadline = j.policy.DeletionAt(&entered, now)
+	}
+	j.notifier.InactivityStageChanged(account, stage, deadline)
+	return true, nil
+}
+
+// ScheduledDeletion is an account the lifecycle deletes unless it becomes
+// active again
+type ScheduledDeletion struct {
+	UserID     string    `json:"user_id"`
+	Email      string    `json:"email"`
+	Stage      string    `json:"stage"`
+	LastActive time.Time `json:"last_active"`
+	DeleteAt   time.Time `json:"delete_at"`
+}
+
+// UpcomingDeletions lists the accounts that would be deleted within the
+// given time if they stay idle, soonest first. Read-only.
+func (j *AccountInactivityJob) UpcomingDeletions(within time.Duration) ([]ScheduledDeletion, error) {
+	now := j.clock.Now()
+	horizon := now.Add(within)
+
+	// An account idle for less than the whole lifecycle can't be deleted in time
+	accounts, err := j.store.FindInactiveAccounts(horizon.Add(-j.policy.threshold(InactivityDeleted)), "")
+	if err != nil {
+		return nil, err
+	}
+
+	deletions := []ScheduledDeletion{}
+	for _, account := range accounts {
+		if j.policy.Exempt(account) || resumed(account) {
+			continue
+		}
+		deleteAt := j.policy.DeletionAt(account, now)
+		if deleteAt.IsZero() || deleteAt.After(horizon) {
+			continue
+		}
+		deletions = append(deletions, ScheduledDeletion{
+			UserID:     account.UserID,
+			Email:      account.Email,
+			Stage:      account.Stage,
+			LastActive: account.LastActive,
+			DeleteAt:   deleteAt,
+		})
+	}
+
+	sort.SliceStable(deletions, func(a, b int) bool {
+		return deletions[a].DeleteAt.Before(deletions[b].DeleteAt)
+	})
+	return deletions, nil
+}
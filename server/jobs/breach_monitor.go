@@ -0,0 +1,129 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+const BreachMonitorJobName = "breach_monitor"
+
+// BreachRecheckInterval is how long a monitored address waits between checks
+const BreachRecheckInterval = 24 * time.Hour
+
+// DefaultBreachMonitorBatch bounds the addresses one run checks, so a run
+// fits well within the HIBP rate before the next one starts
+const DefaultBreachMonitorBatch = 100
+
+type BreachMonitorStore interface {
+	FindDueBreachMonitors(checkedBefore time.Time, userID string, limit int) ([]*storage.BreachMonitor, error)
+	RecordBreachCheck(ctx context.Context, monitor *storage.BreachMonitor, breaches []string, alerts []*storage.BreachAlert, at time.Time) error
+}
+
+// BreachLookup returns one alert, not yet stored, per breach HIBP lists for
+// a monitored address. It goes through the breach cache and the HIBP
+// scheduler like any other lookup.
+type BreachLookup func(ctx context.Context, userID, email string) ([]*storage.BreachAlert, error)
+
+// BreachAlertNotifier tells a user about new breaches of a monitored
+// address. Not called on a dry run.
+type BreachAlertNotifier interface {
+	BreachAlerts(monitor *storage.BreachMonitor, alerts []*storage.BreachAlert)
+}
+
+// BreachMonitorJob re-checks each monitored address once a
+// BreachRecheckInterval and raises an alert for every breach not listed at
+// the check before. An address's first check only records the breaches
+// known then. A failed lookup leaves the address due for the next run.
+type BreachMonitorJob struct {
+	store    BreachMonitorStore
+	lookup   BreachLookup
+	notifier BreachAlertNotifier
+	batch    int
+	clock    clock.Clock
+}
+
+func NewBreachMonitorJob(store BreachMonitorStore, lookup BreachLookup, notifier BreachAlertNotifier, batch int) *BreachMonitorJob {
+	if batch <= 0 {
+		batch = DefaultBreachMonitorBatch
+	}
+	return &BreachMonitorJob{store: store, lookup: lookup, notifier: notifier, batch: batch, clock: clock.System}
+}
+
+// SetClock replaces the clock check times are taken from
+func (j *BreachMonitorJob) SetClock(c clock.Clock) {
+	j.clock = c
+}
+
+func (j *BreachMonitorJob) Name() string {
+	return BreachMonitorJobName
+}
+
+func (j *BreachMonitorJob) Run(ctx context.Context, opts RunOptions) (*Report, error) {
+	monitors, err := j.store.FindDueBreachMonitors(j.clock.Now().Add(-BreachRecheckInterval), opts.UserID, j.batch)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Users: []UserImpact{}}
+	for _, monitor := range monitors {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		found, err := j.lookup(ctx, monitor.UserID, monitor.Email)
+		if err != nil {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			log.Printf("⚠️  Breach monitor %s: lookup failed, retrying next run: %v", monitor.ID, err)
+			continue
+		}
+
+		breaches, alerts := diffBreaches(monitor, found)
+		if !opts.DryRun {
+			err := j.store.RecordBreachCheck(ctx, monitor, breaches, alerts, j.clock.Now())
+			if errors.Is(err, sql.ErrNoRows) {
+				// Unsubscribed during the lookup
+				continue
+			}
+			if err != nil {
+				return report, err
+			}
+			if len(alerts) > 0 {
+				j.notifier.BreachAlerts(monitor, alerts)
+			}
+		}
+		if len(alerts) > 0 {
+			report.TotalAffected += int64(len(alerts))
+			report.Users = append(report.Users, UserImpact{UserID: monitor.UserID, Count: int64(len(alerts))})
+		}
+	}
+
+	return report, nil
+}
+
+// diffBreaches returns the names of the breaches found, and an alert for
+// each one the monitor's last check didn't list; none on its first check
+func diffBreaches(monitor *storage.BreachMonitor, found []*storage.BreachAlert) ([]string, []*storage.BreachAlert) {
+	known := make(map[string]bool, len(monitor.Breaches))
+	for _, name := range monitor.Breaches {
+		known[name] = true
+	}
+
+	breaches := make([]string, 0, len(found))
+	var alerts []*storage.BreachAlert
+	for _, breach := range found {
+		breaches = append(breaches, breach.Breach)
+		if monitor.CheckedAt != nil && !known[breach.Breach] {
+			alert := *breach
+			alert.Email = monitor.Email
+			alerts = append(alerts, &alert)
+		}
+	}
+	return breaches, alerts
+}
@@ -0,0 +1,65 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+const BulkWipeExpiryJobName = "bulk_wipe_expiry"
+
+type BulkWipeExpiryStore interface {
+	FindExpiredWipes(now time.Time, userID string) ([]*storage.BulkWipe, error)
+	ExpireWipe(userID, wipeID string) (int64, error)
+}
+
+// BulkWipeExpiryJob turns the items of bulk wipes past their recovery window
+// into plain tombstones, after which they can no longer be undone and age
+// towards the tombstone purge
+type BulkWipeExpiryJob struct {
+	store BulkWipeExpiryStore
+	clock clock.Clock
+}
+
+func NewBulkWipeExpiryJob(store BulkWipeExpiryStore) *BulkWipeExpiryJob {
+	return &BulkWipeExpiryJob{store: store, clock: clock.System}
+}
+
+// SetClock replaces the clock recovery windows are checked against
+func (j *BulkWipeExpiryJob) SetClock(c clock.Clock) {
+	j.clock = c
+}
+
+func (j *BulkWipeExpiryJob) Name() string {
+	return BulkWipeExpiryJobName
+}
+
+func (j *BulkWipeExpiryJob) Run(ctx context.Context, opts RunOptions) (*Report, error) {
+	wipes, err := j.store.FindExpiredWipes(j.clock.Now().UTC(), opts.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Users: make([]UserImpact, 0, len(wipes))}
+	for _, wipe := range wipes {
+		impact := UserImpact{UserID: wipe.UserID, Zone: wipe.Zone, Count: int64(wipe.Items)}
+
+		if !opts.DryRun {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			expired, err := j.store.ExpireWipe(wipe.UserID, wipe.ID)
+			if err != nil {
+				return report, err
+			}
+			impact.Count = expired
+		}
+
+		report.TotalAffected += impact.Count
+		report.Users = append(report.Users, impact)
+	}
+
+	return report, nil
+}
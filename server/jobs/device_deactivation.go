@@ -0,0 +1,151 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+const DeviceDeactivationJobName = "device_auto_deactivate"
+
+// DeviceWarningPeriod is how long before an idle device is deactivated its
+// owner is warned. A device is never deactivated sooner than this after the
+// warning, even if it was already past its deadline.
+const DeviceWarningPeriod = 7 * 24 * time.Hour
+
+// MinAutoDeactivateDays is the shortest auto-deactivation setting allowed;
+// anything shorter would leave no room for the warning
+const MinAutoDeactivateDays = 14
+
+type DeviceDeactivationStore interface {
+	FindAutoDeactivationCandidates(now time.Time, warningDays int, userID string) ([]*storage.StaleDevice, error)
+	MarkDevicesWarned(deviceIDs []string, at time.Time) error
+	RevokeDevices(userID string, deviceIDs []string) ([]string, error)
+}
+
+// DeviceNotifier tells a user about the job's effect on their devices.
+// Neither method is called on a dry run.
+type DeviceNotifier interface {
+	// DeviceInactive warns that device will be deactivated at deactivateAt
+	DeviceInactive(device *storage.StaleDevice, deactivateAt time.Time)
+	// DevicesDeactivated runs after the devices and their refresh tokens
+	// were revoked; it should close their connections
+	DevicesDeactivated(userID string, deviceIDs []string)
+}
+
+// DeviceDeactivationJob deactivates devices idle longer than their owner's
+// device_auto_deactivate_days setting, after warning the owner
+// DeviceWarningPeriod in advance. Users without the setting are skipped.
+type DeviceDeactivationJob struct {
+	store    DeviceDeactivationStore
+	notifier DeviceNotifier
+	clock    clock.Clock
+}
+
+func NewDeviceDeactivationJob(store DeviceDeactivationStore, notifier DeviceNotifier) *DeviceDeactivationJob {
+	return &DeviceDeactivationJob{store: store, notifier: notifier, clock: clock.System}
+}
+
+// SetClock replaces the clock deadlines are computed from
+func (j *DeviceDeactivationJob) SetClock(c clock.Clock) {
+	j.clock = c
+}
+
+func (j *DeviceDeactivationJob) Name() string {
+	return DeviceDeactivationJobName
+}
+
+func (j *DeviceDeactivationJob) Run(ctx context.Context, opts RunOptions) (*Report, error) {
+	now := j.clock.Now()
+	warningDays := int(DeviceWarningPeriod / (24 * time.Hour))
+
+	candidates, err := j.store.FindAutoDeactivationCandidates(now, warningDays, opts.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Users: []UserImpact{}}
+	for start := 0; start < len(candidates); {
+		end := start
+		for end < len(candidates) && candidates[end].UserID == candidates[start].UserID {
+			end++
+		}
+
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		impact, err := j.runUser(now, candidates[start:end], opts.DryRun)
+		if err != nil {
+			return report, err
+		}
+		if impact.Count > 0 || impact.Warned > 0 {
+			report.TotalAffected += impact.Count
+			report.Users = append(report.Users, impact)
+		}
+		start = end
+	}
+
+	return report, nil
+}
+
+// runUser warns about or deactivates one user's candidate devices
+func (j *DeviceDeactivationJob) runUser(now time.Time, devices []*storage.StaleDevice, dryRun bool) (UserImpact, error) {
+	userID := devices[0].UserID
+	impact := UserImpact{UserID: userID}
+
+	var warn []*storage.StaleDevice
+	var due []string
+	for _, device := range devices {
+		deadline := device.LastActive.Add(time.Duration(device.AutoDeactivateDays) * 24 * time.Hour)
+		switch {
+		case device.WarnedAt == nil:
+			warn = append(warn, device)
+		case !now.Before(deadline) && !now.Before(device.WarnedAt.Add(DeviceWarningPeriod)):
+			due = append(due, device.ID)
+		}
+	}
+
+	impact.Warned = int64(len(warn))
+	if dryRun {
+		impact.DeviceIDs = due
+		impact.Count = int64(len(due))
+		return impact, nil
+	}
+
+	if len(warn) > 0 {
+		ids := make([]string, len(warn))
+		for i, device := range warn {
+			ids[i] = device.ID
+		}
+		if err := j.store.MarkDevicesWarned(ids, now); err != nil {
+			return impact, err
+		}
+		for _, device := range warn {
+			deadline := device.LastActive.Add(time.Duration(device.AutoDeactivateDays) * 24 * time.Hour)
+			j.notifier.DeviceInactive(device, latest(deadline, now.Add(DeviceWarningPeriod)))
+		}
+	}
+
+	if len(due) > 0 {
+		revoked, err := j.store.RevokeDevices(userID, due)
+		if err != nil {
+			return impact, err
+		}
+		if len(revoked) > 0 {
+			j.notifier.DevicesDeactivated(userID, revoked)
+		}
+		impact.DeviceIDs = revoked
+		impact.Count = int64(len(revoked))
+	}
+
+	return impact, nil
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
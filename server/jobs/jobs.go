@@ -0,0 +1,196 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+var ErrUnknownJob = errors.New("unknown job")
+
+// MetricLegalHoldSkipped counts users a destructive job left alone because
+// they are on legal hold
+const MetricLegalHoldSkipped = "jobs_legal_hold_skipped"
+
+// RunOptions are shared by every job. With DryRun set a job must only run
+// its estimate path: the same selection queries as a real run, no writes.
+type RunOptions struct {
+	DryRun     bool
+	UserID     string // Restrict the run to one user (empty = all users)
+	SampleSize int    // Max item UUIDs sampled per user in the report
+}
+
+// UserImpact is what a job did (or would do) to one user's data
+type UserImpact struct {
+	UserID          string   `json:"user_id"`
+	Zone            string   `json:"zone,omitempty"`
+	Count           int64    `json:"count"`
+	SampleItemUUIDs []string `json:"sample_item_uuids,omitempty"`
+	ItemUUIDs       []string `json:"item_uuids,omitempty"` // Every item affected (or that would be), for jobs audited item by item
+	DeviceIDs       []string `json:"device_ids,omitempty"` // Devices deactivated (or that would be)
+	Warned          int64    `json:"warned,omitempty"`     // Devices whose owner was warned
+	Stage           string   `json:"stage,omitempty"`      // Lifecycle stage entered (or that would be)
+}
+
+type Report struct {
+	ID            int64        `json:"id"`
+	Job           string       `json:"job"`
+	DryRun        bool         `json:"dry_run"`
+	StartedAt     time.Time    `json:"started_at"`
+	FinishedAt    time.Time    `json:"finished_at"`
+	TotalAffected int64        `json:"total_affected"`
+	Users         []UserImpact `json:"users"`
+	Error         string       `json:"error,omitempty"`
+}
+
+type Job interface {
+	Name() string
+	Run(ctx context.Context, opts RunOptions) (*Report, error)
+}
+
+// ReportStore persists run reports so dry runs can be reviewed later
+type ReportStore interface {
+	SaveJobReport(report *storage.JobReport) error
+}
+
+type Runner struct {
+	mu      sync.RWMutex
+	jobs    map[string]Job
+	reports ReportStore
+}
+
+func NewRunner(reports ReportStore) *Runner {
+	return &Runner{
+		jobs:    make(map[string]Job),
+		reports: reports,
+	}
+}
+
+func (r *Runner) Register(job Job) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.jobs[job.Name()] = job
+}
+
+// Jobs returns the registered job names, sorted
+func (r *Runner) Jobs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.jobs))
+	for name := range r.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run executes a job and persists its report, including failed runs
+func (r *Runner) Run(ctx context.Context, name string, opts RunOptions) (*Report, error) {
+	r.mu.RLock()
+	job, ok := r.jobs[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownJob, name)
+	}
+
+	if opts.SampleSize <= 0 {
+		opts.SampleSize = 10
+	}
+
+	startedAt := time.Now().UTC()
+	report, runErr := job.Run(ctx, opts)
+	if report == nil {
+		report = &Report{}
+	}
+	report.Job = name
+	report.DryRun = opts.DryRun
+	report.StartedAt = startedAt
+	report.FinishedAt = time.Now().UTC()
+	if runErr != nil {
+		report.Error = runErr.Error()
+	}
+
+	if r.reports != nil {
+		if err := r.saveReport(report); err != nil {
+			if runErr != nil {
+				return report, runErr
+			}
+			return report, fmt.Errorf("failed to save job report: %w", err)
+		}
+	}
+
+	return report, runErr
+}
+
+// Every runs a job on a fixed interval until ctx is cancelled. Failures are
+// logged and recorded in the job's report; the schedule keeps going.
+func (r *Runner) Every(ctx context.Context, name string, interval time.Duration, opts RunOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := r.Run(ctx, name, opts)
+			if err != nil {
+				log.Printf("❌ Scheduled job %s failed: %v", name, err)
+				continue
+			}
+			if report.TotalAffected > 0 {
+				log.Printf("⚠️  Scheduled job %s affected %d item(s)", name, report.TotalAffected)
+			}
+		}
+	}
+}
+
+func (r *Runner) saveReport(report *Report) error {
+	details, err := json.Marshal(report.Users)
+	if err != nil {
+		return err
+	}
+
+	row := &storage.JobReport{
+		JobName:       report.Job,
+		DryRun:        report.DryRun,
+		StartedAt:     report.StartedAt,
+		FinishedAt:    report.FinishedAt,
+		TotalAffected: report.TotalAffected,
+		Details:       details,
+		Error:         report.Error,
+	}
+	if err := r.reports.SaveJobReport(row); err != nil {
+		return err
+	}
+
+	report.ID = row.ID
+	return nil
+}
+
+// ReportFromStorage converts a persisted report back into its API shape
+func ReportFromStorage(row *storage.JobReport) (*Report, error) {
+	report := &Report{
+		ID:            row.ID,
+		Job:           row.JobName,
+		DryRun:        row.DryRun,
+		StartedAt:     row.StartedAt,
+		FinishedAt:    row.FinishedAt,
+		TotalAffected: row.TotalAffected,
+		Error:         row.Error,
+	}
+	if len(row.Details) > 0 {
+		if err := json.Unmarshal(row.Details, &report.Users); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
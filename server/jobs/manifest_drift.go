@@ -0,0 +1,152 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"log"
+
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+const ManifestDriftJobName = "manifest_drift_check"
+
+// Metric names emitted by the drift checker
+const (
+	MetricManifestDriftChecked  = "manifest_drift_checked"
+	MetricManifestDriftDetected = "manifest_drift_detected"
+	MetricManifestDriftRepaired = "manifest_drift_repaired"
+)
+
+type ManifestStore interface {
+	GetSyncState(userID, zone string) (*storage.SyncState, error)
+	ComputeManifest(ctx context.Context, userID, zone string) (*storage.ManifestState, error)
+	UpsertSyncState(userID, zone string, genCount int64, digest []byte) error
+}
+
+// ManifestCheck compares the stored sync_state digest with one recomputed
+// from the live items.
+type ManifestCheck struct {
+	UserID         string `json:"user_id"`
+	Zone           string `json:"zone"`
+	GenCount       int64  `json:"gencount"`
+	LeafCount      int    `json:"leaf_count"`
+	StoredDigest   []byte `json:"stored_digest"`
+	ComputedDigest []byte `json:"computed_digest"`
+	Drift          bool   `json:"drift"`
+	Repaired       bool   `json:"repaired"`
+}
+
+// CheckManifest detects digest drift for one user/zone and, when repair is
+// set, rewrites sync_state with the recomputed digest. The gencount is kept:
+// no record changed, only the summary of them was wrong.
+func CheckManifest(ctx context.Context, store ManifestStore, userID, zone string, repair bool) (*ManifestCheck, error) {
+	state, err := store.GetSyncState(userID, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	computed, err := store.ComputeManifest(ctx, userID, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	check := &ManifestCheck{
+		UserID:         userID,
+		Zone:           zone,
+		GenCount:       state.GenCount,
+		LeafCount:      computed.LeafCount,
+		StoredDigest:   state.Digest,
+		ComputedDigest: computed.Digest,
+	}
+
+	check.Drift = ManifestDrifted(state, computed)
+
+	metrics.Inc(MetricManifestDriftChecked)
+	if !check.Drift {
+		return check, nil
+	}
+	metrics.Inc(MetricManifestDriftDetected)
+
+	if repair {
+		if err := store.UpsertSyncState(userID, zone, state.GenCount, computed.Digest); err != nil {
+			return check, err
+		}
+		check.Repaired = true
+		metrics.Inc(MetricManifestDriftRepaired)
+	}
+
+	return check, nil
+}
+
+// ManifestDrifted reports whether a zone's stored digest disagrees with
+// the one recomputed from its live items
+func ManifestDrifted(state *storage.SyncState, computed *storage.ManifestState) bool {
+	// A zone that was never written has no digest and nothing to drift from
+	noState := state.Digest == nil && state.GenCount == 0
+	return !noState && !bytes.Equal(state.Digest, computed.Digest)
+}
+
+type ManifestDriftStore interface {
+	ManifestStore
+	SampleUserZones(fraction float64, limit int) ([]storage.UserZone, error)
+}
+
+// ManifestDriftJob checks a random sample of user zones for digest drift.
+// It only reports (and counts) drift; repairs go through the admin API so an
+// operator sees them. Both DryRun and real runs are read-only.
+type ManifestDriftJob struct {
+	store    ManifestDriftStore
+	fraction float64
+	limit    int
+}
+
+func NewManifestDriftJob(store ManifestDriftStore, fraction float64, limit int) *ManifestDriftJob {
+	if fraction <= 0 || fraction > 1 {
+		fraction = 0.01
+	}
+	if limit <= 0 {
+		limit = 500
+	}
+	return &ManifestDriftJob{store: store, fraction: fraction, limit: limit}
+}
+
+func (j *ManifestDriftJob) Name() string {
+	return ManifestDriftJobName
+}
+
+func (j *ManifestDriftJob) Run(ctx context.Context, opts RunOptions) (*Report, error) {
+	var pairs []storage.UserZone
+	if opts.UserID != "" {
+		pairs = []storage.UserZone{{UserID: opts.UserID, Zone: "default"}}
+	} else {
+		sampled, err := j.store.SampleUserZones(j.fraction, j.limit)
+		if err != nil {
+			return nil, err
+		}
+		pairs = sampled
+	}
+
+	report := &Report{Users: make([]UserImpact, 0)}
+	for _, pair := range pairs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		check, err := CheckManifest(ctx, j.store, pair.UserID, pair.Zone, false)
+		if err != nil {
+			log.Printf("❌ Manifest check failed for user=%s zone=%s: %v", pair.UserID, pair.Zone, err)
+			continue
+		}
+		if check.Drift {
+			report.TotalAffected++
+			report.Users = append(report.Users, UserImpact{
+				UserID: pair.UserID,
+				Zone:   pair.Zone,
+				Count:  1,
+			})
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,107 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+const OrphanedKeyJobName = "orphaned_key_reconcile"
+
+// DefaultOrphanedKeyMinAge is how long a key must have gone unchanged before
+// it can be tombstoned as orphaned, so a key a client pushed ahead of the
+// credential that will use it is left alone
+const DefaultOrphanedKeyMinAge = 24 * time.Hour
+
+type OrphanedKeyStore interface {
+	FindOrphanedKeys(ctx context.Context, olderThan time.Time, userID string) ([]*storage.OrphanedKeys, error)
+	TombstoneOrphanedKeys(ctx context.Context, userID, zone string, olderThan time.Time) (*storage.WipeResult, error)
+}
+
+// OrphanedKeyNotifier is told about the keys a run tombstoned. It is not
+// called on a dry run.
+type OrphanedKeyNotifier interface {
+	// KeysTombstoned runs after the zone's keys were tombstoned and its
+	// gencount and digest moved; it should make the user's devices pull
+	KeysTombstoned(userID, zone string, result *storage.WipeResult)
+}
+
+// OrphanedKeyJob tombstones crypto keys no live credential or sync record
+// refers to, each with a new gencount, so devices drop them on their next
+// pull. Its reports list every key, so a dry run can be audited key by key
+// before the job is scheduled.
+type OrphanedKeyJob struct {
+	store    OrphanedKeyStore
+	notifier OrphanedKeyNotifier
+	minAge   time.Duration
+	clock    clock.Clock
+}
+
+func NewOrphanedKeyJob(store OrphanedKeyStore, notifier OrphanedKeyNotifier, minAge time.Duration) *OrphanedKeyJob {
+	if minAge <= 0 {
+		minAge = DefaultOrphanedKeyMinAge
+	}
+	return &OrphanedKeyJob{store: store, notifier: notifier, minAge: minAge, clock: clock.System}
+}
+
+// SetClock replaces the clock key ages are measured from
+func (j *OrphanedKeyJob) SetClock(c clock.Clock) {
+	j.clock = c
+}
+
+func (j *OrphanedKeyJob) Name() string {
+	return OrphanedKeyJobName
+}
+
+func (j *OrphanedKeyJob) Run(ctx context.Context, opts RunOptions) (*Report, error) {
+	cutoff := j.clock.Now().UTC().Add(-j.minAge)
+
+	found, err := j.store.FindOrphanedKeys(ctx, cutoff, opts.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Users: make([]UserImpact, 0, len(found))}
+	for _, orphaned := range found {
+		// Held accounts are preserved as-is and left out of the report
+		if orphaned.LegalHold {
+			if !opts.DryRun {
+				metrics.Inc(MetricLegalHoldSkipped)
+			}
+			continue
+		}
+
+		impact := UserImpact{
+			UserID:    orphaned.UserID,
+			Zone:      orphaned.Zone,
+			Count:     int64(len(orphaned.ItemUUIDs)),
+			ItemUUIDs: orphaned.ItemUUIDs,
+		}
+
+		if !opts.DryRun {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			result, err := j.store.TombstoneOrphanedKeys(ctx, orphaned.UserID, orphaned.Zone, cutoff)
+			if err != nil {
+				return report, err
+			}
+			impact.Count = int64(len(result.Items))
+			impact.ItemUUIDs = make([]string, len(result.Items))
+			for i, item := range result.Items {
+				impact.ItemUUIDs[i] = item.ItemUUID.String()
+			}
+			if len(result.Items) > 0 && j.notifier != nil {
+				j.notifier.KeysTombstoned(orphaned.UserID, orphaned.Zone, result)
+			}
+		}
+
+		report.TotalAffected += impact.Count
+		report.Users = append(report.Users, impact)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,124 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+const PasswordHashUpgradeJobName = "password_hash_upgrade"
+
+// What the job did to an account, reported as UserImpact.Stage
+const (
+	HashUpgradeNotified = "notified"
+	HashUpgradeEnforced = "enforced"
+)
+
+type PasswordHashUpgradeStore interface {
+	FindHashUpgradeAccounts(userID string) ([]*storage.HashUpgradeAccount, error)
+	MarkHashUpgradeNotified(userID string, at time.Time) error
+	EnforceHashUpgrade(userID string, at time.Time) (bool, error)
+}
+
+// HashUpgradeNotifier tells users about the campaign. Neither method is
+// called on a dry run.
+type HashUpgradeNotifier interface {
+	// HashUpgradeRequested asks the user to log in before account.Deadline
+	HashUpgradeRequested(account *storage.HashUpgradeAccount)
+	// HashUpgradeEnforced runs after the user's refresh tokens were revoked
+	HashUpgradeEnforced(account *storage.HashUpgradeAccount)
+}
+
+// PasswordHashUpgradeJob carries out hash upgrade campaigns (see
+// storage.StartHashUpgradeCampaign): it notifies each flagged account, then
+// revokes the refresh tokens of those still on a deprecated hash after
+// their deadline, so their next login rehashes the password. An account is
+// never enforced in the run that notified it.
+type PasswordHashUpgradeJob struct {
+	store    PasswordHashUpgradeStore
+	notifier HashUpgradeNotifier
+	clock    clock.Clock
+}
+
+func NewPasswordHashUpgradeJob(store PasswordHashUpgradeStore, notifier HashUpgradeNotifier) *PasswordHashUpgradeJob {
+	return &PasswordHashUpgradeJob{store: store, notifier: notifier, clock: clock.System}
+}
+
+// SetClock replaces the clock deadlines are checked against
+func (j *PasswordHashUpgradeJob) SetClock(c clock.Clock) {
+	j.clock = c
+}
+
+func (j *PasswordHashUpgradeJob) Name() string {
+	return PasswordHashUpgradeJobName
+}
+
+func (j *PasswordHashUpgradeJob) Run(ctx context.Context, opts RunOptions) (*Report, error) {
+	now := j.clock.Now()
+	accounts, err := j.store.FindHashUpgradeAccounts(opts.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Users: []UserImpact{}}
+	for _, account := range accounts {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		var stage string
+		switch {
+		case account.NotifiedAt == nil:
+			stage = HashUpgradeNotified
+		case account.EnforcedAt == nil && !now.Before(*account.Deadline):
+			stage = HashUpgradeEnforced
+		default:
+			continue
+		}
+
+		if !opts.DryRun {
+			done, err := j.apply(account, stage, now)
+			if err != nil {
+				return report, err
+			}
+			if !done {
+				continue
+			}
+		}
+		impact := UserImpact{UserID: account.UserID, Stage: stage}
+		if stage == HashUpgradeEnforced {
+			impact.Count = 1
+			report.TotalAffected++
+		}
+		report.Users = append(report.Users, impact)
+	}
+
+	return report, nil
+}
+
+// apply notifies or enforces. It returns false when the account upgraded,
+// or was deleted, since it was read.
+func (j *PasswordHashUpgradeJob) apply(account *storage.HashUpgradeAccount, stage string, now time.Time) (bool, error) {
+	if stage == HashUpgradeNotified {
+		err := j.store.MarkHashUpgradeNotified(account.UserID, now)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		j.notifier.HashUpgradeRequested(account)
+		return true, nil
+	}
+
+	enforced, err := j.store.EnforceHashUpgrade(account.UserID, now)
+	if err != nil || !enforced {
+		return false, err
+	}
+	j.notifier.HashUpgradeEnforced(account)
+	return true, nil
+}
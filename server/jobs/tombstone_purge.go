@@ -0,0 +1,85 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+const TombstonePurgeJobName = "tombstone_purge"
+
+// DefaultTombstoneRetention is how long tombstones are kept so offline
+// devices can still learn about deletions.
+const DefaultTombstoneRetention = 90 * 24 * time.Hour
+
+type TombstonePurgeStore interface {
+	FindPurgeableTombstones(olderThan time.Time, userID string, sampleSize int) ([]*storage.TombstoneSummary, error)
+	PurgeTombstones(userID, zone string, olderThan time.Time) (int64, error)
+}
+
+// TombstonePurgeJob hard-deletes tombstones older than the retention window
+type TombstonePurgeJob struct {
+	store     TombstonePurgeStore
+	retention time.Duration
+	now       func() time.Time
+}
+
+func NewTombstonePurgeJob(store TombstonePurgeStore, retention time.Duration) *TombstonePurgeJob {
+	if retention <= 0 {
+		retention = DefaultTombstoneRetention
+	}
+	return &TombstonePurgeJob{
+		store:     store,
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+func (j *TombstonePurgeJob) Name() string {
+	return TombstonePurgeJobName
+}
+
+func (j *TombstonePurgeJob) Run(ctx context.Context, opts RunOptions) (*Report, error) {
+	cutoff := j.now().UTC().Add(-j.retention)
+
+	summaries, err := j.store.FindPurgeableTombstones(cutoff, opts.UserID, opts.SampleSize)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Users: make([]UserImpact, 0, len(summaries))}
+	for _, summary := range summaries {
+		// Held accounts are preserved as-is and left out of the report
+		if summary.LegalHold {
+			if !opts.DryRun {
+				metrics.Inc(MetricLegalHoldSkipped)
+			}
+			continue
+		}
+
+		impact := UserImpact{
+			UserID:          summary.UserID,
+			Zone:            summary.Zone,
+			Count:           summary.Count,
+			SampleItemUUIDs: summary.SampleItemUUIDs,
+		}
+
+		if !opts.DryRun {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			purged, err := j.store.PurgeTombstones(summary.UserID, summary.Zone, cutoff)
+			if err != nil {
+				return report, err
+			}
+			impact.Count = purged
+		}
+
+		report.TotalAffected += impact.Count
+		report.Users = append(report.Users, impact)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,73 @@
+// Package mail sends the server's emails to account owners. Without SMTP
+// configured messages are only logged, so nothing depending on them fails
+// in development.
+package mail
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// FromEnv returns an SMTPMailer for SMTP_ADDR (host:port) sending as
+// SMTP_FROM, authenticating with SMTP_USERNAME and SMTP_PASSWORD when set,
+// or a LogMailer when SMTP_ADDR is unset
+func FromEnv() Mailer {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return LogMailer{}
+	}
+
+	mailer := &SMTPMailer{Addr: addr, From: os.Getenv("SMTP_FROM")}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		mailer.Auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return mailer
+}
+
+// LogMailer logs who would have been sent what
+type LogMailer struct{}
+
+func (LogMailer) Send(_ context.Context, msg Message) error {
+	log.Printf("📧 Email not sent (SMTP_ADDR unset): to=%s, subject=%q", msg.To, msg.Subject)
+	return nil
+}
+
+// SMTPMailer sends through an SMTP relay
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth // nil for relays that don't authenticate
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{msg.To}, Format(m.From, msg))
+}
+
+// Format renders a message with its headers. Header values lose any line
+// breaks so a subject or address can't add headers of its own.
+func Format(from string, msg Message) []byte {
+	header := strings.NewReplacer("\r", "", "\n", "")
+	return []byte(fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		header.Replace(from), header.Replace(msg.To), header.Replace(msg.Subject),
+		strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n")))
+}
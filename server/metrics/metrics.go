@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+	"time"
+)
+
+// Process-wide counters published through expvar under "password_sync".
+// They are exposed to operators at /api/v1/admin/metrics.
+var counters = expvar.NewMap("password_sync")
+
+// Inc increments a named counter by one
+func Inc(name string) {
+	counters.Add(name, 1)
+}
+
+// Add increments a named counter by delta
+func Add(name string, delta int64) {
+	counters.Add(name, delta)
+}
+
+// Set overwrites a named gauge
+func Set(name string, value int64) {
+	v := new(expvar.Int)
+	v.Set(value)
+	counters.Set(name, v)
+}
+
+// Value returns the current value of a counter or gauge (0 if unset)
+func Value(name string) int64 {
+	if v, ok := counters.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// Handler serves all expvar variables as JSON
+func Handler() http.Handler {
+	return expvar.Handler()
+}
+
+// Observe records one timed run of name: "<name>_count" and
+// "<name>_ms_total" give the average, "<name>_last_ms" the latest
+func Observe(name string, d time.Duration) {
+	Inc(name + "_count")
+	Add(name+"_ms_total", d.Milliseconds())
+	Set(name+"_last_ms", d.Milliseconds())
+}
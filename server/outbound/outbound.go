@@ -0,0 +1,44 @@
+// Package outbound is the HTTP client for calls from the server to third
+// parties (captcha providers and the like), so timeouts and identification
+// are configured in one place.
+package outbound
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/version"
+)
+
+// DefaultTimeout bounds a whole outbound request, body included
+const DefaultTimeout = 10 * time.Second
+
+var client = New(http.DefaultTransport)
+
+// Client returns the shared outbound client
+func Client() *http.Client {
+	return client
+}
+
+// New builds an outbound client on top of transport; tests pass the
+// transport of an httptest server
+func New(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Timeout:   DefaultTimeout,
+		Transport: userAgent{next: transport},
+	}
+}
+
+// userAgent identifies the server on every request that doesn't set its own
+type userAgent struct {
+	next http.RoundTripper
+}
+
+func (t userAgent) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") != "" {
+		return t.next.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", version.ServerHeader())
+	return t.next.RoundTrip(req)
+}
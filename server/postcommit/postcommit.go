@@ -0,0 +1,153 @@
+// Package postcommit runs the work that follows a committed write, such as
+// manifest digest maintenance and event dispatch, off the request path.
+// The write is already durable when this work starts, so its failures are
+// logged and counted, never reported to the client.
+package postcommit
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/metrics"
+)
+
+const (
+	DefaultWorkers = 4
+	DefaultDepth   = 256 // Queued tasks per worker
+	DefaultTimeout = 10 * time.Second
+)
+
+// Metric names published through the metrics package. Each stage also
+// reports its latency as "stage_<name>" (see metrics.Observe).
+const (
+	MetricDeferred = "postcommit_deferred"     // Tasks handed to a worker
+	MetricInline   = "postcommit_inline"       // Tasks the caller ran because the queue was full
+	MetricFailed   = "postcommit_stage_failed" // Stages that failed, timed out or panicked
+)
+
+// Stage is one step of post-commit work. Run must honour ctx, which expires
+// after the stage's timeout.
+type Stage struct {
+	Name    string
+	Timeout time.Duration // 0 means DefaultTimeout
+	Run     func(ctx context.Context) error
+}
+
+// Queue is a fixed set of workers with bounded queues. Work is sharded by
+// key, so tasks for one key (a user's zone) run in submission order.
+type Queue struct {
+	mu      sync.RWMutex
+	workers []chan []Stage
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// NewQueue starts workers goroutines, each queueing up to depth tasks
+func NewQueue(workers, depth int) *Queue {
+	q := &Queue{workers: make([]chan []Stage, workers)}
+	for i := range q.workers {
+		q.workers[i] = make(chan []Stage, depth)
+		q.wg.Add(1)
+		go q.work(q.workers[i])
+	}
+	return q
+}
+
+// Submit queues the stages behind any earlier work for key and reports
+// whether it did. When the worker's queue is full, or the queue is closed,
+// it returns false and the caller runs the stages itself with Run.
+func (q *Queue) Submit(key string, stages ...Stage) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false
+	}
+
+	select {
+	case q.workers[q.shard(key)] <- stages:
+		metrics.Inc(MetricDeferred)
+		return true
+	default:
+		return false
+	}
+}
+
+// Dispatch submits the stages, or runs them before returning when they
+// can't be queued, so nothing is dropped under load. It reports whether the
+// work was deferred. A nil Queue runs everything inline.
+func (q *Queue) Dispatch(key string, stages ...Stage) bool {
+	if q != nil && q.Submit(key, stages...) {
+		return true
+	}
+	metrics.Inc(MetricInline)
+	Run(stages...)
+	return false
+}
+
+// Close stops accepting work and waits for queued work to finish
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	for _, worker := range q.workers {
+		close(worker)
+	}
+	q.mu.Unlock()
+
+	q.wg.Wait()
+}
+
+func (q *Queue) shard(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(q.workers)))
+}
+
+func (q *Queue) work(tasks <-chan []Stage) {
+	defer q.wg.Done()
+	for stages := range tasks {
+		Run(stages...)
+	}
+}
+
+// Run runs the stages in order, each under its own timeout. A failed stage
+// does not stop the ones after it: each depends on the committed write,
+// not on the stages before it.
+func Run(stages ...Stage) {
+	for _, stage := range stages {
+		runStage(stage)
+	}
+}
+
+func runStage(stage Stage) {
+	timeout := stage.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return stage.Run(ctx)
+	}()
+	metrics.Observe("stage_"+stage.Name, time.Since(start))
+
+	if err != nil {
+		metrics.Inc(MetricFailed)
+		metrics.Inc("stage_" + stage.Name + "_failed")
+		log.Printf("⚠️  Post-commit stage %s failed: %v", stage.Name, err)
+	}
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/google/uuid"
+)
+
+// Audit actions recorded by the services and handlers
+const (
+	AuditActionRegister       = "auth.register"
+	AuditActionLogin          = "auth.login"
+	AuditActionLoginFailed    = "auth.login_failed"
+	AuditActionAccountLocked  = "auth.account_locked"
+	AuditActionRefresh        = "auth.refresh"
+	AuditActionLogout         = "auth.logout"
+	AuditActionSyncPush       = "sync.push"
+	AuditActionSyncPull       = "sync.pull"
+	AuditActionSyncSnapshot   = "sync.snapshot"
+	AuditActionSyncExport     = "sync.export"
+	AuditActionSyncImport     = "sync.import"
+	AuditActionSyncDeleteAll  = "sync.delete_all"
+	AuditActionSyncDeleteItem = "sync.credential_delete"
+	AuditActionSyncUndoWipe   = "sync.undo_wipe"
+	AuditActionSyncIntegrity  = "sync.integrity_check"
+	AuditActionSyncResolve    = "sync.conflict_resolve"
+	AuditActionOrphanedKeys   = "sync.orphaned_keys_tombstone"
+	AuditActionZoneCreate     = "sync.zone_create"
+	AuditActionItemPush       = "item.push"
+	AuditActionItemTombstone  = "item.tombstone"
+	AuditActionDeviceAdd      = "device.register"
+	AuditActionDeviceRevoke   = "device.revoke"
+	AuditActionDeviceInactive = "device.inactivity_warning"
+	AuditActionDeviceTrust    = "device.trust_change"
+	AuditActionDeviceCaps     = "device.capabilities_update"
+	AuditActionDeviceRename   = "device.rename"
+	AuditActionSettings       = "account.settings_update"
+	AuditActionInactivityWarn = "account.inactivity_warning"
+	AuditActionDormant        = "account.dormant"
+	AuditActionDeletionWarn   = "account.deletion_warning"
+	AuditActionDeletionQueued = "account.deletion_queued"
+	AuditActionActiveAgain    = "account.inactivity_cleared"
+	AuditActionHashUpgradeAsk = "account.password_upgrade_requested"
+	AuditActionHashUpgradeDue = "account.password_upgrade_enforced"
+	AuditActionPasswordRehash = "auth.password_rehash"
+	AuditActionPasswordChange = "auth.password_change"
+	AuditActionResetRequest   = "auth.password_reset_requested"
+	AuditActionPasswordReset  = "auth.password_reset"
+	AuditActionAuditExport    = "audit.export"
+	AuditActionManifestFix    = "admin.manifest_repair"
+	AuditActionUserDisable    = "admin.user_deactivate"
+	AuditActionUserEnable     = "admin.user_activate"
+	AuditActionTokenRevoke    = "admin.token_revoke"
+	AuditActionTierChange     = "admin.tier_change"
+	AuditActionLegalHold      = "admin.legal_hold"
+	AuditActionBackup         = "admin.backup"
+	AuditActionRegionMigrate  = "admin.region_migrate"
+	AuditActionDiagnostics    = "admin.diagnostics"
+)
+
+// Auditor stores audit events
+type Auditor interface {
+	RecordAuditEvents(events []*storage.AuditEvent) error
+}
+
+// AuditEvent builds an audit event for userID on behalf of the caller, who
+// is recorded as the actor when acting on another account
+func (c Caller) AuditEvent(userID, action string) *storage.AuditEvent {
+	event := &storage.AuditEvent{
+		UserID:    userID,
+		Action:    action,
+		IPAddress: c.IP,
+	}
+	if c.UserID != "" && c.UserID != userID {
+		actor := c.UserID
+		event.ActorID = &actor
+	}
+	if c.DeviceID != "" {
+		device := c.DeviceID
+		event.DeviceID = &device
+	}
+	return event
+}
+
+// RecordAudit writes audit events, logging (not failing the call) on error
+func RecordAudit(auditor Auditor, events ...*storage.AuditEvent) {
+	if err := auditor.RecordAuditEvents(events); err != nil {
+		log.Printf("❌ Failed to record audit event: %v", err)
+	}
+}
+
+// AuditDetails encodes an audit event's details
+func AuditDetails(details map[string]interface{}) []byte {
+	data, err := json.Marshal(details)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// ItemAuditEvent builds an item-level audit row for a write to one layer
+func (c Caller) ItemAuditEvent(userID, zone string, itemID uuid.UUID, layer string, genCount int64, tombstone bool) *storage.AuditEvent {
+	action := AuditActionItemPush
+	if tombstone {
+		action = AuditActionItemTombstone
+	}
+
+	event := c.AuditEvent(userID, action)
+	event.Zone = &zone
+	item := itemID.String()
+	event.ItemUUID = &item
+	event.Details = AuditDetails(map[string]interface{}{"layer": layer, "gencount": genCount})
+	return event
+}
@@ -0,0 +1,460 @@
+// Package auth registers accounts and issues their tokens
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/mail"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/google/uuid"
+)
+
+// RefreshTokenTTL is how long a refresh token stays valid
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+// Store is the storage the service needs
+type Store interface {
+	service.Auditor
+	service.DeviceTrustReader
+	HasRegion(region string) bool
+	GetUserByEmail(email string) (*storage.User, error)
+	GetUserByID(id string) (*storage.User, error)
+	DeleteUserCascade(ctx context.Context, id string) error
+	CreateUser(email string, passwordHash, salt []byte, region string) (*storage.User, error)
+	CreateUserWithZone(email string, passwordHash, salt []byte, region string, bootstrap *sync.ZoneBootstrap) (*storage.User, error)
+	CreateRefreshToken(userID string, deviceID *string, expiresAt time.Time) (*storage.RefreshToken, error)
+	GetRefreshToken(token string) (*storage.RefreshToken, error)
+	RevokeRefreshToken(token string) error
+	RevokeRefreshTokensByUser(userID string) (int64, error)
+	SetDeviceMaxEncVersion(userID, deviceID string, version int) error
+	TouchUser(userID string, at time.Time) (string, error)
+	UpgradePasswordHash(userID string, hash []byte, version int) error
+	UpdateUserPassword(userID string, hash, salt []byte, version int) (int64, error)
+	IncrementFailedLogin(userID string, threshold int, lockUntil time.Time) (*time.Time, error)
+	ResetFailedLogin(userID string) error
+	IsLocked(userID string, at time.Time) (bool, time.Time, error)
+	CreatePasswordResetToken(userID string, tokenHash []byte, expiresAt time.Time) error
+	ConsumePasswordResetToken(tokenHash []byte, at time.Time) (string, error)
+}
+
+type Service struct {
+	store   Store
+	clock   clock.Clock
+	lockout LockoutPolicy
+	mailer  mail.Mailer
+	deleted []func(user *storage.User)
+}
+
+func NewService(store Store) *Service {
+	return &Service{store: store, clock: clock.System, lockout: DefaultLockoutPolicy(), mailer: mail.LogMailer{}}
+}
+
+// SetMailer replaces what sends password reset emails; they are only
+// logged by default
+func (s *Service) SetMailer(m mail.Mailer) {
+	s.mailer = m
+}
+
+// SetClock replaces the clock used for refresh token expiry
+func (s *Service) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// OnAccountDeleted registers fn to run after DeleteAccount deleted the
+// account of user, e.g. to close its connections and drop what other
+// caches keep of it
+func (s *Service) OnAccountDeleted(fn func(user *storage.User)) {
+	s.deleted = append(s.deleted, fn)
+}
+
+// Tokens are the credentials of a session
+type Tokens struct {
+	AccessToken  string
+	RefreshToken string
+}
+
+type RegisterInput struct {
+	Email     string
+	Password  string
+	Region    string            // storage.DefaultRegion when empty
+	Bootstrap *service.ZoneSpec // Create a first zone with the account
+}
+
+type RegisterResult struct {
+	User   *storage.User
+	Region string
+	Zone   *sync.ZoneBootstrap // nil without a bootstrap
+	Tokens
+}
+
+// Register creates an account, with its first zone when asked to
+func (s *Service) Register(ctx context.Context, caller service.Caller, in RegisterInput) (*RegisterResult, error) {
+	if in.Region == "" {
+		in.Region = storage.DefaultRegion
+	}
+	if !s.store.HasRegion(in.Region) {
+		return nil, service.CodedError(service.KindInvalid, "unknown_region", "unknown region: "+in.Region, nil)
+	}
+
+	// Check if user already exists
+	existingUser, _ := s.store.GetUserByEmail(in.Email)
+	if existingUser != nil {
+		return nil, service.CodedError(service.KindConflict, "email_exists", "user already exists", nil)
+	}
+
+	// Validate the bootstrap block before creating anything
+	var bootstrap *sync.ZoneBootstrap
+	if in.Bootstrap != nil {
+		var err error
+		bootstrap, err = in.Bootstrap.Bootstrap(uuid.Nil.String())
+		if err != nil {
+			if zoneErr := service.ZoneError(err); zoneErr != nil {
+				return nil, zoneErr
+			}
+			return nil, &service.Error{Kind: service.KindInternal, Message: "failed to bootstrap zone", Err: err}
+		}
+	}
+
+	// Generate salt and hash password
+	salt, err := auth.GenerateSalt()
+	if err != nil {
+		return nil, &service.Error{Kind: service.KindInternal, Message: "failed to generate salt", Err: err}
+	}
+
+	passwordHash := auth.HashPassword(in.Password, salt)
+
+	// Create user, together with their first zone if requested
+	var user *storage.User
+	if bootstrap != nil {
+		user, err = s.store.CreateUserWithZone(in.Email, passwordHash, salt, in.Region, bootstrap)
+	} else {
+		user, err = s.store.CreateUser(in.Email, passwordHash, salt, in.Region)
+	}
+	if errors.Is(err, storage.ErrEmailTaken) {
+		return nil, service.CodedError(service.KindConflict, "email_exists", "user already exists", nil)
+	}
+	if err != nil {
+		return nil, &service.Error{Kind: service.KindInternal, Message: "failed to create user", Err: err}
+	}
+
+	tokens, err := s.issueTokens(user, "", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*storage.AuditEvent{caller.AuditEvent(user.ID, service.AuditActionRegister)}
+	if bootstrap != nil {
+		zoneEvent := caller.AuditEvent(user.ID, service.AuditActionZoneCreate)
+		zoneEvent.Zone = &bootstrap.Manifest.Zone
+		zoneEvent.Details = service.AuditDetails(map[string]interface{}{"template": bootstrap.Template})
+		events = append(events, zoneEvent)
+	}
+	service.RecordAudit(s.store, events...)
+
+	return &RegisterResult{User: user, Region: in.Region, Zone: bootstrap, Tokens: *tokens}, nil
+}
+
+type LoginInput struct {
+	Email    string
+	Password string
+	DeviceID string
+	// Highest enc_version the device can decrypt, recorded on its devices row
+	MaxEncVersion int
+}
+
+type LoginResult struct {
+	User *storage.User
+	Tokens
+}
+
+// Login checks a password and starts a session, upgrading a password hash
+// in a deprecated format on the way. A locked account (see LockoutPolicy)
+// is refused before its password is checked.
+func (s *Service) Login(ctx context.Context, caller service.Caller, in LoginInput) (*LoginResult, error) {
+	user, err := s.store.GetUserByEmail(in.Email)
+	if err != nil {
+		return nil, service.NewError(service.KindUnauthorized, "invalid credentials")
+	}
+
+	now := s.clock.Now()
+	locked, lockedUntil, err := s.store.IsLocked(user.ID, now)
+	if err != nil {
+		return nil, service.Internal("failed to check account lockout", err)
+	}
+	if locked {
+		return nil, accountLocked(lockedUntil, now)
+	}
+
+	if !auth.VerifyPassword(in.Password, user.Salt, user.PasswordHash, user.HashVersion) {
+		service.RecordAudit(s.store, caller.AuditEvent(user.ID, service.AuditActionLoginFailed))
+		return nil, s.failedLogin(caller, user.ID, now)
+	}
+
+	if !user.IsActive {
+		return nil, service.NewError(service.KindForbidden, auth.ErrAccountInactive.Error())
+	}
+	// The token vouches for the device it names, so it must be theirs
+	if in.DeviceID != "" {
+		if err := service.CheckTokenDevice(ctx, s.store, user.ID, in.DeviceID); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.store.ResetFailedLogin(user.ID); err != nil {
+		log.Printf("⚠️  Failed to reset failed logins of user %s: %v", user.ID, err)
+	}
+	s.upgradePasswordHash(caller, user, in.Password)
+
+	var deviceID *string
+	if in.DeviceID != "" {
+		deviceID = &in.DeviceID
+	}
+	tokens, err := s.issueTokens(user, in.DeviceID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.DeviceID != "" && in.MaxEncVersion > 0 {
+		if err := s.store.SetDeviceMaxEncVersion(user.ID, in.DeviceID, in.MaxEncVersion); err != nil {
+			log.Printf("⚠️  Failed to record max enc_version for device %s: %v", in.DeviceID, err)
+		}
+	}
+
+	s.touch(caller, user.ID)
+	service.RecordAudit(s.store, caller.AuditEvent(user.ID, service.AuditActionLogin))
+
+	return &LoginResult{User: user, Tokens: *tokens}, nil
+}
+
+// Refresh rotates a refresh token, issuing a new access token with it
+func (s *Service) Refresh(ctx context.Context, caller service.Caller, refreshToken string) (*Tokens, error) {
+	token, err := s.store.GetRefreshToken(refreshToken)
+	if err != nil {
+		return nil, service.NewError(service.KindUnauthorized, "invalid refresh token")
+	}
+
+	if token.Revoked || s.clock.Now().After(token.ExpiresAt) {
+		return nil, service.NewError(service.KindUnauthorized, "refresh token expired or revoked")
+	}
+
+	user, err := s.store.GetUserByID(token.UserID)
+	if err != nil {
+		return nil, service.NewError(service.KindUnauthorized, "user not found")
+	}
+
+	if !user.IsActive {
+		return nil, service.NewError(service.KindForbidden, auth.ErrAccountInactive.Error())
+	}
+
+	deviceID := ""
+	if token.DeviceID != nil {
+		deviceID = *token.DeviceID
+		if err := service.CheckTokenDevice(ctx, s.store, user.ID, deviceID); err != nil {
+			return nil, err
+		}
+	}
+
+	accessToken, err := auth.GenerateAccessToken(user.ID, user.Email, deviceID, user.TokenVersion)
+	if err != nil {
+		return nil, &service.Error{Kind: service.KindInternal, Message: "failed to generate token", Err: err}
+	}
+
+	if err := s.store.RevokeRefreshToken(refreshToken); err != nil {
+		return nil, &service.Error{Kind: service.KindInternal, Message: "failed to revoke old token", Err: err}
+	}
+
+	newRefreshToken, err := s.store.CreateRefreshToken(user.ID, token.DeviceID, s.clock.Now().Add(RefreshTokenTTL))
+	if err != nil {
+		return nil, &service.Error{Kind: service.KindInternal, Message: "failed to create refresh token", Err: err}
+	}
+
+	s.touch(caller, user.ID)
+	service.RecordAudit(s.store, caller.AuditEvent(user.ID, service.AuditActionRefresh))
+
+	return &Tokens{AccessToken: accessToken, RefreshToken: newRefreshToken.Token}, nil
+}
+
+type LogoutInput struct {
+	RefreshToken string
+	AllDevices   bool // Revoke every refresh token of the user, not just this one
+}
+
+// Logout revokes a refresh token so it can no longer be used to refresh.
+// Logging out twice is not an error, but signing out every device takes a
+// token that is still valid.
+func (s *Service) Logout(ctx context.Context, caller service.Caller, in LogoutInput) error {
+	token, err := s.store.GetRefreshToken(in.RefreshToken)
+	if err != nil {
+		return service.NewError(service.KindUnauthorized, "invalid refresh token")
+	}
+
+	if !in.AllDevices {
+		if token.Revoked {
+			return nil
+		}
+		if err := s.store.RevokeRefreshToken(in.RefreshToken); err != nil {
+			return &service.Error{Kind: service.KindInternal, Message: "failed to revoke token", Err: err}
+		}
+		service.RecordAudit(s.store, caller.AuditEvent(token.UserID, service.AuditActionLogout))
+		return nil
+	}
+
+	if token.Revoked || s.clock.Now().After(token.ExpiresAt) {
+		return service.NewError(service.KindUnauthorized, "refresh token expired or revoked")
+	}
+	_, err = s.RevokeSessions(ctx, caller, token.UserID)
+	return err
+}
+
+// RevokeSessions revokes every refresh token of a user, signing all their
+// devices out once their access tokens expire; for a logout from every
+// device. ChangePassword does the same along with the change. It returns
+// how many were revoked.
+func (s *Service) RevokeSessions(ctx context.Context, caller service.Caller, userID string) (int64, error) {
+	revoked, err := s.store.RevokeRefreshTokensByUser(userID)
+	if err != nil {
+		return 0, &service.Error{Kind: service.KindInternal, Message: "failed to revoke tokens", Err: err}
+	}
+
+	event := caller.AuditEvent(userID, service.AuditActionLogout)
+	event.Details = service.AuditDetails(map[string]interface{}{"all_devices": true, "revoked": revoked})
+	service.RecordAudit(s.store, event)
+	return revoked, nil
+}
+
+type ChangePasswordInput struct {
+	CurrentPassword string
+	NewPassword     string
+}
+
+// ChangePassword replaces the caller's password and revokes every token of
+// the account, access tokens included, signing out their other devices.
+// The caller gets a fresh pair so their own session carries on.
+func (s *Service) ChangePassword(ctx context.Context, caller service.Caller, in ChangePasswordInput) (*Tokens, error) {
+	user, err := s.store.GetUserByID(caller.UserID)
+	if err != nil {
+		return nil, service.NewError(service.KindUnauthorized, "user not found")
+	}
+	if !user.IsActive {
+		return nil, service.NewError(service.KindForbidden, auth.ErrAccountInactive.Error())
+	}
+	if !auth.VerifyPassword(in.CurrentPassword, user.Salt, user.PasswordHash, user.HashVersion) {
+		service.RecordAudit(s.store, caller.AuditEvent(user.ID, service.AuditActionLoginFailed))
+		return nil, service.CodedError(service.KindForbidden, "invalid_current_password", "current password is incorrect", nil)
+	}
+
+	salt, err := auth.GenerateSalt()
+	if err != nil {
+		return nil, &service.Error{Kind: service.KindInternal, Message: "failed to generate salt", Err: err}
+	}
+	hash := auth.HashPassword(in.NewPassword, salt)
+	revoked, err := s.store.UpdateUserPassword(user.ID, hash, salt, auth.CurrentHashVersion)
+	if err != nil {
+		return nil, &service.Error{Kind: service.KindInternal, Message: "failed to update password", Err: err}
+	}
+	// Reread for the bumped token version the new access token must carry
+	user, err = s.store.GetUserByID(user.ID)
+	if err != nil {
+		return nil, service.Internal("failed to load user", err)
+	}
+
+	var deviceID *string
+	if caller.DeviceID != "" {
+		deviceID = &caller.DeviceID
+	}
+	tokens, err := s.issueTokens(user, caller.DeviceID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	event := caller.AuditEvent(user.ID, service.AuditActionPasswordChange)
+	event.Details = service.AuditDetails(map[string]interface{}{"revoked": revoked})
+	service.RecordAudit(s.store, event)
+	return tokens, nil
+}
+
+// DeleteAccount deletes the caller's account and everything it holds, once
+// they confirmed it with their password. An account on legal hold is kept.
+// The audit trail goes with the account, so the deletion is only logged.
+func (s *Service) DeleteAccount(ctx context.Context, caller service.Caller, password string) error {
+	user, err := s.store.GetUserByID(caller.UserID)
+	if err != nil {
+		return service.NewError(service.KindUnauthorized, "user not found")
+	}
+	if !auth.VerifyPassword(password, user.Salt, user.PasswordHash, user.HashVersion) {
+		service.RecordAudit(s.store, caller.AuditEvent(user.ID, service.AuditActionLoginFailed))
+		return service.CodedError(service.KindForbidden, "invalid_current_password", "password is incorrect", nil)
+	}
+	if user.LegalHold {
+		return service.CodedError(service.KindLocked, "legal_hold", "account on hold", nil)
+	}
+
+	err = s.store.DeleteUserCascade(ctx, user.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Put on hold since it was read
+		return service.CodedError(service.KindLocked, "legal_hold", "account on hold", nil)
+	}
+	if err != nil {
+		return service.Internal("failed to delete account", err)
+	}
+	log.Printf("🗑️  Deleted account %s at its owner's request", user.ID)
+	for _, fn := range s.deleted {
+		fn(user)
+	}
+	return nil
+}
+
+// issueTokens generates an access token with the device claim and a
+// refresh token bound to deviceID
+func (s *Service) issueTokens(user *storage.User, deviceClaim string, deviceID *string) (*Tokens, error) {
+	accessToken, err := auth.GenerateAccessToken(user.ID, user.Email, deviceClaim, user.TokenVersion)
+	if err != nil {
+		return nil, &service.Error{Kind: service.KindInternal, Message: "failed to generate token", Err: err}
+	}
+
+	refreshToken, err := s.store.CreateRefreshToken(user.ID, deviceID, s.clock.Now().Add(RefreshTokenTTL))
+	if err != nil {
+		return nil, &service.Error{Kind: service.KindInternal, Message: "failed to create refresh token", Err: err}
+	}
+	return &Tokens{AccessToken: accessToken, RefreshToken: refreshToken.Token}, nil
+}
+
+// touch records the login or refresh that keeps an account out of the
+// inactivity lifecycle, auditing the return of one that was in it
+func (s *Service) touch(caller service.Caller, userID string) {
+	previous, err := s.store.TouchUser(userID, s.clock.Now())
+	if err != nil {
+		log.Printf("⚠️  Failed to record activity of user %s: %v", userID, err)
+		return
+	}
+	if previous != storage.InactivityActive {
+		event := caller.AuditEvent(userID, service.AuditActionActiveAgain)
+		event.Details = service.AuditDetails(map[string]interface{}{"from": previous})
+		service.RecordAudit(s.store, event)
+	}
+}
+
+// upgradePasswordHash rehashes the password of a user who just logged in
+// with a hash in a deprecated format. Failures are logged; the login
+// succeeded and the next one tries again.
+func (s *Service) upgradePasswordHash(caller service.Caller, user *storage.User, password string) {
+	if !auth.HashDeprecated(user.HashVersion) {
+		return
+	}
+	hash := auth.HashPassword(password, user.Salt)
+	if err := s.store.UpgradePasswordHash(user.ID, hash, auth.CurrentHashVersion); err != nil {
+		log.Printf("⚠️  Failed to upgrade password hash of user %s: %v", user.ID, err)
+		return
+	}
+
+	event := caller.AuditEvent(user.ID, service.AuditActionPasswordRehash)
+	event.Details = service.AuditDetails(map[string]interface{}{"from": user.HashVersion, "to": auth.CurrentHashVersion})
+	service.RecordAudit(s.store, event)
+}
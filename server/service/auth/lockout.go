@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"log"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/service"
+)
+
+const (
+	DefaultLockoutAttempts = 10
+	DefaultLockoutDuration = 15 * time.Minute
+)
+
+// LockoutPolicy locks an account once Attempts wrong passwords in a row
+// were tried on it: logins are refused for Duration, even with the right
+// password. The lockout also ends with a password change from a session
+// the user still has.
+type LockoutPolicy struct {
+	Attempts int
+	Duration time.Duration
+}
+
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{Attempts: DefaultLockoutAttempts, Duration: DefaultLockoutDuration}
+}
+
+// SetLockout replaces the lockout policy; zero fields keep their default
+func (s *Service) SetLockout(policy LockoutPolicy) {
+	if policy.Attempts <= 0 {
+		policy.Attempts = DefaultLockoutAttempts
+	}
+	if policy.Duration <= 0 {
+		policy.Duration = DefaultLockoutDuration
+	}
+	s.lockout = policy
+}
+
+// failedLogin counts a wrong password. It returns the error the login
+// answers with: account_locked for the attempt that locks the account.
+func (s *Service) failedLogin(caller service.Caller, userID string, now time.Time) error {
+	invalid := service.NewError(service.KindUnauthorized, "invalid credentials")
+	lockedUntil, err := s.store.IncrementFailedLogin(userID, s.lockout.Attempts, now.Add(s.lockout.Duration))
+	if err != nil {
+		log.Printf("⚠️  Failed to count failed login of user %s: %v", userID, err)
+		return invalid
+	}
+	if lockedUntil == nil || !lockedUntil.After(now) {
+		return invalid
+	}
+
+	event := caller.AuditEvent(userID, service.AuditActionAccountLocked)
+	event.Details = service.AuditDetails(map[string]interface{}{
+		"attempts":     s.lockout.Attempts,
+		"locked_until": lockedUntil.UTC(),
+	})
+	service.RecordAudit(s.store, event)
+	return accountLocked(*lockedUntil, now)
+}
+
+func accountLocked(until, now time.Time) *service.Error {
+	return service.CodedError(service.KindLocked, "account_locked",
+		"account is locked after too many failed logins",
+		map[string]interface{}{
+			"locked_until":   until.UTC(),
+			"retry_after_ms": max(until.Sub(now), time.Second).Milliseconds(),
+		})
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/mail"
+	"github.com/deeplyprofound/password-sync/server/service"
+)
+
+// PasswordResetTTL is how long an emailed reset token can be used
+const PasswordResetTTL = 30 * time.Minute
+
+// MasterKeyWarning goes with every password reset: the server never had
+// the master key, so a reset can't bring back access to the vault
+const MasterKeyWarning = "Only the account password was reset. Your vault is still encrypted with your master key, " +
+	"which the server never had and cannot reset; items are readable only on a device that still holds it."
+
+type ResetPasswordInput struct {
+	Token       string
+	NewPassword string
+}
+
+type ResetPasswordResult struct {
+	Revoked  int64 // Refresh tokens revoked with the reset
+	Warnings []string
+}
+
+// RequestPasswordReset emails a reset token to the account with this email.
+// It succeeds whether or not there is one, so callers can't find out which
+// emails have accounts; failures are logged instead.
+func (s *Service) RequestPasswordReset(ctx context.Context, caller service.Caller, email string) error {
+	user, err := s.store.GetUserByEmail(email)
+	if err != nil || !user.IsActive {
+		return nil
+	}
+
+	token, hash, err := auth.GenerateResetToken()
+	if err != nil {
+		log.Printf("❌ Failed to generate password reset token for user %s: %v", user.ID, err)
+		return nil
+	}
+	expiresAt := s.clock.Now().Add(PasswordResetTTL)
+	if err := s.store.CreatePasswordResetToken(user.ID, hash, expiresAt); err != nil {
+		log.Printf("❌ Failed to store password reset token for user %s: %v", user.ID, err)
+		return nil
+	}
+
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Password Sync account password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your Password Sync account. "+
+			"If it was you, enter this code in the app within %d minutes:\n\n%s\n\n"+
+			"It resets your account password only: your vault stays encrypted with your master key, "+
+			"which we can't reset. If it wasn't you, ignore this email; your password is unchanged.\n",
+			int(PasswordResetTTL/time.Minute), token),
+	}
+	if err := s.mailer.Send(ctx, msg); err != nil {
+		log.Printf("❌ Failed to email password reset to user %s: %v", user.ID, err)
+		return nil
+	}
+
+	service.RecordAudit(s.store, caller.AuditEvent(user.ID, service.AuditActionResetRequest))
+	return nil
+}
+
+// ResetPassword sets a new password with an emailed reset token, which then
+// can't be used again. Like ChangePassword it revokes every refresh token of
+// the account and lifts any login lockout.
+func (s *Service) ResetPassword(ctx context.Context, caller service.Caller, in ResetPasswordInput) (*ResetPasswordResult, error) {
+	userID, err := s.store.ConsumePasswordResetToken(auth.HashResetToken(in.Token), s.clock.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, service.CodedError(service.KindInvalid, "invalid_reset_token", "reset token is invalid, expired or already used", nil)
+	}
+	if err != nil {
+		return nil, service.Internal("failed to check reset token", err)
+	}
+
+	user, err := s.store.GetUserByID(userID)
+	if err != nil {
+		return nil, service.Internal("failed to load user", err)
+	}
+	if !user.IsActive {
+		return nil, service.NewError(service.KindForbidden, auth.ErrAccountInactive.Error())
+	}
+
+	salt, err := auth.GenerateSalt()
+	if err != nil {
+		return nil, &service.Error{Kind: service.KindInternal, Message: "failed to generate salt", Err: err}
+	}
+	hash := auth.HashPassword(in.NewPassword, salt)
+	revoked, err := s.store.UpdateUserPassword(user.ID, hash, salt, auth.CurrentHashVersion)
+	if err != nil {
+		return nil, &service.Error{Kind: service.KindInternal, Message: "failed to update password", Err: err}
+	}
+
+	event := caller.AuditEvent(user.ID, service.AuditActionPasswordReset)
+	event.Details = service.AuditDetails(map[string]interface{}{"revoked": revoked})
+	service.RecordAudit(s.store, event)
+	return &ResetPasswordResult{Revoked: revoked, Warnings: []string{MasterKeyWarning}}, nil
+}
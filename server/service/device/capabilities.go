@@ -0,0 +1,171 @@
+package device
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"sort"
+
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	domainsync "github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/google/uuid"
+)
+
+// UpdateCapabilities merges patch into the capabilities of the calling
+// device: each top-level key replaces the stored one and a null removes
+// it. Only a device can describe itself, so deviceID must be the caller's.
+// enc_versions in the result also update the device's max enc_version.
+func (s *Service) UpdateCapabilities(ctx context.Context, caller service.Caller, deviceID string, patch []byte) (*storage.Device, error) {
+	if _, err := uuid.Parse(deviceID); err != nil {
+		return nil, service.NewError(service.KindInvalid, "invalid device id")
+	}
+	if deviceID != caller.DeviceID {
+		return nil, service.CodedError(service.KindForbidden, "not_calling_device",
+			"capabilities can only be updated by the device itself", map[string]interface{}{"device_id": deviceID})
+	}
+	if err := service.CheckDeviceTrust(ctx, s.store, caller, true); err != nil {
+		return nil, err
+	}
+
+	device, err := s.store.GetDevice(ctx, caller.UserID, deviceID)
+	if err == sql.ErrNoRows || (err == nil && !device.IsActive) {
+		return nil, service.NewError(service.KindNotFound, "device not found")
+	}
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+
+	caps, err := parseCapabilities(patch, device.Capabilities)
+	if err != nil {
+		return nil, err
+	}
+	capabilities, err := json.Marshal(caps)
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+	err = s.store.SetDeviceCapabilities(caller.UserID, deviceID, capabilities, caps.MaxEncVersion())
+	if err == sql.ErrNoRows {
+		// Revoked meanwhile
+		return nil, service.NewError(service.KindNotFound, "device not found")
+	}
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+	device.Capabilities = capabilities
+	if caps.MaxEncVersion() > 0 {
+		device.MaxEncVersion = caps.MaxEncVersion()
+	}
+
+	event := caller.AuditEvent(caller.UserID, service.AuditActionDeviceCaps)
+	event.Details = service.AuditDetails(map[string]interface{}{
+		"device_id": deviceID,
+		"version":   caps.Version,
+	})
+	service.RecordAudit(s.store, event)
+	return device, nil
+}
+
+// CapabilitiesSummary describes what the caller's active devices can
+// handle, so a client can warn about a device holding the others back
+type CapabilitiesSummary struct {
+	Devices int
+	// Highest enc_version every active device reads, and the highest any
+	// of them reads
+	MinEncVersion int
+	MaxEncVersion int
+	MsgPack       int            // Devices preferring MessagePack
+	PushPlatforms map[string]int // Devices per push platform
+
+	// Devices that read less than MaxEncVersion, or advertised an older
+	// capabilities schema than the server's; lowest enc_version first
+	Lagging []*LaggingDevice
+}
+
+// LaggingDevice is a device behind the rest of the account
+type LaggingDevice struct {
+	Device        *storage.Device
+	MaxEncVersion int // What it reads; BaseEncVersion when never reported
+	SchemaVersion int // Its capabilities' version; 0 when it never sent any
+}
+
+// Capabilities summarises the capabilities of the caller's active devices
+func (s *Service) Capabilities(ctx context.Context, caller service.Caller) (*CapabilitiesSummary, error) {
+	if err := service.CheckDeviceTrust(ctx, s.store, caller, false); err != nil {
+		return nil, err
+	}
+	devices, err := s.store.GetDevicesByUserID(caller.UserID)
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+
+	summary := &CapabilitiesSummary{
+		Devices:       len(devices),
+		PushPlatforms: map[string]int{},
+		Lagging:       []*LaggingDevice{},
+	}
+	versions := make([]int, len(devices))
+	schemas := make([]int, len(devices))
+	for i, device := range devices {
+		versions[i] = max(device.MaxEncVersion, domainsync.BaseEncVersion)
+		summary.MaxEncVersion = max(summary.MaxEncVersion, versions[i])
+
+		caps := deviceCapabilities(device)
+		if caps == nil {
+			continue
+		}
+		schemas[i] = caps.Version
+		if caps.MsgPack {
+			summary.MsgPack++
+		}
+		if caps.PushPlatform != "" {
+			summary.PushPlatforms[caps.PushPlatform]++
+		}
+	}
+	summary.MinEncVersion, _ = domainsync.MinSupportedEncVersion(versions)
+
+	for i, device := range devices {
+		if versions[i] < summary.MaxEncVersion || schemas[i] < peer.CapabilitiesVersion {
+			summary.Lagging = append(summary.Lagging, &LaggingDevice{
+				Device:        device,
+				MaxEncVersion: versions[i],
+				SchemaVersion: schemas[i],
+			})
+		}
+	}
+	sort.SliceStable(summary.Lagging, func(i, j int) bool {
+		return summary.Lagging[i].MaxEncVersion < summary.Lagging[j].MaxEncVersion
+	})
+	return summary, nil
+}
+
+// deviceCapabilities parses a device's stored capabilities; nil when it
+// never sent any
+func deviceCapabilities(device *storage.Device) *peer.Capabilities {
+	if len(device.Capabilities) == 0 || string(device.Capabilities) == "{}" {
+		return nil
+	}
+	caps, err := peer.ParseCapabilities(device.Capabilities)
+	if err != nil {
+		log.Printf("⚠️  Stored capabilities of device %s are invalid: %v", device.ID, err)
+		return nil
+	}
+	return caps
+}
+
+// parseCapabilities validates new capabilities, or a patch of current ones
+func parseCapabilities(data, current []byte) (*peer.Capabilities, error) {
+	var caps *peer.Capabilities
+	var err error
+	if current == nil {
+		caps, err = peer.ParseCapabilities(data)
+	} else {
+		caps, err = peer.MergeCapabilities(current, data)
+	}
+	if err != nil {
+		return nil, service.CodedError(service.KindInvalid, "invalid_capabilities", err.Error(), nil)
+	}
+	return caps, nil
+}
@@ -0,0 +1,416 @@
+// Package device registers, lists and revokes a user's devices
+package device
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/domain/limits"
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/google/uuid"
+)
+
+// EventDeviceInactive warns a user's devices that one of them will be
+// deactivated for inactivity; device_id names it, timestamp is the deadline
+const EventDeviceInactive = "device_inactive_warning"
+
+// EventDeviceTrustChanged tells a user's devices that one of them was
+// registered pending approval, approved or revoked; device_id names it and
+// trust_level is its new level
+const EventDeviceTrustChanged = "device_trust_changed"
+
+// MaxDeviceNameLength caps a device name, in characters
+const MaxDeviceNameLength = 255
+
+// MaxFingerprintLength caps a device fingerprint, in bytes
+const MaxFingerprintLength = 255
+
+// MaxBulkDevices caps the device IDs accepted by one bulk revocation
+const MaxBulkDevices = 100
+
+// Store is the storage the service needs
+type Store interface {
+	service.Auditor
+	service.DeviceTrustReader
+	CreateDevice(userID, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte) (*storage.Device, error)
+	UpsertDevice(userID, fingerprint, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte) (*storage.Device, bool, error)
+	GetDevicesByUserID(userID string) ([]*storage.Device, error)
+	HasActiveDevice(userID, fingerprint string) (bool, error)
+	GetAccountUsage(ctx context.Context, userID string) (*storage.AccountUsage, error)
+	RevokeDevice(userID, deviceID string) error
+	RevokeDevices(userID string, deviceIDs []string) ([]string, error)
+	FindStaleDevices(userID string, olderThan time.Time, exceptDeviceID string) ([]*storage.StaleDevice, error)
+	SetDeviceTrustLevel(userID, deviceID string, from, to int) error
+	SetDeviceCapabilities(userID, deviceID string, capabilities []byte, maxEncVersion int) error
+	RenameDevice(userID, deviceID, name string) error
+}
+
+// Hub reaches the user's connected devices
+type Hub interface {
+	service.Broadcaster
+	DisconnectUserDevice(userID, deviceID string, reason websocket.CloseReason) int
+}
+
+type Service struct {
+	store Store
+	hub   Hub
+	clock clock.Clock
+	tiers limits.Policy
+}
+
+func NewService(store Store) *Service {
+	return &Service{store: store, clock: clock.System, tiers: limits.DefaultPolicy()}
+}
+
+// SetTierPolicy sets the limits of each subscription tier
+func (s *Service) SetTierPolicy(policy limits.Policy) {
+	s.tiers = policy
+}
+
+// SetClock replaces the clock stale-device thresholds are measured from
+func (s *Service) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// SetHub sets the hub revoked devices are disconnected from
+func (s *Service) SetHub(hub Hub) {
+	s.hub = hub
+}
+
+type RegisterInput struct {
+	Name          string
+	Type          string
+	PublicKey     []byte
+	MaxEncVersion int // Highest enc_version the device can decrypt; 0 if unknown
+
+	// The device's peer.Capabilities JSON; nil for none. Its enc_versions,
+	// when listed, take precedence over MaxEncVersion.
+	Capabilities []byte
+
+	// Stable ID the client keeps across restarts and reinstalls; optional.
+	// Registering it again updates the active device that has it rather
+	// than adding another.
+	Fingerprint string
+}
+
+// Registration is a registered device
+type Registration struct {
+	*storage.Device
+	Created bool // False when the fingerprint matched an active device
+}
+
+// Register adds a device to the caller's account, or updates the one
+// registered with the same fingerprint. Under the account's approval
+// setting a new device starts out pending, and the user's other devices
+// are told so they can approve it. A caller without a device claim may
+// always register, since that is how a device gets one. A device beyond
+// what the caller's tier allows is refused; updating a registered one
+// never is.
+func (s *Service) Register(ctx context.Context, caller service.Caller, in RegisterInput) (*Registration, error) {
+	if len(in.Fingerprint) > MaxFingerprintLength {
+		return nil, service.NewError(service.KindInvalid, fmt.Sprintf("device_fingerprint must be at most %d bytes", MaxFingerprintLength))
+	}
+	if caller.DeviceID != "" {
+		if err := service.CheckDeviceTrust(ctx, s.store, caller, true); err != nil {
+			return nil, err
+		}
+	}
+	var capabilities []byte
+	maxEncVersion := in.MaxEncVersion
+	if in.Capabilities != nil {
+		caps, err := parseCapabilities(in.Capabilities, nil)
+		if err != nil {
+			return nil, err
+		}
+		if capabilities, err = json.Marshal(caps); err != nil {
+			return nil, service.Internal("", err)
+		}
+		if caps.MaxEncVersion() > 0 {
+			maxEncVersion = caps.MaxEncVersion()
+		}
+	}
+
+	if err := s.checkDeviceLimit(ctx, caller, in.Fingerprint); err != nil {
+		return nil, err
+	}
+
+	var device *storage.Device
+	var err error
+	created := true
+	if in.Fingerprint == "" {
+		device, err = s.store.CreateDevice(caller.UserID, in.Name, in.Type, in.PublicKey, maxEncVersion, capabilities)
+	} else {
+		device, created, err = s.store.UpsertDevice(caller.UserID, in.Fingerprint, in.Name, in.Type, in.PublicKey, maxEncVersion, capabilities)
+	}
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+
+	level := peer.TrustLevel(device.TrustLevel)
+	event := caller.AuditEvent(caller.UserID, service.AuditActionDeviceAdd)
+	event.Details = service.AuditDetails(map[string]interface{}{
+		"device_id":   device.ID,
+		"device_type": device.DeviceType,
+		"trust_level": level.String(),
+		"reused":      !created,
+	})
+	service.RecordAudit(s.store, event)
+	if level == peer.TrustLevelPending {
+		s.broadcastTrust(caller.UserID, device.ID, level)
+	}
+	return &Registration{Device: device, Created: created}, nil
+}
+
+// checkDeviceLimit refuses registering one more device than the caller's
+// tier allows, unless fingerprint names an active device, which
+// registering again only updates
+func (s *Service) checkDeviceLimit(ctx context.Context, caller service.Caller, fingerprint string) error {
+	if s.tiers.For(caller.Tier).Devices == 0 {
+		return nil
+	}
+	if fingerprint != "" {
+		registered, err := s.store.HasActiveDevice(caller.UserID, fingerprint)
+		if err != nil {
+			return service.Internal("failed to count devices", err)
+		}
+		if registered {
+			return nil
+		}
+	}
+	usage, err := s.store.GetAccountUsage(ctx, caller.UserID)
+	if err != nil {
+		return service.Internal("failed to count devices", err)
+	}
+	return service.CheckLimit(s.tiers, caller, limits.ResourceDevices, usage.Devices, 1)
+}
+
+// List returns the caller's devices
+func (s *Service) List(ctx context.Context, caller service.Caller) ([]*storage.Device, error) {
+	if err := service.CheckDeviceTrust(ctx, s.store, caller, false); err != nil {
+		return nil, err
+	}
+	devices, err := s.store.GetDevicesByUserID(caller.UserID)
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+	return devices, nil
+}
+
+// Revoke deactivates one of the caller's devices, revokes its refresh
+// tokens and closes its open WebSockets with websocket.CloseRevoked. Access
+// tokens already issued to it stay valid until they expire.
+func (s *Service) Revoke(ctx context.Context, caller service.Caller, deviceID string) error {
+	if _, err := uuid.Parse(deviceID); err != nil {
+		return service.NewError(service.KindInvalid, "invalid device id")
+	}
+	if err := service.CheckDeviceTrust(ctx, s.store, caller, true); err != nil {
+		return err
+	}
+
+	err := s.store.RevokeDevice(caller.UserID, deviceID)
+	if err == sql.ErrNoRows {
+		return service.NewError(service.KindNotFound, "device not found")
+	}
+	if err != nil {
+		return service.Internal("", err)
+	}
+
+	s.revoked(caller.UserID, []string{deviceID})
+
+	event := caller.AuditEvent(caller.UserID, service.AuditActionDeviceRevoke)
+	event.Details = service.AuditDetails(map[string]interface{}{"device_id": deviceID})
+	service.RecordAudit(s.store, event)
+	return nil
+}
+
+// Rename changes the name of one of the caller's devices, which need not
+// be the calling one: any trusted device can tidy up the list
+func (s *Service) Rename(ctx context.Context, caller service.Caller, deviceID, name string) (*storage.Device, error) {
+	if _, err := uuid.Parse(deviceID); err != nil {
+		return nil, service.NewError(service.KindInvalid, "invalid device id")
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > MaxDeviceNameLength {
+		return nil, service.NewError(service.KindInvalid, fmt.Sprintf("device_name must be 1-%d characters", MaxDeviceNameLength))
+	}
+	if err := service.CheckDeviceTrust(ctx, s.store, caller, true); err != nil {
+		return nil, err
+	}
+
+	err := s.store.RenameDevice(caller.UserID, deviceID, name)
+	if err == sql.ErrNoRows {
+		return nil, service.NewError(service.KindNotFound, "device not found")
+	}
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+	device, err := s.store.GetDevice(ctx, caller.UserID, deviceID)
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+
+	event := caller.AuditEvent(caller.UserID, service.AuditActionDeviceRename)
+	event.Details = service.AuditDetails(map[string]interface{}{"device_id": deviceID})
+	service.RecordAudit(s.store, event)
+	return device, nil
+}
+
+// BulkRevokeResult splits a bulk revocation's device IDs
+type BulkRevokeResult struct {
+	Revoked  []string
+	NotFound []string // Unknown, another user's, or already inactive
+}
+
+// RevokeMany is the bulk form of Revoke. IDs that are not the caller's
+// active devices are reported back rather than failing the call.
+func (s *Service) RevokeMany(ctx context.Context, caller service.Caller, deviceIDs []string) (*BulkRevokeResult, error) {
+	if len(deviceIDs) > MaxBulkDevices {
+		return nil, service.CodedError(service.KindInvalid, "too_many_devices", "too many device ids",
+			map[string]interface{}{"max": MaxBulkDevices})
+	}
+	for _, id := range deviceIDs {
+		if _, err := uuid.Parse(id); err != nil {
+			return nil, service.NewError(service.KindInvalid, "invalid device id: "+id)
+		}
+	}
+	if err := service.CheckDeviceTrust(ctx, s.store, caller, true); err != nil {
+		return nil, err
+	}
+
+	revoked, err := s.store.RevokeDevices(caller.UserID, deviceIDs)
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+	s.revoked(caller.UserID, revoked)
+
+	result := &BulkRevokeResult{Revoked: []string{}, NotFound: []string{}}
+	done := make(map[string]bool, len(revoked))
+	for _, id := range revoked {
+		done[id] = true
+		result.Revoked = append(result.Revoked, id)
+	}
+	for _, id := range deviceIDs {
+		if !done[id] {
+			result.NotFound = append(result.NotFound, id)
+		}
+	}
+
+	if len(revoked) > 0 {
+		event := caller.AuditEvent(caller.UserID, service.AuditActionDeviceRevoke)
+		event.Details = service.AuditDetails(map[string]interface{}{"device_ids": revoked})
+		service.RecordAudit(s.store, event)
+	}
+	return result, nil
+}
+
+// CleanupInput selects the caller's devices that have not synced for
+// InactiveDays. The calling device is never included.
+type CleanupInput struct {
+	InactiveDays int
+	DryRun       bool
+}
+
+// Cleanup deactivates the caller's devices that have not synced for
+// in.InactiveDays, revoking them like Revoke. On a dry run it only lists
+// them. It returns the devices deactivated, or that would be.
+func (s *Service) Cleanup(ctx context.Context, caller service.Caller, in CleanupInput) ([]*storage.Device, error) {
+	if err := service.CheckDeviceTrust(ctx, s.store, caller, !in.DryRun); err != nil {
+		return nil, err
+	}
+	cutoff := s.clock.Now().Add(-time.Duration(in.InactiveDays) * 24 * time.Hour)
+	stale, err := s.store.FindStaleDevices(caller.UserID, cutoff, caller.DeviceID)
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+
+	devices := []*storage.Device{}
+	if in.DryRun || len(stale) == 0 {
+		for _, device := range stale {
+			devices = append(devices, &device.Device)
+		}
+		return devices, nil
+	}
+
+	ids := make([]string, len(stale))
+	for i, device := range stale {
+		ids[i] = device.ID
+	}
+	revoked, err := s.store.RevokeDevices(caller.UserID, ids)
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+	s.revoked(caller.UserID, revoked)
+
+	done := make(map[string]bool, len(revoked))
+	for _, id := range revoked {
+		done[id] = true
+	}
+	for _, device := range stale {
+		if done[device.ID] {
+			devices = append(devices, &device.Device)
+		}
+	}
+
+	if len(revoked) > 0 {
+		event := caller.AuditEvent(caller.UserID, service.AuditActionDeviceRevoke)
+		event.Details = service.AuditDetails(map[string]interface{}{"device_ids": revoked, "inactive_days": in.InactiveDays})
+		service.RecordAudit(s.store, event)
+	}
+	return devices, nil
+}
+
+// DeviceInactive implements jobs.DeviceNotifier: the warning goes to the
+// user's connected devices and into their audit log
+func (s *Service) DeviceInactive(device *storage.StaleDevice, deactivateAt time.Time) {
+	service.Broadcast(s.hub, &websocket.SyncEvent{
+		Type:      EventDeviceInactive,
+		UserID:    device.UserID,
+		DeviceID:  &device.ID,
+		Timestamp: deactivateAt.Unix(),
+	})
+
+	service.RecordAudit(s.store, &storage.AuditEvent{
+		UserID:   device.UserID,
+		DeviceID: &device.ID,
+		Action:   service.AuditActionDeviceInactive,
+		Details: service.AuditDetails(map[string]interface{}{
+			"device_name":   device.DeviceName,
+			"last_active":   device.LastActive.UTC().Format(time.RFC3339),
+			"deactivate_at": deactivateAt.UTC().Format(time.RFC3339),
+		}),
+	})
+}
+
+// DevicesDeactivated implements jobs.DeviceNotifier
+func (s *Service) DevicesDeactivated(userID string, deviceIDs []string) {
+	s.revoked(userID, deviceIDs)
+
+	service.RecordAudit(s.store, &storage.AuditEvent{
+		UserID:  userID,
+		Action:  service.AuditActionDeviceRevoke,
+		Details: service.AuditDetails(map[string]interface{}{"device_ids": deviceIDs, "reason": "inactive"}),
+	})
+	log.Printf("📱 Deactivated %d inactive device(s) of user %s", len(deviceIDs), userID)
+}
+
+// revoked closes the WebSockets of revoked devices and tells the user's
+// other devices
+func (s *Service) revoked(userID string, deviceIDs []string) {
+	if s.hub == nil {
+		return
+	}
+	for _, deviceID := range deviceIDs {
+		s.hub.DisconnectUserDevice(userID, deviceID, websocket.CloseRevoked)
+		s.broadcastTrust(userID, deviceID, peer.TrustLevelRevoked)
+	}
+}
@@ -0,0 +1,96 @@
+package device
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/google/uuid"
+)
+
+// SetTrust moves one of the caller's devices to another trust level:
+// approves or rejects a pending device, or revokes a trusted one. Only a
+// trusted device (or a client without a device claim) may do so. Revoking
+// deactivates the device like Revoke. It returns the device at its new
+// level.
+func (s *Service) SetTrust(ctx context.Context, caller service.Caller, deviceID string, to peer.TrustLevel) (*storage.Device, error) {
+	if _, err := uuid.Parse(deviceID); err != nil {
+		return nil, service.NewError(service.KindInvalid, "invalid device id")
+	}
+	if err := service.CheckDeviceTrust(ctx, s.store, caller, true); err != nil {
+		return nil, err
+	}
+
+	device, err := s.store.GetDevice(ctx, caller.UserID, deviceID)
+	if err == sql.ErrNoRows || (err == nil && !device.IsActive) {
+		return nil, service.NewError(service.KindNotFound, "device not found")
+	}
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+	from := peer.TrustLevel(device.TrustLevel)
+	if from == to {
+		return device, nil
+	}
+	if !peer.ValidTransition(from, to) {
+		return nil, service.CodedError(service.KindConflict, "invalid_trust_change", peer.ErrInvalidTrustChange.Error(),
+			map[string]interface{}{"from": from.String(), "to": to.String()})
+	}
+
+	if to == peer.TrustLevelRevoked {
+		err = s.store.RevokeDevice(caller.UserID, deviceID)
+	} else {
+		err = s.store.SetDeviceTrustLevel(caller.UserID, deviceID, int(from), int(to))
+	}
+	if err == sql.ErrNoRows {
+		// Revoked or moved by another request meanwhile
+		return nil, service.CodedError(service.KindConflict, "invalid_trust_change", "device trust changed concurrently",
+			map[string]interface{}{"from": from.String(), "to": to.String()})
+	}
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+
+	device.TrustLevel = int(to)
+	if to == peer.TrustLevelRevoked {
+		device.IsActive = false
+		s.revoked(caller.UserID, []string{deviceID})
+	} else {
+		s.broadcastTrust(caller.UserID, deviceID, to)
+	}
+
+	event := caller.AuditEvent(caller.UserID, service.AuditActionDeviceTrust)
+	event.Details = service.AuditDetails(map[string]interface{}{
+		"device_id": deviceID,
+		"from":      from.String(),
+		"to":        to.String(),
+	})
+	service.RecordAudit(s.store, event)
+	return device, nil
+}
+
+// TrustListener keeps the caller's device records in step with a
+// peer.PeerManager: each change it reports is applied with SetTrust
+func (s *Service) TrustListener(caller service.Caller) peer.TrustListener {
+	return func(peerID string, from, to peer.TrustLevel) {
+		if _, err := s.SetTrust(context.Background(), caller, peerID, to); err != nil {
+			log.Printf("⚠️  Peer %s trust change %s -> %s not recorded: %v", peerID, from, to, err)
+		}
+	}
+}
+
+// broadcastTrust tells the user's devices that one of them changed trust
+// level
+func (s *Service) broadcastTrust(userID, deviceID string, level peer.TrustLevel) {
+	service.Broadcast(s.hub, &websocket.SyncEvent{
+		Type:       EventDeviceTrustChanged,
+		UserID:     userID,
+		DeviceID:   &deviceID,
+		TrustLevel: level.String(),
+		Timestamp:  s.clock.Now().Unix(),
+	})
+}
@@ -0,0 +1,25 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/deeplyprofound/password-sync/server/domain/limits"
+)
+
+// CheckLimit refuses adding to a caller whose account has used of resource,
+// when the total would exceed the limit of the caller's tier. The refusal is
+// a 403 quota_exceeded carrying the tier, the limit and the counts.
+func CheckLimit(policy limits.Policy, caller Caller, resource string, used, adding int64) error {
+	err := policy.Check(caller.Tier, resource, used, adding)
+	var limitErr *limits.LimitError
+	if !errors.As(err, &limitErr) {
+		return err
+	}
+	return CodedError(KindForbidden, "quota_exceeded", limitErr.Error(), map[string]interface{}{
+		"tier":     limitErr.Tier,
+		"resource": limitErr.Resource,
+		"limit":    limitErr.Limit,
+		"used":     limitErr.Used,
+		"adding":   limitErr.Adding,
+	})
+}
@@ -0,0 +1,89 @@
+// Package service holds what the API does, apart from how it is reached.
+// Its subpackages (sync, auth, device) expose plain Go methods taking a
+// context, the Caller and typed inputs, and reach storage and the WebSocket
+// hub only through interfaces, so the gin handlers are left to bind the
+// request, call a method and render the result or Error.
+package service
+
+import (
+	"log"
+
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+)
+
+// Caller is who a request comes from, as the auth middleware established it
+type Caller struct {
+	UserID    string // "" on unauthenticated routes
+	DeviceID  string // Device claim of the token; "" when it has none or it isn't a device UUID
+	IP        string
+	LegalHold bool   // The caller's account is on legal hold
+	Tier      string // Subscription tier of the caller's account; "" when unknown
+}
+
+// Kind classifies an Error the way a transport needs to answer it
+type Kind int
+
+const (
+	KindInternal Kind = iota
+	KindInvalid
+	KindUnauthorized
+	KindForbidden
+	KindNotFound
+	KindConflict
+	KindLocked
+	KindUnavailable
+	KindGone            // Existed, but can no longer be acted on
+	KindRateLimited     // Too many calls; Fields carry retry_after_ms
+	KindPaymentRequired // Beyond what the account's subscription tier allows
+)
+
+// Error is a failure to report to the client: a message, an optional
+// machine-readable code and any fields the client needs to act on it
+type Error struct {
+	Kind    Kind
+	Message string
+	Code    string
+	Fields  map[string]interface{}
+	Err     error // Underlying cause, if any
+}
+
+func (e *Error) Error() string { return e.Message }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// NewError returns an Error without a code
+func NewError(kind Kind, message string) *Error {
+	return &Error{Kind: kind, Message: message}
+}
+
+// CodedError returns an Error with a code and optional fields
+func CodedError(kind Kind, code, message string, fields map[string]interface{}) *Error {
+	return &Error{Kind: kind, Code: code, Message: message, Fields: fields}
+}
+
+// Internal wraps an unexpected failure, prefixing its message with context
+// when there is one
+func Internal(context string, err error) *Error {
+	message := err.Error()
+	if context != "" {
+		message = context + ": " + message
+	}
+	return &Error{Kind: KindInternal, Message: message, Err: err}
+}
+
+// Broadcaster delivers sync events to a user's connected devices
+type Broadcaster interface {
+	BroadcastSyncEvent(event *websocket.SyncEvent) error
+}
+
+// Broadcast notifies the user's connected devices. The write it reports on
+// has already succeeded, so an overloaded hub is logged, not returned; the
+// hub tells those devices to resync instead.
+func Broadcast(hub Broadcaster, event *websocket.SyncEvent) {
+	if hub == nil {
+		return
+	}
+	if err := hub.BroadcastSyncEvent(event); err != nil {
+		log.Printf("⚠️  Sync event %s for user %s not queued: %v", event.Type, event.UserID, err)
+	}
+}
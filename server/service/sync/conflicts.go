@@ -0,0 +1,147 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	domainsync "github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/google/uuid"
+)
+
+// Conflict is a pending manual conflict with both versions of its item
+type Conflict struct {
+	*storage.SyncConflict
+	Stored *models.SyncRecord // The zone's record now; nil once purged
+}
+
+// Conflicts lists the zone's pending manual conflicts, oldest first, with
+// the held-back record and the stored one each
+func (s *Service) Conflicts(ctx context.Context, caller service.Caller, zone string) ([]*Conflict, error) {
+	if err := s.CheckDevice(ctx, caller, false); err != nil {
+		return nil, err
+	}
+	pending, err := s.store.ListConflicts(ctx, caller.UserID, zone)
+	if err != nil {
+		return nil, service.Internal("failed to list conflicts", err)
+	}
+	if len(pending) == 0 {
+		return []*Conflict{}, nil
+	}
+
+	itemIDs := make([]uuid.UUID, len(pending))
+	for i, conflict := range pending {
+		itemIDs[i] = conflict.ItemUUID
+	}
+	records, err := s.store.GetSyncRecordsPage(ctx, caller.UserID, storage.PullRange{
+		Zone:              zone,
+		IncludeTombstoned: true,
+		ItemUUIDs:         itemIDs,
+	})
+	if err != nil {
+		return nil, service.Internal("failed to list conflicts", err)
+	}
+	stored := make(map[uuid.UUID]*models.SyncRecord, len(records))
+	for _, record := range records {
+		stored[record.ItemUUID] = record
+	}
+
+	conflicts := make([]*Conflict, len(pending))
+	for i, conflict := range pending {
+		conflicts[i] = &Conflict{SyncConflict: conflict, Stored: stored[conflict.ItemUUID]}
+	}
+	return conflicts, nil
+}
+
+// pendingConflictItems returns the UUIDs of the zone's items with a pending
+// manual conflict, which the manifest flags
+func (s *Service) pendingConflictItems(ctx context.Context, userID, zone string) ([]string, error) {
+	pending, err := s.store.ListConflicts(ctx, userID, zone)
+	if err != nil {
+		return nil, err
+	}
+	var items []string
+	for _, conflict := range pending {
+		items = append(items, conflict.ItemUUID.String())
+	}
+	return items, nil
+}
+
+// ResolveConflictInput picks the version of a conflicting item to keep
+type ResolveConflictInput struct {
+	Zone       string // "default" when empty
+	ConflictID string
+	// domainsync.ResolutionClientWins keeps the held-back record,
+	// ResolutionServerWins the stored one
+	Resolution string
+}
+
+// ResolveConflictResult reports a resolved conflict
+type ResolveConflictResult struct {
+	ItemUUID   string
+	Resolution string
+	GenCount   int64 // The kept version's new gencount, and the zone's
+}
+
+// ResolveConflict settles a pending manual conflict. The version kept gets
+// a new gencount, so every device pulls it, including the one holding the
+// other.
+func (s *Service) ResolveConflict(ctx context.Context, caller service.Caller, in ResolveConflictInput) (*ResolveConflictResult, error) {
+	if in.Zone == "" {
+		in.Zone = "default"
+	}
+	if _, err := uuid.Parse(in.ConflictID); err != nil {
+		return nil, service.NewError(service.KindInvalid, "invalid conflict ID")
+	}
+	if in.Resolution != domainsync.ResolutionClientWins && in.Resolution != domainsync.ResolutionServerWins {
+		return nil, service.CodedError(service.KindInvalid, "invalid_resolution",
+			"resolution must be "+domainsync.ResolutionClientWins+" or "+domainsync.ResolutionServerWins, nil)
+	}
+	if err := s.CheckDevice(ctx, caller, true); err != nil {
+		return nil, err
+	}
+	userID, deviceID := caller.UserID, caller.DeviceID
+
+	resolved, err := s.store.ResolveConflict(ctx, userID, &storage.ConflictResolveRequest{
+		ID:         in.ConflictID,
+		Zone:       in.Zone,
+		Resolution: in.Resolution,
+		DeviceID:   deviceID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, service.NewError(service.KindNotFound, "conflict not found")
+	}
+	if err != nil {
+		return nil, service.Internal("failed to resolve conflict", err)
+	}
+	// The resolution wrote the zone's gencount and digest itself
+	s.engines.Reset(userID, in.Zone)
+
+	conflict := resolved.Conflict
+	resolveEvent := caller.AuditEvent(userID, service.AuditActionSyncResolve)
+	resolveEvent.Zone = &in.Zone
+	itemUUID := conflict.ItemUUID.String()
+	resolveEvent.ItemUUID = &itemUUID
+	resolveEvent.Details = service.AuditDetails(map[string]interface{}{
+		"conflict_id": conflict.ID,
+		"resolution":  in.Resolution,
+		"gencount":    resolved.GenCount,
+	})
+	service.RecordAudit(s.store, resolveEvent)
+	s.touchDevice(ctx, deviceID)
+	service.Broadcast(s.hub, &websocket.SyncEvent{
+		Type:      websocket.EventCredentialsChanged,
+		UserID:    userID,
+		Zone:      in.Zone,
+		GenCount:  resolved.GenCount,
+		DeviceID:  stringOrNil(deviceID),
+		ItemUUID:  itemUUID,
+		Timestamp: s.clock.Now().Unix(),
+	})
+
+	return &ResolveConflictResult{ItemUUID: itemUUID, Resolution: in.Resolution, GenCount: resolved.GenCount}, nil
+}
@@ -0,0 +1,96 @@
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/google/uuid"
+)
+
+// DeleteCredentialResult reports a deleted credential
+type DeleteCredentialResult struct {
+	GenCount int64 // Zone gencount afterwards
+	DeletedItems
+}
+
+// DeleteCredential tombstones one credential of the zone with its sync
+// record and the keys only it used, so clients don't have to push each
+// layer themselves. Every item gets a new gencount and the user's devices
+// get a credential_deleted event. It is refused while the account is on
+// legal hold.
+func (s *Service) DeleteCredential(ctx context.Context, caller service.Caller, zone, itemUUID string) (*DeleteCredentialResult, error) {
+	itemID, err := uuid.Parse(itemUUID)
+	if err != nil {
+		return nil, service.NewError(service.KindInvalid, "invalid item_uuid")
+	}
+	if err := checkLegalHold(caller); err != nil {
+		return nil, err
+	}
+	if err := s.CheckDevice(ctx, caller, true); err != nil {
+		return nil, err
+	}
+	userID, deviceID := caller.UserID, caller.DeviceID
+
+	deleted, err := s.store.DeleteCredential(ctx, userID, &storage.CredentialDeleteRequest{
+		Zone:     zone,
+		ItemUUID: itemID,
+		DeviceID: deviceID,
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, service.NewError(service.KindNotFound, "credential not found")
+	}
+	if err != nil {
+		return nil, service.Internal("failed to delete credential", err)
+	}
+	// The delete wrote the zone's gencount and digest itself
+	s.engines.Reset(userID, zone)
+
+	deleteEvent := caller.AuditEvent(userID, service.AuditActionSyncDeleteItem)
+	deleteEvent.Zone = &zone
+	deleteEvent.Details = service.AuditDetails(map[string]interface{}{
+		"item_uuid": itemUUID,
+		"deleted":   len(deleted.Items),
+		"gencount":  deleted.GenCount,
+	})
+	s.recordWipe(caller, zone, deleteEvent, deleted, true)
+	s.touchDevice(ctx, deviceID)
+	service.Broadcast(s.hub, &websocket.SyncEvent{
+		Type:      websocket.EventCredentialDeleted,
+		UserID:    userID,
+		Zone:      zone,
+		GenCount:  deleted.GenCount,
+		DeviceID:  stringOrNil(deviceID),
+		ItemUUID:  itemID.String(),
+		Timestamp: s.clock.Now().Unix(),
+	})
+
+	return &DeleteCredentialResult{GenCount: deleted.GenCount, DeletedItems: countDeleted(deleted.Items)}, nil
+}
+
+// KeysTombstoned implements jobs.OrphanedKeyNotifier: the keys nothing
+// referred to were tombstoned by the server, so every device of the user
+// must pull them
+func (s *Service) KeysTombstoned(userID, zone string, result *storage.WipeResult) {
+	// The job wrote the zone's gencount and digest itself
+	s.engines.Reset(userID, zone)
+
+	system := service.Caller{}
+	event := system.AuditEvent(userID, service.AuditActionOrphanedKeys)
+	event.Zone = &zone
+	event.Details = service.AuditDetails(map[string]interface{}{
+		"deleted":  len(result.Items),
+		"gencount": result.GenCount,
+	})
+	s.recordWipe(system, zone, event, result, true)
+	service.Broadcast(s.hub, &websocket.SyncEvent{
+		Type:      websocket.EventCredentialsChanged,
+		UserID:    userID,
+		Zone:      zone,
+		GenCount:  result.GenCount,
+		Timestamp: s.clock.Now().Unix(),
+	})
+}
@@ -0,0 +1,70 @@
+package sync
+
+import (
+	"context"
+
+	domainsync "github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/service"
+)
+
+// DiffInput is a device's copy of a zone: the "layer:uuid:gencount" tuple
+// of every live item it holds, as a version 2 manifest hashes them
+type DiffInput struct {
+	Zone   string // "default" when empty
+	Leaves []string
+}
+
+// DiffResult is how a device's copy of a zone differs from the server's.
+// The device pulls Added and Modified by item UUID and drops Removed.
+type DiffResult struct {
+	Zone     string
+	GenCount int64
+	// DigestVersion digest of the leaves compared against, which the
+	// device's copy hashes to once reconciled
+	Digest []byte
+	domainsync.ManifestDiff
+}
+
+// Diff compares the caller's leaves with the zone's live items, so a device
+// whose digest diverged can fetch only what differs instead of pulling
+// everything since its last gencount
+func (s *Service) Diff(ctx context.Context, caller service.Caller, in DiffInput) (*DiffResult, error) {
+	if err := s.CheckDevice(ctx, caller, false); err != nil {
+		return nil, err
+	}
+	if in.Zone == "" {
+		in.Zone = "default"
+	}
+
+	deviceLeaves := make([]domainsync.ManifestLeaf, len(in.Leaves))
+	for i, tuple := range in.Leaves {
+		leaf, err := domainsync.ParseManifestLeaf(tuple)
+		if err != nil {
+			return nil, service.CodedError(service.KindInvalid, "invalid_leaf", err.Error(), map[string]interface{}{"index": i})
+		}
+		deviceLeaves[i] = leaf
+	}
+
+	result := &DiffResult{Zone: in.Zone}
+	state, err := s.store.GetSyncStateContext(ctx, caller.UserID, in.Zone)
+	if err != nil && ctx.Err() != nil {
+		return nil, service.Internal("failed to get manifest", err)
+	}
+	if err == nil {
+		result.GenCount = state.GenCount
+	}
+
+	serverLeaves, err := s.store.ManifestLeaves(ctx, caller.UserID, in.Zone)
+	if err != nil {
+		return nil, service.Internal("failed to list manifest leaves", err)
+	}
+	syncEngine, err := s.engines.GetOrLoad(caller.UserID, in.Zone)
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+	result.Digest = domainsync.ManifestDigest(serverLeaves)
+	result.ManifestDiff = *syncEngine.DiffLeaves(deviceLeaves, serverLeaves)
+
+	s.touchDevice(ctx, caller.DeviceID)
+	return result, nil
+}
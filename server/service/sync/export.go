@@ -0,0 +1,106 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+// ExportFormatVersion is the version of the vault export document. Imports
+// must refuse versions they don't know.
+const ExportFormatVersion = 1
+
+// exportLayers are the layers an export holds: all of them
+var exportLayers = mapping.PullLayers{Keys: true, Metadata: true, Records: true}
+
+// ExportHeader opens a vault export
+type ExportHeader struct {
+	Version    int
+	ExportedAt time.Time
+}
+
+// ExportWriter receives a vault export while it is read: Begin once, then
+// per zone BeginZone, its items and EndZone. An error after Begin can only
+// cut the export short.
+type ExportWriter interface {
+	Begin(header *ExportHeader) error
+	// BeginZone opens a zone with its manifest; the zone's items follow,
+	// keys before the items they decrypt
+	BeginZone(state *storage.SyncState) error
+	ItemWriter
+	// EndZone closes the zone with how many items it had
+	EndZone(items int) error
+}
+
+// ExportResult closes a vault export
+type ExportResult struct {
+	Zones int
+	Items int
+}
+
+// Export writes the caller's whole vault for an offline backup: every
+// zone's manifest and live items, ciphertext as stored. It is read in a
+// single transaction like a snapshot, so each zone's items are exactly the
+// ones its digest covers; unlike a snapshot it is never paged, and items
+// are handed to w as they are read rather than collected first.
+func (s *Service) Export(ctx context.Context, caller service.Caller, w ExportWriter) (*ExportResult, error) {
+	if err := s.CheckDevice(ctx, caller, false); err != nil {
+		return nil, err
+	}
+	userID := caller.UserID
+
+	result := &ExportResult{}
+	err := s.store.ReadSnapshot(ctx, userID, func(snap storage.SnapshotReader) error {
+		states, err := snap.ListSyncStates(ctx)
+		if err != nil {
+			return service.Internal("failed to list zones", err)
+		}
+
+		header := &ExportHeader{Version: ExportFormatVersion, ExportedAt: s.clock.Now().UTC()}
+		if err := w.Begin(header); err != nil {
+			return err
+		}
+		for _, state := range states {
+			if err := w.BeginZone(state); err != nil {
+				return err
+			}
+			var items int
+			for _, layer := range exportLayers.Order() {
+				r := storage.PullRange{Zone: state.Zone, Until: state.GenCount}
+				n, err := streamLayer(ctx, snap, layer, r, w)
+				items += n
+				if err != nil {
+					return err
+				}
+			}
+			if err := w.EndZone(items); err != nil {
+				return err
+			}
+			result.Zones++
+			result.Items += items
+		}
+		return nil
+	})
+	if err != nil {
+		var serviceErr *service.Error
+		if errors.As(err, &serviceErr) {
+			return nil, serviceErr
+		}
+		return nil, service.Internal("failed to read vault", err)
+	}
+
+	exportEvent := caller.AuditEvent(userID, service.AuditActionSyncExport)
+	exportEvent.Details = service.AuditDetails(map[string]interface{}{
+		"zones":   result.Zones,
+		"items":   result.Items,
+		"version": ExportFormatVersion,
+	})
+	service.RecordAudit(s.store, exportEvent)
+	s.touchDevice(ctx, caller.DeviceID)
+
+	return result, nil
+}
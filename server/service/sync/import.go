@@ -0,0 +1,426 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	domainsync "github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/google/uuid"
+)
+
+// ImportInput is a vault export to restore
+type ImportInput struct {
+	Version int
+	Zones   []ImportZone
+	// Merge into a vault that already has items rather than require an
+	// empty one
+	Merge bool
+}
+
+// ImportZone is one zone of an export: its manifest digest and its items in
+// the push DTO shape, with the gencounts they had when exported
+type ImportZone struct {
+	Zone          string
+	Digest        []byte
+	DigestVersion int
+	Keys          []mapping.CryptoKeyDTO
+	Metadata      []mapping.CredentialMetadataDTO
+	Records       []mapping.SyncRecordDTO
+}
+
+// ImportResult counts what became of an import's items; each is counted
+// once
+type ImportResult struct {
+	Imported   int // Written with no stored version in the way
+	Skipped    int // Invalid, or stored already as they were exported
+	Conflicted int // Settled against a different stored version
+	Zones      []ImportZoneResult
+	// How each conflicted item was settled: ResolutionClientWins when the
+	// imported version was written
+	Conflicts []ImportConflict
+}
+
+// ImportZoneResult is the outcome of an import for one zone
+type ImportZoneResult struct {
+	Zone       string
+	GenCount   int64 // Zone gencount afterwards
+	Imported   int
+	Skipped    int
+	Conflicted int
+}
+
+// ImportConflict is an imported item whose UUID the zone held at another
+// version
+type ImportConflict struct {
+	Zone  string
+	Layer string
+	PushConflict
+
+	written *int64 // The imported item's gencount, when it won
+}
+
+// importItem is an imported item on its way to the batch, with what the
+// conflict path needs of it
+type importItem struct {
+	layer    string
+	itemUUID uuid.UUID
+	genCount int64 // As exported
+	deleted  bool
+}
+
+// Import restores a vault export: each zone's digest is checked against its
+// items, then every item is written in a single transaction with gencounts
+// newly allocated from its zone, as if one device pushed them all. By
+// default the caller's vault must hold no live items. With in.Merge an item
+// whose UUID the zone already holds at a different version is settled by
+// the zone's engine like a push made from the exported version
+// (SyncEngine.ResolvePush); the stored version of a zone under
+// ManualResolve is kept, there being no device to ask.
+func (s *Service) Import(ctx context.Context, caller service.Caller, in ImportInput) (*ImportResult, error) {
+	if err := s.CheckDevice(ctx, caller, true); err != nil {
+		return nil, err
+	}
+	userID, deviceID := caller.UserID, caller.DeviceID
+
+	if in.Version != ExportFormatVersion {
+		return nil, service.CodedError(service.KindInvalid, "unknown_export_version",
+			fmt.Sprintf("export version %d is not supported", in.Version),
+			map[string]interface{}{"version": in.Version, "supported_version": ExportFormatVersion})
+	}
+	seen := make(map[string]bool, len(in.Zones))
+	for i := range in.Zones {
+		zone := &in.Zones[i]
+		if err := domainsync.ValidateZoneName(zone.Zone); err != nil {
+			return nil, service.CodedError(service.KindInvalid, "invalid_zone", err.Error(),
+				map[string]interface{}{"zone": zone.Zone})
+		}
+		if seen[zone.Zone] {
+			return nil, service.CodedError(service.KindInvalid, "invalid_zone",
+				fmt.Sprintf("zone %q appears more than once", zone.Zone), map[string]interface{}{"zone": zone.Zone})
+		}
+		seen[zone.Zone] = true
+		if err := checkImportDigest(zone); err != nil {
+			return nil, err
+		}
+	}
+
+	if !in.Merge {
+		summaries, err := s.store.GetZonesByUser(ctx, userID)
+		if err != nil {
+			return nil, service.Internal("failed to list zones", err)
+		}
+		var live int64
+		for _, summary := range summaries {
+			live += summary.Keys + summary.Metadata + summary.Records
+		}
+		if live > 0 {
+			return nil, service.CodedError(service.KindConflict, "account_not_empty",
+				"the vault already holds items; import with merge=true to merge into it",
+				map[string]interface{}{"items": live})
+		}
+	}
+
+	result := &ImportResult{}
+	var batches []*storage.PushBatch
+	for i := range in.Zones {
+		batch, zoneResult, conflicts, err := s.importZone(ctx, caller, &in.Zones[i], in.Merge)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+		result.Zones = append(result.Zones, *zoneResult)
+		result.Conflicts = append(result.Conflicts, conflicts...)
+	}
+	if err := s.checkCredentialLimit(ctx, caller, batches...); err != nil {
+		return nil, err
+	}
+
+	if err := s.store.CommitImport(ctx, userID, batches); err != nil {
+		var itemErr *storage.ImportItemError
+		if errors.As(err, &itemErr) {
+			return nil, &service.Error{
+				Kind:    service.KindInvalid,
+				Code:    "item_rejected",
+				Message: "rejected by storage: " + itemErr.Error(),
+				Fields: map[string]interface{}{
+					"zone":      itemErr.Zone,
+					"layer":     itemErr.Layer,
+					"item_uuid": batchItemUUID(batches, itemErr),
+				},
+				Err: err,
+			}
+		}
+		return nil, service.Internal("failed to commit import", err)
+	}
+
+	for i, batch := range batches {
+		// The import moved the zone's gencount outside its engine. A digest
+		// that fails here is left to the manifest drift job.
+		s.engines.Reset(userID, batch.Zone)
+		if err := s.saveImportDigest(ctx, userID, batch.Zone); err != nil {
+			log.Printf("⚠️  Digest of zone %s after import for user %s: %v", batch.Zone, userID, err)
+		}
+
+		zoneResult := &result.Zones[i]
+		zoneResult.GenCount = batch.GenCount
+		result.Imported += zoneResult.Imported
+		result.Skipped += zoneResult.Skipped
+		result.Conflicted += zoneResult.Conflicted
+	}
+	for i := range result.Conflicts {
+		if written := result.Conflicts[i].written; written != nil {
+			result.Conflicts[i].WinningGenCount = *written
+		}
+	}
+
+	importEvent := caller.AuditEvent(userID, service.AuditActionSyncImport)
+	importEvent.Details = service.AuditDetails(map[string]interface{}{
+		"zones":      len(batches),
+		"imported":   result.Imported,
+		"skipped":    result.Skipped,
+		"conflicted": result.Conflicted,
+		"merge":      in.Merge,
+		"version":    in.Version,
+	})
+	service.RecordAudit(s.store, importEvent)
+	s.touchDevice(ctx, deviceID)
+	for _, batch := range batches {
+		if batch.Len() == 0 {
+			continue
+		}
+		service.Broadcast(s.hub, &websocket.SyncEvent{
+			Type:      websocket.EventCredentialsChanged,
+			UserID:    userID,
+			Zone:      batch.Zone,
+			GenCount:  batch.GenCount,
+			DeviceID:  stringOrNil(deviceID),
+			Timestamp: s.clock.Now().Unix(),
+		})
+	}
+
+	return result, nil
+}
+
+// saveImportDigest stores the zone's digest once an import committed, as a
+// push's digest stage does
+func (s *Service) saveImportDigest(ctx context.Context, userID, zone string) error {
+	manifest, err := s.store.ComputeManifest(ctx, userID, zone)
+	if err != nil {
+		return err
+	}
+	syncEngine, err := s.engines.GetOrLoad(userID, zone)
+	if err != nil {
+		return err
+	}
+	syncEngine.SetManifestDigest(manifest.Digest)
+	return s.engines.Persist(userID, zone, syncEngine)
+}
+
+// checkImportDigest refuses a zone whose live items don't hash to the
+// digest it was exported with. A zone exported without a digest must have
+// no live items.
+func checkImportDigest(zone *ImportZone) error {
+	mismatch := func(message string) error {
+		return service.CodedError(service.KindInvalid, "export_digest_mismatch", message,
+			map[string]interface{}{"zone": zone.Zone, "digest_version": zone.DigestVersion})
+	}
+	if zone.DigestVersion != domainsync.DigestVersion {
+		return mismatch(fmt.Sprintf("zone %q has digest version %d; only %d can be checked",
+			zone.Zone, zone.DigestVersion, domainsync.DigestVersion))
+	}
+
+	var leaves []domainsync.ManifestLeaf
+	add := func(layer string, index int, itemUUID string, genCount int64, deleted bool) error {
+		id, err := uuid.Parse(itemUUID)
+		if err != nil {
+			return service.CodedError(service.KindInvalid, "invalid_item", "invalid item_uuid",
+				map[string]interface{}{"zone": zone.Zone, "layer": layer, "index": index, "field": "item_uuid"})
+		}
+		if !deleted {
+			leaves = append(leaves, domainsync.ManifestLeaf{Layer: layer, ItemUUID: id.String(), GenCount: genCount})
+		}
+		return nil
+	}
+	for i, dto := range zone.Keys {
+		if err := add(domainsync.LeafCryptoKey, i, dto.ItemUUID, dto.GenCount, dto.Tombstone); err != nil {
+			return err
+		}
+	}
+	for i, dto := range zone.Metadata {
+		if err := add(domainsync.LeafCredentialMetadata, i, dto.ItemUUID, dto.GenCount, dto.Tombstone); err != nil {
+			return err
+		}
+	}
+	for i, dto := range zone.Records {
+		if err := add(domainsync.LeafSyncRecord, i, dto.ItemUUID, dto.GenCount, dto.Tombstone); err != nil {
+			return err
+		}
+	}
+
+	if len(zone.Digest) == 0 && len(leaves) == 0 {
+		return nil
+	}
+	if !bytes.Equal(domainsync.ManifestDigest(leaves), zone.Digest) {
+		return mismatch(fmt.Sprintf("the items of zone %q don't match its digest", zone.Zone))
+	}
+	return nil
+}
+
+// importZone converts a zone of an import into its batch. Invalid items are
+// skipped; under merge so are items stored as they were exported, and
+// those settled against another stored version in the stored one's favour.
+func (s *Service) importZone(ctx context.Context, caller service.Caller, zone *ImportZone, merge bool) (*storage.PushBatch, *ImportZoneResult, []ImportConflict, error) {
+	userID := caller.UserID
+	result := &ImportZoneResult{Zone: zone.Zone}
+	batch := &storage.PushBatch{Zone: zone.Zone, DeviceID: caller.DeviceID}
+
+	var keyItems, credItems, recordItems []importItem
+	for _, dto := range zone.Keys {
+		key, err := mapping.ToCryptoKey(dto, userID, zone.Zone, 0)
+		if err != nil {
+			result.Skipped++
+			continue
+		}
+		batch.Keys = append(batch.Keys, key)
+		keyItems = append(keyItems, importItem{mapping.LayerCryptoKey, key.ItemUUID, dto.GenCount, dto.Tombstone})
+	}
+	for _, dto := range zone.Metadata {
+		cred, err := mapping.ToCredentialMetadata(dto, userID, zone.Zone, 0)
+		if err != nil {
+			result.Skipped++
+			continue
+		}
+		batch.Metadata = append(batch.Metadata, cred)
+		credItems = append(credItems, importItem{mapping.LayerCredentialMetadata, cred.ItemUUID, dto.GenCount, dto.Tombstone})
+	}
+	for _, dto := range zone.Records {
+		record, err := mapping.ToSyncRecord(dto, userID, zone.Zone, 0)
+		if err != nil {
+			result.Skipped++
+			continue
+		}
+		batch.Records = append(batch.Records, record)
+		recordItems = append(recordItems, importItem{mapping.LayerSyncRecord, record.ItemUUID, dto.GenCount, dto.Tombstone})
+	}
+
+	if !merge {
+		result.Imported = int(batch.Len())
+		return batch, result, nil, nil
+	}
+
+	probe := storage.ItemProbe{UserID: userID, Zone: zone.Zone}
+	for _, items := range [][]importItem{keyItems, credItems, recordItems} {
+		for _, item := range items {
+			probe.ItemUUIDs = append(probe.ItemUUIDs, item.itemUUID)
+		}
+	}
+	if len(probe.ItemUUIDs) == 0 {
+		return batch, result, nil, nil
+	}
+	states, err := s.store.ProbeItems(ctx, probe)
+	if err != nil {
+		return nil, nil, nil, service.Internal("failed to check for conflicts", err)
+	}
+	syncEngine, err := s.engines.GetOrLoad(userID, zone.Zone)
+	if err != nil {
+		return nil, nil, nil, service.Internal("", err)
+	}
+	strategy := syncEngine.Strategy()
+	if strategy == domainsync.ManualResolve {
+		strategy = domainsync.HighestGenCountWins
+	}
+
+	var conflicts []ImportConflict
+	// keep reports whether an item is written; genCount is where the
+	// batch will number it
+	keep := func(item importItem, genCount *int64) (bool, error) {
+		state, ok := states[item.itemUUID]
+		if !ok || state.Layer != item.layer {
+			result.Imported++
+			return true, nil
+		}
+		if state.GenCount == item.genCount && state.Tombstone == item.deleted {
+			result.Skipped++
+			return false, nil
+		}
+
+		stored := &models.SyncRecord{ItemUUID: item.itemUUID, GenCount: state.GenCount, Tombstone: state.Tombstone}
+		imported := &models.SyncRecord{ItemUUID: item.itemUUID, GenCount: item.genCount, Tombstone: item.deleted}
+		conflict, err := syncEngine.ResolvePush(strategy, stored, imported, item.genCount)
+		if err != nil {
+			return false, service.Internal("failed to resolve conflict", err)
+		}
+		result.Conflicted++
+		settled := ImportConflict{Zone: zone.Zone, Layer: item.layer, PushConflict: PushConflict{
+			ItemUUID:        conflict.ItemUUID,
+			Resolution:      conflict.Resolution,
+			Outcome:         conflict.Outcome,
+			WinningGenCount: conflict.StoredGenCount,
+		}}
+		won := conflict.Resolution == domainsync.ResolutionClientWins
+		if won {
+			settled.written = genCount
+		}
+		conflicts = append(conflicts, settled)
+		return won, nil
+	}
+
+	keys := batch.Keys[:0]
+	for i, key := range batch.Keys {
+		ok, err := keep(keyItems[i], &key.GenCount)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	creds := batch.Metadata[:0]
+	for i, cred := range batch.Metadata {
+		ok, err := keep(credItems[i], &cred.GenCount)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if ok {
+			creds = append(creds, cred)
+		}
+	}
+	records := batch.Records[:0]
+	for i, record := range batch.Records {
+		ok, err := keep(recordItems[i], &record.GenCount)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if ok {
+			records = append(records, record)
+		}
+	}
+	batch.Keys, batch.Metadata, batch.Records = keys, creds, records
+	return batch, result, conflicts, nil
+}
+
+// batchItemUUID names the item of an import storage refused
+func batchItemUUID(batches []*storage.PushBatch, itemErr *storage.ImportItemError) string {
+	for _, batch := range batches {
+		if batch.Zone != itemErr.Zone {
+			continue
+		}
+		switch itemErr.Layer {
+		case mapping.LayerCryptoKey:
+			return batch.Keys[itemErr.Index].ItemUUID.String()
+		case mapping.LayerCredentialMetadata:
+			return batch.Metadata[itemErr.Index].ItemUUID.String()
+		case mapping.LayerSyncRecord:
+			return batch.Records[itemErr.Index].ItemUUID.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,224 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	domainsync "github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+// integrityMaxItems caps the item UUIDs listed per finding
+const integrityMaxItems = 100
+
+// integrityPeriod is the window IntegrityLimits.RunsPerDay counts runs in
+const integrityPeriod = 24 * time.Hour
+
+// IntegrityLimits bounds how often and how long a user's integrity checks
+// run
+type IntegrityLimits struct {
+	RunsPerDay int
+	Timeout    time.Duration // Per query
+}
+
+var DefaultIntegrityLimits = IntegrityLimits{
+	RunsPerDay: domainsync.DefaultIntegrityRunsPerDay,
+	Timeout:    domainsync.DefaultIntegrityTimeout,
+}
+
+// SetIntegrityLimits replaces the integrity check limits. Zero fields keep
+// their current value.
+func (s *Service) SetIntegrityLimits(limits IntegrityLimits) {
+	if limits.RunsPerDay > 0 {
+		s.integrity.RunsPerDay = limits.RunsPerDay
+	}
+	if limits.Timeout > 0 {
+		s.integrity.Timeout = limits.Timeout
+	}
+}
+
+// IntegrityFinding is one problem the integrity checks found, with the
+// items involved
+type IntegrityFinding struct {
+	Check     string // One of the domainsync.Finding* kinds
+	Severity  string // One of the domainsync.Integrity* severities
+	Count     int64
+	ItemUUIDs []string
+	KeyUUIDs  []string // Keys the items refer to, for reference findings
+	Truncated bool     // More items are involved than listed
+	Repair    string   // One of the domainsync.Repair* actions; "" when the client can't fix it
+}
+
+// IntegrityReport is the result of a zone's integrity checks
+type IntegrityReport struct {
+	Zone          string
+	GeneratedAt   time.Time
+	GenCount      int64
+	LeafCount     int
+	MinEncVersion *int                // Lowest enc_version every active device reads; nil without devices
+	Findings      []*IntegrityFinding // Most severe first
+	RunsLeft      int                 // Further runs allowed today
+}
+
+// Healthy reports whether nothing worse than info was found
+func (r *IntegrityReport) Healthy() bool {
+	for _, finding := range r.Findings {
+		if finding.Severity != domainsync.IntegrityInfo {
+			return false
+		}
+	}
+	return true
+}
+
+// Integrity checks that a zone is coherent: every key reference resolves,
+// the stored digest matches the records, no key is left unreferenced and
+// every active device can read every record. The checks read the whole
+// zone, so each user gets a few runs a day and every query a timeout.
+func (s *Service) Integrity(ctx context.Context, caller service.Caller, zone string) (*IntegrityReport, error) {
+	userID := caller.UserID
+	now := s.clock.Now()
+	if err := s.CheckDevice(ctx, caller, false); err != nil {
+		return nil, err
+	}
+
+	runs, err := s.store.AuditEventTimes(ctx, userID, service.AuditActionSyncIntegrity, now.Add(-integrityPeriod))
+	if err != nil {
+		return nil, service.Internal("failed to check integrity", err)
+	}
+	if len(runs) >= s.integrity.RunsPerDay {
+		// Another run is allowed once the oldest counted one leaves the window
+		retryAfter := runs[len(runs)-s.integrity.RunsPerDay].Add(integrityPeriod).Sub(now)
+		return nil, service.CodedError(service.KindRateLimited, "rate_limited",
+			fmt.Sprintf("integrity checks are limited to %d per day", s.integrity.RunsPerDay),
+			map[string]interface{}{"retry_after_ms": max(retryAfter, time.Second).Milliseconds()})
+	}
+
+	// Recorded up front: a run cut off by the timeout loaded the database
+	// all the same
+	event := caller.AuditEvent(userID, service.AuditActionSyncIntegrity)
+	event.Zone = &zone
+	service.RecordAudit(s.store, event)
+
+	versions, err := s.store.GetDeviceEncVersions(ctx, userID)
+	if err != nil {
+		return nil, service.Internal("failed to check integrity", err)
+	}
+	minVersion, hasDevices := domainsync.MinSupportedEncVersion(versions)
+
+	scan, err := s.store.ScanIntegrity(ctx, userID, zone, storage.IntegrityScanOptions{
+		Limit:         integrityMaxItems,
+		MinEncVersion: minVersion,
+		Timeout:       s.integrity.Timeout,
+	})
+	if errors.Is(err, domainsync.ErrIntegrityTimeout) {
+		return nil, service.CodedError(service.KindUnavailable, "integrity_timeout", err.Error(), map[string]interface{}{"zone": zone})
+	}
+	if err != nil {
+		return nil, service.Internal("failed to check integrity", err)
+	}
+
+	report := &IntegrityReport{
+		Zone:        zone,
+		GeneratedAt: now,
+		GenCount:    scan.GenCount,
+		LeafCount:   scan.Computed.LeafCount,
+		Findings:    integrityFindings(scan),
+		RunsLeft:    s.integrity.RunsPerDay - len(runs) - 1,
+	}
+	if hasDevices {
+		report.MinEncVersion = &minVersion
+	}
+	return report, nil
+}
+
+// integrityFindings turns a scan into findings, most severe first
+func integrityFindings(scan *storage.IntegrityScan) []*IntegrityFinding {
+	findings := referenceFindings(scan.Violations)
+
+	// A zone that was never written has no digest to disagree with
+	written := scan.StoredDigest != nil || scan.GenCount != 0
+	if written && !bytes.Equal(scan.StoredDigest, scan.Computed.Digest) {
+		findings = append(findings, &IntegrityFinding{
+			Check:     domainsync.FindingDigestMismatch,
+			Severity:  domainsync.IntegrityWarning,
+			Count:     1,
+			ItemUUIDs: []string{},
+		})
+	}
+	if scan.Unsupported.Total > 0 {
+		findings = append(findings, sampleFinding(domainsync.FindingUnsupportedRecord,
+			domainsync.IntegrityWarning, domainsync.RepairReencrypt, scan.Unsupported))
+	}
+	if scan.OrphanedKeys.Total > 0 {
+		findings = append(findings, sampleFinding(domainsync.FindingOrphanedKey,
+			domainsync.IntegrityInfo, domainsync.RepairTombstoneKeys, scan.OrphanedKeys))
+	}
+	return findings
+}
+
+// referenceFindings groups reference violations by kind. Every one of them
+// leaves items a device cannot decrypt.
+func referenceFindings(violations []storage.ReferenceViolation) []*IntegrityFinding {
+	truncated := len(violations) > integrityMaxItems
+	if truncated {
+		violations = violations[:integrityMaxItems]
+	}
+
+	byCheck := map[string]*IntegrityFinding{}
+	keys := map[string]map[string]bool{}
+	for _, violation := range violations {
+		check := domainsync.FindingMissingKey
+		switch {
+		case violation.Field == "parent_key_uuid":
+			check = domainsync.FindingMissingParent
+		case violation.Violation == storage.ReferenceTombstoned:
+			check = domainsync.FindingTombstonedKey
+		}
+
+		finding, ok := byCheck[check]
+		if !ok {
+			finding = &IntegrityFinding{
+				Check:     check,
+				Severity:  domainsync.IntegrityError,
+				ItemUUIDs: []string{},
+				KeyUUIDs:  []string{},
+				Truncated: truncated,
+				Repair:    domainsync.RepairPushKeys,
+			}
+			byCheck[check] = finding
+			keys[check] = map[string]bool{}
+		}
+		// A credential missing both its keys counts once
+		if n := len(finding.ItemUUIDs); n == 0 || finding.ItemUUIDs[n-1] != violation.ItemUUID {
+			finding.ItemUUIDs = append(finding.ItemUUIDs, violation.ItemUUID)
+			finding.Count++
+		}
+		if !keys[check][violation.KeyUUID] {
+			keys[check][violation.KeyUUID] = true
+			finding.KeyUUIDs = append(finding.KeyUUIDs, violation.KeyUUID)
+		}
+	}
+
+	findings := make([]*IntegrityFinding, 0, len(byCheck))
+	for _, finding := range byCheck {
+		findings = append(findings, finding)
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Check < findings[j].Check })
+	return findings
+}
+
+func sampleFinding(check, severity, repair string, sample storage.ItemSample) *IntegrityFinding {
+	return &IntegrityFinding{
+		Check:     check,
+		Severity:  severity,
+		Count:     sample.Total,
+		ItemUUIDs: sample.ItemUUIDs,
+		Truncated: sample.Total > int64(len(sample.ItemUUIDs)),
+		Repair:    repair,
+	}
+}
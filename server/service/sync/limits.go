@@ -0,0 +1,71 @@
+package sync
+
+import (
+	"context"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/domain/limits"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/google/uuid"
+)
+
+// SetTierPolicy sets the limits of each subscription tier
+func (s *Service) SetTierPolicy(policy limits.Policy) {
+	s.tiers = policy
+}
+
+// checkCredentialLimit refuses writes adding more live credentials than the
+// caller's tier allows. Each batch counts the credentials it brings to life
+// in its zone: new item_uuids, and ones whose stored metadata is deleted.
+// Edits and deletes add nothing, so they pass even over the limit.
+func (s *Service) checkCredentialLimit(ctx context.Context, caller service.Caller, batches ...*storage.PushBatch) error {
+	if s.tiers.For(caller.Tier).Credentials == 0 {
+		return nil
+	}
+
+	var adding int64
+	for _, batch := range batches {
+		added, err := s.addedCredentials(ctx, caller.UserID, batch.Zone, batch.Metadata)
+		if err != nil {
+			return service.Internal("failed to count credentials", err)
+		}
+		adding += added
+	}
+	if adding == 0 {
+		return nil
+	}
+
+	usage, err := s.store.GetAccountUsage(ctx, caller.UserID)
+	if err != nil {
+		return service.Internal("failed to count credentials", err)
+	}
+	return service.CheckLimit(s.tiers, caller, limits.ResourceCredentials, usage.Credentials, adding)
+}
+
+// addedCredentials counts the live credentials creds bring to zone
+func (s *Service) addedCredentials(ctx context.Context, userID, zone string, creds []*models.CredentialMetadata) (int64, error) {
+	probe := storage.ItemProbe{UserID: userID, Zone: zone}
+	seen := make(map[uuid.UUID]bool, len(creds))
+	for _, cred := range creds {
+		if !cred.Tombstone && !seen[cred.ItemUUID] {
+			seen[cred.ItemUUID] = true
+			probe.ItemUUIDs = append(probe.ItemUUIDs, cred.ItemUUID)
+		}
+	}
+	if len(probe.ItemUUIDs) == 0 {
+		return 0, nil
+	}
+
+	states, err := s.store.ProbeItems(ctx, probe)
+	if err != nil {
+		return 0, err
+	}
+	var added int64
+	for _, id := range probe.ItemUUIDs {
+		if state, ok := states[id]; !ok || state.Tombstone {
+			added++
+		}
+	}
+	return added, nil
+}
@@ -0,0 +1,240 @@
+package sync
+
+import (
+	"context"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	domainsync "github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/google/uuid"
+)
+
+// DefaultPullPageSize is the page size of a resumed pull that sends no limit
+const DefaultPullPageSize = 500
+
+// PullInput selects a zone's changes since LastGenCount. A nil include
+// flag includes its layer.
+type PullInput struct {
+	Zone              string // "default" when empty
+	LastGenCount      int64
+	IncludeTombstoned bool
+	IncludeKeys       *bool
+	IncludeMetadata   *bool
+	IncludeRecords    *bool
+
+	// Limit pages the pull: each page holds at most Limit items and,
+	// while more remain, a checkpoint for the next one. A resumed pull
+	// sends only the checkpoint (and optionally a limit).
+	Limit      int
+	Checkpoint string
+
+	// ItemUUIDs narrows the pull to these items, e.g. a manifest diff's
+	// Added and Modified. Such a pull is not paged; the device splits a
+	// long list across requests itself.
+	ItemUUIDs []uuid.UUID
+}
+
+// PullResult is one pull, or one page of a paged pull. Layers left out of
+// Included have nil items; included layers outside the page are empty.
+type PullResult struct {
+	Included mapping.PullLayers
+	// Where the device's next incremental pull starts from; the
+	// watermark of a paged pull
+	GenCount             int64
+	TombstonesSuppressed bool // A bootstrap pull left tombstones out
+
+	Paged      bool
+	HasMore    bool   // Paged pulls only
+	Checkpoint string // Token for the next page while HasMore
+
+	Keys     []*models.CryptoKey
+	Metadata []*models.CredentialMetadata
+	Records  []*models.SyncRecord
+
+	// The calling device prefers MessagePack, for requests that don't say
+	MsgPack bool
+	// The sync schema version the calling device reads
+	SyncSchema int
+}
+
+// Pull reads the caller's changes to a zone, a page at a time when in.Limit
+// is set, and records that the calling device synced. A device advertising
+// a max_page_size is paged at no more than that, even without a limit.
+func (s *Service) Pull(ctx context.Context, caller service.Caller, in PullInput) (*PullResult, error) {
+	userID := caller.UserID
+	if err := s.CheckDevice(ctx, caller, false); err != nil {
+		return nil, err
+	}
+	layers := mapping.NewPullLayers(in.IncludeKeys, in.IncludeMetadata, in.IncludeRecords)
+	caps := s.deviceCapabilities(ctx, caller)
+	in.Limit = caps.PageSize(in.Limit)
+	if in.ItemUUIDs != nil {
+		if in.Checkpoint != "" {
+			return nil, service.NewError(service.KindInvalid, "item_uuids can't be combined with a checkpoint")
+		}
+		in.Limit = 0
+	}
+
+	// A checkpoint carries the whole query; the request only picks the
+	// page size
+	var checkpoint *domainsync.PullCheckpoint
+	if in.Checkpoint != "" {
+		cp, err := s.checkpoints.Decode(userID, in.Checkpoint)
+		if err != nil {
+			return nil, service.CodedError(service.KindInvalid, "invalid_checkpoint", err.Error(), nil)
+		}
+		checkpoint = cp
+		in.Zone = cp.Zone
+		in.LastGenCount = cp.Since
+		in.IncludeTombstoned = cp.IncludeTombstoned
+		layers = mapping.PullLayersFromMask(cp.Layers)
+		if in.Limit == 0 {
+			in.Limit = DefaultPullPageSize
+		}
+	}
+
+	if in.Zone == "" {
+		in.Zone = "default"
+	}
+
+	syncState, err := s.store.GetSyncStateContext(ctx, userID, in.Zone)
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+
+	result := &PullResult{
+		Included:   layers,
+		GenCount:   syncState.GenCount,
+		MsgPack:    caps.MsgPack,
+		SyncSchema: syncSchema(caps),
+	}
+	window := storage.PullRange{
+		Zone:              in.Zone,
+		Since:             in.LastGenCount,
+		IncludeTombstoned: in.IncludeTombstoned,
+		ItemUUIDs:         in.ItemUUIDs,
+	}
+	// The result's gencount is where the device's incremental pulls,
+	// which do carry tombstones, start from
+	if window.SuppressBootstrapTombstones() {
+		in.IncludeTombstoned = false
+		result.TombstonesSuppressed = true
+	}
+
+	// Unpaged pulls return every included layer in full
+	var spans []domainsync.PageSpan
+	for _, layer := range layers.Order() {
+		spans = append(spans, domainsync.PageSpan{Layer: layer})
+	}
+
+	if in.Limit > 0 {
+		if checkpoint != nil {
+			window.Until = checkpoint.Watermark
+		} else {
+			window.Until = syncState.GenCount
+		}
+		counts, err := s.store.CountPullWindow(ctx, userID, window)
+		if err != nil {
+			return nil, service.Internal("failed to count pull window", err)
+		}
+		layerCounts := map[int]int{
+			domainsync.PullLayerKeys:     counts.Keys,
+			domainsync.PullLayerMetadata: counts.Metadata,
+			domainsync.PullLayerRecords:  counts.Records,
+		}
+		var included []int
+		current := domainsync.PullWindow{GenCount: syncState.GenCount, Digest: syncState.Digest}
+		for _, layer := range layers.Order() {
+			included = append(included, layerCounts[layer])
+			current.Items += layerCounts[layer]
+		}
+
+		if checkpoint == nil {
+			checkpoint = &domainsync.PullCheckpoint{
+				Zone:              in.Zone,
+				Since:             in.LastGenCount,
+				Layers:            layers.Mask(),
+				IncludeTombstoned: in.IncludeTombstoned,
+				Watermark:         current.GenCount,
+				Digest:            current.Digest,
+				Items:             current.Items,
+			}
+		} else if err := checkpoint.Check(current); err != nil {
+			// Offsets into the old window no longer line up; the client
+			// discards the pull and starts over from where it began
+			return nil, &service.Error{
+				Kind:    service.KindConflict,
+				Code:    "checkpoint_stale",
+				Message: err.Error(),
+				Fields:  map[string]interface{}{"zone": checkpoint.Zone, "restart_from": checkpoint.Since},
+				Err:     err,
+			}
+		}
+
+		spans = domainsync.PlanPage(layers.Order(), included, checkpoint.Offset, in.Limit)
+		next := *checkpoint
+		for _, span := range spans {
+			next.Offset += span.Limit
+		}
+
+		// The client advances last_gencount only after the final page
+		result.Paged = true
+		result.GenCount = checkpoint.Watermark
+		result.HasMore = next.Offset < next.Items
+		if result.HasMore {
+			token, err := s.checkpoints.Encode(userID, &next)
+			if err != nil {
+				return nil, service.Internal("failed to encode checkpoint", err)
+			}
+			result.Checkpoint = token
+		}
+	}
+
+	for _, span := range spans {
+		page := window
+		page.Offset = span.Offset
+		page.Limit = span.Limit
+
+		switch span.Layer {
+		case domainsync.PullLayerKeys:
+			keys, err := s.store.GetCryptoKeysPage(ctx, userID, page)
+			if err != nil {
+				return nil, service.Internal("failed to get crypto keys", err)
+			}
+			result.Keys = append(result.Keys, keys...)
+		case domainsync.PullLayerMetadata:
+			metadata, err := s.store.GetCredentialMetadataPage(ctx, userID, page)
+			if err != nil {
+				return nil, service.Internal("failed to get credential metadata", err)
+			}
+			result.Metadata = append(result.Metadata, metadata...)
+		case domainsync.PullLayerRecords:
+			records, err := s.store.GetSyncRecordsPage(ctx, userID, page)
+			if err != nil {
+				return nil, service.Internal("failed to get sync records", err)
+			}
+			result.Records = append(result.Records, records...)
+		}
+	}
+
+	details := map[string]interface{}{
+		"last_gencount": in.LastGenCount,
+		"items":         len(result.Keys) + len(result.Metadata) + len(result.Records),
+		"included":      layers,
+	}
+	if checkpoint != nil {
+		details["offset"] = checkpoint.Offset
+	}
+	if in.ItemUUIDs != nil {
+		details["item_uuids"] = len(in.ItemUUIDs)
+	}
+	pullEvent := caller.AuditEvent(userID, service.AuditActionSyncPull)
+	pullEvent.Zone = &in.Zone
+	pullEvent.Details = service.AuditDetails(details)
+	service.RecordAudit(s.store, pullEvent)
+	s.touchDevice(ctx, caller.DeviceID)
+
+	return result, nil
+}
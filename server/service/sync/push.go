@@ -0,0 +1,588 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	domainsync "github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/deeplyprofound/password-sync/server/postcommit"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+// Push stages, published as "stage_<name>" latency metrics
+const (
+	stagePushValidate = "push_validate"
+	stagePushCommit   = "push_commit"
+	stagePushDigest   = "push_digest"
+	stagePushEvents   = "push_events"
+)
+
+const (
+	pushDigestTimeout = 10 * time.Second
+	pushEventsTimeout = 5 * time.Second
+)
+
+// PushInput is a batch of items to write to a zone
+type PushInput struct {
+	Zone     string // "default" when empty
+	Keys     []mapping.CryptoKeyDTO
+	Metadata []mapping.CredentialMetadataDTO
+	Records  []mapping.SyncRecordDTO
+
+	// Sequence numbers the pushes of one device from 1; 0 for a push that
+	// needs no ordering. See storage.PushBatch.
+	Sequence int64
+
+	// When the push arrived; the validation stage is timed from it. The
+	// call's start when zero.
+	Received time.Time
+
+	// ConflictStrategy overrides the service's for this push; see
+	// domainsync.ParseConflictStrategy
+	ConflictStrategy string
+}
+
+// PushResult reports a committed push
+type PushResult struct {
+	GenCount int64
+	Synced   int
+	// The digest and events were deferred to the post-commit queue
+	EventsPending bool
+	Sequence      int64
+	Warnings      []string // Devices that may not decrypt the records, per the warn policy
+
+	// One per pushed item: keys, then metadata, then sync records, each in
+	// the order they were sent
+	Results     []PushItemResult
+	FailedCount int
+
+	// Records pushed from an older version than the stored one
+	Conflicts []PushConflict
+}
+
+// PushConflict is how a pushed record made from an older version of its
+// item than the stored one was settled
+type PushConflict struct {
+	ItemUUID        string
+	Resolution      string // domainsync.ResolutionClientWins or ResolutionServerWins
+	Outcome         string // How it was settled; see domainsync.ConflictResolution
+	WinningGenCount int64  // Of the record the zone now holds
+}
+
+// What became of a pushed item
+const (
+	PushItemSynced = "synced"
+	PushItemFailed = "failed"
+)
+
+// PushItemResult is the outcome of one pushed item. A failed item was not
+// written; the others in its push were.
+type PushItemResult struct {
+	Layer    string // mapping.LayerCryptoKey etc.
+	Index    int    // Position in the push's list of that layer
+	ItemUUID string // As sent
+	Status   string // PushItemSynced or PushItemFailed
+	GenCount int64  // Synced items only
+
+	// Failed items: invalid_item with the offending field, conflict when
+	// the stored record won over it, or item_rejected when storage refused
+	// the item
+	Code  string
+	Field string
+	Error string
+}
+
+// Push validates and commits a batch of items. Deletes are refused while
+// the account is on legal hold; updates are not.
+func (s *Service) Push(ctx context.Context, caller service.Caller, in PushInput) (*PushResult, error) {
+	// Stage 1: validation
+	started := in.Received
+	if started.IsZero() {
+		started = time.Now()
+	}
+	userID, deviceID := caller.UserID, caller.DeviceID
+
+	if pushDeletes(&in) {
+		if err := checkLegalHold(caller); err != nil {
+			return nil, err
+		}
+	}
+
+	if in.Zone == "" {
+		in.Zone = "default"
+	}
+	if in.Sequence > 0 && deviceID == "" {
+		return nil, service.CodedError(service.KindInvalid, "device_required",
+			"a numbered push needs a token with a device claim", nil)
+	}
+	var strategyOverride *domainsync.ConflictResolutionStrategy
+	if in.ConflictStrategy != "" {
+		parsed, err := domainsync.ParseConflictStrategy(in.ConflictStrategy)
+		if err != nil {
+			return nil, service.CodedError(service.KindInvalid, "invalid_conflict_strategy", err.Error(), nil)
+		}
+		strategyOverride = &parsed
+	}
+	if err := s.CheckDevice(ctx, caller, true); err != nil {
+		return nil, err
+	}
+
+	// Validate every item before writing any. Invalid items are reported
+	// back and left out; the rest get gencounts in push order: keys, then
+	// metadata, then sync records. The range is reserved up front so
+	// concurrent pushes never share one.
+	results := newPushResults(&in)
+	keys := make([]*models.CryptoKey, 0, len(in.Keys))
+	for i, dto := range in.Keys {
+		key, err := mapping.ToCryptoKey(dto, userID, in.Zone, 0)
+		if malformedID(err) {
+			return nil, service.InvalidItem(i, err)
+		}
+		if results.invalid(mapping.LayerCryptoKey, i, err) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	creds := make([]*models.CredentialMetadata, 0, len(in.Metadata))
+	for i, dto := range in.Metadata {
+		cred, err := mapping.ToCredentialMetadata(dto, userID, in.Zone, 0)
+		if malformedID(err) {
+			return nil, service.InvalidItem(i, err)
+		}
+		if results.invalid(mapping.LayerCredentialMetadata, i, err) {
+			continue
+		}
+		creds = append(creds, cred)
+	}
+	records := make([]*models.SyncRecord, 0, len(in.Records))
+	bases := make([]int64, 0, len(in.Records)) // The gencount each record was made from
+	for i, dto := range in.Records {
+		record, err := mapping.ToSyncRecord(dto, userID, in.Zone, 0)
+		if malformedID(err) {
+			return nil, service.InvalidItem(i, err)
+		}
+		if results.invalid(mapping.LayerSyncRecord, i, err) {
+			continue
+		}
+		records = append(records, record)
+		bases = append(bases, dto.GenCount)
+	}
+
+	// Records some active device could not decrypt are refused or flagged,
+	// per the user's policy, before anything is written
+	var warnings []string
+	if pushed := highestEncVersion(records); pushed > domainsync.BaseEncVersion {
+		conflict, reject, err := s.checkEncVersion(ctx, userID, pushed)
+		if err != nil {
+			return nil, service.Internal("failed to check device support", err)
+		}
+		if reject {
+			return nil, service.CodedError(service.KindConflict, "enc_version_unsupported", conflict.Error(),
+				map[string]interface{}{
+					"enc_version":               conflict.Pushed,
+					"min_supported_enc_version": conflict.MinSupported,
+				})
+		}
+		if conflict != nil {
+			log.Printf("⚠️  User %s pushed enc_version %d; some devices support only %d",
+				userID, conflict.Pushed, conflict.MinSupported)
+			warnings = append(warnings, conflict.Error())
+		}
+	}
+
+	syncEngine, err := s.engines.GetOrLoad(userID, in.Zone)
+	if err != nil {
+		return nil, service.Internal("", err)
+	}
+
+	// Records made from a version older than the stored one are settled
+	// per the zone's strategy or the push's; those the stored record wins
+	// over are not written
+	strategy := syncEngine.Strategy()
+	if strategyOverride != nil {
+		strategy = *strategyOverride
+	}
+	conflicts, err := s.resolveConflicts(ctx, caller, in.Zone, syncEngine, strategy, records, bases)
+	if err != nil {
+		return nil, err
+	}
+	lost := make(map[*models.SyncRecord]string, len(conflicts))
+	for _, c := range conflicts {
+		if c.Resolution == domainsync.ResolutionServerWins {
+			lost[c.record] = c.Outcome
+		}
+	}
+	kept := records[:0]
+	for _, record := range records {
+		if outcome, ok := lost[record]; ok {
+			message := "another device wrote the item since the version this record was made from"
+			if outcome == domainsync.OutcomeDeleteWins {
+				message = "another device deleted the item since the version this record was made from"
+			}
+			results.drop(mapping.LayerSyncRecord, len(kept), "conflict", message)
+			continue
+		}
+		kept = append(kept, record)
+	}
+	records = kept
+
+	// The store numbers the items from the zone's gencounts inside its
+	// transaction, so concurrent pushes commit in gencount order
+	batch := &storage.PushBatch{
+		Zone:     in.Zone,
+		DeviceID: deviceID,
+		Sequence: in.Sequence,
+		Keys:     keys,
+		Metadata: creds,
+		Records:  records,
+	}
+	if err := s.checkCredentialLimit(ctx, caller, batch); err != nil {
+		return nil, err
+	}
+
+	metrics.Observe("stage_"+stagePushValidate, time.Since(started))
+
+	// Stage 2: the transactional write, bound to ctx
+	committing := time.Now()
+	rejected, err := s.store.CommitPush(ctx, userID, batch)
+	if err != nil {
+		var sequenceErr *domainsync.PushSequenceError
+		if errors.As(err, &sequenceErr) {
+			// A duplicate was applied before and can be dropped; any other
+			// push waits until the expected one went through
+			return nil, &service.Error{
+				Kind:    service.KindConflict,
+				Code:    "push_sequence_mismatch",
+				Message: sequenceErr.Error(),
+				Fields: map[string]interface{}{
+					"sequence":          sequenceErr.Received,
+					"expected_sequence": sequenceErr.Expected,
+					"duplicate":         sequenceErr.Duplicate(),
+				},
+				Err: err,
+			}
+		}
+		return nil, service.Internal("failed to commit push", err)
+	}
+	currentGenCount := batch.GenCount
+	syncEngine.CatchUp(currentGenCount)
+	syncEngine.RecordWriter(deviceID)
+	metrics.Observe("stage_"+stagePushCommit, time.Since(committing))
+	for _, itemErr := range rejected {
+		log.Printf("⚠️  User %s push to zone %s: %v", userID, in.Zone, itemErr)
+		results.reject(itemErr)
+	}
+
+	var itemEvents []*storage.AuditEvent
+	for i, key := range keys {
+		if results.written(mapping.LayerCryptoKey, i, key.GenCount) {
+			itemEvents = append(itemEvents, caller.ItemAuditEvent(userID, in.Zone, key.ItemUUID, mapping.LayerCryptoKey, key.GenCount, key.Tombstone))
+		}
+	}
+	for i, cred := range creds {
+		if results.written(mapping.LayerCredentialMetadata, i, cred.GenCount) {
+			itemEvents = append(itemEvents, caller.ItemAuditEvent(userID, in.Zone, cred.ItemUUID, mapping.LayerCredentialMetadata, cred.GenCount, cred.Tombstone))
+		}
+	}
+	written := make(map[*models.SyncRecord]bool, len(records))
+	for i, record := range records {
+		if results.written(mapping.LayerSyncRecord, i, record.GenCount) {
+			itemEvents = append(itemEvents, caller.ItemAuditEvent(userID, in.Zone, record.ItemUUID, mapping.LayerSyncRecord, record.GenCount, record.Tombstone))
+			written[record] = true
+		}
+	}
+	pushConflicts := settledConflicts(conflicts, written)
+
+	pushedCount := len(itemEvents)
+	failedCount := len(results.items) - pushedCount
+	pushEvent := caller.AuditEvent(userID, service.AuditActionSyncPush)
+	pushEvent.Zone = &in.Zone
+	pushDetails := map[string]interface{}{"synced": pushedCount, "gencount": currentGenCount}
+	if failedCount > 0 {
+		pushDetails["failed"] = failedCount
+	}
+	if in.Sequence > 0 {
+		pushDetails["sequence"] = in.Sequence
+	}
+	pushEvent.Details = service.AuditDetails(pushDetails)
+	auditEvents := append([]*storage.AuditEvent{pushEvent}, itemEvents...)
+
+	// Stage 3: the data is durable; digest maintenance and event dispatch
+	// run after Push returns. A digest that fails here is left to the
+	// manifest drift job.
+	zone := in.Zone
+	pending := s.postCommit.Dispatch(userID+"/"+zone,
+		postcommit.Stage{
+			Name:    stagePushDigest,
+			Timeout: pushDigestTimeout,
+			Run: func(ctx context.Context) error {
+				manifest, err := s.store.ComputeManifest(ctx, userID, zone)
+				if err != nil {
+					return err
+				}
+				syncEngine.SetManifestDigest(manifest.Digest)
+				return s.engines.Persist(userID, zone, syncEngine)
+			},
+		},
+		postcommit.Stage{
+			Name:    stagePushEvents,
+			Timeout: pushEventsTimeout,
+			Run: func(ctx context.Context) error {
+				service.RecordAudit(s.store, auditEvents...)
+				s.touchDevice(ctx, deviceID)
+				if pushedCount > 0 {
+					service.Broadcast(s.hub, &websocket.SyncEvent{
+						Type:      websocket.EventCredentialsChanged,
+						UserID:    userID,
+						Zone:      zone,
+						GenCount:  currentGenCount,
+						DeviceID:  stringOrNil(deviceID),
+						Timestamp: s.clock.Now().Unix(),
+					})
+				}
+				return ctx.Err()
+			},
+		},
+	)
+
+	return &PushResult{
+		GenCount:      currentGenCount,
+		Synced:        pushedCount,
+		EventsPending: pending,
+		Sequence:      in.Sequence,
+		Warnings:      warnings,
+		Results:       results.items,
+		FailedCount:   failedCount,
+		Conflicts:     pushConflicts,
+	}, nil
+}
+
+// recordConflict is a push conflict with the pushed record
+type recordConflict struct {
+	record *models.SyncRecord
+	*domainsync.PushConflict
+}
+
+// resolveConflicts finds the records made from an older version of their
+// item than the stored one and settles each under strategy, in push order.
+// Records without a base gencount are new to the device and never
+// conflict. Under ManualResolve any conflict refuses the whole push, and
+// the conflicting records are queued until a device picks the versions to
+// keep (see ResolveConflict).
+func (s *Service) resolveConflicts(ctx context.Context, caller service.Caller, zone string, engine *domainsync.SyncEngine,
+	strategy domainsync.ConflictResolutionStrategy, records []*models.SyncRecord, bases []int64) ([]recordConflict, error) {
+	userID := caller.UserID
+	probe := storage.ItemProbe{UserID: userID, Zone: zone}
+	for i, record := range records {
+		if bases[i] > 0 {
+			probe.ItemUUIDs = append(probe.ItemUUIDs, record.ItemUUID)
+		}
+	}
+	if len(probe.ItemUUIDs) == 0 {
+		return nil, nil
+	}
+	states, err := s.store.ProbeItems(ctx, probe)
+	if err != nil {
+		return nil, service.Internal("failed to check for conflicts", err)
+	}
+
+	var conflicts []recordConflict
+	var queued []*storage.SyncConflict
+	for i, record := range records {
+		state, ok := states[record.ItemUUID]
+		if bases[i] == 0 || !ok || state.GenCount <= bases[i] {
+			continue
+		}
+		stored := &models.SyncRecord{ItemUUID: record.ItemUUID, GenCount: state.GenCount, Tombstone: state.Tombstone}
+		conflict, err := engine.ResolvePush(strategy, stored, record, bases[i])
+		if errors.Is(err, domainsync.ErrManualResolve) {
+			queued = append(queued, &storage.SyncConflict{
+				Zone:           zone,
+				ItemUUID:       record.ItemUUID,
+				DeviceID:       stringOrNil(caller.DeviceID),
+				BaseGenCount:   conflict.BaseGenCount,
+				StoredGenCount: conflict.StoredGenCount,
+				Pushed:         record,
+			})
+			continue
+		}
+		if err != nil {
+			return nil, service.Internal("failed to resolve conflict", err)
+		}
+		conflicts = append(conflicts, recordConflict{record: record, PushConflict: conflict})
+	}
+	if queued == nil {
+		return conflicts, nil
+	}
+
+	if err := s.store.QueueConflicts(ctx, userID, queued); err != nil {
+		return nil, service.Internal("failed to queue conflicts", err)
+	}
+	manual := make([]map[string]interface{}, 0, len(queued))
+	for _, conflict := range queued {
+		manual = append(manual, map[string]interface{}{
+			"conflict_id":     conflict.ID,
+			"item_uuid":       conflict.ItemUUID.String(),
+			"gencount":        conflict.BaseGenCount,
+			"stored_gencount": conflict.StoredGenCount,
+		})
+	}
+	return nil, service.CodedError(service.KindConflict, "push_conflict",
+		"records were made from older versions than the stored ones; resolve the queued conflicts",
+		map[string]interface{}{"conflicts": manual})
+}
+
+// settledConflicts reports how a committed push's conflicts ended. A record
+// that won but storage then refused left the stored one in place.
+func settledConflicts(conflicts []recordConflict, written map[*models.SyncRecord]bool) []PushConflict {
+	var settled []PushConflict
+	for _, c := range conflicts {
+		result := PushConflict{
+			ItemUUID:        c.ItemUUID,
+			Resolution:      domainsync.ResolutionServerWins,
+			Outcome:         c.Outcome,
+			WinningGenCount: c.StoredGenCount,
+		}
+		if c.Resolution == domainsync.ResolutionClientWins && written[c.record] {
+			result.Resolution, result.WinningGenCount = domainsync.ResolutionClientWins, c.record.GenCount
+		}
+		settled = append(settled, result)
+	}
+	return settled
+}
+
+// pushResults tracks the outcome of each item of a push
+type pushResults struct {
+	items  []PushItemResult
+	offset map[string]int // Where each layer's items start
+	// Per layer, the result of each valid item, in batch order
+	valid map[string][]*PushItemResult
+}
+
+func newPushResults(in *PushInput) *pushResults {
+	r := &pushResults{
+		items: make([]PushItemResult, 0, len(in.Keys)+len(in.Metadata)+len(in.Records)),
+		offset: map[string]int{
+			mapping.LayerCryptoKey:          0,
+			mapping.LayerCredentialMetadata: len(in.Keys),
+			mapping.LayerSyncRecord:         len(in.Keys) + len(in.Metadata),
+		},
+		valid: make(map[string][]*PushItemResult, 3),
+	}
+	for i, key := range in.Keys {
+		r.items = append(r.items, PushItemResult{Layer: mapping.LayerCryptoKey, Index: i, ItemUUID: key.ItemUUID, Status: PushItemSynced})
+	}
+	for i, cred := range in.Metadata {
+		r.items = append(r.items, PushItemResult{Layer: mapping.LayerCredentialMetadata, Index: i, ItemUUID: cred.ItemUUID, Status: PushItemSynced})
+	}
+	for i, record := range in.Records {
+		r.items = append(r.items, PushItemResult{Layer: mapping.LayerSyncRecord, Index: i, ItemUUID: record.ItemUUID, Status: PushItemSynced})
+	}
+	return r
+}
+
+// invalid records the validation of an item, reporting whether it failed
+func (r *pushResults) invalid(layer string, index int, err error) bool {
+	result := &r.items[r.offset[layer]+index]
+	if err == nil {
+		r.valid[layer] = append(r.valid[layer], result)
+		return false
+	}
+
+	result.Status, result.Code, result.Error = PushItemFailed, "invalid_item", err.Error()
+	var fieldErr *mapping.FieldError
+	if errors.As(err, &fieldErr) {
+		result.Field = fieldErr.Field
+	}
+	return true
+}
+
+// reject fails an item storage refused; its index is the batch's
+func (r *pushResults) reject(itemErr *storage.PushItemError) {
+	result := r.valid[itemErr.Layer][itemErr.Index]
+	result.Status, result.Code, result.Error = PushItemFailed, "item_rejected", "rejected by storage"
+}
+
+// drop fails the batch's index'th item of layer before it is written,
+// leaving it out of the batch so the later items' indexes stay in step
+func (r *pushResults) drop(layer string, index int, code, message string) {
+	result := r.valid[layer][index]
+	result.Status, result.Code, result.Error = PushItemFailed, code, message
+	r.valid[layer] = append(r.valid[layer][:index], r.valid[layer][index+1:]...)
+}
+
+// written records the gencount of the batch's index'th item of layer,
+// reporting whether it was written
+func (r *pushResults) written(layer string, index int, genCount int64) bool {
+	result := r.valid[layer][index]
+	if result.Status != PushItemSynced {
+		return false
+	}
+	result.GenCount = genCount
+	return true
+}
+
+// malformedID reports whether err is an item ID or key reference that does
+// not parse. Rows are keyed by those IDs, so rather than skip the item the
+// whole push is refused: the client sending it is broken.
+func malformedID(err error) bool {
+	var fieldErr *mapping.FieldError
+	return errors.As(err, &fieldErr) && fieldErr.Reason == mapping.ReasonInvalidUUID
+}
+
+// pushDeletes reports whether a push tombstones any item
+func pushDeletes(in *PushInput) bool {
+	for _, key := range in.Keys {
+		if key.Tombstone {
+			return true
+		}
+	}
+	for _, cred := range in.Metadata {
+		if cred.Tombstone {
+			return true
+		}
+	}
+	for _, record := range in.Records {
+		if record.Tombstone {
+			return true
+		}
+	}
+	return false
+}
+
+// highestEncVersion is the newest enc_version among the valid pushed
+// records, whose unset versions were given the default
+func highestEncVersion(records []*models.SyncRecord) int {
+	highest := 0
+	for _, record := range records {
+		highest = max(highest, record.EncVersion)
+	}
+	return highest
+}
+
+// checkEncVersion checks a push's enc_version against the user's active
+// devices and their enc_version policy
+func (s *Service) checkEncVersion(ctx context.Context, userID string, pushed int) (*domainsync.EncVersionConflict, bool, error) {
+	versions, err := s.store.GetDeviceEncVersions(ctx, userID)
+	if err != nil {
+		return nil, false, err
+	}
+	if lowest, ok := domainsync.MinSupportedEncVersion(versions); !ok || pushed <= lowest {
+		return nil, false, nil
+	}
+
+	// The policy is only needed once there is a conflict
+	settings, err := s.store.GetUserSettings(ctx, userID)
+	if err != nil {
+		return nil, false, err
+	}
+	conflict, reject := domainsync.CheckEncVersion(pushed, versions, settings.EncVersionPolicy)
+	return conflict, reject, nil
+}
@@ -0,0 +1,200 @@
+package sync
+
+import (
+	"context"
+	"errors"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	domainsync "github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+// Snapshot page sizes, in items across all zones and layers
+const (
+	DefaultSnapshotPageSize = 1000
+	MaxSnapshotPageSize     = 5000
+)
+
+// SnapshotInput selects an account snapshot page. Without layers the
+// snapshot is the zones' manifests only.
+type SnapshotInput struct {
+	Layers     mapping.PullLayers
+	Limit      int    // 0 means DefaultSnapshotPageSize
+	Checkpoint string // Resumes a snapshot; it carries the layers
+}
+
+// SnapshotHeader opens a snapshot page
+type SnapshotHeader struct {
+	// Every zone's gencount when the snapshot began: where the client's
+	// incremental pulls of each zone start from
+	GenCounts map[string]int64
+	Zones     []*storage.SyncState // The zones' manifests; first page only
+	Included  mapping.PullLayers
+	// The sync schema version the calling device reads
+	SyncSchema int
+}
+
+// ItemWriter receives the items of a snapshot or export as they are read
+type ItemWriter interface {
+	Key(key *models.CryptoKey) error
+	Metadata(cred *models.CredentialMetadata) error
+	Record(record *models.SyncRecord) error
+}
+
+// SnapshotWriter receives a snapshot page while it is read. Begin is called
+// once before any item; an error after it can only cut the page short.
+type SnapshotWriter interface {
+	Begin(header *SnapshotHeader) error
+	ItemWriter
+}
+
+// SnapshotResult closes a snapshot page
+type SnapshotResult struct {
+	Items      int
+	HasMore    bool
+	Checkpoint string // Token for the next page while HasMore
+}
+
+// Snapshot writes a page of the caller's whole account as of one moment:
+// every zone's manifest, then the live items of the included layers, zone
+// by zone, keys before the items they decrypt. A page is read in a single
+// transaction, so a concurrent push is in it entirely or not at all; later
+// pages are refused with checkpoint_stale once a zone they still have to
+// deliver has changed. A page may end up empty when the previous one
+// filled up exactly.
+func (s *Service) Snapshot(ctx context.Context, caller service.Caller, in SnapshotInput, w SnapshotWriter) (*SnapshotResult, error) {
+	if err := s.CheckDevice(ctx, caller, false); err != nil {
+		return nil, err
+	}
+	userID := caller.UserID
+
+	var checkpoint *domainsync.SnapshotCheckpoint
+	if in.Checkpoint != "" {
+		cp, err := s.snapshots.DecodeSnapshot(userID, in.Checkpoint)
+		if err != nil {
+			return nil, service.CodedError(service.KindInvalid, "invalid_checkpoint", err.Error(), nil)
+		}
+		checkpoint = cp
+	}
+	schema := syncSchema(s.deviceCapabilities(ctx, caller))
+	limit := in.Limit
+	if limit <= 0 {
+		limit = DefaultSnapshotPageSize
+	}
+	limit = min(limit, MaxSnapshotPageSize)
+
+	result := &SnapshotResult{}
+	err := s.store.ReadSnapshot(ctx, userID, func(snap storage.SnapshotReader) error {
+		states, err := snap.ListSyncStates(ctx)
+		if err != nil {
+			return service.Internal("failed to list zones", err)
+		}
+		current := make([]domainsync.SnapshotZone, 0, len(states))
+		for _, state := range states {
+			current = append(current, domainsync.SnapshotZone{Zone: state.Zone, GenCount: state.GenCount, Digest: state.Digest})
+		}
+
+		header := &SnapshotHeader{SyncSchema: schema}
+		if checkpoint == nil {
+			checkpoint = &domainsync.SnapshotCheckpoint{Zones: current, Layers: in.Layers.Mask()}
+			header.Zones = states
+		} else if err := checkpoint.Check(current); err != nil {
+			return &service.Error{Kind: service.KindConflict, Code: "checkpoint_stale", Message: err.Error(), Err: err}
+		}
+		header.GenCounts = make(map[string]int64, len(checkpoint.Zones))
+		for _, zone := range checkpoint.Zones {
+			header.GenCounts[zone.Zone] = zone.GenCount
+		}
+		header.Included = mapping.PullLayersFromMask(checkpoint.Layers)
+
+		if err := w.Begin(header); err != nil {
+			return err
+		}
+		return streamSnapshot(ctx, snap, checkpoint, limit, w, result)
+	})
+	if err != nil {
+		var serviceErr *service.Error
+		if errors.As(err, &serviceErr) {
+			return nil, serviceErr
+		}
+		return nil, service.Internal("failed to read snapshot", err)
+	}
+
+	if result.HasMore {
+		token, err := s.snapshots.EncodeSnapshot(userID, checkpoint)
+		if err != nil {
+			return nil, service.Internal("failed to encode checkpoint", err)
+		}
+		result.Checkpoint = token
+	}
+
+	snapshotEvent := caller.AuditEvent(userID, service.AuditActionSyncSnapshot)
+	snapshotEvent.Details = service.AuditDetails(map[string]interface{}{
+		"zones":    len(checkpoint.Zones),
+		"items":    result.Items,
+		"included": mapping.PullLayersFromMask(checkpoint.Layers),
+		"resumed":  in.Checkpoint != "",
+	})
+	service.RecordAudit(s.store, snapshotEvent)
+	s.touchDevice(ctx, caller.DeviceID)
+
+	return result, nil
+}
+
+// streamSnapshot writes up to limit items from the checkpoint's position
+// on, advancing it as it goes
+func streamSnapshot(ctx context.Context, snap storage.SnapshotReader, cp *domainsync.SnapshotCheckpoint, limit int, w SnapshotWriter, result *SnapshotResult) error {
+	layers := mapping.PullLayersFromMask(cp.Layers).Order()
+	for ; cp.Zone < len(cp.Zones); cp.Zone, cp.Layer, cp.Offset = cp.Zone+1, 0, 0 {
+		zone := cp.Zones[cp.Zone]
+		for _, layer := range layers {
+			if layer < cp.Layer {
+				continue
+			}
+			if cp.Layer != layer {
+				cp.Layer, cp.Offset = layer, 0
+			}
+
+			// The zone's live items as of the vector's gencount
+			r := storage.PullRange{Zone: zone.Zone, Until: zone.GenCount, Offset: cp.Offset, Limit: limit - result.Items}
+			n, err := streamLayer(ctx, snap, layer, r, w)
+			cp.Offset += n
+			result.Items += n
+			if err != nil {
+				return err
+			}
+			if n == r.Limit {
+				// The page is full; the layer may have more
+				result.HasMore = true
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// streamLayer writes one layer's items in r and returns how many it wrote
+func streamLayer(ctx context.Context, snap storage.SnapshotReader, layer int, r storage.PullRange, w ItemWriter) (int, error) {
+	var n int
+	var err error
+	switch layer {
+	case domainsync.PullLayerKeys:
+		err = snap.StreamCryptoKeys(ctx, r, func(key *models.CryptoKey) error {
+			n++
+			return w.Key(key)
+		})
+	case domainsync.PullLayerMetadata:
+		err = snap.StreamCredentialMetadata(ctx, r, func(cred *models.CredentialMetadata) error {
+			n++
+			return w.Metadata(cred)
+		})
+	case domainsync.PullLayerRecords:
+		err = snap.StreamSyncRecords(ctx, r, func(record *models.SyncRecord) error {
+			n++
+			return w.Record(record)
+		})
+	}
+	return n, err
+}
@@ -0,0 +1,424 @@
+// Package sync serves a user's zones: their manifests, and pulls, pushes
+// and deletes of their items
+package sync
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/limits"
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	domainsync "github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/postcommit"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+// Store is the storage the service needs
+type Store interface {
+	service.Auditor
+
+	GetSyncStateContext(ctx context.Context, userID, zone string) (*storage.SyncState, error)
+	GetZonesByUser(ctx context.Context, userID string) ([]*storage.ZoneSummary, error)
+	GetDevice(ctx context.Context, userID, deviceID string) (*storage.Device, error)
+	UpdateDeviceLastSync(ctx context.Context, deviceID string) error
+	GetDeviceEncVersions(ctx context.Context, userID string) ([]int, error)
+	GetUserSettings(ctx context.Context, userID string) (*storage.UserSettings, error)
+	GetAccountUsage(ctx context.Context, userID string) (*storage.AccountUsage, error)
+
+	CountPullWindow(ctx context.Context, userID string, r storage.PullRange) (*storage.PullCounts, error)
+	GetCryptoKeysPage(ctx context.Context, userID string, r storage.PullRange) ([]*models.CryptoKey, error)
+	GetCredentialMetadataPage(ctx context.Context, userID string, r storage.PullRange) ([]*models.CredentialMetadata, error)
+	GetSyncRecordsPage(ctx context.Context, userID string, r storage.PullRange) ([]*models.SyncRecord, error)
+
+	ProbeItems(ctx context.Context, probe storage.ItemProbe) (storage.ItemStates, error)
+	CommitPush(ctx context.Context, userID string, batch *storage.PushBatch) ([]*storage.PushItemError, error)
+	CommitImport(ctx context.Context, userID string, batches []*storage.PushBatch) error
+	ComputeManifest(ctx context.Context, userID, zone string) (*storage.ManifestState, error)
+	ManifestLeaves(ctx context.Context, userID, zone string) ([]domainsync.ManifestLeaf, error)
+	LiveLeafIDs(ctx context.Context, userID, zone string) ([]string, error)
+
+	WipeZone(ctx context.Context, userID string, req *storage.WipeRequest) (*storage.WipeResult, error)
+	UndoWipe(ctx context.Context, userID string, req *storage.WipeRequest, now time.Time) (*storage.WipeResult, error)
+	DeleteCredential(ctx context.Context, userID string, req *storage.CredentialDeleteRequest) (*storage.WipeResult, error)
+	QueueConflicts(ctx context.Context, userID string, conflicts []*storage.SyncConflict) error
+	ListConflicts(ctx context.Context, userID, zone string) ([]*storage.SyncConflict, error)
+	ResolveConflict(ctx context.Context, userID string, req *storage.ConflictResolveRequest) (*storage.ConflictResolution, error)
+
+	ScanIntegrity(ctx context.Context, userID, zone string, opts storage.IntegrityScanOptions) (*storage.IntegrityScan, error)
+	ReadSnapshot(ctx context.Context, userID string, fn func(storage.SnapshotReader) error) error
+	AuditEventTimes(ctx context.Context, userID, action string, since time.Time) ([]time.Time, error)
+}
+
+type Service struct {
+	store          Store
+	engines        *domainsync.Registry
+	hub            service.Broadcaster
+	clock          clock.Clock
+	checkpoints    *domainsync.CheckpointCodec
+	snapshots      *domainsync.CheckpointCodec
+	postCommit     *postcommit.Queue
+	recoveryWindow time.Duration
+	integrity      IntegrityLimits
+	tiers          limits.Policy
+}
+
+func NewService(store Store, engines *domainsync.Registry) *Service {
+	return &Service{
+		store:          store,
+		engines:        engines,
+		clock:          clock.System,
+		checkpoints:    domainsync.NewCheckpointCodec(auth.DeriveKey("pull-checkpoint")),
+		snapshots:      domainsync.NewCheckpointCodec(auth.DeriveKey("snapshot-checkpoint")),
+		recoveryWindow: domainsync.DefaultWipeRecoveryWindow,
+		integrity:      DefaultIntegrityLimits,
+		tiers:          limits.DefaultPolicy(),
+	}
+}
+
+// SetHub sets the hub writes are broadcast to
+func (s *Service) SetHub(hub service.Broadcaster) {
+	s.hub = hub
+}
+
+// SetPostCommitQueue defers a push's digest and event work to q. Without
+// one that work runs before Push returns.
+func (s *Service) SetPostCommitQueue(q *postcommit.Queue) {
+	s.postCommit = q
+}
+
+// SetClock replaces the clock used for event timestamps and recovery
+// deadlines
+func (s *Service) SetClock(c clock.Clock) {
+	s.clock = c
+}
+
+// SetRecoveryWindow sets how long a DeleteAll can be undone
+func (s *Service) SetRecoveryWindow(d time.Duration) {
+	if d > 0 {
+		s.recoveryWindow = d
+	}
+}
+
+// SetConflictStrategy sets how pushes settle records made from older
+// versions than the stored ones, unless a push asks for another. It
+// applies to zones loaded from then on; see Registry.SetStrategy.
+func (s *Service) SetConflictStrategy(strategy domainsync.ConflictResolutionStrategy) {
+	s.engines.SetStrategy(strategy)
+}
+
+// SetTombstonePolicy sets how conflicts between a delete and an edit of the
+// same item are settled; see Registry.SetTombstonePolicy
+func (s *Service) SetTombstonePolicy(policy domainsync.TombstonePolicy) {
+	s.engines.SetTombstonePolicy(policy)
+}
+
+// Manifest is a zone's sync state as clients see it
+type Manifest struct {
+	Zone  string
+	State *storage.SyncState // nil when the zone was never written
+	// Lowest enc_version every active device can decrypt; nil without
+	// active devices. Only set with State.
+	MinSupportedEncVersion *int
+	// Version of State.Digest: the one the device advertised, or
+	// LegacyDigestVersion when it advertised none
+	DigestVersion int
+	// Items with a pending manual conflict, which devices should hold off
+	// editing until one is resolved. Only set with State.
+	PendingConflicts []string
+}
+
+// Manifest returns the zone's manifest, recording that the calling device
+// synced
+func (s *Service) Manifest(ctx context.Context, caller service.Caller, zone string) (*Manifest, error) {
+	if err := s.CheckDevice(ctx, caller, false); err != nil {
+		return nil, err
+	}
+	s.touchDevice(ctx, caller.DeviceID)
+
+	state, err := s.store.GetSyncStateContext(ctx, caller.UserID, zone)
+	if err != nil && ctx.Err() != nil {
+		// Cut off by the deadline: not the same as a zone never written
+		return nil, service.Internal("failed to get manifest", err)
+	}
+	if err != nil {
+		return &Manifest{Zone: zone, DigestVersion: domainsync.DigestVersion}, nil
+	}
+	manifest := &Manifest{
+		Zone:                   zone,
+		State:                  state,
+		MinSupportedEncVersion: s.minSupportedEncVersion(ctx, caller.UserID),
+		DigestVersion:          domainsync.DigestVersion,
+	}
+	manifest.PendingConflicts, err = s.pendingConflictItems(ctx, caller.UserID, zone)
+	if err != nil {
+		return nil, service.Internal("failed to get manifest", err)
+	}
+
+	// Devices from before version 2 compare against the sync record digest
+	// they compute; the stored one would never match it
+	if s.deviceCapabilities(ctx, caller).DigestVersion < domainsync.DigestVersion {
+		leafIDs, err := s.store.LiveLeafIDs(ctx, caller.UserID, zone)
+		if err != nil {
+			return nil, service.Internal("failed to get manifest", err)
+		}
+		legacy := *state
+		legacy.Digest = domainsync.LegacyManifestDigest(leafIDs)
+		manifest.State = &legacy
+		manifest.DigestVersion = domainsync.LegacyDigestVersion
+	}
+	return manifest, nil
+}
+
+// Zones returns the sync state of every zone the caller has written
+func (s *Service) Zones(ctx context.Context, caller service.Caller) ([]*storage.ZoneSummary, error) {
+	if err := s.CheckDevice(ctx, caller, false); err != nil {
+		return nil, err
+	}
+	zones, err := s.store.GetZonesByUser(ctx, caller.UserID)
+	if err != nil {
+		return nil, service.Internal("failed to list zones", err)
+	}
+	return zones, nil
+}
+
+// DeleteAllResult reports a zone's bulk wipe
+type DeleteAllResult struct {
+	GenCount int64
+	Deleted  int
+	DeletedItems
+	// Until when UndoWipe restores the items; nil when there was nothing
+	// to delete
+	RecoverUntil *time.Time
+}
+
+// DeleteAll trashes every item of the zone as one bulk wipe. Clients see
+// tombstones; UndoWipe restores the items until the recovery window passes.
+// It is refused while the account is on legal hold.
+func (s *Service) DeleteAll(ctx context.Context, caller service.Caller, zone string) (*DeleteAllResult, error) {
+	if err := checkLegalHold(caller); err != nil {
+		return nil, err
+	}
+	if err := s.CheckDevice(ctx, caller, true); err != nil {
+		return nil, err
+	}
+	userID, deviceID := caller.UserID, caller.DeviceID
+
+	wiped, err := s.store.WipeZone(ctx, userID, &storage.WipeRequest{
+		Zone:         zone,
+		DeviceID:     deviceID,
+		RecoverUntil: s.clock.Now().Add(s.recoveryWindow),
+	})
+	if err != nil {
+		return nil, service.Internal("failed to delete credentials", err)
+	}
+	if wiped.Wipe == nil {
+		return &DeleteAllResult{GenCount: wiped.GenCount}, nil
+	}
+	// The wipe wrote the zone's gencount and digest itself
+	s.engines.Reset(userID, zone)
+
+	deleteEvent := caller.AuditEvent(userID, service.AuditActionSyncDeleteAll)
+	deleteEvent.Zone = &zone
+	deleteEvent.Details = service.AuditDetails(map[string]interface{}{
+		"deleted":       len(wiped.Items),
+		"gencount":      wiped.GenCount,
+		"wipe_id":       wiped.Wipe.ID,
+		"recover_until": wiped.Wipe.RecoverUntil,
+	})
+	s.recordWipe(caller, zone, deleteEvent, wiped, true)
+	s.broadcastWipe(websocket.EventZoneWiped, caller, zone, wiped.GenCount)
+
+	return &DeleteAllResult{
+		GenCount:     wiped.GenCount,
+		Deleted:      len(wiped.Items),
+		DeletedItems: countDeleted(wiped.Items),
+		RecoverUntil: &wiped.Wipe.RecoverUntil,
+	}, nil
+}
+
+// DeletedItems counts the items a delete tombstoned, per layer
+type DeletedItems struct {
+	Keys     int
+	Metadata int
+	Records  int
+}
+
+func countDeleted(items []*storage.WipedItem) DeletedItems {
+	var counts DeletedItems
+	for _, item := range items {
+		switch wipeLayers[item.Table] {
+		case mapping.LayerCryptoKey:
+			counts.Keys++
+		case mapping.LayerCredentialMetadata:
+			counts.Metadata++
+		case mapping.LayerSyncRecord:
+			counts.Records++
+		}
+	}
+	return counts
+}
+
+// UndoWipeResult reports a restored bulk wipe
+type UndoWipeResult struct {
+	GenCount int64
+	// Items written again since the wipe keep their newer state and are
+	// not counted
+	Restored int
+	WipedAt  time.Time
+}
+
+// UndoWipe restores the zone's most recent DeleteAll within its recovery
+// window, giving the items new gencounts so every device pulls them again
+func (s *Service) UndoWipe(ctx context.Context, caller service.Caller, zone string) (*UndoWipeResult, error) {
+	if err := s.CheckDevice(ctx, caller, true); err != nil {
+		return nil, err
+	}
+	userID, deviceID := caller.UserID, caller.DeviceID
+
+	restored, err := s.store.UndoWipe(ctx, userID, &storage.WipeRequest{
+		Zone:     zone,
+		DeviceID: deviceID,
+	}, s.clock.Now())
+	if errors.Is(err, domainsync.ErrNoWipe) {
+		return nil, service.CodedError(service.KindNotFound, "no_wipe", err.Error(), map[string]interface{}{"zone": zone})
+	}
+	if errors.Is(err, domainsync.ErrWipeExpired) {
+		return nil, service.CodedError(service.KindGone, "wipe_expired", err.Error(), map[string]interface{}{"zone": zone})
+	}
+	if err != nil {
+		return nil, service.Internal("failed to undo wipe", err)
+	}
+	s.engines.Reset(userID, zone)
+
+	undoEvent := caller.AuditEvent(userID, service.AuditActionSyncUndoWipe)
+	undoEvent.Zone = &zone
+	undoEvent.Details = service.AuditDetails(map[string]interface{}{
+		"restored": len(restored.Items),
+		"gencount": restored.GenCount,
+		"wipe_id":  restored.Wipe.ID,
+	})
+	s.recordWipe(caller, zone, undoEvent, restored, false)
+	s.broadcastWipe(websocket.EventZoneWipeUndone, caller, zone, restored.GenCount)
+
+	return &UndoWipeResult{
+		GenCount: restored.GenCount,
+		Restored: len(restored.Items),
+		WipedAt:  restored.Wipe.CreatedAt,
+	}, nil
+}
+
+// wipeLayers maps the item tables of a wipe to their audit layers
+var wipeLayers = map[string]string{
+	"crypto_keys":         mapping.LayerCryptoKey,
+	"credential_metadata": mapping.LayerCredentialMetadata,
+	"sync_records":        mapping.LayerSyncRecord,
+}
+
+// recordWipe audits a wipe or undo along with an item-level row per item
+func (s *Service) recordWipe(caller service.Caller, zone string, event *storage.AuditEvent, result *storage.WipeResult, tombstone bool) {
+	events := []*storage.AuditEvent{event}
+	for _, item := range result.Items {
+		events = append(events, caller.ItemAuditEvent(caller.UserID, zone, item.ItemUUID, wipeLayers[item.Table], item.GenCount, tombstone))
+	}
+	service.RecordAudit(s.store, events...)
+}
+
+// broadcastWipe tells the user's devices to pull the zone after a wipe or
+// undo
+func (s *Service) broadcastWipe(eventType string, caller service.Caller, zone string, genCount int64) {
+	service.Broadcast(s.hub, &websocket.SyncEvent{
+		Type:      eventType,
+		UserID:    caller.UserID,
+		Zone:      zone,
+		GenCount:  genCount,
+		DeviceID:  stringOrNil(caller.DeviceID),
+		Timestamp: s.clock.Now().Unix(),
+	})
+}
+
+// CheckDevice refuses callers whose device may not sync: revoked devices
+// always, pending ones (and callers without a device claim) as the
+// account's approval setting says. write says the operation changes the
+// vault.
+func (s *Service) CheckDevice(ctx context.Context, caller service.Caller, write bool) error {
+	return service.CheckDeviceTrust(ctx, s.store, caller, write)
+}
+
+// deviceCapabilities is what the calling device advertised; the defaults
+// for a caller without a device or whose capabilities can't be read
+func (s *Service) deviceCapabilities(ctx context.Context, caller service.Caller) *peer.Capabilities {
+	defaults := &peer.Capabilities{Version: peer.CapabilitiesVersion}
+	if caller.DeviceID == "" {
+		return defaults
+	}
+	device, err := s.store.GetDevice(ctx, caller.UserID, caller.DeviceID)
+	if err != nil {
+		log.Printf("⚠️  Failed to read capabilities of device %s: %v", caller.DeviceID, err)
+		return defaults
+	}
+	caps, err := peer.ParseCapabilities(device.Capabilities)
+	if err != nil {
+		log.Printf("⚠️  Stored capabilities of device %s are invalid: %v", caller.DeviceID, err)
+		return defaults
+	}
+	return caps
+}
+
+// syncSchema is the sync schema version to answer a device in: the newest
+// one both it and the server read
+func syncSchema(caps *peer.Capabilities) int {
+	return min(max(caps.SyncSchema, mapping.LegacySyncSchemaVersion), mapping.SyncSchemaVersion)
+}
+
+// checkLegalHold refuses a destructive call while the caller's account is
+// on legal hold. The flag comes from the auth profile (see
+// middleware.AuthMiddleware). It reads nothing, so it goes before checks
+// that do.
+func checkLegalHold(caller service.Caller) error {
+	if !caller.LegalHold {
+		return nil
+	}
+	return service.CodedError(service.KindLocked, "legal_hold", "account on hold", nil)
+}
+
+// touchDevice records that the device synced, so stale device cleanup
+// leaves it alone. Failures are logged; the sync itself succeeded, so the
+// write isn't given up when the client hangs up right after.
+func (s *Service) touchDevice(ctx context.Context, deviceID string) {
+	if deviceID == "" {
+		return
+	}
+	if err := s.store.UpdateDeviceLastSync(context.WithoutCancel(ctx), deviceID); err != nil {
+		log.Printf("⚠️  Failed to update last sync of device %s: %v", deviceID, err)
+	}
+}
+
+// minSupportedEncVersion is reported in the manifest so clients know what
+// they may emit; nil when the user has no active devices
+func (s *Service) minSupportedEncVersion(ctx context.Context, userID string) *int {
+	versions, err := s.store.GetDeviceEncVersions(ctx, userID)
+	if err != nil {
+		log.Printf("⚠️  Failed to load device enc_versions for user %s: %v", userID, err)
+		return nil
+	}
+	if lowest, ok := domainsync.MinSupportedEncVersion(versions); ok {
+		return &lowest
+	}
+	return nil
+}
+
+// stringOrNil maps "" to a JSON null
+func stringOrNil(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
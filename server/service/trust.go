@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	"github.com/deeplyprofound/password-sync/server/storage"
+)
+
+// DeviceTrustReader reads what CheckDeviceTrust needs
+type DeviceTrustReader interface {
+	GetDevice(ctx context.Context, userID, deviceID string) (*storage.Device, error)
+	GetUserSettings(ctx context.Context, userID string) (*storage.UserSettings, error)
+}
+
+// CheckDeviceTrust refuses a caller whose device was revoked or deactivated,
+// or is still pending and the account's approval setting withholds the
+// access; write says the operation changes the vault. It reads the device
+// on every call, so a revocation applies from the next request on. A caller
+// without a device claim counts as a device registered just now: pending
+// when the account approves devices, so leaving the claim out gets no more
+// than a pending device would.
+func CheckDeviceTrust(ctx context.Context, store DeviceTrustReader, caller Caller, write bool) error {
+	level := peer.TrustLevelPending
+	if caller.DeviceID != "" {
+		var err error
+		if level, err = deviceTrustLevel(ctx, store, caller.UserID, caller.DeviceID); err != nil {
+			return err
+		}
+	}
+
+	approval := peer.DeviceApprovalOff
+	if level == peer.TrustLevelPending {
+		settings, err := store.GetUserSettings(ctx, caller.UserID)
+		if err != nil {
+			return Internal("failed to check device", err)
+		}
+		approval = settings.DeviceApproval
+	}
+
+	if caller.DeviceID == "" {
+		level = peer.InitialTrustLevel(approval)
+	}
+	if err := peer.CheckAccess(level, approval, write); err != nil {
+		return deviceTrustError(caller.DeviceID, err)
+	}
+	return nil
+}
+
+// CheckTokenDevice refuses issuing tokens for a device that isn't one of
+// the user's active devices. Pending devices get theirs; CheckDeviceTrust
+// decides what they may do with them.
+func CheckTokenDevice(ctx context.Context, store DeviceTrustReader, userID, deviceID string) error {
+	_, err := deviceTrustLevel(ctx, store, userID, deviceID)
+	return err
+}
+
+// deviceTrustLevel is the trust level of one of the user's devices. One
+// that isn't theirs, or was deactivated, is refused as revoked.
+func deviceTrustLevel(ctx context.Context, store DeviceTrustReader, userID, deviceID string) (peer.TrustLevel, error) {
+	device, err := store.GetDevice(ctx, userID, deviceID)
+	if err == sql.ErrNoRows {
+		return peer.TrustLevelNone, deviceTrustError(deviceID, peer.ErrPeerRevoked)
+	}
+	if err != nil {
+		return peer.TrustLevelNone, Internal("failed to check device", err)
+	}
+	level := peer.TrustLevel(device.TrustLevel)
+	if !device.IsActive || level == peer.TrustLevelRevoked {
+		return peer.TrustLevelRevoked, deviceTrustError(deviceID, peer.ErrPeerRevoked)
+	}
+	return level, nil
+}
+
+func deviceTrustError(deviceID string, err error) *Error {
+	code := "device_revoked"
+	if errors.Is(err, peer.ErrPeerPending) {
+		code = "device_pending"
+	}
+	if deviceID == "" {
+		return CodedError(KindForbidden, code, err.Error(), nil)
+	}
+	return CodedError(KindForbidden, code, err.Error(), map[string]interface{}{"device_id": deviceID})
+}
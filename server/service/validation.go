@@ -0,0 +1,76 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+)
+
+// ZoneSpec asks for a zone created from a template
+type ZoneSpec struct {
+	Zone        string // "default" when empty
+	Template    string
+	MetadataKey *mapping.CryptoKeyDTO // Required by the standard template
+}
+
+// Bootstrap validates the spec and builds the zone's initial state.
+// ownerID may be the nil UUID before the user row exists; storage writes
+// the key under the real owner.
+func (z ZoneSpec) Bootstrap(ownerID string) (*sync.ZoneBootstrap, error) {
+	zone := z.Zone
+	if zone == "" {
+		zone = "default"
+	}
+
+	var key *models.CryptoKey
+	if z.MetadataKey != nil {
+		converted, err := mapping.ToCryptoKey(*z.MetadataKey, ownerID, zone, 1)
+		if err != nil {
+			return nil, err
+		}
+		key = converted
+	}
+	return sync.BootstrapZone(z.Template, zone, key)
+}
+
+// ZoneError maps a zone bootstrap failure to its Error, or returns nil for
+// errors it does not recognize
+func ZoneError(err error) *Error {
+	var fieldErr *mapping.FieldError
+	switch {
+	case errors.Is(err, sync.ErrZoneExists):
+		return &Error{Kind: KindConflict, Code: "zone_exists", Message: err.Error(), Err: err}
+	case errors.Is(err, sync.ErrUnknownZoneTemplate):
+		return &Error{Kind: KindInvalid, Code: "unknown_template", Message: err.Error(), Err: err}
+	case errors.Is(err, sync.ErrInvalidZoneName),
+		errors.Is(err, sync.ErrMetadataKeyRequired),
+		errors.Is(err, sync.ErrMetadataKeyForbidden):
+		return &Error{Kind: KindInvalid, Code: "invalid_bootstrap", Message: err.Error(), Err: err}
+	case errors.As(err, &fieldErr):
+		return &Error{
+			Kind:    KindInvalid,
+			Code:    "invalid_item",
+			Message: err.Error(),
+			Fields:  map[string]interface{}{"layer": fieldErr.Layer, "field": fieldErr.Field},
+			Err:     err,
+		}
+	}
+	return nil
+}
+
+// InvalidItem rejects a push whose item at index failed conversion
+func InvalidItem(index int, err error) *Error {
+	var fieldErr *mapping.FieldError
+	if !errors.As(err, &fieldErr) {
+		return &Error{Kind: KindInvalid, Message: err.Error(), Err: err}
+	}
+	return &Error{
+		Kind:    KindInvalid,
+		Code:    "invalid_item",
+		Message: err.Error(),
+		Fields:  map[string]interface{}{"layer": fieldErr.Layer, "index": index, "field": fieldErr.Field},
+		Err:     err,
+	}
+}
@@ -0,0 +1,283 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Audit log models and methods
+
+type AuditEvent struct {
+	ID        int64
+	UserID    string
+	ActorID   *string
+	DeviceID  *string
+	Action    string
+	Zone      *string
+	ItemUUID  *string
+	IPAddress string
+	Details   []byte // JSON object, may be nil
+	CreatedAt time.Time
+}
+
+// AuditEventFilter selects a page of a user's audit log ordered by ID.
+// AfterID is the continuation cursor (exclusive); Limit caps the page size.
+type AuditEventFilter struct {
+	UserID       string
+	From         time.Time
+	To           time.Time
+	AfterID      int64
+	IncludeItems bool
+	Limit        int
+}
+
+// ZoneActivityFilter selects a page of a zone's activity feed, newest first.
+// BeforeID is the continuation cursor (exclusive, 0 for the first page);
+// Actions lists the audit actions that make up the feed.
+type ZoneActivityFilter struct {
+	UserID   string
+	Zone     string
+	Actions  []string
+	BeforeID int64
+	Limit    int
+}
+
+// Includes reports whether the feed query selects event, ignoring Limit
+func (f ZoneActivityFilter) Includes(event *AuditEvent) bool {
+	if event.UserID != f.UserID || event.Zone == nil || *event.Zone != f.Zone {
+		return false
+	}
+	if f.BeforeID > 0 && event.ID >= f.BeforeID {
+		return false
+	}
+	return slices.Contains(f.Actions, event.Action)
+}
+
+func (s *PostgresStore) RecordAuditEvent(event *AuditEvent) error {
+	return s.RecordAuditEvents([]*AuditEvent{event})
+}
+
+// RecordAuditEvents inserts a batch of audit events in a single transaction
+// per region the events' users live in
+func (s *PostgresStore) RecordAuditEvents(events []*AuditEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	byDB := map[*sql.DB][]*AuditEvent{}
+	var order []*sql.DB
+	for _, event := range events {
+		db, err := s.userDB(event.UserID)
+		if err != nil {
+			return err
+		}
+		if _, seen := byDB[db]; !seen {
+			order = append(order, db)
+		}
+		byDB[db] = append(byDB[db], event)
+	}
+
+	for _, db := range order {
+		if err := insertAuditEvents(db, byDB[db]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertAuditEvents(db *sql.DB, events []*AuditEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO audit_events (user_id, actor_id, device_id, action, zone,
+			item_uuid, ip_address, details)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, event := range events {
+		var details interface{}
+		if len(event.Details) > 0 {
+			details = string(event.Details)
+		}
+
+		err := stmt.QueryRow(
+			event.UserID, event.ActorID, event.DeviceID, event.Action, event.Zone,
+			event.ItemUUID, event.IPAddress, details,
+		).Scan(&event.ID, &event.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// NextAuditCursor reports whether the filter matches more than Limit rows and,
+// if so, returns the ID of the last row in the page to resume after.
+func (s *PostgresStore) NextAuditCursor(filter AuditEventFilter) (int64, bool, error) {
+	db, err := s.userDB(filter.UserID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	query := `
+		SELECT id FROM audit_events
+		WHERE user_id = $1 AND created_at >= $2 AND created_at < $3 AND id > $4
+		  AND (item_uuid IS NULL OR $5 = true)
+		ORDER BY id ASC
+		OFFSET $6 LIMIT 2
+	`
+
+	rows, err := db.Query(query, filter.UserID, filter.From, filter.To,
+		filter.AfterID, filter.IncludeItems, filter.Limit-1)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return 0, false, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, false, err
+	}
+
+	if len(ids) < 2 {
+		return 0, false, nil
+	}
+	return ids[0], true, nil
+}
+
+// StreamAuditEvents calls fn for every row matching the filter without
+// buffering the result set, so large exports use constant memory.
+func (s *PostgresStore) StreamAuditEvents(filter AuditEventFilter, fn func(*AuditEvent) error) error {
+	db, err := s.userDB(filter.UserID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		SELECT id, user_id, actor_id, device_id, action, zone, item_uuid,
+		       COALESCE(ip_address, ''), details, created_at
+		FROM audit_events
+		WHERE user_id = $1 AND created_at >= $2 AND created_at < $3 AND id > $4
+		  AND (item_uuid IS NULL OR $5 = true)
+		ORDER BY id ASC
+		LIMIT $6
+	`
+
+	rows, err := db.Query(query, filter.UserID, filter.From, filter.To,
+		filter.AfterID, filter.IncludeItems, filter.Limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event := &AuditEvent{}
+		var details sql.NullString
+		err := rows.Scan(
+			&event.ID, &event.UserID, &event.ActorID, &event.DeviceID,
+			&event.Action, &event.Zone, &event.ItemUUID, &event.IPAddress,
+			&details, &event.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+		if details.Valid {
+			event.Details = []byte(details.String)
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// ListZoneActivity returns a page of a zone's activity feed. Only the
+// columns the feed shows are read: no IP address and no details.
+func (s *PostgresStore) ListZoneActivity(ctx context.Context, filter ZoneActivityFilter) ([]*AuditEvent, error) {
+	db, err := s.userDB(filter.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT id, user_id, actor_id, device_id, action, zone, item_uuid, created_at
+		FROM audit_events
+		WHERE user_id = $1 AND zone = $2 AND action = ANY($3)
+		  AND ($4 = 0 OR id < $4)
+		ORDER BY id DESC
+		LIMIT $5
+	`
+
+	rows, err := db.QueryContext(ctx, query, filter.UserID, filter.Zone,
+		pq.Array(filter.Actions), filter.BeforeID, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*AuditEvent
+	for rows.Next() {
+		event := &AuditEvent{}
+		err := rows.Scan(
+			&event.ID, &event.UserID, &event.ActorID, &event.DeviceID,
+			&event.Action, &event.Zone, &event.ItemUUID, &event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// AuditEventTimes returns when the user's events of action after since
+// were recorded, oldest first
+func (s *PostgresStore) AuditEventTimes(ctx context.Context, userID, action string, since time.Time) ([]time.Time, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT created_at FROM audit_events
+		WHERE user_id = $1 AND created_at > $2 AND action = $3
+		ORDER BY created_at, id
+	`, userID, since, action)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var times []time.Time
+	for rows.Next() {
+		var at time.Time
+		if err := rows.Scan(&at); err != nil {
+			return nil, err
+		}
+		times = append(times, at)
+	}
+	return times, rows.Err()
+}
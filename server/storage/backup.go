@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/lib/pq"
+)
+
+// ZoneWatermark is a user/zone's gencount at the time it was read
+type ZoneWatermark struct {
+	UserID   string `json:"user_id"`
+	Zone     string `json:"zone"`
+	GenCount int64  `json:"gencount"`
+}
+
+// ListZoneWatermarks returns the gencount of every user/zone in every
+// region, or of the given users' zones only
+func (s *PostgresStore) ListZoneWatermarks(ctx context.Context, userIDs []string) ([]ZoneWatermark, error) {
+	var watermarks []ZoneWatermark
+	err := s.eachRegion(func(_ string, db *sql.DB) error {
+		rows, err := db.QueryContext(ctx, `
+			SELECT user_id, zone, gencount FROM sync_state
+			WHERE cardinality($1::text[]) = 0 OR user_id::text = ANY($1::text[])
+			ORDER BY user_id, zone
+		`, pq.Array(userIDs))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var w ZoneWatermark
+			if err := rows.Scan(&w.UserID, &w.Zone, &w.GenCount); err != nil {
+				return err
+			}
+			watermarks = append(watermarks, w)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(watermarks, func(i, j int) bool {
+		if watermarks[i].UserID != watermarks[j].UserID {
+			return watermarks[i].UserID < watermarks[j].UserID
+		}
+		return watermarks[i].Zone < watermarks[j].Zone
+	})
+	return watermarks, nil
+}
+
+// RestoreBatch is one chunk of a backup: rows of any users and zones, and
+// the gencounts those zones have at least reached
+type RestoreBatch struct {
+	Keys       []*models.CryptoKey
+	Metadata   []*models.CredentialMetadata
+	Records    []*models.SyncRecord
+	Watermarks []ZoneWatermark
+}
+
+// RestoreRows upserts a backup chunk with the same statements as a push, so
+// applying a chunk twice is harmless. Each user's rows go to their region,
+// in one transaction per region. Zone gencounts only move forward; digests
+// are left to the manifest repair.
+func (s *PostgresStore) RestoreRows(ctx context.Context, batch *RestoreBatch) error {
+	byDB := map[*sql.DB]*RestoreBatch{}
+	var order []*sql.DB
+	regionBatch := func(userID string) (*RestoreBatch, error) {
+		db, err := s.userDB(userID)
+		if err != nil {
+			return nil, err
+		}
+		if _, seen := byDB[db]; !seen {
+			byDB[db] = &RestoreBatch{}
+			order = append(order, db)
+		}
+		return byDB[db], nil
+	}
+
+	for _, key := range batch.Keys {
+		b, err := regionBatch(key.UserID.String())
+		if err != nil {
+			return err
+		}
+		b.Keys = append(b.Keys, key)
+	}
+	for _, cred := range batch.Metadata {
+		b, err := regionBatch(cred.UserID.String())
+		if err != nil {
+			return err
+		}
+		b.Metadata = append(b.Metadata, cred)
+	}
+	for _, record := range batch.Records {
+		b, err := regionBatch(record.UserID.String())
+		if err != nil {
+			return err
+		}
+		b.Records = append(b.Records, record)
+	}
+	for _, w := range batch.Watermarks {
+		b, err := regionBatch(w.UserID)
+		if err != nil {
+			return err
+		}
+		b.Watermarks = append(b.Watermarks, w)
+	}
+
+	for _, db := range order {
+		if err := restoreRows(ctx, db, byDB[db]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreRows(ctx context.Context, db *sql.DB, batch *RestoreBatch) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, key := range batch.Keys {
+		if err := insertCryptoKey(tx, key.UserID.String(), key.ItemUUID.String(), key); err != nil {
+			return err
+		}
+	}
+	for _, cred := range batch.Metadata {
+		if err := insertCredentialMetadata(tx, cred.UserID.String(), cred.ItemUUID.String(), cred); err != nil {
+			return err
+		}
+	}
+	for _, record := range batch.Records {
+		if err := insertSyncRecord(tx, record.UserID.String(), record.ItemUUID.String(), record); err != nil {
+			return err
+		}
+	}
+
+	for _, w := range batch.Watermarks {
+		_, err := tx.Exec(`
+			INSERT INTO sync_state (user_id, zone, gencount)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, zone) DO UPDATE SET
+				gencount = GREATEST(sync_state.gencount, EXCLUDED.gencount),
+				updated_at = NOW()
+		`, w.UserID, w.Zone, w.GenCount)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,287 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Breach monitoring. A user registers addresses to watch; a job re-checks
+// them against HIBP and records an alert for every breach not seen at the
+// check before.
+
+// ErrTooManyMonitors is returned by CreateBreachMonitor at the user's limit
+var ErrTooManyMonitors = errors.New("too many breach monitors")
+
+// BreachMonitor is an address a user watches for new breaches
+type BreachMonitor struct {
+	ID        string
+	UserID    string
+	Email     string   // Normalized: trimmed and lowercased
+	Breaches  []string // HIBP breach names at the last check
+	CreatedAt time.Time
+	// nil until the first check, which records the breaches known then
+	// without alerting about them
+	CheckedAt *time.Time
+}
+
+// BreachAlert is a breach found on a monitored address after it was
+// registered
+type BreachAlert struct {
+	ID         string
+	UserID     string
+	Email      string
+	Breach     string // HIBP breach name
+	BreachDate string
+	DataTypes  []string
+	CreatedAt  time.Time
+}
+
+// CreateBreachMonitor registers email for userID, or returns the monitor
+// it already has (and false). A user with limit monitors gets
+// ErrTooManyMonitors; limit 0 means no limit.
+func (s *PostgresStore) CreateBreachMonitor(ctx context.Context, userID, email string, limit int) (*BreachMonitor, bool, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// Serializes the user's registrations, so two can't both pass the limit
+	var id string
+	if err := tx.QueryRowContext(ctx, `SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&id); err != nil {
+		return nil, false, err
+	}
+	monitor, created, err := createBreachMonitor(ctx, tx, userID, email, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	return monitor, created, tx.Commit()
+}
+
+// ListBreachMonitors returns the user's monitors, oldest first
+func (s *PostgresStore) ListBreachMonitors(ctx context.Context, userID string) ([]*BreachMonitor, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	return listBreachMonitors(ctx, db, `WHERE user_id = $1 ORDER BY created_at, id`, userID)
+}
+
+// DeleteBreachMonitor stops monitoring; the alerts it raised are kept.
+// Returns sql.ErrNoRows when the user has no monitor with that ID.
+func (s *PostgresStore) DeleteBreachMonitor(ctx context.Context, userID, id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return sql.ErrNoRows
+	}
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+	result, err := db.ExecContext(ctx, `DELETE FROM breach_monitors WHERE id = $1 AND user_id = $2`, id, userID)
+	return expectRows(result, err)
+}
+
+// FindDueBreachMonitors returns up to limit monitors, of every user or only
+// userID's, never checked or last checked before checkedBefore: those never
+// checked first, then the longest waiting
+func (s *PostgresStore) FindDueBreachMonitors(checkedBefore time.Time, userID string, limit int) ([]*BreachMonitor, error) {
+	var monitors []*BreachMonitor
+	err := s.eachRegion(func(_ string, db *sql.DB) error {
+		found, err := listBreachMonitors(context.Background(), db, `
+			WHERE (checked_at IS NULL OR checked_at < $1) AND ($2 = '' OR user_id::text = $2)
+			ORDER BY checked_at IS NOT NULL, checked_at, id
+			LIMIT $3
+		`, checkedBefore.UTC(), userID, limit)
+		monitors = append(monitors, found...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortDueBreachMonitors(monitors)
+	if len(monitors) > limit {
+		monitors = monitors[:limit]
+	}
+	return monitors, nil
+}
+
+// RecordBreachCheck stores the breaches a check of monitor found, and the
+// alerts it raised, in one transaction. Fills in each alert's ID and
+// CreatedAt. Returns sql.ErrNoRows, storing no alert, when the monitor was
+// deleted meanwhile.
+func (s *PostgresStore) RecordBreachCheck(ctx context.Context, monitor *BreachMonitor, breaches []string, alerts []*BreachAlert, at time.Time) error {
+	db, err := s.userDB(monitor.UserID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := recordBreachCheck(ctx, tx, monitor, breaches, alerts, at); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListBreachAlerts returns the user's latest alerts, newest first
+func (s *PostgresStore) ListBreachAlerts(ctx context.Context, userID string, limit int) ([]*BreachAlert, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	return listBreachAlerts(ctx, db, userID, limit)
+}
+
+// createBreachMonitor runs CreateBreachMonitor in tx, the user's
+// registrations already serialized
+func createBreachMonitor(ctx context.Context, tx *sql.Tx, userID, email string, limit int) (*BreachMonitor, bool, error) {
+	existing, err := listBreachMonitors(ctx, tx, `WHERE user_id = $1 AND email = $2`, userID, email)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(existing) > 0 {
+		return existing[0], false, nil
+	}
+
+	if limit > 0 {
+		var count int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM breach_monitors WHERE user_id = $1`, userID).Scan(&count); err != nil {
+			return nil, false, err
+		}
+		if count >= limit {
+			return nil, false, ErrTooManyMonitors
+		}
+	}
+
+	monitor := &BreachMonitor{ID: uuid.New().String(), UserID: userID, Email: email, Breaches: []string{}}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO breach_monitors (id, user_id, email) VALUES ($1, $2, $3)
+		RETURNING created_at
+	`, monitor.ID, userID, email).Scan(&monitor.CreatedAt)
+	if err != nil {
+		return nil, false, err
+	}
+	return monitor, true, nil
+}
+
+func recordBreachCheck(ctx context.Context, tx *sql.Tx, monitor *BreachMonitor, breaches []string, alerts []*BreachAlert, at time.Time) error {
+	names, err := json.Marshal(nonNilStrings(breaches))
+	if err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, `
+		UPDATE breach_monitors SET breaches = $3, checked_at = $4 WHERE id = $1 AND user_id = $2
+	`, monitor.ID, monitor.UserID, string(names), at.UTC())
+	if err := expectRows(result, err); err != nil {
+		return err
+	}
+
+	for _, alert := range alerts {
+		dataTypes, err := json.Marshal(nonNilStrings(alert.DataTypes))
+		if err != nil {
+			return err
+		}
+		alert.ID, alert.UserID = uuid.New().String(), monitor.UserID
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO breach_alerts (id, user_id, email, breach, breach_date, data_types)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			RETURNING created_at
+		`, alert.ID, alert.UserID, alert.Email, alert.Breach, alert.BreachDate, string(dataTypes)).Scan(&alert.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// breachMonitorColumns must match listBreachMonitors' scan
+const breachMonitorColumns = `id, user_id, email, breaches, created_at, checked_at`
+
+func listBreachMonitors(ctx context.Context, q rowQuerier, where string, args ...interface{}) ([]*BreachMonitor, error) {
+	rows, err := q.QueryContext(ctx, `SELECT `+breachMonitorColumns+` FROM breach_monitors `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var monitors []*BreachMonitor
+	for rows.Next() {
+		monitor := &BreachMonitor{}
+		var breaches []byte
+		var checkedAt sql.NullTime
+		err := rows.Scan(&monitor.ID, &monitor.UserID, &monitor.Email, &breaches, &monitor.CreatedAt, &checkedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(breaches, &monitor.Breaches); err != nil {
+			return nil, err
+		}
+		if checkedAt.Valid {
+			monitor.CheckedAt = &checkedAt.Time
+		}
+		monitors = append(monitors, monitor)
+	}
+	return monitors, rows.Err()
+}
+
+func listBreachAlerts(ctx context.Context, q rowQuerier, userID string, limit int) ([]*BreachAlert, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT id, user_id, email, breach, COALESCE(breach_date, ''), data_types, created_at
+		FROM breach_alerts WHERE user_id = $1
+		ORDER BY created_at DESC, id
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var alerts []*BreachAlert
+	for rows.Next() {
+		alert := &BreachAlert{}
+		var dataTypes []byte
+		err := rows.Scan(&alert.ID, &alert.UserID, &alert.Email, &alert.Breach, &alert.BreachDate, &dataTypes, &alert.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(dataTypes, &alert.DataTypes); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts, rows.Err()
+}
+
+// sortDueBreachMonitors orders monitors of several regions as
+// FindDueBreachMonitors returns them
+func sortDueBreachMonitors(monitors []*BreachMonitor) {
+	sort.SliceStable(monitors, func(i, j int) bool {
+		a, b := monitors[i].CheckedAt, monitors[j].CheckedAt
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		return a.Before(*b)
+	})
+}
+
+func nonNilStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
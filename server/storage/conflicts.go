@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/google/uuid"
+)
+
+// Manual conflict resolution. Under sync.ManualResolve a pushed sync record
+// made from an older version of its item than the stored one is not
+// written: it waits in sync_conflicts until a device picks the version to
+// keep.
+
+// SyncConflict is a pushed sync record held back for manual resolution
+type SyncConflict struct {
+	ID             string
+	UserID         string
+	Zone           string
+	ItemUUID       uuid.UUID
+	DeviceID       *string // Device that pushed; nil for clients without a device claim
+	BaseGenCount   int64   // The version the device edited
+	StoredGenCount int64   // The stored record's when the push arrived
+	// The pushed record; its gencount is only assigned if it wins
+	Pushed     *models.SyncRecord
+	CreatedAt  time.Time
+	ResolvedAt *time.Time
+	Resolution *string // sync.ResolutionClientWins or ResolutionServerWins
+}
+
+type ConflictResolveRequest struct {
+	ID         string
+	Zone       string
+	Resolution string // sync.ResolutionClientWins keeps the pushed record, ResolutionServerWins the stored one
+	DeviceID   string // Writer; "" for clients without a device claim
+}
+
+// ConflictResolution is a resolved sync conflict
+type ConflictResolution struct {
+	Conflict *SyncConflict
+	GenCount int64 // The kept version's new gencount, and the zone's
+}
+
+// QueueConflicts holds pushed records back for manual resolution. An item
+// that already has a pending conflict keeps it, with the newer push in
+// place of the one held before. Fills in each conflict's ID and CreatedAt.
+func (s *PostgresStore) QueueConflicts(ctx context.Context, userID string, conflicts []*SyncConflict) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, conflict := range conflicts {
+		if err := queueConflict(ctx, tx, userID, conflict); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ListConflicts returns the zone's pending conflicts, oldest first
+func (s *PostgresStore) ListConflicts(ctx context.Context, userID, zone string) ([]*SyncConflict, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	return listConflicts(ctx, db, userID, zone)
+}
+
+// ResolveConflict settles a pending conflict in one transaction: the
+// version req keeps gets one reserved gencount, replacing or renumbering
+// the stored record, and the zone's gencount and digest move with it.
+// Returns sql.ErrNoRows when the zone has no pending conflict with that ID.
+func (s *PostgresStore) ResolveConflict(ctx context.Context, userID string, req *ConflictResolveRequest) (*ConflictResolution, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	conflict, err := scanConflict(tx.QueryRowContext(ctx, `
+		SELECT `+conflictColumns+` FROM sync_conflicts
+		WHERE id = $1 AND user_id = $2 AND zone = $3 AND resolved_at IS NULL
+		FOR UPDATE
+	`, req.ID, userID, req.Zone))
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := keepConflictVersion(ctx, tx, userID, conflict, req, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := saveWipeState(ctx, tx, userID, req.Zone, result.GenCount, req.DeviceID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// queueConflict inserts a conflict, or replaces the push the item's
+// pending one holds
+func queueConflict(ctx context.Context, tx *sql.Tx, userID string, conflict *SyncConflict) error {
+	record := conflict.Pushed
+	conflict.UserID = userID
+	return tx.QueryRowContext(ctx, `
+		INSERT INTO sync_conflicts (id, user_id, zone, item_uuid, device_id, base_gencount, stored_gencount,
+			parent_key_uuid, wrapped_key, enc_item, enc_version, context_id, tombstone)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		ON CONFLICT (user_id, zone, item_uuid) WHERE resolved_at IS NULL DO UPDATE SET
+			device_id = EXCLUDED.device_id,
+			base_gencount = EXCLUDED.base_gencount,
+			stored_gencount = EXCLUDED.stored_gencount,
+			parent_key_uuid = EXCLUDED.parent_key_uuid,
+			wrapped_key = EXCLUDED.wrapped_key,
+			enc_item = EXCLUDED.enc_item,
+			enc_version = EXCLUDED.enc_version,
+			context_id = EXCLUDED.context_id,
+			tombstone = EXCLUDED.tombstone
+		RETURNING id, created_at
+	`, uuid.New().String(), userID, conflict.Zone, conflict.ItemUUID, conflict.DeviceID,
+		conflict.BaseGenCount, conflict.StoredGenCount, record.ParentKeyUUID, record.WrappedKey,
+		record.EncItem, record.EncVersion, record.ContextID, record.Tombstone,
+	).Scan(&conflict.ID, &conflict.CreatedAt)
+}
+
+func listConflicts(ctx context.Context, q rowQuerier, userID, zone string) ([]*SyncConflict, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT `+conflictColumns+` FROM sync_conflicts
+		WHERE user_id = $1 AND zone = $2 AND resolved_at IS NULL
+		ORDER BY created_at, id
+	`, userID, zone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conflicts []*SyncConflict
+	for rows.Next() {
+		conflict, err := scanConflict(rows)
+		if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, rows.Err()
+}
+
+// keepConflictVersion writes the version req keeps under a new gencount
+// and marks the conflict resolved. A stored record purged since the
+// conflict was queued stays gone when it is the one kept.
+func keepConflictVersion(ctx context.Context, tx *sql.Tx, userID string, conflict *SyncConflict, req *ConflictResolveRequest, now time.Time) (*ConflictResolution, error) {
+	genCounts, err := nextGenCounts(ctx, tx, userID, conflict.Zone, 1)
+	if err != nil {
+		return nil, err
+	}
+	result := &ConflictResolution{Conflict: conflict, GenCount: genCounts.Last}
+	if req.Resolution == sync.ResolutionClientWins {
+		record := *conflict.Pushed
+		record.GenCount = result.GenCount
+		if err := insertSyncRecord(tx, userID, conflict.ItemUUID.String(), &record); err != nil {
+			return nil, err
+		}
+	} else {
+		_, err := tx.ExecContext(ctx, `
+			UPDATE sync_records SET gencount = $4
+			WHERE user_id = $1 AND zone = $2 AND item_uuid = $3
+		`, userID, conflict.Zone, conflict.ItemUUID, result.GenCount)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE sync_conflicts SET resolved_at = $2, resolution = $3 WHERE id = $1
+	`, conflict.ID, now.UTC(), req.Resolution)
+	if err != nil {
+		return nil, err
+	}
+	resolution := req.Resolution
+	conflict.ResolvedAt, conflict.Resolution = &now, &resolution
+	return result, nil
+}
+
+// conflictColumns must match scanConflict
+const conflictColumns = `
+	id, user_id, zone, item_uuid, device_id, base_gencount, stored_gencount,
+	parent_key_uuid, wrapped_key, enc_item, enc_version, context_id, tombstone,
+	created_at`
+
+func scanConflict(row rowScanner) (*SyncConflict, error) {
+	conflict := &SyncConflict{}
+	record := &models.SyncRecord{}
+	var deviceID sql.NullString
+	err := row.Scan(
+		&conflict.ID, &conflict.UserID, &conflict.Zone, &conflict.ItemUUID, &deviceID,
+		&conflict.BaseGenCount, &conflict.StoredGenCount, &record.ParentKeyUUID,
+		&record.WrappedKey, &record.EncItem, &record.EncVersion, &record.ContextID,
+		&record.Tombstone, &conflict.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if deviceID.Valid {
+		conflict.DeviceID = &deviceID.String
+	}
+	record.ItemUUID, record.Zone = conflict.ItemUUID, conflict.Zone
+	record.UserID, _ = uuid.Parse(conflict.UserID)
+	conflict.Pushed = record
+	return conflict, nil
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type CredentialDeleteRequest struct {
+	Zone     string
+	ItemUUID uuid.UUID
+	DeviceID string // Writer; "" for clients without a device claim
+}
+
+// DeleteCredential tombstones a live credential in one transaction: its
+// metadata, its sync record, and the keys named by its password_key_uuid
+// and metadata_key_uuid that no other live item of the zone references.
+// Each gets one of the reserved gencounts and the zone's gencount and
+// digest move with them. Returns sql.ErrNoRows when the zone has no live
+// credential with that item_uuid.
+func (s *PostgresStore) DeleteCredential(ctx context.Context, userID string, req *CredentialDeleteRequest) (*WipeResult, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var passwordKey uuid.UUID
+	var metadataKey uuid.NullUUID
+	err = tx.QueryRowContext(ctx, `
+		SELECT password_key_uuid, metadata_key_uuid FROM credential_metadata
+		WHERE user_id = $1 AND zone = $2 AND item_uuid = $3 AND tombstone = false
+		FOR UPDATE
+	`, userID, req.Zone, req.ItemUUID).Scan(&passwordKey, &metadataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyIDs := []string{passwordKey.String()}
+	if metadataKey.Valid {
+		keyIDs = append(keyIDs, metadataKey.UUID.String())
+	}
+	items, err := lockUnsharedKeys(ctx, tx, userID, req.Zone, req.ItemUUID, keyIDs)
+	if err != nil {
+		return nil, err
+	}
+	items = append(items, &WipedItem{Table: "credential_metadata", ItemUUID: req.ItemUUID})
+
+	var record uuid.UUID
+	err = tx.QueryRowContext(ctx, `
+		SELECT item_uuid FROM sync_records
+		WHERE user_id = $1 AND zone = $2 AND item_uuid = $3 AND tombstone = false
+		FOR UPDATE
+	`, userID, req.Zone, req.ItemUUID).Scan(&record)
+	switch {
+	case err == nil:
+		items = append(items, &WipedItem{Table: "sync_records", ItemUUID: record})
+	case err != sql.ErrNoRows:
+		return nil, err
+	}
+
+	genCounts, err := nextGenCounts(ctx, tx, userID, req.Zone, int64(len(items)))
+	if err != nil {
+		return nil, err
+	}
+	result := &WipeResult{GenCount: genCounts.Last, Items: items}
+	if err := renumberWipeItems(ctx, tx, userID, req.Zone, items, result.GenCount, true, nil); err != nil {
+		return nil, err
+	}
+	if err := saveWipeState(ctx, tx, userID, req.Zone, result.GenCount, req.DeviceID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// lockUnsharedKeys locks the live keys among keyIDs that no live item of
+// the zone other than itemUUID references, in numbering order
+func lockUnsharedKeys(ctx context.Context, tx *sql.Tx, userID, zone string, itemUUID uuid.UUID, keyIDs []string) ([]*WipedItem, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT k.item_uuid FROM crypto_keys k
+		WHERE k.user_id = $1 AND k.zone = $2 AND k.item_uuid = ANY($4::uuid[]) AND k.tombstone = false
+		  AND NOT EXISTS (
+			SELECT 1 FROM credential_metadata m
+			WHERE m.user_id = k.user_id AND m.zone = k.zone AND m.tombstone = false
+			  AND m.item_uuid <> $3
+			  AND (m.password_key_uuid = k.item_uuid OR m.metadata_key_uuid = k.item_uuid))
+		  AND NOT EXISTS (
+			SELECT 1 FROM sync_records r
+			WHERE r.user_id = k.user_id AND r.zone = k.zone AND r.tombstone = false
+			  AND r.item_uuid <> $3 AND r.parent_key_uuid = k.item_uuid)
+		ORDER BY k.gencount, k.item_uuid
+		FOR UPDATE
+	`, userID, zone, itemUUID, pq.Array(keyIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []*WipedItem
+	for rows.Next() {
+		item := &WipedItem{Table: "crypto_keys"}
+		if err := rows.Scan(&item.ItemUUID); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+)
+
+// userOwnedTables hold the rows of an account besides its users row,
+// children before the tables they reference
+var userOwnedTables = []string{
+	"sync_conflicts",
+	"sync_records",
+	"breach_alerts",
+	"breach_monitors",
+	"credential_metadata",
+	"crypto_keys",
+	"bulk_wipes",
+	"device_push_sequences",
+	"sync_state",
+	"refresh_tokens",
+	"password_reset_tokens",
+	"devices",
+	"audit_events",
+}
+
+// DeleteUserCascade removes an account and every row it owns in one
+// transaction, table by table rather than trusting the foreign keys'
+// cascades, so nothing of it is left behind whatever the schema says. An
+// account on legal hold is never deleted: sql.ErrNoRows. The change hooks
+// run afterwards, so cached auth profiles of the account are dropped.
+func (s *PostgresStore) DeleteUserCascade(ctx context.Context, id string) error {
+	db, err := s.userDB(id)
+	if err != nil {
+		return err
+	}
+	if err := deleteUserCascade(ctx, db, id); err != nil {
+		return err
+	}
+	s.notifyUserChanged(id)
+	if len(s.regions) > 0 {
+		return s.unregisterUserRegion(id)
+	}
+	return nil
+}
+
+// deleteUserCascade runs DeleteUserCascade's transaction; the statements are
+// the same in Postgres and SQLite
+func deleteUserCascade(ctx context.Context, db *sql.DB, id string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Locks the row first, so the account can't be put on hold meanwhile
+	result, err := tx.ExecContext(ctx, `UPDATE users SET is_active = false WHERE id = $1 AND NOT legal_hold`, id)
+	if err := expectRows(result, err); err != nil {
+		return err
+	}
+	for _, table := range userOwnedTables {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user_id = $1`, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Stale device cleanup and bulk revocation
+
+// StaleDevice is an active device that has not synced for a while
+type StaleDevice struct {
+	Device
+	LastActive time.Time  // last_sync, or created_at if it never synced
+	WarnedAt   *time.Time // When the owner was warned it will be deactivated
+
+	// The owner's auto-deactivation setting; only set by
+	// FindAutoDeactivationCandidates
+	AutoDeactivateDays int
+}
+
+// staleDeviceColumns must match scanStaleDevice
+const staleDeviceColumns = `
+	d.id, d.user_id, d.device_name, d.device_type, d.public_key,
+	d.last_sync, d.created_at, d.is_active, COALESCE(d.max_enc_version, 0),
+	d.trust_level, d.capabilities, COALESCE(d.last_sync, d.created_at), d.inactivity_warned_at`
+
+func scanStaleDevice(row rowScanner, extra ...interface{}) (*StaleDevice, error) {
+	device := &StaleDevice{}
+	dest := []interface{}{
+		&device.ID, &device.UserID, &device.DeviceName, &device.DeviceType,
+		&device.PublicKey, &device.LastSync, &device.CreatedAt, &device.IsActive,
+		&device.MaxEncVersion, &device.TrustLevel, &device.Capabilities,
+		&device.LastActive, &device.WarnedAt,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// FindStaleDevices returns the user's active devices that have not synced
+// since olderThan, oldest first. exceptDeviceID (usually the caller's own
+// device) is never included. Read-only.
+func (s *PostgresStore) FindStaleDevices(userID string, olderThan time.Time, exceptDeviceID string) ([]*StaleDevice, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT ` + staleDeviceColumns + `
+		FROM devices d
+		WHERE d.user_id = $1 AND d.is_active = true
+		  AND COALESCE(d.last_sync, d.created_at) < $2
+		  AND d.id::text <> $3
+		ORDER BY COALESCE(d.last_sync, d.created_at) ASC
+	`
+
+	rows, err := db.Query(query, userID, olderThan, exceptDeviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []*StaleDevice
+	for rows.Next() {
+		device, err := scanStaleDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+// FindAutoDeactivationCandidates returns, across users who turned on
+// auto-deactivation (or just userID when set), active devices idle for at
+// least their owner's setting minus warningDays: those due a warning and
+// those due deactivation. Ordered by user. Read-only.
+func (s *PostgresStore) FindAutoDeactivationCandidates(now time.Time, warningDays int, userID string) ([]*StaleDevice, error) {
+	query := `
+		SELECT ` + staleDeviceColumns + `, u.device_auto_deactivate_days
+		FROM devices d
+		JOIN users u ON u.id = d.user_id
+		WHERE u.device_auto_deactivate_days IS NOT NULL AND u.is_active = true
+		  AND d.is_active = true
+		  AND COALESCE(d.last_sync, d.created_at)
+		      < $1 - make_interval(days => u.device_auto_deactivate_days - $2)
+		  AND ($3 = '' OR d.user_id::text = $3)
+		ORDER BY d.user_id, COALESCE(d.last_sync, d.created_at) ASC
+	`
+
+	var devices []*StaleDevice
+	err := s.eachRegion(func(_ string, db *sql.DB) error {
+		rows, err := db.Query(query, now, warningDays, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var days int
+			device, err := scanStaleDevice(rows, &days)
+			if err != nil {
+				return err
+			}
+			device.AutoDeactivateDays = days
+			devices = append(devices, device)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Each region's rows are in order; keep them so across regions
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].UserID < devices[j].UserID
+	})
+	return devices, nil
+}
+
+// MarkDevicesWarned records that the owners of deviceIDs were warned
+func (s *PostgresStore) MarkDevicesWarned(deviceIDs []string, at time.Time) error {
+	query := `UPDATE devices SET inactivity_warned_at = $2 WHERE id = ANY($1::uuid[])`
+	return s.eachRegion(func(_ string, db *sql.DB) error {
+		_, err := db.Exec(query, pq.Array(deviceIDs), at)
+		return err
+	})
+}
+
+// RevokeDevices deactivates those of deviceIDs that are the user's active
+// devices, revokes their trust and their refresh tokens, in one
+// transaction. It returns the IDs it deactivated. deviceIDs must be valid
+// UUIDs.
+func (s *PostgresStore) RevokeDevices(userID string, deviceIDs []string) ([]string, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		UPDATE devices SET is_active = false, trust_level = $3
+		WHERE user_id = $1 AND id = ANY($2::uuid[]) AND is_active = true
+		RETURNING id
+	`, userID, pq.Array(deviceIDs), int(peer.TrustLevelRevoked))
+	if err != nil {
+		return nil, err
+	}
+
+	var revoked []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		revoked = append(revoked, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(revoked) == 0 {
+		return nil, nil
+	}
+
+	_, err = tx.Exec(`
+		UPDATE refresh_tokens SET revoked = true
+		WHERE user_id = $1 AND device_id = ANY($2::uuid[]) AND revoked = false
+	`, userID, pq.Array(revoked))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+// SetDeviceTrustLevel moves one of the user's active devices from one
+// trust level to another. Returns sql.ErrNoRows if the device does not
+// exist, is inactive or is no longer at from. Revocation goes through
+// RevokeDevices, which also deactivates the device.
+func (s *PostgresStore) SetDeviceTrustLevel(userID, deviceID string, from, to int) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec(`
+		UPDATE devices SET trust_level = $4
+		WHERE user_id = $1 AND id = $2 AND is_active = true AND trust_level = $3
+	`, userID, deviceID, from, to)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RenameDevice changes the name of one of the user's active devices.
+// Returns sql.ErrNoRows if the device does not exist, is another user's or
+// is inactive.
+func (s *PostgresStore) RenameDevice(userID, deviceID, name string) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec(`
+		UPDATE devices SET device_name = $3
+		WHERE user_id = $1 AND id = $2 AND is_active = true
+	`, userID, deviceID, name)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RevokeDevice is RevokeDevices for one device. Returns sql.ErrNoRows if the
+// device does not exist or is already inactive.
+func (s *PostgresStore) RevokeDevice(userID, deviceID string) error {
+	revoked, err := s.RevokeDevices(userID, []string{deviceID})
+	if err != nil {
+		return err
+	}
+	if len(revoked) == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UpsertDevice registers a device under a client-chosen fingerprint. If the
+// user has an active device with that fingerprint, it is updated instead:
+// name and type are replaced, public key and capabilities only when given
+// (a nil publicKey or capabilities keeps the stored ones), and the max
+// enc_version when above 0. A device whose public key changes goes through
+// the account's approval setting again, as a new one would. The bool is
+// true when a device was created.
+func (s *PostgresStore) UpsertDevice(userID, fingerprint, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte) (*Device, bool, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, false, err
+	}
+	return upsertDevice(db, userID, fingerprint, deviceName, deviceType, publicKey, maxEncVersion, capabilities)
+}
+
+func upsertDevice(q querier, userID, fingerprint, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte) (*Device, bool, error) {
+	device := &Device{
+		UserID:     userID,
+		DeviceName: deviceName,
+		DeviceType: deviceType,
+		IsActive:   true,
+	}
+	newCapabilities := capabilities
+	if len(newCapabilities) == 0 {
+		newCapabilities = []byte("{}")
+	}
+
+	// The row keeps the new ID only if the statement inserted it
+	newID := uuid.New().String()
+	err := q.QueryRow(`
+		INSERT INTO devices (id, user_id, device_name, device_type, public_key, is_active, max_enc_version, trust_level, capabilities, device_fingerprint)
+		SELECT $1, $2, $3, $4, $5, true, NULLIF($6, 0),
+		       CASE WHEN u.device_approval = $7 THEN $8 ELSE $9 END, $10, $11
+		FROM users u WHERE u.id = $2
+		ON CONFLICT (user_id, device_fingerprint) WHERE is_active AND device_fingerprint IS NOT NULL
+		DO UPDATE SET
+		    device_name = EXCLUDED.device_name,
+		    device_type = EXCLUDED.device_type,
+		    public_key = COALESCE(EXCLUDED.public_key, devices.public_key),
+		    max_enc_version = COALESCE(EXCLUDED.max_enc_version, devices.max_enc_version),
+		    capabilities = CASE WHEN $12 THEN EXCLUDED.capabilities ELSE devices.capabilities END,
+		    trust_level = CASE
+		        WHEN devices.public_key IS NOT NULL AND EXCLUDED.public_key IS NOT NULL
+		             AND devices.public_key <> EXCLUDED.public_key THEN EXCLUDED.trust_level
+		        ELSE devices.trust_level END
+		RETURNING id, public_key, last_sync, created_at, COALESCE(max_enc_version, 0), trust_level, capabilities
+	`, newID, userID, deviceName, deviceType, publicKey, maxEncVersion,
+		peer.DeviceApprovalOff, int(peer.TrustLevelTrusted), int(peer.TrustLevelPending),
+		string(newCapabilities), fingerprint, capabilities != nil,
+	).Scan(
+		&device.ID, &device.PublicKey, &device.LastSync, &device.CreatedAt,
+		&device.MaxEncVersion, &device.TrustLevel, &device.Capabilities,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	return device, device.ID == newID, nil
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Sync diagnostics: aggregates support reads to triage diverging devices.
+// None of them read encrypted columns or credential metadata text.
+
+// LayerCount is the number of live and tombstoned items in one layer of a zone
+type LayerCount struct {
+	Layer      string `json:"layer"` // One of the mapping.Layer* names
+	Live       int64  `json:"live"`
+	Tombstoned int64  `json:"tombstoned"`
+}
+
+// CountLayerItems counts a zone's live and tombstoned items per layer
+func (s *PostgresStore) CountLayerItems(ctx context.Context, userID, zone string) ([]LayerCount, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]LayerCount, 0, len(probeLayers))
+	for _, l := range probeLayers {
+		count := LayerCount{Layer: l.layer}
+		err := db.QueryRowContext(ctx, `
+			SELECT COUNT(*) FILTER (WHERE NOT COALESCE(tombstone, false)),
+			       COUNT(*) FILTER (WHERE COALESCE(tombstone, false))
+			FROM `+l.table+`
+			WHERE user_id = $1 AND zone = $2
+		`, userID, zone).Scan(&count.Live, &count.Tombstoned)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, nil
+}
+
+// Kinds of reference violation
+const (
+	ReferenceMissing    = "missing"    // No key with that UUID in the zone
+	ReferenceTombstoned = "tombstoned" // The key was deleted
+)
+
+// ReferenceViolation is a live item pointing at a crypto key the zone
+// doesn't have, or no longer has
+type ReferenceViolation struct {
+	Layer     string `json:"layer"`
+	ItemUUID  string `json:"item_uuid"`
+	Field     string `json:"field"` // password_key_uuid, metadata_key_uuid or parent_key_uuid
+	KeyUUID   string `json:"key_uuid"`
+	Violation string `json:"violation"`
+}
+
+// referenceChecks selects live items with a key reference that doesn't
+// resolve to a live key. $1 user, $2 zone.
+const referenceChecks = `
+	SELECT 'credential_metadata', m.item_uuid::text, 'password_key_uuid', m.password_key_uuid::text, k.tombstone
+	FROM credential_metadata m
+	LEFT JOIN crypto_keys k ON k.user_id = m.user_id AND k.zone = m.zone AND k.item_uuid = m.password_key_uuid
+	WHERE m.user_id = $1 AND m.zone = $2 AND m.tombstone = false
+	  AND (k.item_uuid IS NULL OR k.tombstone = true)
+	UNION ALL
+	SELECT 'credential_metadata', m.item_uuid::text, 'metadata_key_uuid', m.metadata_key_uuid::text, k.tombstone
+	FROM credential_metadata m
+	LEFT JOIN crypto_keys k ON k.user_id = m.user_id AND k.zone = m.zone AND k.item_uuid = m.metadata_key_uuid
+	WHERE m.user_id = $1 AND m.zone = $2 AND m.tombstone = false AND m.metadata_key_uuid IS NOT NULL
+	  AND (k.item_uuid IS NULL OR k.tombstone = true)
+	UNION ALL
+	SELECT 'sync_record', r.item_uuid::text, 'parent_key_uuid', r.parent_key_uuid::text, k.tombstone
+	FROM sync_records r
+	LEFT JOIN crypto_keys k ON k.user_id = r.user_id AND k.zone = r.zone AND k.item_uuid = r.parent_key_uuid
+	WHERE r.user_id = $1 AND r.zone = $2 AND r.tombstone = false AND r.parent_key_uuid IS NOT NULL
+	  AND (k.item_uuid IS NULL OR k.tombstone = true)
+`
+
+// FindReferenceViolations returns up to limit of a zone's live items whose
+// key references don't resolve to a live crypto key
+func (s *PostgresStore) FindReferenceViolations(ctx context.Context, userID, zone string, limit int) ([]ReferenceViolation, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	return referenceViolations(ctx, db, userID, zone, limit)
+}
+
+func referenceViolations(ctx context.Context, q rowQuerier, userID, zone string, limit int) ([]ReferenceViolation, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT * FROM (`+referenceChecks+`) violations
+		ORDER BY 1, 2, 3
+		LIMIT $3
+	`, userID, zone, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	violations := []ReferenceViolation{}
+	for rows.Next() {
+		var v ReferenceViolation
+		var keyTombstoned sql.NullBool
+		if err := rows.Scan(&v.Layer, &v.ItemUUID, &v.Field, &v.KeyUUID, &keyTombstoned); err != nil {
+			return nil, err
+		}
+		v.Violation = ReferenceMissing
+		if keyTombstoned.Valid {
+			v.Violation = ReferenceTombstoned
+		}
+		violations = append(violations, v)
+	}
+	return violations, rows.Err()
+}
+
+// ListRecentAuditEvents returns the user's latest audit events, newest
+// first, without their details
+func (s *PostgresStore) ListRecentAuditEvents(ctx context.Context, userID string, limit int) ([]*AuditEvent, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, user_id, actor_id, device_id, action, zone, item_uuid,
+		       COALESCE(ip_address, ''), created_at
+		FROM audit_events
+		WHERE user_id = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*AuditEvent
+	for rows.Next() {
+		event := &AuditEvent{}
+		err := rows.Scan(&event.ID, &event.UserID, &event.ActorID, &event.DeviceID,
+			&event.Action, &event.Zone, &event.ItemUUID, &event.IPAddress, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// ImportItemError is an item of an import the database refused. Unlike a
+// push's, it aborts the whole import.
+type ImportItemError struct {
+	Zone string
+	*PushItemError
+}
+
+func (e *ImportItemError) Error() string {
+	return fmt.Sprintf("zone %s: %v", e.Zone, e.PushItemError)
+}
+
+// CommitImport writes a vault import, one batch per zone, in a single
+// transaction: each batch is numbered from its zone's gencounts like a
+// push (see CommitPush), and any item the database refuses rolls back all
+// of them as an *ImportItemError. As with a push the manifest digests are
+// left to ComputeManifest.
+func (s *PostgresStore) CommitImport(ctx context.Context, userID string, batches []*PushBatch) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, batch := range batches {
+		if err := writeImportBatch(ctx, tx, userID, batch, isItemRejected); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			INSERT INTO sync_state (user_id, zone, gencount, last_writer_device_id)
+			VALUES ($1, $2, $3, NULLIF($4, '')::uuid)
+			ON CONFLICT (user_id, zone) DO UPDATE SET
+				last_writer_device_id = EXCLUDED.last_writer_device_id,
+				updated_at = NOW()
+		`, userID, batch.Zone, batch.GenCount, batch.DeviceID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// writeImportBatch numbers a batch of an import and writes its items in tx.
+// The statements are the same in Postgres and SQLite; rejected tells the
+// database's refusals from other failures.
+func writeImportBatch(ctx context.Context, tx *sql.Tx, userID string, batch *PushBatch, rejected func(error) bool) error {
+	genCounts, err := nextGenCounts(ctx, tx, userID, batch.Zone, batch.Len())
+	if err != nil {
+		return err
+	}
+	batch.Number(genCounts)
+
+	refused := func(layer string, index int, err error) error {
+		if err == nil || !rejected(err) {
+			return err
+		}
+		return &ImportItemError{Zone: batch.Zone, PushItemError: &PushItemError{Layer: layer, Index: index, Err: err}}
+	}
+	for i, key := range batch.Keys {
+		if err := refused("crypto_key", i, insertCryptoKey(tx, userID, key.ItemUUID.String(), key)); err != nil {
+			return err
+		}
+	}
+	for i, cred := range batch.Metadata {
+		if err := refused("credential_metadata", i, insertCredentialMetadata(tx, userID, cred.ItemUUID.String(), cred)); err != nil {
+			return err
+		}
+	}
+	for i, record := range batch.Records {
+		if err := refused("sync_record", i, insertSyncRecord(tx, userID, record.ItemUUID.String(), record)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
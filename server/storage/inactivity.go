@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// Account inactivity lifecycle: what the account_inactivity job reads and
+// writes. Activity is a login or refresh (users.last_active_at) or a sync
+// (devices.last_sync), whichever is latest.
+
+// FreeTier is the subscription tier of accounts that don't pay
+const FreeTier = "free"
+
+// Inactivity stages, in the order an idle account goes through them
+const (
+	InactivityActive         = "active"
+	InactivityWarned         = "warned"          // Told the account will go dormant
+	InactivityDormant        = "dormant"         // Refresh tokens revoked, data kept
+	InactivityDeletionWarned = "deletion_warned" // Told the account will be deleted
+	InactivityDeletionQueued = "deletion_queued" // Deactivated; deleted once the grace period ends
+)
+
+// InactiveAccount is an account the inactivity lifecycle looks at
+type InactiveAccount struct {
+	UserID     string
+	Email      string
+	Tier       string
+	LegalHold  bool
+	LastActive time.Time
+	Stage      string
+	StageAt    *time.Time // When Stage was entered; nil while active
+}
+
+// FindInactiveAccounts returns, across regions (or just userID when set),
+// free accounts not on legal hold with no activity after idleBefore, and
+// every account past the active stage whatever its tier, hold or activity,
+// so the job can take them back. Least recently active first. Read-only.
+func (s *PostgresStore) FindInactiveAccounts(idleBefore time.Time, userID string) ([]*InactiveAccount, error) {
+	query := `
+		SELECT u.id, u.email, COALESCE(u.subscription_tier, 'free'), u.legal_hold,
+		       GREATEST(COALESCE(u.last_active_at, u.created_at), COALESCE(MAX(d.last_sync), u.created_at)),
+		       u.inactivity_stage, u.inactivity_stage_at
+		FROM users u
+		LEFT JOIN devices d ON d.user_id = u.id
+		WHERE ($2 = '' OR u.id::text = $2)
+		GROUP BY u.id
+		HAVING u.inactivity_stage <> 'active'
+		    OR (COALESCE(u.subscription_tier, 'free') = 'free' AND NOT u.legal_hold
+		        AND GREATEST(COALESCE(u.last_active_at, u.created_at), COALESCE(MAX(d.last_sync), u.created_at)) <= $1)
+	`
+
+	var accounts []*InactiveAccount
+	err := s.eachRegion(func(_ string, db *sql.DB) error {
+		rows, err := db.Query(query, idleBefore, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			account := &InactiveAccount{}
+			err := rows.Scan(&account.UserID, &account.Email, &account.Tier, &account.LegalHold,
+				&account.LastActive, &account.Stage, &account.StageAt)
+			if err != nil {
+				return err
+			}
+			accounts = append(accounts, account)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].LastActive.Before(accounts[j].LastActive)
+	})
+	return accounts, nil
+}
+
+// SetInactivityStage moves the user from one stage to another at the given
+// time, with the stage's effects in the same transaction: going dormant
+// revokes the refresh tokens, being queued for deletion also deactivates
+// the account and invalidates its access tokens, and leaving the deletion
+// queue activates it again. It returns false, changing nothing, when the
+// user is no longer in the from stage (a login moved them back meanwhile).
+func (s *PostgresStore) SetInactivityStage(userID, from, to string, at time.Time) (bool, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var stageAt *time.Time
+	if to != InactivityActive {
+		stageAt = &at
+	}
+	result, err := tx.Exec(`
+		UPDATE users SET inactivity_stage = $3, inactivity_stage_at = $4, updated_at = NOW()
+		WHERE id = $1 AND inactivity_stage = $2
+	`, userID, from, to, stageAt)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	if to == InactivityDormant || to == InactivityDeletionQueued {
+		_, err := tx.Exec(`UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND revoked = false`, userID)
+		if err != nil {
+			return false, err
+		}
+	}
+	switch {
+	case to == InactivityDeletionQueued:
+		_, err = tx.Exec(`UPDATE users SET is_active = false, token_version = token_version + 1 WHERE id = $1`, userID)
+	case from == InactivityDeletionQueued:
+		_, err = tx.Exec(`UPDATE users SET is_active = true WHERE id = $1`, userID)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	s.notifyUserChanged(userID)
+	return true, nil
+}
+
+// TouchUser records a login or refresh: the account counts as active from
+// at and leaves whatever inactivity stage it was in. It returns the stage
+// it was in before.
+func (s *PostgresStore) TouchUser(userID string, at time.Time) (string, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return "", err
+	}
+
+	// The joined row is the one before the update
+	var previous string
+	err = db.QueryRow(`
+		UPDATE users u
+		SET last_active_at = $2, inactivity_stage = 'active', inactivity_stage_at = NULL
+		FROM users old
+		WHERE u.id = $1 AND old.id = u.id
+		RETURNING old.inactivity_stage
+	`, userID, at).Scan(&previous)
+	return previous, err
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/lib/pq"
+)
+
+// Integrity scan: the reads behind a user's own integrity report. Like the
+// diagnostics they never read encrypted columns or credential metadata text.
+
+// IntegrityScanOptions bounds an integrity scan
+type IntegrityScanOptions struct {
+	Limit         int           // Item UUIDs returned per check
+	MinEncVersion int           // Records above it are listed; 0 skips the check
+	Timeout       time.Duration // Statement timeout of each query; 0 for none
+}
+
+// ItemSample is the first few item UUIDs a check matched, and how many it
+// matched in all
+type ItemSample struct {
+	Total     int64
+	ItemUUIDs []string
+}
+
+// IntegrityScan is what one zone's integrity checks read, all from the same
+// snapshot
+type IntegrityScan struct {
+	GenCount     int64
+	StoredDigest []byte         // nil for a zone that was never written
+	Computed     *ManifestState // The digest of the zone's live items
+
+	// Up to Limit+1 violations, so callers can tell the list was cut short
+	Violations   []ReferenceViolation
+	OrphanedKeys ItemSample // Live keys no live item refers to
+	Unsupported  ItemSample // Live records above MinEncVersion
+}
+
+// orphanedKeys selects live keys no live credential or sync record refers
+// to. $1 user, $2 zone, $3 limit.
+const orphanedKeys = `
+	SELECT k.item_uuid::text, COUNT(*) OVER ()
+	FROM crypto_keys k
+	WHERE k.user_id = $1 AND k.zone = $2 AND k.tombstone = false
+	  AND NOT EXISTS (
+		SELECT 1 FROM credential_metadata m
+		WHERE m.user_id = k.user_id AND m.zone = k.zone AND m.tombstone = false
+		  AND (m.password_key_uuid = k.item_uuid OR m.metadata_key_uuid = k.item_uuid))
+	  AND NOT EXISTS (
+		SELECT 1 FROM sync_records r
+		WHERE r.user_id = k.user_id AND r.zone = k.zone AND r.tombstone = false
+		  AND r.parent_key_uuid = k.item_uuid)
+	ORDER BY 1
+	LIMIT $3
+`
+
+// ScanIntegrity runs the integrity checks of a user's zone in one read-only
+// snapshot. A query cut off by opts.Timeout fails the scan with
+// sync.ErrIntegrityTimeout.
+func (s *PostgresStore) ScanIntegrity(ctx context.Context, userID, zone string, opts IntegrityScanOptions) (*IntegrityScan, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if opts.Timeout > 0 {
+		// SET takes no parameters; the value is an integer we formatted
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", opts.Timeout.Milliseconds())); err != nil {
+			return nil, err
+		}
+	}
+
+	scan, err := scanIntegrity(ctx, tx, userID, zone, opts)
+	if isQueryCanceled(err) {
+		return nil, sync.ErrIntegrityTimeout
+	}
+	return scan, err
+}
+
+func scanIntegrity(ctx context.Context, tx *sql.Tx, userID, zone string, opts IntegrityScanOptions) (*IntegrityScan, error) {
+	scan := &IntegrityScan{}
+	err := tx.QueryRowContext(ctx, `
+		SELECT gencount, digest FROM sync_state WHERE user_id = $1 AND zone = $2
+	`, userID, zone).Scan(&scan.GenCount, &scan.StoredDigest)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if scan.Computed, err = computeManifest(ctx, tx, userID, zone); err != nil {
+		return nil, err
+	}
+	if scan.Violations, err = referenceViolations(ctx, tx, userID, zone, opts.Limit+1); err != nil {
+		return nil, err
+	}
+	if scan.OrphanedKeys, err = sampleItems(ctx, tx, orphanedKeys, userID, zone, opts.Limit); err != nil {
+		return nil, err
+	}
+	if opts.MinEncVersion > 0 {
+		scan.Unsupported, err = sampleItems(ctx, tx, `
+			SELECT item_uuid::text, COUNT(*) OVER ()
+			FROM sync_records
+			WHERE user_id = $1 AND zone = $2 AND tombstone = false AND enc_version > $4
+			ORDER BY 1
+			LIMIT $3
+		`, userID, zone, opts.Limit, opts.MinEncVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scan, nil
+}
+
+// sampleItems runs a query selecting an item UUID and the total match count
+// per row. $1 user, $2 zone, $3 limit, then args.
+func sampleItems(ctx context.Context, tx *sql.Tx, query, userID, zone string, limit int, args ...interface{}) (ItemSample, error) {
+	sample := ItemSample{ItemUUIDs: []string{}}
+	rows, err := tx.QueryContext(ctx, query, append([]interface{}{userID, zone, limit}, args...)...)
+	if err != nil {
+		return sample, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var itemUUID string
+		if err := rows.Scan(&itemUUID, &sample.Total); err != nil {
+			return sample, err
+		}
+		sample.ItemUUIDs = append(sample.ItemUUIDs, itemUUID)
+	}
+	return sample, rows.Err()
+}
+
+// isQueryCanceled reports whether Postgres cancelled a statement, which is
+// how statement_timeout ends one
+func isQueryCanceled(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "57014"
+}
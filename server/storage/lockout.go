@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Login lockout: consecutive wrong passwords per account, and the time
+// logins are refused until once there were too many.
+
+// IncrementFailedLogin counts a wrong password for the user. The attempt
+// that reaches threshold locks the account until lockUntil and starts the
+// count over. It returns the account's locked_until afterwards, which may
+// be an earlier lock that already expired, or nil; sql.ErrNoRows for an
+// unknown user.
+func (s *PostgresStore) IncrementFailedLogin(userID string, threshold int, lockUntil time.Time) (*time.Time, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var lockedUntil *time.Time
+	err = db.QueryRow(`
+		UPDATE users SET
+		    locked_until = CASE WHEN failed_login_attempts + 1 >= $2 THEN $3 ELSE locked_until END,
+		    failed_login_attempts = CASE WHEN failed_login_attempts + 1 >= $2 THEN 0 ELSE failed_login_attempts + 1 END
+		WHERE id = $1
+		RETURNING locked_until
+	`, userID, threshold, lockUntil).Scan(&lockedUntil)
+	return lockedUntil, err
+}
+
+// ResetFailedLogin clears the user's count of wrong passwords and any
+// lockout, after a successful login
+func (s *PostgresStore) ResetFailedLogin(userID string) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		UPDATE users SET failed_login_attempts = 0, locked_until = NULL
+		WHERE id = $1 AND (failed_login_attempts <> 0 OR locked_until IS NOT NULL)
+	`, userID)
+	return err
+}
+
+// IsLocked reports whether logins to the user's account are refused at the
+// given time, and until when
+func (s *PostgresStore) IsLocked(userID string, at time.Time) (bool, time.Time, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	var lockedUntil sql.NullTime
+	err = db.QueryRow(`SELECT locked_until FROM users WHERE id = $1`, userID).Scan(&lockedUntil)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if !lockedUntil.Valid || !lockedUntil.Time.After(at) {
+		return false, time.Time{}, nil
+	}
+	return true, lockedUntil.Time, nil
+}
@@ -0,0 +1,514 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/lib/pq"
+)
+
+// Retention and maintenance methods
+
+// TombstoneSummary counts the tombstones one user/zone would lose to a purge
+type TombstoneSummary struct {
+	UserID          string
+	Zone            string
+	Count           int64
+	SampleItemUUIDs []string
+	LegalHold       bool // The owner is on legal hold; the purge must skip them
+}
+
+// purgeableTombstones selects tombstoned rows across all three layers whose
+// last update is older than $1. Items of a bulk wipe still in its recovery
+// window are left alone. The dry-run estimate and the real purge both
+// use this predicate so they can never disagree.
+const purgeableTombstones = `
+	SELECT user_id, zone, item_uuid, gencount FROM crypto_keys
+	WHERE tombstone = true AND wipe_id IS NULL AND updated_at < $1
+	UNION ALL
+	SELECT user_id, zone, item_uuid, gencount FROM credential_metadata
+	WHERE tombstone = true AND wipe_id IS NULL AND updated_at < $1
+	UNION ALL
+	SELECT user_id, zone, item_uuid, gencount FROM sync_records
+	WHERE tombstone = true AND wipe_id IS NULL AND updated_at < $1
+`
+
+// FindPurgeableTombstones summarizes, per user and zone, the tombstones older
+// than olderThan. An empty userID covers every user. Read-only.
+func (s *PostgresStore) FindPurgeableTombstones(olderThan time.Time, userID string, sampleSize int) ([]*TombstoneSummary, error) {
+	query := `
+		SELECT purgeable.user_id, purgeable.zone, COUNT(*),
+		       (array_agg(purgeable.item_uuid::text ORDER BY purgeable.gencount ASC))[1:$3],
+		       u.legal_hold
+		FROM (` + purgeableTombstones + `) purgeable
+		JOIN users u ON u.id = purgeable.user_id
+		WHERE ($2 = '' OR purgeable.user_id::text = $2)
+		GROUP BY purgeable.user_id, purgeable.zone, u.legal_hold
+		ORDER BY purgeable.user_id, purgeable.zone
+	`
+
+	var summaries []*TombstoneSummary
+	err := s.eachRegion(func(_ string, db *sql.DB) error {
+		rows, err := db.Query(query, olderThan, userID, sampleSize)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			summary := &TombstoneSummary{}
+			var samples []sql.NullString
+			err := rows.Scan(&summary.UserID, &summary.Zone, &summary.Count, pq.Array(&samples), &summary.LegalHold)
+			if err != nil {
+				return err
+			}
+			for _, sample := range samples {
+				if sample.Valid {
+					summary.SampleItemUUIDs = append(summary.SampleItemUUIDs, sample.String)
+				}
+			}
+			summaries = append(summaries, summary)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(summaries, func(i, j int) bool {
+		if summaries[i].UserID != summaries[j].UserID {
+			return summaries[i].UserID < summaries[j].UserID
+		}
+		return summaries[i].Zone < summaries[j].Zone
+	})
+	return summaries, nil
+}
+
+// PurgeTombstones hard-deletes tombstoned rows older than olderThan for one
+// user/zone across all three layers in a single transaction. It deletes
+// nothing while the user is on legal hold, even if the hold was placed
+// after the job selected them.
+func (s *PostgresStore) PurgeTombstones(userID, zone string, olderThan time.Time) (int64, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var total int64
+	for _, table := range []string{"crypto_keys", "credential_metadata", "sync_records"} {
+		result, err := tx.Exec(`
+			DELETE FROM `+table+`
+			WHERE user_id = $1 AND zone = $2 AND tombstone = true AND wipe_id IS NULL AND updated_at < $3
+			  AND NOT EXISTS (SELECT 1 FROM users WHERE id = $1 AND legal_hold)
+		`, userID, zone, olderThan)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+
+	// Recompute the digest from the rows left, so clients comparing it
+	// against their own manifest don't see the purge as a divergence
+	if total > 0 {
+		manifest, err := computeManifest(context.Background(), tx, userID, zone)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`
+			UPDATE sync_state SET digest = $3 WHERE user_id = $1 AND zone = $2
+		`, userID, zone, manifest.Digest)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// OrphanedKeys lists the keys of one user/zone that nothing refers to
+type OrphanedKeys struct {
+	UserID    string
+	Zone      string
+	ItemUUIDs []string // In the order a tombstoning would number them
+	LegalHold bool     // The owner is on legal hold; the keys must be kept
+}
+
+// orphanedKey is true of a live key k updated before $1 that no credential
+// or sync record of its zone refers to. Items trashed by a bulk wipe still
+// count as referring: undoing the wipe brings them back. The age keeps a
+// key pushed ahead of the credential that will use it out of reach. The
+// integrity scan's orphanedKeys reports more: it has neither exception.
+const orphanedKey = `
+	k.tombstone = false AND k.updated_at < $1
+	AND NOT EXISTS (
+		SELECT 1 FROM credential_metadata m
+		WHERE m.user_id = k.user_id AND m.zone = k.zone
+		  AND (m.tombstone = false OR m.wipe_id IS NOT NULL)
+		  AND (m.password_key_uuid = k.item_uuid OR m.metadata_key_uuid = k.item_uuid))
+	AND NOT EXISTS (
+		SELECT 1 FROM sync_records r
+		WHERE r.user_id = k.user_id AND r.zone = k.zone
+		  AND (r.tombstone = false OR r.wipe_id IS NOT NULL)
+		  AND r.parent_key_uuid = k.item_uuid)
+`
+
+// FindOrphanedKeys lists, per user and zone, the keys older than olderThan
+// that TombstoneOrphanedKeys would tombstone. An empty userID covers every
+// user. Read-only.
+func (s *PostgresStore) FindOrphanedKeys(ctx context.Context, olderThan time.Time, userID string) ([]*OrphanedKeys, error) {
+	var found []*OrphanedKeys
+	err := s.eachRegion(func(_ string, db *sql.DB) error {
+		regionKeys, err := findOrphanedKeys(ctx, db, orphanedKeysByZone, olderThan, userID)
+		found = append(found, regionKeys...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].UserID != found[j].UserID {
+			return found[i].UserID < found[j].UserID
+		}
+		return found[i].Zone < found[j].Zone
+	})
+	return found, nil
+}
+
+// orphanedKeysByZone selects the orphaned keys of every user, or of user $2,
+// in the order findOrphanedKeys groups them
+const orphanedKeysByZone = `
+	SELECT k.user_id, k.zone, k.item_uuid, u.legal_hold
+	FROM crypto_keys k
+	JOIN users u ON u.id = k.user_id
+	WHERE ` + orphanedKey + `
+	  AND ($2 = '' OR k.user_id::text = $2)
+	ORDER BY k.user_id, k.zone, k.gencount, k.item_uuid
+`
+
+// findOrphanedKeys runs query, orphanedKeysByZone in q's dialect, and
+// groups the keys by zone
+func findOrphanedKeys(ctx context.Context, q rowQuerier, query string, olderThan time.Time, userID string) ([]*OrphanedKeys, error) {
+	rows, err := q.QueryContext(ctx, query, olderThan.UTC(), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []*OrphanedKeys
+	for rows.Next() {
+		var userID, zone, itemUUID string
+		var legalHold bool
+		if err := rows.Scan(&userID, &zone, &itemUUID, &legalHold); err != nil {
+			return nil, err
+		}
+		if n := len(found); n == 0 || found[n-1].UserID != userID || found[n-1].Zone != zone {
+			found = append(found, &OrphanedKeys{UserID: userID, Zone: zone, LegalHold: legalHold})
+		}
+		last := found[len(found)-1]
+		last.ItemUUIDs = append(last.ItemUUIDs, itemUUID)
+	}
+	return found, rows.Err()
+}
+
+// TombstoneOrphanedKeys tombstones a user/zone's keys older than olderThan
+// that nothing refers to, giving each a new gencount and recomputing the
+// digest in one transaction. Keys are selected again under lock, so one that
+// gained a reference since FindOrphanedKeys is kept. Nothing is tombstoned
+// while the user is on legal hold.
+func (s *PostgresStore) TombstoneOrphanedKeys(ctx context.Context, userID, zone string, olderThan time.Time) (*WipeResult, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	items, err := zoneOrphanedKeys(ctx, tx, userID, zone, olderThan, "FOR UPDATE")
+	if err != nil {
+		return nil, err
+	}
+	genCounts, err := nextGenCounts(ctx, tx, userID, zone, int64(len(items)))
+	if err != nil {
+		return nil, err
+	}
+	result := &WipeResult{GenCount: genCounts.Last, Items: items}
+	if len(items) > 0 {
+		if err := renumberWipeItems(ctx, tx, userID, zone, items, result.GenCount, true, nil); err != nil {
+			return nil, err
+		}
+		if err := saveWipeState(ctx, tx, userID, zone, result.GenCount, ""); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// zoneOrphanedKeys selects the orphaned keys of one zone in numbering order,
+// none if the user is on legal hold. lock is appended to the query.
+func zoneOrphanedKeys(ctx context.Context, tx *sql.Tx, userID, zone string, olderThan time.Time, lock string) ([]*WipedItem, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT k.item_uuid FROM crypto_keys k
+		WHERE `+orphanedKey+`
+		  AND k.user_id = $2 AND k.zone = $3
+		  AND NOT EXISTS (SELECT 1 FROM users WHERE id = $2 AND legal_hold)
+		ORDER BY k.gencount, k.item_uuid
+		`+lock, olderThan.UTC(), userID, zone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []*WipedItem
+	for rows.Next() {
+		item := &WipedItem{Table: "crypto_keys"}
+		if err := rows.Scan(&item.ItemUUID); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// Job report methods. Reports are kept in the primary database.
+
+type JobReport struct {
+	ID            int64
+	JobName       string
+	DryRun        bool
+	StartedAt     time.Time
+	FinishedAt    time.Time
+	TotalAffected int64
+	Details       []byte // JSON
+	Error         string
+}
+
+func (s *PostgresStore) SaveJobReport(report *JobReport) error {
+	query := `
+		INSERT INTO job_reports (job_name, dry_run, started_at, finished_at,
+			total_affected, details, error)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
+		RETURNING id
+	`
+
+	var details interface{}
+	if len(report.Details) > 0 {
+		details = string(report.Details)
+	}
+
+	return s.db.QueryRow(query,
+		report.JobName, report.DryRun, report.StartedAt, report.FinishedAt,
+		report.TotalAffected, details, report.Error,
+	).Scan(&report.ID)
+}
+
+func (s *PostgresStore) GetJobReport(id int64) (*JobReport, error) {
+	query := `
+		SELECT id, job_name, dry_run, started_at, finished_at, total_affected,
+		       details, COALESCE(error, '')
+		FROM job_reports WHERE id = $1
+	`
+
+	report := &JobReport{}
+	var details sql.NullString
+	err := s.db.QueryRow(query, id).Scan(
+		&report.ID, &report.JobName, &report.DryRun, &report.StartedAt,
+		&report.FinishedAt, &report.TotalAffected, &details, &report.Error,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if details.Valid {
+		report.Details = []byte(details.String)
+	}
+
+	return report, nil
+}
+
+// ListJobReports returns the most recent reports, optionally for one job
+func (s *PostgresStore) ListJobReports(jobName string, limit int) ([]*JobReport, error) {
+	query := `
+		SELECT id, job_name, dry_run, started_at, finished_at, total_affected,
+		       details, COALESCE(error, '')
+		FROM job_reports
+		WHERE ($1 = '' OR job_name = $1)
+		ORDER BY started_at DESC
+		LIMIT $2
+	`
+
+	rows, err := s.db.Query(query, jobName, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []*JobReport
+	for rows.Next() {
+		report := &JobReport{}
+		var details sql.NullString
+		err := rows.Scan(
+			&report.ID, &report.JobName, &report.DryRun, &report.StartedAt,
+			&report.FinishedAt, &report.TotalAffected, &details, &report.Error,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if details.Valid {
+			report.Details = []byte(details.String)
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, rows.Err()
+}
+
+// Manifest consistency methods
+
+// ManifestState is the digest recomputed from a zone's live items
+type ManifestState struct {
+	UserID    string
+	Zone      string
+	LeafCount int
+	Digest    []byte
+}
+
+// manifestLeafTables are the tables of sync.ManifestLeafLayers, in order
+var manifestLeafTables = map[string]string{
+	sync.LeafCredentialMetadata: "credential_metadata",
+	sync.LeafCryptoKey:          "crypto_keys",
+	sync.LeafSyncRecord:         "sync_records",
+}
+
+// ComputeManifest rebuilds a zone's digest from its live items, ignoring
+// sync_state. Items are hashed as they are read rather than loaded first.
+func (s *PostgresStore) ComputeManifest(ctx context.Context, userID, zone string) (*ManifestState, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	return computeManifest(ctx, db, userID, zone)
+}
+
+func computeManifest(ctx context.Context, q rowQuerier, userID, zone string) (*ManifestState, error) {
+	hasher := sync.NewManifestHasher()
+	for _, layer := range sync.ManifestLeafLayers {
+		err := streamLeaves(ctx, q, layer, userID, zone, hasher.Add)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &ManifestState{
+		UserID:    userID,
+		Zone:      zone,
+		LeafCount: hasher.Count(),
+		Digest:    hasher.Sum(),
+	}, nil
+}
+
+// ManifestLeaves returns a zone's live items as its digest sees them, in
+// the order sync.ManifestHasher takes them
+func (s *PostgresStore) ManifestLeaves(ctx context.Context, userID, zone string) ([]sync.ManifestLeaf, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	return manifestLeaves(ctx, db, userID, zone)
+}
+
+func manifestLeaves(ctx context.Context, q rowQuerier, userID, zone string) ([]sync.ManifestLeaf, error) {
+	leaves := []sync.ManifestLeaf{}
+	for _, layer := range sync.ManifestLeafLayers {
+		err := streamLeaves(ctx, q, layer, userID, zone, func(leaf sync.ManifestLeaf) {
+			leaves = append(leaves, leaf)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return leaves, nil
+}
+
+// streamLeaves calls fn for each live item of one layer of a zone, sorted
+// by item UUID
+func streamLeaves(ctx context.Context, q rowQuerier, layer, userID, zone string, fn func(sync.ManifestLeaf)) error {
+	rows, err := q.QueryContext(ctx, `
+		SELECT item_uuid, gencount FROM `+manifestLeafTables[layer]+`
+		WHERE user_id = $1 AND zone = $2 AND tombstone = false
+		ORDER BY item_uuid
+	`, userID, zone)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		leaf := sync.ManifestLeaf{Layer: layer}
+		if err := rows.Scan(&leaf.ItemUUID, &leaf.GenCount); err != nil {
+			return err
+		}
+		fn(leaf)
+	}
+	return rows.Err()
+}
+
+type UserZone struct {
+	UserID string
+	Zone   string
+}
+
+// SampleUserZones returns a random fraction of (user, zone) pairs that have
+// sync state, at most limit of them across all regions
+func (s *PostgresStore) SampleUserZones(fraction float64, limit int) ([]UserZone, error) {
+	var pairs []UserZone
+	err := s.eachRegion(func(_ string, db *sql.DB) error {
+		if len(pairs) >= limit {
+			return nil
+		}
+		rows, err := db.Query(`
+			SELECT user_id, zone FROM sync_state
+			WHERE random() < $1
+			LIMIT $2
+		`, fraction, limit-len(pairs))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var pair UserZone
+			if err := rows.Scan(&pair.UserID, &pair.Zone); err != nil {
+				return err
+			}
+			pairs = append(pairs, pair)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pairs, nil
+}
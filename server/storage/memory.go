@@ -0,0 +1,891 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	syncdomain "github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/google/uuid"
+)
+
+// MemoryStore keeps a whole server in maps guarded by one mutex, for tests
+// of the handlers and services that want no database. It follows the rules
+// of the SQL stores: pulls filter and order items the same way, pushes
+// upsert and keep the highest gencount, and missing rows are sql.ErrNoRows
+// where a method documents it. Writes the schema would refuse fail with a
+// *MemoryConstraintError. It has a single region, DefaultRegion.
+//
+// Rows are copied in and out, though byte slices are shared, so callers must
+// not modify the ones they pass in or get back.
+// Callbacks (user change hooks, snapshot readers, audit streams) run after
+// the mutex is released and may call back into the store.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	users         map[string]*memoryUser
+	devices       []*memoryDevice // In creation order
+	syncStates    map[memoryZoneKey]*memorySyncState
+	items         map[string]map[memoryItemKey]*memoryItem // By wipeTables name
+	pushSequences map[memoryDeviceKey]int64
+	wipes         []*memoryWipe    // In creation order
+	conflicts     []*SyncConflict  // In creation order
+	monitors      []*BreachMonitor // In creation order
+	alerts        []*BreachAlert   // In creation order
+	refreshTokens map[string]*RefreshToken
+	resetTokens   map[string]*memoryResetToken // By token hash
+	auditEvents   []*AuditEvent                // In ID order
+	jobReports    []*JobReport                 // In ID order
+	lastAuditID   int64
+	lastReportID  int64
+
+	// Called after any change to a user's auth-relevant columns
+	userChanged []func(userID string)
+}
+
+// MemoryConstraintError is a write the SQL schema would refuse, e.g. a NULL
+// in a NOT NULL column or a row of a user that doesn't exist. CommitPush
+// reports it per item, as the SQL stores do their constraint violations.
+type MemoryConstraintError struct {
+	Constraint string // NOT NULL, FOREIGN KEY or UNIQUE
+	Column     string // table.column
+}
+
+func (e *MemoryConstraintError) Error() string {
+	return fmt.Sprintf("%s constraint failed: %s", e.Constraint, e.Column)
+}
+
+type memoryUser struct {
+	User
+	settings UserSettings
+
+	lastActiveAt      *time.Time
+	inactivityStage   string
+	inactivityStageAt *time.Time
+
+	hashUpgradeDeadline   *time.Time
+	hashUpgradeNotifiedAt *time.Time
+	hashUpgradeEnforcedAt *time.Time
+
+	failedLogins int
+	lockedUntil  *time.Time
+}
+
+type memoryDevice struct {
+	Device
+	fingerprint *string // nil for devices registered without one
+	warnedAt    *time.Time
+}
+
+type memoryZoneKey struct {
+	userID string
+	zone   string
+}
+
+type memorySyncState struct {
+	genCount   int64
+	digest     []byte
+	lastWriter *string // Device ID
+	updatedAt  time.Time
+}
+
+type memoryDeviceKey struct {
+	userID   string
+	deviceID string
+}
+
+type memoryResetToken struct {
+	userID    string
+	expiresAt time.Time
+	usedAt    *time.Time
+}
+
+// NewMemoryStore returns an empty store
+func NewMemoryStore() *MemoryStore {
+	items := map[string]map[memoryItemKey]*memoryItem{}
+	for _, table := range wipeTables {
+		items[table] = map[memoryItemKey]*memoryItem{}
+	}
+	return &MemoryStore{
+		users:         map[string]*memoryUser{},
+		syncStates:    map[memoryZoneKey]*memorySyncState{},
+		items:         items,
+		pushSequences: map[memoryDeviceKey]int64{},
+		refreshTokens: map[string]*RefreshToken{},
+		resetTokens:   map[string]*memoryResetToken{},
+	}
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// Ping always succeeds, there being nothing to reach
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// HasRegion reports whether region is DefaultRegion, the only one
+func (s *MemoryStore) HasRegion(region string) bool {
+	return region == DefaultRegion
+}
+
+// memoryNow is the time the SQL stores' column defaults would write
+func memoryNow() time.Time {
+	return time.Now().UTC()
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	c := *t
+	return &c
+}
+
+func copyString(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	return &c
+}
+
+// Users
+
+func (s *MemoryStore) CreateUser(email string, passwordHash, salt []byte, region string) (*User, error) {
+	if err := checkSingleRegion(region); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.insertUser(email, passwordHash, salt)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// insertUser adds a user with the schema's defaults
+func (s *MemoryStore) insertUser(email string, passwordHash, salt []byte) (*User, error) {
+	for _, u := range s.users {
+		if u.Email == email {
+			return nil, ErrEmailTaken
+		}
+	}
+
+	now := memoryNow()
+	u := &memoryUser{
+		User: User{
+			ID:               uuid.New().String(),
+			Email:            email,
+			PasswordHash:     passwordHash,
+			Salt:             salt,
+			CreatedAt:        now,
+			UpdatedAt:        now,
+			SubscriptionTier: FreeTier,
+			IsActive:         true,
+			HashVersion:      auth.CurrentHashVersion,
+		},
+		settings: UserSettings{
+			EncVersionPolicy: syncdomain.EncVersionPolicyWarn,
+			DeviceApproval:   peer.DeviceApprovalOff,
+		},
+		inactivityStage: InactivityActive,
+	}
+	s.users[u.ID] = u
+
+	user := u.User
+	return &user, nil
+}
+
+// userRow returns a user's row, or sql.ErrNoRows
+func (s *MemoryStore) userRow(id string) (*memoryUser, error) {
+	u, ok := s.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return u, nil
+}
+
+// usersInOrder returns every user row, oldest first
+func (s *MemoryStore) usersInOrder() []*memoryUser {
+	users := make([]*memoryUser, 0, len(s.users))
+	for _, u := range s.users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if !users[i].CreatedAt.Equal(users[j].CreatedAt) {
+			return users[i].CreatedAt.Before(users[j].CreatedAt)
+		}
+		return users[i].ID < users[j].ID
+	})
+	return users
+}
+
+// checkUser is the user_id foreign key of the tables a user owns
+func (s *MemoryStore) checkUser(table, userID string) error {
+	if _, ok := s.users[userID]; !ok {
+		return &MemoryConstraintError{Constraint: "FOREIGN KEY", Column: table + ".user_id"}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetUserByEmail(email string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Email == email {
+			user := u.User
+			return &user, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *MemoryStore) GetUserByID(id string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.userRow(id)
+	if err != nil {
+		return nil, err
+	}
+	user := u.User
+	return &user, nil
+}
+
+// DeleteUserCascade removes an account and everything it owns, like
+// PostgresStore.DeleteUserCascade
+func (s *MemoryStore) DeleteUserCascade(_ context.Context, id string) error {
+	if err := s.deleteUser(id); err != nil {
+		return err
+	}
+	s.notifyUserChanged(id)
+	return nil
+}
+
+// deleteUser removes the rows of DeleteUserCascade under mu. An account on
+// legal hold is never deleted: sql.ErrNoRows.
+func (s *MemoryStore) deleteUser(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok || u.LegalHold {
+		return sql.ErrNoRows
+	}
+	delete(s.users, id)
+
+	devices := s.devices[:0]
+	for _, d := range s.devices {
+		if d.UserID != id {
+			devices = append(devices, d)
+		}
+	}
+	s.devices = devices
+	for key := range s.syncStates {
+		if key.userID == id {
+			delete(s.syncStates, key)
+		}
+	}
+	for _, rows := range s.items {
+		for key := range rows {
+			if key.userID == id {
+				delete(rows, key)
+			}
+		}
+	}
+	for key := range s.pushSequences {
+		if key.userID == id {
+			delete(s.pushSequences, key)
+		}
+	}
+	wipes := s.wipes[:0]
+	for _, w := range s.wipes {
+		if w.UserID != id {
+			wipes = append(wipes, w)
+		}
+	}
+	s.wipes = wipes
+	conflicts := s.conflicts[:0]
+	for _, c := range s.conflicts {
+		if c.UserID != id {
+			conflicts = append(conflicts, c)
+		}
+	}
+	s.conflicts = conflicts
+	monitors := s.monitors[:0]
+	for _, m := range s.monitors {
+		if m.UserID != id {
+			monitors = append(monitors, m)
+		}
+	}
+	s.monitors = monitors
+	alerts := s.alerts[:0]
+	for _, a := range s.alerts {
+		if a.UserID != id {
+			alerts = append(alerts, a)
+		}
+	}
+	s.alerts = alerts
+	for token, rt := range s.refreshTokens {
+		if rt.UserID == id {
+			delete(s.refreshTokens, token)
+		}
+	}
+	for hash, rt := range s.resetTokens {
+		if rt.userID == id {
+			delete(s.resetTokens, hash)
+		}
+	}
+	events := s.auditEvents[:0]
+	for _, e := range s.auditEvents {
+		if e.UserID != id {
+			events = append(events, e)
+		}
+	}
+	s.auditEvents = events
+	return nil
+}
+
+// GetAuthProfile loads the columns the auth middleware checks on every request
+func (s *MemoryStore) GetAuthProfile(id string) (*auth.Profile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.userRow(id)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.Profile{
+		UserID:       u.ID,
+		Email:        u.Email,
+		Tier:         u.SubscriptionTier,
+		TokenVersion: u.TokenVersion,
+		Active:       u.IsActive,
+		LegalHold:    u.LegalHold,
+	}, nil
+}
+
+// OnUserChanged registers fn to run after a user's active flag, tier, token
+// version, legal hold or password changes, or the user is deleted
+func (s *MemoryStore) OnUserChanged(fn func(userID string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.userChanged = append(s.userChanged, fn)
+}
+
+// notifyUserChanged runs the change hooks; call it without holding mu
+func (s *MemoryStore) notifyUserChanged(userID string) {
+	s.mu.Lock()
+	hooks := s.userChanged
+	s.mu.Unlock()
+
+	for _, fn := range hooks {
+		fn(userID)
+	}
+}
+
+// modifyUser applies fn to a user's row and stamps it, like an UPDATE
+// with the updated_at trigger. sql.ErrNoRows if there is no such user.
+func (s *MemoryStore) modifyUser(userID string, fn func(u *memoryUser)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.userRow(userID)
+	if err != nil {
+		return err
+	}
+	fn(u)
+	u.UpdatedAt = memoryNow()
+	return nil
+}
+
+// updateUser is modifyUser followed by the change hooks
+func (s *MemoryStore) updateUser(userID string, fn func(u *memoryUser)) error {
+	if err := s.modifyUser(userID, fn); err != nil {
+		return err
+	}
+	s.notifyUserChanged(userID)
+	return nil
+}
+
+func (s *MemoryStore) SetUserActive(userID string, active bool) error {
+	return s.updateUser(userID, func(u *memoryUser) { u.IsActive = active })
+}
+
+func (s *MemoryStore) SetSubscriptionTier(userID, tier string) error {
+	return s.updateUser(userID, func(u *memoryUser) { u.SubscriptionTier = tier })
+}
+
+func (s *MemoryStore) SetUserAdmin(userID string, admin bool) error {
+	return s.updateUser(userID, func(u *memoryUser) { u.IsAdmin = admin })
+}
+
+func (s *MemoryStore) SetLegalHold(userID string, hold bool) error {
+	return s.updateUser(userID, func(u *memoryUser) { u.LegalHold = hold })
+}
+
+// BumpTokenVersion invalidates every access token issued to the user so far
+func (s *MemoryStore) BumpTokenVersion(userID string) error {
+	return s.updateUser(userID, func(u *memoryUser) { u.TokenVersion++ })
+}
+
+// Devices
+
+// approvalTrustLevel is the trust level a new device of u starts at
+func approvalTrustLevel(u *memoryUser) int {
+	if u.settings.DeviceApproval == peer.DeviceApprovalOff {
+		return int(peer.TrustLevelTrusted)
+	}
+	return int(peer.TrustLevelPending)
+}
+
+// device returns the row of a device of any user, or nil
+func (s *MemoryStore) device(deviceID string) *memoryDevice {
+	for _, d := range s.devices {
+		if d.ID == deviceID {
+			return d
+		}
+	}
+	return nil
+}
+
+// userDevice returns one of the user's devices, or nil
+func (s *MemoryStore) userDevice(userID, deviceID string) *memoryDevice {
+	if d := s.device(deviceID); d != nil && d.UserID == userID {
+		return d
+	}
+	return nil
+}
+
+func (d *memoryDevice) copy() *Device {
+	device := d.Device
+	device.LastSync = copyTime(d.LastSync)
+	return &device
+}
+
+// insertDevice registers a device; sql.ErrNoRows for an unknown user, as
+// the SQL stores' INSERT ... SELECT FROM users finds no row
+func (s *MemoryStore) insertDevice(userID, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte, fingerprint *string) (*memoryDevice, error) {
+	u, err := s.userRow(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(capabilities) == 0 {
+		capabilities = []byte("{}")
+	}
+
+	d := &memoryDevice{
+		Device: Device{
+			ID:            uuid.New().String(),
+			UserID:        userID,
+			DeviceName:    deviceName,
+			DeviceType:    deviceType,
+			PublicKey:     publicKey,
+			CreatedAt:     memoryNow(),
+			IsActive:      true,
+			MaxEncVersion: maxEncVersion,
+			TrustLevel:    approvalTrustLevel(u),
+			Capabilities:  capabilities,
+		},
+		fingerprint: fingerprint,
+	}
+	s.devices = append(s.devices, d)
+	return d, nil
+}
+
+func (s *MemoryStore) CreateDevice(userID, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte) (*Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, err := s.insertDevice(userID, deviceName, deviceType, publicKey, maxEncVersion, capabilities, nil)
+	if err != nil {
+		return nil, err
+	}
+	return d.copy(), nil
+}
+
+// UpsertDevice updates the user's active device with this fingerprint, or
+// registers one. A nil public key or zero version keeps the stored one, and
+// nil capabilities keep the stored ones. A changed public key resets the
+// device's trust as for a new device.
+func (s *MemoryStore) UpsertDevice(userID, fingerprint, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte) (*Device, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.userRow(userID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, d := range s.devices {
+		if d.UserID != userID || !d.IsActive || d.fingerprint == nil || *d.fingerprint != fingerprint {
+			continue
+		}
+		d.DeviceName = deviceName
+		d.DeviceType = deviceType
+		if publicKey != nil {
+			if d.PublicKey != nil && string(d.PublicKey) != string(publicKey) {
+				d.TrustLevel = approvalTrustLevel(u)
+			}
+			d.PublicKey = publicKey
+		}
+		if maxEncVersion != 0 {
+			d.MaxEncVersion = maxEncVersion
+		}
+		if capabilities != nil {
+			d.Capabilities = capabilities
+			if len(capabilities) == 0 {
+				d.Capabilities = []byte("{}")
+			}
+		}
+		return d.copy(), false, nil
+	}
+
+	d, err := s.insertDevice(userID, deviceName, deviceType, publicKey, maxEncVersion, capabilities, &fingerprint)
+	if err != nil {
+		return nil, false, err
+	}
+	return d.copy(), true, nil
+}
+
+// GetDevicesByUserID returns the user's active devices, newest first
+func (s *MemoryStore) GetDevicesByUserID(userID string) ([]*Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var devices []*Device
+	for i := len(s.devices) - 1; i >= 0; i-- {
+		if d := s.devices[i]; d.UserID == userID && d.IsActive {
+			devices = append(devices, d.copy())
+		}
+	}
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].CreatedAt.After(devices[j].CreatedAt)
+	})
+	return devices, nil
+}
+
+// GetDevice returns one of the user's devices, active or not
+func (s *MemoryStore) GetDevice(_ context.Context, userID, deviceID string) (*Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.userDevice(userID, deviceID)
+	if d == nil {
+		return nil, sql.ErrNoRows
+	}
+	return d.copy(), nil
+}
+
+func (s *MemoryStore) SetDeviceMaxEncVersion(userID, deviceID string, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d := s.userDevice(userID, deviceID); d != nil {
+		d.MaxEncVersion = version
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetDeviceCapabilities(userID, deviceID string, capabilities []byte, maxEncVersion int) error {
+	return s.updateActiveDevice(userID, deviceID, func(d *memoryDevice) bool {
+		d.Capabilities = capabilities
+		if maxEncVersion != 0 {
+			d.MaxEncVersion = maxEncVersion
+		}
+		return true
+	})
+}
+
+// updateActiveDevice applies fn to one of the user's active devices; fn
+// reports whether the row matched. sql.ErrNoRows if none did.
+func (s *MemoryStore) updateActiveDevice(userID, deviceID string, fn func(d *memoryDevice) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d := s.userDevice(userID, deviceID)
+	if d == nil || !d.IsActive || !fn(d) {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetDeviceEncVersions(_ context.Context, userID string) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var versions []int
+	for _, d := range s.devices {
+		if d.UserID == userID && d.IsActive {
+			versions = append(versions, d.MaxEncVersion)
+		}
+	}
+	return versions, nil
+}
+
+// UpdateDeviceLastSync records that the device just synced, which also
+// withdraws any pending inactivity warning
+func (s *MemoryStore) UpdateDeviceLastSync(_ context.Context, deviceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d := s.device(deviceID); d != nil {
+		now := memoryNow()
+		d.LastSync = &now
+		d.warnedAt = nil
+	}
+	return nil
+}
+
+// Sync state
+
+// syncState is the SyncState of a row, with the last writer's name if the
+// device is still registered
+func (s *MemoryStore) syncState(key memoryZoneKey, row *memorySyncState) *SyncState {
+	state := &SyncState{
+		UserID:             key.userID,
+		Zone:               key.zone,
+		GenCount:           row.genCount,
+		Digest:             row.digest,
+		UpdatedAt:          row.updatedAt,
+		LastWriterDeviceID: copyString(row.lastWriter),
+	}
+	if row.lastWriter != nil {
+		if d := s.device(*row.lastWriter); d != nil {
+			name := d.DeviceName
+			state.LastWriterDeviceName = &name
+		}
+	}
+	return state
+}
+
+// listSyncStates returns the user's sync states ordered by zone
+func (s *MemoryStore) listSyncStates(userID string) []*SyncState {
+	states := []*SyncState{}
+	for key, row := range s.syncStates {
+		if key.userID == userID {
+			states = append(states, s.syncState(key, row))
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Zone < states[j].Zone })
+	return states
+}
+
+// syncStateRow returns the zone's sync state row, creating it (gencount 0,
+// no digest) if the user has none
+func (s *MemoryStore) syncStateRow(userID, zone string) (*memorySyncState, error) {
+	key := memoryZoneKey{userID, zone}
+	row, ok := s.syncStates[key]
+	if ok {
+		return row, nil
+	}
+	if err := s.checkUser("sync_state", userID); err != nil {
+		return nil, err
+	}
+	row = &memorySyncState{}
+	s.syncStates[key] = row
+	return row, nil
+}
+
+func (s *MemoryStore) GetSyncState(userID, zone string) (*SyncState, error) {
+	return s.GetSyncStateContext(context.Background(), userID, zone)
+}
+
+// GetSyncStateContext returns a zone's sync state, or gencount 0 for a zone
+// that was never written
+func (s *MemoryStore) GetSyncStateContext(ctx context.Context, userID, zone string) (*SyncState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := memoryZoneKey{userID, zone}
+	row, ok := s.syncStates[key]
+	if !ok {
+		return &SyncState{UserID: userID, Zone: zone}, nil
+	}
+	return s.syncState(key, row), nil
+}
+
+func (s *MemoryStore) ListSyncStates(userID string) ([]*SyncState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listSyncStates(userID), nil
+}
+
+// UpsertSyncState writes the gencount and digest only; the last writer is
+// left as it was, since repairs are not pushes
+func (s *MemoryStore) UpsertSyncState(userID, zone string, genCount int64, digest []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row, err := s.syncStateRow(userID, zone)
+	if err != nil {
+		return err
+	}
+	row.genCount = genCount
+	row.digest = digest
+	row.updatedAt = memoryNow()
+	return nil
+}
+
+// LoadEngineState implements sync.EngineStore on top of the sync state
+func (s *MemoryStore) LoadEngineState(userID, zone string) (*syncdomain.EngineState, error) {
+	state, err := s.GetSyncState(userID, zone)
+	if err != nil {
+		return nil, err
+	}
+	engineState := &syncdomain.EngineState{GenCount: state.GenCount, Digest: state.Digest}
+	if state.LastWriterDeviceID != nil {
+		engineState.LastWriter = *state.LastWriterDeviceID
+	}
+	return engineState, nil
+}
+
+// SaveEngineState implements sync.EngineStore on top of the sync state,
+// never moving the gencount backwards like PostgresStore.SaveEngineState
+func (s *MemoryStore) SaveEngineState(userID, zone string, state *syncdomain.EngineState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row, err := s.syncStateRow(userID, zone)
+	if err != nil {
+		return err
+	}
+	row.genCount = max(row.genCount, state.GenCount)
+	row.digest = state.Digest
+	row.lastWriter = nil
+	if state.LastWriter != "" {
+		lastWriter := state.LastWriter
+		row.lastWriter = &lastWriter
+	}
+	row.updatedAt = memoryNow()
+	return nil
+}
+
+// Refresh tokens
+
+func (s *MemoryStore) CreateRefreshToken(userID string, deviceID *string, expiresAt time.Time) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkUser("refresh_tokens", userID); err != nil {
+		return nil, err
+	}
+	if deviceID != nil && s.device(*deviceID) == nil {
+		return nil, &MemoryConstraintError{Constraint: "FOREIGN KEY", Column: "refresh_tokens.device_id"}
+	}
+
+	token := &RefreshToken{
+		Token:     uuid.New().String(),
+		UserID:    userID,
+		DeviceID:  copyString(deviceID),
+		ExpiresAt: expiresAt,
+		CreatedAt: memoryNow(),
+	}
+	stored := *token
+	s.refreshTokens[token.Token] = &stored
+	return token, nil
+}
+
+// GetRefreshToken returns sql.ErrNoRows for an unknown token
+func (s *MemoryStore) GetRefreshToken(token string) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt, ok := s.refreshTokens[token]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	found := *rt
+	found.DeviceID = copyString(rt.DeviceID)
+	return &found, nil
+}
+
+func (s *MemoryStore) RevokeRefreshToken(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rt, ok := s.refreshTokens[token]; ok {
+		rt.Revoked = true
+	}
+	return nil
+}
+
+// RevokeRefreshTokensByUser revokes every refresh token of a user, returning
+// how many were still valid
+func (s *MemoryStore) RevokeRefreshTokensByUser(userID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revokeRefreshTokens(userID, nil), nil
+}
+
+// revokeRefreshTokens revokes the user's valid refresh tokens, only those of
+// the given devices unless deviceIDs is nil, and returns how many
+func (s *MemoryStore) revokeRefreshTokens(userID string, deviceIDs []string) int64 {
+	var revoked int64
+	for _, rt := range s.refreshTokens {
+		if rt.UserID != userID || rt.Revoked {
+			continue
+		}
+		if deviceIDs != nil && (rt.DeviceID == nil || !containsString(deviceIDs, *rt.DeviceID)) {
+			continue
+		}
+		rt.Revoked = true
+		revoked++
+	}
+	return revoked
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Search
+
+// SearchCredentialMetadata returns live credentials whose server, account, or
+// label contains query (case-insensitive), ordered by server then account
+func (s *MemoryStore) SearchCredentialMetadata(userID, zone, query string) ([]*models.CredentialMetadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	needle := strings.ToLower(query)
+	matches := func(field string) bool {
+		return strings.Contains(strings.ToLower(field), needle)
+	}
+
+	var creds []*models.CredentialMetadata
+	for key, item := range s.items["credential_metadata"] {
+		if key.userID != userID || key.zone != zone || item.cred.Tombstone {
+			continue
+		}
+		cred := item.cred
+		if matches(cred.Server) || matches(cred.Account) || (cred.Label != nil && matches(*cred.Label)) {
+			creds = append(creds, item.clone().cred)
+		}
+	}
+	sort.Slice(creds, func(i, j int) bool {
+		a, b := strings.ToLower(creds[i].Server), strings.ToLower(creds[j].Server)
+		if a != b {
+			return a < b
+		}
+		return strings.ToLower(creds[i].Account) < strings.ToLower(creds[j].Account)
+	})
+	return creds, nil
+}
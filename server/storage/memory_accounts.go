@@ -0,0 +1,629 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	"github.com/google/uuid"
+)
+
+// The in-memory account settings, lockout, passwords, inactivity and
+// device management
+
+func (s *MemoryStore) GetUserSettings(_ context.Context, userID string) (*UserSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.userRow(userID)
+	if err != nil {
+		return nil, err
+	}
+	settings := u.settings
+	return &settings, nil
+}
+
+// UpdateUserSettings writes every setting; callers validate them first
+func (s *MemoryStore) UpdateUserSettings(_ context.Context, userID string, settings *UserSettings) error {
+	return s.modifyUser(userID, func(u *memoryUser) { u.settings = *settings })
+}
+
+// Login lockout
+
+func (s *MemoryStore) IncrementFailedLogin(userID string, threshold int, lockUntil time.Time) (*time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.userRow(userID)
+	if err != nil {
+		return nil, err
+	}
+	if u.failedLogins+1 >= threshold {
+		lockedUntil := lockUntil.UTC()
+		u.lockedUntil = &lockedUntil
+		u.failedLogins = 0
+	} else {
+		u.failedLogins++
+	}
+	u.UpdatedAt = memoryNow()
+	return copyTime(u.lockedUntil), nil
+}
+
+func (s *MemoryStore) ResetFailedLogin(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok && (u.failedLogins != 0 || u.lockedUntil != nil) {
+		u.failedLogins, u.lockedUntil = 0, nil
+		u.UpdatedAt = memoryNow()
+	}
+	return nil
+}
+
+func (s *MemoryStore) IsLocked(userID string, at time.Time) (bool, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.userRow(userID)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if u.lockedUntil == nil || !u.lockedUntil.After(at) {
+		return false, time.Time{}, nil
+	}
+	return true, *u.lockedUntil, nil
+}
+
+// Passwords and resets
+
+// clearHashUpgrade ends any hash upgrade campaign for the user
+func (u *memoryUser) clearHashUpgrade() {
+	u.hashUpgradeDeadline, u.hashUpgradeNotifiedAt, u.hashUpgradeEnforcedAt = nil, nil, nil
+}
+
+func (s *MemoryStore) UpdateUserPassword(userID string, hash, salt []byte, version int) (int64, error) {
+	s.mu.Lock()
+	u, err := s.userRow(userID)
+	if err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+	u.PasswordHash, u.Salt, u.HashVersion = hash, salt, version
+	u.clearHashUpgrade()
+	u.failedLogins, u.lockedUntil = 0, nil
+	u.TokenVersion++
+	u.UpdatedAt = memoryNow()
+	revoked := s.revokeRefreshTokens(userID, nil)
+	s.mu.Unlock()
+
+	s.notifyUserChanged(userID)
+	return revoked, nil
+}
+
+func (s *MemoryStore) UpgradePasswordHash(userID string, hash []byte, version int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok && u.HashVersion < version {
+		u.PasswordHash, u.HashVersion = hash, version
+		u.clearHashUpgrade()
+		u.UpdatedAt = memoryNow()
+	}
+	return nil
+}
+
+func (s *MemoryStore) PasswordHashStats() (*PasswordHashStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := &PasswordHashStats{Versions: map[int]int64{}}
+	for _, u := range s.users {
+		stats.Versions[u.HashVersion]++
+		if u.hashUpgradeDeadline != nil {
+			stats.Flagged++
+		}
+		if u.hashUpgradeNotifiedAt != nil {
+			stats.Notified++
+		}
+		if u.hashUpgradeEnforcedAt != nil {
+			stats.Enforced++
+		}
+	}
+	return stats, nil
+}
+
+// ListDeprecatedHashAccounts returns up to limit active accounts whose hash
+// is older than auth.CurrentHashVersion, soonest deadline first, then least
+// recently active
+func (s *MemoryStore) ListDeprecatedHashAccounts(limit int) ([]*HashUpgradeAccount, error) {
+	return s.findHashUpgradeAccounts(func(u *memoryUser) bool { return u.IsActive }, "", limit)
+}
+
+func (s *MemoryStore) FindHashUpgradeAccounts(userID string) ([]*HashUpgradeAccount, error) {
+	return s.findHashUpgradeAccounts(func(u *memoryUser) bool { return u.hashUpgradeDeadline != nil }, userID, 0)
+}
+
+// findHashUpgradeAccounts returns the matching accounts; limit 0 is no limit
+func (s *MemoryStore) findHashUpgradeAccounts(match func(*memoryUser) bool, userID string, limit int) ([]*HashUpgradeAccount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var users []*memoryUser
+	for _, u := range s.usersInOrder() {
+		if u.HashVersion < auth.CurrentHashVersion && (userID == "" || u.ID == userID) && match(u) {
+			users = append(users, u)
+		}
+	}
+	// Deadlines NULLS LAST, then last activity NULLS FIRST
+	sort.SliceStable(users, func(i, j int) bool {
+		a, b := users[i], users[j]
+		if (a.hashUpgradeDeadline == nil) != (b.hashUpgradeDeadline == nil) {
+			return b.hashUpgradeDeadline == nil
+		}
+		if a.hashUpgradeDeadline != nil && !a.hashUpgradeDeadline.Equal(*b.hashUpgradeDeadline) {
+			return a.hashUpgradeDeadline.Before(*b.hashUpgradeDeadline)
+		}
+		if (a.lastActiveAt == nil) != (b.lastActiveAt == nil) {
+			return a.lastActiveAt == nil
+		}
+		return a.lastActiveAt != nil && a.lastActiveAt.Before(*b.lastActiveAt)
+	})
+	if limit > 0 && limit < len(users) {
+		users = users[:limit]
+	}
+
+	var accounts []*HashUpgradeAccount
+	for _, u := range users {
+		accounts = append(accounts, &HashUpgradeAccount{
+			UserID:      u.ID,
+			Email:       u.Email,
+			HashVersion: u.HashVersion,
+			LastActive:  copyTime(u.lastActiveAt),
+			Deadline:    copyTime(u.hashUpgradeDeadline),
+			NotifiedAt:  copyTime(u.hashUpgradeNotifiedAt),
+			EnforcedAt:  copyTime(u.hashUpgradeEnforcedAt),
+		})
+	}
+	return accounts, nil
+}
+
+func (s *MemoryStore) StartHashUpgradeCampaign(deadline time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var flagged int64
+	for _, u := range s.users {
+		if u.HashVersion < auth.CurrentHashVersion && u.IsActive && u.hashUpgradeDeadline == nil {
+			d := deadline.UTC()
+			u.hashUpgradeDeadline = &d
+			u.UpdatedAt = memoryNow()
+			flagged++
+		}
+	}
+	return flagged, nil
+}
+
+func (s *MemoryStore) MarkHashUpgradeNotified(userID string, at time.Time) error {
+	notifiedAt := at.UTC()
+	return s.updateUser(userID, func(u *memoryUser) { u.hashUpgradeNotifiedAt = &notifiedAt })
+}
+
+func (s *MemoryStore) EnforceHashUpgrade(userID string, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[userID]
+	if !ok || u.HashVersion >= auth.CurrentHashVersion || u.hashUpgradeDeadline == nil || u.hashUpgradeEnforcedAt != nil {
+		return false, nil
+	}
+	enforcedAt := at.UTC()
+	u.hashUpgradeEnforcedAt = &enforcedAt
+	u.UpdatedAt = memoryNow()
+	s.revokeRefreshTokens(userID, nil)
+	return true, nil
+}
+
+func (s *MemoryStore) CreatePasswordResetToken(userID string, tokenHash []byte, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkUser("password_reset_tokens", userID); err != nil {
+		return err
+	}
+	for hash, rt := range s.resetTokens {
+		if rt.userID == userID {
+			delete(s.resetTokens, hash)
+		}
+	}
+	s.resetTokens[string(tokenHash)] = &memoryResetToken{userID: userID, expiresAt: expiresAt.UTC()}
+	return nil
+}
+
+// ConsumePasswordResetToken returns sql.ErrNoRows unless the token is
+// unused and unexpired at the given time
+func (s *MemoryStore) ConsumePasswordResetToken(tokenHash []byte, at time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rt, ok := s.resetTokens[string(tokenHash)]
+	if !ok || rt.usedAt != nil || !rt.expiresAt.After(at) {
+		return "", sql.ErrNoRows
+	}
+	usedAt := at.UTC()
+	rt.usedAt = &usedAt
+	return rt.userID, nil
+}
+
+// Account inactivity
+
+// TouchUser records a login or refresh and returns the inactivity stage the
+// account was in before
+func (s *MemoryStore) TouchUser(userID string, at time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.userRow(userID)
+	if err != nil {
+		return "", err
+	}
+	previous := u.inactivityStage
+	lastActive := at.UTC()
+	u.lastActiveAt = &lastActive
+	u.inactivityStage, u.inactivityStageAt = InactivityActive, nil
+	u.UpdatedAt = memoryNow()
+	return previous, nil
+}
+
+// lastActive is the later of the user's last login and their devices' last
+// sync, either defaulting to when the account was created
+func (s *MemoryStore) lastActive(u *memoryUser) time.Time {
+	active := u.CreatedAt
+	if u.lastActiveAt != nil {
+		active = *u.lastActiveAt
+	}
+	synced := u.CreatedAt
+	var lastSync *time.Time
+	for _, d := range s.devices {
+		if d.UserID == u.ID && d.LastSync != nil && (lastSync == nil || d.LastSync.After(*lastSync)) {
+			lastSync = d.LastSync
+		}
+	}
+	if lastSync != nil {
+		synced = *lastSync
+	}
+	if synced.After(active) {
+		return synced
+	}
+	return active
+}
+
+// FindInactiveAccounts is PostgresStore.FindInactiveAccounts for the one
+// region, least recently active first
+func (s *MemoryStore) FindInactiveAccounts(idleBefore time.Time, userID string) ([]*InactiveAccount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var accounts []*InactiveAccount
+	for _, u := range s.usersInOrder() {
+		if userID != "" && u.ID != userID {
+			continue
+		}
+		tier := u.SubscriptionTier
+		if tier == "" {
+			tier = FreeTier
+		}
+		lastActive := s.lastActive(u)
+		idle := tier == FreeTier && !u.LegalHold && !lastActive.After(idleBefore)
+		if u.inactivityStage == InactivityActive && !idle {
+			continue
+		}
+		accounts = append(accounts, &InactiveAccount{
+			UserID:     u.ID,
+			Email:      u.Email,
+			Tier:       tier,
+			LegalHold:  u.LegalHold,
+			LastActive: lastActive,
+			Stage:      u.inactivityStage,
+			StageAt:    copyTime(u.inactivityStageAt),
+		})
+	}
+	sort.SliceStable(accounts, func(i, j int) bool { return accounts[i].LastActive.Before(accounts[j].LastActive) })
+	return accounts, nil
+}
+
+// SetInactivityStage moves the user between stages with the stage's effects,
+// like PostgresStore.SetInactivityStage
+func (s *MemoryStore) SetInactivityStage(userID, from, to string, at time.Time) (bool, error) {
+	s.mu.Lock()
+	u, ok := s.users[userID]
+	if !ok || u.inactivityStage != from {
+		s.mu.Unlock()
+		return false, nil
+	}
+
+	u.inactivityStage, u.inactivityStageAt = to, nil
+	if to != InactivityActive {
+		stageAt := at.UTC()
+		u.inactivityStageAt = &stageAt
+	}
+	if to == InactivityDormant || to == InactivityDeletionQueued {
+		s.revokeRefreshTokens(userID, nil)
+	}
+	switch {
+	case to == InactivityDeletionQueued:
+		u.IsActive = false
+		u.TokenVersion++
+	case from == InactivityDeletionQueued:
+		u.IsActive = true
+	}
+	u.UpdatedAt = memoryNow()
+	s.mu.Unlock()
+
+	s.notifyUserChanged(userID)
+	return true, nil
+}
+
+// Device management
+
+func (d *memoryDevice) stale() *StaleDevice {
+	device := &StaleDevice{Device: *d.copy(), LastActive: d.CreatedAt, WarnedAt: copyTime(d.warnedAt)}
+	if d.LastSync != nil {
+		device.LastActive = *d.LastSync
+	}
+	return device
+}
+
+func (s *MemoryStore) FindStaleDevices(userID string, olderThan time.Time, exceptDeviceID string) ([]*StaleDevice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var devices []*StaleDevice
+	for _, d := range s.devices {
+		if d.UserID != userID || !d.IsActive || d.ID == exceptDeviceID {
+			continue
+		}
+		if device := d.stale(); device.LastActive.Before(olderThan) {
+			devices = append(devices, device)
+		}
+	}
+	sort.SliceStable(devices, func(i, j int) bool { return devices[i].LastActive.Before(devices[j].LastActive) })
+	return devices, nil
+}
+
+func (s *MemoryStore) FindAutoDeactivationCandidates(now time.Time, warningDays int, userID string) ([]*StaleDevice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var devices []*StaleDevice
+	for _, d := range s.devices {
+		u := s.users[d.UserID]
+		days := u.settings.DeviceAutoDeactivateDays
+		if days == 0 || !u.IsActive || !d.IsActive || (userID != "" && d.UserID != userID) {
+			continue
+		}
+		device := d.stale()
+		if device.LastActive.Before(now.AddDate(0, 0, -(days - warningDays))) {
+			device.AutoDeactivateDays = days
+			devices = append(devices, device)
+		}
+	}
+	sort.SliceStable(devices, func(i, j int) bool {
+		if devices[i].UserID != devices[j].UserID {
+			return devices[i].UserID < devices[j].UserID
+		}
+		return devices[i].LastActive.Before(devices[j].LastActive)
+	})
+	return devices, nil
+}
+
+func (s *MemoryStore) MarkDevicesWarned(deviceIDs []string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.devices {
+		if containsString(deviceIDs, d.ID) {
+			warnedAt := at.UTC()
+			d.warnedAt = &warnedAt
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) RevokeDevices(userID string, deviceIDs []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var revoked []string
+	for _, d := range s.devices {
+		if d.UserID == userID && d.IsActive && containsString(deviceIDs, d.ID) {
+			d.IsActive = false
+			d.TrustLevel = int(peer.TrustLevelRevoked)
+			revoked = append(revoked, d.ID)
+		}
+	}
+	if len(revoked) == 0 {
+		return nil, nil
+	}
+	s.revokeRefreshTokens(userID, revoked)
+	return revoked, nil
+}
+
+func (s *MemoryStore) RevokeDevice(userID, deviceID string) error {
+	revoked, err := s.RevokeDevices(userID, []string{deviceID})
+	if err != nil {
+		return err
+	}
+	if len(revoked) == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetDeviceTrustLevel(userID, deviceID string, from, to int) error {
+	return s.updateActiveDevice(userID, deviceID, func(d *memoryDevice) bool {
+		if d.TrustLevel != from {
+			return false
+		}
+		d.TrustLevel = to
+		return true
+	})
+}
+
+func (s *MemoryStore) RenameDevice(userID, deviceID, name string) error {
+	return s.updateActiveDevice(userID, deviceID, func(d *memoryDevice) bool {
+		d.DeviceName = name
+		return true
+	})
+}
+
+// GetAccountUsage counts like PostgresStore.GetAccountUsage
+func (s *MemoryStore) GetAccountUsage(_ context.Context, userID string) (*AccountUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	usage := &AccountUsage{}
+	for key, item := range s.items["credential_metadata"] {
+		if key.userID == userID && !item.tombstone() {
+			usage.Credentials++
+		}
+	}
+	for _, d := range s.devices {
+		if d.UserID == userID && d.IsActive {
+			usage.Devices++
+		}
+	}
+	return usage, nil
+}
+
+func (s *MemoryStore) HasActiveDevice(userID, fingerprint string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.devices {
+		if d.UserID == userID && d.IsActive && d.fingerprint != nil && *d.fingerprint == fingerprint {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Breach monitoring
+
+func (s *MemoryStore) CreateBreachMonitor(_ context.Context, userID, email string, limit int) (*BreachMonitor, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkUser("breach_monitors", userID); err != nil {
+		return nil, false, err
+	}
+	count := 0
+	for _, m := range s.monitors {
+		if m.UserID != userID {
+			continue
+		}
+		if m.Email == email {
+			return copyBreachMonitor(m), false, nil
+		}
+		count++
+	}
+	if limit > 0 && count >= limit {
+		return nil, false, ErrTooManyMonitors
+	}
+
+	monitor := &BreachMonitor{ID: uuid.New().String(), UserID: userID, Email: email, Breaches: []string{}, CreatedAt: memoryNow()}
+	s.monitors = append(s.monitors, monitor)
+	return copyBreachMonitor(monitor), true, nil
+}
+
+func (s *MemoryStore) ListBreachMonitors(_ context.Context, userID string) ([]*BreachMonitor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var monitors []*BreachMonitor
+	for _, m := range s.monitors {
+		if m.UserID == userID {
+			monitors = append(monitors, copyBreachMonitor(m))
+		}
+	}
+	return monitors, nil
+}
+
+func (s *MemoryStore) DeleteBreachMonitor(_ context.Context, userID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, m := range s.monitors {
+		if m.ID == id && m.UserID == userID {
+			s.monitors = append(s.monitors[:i], s.monitors[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (s *MemoryStore) FindDueBreachMonitors(checkedBefore time.Time, userID string, limit int) ([]*BreachMonitor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var monitors []*BreachMonitor
+	for _, m := range s.monitors {
+		if (m.CheckedAt == nil || m.CheckedAt.Before(checkedBefore)) && (userID == "" || m.UserID == userID) {
+			monitors = append(monitors, copyBreachMonitor(m))
+		}
+	}
+	sortDueBreachMonitors(monitors)
+	if len(monitors) > limit {
+		monitors = monitors[:limit]
+	}
+	return monitors, nil
+}
+
+func (s *MemoryStore) RecordBreachCheck(_ context.Context, monitor *BreachMonitor, breaches []string, alerts []*BreachAlert, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stored *BreachMonitor
+	for _, m := range s.monitors {
+		if m.ID == monitor.ID && m.UserID == monitor.UserID {
+			stored = m
+		}
+	}
+	if stored == nil {
+		return sql.ErrNoRows
+	}
+	checkedAt := at.UTC()
+	stored.Breaches = append([]string{}, breaches...)
+	stored.CheckedAt = &checkedAt
+	for _, alert := range alerts {
+		alert.ID, alert.UserID, alert.CreatedAt = uuid.New().String(), monitor.UserID, memoryNow()
+		row := *alert
+		row.DataTypes = append([]string{}, alert.DataTypes...)
+		s.alerts = append(s.alerts, &row)
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListBreachAlerts(_ context.Context, userID string, limit int) ([]*BreachAlert, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var alerts []*BreachAlert
+	for i := len(s.alerts) - 1; i >= 0 && len(alerts) < limit; i-- {
+		if a := s.alerts[i]; a.UserID == userID {
+			alert := *a
+			alert.DataTypes = append([]string{}, a.DataTypes...)
+			alerts = append(alerts, &alert)
+		}
+	}
+	return alerts, nil
+}
+
+func copyBreachMonitor(m *BreachMonitor) *BreachMonitor {
+	c := *m
+	c.Breaches = append([]string{}, m.Breaches...)
+	c.CheckedAt = copyTime(m.CheckedAt)
+	return &c
+}
@@ -0,0 +1,497 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The in-memory maintenance, diagnostics and audit log
+
+// purgeable is the purgeableTombstones predicate
+func (i *memoryItem) purgeable(olderThan time.Time) bool {
+	_, tombstone, updatedAt := i.columns()
+	return *tombstone && i.wipeID == "" && updatedAt.Before(olderThan)
+}
+
+// FindPurgeableTombstones summarizes, per user and zone, the tombstones older
+// than olderThan, sampling the lowest gencounts. An empty userID covers every
+// user. Read-only.
+func (s *MemoryStore) FindPurgeableTombstones(olderThan time.Time, userID string, sampleSize int) ([]*TombstoneSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purgeable := map[memoryZoneKey][]*memoryItem{}
+	for _, rows := range s.items {
+		for key, item := range rows {
+			if (userID == "" || key.userID == userID) && item.purgeable(olderThan) {
+				zoneKey := memoryZoneKey{key.userID, key.zone}
+				purgeable[zoneKey] = append(purgeable[zoneKey], item)
+			}
+		}
+	}
+
+	var summaries []*TombstoneSummary
+	for key, items := range purgeable {
+		sortItems(items)
+		summary := &TombstoneSummary{
+			UserID:    key.userID,
+			Zone:      key.zone,
+			Count:     int64(len(items)),
+			LegalHold: s.users[key.userID].LegalHold,
+		}
+		for _, item := range items {
+			if len(summary.SampleItemUUIDs) == sampleSize {
+				break
+			}
+			summary.SampleItemUUIDs = append(summary.SampleItemUUIDs, item.itemUUID.String())
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].UserID != summaries[j].UserID {
+			return summaries[i].UserID < summaries[j].UserID
+		}
+		return summaries[i].Zone < summaries[j].Zone
+	})
+	return summaries, nil
+}
+
+// PurgeTombstones hard-deletes a user/zone's tombstones older than olderThan
+// like PostgresStore.PurgeTombstones
+func (s *MemoryStore) PurgeTombstones(userID, zone string, olderThan time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[userID]; ok && u.LegalHold {
+		return 0, nil
+	}
+
+	var total int64
+	for _, table := range wipeTables {
+		for _, item := range s.zoneItems(table, userID, zone) {
+			if item.purgeable(olderThan) {
+				delete(s.items[table], item.memoryItemKey)
+				total++
+			}
+		}
+	}
+
+	if state, ok := s.syncStates[memoryZoneKey{userID, zone}]; ok && total > 0 {
+		state.digest = s.manifest(userID, zone).Digest
+	}
+	return total, nil
+}
+
+// orphanedKeys returns the keys of one zone matching the orphanedKey
+// predicate, in numbering order
+func (s *MemoryStore) orphanedKeys(userID, zone string, olderThan time.Time) []*memoryItem {
+	referenced := map[uuid.UUID]bool{}
+	for _, table := range []string{"credential_metadata", "sync_records"} {
+		for _, item := range s.zoneItems(table, userID, zone) {
+			if item.tombstone() && item.wipeID == "" {
+				continue
+			}
+			switch {
+			case item.cred != nil:
+				referenced[item.cred.PasswordKeyUUID] = true
+				if item.cred.MetadataKeyUUID != nil {
+					referenced[*item.cred.MetadataKeyUUID] = true
+				}
+			case item.record.ParentKeyUUID != nil:
+				referenced[*item.record.ParentKeyUUID] = true
+			}
+		}
+	}
+
+	var keys []*memoryItem
+	for _, key := range s.zoneItems("crypto_keys", userID, zone) {
+		if !key.tombstone() && key.key.UpdatedAt.Before(olderThan) && !referenced[key.itemUUID] {
+			keys = append(keys, key)
+		}
+	}
+	sortItems(keys)
+	return keys
+}
+
+// FindOrphanedKeys lists, per user and zone, the keys nothing refers to
+// like PostgresStore.FindOrphanedKeys
+func (s *MemoryStore) FindOrphanedKeys(ctx context.Context, olderThan time.Time, userID string) ([]*OrphanedKeys, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zones := map[memoryZoneKey]bool{}
+	for key := range s.items["crypto_keys"] {
+		if userID == "" || key.userID == userID {
+			zones[memoryZoneKey{key.userID, key.zone}] = true
+		}
+	}
+
+	var found []*OrphanedKeys
+	for zone := range zones {
+		keys := s.orphanedKeys(zone.userID, zone.zone, olderThan)
+		if len(keys) == 0 {
+			continue
+		}
+		orphaned := &OrphanedKeys{UserID: zone.userID, Zone: zone.zone, LegalHold: s.users[zone.userID].LegalHold}
+		for _, key := range keys {
+			orphaned.ItemUUIDs = append(orphaned.ItemUUIDs, key.itemUUID.String())
+		}
+		found = append(found, orphaned)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].UserID != found[j].UserID {
+			return found[i].UserID < found[j].UserID
+		}
+		return found[i].Zone < found[j].Zone
+	})
+	return found, nil
+}
+
+// TombstoneOrphanedKeys tombstones a user/zone's orphaned keys like
+// PostgresStore.TombstoneOrphanedKeys
+func (s *MemoryStore) TombstoneOrphanedKeys(ctx context.Context, userID, zone string, olderThan time.Time) (*WipeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var items []*WipedItem
+	if u, ok := s.users[userID]; !ok || !u.LegalHold {
+		for _, key := range s.orphanedKeys(userID, zone, olderThan) {
+			items = append(items, &WipedItem{Table: "crypto_keys", ItemUUID: key.itemUUID})
+		}
+	}
+
+	genCounts, err := s.nextGenCounts(userID, zone, int64(len(items)))
+	if err != nil {
+		return nil, err
+	}
+	result := &WipeResult{GenCount: genCounts.Last, Items: items}
+	if len(items) > 0 {
+		s.renumberWipeItems(userID, zone, items, result.GenCount, true, "")
+		if err := s.saveWipeState(userID, zone, result.GenCount, ""); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (s *MemoryStore) ComputeManifest(ctx context.Context, userID, zone string) (*ManifestState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.manifest(userID, zone), nil
+}
+
+// SampleUserZones returns a random fraction of (user, zone) pairs that have
+// sync state, at most limit of them
+func (s *MemoryStore) SampleUserZones(fraction float64, limit int) ([]UserZone, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var pairs []UserZone
+	for key := range s.syncStates {
+		if len(pairs) == limit {
+			break
+		}
+		if rand.Float64() < fraction {
+			pairs = append(pairs, UserZone{UserID: key.userID, Zone: key.zone})
+		}
+	}
+	return pairs, nil
+}
+
+// Job reports
+
+func (s *MemoryStore) SaveJobReport(report *JobReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastReportID++
+	report.ID = s.lastReportID
+	saved := *report
+	s.jobReports = append(s.jobReports, &saved)
+	return nil
+}
+
+func (s *MemoryStore) GetJobReport(id int64) (*JobReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, report := range s.jobReports {
+		if report.ID == id {
+			r := *report
+			return &r, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *MemoryStore) ListJobReports(jobName string, limit int) ([]*JobReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var reports []*JobReport
+	for _, report := range s.jobReports {
+		if jobName == "" || report.JobName == jobName {
+			r := *report
+			reports = append(reports, &r)
+		}
+	}
+	sort.SliceStable(reports, func(i, j int) bool { return reports[i].StartedAt.After(reports[j].StartedAt) })
+	if limit < len(reports) {
+		reports = reports[:limit]
+	}
+	return reports, nil
+}
+
+// Diagnostics
+
+func (s *MemoryStore) CountLayerItems(ctx context.Context, userID, zone string) ([]LayerCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make([]LayerCount, 0, len(probeLayers))
+	for _, l := range probeLayers {
+		count := LayerCount{Layer: l.layer}
+		for _, item := range s.zoneItems(l.table, userID, zone) {
+			if item.tombstone() {
+				count.Tombstoned++
+			} else {
+				count.Live++
+			}
+		}
+		counts = append(counts, count)
+	}
+	return counts, nil
+}
+
+func (s *MemoryStore) FindReferenceViolations(ctx context.Context, userID, zone string, limit int) ([]ReferenceViolation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.referenceViolations(userID, zone, limit), nil
+}
+
+// referenceViolations runs the referenceChecks over the zone's live items
+func (s *MemoryStore) referenceViolations(userID, zone string, limit int) []ReferenceViolation {
+	violations := []ReferenceViolation{}
+	check := func(layer string, item *memoryItem, field string, keyID uuid.UUID) {
+		key, ok := s.items["crypto_keys"][memoryItemKey{userID, zone, keyID}]
+		if ok && !key.tombstone() {
+			return
+		}
+		v := ReferenceViolation{
+			Layer:     layer,
+			ItemUUID:  item.itemUUID.String(),
+			Field:     field,
+			KeyUUID:   keyID.String(),
+			Violation: ReferenceMissing,
+		}
+		if ok {
+			v.Violation = ReferenceTombstoned
+		}
+		violations = append(violations, v)
+	}
+
+	for _, item := range s.zoneItems("credential_metadata", userID, zone) {
+		if item.tombstone() {
+			continue
+		}
+		check("credential_metadata", item, "password_key_uuid", item.cred.PasswordKeyUUID)
+		if item.cred.MetadataKeyUUID != nil {
+			check("credential_metadata", item, "metadata_key_uuid", *item.cred.MetadataKeyUUID)
+		}
+	}
+	for _, item := range s.zoneItems("sync_records", userID, zone) {
+		if !item.tombstone() && item.record.ParentKeyUUID != nil {
+			check("sync_record", item, "parent_key_uuid", *item.record.ParentKeyUUID)
+		}
+	}
+
+	sort.Slice(violations, func(i, j int) bool {
+		a, b := violations[i], violations[j]
+		if a.Layer != b.Layer {
+			return a.Layer < b.Layer
+		}
+		if a.ItemUUID != b.ItemUUID {
+			return a.ItemUUID < b.ItemUUID
+		}
+		return a.Field < b.Field
+	})
+	if limit < len(violations) {
+		violations = violations[:limit]
+	}
+	return violations
+}
+
+// ScanIntegrity runs the integrity checks of a user's zone under the mutex,
+// which makes them one snapshot; opts.Timeout is not needed
+func (s *MemoryStore) ScanIntegrity(ctx context.Context, userID, zone string, opts IntegrityScanOptions) (*IntegrityScan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scan := &IntegrityScan{
+		Computed:   s.manifest(userID, zone),
+		Violations: s.referenceViolations(userID, zone, opts.Limit+1),
+	}
+	if state, ok := s.syncStates[memoryZoneKey{userID, zone}]; ok {
+		scan.GenCount, scan.StoredDigest = state.genCount, state.digest
+	}
+
+	var orphaned []string
+	for _, key := range s.zoneItems("crypto_keys", userID, zone) {
+		if !key.tombstone() && !s.keyReferenced(userID, zone, key.itemUUID, uuid.Nil) {
+			orphaned = append(orphaned, key.itemUUID.String())
+		}
+	}
+	scan.OrphanedKeys = memorySample(orphaned, opts.Limit)
+
+	if opts.MinEncVersion > 0 {
+		var unsupported []string
+		for _, record := range s.zoneItems("sync_records", userID, zone) {
+			if !record.tombstone() && record.record.EncVersion > opts.MinEncVersion {
+				unsupported = append(unsupported, record.itemUUID.String())
+			}
+		}
+		scan.Unsupported = memorySample(unsupported, opts.Limit)
+	}
+	return scan, nil
+}
+
+// memorySample is sampleItems over item UUIDs: the first limit of them in
+// order, with the total known only when any were returned
+func memorySample(itemUUIDs []string, limit int) ItemSample {
+	sort.Strings(itemUUIDs)
+	sample := ItemSample{ItemUUIDs: []string{}}
+	if limit < len(itemUUIDs) {
+		sample.ItemUUIDs = append(sample.ItemUUIDs, itemUUIDs[:limit]...)
+	} else {
+		sample.ItemUUIDs = append(sample.ItemUUIDs, itemUUIDs...)
+	}
+	if len(sample.ItemUUIDs) > 0 {
+		sample.Total = int64(len(itemUUIDs))
+	}
+	return sample
+}
+
+// Audit log
+
+func (s *MemoryStore) RecordAuditEvent(event *AuditEvent) error {
+	return s.RecordAuditEvents([]*AuditEvent{event})
+}
+
+// RecordAuditEvents inserts a batch of audit events, or none if any belongs
+// to an unknown user
+func (s *MemoryStore) RecordAuditEvents(events []*AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, event := range events {
+		if err := s.checkUser("audit_events", event.UserID); err != nil {
+			return err
+		}
+	}
+	now := memoryNow()
+	for _, event := range events {
+		s.lastAuditID++
+		event.ID, event.CreatedAt = s.lastAuditID, now
+		saved := *event
+		s.auditEvents = append(s.auditEvents, &saved)
+	}
+	return nil
+}
+
+// auditPage returns the events the filter selects, ignoring its Limit
+func (s *MemoryStore) auditPage(filter AuditEventFilter) []*AuditEvent {
+	var events []*AuditEvent
+	for _, event := range s.auditEvents {
+		if event.UserID != filter.UserID || event.ID <= filter.AfterID {
+			continue
+		}
+		if event.CreatedAt.Before(filter.From) || !event.CreatedAt.Before(filter.To) {
+			continue
+		}
+		if event.ItemUUID != nil && !filter.IncludeItems {
+			continue
+		}
+		e := *event
+		events = append(events, &e)
+	}
+	return events
+}
+
+// NextAuditCursor reports whether the filter matches more than Limit rows and,
+// if so, returns the ID of the last row in the page to resume after
+func (s *MemoryStore) NextAuditCursor(filter AuditEventFilter) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := s.auditPage(filter)
+	if filter.Limit < 1 || len(events) <= filter.Limit {
+		return 0, false, nil
+	}
+	return events[filter.Limit-1].ID, true, nil
+}
+
+// StreamAuditEvents calls fn with each event of the page in ID order, after
+// releasing the mutex
+func (s *MemoryStore) StreamAuditEvents(filter AuditEventFilter, fn func(*AuditEvent) error) error {
+	s.mu.Lock()
+	events := s.auditPage(filter)
+	s.mu.Unlock()
+
+	if filter.Limit < len(events) {
+		events = events[:filter.Limit]
+	}
+	for _, event := range events {
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListRecentAuditEvents(ctx context.Context, userID string, limit int) ([]*AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []*AuditEvent
+	for i := len(s.auditEvents) - 1; i >= 0 && len(events) < limit; i-- {
+		if event := s.auditEvents[i]; event.UserID == userID {
+			e := *event
+			e.Details = nil
+			events = append(events, &e)
+		}
+	}
+	return events, nil
+}
+
+func (s *MemoryStore) ListZoneActivity(ctx context.Context, filter ZoneActivityFilter) ([]*AuditEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []*AuditEvent
+	for i := len(s.auditEvents) - 1; i >= 0 && len(events) < filter.Limit; i-- {
+		if event := s.auditEvents[i]; filter.Includes(event) {
+			e := *event
+			e.IPAddress, e.Details = "", nil
+			events = append(events, &e)
+		}
+	}
+	return events, nil
+}
+
+func (s *MemoryStore) AuditEventTimes(ctx context.Context, userID, action string, since time.Time) ([]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var times []time.Time
+	for _, event := range s.auditEvents {
+		if event.UserID == userID && event.Action == action && event.CreatedAt.After(since) {
+			times = append(times, event.CreatedAt)
+		}
+	}
+	return times, nil
+}
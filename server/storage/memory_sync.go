@@ -0,0 +1,1065 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	syncdomain "github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/google/uuid"
+)
+
+// The in-memory zones, pulls, pushes, deletes and wipes
+
+type memoryItemKey struct {
+	userID   string
+	zone     string
+	itemUUID uuid.UUID
+}
+
+// memoryItem is a row of one of the item tables; exactly one of key, cred
+// and record is set
+type memoryItem struct {
+	memoryItemKey
+	key    *models.CryptoKey
+	cred   *models.CredentialMetadata
+	record *models.SyncRecord
+	wipeID string // The pending bulk wipe that trashed it; "" for none
+}
+
+// columns returns the columns all three item tables have
+func (i *memoryItem) columns() (genCount *int64, tombstone *bool, updatedAt *time.Time) {
+	switch {
+	case i.key != nil:
+		return &i.key.GenCount, &i.key.Tombstone, &i.key.UpdatedAt
+	case i.cred != nil:
+		return &i.cred.GenCount, &i.cred.Tombstone, &i.cred.UpdatedAt
+	}
+	return &i.record.GenCount, &i.record.Tombstone, &i.record.UpdatedAt
+}
+
+func (i *memoryItem) genCount() int64 {
+	genCount, _, _ := i.columns()
+	return *genCount
+}
+
+func (i *memoryItem) tombstone() bool {
+	_, tombstone, _ := i.columns()
+	return *tombstone
+}
+
+func (i *memoryItem) clone() *memoryItem {
+	c := *i
+	switch {
+	case i.key != nil:
+		key := *i.key
+		c.key = &key
+	case i.cred != nil:
+		cred := *i.cred
+		c.cred = &cred
+	default:
+		record := *i.record
+		c.record = &record
+	}
+	return &c
+}
+
+// sortItems orders items by gencount then item UUID, as pulls are
+func sortItems(items []*memoryItem) {
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i].genCount(), items[j].genCount()
+		if a != b {
+			return a < b
+		}
+		return items[i].itemUUID.String() < items[j].itemUUID.String()
+	})
+}
+
+// zoneItems returns the rows of one of the user's zones in table, unordered
+func (s *MemoryStore) zoneItems(table, userID, zone string) []*memoryItem {
+	var items []*memoryItem
+	for key, item := range s.items[table] {
+		if key.userID == userID && key.zone == zone {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// pullItems is the SQL stores' pull over rows of one user: the range filter,
+// then the order and page
+func pullItems(rows []*memoryItem, r PullRange) []*memoryItem {
+	var items []*memoryItem
+	for _, item := range rows {
+		if item.zone == r.Zone && r.Includes(item.genCount(), item.tombstone()) && r.Selects(item.itemUUID) {
+			items = append(items, item)
+		}
+	}
+	sortItems(items)
+
+	if r.Offset >= len(items) {
+		return nil
+	}
+	items = items[r.Offset:]
+	if r.Limit > 0 && r.Limit < len(items) {
+		items = items[:r.Limit]
+	}
+	return items
+}
+
+func (s *MemoryStore) pull(table, userID string, r PullRange) []*memoryItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var items []*memoryItem
+	for _, item := range pullItems(s.zoneItems(table, userID, r.Zone), r) {
+		items = append(items, item.clone())
+	}
+	return items
+}
+
+func (s *MemoryStore) GetCryptoKeysPage(ctx context.Context, userID string, r PullRange) ([]*models.CryptoKey, error) {
+	var keys []*models.CryptoKey
+	for _, item := range s.pull("crypto_keys", userID, r) {
+		keys = append(keys, item.key)
+	}
+	return keys, nil
+}
+
+func (s *MemoryStore) GetCredentialMetadataByUserWithFilter(userID, zone string, sinceGenCount int64, includeTombstoned bool) ([]*models.CredentialMetadata, error) {
+	return s.GetCredentialMetadataPage(context.Background(), userID, PullRange{Zone: zone, Since: sinceGenCount, IncludeTombstoned: includeTombstoned})
+}
+
+func (s *MemoryStore) GetCredentialMetadataPage(ctx context.Context, userID string, r PullRange) ([]*models.CredentialMetadata, error) {
+	var creds []*models.CredentialMetadata
+	for _, item := range s.pull("credential_metadata", userID, r) {
+		creds = append(creds, item.cred)
+	}
+	return creds, nil
+}
+
+func (s *MemoryStore) GetSyncRecordsPage(ctx context.Context, userID string, r PullRange) ([]*models.SyncRecord, error) {
+	var records []*models.SyncRecord
+	for _, item := range s.pull("sync_records", userID, r) {
+		records = append(records, item.record)
+	}
+	return records, nil
+}
+
+// CountPullWindow counts the items of every layer in the range, ignoring
+// its offset and limit
+func (s *MemoryStore) CountPullWindow(ctx context.Context, userID string, r PullRange) (*PullCounts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := func(table string) int {
+		n := 0
+		for _, item := range s.zoneItems(table, userID, r.Zone) {
+			if r.Includes(item.genCount(), item.tombstone()) && r.Selects(item.itemUUID) {
+				n++
+			}
+		}
+		return n
+	}
+	return &PullCounts{
+		Keys:     count("crypto_keys"),
+		Metadata: count("credential_metadata"),
+		Records:  count("sync_records"),
+	}, nil
+}
+
+// ReadSnapshot copies the user's sync states and items and calls fn with a
+// reader over the copy, so pushes committed meanwhile are not visible
+func (s *MemoryStore) ReadSnapshot(ctx context.Context, userID string, fn func(SnapshotReader) error) error {
+	s.mu.Lock()
+	snapshot := &memorySnapshot{states: s.listSyncStates(userID), items: map[string][]*memoryItem{}}
+	for table, rows := range s.items {
+		for key, item := range rows {
+			if key.userID == userID {
+				snapshot.items[table] = append(snapshot.items[table], item.clone())
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	return fn(snapshot)
+}
+
+type memorySnapshot struct {
+	states []*SyncState
+	items  map[string][]*memoryItem // The user's rows by table
+}
+
+func (m *memorySnapshot) ListSyncStates(ctx context.Context) ([]*SyncState, error) {
+	return m.states, nil
+}
+
+func (m *memorySnapshot) StreamCryptoKeys(ctx context.Context, r PullRange, fn func(*models.CryptoKey) error) error {
+	for _, item := range pullItems(m.items["crypto_keys"], r) {
+		if err := fn(item.clone().key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memorySnapshot) StreamCredentialMetadata(ctx context.Context, r PullRange, fn func(*models.CredentialMetadata) error) error {
+	for _, item := range pullItems(m.items["credential_metadata"], r) {
+		if err := fn(item.clone().cred); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memorySnapshot) StreamSyncRecords(ctx context.Context, r PullRange, fn func(*models.SyncRecord) error) error {
+	for _, item := range pullItems(m.items["sync_records"], r) {
+		if err := fn(item.clone().record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) ProbeItems(ctx context.Context, probe ItemProbe) (ItemStates, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	states := ItemStates{}
+	for _, l := range probeLayers {
+		for _, id := range probe.ItemUUIDs {
+			if item, ok := s.items[l.table][memoryItemKey{probe.UserID, probe.Zone, id}]; ok {
+				states.Add(id, ItemState{Layer: l.layer, GenCount: item.genCount(), Tombstone: item.tombstone()})
+			}
+		}
+	}
+	return states, nil
+}
+
+// Zones
+
+func (s *MemoryStore) CreateZone(userID string, bootstrap *syncdomain.ZoneBootstrap) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insertZone(userID, bootstrap)
+}
+
+// CreateUserWithZone creates a user and bootstraps their first zone
+// atomically
+func (s *MemoryStore) CreateUserWithZone(email string, passwordHash, salt []byte, region string, bootstrap *syncdomain.ZoneBootstrap) (*User, error) {
+	if err := checkSingleRegion(region); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.insertUser(email, passwordHash, salt)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.insertZone(user.ID, bootstrap); err != nil {
+		delete(s.users, user.ID)
+		return nil, err
+	}
+	return user, nil
+}
+
+// insertZone writes a new zone's sync state and metadata key, or neither.
+// sync.ErrZoneExists if the user already has sync state for the zone.
+func (s *MemoryStore) insertZone(userID string, bootstrap *syncdomain.ZoneBootstrap) error {
+	manifest := bootstrap.Manifest
+	zoneKey := memoryZoneKey{userID, manifest.Zone}
+	if _, ok := s.syncStates[zoneKey]; ok {
+		return syncdomain.ErrZoneExists
+	}
+	if err := s.checkUser("sync_state", userID); err != nil {
+		return err
+	}
+
+	if key := bootstrap.MetadataKey; key != nil {
+		if err := s.putCryptoKey(userID, key); err != nil {
+			return err
+		}
+	}
+	s.syncStates[zoneKey] = &memorySyncState{
+		genCount:  manifest.GenCount,
+		digest:    manifest.Digest,
+		updatedAt: memoryNow(),
+	}
+	return nil
+}
+
+// GetZonesByUser returns a summary of every zone the user has written,
+// ordered by name
+func (s *MemoryStore) GetZonesByUser(ctx context.Context, userID string) ([]*ZoneSummary, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	live := func(table, zone string) int64 {
+		var n int64
+		for _, item := range s.zoneItems(table, userID, zone) {
+			if !item.tombstone() {
+				n++
+			}
+		}
+		return n
+	}
+
+	zones := []*ZoneSummary{}
+	for _, state := range s.listSyncStates(userID) {
+		zones = append(zones, &ZoneSummary{
+			SyncState: *state,
+			Keys:      live("crypto_keys", state.Zone),
+			Metadata:  live("credential_metadata", state.Zone),
+			Records:   live("sync_records", state.Zone),
+		})
+	}
+	return zones, nil
+}
+
+// Pushes
+
+func memoryNotNull(column string) error {
+	return &MemoryConstraintError{Constraint: "NOT NULL", Column: column}
+}
+
+// putCryptoKey upserts a key like insertCryptoKey: an existing row takes
+// the pushed data, flags, gencount and tombstone and leaves any bulk wipe
+func (s *MemoryStore) putCryptoKey(userID string, key *models.CryptoKey) error {
+	itemID, owner, err := parseItemIDs(key.ItemUUID.String(), userID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkUser("crypto_keys", userID); err != nil {
+		return err
+	}
+	if key.Data == nil {
+		return memoryNotNull("crypto_keys.data")
+	}
+	if key.Flags == nil {
+		return memoryNotNull("crypto_keys.usage_flags")
+	}
+
+	now := memoryNow()
+	rowKey := memoryItemKey{userID, key.Zone, itemID}
+	item, ok := s.items["crypto_keys"][rowKey]
+	if ok {
+		row := item.key
+		row.Data, row.Flags = key.Data, key.Flags
+		row.GenCount, row.Tombstone, row.UpdatedAt = key.GenCount, key.Tombstone, now
+		item.wipeID = ""
+	} else {
+		row := *key
+		row.ID, row.UserID, row.ItemUUID = uuid.New(), owner, itemID
+		row.CreatedAt, row.UpdatedAt = now, now
+		item = &memoryItem{memoryItemKey: rowKey, key: &row}
+		s.items["crypto_keys"][rowKey] = item
+	}
+	key.CreatedAt, key.UpdatedAt = item.key.CreatedAt, item.key.UpdatedAt
+	return nil
+}
+
+// putCredentialMetadata upserts a credential like insertCredentialMetadata
+func (s *MemoryStore) putCredentialMetadata(userID string, cred *models.CredentialMetadata) error {
+	itemID, owner, err := parseItemIDs(cred.ItemUUID.String(), userID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkUser("credential_metadata", userID); err != nil {
+		return err
+	}
+
+	now := memoryNow()
+	rowKey := memoryItemKey{userID, cred.Zone, itemID}
+	item, ok := s.items["credential_metadata"][rowKey]
+	if ok {
+		row := item.cred
+		row.Server, row.Account, row.PasswordKeyUUID = cred.Server, cred.Account, cred.PasswordKeyUUID
+		row.GenCount, row.Tombstone, row.UpdatedAt = cred.GenCount, cred.Tombstone, now
+		item.wipeID = ""
+	} else {
+		row := *cred
+		row.ID, row.UserID, row.ItemUUID = uuid.New(), owner, itemID
+		row.CreatedAt, row.UpdatedAt = now, now
+		item = &memoryItem{memoryItemKey: rowKey, cred: &row}
+		s.items["credential_metadata"][rowKey] = item
+	}
+	cred.CreatedAt, cred.UpdatedAt = item.cred.CreatedAt, item.cred.UpdatedAt
+	return nil
+}
+
+// putSyncRecord upserts a record like insertSyncRecord
+func (s *MemoryStore) putSyncRecord(userID string, record *models.SyncRecord) error {
+	itemID, owner, err := parseItemIDs(record.ItemUUID.String(), userID)
+	if err != nil {
+		return err
+	}
+	if err := s.checkUser("sync_records", userID); err != nil {
+		return err
+	}
+	if record.WrappedKey == nil {
+		return memoryNotNull("sync_records.wrapped_key")
+	}
+	if record.EncItem == nil {
+		return memoryNotNull("sync_records.enc_item")
+	}
+
+	now := memoryNow()
+	rowKey := memoryItemKey{userID, record.Zone, itemID}
+	item, ok := s.items["sync_records"][rowKey]
+	if ok {
+		row := item.record
+		row.WrappedKey, row.EncItem = record.WrappedKey, record.EncItem
+		row.GenCount, row.Tombstone, row.UpdatedAt = record.GenCount, record.Tombstone, now
+		item.wipeID = ""
+	} else {
+		row := *record
+		row.ID, row.UserID, row.ItemUUID = uuid.New(), owner, itemID
+		row.CreatedAt, row.UpdatedAt = now, now
+		item = &memoryItem{memoryItemKey: rowKey, record: &row}
+		s.items["sync_records"][rowKey] = item
+	}
+	record.CreatedAt, record.UpdatedAt = item.record.CreatedAt, item.record.UpdatedAt
+	return nil
+}
+
+// NextGenCounts reserves gencounts like PostgresStore.NextGenCounts
+func (s *MemoryStore) NextGenCounts(ctx context.Context, userID, zone string, n int) (GenCountRange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextGenCounts(userID, zone, int64(n))
+}
+
+// nextGenCounts is the SQL stores' nextGenCounts; s.mu stands in for the
+// row lock
+func (s *MemoryStore) nextGenCounts(userID, zone string, n int64) (GenCountRange, error) {
+	if n == 0 {
+		var genCount int64
+		if row, ok := s.syncStates[memoryZoneKey{userID, zone}]; ok {
+			genCount = row.genCount
+		}
+		return GenCountRange{First: genCount + 1, Last: genCount}, nil
+	}
+	row, err := s.syncStateRow(userID, zone)
+	if err != nil {
+		return GenCountRange{}, err
+	}
+	row.genCount += n
+	row.updatedAt = memoryNow()
+	return GenCountRange{First: row.genCount - n + 1, Last: row.genCount}, nil
+}
+
+// CommitPush writes a push like PostgresStore.CommitPush. An item the schema
+// would refuse is skipped and reported as a *PushItemError wrapping a
+// *MemoryConstraintError.
+func (s *MemoryStore) CommitPush(ctx context.Context, userID string, batch *PushBatch) ([]*PushItemError, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// What would abort the SQL transaction is checked before anything is
+	// written
+	if _, err := uuid.Parse(userID); err != nil {
+		return nil, err
+	}
+	if err := s.checkUser("sync_state", userID); err != nil {
+		return nil, err
+	}
+	sequenceKey := memoryDeviceKey{userID, batch.DeviceID}
+	if batch.Sequence > 0 {
+		if s.device(batch.DeviceID) == nil {
+			return nil, &MemoryConstraintError{Constraint: "FOREIGN KEY", Column: "device_push_sequences.device_id"}
+		}
+		if err := syncdomain.CheckPushSequence(s.pushSequences[sequenceKey], batch.Sequence); err != nil {
+			return nil, err
+		}
+	}
+
+	genCounts, err := s.nextGenCounts(userID, batch.Zone, batch.Len())
+	if err != nil {
+		return nil, err
+	}
+	batch.Number(genCounts)
+
+	var rejected []*PushItemError
+	writeItem := func(layer string, index int, err error) error {
+		if _, ok := err.(*MemoryConstraintError); ok {
+			rejected = append(rejected, &PushItemError{Layer: layer, Index: index, Err: err})
+			return nil
+		}
+		return err
+	}
+	for i, key := range batch.Keys {
+		if err := writeItem("crypto_key", i, s.putCryptoKey(userID, key)); err != nil {
+			return nil, err
+		}
+	}
+	for i, cred := range batch.Metadata {
+		if err := writeItem("credential_metadata", i, s.putCredentialMetadata(userID, cred)); err != nil {
+			return nil, err
+		}
+	}
+	for i, record := range batch.Records {
+		if err := writeItem("sync_record", i, s.putSyncRecord(userID, record)); err != nil {
+			return nil, err
+		}
+	}
+
+	if batch.Sequence > 0 {
+		s.pushSequences[sequenceKey] = batch.Sequence
+	}
+
+	state, err := s.syncStateRow(userID, batch.Zone)
+	if err != nil {
+		return nil, err
+	}
+	state.lastWriter = nil
+	if batch.DeviceID != "" {
+		deviceID := batch.DeviceID
+		state.lastWriter = &deviceID
+	}
+	state.updatedAt = memoryNow()
+	return rejected, nil
+}
+
+// CommitImport writes a vault import like PostgresStore.CommitImport. The
+// rows it would change are copied first and put back when an item is
+// refused, so a failed import leaves the maps as they were.
+func (s *MemoryStore) CommitImport(ctx context.Context, userID string, batches []*PushBatch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := uuid.Parse(userID); err != nil {
+		return err
+	}
+	if err := s.checkUser("sync_state", userID); err != nil {
+		return err
+	}
+
+	var undo []func()
+	saveState := func(zone string) {
+		key := memoryZoneKey{userID, zone}
+		if row, ok := s.syncStates[key]; ok {
+			saved := *row
+			undo = append(undo, func() { *row = saved })
+			return
+		}
+		undo = append(undo, func() { delete(s.syncStates, key) })
+	}
+	saveItem := func(table, zone string, itemUUID uuid.UUID) {
+		key := memoryItemKey{userID, zone, itemUUID}
+		if item, ok := s.items[table][key]; ok {
+			saved := item.clone()
+			undo = append(undo, func() { s.items[table][key] = saved })
+			return
+		}
+		undo = append(undo, func() { delete(s.items[table], key) })
+	}
+	refused := func(zone, layer string, index int, err error) error {
+		if _, ok := err.(*MemoryConstraintError); ok && layer != "" {
+			err = &ImportItemError{Zone: zone, PushItemError: &PushItemError{Layer: layer, Index: index, Err: err}}
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+		return err
+	}
+
+	for _, batch := range batches {
+		saveState(batch.Zone)
+		genCounts, err := s.nextGenCounts(userID, batch.Zone, batch.Len())
+		if err != nil {
+			return refused(batch.Zone, "", 0, err)
+		}
+		batch.Number(genCounts)
+
+		for i, key := range batch.Keys {
+			saveItem("crypto_keys", batch.Zone, key.ItemUUID)
+			if err := s.putCryptoKey(userID, key); err != nil {
+				return refused(batch.Zone, "crypto_key", i, err)
+			}
+		}
+		for i, cred := range batch.Metadata {
+			saveItem("credential_metadata", batch.Zone, cred.ItemUUID)
+			if err := s.putCredentialMetadata(userID, cred); err != nil {
+				return refused(batch.Zone, "credential_metadata", i, err)
+			}
+		}
+		for i, record := range batch.Records {
+			saveItem("sync_records", batch.Zone, record.ItemUUID)
+			if err := s.putSyncRecord(userID, record); err != nil {
+				return refused(batch.Zone, "sync_record", i, err)
+			}
+		}
+
+		state, err := s.syncStateRow(userID, batch.Zone)
+		if err != nil {
+			return refused(batch.Zone, "", 0, err)
+		}
+		state.lastWriter = nil
+		if batch.DeviceID != "" {
+			deviceID := batch.DeviceID
+			state.lastWriter = &deviceID
+		}
+		state.updatedAt = memoryNow()
+	}
+	return nil
+}
+
+// LiveLeafIDs returns the item UUIDs of a zone's live sync records, the
+// leaves of its version 1 manifest digest (sync.LegacyManifestDigest)
+func (s *MemoryStore) LiveLeafIDs(ctx context.Context, userID, zone string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.liveLeafIDs(userID, zone), nil
+}
+
+func (s *MemoryStore) liveLeafIDs(userID, zone string) []string {
+	leafIDs := []string{}
+	for _, item := range s.zoneItems("sync_records", userID, zone) {
+		if !item.tombstone() {
+			leafIDs = append(leafIDs, item.itemUUID.String())
+		}
+	}
+	sort.Strings(leafIDs)
+	return leafIDs
+}
+
+// manifest is computeManifest over the maps
+func (s *MemoryStore) manifest(userID, zone string) *ManifestState {
+	leaves := s.manifestLeaves(userID, zone)
+	return &ManifestState{
+		UserID:    userID,
+		Zone:      zone,
+		LeafCount: len(leaves),
+		Digest:    syncdomain.ManifestDigest(leaves),
+	}
+}
+
+// ManifestLeaves returns a zone's live items like
+// PostgresStore.ManifestLeaves
+func (s *MemoryStore) ManifestLeaves(ctx context.Context, userID, zone string) ([]syncdomain.ManifestLeaf, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.manifestLeaves(userID, zone), nil
+}
+
+func (s *MemoryStore) manifestLeaves(userID, zone string) []syncdomain.ManifestLeaf {
+	leaves := []syncdomain.ManifestLeaf{}
+	for _, layer := range syncdomain.ManifestLeafLayers {
+		start := len(leaves)
+		for _, item := range s.zoneItems(manifestLeafTables[layer], userID, zone) {
+			if !item.tombstone() {
+				leaves = append(leaves, syncdomain.ManifestLeaf{Layer: layer, ItemUUID: item.itemUUID.String(), GenCount: item.genCount()})
+			}
+		}
+		layerLeaves := leaves[start:]
+		sort.Slice(layerLeaves, func(i, j int) bool { return layerLeaves[i].ItemUUID < layerLeaves[j].ItemUUID })
+	}
+	return leaves
+}
+
+// Deletes and wipes
+
+type memoryWipe struct {
+	BulkWipe
+	expiredAt *time.Time
+}
+
+func (w *memoryWipe) copy() *BulkWipe {
+	wipe := w.BulkWipe
+	wipe.DeviceID = copyString(w.DeviceID)
+	wipe.UndoneAt = copyTime(w.UndoneAt)
+	return &wipe
+}
+
+// DeleteCredential tombstones a live credential like
+// PostgresStore.DeleteCredential; sql.ErrNoRows if there is no such live
+// credential
+func (s *MemoryStore) DeleteCredential(ctx context.Context, userID string, req *CredentialDeleteRequest) (*WipeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cred, ok := s.items["credential_metadata"][memoryItemKey{userID, req.Zone, req.ItemUUID}]
+	if !ok || cred.tombstone() {
+		return nil, sql.ErrNoRows
+	}
+
+	keyIDs := []uuid.UUID{cred.cred.PasswordKeyUUID}
+	if cred.cred.MetadataKeyUUID != nil {
+		keyIDs = append(keyIDs, *cred.cred.MetadataKeyUUID)
+	}
+	items := s.unsharedKeys(userID, req.Zone, req.ItemUUID, keyIDs)
+	items = append(items, &WipedItem{Table: "credential_metadata", ItemUUID: req.ItemUUID})
+	if record, ok := s.items["sync_records"][memoryItemKey{userID, req.Zone, req.ItemUUID}]; ok && !record.tombstone() {
+		items = append(items, &WipedItem{Table: "sync_records", ItemUUID: req.ItemUUID})
+	}
+
+	genCounts, err := s.nextGenCounts(userID, req.Zone, int64(len(items)))
+	if err != nil {
+		return nil, err
+	}
+	result := &WipeResult{GenCount: genCounts.Last, Items: items}
+	s.renumberWipeItems(userID, req.Zone, items, result.GenCount, true, "")
+	if err := s.saveWipeState(userID, req.Zone, result.GenCount, req.DeviceID); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// unsharedKeys returns the live keys among keyIDs that no other live
+// credential or sync record of the zone refers to, like lockUnsharedKeys
+func (s *MemoryStore) unsharedKeys(userID, zone string, itemUUID uuid.UUID, keyIDs []uuid.UUID) []*WipedItem {
+	var keys []*memoryItem
+	for _, id := range keyIDs {
+		key, ok := s.items["crypto_keys"][memoryItemKey{userID, zone, id}]
+		if !ok || key.tombstone() || s.keyReferenced(userID, zone, id, itemUUID) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sortItems(keys)
+
+	var items []*WipedItem
+	for _, key := range keys {
+		items = append(items, &WipedItem{Table: "crypto_keys", ItemUUID: key.itemUUID})
+	}
+	return items
+}
+
+// keyReferenced reports whether a live credential or sync record of the zone
+// other than except refers to the key
+func (s *MemoryStore) keyReferenced(userID, zone string, keyID, except uuid.UUID) bool {
+	for _, item := range s.zoneItems("credential_metadata", userID, zone) {
+		if item.tombstone() || item.itemUUID == except {
+			continue
+		}
+		if item.cred.PasswordKeyUUID == keyID || (item.cred.MetadataKeyUUID != nil && *item.cred.MetadataKeyUUID == keyID) {
+			return true
+		}
+	}
+	for _, item := range s.zoneItems("sync_records", userID, zone) {
+		if item.tombstone() || item.itemUUID == except {
+			continue
+		}
+		if item.record.ParentKeyUUID != nil && *item.record.ParentKeyUUID == keyID {
+			return true
+		}
+	}
+	return false
+}
+
+// WipeZone trashes every live item of the zone like PostgresStore.WipeZone
+func (s *MemoryStore) WipeZone(ctx context.Context, userID string, req *WipeRequest) (*WipeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	items := s.wipeItems(userID, req.Zone, func(item *memoryItem) bool { return !item.tombstone() })
+	if len(items) == 0 {
+		genCounts, err := s.nextGenCounts(userID, req.Zone, 0)
+		return &WipeResult{GenCount: genCounts.Last}, err
+	}
+	if err := s.checkUser("bulk_wipes", userID); err != nil {
+		return nil, err
+	}
+
+	genCounts, err := s.nextGenCounts(userID, req.Zone, int64(len(items)))
+	if err != nil {
+		return nil, err
+	}
+	result := &WipeResult{GenCount: genCounts.Last, Items: items}
+	wipe := &memoryWipe{BulkWipe: BulkWipe{
+		ID:           uuid.New().String(),
+		UserID:       userID,
+		Zone:         req.Zone,
+		Items:        len(items),
+		GenCount:     result.GenCount,
+		CreatedAt:    memoryNow(),
+		RecoverUntil: req.RecoverUntil,
+	}}
+	if req.DeviceID != "" {
+		deviceID := req.DeviceID
+		wipe.DeviceID = &deviceID
+	}
+	s.wipes = append(s.wipes, wipe)
+	result.Wipe = wipe.copy()
+
+	s.renumberWipeItems(userID, req.Zone, items, result.GenCount, true, wipe.ID)
+	if err := s.saveWipeState(userID, req.Zone, result.GenCount, req.DeviceID); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// UndoWipe restores the zone's most recent bulk wipe like
+// PostgresStore.UndoWipe
+func (s *MemoryStore) UndoWipe(ctx context.Context, userID string, req *WipeRequest, now time.Time) (*WipeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var wipe *memoryWipe
+	for _, w := range s.wipes {
+		if w.UserID != userID || w.Zone != req.Zone || w.UndoneAt != nil || w.expiredAt != nil {
+			continue
+		}
+		if wipe == nil || !w.CreatedAt.Before(wipe.CreatedAt) {
+			wipe = w
+		}
+	}
+	if wipe == nil {
+		return nil, syncdomain.ErrNoWipe
+	}
+	if !now.Before(wipe.RecoverUntil) {
+		return nil, syncdomain.ErrWipeExpired
+	}
+
+	items := s.wipeItems(userID, req.Zone, func(item *memoryItem) bool { return item.wipeID == wipe.ID })
+	genCounts, err := s.nextGenCounts(userID, req.Zone, int64(len(items)))
+	if err != nil {
+		return nil, err
+	}
+	result := &WipeResult{GenCount: genCounts.Last, Items: items}
+
+	undoneAt := now
+	wipe.UndoneAt = &undoneAt
+	result.Wipe = wipe.copy()
+
+	if len(items) > 0 {
+		s.renumberWipeItems(userID, req.Zone, items, result.GenCount, false, "")
+		if err := s.saveWipeState(userID, req.Zone, result.GenCount, req.DeviceID); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// FindExpiredWipes lists the bulk wipes whose recovery window passed by now
+// and whose items are still marked. An empty userID covers every user.
+func (s *MemoryStore) FindExpiredWipes(now time.Time, userID string) ([]*BulkWipe, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var wipes []*BulkWipe
+	for _, w := range s.wipes {
+		if w.UndoneAt == nil && w.expiredAt == nil && !w.RecoverUntil.After(now) && (userID == "" || w.UserID == userID) {
+			wipes = append(wipes, w.copy())
+		}
+	}
+	sort.SliceStable(wipes, func(i, j int) bool { return wipes[i].RecoverUntil.Before(wipes[j].RecoverUntil) })
+	return wipes, nil
+}
+
+// ExpireWipe turns the items a bulk wipe still marks into plain tombstones
+// and returns how many there were
+func (s *MemoryStore) ExpireWipe(userID, wipeID string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var wipe *memoryWipe
+	for _, w := range s.wipes {
+		if w.ID == wipeID && w.UserID == userID && w.UndoneAt == nil && w.expiredAt == nil {
+			wipe = w
+		}
+	}
+	if wipe == nil {
+		return 0, nil
+	}
+	expiredAt := memoryNow()
+	wipe.expiredAt = &expiredAt
+
+	var total int64
+	for _, rows := range s.items {
+		for key, item := range rows {
+			if key.userID == userID && item.wipeID == wipeID {
+				item.wipeID = ""
+				total++
+			}
+		}
+	}
+	return total, nil
+}
+
+// wipeItems returns the zone's items that match, table by table in
+// wipeTables order and by gencount within a table, like lockWipeItems
+func (s *MemoryStore) wipeItems(userID, zone string, match func(*memoryItem) bool) []*WipedItem {
+	var items []*WipedItem
+	for _, table := range wipeTables {
+		var rows []*memoryItem
+		for _, item := range s.zoneItems(table, userID, zone) {
+			if match(item) {
+				rows = append(rows, item)
+			}
+		}
+		sortItems(rows)
+		for _, item := range rows {
+			items = append(items, &WipedItem{Table: table, ItemUUID: item.itemUUID})
+		}
+	}
+	return items
+}
+
+// renumberWipeItems gives the items the gencounts up to genCount in order,
+// like renumberWipeItems
+func (s *MemoryStore) renumberWipeItems(userID, zone string, items []*WipedItem, genCount int64, tombstone bool, wipeID string) {
+	now := memoryNow()
+	next := genCount - int64(len(items))
+	for _, wiped := range items {
+		next++
+		wiped.GenCount = next
+
+		item := s.items[wiped.Table][memoryItemKey{userID, zone, wiped.ItemUUID}]
+		itemGenCount, itemTombstone, updatedAt := item.columns()
+		*itemGenCount, *itemTombstone, *updatedAt = next, tombstone, now
+		item.wipeID = wipeID
+	}
+}
+
+// saveWipeState moves the zone's gencount (never backwards) and recomputes
+// its digest, like saveWipeState
+func (s *MemoryStore) saveWipeState(userID, zone string, genCount int64, deviceID string) error {
+	state, err := s.syncStateRow(userID, zone)
+	if err != nil {
+		return err
+	}
+	if genCount > state.genCount {
+		state.genCount = genCount
+	}
+	state.digest = s.manifest(userID, zone).Digest
+	state.lastWriter = nil
+	if deviceID != "" {
+		state.lastWriter = &deviceID
+	}
+	state.updatedAt = memoryNow()
+	return nil
+}
+
+// ListZoneWatermarks returns the gencount of every user/zone, or of the
+// given users' zones only
+func (s *MemoryStore) ListZoneWatermarks(ctx context.Context, userIDs []string) ([]ZoneWatermark, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var watermarks []ZoneWatermark
+	for key, state := range s.syncStates {
+		if len(userIDs) == 0 || containsString(userIDs, key.userID) {
+			watermarks = append(watermarks, ZoneWatermark{UserID: key.userID, Zone: key.zone, GenCount: state.genCount})
+		}
+	}
+	sort.Slice(watermarks, func(i, j int) bool {
+		if watermarks[i].UserID != watermarks[j].UserID {
+			return watermarks[i].UserID < watermarks[j].UserID
+		}
+		return watermarks[i].Zone < watermarks[j].Zone
+	})
+	return watermarks, nil
+}
+
+// Manual conflict resolution
+
+// copyConflict copies a conflict for a caller, who may change it
+func copyConflict(c *SyncConflict) *SyncConflict {
+	conflict := *c
+	record := *c.Pushed
+	conflict.Pushed = &record
+	conflict.DeviceID = copyString(c.DeviceID)
+	conflict.ResolvedAt = copyTime(c.ResolvedAt)
+	conflict.Resolution = copyString(c.Resolution)
+	return &conflict
+}
+
+// pendingConflict returns the item's pending conflict, if any
+func (s *MemoryStore) pendingConflict(userID, zone string, itemUUID uuid.UUID) *SyncConflict {
+	for _, c := range s.conflicts {
+		if c.UserID == userID && c.Zone == zone && c.ItemUUID == itemUUID && c.ResolvedAt == nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// QueueConflicts holds pushed records back for manual resolution like
+// PostgresStore.QueueConflicts
+func (s *MemoryStore) QueueConflicts(ctx context.Context, userID string, conflicts []*SyncConflict) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkUser("sync_conflicts", userID); err != nil {
+		return err
+	}
+	for _, conflict := range conflicts {
+		if conflict.Pushed.WrappedKey == nil {
+			return memoryNotNull("sync_conflicts.wrapped_key")
+		}
+		if conflict.Pushed.EncItem == nil {
+			return memoryNotNull("sync_conflicts.enc_item")
+		}
+	}
+
+	for _, conflict := range conflicts {
+		conflict.UserID = userID
+		if pending := s.pendingConflict(userID, conflict.Zone, conflict.ItemUUID); pending != nil {
+			conflict.ID, conflict.CreatedAt = pending.ID, pending.CreatedAt
+			*pending = *copyConflict(conflict)
+			continue
+		}
+		conflict.ID, conflict.CreatedAt = uuid.New().String(), memoryNow()
+		s.conflicts = append(s.conflicts, copyConflict(conflict))
+	}
+	return nil
+}
+
+func (s *MemoryStore) ListConflicts(ctx context.Context, userID, zone string) ([]*SyncConflict, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var conflicts []*SyncConflict
+	for _, c := range s.conflicts {
+		if c.UserID == userID && c.Zone == zone && c.ResolvedAt == nil {
+			conflicts = append(conflicts, copyConflict(c))
+		}
+	}
+	return conflicts, nil
+}
+
+// ResolveConflict settles a pending conflict like
+// PostgresStore.ResolveConflict; sql.ErrNoRows if there is no such
+// pending conflict
+func (s *MemoryStore) ResolveConflict(ctx context.Context, userID string, req *ConflictResolveRequest) (*ConflictResolution, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var conflict *SyncConflict
+	for _, c := range s.conflicts {
+		if c.ID == req.ID && c.UserID == userID && c.Zone == req.Zone && c.ResolvedAt == nil {
+			conflict = c
+		}
+	}
+	if conflict == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	genCounts, err := s.nextGenCounts(userID, req.Zone, 1)
+	if err != nil {
+		return nil, err
+	}
+	genCount := genCounts.Last
+	if req.Resolution == syncdomain.ResolutionClientWins {
+		record := *conflict.Pushed
+		record.GenCount = genCount
+		if err := s.putSyncRecord(userID, &record); err != nil {
+			return nil, err
+		}
+	} else if item, ok := s.items["sync_records"][memoryItemKey{userID, req.Zone, conflict.ItemUUID}]; ok {
+		item.record.GenCount, item.record.UpdatedAt = genCount, memoryNow()
+	}
+
+	now := memoryNow()
+	resolution := req.Resolution
+	conflict.ResolvedAt, conflict.Resolution = &now, &resolution
+	if err := s.saveWipeState(userID, req.Zone, genCount, req.DeviceID); err != nil {
+		return nil, err
+	}
+	return &ConflictResolution{Conflict: copyConflict(conflict), GenCount: genCount}, nil
+}
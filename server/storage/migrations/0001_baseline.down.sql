@@ -1,7 +1,13 @@
 -- Drop all tables in correct order (respecting foreign key constraints)
--- Used by 'make db-reset' to recreate schema
+-- Used by 'make db-reset' (migrate -to 0) to recreate the schema
 
+DROP TABLE IF EXISTS user_regions CASCADE;
+DROP TABLE IF EXISTS job_reports CASCADE;
+DROP TABLE IF EXISTS audit_events CASCADE;
+DROP TABLE IF EXISTS password_reset_tokens CASCADE;
 DROP TABLE IF EXISTS refresh_tokens CASCADE;
+DROP TABLE IF EXISTS bulk_wipes CASCADE;
+DROP TABLE IF EXISTS device_push_sequences CASCADE;
 DROP TABLE IF EXISTS sync_records CASCADE;
 DROP TABLE IF EXISTS credential_metadata CASCADE;
 DROP TABLE IF EXISTS crypto_keys CASCADE;
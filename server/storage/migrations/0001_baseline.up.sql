@@ -0,0 +1,314 @@
+-- Multi-tenant control plane schema for Postgres
+-- Client devices keep SQLite for encrypted vault data
+-- Every statement is idempotent, so databases set up before versioned
+-- migrations (when `password-sync migrate` re-applied this file) adopt it as
+-- version 1. Later changes go in new numbered files, not here.
+
+-- Users table (authentication and account management)
+CREATE TABLE IF NOT EXISTS users (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    email VARCHAR(255) UNIQUE NOT NULL,
+    password_hash BYTEA NOT NULL,  -- PBKDF2 hash for login (NOT master password!)
+    salt BYTEA NOT NULL,            -- Salt for password_hash
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    subscription_tier VARCHAR(50) DEFAULT 'free',
+    email_verified BOOLEAN DEFAULT FALSE,
+    is_admin BOOLEAN DEFAULT FALSE, -- Operator accounts (audit export for other users, admin API)
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,   -- Deactivated accounts are rejected on every request
+    token_version INTEGER NOT NULL DEFAULT 0,  -- Bumped to invalidate all outstanding access tokens
+    enc_version_policy VARCHAR(10) NOT NULL DEFAULT 'warn', -- 'warn' or 'reject' pushes newer than a device supports
+    device_auto_deactivate_days INTEGER, -- Deactivate devices idle this long; NULL = never
+    legal_hold BOOLEAN NOT NULL DEFAULT FALSE, -- Set by operators: no deletes, purges or pruning while true
+    last_active_at TIMESTAMPTZ,     -- Last login or refresh; NULL = never since this column existed
+    inactivity_stage VARCHAR(20) NOT NULL DEFAULT 'active', -- 'active', 'warned', 'dormant', 'deletion_warned', 'deletion_queued'
+    inactivity_stage_at TIMESTAMPTZ, -- When inactivity_stage was entered; NULL while active
+    hash_version SMALLINT NOT NULL DEFAULT 1, -- Format of password_hash: 1 = PBKDF2, 2 = Argon2id
+    hash_upgrade_deadline TIMESTAMPTZ,      -- Set by a hash upgrade campaign: log in before this
+    hash_upgrade_notified_at TIMESTAMPTZ,   -- When the user was told about the campaign
+    hash_upgrade_enforced_at TIMESTAMPTZ,   -- When the deadline passed and refresh tokens were revoked
+    device_approval VARCHAR(10) NOT NULL DEFAULT 'off', -- 'off', 'read_only' or 'required': access of new devices until a trusted one approves them
+    failed_login_attempts INTEGER NOT NULL DEFAULT 0, -- Consecutive wrong passwords since the last login or lockout
+    locked_until TIMESTAMPTZ         -- Logins are refused until then after too many wrong passwords
+);
+
+-- Devices per user (trusted device circle)
+CREATE TABLE IF NOT EXISTS devices (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_name VARCHAR(255),
+    device_type VARCHAR(50),        -- 'desktop', 'mobile', 'extension', 'web'
+    public_key BYTEA,               -- Ed25519 public key for device verification
+    last_sync TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    is_active BOOLEAN DEFAULT TRUE,
+    max_enc_version INTEGER,        -- Highest enc_version the device can decrypt; NULL if never reported
+    inactivity_warned_at TIMESTAMPTZ, -- When the owner was warned of auto-deactivation; cleared on sync
+    trust_level SMALLINT NOT NULL DEFAULT 2, -- peer.TrustLevel: 1 = pending, 2 = trusted, 3 = revoked
+    capabilities JSONB NOT NULL DEFAULT '{}', -- peer.Capabilities the device advertised
+    device_fingerprint VARCHAR(255) -- Chosen by the client; registering it again updates the device
+);
+
+-- Sync state per user per zone
+CREATE TABLE IF NOT EXISTS sync_state (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    zone VARCHAR(100) NOT NULL DEFAULT 'default',
+    gencount BIGINT NOT NULL DEFAULT 0,
+    digest BYTEA,
+    last_writer_device_id UUID,     -- Device of the last push; NULL for clients without a device claim
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (user_id, zone)
+);
+
+-- Layer 1: Encrypted cryptographic keys (server stores encrypted blobs, cannot decrypt)
+CREATE TABLE IF NOT EXISTS crypto_keys (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    item_uuid UUID NOT NULL,
+    zone VARCHAR(100) NOT NULL DEFAULT 'default',
+    
+    -- Key metadata
+    key_class SMALLINT NOT NULL,    -- 0=Symmetric, 1=Public, 2=Private
+    key_type SMALLINT NOT NULL,     -- 0=AES256GCM, 1=Ed25519, 2=X25519
+    label VARCHAR(255),
+    application_label VARCHAR(255),
+    access_group VARCHAR(100) NOT NULL DEFAULT 'default',
+    
+    -- Encrypted key data
+    data BYTEA NOT NULL,            -- Encrypted key material
+    
+    -- Usage flags (bitfield or JSON)
+    usage_flags JSONB NOT NULL,     -- {encrypt, decrypt, wrap, unwrap, sign, verify, derive}
+    
+    -- Sync metadata
+    gencount BIGINT NOT NULL,
+    tombstone BOOLEAN DEFAULT FALSE,
+    wipe_id UUID,                   -- Trashed by this bulk wipe: a tombstone that can still be undone
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    
+    UNIQUE (user_id, item_uuid, zone)
+);
+
+-- Layer 2: Credential metadata (references crypto_keys for actual passwords)
+CREATE TABLE IF NOT EXISTS credential_metadata (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    item_uuid UUID NOT NULL,
+    zone VARCHAR(100) NOT NULL DEFAULT 'default',
+    
+    -- Credential information
+    server VARCHAR(500) NOT NULL,
+    account VARCHAR(255) NOT NULL,
+    protocol SMALLINT NOT NULL DEFAULT 0,
+    port INTEGER NOT NULL DEFAULT 443,
+    path VARCHAR(1000),
+    label VARCHAR(255),
+    access_group VARCHAR(100) NOT NULL DEFAULT 'default',
+    
+    -- References to crypto_keys
+    password_key_uuid UUID NOT NULL,
+    metadata_key_uuid UUID,
+    
+    -- Sync metadata
+    gencount BIGINT NOT NULL,
+    tombstone BOOLEAN DEFAULT FALSE,
+    wipe_id UUID,                   -- Trashed by this bulk wipe: a tombstone that can still be undone
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    
+    UNIQUE (user_id, item_uuid, zone)
+);
+
+-- Layer 3: Sync records (encrypted blobs for syncing)
+CREATE TABLE IF NOT EXISTS sync_records (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    item_uuid UUID NOT NULL,
+    zone VARCHAR(100) NOT NULL DEFAULT 'default',
+    parent_key_uuid UUID,           -- For key hierarchy
+    
+    -- Encrypted data
+    wrapped_key BYTEA NOT NULL,     -- Content key encrypted with master key
+    enc_item BYTEA NOT NULL,        -- Item data encrypted with content key
+    enc_version SMALLINT NOT NULL DEFAULT 1,
+    
+    -- Context for multi-context support
+    context_id VARCHAR(100) NOT NULL DEFAULT 'default',
+    
+    -- Sync metadata
+    gencount BIGINT NOT NULL,
+    tombstone BOOLEAN DEFAULT FALSE,
+    wipe_id UUID,                   -- Trashed by this bulk wipe: a tombstone that can still be undone
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    
+    UNIQUE (user_id, item_uuid, zone)
+);
+
+-- Last numbered push applied per device, so a multi-request offline flush
+-- is applied in order whatever order its requests arrive in
+CREATE TABLE IF NOT EXISTS device_push_sequences (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    last_sequence BIGINT NOT NULL,
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (user_id, device_id)
+);
+
+-- Bulk wipes of a zone (DELETE /sync/credentials). Their items stay
+-- restorable until recover_until, after which the bulk wipe expiry job
+-- turns them into plain tombstones.
+CREATE TABLE IF NOT EXISTS bulk_wipes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    zone VARCHAR(100) NOT NULL,
+    device_id UUID,                 -- Device that wiped; NULL for clients without a device claim
+    items INTEGER NOT NULL,
+    gencount BIGINT NOT NULL,       -- Zone gencount after the wipe
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    recover_until TIMESTAMPTZ NOT NULL,
+    undone_at TIMESTAMPTZ,
+    expired_at TIMESTAMPTZ          -- When its items became plain tombstones
+);
+
+-- Refresh tokens for JWT rotation
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_id UUID REFERENCES devices(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    revoked BOOLEAN DEFAULT FALSE
+);
+
+-- Single-use password reset tokens, emailed to the account; only their
+-- SHA-256 is kept
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    token_hash BYTEA PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    used_at TIMESTAMPTZ
+);
+
+-- Audit log (security and sync activity, exportable for compliance)
+CREATE TABLE IF NOT EXISTS audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,  -- Account the event belongs to
+    actor_id UUID,                  -- User who performed the action (differs for admin actions)
+    device_id UUID,
+    action VARCHAR(100) NOT NULL,   -- 'auth.login', 'sync.push', 'item.push', ...
+    zone VARCHAR(100),
+    item_uuid UUID,                 -- Set for item-level rows only
+    ip_address VARCHAR(64),
+    details JSONB,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- Maintenance job runs (retention jobs, dry-run estimates) kept for review
+CREATE TABLE IF NOT EXISTS job_reports (
+    id BIGSERIAL PRIMARY KEY,
+    job_name VARCHAR(100) NOT NULL,
+    dry_run BOOLEAN NOT NULL DEFAULT FALSE,
+    started_at TIMESTAMPTZ NOT NULL,
+    finished_at TIMESTAMPTZ NOT NULL,
+    total_affected BIGINT NOT NULL DEFAULT 0,
+    details JSONB,                  -- Per-user counts and sample item UUIDs
+    error TEXT
+);
+
+-- Region directory (primary database only): where each user of a region
+-- other than the primary lives. Its unique email stands in for users.email,
+-- which can't be unique across databases.
+CREATE TABLE IF NOT EXISTS user_regions (
+    user_id UUID PRIMARY KEY,
+    email VARCHAR(255) UNIQUE NOT NULL,
+    region VARCHAR(32) NOT NULL
+);
+
+-- Column additions for databases created from an earlier version of this file
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_active BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS token_version INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE sync_state ADD COLUMN IF NOT EXISTS last_writer_device_id UUID;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS enc_version_policy VARCHAR(10) NOT NULL DEFAULT 'warn';
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS max_enc_version INTEGER;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS device_auto_deactivate_days INTEGER;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS legal_hold BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS inactivity_warned_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_active_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS inactivity_stage VARCHAR(20) NOT NULL DEFAULT 'active';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS inactivity_stage_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS hash_version SMALLINT NOT NULL DEFAULT 1;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS hash_upgrade_deadline TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS hash_upgrade_notified_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS hash_upgrade_enforced_at TIMESTAMPTZ;
+ALTER TABLE crypto_keys ADD COLUMN IF NOT EXISTS wipe_id UUID;
+ALTER TABLE credential_metadata ADD COLUMN IF NOT EXISTS wipe_id UUID;
+ALTER TABLE sync_records ADD COLUMN IF NOT EXISTS wipe_id UUID;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS device_approval VARCHAR(10) NOT NULL DEFAULT 'off';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_login_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMPTZ;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS trust_level SMALLINT NOT NULL DEFAULT 2;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS capabilities JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS device_fingerprint VARCHAR(255);
+
+-- Indexes for performance
+CREATE INDEX IF NOT EXISTS idx_devices_user_id ON devices(user_id);
+-- One active device per fingerprint; UpsertDevice's ON CONFLICT target
+CREATE UNIQUE INDEX IF NOT EXISTS idx_devices_user_fingerprint ON devices(user_id, device_fingerprint)
+    WHERE is_active AND device_fingerprint IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_crypto_keys_user_gencount ON crypto_keys(user_id, gencount);
+CREATE INDEX IF NOT EXISTS idx_crypto_keys_user_zone ON crypto_keys(user_id, zone);
+CREATE INDEX IF NOT EXISTS idx_credential_metadata_user_gencount ON credential_metadata(user_id, gencount);
+CREATE INDEX IF NOT EXISTS idx_credential_metadata_user_zone ON credential_metadata(user_id, zone);
+CREATE INDEX IF NOT EXISTS idx_credential_metadata_server ON credential_metadata(user_id, server);
+-- Grouped search and dedupe key on (server, account) case-insensitively
+CREATE INDEX IF NOT EXISTS idx_credential_metadata_server_account
+    ON credential_metadata(user_id, zone, lower(server), lower(account)) WHERE tombstone = false;
+CREATE INDEX IF NOT EXISTS idx_sync_records_user_gencount ON sync_records(user_id, gencount);
+CREATE INDEX IF NOT EXISTS idx_sync_records_user_zone ON sync_records(user_id, zone);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user_id ON password_reset_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_user_created ON audit_events(user_id, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_user_zone ON audit_events(user_id, zone, id) WHERE zone IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_users_inactivity_stage ON users(inactivity_stage) WHERE inactivity_stage <> 'active';
+CREATE INDEX IF NOT EXISTS idx_users_hash_upgrade ON users(hash_upgrade_deadline) WHERE hash_upgrade_deadline IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_crypto_keys_wipe ON crypto_keys(wipe_id) WHERE wipe_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_credential_metadata_wipe ON credential_metadata(wipe_id) WHERE wipe_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_sync_records_wipe ON sync_records(wipe_id) WHERE wipe_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_bulk_wipes_user_zone ON bulk_wipes(user_id, zone, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_bulk_wipes_pending ON bulk_wipes(recover_until)
+    WHERE undone_at IS NULL AND expired_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_job_reports_job_started ON job_reports(job_name, started_at DESC);
+
+-- Trigger to update updated_at timestamp (OR REPLACE keeps the file re-runnable, Postgres 14+)
+CREATE OR REPLACE FUNCTION update_updated_at_column()
+RETURNS TRIGGER AS $$
+BEGIN
+    NEW.updated_at = NOW();
+    RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE OR REPLACE TRIGGER update_users_updated_at BEFORE UPDATE ON users
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE OR REPLACE TRIGGER update_crypto_keys_updated_at BEFORE UPDATE ON crypto_keys
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE OR REPLACE TRIGGER update_credential_metadata_updated_at BEFORE UPDATE ON credential_metadata
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE OR REPLACE TRIGGER update_sync_records_updated_at BEFORE UPDATE ON sync_records
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+-- Sample comment explaining architecture
+COMMENT ON TABLE users IS 'User accounts for authentication. Master password NEVER stored here.';
+COMMENT ON TABLE crypto_keys IS 'Layer 1: Encrypted cryptographic keys used to encrypt passwords. Server cannot decrypt.';
+COMMENT ON TABLE credential_metadata IS 'Layer 2: Credential metadata that references crypto_keys for actual password data.';
+COMMENT ON TABLE sync_records IS 'Layer 3: Encrypted sync records for device synchronization. Triple-layer encryption.';
+COMMENT ON TABLE audit_events IS 'Append-only audit log. Never contains decrypted vault content.';
+COMMENT ON COLUMN sync_records.wrapped_key IS 'Content key wrapped with user master key (client-side only)';
+COMMENT ON COLUMN sync_records.enc_item IS 'Item data encrypted with content key (layered encryption)';
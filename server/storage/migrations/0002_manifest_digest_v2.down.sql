@@ -0,0 +1,10 @@
+-- Back to manifest digest version 1: a SHA-256 hash of the sorted UUIDs of
+-- a zone's live sync records, each followed by '|'
+
+UPDATE sync_state s
+SET digest = sha256(convert_to(COALESCE((
+    SELECT string_agg(item_uuid::text || '|', '' ORDER BY item_uuid::text COLLATE "C")
+    FROM sync_records
+    WHERE user_id = s.user_id AND zone = s.zone AND tombstone = false
+), ''), 'UTF8'))
+WHERE digest IS NOT NULL;
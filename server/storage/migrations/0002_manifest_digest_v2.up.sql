@@ -0,0 +1,24 @@
+-- Manifest digest version 2: a SHA-256 hash of the sorted
+-- "layer:item_uuid:gencount" tuples of a zone's live keys, credentials and
+-- sync records, each followed by '|' (see sync.ManifestDigest). Version 1
+-- hashed live sync record UUIDs only. Rewrites every stored digest; zones
+-- never written keep none.
+
+UPDATE sync_state s
+SET digest = sha256(convert_to(COALESCE((
+    SELECT string_agg(leaf, '' ORDER BY leaf COLLATE "C")
+    FROM (
+        SELECT 'credential_metadata:' || item_uuid::text || ':' || gencount::text || '|' AS leaf
+        FROM credential_metadata
+        WHERE user_id = s.user_id AND zone = s.zone AND tombstone = false
+        UNION ALL
+        SELECT 'crypto_key:' || item_uuid::text || ':' || gencount::text || '|'
+        FROM crypto_keys
+        WHERE user_id = s.user_id AND zone = s.zone AND tombstone = false
+        UNION ALL
+        SELECT 'sync_record:' || item_uuid::text || ':' || gencount::text || '|'
+        FROM sync_records
+        WHERE user_id = s.user_id AND zone = s.zone AND tombstone = false
+    ) leaves
+), ''), 'UTF8'))
+WHERE digest IS NOT NULL;
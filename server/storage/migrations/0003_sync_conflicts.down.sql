@@ -0,0 +1,3 @@
+-- Drops the manual conflict queue with any conflicts still pending
+
+DROP TABLE IF EXISTS sync_conflicts;
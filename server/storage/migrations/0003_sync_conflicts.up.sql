@@ -0,0 +1,29 @@
+-- Pushed sync records held back under manual conflict resolution: each was
+-- made from an older version of its item than the stored one. The record
+-- waits here until a device picks the version to keep; an item has at most
+-- one pending conflict, holding its latest held-back push.
+
+CREATE TABLE IF NOT EXISTS sync_conflicts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    zone VARCHAR(100) NOT NULL,
+    item_uuid UUID NOT NULL,
+    device_id UUID,                 -- Device that pushed; NULL for clients without a device claim
+    base_gencount BIGINT NOT NULL,  -- The version the device edited
+    stored_gencount BIGINT NOT NULL, -- The stored record's when the push arrived
+
+    -- The pushed record, as sync_records holds it
+    parent_key_uuid UUID,
+    wrapped_key BYTEA NOT NULL,
+    enc_item BYTEA NOT NULL,
+    enc_version SMALLINT NOT NULL DEFAULT 1,
+    context_id VARCHAR(100) NOT NULL DEFAULT 'default',
+    tombstone BOOLEAN NOT NULL DEFAULT FALSE,
+
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    resolved_at TIMESTAMPTZ,
+    resolution VARCHAR(20)          -- client_wins or server_wins
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sync_conflicts_pending ON sync_conflicts(user_id, zone, item_uuid)
+    WHERE resolved_at IS NULL;
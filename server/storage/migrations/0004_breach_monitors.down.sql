@@ -0,0 +1,4 @@
+-- Drops breach monitoring with every monitor and alert
+
+DROP TABLE IF EXISTS breach_alerts;
+DROP TABLE IF EXISTS breach_monitors;
@@ -0,0 +1,27 @@
+-- Addresses users asked to be alerted about when they turn up in a new
+-- breach, and the alerts raised. A job re-checks each monitor daily against
+-- HIBP; breaches holds the names seen at its last check, and every name
+-- not among them becomes an alert.
+
+CREATE TABLE IF NOT EXISTS breach_monitors (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,    -- Normalized: trimmed and lowercased
+    breaches JSONB NOT NULL DEFAULT '[]', -- HIBP breach names at the last check
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    checked_at TIMESTAMPTZ,         -- NULL until the first check, which only records the breaches known then
+    UNIQUE (user_id, email)
+);
+
+CREATE TABLE IF NOT EXISTS breach_alerts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    breach VARCHAR(255) NOT NULL,   -- HIBP breach name
+    breach_date VARCHAR(32),
+    data_types JSONB NOT NULL DEFAULT '[]',
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_breach_monitors_checked ON breach_monitors(checked_at);
+CREATE INDEX IF NOT EXISTS idx_breach_alerts_user_created ON breach_alerts(user_id, created_at DESC);
@@ -0,0 +1,15 @@
+-- Back to storing a port as the protocol: each protocol becomes its usual
+-- port. Which of several ports a row was upgraded from is not kept.
+
+UPDATE credential_metadata
+SET protocol = CASE protocol
+    WHEN 1 THEN 443
+    WHEN 2 THEN 80
+    WHEN 3 THEN 22
+    WHEN 4 THEN 21
+    WHEN 5 THEN 587
+    WHEN 6 THEN 993
+    WHEN 7 THEN 995
+    WHEN 8 THEN 389
+END
+WHERE protocol BETWEEN 1 AND 8;
@@ -0,0 +1,24 @@
+-- Credential protocols become models.Protocol values (1 https, 2 http,
+-- 3 ssh, 4 ftp, 5 smtp, 6 imap, 7 pop3, 8 ldap). Clients used to send the
+-- port as the protocol, and the server defaulted it to 443: each such port
+-- is reinterpreted as the protocol it stood for; any other becomes 0, no
+-- protocol given. Ports are left as they are.
+
+UPDATE credential_metadata
+SET protocol = CASE protocol
+    WHEN 443 THEN 1
+    WHEN 80 THEN 2
+    WHEN 22 THEN 3
+    WHEN 21 THEN 4
+    WHEN 25 THEN 5
+    WHEN 465 THEN 5
+    WHEN 587 THEN 5
+    WHEN 143 THEN 6
+    WHEN 993 THEN 6
+    WHEN 110 THEN 7
+    WHEN 995 THEN 7
+    WHEN 389 THEN 8
+    WHEN 636 THEN 8
+    ELSE 0
+END
+WHERE protocol <> 0;
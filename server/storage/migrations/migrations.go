@@ -0,0 +1,118 @@
+// Package migrations is the Postgres schema as numbered SQL files, embedded
+// in the server binary. NNNN_name.up.sql moves a database to version NNNN;
+// NNNN_name.down.sql takes it back to the version before. Migrations are
+// never edited once released: a change to the schema is a new pair of files.
+//
+// storage.PostgresStore.Migrate applies them; the SQLite schema for
+// self-hosters is kept separately in sqlite_schema.sql.
+package migrations
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// Migration is one schema version: the SQL moving a database to it from
+// the one before, and back
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// All returns every migration in version order. Each must have both its up
+// and down file.
+func All() ([]Migration, error) {
+	names, err := fs.Glob(files, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, file := range names {
+		version, name, direction, err := parseName(file)
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d is named both %q and %q", version, m.Name, name)
+		}
+
+		data, err := fs.ReadFile(files, file)
+		if err != nil {
+			return nil, err
+		}
+		if direction == "up" {
+			m.Up = string(data)
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	all := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		all = append(all, *m)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+	return all, nil
+}
+
+// Latest is the version All ends at, which a fully migrated database has
+func Latest() int {
+	all, err := All()
+	if err != nil || len(all) == 0 {
+		return 0
+	}
+	return all[len(all)-1].Version
+}
+
+// Up returns the up SQL of the migration called name. Data migrations plain
+// enough for SQLite too are shared with the SQLite store this way.
+func Up(name string) (string, error) {
+	all, err := All()
+	if err != nil {
+		return "", err
+	}
+	for _, m := range all {
+		if m.Name == name {
+			return m.Up, nil
+		}
+	}
+	return "", fmt.Errorf("no migration is named %q", name)
+}
+
+// parseName splits "0002_add_tiers.up.sql" into 2, "add_tiers" and "up"
+func parseName(file string) (int, string, string, error) {
+	base, ok := strings.CutSuffix(file, ".sql")
+	direction := ""
+	if ok {
+		switch {
+		case strings.HasSuffix(base, ".up"):
+			base, direction = strings.TrimSuffix(base, ".up"), "up"
+		case strings.HasSuffix(base, ".down"):
+			base, direction = strings.TrimSuffix(base, ".down"), "down"
+		}
+	}
+	number, name, found := strings.Cut(base, "_")
+	version, err := strconv.Atoi(number)
+	if direction == "" || !found || name == "" || err != nil || version < 1 {
+		return 0, "", "", fmt.Errorf("migration file %s is not named NNNN_name.up.sql or NNNN_name.down.sql", file)
+	}
+	return version, name, direction, nil
+}
@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+)
+
+// Password hash upgrades: which accounts still have a hash in a deprecated
+// format, and the campaign that makes them log in so it is rehashed.
+
+// PasswordHashStats counts accounts per hash version, and those in the
+// upgrade campaign
+type PasswordHashStats struct {
+	Versions map[int]int64 `json:"versions"`
+	Flagged  int64         `json:"flagged"`  // Given a deadline to log in
+	Notified int64         `json:"notified"` // Told about it
+	Enforced int64         `json:"enforced"` // Past the deadline; refresh tokens revoked
+}
+
+// HashUpgradeAccount is an account whose password hash is deprecated
+type HashUpgradeAccount struct {
+	UserID      string     `json:"user_id"`
+	Email       string     `json:"email"`
+	HashVersion int        `json:"hash_version"`
+	LastActive  *time.Time `json:"last_active"` // Last login or refresh; nil if never recorded
+	Deadline    *time.Time `json:"deadline"`    // nil until a campaign flags the account
+	NotifiedAt  *time.Time `json:"notified_at"`
+	EnforcedAt  *time.Time `json:"enforced_at"`
+}
+
+// PasswordHashStats counts the accounts of every region by hash version
+func (s *PostgresStore) PasswordHashStats() (*PasswordHashStats, error) {
+	stats := &PasswordHashStats{Versions: map[int]int64{}}
+	err := s.eachRegion(func(_ string, db *sql.DB) error {
+		rows, err := db.Query(`
+			SELECT hash_version, COUNT(*), COUNT(hash_upgrade_deadline),
+			       COUNT(hash_upgrade_notified_at), COUNT(hash_upgrade_enforced_at)
+			FROM users
+			GROUP BY hash_version
+		`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var version int
+			var count, flagged, notified, enforced int64
+			if err := rows.Scan(&version, &count, &flagged, &notified, &enforced); err != nil {
+				return err
+			}
+			stats.Versions[version] += count
+			stats.Flagged += flagged
+			stats.Notified += notified
+			stats.Enforced += enforced
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// ListDeprecatedHashAccounts returns up to limit active accounts of every
+// region whose hash is older than auth.CurrentHashVersion, soonest deadline
+// first, then least recently active
+func (s *PostgresStore) ListDeprecatedHashAccounts(limit int) ([]*HashUpgradeAccount, error) {
+	accounts, err := s.findHashUpgradeAccounts(`is_active`, "", limit)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(accounts, func(i, j int) bool {
+		a, b := accounts[i], accounts[j]
+		if (a.Deadline == nil) != (b.Deadline == nil) {
+			return a.Deadline != nil
+		}
+		if a.Deadline != nil && !a.Deadline.Equal(*b.Deadline) {
+			return a.Deadline.Before(*b.Deadline)
+		}
+		return lastActiveBefore(a.LastActive, b.LastActive)
+	})
+	if limit > 0 && len(accounts) > limit {
+		accounts = accounts[:limit]
+	}
+	return accounts, nil
+}
+
+// FindHashUpgradeAccounts returns the accounts a campaign flagged that still
+// have a deprecated hash, across regions (or just userID when set)
+func (s *PostgresStore) FindHashUpgradeAccounts(userID string) ([]*HashUpgradeAccount, error) {
+	return s.findHashUpgradeAccounts(`hash_upgrade_deadline IS NOT NULL`, userID, 0)
+}
+
+// findHashUpgradeAccounts runs one query per region; limit 0 is no limit
+func (s *PostgresStore) findHashUpgradeAccounts(condition, userID string, limit int) ([]*HashUpgradeAccount, error) {
+	query := `
+		SELECT id, email, hash_version, last_active_at,
+		       hash_upgrade_deadline, hash_upgrade_notified_at, hash_upgrade_enforced_at
+		FROM users
+		WHERE hash_version < $1 AND ($2 = '' OR id::text = $2) AND ` + condition + `
+		ORDER BY hash_upgrade_deadline NULLS LAST, last_active_at NULLS FIRST
+		LIMIT NULLIF($3, 0)
+	`
+
+	var accounts []*HashUpgradeAccount
+	err := s.eachRegion(func(_ string, db *sql.DB) error {
+		rows, err := db.Query(query, auth.CurrentHashVersion, userID, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			account := &HashUpgradeAccount{}
+			err := rows.Scan(&account.UserID, &account.Email, &account.HashVersion, &account.LastActive,
+				&account.Deadline, &account.NotifiedAt, &account.EnforcedAt)
+			if err != nil {
+				return err
+			}
+			accounts = append(accounts, account)
+		}
+		return rows.Err()
+	})
+	return accounts, err
+}
+
+// lastActiveBefore orders accounts never seen active first
+func lastActiveBefore(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b != nil
+	}
+	return a.Before(*b)
+}
+
+// StartHashUpgradeCampaign gives every active account with a deprecated
+// hash, and no deadline yet, until deadline to log in. Accounts already in
+// a campaign keep their deadline. It returns how many were flagged.
+func (s *PostgresStore) StartHashUpgradeCampaign(deadline time.Time) (int64, error) {
+	var flagged int64
+	err := s.eachRegion(func(_ string, db *sql.DB) error {
+		result, err := db.Exec(`
+			UPDATE users SET hash_upgrade_deadline = $2, updated_at = NOW()
+			WHERE hash_version < $1 AND is_active AND hash_upgrade_deadline IS NULL
+		`, auth.CurrentHashVersion, deadline)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		flagged += n
+		return err
+	})
+	return flagged, err
+}
+
+// MarkHashUpgradeNotified records that the user was told about the deadline
+func (s *PostgresStore) MarkHashUpgradeNotified(userID string, at time.Time) error {
+	return s.updateUser(userID, `
+		UPDATE users SET hash_upgrade_notified_at = $2 WHERE id = $1
+	`, at)
+}
+
+// EnforceHashUpgrade revokes the refresh tokens of a flagged user whose
+// deadline passed, so their next session starts with a login. It returns
+// false, changing nothing, when the user upgraded or was enforced already.
+func (s *PostgresStore) EnforceHashUpgrade(userID string, at time.Time) (bool, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE users SET hash_upgrade_enforced_at = $3
+		WHERE id = $1 AND hash_version < $2
+		  AND hash_upgrade_deadline IS NOT NULL AND hash_upgrade_enforced_at IS NULL
+	`, userID, auth.CurrentHashVersion, at)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	_, err = tx.Exec(`UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND revoked = false`, userID)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UpdateUserPassword sets a new password hash and salt chosen by the user,
+// taking them out of any upgrade campaign and lifting any login lockout,
+// bumps their token version and revokes their refresh tokens in the same
+// transaction, so no token issued before outlives the change. It returns
+// how many refresh tokens were revoked; sql.ErrNoRows for an unknown user.
+func (s *PostgresStore) UpdateUserPassword(userID string, hash, salt []byte, version int) (int64, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE users
+		SET password_hash = $2, salt = $3, hash_version = $4, hash_upgrade_deadline = NULL,
+		    hash_upgrade_notified_at = NULL, hash_upgrade_enforced_at = NULL,
+		    failed_login_attempts = 0, locked_until = NULL,
+		    token_version = token_version + 1, updated_at = NOW()
+		WHERE id = $1
+	`, userID, hash, salt, version)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, sql.ErrNoRows
+	}
+
+	result, err = tx.Exec(`UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND revoked = false`, userID)
+	if err != nil {
+		return 0, err
+	}
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.notifyUserChanged(userID)
+	return revoked, nil
+}
+
+// UpgradePasswordHash replaces the user's hash with one in a newer format
+// and takes them out of any campaign. A hash at least as new is kept.
+func (s *PostgresStore) UpgradePasswordHash(userID string, hash []byte, version int) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		UPDATE users
+		SET password_hash = $2, hash_version = $3, hash_upgrade_deadline = NULL,
+		    hash_upgrade_notified_at = NULL, hash_upgrade_enforced_at = NULL, updated_at = NOW()
+		WHERE id = $1 AND hash_version < $3
+	`, userID, hash, version)
+	return err
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Password resets: the tokens emailed to account owners who lost their
+// password. Tokens are looked up by their hash; the token itself is never
+// stored.
+
+// CreatePasswordResetToken stores the hash of a new reset token for the
+// user. Any earlier token of theirs stops working, so only the latest email
+// can be used.
+func (s *PostgresStore) CreatePasswordResetToken(userID string, tokenHash []byte, expiresAt time.Time) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM password_reset_tokens WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO password_reset_tokens (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, tokenHash, userID, expiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ConsumePasswordResetToken marks the token with this hash used and returns
+// its user. A token works once, and not after it expired: sql.ErrNoRows
+// when no region has it unused and unexpired at the given time.
+func (s *PostgresStore) ConsumePasswordResetToken(tokenHash []byte, at time.Time) (string, error) {
+	query := `
+		UPDATE password_reset_tokens SET used_at = $2
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2
+		RETURNING user_id
+	`
+
+	var userID string
+	err := s.eachRegion(func(_ string, db *sql.DB) error {
+		if userID != "" {
+			return nil
+		}
+		err := db.QueryRow(query, tokenHash, at).Scan(&userID)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if userID == "" {
+		return "", sql.ErrNoRows
+	}
+	return userID, nil
+}
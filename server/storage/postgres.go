@@ -1,33 +1,135 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
 	"github.com/google/uuid"
 	_ "github.com/lib/pq"
 )
 
+// querier is satisfied by both *sql.DB and *sql.Tx, so inserts can run
+// alone or as part of a larger transaction
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
 type PostgresStore struct {
-	db *sql.DB
+	db     *sql.DB // The primary database, DefaultRegion
+	config Config  // Applied to every region's database too
+
+	// Databases of the other regions, by name, and where users live
+	regions     map[string]*sql.DB
+	regionCache regionCache
+
+	// Called after any change to a user's auth-relevant columns
+	userChanged []func(userID string)
+}
+
+// Config tunes the connections of every database a PostgresStore opens.
+// Zero pool values keep database/sql's defaults.
+type Config struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+
+	// Postgres cancels any statement running longer; 0 for no limit
+	StatementTimeout time.Duration
+}
+
+// DefaultConfig bounds the pool so a burst of requests queues for
+// connections instead of exhausting the server's max_connections
+var DefaultConfig = Config{
+	MaxOpenConns:    25,
+	MaxIdleConns:    10,
+	ConnMaxLifetime: 30 * time.Minute,
 }
 
+// NewPostgresStore connects to the primary database with DefaultConfig
 func NewPostgresStore(connString string) (*PostgresStore, error) {
+	return NewPostgresStoreWithConfig(connString, DefaultConfig)
+}
+
+func NewPostgresStoreWithConfig(connString string, cfg Config) (*PostgresStore, error) {
+	db, err := openPostgres(connString, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{db: db, config: cfg}, nil
+}
+
+// openPostgres opens a database with the session settings and pool of cfg
+// and checks it is reachable
+func openPostgres(connString string, cfg Config) (*sql.DB, error) {
+	connString = withUTCSession(connString)
+	if cfg.StatementTimeout > 0 {
+		connString = withSessionSetting(connString, "statement_timeout", strconv.FormatInt(cfg.StatementTimeout.Milliseconds(), 10))
+	}
 	db, err := sql.Open("postgres", connString)
 	if err != nil {
 		return nil, err
 	}
 
+	if cfg.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(cfg.MaxOpenConns)
+	}
+	if cfg.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(cfg.MaxIdleConns)
+	}
+	if cfg.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	}
+
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
+	return db, nil
+}
 
-	return &PostgresStore{db: db}, nil
+// withUTCSession pins the session timezone to UTC unless the connection
+// string sets one, so timestamps read back (and serialized) are UTC no
+// matter how the database server is configured. Columns are TIMESTAMPTZ,
+// so this changes presentation only, never the stored instant.
+func withUTCSession(connString string) string {
+	return withSessionSetting(connString, "timezone", "UTC")
+}
+
+// withSessionSetting adds a run-time parameter, which lib/pq sends when the
+// session starts, unless the connection string sets it already
+func withSessionSetting(connString, name, value string) string {
+	if strings.Contains(strings.ToLower(connString), name+"=") {
+		return connString
+	}
+	if strings.Contains(connString, "://") {
+		if strings.Contains(connString, "?") {
+			return connString + "&" + name + "=" + value
+		}
+		return connString + "?" + name + "=" + value
+	}
+	return strings.TrimSpace(connString) + " " + name + "=" + value
+}
+
+// Ping checks that the database of every region is reachable
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.eachRegion(func(_ string, db *sql.DB) error {
+		return db.PingContext(ctx)
+	})
 }
 
 func (s *PostgresStore) Close() error {
-	return s.db.Close()
+	return s.eachRegion(func(_ string, db *sql.DB) error {
+		return db.Close()
+	})
 }
 
 // User models and methods
@@ -41,27 +143,46 @@ type User struct {
 	UpdatedAt        time.Time
 	SubscriptionTier string
 	EmailVerified    bool
+	IsAdmin          bool
+	IsActive         bool
+	TokenVersion     int
+	LegalHold        bool
+	HashVersion      int // Format of PasswordHash, one of the auth.HashVersion* values
 }
 
-func (s *PostgresStore) CreateUser(email string, passwordHash, salt []byte) (*User, error) {
+// CreateUser creates a user in region ("" for DefaultRegion). passwordHash
+// is in auth.CurrentHashVersion's format.
+func (s *PostgresStore) CreateUser(email string, passwordHash, salt []byte, region string) (*User, error) {
+	var user *User
+	err := s.createInRegion(uuid.New().String(), email, region, func(db *sql.DB, userID string) error {
+		var err error
+		user, err = insertUser(db, userID, email, passwordHash, salt)
+		return err
+	})
+	return user, err
+}
+
+func insertUser(q querier, userID, email string, passwordHash, salt []byte) (*User, error) {
 	user := &User{
-		ID:               uuid.New().String(),
+		ID:               userID,
 		Email:            email,
 		PasswordHash:     passwordHash,
 		Salt:             salt,
-		SubscriptionTier: "free",
+		SubscriptionTier: FreeTier,
 		EmailVerified:    false,
+		IsActive:         true,
+		HashVersion:      auth.CurrentHashVersion,
 	}
 
 	query := `
-		INSERT INTO users (id, email, password_hash, salt, subscription_tier, email_verified)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO users (id, email, password_hash, salt, subscription_tier, email_verified, hash_version)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 		RETURNING created_at, updated_at
 	`
 
-	err := s.db.QueryRow(query,
+	err := q.QueryRow(query,
 		user.ID, user.Email, user.PasswordHash, user.Salt,
-		user.SubscriptionTier, user.EmailVerified,
+		user.SubscriptionTier, user.EmailVerified, user.HashVersion,
 	).Scan(&user.CreatedAt, &user.UpdatedAt)
 
 	if err != nil {
@@ -71,46 +192,135 @@ func (s *PostgresStore) CreateUser(email string, passwordHash, salt []byte) (*Us
 	return user, nil
 }
 
-func (s *PostgresStore) GetUserByEmail(email string) (*User, error) {
-	user := &User{}
-	query := `
-		SELECT id, email, password_hash, salt, created_at, updated_at, 
-		       subscription_tier, email_verified
-		FROM users WHERE email = $1
-	`
+// userColumns must match scanUser
+const userColumns = `
+	id, email, password_hash, salt, created_at, updated_at,
+	subscription_tier, email_verified, is_admin, is_active, token_version,
+	legal_hold, hash_version`
 
-	err := s.db.QueryRow(query, email).Scan(
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{}
+	err := row.Scan(
 		&user.ID, &user.Email, &user.PasswordHash, &user.Salt,
 		&user.CreatedAt, &user.UpdatedAt, &user.SubscriptionTier,
-		&user.EmailVerified,
+		&user.EmailVerified, &user.IsAdmin, &user.IsActive, &user.TokenVersion,
+		&user.LegalHold, &user.HashVersion,
 	)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
 
+func (s *PostgresStore) GetUserByEmail(email string) (*User, error) {
+	db, err := s.emailDB(email)
 	if err != nil {
 		return nil, err
 	}
 
-	return user, nil
+	return scanUser(db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = $1`, email))
 }
 
 func (s *PostgresStore) GetUserByID(id string) (*User, error) {
-	user := &User{}
+	db, err := s.userDB(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanUser(db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = $1`, id))
+}
+
+// GetAuthProfile loads the columns the auth middleware checks on every request
+func (s *PostgresStore) GetAuthProfile(id string) (*auth.Profile, error) {
+	db, err := s.userDB(id)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &auth.Profile{}
 	query := `
-		SELECT id, email, password_hash, salt, created_at, updated_at,
-		       subscription_tier, email_verified
+		SELECT id, email, subscription_tier, token_version, is_active, legal_hold
 		FROM users WHERE id = $1
 	`
 
-	err := s.db.QueryRow(query, id).Scan(
-		&user.ID, &user.Email, &user.PasswordHash, &user.Salt,
-		&user.CreatedAt, &user.UpdatedAt, &user.SubscriptionTier,
-		&user.EmailVerified,
+	err = db.QueryRow(query, id).Scan(
+		&profile.UserID, &profile.Email, &profile.Tier,
+		&profile.TokenVersion, &profile.Active, &profile.LegalHold,
 	)
-
 	if err != nil {
 		return nil, err
 	}
 
-	return user, nil
+	return profile, nil
+}
+
+// OnUserChanged registers fn to run after a user's active flag, tier, token
+// version, legal hold or password changes, or the user is deleted (e.g. to
+// invalidate cached auth profiles).
+func (s *PostgresStore) OnUserChanged(fn func(userID string)) {
+	s.userChanged = append(s.userChanged, fn)
+}
+
+func (s *PostgresStore) notifyUserChanged(userID string) {
+	for _, fn := range s.userChanged {
+		fn(userID)
+	}
+}
+
+// updateUser runs a single-row users UPDATE and fires the change hooks
+func (s *PostgresStore) updateUser(userID, query string, args ...interface{}) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec(query, append([]interface{}{userID}, args...)...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	s.notifyUserChanged(userID)
+	return nil
+}
+
+func (s *PostgresStore) SetUserActive(userID string, active bool) error {
+	return s.updateUser(userID, `
+		UPDATE users SET is_active = $2, updated_at = NOW() WHERE id = $1
+	`, active)
+}
+
+func (s *PostgresStore) SetSubscriptionTier(userID, tier string) error {
+	return s.updateUser(userID, `
+		UPDATE users SET subscription_tier = $2, updated_at = NOW() WHERE id = $1
+	`, tier)
+}
+
+func (s *PostgresStore) SetUserAdmin(userID string, admin bool) error {
+	return s.updateUser(userID, `
+		UPDATE users SET is_admin = $2, updated_at = NOW() WHERE id = $1
+	`, admin)
+}
+
+// SetLegalHold freezes (or releases) the user's data. Handlers read the
+// flag from the auth profile, which the change hooks invalidate.
+func (s *PostgresStore) SetLegalHold(userID string, hold bool) error {
+	return s.updateUser(userID, `
+		UPDATE users SET legal_hold = $2, updated_at = NOW() WHERE id = $1
+	`, hold)
+}
+
+// BumpTokenVersion invalidates every access token issued to the user so far
+func (s *PostgresStore) BumpTokenVersion(userID string) error {
+	return s.updateUser(userID, `
+		UPDATE users SET token_version = token_version + 1, updated_at = NOW() WHERE id = $1
+	`)
 }
 
 // Device models and methods
@@ -124,28 +334,57 @@ type Device struct {
 	LastSync   *time.Time
 	CreatedAt  time.Time
 	IsActive   bool
+
+	MaxEncVersion int // 0 when the device never reported it
+	TrustLevel    int // A peer.TrustLevel
+
+	// The peer.Capabilities JSON the device advertised; {} when none
+	Capabilities []byte
+}
+
+// CreateDevice registers a device. capabilities is its peer.Capabilities
+// JSON, nil for none.
+func (s *PostgresStore) CreateDevice(userID, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte) (*Device, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return insertDevice(db, userID, deviceName, deviceType, publicKey, maxEncVersion, capabilities)
 }
 
-func (s *PostgresStore) CreateDevice(userID, deviceName, deviceType string, publicKey []byte) (*Device, error) {
+func insertDevice(q querier, userID, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte) (*Device, error) {
 	device := &Device{
-		ID:         uuid.New().String(),
-		UserID:     userID,
-		DeviceName: deviceName,
-		DeviceType: deviceType,
-		PublicKey:  publicKey,
-		IsActive:   true,
+		ID:            uuid.New().String(),
+		UserID:        userID,
+		DeviceName:    deviceName,
+		DeviceType:    deviceType,
+		PublicKey:     publicKey,
+		IsActive:      true,
+		MaxEncVersion: maxEncVersion,
+		Capabilities:  capabilities,
+	}
+	if len(device.Capabilities) == 0 {
+		device.Capabilities = []byte("{}")
 	}
 
+	// The account's approval setting decides whether the device starts out
+	// trusted or pending, in the same statement so it can't change between
 	query := `
-		INSERT INTO devices (id, user_id, device_name, device_type, public_key, is_active)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING created_at
+		INSERT INTO devices (id, user_id, device_name, device_type, public_key, is_active, max_enc_version, trust_level, capabilities)
+		SELECT $1, $2, $3, $4, $5, $6, NULLIF($7, 0),
+		       CASE WHEN u.device_approval = $8 THEN $9 ELSE $10 END, $11
+		FROM users u WHERE u.id = $2
+		RETURNING created_at, trust_level
 	`
 
-	err := s.db.QueryRow(query,
+	err := q.QueryRow(query,
 		device.ID, device.UserID, device.DeviceName,
 		device.DeviceType, device.PublicKey, device.IsActive,
-	).Scan(&device.CreatedAt)
+		device.MaxEncVersion, peer.DeviceApprovalOff,
+		int(peer.TrustLevelTrusted), int(peer.TrustLevelPending),
+		string(device.Capabilities),
+	).Scan(&device.CreatedAt, &device.TrustLevel)
 
 	if err != nil {
 		return nil, err
@@ -155,42 +394,150 @@ func (s *PostgresStore) CreateDevice(userID, deviceName, deviceType string, publ
 }
 
 func (s *PostgresStore) GetDevicesByUserID(userID string) ([]*Device, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
-		SELECT id, user_id, device_name, device_type, public_key, 
-		       last_sync, created_at, is_active
+		SELECT ` + deviceColumns + `
 		FROM devices WHERE user_id = $1 AND is_active = true
 		ORDER BY created_at DESC
 	`
 
-	rows, err := s.db.Query(query, userID)
+	rows, err := db.Query(query, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	return scanDevices(rows)
+}
+
+// deviceColumns must match scanDevice
+const deviceColumns = `
+	id, user_id, device_name, device_type, public_key,
+	last_sync, created_at, is_active, COALESCE(max_enc_version, 0), trust_level,
+	capabilities`
+
+func scanDevice(row rowScanner) (*Device, error) {
+	device := &Device{}
+	err := row.Scan(
+		&device.ID, &device.UserID, &device.DeviceName,
+		&device.DeviceType, &device.PublicKey, &device.LastSync,
+		&device.CreatedAt, &device.IsActive, &device.MaxEncVersion,
+		&device.TrustLevel, &device.Capabilities,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func scanDevices(rows *sql.Rows) ([]*Device, error) {
 	var devices []*Device
 	for rows.Next() {
-		device := &Device{}
-		err := rows.Scan(
-			&device.ID, &device.UserID, &device.DeviceName,
-			&device.DeviceType, &device.PublicKey, &device.LastSync,
-			&device.CreatedAt, &device.IsActive,
-		)
+		device, err := scanDevice(rows)
 		if err != nil {
 			return nil, err
 		}
 		devices = append(devices, device)
 	}
+	return devices, rows.Err()
+}
+
+// GetDevice returns one of the user's devices, active or not
+func (s *PostgresStore) GetDevice(ctx context.Context, userID, deviceID string) (*Device, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
 
-	return devices, nil
+	query := `SELECT ` + deviceColumns + ` FROM devices WHERE id = $1 AND user_id = $2`
+	return scanDevice(db.QueryRowContext(ctx, query, deviceID, userID))
 }
 
-func (s *PostgresStore) UpdateDeviceLastSync(deviceID string) error {
-	query := `UPDATE devices SET last_sync = $1 WHERE id = $2`
-	_, err := s.db.Exec(query, time.Now(), deviceID)
+// SetDeviceMaxEncVersion records the highest enc_version a device reports
+// it can decrypt. Devices of other users are left alone.
+func (s *PostgresStore) SetDeviceMaxEncVersion(userID, deviceID string, version int) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE devices SET max_enc_version = $3 WHERE id = $1 AND user_id = $2`
+	_, err = db.Exec(query, deviceID, userID, version)
 	return err
 }
 
+// SetDeviceCapabilities replaces the capabilities of one of the user's
+// active devices. A maxEncVersion above 0, the highest of the capabilities'
+// enc_versions, also becomes the device's max enc_version. sql.ErrNoRows
+// when there is no such device.
+func (s *PostgresStore) SetDeviceCapabilities(userID, deviceID string, capabilities []byte, maxEncVersion int) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE devices SET capabilities = $3, max_enc_version = COALESCE(NULLIF($4, 0), max_enc_version)
+		WHERE id = $1 AND user_id = $2 AND is_active = true
+	`
+	result, err := db.Exec(query, deviceID, userID, string(capabilities), maxEncVersion)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetDeviceEncVersions returns the reported max enc_version of each of the
+// user's active devices, 0 for devices that never reported one
+func (s *PostgresStore) GetDeviceEncVersions(ctx context.Context, userID string) ([]int, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT COALESCE(max_enc_version, 0)
+		FROM devices WHERE user_id = $1 AND is_active = true
+	`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []int
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// UpdateDeviceLastSync records that the device just synced, which also
+// withdraws any pending inactivity warning
+func (s *PostgresStore) UpdateDeviceLastSync(ctx context.Context, deviceID string) error {
+	query := `UPDATE devices SET last_sync = NOW(), inactivity_warned_at = NULL WHERE id = $1`
+	return s.eachRegion(func(_ string, db *sql.DB) error {
+		_, err := db.ExecContext(ctx, query, deviceID)
+		return err
+	})
+}
+
 // Sync state methods
 
 type SyncState struct {
@@ -199,19 +546,52 @@ type SyncState struct {
 	GenCount  int64
 	Digest    []byte
 	UpdatedAt time.Time
+
+	// Device that made the last push, and its name if it is still
+	// registered. Both are nil for pushes without a device claim.
+	LastWriterDeviceID   *string
+	LastWriterDeviceName *string
 }
 
-func (s *PostgresStore) GetSyncState(userID, zone string) (*SyncState, error) {
-	state := &SyncState{}
-	query := `
-		SELECT user_id, zone, gencount, digest, updated_at
-		FROM sync_state WHERE user_id = $1 AND zone = $2
-	`
+const syncStateColumns = `
+	s.user_id, s.zone, s.gencount, s.digest, s.updated_at,
+	s.last_writer_device_id, d.device_name
+`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
 
-	err := s.db.QueryRow(query, userID, zone).Scan(
+func scanSyncState(row rowScanner) (*SyncState, error) {
+	state := &SyncState{}
+	err := row.Scan(
 		&state.UserID, &state.Zone, &state.GenCount,
 		&state.Digest, &state.UpdatedAt,
+		&state.LastWriterDeviceID, &state.LastWriterDeviceName,
 	)
+	return state, err
+}
+
+func (s *PostgresStore) GetSyncState(userID, zone string) (*SyncState, error) {
+	return s.GetSyncStateContext(context.Background(), userID, zone)
+}
+
+// GetSyncStateContext is GetSyncState bound to ctx, for request handlers
+func (s *PostgresStore) GetSyncStateContext(ctx context.Context, userID, zone string) (*SyncState, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT ` + syncStateColumns + `
+		FROM sync_state s
+		LEFT JOIN devices d ON d.id = s.last_writer_device_id
+		WHERE s.user_id = $1 AND s.zone = $2
+	`
+
+	state, err := scanSyncState(db.QueryRowContext(ctx, query, userID, zone))
 
 	if err == sql.ErrNoRows {
 		return &SyncState{
@@ -228,7 +608,50 @@ func (s *PostgresStore) GetSyncState(userID, zone string) (*SyncState, error) {
 	return state, nil
 }
 
+// ListSyncStates returns the sync state of every zone the user has written
+func (s *PostgresStore) ListSyncStates(userID string) ([]*SyncState, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return listSyncStates(context.Background(), db, userID)
+}
+
+func listSyncStates(ctx context.Context, q rowQuerier, userID string) ([]*SyncState, error) {
+	query := `
+		SELECT ` + syncStateColumns + `
+		FROM sync_state s
+		LEFT JOIN devices d ON d.id = s.last_writer_device_id
+		WHERE s.user_id = $1
+		ORDER BY s.zone
+	`
+
+	rows, err := q.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := []*SyncState{}
+	for rows.Next() {
+		state, err := scanSyncState(rows)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, state)
+	}
+	return states, rows.Err()
+}
+
+// UpsertSyncState writes the gencount and digest only; the last writer is
+// left as it was, since repairs are not pushes
 func (s *PostgresStore) UpsertSyncState(userID, zone string, genCount int64, digest []byte) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
 	query := `
 		INSERT INTO sync_state (user_id, zone, gencount, digest)
 		VALUES ($1, $2, $3, $4)
@@ -238,13 +661,70 @@ func (s *PostgresStore) UpsertSyncState(userID, zone string, genCount int64, dig
 			updated_at = NOW()
 	`
 
-	_, err := s.db.Exec(query, userID, zone, genCount, digest)
+	_, err = db.Exec(query, userID, zone, genCount, digest)
+	return err
+}
+
+// LoadEngineState implements sync.EngineStore on top of sync_state
+func (s *PostgresStore) LoadEngineState(userID, zone string) (*sync.EngineState, error) {
+	state, err := s.GetSyncState(userID, zone)
+	if err != nil {
+		return nil, err
+	}
+	engineState := &sync.EngineState{GenCount: state.GenCount, Digest: state.Digest}
+	if state.LastWriterDeviceID != nil {
+		engineState.LastWriter = *state.LastWriterDeviceID
+	}
+	return engineState, nil
+}
+
+// SaveEngineState implements sync.EngineStore on top of sync_state. The
+// gencount never moves backwards: writes reserve theirs from the row (see
+// nextGenCounts), past what an engine may hold.
+func (s *PostgresStore) SaveEngineState(userID, zone string, state *sync.EngineState) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO sync_state (user_id, zone, gencount, digest, last_writer_device_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, '')::uuid)
+		ON CONFLICT (user_id, zone) DO UPDATE SET
+			gencount = GREATEST(sync_state.gencount, EXCLUDED.gencount),
+			digest = EXCLUDED.digest,
+			last_writer_device_id = EXCLUDED.last_writer_device_id,
+			updated_at = NOW()
+	`
+
+	_, err = db.Exec(query, userID, zone, state.GenCount, state.Digest, state.LastWriter)
 	return err
 }
 
 // Triple-layer architecture storage methods
 
 func (s *PostgresStore) CreateCryptoKey(userID, itemUUID string, key *models.CryptoKey) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	return insertCryptoKey(db, userID, itemUUID, key)
+}
+
+// parseItemIDs parses the IDs an item row is keyed by. A malformed one is an
+// error rather than the zero UUID.
+func parseItemIDs(itemUUID, userID string) (itemID, owner uuid.UUID, err error) {
+	if itemID, err = uuid.Parse(itemUUID); err != nil {
+		return uuid.Nil, uuid.Nil, fmt.Errorf("invalid item_uuid %q: %w", itemUUID, err)
+	}
+	if owner, err = uuid.Parse(userID); err != nil {
+		return uuid.Nil, uuid.Nil, fmt.Errorf("invalid user_id %q: %w", userID, err)
+	}
+	return itemID, owner, nil
+}
+
+func insertCryptoKey(q querier, userID, itemUUID string, key *models.CryptoKey) error {
 	query := `
 		INSERT INTO crypto_keys (id, user_id, item_uuid, zone, key_class, key_type, 
 			label, application_label, access_group, data, usage_flags, gencount, tombstone)
@@ -253,15 +733,18 @@ func (s *PostgresStore) CreateCryptoKey(userID, itemUUID string, key *models.Cry
 			data = EXCLUDED.data,
 			usage_flags = EXCLUDED.usage_flags,
 			gencount = EXCLUDED.gencount,
-			tombstone = EXCLUDED.tombstone
+			tombstone = EXCLUDED.tombstone,
+			wipe_id = NULL
 		RETURNING created_at, updated_at
 	`
 
 	keyID := uuid.New()
-	itemID, _ := uuid.Parse(itemUUID)
-	userIDParsed, _ := uuid.Parse(userID)
+	itemID, userIDParsed, err := parseItemIDs(itemUUID, userID)
+	if err != nil {
+		return err
+	}
 
-	err := s.db.QueryRow(query,
+	err = q.QueryRow(query,
 		keyID, userIDParsed, itemID, key.Zone, key.KeyClass, key.KeyType,
 		key.Label, key.AppLabel, key.AccGroup, key.Data, key.Flags,
 		key.GenCount, key.Tombstone,
@@ -275,39 +758,84 @@ func (s *PostgresStore) GetCryptoKeysByUser(userID, zone string, sinceGenCount i
 }
 
 func (s *PostgresStore) GetCryptoKeysByUserWithFilter(userID, zone string, sinceGenCount int64, includeTombstoned bool) ([]*models.CryptoKey, error) {
+	return s.GetCryptoKeysPage(context.Background(), userID, PullRange{Zone: zone, Since: sinceGenCount, IncludeTombstoned: includeTombstoned})
+}
+
+func (s *PostgresStore) GetCryptoKeysPage(ctx context.Context, userID string, r PullRange) ([]*models.CryptoKey, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*models.CryptoKey
+	err = streamCryptoKeys(ctx, db, userID, r, func(key *models.CryptoKey) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// streamCryptoKeys calls fn for each key in r without buffering them
+func streamCryptoKeys(ctx context.Context, q rowQuerier, userID string, r PullRange, fn func(*models.CryptoKey) error) error {
 	query := `
-		SELECT id, user_id, item_uuid, zone, key_class, key_type, label,
-		       application_label, access_group, data, usage_flags, gencount,
-		       tombstone, created_at, updated_at
+		SELECT ` + cryptoKeyColumns + `
 		FROM crypto_keys
-		WHERE user_id = $1 AND zone = $2 AND gencount > $3 AND (tombstone = false OR $4 = true)
-		ORDER BY gencount ASC
+		WHERE user_id = $1 AND zone = $2 AND ` + pullRangeFilter + `
+		ORDER BY gencount ASC, item_uuid ASC
+		OFFSET $7 LIMIT NULLIF($8::bigint, 0)
 	`
 
-	rows, err := s.db.Query(query, userID, zone, sinceGenCount, includeTombstoned)
+	rows, err := q.QueryContext(ctx, query, r.args(userID)...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	var keys []*models.CryptoKey
 	for rows.Next() {
-		key := &models.CryptoKey{}
-		err := rows.Scan(
-			&key.ID, &key.UserID, &key.ItemUUID, &key.Zone, &key.KeyClass,
-			&key.KeyType, &key.Label, &key.AppLabel, &key.AccGroup, &key.Data,
-			&key.Flags, &key.GenCount, &key.Tombstone, &key.CreatedAt, &key.UpdatedAt,
-		)
+		key, err := scanCryptoKey(rows)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
 		}
-		keys = append(keys, key)
 	}
 
-	return keys, nil
+	return rows.Err()
+}
+
+// cryptoKeyColumns must match scanCryptoKey
+const cryptoKeyColumns = `
+	id, user_id, item_uuid, zone, key_class, key_type, label,
+	application_label, access_group, data, usage_flags, gencount,
+	tombstone, created_at, updated_at`
+
+func scanCryptoKey(row rowScanner) (*models.CryptoKey, error) {
+	key := &models.CryptoKey{}
+	err := row.Scan(
+		&key.ID, &key.UserID, &key.ItemUUID, &key.Zone, &key.KeyClass,
+		&key.KeyType, &key.Label, &key.AppLabel, &key.AccGroup, &key.Data,
+		&key.Flags, &key.GenCount, &key.Tombstone, &key.CreatedAt, &key.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
 }
 
 func (s *PostgresStore) CreateCredentialMetadata(userID, itemUUID string, cred *models.CredentialMetadata) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	return insertCredentialMetadata(db, userID, itemUUID, cred)
+}
+
+func insertCredentialMetadata(q querier, userID, itemUUID string, cred *models.CredentialMetadata) error {
 	query := `
 		INSERT INTO credential_metadata (id, user_id, item_uuid, zone, server, account,
 			protocol, port, path, label, access_group, password_key_uuid, metadata_key_uuid,
@@ -318,15 +846,18 @@ func (s *PostgresStore) CreateCredentialMetadata(userID, itemUUID string, cred *
 			account = EXCLUDED.account,
 			password_key_uuid = EXCLUDED.password_key_uuid,
 			gencount = EXCLUDED.gencount,
-			tombstone = EXCLUDED.tombstone
+			tombstone = EXCLUDED.tombstone,
+			wipe_id = NULL
 		RETURNING created_at, updated_at
 	`
 
 	credID := uuid.New()
-	itemID, _ := uuid.Parse(itemUUID)
-	userIDParsed, _ := uuid.Parse(userID)
+	itemID, userIDParsed, err := parseItemIDs(itemUUID, userID)
+	if err != nil {
+		return err
+	}
 
-	err := s.db.QueryRow(query,
+	err = q.QueryRow(query,
 		credID, userIDParsed, itemID, cred.Zone, cred.Server, cred.Account,
 		cred.Protocol, cred.Port, cred.Path, cred.Label, cred.AccGroup,
 		cred.PasswordKeyUUID, cred.MetadataKeyUUID, cred.GenCount, cred.Tombstone,
@@ -340,40 +871,85 @@ func (s *PostgresStore) GetCredentialMetadataByUser(userID, zone string, sinceGe
 }
 
 func (s *PostgresStore) GetCredentialMetadataByUserWithFilter(userID, zone string, sinceGenCount int64, includeTombstoned bool) ([]*models.CredentialMetadata, error) {
+	return s.GetCredentialMetadataPage(context.Background(), userID, PullRange{Zone: zone, Since: sinceGenCount, IncludeTombstoned: includeTombstoned})
+}
+
+func (s *PostgresStore) GetCredentialMetadataPage(ctx context.Context, userID string, r PullRange) ([]*models.CredentialMetadata, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds []*models.CredentialMetadata
+	err = streamCredentialMetadata(ctx, db, userID, r, func(cred *models.CredentialMetadata) error {
+		creds = append(creds, cred)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// streamCredentialMetadata calls fn for each credential in r without buffering them
+func streamCredentialMetadata(ctx context.Context, q rowQuerier, userID string, r PullRange, fn func(*models.CredentialMetadata) error) error {
 	query := `
-		SELECT id, user_id, item_uuid, zone, server, account, protocol, port,
-		       path, label, access_group, password_key_uuid, metadata_key_uuid,
-		       gencount, tombstone, created_at, updated_at
+		SELECT ` + credentialMetadataColumns + `
 		FROM credential_metadata
-		WHERE user_id = $1 AND zone = $2 AND gencount > $3 AND (tombstone = false OR $4 = true)
-		ORDER BY gencount ASC
+		WHERE user_id = $1 AND zone = $2 AND ` + pullRangeFilter + `
+		ORDER BY gencount ASC, item_uuid ASC
+		OFFSET $7 LIMIT NULLIF($8::bigint, 0)
 	`
 
-	rows, err := s.db.Query(query, userID, zone, sinceGenCount, includeTombstoned)
+	rows, err := q.QueryContext(ctx, query, r.args(userID)...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	var creds []*models.CredentialMetadata
 	for rows.Next() {
-		cred := &models.CredentialMetadata{}
-		err := rows.Scan(
-			&cred.ID, &cred.UserID, &cred.ItemUUID, &cred.Zone, &cred.Server,
-			&cred.Account, &cred.Protocol, &cred.Port, &cred.Path, &cred.Label,
-			&cred.AccGroup, &cred.PasswordKeyUUID, &cred.MetadataKeyUUID,
-			&cred.GenCount, &cred.Tombstone, &cred.CreatedAt, &cred.UpdatedAt,
-		)
+		cred, err := scanCredentialMetadata(rows)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := fn(cred); err != nil {
+			return err
 		}
-		creds = append(creds, cred)
 	}
 
-	return creds, nil
+	return rows.Err()
+}
+
+// credentialMetadataColumns must match scanCredentialMetadata
+const credentialMetadataColumns = `
+	id, user_id, item_uuid, zone, server, account, protocol, port,
+	path, label, access_group, password_key_uuid, metadata_key_uuid,
+	gencount, tombstone, created_at, updated_at`
+
+func scanCredentialMetadata(row rowScanner) (*models.CredentialMetadata, error) {
+	cred := &models.CredentialMetadata{}
+	err := row.Scan(
+		&cred.ID, &cred.UserID, &cred.ItemUUID, &cred.Zone, &cred.Server,
+		&cred.Account, &cred.Protocol, &cred.Port, &cred.Path, &cred.Label,
+		&cred.AccGroup, &cred.PasswordKeyUUID, &cred.MetadataKeyUUID,
+		&cred.GenCount, &cred.Tombstone, &cred.CreatedAt, &cred.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return cred, nil
 }
 
 func (s *PostgresStore) CreateSyncRecord(userID, itemUUID string, record *models.SyncRecord) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	return insertSyncRecord(db, userID, itemUUID, record)
+}
+
+func insertSyncRecord(q querier, userID, itemUUID string, record *models.SyncRecord) error {
 	query := `
 		INSERT INTO sync_records (id, user_id, item_uuid, zone, parent_key_uuid,
 			wrapped_key, enc_item, enc_version, context_id, gencount, tombstone)
@@ -382,15 +958,18 @@ func (s *PostgresStore) CreateSyncRecord(userID, itemUUID string, record *models
 			wrapped_key = EXCLUDED.wrapped_key,
 			enc_item = EXCLUDED.enc_item,
 			gencount = EXCLUDED.gencount,
-			tombstone = EXCLUDED.tombstone
+			tombstone = EXCLUDED.tombstone,
+			wipe_id = NULL
 		RETURNING created_at, updated_at
 	`
 
 	recordID := uuid.New()
-	itemID, _ := uuid.Parse(itemUUID)
-	userIDParsed, _ := uuid.Parse(userID)
+	itemID, userIDParsed, err := parseItemIDs(itemUUID, userID)
+	if err != nil {
+		return err
+	}
 
-	err := s.db.QueryRow(query,
+	err = q.QueryRow(query,
 		recordID, userIDParsed, itemID, record.Zone, record.ParentKeyUUID,
 		record.WrappedKey, record.EncItem, record.EncVersion, record.ContextID,
 		record.GenCount, record.Tombstone,
@@ -404,37 +983,73 @@ func (s *PostgresStore) GetSyncRecordsByUser(userID, zone string, sinceGenCount
 }
 
 func (s *PostgresStore) GetSyncRecordsByUserWithFilter(userID, zone string, sinceGenCount int64, includeTombstoned bool) ([]*models.SyncRecord, error) {
+	return s.GetSyncRecordsPage(context.Background(), userID, PullRange{Zone: zone, Since: sinceGenCount, IncludeTombstoned: includeTombstoned})
+}
+
+func (s *PostgresStore) GetSyncRecordsPage(ctx context.Context, userID string, r PullRange) ([]*models.SyncRecord, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []*models.SyncRecord
+	err = streamSyncRecords(ctx, db, userID, r, func(record *models.SyncRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// streamSyncRecords calls fn for each sync record in r without buffering them
+func streamSyncRecords(ctx context.Context, q rowQuerier, userID string, r PullRange, fn func(*models.SyncRecord) error) error {
 	query := `
-		SELECT id, user_id, item_uuid, zone, parent_key_uuid, wrapped_key,
-		       enc_item, enc_version, context_id, gencount, tombstone,
-		       created_at, updated_at
+		SELECT ` + syncRecordColumns + `
 		FROM sync_records
-		WHERE user_id = $1 AND zone = $2 AND gencount > $3 AND (tombstone = false OR $4 = true)
-		ORDER BY gencount ASC
+		WHERE user_id = $1 AND zone = $2 AND ` + pullRangeFilter + `
+		ORDER BY gencount ASC, item_uuid ASC
+		OFFSET $7 LIMIT NULLIF($8::bigint, 0)
 	`
 
-	rows, err := s.db.Query(query, userID, zone, sinceGenCount, includeTombstoned)
+	rows, err := q.QueryContext(ctx, query, r.args(userID)...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	var records []*models.SyncRecord
 	for rows.Next() {
-		record := &models.SyncRecord{}
-		err := rows.Scan(
-			&record.ID, &record.UserID, &record.ItemUUID, &record.Zone,
-			&record.ParentKeyUUID, &record.WrappedKey, &record.EncItem,
-			&record.EncVersion, &record.ContextID, &record.GenCount,
-			&record.Tombstone, &record.CreatedAt, &record.UpdatedAt,
-		)
+		record, err := scanSyncRecord(rows)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
 		}
-		records = append(records, record)
 	}
 
-	return records, nil
+	return rows.Err()
+}
+
+// syncRecordColumns must match scanSyncRecord
+const syncRecordColumns = `
+	id, user_id, item_uuid, zone, parent_key_uuid, wrapped_key,
+	enc_item, enc_version, context_id, gencount, tombstone,
+	created_at, updated_at`
+
+func scanSyncRecord(row rowScanner) (*models.SyncRecord, error) {
+	record := &models.SyncRecord{}
+	err := row.Scan(
+		&record.ID, &record.UserID, &record.ItemUUID, &record.Zone,
+		&record.ParentKeyUUID, &record.WrappedKey, &record.EncItem,
+		&record.EncVersion, &record.ContextID, &record.GenCount,
+		&record.Tombstone, &record.CreatedAt, &record.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
 }
 
 func (s *PostgresStore) GetAllSyncRecordsByUser(userID, zone string) ([]*models.SyncRecord, error) {
@@ -453,6 +1068,11 @@ type RefreshToken struct {
 }
 
 func (s *PostgresStore) CreateRefreshToken(userID string, deviceID *string, expiresAt time.Time) (*RefreshToken, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
 	token := &RefreshToken{
 		Token:     uuid.New().String(),
 		UserID:    userID,
@@ -467,7 +1087,7 @@ func (s *PostgresStore) CreateRefreshToken(userID string, deviceID *string, expi
 		RETURNING created_at
 	`
 
-	err := s.db.QueryRow(query, token.Token, token.UserID, token.DeviceID, token.ExpiresAt).
+	err = db.QueryRow(query, token.Token, token.UserID, token.DeviceID, token.ExpiresAt).
 		Scan(&token.CreatedAt)
 
 	if err != nil {
@@ -477,27 +1097,99 @@ func (s *PostgresStore) CreateRefreshToken(userID string, deviceID *string, expi
 	return token, nil
 }
 
+// GetRefreshToken looks the token up in every region; sql.ErrNoRows if
+// none has it
 func (s *PostgresStore) GetRefreshToken(token string) (*RefreshToken, error) {
-	rt := &RefreshToken{}
 	query := `
 		SELECT token, user_id, device_id, expires_at, created_at, revoked
 		FROM refresh_tokens WHERE token = $1
 	`
 
-	err := s.db.QueryRow(query, token).Scan(
-		&rt.Token, &rt.UserID, &rt.DeviceID, &rt.ExpiresAt,
-		&rt.CreatedAt, &rt.Revoked,
-	)
+	var found *RefreshToken
+	err := s.eachRegion(func(_ string, db *sql.DB) error {
+		rt := &RefreshToken{}
+		err := db.QueryRow(query, token).Scan(
+			&rt.Token, &rt.UserID, &rt.DeviceID, &rt.ExpiresAt,
+			&rt.CreatedAt, &rt.Revoked,
+		)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err == nil && found == nil {
+			found = rt
+		}
+		return err
+	})
 
 	if err != nil {
 		return nil, err
 	}
+	if found == nil {
+		return nil, sql.ErrNoRows
+	}
 
-	return rt, nil
+	return found, nil
 }
 
 func (s *PostgresStore) RevokeRefreshToken(token string) error {
 	query := `UPDATE refresh_tokens SET revoked = true WHERE token = $1`
-	_, err := s.db.Exec(query, token)
-	return err
+	return s.eachRegion(func(_ string, db *sql.DB) error {
+		_, err := db.Exec(query, token)
+		return err
+	})
+}
+
+// RevokeRefreshTokensByUser revokes every refresh token of a user, returning
+// how many were still valid
+func (s *PostgresStore) RevokeRefreshTokensByUser(userID string) (int64, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.Exec(`UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND revoked = false`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// SearchCredentialMetadata returns live credentials whose server, account, or
+// label contains query (case-insensitive), ordered by server then account.
+func (s *PostgresStore) SearchCredentialMetadata(userID, zone, query string) ([]*models.CredentialMetadata, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	sqlQuery := `
+		SELECT ` + credentialMetadataColumns + `
+		FROM credential_metadata
+		WHERE user_id = $1 AND zone = $2 AND tombstone = false
+		  AND (server ILIKE $3 OR account ILIKE $3 OR label ILIKE $3)
+		ORDER BY lower(server) ASC, lower(account) ASC
+	`
+
+	pattern := "%" + escapeLike(query) + "%"
+	rows, err := db.Query(sqlQuery, userID, zone, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var creds []*models.CredentialMetadata
+	for rows.Next() {
+		cred, err := scanCredentialMetadata(rows)
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, cred)
+	}
+
+	return creds, nil
+}
+
+// escapeLike escapes LIKE wildcards so user input matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
 }
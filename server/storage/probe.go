@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ItemState is where one item stands in its zone
+type ItemState struct {
+	Layer     string // One of the mapping.Layer* names
+	GenCount  int64
+	Tombstone bool
+}
+
+// ItemStates maps item UUIDs to their state
+type ItemStates map[uuid.UUID]ItemState
+
+// Add records the state of an item. A UUID used in more than one layer
+// keeps its most recent write.
+func (s ItemStates) Add(id uuid.UUID, state ItemState) {
+	if current, ok := s[id]; ok && current.GenCount >= state.GenCount {
+		return
+	}
+	s[id] = state
+}
+
+// ItemProbe asks for the state of a set of items in one of a user's zones
+type ItemProbe struct {
+	UserID    string
+	Zone      string
+	ItemUUIDs []uuid.UUID
+}
+
+// Matches reports whether the probe query selects an item row; it is the
+// WHERE clause of ProbeItems for callers outside SQL
+func (p ItemProbe) Matches(userID, zone string, itemUUID uuid.UUID) bool {
+	if userID != p.UserID || zone != p.Zone {
+		return false
+	}
+	for _, id := range p.ItemUUIDs {
+		if id == itemUUID {
+			return true
+		}
+	}
+	return false
+}
+
+var probeLayers = []struct {
+	table string
+	layer string
+}{
+	{"crypto_keys", "crypto_key"},
+	{"credential_metadata", "credential_metadata"},
+	{"sync_records", "sync_record"},
+}
+
+// ProbeItems returns the state of the probed items, one ANY query per
+// layer. Items the user doesn't have in the zone are absent, whoever else
+// holds them.
+func (s *PostgresStore) ProbeItems(ctx context.Context, probe ItemProbe) (ItemStates, error) {
+	db, err := s.userDB(probe.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, len(probe.ItemUUIDs))
+	for i, id := range probe.ItemUUIDs {
+		ids[i] = id.String()
+	}
+
+	states := ItemStates{}
+	for _, l := range probeLayers {
+		query := `
+			SELECT item_uuid, gencount, COALESCE(tombstone, false)
+			FROM ` + l.table + `
+			WHERE user_id = $1 AND zone = $2 AND item_uuid = ANY($3::uuid[])
+		`
+		rows, err := db.QueryContext(ctx, query, probe.UserID, probe.Zone, pq.Array(ids))
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id uuid.UUID
+			state := ItemState{Layer: l.layer}
+			if err := rows.Scan(&id, &state.GenCount, &state.Tombstone); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			states.Add(id, state)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return states, nil
+}
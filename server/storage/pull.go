@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// PullRange selects one layer's slice of a pull, ordered by gencount then
+// item UUID so offsets are stable while the zone is unchanged
+type PullRange struct {
+	Zone              string
+	Since             int64 // Exclusive
+	Until             int64 // Inclusive watermark; 0 means no upper bound
+	IncludeTombstoned bool
+	// ItemUUIDs narrows the range to these items, e.g. the ones a manifest
+	// diff found diverged; nil means every item
+	ItemUUIDs []uuid.UUID
+	Offset    int
+	Limit     int // 0 means no limit
+}
+
+// pullRangeFilter uses PullRange.args' $3-$6
+const pullRangeFilter = `gencount > $3 AND ($4::bigint = 0 OR gencount <= $4) AND (tombstone = false OR $5 = true)
+	AND ($6::uuid[] IS NULL OR item_uuid = ANY($6::uuid[]))`
+
+// Includes reports whether an item at genCount falls in the range, ignoring
+// item UUIDs, offset and limit; with Selects it is pullRangeFilter for
+// callers outside SQL
+func (r PullRange) Includes(genCount int64, tombstone bool) bool {
+	return genCount > r.Since && (r.Until == 0 || genCount <= r.Until) && (!tombstone || r.IncludeTombstoned)
+}
+
+// Selects reports whether the range's item UUIDs, if any, hold itemUUID
+func (r PullRange) Selects(itemUUID uuid.UUID) bool {
+	if r.ItemUUIDs == nil {
+		return true
+	}
+	for _, id := range r.ItemUUIDs {
+		if id == itemUUID {
+			return true
+		}
+	}
+	return false
+}
+
+// SuppressBootstrapTombstones excludes tombstones from a pull starting at
+// gencount 0: a fresh device has nothing to delete, and an old account's
+// tombstones can far outnumber its live items. It reports whether the pull
+// is such a bootstrap; later pulls keep include_tombstoned as asked.
+func (r *PullRange) SuppressBootstrapTombstones() bool {
+	if r.Since != 0 {
+		return false
+	}
+	r.IncludeTombstoned = false
+	return true
+}
+
+func (r PullRange) args(userID string) []interface{} {
+	var items interface{}
+	if r.ItemUUIDs != nil {
+		items = pq.Array(uuidStrings(r.ItemUUIDs))
+	}
+	return []interface{}{userID, r.Zone, r.Since, r.Until, r.IncludeTombstoned, items, r.Offset, r.Limit}
+}
+
+// PullCounts is the number of items each layer has in a pull window
+type PullCounts struct {
+	Keys     int
+	Metadata int
+	Records  int
+}
+
+// CountPullWindow counts the items of every layer in the range, ignoring
+// its offset and limit
+func (s *PostgresStore) CountPullWindow(ctx context.Context, userID string, r PullRange) (*PullCounts, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		SELECT
+			(SELECT COUNT(*) FROM crypto_keys WHERE user_id = $1 AND zone = $2 AND ` + pullRangeFilter + `),
+			(SELECT COUNT(*) FROM credential_metadata WHERE user_id = $1 AND zone = $2 AND ` + pullRangeFilter + `),
+			(SELECT COUNT(*) FROM sync_records WHERE user_id = $1 AND zone = $2 AND ` + pullRangeFilter + `)
+	`
+
+	var counts PullCounts
+	args := r.args(userID)[:6]
+	err = db.QueryRowContext(ctx, query, args...).Scan(&counts.Keys, &counts.Metadata, &counts.Records)
+	if err != nil {
+		return nil, err
+	}
+	return &counts, nil
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/lib/pq"
+)
+
+// PushBatch is one push's items, converted. CommitPush numbers them.
+type PushBatch struct {
+	Zone     string
+	GenCount int64  // Highest gencount in the batch; set by CommitPush
+	DeviceID string // Writer; "" for clients without a device claim
+	Sequence int64  // The device's push sequence; 0 for unnumbered pushes
+	Keys     []*models.CryptoKey
+	Metadata []*models.CredentialMetadata
+	Records  []*models.SyncRecord
+}
+
+// Len is the number of items in the batch
+func (b *PushBatch) Len() int64 {
+	return int64(len(b.Keys) + len(b.Metadata) + len(b.Records))
+}
+
+// Number gives the batch's items the gencounts of r, which holds Len of
+// them: keys first, then metadata, then records
+func (b *PushBatch) Number(r GenCountRange) {
+	genCount := r.First
+	for _, key := range b.Keys {
+		key.GenCount = genCount
+		genCount++
+	}
+	for _, cred := range b.Metadata {
+		cred.GenCount = genCount
+		genCount++
+	}
+	for _, record := range b.Records {
+		record.GenCount = genCount
+		genCount++
+	}
+	b.GenCount = r.Last
+}
+
+// PushItemError is an item of a push the database refused, e.g. for a
+// constraint it violates. The rest of the push is unaffected.
+type PushItemError struct {
+	Layer string // crypto_key, credential_metadata or sync_record
+	Index int    // Position in the batch's slice of that layer
+	Err   error
+}
+
+func (e *PushItemError) Error() string {
+	return fmt.Sprintf("%s %d: %v", e.Layer, e.Index, e.Err)
+}
+
+func (e *PushItemError) Unwrap() error { return e.Err }
+
+// CommitPush numbers a push's items from the zone's gencounts (see
+// nextGenCounts) and writes them in one transaction. Each item is written
+// under its own savepoint: one the database refuses is rolled back alone and
+// reported as a *PushItemError, while any other failure aborts the whole
+// push. The manifest digest is maintained after commit (see
+// ComputeManifest). A numbered push that isn't the device's next writes
+// nothing and returns a *sync.PushSequenceError.
+func (s *PostgresStore) CommitPush(ctx context.Context, userID string, batch *PushBatch) ([]*PushItemError, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if batch.Sequence > 0 {
+		if err := advancePushSequence(ctx, tx, userID, batch.DeviceID, batch.Sequence); err != nil {
+			return nil, err
+		}
+	}
+	genCounts, err := nextGenCounts(ctx, tx, userID, batch.Zone, batch.Len())
+	if err != nil {
+		return nil, err
+	}
+	batch.Number(genCounts)
+
+	var rejected []*PushItemError
+	writeItem := func(layer string, index int, insert func() error) error {
+		if _, err := tx.ExecContext(ctx, `SAVEPOINT push_item`); err != nil {
+			return err
+		}
+		if err := insert(); err != nil {
+			if !isItemRejected(err) {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT push_item`); err != nil {
+				return err
+			}
+			rejected = append(rejected, &PushItemError{Layer: layer, Index: index, Err: err})
+			return nil
+		}
+		_, err := tx.ExecContext(ctx, `RELEASE SAVEPOINT push_item`)
+		return err
+	}
+
+	for i, key := range batch.Keys {
+		err := writeItem("crypto_key", i, func() error {
+			return insertCryptoKey(tx, userID, key.ItemUUID.String(), key)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, cred := range batch.Metadata {
+		err := writeItem("credential_metadata", i, func() error {
+			return insertCredentialMetadata(tx, userID, cred.ItemUUID.String(), cred)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, record := range batch.Records {
+		err := writeItem("sync_record", i, func() error {
+			return insertSyncRecord(tx, userID, record.ItemUUID.String(), record)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The gencount moved with the reservation; an empty push creates the
+	// zone's row
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO sync_state (user_id, zone, gencount, last_writer_device_id)
+		VALUES ($1, $2, $3, NULLIF($4, '')::uuid)
+		ON CONFLICT (user_id, zone) DO UPDATE SET
+			last_writer_device_id = EXCLUDED.last_writer_device_id,
+			updated_at = NOW()
+	`, userID, batch.Zone, batch.GenCount, batch.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return rejected, nil
+}
+
+// isItemRejected reports whether Postgres refused an item for its content:
+// a data exception (class 22) or an integrity constraint violation
+// (class 23), as opposed to a failure of the connection or transaction
+func isItemRejected(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	class := pqErr.Code.Class()
+	return class == "22" || class == "23"
+}
+
+// advancePushSequence records sequence as the device's last applied push if
+// it is the next one. The row stays locked until the push commits, so
+// concurrent pushes of one device are checked one after the other.
+func advancePushSequence(ctx context.Context, tx *sql.Tx, userID, deviceID string, sequence int64) error {
+	var last int64
+	err := tx.QueryRowContext(ctx, `
+		SELECT last_sequence FROM device_push_sequences
+		WHERE user_id = $1 AND device_id = $2
+		FOR UPDATE
+	`, userID, deviceID).Scan(&last)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err := sync.CheckPushSequence(last, sequence); err != nil {
+		return err
+	}
+
+	if last > 0 {
+		_, err := tx.ExecContext(ctx, `
+			UPDATE device_push_sequences SET last_sequence = $3, updated_at = NOW()
+			WHERE user_id = $1 AND device_id = $2
+		`, userID, deviceID, sequence)
+		return err
+	}
+
+	// The device's first numbered push, so sequence is 1. A racing push of
+	// 1 that got here first makes this one wait for it to commit, after
+	// which this one is a duplicate.
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO device_push_sequences (user_id, device_id, last_sequence)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, device_id) DO NOTHING
+	`, userID, deviceID, sequence)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	return &sync.PushSequenceError{Expected: sequence + 1, Received: sequence}
+}
+
+// LiveLeafIDs returns the item UUIDs of a zone's live sync records, the
+// leaves of its version 1 manifest digest (sync.LegacyManifestDigest), sorted
+func (s *PostgresStore) LiveLeafIDs(ctx context.Context, userID, zone string) ([]string, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	return liveLeafIDs(ctx, db, userID, zone)
+}
+
+// rowQuerier is a *sql.DB or *sql.Tx
+type rowQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func liveLeafIDs(ctx context.Context, q rowQuerier, userID, zone string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT item_uuid FROM sync_records
+		WHERE user_id = $1 AND zone = $2 AND tombstone = false
+		ORDER BY item_uuid
+	`, userID, zone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leafIDs := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		leafIDs = append(leafIDs, id)
+	}
+	return leafIDs, rows.Err()
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Moving a user to another region
+
+var (
+	// ErrUserActive is returned when migrating a user who can still sync
+	ErrUserActive = errors.New("user is active; deactivate the account before migrating it")
+	// ErrUserOnHold is returned when migrating a user on legal hold, whose
+	// rows must stay where they are
+	ErrUserOnHold = errors.New("user is on legal hold")
+)
+
+// residentTable is a table holding a user's rows, selected by userColumn
+type residentTable struct {
+	name       string
+	userColumn string
+	// Generated key the target assigns anew, left out of the copy and the
+	// digest, and the columns copied instead of all of them
+	serialColumn string
+	columns      string
+}
+
+// residentTables lists every table with a user's rows, parents before the
+// tables referencing them
+var residentTables = []residentTable{
+	{name: "users", userColumn: "id"},
+	{name: "devices", userColumn: "user_id"},
+	{name: "sync_state", userColumn: "user_id"},
+	{name: "crypto_keys", userColumn: "user_id"},
+	{name: "credential_metadata", userColumn: "user_id"},
+	{name: "sync_records", userColumn: "user_id"},
+	{name: "refresh_tokens", userColumn: "user_id"},
+	{name: "device_push_sequences", userColumn: "user_id"},
+	{name: "bulk_wipes", userColumn: "user_id"},
+	{name: "sync_conflicts", userColumn: "user_id"},
+	{name: "breach_monitors", userColumn: "user_id"},
+	{name: "breach_alerts", userColumn: "user_id"},
+	{name: "audit_events", userColumn: "user_id", serialColumn: "id",
+		columns: "user_id, actor_id, device_id, action, zone, item_uuid, ip_address, details, created_at"},
+}
+
+// TableDigest summarizes a user's rows in one table: their number and an md5
+// over the rows as JSONB, which orders keys the same way whatever order the
+// columns were added in
+type TableDigest struct {
+	Table  string `json:"table"`
+	Rows   int64  `json:"rows"`
+	Digest string `json:"digest"`
+}
+
+// RegionMigration reports a user's move to another region
+type RegionMigration struct {
+	UserID string        `json:"user_id"`
+	From   string        `json:"from"`
+	To     string        `json:"to"`
+	Tables []TableDigest `json:"tables"`
+}
+
+// CompareTableDigests returns an error naming every table whose copy
+// differs from the source
+func CompareTableDigests(source, target []TableDigest) error {
+	targets := make(map[string]TableDigest, len(target))
+	for _, digest := range target {
+		targets[digest.Table] = digest
+	}
+
+	var errs []error
+	for _, want := range source {
+		got, ok := targets[want.Table]
+		switch {
+		case !ok:
+			errs = append(errs, fmt.Errorf("%s: not copied", want.Table))
+		case got.Rows != want.Rows:
+			errs = append(errs, fmt.Errorf("%s: %d rows copied, source has %d", want.Table, got.Rows, want.Rows))
+		case got.Digest != want.Digest:
+			errs = append(errs, fmt.Errorf("%s: copied rows differ from the source", want.Table))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MigrateUser moves a deactivated user's rows to the target region. The
+// rows are copied in one transaction on the target and verified against
+// the source (row counts and digests) before it commits; then the user's
+// directory entry is pointed at the target and the source rows are
+// deleted. A copy left on the target by an earlier failed run is replaced.
+//
+// Other processes keep routing the user to the old region for up to
+// RegionCacheTTL, which is why the user must stay deactivated until then.
+// Audit events get new IDs on the target, so audit cursors issued before
+// the move are invalidated.
+func (s *PostgresStore) MigrateUser(ctx context.Context, userID, target string) (*RegionMigration, error) {
+	if len(s.regions) == 0 {
+		return nil, fmt.Errorf("no regions besides %s are configured", DefaultRegion)
+	}
+	targetDB, err := s.regionDB(target)
+	if err != nil {
+		return nil, err
+	}
+
+	s.regionCache.forget(userID)
+	source, err := s.UserRegion(userID)
+	if err != nil {
+		return nil, err
+	}
+	if source == target {
+		return nil, fmt.Errorf("user already lives in %s", target)
+	}
+	sourceDB, err := s.regionDB(source)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.IsActive {
+		return nil, ErrUserActive
+	}
+	if user.LegalHold {
+		return nil, ErrUserOnHold
+	}
+
+	want, err := digestUserRows(ctx, sourceDB, userID)
+	if err != nil {
+		return nil, fmt.Errorf("digest %s: %w", source, err)
+	}
+
+	tx, err := targetDB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Cascades to every other table
+	if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, userID); err != nil {
+		return nil, err
+	}
+	for _, table := range residentTables {
+		if err := copyUserRows(ctx, sourceDB, tx, table, userID); err != nil {
+			return nil, fmt.Errorf("copy %s: %w", table.name, err)
+		}
+	}
+
+	got, err := digestUserRows(ctx, tx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("digest %s: %w", target, err)
+	}
+	if err := CompareTableDigests(want, got); err != nil {
+		return nil, fmt.Errorf("verify copy: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO user_regions (user_id, email, region) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET region = EXCLUDED.region
+	`, userID, user.Email, target)
+	s.regionCache.forget(userID)
+	if err != nil {
+		return nil, fmt.Errorf("copied to %s but the directory still points at %s: %w", target, source, err)
+	}
+
+	if _, err := sourceDB.ExecContext(ctx, `DELETE FROM users WHERE id = $1`, userID); err != nil {
+		return nil, fmt.Errorf("moved to %s but the rows left in %s could not be deleted: %w", target, source, err)
+	}
+
+	return &RegionMigration{UserID: userID, From: source, To: target, Tables: want}, nil
+}
+
+// contextQuerier is satisfied by both *sql.DB and *sql.Tx
+type contextQuerier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// copyUserRows streams a user's rows of one table from the source database
+// into the target transaction as JSON, so the copy doesn't depend on the
+// column order of either database
+func copyUserRows(ctx context.Context, source *sql.DB, target *sql.Tx, table residentTable, userID string) error {
+	order := table.userColumn
+	if table.serialColumn != "" {
+		order = table.serialColumn
+	}
+	rows, err := source.QueryContext(ctx, `
+		SELECT row_to_json(t)::text FROM `+table.name+` t
+		WHERE `+table.userColumn+` = $1 ORDER BY `+order, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	insert := `INSERT INTO ` + table.name + ` SELECT * FROM json_populate_record(NULL::` + table.name + `, $1::json)`
+	if table.columns != "" {
+		insert = `
+			INSERT INTO ` + table.name + ` (` + table.columns + `)
+			SELECT ` + table.columns + ` FROM json_populate_record(NULL::` + table.name + `, $1::json)`
+	}
+	stmt, err := target.PrepareContext(ctx, insert)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// digestUserRows counts and digests a user's rows in every resident table
+func digestUserRows(ctx context.Context, q contextQuerier, userID string) ([]TableDigest, error) {
+	digests := make([]TableDigest, 0, len(residentTables))
+	for _, table := range residentTables {
+		row := `to_jsonb(t)`
+		if table.serialColumn != "" {
+			row = `(to_jsonb(t) - '` + table.serialColumn + `')`
+		}
+
+		digest := TableDigest{Table: table.name}
+		err := q.QueryRowContext(ctx, `
+			SELECT COUNT(*), COALESCE(md5(string_agg(`+row+`::text, E'\n' ORDER BY `+row+`::text)), '')
+			FROM `+table.name+` t WHERE `+table.userColumn+` = $1
+		`, userID).Scan(&digest.Rows, &digest.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", table.name, err)
+		}
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Data residency
+//
+// Every user lives in exactly one region: all of their rows are stored in
+// that region's database. The primary database (the one NewPostgresStore
+// opens) is DefaultRegion; it also holds the user_regions directory that
+// maps each user of another region to it, and the job reports. A user with
+// no directory row lives in DefaultRegion, so a deployment without extra
+// regions never reads the directory.
+
+// DefaultRegion names the primary database
+const DefaultRegion = "default"
+
+// RegionCacheTTL is how long a user's region is cached. A migration done by
+// another process becomes visible to a running server within this time.
+const RegionCacheTTL = 30 * time.Second
+
+// ErrUnknownRegion is returned for a region no database is configured for
+var ErrUnknownRegion = errors.New("unknown region")
+
+// ErrEmailTaken is returned when registering an email another region's
+// user already has
+var ErrEmailTaken = errors.New("email already registered")
+
+// regionCache remembers users' regions for RegionCacheTTL
+type regionCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedRegion
+}
+
+type cachedRegion struct {
+	region  string
+	expires time.Time
+}
+
+func (c *regionCache) get(userID string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.entries[userID]
+	if !ok || !time.Now().Before(cached.expires) {
+		return "", false
+	}
+	return cached.region, true
+}
+
+func (c *regionCache) set(userID, region string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = map[string]cachedRegion{}
+	}
+	c.entries[userID] = cachedRegion{region: region, expires: time.Now().Add(RegionCacheTTL)}
+}
+
+func (c *regionCache) forget(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, userID)
+}
+
+// ParseRegions parses a DATABASE_REGIONS value, a comma-separated list of
+// name=connection-string pairs, into connection strings by region name
+func ParseRegions(value string) (map[string]string, error) {
+	regions := map[string]string{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, conn, ok := strings.Cut(entry, "=")
+		name, conn = strings.TrimSpace(name), strings.TrimSpace(conn)
+		if !ok || conn == "" {
+			return nil, fmt.Errorf("region %q has no connection string", name)
+		}
+		if err := ValidateRegionName(name); err != nil {
+			return nil, err
+		}
+		if name == DefaultRegion {
+			return nil, fmt.Errorf("region %q is the primary database and can't be redefined", name)
+		}
+		if _, dup := regions[name]; dup {
+			return nil, fmt.Errorf("region %q is listed twice", name)
+		}
+		regions[name] = conn
+	}
+	return regions, nil
+}
+
+// ValidateRegionName checks a region name: lowercase letters, digits and
+// dashes, at most 32 characters
+func ValidateRegionName(name string) error {
+	if name == "" || len(name) > 32 {
+		return fmt.Errorf("region name %q must be 1-32 characters", name)
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return fmt.Errorf("region name %q may only contain a-z, 0-9 and '-'", name)
+		}
+	}
+	return nil
+}
+
+// AddRegion opens the database of an additional region
+func (s *PostgresStore) AddRegion(name, connString string) error {
+	if err := ValidateRegionName(name); err != nil {
+		return err
+	}
+	if s.HasRegion(name) {
+		return fmt.Errorf("region %q is already configured", name)
+	}
+
+	db, err := openPostgres(connString, s.config)
+	if err != nil {
+		return fmt.Errorf("region %s: %w", name, err)
+	}
+
+	if s.regions == nil {
+		s.regions = map[string]*sql.DB{}
+	}
+	s.regions[name] = db
+	return nil
+}
+
+// Regions returns the configured region names, DefaultRegion first
+func (s *PostgresStore) Regions() []string {
+	names := make([]string, 0, len(s.regions))
+	for name := range s.regions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{DefaultRegion}, names...)
+}
+
+// HasRegion reports whether a database is configured for region
+func (s *PostgresStore) HasRegion(region string) bool {
+	if region == DefaultRegion {
+		return true
+	}
+	_, ok := s.regions[region]
+	return ok
+}
+
+// regionDB returns the database of a configured region
+func (s *PostgresStore) regionDB(region string) (*sql.DB, error) {
+	if region == DefaultRegion || region == "" {
+		return s.db, nil
+	}
+	db, ok := s.regions[region]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownRegion, region)
+	}
+	return db, nil
+}
+
+// UserRegion returns the region a user lives in
+func (s *PostgresStore) UserRegion(userID string) (string, error) {
+	if len(s.regions) == 0 {
+		return DefaultRegion, nil
+	}
+
+	if region, ok := s.regionCache.get(userID); ok {
+		return region, nil
+	}
+
+	region := DefaultRegion
+	err := s.db.QueryRow(`SELECT region FROM user_regions WHERE user_id = $1`, userID).Scan(&region)
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	s.regionCache.set(userID, region)
+	return region, nil
+}
+
+// userDB returns the database holding a user's rows
+func (s *PostgresStore) userDB(userID string) (*sql.DB, error) {
+	region, err := s.UserRegion(userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.regionDB(region)
+}
+
+// emailDB returns the database holding the account registered with email:
+// the directory's region for it, else the primary
+func (s *PostgresStore) emailDB(email string) (*sql.DB, error) {
+	if len(s.regions) == 0 {
+		return s.db, nil
+	}
+
+	var region string
+	err := s.db.QueryRow(`SELECT region FROM user_regions WHERE email = $1`, email).Scan(&region)
+	if err == sql.ErrNoRows {
+		return s.db, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.regionDB(region)
+}
+
+// eachRegion runs fn against every region's database in Regions order,
+// stopping at the first error. Admin operations and backups use it to
+// cover all users.
+func (s *PostgresStore) eachRegion(fn func(region string, db *sql.DB) error) error {
+	for _, region := range s.Regions() {
+		db, err := s.regionDB(region)
+		if err != nil {
+			return err
+		}
+		if err := fn(region, db); err != nil {
+			if region == DefaultRegion {
+				return err
+			}
+			return fmt.Errorf("region %s: %w", region, err)
+		}
+	}
+	return nil
+}
+
+// registerUserRegion claims email for a new user of another region in the
+// directory. The directory's unique email stands in for users.email, which
+// can't be unique across databases.
+func (s *PostgresStore) registerUserRegion(userID, email, region string) error {
+	var taken bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE email = $1)`, email).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrEmailTaken
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO user_regions (user_id, email, region) VALUES ($1, $2, $3)
+	`, userID, email, region)
+	if isUniqueViolation(err) {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+func (s *PostgresStore) unregisterUserRegion(userID string) error {
+	_, err := s.db.Exec(`DELETE FROM user_regions WHERE user_id = $1`, userID)
+	s.regionCache.forget(userID)
+	return err
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// createInRegion runs create against region's database for a new user.
+// With regions configured the user's directory entry is written first, and
+// removed again if create fails.
+func (s *PostgresStore) createInRegion(userID, email, region string, create func(db *sql.DB, userID string) error) error {
+	if region == "" {
+		region = DefaultRegion
+	}
+	db, err := s.regionDB(region)
+	if err != nil {
+		return err
+	}
+	if len(s.regions) == 0 {
+		return create(db, userID)
+	}
+
+	if err := s.registerUserRegion(userID, email, region); err != nil {
+		return err
+	}
+	if err := create(db, userID); err != nil {
+		if cleanupErr := s.unregisterUserRegion(userID); cleanupErr != nil {
+			return errors.Join(err, cleanupErr)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"fmt"
+
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/storage/migrations"
+)
+
+// migrationLock is the advisory lock serializing migrations of a database,
+// so servers started together with -migrate take turns
+const migrationLock = 0x7073796e63 // "psync"
+
+const schemaMigrationsTable = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+	    version INTEGER PRIMARY KEY,
+	    name VARCHAR(255) NOT NULL,
+	    applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)
+`
+
+// MigrationStep is a migration applied to, or reverted from, one region's
+// database
+type MigrationStep struct {
+	Region  string
+	Version int
+	Name    string
+	Down    bool
+}
+
+// Migrate applies the pending migrations to every region's database
+func (s *PostgresStore) Migrate(ctx context.Context) ([]MigrationStep, error) {
+	return s.MigrateTo(ctx, migrations.Latest())
+}
+
+// MigrateTo moves every region's database to version: up through the
+// migrations it lacks, or down by reverting those above version. Version 0
+// reverts them all, dropping every table. Each migration commits on its
+// own, so a failure leaves the database at the last one that succeeded.
+func (s *PostgresStore) MigrateTo(ctx context.Context, version int) ([]MigrationStep, error) {
+	all, err := migrations.All()
+	if err != nil {
+		return nil, err
+	}
+	if version < 0 || version > migrations.Latest() {
+		return nil, fmt.Errorf("unknown schema version %d: this binary knows 0 to %d", version, migrations.Latest())
+	}
+
+	var steps []MigrationStep
+	err = s.eachRegion(func(region string, db *sql.DB) error {
+		applied, err := migrateDB(ctx, db, all, version)
+		for _, step := range applied {
+			step.Region = region
+			steps = append(steps, step)
+		}
+		return err
+	})
+	return steps, err
+}
+
+// SchemaVersions is the highest migration applied to each region's
+// database; 0 for one never migrated
+func (s *PostgresStore) SchemaVersions(ctx context.Context) (map[string]int, error) {
+	versions := map[string]int{}
+	err := s.eachRegion(func(region string, db *sql.DB) error {
+		var version int
+		err := db.QueryRowContext(ctx, `
+			SELECT CASE WHEN to_regclass('schema_migrations') IS NULL THEN 0
+			            ELSE (SELECT COALESCE(MAX(version), 0) FROM schema_migrations) END
+		`).Scan(&version)
+		versions[region] = version
+		return err
+	})
+	return versions, err
+}
+
+// migrateDB brings one database to target, holding the migration lock on a
+// single connection throughout
+func migrateDB(ctx context.Context, db *sql.DB, all []migrations.Migration, target int) ([]MigrationStep, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLock); err != nil {
+		return nil, err
+	}
+	// Closing the session releases the lock too, should this fail
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLock)
+
+	if _, err := conn.ExecContext(ctx, schemaMigrationsTable); err != nil {
+		return nil, err
+	}
+	applied := map[int]bool{}
+	rows, err := conn.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		applied[version] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// A newer binary migrated this database; this one can't revert that
+	known := map[int]bool{}
+	for _, m := range all {
+		known[m.Version] = true
+	}
+	for version := range applied {
+		if !known[version] && version > target {
+			return nil, fmt.Errorf("database has migration %d, which this binary doesn't know", version)
+		}
+	}
+
+	var steps []MigrationStep
+	for _, m := range all {
+		if m.Version > target || applied[m.Version] {
+			continue
+		}
+		err := runMigration(ctx, conn, m.Up, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name)
+		if err != nil {
+			return steps, fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		steps = append(steps, MigrationStep{Version: m.Version, Name: m.Name})
+	}
+	for i := len(all) - 1; i >= 0; i-- {
+		m := all[i]
+		if m.Version <= target || !applied[m.Version] {
+			continue
+		}
+		err := runMigration(ctx, conn, m.Down, `DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+		if err != nil {
+			return steps, fmt.Errorf("reverting migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		steps = append(steps, MigrationStep{Version: m.Version, Name: m.Name, Down: true})
+	}
+	return steps, nil
+}
+
+// runMigration runs a migration's script and records it in one transaction
+func runMigration(ctx context.Context, conn *sql.Conn, script, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SQLiteSchema is sqlite_schema.sql, the same tables for SQLiteStore
+//
+//go:embed sqlite_schema.sql
+var SQLiteSchema string
+
+// ApplySchema runs the (idempotent) schema against the database file, then
+// brings its manifest digests up to sync.DigestVersion and its credential
+// protocols up to models.Protocol
+func (s *SQLiteStore) ApplySchema() error {
+	if _, err := s.db.Exec(SQLiteSchema); err != nil {
+		return err
+	}
+	if err := s.upgradeDigests(context.Background()); err != nil {
+		return err
+	}
+	return s.upgradeProtocols(context.Background())
+}
+
+// upgradeDigests rewrites every stored manifest digest once, recording the
+// version it wrote in the file's user_version. SQLite has no SHA-256 to do
+// it in the schema, as the Postgres migration does.
+func (s *SQLiteStore) upgradeDigests(ctx context.Context) error {
+	var version int
+	if err := s.db.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version >= sync.DigestVersion {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var zones []UserZone
+	rows, err := tx.QueryContext(ctx, `SELECT user_id, zone FROM sync_state WHERE digest IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var zone UserZone
+		if err := rows.Scan(&zone.UserID, &zone.Zone); err != nil {
+			rows.Close()
+			return err
+		}
+		zones = append(zones, zone)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, zone := range zones {
+		manifest, err := computeManifest(ctx, tx, zone.UserID, zone.Zone)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `
+			UPDATE sync_state SET digest = $3 WHERE user_id = $1 AND zone = $2
+		`, zone.UserID, zone.Zone, manifest.Digest)
+		if err != nil {
+			return err
+		}
+	}
+	// PRAGMA takes no parameters; the version is our own integer
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", sync.DigestVersion)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// protocolUserVersion is the user_version of a file whose credential
+// protocols are models.Protocol values; it follows the digest upgrade's
+// sync.DigestVersion
+const protocolUserVersion = 3
+
+// upgradeProtocols reinterprets the ports older clients stored as the
+// protocol (443 for https), as the Postgres migration 0005 does, once
+func (s *SQLiteStore) upgradeProtocols(ctx context.Context) error {
+	var version int
+	if err := s.db.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version >= protocolUserVersion {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	upgrade, err := migrations.Up("protocol_enum")
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, upgrade); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", protocolUserVersion)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
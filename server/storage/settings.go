@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+)
+
+// UserSettings are the preferences a user manages for their own account
+type UserSettings struct {
+	EncVersionPolicy string // sync.EncVersionPolicyWarn or sync.EncVersionPolicyReject
+	// Devices idle this many days are deactivated; 0 turns it off
+	DeviceAutoDeactivateDays int
+	DeviceApproval           string // A peer.DeviceApproval* setting
+}
+
+func (s *PostgresStore) GetUserSettings(ctx context.Context, userID string) (*UserSettings, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &UserSettings{}
+	query := `
+		SELECT enc_version_policy, COALESCE(device_auto_deactivate_days, 0), device_approval
+		FROM users WHERE id = $1
+	`
+
+	err = db.QueryRowContext(ctx, query, userID).Scan(&settings.EncVersionPolicy, &settings.DeviceAutoDeactivateDays, &settings.DeviceApproval)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// UpdateUserSettings writes every setting; callers validate them first
+func (s *PostgresStore) UpdateUserSettings(ctx context.Context, userID string, settings *UserSettings) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE users
+		SET enc_version_policy = $2, device_auto_deactivate_days = NULLIF($3, 0),
+		    device_approval = $4, updated_at = NOW()
+		WHERE id = $1
+	`
+	result, err := db.ExecContext(ctx, query, userID, settings.EncVersionPolicy, settings.DeviceAutoDeactivateDays, settings.DeviceApproval)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
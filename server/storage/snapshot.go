@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+)
+
+// SnapshotReader reads one user's zones as they were at a single moment:
+// a push committed while it is in use is either wholly visible or not at
+// all. The Stream methods call fn per row without buffering the page.
+type SnapshotReader interface {
+	ListSyncStates(ctx context.Context) ([]*SyncState, error)
+	StreamCryptoKeys(ctx context.Context, r PullRange, fn func(*models.CryptoKey) error) error
+	StreamCredentialMetadata(ctx context.Context, r PullRange, fn func(*models.CredentialMetadata) error) error
+	StreamSyncRecords(ctx context.Context, r PullRange, fn func(*models.SyncRecord) error) error
+}
+
+// ReadSnapshot calls fn with a reader over the user's zones inside one
+// read-only, repeatable-read transaction. The reader is only valid until
+// fn returns.
+func (s *PostgresStore) ReadSnapshot(ctx context.Context, userID string, fn func(SnapshotReader) error) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(&txSnapshot{tx: tx, userID: userID}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// txSnapshot is a SnapshotReader on a repeatable-read transaction
+type txSnapshot struct {
+	tx     *sql.Tx
+	userID string
+}
+
+func (t *txSnapshot) ListSyncStates(ctx context.Context) ([]*SyncState, error) {
+	return listSyncStates(ctx, t.tx, t.userID)
+}
+
+func (t *txSnapshot) StreamCryptoKeys(ctx context.Context, r PullRange, fn func(*models.CryptoKey) error) error {
+	return streamCryptoKeys(ctx, t.tx, t.userID, r, fn)
+}
+
+func (t *txSnapshot) StreamCredentialMetadata(ctx context.Context, r PullRange, fn func(*models.CredentialMetadata) error) error {
+	return streamCredentialMetadata(ctx, t.tx, t.userID, r, fn)
+}
+
+func (t *txSnapshot) StreamSyncRecords(ctx context.Context, r PullRange, fn func(*models.SyncRecord) error) error {
+	return streamSyncRecords(ctx, t.tx, t.userID, r, fn)
+}
@@ -0,0 +1,586 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/google/uuid"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteStore keeps a whole server in one SQLite file, for self-hosters who
+// don't want to run Postgres. It has a single region, DefaultRegion.
+//
+// Statements that Postgres and SQLite both accept are shared with
+// PostgresStore; the sqlite*.go files hold the SQLite dialect of the rest.
+// Timestamps are stored as text, so every time bound to a statement is
+// converted to UTC first: text comparisons then order them in time.
+// Transactions start IMMEDIATE, taking the write lock up front where
+// Postgres would lock rows with FOR UPDATE.
+type SQLiteStore struct {
+	db *sql.DB
+
+	// Called after any change to a user's auth-relevant columns
+	userChanged []func(userID string)
+}
+
+// How long a statement waits for another connection's write lock
+const sqliteBusyTimeout = 5 * time.Second
+
+// NewSQLiteStore opens (creating if needed) the database file at path. Call
+// ApplySchema before first use.
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	params := url.Values{}
+	params.Add("_pragma", "foreign_keys(1)")
+	params.Add("_pragma", "journal_mode(WAL)")
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", sqliteBusyTimeout.Milliseconds()))
+	params.Set("_time_format", "sqlite")
+	params.Set("_txlock", "immediate")
+
+	db, err := sql.Open("sqlite", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// HasRegion reports whether region is DefaultRegion, the only one
+func (s *SQLiteStore) HasRegion(region string) bool {
+	return region == DefaultRegion
+}
+
+// checkSingleRegion accepts the region arguments of a store that has only
+// DefaultRegion
+func checkSingleRegion(region string) error {
+	if region != "" && region != DefaultRegion {
+		return fmt.Errorf("%w: %s", ErrUnknownRegion, region)
+	}
+	return nil
+}
+
+// isSQLiteConstraint reports whether SQLite refused a statement for the
+// data it writes: a constraint it violates or a value of the wrong type
+func isSQLiteConstraint(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	code := sqliteErr.Code() & 0xff // The primary result code
+	return code == sqlite3.SQLITE_CONSTRAINT || code == sqlite3.SQLITE_MISMATCH
+}
+
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY)
+}
+
+// sqliteTime scans a timestamp computed by an expression, which SQLite
+// returns as text since only columns carry a declared type
+type sqliteTime struct {
+	Time *time.Time
+}
+
+var sqliteTimeFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+func (t sqliteTime) Scan(src any) error {
+	switch v := src.(type) {
+	case time.Time:
+		*t.Time = v
+		return nil
+	case string:
+		for _, format := range sqliteTimeFormats {
+			if parsed, err := time.Parse(format, v); err == nil {
+				*t.Time = parsed
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid timestamp %q", v)
+	}
+	return fmt.Errorf("cannot scan %T into a timestamp", src)
+}
+
+// Users
+
+func (s *SQLiteStore) CreateUser(email string, passwordHash, salt []byte, region string) (*User, error) {
+	if err := checkSingleRegion(region); err != nil {
+		return nil, err
+	}
+	user, err := insertUser(s.db, uuid.New().String(), email, passwordHash, salt)
+	if isSQLiteUniqueViolation(err) {
+		return nil, ErrEmailTaken
+	}
+	return user, err
+}
+
+func (s *SQLiteStore) GetUserByEmail(email string) (*User, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = $1`, email))
+}
+
+func (s *SQLiteStore) GetUserByID(id string) (*User, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = $1`, id))
+}
+
+// DeleteUserCascade removes an account and every row it owns in one
+// transaction, like PostgresStore.DeleteUserCascade
+func (s *SQLiteStore) DeleteUserCascade(ctx context.Context, id string) error {
+	if err := deleteUserCascade(ctx, s.db, id); err != nil {
+		return err
+	}
+	s.notifyUserChanged(id)
+	return nil
+}
+
+// GetAuthProfile loads the columns the auth middleware checks on every request
+func (s *SQLiteStore) GetAuthProfile(id string) (*auth.Profile, error) {
+	profile := &auth.Profile{}
+	err := s.db.QueryRow(`
+		SELECT id, email, subscription_tier, token_version, is_active, legal_hold
+		FROM users WHERE id = $1
+	`, id).Scan(
+		&profile.UserID, &profile.Email, &profile.Tier,
+		&profile.TokenVersion, &profile.Active, &profile.LegalHold,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// OnUserChanged registers fn to run after a user's active flag, tier, token
+// version, legal hold or password changes, or the user is deleted
+func (s *SQLiteStore) OnUserChanged(fn func(userID string)) {
+	s.userChanged = append(s.userChanged, fn)
+}
+
+func (s *SQLiteStore) notifyUserChanged(userID string) {
+	for _, fn := range s.userChanged {
+		fn(userID)
+	}
+}
+
+// updateUser runs a single-row users UPDATE and fires the change hooks.
+// The updated_at trigger stamps the row.
+func (s *SQLiteStore) updateUser(userID, query string, args ...interface{}) error {
+	result, err := s.db.Exec(query, append([]interface{}{userID}, args...)...)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	s.notifyUserChanged(userID)
+	return nil
+}
+
+func (s *SQLiteStore) SetUserActive(userID string, active bool) error {
+	return s.updateUser(userID, `UPDATE users SET is_active = $2 WHERE id = $1`, active)
+}
+
+func (s *SQLiteStore) SetSubscriptionTier(userID, tier string) error {
+	return s.updateUser(userID, `UPDATE users SET subscription_tier = $2 WHERE id = $1`, tier)
+}
+
+func (s *SQLiteStore) SetUserAdmin(userID string, admin bool) error {
+	return s.updateUser(userID, `UPDATE users SET is_admin = $2 WHERE id = $1`, admin)
+}
+
+func (s *SQLiteStore) SetLegalHold(userID string, hold bool) error {
+	return s.updateUser(userID, `UPDATE users SET legal_hold = $2 WHERE id = $1`, hold)
+}
+
+// BumpTokenVersion invalidates every access token issued to the user so far
+func (s *SQLiteStore) BumpTokenVersion(userID string) error {
+	return s.updateUser(userID, `UPDATE users SET token_version = token_version + 1 WHERE id = $1`)
+}
+
+// Devices
+
+func (s *SQLiteStore) CreateDevice(userID, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte) (*Device, error) {
+	return insertDevice(s.db, userID, deviceName, deviceType, publicKey, maxEncVersion, capabilities)
+}
+
+func (s *SQLiteStore) UpsertDevice(userID, fingerprint, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte) (*Device, bool, error) {
+	return upsertDevice(s.db, userID, fingerprint, deviceName, deviceType, publicKey, maxEncVersion, capabilities)
+}
+
+func (s *SQLiteStore) GetDevicesByUserID(userID string) ([]*Device, error) {
+	rows, err := s.db.Query(`
+		SELECT `+deviceColumns+`
+		FROM devices WHERE user_id = $1 AND is_active = true
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanDevices(rows)
+}
+
+// GetDevice returns one of the user's devices, active or not
+func (s *SQLiteStore) GetDevice(ctx context.Context, userID, deviceID string) (*Device, error) {
+	query := `SELECT ` + deviceColumns + ` FROM devices WHERE id = $1 AND user_id = $2`
+	return scanDevice(s.db.QueryRowContext(ctx, query, deviceID, userID))
+}
+
+func (s *SQLiteStore) SetDeviceMaxEncVersion(userID, deviceID string, version int) error {
+	_, err := s.db.Exec(`UPDATE devices SET max_enc_version = $3 WHERE id = $1 AND user_id = $2`, deviceID, userID, version)
+	return err
+}
+
+func (s *SQLiteStore) SetDeviceCapabilities(userID, deviceID string, capabilities []byte, maxEncVersion int) error {
+	result, err := s.db.Exec(`
+		UPDATE devices SET capabilities = $3, max_enc_version = COALESCE(NULLIF($4, 0), max_enc_version)
+		WHERE id = $1 AND user_id = $2 AND is_active = true
+	`, deviceID, userID, string(capabilities), maxEncVersion)
+	return expectRows(result, err)
+}
+
+func (s *SQLiteStore) GetDeviceEncVersions(ctx context.Context, userID string) ([]int, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT COALESCE(max_enc_version, 0)
+		FROM devices WHERE user_id = $1 AND is_active = true
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []int
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// UpdateDeviceLastSync records that the device just synced, which also
+// withdraws any pending inactivity warning
+func (s *SQLiteStore) UpdateDeviceLastSync(ctx context.Context, deviceID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE devices SET last_sync = $2, inactivity_warned_at = NULL WHERE id = $1
+	`, deviceID, time.Now().UTC())
+	return err
+}
+
+// expectRows turns an UPDATE that matched no row into sql.ErrNoRows
+func expectRows(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Sync state
+
+func (s *SQLiteStore) GetSyncState(userID, zone string) (*SyncState, error) {
+	return s.GetSyncStateContext(context.Background(), userID, zone)
+}
+
+func (s *SQLiteStore) GetSyncStateContext(ctx context.Context, userID, zone string) (*SyncState, error) {
+	state, err := scanSyncState(s.db.QueryRowContext(ctx, `
+		SELECT `+syncStateColumns+`
+		FROM sync_state s
+		LEFT JOIN devices d ON d.id = s.last_writer_device_id
+		WHERE s.user_id = $1 AND s.zone = $2
+	`, userID, zone))
+	if err == sql.ErrNoRows {
+		return &SyncState{UserID: userID, Zone: zone}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (s *SQLiteStore) ListSyncStates(userID string) ([]*SyncState, error) {
+	return listSyncStates(context.Background(), s.db, userID)
+}
+
+// UpsertSyncState writes the gencount and digest only; the last writer is
+// left as it was, since repairs are not pushes
+func (s *SQLiteStore) UpsertSyncState(userID, zone string, genCount int64, digest []byte) error {
+	_, err := s.db.Exec(`
+		INSERT INTO sync_state (user_id, zone, gencount, digest)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, zone) DO UPDATE SET
+			gencount = excluded.gencount,
+			digest = excluded.digest,
+			updated_at = $5
+	`, userID, zone, genCount, digest, time.Now().UTC())
+	return err
+}
+
+// LoadEngineState implements sync.EngineStore on top of sync_state
+func (s *SQLiteStore) LoadEngineState(userID, zone string) (*sync.EngineState, error) {
+	state, err := s.GetSyncState(userID, zone)
+	if err != nil {
+		return nil, err
+	}
+	engineState := &sync.EngineState{GenCount: state.GenCount, Digest: state.Digest}
+	if state.LastWriterDeviceID != nil {
+		engineState.LastWriter = *state.LastWriterDeviceID
+	}
+	return engineState, nil
+}
+
+// SaveEngineState implements sync.EngineStore on top of sync_state, never
+// moving the gencount backwards like PostgresStore.SaveEngineState
+func (s *SQLiteStore) SaveEngineState(userID, zone string, state *sync.EngineState) error {
+	_, err := s.db.Exec(`
+		INSERT INTO sync_state (user_id, zone, gencount, digest, last_writer_device_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+		ON CONFLICT (user_id, zone) DO UPDATE SET
+			gencount = MAX(sync_state.gencount, excluded.gencount),
+			digest = excluded.digest,
+			last_writer_device_id = excluded.last_writer_device_id,
+			updated_at = $6
+	`, userID, zone, state.GenCount, state.Digest, state.LastWriter, time.Now().UTC())
+	return err
+}
+
+// Items
+
+// sqlitePullPage orders and pages a pull like the Postgres statements'
+// OFFSET/LIMIT NULLIF; a negative LIMIT is none
+const sqlitePullPage = `
+	ORDER BY gencount ASC, item_uuid ASC
+	LIMIT CASE WHEN $8 = 0 THEN -1 ELSE $8 END OFFSET $7`
+
+// sqlitePullRangeFilter is pullRangeFilter without the casts, taking the
+// item UUIDs as a JSON array (sqlitePullArgs)
+const sqlitePullRangeFilter = `gencount > $3 AND ($4 = 0 OR gencount <= $4) AND (tombstone = false OR $5 = true)
+	AND ($6 IS NULL OR item_uuid IN (SELECT value FROM json_each($6)))`
+
+// sqlitePullArgs is PullRange.args with the item UUIDs for json_each
+func sqlitePullArgs(r PullRange, userID string) []interface{} {
+	args := r.args(userID)
+	if r.ItemUUIDs != nil {
+		args[5] = sqliteArray(uuidStrings(r.ItemUUIDs))
+	}
+	return args
+}
+
+func (s *SQLiteStore) GetCryptoKeysPage(ctx context.Context, userID string, r PullRange) ([]*models.CryptoKey, error) {
+	var keys []*models.CryptoKey
+	err := sqliteStreamCryptoKeys(ctx, s.db, userID, r, func(key *models.CryptoKey) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func sqliteStreamCryptoKeys(ctx context.Context, q rowQuerier, userID string, r PullRange, fn func(*models.CryptoKey) error) error {
+	rows, err := q.QueryContext(ctx, `
+		SELECT `+cryptoKeyColumns+`
+		FROM crypto_keys
+		WHERE user_id = $1 AND zone = $2 AND `+sqlitePullRangeFilter+sqlitePullPage,
+		sqlitePullArgs(r, userID)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		key, err := scanCryptoKey(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteStore) GetCredentialMetadataByUserWithFilter(userID, zone string, sinceGenCount int64, includeTombstoned bool) ([]*models.CredentialMetadata, error) {
+	return s.GetCredentialMetadataPage(context.Background(), userID, PullRange{Zone: zone, Since: sinceGenCount, IncludeTombstoned: includeTombstoned})
+}
+
+func (s *SQLiteStore) GetCredentialMetadataPage(ctx context.Context, userID string, r PullRange) ([]*models.CredentialMetadata, error) {
+	var creds []*models.CredentialMetadata
+	err := sqliteStreamCredentialMetadata(ctx, s.db, userID, r, func(cred *models.CredentialMetadata) error {
+		creds = append(creds, cred)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func sqliteStreamCredentialMetadata(ctx context.Context, q rowQuerier, userID string, r PullRange, fn func(*models.CredentialMetadata) error) error {
+	rows, err := q.QueryContext(ctx, `
+		SELECT `+credentialMetadataColumns+`
+		FROM credential_metadata
+		WHERE user_id = $1 AND zone = $2 AND `+sqlitePullRangeFilter+sqlitePullPage,
+		sqlitePullArgs(r, userID)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		cred, err := scanCredentialMetadata(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(cred); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteStore) GetSyncRecordsPage(ctx context.Context, userID string, r PullRange) ([]*models.SyncRecord, error) {
+	var records []*models.SyncRecord
+	err := sqliteStreamSyncRecords(ctx, s.db, userID, r, func(record *models.SyncRecord) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func sqliteStreamSyncRecords(ctx context.Context, q rowQuerier, userID string, r PullRange, fn func(*models.SyncRecord) error) error {
+	rows, err := q.QueryContext(ctx, `
+		SELECT `+syncRecordColumns+`
+		FROM sync_records
+		WHERE user_id = $1 AND zone = $2 AND `+sqlitePullRangeFilter+sqlitePullPage,
+		sqlitePullArgs(r, userID)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record, err := scanSyncRecord(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// SearchCredentialMetadata returns live credentials whose server, account, or
+// label contains query (case-insensitive for ASCII), ordered by server then
+// account
+func (s *SQLiteStore) SearchCredentialMetadata(userID, zone, query string) ([]*models.CredentialMetadata, error) {
+	rows, err := s.db.Query(`
+		SELECT `+credentialMetadataColumns+`
+		FROM credential_metadata
+		WHERE user_id = $1 AND zone = $2 AND tombstone = false
+		  AND (server LIKE $3 ESCAPE '\' OR account LIKE $3 ESCAPE '\' OR label LIKE $3 ESCAPE '\')
+		ORDER BY lower(server) ASC, lower(account) ASC
+	`, userID, zone, "%"+escapeLike(query)+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var creds []*models.CredentialMetadata
+	for rows.Next() {
+		cred, err := scanCredentialMetadata(rows)
+		if err != nil {
+			return nil, err
+		}
+		creds = append(creds, cred)
+	}
+	return creds, rows.Err()
+}
+
+// Refresh tokens
+
+func (s *SQLiteStore) CreateRefreshToken(userID string, deviceID *string, expiresAt time.Time) (*RefreshToken, error) {
+	token := &RefreshToken{
+		Token:     uuid.New().String(),
+		UserID:    userID,
+		DeviceID:  deviceID,
+		ExpiresAt: expiresAt,
+	}
+
+	err := s.db.QueryRow(`
+		INSERT INTO refresh_tokens (token, user_id, device_id, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING created_at
+	`, token.Token, token.UserID, token.DeviceID, token.ExpiresAt.UTC()).Scan(&token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// GetRefreshToken returns sql.ErrNoRows for an unknown token
+func (s *SQLiteStore) GetRefreshToken(token string) (*RefreshToken, error) {
+	rt := &RefreshToken{}
+	err := s.db.QueryRow(`
+		SELECT token, user_id, device_id, expires_at, created_at, revoked
+		FROM refresh_tokens WHERE token = $1
+	`, token).Scan(&rt.Token, &rt.UserID, &rt.DeviceID, &rt.ExpiresAt, &rt.CreatedAt, &rt.Revoked)
+	if err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+func (s *SQLiteStore) RevokeRefreshToken(token string) error {
+	_, err := s.db.Exec(`UPDATE refresh_tokens SET revoked = true WHERE token = $1`, token)
+	return err
+}
+
+// RevokeRefreshTokensByUser revokes every refresh token of a user, returning
+// how many were still valid
+func (s *SQLiteStore) RevokeRefreshTokensByUser(userID string) (int64, error) {
+	result, err := s.db.Exec(`UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND revoked = false`, userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
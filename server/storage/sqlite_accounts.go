@@ -0,0 +1,586 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+)
+
+// The SQLite dialect of account settings, lockout, passwords, inactivity
+// and device management
+
+func (s *SQLiteStore) GetUserSettings(ctx context.Context, userID string) (*UserSettings, error) {
+	settings := &UserSettings{}
+	err := s.db.QueryRowContext(ctx, `
+		SELECT enc_version_policy, COALESCE(device_auto_deactivate_days, 0), device_approval
+		FROM users WHERE id = $1
+	`, userID).Scan(&settings.EncVersionPolicy, &settings.DeviceAutoDeactivateDays, &settings.DeviceApproval)
+	if err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// UpdateUserSettings writes every setting; callers validate them first
+func (s *SQLiteStore) UpdateUserSettings(ctx context.Context, userID string, settings *UserSettings) error {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET enc_version_policy = $2, device_auto_deactivate_days = NULLIF($3, 0), device_approval = $4
+		WHERE id = $1
+	`, userID, settings.EncVersionPolicy, settings.DeviceAutoDeactivateDays, settings.DeviceApproval)
+	return expectRows(result, err)
+}
+
+// Login lockout
+
+func (s *SQLiteStore) IncrementFailedLogin(userID string, threshold int, lockUntil time.Time) (*time.Time, error) {
+	var lockedUntil *time.Time
+	err := s.db.QueryRow(`
+		UPDATE users SET
+		    locked_until = CASE WHEN failed_login_attempts + 1 >= $2 THEN $3 ELSE locked_until END,
+		    failed_login_attempts = CASE WHEN failed_login_attempts + 1 >= $2 THEN 0 ELSE failed_login_attempts + 1 END
+		WHERE id = $1
+		RETURNING locked_until
+	`, userID, threshold, lockUntil.UTC()).Scan(&lockedUntil)
+	return lockedUntil, err
+}
+
+func (s *SQLiteStore) ResetFailedLogin(userID string) error {
+	_, err := s.db.Exec(`
+		UPDATE users SET failed_login_attempts = 0, locked_until = NULL
+		WHERE id = $1 AND (failed_login_attempts <> 0 OR locked_until IS NOT NULL)
+	`, userID)
+	return err
+}
+
+func (s *SQLiteStore) IsLocked(userID string, at time.Time) (bool, time.Time, error) {
+	var lockedUntil sql.NullTime
+	err := s.db.QueryRow(`SELECT locked_until FROM users WHERE id = $1`, userID).Scan(&lockedUntil)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if !lockedUntil.Valid || !lockedUntil.Time.After(at) {
+		return false, time.Time{}, nil
+	}
+	return true, lockedUntil.Time, nil
+}
+
+// Passwords and resets
+
+func (s *SQLiteStore) UpdateUserPassword(userID string, hash, salt []byte, version int) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE users
+		SET password_hash = $2, salt = $3, hash_version = $4, hash_upgrade_deadline = NULL,
+		    hash_upgrade_notified_at = NULL, hash_upgrade_enforced_at = NULL,
+		    failed_login_attempts = 0, locked_until = NULL, token_version = token_version + 1
+		WHERE id = $1
+	`, userID, hash, salt, version)
+	if err := expectRows(result, err); err != nil {
+		return 0, err
+	}
+
+	result, err = tx.Exec(`UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND revoked = false`, userID)
+	if err != nil {
+		return 0, err
+	}
+	revoked, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.notifyUserChanged(userID)
+	return revoked, nil
+}
+
+func (s *SQLiteStore) UpgradePasswordHash(userID string, hash []byte, version int) error {
+	_, err := s.db.Exec(`
+		UPDATE users
+		SET password_hash = $2, hash_version = $3, hash_upgrade_deadline = NULL,
+		    hash_upgrade_notified_at = NULL, hash_upgrade_enforced_at = NULL
+		WHERE id = $1 AND hash_version < $3
+	`, userID, hash, version)
+	return err
+}
+
+func (s *SQLiteStore) PasswordHashStats() (*PasswordHashStats, error) {
+	rows, err := s.db.Query(`
+		SELECT hash_version, COUNT(*), COUNT(hash_upgrade_deadline),
+		       COUNT(hash_upgrade_notified_at), COUNT(hash_upgrade_enforced_at)
+		FROM users
+		GROUP BY hash_version
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := &PasswordHashStats{Versions: map[int]int64{}}
+	for rows.Next() {
+		var version int
+		var count, flagged, notified, enforced int64
+		if err := rows.Scan(&version, &count, &flagged, &notified, &enforced); err != nil {
+			return nil, err
+		}
+		stats.Versions[version] = count
+		stats.Flagged += flagged
+		stats.Notified += notified
+		stats.Enforced += enforced
+	}
+	return stats, rows.Err()
+}
+
+// ListDeprecatedHashAccounts returns up to limit active accounts whose hash
+// is older than auth.CurrentHashVersion, soonest deadline first, then least
+// recently active
+func (s *SQLiteStore) ListDeprecatedHashAccounts(limit int) ([]*HashUpgradeAccount, error) {
+	return s.findHashUpgradeAccounts(`is_active`, "", limit)
+}
+
+func (s *SQLiteStore) FindHashUpgradeAccounts(userID string) ([]*HashUpgradeAccount, error) {
+	return s.findHashUpgradeAccounts(`hash_upgrade_deadline IS NOT NULL`, userID, 0)
+}
+
+// findHashUpgradeAccounts returns the matching accounts; limit 0 is no limit
+func (s *SQLiteStore) findHashUpgradeAccounts(condition, userID string, limit int) ([]*HashUpgradeAccount, error) {
+	rows, err := s.db.Query(`
+		SELECT id, email, hash_version, last_active_at,
+		       hash_upgrade_deadline, hash_upgrade_notified_at, hash_upgrade_enforced_at
+		FROM users
+		WHERE hash_version < $1 AND ($2 = '' OR id = $2) AND `+condition+`
+		ORDER BY hash_upgrade_deadline NULLS LAST, last_active_at NULLS FIRST
+		LIMIT CASE WHEN $3 = 0 THEN -1 ELSE $3 END
+	`, auth.CurrentHashVersion, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []*HashUpgradeAccount
+	for rows.Next() {
+		account := &HashUpgradeAccount{}
+		err := rows.Scan(&account.UserID, &account.Email, &account.HashVersion, &account.LastActive,
+			&account.Deadline, &account.NotifiedAt, &account.EnforcedAt)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+func (s *SQLiteStore) StartHashUpgradeCampaign(deadline time.Time) (int64, error) {
+	result, err := s.db.Exec(`
+		UPDATE users SET hash_upgrade_deadline = $2
+		WHERE hash_version < $1 AND is_active AND hash_upgrade_deadline IS NULL
+	`, auth.CurrentHashVersion, deadline.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *SQLiteStore) MarkHashUpgradeNotified(userID string, at time.Time) error {
+	return s.updateUser(userID, `
+		UPDATE users SET hash_upgrade_notified_at = $2 WHERE id = $1
+	`, at.UTC())
+}
+
+func (s *SQLiteStore) EnforceHashUpgrade(userID string, at time.Time) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE users SET hash_upgrade_enforced_at = $3
+		WHERE id = $1 AND hash_version < $2
+		  AND hash_upgrade_deadline IS NOT NULL AND hash_upgrade_enforced_at IS NULL
+	`, userID, auth.CurrentHashVersion, at.UTC())
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	_, err = tx.Exec(`UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND revoked = false`, userID)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *SQLiteStore) CreatePasswordResetToken(userID string, tokenHash []byte, expiresAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM password_reset_tokens WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO password_reset_tokens (token_hash, user_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, tokenHash, userID, expiresAt.UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ConsumePasswordResetToken returns sql.ErrNoRows unless the token is
+// unused and unexpired at the given time
+func (s *SQLiteStore) ConsumePasswordResetToken(tokenHash []byte, at time.Time) (string, error) {
+	var userID string
+	err := s.db.QueryRow(`
+		UPDATE password_reset_tokens SET used_at = $2
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2
+		RETURNING user_id
+	`, tokenHash, at.UTC()).Scan(&userID)
+	return userID, err
+}
+
+// Account inactivity
+
+// TouchUser records a login or refresh and returns the inactivity stage the
+// account was in before
+func (s *SQLiteStore) TouchUser(userID string, at time.Time) (string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var previous string
+	if err := tx.QueryRow(`SELECT inactivity_stage FROM users WHERE id = $1`, userID).Scan(&previous); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		UPDATE users SET last_active_at = $2, inactivity_stage = 'active', inactivity_stage_at = NULL
+		WHERE id = $1
+	`, userID, at.UTC())
+	if err != nil {
+		return "", err
+	}
+	return previous, tx.Commit()
+}
+
+// FindInactiveAccounts is PostgresStore.FindInactiveAccounts for the one
+// region, least recently active first
+func (s *SQLiteStore) FindInactiveAccounts(idleBefore time.Time, userID string) ([]*InactiveAccount, error) {
+	rows, err := s.db.Query(`
+		SELECT u.id, u.email, COALESCE(u.subscription_tier, 'free'), u.legal_hold,
+		       MAX(COALESCE(u.last_active_at, u.created_at), COALESCE(MAX(d.last_sync), u.created_at)) AS last_active,
+		       u.inactivity_stage, u.inactivity_stage_at
+		FROM users u
+		LEFT JOIN devices d ON d.user_id = u.id
+		WHERE ($2 = '' OR u.id = $2)
+		GROUP BY u.id
+		HAVING u.inactivity_stage <> 'active'
+		    OR (COALESCE(u.subscription_tier, 'free') = 'free' AND NOT u.legal_hold AND last_active <= $1)
+		ORDER BY last_active
+	`, idleBefore.UTC(), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []*InactiveAccount
+	for rows.Next() {
+		account := &InactiveAccount{}
+		err := rows.Scan(&account.UserID, &account.Email, &account.Tier, &account.LegalHold,
+			sqliteTime{&account.LastActive}, &account.Stage, &account.StageAt)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// SetInactivityStage moves the user between stages with the stage's effects,
+// like PostgresStore.SetInactivityStage
+func (s *SQLiteStore) SetInactivityStage(userID, from, to string, at time.Time) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var stageAt *time.Time
+	if to != InactivityActive {
+		utc := at.UTC()
+		stageAt = &utc
+	}
+	result, err := tx.Exec(`
+		UPDATE users SET inactivity_stage = $3, inactivity_stage_at = $4
+		WHERE id = $1 AND inactivity_stage = $2
+	`, userID, from, to, stageAt)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	if to == InactivityDormant || to == InactivityDeletionQueued {
+		_, err := tx.Exec(`UPDATE refresh_tokens SET revoked = true WHERE user_id = $1 AND revoked = false`, userID)
+		if err != nil {
+			return false, err
+		}
+	}
+	switch {
+	case to == InactivityDeletionQueued:
+		_, err = tx.Exec(`UPDATE users SET is_active = false, token_version = token_version + 1 WHERE id = $1`, userID)
+	case from == InactivityDeletionQueued:
+		_, err = tx.Exec(`UPDATE users SET is_active = true WHERE id = $1`, userID)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	s.notifyUserChanged(userID)
+	return true, nil
+}
+
+// Device management
+
+// sqliteStaleDeviceColumns must match sqliteScanStaleDevice
+const sqliteStaleDeviceColumns = `
+	d.id, d.user_id, d.device_name, d.device_type, d.public_key,
+	d.last_sync, d.created_at, d.is_active, COALESCE(d.max_enc_version, 0),
+	d.trust_level, d.capabilities, d.inactivity_warned_at`
+
+// sqliteScanStaleDevice is scanStaleDevice with LastActive computed here,
+// as SQLite returns COALESCE of two timestamps as text
+func sqliteScanStaleDevice(row rowScanner, extra ...interface{}) (*StaleDevice, error) {
+	device := &StaleDevice{}
+	dest := []interface{}{
+		&device.ID, &device.UserID, &device.DeviceName, &device.DeviceType,
+		&device.PublicKey, &device.LastSync, &device.CreatedAt, &device.IsActive,
+		&device.MaxEncVersion, &device.TrustLevel, &device.Capabilities, &device.WarnedAt,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	device.LastActive = device.CreatedAt
+	if device.LastSync != nil {
+		device.LastActive = *device.LastSync
+	}
+	return device, nil
+}
+
+func (s *SQLiteStore) FindStaleDevices(userID string, olderThan time.Time, exceptDeviceID string) ([]*StaleDevice, error) {
+	rows, err := s.db.Query(`
+		SELECT `+sqliteStaleDeviceColumns+`
+		FROM devices d
+		WHERE d.user_id = $1 AND d.is_active = true
+		  AND COALESCE(d.last_sync, d.created_at) < $2
+		  AND d.id <> $3
+		ORDER BY COALESCE(d.last_sync, d.created_at) ASC
+	`, userID, olderThan.UTC(), exceptDeviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []*StaleDevice
+	for rows.Next() {
+		device, err := sqliteScanStaleDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+func (s *SQLiteStore) FindAutoDeactivationCandidates(now time.Time, warningDays int, userID string) ([]*StaleDevice, error) {
+	rows, err := s.db.Query(`
+		SELECT `+sqliteStaleDeviceColumns+`, u.device_auto_deactivate_days
+		FROM devices d
+		JOIN users u ON u.id = d.user_id
+		WHERE u.device_auto_deactivate_days IS NOT NULL AND u.is_active = true
+		  AND d.is_active = true
+		  AND julianday(COALESCE(d.last_sync, d.created_at))
+		      < julianday($1) - (u.device_auto_deactivate_days - $2)
+		  AND ($3 = '' OR d.user_id = $3)
+		ORDER BY d.user_id, COALESCE(d.last_sync, d.created_at) ASC
+	`, now.UTC(), warningDays, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var devices []*StaleDevice
+	for rows.Next() {
+		var days int
+		device, err := sqliteScanStaleDevice(rows, &days)
+		if err != nil {
+			return nil, err
+		}
+		device.AutoDeactivateDays = days
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+func (s *SQLiteStore) MarkDevicesWarned(deviceIDs []string, at time.Time) error {
+	_, err := s.db.Exec(`
+		UPDATE devices SET inactivity_warned_at = $2
+		WHERE id IN (SELECT value FROM json_each($1))
+	`, sqliteArray(deviceIDs), at.UTC())
+	return err
+}
+
+func (s *SQLiteStore) RevokeDevices(userID string, deviceIDs []string) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		UPDATE devices SET is_active = false, trust_level = $3
+		WHERE user_id = $1 AND id IN (SELECT value FROM json_each($2)) AND is_active = true
+		RETURNING id
+	`, userID, sqliteArray(deviceIDs), int(peer.TrustLevelRevoked))
+	if err != nil {
+		return nil, err
+	}
+
+	var revoked []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		revoked = append(revoked, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(revoked) == 0 {
+		return nil, nil
+	}
+
+	_, err = tx.Exec(`
+		UPDATE refresh_tokens SET revoked = true
+		WHERE user_id = $1 AND device_id IN (SELECT value FROM json_each($2)) AND revoked = false
+	`, userID, sqliteArray(revoked))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+func (s *SQLiteStore) RevokeDevice(userID, deviceID string) error {
+	revoked, err := s.RevokeDevices(userID, []string{deviceID})
+	if err != nil {
+		return err
+	}
+	if len(revoked) == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *SQLiteStore) SetDeviceTrustLevel(userID, deviceID string, from, to int) error {
+	result, err := s.db.Exec(`
+		UPDATE devices SET trust_level = $4
+		WHERE user_id = $1 AND id = $2 AND is_active = true AND trust_level = $3
+	`, userID, deviceID, from, to)
+	return expectRows(result, err)
+}
+
+func (s *SQLiteStore) RenameDevice(userID, deviceID, name string) error {
+	result, err := s.db.Exec(`
+		UPDATE devices SET device_name = $3
+		WHERE user_id = $1 AND id = $2 AND is_active = true
+	`, userID, deviceID, name)
+	return expectRows(result, err)
+}
+
+func (s *SQLiteStore) GetAccountUsage(ctx context.Context, userID string) (*AccountUsage, error) {
+	return getAccountUsage(ctx, s.db, userID)
+}
+
+func (s *SQLiteStore) HasActiveDevice(userID, fingerprint string) (bool, error) {
+	return hasActiveDevice(s.db, userID, fingerprint)
+}
+
+// CreateBreachMonitor registers email like PostgresStore.CreateBreachMonitor;
+// the transaction's write lock serializes registrations
+func (s *SQLiteStore) CreateBreachMonitor(ctx context.Context, userID, email string, limit int) (*BreachMonitor, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	monitor, created, err := createBreachMonitor(ctx, tx, userID, email, limit)
+	if err != nil {
+		return nil, false, err
+	}
+	return monitor, created, tx.Commit()
+}
+
+func (s *SQLiteStore) ListBreachMonitors(ctx context.Context, userID string) ([]*BreachMonitor, error) {
+	return listBreachMonitors(ctx, s.db, `WHERE user_id = $1 ORDER BY created_at, id`, userID)
+}
+
+func (s *SQLiteStore) DeleteBreachMonitor(ctx context.Context, userID, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM breach_monitors WHERE id = $1 AND user_id = $2`, id, userID)
+	return expectRows(result, err)
+}
+
+func (s *SQLiteStore) FindDueBreachMonitors(checkedBefore time.Time, userID string, limit int) ([]*BreachMonitor, error) {
+	return listBreachMonitors(context.Background(), s.db, `
+		WHERE (checked_at IS NULL OR checked_at < $1) AND ($2 = '' OR user_id = $2)
+		ORDER BY checked_at IS NOT NULL, checked_at, id
+		LIMIT $3
+	`, checkedBefore.UTC(), userID, limit)
+}
+
+func (s *SQLiteStore) RecordBreachCheck(ctx context.Context, monitor *BreachMonitor, breaches []string, alerts []*BreachAlert, at time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := recordBreachCheck(ctx, tx, monitor, breaches, alerts, at); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) ListBreachAlerts(ctx context.Context, userID string, limit int) ([]*BreachAlert, error) {
+	return listBreachAlerts(ctx, s.db, userID, limit)
+}
@@ -0,0 +1,509 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+)
+
+// The SQLite dialect of maintenance, diagnostics and the audit log
+
+// sqliteDialect strips the ::text casts Postgres needs to compare or return
+// UUIDs as text; SQLite stores them as text already
+func sqliteDialect(query string) string {
+	return strings.ReplaceAll(query, "::text", "")
+}
+
+// FindPurgeableTombstones summarizes, per user and zone, the tombstones older
+// than olderThan, sampling the lowest gencounts. An empty userID covers every
+// user. Read-only.
+func (s *SQLiteStore) FindPurgeableTombstones(olderThan time.Time, userID string, sampleSize int) ([]*TombstoneSummary, error) {
+	rows, err := s.db.Query(`
+		SELECT purgeable.user_id, purgeable.zone, COUNT(*),
+		       group_concat(CASE WHEN purgeable.sample_rank <= $3 THEN purgeable.item_uuid END, ',' ORDER BY purgeable.gencount),
+		       u.legal_hold
+		FROM (
+			SELECT tombstones.*, ROW_NUMBER() OVER (
+				PARTITION BY tombstones.user_id, tombstones.zone ORDER BY tombstones.gencount) AS sample_rank
+			FROM (`+purgeableTombstones+`) tombstones
+		) purgeable
+		JOIN users u ON u.id = purgeable.user_id
+		WHERE ($2 = '' OR purgeable.user_id = $2)
+		GROUP BY purgeable.user_id, purgeable.zone, u.legal_hold
+		ORDER BY purgeable.user_id, purgeable.zone
+	`, olderThan.UTC(), userID, sampleSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []*TombstoneSummary
+	for rows.Next() {
+		summary := &TombstoneSummary{}
+		var samples sql.NullString
+		err := rows.Scan(&summary.UserID, &summary.Zone, &summary.Count, &samples, &summary.LegalHold)
+		if err != nil {
+			return nil, err
+		}
+		if samples.Valid {
+			summary.SampleItemUUIDs = strings.Split(samples.String, ",")
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+// PurgeTombstones hard-deletes a user/zone's tombstones older than olderThan
+// like PostgresStore.PurgeTombstones
+func (s *SQLiteStore) PurgeTombstones(userID, zone string, olderThan time.Time) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var total int64
+	for _, table := range wipeTables {
+		result, err := tx.Exec(`
+			DELETE FROM `+table+`
+			WHERE user_id = $1 AND zone = $2 AND tombstone = true AND wipe_id IS NULL AND updated_at < $3
+			  AND NOT EXISTS (SELECT 1 FROM users WHERE id = $1 AND legal_hold)
+		`, userID, zone, olderThan.UTC())
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+
+	if total > 0 {
+		manifest, err := computeManifest(context.Background(), tx, userID, zone)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`
+			UPDATE sync_state SET digest = $3 WHERE user_id = $1 AND zone = $2
+		`, userID, zone, manifest.Digest)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// FindOrphanedKeys lists, per user and zone, the keys nothing refers to
+// like PostgresStore.FindOrphanedKeys
+func (s *SQLiteStore) FindOrphanedKeys(ctx context.Context, olderThan time.Time, userID string) ([]*OrphanedKeys, error) {
+	return findOrphanedKeys(ctx, s.db, sqliteDialect(orphanedKeysByZone), olderThan, userID)
+}
+
+// TombstoneOrphanedKeys tombstones a user/zone's orphaned keys like
+// PostgresStore.TombstoneOrphanedKeys
+func (s *SQLiteStore) TombstoneOrphanedKeys(ctx context.Context, userID, zone string, olderThan time.Time) (*WipeResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	items, err := zoneOrphanedKeys(ctx, tx, userID, zone, olderThan, "")
+	if err != nil {
+		return nil, err
+	}
+	genCounts, err := nextGenCounts(ctx, tx, userID, zone, int64(len(items)))
+	if err != nil {
+		return nil, err
+	}
+	result := &WipeResult{GenCount: genCounts.Last, Items: items}
+	if len(items) > 0 {
+		if err := sqliteRenumberWipeItems(ctx, tx, userID, zone, items, result.GenCount, true, nil); err != nil {
+			return nil, err
+		}
+		if err := sqliteSaveWipeState(ctx, tx, userID, zone, result.GenCount, ""); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *SQLiteStore) ComputeManifest(ctx context.Context, userID, zone string) (*ManifestState, error) {
+	return computeManifest(ctx, s.db, userID, zone)
+}
+
+func (s *SQLiteStore) ManifestLeaves(ctx context.Context, userID, zone string) ([]sync.ManifestLeaf, error) {
+	return manifestLeaves(ctx, s.db, userID, zone)
+}
+
+// SampleUserZones returns a random fraction of (user, zone) pairs that have
+// sync state, at most limit of them
+func (s *SQLiteStore) SampleUserZones(fraction float64, limit int) ([]UserZone, error) {
+	rows, err := s.db.Query(`
+		SELECT user_id, zone FROM sync_state
+		WHERE abs(random() % 1000000) / 1000000.0 < $1
+		LIMIT $2
+	`, fraction, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pairs []UserZone
+	for rows.Next() {
+		var pair UserZone
+		if err := rows.Scan(&pair.UserID, &pair.Zone); err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, rows.Err()
+}
+
+// Job reports
+
+func (s *SQLiteStore) SaveJobReport(report *JobReport) error {
+	var details interface{}
+	if len(report.Details) > 0 {
+		details = string(report.Details)
+	}
+
+	return s.db.QueryRow(`
+		INSERT INTO job_reports (job_name, dry_run, started_at, finished_at,
+			total_affected, details, error)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
+		RETURNING id
+	`, report.JobName, report.DryRun, report.StartedAt.UTC(), report.FinishedAt.UTC(),
+		report.TotalAffected, details, report.Error,
+	).Scan(&report.ID)
+}
+
+// jobReportColumns must match scanJobReport
+const jobReportColumns = `id, job_name, dry_run, started_at, finished_at, total_affected, details, COALESCE(error, '')`
+
+func scanJobReport(row rowScanner) (*JobReport, error) {
+	report := &JobReport{}
+	var details sql.NullString
+	err := row.Scan(
+		&report.ID, &report.JobName, &report.DryRun, &report.StartedAt,
+		&report.FinishedAt, &report.TotalAffected, &details, &report.Error,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if details.Valid {
+		report.Details = []byte(details.String)
+	}
+	return report, nil
+}
+
+func (s *SQLiteStore) GetJobReport(id int64) (*JobReport, error) {
+	return scanJobReport(s.db.QueryRow(`SELECT `+jobReportColumns+` FROM job_reports WHERE id = $1`, id))
+}
+
+func (s *SQLiteStore) ListJobReports(jobName string, limit int) ([]*JobReport, error) {
+	rows, err := s.db.Query(`
+		SELECT `+jobReportColumns+`
+		FROM job_reports
+		WHERE ($1 = '' OR job_name = $1)
+		ORDER BY started_at DESC
+		LIMIT $2
+	`, jobName, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []*JobReport
+	for rows.Next() {
+		report, err := scanJobReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+// Diagnostics
+
+func (s *SQLiteStore) CountLayerItems(ctx context.Context, userID, zone string) ([]LayerCount, error) {
+	counts := make([]LayerCount, 0, len(probeLayers))
+	for _, l := range probeLayers {
+		count := LayerCount{Layer: l.layer}
+		err := s.db.QueryRowContext(ctx, `
+			SELECT COUNT(*) FILTER (WHERE NOT COALESCE(tombstone, false)),
+			       COUNT(*) FILTER (WHERE COALESCE(tombstone, false))
+			FROM `+l.table+`
+			WHERE user_id = $1 AND zone = $2
+		`, userID, zone).Scan(&count.Live, &count.Tombstoned)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, nil
+}
+
+func (s *SQLiteStore) FindReferenceViolations(ctx context.Context, userID, zone string, limit int) ([]ReferenceViolation, error) {
+	return sqliteReferenceViolations(ctx, s.db, userID, zone, limit)
+}
+
+func sqliteReferenceViolations(ctx context.Context, q rowQuerier, userID, zone string, limit int) ([]ReferenceViolation, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT * FROM (`+sqliteDialect(referenceChecks)+`) violations
+		ORDER BY 1, 2, 3
+		LIMIT $3
+	`, userID, zone, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	violations := []ReferenceViolation{}
+	for rows.Next() {
+		var v ReferenceViolation
+		var keyTombstoned sql.NullBool
+		if err := rows.Scan(&v.Layer, &v.ItemUUID, &v.Field, &v.KeyUUID, &keyTombstoned); err != nil {
+			return nil, err
+		}
+		v.Violation = ReferenceMissing
+		if keyTombstoned.Valid {
+			v.Violation = ReferenceTombstoned
+		}
+		violations = append(violations, v)
+	}
+	return violations, rows.Err()
+}
+
+// ScanIntegrity runs the integrity checks of a user's zone in one read
+// transaction. SQLite has no statement timeout, so opts.Timeout bounds the
+// whole scan instead; running out fails it with sync.ErrIntegrityTimeout.
+func (s *SQLiteStore) ScanIntegrity(ctx context.Context, userID, zone string, opts IntegrityScanOptions) (*IntegrityScan, error) {
+	scanCtx := ctx
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		scanCtx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	tx, err := s.db.BeginTx(scanCtx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	scan, err := sqliteScanIntegrity(scanCtx, tx, userID, zone, opts)
+	if err != nil && ctx.Err() == nil && errors.Is(scanCtx.Err(), context.DeadlineExceeded) {
+		return nil, sync.ErrIntegrityTimeout
+	}
+	return scan, err
+}
+
+func sqliteScanIntegrity(ctx context.Context, tx *sql.Tx, userID, zone string, opts IntegrityScanOptions) (*IntegrityScan, error) {
+	scan := &IntegrityScan{}
+	err := tx.QueryRowContext(ctx, `
+		SELECT gencount, digest FROM sync_state WHERE user_id = $1 AND zone = $2
+	`, userID, zone).Scan(&scan.GenCount, &scan.StoredDigest)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if scan.Computed, err = computeManifest(ctx, tx, userID, zone); err != nil {
+		return nil, err
+	}
+	if scan.Violations, err = sqliteReferenceViolations(ctx, tx, userID, zone, opts.Limit+1); err != nil {
+		return nil, err
+	}
+	if scan.OrphanedKeys, err = sampleItems(ctx, tx, sqliteDialect(orphanedKeys), userID, zone, opts.Limit); err != nil {
+		return nil, err
+	}
+	if opts.MinEncVersion > 0 {
+		scan.Unsupported, err = sampleItems(ctx, tx, `
+			SELECT item_uuid, COUNT(*) OVER ()
+			FROM sync_records
+			WHERE user_id = $1 AND zone = $2 AND tombstone = false AND enc_version > $4
+			ORDER BY 1
+			LIMIT $3
+		`, userID, zone, opts.Limit, opts.MinEncVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scan, nil
+}
+
+// Audit log
+
+func (s *SQLiteStore) RecordAuditEvent(event *AuditEvent) error {
+	return s.RecordAuditEvents([]*AuditEvent{event})
+}
+
+// RecordAuditEvents inserts a batch of audit events in a single transaction
+func (s *SQLiteStore) RecordAuditEvents(events []*AuditEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return insertAuditEvents(s.db, events)
+}
+
+// NextAuditCursor reports whether the filter matches more than Limit rows and,
+// if so, returns the ID of the last row in the page to resume after
+func (s *SQLiteStore) NextAuditCursor(filter AuditEventFilter) (int64, bool, error) {
+	rows, err := s.db.Query(`
+		SELECT id FROM audit_events
+		WHERE user_id = $1 AND created_at >= $2 AND created_at < $3 AND id > $4
+		  AND (item_uuid IS NULL OR $5 = true)
+		ORDER BY id ASC
+		LIMIT 2 OFFSET $6
+	`, filter.UserID, filter.From.UTC(), filter.To.UTC(),
+		filter.AfterID, filter.IncludeItems, filter.Limit-1)
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return 0, false, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, false, err
+	}
+
+	if len(ids) < 2 {
+		return 0, false, nil
+	}
+	return ids[0], true, nil
+}
+
+func (s *SQLiteStore) StreamAuditEvents(filter AuditEventFilter, fn func(*AuditEvent) error) error {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, actor_id, device_id, action, zone, item_uuid,
+		       COALESCE(ip_address, ''), details, created_at
+		FROM audit_events
+		WHERE user_id = $1 AND created_at >= $2 AND created_at < $3 AND id > $4
+		  AND (item_uuid IS NULL OR $5 = true)
+		ORDER BY id ASC
+		LIMIT $6
+	`, filter.UserID, filter.From.UTC(), filter.To.UTC(),
+		filter.AfterID, filter.IncludeItems, filter.Limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event := &AuditEvent{}
+		var details sql.NullString
+		err := rows.Scan(
+			&event.ID, &event.UserID, &event.ActorID, &event.DeviceID,
+			&event.Action, &event.Zone, &event.ItemUUID, &event.IPAddress,
+			&details, &event.CreatedAt,
+		)
+		if err != nil {
+			return err
+		}
+		if details.Valid {
+			event.Details = []byte(details.String)
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteStore) ListRecentAuditEvents(ctx context.Context, userID string, limit int) ([]*AuditEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, user_id, actor_id, device_id, action, zone, item_uuid,
+		       COALESCE(ip_address, ''), created_at
+		FROM audit_events
+		WHERE user_id = $1
+		ORDER BY id DESC
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*AuditEvent
+	for rows.Next() {
+		event := &AuditEvent{}
+		err := rows.Scan(&event.ID, &event.UserID, &event.ActorID, &event.DeviceID,
+			&event.Action, &event.Zone, &event.ItemUUID, &event.IPAddress, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (s *SQLiteStore) ListZoneActivity(ctx context.Context, filter ZoneActivityFilter) ([]*AuditEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, user_id, actor_id, device_id, action, zone, item_uuid, created_at
+		FROM audit_events
+		WHERE user_id = $1 AND zone = $2 AND action IN (SELECT value FROM json_each($3))
+		  AND ($4 = 0 OR id < $4)
+		ORDER BY id DESC
+		LIMIT $5
+	`, filter.UserID, filter.Zone, sqliteArray(filter.Actions), filter.BeforeID, filter.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*AuditEvent
+	for rows.Next() {
+		event := &AuditEvent{}
+		err := rows.Scan(
+			&event.ID, &event.UserID, &event.ActorID, &event.DeviceID,
+			&event.Action, &event.Zone, &event.ItemUUID, &event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (s *SQLiteStore) AuditEventTimes(ctx context.Context, userID, action string, since time.Time) ([]time.Time, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT created_at FROM audit_events
+		WHERE user_id = $1 AND created_at > $2 AND action = $3
+		ORDER BY created_at, id
+	`, userID, since.UTC(), action)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var times []time.Time
+	for rows.Next() {
+		var at time.Time
+		if err := rows.Scan(&at); err != nil {
+			return nil, err
+		}
+		times = append(times, at)
+	}
+	return times, rows.Err()
+}
@@ -0,0 +1,283 @@
+-- Single-file schema for SQLite, the self-hosting backend
+-- Mirrors the Postgres migrations (migrations/*.up.sql) table for table; see there for what each column means
+-- UUIDs are TEXT, BYTEA is BLOB and JSONB is TEXT. Timestamps are written by
+-- the server in UTC, so comparing them as text orders them in time.
+-- Every statement is idempotent: the schema is applied on each start
+-- PRAGMA user_version is the manifest digest version of sync_state.digest
+-- (see SQLiteStore.ApplySchema)
+
+CREATE TABLE IF NOT EXISTS users (
+    id TEXT PRIMARY KEY,
+    email VARCHAR(255) UNIQUE NOT NULL,
+    password_hash BLOB NOT NULL,
+    salt BLOB NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    subscription_tier VARCHAR(50) DEFAULT 'free',
+    email_verified BOOLEAN DEFAULT FALSE,
+    is_admin BOOLEAN DEFAULT FALSE,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    token_version INTEGER NOT NULL DEFAULT 0,
+    enc_version_policy VARCHAR(10) NOT NULL DEFAULT 'warn',
+    device_auto_deactivate_days INTEGER,
+    legal_hold BOOLEAN NOT NULL DEFAULT FALSE,
+    last_active_at TIMESTAMP,
+    inactivity_stage VARCHAR(20) NOT NULL DEFAULT 'active',
+    inactivity_stage_at TIMESTAMP,
+    hash_version SMALLINT NOT NULL DEFAULT 1,
+    hash_upgrade_deadline TIMESTAMP,
+    hash_upgrade_notified_at TIMESTAMP,
+    hash_upgrade_enforced_at TIMESTAMP,
+    device_approval VARCHAR(10) NOT NULL DEFAULT 'off',
+    failed_login_attempts INTEGER NOT NULL DEFAULT 0,
+    locked_until TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS devices (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_name VARCHAR(255),
+    device_type VARCHAR(50),
+    public_key BLOB,
+    last_sync TIMESTAMP,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    is_active BOOLEAN DEFAULT TRUE,
+    max_enc_version INTEGER,
+    inactivity_warned_at TIMESTAMP,
+    trust_level SMALLINT NOT NULL DEFAULT 2,
+    capabilities TEXT NOT NULL DEFAULT '{}',
+    device_fingerprint VARCHAR(255)
+);
+
+CREATE TABLE IF NOT EXISTS sync_state (
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    zone VARCHAR(100) NOT NULL DEFAULT 'default',
+    gencount BIGINT NOT NULL DEFAULT 0,
+    digest BLOB,
+    last_writer_device_id TEXT,
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    PRIMARY KEY (user_id, zone)
+);
+
+-- Layer 1: Encrypted cryptographic keys
+CREATE TABLE IF NOT EXISTS crypto_keys (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    item_uuid TEXT NOT NULL,
+    zone VARCHAR(100) NOT NULL DEFAULT 'default',
+    key_class SMALLINT NOT NULL,
+    key_type SMALLINT NOT NULL,
+    label VARCHAR(255),
+    application_label VARCHAR(255),
+    access_group VARCHAR(100) NOT NULL DEFAULT 'default',
+    data BLOB NOT NULL,
+    usage_flags TEXT NOT NULL,
+    gencount BIGINT NOT NULL,
+    tombstone BOOLEAN DEFAULT FALSE,
+    wipe_id TEXT,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    UNIQUE (user_id, item_uuid, zone)
+);
+
+-- Layer 2: Credential metadata
+CREATE TABLE IF NOT EXISTS credential_metadata (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    item_uuid TEXT NOT NULL,
+    zone VARCHAR(100) NOT NULL DEFAULT 'default',
+    server VARCHAR(500) NOT NULL,
+    account VARCHAR(255) NOT NULL,
+    protocol SMALLINT NOT NULL DEFAULT 0,
+    port INTEGER NOT NULL DEFAULT 443,
+    path VARCHAR(1000),
+    label VARCHAR(255),
+    access_group VARCHAR(100) NOT NULL DEFAULT 'default',
+    password_key_uuid TEXT NOT NULL,
+    metadata_key_uuid TEXT,
+    gencount BIGINT NOT NULL,
+    tombstone BOOLEAN DEFAULT FALSE,
+    wipe_id TEXT,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    UNIQUE (user_id, item_uuid, zone)
+);
+
+-- Layer 3: Sync records
+CREATE TABLE IF NOT EXISTS sync_records (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    item_uuid TEXT NOT NULL,
+    zone VARCHAR(100) NOT NULL DEFAULT 'default',
+    parent_key_uuid TEXT,
+    wrapped_key BLOB NOT NULL,
+    enc_item BLOB NOT NULL,
+    enc_version SMALLINT NOT NULL DEFAULT 1,
+    context_id VARCHAR(100) NOT NULL DEFAULT 'default',
+    gencount BIGINT NOT NULL,
+    tombstone BOOLEAN DEFAULT FALSE,
+    wipe_id TEXT,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    UNIQUE (user_id, item_uuid, zone)
+);
+
+CREATE TABLE IF NOT EXISTS device_push_sequences (
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_id TEXT NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    last_sequence BIGINT NOT NULL,
+    updated_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    PRIMARY KEY (user_id, device_id)
+);
+
+CREATE TABLE IF NOT EXISTS bulk_wipes (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    zone VARCHAR(100) NOT NULL,
+    device_id TEXT,
+    items INTEGER NOT NULL,
+    gencount BIGINT NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    recover_until TIMESTAMP NOT NULL,
+    undone_at TIMESTAMP,
+    expired_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS sync_conflicts (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    zone VARCHAR(100) NOT NULL,
+    item_uuid TEXT NOT NULL,
+    device_id TEXT,
+    base_gencount BIGINT NOT NULL,
+    stored_gencount BIGINT NOT NULL,
+    parent_key_uuid TEXT,
+    wrapped_key BLOB NOT NULL,
+    enc_item BLOB NOT NULL,
+    enc_version SMALLINT NOT NULL DEFAULT 1,
+    context_id VARCHAR(100) NOT NULL DEFAULT 'default',
+    tombstone BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    resolved_at TIMESTAMP,
+    resolution VARCHAR(20)
+);
+
+CREATE TABLE IF NOT EXISTS breach_monitors (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    breaches TEXT NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    checked_at TIMESTAMP,
+    UNIQUE (user_id, email)
+);
+
+CREATE TABLE IF NOT EXISTS breach_alerts (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    email VARCHAR(255) NOT NULL,
+    breach VARCHAR(255) NOT NULL,
+    breach_date VARCHAR(32),
+    data_types TEXT NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'))
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_id TEXT REFERENCES devices(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    revoked BOOLEAN DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+    token_hash BLOB PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now')),
+    used_at TIMESTAMP
+);
+
+-- Append-only audit log
+CREATE TABLE IF NOT EXISTS audit_events (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    actor_id TEXT,
+    device_id TEXT,
+    action VARCHAR(100) NOT NULL,
+    zone VARCHAR(100),
+    item_uuid TEXT,
+    ip_address VARCHAR(64),
+    details TEXT,
+    created_at TIMESTAMP DEFAULT (strftime('%Y-%m-%d %H:%M:%f+00:00', 'now'))
+);
+
+CREATE TABLE IF NOT EXISTS job_reports (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    job_name VARCHAR(100) NOT NULL,
+    dry_run BOOLEAN NOT NULL DEFAULT FALSE,
+    started_at TIMESTAMP NOT NULL,
+    finished_at TIMESTAMP NOT NULL,
+    total_affected BIGINT NOT NULL DEFAULT 0,
+    details TEXT,
+    error TEXT
+);
+
+-- Indexes for performance
+CREATE INDEX IF NOT EXISTS idx_devices_user_id ON devices(user_id);
+-- One active device per fingerprint; UpsertDevice's ON CONFLICT target
+CREATE UNIQUE INDEX IF NOT EXISTS idx_devices_user_fingerprint ON devices(user_id, device_fingerprint)
+    WHERE is_active AND device_fingerprint IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_crypto_keys_user_gencount ON crypto_keys(user_id, gencount);
+CREATE INDEX IF NOT EXISTS idx_crypto_keys_user_zone ON crypto_keys(user_id, zone);
+CREATE INDEX IF NOT EXISTS idx_credential_metadata_user_gencount ON credential_metadata(user_id, gencount);
+CREATE INDEX IF NOT EXISTS idx_credential_metadata_user_zone ON credential_metadata(user_id, zone);
+CREATE INDEX IF NOT EXISTS idx_credential_metadata_server ON credential_metadata(user_id, server);
+CREATE INDEX IF NOT EXISTS idx_credential_metadata_server_account
+    ON credential_metadata(user_id, zone, lower(server), lower(account)) WHERE tombstone = false;
+CREATE INDEX IF NOT EXISTS idx_sync_records_user_gencount ON sync_records(user_id, gencount);
+CREATE INDEX IF NOT EXISTS idx_sync_records_user_zone ON sync_records(user_id, zone);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user_id ON password_reset_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_user_created ON audit_events(user_id, created_at, id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_user_zone ON audit_events(user_id, zone, id) WHERE zone IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_users_inactivity_stage ON users(inactivity_stage) WHERE inactivity_stage <> 'active';
+CREATE INDEX IF NOT EXISTS idx_users_hash_upgrade ON users(hash_upgrade_deadline) WHERE hash_upgrade_deadline IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_crypto_keys_wipe ON crypto_keys(wipe_id) WHERE wipe_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_credential_metadata_wipe ON credential_metadata(wipe_id) WHERE wipe_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_sync_records_wipe ON sync_records(wipe_id) WHERE wipe_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_bulk_wipes_user_zone ON bulk_wipes(user_id, zone, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_bulk_wipes_pending ON bulk_wipes(recover_until)
+    WHERE undone_at IS NULL AND expired_at IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sync_conflicts_pending ON sync_conflicts(user_id, zone, item_uuid)
+    WHERE resolved_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_job_reports_job_started ON job_reports(job_name, started_at DESC);
+CREATE INDEX IF NOT EXISTS idx_breach_monitors_checked ON breach_monitors(checked_at);
+CREATE INDEX IF NOT EXISTS idx_breach_alerts_user_created ON breach_alerts(user_id, created_at DESC);
+
+-- updated_at follows every update that doesn't set it itself, as the
+-- Postgres trigger does
+CREATE TRIGGER IF NOT EXISTS update_users_updated_at AFTER UPDATE ON users
+    FOR EACH ROW WHEN NEW.updated_at IS OLD.updated_at
+BEGIN
+    UPDATE users SET updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now') WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS update_crypto_keys_updated_at AFTER UPDATE ON crypto_keys
+    FOR EACH ROW WHEN NEW.updated_at IS OLD.updated_at
+BEGIN
+    UPDATE crypto_keys SET updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now') WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS update_credential_metadata_updated_at AFTER UPDATE ON credential_metadata
+    FOR EACH ROW WHEN NEW.updated_at IS OLD.updated_at
+BEGIN
+    UPDATE credential_metadata SET updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now') WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER IF NOT EXISTS update_sync_records_updated_at AFTER UPDATE ON sync_records
+    FOR EACH ROW WHEN NEW.updated_at IS OLD.updated_at
+BEGIN
+    UPDATE sync_records SET updated_at = strftime('%Y-%m-%d %H:%M:%f+00:00', 'now') WHERE id = NEW.id;
+END;
@@ -0,0 +1,734 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/google/uuid"
+)
+
+// The SQLite dialect of zones, pulls, pushes, deletes and wipes
+
+// sqliteArray binds a list for `IN (SELECT value FROM json_each($n))`,
+// SQLite's ANY
+func sqliteArray(values []string) string {
+	if values == nil {
+		values = []string{}
+	}
+	encoded, _ := json.Marshal(values)
+	return string(encoded)
+}
+
+func uuidStrings(ids []uuid.UUID) []string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = id.String()
+	}
+	return strs
+}
+
+func (s *SQLiteStore) CreateZone(userID string, bootstrap *sync.ZoneBootstrap) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertZone(tx, userID, bootstrap); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateUserWithZone creates a user and bootstraps their first zone
+// atomically
+func (s *SQLiteStore) CreateUserWithZone(email string, passwordHash, salt []byte, region string, bootstrap *sync.ZoneBootstrap) (*User, error) {
+	if err := checkSingleRegion(region); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	user, err := insertUser(tx, uuid.New().String(), email, passwordHash, salt)
+	if isSQLiteUniqueViolation(err) {
+		return nil, ErrEmailTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := insertZone(tx, user.ID, bootstrap); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *SQLiteStore) GetZonesByUser(ctx context.Context, userID string) ([]*ZoneSummary, error) {
+	return listZones(ctx, s.db, userID)
+}
+
+func (s *SQLiteStore) CountPullWindow(ctx context.Context, userID string, r PullRange) (*PullCounts, error) {
+	query := `
+		SELECT
+			(SELECT COUNT(*) FROM crypto_keys WHERE user_id = $1 AND zone = $2 AND ` + sqlitePullRangeFilter + `),
+			(SELECT COUNT(*) FROM credential_metadata WHERE user_id = $1 AND zone = $2 AND ` + sqlitePullRangeFilter + `),
+			(SELECT COUNT(*) FROM sync_records WHERE user_id = $1 AND zone = $2 AND ` + sqlitePullRangeFilter + `)
+	`
+
+	var counts PullCounts
+	err := s.db.QueryRowContext(ctx, query, sqlitePullArgs(r, userID)[:6]...).Scan(&counts.Keys, &counts.Metadata, &counts.Records)
+	if err != nil {
+		return nil, err
+	}
+	return &counts, nil
+}
+
+// ReadSnapshot calls fn with a reader inside one deferred transaction,
+// which reads a single snapshot of the WAL without blocking writers
+func (s *SQLiteStore) ReadSnapshot(ctx context.Context, userID string, fn func(SnapshotReader) error) error {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(&sqliteSnapshot{tx: tx, userID: userID}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type sqliteSnapshot struct {
+	tx     *sql.Tx
+	userID string
+}
+
+func (t *sqliteSnapshot) ListSyncStates(ctx context.Context) ([]*SyncState, error) {
+	return listSyncStates(ctx, t.tx, t.userID)
+}
+
+func (t *sqliteSnapshot) StreamCryptoKeys(ctx context.Context, r PullRange, fn func(*models.CryptoKey) error) error {
+	return sqliteStreamCryptoKeys(ctx, t.tx, t.userID, r, fn)
+}
+
+func (t *sqliteSnapshot) StreamCredentialMetadata(ctx context.Context, r PullRange, fn func(*models.CredentialMetadata) error) error {
+	return sqliteStreamCredentialMetadata(ctx, t.tx, t.userID, r, fn)
+}
+
+func (t *sqliteSnapshot) StreamSyncRecords(ctx context.Context, r PullRange, fn func(*models.SyncRecord) error) error {
+	return sqliteStreamSyncRecords(ctx, t.tx, t.userID, r, fn)
+}
+
+func (s *SQLiteStore) ProbeItems(ctx context.Context, probe ItemProbe) (ItemStates, error) {
+	ids := sqliteArray(uuidStrings(probe.ItemUUIDs))
+
+	states := ItemStates{}
+	for _, l := range probeLayers {
+		query := `
+			SELECT item_uuid, gencount, COALESCE(tombstone, false)
+			FROM ` + l.table + `
+			WHERE user_id = $1 AND zone = $2 AND item_uuid IN (SELECT value FROM json_each($3))
+		`
+		rows, err := s.db.QueryContext(ctx, query, probe.UserID, probe.Zone, ids)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id uuid.UUID
+			state := ItemState{Layer: l.layer}
+			if err := rows.Scan(&id, &state.GenCount, &state.Tombstone); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			states.Add(id, state)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return states, nil
+}
+
+// NextGenCounts reserves gencounts like PostgresStore.NextGenCounts
+func (s *SQLiteStore) NextGenCounts(ctx context.Context, userID, zone string, n int) (GenCountRange, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return GenCountRange{}, err
+	}
+	defer tx.Rollback()
+
+	genCounts, err := nextGenCounts(ctx, tx, userID, zone, int64(n))
+	if err != nil {
+		return GenCountRange{}, err
+	}
+	return genCounts, tx.Commit()
+}
+
+// CommitPush writes a push like PostgresStore.CommitPush. The transaction
+// holds the database's write lock, so device sequences need no row lock.
+func (s *SQLiteStore) CommitPush(ctx context.Context, userID string, batch *PushBatch) ([]*PushItemError, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if batch.Sequence > 0 {
+		if err := sqliteAdvancePushSequence(ctx, tx, userID, batch.DeviceID, batch.Sequence, now); err != nil {
+			return nil, err
+		}
+	}
+	genCounts, err := nextGenCounts(ctx, tx, userID, batch.Zone, batch.Len())
+	if err != nil {
+		return nil, err
+	}
+	batch.Number(genCounts)
+
+	var rejected []*PushItemError
+	writeItem := func(layer string, index int, insert func() error) error {
+		if _, err := tx.ExecContext(ctx, `SAVEPOINT push_item`); err != nil {
+			return err
+		}
+		if err := insert(); err != nil {
+			if !isSQLiteConstraint(err) {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `ROLLBACK TO SAVEPOINT push_item`); err != nil {
+				return err
+			}
+			rejected = append(rejected, &PushItemError{Layer: layer, Index: index, Err: err})
+		}
+		_, err := tx.ExecContext(ctx, `RELEASE SAVEPOINT push_item`)
+		return err
+	}
+
+	for i, key := range batch.Keys {
+		err := writeItem("crypto_key", i, func() error {
+			return insertCryptoKey(tx, userID, key.ItemUUID.String(), key)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, cred := range batch.Metadata {
+		err := writeItem("credential_metadata", i, func() error {
+			return insertCredentialMetadata(tx, userID, cred.ItemUUID.String(), cred)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i, record := range batch.Records {
+		err := writeItem("sync_record", i, func() error {
+			return insertSyncRecord(tx, userID, record.ItemUUID.String(), record)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO sync_state (user_id, zone, gencount, last_writer_device_id)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		ON CONFLICT (user_id, zone) DO UPDATE SET
+			last_writer_device_id = excluded.last_writer_device_id,
+			updated_at = $5
+	`, userID, batch.Zone, batch.GenCount, batch.DeviceID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return rejected, nil
+}
+
+// CommitImport writes a vault import like PostgresStore.CommitImport
+func (s *SQLiteStore) CommitImport(ctx context.Context, userID string, batches []*PushBatch) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	for _, batch := range batches {
+		if err := writeImportBatch(ctx, tx, userID, batch, isSQLiteConstraint); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			INSERT INTO sync_state (user_id, zone, gencount, last_writer_device_id)
+			VALUES ($1, $2, $3, NULLIF($4, ''))
+			ON CONFLICT (user_id, zone) DO UPDATE SET
+				last_writer_device_id = excluded.last_writer_device_id,
+				updated_at = $5
+		`, userID, batch.Zone, batch.GenCount, batch.DeviceID, now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// sqliteAdvancePushSequence is advancePushSequence under the write lock
+func sqliteAdvancePushSequence(ctx context.Context, tx *sql.Tx, userID, deviceID string, sequence int64, now time.Time) error {
+	var last int64
+	err := tx.QueryRowContext(ctx, `
+		SELECT last_sequence FROM device_push_sequences
+		WHERE user_id = $1 AND device_id = $2
+	`, userID, deviceID).Scan(&last)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if err := sync.CheckPushSequence(last, sequence); err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO device_push_sequences (user_id, device_id, last_sequence)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, device_id) DO UPDATE SET
+			last_sequence = excluded.last_sequence,
+			updated_at = $4
+	`, userID, deviceID, sequence, now)
+	return err
+}
+
+func (s *SQLiteStore) LiveLeafIDs(ctx context.Context, userID, zone string) ([]string, error) {
+	return liveLeafIDs(ctx, s.db, userID, zone)
+}
+
+// DeleteCredential tombstones a live credential like
+// PostgresStore.DeleteCredential
+func (s *SQLiteStore) DeleteCredential(ctx context.Context, userID string, req *CredentialDeleteRequest) (*WipeResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var passwordKey uuid.UUID
+	var metadataKey uuid.NullUUID
+	err = tx.QueryRowContext(ctx, `
+		SELECT password_key_uuid, metadata_key_uuid FROM credential_metadata
+		WHERE user_id = $1 AND zone = $2 AND item_uuid = $3 AND tombstone = false
+	`, userID, req.Zone, req.ItemUUID).Scan(&passwordKey, &metadataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyIDs := []string{passwordKey.String()}
+	if metadataKey.Valid {
+		keyIDs = append(keyIDs, metadataKey.UUID.String())
+	}
+	items, err := sqliteUnsharedKeys(ctx, tx, userID, req.Zone, req.ItemUUID, keyIDs)
+	if err != nil {
+		return nil, err
+	}
+	items = append(items, &WipedItem{Table: "credential_metadata", ItemUUID: req.ItemUUID})
+
+	var record uuid.UUID
+	err = tx.QueryRowContext(ctx, `
+		SELECT item_uuid FROM sync_records
+		WHERE user_id = $1 AND zone = $2 AND item_uuid = $3 AND tombstone = false
+	`, userID, req.Zone, req.ItemUUID).Scan(&record)
+	switch {
+	case err == nil:
+		items = append(items, &WipedItem{Table: "sync_records", ItemUUID: record})
+	case err != sql.ErrNoRows:
+		return nil, err
+	}
+
+	genCounts, err := nextGenCounts(ctx, tx, userID, req.Zone, int64(len(items)))
+	if err != nil {
+		return nil, err
+	}
+	result := &WipeResult{GenCount: genCounts.Last, Items: items}
+	if err := sqliteRenumberWipeItems(ctx, tx, userID, req.Zone, items, result.GenCount, true, nil); err != nil {
+		return nil, err
+	}
+	if err := sqliteSaveWipeState(ctx, tx, userID, req.Zone, result.GenCount, req.DeviceID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// sqliteUnsharedKeys is lockUnsharedKeys under the write lock
+func sqliteUnsharedKeys(ctx context.Context, tx *sql.Tx, userID, zone string, itemUUID uuid.UUID, keyIDs []string) ([]*WipedItem, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT k.item_uuid FROM crypto_keys k
+		WHERE k.user_id = $1 AND k.zone = $2 AND k.tombstone = false
+		  AND k.item_uuid IN (SELECT value FROM json_each($4))
+		  AND NOT EXISTS (
+			SELECT 1 FROM credential_metadata m
+			WHERE m.user_id = k.user_id AND m.zone = k.zone AND m.tombstone = false
+			  AND m.item_uuid <> $3
+			  AND (m.password_key_uuid = k.item_uuid OR m.metadata_key_uuid = k.item_uuid))
+		  AND NOT EXISTS (
+			SELECT 1 FROM sync_records r
+			WHERE r.user_id = k.user_id AND r.zone = k.zone AND r.tombstone = false
+			  AND r.item_uuid <> $3 AND r.parent_key_uuid = k.item_uuid)
+		ORDER BY k.gencount, k.item_uuid
+	`, userID, zone, itemUUID, sqliteArray(keyIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []*WipedItem
+	for rows.Next() {
+		item := &WipedItem{Table: "crypto_keys"}
+		if err := rows.Scan(&item.ItemUUID); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// WipeZone trashes every live item of the zone like PostgresStore.WipeZone
+func (s *SQLiteStore) WipeZone(ctx context.Context, userID string, req *WipeRequest) (*WipeResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	items, err := sqliteWipeItems(ctx, tx, "tombstone = false", userID, req.Zone)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		genCount, err := zoneGenCount(ctx, tx, userID, req.Zone)
+		return &WipeResult{GenCount: genCount}, err
+	}
+
+	genCounts, err := nextGenCounts(ctx, tx, userID, req.Zone, int64(len(items)))
+	if err != nil {
+		return nil, err
+	}
+	result := &WipeResult{GenCount: genCounts.Last, Items: items}
+	wipe := &BulkWipe{
+		ID:           uuid.New().String(),
+		UserID:       userID,
+		Zone:         req.Zone,
+		Items:        len(items),
+		GenCount:     result.GenCount,
+		RecoverUntil: req.RecoverUntil,
+	}
+	if req.DeviceID != "" {
+		wipe.DeviceID = &req.DeviceID
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO bulk_wipes (id, user_id, zone, device_id, items, gencount, recover_until)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, $6, $7)
+		RETURNING created_at
+	`, wipe.ID, userID, req.Zone, req.DeviceID, wipe.Items, wipe.GenCount, wipe.RecoverUntil.UTC()).Scan(&wipe.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	result.Wipe = wipe
+
+	if err := sqliteRenumberWipeItems(ctx, tx, userID, req.Zone, items, result.GenCount, true, &wipe.ID); err != nil {
+		return nil, err
+	}
+	if err := sqliteSaveWipeState(ctx, tx, userID, req.Zone, result.GenCount, req.DeviceID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// UndoWipe restores the zone's most recent bulk wipe like
+// PostgresStore.UndoWipe
+func (s *SQLiteStore) UndoWipe(ctx context.Context, userID string, req *WipeRequest, now time.Time) (*WipeResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	wipe := &BulkWipe{UserID: userID, Zone: req.Zone}
+	var deviceID sql.NullString
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, device_id, items, gencount, created_at, recover_until
+		FROM bulk_wipes
+		WHERE user_id = $1 AND zone = $2 AND undone_at IS NULL AND expired_at IS NULL
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, userID, req.Zone).Scan(&wipe.ID, &deviceID, &wipe.Items, &wipe.GenCount, &wipe.CreatedAt, &wipe.RecoverUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, sync.ErrNoWipe
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deviceID.Valid {
+		wipe.DeviceID = &deviceID.String
+	}
+	if !now.Before(wipe.RecoverUntil) {
+		return nil, sync.ErrWipeExpired
+	}
+
+	items, err := sqliteWipeItems(ctx, tx, "wipe_id = $3", userID, req.Zone, wipe.ID)
+	if err != nil {
+		return nil, err
+	}
+	genCounts, err := nextGenCounts(ctx, tx, userID, req.Zone, int64(len(items)))
+	if err != nil {
+		return nil, err
+	}
+	result := &WipeResult{Wipe: wipe, GenCount: genCounts.Last, Items: items}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE bulk_wipes SET undone_at = $2 WHERE id = $1`, wipe.ID, now.UTC()); err != nil {
+		return nil, err
+	}
+	wipe.UndoneAt = &now
+
+	if len(items) > 0 {
+		if err := sqliteRenumberWipeItems(ctx, tx, userID, req.Zone, items, result.GenCount, false, nil); err != nil {
+			return nil, err
+		}
+		if err := sqliteSaveWipeState(ctx, tx, userID, req.Zone, result.GenCount, req.DeviceID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// FindExpiredWipes lists the bulk wipes whose recovery window passed by now
+// and whose items are still marked. An empty userID covers every user.
+func (s *SQLiteStore) FindExpiredWipes(now time.Time, userID string) ([]*BulkWipe, error) {
+	rows, err := s.db.Query(`
+		SELECT id, user_id, zone, device_id, items, gencount, created_at, recover_until
+		FROM bulk_wipes
+		WHERE undone_at IS NULL AND expired_at IS NULL AND recover_until <= $1
+		  AND ($2 = '' OR user_id = $2)
+		ORDER BY recover_until
+	`, now.UTC(), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var wipes []*BulkWipe
+	for rows.Next() {
+		wipe := &BulkWipe{}
+		var deviceID sql.NullString
+		err := rows.Scan(&wipe.ID, &wipe.UserID, &wipe.Zone, &deviceID, &wipe.Items,
+			&wipe.GenCount, &wipe.CreatedAt, &wipe.RecoverUntil)
+		if err != nil {
+			return nil, err
+		}
+		if deviceID.Valid {
+			wipe.DeviceID = &deviceID.String
+		}
+		wipes = append(wipes, wipe)
+	}
+	return wipes, rows.Err()
+}
+
+// ExpireWipe turns the items a bulk wipe still marks into plain tombstones
+// and returns how many there were
+func (s *SQLiteStore) ExpireWipe(userID, wipeID string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE bulk_wipes SET expired_at = $3
+		WHERE id = $1 AND user_id = $2 AND undone_at IS NULL AND expired_at IS NULL
+	`, wipeID, userID, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return 0, err
+	}
+
+	var total int64
+	for _, table := range wipeTables {
+		result, err := tx.Exec(`
+			UPDATE `+table+` SET wipe_id = NULL
+			WHERE user_id = $1 AND wipe_id = $2
+		`, userID, wipeID)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// sqliteWipeItems is lockWipeItems under the write lock
+func sqliteWipeItems(ctx context.Context, tx *sql.Tx, predicate, userID, zone string, args ...interface{}) ([]*WipedItem, error) {
+	var items []*WipedItem
+	for _, table := range wipeTables {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT item_uuid FROM `+table+`
+			WHERE user_id = $1 AND zone = $2 AND `+predicate+`
+			ORDER BY gencount, item_uuid
+		`, append([]interface{}{userID, zone}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			item := &WipedItem{Table: table}
+			if err := rows.Scan(&item.ItemUUID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// sqliteRenumberWipeItems is renumberWipeItems one row at a time, SQLite
+// having no unnest
+func sqliteRenumberWipeItems(ctx context.Context, tx *sql.Tx, userID, zone string, items []*WipedItem, genCount int64, tombstone bool, wipeID *string) error {
+	next := genCount - int64(len(items))
+	for _, item := range items {
+		next++
+		item.GenCount = next
+		_, err := tx.ExecContext(ctx, `
+			UPDATE `+item.Table+`
+			SET tombstone = $3, wipe_id = $4, gencount = $6
+			WHERE user_id = $1 AND zone = $2 AND item_uuid = $5
+		`, userID, zone, tombstone, wipeID, item.ItemUUID, item.GenCount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteSaveWipeState is saveWipeState in the SQLite dialect
+func sqliteSaveWipeState(ctx context.Context, tx *sql.Tx, userID, zone string, genCount int64, deviceID string) error {
+	manifest, err := computeManifest(ctx, tx, userID, zone)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO sync_state (user_id, zone, gencount, digest, last_writer_device_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+		ON CONFLICT (user_id, zone) DO UPDATE SET
+			gencount = MAX(sync_state.gencount, excluded.gencount),
+			digest = excluded.digest,
+			last_writer_device_id = excluded.last_writer_device_id,
+			updated_at = $6
+	`, userID, zone, genCount, manifest.Digest, deviceID, time.Now().UTC())
+	return err
+}
+
+// QueueConflicts holds pushed records back for manual resolution like
+// PostgresStore.QueueConflicts
+func (s *SQLiteStore) QueueConflicts(ctx context.Context, userID string, conflicts []*SyncConflict) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, conflict := range conflicts {
+		if err := queueConflict(ctx, tx, userID, conflict); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) ListConflicts(ctx context.Context, userID, zone string) ([]*SyncConflict, error) {
+	return listConflicts(ctx, s.db, userID, zone)
+}
+
+// ResolveConflict settles a pending conflict like
+// PostgresStore.ResolveConflict
+func (s *SQLiteStore) ResolveConflict(ctx context.Context, userID string, req *ConflictResolveRequest) (*ConflictResolution, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	conflict, err := scanConflict(tx.QueryRowContext(ctx, `
+		SELECT `+conflictColumns+` FROM sync_conflicts
+		WHERE id = $1 AND user_id = $2 AND zone = $3 AND resolved_at IS NULL
+	`, req.ID, userID, req.Zone))
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := keepConflictVersion(ctx, tx, userID, conflict, req, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if err := sqliteSaveWipeState(ctx, tx, userID, req.Zone, result.GenCount, req.DeviceID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListZoneWatermarks returns the gencount of every user/zone, or of the
+// given users' zones only
+func (s *SQLiteStore) ListZoneWatermarks(ctx context.Context, userIDs []string) ([]ZoneWatermark, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT user_id, zone, gencount FROM sync_state
+		WHERE json_array_length($1) = 0 OR user_id IN (SELECT value FROM json_each($1))
+		ORDER BY user_id, zone
+	`, sqliteArray(userIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var watermarks []ZoneWatermark
+	for rows.Next() {
+		var w ZoneWatermark
+		if err := rows.Scan(&w.UserID, &w.Zone, &w.GenCount); err != nil {
+			return nil, err
+		}
+		watermarks = append(watermarks, w)
+	}
+	return watermarks, rows.Err()
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+)
+
+// Store is what the server needs from its database. PostgresStore is the
+// multi-tenant backend with regions; SQLiteStore keeps everything in one
+// file for self-hosters; MemoryStore is for tests. All follow the same
+// schema and return sql.ErrNoRows where a method documents it.
+//
+// Operator-only methods (regions, migrations, backup restores) stay on
+// PostgresStore.
+type Store interface {
+	Close() error
+	OnUserChanged(fn func(userID string))
+	HasRegion(region string) bool
+	Ping(ctx context.Context) error
+
+	// Users
+	CreateUser(email string, passwordHash, salt []byte, region string) (*User, error)
+	CreateUserWithZone(email string, passwordHash, salt []byte, region string, bootstrap *sync.ZoneBootstrap) (*User, error)
+	GetUserByEmail(email string) (*User, error)
+	GetUserByID(id string) (*User, error)
+	DeleteUserCascade(ctx context.Context, id string) error
+	GetAuthProfile(id string) (*auth.Profile, error)
+	SetUserActive(userID string, active bool) error
+	SetSubscriptionTier(userID, tier string) error
+	SetUserAdmin(userID string, admin bool) error
+	SetLegalHold(userID string, hold bool) error
+	BumpTokenVersion(userID string) error
+	GetUserSettings(ctx context.Context, userID string) (*UserSettings, error)
+	UpdateUserSettings(ctx context.Context, userID string, settings *UserSettings) error
+
+	// Login lockout, passwords and resets
+	IncrementFailedLogin(userID string, threshold int, lockUntil time.Time) (*time.Time, error)
+	ResetFailedLogin(userID string) error
+	IsLocked(userID string, at time.Time) (bool, time.Time, error)
+	UpdateUserPassword(userID string, hash, salt []byte, version int) (int64, error)
+	UpgradePasswordHash(userID string, hash []byte, version int) error
+	PasswordHashStats() (*PasswordHashStats, error)
+	ListDeprecatedHashAccounts(limit int) ([]*HashUpgradeAccount, error)
+	FindHashUpgradeAccounts(userID string) ([]*HashUpgradeAccount, error)
+	StartHashUpgradeCampaign(deadline time.Time) (int64, error)
+	MarkHashUpgradeNotified(userID string, at time.Time) error
+	EnforceHashUpgrade(userID string, at time.Time) (bool, error)
+	CreatePasswordResetToken(userID string, tokenHash []byte, expiresAt time.Time) error
+	ConsumePasswordResetToken(tokenHash []byte, at time.Time) (string, error)
+
+	// Account inactivity
+	TouchUser(userID string, at time.Time) (string, error)
+	FindInactiveAccounts(idleBefore time.Time, userID string) ([]*InactiveAccount, error)
+	SetInactivityStage(userID, from, to string, at time.Time) (bool, error)
+
+	// Devices
+	CreateDevice(userID, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte) (*Device, error)
+	UpsertDevice(userID, fingerprint, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte) (*Device, bool, error)
+	GetDevicesByUserID(userID string) ([]*Device, error)
+	HasActiveDevice(userID, fingerprint string) (bool, error)
+	GetAccountUsage(ctx context.Context, userID string) (*AccountUsage, error)
+	GetDevice(ctx context.Context, userID, deviceID string) (*Device, error)
+	SetDeviceMaxEncVersion(userID, deviceID string, version int) error
+	SetDeviceCapabilities(userID, deviceID string, capabilities []byte, maxEncVersion int) error
+	GetDeviceEncVersions(ctx context.Context, userID string) ([]int, error)
+	UpdateDeviceLastSync(ctx context.Context, deviceID string) error
+	RenameDevice(userID, deviceID, name string) error
+	SetDeviceTrustLevel(userID, deviceID string, from, to int) error
+	RevokeDevice(userID, deviceID string) error
+	RevokeDevices(userID string, deviceIDs []string) ([]string, error)
+	FindStaleDevices(userID string, olderThan time.Time, exceptDeviceID string) ([]*StaleDevice, error)
+	FindAutoDeactivationCandidates(now time.Time, warningDays int, userID string) ([]*StaleDevice, error)
+	MarkDevicesWarned(deviceIDs []string, at time.Time) error
+
+	// Refresh tokens
+	CreateRefreshToken(userID string, deviceID *string, expiresAt time.Time) (*RefreshToken, error)
+	GetRefreshToken(token string) (*RefreshToken, error)
+	RevokeRefreshToken(token string) error
+	RevokeRefreshTokensByUser(userID string) (int64, error)
+
+	// Zones and sync state
+	CreateZone(userID string, bootstrap *sync.ZoneBootstrap) error
+	GetZonesByUser(ctx context.Context, userID string) ([]*ZoneSummary, error)
+	GetSyncState(userID, zone string) (*SyncState, error)
+	GetSyncStateContext(ctx context.Context, userID, zone string) (*SyncState, error)
+	ListSyncStates(userID string) ([]*SyncState, error)
+	UpsertSyncState(userID, zone string, genCount int64, digest []byte) error
+	LoadEngineState(userID, zone string) (*sync.EngineState, error)
+	SaveEngineState(userID, zone string, state *sync.EngineState) error
+
+	// Items: pulls, pushes, deletes and wipes
+	GetCryptoKeysPage(ctx context.Context, userID string, r PullRange) ([]*models.CryptoKey, error)
+	GetCredentialMetadataPage(ctx context.Context, userID string, r PullRange) ([]*models.CredentialMetadata, error)
+	GetSyncRecordsPage(ctx context.Context, userID string, r PullRange) ([]*models.SyncRecord, error)
+	GetCredentialMetadataByUserWithFilter(userID, zone string, sinceGenCount int64, includeTombstoned bool) ([]*models.CredentialMetadata, error)
+	SearchCredentialMetadata(userID, zone, query string) ([]*models.CredentialMetadata, error)
+	CountPullWindow(ctx context.Context, userID string, r PullRange) (*PullCounts, error)
+	ReadSnapshot(ctx context.Context, userID string, fn func(SnapshotReader) error) error
+	ProbeItems(ctx context.Context, probe ItemProbe) (ItemStates, error)
+	NextGenCounts(ctx context.Context, userID, zone string, n int) (GenCountRange, error)
+	CommitPush(ctx context.Context, userID string, batch *PushBatch) ([]*PushItemError, error)
+	CommitImport(ctx context.Context, userID string, batches []*PushBatch) error
+	LiveLeafIDs(ctx context.Context, userID, zone string) ([]string, error)
+	DeleteCredential(ctx context.Context, userID string, req *CredentialDeleteRequest) (*WipeResult, error)
+	WipeZone(ctx context.Context, userID string, req *WipeRequest) (*WipeResult, error)
+	UndoWipe(ctx context.Context, userID string, req *WipeRequest, now time.Time) (*WipeResult, error)
+	FindExpiredWipes(now time.Time, userID string) ([]*BulkWipe, error)
+	ExpireWipe(userID, wipeID string) (int64, error)
+	QueueConflicts(ctx context.Context, userID string, conflicts []*SyncConflict) error
+	ListConflicts(ctx context.Context, userID, zone string) ([]*SyncConflict, error)
+	ResolveConflict(ctx context.Context, userID string, req *ConflictResolveRequest) (*ConflictResolution, error)
+	ListZoneWatermarks(ctx context.Context, userIDs []string) ([]ZoneWatermark, error)
+
+	// Maintenance and diagnostics
+	FindPurgeableTombstones(olderThan time.Time, userID string, sampleSize int) ([]*TombstoneSummary, error)
+	PurgeTombstones(userID, zone string, olderThan time.Time) (int64, error)
+	FindOrphanedKeys(ctx context.Context, olderThan time.Time, userID string) ([]*OrphanedKeys, error)
+	TombstoneOrphanedKeys(ctx context.Context, userID, zone string, olderThan time.Time) (*WipeResult, error)
+	ComputeManifest(ctx context.Context, userID, zone string) (*ManifestState, error)
+	ManifestLeaves(ctx context.Context, userID, zone string) ([]sync.ManifestLeaf, error)
+	SampleUserZones(fraction float64, limit int) ([]UserZone, error)
+	SaveJobReport(report *JobReport) error
+	GetJobReport(id int64) (*JobReport, error)
+	ListJobReports(jobName string, limit int) ([]*JobReport, error)
+	CountLayerItems(ctx context.Context, userID, zone string) ([]LayerCount, error)
+	FindReferenceViolations(ctx context.Context, userID, zone string, limit int) ([]ReferenceViolation, error)
+	ScanIntegrity(ctx context.Context, userID, zone string, opts IntegrityScanOptions) (*IntegrityScan, error)
+
+	// Breach monitoring
+	CreateBreachMonitor(ctx context.Context, userID, email string, limit int) (*BreachMonitor, bool, error)
+	ListBreachMonitors(ctx context.Context, userID string) ([]*BreachMonitor, error)
+	DeleteBreachMonitor(ctx context.Context, userID, id string) error
+	FindDueBreachMonitors(checkedBefore time.Time, userID string, limit int) ([]*BreachMonitor, error)
+	RecordBreachCheck(ctx context.Context, monitor *BreachMonitor, breaches []string, alerts []*BreachAlert, at time.Time) error
+	ListBreachAlerts(ctx context.Context, userID string, limit int) ([]*BreachAlert, error)
+
+	// Audit log
+	RecordAuditEvent(event *AuditEvent) error
+	RecordAuditEvents(events []*AuditEvent) error
+	NextAuditCursor(filter AuditEventFilter) (int64, bool, error)
+	StreamAuditEvents(filter AuditEventFilter, fn func(*AuditEvent) error) error
+	ListRecentAuditEvents(ctx context.Context, userID string, limit int) ([]*AuditEvent, error)
+	ListZoneActivity(ctx context.Context, filter ZoneActivityFilter) ([]*AuditEvent, error)
+	AuditEventTimes(ctx context.Context, userID, action string, since time.Time) ([]time.Time, error)
+}
+
+var (
+	_ Store = (*PostgresStore)(nil)
+	_ Store = (*SQLiteStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
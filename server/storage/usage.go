@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// AccountUsage is what an account holds of the resources its subscription
+// tier limits
+type AccountUsage struct {
+	Credentials int64 // Live credential metadata, across zones
+	Devices     int64 // Active devices
+}
+
+// accountUsage counts in SQL, so checking a limit never reads the items.
+// The statement is the same in Postgres and SQLite.
+const accountUsage = `
+	SELECT
+		(SELECT COUNT(*) FROM credential_metadata WHERE user_id = $1 AND tombstone = false),
+		(SELECT COUNT(*) FROM devices WHERE user_id = $1 AND is_active = true)
+`
+
+// GetAccountUsage counts the user's live credentials and active devices
+func (s *PostgresStore) GetAccountUsage(ctx context.Context, userID string) (*AccountUsage, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+	return getAccountUsage(ctx, db, userID)
+}
+
+func getAccountUsage(ctx context.Context, db *sql.DB, userID string) (*AccountUsage, error) {
+	usage := &AccountUsage{}
+	err := db.QueryRowContext(ctx, accountUsage, userID).Scan(&usage.Credentials, &usage.Devices)
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// HasActiveDevice reports whether the user has an active device registered
+// with fingerprint, which registering again reuses rather than adds
+func (s *PostgresStore) HasActiveDevice(userID, fingerprint string) (bool, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return false, err
+	}
+	return hasActiveDevice(db, userID, fingerprint)
+}
+
+func hasActiveDevice(db *sql.DB, userID, fingerprint string) (bool, error) {
+	var one int
+	err := db.QueryRow(`
+		SELECT 1 FROM devices
+		WHERE user_id = $1 AND device_fingerprint = $2 AND is_active = true
+		LIMIT 1
+	`, userID, fingerprint).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
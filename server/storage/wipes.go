@@ -0,0 +1,357 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// Bulk wipe methods. A wipe trashes a zone's live items: clients see
+// tombstones, while the rows keep their wipe_id until the wipe is undone or
+// its recovery window passes.
+
+// wipeTables are the item tables in push order; wipes and undos number
+// their items in this order
+var wipeTables = []string{"crypto_keys", "credential_metadata", "sync_records"}
+
+type BulkWipe struct {
+	ID           string
+	UserID       string
+	Zone         string
+	DeviceID     *string // nil for clients without a device claim
+	Items        int
+	GenCount     int64 // Zone gencount after the wipe
+	CreatedAt    time.Time
+	RecoverUntil time.Time
+	UndoneAt     *time.Time
+}
+
+// WipedItem is one item a wipe trashed or an undo restored, with its new
+// gencount
+type WipedItem struct {
+	Table    string // One of wipeTables
+	ItemUUID uuid.UUID
+	GenCount int64
+}
+
+// WipeResult is a committed wipe or undo
+type WipeResult struct {
+	Wipe     *BulkWipe
+	GenCount int64 // Zone gencount afterwards
+	Items    []*WipedItem
+}
+
+type WipeRequest struct {
+	Zone         string
+	DeviceID     string // Writer; "" for clients without a device claim
+	RecoverUntil time.Time
+}
+
+// WipeZone trashes every live item of the zone in one transaction: each
+// becomes a tombstone marked with a new bulk wipe and renumbered from the
+// reserved gencounts, and the zone's gencount and digest move with them.
+// A zone without live items is left as is and the result has no Wipe.
+func (s *PostgresStore) WipeZone(ctx context.Context, userID string, req *WipeRequest) (*WipeResult, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	items, err := lockWipeItems(ctx, tx, "tombstone = false", userID, req.Zone)
+	if err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		genCount, err := zoneGenCount(ctx, tx, userID, req.Zone)
+		return &WipeResult{GenCount: genCount}, err
+	}
+
+	genCounts, err := nextGenCounts(ctx, tx, userID, req.Zone, int64(len(items)))
+	if err != nil {
+		return nil, err
+	}
+	result := &WipeResult{GenCount: genCounts.Last, Items: items}
+	wipe := &BulkWipe{
+		UserID:       userID,
+		Zone:         req.Zone,
+		Items:        len(items),
+		GenCount:     result.GenCount,
+		RecoverUntil: req.RecoverUntil,
+	}
+	if req.DeviceID != "" {
+		wipe.DeviceID = &req.DeviceID
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO bulk_wipes (user_id, zone, device_id, items, gencount, recover_until)
+		VALUES ($1, $2, NULLIF($3, '')::uuid, $4, $5, $6)
+		RETURNING id, created_at
+	`, userID, req.Zone, req.DeviceID, wipe.Items, wipe.GenCount, wipe.RecoverUntil).Scan(&wipe.ID, &wipe.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	result.Wipe = wipe
+
+	if err := renumberWipeItems(ctx, tx, userID, req.Zone, items, result.GenCount, true, &wipe.ID); err != nil {
+		return nil, err
+	}
+	if err := saveWipeState(ctx, tx, userID, req.Zone, result.GenCount, req.DeviceID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// UndoWipe restores the items of the zone's most recent bulk wipe that was
+// neither undone nor expired, in one transaction: they become live again
+// with new gencounts and the zone's gencount and digest move with them.
+// Items pushed again since the wipe keep their newer state. Returns
+// sync.ErrNoWipe without such a wipe and sync.ErrWipeExpired once its
+// recovery window passed. req.RecoverUntil is not used.
+func (s *PostgresStore) UndoWipe(ctx context.Context, userID string, req *WipeRequest, now time.Time) (*WipeResult, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	wipe := &BulkWipe{UserID: userID, Zone: req.Zone}
+	var deviceID sql.NullString
+	err = tx.QueryRowContext(ctx, `
+		SELECT id, device_id, items, gencount, created_at, recover_until
+		FROM bulk_wipes
+		WHERE user_id = $1 AND zone = $2 AND undone_at IS NULL AND expired_at IS NULL
+		ORDER BY created_at DESC
+		LIMIT 1
+		FOR UPDATE
+	`, userID, req.Zone).Scan(&wipe.ID, &deviceID, &wipe.Items, &wipe.GenCount, &wipe.CreatedAt, &wipe.RecoverUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, sync.ErrNoWipe
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deviceID.Valid {
+		wipe.DeviceID = &deviceID.String
+	}
+	if !now.Before(wipe.RecoverUntil) {
+		return nil, sync.ErrWipeExpired
+	}
+
+	items, err := lockWipeItems(ctx, tx, "wipe_id = $3", userID, req.Zone, wipe.ID)
+	if err != nil {
+		return nil, err
+	}
+	genCounts, err := nextGenCounts(ctx, tx, userID, req.Zone, int64(len(items)))
+	if err != nil {
+		return nil, err
+	}
+	result := &WipeResult{Wipe: wipe, GenCount: genCounts.Last, Items: items}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE bulk_wipes SET undone_at = $2 WHERE id = $1`, wipe.ID, now); err != nil {
+		return nil, err
+	}
+	wipe.UndoneAt = &now
+
+	if len(items) > 0 {
+		if err := renumberWipeItems(ctx, tx, userID, req.Zone, items, result.GenCount, false, nil); err != nil {
+			return nil, err
+		}
+		if err := saveWipeState(ctx, tx, userID, req.Zone, result.GenCount, req.DeviceID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// FindExpiredWipes lists the bulk wipes whose recovery window passed by now
+// and whose items are still marked. An empty userID covers every user.
+// Read-only.
+func (s *PostgresStore) FindExpiredWipes(now time.Time, userID string) ([]*BulkWipe, error) {
+	var wipes []*BulkWipe
+	err := s.eachRegion(func(_ string, db *sql.DB) error {
+		rows, err := db.Query(`
+			SELECT id, user_id, zone, device_id, items, gencount, created_at, recover_until
+			FROM bulk_wipes
+			WHERE undone_at IS NULL AND expired_at IS NULL AND recover_until <= $1
+			  AND ($2 = '' OR user_id::text = $2)
+			ORDER BY recover_until
+		`, now, userID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			wipe := &BulkWipe{}
+			var deviceID sql.NullString
+			err := rows.Scan(&wipe.ID, &wipe.UserID, &wipe.Zone, &deviceID, &wipe.Items,
+				&wipe.GenCount, &wipe.CreatedAt, &wipe.RecoverUntil)
+			if err != nil {
+				return err
+			}
+			if deviceID.Valid {
+				wipe.DeviceID = &deviceID.String
+			}
+			wipes = append(wipes, wipe)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return wipes, nil
+}
+
+// ExpireWipe turns the items a bulk wipe still marks into plain tombstones,
+// which the tombstone purge picks up from then on, and returns how many
+// there were. A wipe undone in the meantime is left alone.
+func (s *PostgresStore) ExpireWipe(userID, wipeID string) (int64, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Updating the wipe first serializes with a concurrent undo
+	result, err := tx.Exec(`
+		UPDATE bulk_wipes SET expired_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND undone_at IS NULL AND expired_at IS NULL
+	`, wipeID, userID)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return 0, err
+	}
+
+	var total int64
+	for _, table := range wipeTables {
+		result, err := tx.Exec(`
+			UPDATE `+table+` SET wipe_id = NULL
+			WHERE user_id = $1 AND wipe_id = $2
+		`, userID, wipeID)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// lockWipeItems locks the zone's items matching predicate, which may refer
+// to args from $3 on, and returns them in numbering order
+func lockWipeItems(ctx context.Context, tx *sql.Tx, predicate, userID, zone string, args ...interface{}) ([]*WipedItem, error) {
+	var items []*WipedItem
+	for _, table := range wipeTables {
+		rows, err := tx.QueryContext(ctx, `
+			SELECT item_uuid FROM `+table+`
+			WHERE user_id = $1 AND zone = $2 AND `+predicate+`
+			ORDER BY gencount, item_uuid
+			FOR UPDATE
+		`, append([]interface{}{userID, zone}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			item := &WipedItem{Table: table}
+			if err := rows.Scan(&item.ItemUUID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// renumberWipeItems gives items the gencounts up to genCount, in order,
+// and sets their tombstone flag and wipe mark
+func renumberWipeItems(ctx context.Context, tx *sql.Tx, userID, zone string, items []*WipedItem, genCount int64, tombstone bool, wipeID *string) error {
+	next := genCount - int64(len(items))
+	byTable := map[string][]*WipedItem{}
+	for _, item := range items {
+		next++
+		item.GenCount = next
+		byTable[item.Table] = append(byTable[item.Table], item)
+	}
+
+	for _, table := range wipeTables {
+		tableItems := byTable[table]
+		if len(tableItems) == 0 {
+			continue
+		}
+		ids := make([]string, len(tableItems))
+		genCounts := make([]int64, len(tableItems))
+		for i, item := range tableItems {
+			ids[i] = item.ItemUUID.String()
+			genCounts[i] = item.GenCount
+		}
+		_, err := tx.ExecContext(ctx, `
+			UPDATE `+table+` AS item
+			SET tombstone = $3, wipe_id = $4, gencount = numbered.gencount
+			FROM unnest($5::uuid[], $6::bigint[]) AS numbered(item_uuid, gencount)
+			WHERE item.user_id = $1 AND item.zone = $2 AND item.item_uuid = numbered.item_uuid
+		`, userID, zone, tombstone, wipeID, pq.Array(ids), pq.Array(genCounts))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveWipeState moves the zone's gencount and digest along with a wipe or
+// undo, inside its transaction
+func saveWipeState(ctx context.Context, tx *sql.Tx, userID, zone string, genCount int64, deviceID string) error {
+	manifest, err := computeManifest(ctx, tx, userID, zone)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO sync_state (user_id, zone, gencount, digest, last_writer_device_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, '')::uuid)
+		ON CONFLICT (user_id, zone) DO UPDATE SET
+			gencount = GREATEST(sync_state.gencount, EXCLUDED.gencount),
+			digest = EXCLUDED.digest,
+			last_writer_device_id = EXCLUDED.last_writer_device_id,
+			updated_at = NOW()
+	`, userID, zone, genCount, manifest.Digest, deviceID)
+	return err
+}
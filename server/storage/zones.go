@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/google/uuid"
+)
+
+// CreateZone writes a new zone's sync state and, for templates that have one,
+// its metadata key in a single transaction. It returns sync.ErrZoneExists if
+// the user already has sync state for the zone.
+func (s *PostgresStore) CreateZone(userID string, bootstrap *sync.ZoneBootstrap) error {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertZone(tx, userID, bootstrap); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateUserWithZone creates a user in region ("" for DefaultRegion) and
+// bootstraps their first zone atomically: either both exist afterwards or
+// neither does.
+func (s *PostgresStore) CreateUserWithZone(email string, passwordHash, salt []byte, region string, bootstrap *sync.ZoneBootstrap) (*User, error) {
+	var user *User
+	err := s.createInRegion(uuid.New().String(), email, region, func(db *sql.DB, userID string) error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		user, err = insertUser(tx, userID, email, passwordHash, salt)
+		if err != nil {
+			return err
+		}
+		if err := insertZone(tx, user.ID, bootstrap); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func insertZone(q querier, userID string, bootstrap *sync.ZoneBootstrap) error {
+	manifest := bootstrap.Manifest
+	result, err := q.Exec(`
+		INSERT INTO sync_state (user_id, zone, gencount, digest)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, zone) DO NOTHING
+	`, userID, manifest.Zone, manifest.GenCount, manifest.Digest)
+	if err != nil {
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err != nil {
+		return err
+	} else if inserted == 0 {
+		return sync.ErrZoneExists
+	}
+
+	if key := bootstrap.MetadataKey; key != nil {
+		return insertCryptoKey(q, userID, key.ItemUUID.String(), key)
+	}
+	return nil
+}
+
+// ZoneSummary is a zone's sync state with how many live items it holds in
+// each layer
+type ZoneSummary struct {
+	SyncState
+	Keys     int64
+	Metadata int64
+	Records  int64
+}
+
+// GetZonesByUser returns a summary of every zone the user has written,
+// ordered by name
+func (s *PostgresStore) GetZonesByUser(ctx context.Context, userID string) ([]*ZoneSummary, error) {
+	db, err := s.userDB(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return listZones(ctx, db, userID)
+}
+
+func listZones(ctx context.Context, q rowQuerier, userID string) ([]*ZoneSummary, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT `+syncStateColumns+`,
+			(SELECT COUNT(*) FROM crypto_keys k
+			 WHERE k.user_id = s.user_id AND k.zone = s.zone AND k.tombstone = false),
+			(SELECT COUNT(*) FROM credential_metadata m
+			 WHERE m.user_id = s.user_id AND m.zone = s.zone AND m.tombstone = false),
+			(SELECT COUNT(*) FROM sync_records r
+			 WHERE r.user_id = s.user_id AND r.zone = s.zone AND r.tombstone = false)
+		FROM sync_state s
+		LEFT JOIN devices d ON d.id = s.last_writer_device_id
+		WHERE s.user_id = $1
+		ORDER BY s.zone
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	zones := []*ZoneSummary{}
+	for rows.Next() {
+		zone := &ZoneSummary{}
+		err := rows.Scan(
+			&zone.UserID, &zone.Zone, &zone.GenCount,
+			&zone.Digest, &zone.UpdatedAt,
+			&zone.LastWriterDeviceID, &zone.LastWriterDeviceName,
+			&zone.Keys, &zone.Metadata, &zone.Records,
+		)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, zone)
+	}
+	return zones, rows.Err()
+}
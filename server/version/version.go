@@ -0,0 +1,50 @@
+// Package version identifies the running build. The variables are set at
+// link time:
+//
+//	go build -ldflags "-X github.com/deeplyprofound/password-sync/server/version.Version=1.4.0 \
+//	  -X github.com/deeplyprofound/password-sync/server/version.Commit=$(git rev-parse --short HEAD) \
+//	  -X github.com/deeplyprofound/password-sync/server/version.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" ./server/cmd
+//
+// Builds without them (go run, go test) report Dev.
+package version
+
+// Product is the name in the Server header
+const Product = "password-sync"
+
+// Dev stands in for any value the build did not set
+const Dev = "dev"
+
+var (
+	Version   string // Semantic version, e.g. "1.4.0"
+	Commit    string // Git commit the binary was built from
+	BuildDate string // RFC 3339 UTC build time
+)
+
+// Info is the build identity as /version reports it
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// Get returns the build identity, with Dev for anything unset
+func Get() Info {
+	return Info{
+		Version:   orDev(Version),
+		Commit:    orDev(Commit),
+		BuildDate: orDev(BuildDate),
+	}
+}
+
+// ServerHeader is the value of the Server response header,
+// e.g. "password-sync/1.4.0"
+func ServerHeader() string {
+	return Product + "/" + orDev(Version)
+}
+
+func orDev(value string) string {
+	if value == "" {
+		return Dev
+	}
+	return value
+}
@@ -0,0 +1,158 @@
+package unit
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/service"
+	authservice "github.com/deeplyprofound/password-sync/server/service/auth"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// accountTables are every table with rows of an account, users aside
+var accountTables = []string{
+	"devices", "sync_state", "crypto_keys", "credential_metadata", "sync_records",
+	"device_push_sequences", "bulk_wipes", "sync_conflicts", "refresh_tokens",
+	"password_reset_tokens", "audit_events", "breach_monitors", "breach_alerts",
+}
+
+// TestStoresDeleteUserCascade fills every table for one account, deletes it
+// and counts what is left in the database itself. Postgres joins in with
+// POSTGRES_TEST_CONN set (see TestPostgresMigrationChain).
+func TestStoresDeleteUserCascade(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "password-sync.db")
+	sqlite, err := storage.NewSQLiteStore(path)
+	require.NoError(t, err)
+	defer sqlite.Close()
+	require.NoError(t, sqlite.ApplySchema())
+	sqliteDB, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer sqliteDB.Close()
+
+	stores := map[string]storage.Store{"sqlite": sqlite}
+	dbs := map[string]*sql.DB{"sqlite": sqliteDB}
+	if conn := os.Getenv("POSTGRES_TEST_CONN"); conn != "" {
+		postgres, err := storage.NewPostgresStore(conn)
+		require.NoError(t, err)
+		defer postgres.Close()
+		_, err = postgres.Migrate(ctx)
+		require.NoError(t, err)
+		postgresDB, err := sql.Open("postgres", conn)
+		require.NoError(t, err)
+		defer postgresDB.Close()
+		stores["postgres"], dbs["postgres"] = postgres, postgresDB
+	}
+
+	for name, store := range stores {
+		db := dbs[name]
+		t.Run(name, func(t *testing.T) {
+			alice, err := store.CreateUser(uuid.New().String()+"@example.com", []byte("hash"), []byte("salt"), "")
+			require.NoError(t, err)
+			bob, err := store.CreateUser(uuid.New().String()+"@example.com", []byte("hash"), []byte("salt"), "")
+			require.NoError(t, err)
+
+			for _, user := range []*storage.User{alice, bob} {
+				device, err := store.CreateDevice(user.ID, "Laptop", "desktop", nil, 0, nil)
+				require.NoError(t, err)
+				batch, credID := sqliteBatch("default")
+				batch.DeviceID, batch.Sequence = device.ID, 1
+				_, err = store.CommitPush(ctx, user.ID, batch)
+				require.NoError(t, err)
+				work, _ := sqliteBatch("work")
+				_, err = store.CommitPush(ctx, user.ID, work)
+				require.NoError(t, err)
+				_, err = store.WipeZone(ctx, user.ID, &storage.WipeRequest{Zone: "work", RecoverUntil: time.Now().Add(time.Hour)})
+				require.NoError(t, err)
+				require.NoError(t, store.QueueConflicts(ctx, user.ID, []*storage.SyncConflict{{
+					Zone: "default", ItemUUID: credID, BaseGenCount: 1, StoredGenCount: 3, Pushed: batch.Records[0],
+				}}))
+				_, err = store.CreateRefreshToken(user.ID, &device.ID, time.Now().Add(time.Hour))
+				require.NoError(t, err)
+				require.NoError(t, store.CreatePasswordResetToken(user.ID, []byte(user.ID), time.Now().Add(time.Hour)))
+				require.NoError(t, store.RecordAuditEvent(&storage.AuditEvent{UserID: user.ID, Action: service.AuditActionSyncPush}))
+				monitor, _, err := store.CreateBreachMonitor(ctx, user.ID, user.Email, 5)
+				require.NoError(t, err)
+				require.NoError(t, store.RecordBreachCheck(ctx, monitor, []string{"Canva"}, []*storage.BreachAlert{{Email: user.Email, Breach: "Canva"}}, time.Now()))
+			}
+
+			require.NoError(t, store.SetLegalHold(alice.ID, true))
+			assert.ErrorIs(t, store.DeleteUserCascade(ctx, alice.ID), sql.ErrNoRows, "an account on hold is kept")
+			require.NoError(t, store.SetLegalHold(alice.ID, false))
+
+			var changed []string
+			store.OnUserChanged(func(userID string) { changed = append(changed, userID) })
+			require.NoError(t, store.DeleteUserCascade(ctx, alice.ID))
+			assert.Equal(t, []string{alice.ID}, changed)
+			assert.ErrorIs(t, store.DeleteUserCascade(ctx, alice.ID), sql.ErrNoRows)
+
+			count := func(table, column, userID string) int {
+				var n int
+				require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE `+column+` = $1`, userID).Scan(&n))
+				return n
+			}
+			assert.Zero(t, count("users", "id", alice.ID))
+			assert.Equal(t, 1, count("users", "id", bob.ID))
+			for _, table := range accountTables {
+				assert.Zero(t, count(table, "user_id", alice.ID), table)
+				assert.NotZero(t, count(table, "user_id", bob.ID), "%s of another account", table)
+			}
+		})
+	}
+}
+
+func TestAuthServiceDeleteAccount(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}
+	store := newMemStore(clock)
+	accounts := authservice.NewService(store)
+	accounts.SetClock(clock)
+	var deleted []*storage.User
+	accounts.OnAccountDeleted(func(user *storage.User) { deleted = append(deleted, user) })
+	ctx := context.Background()
+
+	registered, err := accounts.Register(ctx, service.Caller{}, authservice.RegisterInput{Email: "a@example.com", Password: "hunter22"})
+	require.NoError(t, err)
+	caller := service.Caller{UserID: registered.User.ID}
+
+	err = accounts.DeleteAccount(ctx, caller, "hunter23")
+	assertServiceError(t, err, service.KindForbidden, "invalid_current_password")
+	store.users[caller.UserID].LegalHold = true
+	err = accounts.DeleteAccount(ctx, caller, "hunter22")
+	assertServiceError(t, err, service.KindLocked, "legal_hold")
+	store.users[caller.UserID].LegalHold = false
+	assert.Empty(t, deleted)
+
+	require.NoError(t, accounts.DeleteAccount(ctx, caller, "hunter22"))
+	assert.NotContains(t, store.users, caller.UserID)
+	require.Len(t, deleted, 1)
+	assert.Equal(t, "a@example.com", deleted[0].Email)
+	_, err = accounts.Refresh(ctx, service.Caller{}, registered.RefreshToken)
+	assertServiceError(t, err, service.KindUnauthorized, "")
+}
+
+// Once deleted, the account's token stops working at once and its email
+// can register again
+func TestDeleteAccountEndpoint(t *testing.T) {
+	s := newImportServer(t)
+	alice := s.register("alice@example.com")
+	s.pushCredential(alice, "default")
+
+	wrong := s.do(alice, http.MethodDelete, "/api/v1/account", []byte(`{"password":"wrong horse battery"}`), http.StatusForbidden)
+	assert.Equal(t, "invalid_current_password", wrong["code"])
+	s.do(alice, http.MethodDelete, "/api/v1/account", []byte(`{}`), http.StatusBadRequest)
+
+	s.do(alice, http.MethodDelete, "/api/v1/account", []byte(`{"password":"correct horse battery"}`), http.StatusOK)
+	s.do(alice, http.MethodGet, "/api/v1/account/limits", nil, http.StatusUnauthorized)
+
+	again := s.register("alice@example.com")
+	limits := s.do(again, http.MethodGet, "/api/v1/account/limits", nil, http.StatusOK)
+	assert.Equal(t, float64(0), limits["credentials"].(map[string]interface{})["used"])
+}
@@ -0,0 +1,265 @@
+package unit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// auditExportAPI serves the API on a memory store with two accounts
+type auditExportAPI struct {
+	store   *storage.MemoryStore
+	handler http.Handler
+	alice   *storage.User
+	bob     *storage.User
+	tokens  map[string]string // By user ID
+}
+
+func newAuditExportAPI(t *testing.T) *auditExportAPI {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	store := storage.NewMemoryStore()
+	a := &auditExportAPI{store: store, handler: api.NewServerWithAuth(store).Handler(), tokens: map[string]string{}}
+
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		body, err := json.Marshal(map[string]string{"email": email, "password": "correct horse battery"})
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/auth/register", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		a.handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var resp map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+		user, err := store.GetUserByEmail(email)
+		require.NoError(t, err)
+		a.tokens[user.ID] = resp["access_token"].(string)
+		if a.alice == nil {
+			a.alice = user
+		} else {
+			a.bob = user
+		}
+	}
+	return a
+}
+
+// export requests the audit export as user with query
+func (a *auditExportAPI) export(t *testing.T, user *storage.User, query url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	if query.Get("to") == "" {
+		// Past the events the test records, which the default would cut at the request
+		query.Set("to", time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/auth/audit/export?"+query.Encode(), nil)
+	req.Header.Set("Authorization", "Bearer "+a.tokens[user.ID])
+	w := httptest.NewRecorder()
+	a.handler.ServeHTTP(w, req)
+	return w
+}
+
+// record adds audit events for user with the given actions
+func (a *auditExportAPI) record(t *testing.T, user *storage.User, actions ...string) []int64 {
+	t.Helper()
+	var ids []int64
+	for _, action := range actions {
+		event := &storage.AuditEvent{UserID: user.ID, Action: action, IPAddress: "192.0.2.1"}
+		require.NoError(t, a.store.RecordAuditEvent(event))
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+// exportActions returns the details of the audit.export events in user's log
+func (a *auditExportAPI) exportActions(t *testing.T, user *storage.User) []map[string]interface{} {
+	t.Helper()
+	var exports []map[string]interface{}
+	err := a.store.StreamAuditEvents(storage.AuditEventFilter{
+		UserID: user.ID, To: time.Now().Add(time.Hour), Limit: 1000,
+	}, func(event *storage.AuditEvent) error {
+		if event.Action == service.AuditActionAuditExport {
+			var details map[string]interface{}
+			require.NoError(t, json.Unmarshal(event.Details, &details))
+			exports = append(exports, details)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return exports
+}
+
+func TestAuditExportCSVEscapes(t *testing.T) {
+	a := newAuditExportAPI(t)
+	zone := `work, "home"`
+	tricky := &storage.AuditEvent{
+		UserID: a.alice.ID, Action: "item.update", Zone: &zone, IPAddress: "192.0.2.1",
+		Details: []byte(`{"note":"first, \"second\"\nthird"}`),
+	}
+	require.NoError(t, a.store.RecordAuditEvent(tricky))
+
+	w := a.export(t, a.alice, url.Values{})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), `.csv"`)
+	assert.Empty(t, w.Header().Get("X-Next-Cursor"))
+
+	rows, err := csv.NewReader(bytes.NewReader(w.Body.Bytes())).ReadAll()
+	require.NoError(t, err, "RFC 4180: quotes doubled, fields with commas, quotes or newlines quoted")
+	require.NotEmpty(t, rows)
+	assert.Equal(t, []string{
+		"id", "created_at", "user_id", "actor_id", "device_id",
+		"action", "zone", "item_uuid", "ip_address", "details",
+	}, rows[0])
+
+	var found []string
+	for _, row := range rows[1:] {
+		require.Len(t, row, 10)
+		if row[5] == "item.update" {
+			found = row
+		}
+	}
+	require.NotNil(t, found)
+	assert.Equal(t, zone, found[6])
+	assert.Equal(t, string(tricky.Details), found[9])
+	assert.Equal(t, a.alice.ID, found[2])
+}
+
+func TestAuditExportJSONLines(t *testing.T) {
+	a := newAuditExportAPI(t)
+	ids := a.record(t, a.alice, "device.register", "item.update")
+
+	w := a.export(t, a.alice, url.Values{"format": {"jsonl"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), `.jsonl"`)
+
+	var exported []int64
+	scanner := bufio.NewScanner(bytes.NewReader(w.Body.Bytes()))
+	for scanner.Scan() {
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record), "one JSON object per line: %s", scanner.Text())
+		assert.Equal(t, a.alice.ID, record["user_id"])
+		assert.Contains(t, record, "details")
+		exported = append(exported, int64(record["id"].(float64)))
+	}
+	require.NoError(t, scanner.Err())
+	assert.Subset(t, exported, ids)
+
+	w = a.export(t, a.alice, url.Values{"format": {"xml"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// Past limit rows the export stops and X-Next-Cursor resumes it, each row
+// coming once and in order
+func TestAuditExportRowCap(t *testing.T) {
+	a := newAuditExportAPI(t)
+	seeded := a.record(t, a.alice, "a.1", "a.2", "a.3", "a.4", "a.5")
+
+	var exported []int64
+	query := url.Values{"format": {"jsonl"}, "limit": {"2"}, "to": {time.Now().Add(time.Hour).UTC().Format(time.RFC3339)}}
+	pages := 0
+	for {
+		pages++
+		require.Less(t, pages, 20, "the cursor must run out")
+		w := a.export(t, a.alice, query)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		lines := 0
+		scanner := bufio.NewScanner(bytes.NewReader(w.Body.Bytes()))
+		for scanner.Scan() {
+			var record struct {
+				ID     int64  `json:"id"`
+				Action string `json:"action"`
+			}
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+			lines++
+			if record.Action != service.AuditActionAuditExport {
+				exported = append(exported, record.ID)
+			}
+		}
+		assert.LessOrEqual(t, lines, 2)
+
+		cursor := w.Header().Get("X-Next-Cursor")
+		if cursor == "" {
+			break
+		}
+		assert.Equal(t, 2, lines, "only a full page has a next one")
+		query.Set("cursor", cursor)
+	}
+	assert.Greater(t, pages, 2)
+	assert.Subset(t, exported, seeded)
+	assert.IsIncreasing(t, exported, "in ID order, none twice")
+
+	for _, limit := range []string{"0", "-1", "100001", "many"} {
+		w := a.export(t, a.alice, url.Values{"limit": {limit}})
+		assert.Equal(t, http.StatusBadRequest, w.Code, limit)
+	}
+	w := a.export(t, a.alice, url.Values{"cursor": {"not base64!"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestAuditExportOtherUser(t *testing.T) {
+	a := newAuditExportAPI(t)
+	a.record(t, a.bob, "bob.only")
+
+	w := a.export(t, a.alice, url.Values{"user_id": {a.bob.ID}})
+	assert.Equal(t, http.StatusForbidden, w.Code, "only admins export another account")
+	assert.Empty(t, a.exportActions(t, a.bob), "a refused export is not audited")
+
+	w = a.export(t, a.bob, url.Values{"user_id": {a.bob.ID}})
+	assert.Equal(t, http.StatusOK, w.Code, "naming oneself needs no admin")
+
+	require.NoError(t, a.store.SetUserAdmin(a.alice.ID, true))
+	w = a.export(t, a.alice, url.Values{"user_id": {"not-a-uuid"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = a.export(t, a.alice, url.Values{"user_id": {a.bob.ID}, "format": {"jsonl"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"action":"bob.only"`)
+	scanner := bufio.NewScanner(bytes.NewReader(w.Body.Bytes()))
+	for scanner.Scan() {
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		assert.Equal(t, a.bob.ID, record["user_id"], "the admin's own log stays out")
+	}
+}
+
+// Each export is recorded on the exported account's log, with its format
+// and window
+func TestAuditExportIsAudited(t *testing.T) {
+	a := newAuditExportAPI(t)
+	from := time.Now().Add(-24 * time.Hour).UTC().Truncate(time.Second)
+	to := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	w := a.export(t, a.alice, url.Values{
+		"format": {"jsonl"}, "from": {from.Format(time.RFC3339)}, "to": {to.Format(time.RFC3339)},
+	})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	exports := a.exportActions(t, a.alice)
+	require.Len(t, exports, 1)
+	assert.Equal(t, map[string]interface{}{
+		"format": "jsonl", "from": from.Format(time.RFC3339), "to": to.Format(time.RFC3339),
+	}, exports[0])
+
+	require.NoError(t, a.store.SetUserAdmin(a.alice.ID, true))
+	w = a.export(t, a.alice, url.Values{"user_id": {a.bob.ID}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, a.exportActions(t, a.bob), 1, "recorded on the exported account")
+	assert.Len(t, a.exportActions(t, a.alice), 1)
+
+	w = a.export(t, a.alice, url.Values{"from": {"yesterday"}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Len(t, a.exportActions(t, a.alice), 1, "a refused export is not audited")
+}
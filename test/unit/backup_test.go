@@ -0,0 +1,290 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/backup"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// backupStore keeps the three sync tables and sync_state in memory, with
+// the upsert semantics of storage: rows are keyed by user, zone and item
+type backupStore struct {
+	keys     map[string]*models.CryptoKey
+	metadata map[string]*models.CredentialMetadata
+	records  map[string]*models.SyncRecord
+	gencount map[string]int64 // user/zone
+}
+
+func newBackupStore() *backupStore {
+	return &backupStore{
+		keys:     make(map[string]*models.CryptoKey),
+		metadata: make(map[string]*models.CredentialMetadata),
+		records:  make(map[string]*models.SyncRecord),
+		gencount: make(map[string]int64),
+	}
+}
+
+func rowKey(userID uuid.UUID, zone string, item uuid.UUID) string {
+	return userID.String() + "/" + zone + "/" + item.String()
+}
+
+// push writes one item to every layer at the zone's next gencount,
+// tombstoned or not
+func (s *backupStore) push(userID uuid.UUID, zone string, item uuid.UUID, payload string, tombstone bool) {
+	zoneKey := userID.String() + "/" + zone
+	s.gencount[zoneKey]++
+	gen := s.gencount[zoneKey]
+	key := rowKey(userID, zone, item)
+	s.keys[key] = &models.CryptoKey{UserID: userID, ItemUUID: item, Zone: zone, Data: []byte(payload), Flags: []byte(`{"encrypt":true}`), GenCount: gen, Tombstone: tombstone}
+	s.metadata[key] = &models.CredentialMetadata{UserID: userID, ItemUUID: item, Zone: zone, Server: payload + ".example.com", Account: "me", PasswordKeyUUID: item, GenCount: gen, Tombstone: tombstone}
+	s.records[key] = &models.SyncRecord{UserID: userID, ItemUUID: item, Zone: zone, WrappedKey: []byte("wk"), EncItem: []byte(payload), EncVersion: 1, ContextID: "default", GenCount: gen, Tombstone: tombstone}
+}
+
+func (s *backupStore) ListZoneWatermarks(ctx context.Context, userIDs []string) ([]storage.ZoneWatermark, error) {
+	var out []storage.ZoneWatermark
+	for zoneKey, gen := range s.gencount {
+		userID, zone, _ := strings.Cut(zoneKey, "/")
+		if len(userIDs) > 0 && !contains(userIDs, userID) {
+			continue
+		}
+		out = append(out, storage.ZoneWatermark{UserID: userID, Zone: zone, GenCount: gen})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].UserID+out[i].Zone < out[j].UserID+out[j].Zone
+	})
+	return out, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// page applies a PullRange the way the SQL does: filter, order by gencount
+// then item, offset, limit
+func page[T any](rows map[string]T, userID string, r storage.PullRange, fields func(T) (string, string, uuid.UUID, int64, bool)) []T {
+	var matched []T
+	for _, row := range rows {
+		owner, zone, _, gen, tombstone := fields(row)
+		if owner != userID || zone != r.Zone || gen <= r.Since || (r.Until > 0 && gen > r.Until) || (tombstone && !r.IncludeTombstoned) {
+			continue
+		}
+		matched = append(matched, row)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		_, _, itemI, genI, _ := fields(matched[i])
+		_, _, itemJ, genJ, _ := fields(matched[j])
+		if genI != genJ {
+			return genI < genJ
+		}
+		return itemI.String() < itemJ.String()
+	})
+	if r.Offset >= len(matched) {
+		return nil
+	}
+	matched = matched[r.Offset:]
+	if r.Limit > 0 && len(matched) > r.Limit {
+		matched = matched[:r.Limit]
+	}
+	return matched
+}
+
+func (s *backupStore) GetCryptoKeysPage(ctx context.Context, userID string, r storage.PullRange) ([]*models.CryptoKey, error) {
+	return page(s.keys, userID, r, func(k *models.CryptoKey) (string, string, uuid.UUID, int64, bool) {
+		return k.UserID.String(), k.Zone, k.ItemUUID, k.GenCount, k.Tombstone
+	}), nil
+}
+
+func (s *backupStore) GetCredentialMetadataPage(ctx context.Context, userID string, r storage.PullRange) ([]*models.CredentialMetadata, error) {
+	return page(s.metadata, userID, r, func(c *models.CredentialMetadata) (string, string, uuid.UUID, int64, bool) {
+		return c.UserID.String(), c.Zone, c.ItemUUID, c.GenCount, c.Tombstone
+	}), nil
+}
+
+func (s *backupStore) GetSyncRecordsPage(ctx context.Context, userID string, r storage.PullRange) ([]*models.SyncRecord, error) {
+	return page(s.records, userID, r, func(rec *models.SyncRecord) (string, string, uuid.UUID, int64, bool) {
+		return rec.UserID.String(), rec.Zone, rec.ItemUUID, rec.GenCount, rec.Tombstone
+	}), nil
+}
+
+func (s *backupStore) RestoreRows(ctx context.Context, batch *storage.RestoreBatch) error {
+	for _, key := range batch.Keys {
+		s.keys[rowKey(key.UserID, key.Zone, key.ItemUUID)] = key
+	}
+	for _, cred := range batch.Metadata {
+		s.metadata[rowKey(cred.UserID, cred.Zone, cred.ItemUUID)] = cred
+	}
+	for _, record := range batch.Records {
+		s.records[rowKey(record.UserID, record.Zone, record.ItemUUID)] = record
+	}
+	for _, w := range batch.Watermarks {
+		zoneKey := w.UserID + "/" + w.Zone
+		if w.GenCount > s.gencount[zoneKey] {
+			s.gencount[zoneKey] = w.GenCount
+		}
+	}
+	return nil
+}
+
+func assertSameTables(t *testing.T, want, got *backupStore) {
+	t.Helper()
+	assert.Equal(t, want.keys, got.keys)
+	assert.Equal(t, want.metadata, got.metadata)
+	assert.Equal(t, want.records, got.records)
+	assert.Equal(t, want.gencount, got.gencount)
+}
+
+func exportBackup(t *testing.T, src *backupStore, opts backup.Options) ([]byte, *backup.Trailer) {
+	t.Helper()
+	var buf bytes.Buffer
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = 3
+	}
+	opts.Now = time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	trailer, err := backup.Export(context.Background(), src, &buf, opts)
+	require.NoError(t, err)
+	return buf.Bytes(), trailer
+}
+
+func TestBackupFullThenIncrementals(t *testing.T) {
+	alice, bob := uuid.New(), uuid.New()
+	items := []uuid.UUID{uuid.New(), uuid.New(), uuid.New(), uuid.New()}
+	src := newBackupStore()
+
+	for i, item := range items {
+		src.push(alice, "default", item, fmt.Sprintf("a%d", i), false)
+	}
+	src.push(bob, "default", items[0], "b0", false)
+	full, fullTrailer := exportBackup(t, src, backup.Options{})
+	assert.Equal(t, int64(15), fullTrailer.Rows)
+	assert.Equal(t, 5, fullTrailer.Chunks, "three rows per chunk")
+
+	// Edits, a deletion and a new zone
+	src.push(alice, "default", items[1], "a1-edited", false)
+	src.push(alice, "default", items[2], "", true)
+	src.push(bob, "work", items[3], "b3", false)
+	inc1, inc1Trailer := exportBackup(t, src, backup.Options{Base: fullTrailer.Manifest})
+	assert.Equal(t, int64(9), inc1Trailer.Rows, "only the rows written since the full backup")
+
+	// Nothing changed for bob; alice edits again
+	src.push(alice, "default", items[0], "a0-edited", false)
+	inc2, inc2Trailer := exportBackup(t, src, backup.Options{Base: inc1Trailer.Manifest})
+	assert.Equal(t, int64(3), inc2Trailer.Rows)
+	assert.Equal(t, int64(7), inc2Trailer.Manifest[alice.String()]["default"])
+	assert.Equal(t, int64(1), inc2Trailer.Manifest[bob.String()]["work"], "zones without changes keep their watermark")
+
+	dst := newBackupStore()
+	var base backup.Manifest
+	for _, stream := range [][]byte{full, inc1, inc2} {
+		trailer, err := backup.Restore(context.Background(), dst, bytes.NewReader(stream), base)
+		require.NoError(t, err)
+		base = trailer.Manifest
+	}
+	assertSameTables(t, src, dst)
+
+	t.Run("restoring again is a no-op", func(t *testing.T) {
+		_, err := backup.Restore(context.Background(), dst, bytes.NewReader(inc1), nil)
+		require.NoError(t, err)
+		_, err = backup.Restore(context.Background(), dst, bytes.NewReader(inc2), nil)
+		require.NoError(t, err)
+		assertSameTables(t, src, dst)
+	})
+
+	t.Run("an incremental must follow its base", func(t *testing.T) {
+		_, err := backup.Restore(context.Background(), newBackupStore(), bytes.NewReader(inc2), fullTrailer.Manifest)
+		assert.ErrorIs(t, err, backup.ErrOutOfOrder)
+	})
+
+	t.Run("the manifest of a file is the base of the next", func(t *testing.T) {
+		manifest, err := backup.ReadManifest(bytes.NewReader(inc1))
+		require.NoError(t, err)
+		assert.True(t, manifest.Equal(inc1Trailer.Manifest))
+	})
+}
+
+func TestBackupUserSubset(t *testing.T) {
+	alice, bob := uuid.New(), uuid.New()
+	src := newBackupStore()
+	src.push(alice, "default", uuid.New(), "a", false)
+	src.push(bob, "default", uuid.New(), "b", false)
+
+	stream, trailer := exportBackup(t, src, backup.Options{UserIDs: []string{bob.String()}})
+	assert.Equal(t, int64(3), trailer.Rows)
+	assert.NotContains(t, trailer.Manifest, alice.String())
+
+	dst := newBackupStore()
+	_, err := backup.Restore(context.Background(), dst, bytes.NewReader(stream), nil)
+	require.NoError(t, err)
+	assert.Len(t, dst.records, 1)
+	assert.Equal(t, map[string]int64{bob.String() + "/default": 1}, dst.gencount)
+}
+
+func TestBackupSince(t *testing.T) {
+	alice := uuid.New()
+	src := newBackupStore()
+	for i := 0; i < 5; i++ {
+		src.push(alice, "default", uuid.New(), fmt.Sprint(i), false)
+	}
+
+	_, trailer := exportBackup(t, src, backup.Options{Since: 3})
+	assert.Equal(t, int64(6), trailer.Rows, "gencounts 4 and 5 in all three layers")
+	assert.Equal(t, int64(5), trailer.Manifest[alice.String()]["default"])
+}
+
+func TestBackupIntegrity(t *testing.T) {
+	alice := uuid.New()
+	src := newBackupStore()
+	for i := 0; i < 4; i++ {
+		src.push(alice, "default", uuid.New(), fmt.Sprintf("payload-%d", i), false)
+	}
+	stream, _ := exportBackup(t, src, backup.Options{})
+
+	t.Run("tampered row", func(t *testing.T) {
+		tampered := bytes.Replace(stream, []byte("payload-3.example.com"), []byte("payload-9.example.com"), 1)
+		require.NotEqual(t, stream, tampered)
+
+		dst := newBackupStore()
+		_, err := backup.Restore(context.Background(), dst, bytes.NewReader(tampered), nil)
+		assert.ErrorIs(t, err, backup.ErrCorrupt)
+		for _, cred := range dst.metadata {
+			assert.NotEqual(t, "payload-9.example.com", cred.Server, "the bad chunk is never applied")
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		lines := bytes.SplitAfter(stream, []byte("\n"))
+		truncated := bytes.Join(lines[:len(lines)-2], nil) // drop the manifest
+
+		_, err := backup.Restore(context.Background(), newBackupStore(), bytes.NewReader(truncated), nil)
+		assert.ErrorIs(t, err, backup.ErrCorrupt)
+	})
+
+	t.Run("dropped chunk", func(t *testing.T) {
+		lines := bytes.SplitAfter(stream, []byte("\n"))
+		// header, then 3 rows + chunk line, drop those four
+		dropped := append(append([]byte{}, lines[0]...), bytes.Join(lines[5:], nil)...)
+
+		_, err := backup.Restore(context.Background(), newBackupStore(), bytes.NewReader(dropped), nil)
+		assert.ErrorIs(t, err, backup.ErrCorrupt)
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		_, err := backup.Restore(context.Background(), newBackupStore(), strings.NewReader(`{"type":"header","header":{"version":99}}`+"\n"), nil)
+		assert.ErrorIs(t, err, backup.ErrUnsupportedVersion)
+	})
+}
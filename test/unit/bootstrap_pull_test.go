@@ -0,0 +1,124 @@
+package unit
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// zoneItem is one item of a zone: its latest gencount and whether it is
+// deleted
+type zoneItem struct {
+	genCount  int64
+	tombstone bool
+}
+
+// pullZone answers a pull the way PullSync does: suppression first, then the
+// range filter
+func pullZone(zone map[string]zoneItem, since int64, includeTombstoned bool) (map[string]zoneItem, bool) {
+	window := storage.PullRange{Zone: "default", Since: since, IncludeTombstoned: includeTombstoned}
+	suppressed := window.SuppressBootstrapTombstones()
+	out := map[string]zoneItem{}
+	for id, item := range zone {
+		if window.Includes(item.genCount, item.tombstone) {
+			out[id] = item
+		}
+	}
+	return out, suppressed
+}
+
+// applyPull updates a device's local items
+func applyPull(local map[string]bool, pulled map[string]zoneItem) {
+	for id, item := range pulled {
+		if item.tombstone {
+			delete(local, id)
+		} else {
+			local[id] = true
+		}
+	}
+}
+
+func liveIDs(items map[string]bool) []string {
+	ids := make([]string, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestPullRangeIncludes(t *testing.T) {
+	r := storage.PullRange{Since: 5, Until: 10}
+	assert.False(t, r.Includes(5, false), "since is exclusive")
+	assert.True(t, r.Includes(6, false))
+	assert.True(t, r.Includes(10, false), "until is inclusive")
+	assert.False(t, r.Includes(11, false))
+	assert.False(t, r.Includes(7, true))
+
+	r.IncludeTombstoned = true
+	assert.True(t, r.Includes(7, true))
+	r.Until = 0
+	assert.True(t, r.Includes(1000, false), "no upper bound")
+}
+
+func TestBootstrapPullSuppressesTombstones(t *testing.T) {
+	// An old account: two live items among many deletions
+	zone := map[string]zoneItem{"a": {genCount: 3}, "b": {genCount: 250}}
+	for i := int64(0); i < 200; i++ {
+		zone[fmt.Sprintf("deleted-%d", i)] = zoneItem{genCount: 10 + i, tombstone: true}
+	}
+
+	pulled, suppressed := pullZone(zone, 0, true)
+	assert.True(t, suppressed)
+	assert.Len(t, pulled, 2, "include_tombstoned is ignored at gencount 0")
+	for _, item := range pulled {
+		assert.False(t, item.tombstone)
+	}
+
+	// Non-zero gencounts keep the flag
+	pulled, suppressed = pullZone(zone, 100, true)
+	assert.False(t, suppressed)
+	assert.Len(t, pulled, 110)
+	pulled, _ = pullZone(zone, 100, false)
+	assert.Len(t, pulled, 1)
+
+	window := storage.PullRange{Since: 0}
+	assert.True(t, window.SuppressBootstrapTombstones(), "suppressed even when not asked for")
+}
+
+func TestCatchUpAcrossDeletion(t *testing.T) {
+	zone := map[string]zoneItem{
+		"a": {genCount: 1},
+		"b": {genCount: 2},
+		"c": {genCount: 3, tombstone: true},
+	}
+
+	// A fresh device bootstraps from the live items and continues from the
+	// gencount of the response
+	device := map[string]bool{}
+	pulled, suppressed := pullZone(zone, 0, true)
+	assert.True(t, suppressed)
+	applyPull(device, pulled)
+	assert.Equal(t, []string{"a", "b"}, liveIDs(device))
+	lastGenCount := int64(3) // The response's gencount
+
+	// Another device deletes b and adds d
+	zone["b"] = zoneItem{genCount: 4, tombstone: true}
+	zone["d"] = zoneItem{genCount: 5}
+
+	// Catching up carries the deletion
+	pulled, suppressed = pullZone(zone, lastGenCount, true)
+	assert.False(t, suppressed)
+	assert.True(t, pulled["b"].tombstone)
+	applyPull(device, pulled)
+	assert.Equal(t, []string{"a", "d"}, liveIDs(device))
+
+	// And ends where a second fresh device starts
+	fresh := map[string]bool{}
+	pulled, _ = pullZone(zone, 0, true)
+	applyPull(fresh, pulled)
+	assert.Equal(t, liveIDs(fresh), liveIDs(device))
+}
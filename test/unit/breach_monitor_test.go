@@ -0,0 +1,171 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/breach"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingBreachNotifier struct {
+	alerts map[string][]string // Monitor ID -> breaches alerted
+}
+
+func (n *recordingBreachNotifier) BreachAlerts(monitor *storage.BreachMonitor, alerts []*storage.BreachAlert) {
+	for _, alert := range alerts {
+		n.alerts[monitor.ID] = append(n.alerts[monitor.ID], alert.Breach)
+	}
+}
+
+// The first check records the breaches known then; a later one alerts about
+// each breach added since, once
+func TestBreachMonitorJob(t *testing.T) {
+	stores := map[string]storage.Store{"sqlite": newSQLiteStore(t), "memory": storage.NewMemoryStore()}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			clock := &fakeClock{now: time.Now().UTC()}
+			user, err := store.CreateUser("alice@example.com", []byte("hash"), []byte("salt"), "")
+			require.NoError(t, err)
+			monitor, created, err := store.CreateBreachMonitor(ctx, user.ID, "alice@example.com", 5)
+			require.NoError(t, err)
+			require.True(t, created)
+
+			breaches := []string{"Adobe"}
+			var lookups int
+			lookup := func(_ context.Context, userID, email string) ([]*storage.BreachAlert, error) {
+				lookups++
+				assert.Equal(t, user.ID, userID)
+				found := make([]*storage.BreachAlert, len(breaches))
+				for i, name := range breaches {
+					found[i] = &storage.BreachAlert{Email: email, Breach: name, BreachDate: "2024-01-02", DataTypes: []string{"Passwords"}}
+				}
+				return found, nil
+			}
+			notifier := &recordingBreachNotifier{alerts: map[string][]string{}}
+			job := jobs.NewBreachMonitorJob(store, lookup, notifier, 0)
+			job.SetClock(clock)
+
+			report, err := job.Run(ctx, jobs.RunOptions{})
+			require.NoError(t, err)
+			assert.Zero(t, report.TotalAffected, "the first check is the baseline")
+			report, err = job.Run(ctx, jobs.RunOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, 1, lookups, "checked once a day")
+
+			breaches = []string{"Adobe", "Canva"}
+			clock.now = clock.now.Add(jobs.BreachRecheckInterval + time.Minute)
+			report, err = job.Run(ctx, jobs.RunOptions{DryRun: true})
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), report.TotalAffected)
+			assert.Empty(t, notifier.alerts, "a dry run alerts nobody")
+
+			report, err = job.Run(ctx, jobs.RunOptions{})
+			require.NoError(t, err)
+			require.Len(t, report.Users, 1)
+			assert.Equal(t, jobs.UserImpact{UserID: user.ID, Count: 1}, report.Users[0])
+			assert.Equal(t, map[string][]string{monitor.ID: {"Canva"}}, notifier.alerts)
+
+			alerts, err := store.ListBreachAlerts(ctx, user.ID, 10)
+			require.NoError(t, err)
+			require.Len(t, alerts, 1)
+			assert.Equal(t, "Canva", alerts[0].Breach)
+			assert.Equal(t, "alice@example.com", alerts[0].Email)
+			assert.Equal(t, []string{"Passwords"}, alerts[0].DataTypes)
+			monitors, err := store.ListBreachMonitors(ctx, user.ID)
+			require.NoError(t, err)
+			require.Len(t, monitors, 1)
+			assert.Equal(t, []string{"Adobe", "Canva"}, monitors[0].Breaches)
+
+			clock.now = clock.now.Add(jobs.BreachRecheckInterval + time.Minute)
+			report, err = job.Run(ctx, jobs.RunOptions{})
+			require.NoError(t, err)
+			assert.Zero(t, report.TotalAffected, "a breach is alerted once")
+
+			require.NoError(t, store.DeleteBreachMonitor(ctx, user.ID, monitor.ID))
+			alerts, err = store.ListBreachAlerts(ctx, user.ID, 10)
+			require.NoError(t, err)
+			assert.Len(t, alerts, 1, "unsubscribing keeps the alerts")
+		})
+	}
+}
+
+func TestBreachMonitorEndpoints(t *testing.T) {
+	store := storage.NewMemoryStore()
+	alice, err := store.CreateUser("alice@example.com", []byte("hash"), []byte("salt"), "")
+	require.NoError(t, err)
+	bob, err := store.CreateUser("bob@example.com", []byte("hash"), []byte("salt"), "")
+	require.NoError(t, err)
+	breach.SetMonitorStore(store)
+	defer breach.SetMonitorStore(nil)
+	breach.SetMonitorConfig(breach.MonitorConfig{MaxPerUser: 2})
+	defer breach.SetMonitorConfig(breach.DefaultMonitorConfig)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		middleware.SetClaims(c, &auth.Claims{UserID: c.GetHeader("X-User")})
+	})
+	router.POST("/breach/monitor", breach.Subscribe)
+	router.GET("/breach/monitors", breach.ListMonitors)
+	router.DELETE("/breach/monitor/:id", breach.Unsubscribe)
+	router.GET("/breach/alerts", breach.ListAlerts)
+	serve := func(user, method, path, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var resp map[string]interface{}
+		if w.Body.Len() > 0 {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+		}
+		return w.Code, resp
+	}
+
+	status, first := serve(alice.ID, http.MethodPost, "/breach/monitor", `{"email":"Alice@Example.com"}`)
+	require.Equal(t, http.StatusCreated, status, first)
+	assert.Equal(t, "alice@example.com", first["email"])
+	status, again := serve(alice.ID, http.MethodPost, "/breach/monitor", `{"email":"alice@example.com"}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, first["id"], again["id"], "an address is monitored once")
+
+	status, _ = serve(alice.ID, http.MethodPost, "/breach/monitor", `{"email":"work@example.com"}`)
+	assert.Equal(t, http.StatusCreated, status)
+	status, refused := serve(alice.ID, http.MethodPost, "/breach/monitor", `{"email":"old@example.com"}`)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Equal(t, "quota_exceeded", refused["code"])
+	assert.Equal(t, float64(2), refused["limit"])
+	status, _ = serve(bob.ID, http.MethodPost, "/breach/monitor", `{"email":"old@example.com"}`)
+	assert.Equal(t, http.StatusCreated, status, "the limit is per user")
+
+	status, listed := serve(alice.ID, http.MethodGet, "/breach/monitors", "")
+	require.Equal(t, http.StatusOK, status)
+	assert.Len(t, listed["monitors"], 2)
+
+	id := first["id"].(string)
+	status, _ = serve(bob.ID, http.MethodDelete, "/breach/monitor/"+id, "")
+	assert.Equal(t, http.StatusNotFound, status, "only the owner unsubscribes")
+	status, _ = serve(alice.ID, http.MethodDelete, "/breach/monitor/"+id, "")
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = serve(alice.ID, http.MethodDelete, "/breach/monitor/"+id, "")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = serve(alice.ID, http.MethodPost, "/breach/monitor", `{"email":"old@example.com"}`)
+	assert.Equal(t, http.StatusCreated, status, "unsubscribing frees a slot")
+
+	status, alerts := serve(alice.ID, http.MethodGet, "/breach/alerts", "")
+	require.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []interface{}{}, alerts["alerts"])
+}
@@ -0,0 +1,184 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	apperrors "github.com/deeplyprofound/password-sync/pkg/errors"
+	"github.com/deeplyprofound/password-sync/server/api/breach"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/crypto"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func cacheKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, crypto.CacheKeySize)
+}
+
+// tamperEnvelope flips a bit of a sealed value's ciphertext
+func tamperEnvelope(t *testing.T, sealed []byte) []byte {
+	t.Helper()
+	var envelope map[string]interface{}
+	require.NoError(t, json.Unmarshal(sealed, &envelope))
+	ciphertext, err := base64.StdEncoding.DecodeString(envelope["ct"].(string))
+	require.NoError(t, err)
+	ciphertext[0] ^= 1
+	envelope["ct"] = ciphertext
+	tampered, err := json.Marshal(envelope)
+	require.NoError(t, err)
+	return tampered
+}
+
+func TestCacheKeyringRotation(t *testing.T) {
+	old, err := crypto.NewCacheKeyring("k1", map[string][]byte{"k1": cacheKey(1)})
+	require.NoError(t, err)
+	sealed, err := old.Seal([]byte("report"), "breach:email:a@example.com")
+	require.NoError(t, err)
+
+	// During the overlap the new key seals and the old one still opens
+	spec := "k2:" + base64.StdEncoding.EncodeToString(cacheKey(2)) + ",k1:" + base64.StdEncoding.EncodeToString(cacheKey(1))
+	rotated, err := crypto.ParseCacheKeyring(spec)
+	require.NoError(t, err)
+	assert.Equal(t, "k2", rotated.CurrentKeyID())
+
+	plaintext, err := rotated.Open(sealed, "breach:email:a@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "report", string(plaintext))
+
+	resealed, err := rotated.Seal(plaintext, "breach:email:a@example.com")
+	require.NoError(t, err)
+	assert.Contains(t, string(resealed), `"kid":"k2"`)
+	assert.Contains(t, string(resealed), `"v":1`)
+
+	// Once the old key is dropped its values no longer open
+	retired, err := crypto.NewCacheKeyring("k2", map[string][]byte{"k2": cacheKey(2)})
+	require.NoError(t, err)
+	_, err = retired.Open(sealed, "breach:email:a@example.com")
+	assert.ErrorIs(t, err, apperrors.ErrUnknownKeyID)
+	_, err = retired.Open(resealed, "breach:email:a@example.com")
+	assert.NoError(t, err)
+}
+
+func TestCacheKeyringRejects(t *testing.T) {
+	keys, err := crypto.NewCacheKeyring("k1", map[string][]byte{"k1": cacheKey(1)})
+	require.NoError(t, err)
+	sealed, err := keys.Seal([]byte(`{"email":"a@example.com"}`), "breach:email:a@example.com")
+	require.NoError(t, err)
+	assert.NotContains(t, string(sealed), "a@example.com")
+
+	t.Run("tampered ciphertext", func(t *testing.T) {
+		_, err := keys.Open(tamperEnvelope(t, sealed), "breach:email:a@example.com")
+		assert.ErrorIs(t, err, apperrors.ErrDecryptionFailed)
+	})
+
+	t.Run("copied to another cache key", func(t *testing.T) {
+		_, err := keys.Open(sealed, "breach:email:b@example.com")
+		assert.ErrorIs(t, err, apperrors.ErrDecryptionFailed)
+	})
+
+	t.Run("plaintext cached before sealing", func(t *testing.T) {
+		_, err := keys.Open([]byte(`{"email":"a@example.com"}`), "breach:email:a@example.com")
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid keyrings", func(t *testing.T) {
+		_, err := crypto.NewCacheKeyring("k1", map[string][]byte{"k1": cacheKey(1)[:16]})
+		assert.ErrorIs(t, err, apperrors.ErrInvalidKeySize)
+		_, err = crypto.NewCacheKeyring("k2", map[string][]byte{"k1": cacheKey(1)})
+		assert.ErrorIs(t, err, apperrors.ErrUnknownKeyID)
+		_, err = crypto.ParseCacheKeyring("k1")
+		assert.Error(t, err)
+	})
+}
+
+func TestBreachCacheSealedInRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+	keys, err := crypto.NewCacheKeyring("k1", map[string][]byte{"k1": cacheKey(1)})
+	require.NoError(t, err)
+	breach.SetCacheKeyring(keys)
+	defer breach.SetCacheKeyring(nil)
+	require.NoError(t, breach.InitRedis(server.Addr()))
+	defer breach.CloseRedis()
+
+	report := &breach.LeakResponse{Email: "a@example.com", Sources: []string{"Adobe"}, TotalLeaks: 1}
+	require.NoError(t, breach.CacheBreachReport("a@example.com", report, time.Hour))
+
+	key := breach.BreachCacheKey("a@example.com")
+	assert.NotContains(t, key, "example", "key names carry no address")
+	stored, err := server.Get(key)
+	require.NoError(t, err)
+	assert.NotContains(t, stored, "a@example.com")
+	assert.NotContains(t, stored, "Adobe")
+
+	// However the address is typed, it is one entry
+	cached, err := breach.GetCachedBreachReport(" A@Example.COM")
+	require.NoError(t, err)
+	assert.Equal(t, report, cached)
+
+	// A value that does not open is a miss, not an error
+	failures := metrics.Value(breach.MetricCacheOpenFailed)
+	server.Set(key, string(tamperEnvelope(t, []byte(stored))))
+	cached, err = breach.GetCachedBreachReport("a@example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, cached)
+	assert.Equal(t, failures+1, metrics.Value(breach.MetricCacheOpenFailed))
+}
+
+// Invalidating an address drops its report, and any still cached under the
+// key format from before reports were keyed by a hash
+func TestBreachCacheInvalidate(t *testing.T) {
+	server := miniredis.RunT(t)
+	require.NoError(t, breach.InitRedis(server.Addr()))
+	defer breach.CloseRedis()
+
+	report := &breach.LeakResponse{Email: "a@example.com", TotalLeaks: 0}
+	require.NoError(t, breach.CacheBreachReport("a@example.com", report, time.Hour))
+	require.NoError(t, server.Set("breach:email:A@Example.com", "{}"))
+	require.NoError(t, server.Set("breach:email:b@example.com", "{}"))
+
+	require.NoError(t, breach.InvalidateBreachCache("A@Example.com"))
+	assert.Equal(t, []string{"breach:email:b@example.com"}, server.Keys())
+	cached, err := breach.GetCachedBreachReport("a@example.com")
+	require.NoError(t, err)
+	assert.Nil(t, cached)
+}
+
+func TestProfileCacheSealedInRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	keys, err := crypto.NewCacheKeyring("k1", map[string][]byte{"k1": cacheKey(1)})
+	require.NoError(t, err)
+
+	source := newProfileSource()
+	cache := auth.NewProfileCache(source, auth.ProfileCacheOptions{TTL: time.Minute, Redis: client, Keys: keys})
+	_, err = cache.Get(context.Background(), profileUserID)
+	require.NoError(t, err)
+
+	stored, err := server.Get("auth:profile:" + profileUserID)
+	require.NoError(t, err)
+	assert.NotContains(t, stored, "a@example.com")
+
+	// A second instance with the same keyring reads the sealed entry
+	other := auth.NewProfileCache(source, auth.ProfileCacheOptions{TTL: time.Minute, Redis: client, Keys: keys})
+	loads := source.loads
+	profile, err := other.Get(context.Background(), profileUserID)
+	require.NoError(t, err)
+	assert.Equal(t, "a@example.com", profile.Email)
+	assert.Equal(t, loads, source.loads)
+
+	// A tampered entry is reloaded from the source
+	server.Set("auth:profile:"+profileUserID, `{"email":"mallory@example.com","active":true}`)
+	profile, err = other.Get(context.Background(), profileUserID)
+	require.NoError(t, err)
+	assert.Equal(t, "a@example.com", profile.Email)
+	assert.Equal(t, loads+1, source.loads)
+}
@@ -0,0 +1,152 @@
+package unit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshalCanonicalVector(t *testing.T) {
+	// Fixed test vector: clients in other languages must produce these bytes
+	label := "Mail <work> & \"quoted\"\u2028\n"
+	key := models.CryptoKey{
+		ID:        uuid.MustParse("00000000-0000-0000-0000-000000000001"),
+		UserID:    uuid.MustParse("00000000-0000-0000-0000-000000000002"),
+		ItemUUID:  uuid.MustParse("00000000-0000-0000-0000-000000000003"),
+		Zone:      "default",
+		KeyClass:  models.KeyClassPrivate,
+		KeyType:   models.KeyTypeEd25519,
+		Label:     &label,
+		AccGroup:  "default",
+		Data:      []byte{0x00, 0xff, 0x10},
+		Flags:     []byte(`{"sign":true}`),
+		GenCount:  -0,
+		Tombstone: false,
+	}
+
+	got, err := models.MarshalCanonical(key)
+	require.NoError(t, err)
+
+	want := `{"access_group":"default","created_at":"0001-01-01T00:00:00Z","data":"AP8Q",` +
+		`"gencount":0,"id":"00000000-0000-0000-0000-000000000001",` +
+		`"item_uuid":"00000000-0000-0000-0000-000000000003","key_class":2,"key_type":1,` +
+		`"label":"Mail <work> & \"quoted\"` + "\u2028" + `\n","tombstone":false,` +
+		`"updated_at":"0001-01-01T00:00:00Z","usage_flags":"eyJzaWduIjp0cnVlfQ==",` +
+		`"user_id":"00000000-0000-0000-0000-000000000002","zone":"default"}`
+	assert.Equal(t, want, string(got))
+	assert.NoError(t, models.VerifyCanonical(got))
+}
+
+func TestCanonicalizeFieldOrder(t *testing.T) {
+	inputs := []string{
+		`{"b":1,"a":{"y":[3,{"k":"v","j":null}],"x":true},"c":"s"}`,
+		`{ "c" : "s", "a" : { "x" : true, "y" : [ 3, { "j" : null, "k" : "v" } ] }, "b" : 1 }`,
+		"{\"a\":{\"x\":true,\"y\":[3,{\"k\":\"v\",\"j\":null}]},\n\t\"c\":\"s\",\"b\":1}",
+	}
+	want := `{"a":{"x":true,"y":[3,{"j":null,"k":"v"}]},"b":1,"c":"s"}`
+
+	for _, input := range inputs {
+		got, err := models.Canonicalize([]byte(input))
+		require.NoError(t, err, input)
+		assert.Equal(t, want, string(got), input)
+	}
+
+	// A struct and a map with the same fields encode identically
+	type pair struct {
+		Zeta  string `json:"zeta"`
+		Alpha int64  `json:"alpha"`
+	}
+	fromStruct, err := models.MarshalCanonical(pair{Zeta: "z", Alpha: 7})
+	require.NoError(t, err)
+	fromMap, err := models.MarshalCanonical(map[string]interface{}{"alpha": 7, "zeta": "z"})
+	require.NoError(t, err)
+	assert.Equal(t, fromStruct, fromMap)
+	assert.Equal(t, `{"alpha":7,"zeta":"z"}`, string(fromStruct))
+}
+
+func TestCanonicalizeRoundTrip(t *testing.T) {
+	values := []interface{}{
+		models.SyncRecord{ItemUUID: uuid.New(), WrappedKey: []byte("wk"), EncItem: []byte{1, 2, 3}, EncVersion: 1, GenCount: 9007199254740993},
+		models.CredentialMetadata{Server: "例え.jp", Account: "ünïcödé", Port: 443},
+		map[string]interface{}{"empty": map[string]interface{}{}, "list": []interface{}{}, "neg": -42},
+		[]string{"\x00\x1f\x7f", "tab\there", `back\slash`},
+	}
+
+	for _, value := range values {
+		first, err := models.MarshalCanonical(value)
+		require.NoError(t, err)
+		require.NoError(t, models.VerifyCanonical(first))
+
+		again, err := models.Canonicalize(first)
+		require.NoError(t, err)
+		assert.Equal(t, first, again, "canonical form is a fixed point")
+	}
+}
+
+func TestCanonicalizeEscapes(t *testing.T) {
+	got, err := models.MarshalCanonical("\x00\x01\b\t\n\f\r\x1f \"\\/<>&")
+	require.NoError(t, err)
+	assert.Equal(t, `"\u0000\u0001\b\t\n\f\r\u001f \"\\/<>&"`, string(got))
+}
+
+func TestCanonicalizeNumbers(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		err   error
+	}{
+		{`0`, `0`, nil},
+		{`-0`, `0`, nil},
+		{`-17`, `-17`, nil},
+		{`123456789012345678901234567890`, `123456789012345678901234567890`, nil},
+		{`1.0`, ``, models.ErrNonIntegerNumber},
+		{`1.5`, ``, models.ErrNonIntegerNumber},
+		{`1e3`, ``, models.ErrNonIntegerNumber},
+	}
+
+	for _, tt := range tests {
+		got, err := models.Canonicalize([]byte(tt.input))
+		if tt.err != nil {
+			assert.True(t, errors.Is(err, tt.err), tt.input)
+			continue
+		}
+		require.NoError(t, err, tt.input)
+		assert.Equal(t, tt.want, string(got))
+	}
+
+	_, err := models.MarshalCanonical(map[string]float64{"ratio": 0.5})
+	assert.True(t, errors.Is(err, models.ErrNonIntegerNumber))
+}
+
+func TestCanonicalizeRejects(t *testing.T) {
+	_, err := models.Canonicalize([]byte(`{"a":1,"a":2}`))
+	assert.True(t, errors.Is(err, models.ErrDuplicateKey))
+
+	_, err = models.Canonicalize([]byte("\"\xff\""))
+	assert.True(t, errors.Is(err, models.ErrInvalidUTF8))
+
+	_, err = models.Canonicalize([]byte(`{"a":1} {"b":2}`))
+	assert.Error(t, err)
+
+	_, err = models.Canonicalize([]byte(`{"a":`))
+	assert.Error(t, err)
+}
+
+func TestVerifyCanonical(t *testing.T) {
+	assert.NoError(t, models.VerifyCanonical([]byte(`{"a":[1,2],"b":"x"}`)))
+
+	notCanonical := []string{
+		`{"b":"x","a":[1,2]}`,  // key order
+		`{"a":[1, 2],"b":"x"}`, // whitespace
+		`{"a":"\u0041"}`,       // unnecessary escape
+		`"\u0020"`,             // must be literal
+		`-0`,
+	}
+	for _, input := range notCanonical {
+		assert.True(t, errors.Is(models.VerifyCanonical([]byte(input)), models.ErrNotCanonical), input)
+	}
+}
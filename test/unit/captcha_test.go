@@ -0,0 +1,257 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/handlers"
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/outbound"
+	"github.com/deeplyprofound/password-sync/server/version"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubProvider plays hCaptcha/Turnstile's siteverify endpoint
+type stubProvider struct {
+	server *httptest.Server
+	status int
+	result map[string]interface{}
+	calls  int
+	form   map[string]string
+	agent  string
+}
+
+func newStubProvider(t *testing.T) *stubProvider {
+	stub := &stubProvider{status: http.StatusOK, result: map[string]interface{}{"success": true}}
+	stub.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stub.calls++
+		require.NoError(t, r.ParseForm())
+		stub.form = map[string]string{}
+		for key := range r.PostForm {
+			stub.form[key] = r.PostForm.Get(key)
+		}
+		stub.agent = r.Header.Get("User-Agent")
+		w.WriteHeader(stub.status)
+		json.NewEncoder(w).Encode(stub.result)
+	}))
+	t.Cleanup(stub.server.Close)
+	return stub
+}
+
+func (s *stubProvider) verifier(provider string) *auth.SiteVerifier {
+	client := outbound.New(s.server.Client().Transport)
+	return auth.NewSiteVerifier(provider, s.server.URL, "shh", "site-key", client)
+}
+
+func TestSiteVerifier(t *testing.T) {
+	for _, provider := range []string{auth.CaptchaHCaptcha, auth.CaptchaTurnstile} {
+		t.Run(provider, func(t *testing.T) {
+			stub := newStubProvider(t)
+			verifier := stub.verifier(provider)
+
+			require.NoError(t, verifier.Verify(context.Background(), auth.CaptchaResponse{Token: "tok"}, "203.0.113.9"))
+			assert.Equal(t, map[string]string{
+				"secret":   "shh",
+				"response": "tok",
+				"remoteip": "203.0.113.9",
+				"sitekey":  "site-key",
+			}, stub.form)
+			assert.Equal(t, version.ServerHeader(), stub.agent, "calls go through the outbound client")
+
+			stub.result = map[string]interface{}{"success": false, "error-codes": []string{"invalid-input-response"}}
+			err := verifier.Verify(context.Background(), auth.CaptchaResponse{Token: "tok"}, "")
+			assert.ErrorIs(t, err, auth.ErrCaptchaFailed)
+			assert.Contains(t, err.Error(), "invalid-input-response")
+
+			stub.status = http.StatusInternalServerError
+			err = verifier.Verify(context.Background(), auth.CaptchaResponse{Token: "tok"}, "")
+			assert.ErrorIs(t, err, auth.ErrCaptchaUnavailable)
+
+			calls := stub.calls
+			err = verifier.Verify(context.Background(), auth.CaptchaResponse{}, "")
+			assert.ErrorIs(t, err, auth.ErrCaptchaRequired)
+			assert.Equal(t, calls, stub.calls, "an empty token is rejected without calling the provider")
+
+			assert.Equal(t, auth.CaptchaRequirements{Provider: provider, SiteKey: "site-key"}, verifier.Requirements())
+		})
+	}
+}
+
+func TestNewCaptchaVerifier(t *testing.T) {
+	verifier, err := auth.NewCaptchaVerifier(auth.CaptchaConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, verifier, "disabled by default")
+
+	_, err = auth.NewCaptchaVerifier(auth.CaptchaConfig{Provider: auth.CaptchaTurnstile})
+	assert.Error(t, err, "a provider needs its secret")
+
+	_, err = auth.NewCaptchaVerifier(auth.CaptchaConfig{Provider: "recaptcha"})
+	assert.ErrorIs(t, err, auth.ErrUnknownCaptcha)
+
+	_, err = auth.NewCaptchaVerifier(auth.CaptchaConfig{Provider: auth.CaptchaProofOfWork, Difficulty: 99})
+	assert.Error(t, err)
+
+	verifier, err = auth.NewCaptchaVerifier(auth.CaptchaConfig{Provider: auth.CaptchaProofOfWork})
+	require.NoError(t, err)
+	assert.Equal(t, auth.DefaultPoWDifficulty, verifier.Requirements().Difficulty)
+}
+
+// solvePoW brute-forces a challenge the way a client would
+func solvePoW(challenge *auth.PoWChallenge) string {
+	for i := 0; ; i++ {
+		solution := strconv.Itoa(i)
+		if auth.SolvesPoW(challenge.Token, solution, challenge.Difficulty) {
+			return solution
+		}
+	}
+}
+
+func TestProofOfWork(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	pow, err := auth.NewProofOfWork(8, []byte("key"))
+	require.NoError(t, err)
+	pow.SetClock(clock.Frozen(now))
+	ctx := context.Background()
+
+	challenge, err := pow.Issue()
+	require.NoError(t, err)
+	assert.Equal(t, 8, challenge.Difficulty)
+	assert.Equal(t, now.Add(auth.PoWChallengeTTL), challenge.ExpiresAt)
+
+	solution := solvePoW(challenge)
+	require.NoError(t, pow.Verify(ctx, auth.CaptchaResponse{Token: challenge.Token, Solution: solution}, ""))
+
+	err = pow.Verify(ctx, auth.CaptchaResponse{Token: challenge.Token, Solution: solution}, "")
+	assert.ErrorIs(t, err, auth.ErrCaptchaFailed, "a solved challenge is single-use")
+
+	t.Run("wrong solution", func(t *testing.T) {
+		challenge, err := pow.Issue()
+		require.NoError(t, err)
+		for i := 0; ; i++ {
+			wrong := "x" + strconv.Itoa(i)
+			if !auth.SolvesPoW(challenge.Token, wrong, challenge.Difficulty) {
+				err := pow.Verify(ctx, auth.CaptchaResponse{Token: challenge.Token, Solution: wrong}, "")
+				assert.ErrorIs(t, err, auth.ErrCaptchaFailed)
+				break
+			}
+		}
+	})
+
+	t.Run("forged challenge", func(t *testing.T) {
+		other, err := auth.NewProofOfWork(1, []byte("attacker"))
+		require.NoError(t, err)
+		forged, err := other.Issue()
+		require.NoError(t, err)
+		err = pow.Verify(ctx, auth.CaptchaResponse{Token: forged.Token, Solution: solvePoW(forged)}, "")
+		assert.ErrorIs(t, err, auth.ErrCaptchaFailed)
+	})
+
+	t.Run("expired challenge", func(t *testing.T) {
+		challenge, err := pow.Issue()
+		require.NoError(t, err)
+		solution := solvePoW(challenge)
+		pow.SetClock(clock.Frozen(now.Add(auth.PoWChallengeTTL)))
+		defer pow.SetClock(clock.Frozen(now))
+		err = pow.Verify(ctx, auth.CaptchaResponse{Token: challenge.Token, Solution: solution}, "")
+		assert.ErrorIs(t, err, auth.ErrCaptchaFailed)
+	})
+
+	t.Run("missing solution", func(t *testing.T) {
+		err := pow.Verify(ctx, auth.CaptchaResponse{Token: challenge.Token}, "")
+		assert.ErrorIs(t, err, auth.ErrCaptchaRequired)
+	})
+}
+
+// newRegisterRouter serves the registration routes without a store; only
+// requests rejected by the challenge may be sent
+func newRegisterRouter(verifier auth.CaptchaVerifier) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	service := handlers.NewAuthService(nil)
+	service.SetCaptchaVerifier(verifier)
+
+	router := gin.New()
+	router.POST("/auth/register", service.Register)
+	router.GET("/auth/register/challenge", service.RegisterChallenge)
+	return router
+}
+
+func postRegister(router *gin.Engine, body map[string]interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, "/auth/register", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w, resp
+}
+
+func TestRegisterRequiresCaptcha(t *testing.T) {
+	stub := newStubProvider(t)
+	stub.result = map[string]interface{}{"success": false}
+	router := newRegisterRouter(stub.verifier(auth.CaptchaHCaptcha))
+	account := map[string]interface{}{"email": "bot@example.com", "password": "hunter2hunter2"}
+
+	w, resp := postRegister(router, account)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "captcha_required", resp["code"])
+	assert.Equal(t, map[string]interface{}{"provider": "hcaptcha", "site_key": "site-key"}, resp["captcha"])
+
+	account["captcha"] = map[string]string{"token": "bogus"}
+	w, resp = postRegister(router, account)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "captcha_failed", resp["code"])
+	assert.NotNil(t, resp["captcha"])
+
+	stub.status = http.StatusBadGateway
+	w, resp = postRegister(router, account)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "captcha_unavailable", resp["code"])
+}
+
+func TestRegisterChallenge(t *testing.T) {
+	get := func(router *gin.Engine) map[string]interface{} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/register/challenge", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+
+	assert.Equal(t, map[string]interface{}{"required": false}, get(newRegisterRouter(nil)))
+
+	pow, err := auth.NewProofOfWork(4, []byte("key"))
+	require.NoError(t, err)
+	router := newRegisterRouter(pow)
+	resp := get(router)
+	assert.Equal(t, true, resp["required"])
+	challenge := resp["challenge"].(map[string]interface{})
+	assert.Equal(t, "sha256", challenge["algorithm"])
+	assert.NotEqual(t, challenge["token"], get(router)["challenge"].(map[string]interface{})["token"], "every call issues a new puzzle")
+
+	// A wrong solution is a structured 403 pointing back at the challenge
+	token := challenge["token"].(string)
+	wrong := "nope"
+	for i := 0; auth.SolvesPoW(token, wrong, 4); i++ {
+		wrong = "nope" + strconv.Itoa(i)
+	}
+	w, body := postRegister(router, map[string]interface{}{
+		"email":    "bot@example.com",
+		"password": "hunter2hunter2",
+		"captcha":  map[string]string{"token": token, "solution": wrong},
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "captcha_failed", body["code"])
+	assert.Equal(t, auth.PoWChallengePath, body["captcha"].(map[string]interface{})["challenge_url"])
+}
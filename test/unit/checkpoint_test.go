@@ -0,0 +1,161 @@
+package unit
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestCheckpoint() *sync.PullCheckpoint {
+	return &sync.PullCheckpoint{
+		Zone:      "default",
+		Since:     10,
+		Layers:    sync.PullLayerKeys | sync.PullLayerRecords,
+		Watermark: 42,
+		Digest:    []byte("digest-at-start"),
+		Items:     7,
+		Offset:    3,
+	}
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	codec := sync.NewCheckpointCodec([]byte("secret"))
+	cp := newTestCheckpoint()
+
+	token, err := codec.Encode("alice", cp)
+	require.NoError(t, err)
+
+	decoded, err := codec.Decode("alice", token)
+	require.NoError(t, err)
+	assert.Equal(t, cp, decoded)
+	assert.Equal(t, mapping.PullLayers{Keys: true, Records: true}, mapping.PullLayersFromMask(decoded.Layers))
+}
+
+func TestCheckpointRejectsForgery(t *testing.T) {
+	codec := sync.NewCheckpointCodec([]byte("secret"))
+	token, err := codec.Encode("alice", newTestCheckpoint())
+	require.NoError(t, err)
+
+	_, err = codec.Decode("bob", token)
+	assert.ErrorIs(t, err, sync.ErrInvalidCheckpoint, "tokens are bound to their user")
+
+	_, err = sync.NewCheckpointCodec([]byte("other")).Decode("alice", token)
+	assert.ErrorIs(t, err, sync.ErrInvalidCheckpoint)
+
+	// Re-encode the payload with a later offset but keep the old MAC
+	forged := newTestCheckpoint()
+	forged.Offset = 6
+	forgedToken, err := sync.NewCheckpointCodec([]byte("attacker")).Encode("alice", forged)
+	require.NoError(t, err)
+	payload, _, _ := strings.Cut(forgedToken, ".")
+	_, mac, _ := strings.Cut(token, ".")
+	_, err = codec.Decode("alice", payload+"."+mac)
+	assert.ErrorIs(t, err, sync.ErrInvalidCheckpoint)
+
+	for _, bad := range []string{"", "garbage", "a.b", token + "x"} {
+		_, err := codec.Decode("alice", bad)
+		assert.ErrorIs(t, err, sync.ErrInvalidCheckpoint, bad)
+	}
+}
+
+func TestPlanPage(t *testing.T) {
+	layers := []int{sync.PullLayerKeys, sync.PullLayerMetadata, sync.PullLayerRecords}
+	counts := []int{2, 0, 5}
+
+	assert.Equal(t, []sync.PageSpan{
+		{Layer: sync.PullLayerKeys, Offset: 0, Limit: 2},
+		{Layer: sync.PullLayerRecords, Offset: 0, Limit: 1},
+	}, sync.PlanPage(layers, counts, 0, 3))
+
+	assert.Equal(t, []sync.PageSpan{
+		{Layer: sync.PullLayerRecords, Offset: 1, Limit: 3},
+	}, sync.PlanPage(layers, counts, 3, 3))
+
+	assert.Equal(t, []sync.PageSpan{
+		{Layer: sync.PullLayerRecords, Offset: 4, Limit: 1},
+	}, sync.PlanPage(layers, counts, 6, 3))
+
+	assert.Empty(t, sync.PlanPage(layers, counts, 7, 3))
+}
+
+// pullPages walks a paginated pull of a zone with the given layer sizes,
+// resuming through encoded tokens, and returns the spans of every page
+func pullPages(t *testing.T, codec *sync.CheckpointCodec, window sync.PullWindow, counts []int, limit int) [][]sync.PageSpan {
+	layers := []int{sync.PullLayerKeys, sync.PullLayerMetadata, sync.PullLayerRecords}
+	cp := &sync.PullCheckpoint{Zone: "default", Layers: 7, Watermark: window.GenCount, Digest: window.Digest, Items: window.Items}
+
+	var pages [][]sync.PageSpan
+	for {
+		spans := sync.PlanPage(layers, counts, cp.Offset, limit)
+		pages = append(pages, spans)
+		for _, span := range spans {
+			cp.Offset += span.Limit
+		}
+		if cp.Offset >= cp.Items {
+			return pages
+		}
+
+		token, err := codec.Encode("alice", cp)
+		require.NoError(t, err)
+		cp, err = codec.Decode("alice", token)
+		require.NoError(t, err)
+		require.NoError(t, cp.Check(window))
+	}
+}
+
+func TestCheckpointResumeDeliversEveryItemOnce(t *testing.T) {
+	codec := sync.NewCheckpointCodec([]byte("secret"))
+	counts := []int{3, 4, 5}
+	window := sync.PullWindow{GenCount: 12, Digest: []byte("d"), Items: 12}
+
+	pages := pullPages(t, codec, window, counts, 5)
+	require.Len(t, pages, 3)
+
+	delivered := map[int]int{}
+	for _, page := range pages {
+		for _, span := range page {
+			delivered[span.Layer] += span.Limit
+		}
+	}
+	assert.Equal(t, map[int]int{
+		sync.PullLayerKeys:     3,
+		sync.PullLayerMetadata: 4,
+		sync.PullLayerRecords:  5,
+	}, delivered)
+}
+
+func TestCheckpointResumeAfterChange(t *testing.T) {
+	cp := newTestCheckpoint()
+	require.NoError(t, cp.Check(cp.Window()))
+
+	// Another device pushed: the gencount moved past the watermark
+	pushed := cp.Window()
+	pushed.GenCount++
+	assert.ErrorIs(t, cp.Check(pushed), sync.ErrCheckpointStale)
+
+	// The live set changed without the gencount moving (e.g. a restore
+	// rewrote the manifest)
+	rewritten := cp.Window()
+	rewritten.Digest = []byte("digest-after-restore")
+	assert.ErrorIs(t, cp.Check(rewritten), sync.ErrCheckpointStale)
+}
+
+func TestCheckpointResumeAfterPurge(t *testing.T) {
+	// Purging tombstones moves neither the gencount nor the digest, but
+	// a pull that includes tombstones loses items from its window, which
+	// would shift every later offset
+	cp := newTestCheckpoint()
+	cp.IncludeTombstoned = true
+	purged := cp.Window()
+	purged.Items -= 2
+	assert.ErrorIs(t, cp.Check(purged), sync.ErrCheckpointStale)
+
+	// A pull without tombstones never saw the purged rows, so its window
+	// is unchanged and it resumes
+	live := newTestCheckpoint()
+	assert.NoError(t, live.Check(live.Window()))
+}
@@ -0,0 +1,258 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/cli"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cliRun is one run of the command line: its exit code and output
+type cliRun struct {
+	code   int
+	stdout string
+	stderr string
+}
+
+// runCLI runs args with stdin, on store when one is given
+func runCLI(t *testing.T, store storage.Store, stdin string, args ...string) cliRun {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	c := &cli.CLI{Stdin: strings.NewReader(stdin), Stdout: &stdout, Stderr: &stderr}
+	if store != nil {
+		c.OpenStore = func() (storage.Store, error) { return store, nil }
+	}
+	code := c.Run(args)
+	return cliRun{code: code, stdout: stdout.String(), stderr: stderr.String()}
+}
+
+// isolateCLI keeps the command line off the environment's databases,
+// Redis and upstream keys, and restores the access token configuration
+// serve changes
+func isolateCLI(t *testing.T) {
+	t.Helper()
+	for _, key := range []string{"POSTGRES_CONN", "JWT_SECRET", "JWT_PRIVATE_KEY", "JWT_PRIVATE_KEY_FILE", "HIBP_API_KEY", "NIST_API_KEY"} {
+		t.Setenv(key, "")
+	}
+	t.Setenv("REDIS_ADDR", "127.0.0.1:1")
+	previous := auth.JWTConfig()
+	t.Cleanup(func() { require.NoError(t, auth.SetJWTConfig(previous)) })
+}
+
+// A bare invocation, or one starting with flags, is serve; serve stops here
+// at the missing upstream keys
+func TestCLIDefaultsToServe(t *testing.T) {
+	isolateCLI(t)
+
+	for _, args := range [][]string{nil, {"-port", "0"}, {"serve", "-port", "0"}} {
+		run := runCLI(t, nil, "", args...)
+		assert.Equal(t, 1, run.code, "%v", args)
+		assert.Contains(t, run.stderr, "invalid breach/CVE config", "%v", args)
+	}
+
+	run := runCLI(t, nil, "", "-no-such-flag")
+	assert.Equal(t, 2, run.code)
+	assert.Contains(t, run.stderr, "flag provided but not defined")
+
+	t.Run("release mode refuses the default secret", func(t *testing.T) {
+		gin.SetMode(gin.ReleaseMode)
+		defer gin.SetMode(gin.TestMode)
+		run := runCLI(t, nil, "")
+		assert.Equal(t, 1, run.code)
+		assert.Contains(t, run.stderr, "default JWT secret is refused in release mode")
+		run = runCLI(t, nil, "", "-jwt-secret", "dev-secret-change-in-production")
+		assert.Equal(t, 1, run.code, "naming it doesn't help")
+		assert.Contains(t, run.stderr, "default JWT secret is refused in release mode")
+	})
+}
+
+func TestCLIUsageErrors(t *testing.T) {
+	isolateCLI(t)
+
+	run := runCLI(t, nil, "", "help")
+	assert.Equal(t, 0, run.code)
+	assert.Contains(t, run.stderr, "purge-tombstones")
+
+	for _, args := range [][]string{
+		{"frobnicate"},
+		{"user"},
+		{"user", "frobnicate"},
+		{"user", "create"},
+		{"user", "create", "-bogus"},
+		{"user", "deactivate", "-bogus"},
+		{"user", "set-tier", "-id", "some-user"},
+		{"user", "migrate-region", "-id", "some-user"},
+		{"manifest"},
+		{"manifest", "check"},
+		{"manifest", "repair", "-zone"},
+		{"purge-tombstones", "-retention", "a while"},
+		{"jwt"},
+		{"jwt", "rotate", "-bogus"},
+	} {
+		run := runCLI(t, nil, "", args...)
+		assert.Equal(t, 2, run.code, "%v: %s", args, run.stderr)
+		assert.NotEmpty(t, run.stderr, "%v", args)
+	}
+
+	// Well formed, but without a database to work on
+	for _, args := range [][]string{
+		{"user", "deactivate", "-id", "some-user", "-yes"},
+		{"manifest", "repair", "-id", "some-user"},
+		{"purge-tombstones", "-dry-run"},
+	} {
+		run := runCLI(t, nil, "", args...)
+		assert.Equal(t, 1, run.code, "%v", args)
+		assert.Contains(t, run.stderr, "Postgres connection string is required", "%v", args)
+	}
+}
+
+func TestCLIJWTRotate(t *testing.T) {
+	run := runCLI(t, nil, "", "jwt", "rotate")
+	require.Equal(t, 0, run.code, run.stderr)
+
+	lines := strings.Split(run.stdout, "\n")
+	require.Greater(t, len(lines), 2)
+	secret, err := base64.StdEncoding.DecodeString(lines[2])
+	require.NoError(t, err, run.stdout)
+	assert.Len(t, secret, 32)
+}
+
+func TestCLIUserCommands(t *testing.T) {
+	isolateCLI(t)
+	store := storage.NewMemoryStore()
+
+	run := runCLI(t, store, "short\n", "user", "create", "-email", "alice@example.com")
+	assert.Equal(t, 1, run.code)
+	assert.Contains(t, run.stderr, "at least 8 characters")
+
+	run = runCLI(t, store, "correct horse battery\n", "user", "create", "-email", "alice@example.com", "-region", "mars")
+	assert.Equal(t, 1, run.code)
+	assert.Contains(t, run.stderr, `unknown region "mars" (configured: default)`)
+
+	run = runCLI(t, store, "correct horse battery\n", "user", "create", "-email", "alice@example.com", "-admin")
+	require.Equal(t, 0, run.code, run.stderr)
+	alice, err := store.GetUserByEmail("alice@example.com")
+	require.NoError(t, err)
+	assert.True(t, alice.IsAdmin)
+	assert.True(t, auth.VerifyPassword("correct horse battery", alice.Salt, alice.PasswordHash, alice.HashVersion), "piped in on stdin")
+
+	run = runCLI(t, store, "correct horse battery\n", "user", "create", "-email", "alice@example.com")
+	assert.Equal(t, 1, run.code)
+	assert.Contains(t, run.stderr, "user already exists")
+
+	active := func() bool {
+		user, err := store.GetUserByID(alice.ID)
+		require.NoError(t, err)
+		return user.IsActive
+	}
+
+	t.Run("deactivate asks first", func(t *testing.T) {
+		for _, answer := range []string{"no\n", "", "YES\n"} {
+			run := runCLI(t, store, answer, "user", "deactivate", "-email", "alice@example.com")
+			assert.Equal(t, 1, run.code, "%q", answer)
+			assert.Contains(t, run.stdout, "Type 'yes' to continue")
+			assert.Contains(t, run.stdout, "Aborted")
+			assert.True(t, active(), "%q", answer)
+		}
+
+		run := runCLI(t, store, "yes\n", "user", "deactivate", "-email", "alice@example.com")
+		require.Equal(t, 0, run.code, run.stderr)
+		assert.False(t, active())
+
+		run = runCLI(t, store, "", "user", "activate", "-id", alice.ID)
+		require.Equal(t, 0, run.code, run.stderr)
+		assert.NotContains(t, run.stdout, "Type 'yes'", "activating needs no confirmation")
+		assert.True(t, active())
+
+		run = runCLI(t, store, "", "user", "deactivate", "-id", alice.ID, "-yes")
+		require.Equal(t, 0, run.code, run.stderr)
+		assert.NotContains(t, run.stdout, "Type 'yes'")
+		assert.False(t, active())
+	})
+
+	run = runCLI(t, store, "", "user", "set-tier", "-id", alice.ID, "-tier", "pro")
+	require.Equal(t, 0, run.code, run.stderr)
+	user, err := store.GetUserByID(alice.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "pro", user.SubscriptionTier)
+
+	run = runCLI(t, store, "", "user", "set-tier", "-email", "nobody@example.com", "-tier", "pro")
+	assert.Equal(t, 1, run.code)
+	assert.Contains(t, run.stderr, "not found")
+	run = runCLI(t, store, "", "user", "set-tier", "-tier", "pro")
+	assert.Equal(t, 1, run.code)
+	assert.Contains(t, run.stderr, "one of -id or -email is required")
+
+	var actions []string
+	err = store.StreamAuditEvents(storage.AuditEventFilter{
+		UserID: alice.ID, To: time.Now().Add(time.Hour), Limit: 100,
+	}, func(event *storage.AuditEvent) error {
+		assert.Contains(t, string(event.Details), `"source":"cli"`)
+		actions = append(actions, event.Action)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{service.AuditActionRegister, service.AuditActionUserDisable, service.AuditActionUserEnable, service.AuditActionUserDisable, service.AuditActionTierChange}, actions)
+}
+
+func TestCLIPurgeTombstones(t *testing.T) {
+	isolateCLI(t)
+	store := storage.NewMemoryStore()
+	user, err := store.CreateUser("alice@example.com", []byte("hash"), []byte("salt"), "")
+	require.NoError(t, err)
+
+	run := runCLI(t, store, "", "purge-tombstones", "-retention", "1ns")
+	require.Equal(t, 0, run.code, run.stderr)
+	assert.Contains(t, run.stdout, "Nothing to purge")
+	assert.NotContains(t, run.stdout, "Type 'yes'")
+
+	ctx := context.Background()
+	batch, _ := sqliteBatch("default")
+	batch.Records[0].Tombstone = true
+	_, err = store.CommitPush(ctx, user.ID, batch)
+	require.NoError(t, err)
+	tombstones := func() int {
+		records, err := store.GetSyncRecordsPage(ctx, user.ID, storage.PullRange{Zone: "default", IncludeTombstoned: true})
+		require.NoError(t, err)
+		n := 0
+		for _, record := range records {
+			if record.Tombstone {
+				n++
+			}
+		}
+		return n
+	}
+	require.Equal(t, 1, tombstones())
+
+	run = runCLI(t, store, "no\n", "purge-tombstones", "-retention", "1ns")
+	assert.Equal(t, 1, run.code)
+	assert.Contains(t, run.stdout, "Permanently delete")
+	assert.Equal(t, 1, tombstones())
+
+	run = runCLI(t, store, "", "purge-tombstones", "-retention", "1ns", "-dry-run")
+	require.Equal(t, 0, run.code, run.stderr)
+	assert.Contains(t, run.stdout, "Would purge")
+	assert.NotContains(t, run.stdout, "Type 'yes'", "a dry run asks nothing")
+	assert.Equal(t, 1, tombstones())
+
+	run = runCLI(t, store, "", "purge-tombstones", "-retention", "1ns", "-yes")
+	require.Equal(t, 0, run.code, run.stderr)
+	assert.Contains(t, run.stdout, "Purged")
+	assert.Equal(t, 0, tombstones())
+
+	run = runCLI(t, store, "", "manifest", "repair", "-id", user.ID, "-dry-run")
+	require.Equal(t, 0, run.code, run.stderr)
+	assert.Contains(t, run.stdout, "No drift")
+	run = runCLI(t, store, "", "manifest", "repair", "-id", "nobody")
+	assert.Equal(t, 1, run.code)
+}
@@ -0,0 +1,65 @@
+package unit
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// 14:30 in UTC+05:30, i.e. 09:00 UTC
+var frozenAt = time.Date(2025, 3, 1, 14, 30, 0, 0, time.FixedZone("IST", 5*3600+1800))
+
+func TestSystemClockIsUTC(t *testing.T) {
+	assert.Equal(t, time.UTC, clock.System.Now().Location())
+	assert.Equal(t, time.UTC, clock.Frozen(frozenAt).Now().Location())
+}
+
+func TestEngineTimestampsComeFromClock(t *testing.T) {
+	engine := sync.NewSyncEngine("default")
+	engine.SetClock(clock.Frozen(frozenAt))
+
+	op := engine.CreateSyncOperation("item-1", 0)
+	assert.True(t, op.Timestamp.Equal(frozenAt))
+	assert.Equal(t, time.UTC, op.Timestamp.Location())
+
+	tombstone := engine.MarkTombstone("item-1")
+	assert.True(t, tombstone.Timestamp.Equal(frozenAt))
+
+	manifest, err := engine.BuildManifest([]sync.ManifestLeaf{{Layer: sync.LeafSyncRecord, ItemUUID: "item-2", GenCount: 2}}, 2)
+	require.NoError(t, err)
+
+	data, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &fields))
+	assert.Equal(t, "2025-03-01T09:00:00Z", fields["updated_at"])
+}
+
+func TestRegistryEnginesUseRegistryClock(t *testing.T) {
+	registry := sync.NewRegistry(newEngineStore(), 10)
+	registry.SetClock(clock.Frozen(frozenAt))
+
+	engine, err := registry.GetOrLoad("alice", "default")
+	require.NoError(t, err)
+	assert.Equal(t, "2025-03-01T09:00:00Z", engine.MarkTombstone("item-1").Timestamp.Format(time.RFC3339))
+}
+
+func TestConflictResolutionIgnoresTimestamps(t *testing.T) {
+	engine := sync.NewSyncEngine("default")
+
+	// A record written "later" by a clock in another timezone still loses
+	// to the higher gencount
+	local := &models.SyncRecord{ItemUUID: uuid.New(), GenCount: 5, UpdatedAt: frozenAt.Add(time.Hour)}
+	remote := &models.SyncRecord{ItemUUID: local.ItemUUID, GenCount: 6, UpdatedAt: frozenAt}
+
+	resolved, err := engine.ResolveConflict(local, remote)
+	require.NoError(t, err)
+	assert.Same(t, remote, resolved.Winner)
+}
@@ -0,0 +1,173 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/breach"
+	"github.com/deeplyprofound/password-sync/server/api/cve"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Each breach is matched by the operator's mapping, then the CPE
+// dictionary, then by keyword, and its CVE data says which
+func TestBreachEnrichmentMatchesCPE(t *testing.T) {
+	suffix := time.Now().UnixNano()
+	vendor := fmt.Sprintf("Vendor Co%d", suffix)
+	mapped := fmt.Sprintf("Mapped%d", suffix)
+	combo := fmt.Sprintf("Combo List%d", suffix)
+	unknown := fmt.Sprintf("Unknown%d", suffix)
+
+	var mu sync.Mutex
+	var searches []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path == "/cpes" {
+			if query.Get("cpeMatchString") == fmt.Sprintf("cpe:2.3:*:vendor_co%d", suffix) {
+				fmt.Fprintf(w, `{"totalResults":2,"products":[
+					{"cpe":{"cpeName":"cpe:2.3:a:vendor_co%d:old:1.0:*:*:*:*:*:*:*","deprecated":true}},
+					{"cpe":{"cpeName":"cpe:2.3:a:vendor_co%d:app:2.0:*:*:*:*:*:*:*"}}]}`, suffix, suffix)
+				return
+			}
+			fmt.Fprint(w, `{"totalResults":0,"products":[]}`)
+			return
+		}
+		mu.Lock()
+		searches = append(searches, query.Get("virtualMatchString")+"|"+query.Get("keywordSearch"))
+		mu.Unlock()
+		fmt.Fprint(w, `{"totalResults":1,"vulnerabilities":[
+			{"cve":{"id":"CVE-2024-0003","metrics":{"cvssMetricV31":[{"cvssData":{"baseScore":7.1,"baseSeverity":"HIGH"}}]}}}]}`)
+	}))
+	defer upstream.Close()
+	client, err := cve.NewCVEClient(cve.ClientConfig{BaseURL: upstream.URL, CPEURL: upstream.URL + "/cpes", APIKey: "nvd-key", HTTPClient: upstream.Client()})
+	require.NoError(t, err)
+	breach.SetCVEClient(client)
+	defer breach.SetCVEClient(nil)
+
+	path := filepath.Join(t.TempDir(), "cpes.json")
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(`{" %s ": "cpe:2.3:a:mapped", %q: ""}`, mapped, combo)), 0o600))
+	mapping, err := breach.LoadCompanyCPEs(path)
+	require.NoError(t, err)
+	breach.SetCompanyCPEs(mapping)
+	defer breach.SetCompanyCPEs(nil)
+
+	enricher := breach.NewEnricher(breach.DefaultEnrichConfig)
+	breach.SetEnricher(enricher)
+	defer breach.SetEnricher(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go enricher.Run(ctx)
+
+	email := fmt.Sprintf("cpe-%d@example.com", suffix)
+	report := &breach.LeakResponse{Email: email, TotalLeaks: 4}
+	for _, source := range []string{vendor, mapped, combo, unknown} {
+		report.Sources = append(report.Sources, source)
+		report.LeakedData = append(report.LeakedData, breach.LeakSource{Source: source})
+	}
+	require.NoError(t, breach.CacheBreachReport(email, report, time.Minute))
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		middleware.SetClaims(c, &auth.Claims{UserID: "alice"})
+	})
+	router.POST("/breach/enrich", breach.StartEnrichment)
+	router.GET("/breach/enrich/:job_id", breach.GetEnrichment)
+
+	req := httptest.NewRequest(http.MethodPost, "/breach/enrich", bytes.NewReader([]byte(`{"email":"`+email+`"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var started breach.EnrichStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &started))
+
+	var done breach.EnrichStatus
+	require.Eventually(t, func() bool {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/breach/enrich/"+started.JobID, nil))
+		return w.Code == http.StatusOK && json.Unmarshal(w.Body.Bytes(), &done) == nil
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, breach.EnrichDone, done.Status, done.Error)
+
+	byVendor := done.Report.LeakedData[0].CVEData
+	assert.Equal(t, breach.MatchCPE, byVendor.MatchMethod)
+	assert.Equal(t, fmt.Sprintf("cpe:2.3:a:vendor_co%d", suffix), byVendor.CPE)
+	assert.Equal(t, "HIGH", byVendor.HighestLevel)
+
+	byMapping := done.Report.LeakedData[1].CVEData
+	assert.Equal(t, breach.MatchOverride, byMapping.MatchMethod)
+	assert.Equal(t, "cpe:2.3:a:mapped", byMapping.CPE)
+
+	noProduct := done.Report.LeakedData[2].CVEData
+	assert.Equal(t, breach.MatchOverride, noProduct.MatchMethod)
+	assert.Equal(t, 0, noProduct.TotalCVEs)
+
+	byKeyword := done.Report.LeakedData[3].CVEData
+	assert.Equal(t, breach.MatchKeyword, byKeyword.MatchMethod)
+	assert.Empty(t, byKeyword.CPE)
+
+	assert.Equal(t, []string{
+		fmt.Sprintf("cpe:2.3:a:vendor_co%d|", suffix),
+		"cpe:2.3:a:mapped|",
+		"|" + unknown + " vulnerability",
+	}, searches, "a breach mapped to no product is not searched")
+}
+
+func TestLoadCompanyCPEsRejectsBadMatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cpes.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"Canva": "canva"}`), 0o600))
+	_, err := breach.LoadCompanyCPEs(path)
+	assert.ErrorContains(t, err, "not a CPE 2.3 match string")
+}
+
+// A server login's host is matched by the product the operator mapped it
+// or a parent domain to, else by its second-level label
+func TestHostProductCVEs(t *testing.T) {
+	suffix := time.Now().UnixNano()
+	mapped := fmt.Sprintf("corp%d.example", suffix)
+	breach.SetCompanyCPEs(map[string]string{mapped: "cpe:2.3:a:gitlab"})
+	defer breach.SetCompanyCPEs(nil)
+
+	assert.Equal(t, mapped, breach.HostProduct("git."+mapped))
+	assert.Equal(t, mapped, breach.HostProduct(strings.ToUpper(mapped)))
+	assert.Equal(t, "github", breach.HostProduct("ssh.github.com"))
+	assert.Equal(t, "", breach.HostProduct("10.0.0.5"))
+	assert.Equal(t, "", breach.HostProduct("::1"))
+	assert.Equal(t, "", breach.HostProduct("nas"))
+
+	assert.Nil(t, breach.GetCVEDataForHost(context.Background(), "git."+mapped), "no NVD client")
+
+	var searched []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		searched = append(searched, r.URL.Query().Get("virtualMatchString"))
+		fmt.Fprint(w, `{"totalResults":1,"vulnerabilities":[
+			{"cve":{"id":"CVE-2024-0004","metrics":{"cvssMetricV31":[{"cvssData":{"baseScore":9.8,"baseSeverity":"CRITICAL"}}]}}}]}`)
+	}))
+	defer upstream.Close()
+	client, err := cve.NewCVEClient(cve.ClientConfig{BaseURL: upstream.URL, CPEURL: upstream.URL + "/cpes", APIKey: "nvd-key", HTTPClient: upstream.Client()})
+	require.NoError(t, err)
+	breach.SetCVEClient(client)
+	defer breach.SetCVEClient(nil)
+
+	data := breach.GetCVEDataForHost(context.Background(), "git."+mapped)
+	require.NotNil(t, data)
+	assert.Equal(t, breach.MatchOverride, data.MatchMethod)
+	assert.Equal(t, "CRITICAL", data.HighestLevel)
+	assert.Equal(t, []string{"cpe:2.3:a:gitlab"}, searched)
+	assert.Nil(t, breach.GetCVEDataForHost(context.Background(), "10.0.0.5"))
+}
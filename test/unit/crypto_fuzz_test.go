@@ -0,0 +1,194 @@
+package unit
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	apperrors "github.com/deeplyprofound/password-sync/pkg/errors"
+	"github.com/deeplyprofound/password-sync/server/domain/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// GCM nonce plus authentication tag: the smallest ciphertext decrypt accepts
+const minCiphertextSize = 12 + 16
+
+// fuzzCrypto derives the master key once; PBKDF2 per fuzz input would make
+// the targets far too slow to be useful
+func fuzzCrypto(tb testing.TB) *crypto.LayeredCrypto {
+	tb.Helper()
+	lc, err := crypto.NewLayeredCrypto("fuzz-password", make([]byte, 32))
+	require.NoError(tb, err)
+	return lc
+}
+
+// requireTypedDecryptError checks a failed decryption reports one of the
+// documented causes rather than a raw cipher error
+func requireTypedDecryptError(t *testing.T, err error) {
+	t.Helper()
+	if !errors.Is(err, apperrors.ErrCiphertextTooShort) &&
+		!errors.Is(err, apperrors.ErrCiphertextTooLarge) &&
+		!errors.Is(err, apperrors.ErrDecryptionFailed) &&
+		!errors.Is(err, apperrors.ErrInvalidKeySize) {
+		t.Fatalf("untyped decryption error: %v", err)
+	}
+}
+
+func FuzzUnwrapKey(f *testing.F) {
+	lc := fuzzCrypto(f)
+	contentKey, err := crypto.GenerateRandomKey(32)
+	require.NoError(f, err)
+	wrapped, err := lc.WrapKey(contentKey)
+	require.NoError(f, err)
+
+	f.Add(wrapped)
+	f.Add([]byte{})
+	f.Add(wrapped[:12])
+	f.Add(wrapped[:minCiphertextSize-1])
+
+	f.Fuzz(func(t *testing.T, wrappedKey []byte) {
+		unwrapped, err := lc.UnwrapKey(wrappedKey)
+		if err != nil {
+			requireTypedDecryptError(t, err)
+			return
+		}
+
+		rewrapped, err := lc.WrapKey(unwrapped)
+		require.NoError(t, err)
+		again, err := lc.UnwrapKey(rewrapped)
+		require.NoError(t, err)
+		assert.Equal(t, unwrapped, again)
+	})
+}
+
+func FuzzDecryptItem(f *testing.F) {
+	lc := fuzzCrypto(f)
+	contentKey, err := crypto.GenerateRandomKey(32)
+	require.NoError(f, err)
+	encrypted, err := lc.EncryptItem([]byte("sensitive-data"), contentKey)
+	require.NoError(f, err)
+
+	f.Add(encrypted, contentKey)
+	f.Add([]byte{}, contentKey)
+	f.Add(encrypted[:12], contentKey)
+	f.Add(encrypted, contentKey[:16])
+	f.Add(encrypted, []byte{})
+
+	f.Fuzz(func(t *testing.T, encData, key []byte) {
+		plaintext, err := lc.DecryptItem(encData, key)
+		if err != nil {
+			requireTypedDecryptError(t, err)
+			return
+		}
+
+		reencrypted, err := lc.EncryptItem(plaintext, key)
+		require.NoError(t, err)
+		again, err := lc.DecryptItem(reencrypted, key)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, again)
+	})
+}
+
+func FuzzDecryptCredential(f *testing.F) {
+	lc := fuzzCrypto(f)
+	wrappedKey, encItem, err := lc.EncryptCredential([]byte("secret-passkey-data"))
+	require.NoError(f, err)
+
+	f.Add(wrappedKey, encItem)
+	f.Add([]byte{}, encItem)
+	f.Add(wrappedKey, []byte{})
+	f.Add(encItem, wrappedKey)
+
+	f.Fuzz(func(t *testing.T, wrappedKey, encItem []byte) {
+		plaintext, err := lc.DecryptCredential(wrappedKey, encItem)
+		if err != nil {
+			requireTypedDecryptError(t, err)
+			return
+		}
+
+		rewrapped, reencrypted, err := lc.EncryptCredential(plaintext)
+		require.NoError(t, err)
+		again, err := lc.DecryptCredential(rewrapped, reencrypted)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, again)
+	})
+}
+
+// Every single-bit flip anywhere in the nonce, body or tag must be rejected
+func TestDecryptRejectsEveryBitFlip(t *testing.T) {
+	lc := fuzzCrypto(t)
+	wrappedKey, encItem, err := lc.EncryptCredential([]byte("secret-passkey-data"))
+	require.NoError(t, err)
+
+	flipped := func(data []byte, bit int) []byte {
+		out := bytes.Clone(data)
+		out[bit/8] ^= 1 << (bit % 8)
+		return out
+	}
+
+	for bit := 0; bit < len(wrappedKey)*8; bit++ {
+		_, err := lc.DecryptCredential(flipped(wrappedKey, bit), encItem)
+		require.ErrorIs(t, err, apperrors.ErrDecryptionFailed, "wrapped key bit %d", bit)
+	}
+	for bit := 0; bit < len(encItem)*8; bit++ {
+		_, err := lc.DecryptCredential(wrappedKey, flipped(encItem, bit))
+		require.ErrorIs(t, err, apperrors.ErrDecryptionFailed, "item bit %d", bit)
+	}
+
+	plaintext, err := lc.DecryptCredential(wrappedKey, encItem)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret-passkey-data"), plaintext)
+}
+
+func TestDecryptEdgeCases(t *testing.T) {
+	lc := fuzzCrypto(t)
+	contentKey, err := crypto.GenerateRandomKey(32)
+	require.NoError(t, err)
+	encrypted, err := lc.EncryptItem([]byte("data"), contentKey)
+	require.NoError(t, err)
+
+	t.Run("empty input", func(t *testing.T) {
+		_, err := lc.DecryptItem(nil, contentKey)
+		assert.ErrorIs(t, err, apperrors.ErrCiphertextTooShort)
+		_, err = lc.UnwrapKey([]byte{})
+		assert.ErrorIs(t, err, apperrors.ErrCiphertextTooShort)
+	})
+
+	t.Run("nonce only", func(t *testing.T) {
+		_, err := lc.DecryptItem(encrypted[:12], contentKey)
+		assert.ErrorIs(t, err, apperrors.ErrCiphertextTooShort)
+	})
+
+	t.Run("nonce and partial tag", func(t *testing.T) {
+		_, err := lc.DecryptItem(encrypted[:minCiphertextSize-1], contentKey)
+		assert.ErrorIs(t, err, apperrors.ErrCiphertextTooShort)
+	})
+
+	t.Run("empty plaintext round trips", func(t *testing.T) {
+		empty, err := lc.EncryptItem([]byte{}, contentKey)
+		require.NoError(t, err)
+		assert.Len(t, empty, minCiphertextSize)
+
+		decrypted, err := lc.DecryptItem(empty, contentKey)
+		require.NoError(t, err)
+		assert.Empty(t, decrypted)
+	})
+
+	t.Run("oversized payload", func(t *testing.T) {
+		_, err := lc.DecryptItem(make([]byte, crypto.MaxCiphertextSize+1), contentKey)
+		assert.ErrorIs(t, err, apperrors.ErrCiphertextTooLarge)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		otherKey, err := crypto.GenerateRandomKey(32)
+		require.NoError(t, err)
+		_, err = lc.DecryptItem(encrypted, otherKey)
+		assert.ErrorIs(t, err, apperrors.ErrDecryptionFailed)
+	})
+
+	t.Run("invalid key size", func(t *testing.T) {
+		_, err := lc.DecryptItem(encrypted, contentKey[:7])
+		assert.ErrorIs(t, err, apperrors.ErrInvalidKeySize)
+	})
+}
@@ -0,0 +1,117 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/breach"
+	"github.com/deeplyprofound/password-sync/server/api/cve"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCVERouter(t *testing.T, upstream *httptest.Server) *gin.Engine {
+	t.Helper()
+	noRetries := cve.NewLimiter(cve.LimiterConfig{MaxRetries: 0})
+	client, err := cve.NewCVEClient(cve.ClientConfig{BaseURL: upstream.URL, APIKey: "nvd-key", HTTPClient: upstream.Client(), Limiter: noRetries})
+	require.NoError(t, err)
+	cve.SetClient(client)
+	cve.SetCache(breach.SharedCache())
+	t.Cleanup(func() {
+		cve.SetClient(nil)
+		cve.SetCache(nil)
+	})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/cve/search", cve.SearchCVEs)
+	router.GET("/cve/latest", cve.GetLatestCVEs)
+	return router
+}
+
+// Searches differing only in keyword case and spacing share one NVD call,
+// answered typed, and pages pass their start index through
+func TestCVESearchCached(t *testing.T) {
+	keyword := fmt.Sprintf("cachedvendor%d", time.Now().UnixNano())
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		assert.Equal(t, keyword+" server", r.URL.Query().Get("keywordSearch"))
+		fmt.Fprintf(w, `{"resultsPerPage":1,"startIndex":%s,"totalResults":3,"vulnerabilities":[
+			{"cve":{"id":"CVE-2024-0001","descriptions":[{"lang":"es","value":"desbordamiento"},{"lang":"en","value":"overflow"}],
+			"metrics":{"cvssMetricV2":[{"cvssData":{"version":"2.0","baseScore":7.5}}]}}}]}`, r.URL.Query().Get("startIndex"))
+	}))
+	defer upstream.Close()
+	router := newCVERouter(t, upstream)
+
+	search := func(body string) cve.CVEResponse {
+		req := httptest.NewRequest(http.MethodPost, "/cve/search", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var resp cve.CVEResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+
+	first := search(`{"keyword":"` + keyword + ` server","limit":1}`)
+	require.Len(t, first.Vulnerabilities, 1)
+	item := first.Vulnerabilities[0].CVE
+	assert.Equal(t, "overflow", item.Description())
+	score, severity := item.Score()
+	assert.Equal(t, 7.5, score)
+	assert.Equal(t, "HIGH", severity)
+
+	again := search(`{"keyword":"  ` + keyword + `   SERVER ","limit":1}`)
+	assert.Equal(t, first, again)
+	assert.Equal(t, int32(1), calls.Load())
+
+	page := search(`{"keyword":"` + keyword + ` server","limit":1,"start_index":2}`)
+	assert.Equal(t, 2, page.StartIndex)
+	assert.Equal(t, int32(2), calls.Load())
+
+	for _, body := range []string{`{"limit":2001}`, `{"limit":-1}`, `{"start_index":-1}`} {
+		req := httptest.NewRequest(http.MethodPost, "/cve/search", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cve/latest?start_index=abc", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+// A search the NVD still rate limits after the client's retries is a 429
+// telling the client when to come back, and is not cached
+func TestCVESearchRateLimited(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "12")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer upstream.Close()
+	router := newCVERouter(t, upstream)
+
+	path := fmt.Sprintf("/cve/latest?limit=5&start_index=%d", time.Now().UnixNano()%1000000)
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusTooManyRequests, w.Code, w.Body.String())
+		assert.Equal(t, "12", w.Header().Get("Retry-After"))
+		var resp map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, "rate_limited", resp["code"])
+	}
+	assert.Equal(t, int32(2), calls.Load())
+}
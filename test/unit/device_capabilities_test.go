@@ -0,0 +1,269 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/handlers"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/service/device"
+	syncservice "github.com/deeplyprofound/password-sync/server/service/sync"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	gorilla "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ugorji/go/codec"
+)
+
+func TestDeviceCapabilitiesValidation(t *testing.T) {
+	t.Run("known keys are typed", func(t *testing.T) {
+		caps, err := peer.ParseCapabilities([]byte(`{"version":1,"enc_versions":[1,2],"msgpack":true,"max_page_size":200,"push_platform":"fcm","digest_version":2,"sync_schema":2}`))
+		require.NoError(t, err)
+		assert.Equal(t, []int{1, 2}, caps.EncVersions)
+		assert.Equal(t, 2, caps.DigestVersion)
+		assert.Equal(t, 2, caps.SyncSchema)
+		assert.Equal(t, 2, caps.MaxEncVersion())
+		assert.True(t, caps.MsgPack)
+		assert.Equal(t, peer.PushPlatformFCM, caps.PushPlatform)
+
+		empty, err := peer.ParseCapabilities(nil)
+		require.NoError(t, err)
+		assert.Equal(t, peer.CapabilitiesVersion, empty.Version)
+		assert.Zero(t, empty.MaxEncVersion())
+	})
+
+	t.Run("invalid documents", func(t *testing.T) {
+		for name, doc := range map[string]string{
+			"not an object":     `[1,2]`,
+			"null":              `null`,
+			"version zero":      `{"version":0}`,
+			"enc_versions type": `{"enc_versions":"2"}`,
+			"enc_version range": `{"enc_versions":[1,40000]}`,
+			"no enc_versions":   `{"enc_versions":[]}`,
+			"msgpack type":      `{"msgpack":"yes"}`,
+			"page size too big": `{"max_page_size":1001}`,
+			"fractional page":   `{"max_page_size":1.5}`,
+			"unknown platform":  `{"push_platform":"pager"}`,
+			"digest version":    `{"digest_version":0}`,
+			"sync schema":       `{"sync_schema":0}`,
+			"null known key":    `{"msgpack":null}`,
+			"too large":         `{"note":"` + strings.Repeat("x", peer.MaxCapabilitiesSize) + `"}`,
+			"malformed":         `{"version":`,
+		} {
+			_, err := peer.ParseCapabilities([]byte(doc))
+			assert.ErrorIs(t, err, peer.ErrInvalidCapabilities, name)
+		}
+	})
+
+	t.Run("unknown keys survive", func(t *testing.T) {
+		caps, err := peer.ParseCapabilities([]byte(`{"version":3,"msgpack":true,"x-theme":{"dark":true}}`))
+		require.NoError(t, err)
+		assert.Equal(t, 3, caps.Version, "newer schemas are accepted")
+		data, err := json.Marshal(caps)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"version":3,"msgpack":true,"x-theme":{"dark":true}}`, string(data))
+	})
+
+	t.Run("patches replace and delete keys", func(t *testing.T) {
+		caps, err := peer.MergeCapabilities(
+			[]byte(`{"version":1,"msgpack":true,"max_page_size":200,"x-theme":"dark"}`),
+			[]byte(`{"max_page_size":50,"x-theme":null,"push_platform":"apns"}`))
+		require.NoError(t, err)
+		data, _ := json.Marshal(caps)
+		assert.JSONEq(t, `{"version":1,"msgpack":true,"max_page_size":50,"push_platform":"apns"}`, string(data))
+
+		_, err = peer.MergeCapabilities([]byte(`{}`), []byte(`{"max_page_size":0}`))
+		assert.ErrorIs(t, err, peer.ErrInvalidCapabilities, "the merged result is validated")
+	})
+
+	t.Run("page size", func(t *testing.T) {
+		caps := &peer.Capabilities{MaxPageSize: 100}
+		assert.Equal(t, 100, caps.PageSize(0))
+		assert.Equal(t, 40, caps.PageSize(40))
+		assert.Equal(t, 100, caps.PageSize(500))
+		assert.Equal(t, 500, (&peer.Capabilities{}).PageSize(500))
+	})
+}
+
+func TestDeviceCapabilitiesService(t *testing.T) {
+	svc, store, _ := newSyncService(t)
+	devices := device.NewService(store)
+	ctx := context.Background()
+
+	userID := uuid.New().String()
+	laptop, _ := store.CreateDevice(userID, "laptop", "desktop", nil, 0, nil)
+	fromLaptop := service.Caller{UserID: userID, DeviceID: laptop.ID}
+
+	_, err := devices.Register(ctx, fromLaptop, device.RegisterInput{Name: "tv", Type: "tv", Capabilities: []byte(`{"max_page_size":0}`)})
+	assertServiceError(t, err, service.KindInvalid, "invalid_capabilities")
+
+	phone, err := devices.Register(ctx, fromLaptop, device.RegisterInput{
+		Name:          "phone",
+		Type:          "mobile",
+		MaxEncVersion: 1,
+		Capabilities:  []byte(`{"enc_versions":[1,2],"push_platform":"apns","x-build":"2026.10"}`),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, phone.MaxEncVersion, "enc_versions win over max_enc_version")
+	assert.JSONEq(t, `{"version":1,"enc_versions":[1,2],"push_platform":"apns","x-build":"2026.10"}`, string(phone.Capabilities))
+	fromPhone := service.Caller{UserID: userID, DeviceID: phone.ID}
+
+	t.Run("only the device updates itself", func(t *testing.T) {
+		_, err := devices.UpdateCapabilities(ctx, fromLaptop, phone.ID, []byte(`{"msgpack":true}`))
+		assertServiceError(t, err, service.KindForbidden, "not_calling_device")
+		_, err = devices.UpdateCapabilities(ctx, fromPhone, phone.ID, []byte(`{"push_platform":"sms"}`))
+		assertServiceError(t, err, service.KindInvalid, "invalid_capabilities")
+
+		updated, err := devices.UpdateCapabilities(ctx, fromPhone, phone.ID, []byte(`{"msgpack":true,"x-build":null}`))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"version":1,"enc_versions":[1,2],"msgpack":true,"push_platform":"apns"}`, string(updated.Capabilities))
+		assert.Equal(t, service.AuditActionDeviceCaps, store.audit[len(store.audit)-1].Action)
+	})
+
+	t.Run("fleet summary", func(t *testing.T) {
+		summary, err := devices.Capabilities(ctx, fromLaptop)
+		require.NoError(t, err)
+		assert.Equal(t, 2, summary.Devices)
+		assert.Equal(t, 1, summary.MinEncVersion, "the laptop never reported any")
+		assert.Equal(t, 2, summary.MaxEncVersion)
+		assert.Equal(t, 1, summary.MsgPack)
+		assert.Equal(t, map[string]int{"apns": 1}, summary.PushPlatforms)
+		require.Len(t, summary.Lagging, 1)
+		assert.Equal(t, laptop.ID, summary.Lagging[0].Device.ID)
+		assert.Zero(t, summary.Lagging[0].SchemaVersion)
+	})
+
+	t.Run("enc_versions feed the fleet minimum", func(t *testing.T) {
+		record := syncRecord(false)
+		record.EncVersion = 2
+		_, err := svc.Push(ctx, fromPhone, syncservice.PushInput{Records: []mapping.SyncRecordDTO{record}})
+		assertServiceError(t, err, service.KindConflict, "enc_version_unsupported")
+
+		_, err = devices.UpdateCapabilities(ctx, fromLaptop, laptop.ID, []byte(`{"enc_versions":[1,2]}`))
+		require.NoError(t, err)
+		_, err = svc.Push(ctx, fromPhone, syncservice.PushInput{Records: []mapping.SyncRecordDTO{record}})
+		require.NoError(t, err)
+
+		summary, err := devices.Capabilities(ctx, fromLaptop)
+		require.NoError(t, err)
+		assert.Equal(t, 2, summary.MinEncVersion)
+		assert.Empty(t, summary.Lagging)
+	})
+
+	t.Run("page size defaults to the device's", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			_, err := svc.Push(ctx, fromLaptop, syncservice.PushInput{Records: []mapping.SyncRecordDTO{syncRecord(false)}})
+			require.NoError(t, err)
+		}
+		_, err := devices.UpdateCapabilities(ctx, fromLaptop, laptop.ID, []byte(`{"max_page_size":2}`))
+		require.NoError(t, err)
+
+		result, err := svc.Pull(ctx, fromLaptop, syncservice.PullInput{Zone: "default"})
+		require.NoError(t, err)
+		assert.True(t, result.Paged)
+		assert.True(t, result.HasMore)
+		assert.Len(t, result.Records, 2)
+
+		result, err = svc.Pull(ctx, fromLaptop, syncservice.PullInput{Zone: "default", Limit: 1000})
+		require.NoError(t, err)
+		assert.Len(t, result.Records, 2, "the device's size caps explicit limits too")
+
+		result, err = svc.Pull(ctx, fromPhone, syncservice.PullInput{Zone: "default"})
+		require.NoError(t, err)
+		assert.False(t, result.Paged, "other devices are unaffected")
+		assert.True(t, result.MsgPack)
+	})
+}
+
+func TestDeviceCapabilitiesNegotiation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	svc, store, _ := newSyncService(t)
+	devices := device.NewService(store)
+	ctx := context.Background()
+
+	userID := uuid.New().String()
+	laptop, _ := store.CreateDevice(userID, "laptop", "desktop", nil, 0, []byte(`{"version":1,"msgpack":true}`))
+	phone, _ := store.CreateDevice(userID, "phone", "mobile", nil, 0, nil)
+	_, err := svc.Push(ctx, service.Caller{UserID: userID, DeviceID: phone.ID}, syncservice.PushInput{Records: []mapping.SyncRecordDTO{syncRecord(false)}})
+	require.NoError(t, err)
+
+	pull := func(deviceID, accept string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.POST("/sync/pull", func(c *gin.Context) {
+			middleware.SetClaims(c, &auth.Claims{UserID: userID, DeviceID: deviceID})
+		}, handlers.NewSyncHandlerWithService(svc).PullSync)
+		req := httptest.NewRequest(http.MethodPost, "/sync/pull", strings.NewReader(`{"zone":"default"}`))
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		return w
+	}
+
+	t.Run("pull responses", func(t *testing.T) {
+		w := pull(laptop.ID, "")
+		assert.Equal(t, "application/msgpack; charset=utf-8", w.Header().Get("Content-Type"))
+		var body map[string]interface{}
+		require.NoError(t, codec.NewDecoderBytes(w.Body.Bytes(), &codec.MsgpackHandle{}).Decode(&body))
+		assert.EqualValues(t, 1, body["gencount"])
+		assert.Len(t, body["sync_records"], 1)
+
+		assert.Contains(t, pull(laptop.ID, "*/*").Header().Get("Content-Type"), "application/msgpack")
+		assert.Contains(t, pull(laptop.ID, "application/json").Header().Get("Content-Type"), "application/json", "the header wins")
+		assert.Contains(t, pull(phone.ID, "").Header().Get("Content-Type"), "application/json")
+		assert.Contains(t, pull(phone.ID, "application/msgpack").Header().Get("Content-Type"), "application/msgpack")
+	})
+
+	t.Run("websocket events", func(t *testing.T) {
+		hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond})
+		wsHandler := handlers.NewWebSocketHandler(hub, middleware.NewOriginPolicy(nil, false))
+		wsHandler.SetDevices(store)
+		router := gin.New()
+		router.GET("/sync/live", func(c *gin.Context) {
+			middleware.SetClaims(c, &auth.Claims{UserID: userID, DeviceID: c.Query("device")})
+		}, wsHandler.HandleWebSocket)
+		server := httptest.NewServer(router)
+		t.Cleanup(server.Close)
+		url := "ws" + strings.TrimPrefix(server.URL, "http") + "/sync/live?device="
+
+		binary := dialLive(t, url+laptop.ID)
+		text := dialLive(t, url+phone.ID)
+		time.Sleep(50 * time.Millisecond)
+		origin := "another-device" // Not delivered back to the device that made the change
+		require.NoError(t, hub.BroadcastSyncEvent(&websocket.SyncEvent{Type: "credentials_changed", UserID: userID, Zone: "default", GenCount: 4, DeviceID: &origin}))
+
+		binary.SetReadDeadline(time.Now().Add(2 * time.Second))
+		frameType, frame, err := binary.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, gorilla.BinaryMessage, frameType)
+		var event websocket.SyncEvent
+		require.NoError(t, codec.NewDecoder(bytes.NewReader(frame), &codec.MsgpackHandle{}).Decode(&event))
+		assert.Equal(t, "credentials_changed", event.Type)
+		assert.Equal(t, int64(4), event.GenCount)
+		assert.Equal(t, origin, *event.DeviceID)
+
+		assert.Equal(t, int64(4), readEvent(t, text).GenCount, "other devices keep JSON")
+
+		// The preference applies from the next connection on
+		_, err = devices.UpdateCapabilities(ctx, service.Caller{UserID: userID, DeviceID: laptop.ID}, laptop.ID, []byte(`{"msgpack":false}`))
+		require.NoError(t, err)
+		again := dialLive(t, url+laptop.ID)
+		time.Sleep(50 * time.Millisecond)
+		require.NoError(t, hub.BroadcastSyncEvent(&websocket.SyncEvent{Type: "credentials_changed", UserID: userID, Zone: "default", GenCount: 5}))
+		assert.Equal(t, int64(5), readEvent(t, again).GenCount)
+	})
+}
@@ -0,0 +1,311 @@
+package unit
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/handlers"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	"github.com/deeplyprofound/password-sync/server/service"
+	authservice "github.com/deeplyprofound/password-sync/server/service/auth"
+	"github.com/deeplyprofound/password-sync/server/service/device"
+	syncservice "github.com/deeplyprofound/password-sync/server/service/sync"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// trustStore adds the account profile ClientAuthorizer reads to a memStore
+type trustStore struct {
+	*memStore
+}
+
+func (s trustStore) GetAuthProfile(id string) (*auth.Profile, error) {
+	return &auth.Profile{UserID: id, Active: true}, nil
+}
+
+func TestPeerTrustRules(t *testing.T) {
+	t.Run("access by level and approval setting", func(t *testing.T) {
+		assert.NoError(t, peer.CheckAccess(peer.TrustLevelTrusted, peer.DeviceApprovalRequired, true))
+		assert.NoError(t, peer.CheckAccess(peer.TrustLevelNone, peer.DeviceApprovalRequired, true), "callers without a device record")
+		assert.ErrorIs(t, peer.CheckAccess(peer.TrustLevelRevoked, peer.DeviceApprovalOff, false), peer.ErrPeerRevoked)
+
+		assert.NoError(t, peer.CheckAccess(peer.TrustLevelPending, peer.DeviceApprovalReadOnly, false))
+		assert.ErrorIs(t, peer.CheckAccess(peer.TrustLevelPending, peer.DeviceApprovalReadOnly, true), peer.ErrPeerPending)
+		assert.ErrorIs(t, peer.CheckAccess(peer.TrustLevelPending, peer.DeviceApprovalRequired, false), peer.ErrPeerPending)
+	})
+
+	t.Run("revocation is final", func(t *testing.T) {
+		assert.True(t, peer.ValidTransition(peer.TrustLevelPending, peer.TrustLevelTrusted))
+		assert.True(t, peer.ValidTransition(peer.TrustLevelTrusted, peer.TrustLevelRevoked))
+		assert.False(t, peer.ValidTransition(peer.TrustLevelTrusted, peer.TrustLevelPending))
+		assert.False(t, peer.ValidTransition(peer.TrustLevelRevoked, peer.TrustLevelTrusted))
+	})
+
+	t.Run("names round trip", func(t *testing.T) {
+		for _, level := range []peer.TrustLevel{peer.TrustLevelPending, peer.TrustLevelTrusted, peer.TrustLevelRevoked} {
+			parsed, err := peer.ParseTrustLevel(level.String())
+			require.NoError(t, err)
+			assert.Equal(t, level, parsed)
+		}
+		_, err := peer.ParseTrustLevel("none")
+		assert.ErrorIs(t, err, peer.ErrUnknownTrustLevel)
+	})
+
+	t.Run("peer manager reports changes", func(t *testing.T) {
+		pm, err := peer.NewPeerManager("device-1")
+		require.NoError(t, err)
+		var changes []string
+		pm.SetTrustListener(func(peerID string, from, to peer.TrustLevel) {
+			changes = append(changes, peerID+": "+from.String()+" -> "+to.String())
+		})
+		pubKey, _, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+
+		require.NoError(t, pm.AddPendingPeer("device-2", pubKey))
+		assert.False(t, pm.IsPeerTrusted("device-2"))
+		require.NoError(t, pm.EstablishTrust("device-2", pubKey))
+		require.NoError(t, pm.RevokeTrust("device-2"))
+		assert.ErrorIs(t, pm.EstablishTrust("device-2", pubKey), peer.ErrPeerRevoked)
+		assert.Equal(t, peer.TrustLevelRevoked, pm.TrustLevelOf("device-2"))
+
+		pm.LoadPeer("device-3", pubKey, peer.TrustLevelPending)
+		assert.Equal(t, []string{
+			"device-2: none -> pending",
+			"device-2: pending -> trusted",
+			"device-2: trusted -> revoked",
+		}, changes, "loaded peers are not reported")
+	})
+}
+
+func TestRevokedPeerIsCutOff(t *testing.T) {
+	svc, store, _ := newSyncService(t)
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond})
+	hub.SetAuthorizer(handlers.ClientAuthorizer(trustStore{store}))
+	devices := device.NewService(store)
+	devices.SetHub(hub)
+	ctx := context.Background()
+
+	userID := uuid.New().String()
+	laptop, _ := store.CreateDevice(userID, "laptop", "desktop", nil, 0, nil)
+	phone, _ := store.CreateDevice(userID, "phone", "mobile", nil, 0, nil)
+	fromLaptop := service.Caller{UserID: userID, DeviceID: laptop.ID}
+	fromPhone := service.Caller{UserID: userID, DeviceID: phone.ID}
+
+	_, err := svc.Push(ctx, fromPhone, syncservice.PushInput{Records: []mapping.SyncRecordDTO{syncRecord(false)}})
+	require.NoError(t, err)
+	_, err = svc.Pull(ctx, fromPhone, syncservice.PullInput{Zone: "default"})
+	require.NoError(t, err)
+	require.NoError(t, hub.Authorize(userID, phone.ID, "default"))
+	live := connectDevice(hub, userID, phone.ID, "default")
+	watcher := connectDevice(hub, userID, laptop.ID, "default")
+
+	revoked, err := devices.SetTrust(ctx, fromLaptop, phone.ID, peer.TrustLevelRevoked)
+	require.NoError(t, err)
+	assert.False(t, revoked.IsActive)
+	assert.Equal(t, int(peer.TrustLevelRevoked), revoked.TrustLevel)
+
+	// The very next request of each kind is refused
+	_, err = svc.Push(ctx, fromPhone, syncservice.PushInput{Records: []mapping.SyncRecordDTO{syncRecord(false)}})
+	assertServiceError(t, err, service.KindForbidden, "device_revoked")
+	_, err = svc.Pull(ctx, fromPhone, syncservice.PullInput{Zone: "default"})
+	assertServiceError(t, err, service.KindForbidden, "device_revoked")
+	_, err = svc.Manifest(ctx, fromPhone, "default")
+	assertServiceError(t, err, service.KindForbidden, "device_revoked")
+
+	// Its open socket was closed, and it can't open another
+	assertClosed(t, live)
+	assert.ErrorIs(t, hub.Authorize(userID, phone.ID, "default"), websocket.ErrClientRevoked)
+	router := gin.New()
+	router.GET("/sync/live", func(c *gin.Context) {
+		middleware.SetClaims(c, &auth.Claims{UserID: userID, DeviceID: phone.ID})
+	}, handlers.NewWebSocketHandler(hub, middleware.NewOriginPolicy(nil, false)).HandleWebSocket)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sync/live", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "device_revoked", body["code"])
+
+	// The other devices hear about it, and the audit log has the transition
+	event := receiveEvent(t, watcher)
+	assert.Equal(t, device.EventDeviceTrustChanged, event.Type)
+	assert.Equal(t, phone.ID, *event.DeviceID)
+	assert.Equal(t, "revoked", event.TrustLevel)
+	last := store.audit[len(store.audit)-1]
+	assert.Equal(t, service.AuditActionDeviceTrust, last.Action)
+	assert.JSONEq(t, `{"device_id":"`+phone.ID+`","from":"trusted","to":"revoked"}`, string(last.Details))
+
+	// The laptop is unaffected, and revocation can't be undone
+	_, err = svc.Pull(ctx, fromLaptop, syncservice.PullInput{Zone: "default"})
+	require.NoError(t, err)
+	_, err = devices.SetTrust(ctx, fromLaptop, phone.ID, peer.TrustLevelTrusted)
+	assertServiceError(t, err, service.KindNotFound, "")
+}
+
+func TestPendingDeviceApproval(t *testing.T) {
+	svc, store, hub := newSyncService(t)
+	devices := device.NewService(store)
+	devices.SetHub(hub)
+	ctx := context.Background()
+
+	userID := uuid.New().String()
+	laptop, _ := store.CreateDevice(userID, "laptop", "desktop", nil, 0, nil)
+	fromLaptop := service.Caller{UserID: userID, DeviceID: laptop.ID}
+	_, err := svc.Push(ctx, fromLaptop, syncservice.PushInput{Records: []mapping.SyncRecordDTO{syncRecord(false)}})
+	require.NoError(t, err)
+
+	store.approval = peer.DeviceApprovalReadOnly
+	phone, err := devices.Register(ctx, fromLaptop, device.RegisterInput{Name: "phone", Type: "mobile"})
+	require.NoError(t, err)
+	assert.Equal(t, int(peer.TrustLevelPending), phone.TrustLevel)
+	require.NotEmpty(t, hub.events)
+	assert.Equal(t, device.EventDeviceTrustChanged, hub.events[len(hub.events)-1].Type)
+	assert.Equal(t, "pending", hub.events[len(hub.events)-1].TrustLevel)
+	fromPhone := service.Caller{UserID: userID, DeviceID: phone.ID}
+
+	// Read-only: it may pull but not push, and can't approve itself
+	_, err = svc.Pull(ctx, fromPhone, syncservice.PullInput{Zone: "default"})
+	require.NoError(t, err)
+	_, err = svc.Push(ctx, fromPhone, syncservice.PushInput{Records: []mapping.SyncRecordDTO{syncRecord(false)}})
+	assertServiceError(t, err, service.KindForbidden, "device_pending")
+	_, err = devices.SetTrust(ctx, fromPhone, phone.ID, peer.TrustLevelTrusted)
+	assertServiceError(t, err, service.KindForbidden, "device_pending")
+
+	// Approval required: no access at all
+	store.approval = peer.DeviceApprovalRequired
+	_, err = svc.Pull(ctx, fromPhone, syncservice.PullInput{Zone: "default"})
+	assertServiceError(t, err, service.KindForbidden, "device_pending")
+
+	approved, err := devices.SetTrust(ctx, fromLaptop, phone.ID, peer.TrustLevelTrusted)
+	require.NoError(t, err)
+	assert.Equal(t, int(peer.TrustLevelTrusted), approved.TrustLevel)
+	_, err = svc.Push(ctx, fromPhone, syncservice.PushInput{Records: []mapping.SyncRecordDTO{syncRecord(false)}})
+	require.NoError(t, err)
+
+	_, err = devices.SetTrust(ctx, fromLaptop, phone.ID, peer.TrustLevelPending)
+	assertServiceError(t, err, service.KindConflict, "invalid_trust_change")
+	assert.Contains(t, store.actions(), service.AuditActionDeviceTrust)
+}
+
+func TestReregisteredDeviceKeepsTrust(t *testing.T) {
+	_, store, hub := newSyncService(t)
+	devices := device.NewService(store)
+	devices.SetHub(hub)
+	ctx := context.Background()
+
+	userID := uuid.New().String()
+	laptop, _ := store.CreateDevice(userID, "laptop", "desktop", nil, 0, nil)
+	fromLaptop := service.Caller{UserID: userID, DeviceID: laptop.ID}
+	store.approval = peer.DeviceApprovalRequired
+	in := device.RegisterInput{Name: "phone", Type: "mobile", PublicKey: []byte("key-1"), Fingerprint: "phone-1"}
+	phone, err := devices.Register(ctx, fromLaptop, in)
+	require.NoError(t, err)
+	_, err = devices.SetTrust(ctx, fromLaptop, phone.ID, peer.TrustLevelTrusted)
+	require.NoError(t, err)
+
+	again, err := devices.Register(ctx, fromLaptop, in)
+	require.NoError(t, err)
+	assert.Equal(t, phone.ID, again.ID)
+	assert.Equal(t, int(peer.TrustLevelTrusted), again.TrustLevel)
+
+	// A new key must be approved again
+	in.PublicKey = []byte("key-2")
+	rekeyed, err := devices.Register(ctx, fromLaptop, in)
+	require.NoError(t, err)
+	assert.False(t, rekeyed.Created)
+	assert.Equal(t, int(peer.TrustLevelPending), rekeyed.TrustLevel)
+	assert.Equal(t, "pending", hub.events[len(hub.events)-1].TrustLevel)
+}
+
+// Leaving out or swapping the device claim gets no more access than the
+// device itself has: tokens are only issued for the user's own active
+// devices, and a caller without a device counts as pending while the
+// account approves devices
+func TestDeviceClaimCannotBeDropped(t *testing.T) {
+	svc, store, hub := newSyncService(t)
+	accounts := authservice.NewService(store)
+	devices := device.NewService(store)
+	devices.SetHub(hub)
+	ctx := context.Background()
+	login := authservice.LoginInput{Email: "alice@example.com", Password: "hunter22"}
+
+	alice, err := accounts.Register(ctx, service.Caller{}, authservice.RegisterInput{Email: login.Email, Password: login.Password})
+	require.NoError(t, err)
+	bob, err := accounts.Register(ctx, service.Caller{}, authservice.RegisterInput{Email: "bob@example.com", Password: "hunter22"})
+	require.NoError(t, err)
+	laptop, _ := store.CreateDevice(alice.User.ID, "laptop", "desktop", nil, 0, nil)
+	phone, _ := store.CreateDevice(alice.User.ID, "phone", "mobile", nil, 0, nil)
+	bobsPhone, _ := store.CreateDevice(bob.User.ID, "phone", "mobile", nil, 0, nil)
+	fromLaptop := service.Caller{UserID: alice.User.ID, DeviceID: laptop.ID}
+
+	onPhone := login
+	onPhone.DeviceID = phone.ID
+	session, err := accounts.Login(ctx, service.Caller{}, onPhone)
+	require.NoError(t, err)
+	_, err = devices.SetTrust(ctx, fromLaptop, phone.ID, peer.TrustLevelRevoked)
+	require.NoError(t, err)
+
+	t.Run("a revoked device gets no token", func(t *testing.T) {
+		_, err := accounts.Login(ctx, service.Caller{}, onPhone)
+		assertServiceError(t, err, service.KindForbidden, "device_revoked")
+		_, err = accounts.Refresh(ctx, service.Caller{}, session.RefreshToken)
+		assertServiceError(t, err, service.KindForbidden, "device_revoked")
+	})
+
+	t.Run("nor does another user's device", func(t *testing.T) {
+		borrowed := login
+		borrowed.DeviceID = bobsPhone.ID
+		_, err := accounts.Login(ctx, service.Caller{}, borrowed)
+		assertServiceError(t, err, service.KindForbidden, "device_revoked")
+		borrowed.DeviceID = uuid.NewString()
+		_, err = accounts.Login(ctx, service.Caller{}, borrowed)
+		assertServiceError(t, err, service.KindForbidden, "device_revoked")
+	})
+
+	t.Run("without a device claim", func(t *testing.T) {
+		_, err := accounts.Login(ctx, service.Caller{}, login)
+		require.NoError(t, err, "a new device logs in before it registers")
+		deviceless := service.Caller{UserID: alice.User.ID}
+		push := func() error {
+			_, err := svc.Push(ctx, deviceless, syncservice.PushInput{Records: []mapping.SyncRecordDTO{syncRecord(false)}})
+			return err
+		}
+		pull := func() error {
+			_, err := svc.Pull(ctx, deviceless, syncservice.PullInput{Zone: "default"})
+			return err
+		}
+		authorize := handlers.ClientAuthorizer(trustStore{store})
+
+		// Approval off: like a device registered now, it is trusted
+		require.NoError(t, push())
+		require.NoError(t, pull())
+		require.NoError(t, authorize(alice.User.ID, "", "default"))
+
+		store.approval = peer.DeviceApprovalReadOnly
+		assertServiceError(t, push(), service.KindForbidden, "device_pending")
+		require.NoError(t, pull())
+
+		store.approval = peer.DeviceApprovalRequired
+		assertServiceError(t, push(), service.KindForbidden, "device_pending")
+		assertServiceError(t, pull(), service.KindForbidden, "device_pending")
+		assert.ErrorIs(t, authorize(alice.User.ID, "", "default"), websocket.ErrClientRevoked)
+		_, err = devices.SetTrust(ctx, deviceless, phone.ID, peer.TrustLevelTrusted)
+		assertServiceError(t, err, service.KindForbidden, "device_pending")
+
+		// It may still register, as a device waiting for approval
+		registered, err := devices.Register(ctx, deviceless, device.RegisterInput{Name: "tablet", Type: "mobile"})
+		require.NoError(t, err)
+		assert.Equal(t, int(peer.TrustLevelPending), registered.TrustLevel)
+	})
+}
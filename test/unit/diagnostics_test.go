@@ -0,0 +1,115 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/server/api/handlers"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	diagnosticsDevice   = "22222222-2222-4222-8222-222222222222"
+	diagnosticsOperator = "33333333-3333-4333-8333-333333333333"
+	diagnosticsItem     = "44444444-4444-4444-8444-444444444444"
+	diagnosticsKey      = "55555555-5555-4555-8555-555555555555"
+)
+
+func fullDiagnostics() *handlers.SyncDiagnostics {
+	zone, device, operator, item := "default", diagnosticsDevice, diagnosticsOperator, diagnosticsItem
+	lastSync := "2026-10-01T12:00:00Z"
+	return &handlers.SyncDiagnostics{
+		UserID:      activityAlice,
+		Zone:        zone,
+		GeneratedAt: "2026-10-02T08:00:00Z",
+		Manifest: handlers.ManifestDiagnostics{
+			GenCount:       42,
+			StoredDigest:   []byte{1, 2, 3},
+			ComputedDigest: []byte{1, 2, 4},
+			LeafCount:      7,
+			Drift:          true,
+		},
+		Layers: []storage.LayerCount{
+			{Layer: "crypto_key", Live: 3, Tombstoned: 1},
+			{Layer: "sync_record", Live: 7, Tombstoned: 2},
+		},
+		Devices: []handlers.DeviceDiagnostics{
+			{ID: device, Name: "Alice's Work Laptop", Type: "desktop", LastSync: &lastSync},
+		},
+		RecentEvents: []handlers.AuditEventRecord{
+			{ID: 9, CreatedAt: "2026-10-01T12:00:00Z", UserID: activityAlice, DeviceID: &device,
+				Action: service.AuditActionItemPush, Zone: &zone, ItemUUID: &item, IPAddress: "203.0.113.7"},
+			{ID: 8, CreatedAt: "2026-10-01T11:00:00Z", UserID: activityAlice, ActorID: &operator,
+				Action: service.AuditActionManifestFix, Zone: &zone, IPAddress: "198.51.100.2"},
+		},
+		ReferenceViolations: []storage.ReferenceViolation{
+			{Layer: "credential_metadata", ItemUUID: item, Field: "password_key_uuid", KeyUUID: diagnosticsKey, Violation: storage.ReferenceMissing},
+			{Layer: "sync_record", ItemUUID: item, Field: "parent_key_uuid", KeyUUID: diagnosticsKey, Violation: storage.ReferenceTombstoned},
+			{Layer: "credential_metadata", ItemUUID: item, Field: "metadata_key_uuid", KeyUUID: diagnosticsKey, Violation: storage.ReferenceMissing},
+		},
+	}
+}
+
+func TestUserDiagnosticsAreRedacted(t *testing.T) {
+	reduced := handlers.NewUserSyncDiagnostics(fullDiagnostics())
+	data, err := json.Marshal(reduced)
+	require.NoError(t, err)
+	body := string(data)
+
+	for _, secret := range []string{
+		activityAlice,         // the account
+		"Alice's Work Laptop", // device names
+		"203.0.113.7", "198.51.100.2",
+		diagnosticsOperator, // who acted on the account
+		diagnosticsItem, diagnosticsKey,
+	} {
+		assert.NotContains(t, body, secret)
+	}
+
+	// What triage needs is still there
+	assert.True(t, reduced.Manifest.Drift)
+	assert.Equal(t, int64(42), reduced.Manifest.GenCount)
+	assert.Len(t, reduced.Layers, 2)
+	require.Len(t, reduced.Devices, 1)
+	assert.Equal(t, diagnosticsDevice, reduced.Devices[0].ID)
+	assert.Equal(t, "2026-10-01T12:00:00Z", *reduced.Devices[0].LastSync)
+	require.Len(t, reduced.RecentEvents, 2)
+	assert.Equal(t, service.AuditActionItemPush, reduced.RecentEvents[0].Action, "newest first")
+	assert.Equal(t, map[string]int{storage.ReferenceMissing: 2, storage.ReferenceTombstoned: 1}, reduced.ReferenceViolations)
+}
+
+func TestAdminDiagnosticsKeepDetails(t *testing.T) {
+	data, err := json.Marshal(fullDiagnostics())
+	require.NoError(t, err)
+	body := string(data)
+
+	for _, detail := range []string{activityAlice, "Alice's Work Laptop", "203.0.113.7", diagnosticsOperator, diagnosticsItem} {
+		assert.Contains(t, body, detail)
+	}
+}
+
+func TestManifestDrifted(t *testing.T) {
+	computed := &storage.ManifestState{Digest: []byte{1}}
+
+	assert.False(t, jobs.ManifestDrifted(&storage.SyncState{}, computed), "a zone never written can't drift")
+	assert.False(t, jobs.ManifestDrifted(&storage.SyncState{GenCount: 3, Digest: []byte{1}}, computed))
+	assert.True(t, jobs.ManifestDrifted(&storage.SyncState{GenCount: 3, Digest: []byte{2}}, computed))
+	assert.True(t, jobs.ManifestDrifted(&storage.SyncState{GenCount: 3}, computed), "written but no digest stored")
+}
+
+func TestDiagnosticsRequireAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/sync/diagnostics", handlers.NewSyncHandler(nil, nil).GetDiagnostics)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sync/diagnostics", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
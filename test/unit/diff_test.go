@@ -0,0 +1,122 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/server/api"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDiffThenTargetedPull reconciles a device whose copy of a zone
+// diverged: the diff names what it lacks, holds stale, and should drop, and
+// a pull by item_uuids returns only the first two
+func TestDiffThenTargetedPull(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := api.NewServerWithAuth(storage.NewMemoryStore()).Handler()
+
+	var token string
+	do := func(method, path string, body interface{}, status int) map[string]interface{} {
+		t.Helper()
+		encoded, err := json.Marshal(body)
+		require.NoError(t, err)
+		req := httptest.NewRequest(method, path, bytes.NewReader(encoded))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		require.Equal(t, status, w.Code, w.Body.String())
+
+		var resp map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+
+	registered := do(http.MethodPost, "/api/v1/auth/register", map[string]string{
+		"email": "alice@example.com", "password": "correct horse battery",
+	}, http.StatusCreated)
+	token, _ = registered["access_token"].(string)
+	require.NotEmpty(t, token)
+
+	keyID, kept, stale, missing := uuid.New().String(), uuid.New().String(), uuid.New().String(), uuid.New().String()
+	credential := func(id string) (map[string]interface{}, map[string]interface{}) {
+		return map[string]interface{}{
+			"item_uuid": id, "server": "example.com", "account": id,
+			"protocol": 443, "port": 443, "path": "/", "password_key_uuid": keyID,
+		}, map[string]interface{}{
+			"item_uuid": id, "parent_key_uuid": keyID, "wrapped_key": "d3JhcHBlZA==",
+			"enc_item": "c2VhbGVk", "enc_version": 1,
+		}
+	}
+	push := func(ids ...string) {
+		var metadata, records []map[string]interface{}
+		for _, id := range ids {
+			m, r := credential(id)
+			metadata, records = append(metadata, m), append(records, r)
+		}
+		body := map[string]interface{}{"zone": "default", "credential_metadata": metadata, "sync_records": records}
+		if ids[0] == kept {
+			body["keys"] = []map[string]interface{}{{
+				"item_uuid": keyID, "key_class": 1, "key_type": 2, "label": "password key",
+				"data": "a2V5", "usage_flags": "e30=",
+			}}
+		}
+		do(http.MethodPost, "/api/v1/sync/push", body, http.StatusOK)
+	}
+	push(kept, stale)
+
+	// The device's copy as of this pull; then stale is rewritten and
+	// missing pushed without it
+	device := do(http.MethodPost, "/api/v1/sync/pull", map[string]interface{}{"zone": "default"}, http.StatusOK)
+	push(stale)
+	push(missing)
+
+	gone := uuid.New().String()
+	leaves := []string{"sync_record:" + gone + ":2"}
+	for layer, items := range map[string]string{"crypto_key": "keys", "credential_metadata": "credential_metadata", "sync_record": "sync_records"} {
+		for _, item := range device[items].([]interface{}) {
+			item := item.(map[string]interface{})
+			leaves = append(leaves, fmt.Sprintf("%s:%s:%.0f", layer, item["item_uuid"], item["gencount"]))
+		}
+	}
+
+	diff := do(http.MethodPost, "/api/v1/sync/diff", map[string]interface{}{"zone": "default", "leaf_ids": leaves}, http.StatusOK)
+	assert.Equal(t, []interface{}{missing}, diff["added"])
+	assert.Equal(t, []interface{}{stale}, diff["modified"])
+	assert.Equal(t, []interface{}{gone}, diff["removed"])
+	manifest := do(http.MethodGet, "/api/v1/sync/manifest?zone=default", nil, http.StatusOK)
+	assert.Equal(t, manifest["gencount"], diff["gencount"])
+	assert.NotEmpty(t, diff["digest"])
+	assert.Equal(t, float64(2), diff["digest_version"])
+
+	pulled := do(http.MethodPost, "/api/v1/sync/pull", map[string]interface{}{
+		"zone": "default", "item_uuids": []string{missing, stale}, "limit": 1,
+	}, http.StatusOK)
+	assert.Empty(t, pulled["keys"])
+	var records []string
+	for _, record := range pulled["sync_records"].([]interface{}) {
+		records = append(records, record.(map[string]interface{})["item_uuid"].(string))
+	}
+	want := []string{missing, stale}
+	sort.Strings(records)
+	sort.Strings(want)
+	assert.Equal(t, want, records)
+	assert.Len(t, pulled["credential_metadata"], 2)
+	assert.Nil(t, pulled["checkpoint"], "a targeted pull is not paged")
+
+	invalid := do(http.MethodPost, "/api/v1/sync/diff", map[string]interface{}{"leaf_ids": []string{"sync_record:" + kept}}, http.StatusBadRequest)
+	assert.Equal(t, "invalid_leaf", invalid["code"])
+	do(http.MethodPost, "/api/v1/sync/pull", map[string]interface{}{"item_uuids": []string{"nope"}}, http.StatusBadRequest)
+	do(http.MethodPost, "/api/v1/sync/pull", map[string]interface{}{"item_uuids": []string{kept}, "checkpoint": "x"}, http.StatusBadRequest)
+}
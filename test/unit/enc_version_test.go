@@ -0,0 +1,61 @@
+package unit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMinSupportedEncVersion(t *testing.T) {
+	_, ok := sync.MinSupportedEncVersion(nil)
+	assert.False(t, ok, "no active devices, no constraint")
+
+	lowest, ok := sync.MinSupportedEncVersion([]int{3, 2, 3})
+	assert.True(t, ok)
+	assert.Equal(t, 2, lowest)
+
+	lowest, _ = sync.MinSupportedEncVersion([]int{3, 0})
+	assert.Equal(t, sync.BaseEncVersion, lowest, "devices that never reported are assumed to be on the base version")
+}
+
+func TestCheckEncVersionMixedFleet(t *testing.T) {
+	// A new desktop, a phone one release behind and a tablet that predates reporting
+	fleet := []int{3, 2, 0}
+
+	conflict, reject := sync.CheckEncVersion(1, fleet, sync.EncVersionPolicyReject)
+	assert.Nil(t, conflict, "everyone reads the base version")
+	assert.False(t, reject)
+
+	conflict, reject = sync.CheckEncVersion(2, fleet, sync.EncVersionPolicyWarn)
+	require.NotNil(t, conflict, "the tablet cannot read v2")
+	assert.False(t, reject, "warn accepts the push")
+	assert.Equal(t, 2, conflict.Pushed)
+	assert.Equal(t, 1, conflict.MinSupported)
+
+	conflict, reject = sync.CheckEncVersion(3, fleet, sync.EncVersionPolicyReject)
+	require.NotNil(t, conflict)
+	assert.True(t, reject)
+	assert.True(t, errors.Is(conflict, sync.ErrEncVersionUnsupported))
+
+	// Once the tablet is retired, v2 is safe but v3 still is not
+	upgraded := []int{3, 2}
+	conflict, _ = sync.CheckEncVersion(2, upgraded, sync.EncVersionPolicyReject)
+	assert.Nil(t, conflict)
+	conflict, reject = sync.CheckEncVersion(3, upgraded, sync.EncVersionPolicyReject)
+	require.NotNil(t, conflict)
+	assert.True(t, reject)
+	assert.Equal(t, 2, conflict.MinSupported)
+
+	conflict, _ = sync.CheckEncVersion(5, nil, sync.EncVersionPolicyReject)
+	assert.Nil(t, conflict, "a user without active devices is not blocked")
+}
+
+func TestValidEncVersionPolicy(t *testing.T) {
+	assert.True(t, sync.ValidEncVersionPolicy(sync.EncVersionPolicyWarn))
+	assert.True(t, sync.ValidEncVersionPolicy(sync.EncVersionPolicyReject))
+	assert.False(t, sync.ValidEncVersionPolicy(""))
+	assert.False(t, sync.ValidEncVersionPolicy("block"))
+}
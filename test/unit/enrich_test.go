@@ -0,0 +1,142 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/breach"
+	"github.com/deeplyprofound/password-sync/server/api/cve"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Enrichment answers at once with a job; a second request for the address
+// joins it, and the job's users poll it to the enriched report
+func TestBreachEnrichmentJob(t *testing.T) {
+	company := fmt.Sprintf("Breachco%d", time.Now().UnixNano())
+	release := make(chan struct{})
+	var searches atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cpes" {
+			// Not a vendor in the CPE dictionary
+			fmt.Fprint(w, `{"totalResults":0,"products":[]}`)
+			return
+		}
+		searches.Add(1)
+		assert.Equal(t, company+" vulnerability", r.URL.Query().Get("keywordSearch"))
+		<-release
+		fmt.Fprint(w, `{"totalResults":2,"vulnerabilities":[
+			{"cve":{"id":"CVE-2024-0002","metrics":{"cvssMetricV31":[{"cvssData":{"baseScore":5.3,"baseSeverity":"MEDIUM"}}]}}},
+			{"cve":{"id":"CVE-2024-0001","metrics":{"cvssMetricV31":[{"cvssData":{"baseScore":9.8,"baseSeverity":"CRITICAL"}}]}}}]}`)
+	}))
+	defer upstream.Close()
+	client, err := cve.NewCVEClient(cve.ClientConfig{BaseURL: upstream.URL, CPEURL: upstream.URL + "/cpes", APIKey: "nvd-key", HTTPClient: upstream.Client()})
+	require.NoError(t, err)
+	breach.SetCVEClient(client)
+	defer breach.SetCVEClient(nil)
+
+	enricher := breach.NewEnricher(breach.DefaultEnrichConfig)
+	breach.SetEnricher(enricher)
+	defer breach.SetEnricher(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go enricher.Run(ctx)
+
+	email := "enrich-" + time.Now().Format("150405.000000") + "@example.com"
+	require.NoError(t, breach.CacheBreachReport(email, &breach.LeakResponse{
+		Email: email, Sources: []string{company}, TotalLeaks: 1, LeakedData: []breach.LeakSource{{Source: company}},
+	}, time.Minute))
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		middleware.SetClaims(c, &auth.Claims{UserID: c.GetHeader("X-User")})
+	})
+	router.POST("/breach/enrich", breach.StartEnrichment)
+	router.GET("/breach/enrich/:job_id", breach.GetEnrichment)
+	serve := func(user, method, path, body string) (int, map[string]interface{}) {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-User", user)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var resp map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+		return w.Code, resp
+	}
+
+	status, started := serve("alice", http.MethodPost, "/breach/enrich", `{"email":"`+email+`"}`)
+	require.Equal(t, http.StatusAccepted, status, started)
+	jobID := started["job_id"].(string)
+	assert.Equal(t, "/api/v1/breach/enrich/"+jobID, started["poll_url"])
+
+	status, joined := serve("bob", http.MethodPost, "/breach/enrich", `{"email":"`+strings.ToUpper(email)+`"}`)
+	require.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, jobID, joined["job_id"], "a running enrichment of the address is joined")
+
+	require.Eventually(t, func() bool {
+		status, polled := serve("alice", http.MethodGet, "/breach/enrich/"+jobID, "")
+		return status == http.StatusAccepted && polled["status"] == breach.EnrichRunning && polled["total"] == float64(1)
+	}, 2*time.Second, 10*time.Millisecond)
+	status, _ = serve("carol", http.MethodGet, "/breach/enrich/"+jobID, "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	close(release)
+	var done breach.EnrichStatus
+	require.Eventually(t, func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/breach/enrich/"+jobID, nil)
+		req.Header.Set("X-User", "bob")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code == http.StatusOK && json.Unmarshal(w.Body.Bytes(), &done) == nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, breach.EnrichDone, done.Status)
+	assert.Equal(t, 100, done.Percent)
+	require.NotNil(t, done.Report)
+	require.Len(t, done.Report.LeakedData, 1)
+	cveData := done.Report.LeakedData[0].CVEData
+	require.NotNil(t, cveData)
+	assert.Equal(t, 2, cveData.TotalCVEs)
+	assert.Equal(t, "CRITICAL", cveData.HighestLevel)
+	assert.Equal(t, "CVE-2024-0001", cveData.TopCVEs[0].ID)
+	assert.Equal(t, breach.MatchKeyword, cveData.MatchMethod)
+	assert.Equal(t, int32(1), searches.Load())
+
+	cached, err := breach.GetCachedBreachReport(email)
+	require.NoError(t, err)
+	assert.NotNil(t, cached.LeakedData[0].CVEData, "the enriched report replaces the cached one")
+}
+
+func TestBreachEnrichmentQueueFull(t *testing.T) {
+	// No workers run: the one queued job fills the queue
+	breach.SetEnricher(breach.NewEnricher(breach.EnrichConfig{MaxQueued: 1}))
+	defer breach.SetEnricher(nil)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/breach/enrich", func(c *gin.Context) {
+		middleware.SetClaims(c, &auth.Claims{UserID: "alice"})
+	}, breach.StartEnrichment)
+	enrich := func(email string) int {
+		req := httptest.NewRequest(http.MethodPost, "/breach/enrich", bytes.NewReader([]byte(`{"email":"`+email+`"}`)))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusAccepted, enrich("first@example.com"))
+	assert.Equal(t, http.StatusAccepted, enrich("first@example.com"))
+	assert.Equal(t, http.StatusTooManyRequests, enrich("second@example.com"))
+}
@@ -0,0 +1,204 @@
+package unit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	apperrors "github.com/deeplyprofound/password-sync/pkg/errors"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEveryErrorCodeHasGuidance(t *testing.T) {
+	codes := apperrors.Codes()
+	require.NotEmpty(t, codes)
+	for _, code := range codes {
+		g, ok := apperrors.GuidanceFor(code)
+		require.True(t, ok, code)
+		if g.Resolution != "" {
+			assert.Contains(t, apperrors.Resolutions, g.Resolution, "code %s", code)
+		}
+		if !g.Retryable {
+			assert.Zero(t, g.RetryAfter, "code %s is not retryable but has a wait", code)
+		}
+	}
+
+	// Every status falls back to a registered code
+	for status := 400; status < 600; status++ {
+		_, ok := apperrors.GuidanceFor(apperrors.StatusCode(status))
+		assert.True(t, ok, "status %d", status)
+	}
+
+	// Every code a handler or service writes is registered
+	literal := regexp.MustCompile(`"code":\s*"([a-z_]+)"`)
+	assigned := regexp.MustCompile(`\bcode\s*:?=\s*"([a-z_]+)"`)
+	serviceErr := regexp.MustCompile(`(?:\bCode:\s*|CodedError\([\w.]+,\s*)"([a-z_]+)"`)
+	found := 0
+	err := filepath.WalkDir("../../server", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, ".go") {
+			return err
+		}
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, re := range []*regexp.Regexp{literal, assigned, serviceErr} {
+			for _, match := range re.FindAllStringSubmatch(string(src), -1) {
+				found++
+				assert.True(t, slices.Contains(codes, match[1]), "%s returns unregistered code %q", path, match[1])
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Greater(t, found, 10, "the scan found the handlers' codes")
+}
+
+func TestCodeForSentinels(t *testing.T) {
+	tests := []struct {
+		err  error
+		code string
+	}{
+		{apperrors.ErrGenCountStale, apperrors.CodeGenCountStale},
+		{fmt.Errorf("push: %w", apperrors.ErrSyncConflict), apperrors.CodeConflict},
+		{apperrors.ErrTokenExpired, apperrors.CodeUnauthorized},
+		{apperrors.ErrRateLimited, apperrors.CodeRateLimited},
+		{apperrors.ErrQuotaExceeded, apperrors.CodeQuotaExceeded},
+		{apperrors.ErrCiphertextTooLarge, apperrors.CodePayloadTooLarge},
+		{apperrors.NewAppError("legal_hold", "on hold", nil), "legal_hold"},
+		{fmt.Errorf("something else"), ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.code, apperrors.CodeFor(tt.err), tt.err.Error())
+	}
+}
+
+func envelopeRouter(handler gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.ErrorEnvelope())
+	router.GET("/", handler)
+	return router
+}
+
+func envelopeOf(t *testing.T, handler gin.HandlerFunc) (*httptest.ResponseRecorder, *apperrors.APIError) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	envelopeRouter(handler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	apiErr := apperrors.ReadAPIError(w.Result())
+	return w, apiErr
+}
+
+func TestErrorEnvelopeGuidance(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    gin.HandlerFunc
+		status     int
+		code       string
+		retryable  bool
+		retryAfter time.Duration
+		resolution apperrors.Resolution
+	}{
+		{
+			name: "unauthorized from status",
+			handler: func(c *gin.Context) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "token expired"})
+			},
+			status: 401, code: "unauthorized", resolution: apperrors.ResolutionReauthenticate,
+		},
+		{
+			name: "stale gencount from the attached error",
+			handler: func(c *gin.Context) {
+				c.Error(fmt.Errorf("push: %w", apperrors.ErrGenCountStale))
+				c.JSON(http.StatusConflict, gin.H{"error": "gencount is stale"})
+			},
+			status: 409, code: "gencount_stale", resolution: apperrors.ResolutionPullFirst,
+		},
+		{
+			name: "handler code wins over the status",
+			handler: func(c *gin.Context) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "account is on legal hold", "code": "legal_hold"})
+			},
+			status: 403, code: "legal_hold", resolution: apperrors.ResolutionContactSupport,
+		},
+		{
+			name: "rate limit honours Retry-After",
+			handler: func(c *gin.Context) {
+				c.Header("Retry-After", "30")
+				c.JSON(http.StatusTooManyRequests, gin.H{"error": "slow down"})
+			},
+			status: 429, code: "rate_limited", retryable: true, retryAfter: 30 * time.Second,
+		},
+		{
+			name: "quota is final",
+			handler: func(c *gin.Context) {
+				c.Error(apperrors.ErrQuotaExceeded)
+				c.AbortWithStatus(http.StatusForbidden)
+			},
+			status: 403, code: "quota_exceeded", resolution: apperrors.ResolutionContactSupport,
+		},
+		{
+			name: "unavailable gets the default wait",
+			handler: func(c *gin.Context) {
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "failed to verify account"})
+			},
+			status: 503, code: "unavailable", retryable: true, retryAfter: time.Second,
+		},
+		{
+			name: "unregistered code falls back to the status",
+			handler: func(c *gin.Context) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "nope", "code": "made_up"})
+			},
+			status: 400, code: "invalid_request",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, apiErr := envelopeOf(t, tt.handler)
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, tt.code, apiErr.Code)
+			assert.Equal(t, tt.retryable, apiErr.Retryable)
+			assert.Equal(t, tt.retryAfter, apiErr.RetryAfter())
+			assert.Equal(t, tt.resolution, apiErr.Resolution)
+			assert.NotEmpty(t, apiErr.Message)
+			if tt.retryAfter > 0 {
+				assert.Equal(t, fmt.Sprint(int(tt.retryAfter.Seconds())), w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestErrorEnvelopeKeepsOtherResponses(t *testing.T) {
+	// Extra fields of an error survive
+	w, apiErr := envelopeOf(t, func(c *gin.Context) {
+		c.JSON(http.StatusConflict, gin.H{"error": "zone changed", "code": "checkpoint_stale", "restart_from": 42})
+	})
+	var body map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, float64(42), body["restart_from"])
+	assert.Equal(t, apperrors.ResolutionPullFirst, apiErr.Resolution)
+
+	// Successes and non-JSON errors are untouched
+	w, _ = envelopeOf(t, func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"gencount": 7})
+	})
+	assert.JSONEq(t, `{"gencount":7}`, w.Body.String())
+
+	w, _ = envelopeOf(t, func(c *gin.Context) {
+		c.String(http.StatusNotFound, "no such page")
+	})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "no such page", w.Body.String())
+}
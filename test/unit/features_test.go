@@ -0,0 +1,139 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/breach"
+	"github.com/deeplyprofound/password-sync/server/api/handlers"
+	"github.com/deeplyprofound/password-sync/server/features"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveFeatures(t *testing.T) {
+	t.Run("without redis everything runs in memory", func(t *testing.T) {
+		feats := features.Resolve(false)
+		assert.Equal(t, features.ModeSingleBinary, feats.Mode())
+		require.Len(t, feats.Degraded(), len(feats.All()))
+		for _, capability := range feats.All() {
+			assert.Equal(t, features.BackendMemory, capability.Backend, capability.Name)
+			assert.NotEmpty(t, capability.Caveat, "%s documents its durability caveat", capability.Name)
+		}
+	})
+
+	t.Run("with redis nothing is degraded", func(t *testing.T) {
+		feats := features.Resolve(true)
+		assert.Equal(t, features.ModeRedis, feats.Mode())
+		assert.Empty(t, feats.Degraded())
+		assert.Empty(t, feats.Get(features.BreachCache).Caveat)
+	})
+
+	t.Run("one capability falling back", func(t *testing.T) {
+		feats := features.Resolve(true)
+		feats.Fallback(features.EngineInvalidation)
+		assert.Equal(t, features.ModeDegraded, feats.Mode())
+		require.Len(t, feats.Degraded(), 1)
+		assert.Equal(t, features.EngineInvalidation, feats.Degraded()[0].Name)
+		assert.False(t, feats.Get(features.ProfileCache).Degraded())
+	})
+}
+
+func TestHealthReportsDegradedCapabilities(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	health := func(feats *features.Features) map[string]interface{} {
+		router := gin.New()
+		router.GET("/health", handlers.Health(feats))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+		require.Equal(t, http.StatusOK, recorder.Code, "a degraded server is still healthy")
+
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+		return body
+	}
+
+	body := health(features.Resolve(false))
+	assert.Equal(t, "ok", body["status"])
+	assert.Equal(t, features.ModeSingleBinary, body["backend_mode"])
+	assert.ElementsMatch(t, []interface{}{
+		features.BreachCache, features.ProfileCache, features.EngineInvalidation, features.EventLog, features.AuthRateLimit,
+	}, body["degraded"])
+	assert.Len(t, body["capabilities"], 5)
+
+	body = health(features.Resolve(true))
+	assert.Equal(t, features.ModeRedis, body["backend_mode"])
+	assert.Equal(t, []interface{}{}, body["degraded"], "an empty list, not null")
+}
+
+func TestHealthPingsDependencies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	health := func(deps ...handlers.Dependency) (int, map[string]interface{}) {
+		router := gin.New()
+		router.GET("/health", handlers.Health(features.Resolve(false), deps...))
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+		return recorder.Code, body
+	}
+	up := func(context.Context) error { return nil }
+	down := func(context.Context) error { return errors.New("dial tcp db.internal:5432: connection refused") }
+
+	status, body := health(handlers.Dependency{Name: "database", Ping: storage.NewMemoryStore().Ping})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ok", body["status"])
+	assert.Equal(t, map[string]interface{}{"database": "ok"}, body["dependencies"])
+
+	status, body = health(
+		handlers.Dependency{Name: "database", Ping: down},
+		handlers.Dependency{Name: "redis", Ping: up},
+	)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "unavailable", body["status"])
+	assert.Equal(t, map[string]interface{}{"database": "down", "redis": "ok"}, body["dependencies"])
+	assert.NotContains(t, fmt.Sprint(body), "db.internal", "the error stays in the log")
+}
+
+// The unit tests never call breach.InitRedis, so this is the single-binary
+// path: reports are cached in memory instead of not at all
+func TestBreachCacheWithoutRedis(t *testing.T) {
+	require.Nil(t, breach.RedisClient())
+
+	email := "single-binary@example.com"
+	cached, err := breach.GetCachedBreachReport(email)
+	require.NoError(t, err)
+	assert.Nil(t, cached, "miss")
+
+	report := &breach.LeakResponse{Email: email}
+	require.NoError(t, breach.CacheBreachReport(email, report, time.Hour))
+	cached, err = breach.GetCachedBreachReport(email)
+	require.NoError(t, err)
+	require.NotNil(t, cached)
+	assert.Equal(t, email, cached.Email)
+
+	require.NoError(t, breach.InvalidateBreachCache(email))
+	cached, err = breach.GetCachedBreachReport(email)
+	require.NoError(t, err)
+	assert.Nil(t, cached)
+
+	require.NoError(t, breach.CacheBreachReport(email, report, time.Millisecond))
+	time.Sleep(5 * time.Millisecond)
+	cached, err = breach.GetCachedBreachReport(email)
+	require.NoError(t, err)
+	assert.Nil(t, cached, "expired")
+
+	require.NoError(t, breach.CacheCompanyCVE("acme", &breach.CompanyCVEData{}, time.Hour))
+	cve, err := breach.GetCachedCompanyCVE("acme")
+	require.NoError(t, err)
+	assert.NotNil(t, cve)
+}
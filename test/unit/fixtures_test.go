@@ -0,0 +1,104 @@
+package unit
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/pkg/importers"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/domain/crypto"
+	"github.com/deeplyprofound/password-sync/server/fixtures"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const fixtureVaultPassword = "password123"
+
+func generateFixtures(t *testing.T, opts fixtures.Options) []*fixtures.User {
+	t.Helper()
+	users, err := fixtures.Generate(opts, func(salt []byte) (fixtures.Encryptor, error) {
+		return crypto.NewLayeredCrypto(fixtureVaultPassword, salt)
+	})
+	require.NoError(t, err)
+	return users
+}
+
+func TestFixturesDecryptAndValidate(t *testing.T) {
+	users := generateFixtures(t, fixtures.Options{
+		Users: 2, Email: "dev@example.com", Zones: []string{"default", "work"},
+		Keys: 2, Credentials: 3, Records: 4, Seed: 7,
+	})
+	require.Len(t, users, 2)
+	assert.Equal(t, "dev@example.com", users[0].Email)
+	assert.Equal(t, "dev+1@example.com", users[1].Email)
+
+	for _, user := range users {
+		lc, err := crypto.NewLayeredCrypto(fixtureVaultPassword, user.VaultSalt)
+		require.NoError(t, err)
+		userID := uuid.NewString()
+
+		require.Len(t, user.Zones, 2)
+		for _, zone := range user.Zones {
+			assert.Equal(t, 9, zone.Items())
+			keyIDs := map[string]bool{}
+			for _, dto := range zone.Keys {
+				_, err := mapping.ToCryptoKey(dto, userID, zone.Name, 1)
+				require.NoError(t, err)
+				_, err = lc.UnwrapKey(dto.Data)
+				require.NoError(t, err, "key material is wrapped under the vault key")
+				keyIDs[dto.ItemUUID] = true
+			}
+			for _, dto := range zone.Credentials {
+				_, err := mapping.ToCredentialMetadata(dto, userID, zone.Name, 1)
+				require.NoError(t, err)
+				assert.True(t, keyIDs[dto.PasswordKeyUUID])
+			}
+			for i, dto := range zone.Records {
+				_, err := mapping.ToSyncRecord(dto, userID, zone.Name, 1)
+				require.NoError(t, err)
+				assert.True(t, keyIDs[*dto.ParentKeyUUID])
+
+				plaintext, err := lc.DecryptCredential(dto.WrappedKey, dto.EncItem)
+				require.NoError(t, err)
+				var cred importers.PlainCredential
+				require.NoError(t, json.Unmarshal(plaintext, &cred))
+				assert.Equal(t, zone.Plaintext[i], cred)
+				assert.Equal(t, zone.Name, cred.Collection)
+				assert.NotEmpty(t, cred.Password)
+			}
+		}
+	}
+}
+
+func TestFixturesAreDeterministic(t *testing.T) {
+	opts := fixtures.Options{Users: 3, Email: "dev@example.com", Zones: []string{"default"}, Keys: 1, Credentials: 2, Records: 2, Seed: 42}
+	first, second := generateFixtures(t, opts), generateFixtures(t, opts)
+
+	for i := range first {
+		assert.Equal(t, first[i].Email, second[i].Email)
+		assert.Equal(t, first[i].VaultSalt, second[i].VaultSalt)
+		a, b := first[i].Zones[0], second[i].Zones[0]
+		assert.Equal(t, a.Plaintext, b.Plaintext)
+		assert.Equal(t, a.Credentials, b.Credentials)
+		for j := range a.Keys {
+			assert.Equal(t, a.Keys[j].ItemUUID, b.Keys[j].ItemUUID)
+		}
+		for j := range a.Records {
+			assert.Equal(t, a.Records[j].ItemUUID, b.Records[j].ItemUUID)
+		}
+	}
+
+	opts.Seed = 43
+	other := generateFixtures(t, opts)
+	assert.NotEqual(t, first[0].VaultSalt, other[0].VaultSalt)
+	assert.NotEqual(t, first[0].Zones[0].Keys[0].ItemUUID, other[0].Zones[0].Keys[0].ItemUUID)
+}
+
+func TestFixturesNeedKeys(t *testing.T) {
+	_, err := fixtures.Generate(fixtures.Options{Users: 1, Email: "dev@example.com", Zones: []string{"default"}, Records: 1},
+		func(salt []byte) (fixtures.Encryptor, error) {
+			return crypto.NewLayeredCrypto(fixtureVaultPassword, salt)
+		})
+	assert.ErrorIs(t, err, fixtures.ErrNoKeys)
+}
@@ -0,0 +1,325 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/breach"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingLookup answers every email with an empty report and remembers
+// the order it was asked in. The first `failures` calls get a 429.
+type recordingLookup struct {
+	mu       sync.Mutex
+	emails   []string
+	failures int
+}
+
+func (l *recordingLookup) lookup(ctx context.Context, email string) (*breach.LeakResponse, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.emails = append(l.emails, email)
+	if l.failures > 0 {
+		l.failures--
+		return nil, &breach.RateLimitedError{RetryAfter: 20 * time.Millisecond}
+	}
+	return &breach.LeakResponse{Email: email, Sources: []string{}, LeakedData: []breach.LeakSource{}}, nil
+}
+
+func (l *recordingLookup) calls() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.emails...)
+}
+
+func hibpConfig(ratePerMinute int) breach.SchedulerConfig {
+	cfg := breach.DefaultSchedulerConfig
+	cfg.RatePerMinute = ratePerMinute
+	cfg.MaxQueuedPerUser = 3
+	return cfg
+}
+
+func waitJob(t *testing.T, job *breach.Job) {
+	t.Helper()
+	select {
+	case <-job.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("job %s did not finish", job.Email)
+	}
+}
+
+func TestHIBPSchedulerOrder(t *testing.T) {
+	s := breach.NewScheduler(hibpConfig(60), (&recordingLookup{}).lookup)
+	s.SetClock(&fakeClock{now: time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)})
+
+	monitor, err := s.Submit("carol", "carol@example.com", breach.PriorityBackground)
+	require.NoError(t, err)
+	var alice []*breach.Job
+	for _, email := range []string{"a1@example.com", "a2@example.com", "a3@example.com"} {
+		job, err := s.Submit("alice", email, breach.PriorityInteractive)
+		require.NoError(t, err)
+		alice = append(alice, job)
+	}
+	bob, err := s.Submit("bob", "bob@example.com", breach.PriorityInteractive)
+	require.NoError(t, err)
+
+	// Interactive checks first, users taking turns, background last
+	for want, job := range []*breach.Job{alice[0], bob, alice[1], alice[2], monitor} {
+		status := s.Status(job)
+		assert.Equal(t, want, status.Position, job.Email)
+		// One request is available now, then one a second
+		assert.Equal(t, time.Duration(want)*time.Second, status.EstimatedWait, job.Email)
+	}
+
+	// The same check again is the same job; a fourth one is over the cap
+	again, err := s.Submit("alice", "a2@example.com", breach.PriorityInteractive)
+	require.NoError(t, err)
+	assert.Same(t, alice[1], again)
+	_, err = s.Submit("alice", "a4@example.com", breach.PriorityInteractive)
+	assert.ErrorIs(t, err, breach.ErrQueueFull)
+
+	// Jobs are private to their user
+	_, err = s.Job("bob", alice[0].ID)
+	assert.ErrorIs(t, err, breach.ErrJobNotFound)
+	found, err := s.Job("alice", alice[0].ID)
+	require.NoError(t, err)
+	assert.Same(t, alice[0], found)
+}
+
+func TestHIBPSchedulerRunsAtPlanRate(t *testing.T) {
+	lookup := &recordingLookup{}
+	s := breach.NewScheduler(hibpConfig(1200), lookup.lookup) // One request per 50ms
+
+	var jobs []*breach.Job
+	for _, user := range []string{"alice", "alice", "bob"} {
+		job, err := s.Submit(user, user+time.Now().Format("150405.000000")+"@example.com", breach.PriorityInteractive)
+		require.NoError(t, err)
+		jobs = append(jobs, job)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := time.Now()
+	go s.Run(ctx)
+	for _, job := range jobs {
+		waitJob(t, job)
+	}
+
+	assert.GreaterOrEqual(t, time.Since(started), 100*time.Millisecond, "three requests take two intervals")
+	assert.Equal(t, []string{jobs[0].Email, jobs[2].Email, jobs[1].Email}, lookup.calls(), "bob goes between alice's checks")
+}
+
+func TestHIBPSchedulerRetriesUpstream429(t *testing.T) {
+	lookup := &recordingLookup{failures: 1}
+	s := breach.NewScheduler(hibpConfig(6000), lookup.lookup)
+	before := metrics.Value(breach.MetricHIBPUpstream429)
+
+	job, err := s.Submit("alice", "retry@example.com", breach.PriorityInteractive)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	waitJob(t, job)
+
+	report, err := job.Result()
+	require.NoError(t, err, "the 429 is not the caller's problem")
+	assert.Equal(t, "retry@example.com", report.Email)
+	assert.Len(t, lookup.calls(), 2)
+	assert.Equal(t, before+1, metrics.Value(breach.MetricHIBPUpstream429))
+}
+
+func TestBreachCheckQueuedAnswers202(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := hibpConfig(6000)
+	cfg.InteractiveWait = 20 * time.Millisecond
+	s := breach.NewScheduler(cfg, (&recordingLookup{}).lookup)
+	breach.SetScheduler(s)
+	defer breach.SetScheduler(nil)
+
+	router := gin.New()
+	asUser := func(userID string) gin.HandlerFunc {
+		return func(c *gin.Context) { middleware.SetClaims(c, &auth.Claims{UserID: userID}) }
+	}
+	router.POST("/breach/check", asUser("alice"), breach.CheckEmail)
+	router.GET("/breach/checks/:id", asUser("alice"), breach.GetCheck)
+	router.GET("/other/checks/:id", asUser("bob"), breach.GetCheck)
+	serve := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Nothing runs the queue yet: the check can't finish in time
+	email := "queued-" + time.Now().Format("150405.000000") + "@example.com"
+	w := serve(http.MethodPost, "/breach/check", []byte(`{"email":"`+email+`"}`))
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	var queued struct {
+		Status   string `json:"status"`
+		JobID    string `json:"job_id"`
+		Position int    `json:"position"`
+		PollURL  string `json:"poll_url"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &queued))
+	assert.Equal(t, "queued", queued.Status)
+	assert.Equal(t, 0, queued.Position)
+	assert.Equal(t, "/api/v1/breach/checks/"+queued.JobID, queued.PollURL)
+
+	assert.Equal(t, http.StatusAccepted, serve(http.MethodGet, "/breach/checks/"+queued.JobID, nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/other/checks/"+queued.JobID, nil).Code)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	job, err := s.Job("alice", queued.JobID)
+	require.NoError(t, err)
+	waitJob(t, job)
+
+	w = serve(http.MethodGet, "/breach/checks/"+queued.JobID, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var report breach.LeakResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, email, report.Email)
+}
+
+// Addresses typed differently share one cached report and one HIBP call
+func TestBreachCheckNormalizesEmail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	lookups := &recordingLookup{}
+	s := breach.NewScheduler(hibpConfig(6000), func(ctx context.Context, email string) (*breach.LeakResponse, error) {
+		report, err := lookups.lookup(ctx, email)
+		if err == nil {
+			err = breach.CacheBreachReport(email, report, time.Minute)
+		}
+		return report, err
+	})
+	breach.SetScheduler(s)
+	defer breach.SetScheduler(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	router := gin.New()
+	router.POST("/breach/check", func(c *gin.Context) {
+		middleware.SetClaims(c, &auth.Claims{UserID: "alice"})
+	}, breach.CheckEmail)
+	email := "Mixed-" + time.Now().Format("150405.000000") + "@Example.com"
+	for _, typed := range []string{email, strings.ToLower(email)} {
+		req := httptest.NewRequest(http.MethodPost, "/breach/check", bytes.NewReader([]byte(`{"email":"`+typed+`"}`)))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var report breach.LeakResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		assert.Equal(t, strings.ToLower(email), report.Email)
+	}
+	assert.Equal(t, []string{strings.ToLower(email)}, lookups.calls())
+}
+
+// A batch answers every address: from the cache, the queue, or with its
+// error, one failure leaving the others alone
+func TestBreachCheckBatch(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	suffix := time.Now().Format("150405.000000") + "@example.com"
+	cached, found, broken := "cached-"+suffix, "found-"+suffix, "broken-"+suffix
+	require.NoError(t, breach.CacheBreachReport(cached, &breach.LeakResponse{Email: cached, TotalLeaks: 2}, time.Minute))
+
+	lookups := &recordingLookup{}
+	cfg := hibpConfig(6000)
+	s := breach.NewScheduler(cfg, func(ctx context.Context, email string) (*breach.LeakResponse, error) {
+		if email == broken {
+			lookups.lookup(ctx, email)
+			return nil, errors.New("HIBP API returned status 503")
+		}
+		return lookups.lookup(ctx, email)
+	})
+	breach.SetScheduler(s)
+	defer breach.SetScheduler(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+
+	router := gin.New()
+	router.POST("/breach/check-batch", func(c *gin.Context) {
+		middleware.SetClaims(c, &auth.Claims{UserID: "alice"})
+	}, breach.CheckBatch)
+	check := func(emails []string, status int) breach.CheckBatchResponse {
+		t.Helper()
+		body, _ := json.Marshal(map[string][]string{"emails": emails})
+		req := httptest.NewRequest(http.MethodPost, "/breach/check-batch", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, status, w.Code, w.Body.String())
+		var resp breach.CheckBatchResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+
+	resp := check([]string{cached, found, strings.ToUpper(found), broken}, http.StatusOK)
+	require.Len(t, resp.Results, 2)
+	assert.Equal(t, 2, resp.Results[cached].TotalLeaks)
+	assert.Equal(t, found, resp.Results[found].Email)
+	assert.Empty(t, resp.Queued)
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, "lookup_failed", resp.Errors[broken].Code)
+	assert.ElementsMatch(t, []string{found, broken}, lookups.calls(), "one lookup per address, none for the cached one")
+
+	breach.SetBatchConfig(breach.BatchConfig{MaxEmails: 2})
+	defer breach.SetBatchConfig(breach.DefaultBatchConfig)
+	check([]string{cached, found, broken}, http.StatusBadRequest)
+	check([]string{"not an email"}, http.StatusBadRequest)
+}
+
+// Lookups still queued after the interactive wait come back as jobs to
+// poll; past the user's queue cap they are rate limited
+func TestBreachCheckBatchQueued(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := hibpConfig(6000)
+	cfg.MaxQueuedPerUser = 2
+	cfg.InteractiveWait = 20 * time.Millisecond
+	// Nothing runs the queue
+	breach.SetScheduler(breach.NewScheduler(cfg, (&recordingLookup{}).lookup))
+	defer breach.SetScheduler(nil)
+
+	router := gin.New()
+	router.POST("/breach/check-batch", func(c *gin.Context) {
+		middleware.SetClaims(c, &auth.Claims{UserID: "alice"})
+	}, breach.CheckBatch)
+	suffix := time.Now().Format("150405.000000") + "@example.com"
+	body, _ := json.Marshal(map[string][]string{"emails": {"a-" + suffix, "b-" + suffix, "c-" + suffix}})
+	req := httptest.NewRequest(http.MethodPost, "/breach/check-batch", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp breach.CheckBatchResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Empty(t, resp.Results)
+	require.Len(t, resp.Queued, 2)
+	for _, queued := range resp.Queued {
+		assert.Equal(t, "/api/v1/breach/checks/"+queued.JobID, queued.PollURL)
+	}
+	require.Len(t, resp.Errors, 1)
+	for _, failed := range resp.Errors {
+		assert.Equal(t, "rate_limited", failed.Code)
+	}
+}
@@ -0,0 +1,159 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	gorilla "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialHubClient connects a client of alice's "default" zone to the hub and
+// returns both ends once it is registered
+func dialHubClient(t *testing.T, hub *websocket.Hub) (*websocket.Client, *gorilla.Conn) {
+	t.Helper()
+	clients := make(chan *websocket.Client, 1)
+	upgrader := gorilla.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := &websocket.Client{Hub: hub, Conn: conn, Send: make(chan []byte, 16), UserID: "alice", Zone: "default"}
+		hub.Register <- client
+		go client.WritePump()
+		go client.ReadPump()
+		clients <- client
+	}))
+	t.Cleanup(server.Close)
+
+	conn := dialLive(t, "ws"+strings.TrimPrefix(server.URL, "http"))
+	return <-clients, conn
+}
+
+func assertCloseCode(t *testing.T, conn *gorilla.Conn, code int) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *gorilla.CloseError
+		require.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, code, closeErr.Code)
+		return
+	}
+}
+
+func TestHubSubscribeRejectsInvalidZoneName(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond})
+	client, conn := dialHubClient(t, hub)
+	rejected := metrics.Value(websocket.MetricZoneRejected)
+
+	err := hub.Subscribe(client, strings.Repeat("z", 101))
+	assert.ErrorIs(t, err, sync.ErrInvalidZoneName)
+	assertCloseCode(t, conn, websocket.CloseInvalidZone.Code)
+	assert.Equal(t, rejected+1, metrics.Value(websocket.MetricZoneRejected))
+}
+
+func TestHubSubscribeLimitsZonesPerClient(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond, MaxZonesPerClient: 3})
+	client, conn := dialHubClient(t, hub)
+	rejected := metrics.Value(websocket.MetricZoneRejected)
+
+	require.NoError(t, hub.Subscribe(client, "work"))
+	require.NoError(t, hub.Subscribe(client, "home"))
+	require.NoError(t, hub.Subscribe(client, "work"), "subscribing again takes no extra slot")
+	require.NoError(t, hub.Subscribe(client, "default"), "neither does the connection's own zone")
+
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "travel", 1)))
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "work", 2)))
+	assert.Equal(t, "work", readEvent(t, conn).Zone, "travel is not subscribed")
+
+	assert.ErrorIs(t, hub.Subscribe(client, "travel"), websocket.ErrTooManyZones)
+	assertCloseCode(t, conn, websocket.CloseTooManyZones.Code)
+	assert.Equal(t, rejected+1, metrics.Value(websocket.MetricZoneRejected))
+}
+
+func TestHubSubscribeToAllZones(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond, MaxZonesPerClient: 2})
+	client, conn := dialHubClient(t, hub)
+
+	require.NoError(t, hub.Subscribe(client, sync.AllZones))
+	require.NoError(t, hub.Subscribe(client, "travel"), "every zone is subscribed already")
+
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "travel", 1)))
+	assert.Equal(t, "travel", readEvent(t, conn).Zone)
+	assert.ErrorIs(t, sync.ValidateZoneName(sync.AllZones), sync.ErrInvalidZoneName, "no zone can be named *")
+}
+
+func TestHubDowngradesOversizedEvents(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond, MaxEventSize: 300})
+	client := connectClient(hub, "alice", 16)
+	downgraded := metrics.Value(websocket.MetricEventsDowngraded)
+
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", 1)))
+	assert.Equal(t, "credentials_changed", receiveEvent(t, client).Type, "small events are untouched")
+
+	big := &websocket.SyncEvent{Type: "breach_check_complete", UserID: "alice", Zone: "work", GenCount: 7, JobID: strings.Repeat("j", 400)}
+	require.NoError(t, hub.BroadcastSyncEvent(big))
+	event := receiveEvent(t, client)
+	assert.Equal(t, websocket.EventPullRequired, event.Type)
+	assert.Equal(t, "work", event.Zone)
+	assert.Equal(t, int64(7), event.GenCount)
+	assert.Empty(t, event.JobID)
+	assert.Equal(t, downgraded+1, metrics.Value(websocket.MetricEventsDowngraded))
+}
+
+func TestWebSocketReplayDowngradesOversizedEvents(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond, MaxEventSize: 300})
+	hub.SetEventLog(websocket.NewMemoryEventLog(10))
+	url := liveServer(t, hub)
+
+	big := changed("alice", "default", 3)
+	big.JobID = strings.Repeat("j", 400)
+	require.NoError(t, hub.BroadcastSyncEvent(big))
+
+	event := readEvent(t, dialLive(t, url+"?last_seq=0"))
+	assert.Equal(t, websocket.EventPullRequired, event.Type)
+	assert.Equal(t, int64(1), event.Seq, "still resumable from")
+	assert.Equal(t, int64(3), event.GenCount)
+}
+
+func TestWebSocketReadLimit(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{ReadLimit: 64})
+	conn := dialLive(t, liveServer(t, hub))
+	exceeded := metrics.Value(websocket.MetricReadLimitExceeded)
+
+	require.NoError(t, conn.WriteMessage(gorilla.TextMessage, []byte(`{"type":"ping"}`)))
+	require.NoError(t, conn.WriteMessage(gorilla.TextMessage, []byte(strings.Repeat("x", 1024))))
+	assertCloseCode(t, conn, gorilla.CloseMessageTooBig)
+
+	require.Eventually(t, func() bool {
+		return metrics.Value(websocket.MetricReadLimitExceeded) == exceeded+1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestWebSocketRejectsInvalidZone(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{})
+	url := "http" + strings.TrimPrefix(liveServer(t, hub), "ws")
+
+	for _, query := range []string{"?zone=", "?zone=" + strings.Repeat("z", 101)} {
+		resp, err := http.Get(url + query)
+		require.NoError(t, err)
+		var body struct{ Code string }
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+		assert.Equal(t, "invalid_zone", body.Code, "refused before upgrading")
+	}
+}
@@ -0,0 +1,125 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	gorilla "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHubClientSubscribeMessage(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond})
+	_, conn := dialHubClient(t, hub)
+
+	require.NoError(t, conn.WriteJSON(websocket.ClientMessage{Type: websocket.MessageSubscribe, Zone: "work"}))
+	reply := readEvent(t, conn)
+	assert.Equal(t, websocket.EventSubscribed, reply.Type)
+	assert.Equal(t, "work", reply.Zone)
+
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "work", 3)))
+	assert.Equal(t, "work", readEvent(t, conn).Zone)
+}
+
+func TestHubClientSubscribeMessageDenied(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond})
+	hub.SetAuthorizer(func(userID, deviceID, zone string) error {
+		if zone == "work" {
+			return websocket.ErrClientRevoked
+		}
+		return nil
+	})
+	_, conn := dialHubClient(t, hub)
+
+	require.NoError(t, conn.WriteJSON(websocket.ClientMessage{Type: websocket.MessageSubscribe, Zone: "work"}))
+	assertCloseCode(t, conn, websocket.CloseRevoked.Code)
+}
+
+func TestHubClientManifestRequest(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond})
+	_, conn := dialHubClient(t, hub)
+
+	// Without a reader
+	require.NoError(t, conn.WriteJSON(websocket.ClientMessage{Type: websocket.MessageManifestRequest}))
+	reply := readEvent(t, conn)
+	assert.Equal(t, websocket.EventError, reply.Type)
+	assert.Equal(t, "unavailable", reply.Code)
+
+	hub.SetManifestReader(func(ctx context.Context, userID, deviceID, zone string) (int64, []byte, error) {
+		switch zone {
+		case "default":
+			return 12, []byte{0xab, 0xcd}, nil
+		case "locked":
+			return 0, nil, &websocket.MessageError{Code: "device_revoked", Message: "device has been revoked"}
+		}
+		return 0, nil, errors.New("connection refused")
+	})
+
+	// The connection's zone unless the message names one
+	require.NoError(t, conn.WriteJSON(websocket.ClientMessage{Type: websocket.MessageManifestRequest}))
+	reply = readEvent(t, conn)
+	assert.Equal(t, websocket.EventManifest, reply.Type)
+	assert.Equal(t, "default", reply.Zone)
+	assert.Equal(t, int64(12), reply.GenCount)
+	assert.Equal(t, []byte{0xab, 0xcd}, reply.Digest)
+
+	require.NoError(t, conn.WriteJSON(websocket.ClientMessage{Type: websocket.MessageManifestRequest, Zone: "locked"}))
+	reply = readEvent(t, conn)
+	assert.Equal(t, websocket.EventError, reply.Type)
+	assert.Equal(t, "device_revoked", reply.Code)
+	assert.Equal(t, "device has been revoked", reply.Error)
+
+	require.NoError(t, conn.WriteJSON(websocket.ClientMessage{Type: websocket.MessageManifestRequest, Zone: "work"}))
+	reply = readEvent(t, conn)
+	assert.Equal(t, "internal", reply.Code)
+	assert.NotContains(t, reply.Error, "connection refused")
+}
+
+func TestHubClientAckTracksCaughtUpClients(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond})
+	_, conn := dialHubClient(t, hub)
+	connectDevice(hub, "alice", "device-b", "default")
+
+	require.Eventually(t, func() bool {
+		_, connected := hub.CaughtUp("alice", "default", 1)
+		return connected == 2
+	}, 2*time.Second, 5*time.Millisecond)
+
+	require.NoError(t, conn.WriteJSON(websocket.ClientMessage{Type: websocket.MessageAck, GenCount: 7}))
+	assert.Eventually(t, func() bool {
+		caughtUp, _ := hub.CaughtUp("alice", "default", 7)
+		return caughtUp == 1
+	}, 2*time.Second, 5*time.Millisecond)
+
+	// An older ack doesn't move it back
+	require.NoError(t, conn.WriteJSON(websocket.ClientMessage{Type: websocket.MessageAck, GenCount: 3}))
+	require.NoError(t, conn.WriteJSON(websocket.ClientMessage{Type: websocket.MessageAck, GenCount: -1}))
+	assert.Equal(t, "invalid_message", readEvent(t, conn).Code)
+	caughtUp, connected := hub.CaughtUp("alice", "default", 7)
+	assert.Equal(t, 1, caughtUp)
+	assert.Equal(t, 2, connected)
+}
+
+func TestHubClientMessageErrors(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond})
+	_, conn := dialHubClient(t, hub)
+
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "resync_please"}))
+	reply := readEvent(t, conn)
+	assert.Equal(t, websocket.EventError, reply.Type)
+	assert.Equal(t, "unknown_message_type", reply.Code)
+
+	require.NoError(t, conn.WriteMessage(gorilla.TextMessage, []byte("not json")))
+	assert.Equal(t, "invalid_message", readEvent(t, conn).Code)
+
+	require.NoError(t, conn.WriteJSON(websocket.ClientMessage{Type: websocket.MessageAck, Zone: "*", GenCount: 1}))
+	assert.Equal(t, "invalid_zone", readEvent(t, conn).Code)
+
+	// The connection stays open
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", 1)))
+	assert.Equal(t, "credentials_changed", readEvent(t, conn).Type)
+}
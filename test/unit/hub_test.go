@@ -0,0 +1,605 @@
+package unit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	gorilla "github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+)
+
+func startHub(t *testing.T, opts websocket.HubOptions) *websocket.Hub {
+	hub := websocket.NewHubWithOptions(opts)
+	go hub.Run()
+	t.Cleanup(hub.Stop)
+	return hub
+}
+
+func connectClient(hub *websocket.Hub, userID string, buffer int) *websocket.Client {
+	client := &websocket.Client{Hub: hub, Send: make(chan []byte, buffer), UserID: userID}
+	hub.Register <- client
+	return client
+}
+
+func receiveEvent(t *testing.T, client *websocket.Client) *websocket.SyncEvent {
+	t.Helper()
+	select {
+	case message, ok := <-client.Send:
+		require.True(t, ok, "send channel closed")
+		var event websocket.SyncEvent
+		require.NoError(t, json.Unmarshal(message, &event))
+		return &event
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event received")
+		return nil
+	}
+}
+
+func connectDevice(hub *websocket.Hub, userID, deviceID, zone string) *websocket.Client {
+	client := &websocket.Client{Hub: hub, Send: make(chan []byte, 16), UserID: userID, DeviceID: deviceID, Zone: zone}
+	hub.Register <- client
+	return client
+}
+
+// assertClosed drains anything already queued and fails on an event that
+// arrives after the channel should have been closed
+func assertClosed(t *testing.T, client *websocket.Client) {
+	t.Helper()
+	select {
+	case message, ok := <-client.Send:
+		assert.False(t, ok, "unexpected message %s", message)
+	case <-time.After(time.Second):
+		t.Fatal("send channel not closed")
+	}
+}
+
+func assertNoEvent(t *testing.T, client *websocket.Client, wait time.Duration) {
+	t.Helper()
+	select {
+	case message := <-client.Send:
+		t.Fatalf("unexpected message %s", message)
+	case <-time.After(wait):
+	}
+}
+
+func changed(userID, zone string, genCount int64) *websocket.SyncEvent {
+	return &websocket.SyncEvent{Type: "credentials_changed", UserID: userID, Zone: zone, GenCount: genCount}
+}
+
+func TestHubCoalescesEventsWithinATick(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 200 * time.Millisecond})
+	client := connectClient(hub, "alice", 16)
+
+	for gen := int64(1); gen <= 100; gen++ {
+		require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", gen)))
+	}
+	require.NoError(t, hub.BroadcastSyncEvent(changed("bob", "default", 7)))
+
+	// At most one notification per tick the burst straddled, ending with the newest
+	var events []*websocket.SyncEvent
+	for {
+		event := receiveEvent(t, client)
+		assert.Equal(t, "alice", event.UserID)
+		events = append(events, event)
+		if event.GenCount == 100 {
+			break
+		}
+	}
+	assert.LessOrEqual(t, len(events), 2)
+}
+
+func TestSyncEventDeviceIDIsNullWhenUnknown(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 10 * time.Millisecond})
+	client := connectClient(hub, "alice", 16)
+
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", 1)))
+	select {
+	case message := <-client.Send:
+		assert.Contains(t, string(message), `"device_id":null`, "old clients keep the field, just null")
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event received")
+	}
+
+	device := "7f1e2d3c-0000-4000-8000-000000000001"
+	event := changed("alice", "default", 2)
+	event.DeviceID = &device
+	require.NoError(t, hub.BroadcastSyncEvent(event))
+	received := receiveEvent(t, client)
+	require.NotNil(t, received.DeviceID)
+	assert.Equal(t, device, *received.DeviceID)
+}
+
+func TestHubSkipsTheDeviceThatMadeTheChange(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 10 * time.Millisecond})
+	laptop := connectDevice(hub, "alice", "laptop", "default")
+	phone := connectDevice(hub, "alice", "phone", "default")
+
+	pushed := changed("alice", "default", 1)
+	pushed.DeviceID = &[]string{"laptop"}[0]
+	require.NoError(t, hub.BroadcastSyncEvent(pushed))
+	assert.Equal(t, "laptop", *receiveEvent(t, phone).DeviceID)
+	assertNoEvent(t, laptop, 50*time.Millisecond)
+
+	// Other events naming the device still reach it
+	require.NoError(t, hub.BroadcastSyncEvent(&websocket.SyncEvent{Type: "device_inactive_warning", UserID: "alice", DeviceID: pushed.DeviceID}))
+	assert.Equal(t, "device_inactive_warning", receiveEvent(t, laptop).Type)
+	assert.Equal(t, "device_inactive_warning", receiveEvent(t, phone).Type)
+}
+
+func TestHubCoalescedChangesOfSeveralDevicesReachThemAll(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 200 * time.Millisecond})
+	laptop := connectDevice(hub, "alice", "laptop", "default")
+	phone := connectDevice(hub, "alice", "phone", "default")
+
+	for gen, device := range []string{"laptop", "phone", "laptop"} {
+		event := changed("alice", "default", int64(gen+1))
+		event.DeviceID = &device
+		require.NoError(t, hub.BroadcastSyncEvent(event))
+	}
+
+	// Whatever the tick boundaries, the phone hears about gencount 3 and the
+	// laptop about the phone's change. An event carrying both devices'
+	// changes names neither.
+	for receiveEvent(t, phone).GenCount != 3 {
+	}
+	event := receiveEvent(t, laptop)
+	assert.GreaterOrEqual(t, event.GenCount, int64(2))
+	if event.DeviceID != nil {
+		assert.Equal(t, "phone", *event.DeviceID)
+	}
+}
+
+func TestHubQueueOverflowDegradesToResync(t *testing.T) {
+	// Not running yet, so the one-slot queue stays full
+	hub := websocket.NewHubWithOptions(websocket.HubOptions{
+		QueueSize:        1,
+		FlushInterval:    100 * time.Millisecond,
+		BroadcastTimeout: 10 * time.Millisecond,
+	})
+	before := metrics.Value(websocket.MetricBroadcastOverflow)
+
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", 1)))
+	start := time.Now()
+	err := hub.BroadcastSyncEvent(changed("alice", "default", 2))
+	assert.ErrorIs(t, err, websocket.ErrHubOverloaded)
+	assert.Less(t, time.Since(start), time.Second, "publishers wait at most the broadcast timeout")
+	assert.Equal(t, before+1, metrics.Value(websocket.MetricBroadcastOverflow))
+
+	go hub.Run()
+	t.Cleanup(hub.Stop)
+	client := connectClient(hub, "alice", 16)
+
+	// The queued event is superseded: only the resync arrives
+	event := receiveEvent(t, client)
+	assert.Equal(t, websocket.EventResyncRecommended, event.Type)
+	select {
+	case message := <-client.Send:
+		t.Fatalf("unexpected extra message %s", message)
+	case <-time.After(250 * time.Millisecond):
+	}
+}
+
+func TestHubSlowConsumerGetsOneResync(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 20 * time.Millisecond})
+	client := connectClient(hub, "alice", 1)
+	before := metrics.Value(websocket.MetricClientOverflow)
+
+	// Different zones are not coalesced, so they overflow the one-slot buffer
+	for i := 0; i < 5; i++ {
+		require.NoError(t, hub.BroadcastSyncEvent(changed("alice", fmt.Sprintf("zone-%d", i), 1)))
+	}
+
+	assert.Eventually(t, func() bool {
+		return metrics.Value(websocket.MetricClientOverflow) > before
+	}, time.Second, 5*time.Millisecond)
+
+	first := receiveEvent(t, client)
+	assert.Equal(t, "credentials_changed", first.Type)
+
+	// Once there is room the client is told to resync instead of getting the rest
+	second := receiveEvent(t, client)
+	assert.Equal(t, websocket.EventResyncRecommended, second.Type)
+
+	select {
+	case message := <-client.Send:
+		t.Fatalf("unexpected extra message %s", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHubStopReleasesPublishersAndClients(t *testing.T) {
+	hub := websocket.NewHubWithOptions(websocket.HubOptions{})
+	go hub.Run()
+	client := connectClient(hub, "alice", 1)
+
+	hub.Stop()
+	hub.Stop() // Idempotent
+
+	_, ok := <-client.Send
+	assert.False(t, ok, "Stop closes client channels")
+	assert.ErrorIs(t, hub.BroadcastSyncEvent(changed("alice", "default", 1)), websocket.ErrHubStopped)
+}
+
+func TestHubStopWithoutRunReturns(t *testing.T) {
+	hub := websocket.NewHub()
+	hub.Stop()
+	assert.ErrorIs(t, hub.AddClient(&websocket.Client{Hub: hub, UserID: "alice"}), websocket.ErrHubStopped)
+}
+
+// Stopping the hub ends Run, every client's pumps and the connections, and
+// turns away clients connecting afterwards
+func TestHubStopLeaksNoGoroutines(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	hub := websocket.NewHubWithOptions(websocket.HubOptions{FlushInterval: 10 * time.Millisecond})
+	go hub.Run()
+
+	registered := make(chan struct{}, 3)
+	upgrader := gorilla.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := &websocket.Client{Hub: hub, Conn: conn, Send: make(chan []byte, 16), UserID: "alice"}
+		if err := hub.AddClient(client); err != nil {
+			websocket.CloseShutdown(conn)
+			return
+		}
+		go client.WritePump()
+		go client.ReadPump()
+		registered <- struct{}{}
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	assertShutdown := func(conn *gorilla.Conn) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, _, err := conn.ReadMessage()
+			if err == nil {
+				continue
+			}
+			var closeErr *gorilla.CloseError
+			require.ErrorAs(t, err, &closeErr)
+			assert.Equal(t, gorilla.CloseGoingAway, closeErr.Code)
+			return
+		}
+	}
+
+	var conns []*gorilla.Conn
+	for i := 0; i < 3; i++ {
+		conn, _, err := gorilla.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+		conns = append(conns, conn)
+		<-registered
+	}
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", 1)))
+	for _, conn := range conns {
+		_, message, err := conn.ReadMessage()
+		require.NoError(t, err)
+		assert.Contains(t, string(message), `"gencount":1`)
+	}
+
+	hub.Stop()
+	for _, conn := range conns {
+		assertShutdown(conn)
+	}
+	assert.ErrorIs(t, hub.BroadcastSyncEvent(changed("alice", "default", 2)), websocket.ErrHubStopped)
+
+	late, _, err := gorilla.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer late.Close()
+	assertShutdown(late)
+}
+
+func TestHubRevokeDeviceMidStream(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 10 * time.Millisecond})
+	revoked := connectDevice(hub, "alice", "device-a", "default")
+	kept := connectDevice(hub, "alice", "device-b", "default")
+	before := metrics.Value(websocket.MetricClientsClosed)
+
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", 1)))
+	assert.Equal(t, int64(1), receiveEvent(t, revoked).GenCount)
+	assert.Equal(t, int64(1), receiveEvent(t, kept).GenCount)
+
+	// Events keep flowing while the revocation lands
+	stop := make(chan struct{})
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for gen := int64(2); ; gen++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_ = hub.BroadcastSyncEvent(changed("alice", "default", gen))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	time.Sleep(30 * time.Millisecond)
+
+	assert.Equal(t, 1, hub.DisconnectUserDevice("alice", "device-a", websocket.CloseRevoked))
+	assert.Equal(t, 0, hub.DisconnectUserDevice("alice", "device-a", websocket.CloseRevoked), "already gone")
+	assert.Equal(t, before+1, metrics.Value(websocket.MetricClientsClosed))
+
+	// Whatever was queued before the revocation may still be read, but the
+	// channel ends there
+	for range revoked.Send {
+	}
+	time.Sleep(30 * time.Millisecond)
+	close(stop)
+	<-published
+
+	last := int64(0)
+	for {
+		select {
+		case message := <-kept.Send:
+			var event websocket.SyncEvent
+			require.NoError(t, json.Unmarshal(message, &event))
+			last = event.GenCount
+			continue
+		case <-time.After(100 * time.Millisecond):
+		}
+		break
+	}
+	assert.Greater(t, last, int64(1), "the other device keeps receiving")
+
+	// Unregistering an already disconnected client is harmless
+	hub.Unregister <- revoked
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", 1000)))
+	assert.Equal(t, int64(1000), receiveEvent(t, kept).GenCount)
+}
+
+func TestHubDisconnectUser(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 10 * time.Millisecond})
+	first := connectDevice(hub, "alice", "device-a", "default")
+	second := connectDevice(hub, "alice", "", "work")
+	other := connectDevice(hub, "bob", "device-c", "default")
+
+	assert.Equal(t, 2, hub.DisconnectUser("alice", websocket.CloseReauthenticate))
+	assertClosed(t, first)
+	assertClosed(t, second)
+
+	require.NoError(t, hub.BroadcastSyncEvent(changed("bob", "default", 1)))
+	assert.Equal(t, int64(1), receiveEvent(t, other).GenCount)
+}
+
+func TestHubRefreshClientAuthorization(t *testing.T) {
+	hub := websocket.NewHubWithOptions(websocket.HubOptions{FlushInterval: 10 * time.Millisecond})
+	assert.Equal(t, 0, hub.RefreshClientAuthorization("alice"), "no authorizer, nothing to check")
+
+	var mu gosync.Mutex
+	denied := map[string]error{}
+	hub.SetAuthorizer(func(userID, deviceID, zone string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return denied[deviceID+"/"+zone]
+	})
+	go hub.Run()
+	t.Cleanup(hub.Stop)
+
+	revoked := connectDevice(hub, "alice", "device-a", "default")
+	lostZone := connectDevice(hub, "alice", "device-b", "work")
+	kept := connectDevice(hub, "alice", "device-b", "default")
+
+	assert.NoError(t, hub.Authorize("alice", "device-a", "default"))
+	assert.Equal(t, 0, hub.RefreshClientAuthorization("alice"))
+
+	mu.Lock()
+	denied["device-a/default"] = websocket.ErrClientRevoked
+	denied["device-b/work"] = errors.New("zone access changed")
+	mu.Unlock()
+
+	assert.ErrorIs(t, hub.Authorize("alice", "device-a", "default"), websocket.ErrClientRevoked)
+	assert.Equal(t, 2, hub.RefreshClientAuthorization("alice"))
+	assertClosed(t, revoked)
+	assertClosed(t, lostZone)
+
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", 1)))
+	assert.Equal(t, int64(1), receiveEvent(t, kept).GenCount)
+}
+
+func TestHubFiltersEventsByClientZone(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 10 * time.Millisecond})
+	work := connectDevice(hub, "alice", "device-a", "work")
+	all := connectClient(hub, "alice", 16) // No zone: every event
+
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", 1)))
+	assert.Equal(t, "default", receiveEvent(t, all).Zone)
+	assertNoEvent(t, work, 50*time.Millisecond)
+
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "work", 2)))
+	assert.Equal(t, "work", receiveEvent(t, work).Zone)
+	assert.Equal(t, "work", receiveEvent(t, all).Zone)
+
+	// Zone-less events are account-wide
+	require.NoError(t, hub.BroadcastSyncEvent(&websocket.SyncEvent{Type: "account_changed", UserID: "alice"}))
+	assert.Equal(t, "account_changed", receiveEvent(t, work).Type)
+}
+
+func TestHubDeliversZonesOnlyToTheirSubscribers(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 10 * time.Millisecond})
+	work := connectDevice(hub, "alice", "device-a", "work")
+	home := connectDevice(hub, "alice", "device-b", "default")
+	every := connectDevice(hub, "alice", "device-c", sync.AllZones)
+
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", 1)))
+	assert.Equal(t, "default", receiveEvent(t, home).Zone)
+	assert.Equal(t, "default", receiveEvent(t, every).Zone)
+	assertNoEvent(t, work, 50*time.Millisecond)
+
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "work", 2)))
+	assert.Equal(t, "work", receiveEvent(t, work).Zone)
+	assert.Equal(t, "work", receiveEvent(t, every).Zone)
+	assertNoEvent(t, home, 50*time.Millisecond)
+}
+
+func TestHubCloseFrameCarriesReason(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 10 * time.Millisecond})
+
+	registered := make(chan struct{})
+	upgrader := gorilla.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := &websocket.Client{Hub: hub, Conn: conn, Send: make(chan []byte, 16), UserID: "alice", DeviceID: r.URL.Query().Get("device")}
+		hub.Register <- client
+		go client.WritePump()
+		go client.ReadPump()
+		close(registered)
+	}))
+	t.Cleanup(server.Close)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?device=device-a"
+	conn, _, err := gorilla.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	<-registered
+
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", 1)))
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(message), `"gencount":1`)
+
+	assert.Equal(t, 1, hub.DisconnectUserDevice("alice", "device-a", websocket.CloseRevoked))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *gorilla.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, websocket.CloseRevoked.Code, closeErr.Code)
+	assert.Equal(t, websocket.CloseRevoked.Text, closeErr.Text)
+}
+
+// Drives ~10k events/second for a second through a hub with fast and slow
+// consumers, then checks nothing blocked and no goroutines were left behind.
+func TestHubLoadWithSlowConsumers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("load test")
+	}
+	baseline := runtime.NumGoroutine()
+
+	hub := websocket.NewHubWithOptions(websocket.HubOptions{
+		FlushInterval:    10 * time.Millisecond,
+		BroadcastTimeout: 5 * time.Millisecond,
+	})
+	go hub.Run()
+
+	const users, publishers, perPublisher = 20, 10, 1000
+	var readers gosync.WaitGroup
+	var fast, slow []*trackedClient
+	for u := 0; u < users; u++ {
+		userID := fmt.Sprintf("user-%d", u)
+		fastClient := &trackedClient{client: connectClient(hub, userID, 64)}
+		slowClient := &trackedClient{client: connectClient(hub, userID, 1), delay: 20 * time.Millisecond}
+		fast = append(fast, fastClient)
+		slow = append(slow, slowClient)
+		for _, tc := range []*trackedClient{fastClient, slowClient} {
+			readers.Add(1)
+			go tc.read(&readers)
+		}
+	}
+
+	var sent, overloaded atomic.Int64
+	var publishersDone gosync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		publishersDone.Add(1)
+		go func(p int) {
+			defer publishersDone.Done()
+			pace := time.NewTicker(time.Millisecond)
+			defer pace.Stop()
+			for i := 1; i <= perPublisher; i++ {
+				<-pace.C
+				err := hub.BroadcastSyncEvent(changed(fmt.Sprintf("user-%d", (p+i)%users), "default", int64(i)))
+				switch {
+				case err == nil:
+					sent.Add(1)
+				case errors.Is(err, websocket.ErrHubOverloaded):
+					overloaded.Add(1)
+				default:
+					t.Errorf("unexpected broadcast error: %v", err)
+				}
+			}
+		}(p)
+	}
+	publishersDone.Wait()
+	assert.Equal(t, int64(publishers*perPublisher), sent.Load()+overloaded.Load())
+
+	// Let the last tick drain, then every fast client has seen the final
+	// gencount (or been told to resync)
+	time.Sleep(50 * time.Millisecond)
+	for u, tc := range fast {
+		want := lastGenCount(u, users, publishers, perPublisher)
+		assert.True(t, tc.maxGen.Load() == want || tc.resyncs.Load() > 0,
+			"user-%d saw gencount %d, want %d or a resync", u, tc.maxGen.Load(), want)
+	}
+	slowResyncs := int64(0)
+	for _, tc := range slow {
+		slowResyncs += tc.resyncs.Load()
+	}
+	assert.Positive(t, slowResyncs, "slow consumers degrade to resync")
+
+	hub.Stop()
+	readers.Wait()
+
+	// Polled by hand: assert.Eventually runs its condition on a goroutine
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), baseline, "goroutines leaked")
+}
+
+// lastGenCount is the highest gencount any publisher sends to user u
+func lastGenCount(u, users, publishers, perPublisher int) int64 {
+	for i := perPublisher; i > 0; i-- {
+		for p := 0; p < publishers; p++ {
+			if (p+i)%users == u {
+				return int64(i)
+			}
+		}
+	}
+	return 0
+}
+
+type trackedClient struct {
+	client  *websocket.Client
+	delay   time.Duration
+	maxGen  atomic.Int64
+	resyncs atomic.Int64
+}
+
+func (tc *trackedClient) read(wg *gosync.WaitGroup) {
+	defer wg.Done()
+	for message := range tc.client.Send {
+		var event websocket.SyncEvent
+		if json.Unmarshal(message, &event) != nil {
+			continue
+		}
+		if event.Type == websocket.EventResyncRecommended {
+			tc.resyncs.Add(1)
+		} else if event.GenCount > tc.maxGen.Load() {
+			tc.maxGen.Store(event.GenCount)
+		}
+		time.Sleep(tc.delay)
+	}
+}
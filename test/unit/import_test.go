@@ -0,0 +1,214 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// importServer is a server over a MemoryStore with a helper to call it as
+// one of its users
+type importServer struct {
+	t       *testing.T
+	handler http.Handler
+}
+
+func newImportServer(t *testing.T) *importServer {
+	gin.SetMode(gin.TestMode)
+	return &importServer{t: t, handler: api.NewServerWithAuth(storage.NewMemoryStore()).Handler()}
+}
+
+func (s *importServer) do(token, method, path string, body []byte, status int) map[string]interface{} {
+	s.t.Helper()
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	require.Equal(s.t, status, w.Code, w.Body.String())
+
+	var resp map[string]interface{}
+	require.NoError(s.t, json.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+	return resp
+}
+
+func (s *importServer) register(email string) string {
+	s.t.Helper()
+	body, _ := json.Marshal(map[string]string{"email": email, "password": "correct horse battery"})
+	registered := s.do("", http.MethodPost, "/api/v1/auth/register", body, http.StatusCreated)
+	token, _ := registered["access_token"].(string)
+	require.NotEmpty(s.t, token)
+	return token
+}
+
+// pushCredential pushes a key, a credential using it and its sync record
+func (s *importServer) pushCredential(token, zone string) (keyID, recordID string) {
+	s.t.Helper()
+	keyID, recordID = uuid.New().String(), uuid.New().String()
+	body, _ := json.Marshal(map[string]interface{}{
+		"zone": zone,
+		"keys": []map[string]interface{}{{
+			"item_uuid": keyID, "key_class": 1, "key_type": 2, "data": "a2V5", "usage_flags": "e30=",
+		}},
+		"credential_metadata": []map[string]interface{}{{
+			"item_uuid": uuid.New().String(), "server": "example.com", "account": "alice",
+			"password_key_uuid": keyID,
+		}},
+		"sync_records": []map[string]interface{}{{
+			"item_uuid": recordID, "parent_key_uuid": keyID, "wrapped_key": "d3JhcHBlZA==",
+			"enc_item": "c2VhbGVk", "enc_version": 1,
+		}},
+	})
+	s.do(token, http.MethodPost, "/api/v1/sync/push", body, http.StatusOK)
+	return keyID, recordID
+}
+
+// export downloads the vault once every zone has the digest of its last
+// push, which is stored after the push returns
+func (s *importServer) export(token string) []byte {
+	s.t.Helper()
+	var body []byte
+	require.Eventually(s.t, func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/sync/export", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, req)
+		var doc struct {
+			Zones []struct {
+				Digest []byte `json:"digest"`
+			} `json:"zones"`
+		}
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &doc) != nil {
+			return false
+		}
+		for _, zone := range doc.Zones {
+			if zone.Digest == nil {
+				return false
+			}
+		}
+		body = w.Body.Bytes()
+		return true
+	}, 2*time.Second, 10*time.Millisecond)
+	return body
+}
+
+// Restoring an export into an empty account writes every item with new
+// gencounts; a second restore needs merge, which skips what is unchanged
+func TestImportRoundTrip(t *testing.T) {
+	s := newImportServer(t)
+	alice := s.register("alice@example.com")
+	s.pushCredential(alice, "default")
+	s.pushCredential(alice, "work")
+	doc := s.export(alice)
+
+	restored := s.register("restored@example.com")
+	s.pushCredential(restored, "scratch")
+	s.do(restored, http.MethodDelete, "/api/v1/sync/zones/scratch", nil, http.StatusOK)
+
+	result := s.do(restored, http.MethodPost, "/api/v1/sync/import", doc, http.StatusOK)
+	assert.Equal(t, float64(6), result["imported"])
+	assert.Equal(t, float64(0), result["skipped"])
+	assert.Equal(t, float64(0), result["conflicted"])
+	zones := result["zones"].([]interface{})
+	require.Len(t, zones, 2)
+	assert.Equal(t, "default", zones[0].(map[string]interface{})["zone"])
+	assert.Equal(t, float64(3), zones[0].(map[string]interface{})["gencount"])
+
+	pulled := s.do(restored, http.MethodPost, "/api/v1/sync/pull", []byte(`{"zone":"work"}`), http.StatusOK)
+	assert.Len(t, pulled["keys"], 1)
+	assert.Len(t, pulled["credential_metadata"], 1)
+	assert.Len(t, pulled["sync_records"], 1)
+
+	// The import stored the digests of what it wrote, so the restored vault
+	// exports and imports again
+	again := s.export(restored)
+	third := s.do(s.register("third@example.com"), http.MethodPost, "/api/v1/sync/import", again, http.StatusOK)
+	assert.Equal(t, float64(6), third["imported"])
+
+	notEmpty := s.do(restored, http.MethodPost, "/api/v1/sync/import", doc, http.StatusConflict)
+	assert.Equal(t, "account_not_empty", notEmpty["code"])
+
+	unchanged := s.do(alice, http.MethodPost, "/api/v1/sync/import?merge=true", doc, http.StatusOK)
+	assert.Equal(t, float64(0), unchanged["imported"])
+	assert.Equal(t, float64(6), unchanged["skipped"])
+	assert.Empty(t, unchanged["conflicts"])
+}
+
+// Under merge an item stored at another version than the exported one is
+// settled like a push made from the exported version
+func TestImportMergeConflicts(t *testing.T) {
+	s := newImportServer(t)
+	alice := s.register("alice@example.com")
+	keyID, recordID := s.pushCredential(alice, "default")
+	doc := s.export(alice)
+
+	edit, _ := json.Marshal(map[string]interface{}{
+		"zone": "default",
+		"sync_records": []map[string]interface{}{{
+			"item_uuid": recordID, "parent_key_uuid": keyID, "wrapped_key": "d3JhcHBlZA==",
+			"enc_item": "ZWRpdGVk", "enc_version": 1, "gencount": 3,
+		}},
+	})
+	s.do(alice, http.MethodPost, "/api/v1/sync/push", edit, http.StatusOK)
+
+	result := s.do(alice, http.MethodPost, "/api/v1/sync/import?merge=true", doc, http.StatusOK)
+	assert.Equal(t, float64(0), result["imported"])
+	assert.Equal(t, float64(2), result["skipped"])
+	assert.Equal(t, float64(1), result["conflicted"])
+	conflicts := result["conflicts"].([]interface{})
+	require.Len(t, conflicts, 1)
+	conflict := conflicts[0].(map[string]interface{})
+	assert.Equal(t, recordID, conflict["item_uuid"])
+	assert.Equal(t, "sync_record", conflict["layer"])
+	assert.Equal(t, "client_wins", conflict["resolution"], "last_write_wins: the import is the later write")
+	assert.Equal(t, float64(5), conflict["winning_gencount"])
+}
+
+func TestImportRefusesBadDocuments(t *testing.T) {
+	s := newImportServer(t)
+	alice := s.register("alice@example.com")
+	s.pushCredential(alice, "default")
+	doc := s.export(alice)
+	target := s.register("target@example.com")
+
+	var tampered map[string]interface{}
+	require.NoError(t, json.Unmarshal(doc, &tampered))
+	records := tampered["zones"].([]interface{})[0].(map[string]interface{})["sync_records"].([]interface{})
+	records[0].(map[string]interface{})["gencount"] = 7
+	body, _ := json.Marshal(tampered)
+	mismatch := s.do(target, http.MethodPost, "/api/v1/sync/import", body, http.StatusBadRequest)
+	assert.Equal(t, "export_digest_mismatch", mismatch["code"])
+	assert.Equal(t, "default", mismatch["zone"])
+
+	tampered["version"] = 2
+	body, _ = json.Marshal(tampered)
+	version := s.do(target, http.MethodPost, "/api/v1/sync/import", body, http.StatusBadRequest)
+	assert.Equal(t, "unknown_export_version", version["code"])
+
+	pulled := s.do(target, http.MethodPost, "/api/v1/sync/pull", []byte(`{"zone":"default"}`), http.StatusOK)
+	assert.Empty(t, pulled["sync_records"], "a refused import writes nothing")
+}
+
+func TestImportBodyLimit(t *testing.T) {
+	t.Setenv("IMPORT_MAX_BODY_BYTES", "512")
+	s := newImportServer(t)
+	alice := s.register("alice@example.com")
+	s.pushCredential(alice, "default")
+	doc := s.export(alice)
+	require.Greater(t, len(doc), 512)
+
+	tooLarge := s.do(alice, http.MethodPost, "/api/v1/sync/import?merge=true", doc, http.StatusRequestEntityTooLarge)
+	assert.Equal(t, "payload_too_large", tooLarge["code"])
+}
@@ -0,0 +1,222 @@
+package unit
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/pkg/importers"
+	"github.com/deeplyprofound/password-sync/server/domain/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseFixture(t *testing.T, format, path string) *importers.Result {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	result, err := importers.Parse(format, f)
+	require.NoError(t, err)
+	return result
+}
+
+func skipReasons(result *importers.Result) []string {
+	reasons := make([]string, 0, len(result.Skipped))
+	for _, skipped := range result.Skipped {
+		reasons = append(reasons, skipped.Reason)
+	}
+	return reasons
+}
+
+func TestImportBitwardenCSV(t *testing.T) {
+	result := parseFixture(t, importers.FormatBitwardenCSV, "testdata/importers/bitwarden.csv")
+
+	require.Len(t, result.Credentials, 2)
+	github := result.Credentials[0]
+	assert.Equal(t, "GitHub", github.Name)
+	assert.Equal(t, []string{"https://github.com", "https://github.com/login"}, github.URIs)
+	assert.Equal(t, "dev@example.com", github.Username)
+	assert.Equal(t, " leading space", github.Password, "passwords are not trimmed")
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", github.TOTP)
+	assert.Equal(t, "Line one\nLine two", github.Notes)
+	assert.Equal(t, "Work", github.Collection, "folder header survives the byte order mark")
+	assert.True(t, github.Favorite)
+	assert.Equal(t, []importers.Field{{Name: "API Key", Value: "ghp_abc123"}, {Name: "Org", Value: "MyCompany"}}, github.Fields)
+
+	assert.Empty(t, result.Credentials[1].Collection)
+
+	assert.Equal(t, []string{
+		"unsupported item type note",
+		"no username, password or TOTP",
+		"expected 11 columns, found 2",
+	}, skipReasons(result))
+	assert.Equal(t, 8, result.Skipped[2].Entry, "entries are reported by CSV line")
+}
+
+func TestImportBitwardenJSON(t *testing.T) {
+	result := parseFixture(t, importers.FormatBitwardenJSON, "testdata/importers/bitwarden.json")
+
+	require.Len(t, result.Credentials, 2)
+	github := result.Credentials[0]
+	assert.Equal(t, []string{"https://github.com", "https://github.com/login"}, github.URIs)
+	assert.Equal(t, "otpauth://totp/GitHub?secret=JBSWY3DPEHPK3PXP", github.TOTP)
+	assert.Equal(t, "Primary account", github.Notes)
+	assert.Equal(t, "Work", github.Collection)
+	assert.True(t, github.Favorite)
+	assert.Equal(t, []importers.Field{{Name: "API Key", Value: "ghp_abc123"}}, github.Fields)
+
+	wiki := result.Credentials[1]
+	assert.Equal(t, "Shared", wiki.Collection, "organization collections stand in for folders")
+	assert.Nil(t, wiki.URIs)
+
+	require.Len(t, result.Skipped, 1)
+	assert.Equal(t, importers.Skipped{Entry: 3, Name: "WiFi", Reason: "not a login item"}, result.Skipped[0])
+}
+
+func TestImportOnePasswordCSV(t *testing.T) {
+	result := parseFixture(t, importers.FormatOnePasswordCSV, "testdata/importers/1password.csv")
+
+	require.Len(t, result.Credentials, 2)
+	github := result.Credentials[0]
+	assert.Equal(t, []string{"https://github.com"}, github.URIs)
+	assert.Equal(t, "otpauth://totp/GitHub?secret=JBSWY3DPEHPK3PXP", github.TOTP)
+	assert.Equal(t, "Multi\nline", github.Notes)
+	assert.True(t, github.Favorite)
+
+	quoted := result.Credentials[1]
+	assert.Equal(t, `Quoted "Title"`, quoted.Name, "lazy quotes keep stray quotes in a field")
+	assert.Equal(t, "pa,ss", quoted.Password)
+
+	assert.Equal(t, []string{"archived"}, skipReasons(result))
+}
+
+func TestImportOnePassword1PUX(t *testing.T) {
+	result := parseFixture(t, importers.FormatOnePassword1PUX, "testdata/importers/1password.1pux.json")
+
+	require.Len(t, result.Credentials, 2)
+	github := result.Credentials[0]
+	assert.Equal(t, "dev@example.com", github.Username)
+	assert.Equal(t, "GitHubP@ss", github.Password)
+	assert.Equal(t, []string{"https://github.com", "https://gist.github.com"}, github.URIs)
+	assert.Equal(t, "otpauth://totp/GitHub?secret=JBSWY3DPEHPK3PXP", github.TOTP)
+	assert.Equal(t, "Work account", github.Notes)
+	assert.Equal(t, "Private", github.Collection, "vaults become collections")
+	assert.True(t, github.Favorite)
+	assert.Equal(t, []importers.Field{{Name: "PIN", Value: "1234"}}, github.Fields)
+
+	router := result.Credentials[1]
+	assert.Equal(t, "router-admin", router.Password)
+	assert.Equal(t, "Shared", router.Collection)
+
+	assert.Equal(t, []string{"unsupported category 003"}, skipReasons(result))
+}
+
+func TestImportLastPassCSV(t *testing.T) {
+	result := parseFixture(t, importers.FormatLastPassCSV, "testdata/importers/lastpass.csv")
+
+	require.Len(t, result.Credentials, 1)
+	cred := result.Credentials[0]
+	assert.Equal(t, "Stack&Overflow", cred.Name)
+	assert.Equal(t, "john&doe", cred.Username)
+	assert.Equal(t, "p<ss>", cred.Password, "HTML entities are decoded")
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", cred.TOTP)
+	assert.Equal(t, "Q&A account", cred.Notes)
+	assert.Equal(t, `Development\Tools`, cred.Collection)
+	assert.True(t, cred.Favorite)
+
+	assert.Equal(t, []string{"secure notes are not imported"}, skipReasons(result))
+}
+
+func TestImportChromeCSV(t *testing.T) {
+	result := parseFixture(t, importers.FormatChromeCSV, "testdata/importers/chrome.csv")
+
+	require.Len(t, result.Credentials, 2)
+	assert.Equal(t, "my note", result.Credentials[0].Notes)
+	assert.Equal(t, "https://unnamed.example.com", result.Credentials[1].Name, "unnamed entries fall back to their URL")
+	assert.Empty(t, result.Skipped)
+}
+
+// The sample exports shipped for the desktop importer parse as well
+func TestImportSampleExports(t *testing.T) {
+	samples := map[string]string{
+		importers.FormatBitwardenCSV:    "bitwarden-format.csv",
+		importers.FormatBitwardenJSON:   "bitwarden-json-format.json",
+		importers.FormatOnePasswordCSV:  "1password-csv-format.csv",
+		importers.FormatOnePassword1PUX: "1password-1pux-format.json",
+		importers.FormatLastPassCSV:     "lastpass-format.csv",
+		importers.FormatChromeCSV:       "chrome-format.csv",
+	}
+	for format, file := range samples {
+		result := parseFixture(t, format, filepath.Join("..", "sample-imports", file))
+		assert.NotEmpty(t, result.Credentials, format)
+		for _, cred := range result.Credentials {
+			assert.NotEmpty(t, cred.Name, format)
+			assert.NotEmpty(t, cred.Password, format)
+		}
+	}
+}
+
+func TestImportMalformedInput(t *testing.T) {
+	var formatErr *importers.FormatError
+
+	_, err := importers.Parse("keepass-xml", strings.NewReader(""))
+	assert.ErrorIs(t, err, importers.ErrUnknownFormat)
+
+	for _, format := range []string{importers.FormatChromeCSV, importers.FormatLastPassCSV} {
+		_, err = importers.Parse(format, strings.NewReader(""))
+		require.ErrorAs(t, err, &formatErr, format)
+		assert.Equal(t, "file is empty", formatErr.Reason)
+	}
+
+	_, err = importers.Parse(importers.FormatBitwardenCSV, strings.NewReader("name,url,username,password\n"))
+	require.ErrorAs(t, err, &formatErr)
+	assert.Equal(t, 1, formatErr.Line)
+	assert.Contains(t, formatErr.Reason, "missing column")
+
+	// An unterminated quote swallows the rest of the file into one field;
+	// that row is reported, not imported with shifted columns
+	result := parseFixture(t, importers.FormatChromeCSV, "testdata/importers/malformed.csv")
+	assert.Empty(t, result.Credentials)
+	assert.Equal(t, []string{"expected 4 columns, found 1"}, skipReasons(result))
+
+	for _, format := range []string{importers.FormatBitwardenJSON, importers.FormatOnePassword1PUX} {
+		_, err = importers.Parse(format, strings.NewReader(`{"items": [`))
+		require.ErrorAs(t, err, &formatErr, format)
+	}
+
+	_, err = importers.Parse(importers.FormatBitwardenJSON, strings.NewReader(`{"encrypted": true, "items": []}`))
+	assert.True(t, errors.Is(err, importers.ErrEncryptedExport))
+}
+
+func TestImportEncryptRoundTrip(t *testing.T) {
+	lc, err := crypto.NewLayeredCrypto("vault-password", make([]byte, 32))
+	require.NoError(t, err)
+	result := parseFixture(t, importers.FormatBitwardenJSON, "testdata/importers/bitwarden.json")
+
+	records, err := importers.Encrypt(lc, result.Credentials)
+	require.NoError(t, err)
+	require.Len(t, records, len(result.Credentials))
+
+	for i, record := range records {
+		assert.NotContains(t, string(record.EncItem), result.Credentials[i].Password)
+		assert.Equal(t, importers.RecordEncVersion, record.EncVersion)
+
+		plaintext, err := lc.DecryptCredential(record.WrappedKey, record.EncItem)
+		require.NoError(t, err)
+		var cred importers.PlainCredential
+		require.NoError(t, json.Unmarshal(plaintext, &cred))
+		assert.Equal(t, result.Credentials[i], cred)
+	}
+	assert.NotEqual(t, records[0].ItemUUID, records[1].ItemUUID)
+
+	batches := importers.Batches("default", append(records, records...), 3)
+	require.Len(t, batches, 2)
+	assert.Len(t, batches[0].SyncRecords, 3)
+	assert.Len(t, batches[1].SyncRecords, 1)
+	assert.Equal(t, "default", batches[1].Zone)
+}
@@ -0,0 +1,341 @@
+package unit
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/mail"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// inactivityStore stands in for the users table in inactivity tests
+type inactivityStore struct {
+	accounts map[string]*storage.InactiveAccount
+	deleted  []string
+	writes   int
+	// Users put on legal hold after the job read them
+	heldMeanwhile map[string]bool
+}
+
+func newInactivityStore(accounts ...*storage.InactiveAccount) *inactivityStore {
+	s := &inactivityStore{accounts: map[string]*storage.InactiveAccount{}, heldMeanwhile: map[string]bool{}}
+	for _, account := range accounts {
+		if account.Tier == "" {
+			account.Tier = storage.FreeTier
+		}
+		if account.Stage == "" {
+			account.Stage = storage.InactivityActive
+		}
+		s.accounts[account.UserID] = account
+	}
+	return s
+}
+
+func (s *inactivityStore) FindInactiveAccounts(idleBefore time.Time, userID string) ([]*storage.InactiveAccount, error) {
+	var result []*storage.InactiveAccount
+	for _, account := range s.accounts {
+		if userID != "" && account.UserID != userID {
+			continue
+		}
+		exempt := account.LegalHold || account.Tier != storage.FreeTier
+		if account.Stage != storage.InactivityActive || (!exempt && !account.LastActive.After(idleBefore)) {
+			copied := *account
+			result = append(result, &copied)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].UserID < result[j].UserID })
+	return result, nil
+}
+
+func (s *inactivityStore) SetInactivityStage(userID, from, to string, at time.Time) (bool, error) {
+	account, ok := s.accounts[userID]
+	if !ok || account.Stage != from {
+		return false, nil
+	}
+	s.writes++
+	account.Stage, account.StageAt = to, &at
+	if to == storage.InactivityActive {
+		account.StageAt = nil
+	}
+	return true, nil
+}
+
+func (s *inactivityStore) DeleteUserCascade(_ context.Context, id string) error {
+	if s.heldMeanwhile[id] || s.accounts[id] == nil {
+		return sql.ErrNoRows
+	}
+	s.writes++
+	delete(s.accounts, id)
+	s.deleted = append(s.deleted, id)
+	return nil
+}
+
+type stageChange struct {
+	UserID   string
+	Stage    string
+	Deadline time.Time
+}
+
+type inactivityNotifier struct {
+	changes []stageChange
+	deleted []string
+}
+
+func (n *inactivityNotifier) InactivityStageChanged(account *storage.InactiveAccount, stage string, deadline time.Time) {
+	n.changes = append(n.changes, stageChange{account.UserID, stage, deadline})
+}
+
+func (n *inactivityNotifier) AccountDeleted(account *storage.InactiveAccount) {
+	n.deleted = append(n.deleted, account.UserID)
+}
+
+// Short thresholds so a lifecycle fits in a few months of fake time
+var testInactivityPolicy = jobs.InactivityPolicy{
+	WarnAfter:         10 * 24 * time.Hour,
+	DormantAfter:      20 * 24 * time.Hour,
+	DeletionWarnAfter: 100 * 24 * time.Hour,
+	DeleteAfter:       110 * 24 * time.Hour,
+	DeletionGrace:     5 * 24 * time.Hour,
+}
+
+type inactivityRig struct {
+	clock    *fakeClock
+	store    *inactivityStore
+	notifier *inactivityNotifier
+	job      *jobs.AccountInactivityJob
+	runner   *jobs.Runner
+}
+
+func newInactivityRig(start time.Time, accounts ...*storage.InactiveAccount) *inactivityRig {
+	rig := &inactivityRig{
+		clock:    &fakeClock{now: start},
+		store:    newInactivityStore(accounts...),
+		notifier: &inactivityNotifier{},
+	}
+	rig.job = jobs.NewAccountInactivityJob(rig.store, rig.notifier, testInactivityPolicy)
+	rig.job.SetClock(rig.clock)
+	rig.runner = jobs.NewRunner(nil)
+	rig.runner.Register(rig.job)
+	return rig
+}
+
+// runAt moves the clock to day n after start and runs the job
+func (r *inactivityRig) runAt(t *testing.T, start time.Time, n int, opts jobs.RunOptions) *jobs.Report {
+	t.Helper()
+	r.clock.now = start.Add(days(n))
+	report, err := r.runner.Run(context.Background(), jobs.AccountInactivityJobName, opts)
+	require.NoError(t, err)
+	return report
+}
+
+func days(n int) time.Duration { return time.Duration(n) * 24 * time.Hour }
+
+func stages(report *jobs.Report) map[string]string {
+	out := map[string]string{}
+	for _, user := range report.Users {
+		out[user.UserID] = user.Stage
+	}
+	return out
+}
+
+func TestAccountInactivityLifecycle(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rig := newInactivityRig(start, &storage.InactiveAccount{UserID: "idle", Email: "idle@example.com", LastActive: start})
+
+	steps := []struct {
+		day      int
+		stage    string // "" when nothing is due
+		deadline int    // Day the notified deadline falls on
+	}{
+		{9, "", 0},
+		{10, storage.InactivityWarned, 20},
+		{19, "", 0},
+		{20, storage.InactivityDormant, 115},
+		{99, "", 0},
+		{100, storage.InactivityDeletionWarned, 115},
+		{109, "", 0},
+		{110, storage.InactivityDeletionQueued, 115},
+		{114, "", 0},
+		{115, jobs.InactivityDeleted, 0},
+	}
+	for _, step := range steps {
+		changes := len(rig.notifier.changes)
+		report := rig.runAt(t, start, step.day, jobs.RunOptions{})
+
+		if step.stage == "" {
+			assert.Empty(t, report.Users, "day %d", step.day)
+			continue
+		}
+		assert.Equal(t, map[string]string{"idle": step.stage}, stages(report), "day %d", step.day)
+		if step.stage == jobs.InactivityDeleted {
+			break
+		}
+		require.Len(t, rig.notifier.changes, changes+1, "day %d", step.day)
+		change := rig.notifier.changes[changes]
+		assert.Equal(t, step.stage, change.Stage)
+		assert.Equal(t, start.Add(days(step.deadline)), change.Deadline, "day %d", step.day)
+		assert.Equal(t, step.stage, rig.store.accounts["idle"].Stage)
+	}
+
+	assert.Equal(t, []string{"idle"}, rig.store.deleted)
+	assert.Equal(t, []string{"idle"}, rig.notifier.deleted)
+}
+
+func TestAccountInactivityGivesFullNoticeWhenLate(t *testing.T) {
+	// Idle far longer than every threshold when the lifecycle is turned on
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rig := newInactivityRig(start, &storage.InactiveAccount{UserID: "ancient", LastActive: start.Add(-days(1000))})
+
+	assert.Equal(t, storage.InactivityWarned, stages(rig.runAt(t, start, 0, jobs.RunOptions{}))["ancient"])
+	assert.Equal(t, start.Add(days(10)), rig.notifier.changes[0].Deadline, "the warning's full ten days")
+	assert.Empty(t, rig.runAt(t, start, 9, jobs.RunOptions{}).Users)
+	assert.Equal(t, storage.InactivityDormant, stages(rig.runAt(t, start, 10, jobs.RunOptions{}))["ancient"])
+	assert.Empty(t, rig.runAt(t, start, 89, jobs.RunOptions{}).Users, "dormant for 80 days first")
+	assert.Equal(t, storage.InactivityDeletionWarned, stages(rig.runAt(t, start, 90, jobs.RunOptions{}))["ancient"])
+	assert.Empty(t, rig.runAt(t, start, 99, jobs.RunOptions{}).Users)
+	assert.Equal(t, storage.InactivityDeletionQueued, stages(rig.runAt(t, start, 100, jobs.RunOptions{}))["ancient"])
+	assert.Empty(t, rig.runAt(t, start, 104, jobs.RunOptions{}).Users)
+	assert.Equal(t, jobs.InactivityDeleted, stages(rig.runAt(t, start, 105, jobs.RunOptions{}))["ancient"])
+}
+
+func TestAccountInactivityActivityResets(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	warnedAt := start.Add(-days(5))
+	rig := newInactivityRig(start,
+		// Synced after the warning
+		&storage.InactiveAccount{UserID: "synced", LastActive: start.Add(-days(1)), Stage: storage.InactivityWarned, StageAt: &warnedAt},
+		// Still idle
+		&storage.InactiveAccount{UserID: "idle", LastActive: start.Add(-days(15)), Stage: storage.InactivityWarned, StageAt: &warnedAt},
+	)
+
+	report := rig.runAt(t, start, 0, jobs.RunOptions{})
+	assert.Equal(t, map[string]string{"synced": storage.InactivityActive}, stages(report))
+	assert.Equal(t, storage.InactivityActive, rig.store.accounts["synced"].Stage)
+	assert.Nil(t, rig.store.accounts["synced"].StageAt)
+	require.Len(t, rig.notifier.changes, 1)
+	assert.True(t, rig.notifier.changes[0].Deadline.IsZero())
+
+	// A login moved the other one back too: nothing left to do
+	rig.store.accounts["idle"].Stage = storage.InactivityActive
+	rig.store.accounts["idle"].LastActive = start.Add(days(5))
+	report = rig.runAt(t, start, 5, jobs.RunOptions{})
+	assert.Empty(t, report.Users)
+}
+
+func TestAccountInactivityExemptions(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	queuedAt := start.Add(-days(3))
+	rig := newInactivityRig(start,
+		&storage.InactiveAccount{UserID: "paid", Tier: "premium", LastActive: start.Add(-days(500))},
+		&storage.InactiveAccount{UserID: "held", LegalHold: true, LastActive: start.Add(-days(500))},
+		// Upgraded after being queued for deletion
+		&storage.InactiveAccount{UserID: "upgraded", Tier: "premium", LastActive: start.Add(-days(500)), Stage: storage.InactivityDeletionQueued, StageAt: &queuedAt},
+	)
+
+	report := rig.runAt(t, start, 0, jobs.RunOptions{})
+	assert.Equal(t, map[string]string{"upgraded": storage.InactivityActive}, stages(report))
+	assert.Equal(t, storage.InactivityActive, rig.store.accounts["paid"].Stage)
+	assert.Equal(t, storage.InactivityActive, rig.store.accounts["held"].Stage)
+
+	for i := 1; i <= 200; i += 10 {
+		assert.Empty(t, rig.runAt(t, start, i, jobs.RunOptions{}).Users, "day %d", i)
+	}
+	assert.Empty(t, rig.store.deleted)
+}
+
+func TestAccountInactivityLegalHoldBeforeDeletion(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	queuedAt := start.Add(-days(10))
+	rig := newInactivityRig(start,
+		&storage.InactiveAccount{UserID: "queued", LastActive: start.Add(-days(500)), Stage: storage.InactivityDeletionQueued, StageAt: &queuedAt})
+	rig.store.heldMeanwhile["queued"] = true
+	skipped := metrics.Value(jobs.MetricLegalHoldSkipped)
+
+	report := rig.runAt(t, start, 0, jobs.RunOptions{})
+	assert.Empty(t, report.Users)
+	assert.Empty(t, rig.notifier.deleted)
+	assert.Equal(t, skipped+1, metrics.Value(jobs.MetricLegalHoldSkipped))
+}
+
+func TestAccountInactivityDryRun(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	queuedAt := start.Add(-days(10))
+	rig := newInactivityRig(start,
+		&storage.InactiveAccount{UserID: "idle", LastActive: start.Add(-days(12))},
+		&storage.InactiveAccount{UserID: "queued", LastActive: start.Add(-days(500)), Stage: storage.InactivityDeletionQueued, StageAt: &queuedAt},
+		&storage.InactiveAccount{UserID: "recent", LastActive: start.Add(-days(2))},
+	)
+
+	report := rig.runAt(t, start, 0, jobs.RunOptions{DryRun: true})
+	assert.Equal(t, map[string]string{"idle": storage.InactivityWarned, "queued": jobs.InactivityDeleted}, stages(report))
+	assert.Equal(t, int64(2), report.TotalAffected)
+	assert.Zero(t, rig.store.writes)
+	assert.Empty(t, rig.notifier.changes)
+
+	report = rig.runAt(t, start, 0, jobs.RunOptions{DryRun: true, UserID: "idle"})
+	assert.Equal(t, map[string]string{"idle": storage.InactivityWarned}, stages(report))
+}
+
+func TestUpcomingDeletions(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(d int) *time.Time { t := start.Add(days(d)); return &t }
+	rig := newInactivityRig(start,
+		&storage.InactiveAccount{UserID: "queued", LastActive: start.Add(-days(200)), Stage: storage.InactivityDeletionQueued, StageAt: at(-2)},
+		&storage.InactiveAccount{UserID: "warned", LastActive: start.Add(-days(105)), Stage: storage.InactivityDeletionWarned, StageAt: at(-5)},
+		&storage.InactiveAccount{UserID: "dormant", LastActive: start.Add(-days(60)), Stage: storage.InactivityDormant, StageAt: at(-40)},
+		&storage.InactiveAccount{UserID: "paid", Tier: "premium", LastActive: start.Add(-days(500)), Stage: storage.InactivityDeletionQueued, StageAt: at(-2)},
+	)
+
+	deletions, err := rig.job.UpcomingDeletions(days(30))
+	require.NoError(t, err)
+	require.Len(t, deletions, 2, "dormant isn't due for months, paid never is")
+	assert.Equal(t, "queued", deletions[0].UserID)
+	assert.Equal(t, start.Add(days(3)), deletions[0].DeleteAt)
+	assert.Equal(t, "warned", deletions[1].UserID)
+	assert.Equal(t, start.Add(days(10)), deletions[1].DeleteAt, "queued on day 5, deleted 5 days later")
+
+	deletions, err = rig.job.UpcomingDeletions(days(200))
+	require.NoError(t, err)
+	require.Len(t, deletions, 3)
+	assert.Equal(t, "dormant", deletions[2].UserID)
+	assert.Equal(t, start.Add(days(55)), deletions[2].DeleteAt)
+}
+
+func TestInactivityPolicyValidate(t *testing.T) {
+	assert.NoError(t, jobs.DefaultInactivityPolicy.Validate())
+	assert.NoError(t, testInactivityPolicy.Validate())
+
+	swapped := testInactivityPolicy
+	swapped.DormantAfter, swapped.WarnAfter = swapped.WarnAfter, swapped.DormantAfter
+	assert.Error(t, swapped.Validate())
+
+	noGrace := testInactivityPolicy
+	noGrace.DeletionGrace = 0
+	assert.Error(t, noGrace.Validate())
+}
+
+func TestMailFormatKeepsHeadersOnOneLine(t *testing.T) {
+	message := string(mail.Format("noreply@example.com", mail.Message{
+		To:      "user@example.com\r\nBcc: everyone@example.com",
+		Subject: "Hello\nX-Injected: yes",
+		Body:    "line one\nline two",
+	}))
+
+	headers, body, found := strings.Cut(message, "\r\n\r\n")
+	require.True(t, found)
+	assert.Equal(t, []string{
+		"From: noreply@example.com",
+		"To: user@example.comBcc: everyone@example.com",
+		"Subject: HelloX-Injected: yes",
+		"Content-Type: text/plain; charset=UTF-8",
+	}, strings.Split(headers, "\r\n"))
+	assert.Equal(t, "line one\r\nline two", body)
+}
@@ -0,0 +1,245 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore records every call so tests can prove a dry run has no side effects
+type countingStore struct {
+	summaries []*storage.TombstoneSummary
+	reads     int
+	writes    int
+	purged    map[string]time.Time
+	reports   []*storage.JobReport
+}
+
+func (s *countingStore) FindPurgeableTombstones(olderThan time.Time, userID string, sampleSize int) ([]*storage.TombstoneSummary, error) {
+	s.reads++
+	var result []*storage.TombstoneSummary
+	for _, summary := range s.summaries {
+		if userID != "" && summary.UserID != userID {
+			continue
+		}
+		copied := *summary
+		if len(copied.SampleItemUUIDs) > sampleSize {
+			copied.SampleItemUUIDs = copied.SampleItemUUIDs[:sampleSize]
+		}
+		result = append(result, &copied)
+	}
+	return result, nil
+}
+
+func (s *countingStore) PurgeTombstones(userID, zone string, olderThan time.Time) (int64, error) {
+	s.writes++
+	if s.purged == nil {
+		s.purged = make(map[string]time.Time)
+	}
+	s.purged[userID+"/"+zone] = olderThan
+	for _, summary := range s.summaries {
+		if summary.UserID == userID && summary.Zone == zone {
+			return summary.Count, nil
+		}
+	}
+	return 0, nil
+}
+
+func (s *countingStore) SaveJobReport(report *storage.JobReport) error {
+	report.ID = int64(len(s.reports) + 1)
+	s.reports = append(s.reports, report)
+	return nil
+}
+
+func newCountingStore() *countingStore {
+	return &countingStore{
+		summaries: []*storage.TombstoneSummary{
+			{UserID: "user-a", Zone: "default", Count: 3, SampleItemUUIDs: []string{"a1", "a2", "a3"}},
+			{UserID: "user-a", Zone: "work", Count: 1, SampleItemUUIDs: []string{"a4"}},
+			{UserID: "user-b", Zone: "default", Count: 2, SampleItemUUIDs: []string{"b1", "b2"}},
+		},
+	}
+}
+
+func TestTombstonePurgeJob(t *testing.T) {
+	t.Run("dry run reports impact without writing", func(t *testing.T) {
+		store := newCountingStore()
+		runner := jobs.NewRunner(store)
+		runner.Register(jobs.NewTombstonePurgeJob(store, time.Hour))
+
+		report, err := runner.Run(context.Background(), jobs.TombstonePurgeJobName, jobs.RunOptions{DryRun: true, SampleSize: 2})
+		require.NoError(t, err)
+
+		assert.Equal(t, 0, store.writes)
+		assert.Equal(t, 1, store.reads)
+		assert.True(t, report.DryRun)
+		assert.Equal(t, int64(6), report.TotalAffected)
+		require.Len(t, report.Users, 3)
+		assert.Equal(t, "user-a", report.Users[0].UserID)
+		assert.Equal(t, []string{"a1", "a2"}, report.Users[0].SampleItemUUIDs)
+
+		// The report is persisted for later review
+		require.Len(t, store.reports, 1)
+		assert.True(t, store.reports[0].DryRun)
+		assert.Equal(t, report.ID, store.reports[0].ID)
+
+		persisted, err := jobs.ReportFromStorage(store.reports[0])
+		require.NoError(t, err)
+		assert.Equal(t, report.Users, persisted.Users)
+	})
+
+	t.Run("real run purges each user and zone", func(t *testing.T) {
+		store := newCountingStore()
+		runner := jobs.NewRunner(store)
+		runner.Register(jobs.NewTombstonePurgeJob(store, time.Hour))
+
+		report, err := runner.Run(context.Background(), jobs.TombstonePurgeJobName, jobs.RunOptions{})
+		require.NoError(t, err)
+
+		assert.Equal(t, 3, store.writes)
+		assert.False(t, report.DryRun)
+		assert.Equal(t, int64(6), report.TotalAffected)
+		assert.Contains(t, store.purged, "user-a/work")
+	})
+
+	t.Run("dry run restricted to one user", func(t *testing.T) {
+		store := newCountingStore()
+		runner := jobs.NewRunner(store)
+		runner.Register(jobs.NewTombstonePurgeJob(store, time.Hour))
+
+		report, err := runner.Run(context.Background(), jobs.TombstonePurgeJobName, jobs.RunOptions{DryRun: true, UserID: "user-b"})
+		require.NoError(t, err)
+
+		assert.Equal(t, 0, store.writes)
+		require.Len(t, report.Users, 1)
+		assert.Equal(t, int64(2), report.TotalAffected)
+	})
+
+	t.Run("unknown job", func(t *testing.T) {
+		runner := jobs.NewRunner(nil)
+		_, err := runner.Run(context.Background(), "nope", jobs.RunOptions{DryRun: true})
+		assert.True(t, errors.Is(err, jobs.ErrUnknownJob))
+	})
+}
+
+// deviceStore stands in for the devices table in device deactivation tests
+type deviceStore struct {
+	candidates []*storage.StaleDevice
+	warned     []string
+	revoked    map[string][]string
+	writes     int
+}
+
+func (s *deviceStore) FindAutoDeactivationCandidates(now time.Time, warningDays int, userID string) ([]*storage.StaleDevice, error) {
+	var result []*storage.StaleDevice
+	for _, device := range s.candidates {
+		if userID == "" || device.UserID == userID {
+			result = append(result, device)
+		}
+	}
+	return result, nil
+}
+
+func (s *deviceStore) MarkDevicesWarned(deviceIDs []string, at time.Time) error {
+	s.writes++
+	s.warned = append(s.warned, deviceIDs...)
+	return nil
+}
+
+func (s *deviceStore) RevokeDevices(userID string, deviceIDs []string) ([]string, error) {
+	s.writes++
+	if s.revoked == nil {
+		s.revoked = make(map[string][]string)
+	}
+	s.revoked[userID] = append(s.revoked[userID], deviceIDs...)
+	return deviceIDs, nil
+}
+
+type recordingNotifier struct {
+	warnings    map[string]time.Time
+	deactivated map[string][]string
+}
+
+func (n *recordingNotifier) DeviceInactive(device *storage.StaleDevice, deactivateAt time.Time) {
+	if n.warnings == nil {
+		n.warnings = make(map[string]time.Time)
+	}
+	n.warnings[device.ID] = deactivateAt
+}
+
+func (n *recordingNotifier) DevicesDeactivated(userID string, deviceIDs []string) {
+	if n.deactivated == nil {
+		n.deactivated = make(map[string][]string)
+	}
+	n.deactivated[userID] = append(n.deactivated[userID], deviceIDs...)
+}
+
+func TestDeviceDeactivationJob(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	days := func(n int) time.Duration { return time.Duration(n) * 24 * time.Hour }
+	at := func(t time.Time) *time.Time { return &t }
+
+	newStore := func() *deviceStore {
+		return &deviceStore{candidates: []*storage.StaleDevice{
+			// 23 of 30 days idle, not yet warned: warned, due on day 30
+			{Device: storage.Device{ID: "laptop", UserID: "user-a"}, LastActive: now.Add(-days(23)), AutoDeactivateDays: 30},
+			// Past the deadline but never warned: gets a full week's notice
+			{Device: storage.Device{ID: "old-phone", UserID: "user-a"}, LastActive: now.Add(-days(90)), AutoDeactivateDays: 30},
+			// Warned 8 days ago and past the deadline: deactivated
+			{Device: storage.Device{ID: "tablet", UserID: "user-a"}, LastActive: now.Add(-days(31)), AutoDeactivateDays: 30, WarnedAt: at(now.Add(-days(8)))},
+			// Past the deadline, but warned only 3 days ago: still waiting
+			{Device: storage.Device{ID: "watch", UserID: "user-b"}, LastActive: now.Add(-days(40)), AutoDeactivateDays: 30, WarnedAt: at(now.Add(-days(3)))},
+		}}
+	}
+	newJob := func(store *deviceStore, notifier *recordingNotifier) *jobs.Runner {
+		job := jobs.NewDeviceDeactivationJob(store, notifier)
+		job.SetClock(clock.Frozen(now))
+		runner := jobs.NewRunner(nil)
+		runner.Register(job)
+		return runner
+	}
+
+	t.Run("dry run only reports", func(t *testing.T) {
+		store, notifier := newStore(), &recordingNotifier{}
+		report, err := newJob(store, notifier).Run(context.Background(), jobs.DeviceDeactivationJobName, jobs.RunOptions{DryRun: true})
+		require.NoError(t, err)
+
+		assert.Equal(t, 0, store.writes)
+		assert.Empty(t, notifier.warnings)
+		assert.Empty(t, notifier.deactivated)
+		assert.Equal(t, int64(1), report.TotalAffected)
+		require.Len(t, report.Users, 1, "a user with nothing due yet is left out")
+		assert.Equal(t, []string{"tablet"}, report.Users[0].DeviceIDs)
+		assert.Equal(t, int64(2), report.Users[0].Warned)
+	})
+
+	t.Run("real run warns, then deactivates a week later", func(t *testing.T) {
+		store, notifier := newStore(), &recordingNotifier{}
+		report, err := newJob(store, notifier).Run(context.Background(), jobs.DeviceDeactivationJobName, jobs.RunOptions{})
+		require.NoError(t, err)
+
+		assert.ElementsMatch(t, []string{"laptop", "old-phone"}, store.warned)
+		assert.Equal(t, now.Add(days(7)), notifier.warnings["laptop"], "due when the 30 days are up")
+		assert.Equal(t, now.Add(jobs.DeviceWarningPeriod), notifier.warnings["old-phone"], "never sooner than a week after the warning")
+
+		assert.Equal(t, map[string][]string{"user-a": {"tablet"}}, store.revoked)
+		assert.Equal(t, map[string][]string{"user-a": {"tablet"}}, notifier.deactivated)
+		assert.Equal(t, int64(1), report.TotalAffected)
+	})
+
+	t.Run("restricted to one user", func(t *testing.T) {
+		store, notifier := newStore(), &recordingNotifier{}
+		report, err := newJob(store, notifier).Run(context.Background(), jobs.DeviceDeactivationJobName, jobs.RunOptions{UserID: "user-b"})
+		require.NoError(t, err)
+
+		assert.Equal(t, 0, store.writes, "user-b's only device is still in its warning period")
+		assert.Empty(t, report.Users)
+	})
+}
@@ -0,0 +1,346 @@
+package unit
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/handlers"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setJWTConfig configures access tokens for the test, restoring the
+// previous configuration afterwards
+func setJWTConfig(t *testing.T, cfg auth.Config) {
+	t.Helper()
+	previous := auth.JWTConfig()
+	t.Cleanup(func() { require.NoError(t, auth.SetJWTConfig(previous)) })
+	require.NoError(t, auth.SetJWTConfig(cfg))
+}
+
+// signClaims signs claims with the configured secret, as GenerateAccessToken
+// would have with another configuration
+func signClaims(t *testing.T, claims jwt.RegisteredClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, auth.Claims{UserID: "user-1", RegisteredClaims: claims}).
+		SignedString(auth.JWTConfig().Secret)
+	require.NoError(t, err)
+	return token
+}
+
+func TestJWTConfig(t *testing.T) {
+	setJWTConfig(t, auth.Config{Secret: []byte("test-secret"), AccessTokenTTL: time.Hour, Issuer: "gateway", Audience: "mobile"})
+
+	token, err := auth.GenerateAccessToken("user-1", "a@example.com", "device-1", 2)
+	require.NoError(t, err)
+	claims, err := auth.ValidateToken(token)
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", claims.UserID)
+	assert.Equal(t, "gateway", claims.Issuer)
+	assert.Equal(t, jwt.ClaimStrings{"mobile"}, claims.Audience)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), claims.ExpiresAt.Time, time.Minute)
+
+	// SetJWTSecret keeps the rest
+	auth.SetJWTSecret([]byte("test-secret"))
+	assert.Equal(t, time.Hour, auth.JWTConfig().AccessTokenTTL)
+
+	assert.Error(t, auth.SetJWTConfig(auth.Config{AccessTokenTTL: -time.Minute}))
+}
+
+func TestJWTConfigDefaults(t *testing.T) {
+	setJWTConfig(t, auth.Config{Secret: []byte("test-secret"), AccessTokenTTL: time.Hour, Issuer: "gateway", Audience: "mobile"})
+	require.NoError(t, auth.SetJWTConfig(auth.Config{}))
+
+	cfg := auth.JWTConfig()
+	assert.Equal(t, []byte("test-secret"), cfg.Secret, "an empty secret keeps the current one")
+	assert.Equal(t, auth.DefaultAccessTokenTTL, cfg.AccessTokenTTL)
+	assert.Equal(t, auth.DefaultIssuer, cfg.Issuer)
+
+	// Without an audience none is set, and tokens naming one are fine
+	token, err := auth.GenerateAccessToken("user-1", "a@example.com", "", 0)
+	require.NoError(t, err)
+	claims, err := auth.ValidateToken(token)
+	require.NoError(t, err)
+	assert.Empty(t, claims.Audience)
+	_, err = auth.ValidateToken(signClaims(t, jwt.RegisteredClaims{
+		Issuer:    auth.DefaultIssuer,
+		Audience:  jwt.ClaimStrings{"web"},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}))
+	assert.NoError(t, err)
+}
+
+func TestJWTValidateRejects(t *testing.T) {
+	setJWTConfig(t, auth.Config{Secret: []byte("test-secret"), Issuer: "gateway", Audience: "mobile"})
+	valid := jwt.RegisteredClaims{
+		Issuer:    "gateway",
+		Audience:  jwt.ClaimStrings{"mobile"},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+	_, err := auth.ValidateToken(signClaims(t, valid))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		change func(*jwt.RegisteredClaims)
+		want   error
+	}{
+		{"expired", func(c *jwt.RegisteredClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }, auth.ErrExpiredToken},
+		{"without expiry", func(c *jwt.RegisteredClaims) { c.ExpiresAt = nil }, auth.ErrInvalidToken},
+		{"wrong audience", func(c *jwt.RegisteredClaims) { c.Audience = jwt.ClaimStrings{"web"} }, auth.ErrInvalidToken},
+		{"without audience", func(c *jwt.RegisteredClaims) { c.Audience = nil }, auth.ErrInvalidToken},
+		{"wrong issuer", func(c *jwt.RegisteredClaims) { c.Issuer = auth.DefaultIssuer }, auth.ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid
+			tt.change(&claims)
+			_, err := auth.ValidateToken(signClaims(t, claims))
+			assert.ErrorIs(t, err, tt.want)
+		})
+	}
+
+	t.Run("issued under another configuration", func(t *testing.T) {
+		token, err := auth.GenerateAccessToken("user-1", "a@example.com", "", 0)
+		require.NoError(t, err)
+		require.NoError(t, auth.SetJWTConfig(auth.Config{Issuer: "gateway", Audience: "web"}))
+		_, err = auth.ValidateToken(token)
+		assert.ErrorIs(t, err, auth.ErrInvalidToken)
+	})
+}
+
+// useJWTKeys signs access tokens with private for the test
+func useJWTKeys(t *testing.T, private crypto.Signer, public ...crypto.PublicKey) {
+	t.Helper()
+	t.Cleanup(func() { require.NoError(t, auth.SetJWTKeys(nil)) })
+	require.NoError(t, auth.SetJWTKeys(private, public...))
+}
+
+func TestJWTAsymmetricKeys(t *testing.T) {
+	setJWTConfig(t, auth.Config{Secret: []byte("test-secret")})
+	hmacToken, err := auth.GenerateAccessToken("user-1", "a@example.com", "", 0)
+	require.NoError(t, err)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	for _, key := range []crypto.Signer{rsaKey, edKey} {
+		useJWTKeys(t, key)
+		token, err := auth.GenerateAccessToken("user-1", "a@example.com", "", 0)
+		require.NoError(t, err)
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, &auth.Claims{})
+		require.NoError(t, err)
+		kid, err := auth.KeyID(key.Public())
+		require.NoError(t, err)
+		assert.Equal(t, kid, parsed.Header["kid"])
+
+		claims, err := auth.ValidateToken(token)
+		require.NoError(t, err)
+		assert.Equal(t, "user-1", claims.UserID)
+		_, err = auth.ValidateToken(hmacToken)
+		assert.ErrorIs(t, err, auth.ErrInvalidToken, "tokens signed with the secret are refused")
+	}
+
+	t.Run("rotation", func(t *testing.T) {
+		useJWTKeys(t, edKey)
+		old, err := auth.GenerateAccessToken("user-1", "a@example.com", "", 0)
+		require.NoError(t, err)
+
+		useJWTKeys(t, rsaKey, edKey.Public())
+		_, err = auth.ValidateToken(old)
+		assert.NoError(t, err, "the previous key is still accepted")
+		jwks := auth.JWKS()
+		require.Len(t, jwks.Keys, 2)
+		assert.Equal(t, "RSA", jwks.Keys[0].Kty, "the active key first")
+		assert.Equal(t, "OKP", jwks.Keys[1].Kty)
+		assert.Equal(t, "Ed25519", jwks.Keys[1].Crv)
+
+		useJWTKeys(t, rsaKey)
+		_, err = auth.ValidateToken(old)
+		assert.ErrorIs(t, err, auth.ErrInvalidToken, "dropped from the rotation")
+	})
+
+	t.Run("alg confusion", func(t *testing.T) {
+		useJWTKeys(t, rsaKey)
+		kid, err := auth.KeyID(rsaKey.Public())
+		require.NoError(t, err)
+		der, err := x509.MarshalPKIXPublicKey(rsaKey.Public())
+		require.NoError(t, err)
+		publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+		claims := auth.Claims{UserID: "user-1", RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    auth.DefaultIssuer,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		}}
+		for _, secret := range [][]byte{publicPEM, der} {
+			forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+			forged.Header["kid"] = kid
+			token, err := forged.SignedString(secret)
+			require.NoError(t, err)
+			_, err = auth.ValidateToken(token)
+			assert.ErrorIs(t, err, auth.ErrInvalidToken)
+		}
+
+		// An EdDSA token naming the RSA key's kid
+		forged := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+		forged.Header["kid"] = kid
+		token, err := forged.SignedString(edKey)
+		require.NoError(t, err)
+		_, err = auth.ValidateToken(token)
+		assert.ErrorIs(t, err, auth.ErrInvalidToken)
+
+		unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+		require.NoError(t, err)
+		_, err = auth.ValidateToken(unsigned)
+		assert.ErrorIs(t, err, auth.ErrInvalidToken)
+	})
+}
+
+// Once signing keys are set, a token signed with the secret, such as one
+// forged with the default secret, passes only until a fixed grace period
+// ends
+func TestJWTHMACGracePeriod(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	setJWTConfig(t, auth.Config{Secret: []byte("dev-secret-change-in-production")})
+	hmacToken, err := auth.GenerateAccessToken("user-1", "a@example.com", "", 0)
+	require.NoError(t, err)
+	useJWTKeys(t, edKey)
+
+	_, err = auth.ValidateToken(hmacToken)
+	assert.ErrorIs(t, err, auth.ErrInvalidToken, "no grace period")
+
+	setJWTConfig(t, auth.Config{HMACGraceUntil: time.Now().Add(time.Hour)})
+	claims, err := auth.ValidateToken(hmacToken)
+	require.NoError(t, err, "within the grace period")
+	assert.Equal(t, "user-1", claims.UserID)
+
+	setJWTConfig(t, auth.Config{HMACGraceUntil: time.Now().Add(-time.Second)})
+	_, err = auth.ValidateToken(hmacToken)
+	assert.ErrorIs(t, err, auth.ErrInvalidToken, "after the grace period")
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/protected", middleware.AuthMiddleware(nil), func(c *gin.Context) { c.Status(http.StatusOK) })
+	req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	req.Header.Set("Authorization", "Bearer "+hmacToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	require.NoError(t, auth.SetJWTKeys(nil))
+	_, err = auth.ValidateToken(hmacToken)
+	assert.NoError(t, err, "back to signing with the secret")
+}
+
+func TestJWTLoadKeysPEM(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	var publicPEM []byte
+	for i := 0; i < 2; i++ {
+		previous, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		der, err := x509.MarshalPKIXPublicKey(previous)
+		require.NoError(t, err)
+		publicPEM = append(publicPEM, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})...)
+	}
+
+	t.Cleanup(func() { require.NoError(t, auth.SetJWTKeys(nil)) })
+	require.NoError(t, auth.LoadJWTKeys(privatePEM, publicPEM))
+	assert.Len(t, auth.JWKS().Keys, 3)
+
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	weakPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(weak)})
+	assert.Error(t, auth.LoadJWTKeys(weakPEM, nil))
+	assert.Error(t, auth.LoadJWTKeys([]byte("not pem"), nil))
+	assert.Error(t, auth.LoadJWTKeys(privatePEM, privatePEM), "public keys must be PUBLIC KEY blocks")
+}
+
+func TestJWKSEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/.well-known/jwks.json", handlers.JWKS)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"keys":[]}`, w.Body.String(), "none while tokens use the secret")
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	useJWTKeys(t, edKey)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+
+	var jwks auth.JSONWebKeySet
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	require.Len(t, jwks.Keys, 1)
+	assert.Equal(t, "EdDSA", jwks.Keys[0].Alg)
+	assert.Equal(t, "sig", jwks.Keys[0].Use)
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey)), jwks.Keys[0].X)
+	assert.NotEmpty(t, w.Header().Get("Cache-Control"))
+}
+
+func TestAuthMiddlewareClaims(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	deviceID := "5f0c7a4e-8d1b-4e2a-9c3f-6b7a8d9e0f1a"
+	var seen struct {
+		userID, deviceID string
+		claims           *auth.Claims
+	}
+	router := gin.New()
+	router.GET("/protected", middleware.AuthMiddleware(nil), func(c *gin.Context) {
+		seen.userID = middleware.MustUserID(c)
+		seen.deviceID = middleware.DeviceID(c)
+		seen.claims, _ = middleware.Claims(c)
+	})
+	router.GET("/public", func(c *gin.Context) {
+		assert.Empty(t, middleware.UserID(c))
+		assert.Empty(t, middleware.DeviceID(c))
+		assert.Panics(t, func() { middleware.MustUserID(c) })
+	})
+
+	get := func(device string) {
+		token, err := auth.GenerateAccessToken("user-1", "a@example.com", device, 0)
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	get(deviceID)
+	assert.Equal(t, "user-1", seen.userID)
+	assert.Equal(t, deviceID, seen.deviceID)
+	require.NotNil(t, seen.claims)
+	assert.Equal(t, "a@example.com", seen.claims.Email)
+
+	// Older clients' device claims aren't device UUIDs
+	get("my-laptop")
+	assert.Empty(t, seen.deviceID)
+	assert.Equal(t, "my-laptop", seen.claims.DeviceID)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/public", nil))
+}
@@ -0,0 +1,164 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/handlers"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newHoldRouter serves the destructive sync routes behind the real auth
+// middleware. The handlers have no store: a held account must be rejected
+// before anything is read or written.
+func newHoldRouter(t *testing.T, source *profileSource) func(method, path string, body interface{}) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	cache := auth.NewProfileCache(source, auth.ProfileCacheOptions{TTL: time.Hour})
+	syncHandler := handlers.NewSyncHandler(nil, nil)
+
+	router := gin.New()
+	protected := router.Group("/", middleware.AuthMiddleware(cache))
+	protected.DELETE("/sync/credentials", syncHandler.DeleteAllCredentials)
+	protected.POST("/sync/push", syncHandler.PushSync)
+
+	return func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		token, err := auth.GenerateAccessToken(profileUserID, "a@example.com", "", 0)
+		require.NoError(t, err)
+
+		var payload bytes.Buffer
+		if body != nil {
+			require.NoError(t, json.NewEncoder(&payload).Encode(body))
+		}
+		req := httptest.NewRequest(method, path, &payload)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+}
+
+func assertOnHold(t *testing.T, w *httptest.ResponseRecorder) {
+	t.Helper()
+	assert.Equal(t, http.StatusLocked, w.Code)
+	var body map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "account on hold", body["error"])
+	assert.Equal(t, "legal_hold", body["code"])
+}
+
+func TestLegalHoldBlocksDeleteAll(t *testing.T) {
+	source := newProfileSource()
+	source.update(func(p *auth.Profile) { p.LegalHold = true })
+	request := newHoldRouter(t, source)
+
+	assertOnHold(t, request(http.MethodDelete, "/sync/credentials?zone=work", nil))
+}
+
+func TestLegalHoldBlocksItemDeletes(t *testing.T) {
+	source := newProfileSource()
+	source.update(func(p *auth.Profile) { p.LegalHold = true })
+	request := newHoldRouter(t, source)
+
+	tombstone := map[string]interface{}{"item_uuid": "6f1c2b3a-4d5e-4f60-8a7b-9c0d1e2f3a4b", "tombstone": true}
+	for layer, item := range map[string]map[string]interface{}{
+		"keys":                tombstone,
+		"credential_metadata": tombstone,
+		"sync_records":        tombstone,
+	} {
+		w := request(http.MethodPost, "/sync/push", map[string]interface{}{
+			"zone": "default",
+			layer:  []interface{}{item},
+		})
+		assertOnHold(t, w)
+	}
+}
+
+func TestLegalHoldRejectsUntilLifted(t *testing.T) {
+	source := newProfileSource()
+	cache := auth.NewProfileCache(source, auth.ProfileCacheOptions{TTL: time.Hour})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.DELETE("/sync/credentials", middleware.AuthMiddleware(cache), func(c *gin.Context) {
+		hold, _ := c.Get("legal_hold")
+		c.JSON(http.StatusOK, gin.H{"legal_hold": hold})
+	})
+	request := func() bool {
+		token, err := auth.GenerateAccessToken(profileUserID, "a@example.com", "", 0)
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodDelete, "/sync/credentials", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var body map[string]bool
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return body["legal_hold"]
+	}
+
+	assert.False(t, request())
+
+	// Placing the hold invalidates the cached profile, like storage's
+	// OnUserChanged hook does
+	source.update(func(p *auth.Profile) { p.LegalHold = true })
+	cache.Invalidate(context.Background(), profileUserID)
+	assert.True(t, request())
+
+	source.update(func(p *auth.Profile) { p.LegalHold = false })
+	cache.Invalidate(context.Background(), profileUserID)
+	assert.False(t, request())
+}
+
+func TestTombstonePurgeSkipsLegalHold(t *testing.T) {
+	newStore := func() *countingStore {
+		store := newCountingStore()
+		store.summaries[2] = &storage.TombstoneSummary{
+			UserID: "user-b", Zone: "default", Count: 2, SampleItemUUIDs: []string{"b1", "b2"}, LegalHold: true,
+		}
+		return store
+	}
+
+	t.Run("dry run leaves held users out", func(t *testing.T) {
+		store := newStore()
+		runner := jobs.NewRunner(store)
+		runner.Register(jobs.NewTombstonePurgeJob(store, time.Hour))
+		skipped := metrics.Value(jobs.MetricLegalHoldSkipped)
+
+		report, err := runner.Run(context.Background(), jobs.TombstonePurgeJobName, jobs.RunOptions{DryRun: true})
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(4), report.TotalAffected)
+		for _, impact := range report.Users {
+			assert.NotEqual(t, "user-b", impact.UserID)
+		}
+		assert.Equal(t, skipped, metrics.Value(jobs.MetricLegalHoldSkipped), "dry runs don't count skips")
+	})
+
+	t.Run("real run never purges a held user", func(t *testing.T) {
+		store := newStore()
+		runner := jobs.NewRunner(store)
+		runner.Register(jobs.NewTombstonePurgeJob(store, time.Hour))
+		skipped := metrics.Value(jobs.MetricLegalHoldSkipped)
+
+		report, err := runner.Run(context.Background(), jobs.TombstonePurgeJobName, jobs.RunOptions{})
+		require.NoError(t, err)
+
+		assert.Equal(t, 2, store.writes)
+		assert.NotContains(t, store.purged, "user-b/default")
+		assert.Equal(t, int64(4), report.TotalAffected)
+		assert.Equal(t, skipped+1, metrics.Value(jobs.MetricLegalHoldSkipped))
+	})
+}
@@ -0,0 +1,58 @@
+package unit
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/server/domain/limits"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTierPolicy(t *testing.T) {
+	policy := limits.DefaultPolicy()
+	assert.Equal(t, limits.Limits{Credentials: limits.DefaultFreeCredentials, Devices: limits.DefaultFreeDevices}, policy.For(limits.TierFree))
+	assert.Equal(t, limits.TierFree, policy.Tier("platinum"), "an unknown tier gets the free limits")
+	assert.Equal(t, policy.For(limits.TierFree), policy.For(""))
+
+	assert.NoError(t, policy.Check(limits.TierFree, limits.ResourceDevices, 1, 1))
+	assert.NoError(t, policy.Check(limits.TierFree, limits.ResourceDevices, 5, 0), "adding nothing passes over the limit")
+	assert.NoError(t, policy.Check(limits.TierPremium, limits.ResourceCredentials, 1000, 1000))
+
+	err := policy.Check("platinum", limits.ResourceDevices, 2, 1)
+	var limitErr *limits.LimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, limits.LimitError{Tier: limits.TierFree, Resource: limits.ResourceDevices, Limit: 2, Used: 2, Adding: 1}, *limitErr)
+}
+
+func TestAccountLimits(t *testing.T) {
+	t.Setenv("FREE_TIER_MAX_CREDENTIALS", "1")
+	s := newImportServer(t)
+	alice := s.register("alice@example.com")
+
+	empty := s.do(alice, http.MethodGet, "/api/v1/account/limits", nil, http.StatusOK)
+	assert.Equal(t, limits.TierFree, empty["tier"])
+	assert.Equal(t, map[string]interface{}{"used": float64(0), "limit": float64(1)}, empty["credentials"])
+	assert.Equal(t, map[string]interface{}{"used": float64(0), "limit": float64(limits.DefaultFreeDevices)}, empty["devices"])
+
+	s.pushCredential(alice, "default")
+	full := s.do(alice, http.MethodGet, "/api/v1/account/limits", nil, http.StatusOK)
+	assert.Equal(t, float64(1), full["credentials"].(map[string]interface{})["used"])
+
+	refused := s.do(alice, http.MethodPost, "/api/v1/sync/push",
+		[]byte(`{"zone":"work","credential_metadata":[{"item_uuid":"`+uuid.New().String()+`","server":"example.com","account":"bob",`+
+			`"password_key_uuid":"`+uuid.New().String()+`"}]}`),
+		http.StatusForbidden)
+	assert.Equal(t, "quota_exceeded", refused["code"])
+	assert.Equal(t, limits.ResourceCredentials, refused["resource"])
+	assert.Equal(t, float64(1), refused["limit"])
+
+	// An import counts against the same limit
+	doc := s.export(alice)
+	bob := s.register("bob@example.com")
+	s.pushCredential(bob, "default")
+	merged := s.do(bob, http.MethodPost, "/api/v1/sync/import?merge=true", doc, http.StatusForbidden)
+	assert.Equal(t, "quota_exceeded", merged["code"])
+	assert.Equal(t, float64(1), merged["adding"])
+}
@@ -0,0 +1,122 @@
+package unit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// manifestStore keeps one zone's sync_state next to the live items it summarizes
+type manifestStore struct {
+	state   storage.SyncState
+	leaves  []sync.ManifestLeaf
+	upserts int
+}
+
+func (s *manifestStore) GetSyncState(userID, zone string) (*storage.SyncState, error) {
+	state := s.state
+	return &state, nil
+}
+
+func (s *manifestStore) ComputeManifest(ctx context.Context, userID, zone string) (*storage.ManifestState, error) {
+	return &storage.ManifestState{
+		UserID:    userID,
+		Zone:      zone,
+		LeafCount: len(s.leaves),
+		Digest:    sync.ManifestDigest(s.leaves),
+	}, nil
+}
+
+func (s *manifestStore) UpsertSyncState(userID, zone string, genCount int64, digest []byte) error {
+	s.upserts++
+	s.state.GenCount = genCount
+	s.state.Digest = digest
+	return nil
+}
+
+func (s *manifestStore) SampleUserZones(fraction float64, limit int) ([]storage.UserZone, error) {
+	return []storage.UserZone{{UserID: s.state.UserID, Zone: s.state.Zone}}, nil
+}
+
+func newCorruptedManifestStore() *manifestStore {
+	leaves := []sync.ManifestLeaf{
+		{Layer: sync.LeafSyncRecord, ItemUUID: "b-item", GenCount: 2},
+		{Layer: sync.LeafSyncRecord, ItemUUID: "a-item", GenCount: 1},
+		{Layer: sync.LeafCryptoKey, ItemUUID: "c-key", GenCount: 7},
+	}
+	return &manifestStore{
+		state: storage.SyncState{
+			UserID:   "user-a",
+			Zone:     "default",
+			GenCount: 7,
+			// Digest of a stale leaf set (c-key missing)
+			Digest: sync.ManifestDigest(leaves[:2]),
+		},
+		leaves: leaves,
+	}
+}
+
+func TestCheckManifest(t *testing.T) {
+	t.Run("corrupted digest is detected and repaired", func(t *testing.T) {
+		store := newCorruptedManifestStore()
+		detectedBefore := metrics.Value(jobs.MetricManifestDriftDetected)
+
+		check, err := jobs.CheckManifest(context.Background(), store, "user-a", "default", true)
+		require.NoError(t, err)
+
+		assert.True(t, check.Drift)
+		assert.True(t, check.Repaired)
+		assert.Equal(t, 3, check.LeafCount)
+		assert.Equal(t, 1, store.upserts)
+		assert.Equal(t, int64(7), store.state.GenCount, "repair must not bump gencount")
+		assert.Equal(t, check.ComputedDigest, store.state.Digest)
+		assert.Equal(t, detectedBefore+1, metrics.Value(jobs.MetricManifestDriftDetected))
+
+		// A second check finds nothing to repair
+		again, err := jobs.CheckManifest(context.Background(), store, "user-a", "default", true)
+		require.NoError(t, err)
+		assert.False(t, again.Drift)
+		assert.False(t, again.Repaired)
+		assert.Equal(t, 1, store.upserts)
+	})
+
+	t.Run("check without repair does not write", func(t *testing.T) {
+		store := newCorruptedManifestStore()
+
+		check, err := jobs.CheckManifest(context.Background(), store, "user-a", "default", false)
+		require.NoError(t, err)
+
+		assert.True(t, check.Drift)
+		assert.False(t, check.Repaired)
+		assert.Equal(t, 0, store.upserts)
+	})
+
+	t.Run("zone without sync state is not drift", func(t *testing.T) {
+		store := &manifestStore{state: storage.SyncState{UserID: "user-a", Zone: "default"}}
+
+		check, err := jobs.CheckManifest(context.Background(), store, "user-a", "default", true)
+		require.NoError(t, err)
+		assert.False(t, check.Drift)
+		assert.Equal(t, 0, store.upserts)
+	})
+
+	t.Run("sampled job reports drift without repairing", func(t *testing.T) {
+		store := newCorruptedManifestStore()
+		runner := jobs.NewRunner(nil)
+		runner.Register(jobs.NewManifestDriftJob(store, 0.5, 10))
+
+		report, err := runner.Run(context.Background(), jobs.ManifestDriftJobName, jobs.RunOptions{})
+		require.NoError(t, err)
+
+		assert.Equal(t, int64(1), report.TotalAffected)
+		require.Len(t, report.Users, 1)
+		assert.Equal(t, "user-a", report.Users[0].UserID)
+		assert.Equal(t, 0, store.upserts)
+	})
+}
@@ -0,0 +1,234 @@
+package unit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const mappingUserID = "7f8a1b52-3c4d-4e5f-8a9b-0c1d2e3f4a5b"
+
+func TestToCryptoKey(t *testing.T) {
+	itemID := uuid.New()
+
+	t.Run("applies defaults", func(t *testing.T) {
+		key, err := mapping.ToCryptoKey(mapping.CryptoKeyDTO{
+			ItemUUID: itemID.String(),
+			Data:     []byte("ciphertext"),
+			Flags:    []byte(`{"encrypt":true}`),
+		}, mappingUserID, "default", 12)
+		require.NoError(t, err)
+
+		assert.Equal(t, itemID, key.ItemUUID)
+		assert.Equal(t, mapping.DefaultAccessGroup, key.AccGroup)
+		assert.Equal(t, int64(12), key.GenCount)
+		assert.Nil(t, key.Label)
+	})
+
+	t.Run("tombstone without key material", func(t *testing.T) {
+		key, err := mapping.ToCryptoKey(mapping.CryptoKeyDTO{ItemUUID: itemID.String(), Tombstone: true}, mappingUserID, "default", 1)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{}, key.Data)
+		assert.Equal(t, []byte("{}"), key.Flags)
+	})
+
+	tests := []struct {
+		name  string
+		dto   mapping.CryptoKeyDTO
+		field string
+	}{
+		{"missing item uuid", mapping.CryptoKeyDTO{Data: []byte("x"), Flags: []byte("{}")}, "item_uuid"},
+		{"bad item uuid", mapping.CryptoKeyDTO{ItemUUID: "nope", Data: []byte("x"), Flags: []byte("{}")}, "item_uuid"},
+		{"missing data", mapping.CryptoKeyDTO{ItemUUID: itemID.String(), Flags: []byte("{}")}, "data"},
+		{"flags not json", mapping.CryptoKeyDTO{ItemUUID: itemID.String(), Data: []byte("x"), Flags: []byte("{")}, "usage_flags"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := mapping.ToCryptoKey(tt.dto, mappingUserID, "default", 1)
+			var fieldErr *mapping.FieldError
+			require.True(t, errors.As(err, &fieldErr))
+			assert.Equal(t, mapping.LayerCryptoKey, fieldErr.Layer)
+			assert.Equal(t, tt.field, fieldErr.Field)
+		})
+	}
+
+	t.Run("bad user id", func(t *testing.T) {
+		_, err := mapping.ToCryptoKey(mapping.CryptoKeyDTO{ItemUUID: itemID.String(), Tombstone: true}, "", "default", 1)
+		var fieldErr *mapping.FieldError
+		require.True(t, errors.As(err, &fieldErr))
+		assert.Equal(t, "user_id", fieldErr.Field)
+	})
+}
+
+func TestToCredentialMetadata(t *testing.T) {
+	dto := mapping.CredentialMetadataDTO{
+		ItemUUID:        uuid.NewString(),
+		Server:          "github.com",
+		Account:         "octocat",
+		PasswordKeyUUID: uuid.NewString(),
+	}
+
+	cred, err := mapping.ToCredentialMetadata(dto, mappingUserID, "default", 3)
+	require.NoError(t, err)
+	assert.Equal(t, mapping.DefaultProtocol, cred.Protocol)
+	assert.Equal(t, 443, cred.Port, "the port defaults to the protocol's")
+	assert.Equal(t, mapping.DefaultAccessGroup, cred.AccGroup)
+	assert.Nil(t, cred.MetadataKeyUUID)
+
+	t.Run("empty metadata key uuid is unset", func(t *testing.T) {
+		empty := ""
+		withEmpty := dto
+		withEmpty.MetadataKeyUUID = &empty
+		cred, err := mapping.ToCredentialMetadata(withEmpty, mappingUserID, "default", 3)
+		require.NoError(t, err)
+		assert.Nil(t, cred.MetadataKeyUUID)
+	})
+
+	t.Run("invalid metadata key uuid is rejected", func(t *testing.T) {
+		bad := "not-a-uuid"
+		withBad := dto
+		withBad.MetadataKeyUUID = &bad
+		_, err := mapping.ToCredentialMetadata(withBad, mappingUserID, "default", 3)
+		var fieldErr *mapping.FieldError
+		require.True(t, errors.As(err, &fieldErr))
+		assert.Equal(t, "metadata_key_uuid", fieldErr.Field)
+	})
+
+	t.Run("port out of range", func(t *testing.T) {
+		withPort := dto
+		withPort.Port = 70000
+		_, err := mapping.ToCredentialMetadata(withPort, mappingUserID, "default", 3)
+		var fieldErr *mapping.FieldError
+		require.True(t, errors.As(err, &fieldErr))
+		assert.Equal(t, "port", fieldErr.Field)
+	})
+}
+
+func TestToSyncRecord(t *testing.T) {
+	record, err := mapping.ToSyncRecord(mapping.SyncRecordDTO{
+		ItemUUID:   uuid.NewString(),
+		WrappedKey: []byte("wk"),
+		EncItem:    []byte("ei"),
+	}, mappingUserID, "default", 9)
+	require.NoError(t, err)
+	assert.Equal(t, mapping.DefaultEncVersion, record.EncVersion)
+	assert.Equal(t, mapping.DefaultContextID, record.ContextID)
+	assert.Nil(t, record.ParentKeyUUID)
+
+	_, err = mapping.ToSyncRecord(mapping.SyncRecordDTO{ItemUUID: uuid.NewString(), WrappedKey: []byte("wk")}, mappingUserID, "default", 9)
+	var fieldErr *mapping.FieldError
+	require.True(t, errors.As(err, &fieldErr))
+	assert.Equal(t, "enc_item", fieldErr.Field)
+}
+
+// Fuzz targets: whatever JSON a client pushes, conversion must not panic,
+// must only fail with a FieldError, and must round-trip through the response DTO.
+
+func assertFieldError(t *testing.T, err error) {
+	var fieldErr *mapping.FieldError
+	if !errors.As(err, &fieldErr) {
+		t.Fatalf("unstructured error %T: %v", err, err)
+	}
+}
+
+func FuzzToCryptoKey(f *testing.F) {
+	f.Add([]byte(`{"item_uuid":"` + uuid.NewString() + `","key_class":0,"key_type":1,"data":"AAEC","usage_flags":"e30="}`))
+	f.Add([]byte(`{"item_uuid":"` + uuid.NewString() + `","tombstone":true}`))
+	f.Add([]byte(`{"item_uuid":"x","key_class":-1}`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		var dto mapping.CryptoKeyDTO
+		if json.Unmarshal(body, &dto) != nil {
+			return
+		}
+		key, err := mapping.ToCryptoKey(dto, mappingUserID, "default", 1)
+		if err != nil {
+			assertFieldError(t, err)
+			return
+		}
+		again, err := mapping.ToCryptoKey(mapping.FromCryptoKey(key), mappingUserID, "default", 1)
+		require.NoError(t, err)
+		assert.Equal(t, key, again)
+	})
+}
+
+func FuzzToCredentialMetadata(f *testing.F) {
+	f.Add([]byte(`{"item_uuid":"` + uuid.NewString() + `","server":"a.com","account":"me","password_key_uuid":"` + uuid.NewString() + `"}`))
+	f.Add([]byte(`{"item_uuid":"` + uuid.NewString() + `","password_key_uuid":"` + uuid.NewString() + `","metadata_key_uuid":null,"tombstone":true}`))
+	f.Add([]byte(`{"item_uuid":"","port":-5,"metadata_key_uuid":"zz"}`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		var dto mapping.CredentialMetadataDTO
+		if json.Unmarshal(body, &dto) != nil {
+			return
+		}
+		cred, err := mapping.ToCredentialMetadata(dto, mappingUserID, "default", 1)
+		if err != nil {
+			assertFieldError(t, err)
+			return
+		}
+		for _, schema := range []int{mapping.LegacySyncSchemaVersion, mapping.SyncSchemaVersion} {
+			again, err := mapping.ToCredentialMetadata(mapping.FromCredentialMetadata(cred, schema), mappingUserID, "default", 1)
+			require.NoError(t, err)
+			assert.Equal(t, cred, again)
+		}
+	})
+}
+
+func FuzzToSyncRecord(f *testing.F) {
+	f.Add([]byte(`{"item_uuid":"` + uuid.NewString() + `","wrapped_key":"AQ==","enc_item":"Ag==","enc_version":2}`))
+	f.Add([]byte(`{"item_uuid":"` + uuid.NewString() + `","parent_key_uuid":"` + uuid.NewString() + `","tombstone":true}`))
+	f.Add([]byte(`{"item_uuid":"` + uuid.NewString() + `","parent_key_uuid":"bad","enc_version":99999}`))
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		var dto mapping.SyncRecordDTO
+		if json.Unmarshal(body, &dto) != nil {
+			return
+		}
+		record, err := mapping.ToSyncRecord(dto, mappingUserID, "default", 1)
+		if err != nil {
+			assertFieldError(t, err)
+			return
+		}
+		again, err := mapping.ToSyncRecord(mapping.FromSyncRecord(record), mappingUserID, "default", 1)
+		require.NoError(t, err)
+		assert.Equal(t, record, again)
+	})
+}
+
+func TestNewPullLayers(t *testing.T) {
+	yes, no := true, false
+	flag := func(include bool) *bool {
+		if include {
+			return &yes
+		}
+		return &no
+	}
+
+	assert.Equal(t, mapping.PullLayers{Keys: true, Metadata: true, Records: true},
+		mapping.NewPullLayers(nil, nil, nil), "omitted flags include every layer")
+
+	for _, keys := range []bool{true, false} {
+		for _, metadata := range []bool{true, false} {
+			for _, records := range []bool{true, false} {
+				name := fmt.Sprintf("keys=%v,metadata=%v,records=%v", keys, metadata, records)
+				t.Run(name, func(t *testing.T) {
+					layers := mapping.NewPullLayers(flag(keys), flag(metadata), flag(records))
+					assert.Equal(t, mapping.PullLayers{Keys: keys, Metadata: metadata, Records: records}, layers)
+				})
+			}
+		}
+	}
+
+	t.Run("echoed with the response's layer names", func(t *testing.T) {
+		data, err := json.Marshal(mapping.NewPullLayers(&no, nil, &no))
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"keys":false,"credential_metadata":true,"sync_records":false}`, string(data))
+	})
+}
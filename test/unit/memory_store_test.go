@@ -0,0 +1,508 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api"
+	"github.com/deeplyprofound/password-sync/server/clock"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pullWindow lists what a pull of the range returns, layer by layer, as
+// "layer item gencount tombstone" lines
+func pullWindow(t *testing.T, store storage.Store, userID string, r storage.PullRange) []string {
+	t.Helper()
+	ctx := context.Background()
+	var lines []string
+	keys, err := store.GetCryptoKeysPage(ctx, userID, r)
+	require.NoError(t, err)
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("key %s %d %t", k.ItemUUID, k.GenCount, k.Tombstone))
+	}
+	creds, err := store.GetCredentialMetadataPage(ctx, userID, r)
+	require.NoError(t, err)
+	for _, m := range creds {
+		lines = append(lines, fmt.Sprintf("metadata %s %d %t", m.ItemUUID, m.GenCount, m.Tombstone))
+	}
+	records, err := store.GetSyncRecordsPage(ctx, userID, r)
+	require.NoError(t, err)
+	for _, rec := range records {
+		lines = append(lines, fmt.Sprintf("record %s %d %t", rec.ItemUUID, rec.GenCount, rec.Tombstone))
+	}
+	return lines
+}
+
+// TestMemoryStoreMatchesSQLite replays the same pushes, deletes and wipes on
+// both stores and compares what pulls of every kind return
+func TestMemoryStoreMatchesSQLite(t *testing.T) {
+	ctx := context.Background()
+	first, firstCred := sqliteBatch("default")
+	second, secondCred := sqliteBatch("default")
+	other, _ := sqliteBatch("work")
+
+	replay := func(store storage.Store) (string, *storage.SyncState) {
+		user, err := store.CreateUser("alice@example.com", []byte("hash"), []byte("salt"), "")
+		require.NoError(t, err)
+		for _, batch := range []*storage.PushBatch{first, second, other} {
+			rejected, err := store.CommitPush(ctx, user.ID, batch)
+			require.NoError(t, err)
+			require.Empty(t, rejected)
+		}
+
+		_, err = store.DeleteCredential(ctx, user.ID, &storage.CredentialDeleteRequest{Zone: "default", ItemUUID: firstCred})
+		require.NoError(t, err)
+		_, err = store.WipeZone(ctx, user.ID, &storage.WipeRequest{Zone: "work", RecoverUntil: time.Now().Add(time.Hour)})
+		require.NoError(t, err)
+
+		state, err := store.GetSyncState(user.ID, "default")
+		require.NoError(t, err)
+		return user.ID, state
+	}
+
+	sqlite, memory := newSQLiteStore(t), storage.NewMemoryStore()
+	sqliteUser, sqliteState := replay(sqlite)
+	memoryUser, memoryState := replay(memory)
+	assert.Equal(t, sqliteState.GenCount, memoryState.GenCount)
+	assert.Equal(t, sqliteState.Digest, memoryState.Digest)
+
+	ranges := []storage.PullRange{
+		{Zone: "default"},
+		{Zone: "default", IncludeTombstoned: true},
+		{Zone: "default", Since: 4, IncludeTombstoned: true},
+		{Zone: "default", Since: 4},
+		{Zone: "default", IncludeTombstoned: true, Limit: 2, Offset: 1},
+		{Zone: "default", IncludeTombstoned: true, Until: 6},
+		{Zone: "work", IncludeTombstoned: true},
+		{Zone: "none"},
+		{Zone: "default", IncludeTombstoned: true, ItemUUIDs: []uuid.UUID{firstCred, uuid.New()}},
+		{Zone: "default", Since: 4, ItemUUIDs: []uuid.UUID{secondCred}},
+		{Zone: "default", IncludeTombstoned: true, ItemUUIDs: []uuid.UUID{}},
+	}
+	for _, r := range ranges {
+		want := pullWindow(t, sqlite, sqliteUser, r)
+		assert.Equal(t, want, pullWindow(t, memory, memoryUser, r), "%+v", r)
+
+		wantCounts, err := sqlite.CountPullWindow(ctx, sqliteUser, r)
+		require.NoError(t, err)
+		counts, err := memory.CountPullWindow(ctx, memoryUser, r)
+		require.NoError(t, err)
+		assert.Equal(t, wantCounts, counts, "%+v", r)
+	}
+
+	leaves, err := memory.LiveLeafIDs(ctx, memoryUser, "default")
+	require.NoError(t, err)
+	assert.Equal(t, []string{secondCred.String()}, leaves)
+
+	for _, zone := range []string{"default", "work"} {
+		want, err := sqlite.ComputeManifest(ctx, sqliteUser, zone)
+		require.NoError(t, err)
+		got, err := memory.ComputeManifest(ctx, memoryUser, zone)
+		require.NoError(t, err)
+		assert.Equal(t, want.LeafCount, got.LeafCount, zone)
+		assert.Equal(t, want.Digest, got.Digest, zone)
+
+		wantLeaves, err := sqlite.ManifestLeaves(ctx, sqliteUser, zone)
+		require.NoError(t, err)
+		gotLeaves, err := memory.ManifestLeaves(ctx, memoryUser, zone)
+		require.NoError(t, err)
+		assert.Len(t, wantLeaves, want.LeafCount, zone)
+		assert.Equal(t, want.Digest, sync.ManifestDigest(wantLeaves), zone)
+		assert.Equal(t, wantLeaves, gotLeaves, zone)
+	}
+}
+
+func TestStoresQueueAndResolveConflicts(t *testing.T) {
+	ctx := context.Background()
+	batch, credID := sqliteBatch("default")
+
+	replay := func(store storage.Store) *storage.SyncState {
+		user, err := store.CreateUser("alice@example.com", []byte("hash"), []byte("salt"), "")
+		require.NoError(t, err)
+		_, err = store.CommitPush(ctx, user.ID, batch)
+		require.NoError(t, err)
+
+		// A second held-back push of the item takes the place of the first
+		queue := func(encItem string) *storage.SyncConflict {
+			pushed := *batch.Records[0]
+			pushed.EncItem = []byte(encItem)
+			conflict := &storage.SyncConflict{Zone: "default", ItemUUID: credID, BaseGenCount: 1, StoredGenCount: 3, Pushed: &pushed}
+			require.NoError(t, store.QueueConflicts(ctx, user.ID, []*storage.SyncConflict{conflict}))
+			return conflict
+		}
+		first, second := queue("theirs"), queue("theirs, later")
+		assert.Equal(t, first.ID, second.ID)
+		pending, err := store.ListConflicts(ctx, user.ID, "default")
+		require.NoError(t, err)
+		require.Len(t, pending, 1)
+		assert.Equal(t, []byte("theirs, later"), pending[0].Pushed.EncItem)
+		assert.Equal(t, batch.Records[0].ParentKeyUUID, pending[0].Pushed.ParentKeyUUID)
+		assert.Nil(t, pending[0].DeviceID)
+
+		_, err = store.ResolveConflict(ctx, user.ID, &storage.ConflictResolveRequest{ID: second.ID, Zone: "work", Resolution: sync.ResolutionClientWins})
+		assert.ErrorIs(t, err, sql.ErrNoRows, "another zone's")
+		resolved, err := store.ResolveConflict(ctx, user.ID, &storage.ConflictResolveRequest{ID: second.ID, Zone: "default", Resolution: sync.ResolutionClientWins})
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), resolved.GenCount)
+		require.NotNil(t, resolved.Conflict.Resolution)
+		assert.Equal(t, sync.ResolutionClientWins, *resolved.Conflict.Resolution)
+
+		// Keeping the stored record renumbers it
+		third := queue("theirs again")
+		assert.NotEqual(t, second.ID, third.ID)
+		resolved, err = store.ResolveConflict(ctx, user.ID, &storage.ConflictResolveRequest{ID: third.ID, Zone: "default", Resolution: sync.ResolutionServerWins})
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), resolved.GenCount)
+		_, err = store.ResolveConflict(ctx, user.ID, &storage.ConflictResolveRequest{ID: third.ID, Zone: "default", Resolution: sync.ResolutionClientWins})
+		assert.ErrorIs(t, err, sql.ErrNoRows, "resolved")
+
+		pending, err = store.ListConflicts(ctx, user.ID, "default")
+		require.NoError(t, err)
+		assert.Empty(t, pending)
+		records, err := store.GetSyncRecordsPage(ctx, user.ID, storage.PullRange{Zone: "default"})
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		assert.Equal(t, []byte("theirs, later"), records[0].EncItem)
+		assert.Equal(t, int64(5), records[0].GenCount)
+
+		state, err := store.GetSyncState(user.ID, "default")
+		require.NoError(t, err)
+		manifest, err := store.ComputeManifest(ctx, user.ID, "default")
+		require.NoError(t, err)
+		assert.Equal(t, manifest.Digest, state.Digest)
+		return state
+	}
+
+	sqliteState := replay(newSQLiteStore(t))
+	memoryState := replay(storage.NewMemoryStore())
+	assert.Equal(t, int64(5), sqliteState.GenCount)
+	assert.Equal(t, sqliteState.GenCount, memoryState.GenCount)
+	assert.Equal(t, sqliteState.Digest, memoryState.Digest)
+}
+
+func TestMemoryStoreRejectsItemAlone(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryStore()
+	user, err := store.CreateUser("alice@example.com", []byte("hash"), []byte("salt"), "")
+	require.NoError(t, err)
+
+	batch, _ := sqliteBatch("default")
+	batch.Records[0].EncItem = nil // NOT NULL
+	rejected, err := store.CommitPush(ctx, user.ID, batch)
+	require.NoError(t, err)
+	require.Len(t, rejected, 1)
+	assert.Equal(t, "sync_record", rejected[0].Layer)
+	var constraint *storage.MemoryConstraintError
+	assert.True(t, errors.As(rejected[0].Err, &constraint))
+
+	counts, err := store.CountPullWindow(ctx, user.ID, storage.PullRange{Zone: "default"})
+	require.NoError(t, err)
+	assert.Equal(t, storage.PullCounts{Keys: 1, Metadata: 1}, *counts)
+
+	device, err := store.CreateDevice(user.ID, "Phone", "ios", nil, 0, nil)
+	require.NoError(t, err)
+	batch, _ = sqliteBatch("default")
+	batch.DeviceID, batch.Sequence = device.ID, 2
+	_, err = store.CommitPush(ctx, user.ID, batch)
+	var sequenceErr *sync.PushSequenceError
+	assert.True(t, errors.As(err, &sequenceErr), "sequence 1 never arrived")
+
+	require.NoError(t, store.DeleteUserCascade(ctx, user.ID))
+	_, err = store.GetUserByID(user.ID)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+	counts, err = store.CountPullWindow(ctx, user.ID, storage.PullRange{Zone: "default"})
+	require.NoError(t, err)
+	assert.Equal(t, storage.PullCounts{}, *counts, "deleted with the user")
+}
+
+// TestMemoryStoreRegisterPushPull drives the whole API over a MemoryStore:
+// an account registers, pushes a credential, pulls it back, deletes it and
+// sees the tombstones only when it asks for them
+func TestMemoryStoreRegisterPushPull(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := api.NewServerWithAuth(storage.NewMemoryStore()).Handler()
+
+	do := func(method, path, token string, body interface{}, status int) map[string]interface{} {
+		t.Helper()
+		encoded, err := json.Marshal(body)
+		require.NoError(t, err)
+		req := httptest.NewRequest(method, path, bytes.NewReader(encoded))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		require.Equal(t, status, w.Code, w.Body.String())
+
+		var resp map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp
+	}
+
+	registered := do(http.MethodPost, "/api/v1/auth/register", "", map[string]string{
+		"email": "alice@example.com", "password": "correct horse battery",
+	}, http.StatusCreated)
+	token, _ := registered["access_token"].(string)
+	require.NotEmpty(t, token)
+
+	keyID, credID := uuid.New().String(), uuid.New().String()
+	pushed := do(http.MethodPost, "/api/v1/sync/push", token, map[string]interface{}{
+		"zone": "default",
+		"keys": []map[string]interface{}{{
+			"item_uuid": keyID, "key_class": 1, "key_type": 2, "label": "password key",
+			"data": "a2V5", "usage_flags": "e30=",
+		}},
+		"credential_metadata": []map[string]interface{}{{
+			"item_uuid": credID, "server": "example.com", "account": "alice",
+			"protocol": 443, "port": 443, "path": "/", "password_key_uuid": keyID,
+		}},
+		"sync_records": []map[string]interface{}{{
+			"item_uuid": credID, "parent_key_uuid": keyID, "wrapped_key": "d3JhcHBlZA==",
+			"enc_item": "c2VhbGVk", "enc_version": 1,
+		}},
+	}, http.StatusOK)
+	assert.Equal(t, float64(3), pushed["synced"])
+	assert.Equal(t, float64(3), pushed["gencount"])
+
+	pulled := do(http.MethodPost, "/api/v1/sync/pull", token, map[string]interface{}{
+		"zone": "default",
+	}, http.StatusOK)
+	assert.Equal(t, float64(3), pulled["gencount"])
+	require.Len(t, pulled["keys"], 1)
+	require.Len(t, pulled["credential_metadata"], 1)
+	require.Len(t, pulled["sync_records"], 1)
+	record := pulled["sync_records"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, credID, record["item_uuid"])
+	assert.Equal(t, "c2VhbGVk", record["enc_item"])
+
+	since := do(http.MethodPost, "/api/v1/sync/pull", token, map[string]interface{}{
+		"zone": "default", "last_gencount": 2,
+	}, http.StatusOK)
+	assert.Len(t, since["sync_records"], 1)
+	assert.Empty(t, since["credential_metadata"], "pulled before")
+
+	do(http.MethodDelete, "/api/v1/sync/credentials/"+credID+"?zone=default", token, nil, http.StatusOK)
+
+	live := do(http.MethodPost, "/api/v1/sync/pull", token, map[string]interface{}{
+		"zone": "default", "last_gencount": 3,
+	}, http.StatusOK)
+	assert.Empty(t, live["sync_records"])
+	assert.Empty(t, live["credential_metadata"])
+
+	tombstones := do(http.MethodPost, "/api/v1/sync/pull", token, map[string]interface{}{
+		"zone": "default", "last_gencount": 3, "include_tombstoned": true,
+	}, http.StatusOK)
+	require.Len(t, tombstones["sync_records"], 1)
+	assert.Equal(t, true, tombstones["sync_records"].([]interface{})[0].(map[string]interface{})["tombstone"])
+	assert.Len(t, tombstones["keys"], 1, "the key only the deleted credential used")
+}
+
+// TestStoresSerializeConcurrentPushes fires pushes and bare reservations at
+// one zone in parallel. Every write reserves its gencounts from the zone's
+// sync state inside its transaction, so none is handed out twice and the
+// zone's gencount ends at the highest. Postgres joins in with
+// POSTGRES_TEST_CONN set (see TestPostgresMigrationChain).
+func TestStoresSerializeConcurrentPushes(t *testing.T) {
+	ctx := context.Background()
+	stores := map[string]storage.Store{"sqlite": newSQLiteStore(t), "memory": storage.NewMemoryStore()}
+	if conn := os.Getenv("POSTGRES_TEST_CONN"); conn != "" {
+		postgres, err := storage.NewPostgresStore(conn)
+		require.NoError(t, err)
+		defer postgres.Close()
+		_, err = postgres.Migrate(ctx)
+		require.NoError(t, err)
+		stores["postgres"] = postgres
+	}
+
+	const workers, pushes = 8, 5
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			user, err := store.CreateUser(uuid.New().String()+"@example.com", []byte("hash"), []byte("salt"), "")
+			require.NoError(t, err)
+
+			var mu gosync.Mutex
+			var ranges []storage.GenCountRange
+			var wg gosync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < pushes; i++ {
+						batch, _ := sqliteBatch("default")
+						_, err := store.CommitPush(ctx, user.ID, batch)
+						if !assert.NoError(t, err) {
+							return
+						}
+						reserved, err := store.NextGenCounts(ctx, user.ID, "default", 2)
+						if !assert.NoError(t, err) {
+							return
+						}
+						mu.Lock()
+						ranges = append(ranges, storage.GenCountRange{First: batch.GenCount - 2, Last: batch.GenCount}, reserved)
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			require.Len(t, ranges, 2*workers*pushes)
+
+			seen := make(map[int64]bool)
+			for _, line := range pullWindow(t, store, user.ID, storage.PullRange{Zone: "default", IncludeTombstoned: true}) {
+				var layer, item string
+				var genCount int64
+				var tombstone bool
+				_, err := fmt.Sscanf(line, "%s %s %d %t", &layer, &item, &genCount, &tombstone)
+				require.NoError(t, err)
+				assert.False(t, seen[genCount], "gencount %d handed out twice", genCount)
+				seen[genCount] = true
+			}
+			assert.Len(t, seen, 3*workers*pushes)
+
+			// Back to back, the ranges cover every gencount handed out
+			sort.Slice(ranges, func(i, j int) bool { return ranges[i].First < ranges[j].First })
+			assert.Equal(t, int64(1), ranges[0].First)
+			for i := 1; i < len(ranges); i++ {
+				assert.Equal(t, ranges[i-1].Last+1, ranges[i].First, "ranges %v and %v", ranges[i-1], ranges[i])
+			}
+			state, err := store.GetSyncStateContext(ctx, user.ID, "default")
+			require.NoError(t, err)
+			assert.Equal(t, ranges[len(ranges)-1].Last, state.GenCount)
+		})
+	}
+}
+
+// keyNotifier records the zones an orphaned key run tombstoned keys in
+type keyNotifier struct {
+	zones []string
+}
+
+func (n *keyNotifier) KeysTombstoned(userID, zone string, result *storage.WipeResult) {
+	n.zones = append(n.zones, zone)
+}
+
+func TestStoresTombstoneOrphanedKeys(t *testing.T) {
+	ctx := context.Background()
+	batch, _ := sqliteBatch("default")
+	orphan := uuid.New()
+	later := clock.Frozen(time.Now().Add(48 * time.Hour))
+
+	replay := func(store storage.Store) *storage.SyncState {
+		user, err := store.CreateUser("alice@example.com", []byte("hash"), []byte("salt"), "")
+		require.NoError(t, err)
+		_, err = store.CommitPush(ctx, user.ID, batch)
+		require.NoError(t, err)
+		_, err = store.CommitPush(ctx, user.ID, &storage.PushBatch{Zone: "default", Keys: []*models.CryptoKey{{
+			ItemUUID: orphan, Zone: "default", AccGroup: "group", Data: []byte("key"), Flags: []byte("{}"),
+		}}})
+		require.NoError(t, err)
+
+		found, err := store.FindOrphanedKeys(ctx, time.Now().Add(-time.Hour), "")
+		require.NoError(t, err)
+		assert.Empty(t, found, "keys younger than the cutoff are kept")
+
+		notifier := &keyNotifier{}
+		job := jobs.NewOrphanedKeyJob(store, notifier, 24*time.Hour)
+		job.SetClock(later)
+		report, err := job.Run(ctx, jobs.RunOptions{DryRun: true})
+		require.NoError(t, err)
+		require.Len(t, report.Users, 1)
+		assert.Equal(t, []string{orphan.String()}, report.Users[0].ItemUUIDs)
+		state, err := store.GetSyncState(user.ID, "default")
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), state.GenCount, "a dry run writes nothing")
+
+		require.NoError(t, store.SetLegalHold(user.ID, true))
+		report, err = job.Run(ctx, jobs.RunOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, report.Users, "held accounts are skipped")
+		result, err := store.TombstoneOrphanedKeys(ctx, user.ID, "default", later.Now())
+		require.NoError(t, err)
+		assert.Empty(t, result.Items, "the hold is checked again under lock")
+		require.NoError(t, store.SetLegalHold(user.ID, false))
+
+		report, err = job.Run(ctx, jobs.RunOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), report.TotalAffected)
+		assert.Equal(t, []string{"default"}, notifier.zones)
+		report, err = job.Run(ctx, jobs.RunOptions{})
+		require.NoError(t, err)
+		assert.Zero(t, report.TotalAffected)
+		assert.Len(t, notifier.zones, 1, "nothing left to tell")
+
+		keys, err := store.GetCryptoKeysPage(ctx, user.ID, storage.PullRange{Zone: "default", IncludeTombstoned: true})
+		require.NoError(t, err)
+		require.Len(t, keys, 2)
+		assert.Equal(t, orphan, keys[1].ItemUUID)
+		assert.True(t, keys[1].Tombstone)
+		assert.Equal(t, int64(5), keys[1].GenCount)
+		assert.False(t, keys[0].Tombstone, "the credential's key is kept")
+
+		state, err = store.GetSyncState(user.ID, "default")
+		require.NoError(t, err)
+		manifest, err := store.ComputeManifest(ctx, user.ID, "default")
+		require.NoError(t, err)
+		assert.Equal(t, manifest.Digest, state.Digest)
+		return state
+	}
+
+	sqliteState := replay(newSQLiteStore(t))
+	memoryState := replay(storage.NewMemoryStore())
+	assert.Equal(t, int64(5), sqliteState.GenCount)
+	assert.Equal(t, sqliteState.GenCount, memoryState.GenCount)
+	assert.Equal(t, sqliteState.Digest, memoryState.Digest)
+}
+
+// An item refused in one zone rolls back the whole import, the zones
+// written before it included
+func TestStoresRollBackRefusedImport(t *testing.T) {
+	ctx := context.Background()
+	stores := map[string]storage.Store{"sqlite": newSQLiteStore(t), "memory": storage.NewMemoryStore()}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			user, err := store.CreateUser(uuid.New().String()+"@example.com", []byte("hash"), []byte("salt"), "")
+			require.NoError(t, err)
+
+			personal, _ := sqliteBatch("default")
+			work, _ := sqliteBatch("work")
+			work.Records[0].EncItem = nil // NOT NULL
+			err = store.CommitImport(ctx, user.ID, []*storage.PushBatch{personal, work})
+			var itemErr *storage.ImportItemError
+			require.True(t, errors.As(err, &itemErr), "%v", err)
+			assert.Equal(t, "work", itemErr.Zone)
+			assert.Equal(t, "sync_record", itemErr.Layer)
+
+			for _, zone := range []string{"default", "work"} {
+				counts, err := store.CountPullWindow(ctx, user.ID, storage.PullRange{Zone: zone})
+				require.NoError(t, err)
+				assert.Equal(t, storage.PullCounts{}, *counts, zone)
+				state, err := store.GetSyncStateContext(ctx, user.ID, zone)
+				require.NoError(t, err)
+				assert.Zero(t, state.GenCount, zone)
+			}
+
+			work.Records[0].EncItem = []byte("item")
+			require.NoError(t, store.CommitImport(ctx, user.ID, []*storage.PushBatch{personal, work}))
+			assert.Equal(t, int64(3), personal.GenCount)
+			assert.Equal(t, int64(3), work.Records[0].GenCount)
+		})
+	}
+}
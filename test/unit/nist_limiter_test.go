@@ -0,0 +1,106 @@
+package unit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/cve"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSleeper advances a fake clock instead of sleeping, and records how
+// long each wait was
+type fakeSleeper struct {
+	clock *fakeClock
+	waits []time.Duration
+}
+
+func (s *fakeSleeper) sleep(ctx context.Context, d time.Duration) error {
+	s.waits = append(s.waits, d)
+	s.clock.Advance(d)
+	return ctx.Err()
+}
+
+func newFakeLimiter(cfg cve.LimiterConfig) (*cve.Limiter, *fakeSleeper) {
+	limiter := cve.NewLimiter(cfg)
+	sleeper := &fakeSleeper{clock: &fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}}
+	limiter.SetClock(sleeper.clock, sleeper.sleep)
+	return limiter, sleeper
+}
+
+func TestNISTLimiterRate(t *testing.T) {
+	// 2 requests per 30s: one every 15s after a burst of 2
+	limiter, sleeper := newFakeLimiter(cve.LimiterConfig{Requests: 2, Window: 30 * time.Second, Burst: 2})
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, limiter.Wait(ctx))
+	}
+	assert.Equal(t, []time.Duration{15 * time.Second, 15 * time.Second}, sleeper.waits)
+
+	// A quiet spell refills the burst, no further
+	sleeper.clock.Advance(time.Hour)
+	sleeper.waits = nil
+	for i := 0; i < 3; i++ {
+		require.NoError(t, limiter.Wait(ctx))
+	}
+	assert.Equal(t, []time.Duration{15 * time.Second}, sleeper.waits)
+
+	// A pause holds everyone; the bucket empties and refills meanwhile
+	limiter.Pause(20 * time.Second)
+	sleeper.waits = nil
+	require.NoError(t, limiter.Wait(ctx))
+	require.NoError(t, limiter.Wait(ctx))
+	assert.Equal(t, []time.Duration{20 * time.Second, 10 * time.Second}, sleeper.waits)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.ErrorIs(t, limiter.Wait(cancelled), context.Canceled)
+}
+
+// A rate limited request pauses the limiter for the upstream's Retry-After,
+// or a jittered backoff without one, and is retried
+func TestCVEClientRetriesRateLimit(t *testing.T) {
+	var answers []int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := answers[0]
+		answers = answers[1:]
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "7")
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"totalResults":0}`)
+	}))
+	defer upstream.Close()
+
+	limiter, sleeper := newFakeLimiter(cve.LimiterConfig{Requests: 50, Window: 30 * time.Second, Burst: 5, MaxRetries: 2, Backoff: 6 * time.Second})
+	client, err := cve.NewCVEClient(cve.ClientConfig{BaseURL: upstream.URL, APIKey: "nvd-key", HTTPClient: upstream.Client(), Limiter: limiter})
+	require.NoError(t, err)
+	ctx := context.Background()
+	var out map[string]interface{}
+
+	answers = []int{http.StatusTooManyRequests, http.StatusForbidden, http.StatusOK}
+	require.NoError(t, client.Get(ctx, nil, &out))
+	require.Len(t, sleeper.waits, 2)
+	assert.Equal(t, 7*time.Second, sleeper.waits[0], "Retry-After is honoured")
+	assert.GreaterOrEqual(t, sleeper.waits[1], 12*time.Second, "the second retry backs off twice the base")
+	assert.LessOrEqual(t, sleeper.waits[1], 18*time.Second, "with at most half again of jitter")
+
+	answers = []int{http.StatusForbidden, http.StatusForbidden, http.StatusForbidden}
+	err = client.Get(ctx, nil, &out)
+	var status *cve.StatusError
+	require.ErrorAs(t, err, &status)
+	assert.True(t, status.RateLimited())
+	assert.Empty(t, answers, "MaxRetries retries, then the error")
+
+	answers = []int{http.StatusInternalServerError}
+	err = client.Get(ctx, nil, &out)
+	require.ErrorAs(t, err, &status)
+	assert.False(t, status.RateLimited())
+	assert.Empty(t, answers, "other errors are not retried")
+}
@@ -0,0 +1,126 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/server/api"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	policy := middleware.NewOriginPolicy(
+		middleware.ParseOrigins("https://vault.example.com, https://*.example.org, http://*.dev.test:8080"),
+		false,
+	)
+	const host = "api.example.com"
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://vault.example.com", true},
+		{"HTTPS://Vault.Example.com", true},
+		{"https://api.example.com", true}, // same origin
+		{"https://app.example.org", true},
+		{"https://a.b.example.org", true},
+		{"http://web.dev.test:8080", true},
+		{"https://example.org", false}, // wildcard does not match the apex
+		{"http://app.example.org", false},
+		{"https://app.example.org:8443", false},
+		{"http://web.dev.test", false},
+		{"https://evil.com", false},
+		{"https://vault.example.com.evil.com", false},
+		{"https://evilexample.org", false},
+		{"null", false},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.allowed, policy.AllowsOrigin(tt.origin, host), tt.origin)
+	}
+}
+
+func TestOriginPolicyDefaults(t *testing.T) {
+	t.Run("release mode is same-origin only", func(t *testing.T) {
+		policy := middleware.NewOriginPolicy(nil, false)
+		assert.True(t, policy.AllowsOrigin("https://api.example.com", "api.example.com"))
+		assert.False(t, policy.AllowsOrigin("http://localhost:4200", "api.example.com"))
+	})
+
+	t.Run("debug mode is permissive", func(t *testing.T) {
+		policy := middleware.NewOriginPolicy(nil, true)
+		assert.True(t, policy.AllowsOrigin("http://localhost:4200", "api.example.com"))
+	})
+}
+
+func TestRequireAllowedOrigin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	policy := middleware.NewOriginPolicy([]string{"https://vault.example.com"}, false)
+
+	router := gin.New()
+	router.GET("/sync/live", middleware.RequireAllowedOrigin(policy), func(c *gin.Context) {
+		c.Status(http.StatusSwitchingProtocols)
+	})
+
+	request := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://api.example.com/sync/live", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("allowed origin", func(t *testing.T) {
+		assert.Equal(t, http.StatusSwitchingProtocols, request("https://vault.example.com").Code)
+	})
+
+	t.Run("rejected origin gets a structured 403", func(t *testing.T) {
+		w := request("https://evil.com")
+		require.Equal(t, http.StatusForbidden, w.Code)
+
+		var body map[string]string
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, "origin_not_allowed", body["code"])
+		assert.Equal(t, "https://evil.com", body["origin"])
+	})
+
+	t.Run("missing origin is a native client", func(t *testing.T) {
+		assert.Equal(t, http.StatusSwitchingProtocols, request("").Code)
+	})
+}
+
+// The live sync route checks the origin before the token: a disallowed
+// origin is refused whether its token is missing, invalid or valid
+func TestLiveSyncChecksOriginBeforeAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("ALLOWED_ORIGINS", "https://vault.example.com")
+	a := newAuditExportAPI(t)
+	handler := api.NewServerWithAuth(a.store).Handler()
+
+	request := func(origin, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://api.example.com/api/v1/sync/live", nil)
+		req.Header.Set("Origin", origin)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, token := range []string{"", "not-a-token", a.tokens[a.alice.ID]} {
+		w := request("https://evil.com", token)
+		assert.Equal(t, http.StatusForbidden, w.Code, w.Body.String())
+		assert.NotContains(t, w.Body.String(), "token")
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request("https://vault.example.com", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("https://vault.example.com", "not-a-token").Code)
+}
@@ -0,0 +1,248 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestPasswordHashVersions(t *testing.T) {
+	salt, err := auth.GenerateSalt()
+	require.NoError(t, err)
+
+	// Hashes stored before versioning must keep verifying as version 1
+	legacy := pbkdf2.Key([]byte("hunter22"), salt, auth.HashIterations, auth.HashKeyLen, sha256.New)
+	assert.Equal(t, legacy, auth.HashPasswordVersion("hunter22", salt, auth.HashVersionPBKDF2))
+	assert.True(t, auth.VerifyPassword("hunter22", salt, legacy, auth.HashVersionPBKDF2))
+	assert.False(t, auth.VerifyPassword("hunter22", salt, legacy, auth.HashVersionArgon2id), "the version picks the algorithm")
+
+	current := auth.HashPassword("hunter22", salt)
+	assert.NotEqual(t, legacy, current)
+	assert.True(t, auth.VerifyPassword("hunter22", salt, current, auth.CurrentHashVersion))
+	assert.False(t, auth.VerifyPassword("hunter23", salt, current, auth.CurrentHashVersion))
+
+	assert.Nil(t, auth.HashPasswordVersion("hunter22", salt, 99))
+	assert.False(t, auth.VerifyPassword("hunter22", salt, nil, 99), "an unknown version never verifies")
+
+	assert.True(t, auth.HashDeprecated(auth.HashVersionPBKDF2))
+	assert.False(t, auth.HashDeprecated(auth.CurrentHashVersion))
+}
+
+// hashUpgradeStore stands in for the users table in campaign tests
+type hashUpgradeStore struct {
+	accounts map[string]*storage.HashUpgradeAccount
+	revoked  []string
+	writes   int
+}
+
+func newHashUpgradeStore(deadline time.Time, userIDs ...string) *hashUpgradeStore {
+	s := &hashUpgradeStore{accounts: map[string]*storage.HashUpgradeAccount{}}
+	for _, id := range userIDs {
+		s.accounts[id] = &storage.HashUpgradeAccount{
+			UserID:      id,
+			Email:       id + "@example.com",
+			HashVersion: auth.HashVersionPBKDF2,
+			Deadline:    &deadline,
+		}
+	}
+	return s
+}
+
+func (s *hashUpgradeStore) FindHashUpgradeAccounts(userID string) ([]*storage.HashUpgradeAccount, error) {
+	var result []*storage.HashUpgradeAccount
+	for _, account := range s.accounts {
+		if userID == "" || account.UserID == userID {
+			copied := *account
+			result = append(result, &copied)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].UserID < result[j].UserID })
+	return result, nil
+}
+
+func (s *hashUpgradeStore) MarkHashUpgradeNotified(userID string, at time.Time) error {
+	account, ok := s.accounts[userID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	s.writes++
+	account.NotifiedAt = &at
+	return nil
+}
+
+func (s *hashUpgradeStore) EnforceHashUpgrade(userID string, at time.Time) (bool, error) {
+	account, ok := s.accounts[userID]
+	if !ok || account.EnforcedAt != nil {
+		return false, nil
+	}
+	s.writes++
+	account.EnforcedAt = &at
+	s.revoked = append(s.revoked, userID)
+	return true, nil
+}
+
+// upgrade is a login rehashing the password: the account leaves the campaign
+func (s *hashUpgradeStore) upgrade(userID string) {
+	delete(s.accounts, userID)
+}
+
+type hashUpgradeNotifier struct {
+	requested []string
+	enforced  []string
+}
+
+func (n *hashUpgradeNotifier) HashUpgradeRequested(account *storage.HashUpgradeAccount) {
+	n.requested = append(n.requested, account.UserID)
+}
+
+func (n *hashUpgradeNotifier) HashUpgradeEnforced(account *storage.HashUpgradeAccount) {
+	n.enforced = append(n.enforced, account.UserID)
+}
+
+func stagesByUser(report *jobs.Report) map[string]string {
+	stages := map[string]string{}
+	for _, impact := range report.Users {
+		stages[impact.UserID] = impact.Stage
+	}
+	return stages
+}
+
+func TestHashUpgradeCampaignDeadline(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}
+	deadline := clock.now.Add(30 * 24 * time.Hour)
+	store := newHashUpgradeStore(deadline, activityAlice, activityBob)
+	notifier := &hashUpgradeNotifier{}
+	job := jobs.NewPasswordHashUpgradeJob(store, notifier)
+	job.SetClock(clock)
+
+	report, err := job.Run(context.Background(), jobs.RunOptions{})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{activityAlice, activityBob}, notifier.requested)
+	assert.Equal(t, int64(0), report.TotalAffected, "notifying revokes nothing")
+	assert.Equal(t, jobs.HashUpgradeNotified, stagesByUser(report)[activityAlice])
+
+	// Nobody is told twice, and nothing happens before the deadline
+	clock.Advance(29 * 24 * time.Hour)
+	report, err = job.Run(context.Background(), jobs.RunOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, report.Users)
+	assert.Len(t, notifier.requested, 2)
+
+	// Alice logs in meanwhile; Bob doesn't
+	store.upgrade(activityAlice)
+	clock.Advance(24 * time.Hour)
+	report, err = job.Run(context.Background(), jobs.RunOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), report.TotalAffected)
+	assert.Equal(t, map[string]string{activityBob: jobs.HashUpgradeEnforced}, stagesByUser(report))
+	assert.Equal(t, []string{activityBob}, store.revoked)
+	assert.Equal(t, []string{activityBob}, notifier.enforced)
+
+	// Enforced once: Bob's next login upgrades him
+	report, err = job.Run(context.Background(), jobs.RunOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, report.Users)
+	assert.Len(t, store.revoked, 1)
+}
+
+func TestHashUpgradeNotifiesBeforeEnforcing(t *testing.T) {
+	// The job was down until after the deadline: the user is told first
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}
+	store := newHashUpgradeStore(clock.now.Add(-time.Hour), activityAlice)
+	notifier := &hashUpgradeNotifier{}
+	job := jobs.NewPasswordHashUpgradeJob(store, notifier)
+	job.SetClock(clock)
+
+	report, err := job.Run(context.Background(), jobs.RunOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, jobs.HashUpgradeNotified, stagesByUser(report)[activityAlice])
+	assert.Empty(t, store.revoked)
+
+	clock.Advance(time.Hour)
+	report, err = job.Run(context.Background(), jobs.RunOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, jobs.HashUpgradeEnforced, stagesByUser(report)[activityAlice])
+	assert.Equal(t, []string{activityAlice}, store.revoked)
+}
+
+func TestHashUpgradeDryRun(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}
+	store := newHashUpgradeStore(clock.now.Add(time.Hour), activityAlice)
+	notifier := &hashUpgradeNotifier{}
+	job := jobs.NewPasswordHashUpgradeJob(store, notifier)
+	job.SetClock(clock)
+
+	report, err := job.Run(context.Background(), jobs.RunOptions{DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, jobs.HashUpgradeNotified, stagesByUser(report)[activityAlice])
+	assert.Zero(t, store.writes)
+	assert.Empty(t, notifier.requested)
+}
+
+// A password change revokes the access tokens issued before it at once,
+// the caller's and other sessions', not when they expire; the pair it
+// returns carries on
+func TestPasswordChangeRevokesAccessTokens(t *testing.T) {
+	stores := map[string]storage.Store{"sqlite": newSQLiteStore(t), "memory": storage.NewMemoryStore()}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			handler := api.NewServerWithAuth(store).Handler()
+			do := func(method, path, token string, body interface{}) (int, map[string]interface{}) {
+				t.Helper()
+				encoded, err := json.Marshal(body)
+				require.NoError(t, err)
+				req := httptest.NewRequest(method, path, bytes.NewReader(encoded))
+				req.Header.Set("Content-Type", "application/json")
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				var resp map[string]interface{}
+				_ = json.Unmarshal(w.Body.Bytes(), &resp)
+				return w.Code, resp
+			}
+			credentials := map[string]string{"email": "alice@example.com", "password": "correct horse battery"}
+
+			code, registered := do(http.MethodPost, "/api/v1/auth/register", "", credentials)
+			require.Equal(t, http.StatusCreated, code, registered)
+			session, _ := registered["access_token"].(string)
+			code, loggedIn := do(http.MethodPost, "/api/v1/auth/login", "", credentials)
+			require.Equal(t, http.StatusOK, code, loggedIn)
+			other, _ := loggedIn["access_token"].(string)
+			code, _ = do(http.MethodGet, "/api/v1/devices", other, nil)
+			require.Equal(t, http.StatusOK, code, "cached in the auth profile before the change")
+
+			code, changed := do(http.MethodPost, "/api/v1/auth/change-password", session, map[string]string{
+				"current_password": credentials["password"], "new_password": "battery staple horse",
+			})
+			require.Equal(t, http.StatusOK, code, changed)
+
+			for _, old := range []string{session, other} {
+				code, _ = do(http.MethodGet, "/api/v1/devices", old, nil)
+				assert.Equal(t, http.StatusUnauthorized, code)
+			}
+			code, _ = do(http.MethodGet, "/api/v1/devices", changed["access_token"].(string), nil)
+			assert.Equal(t, http.StatusOK, code)
+			code, _ = do(http.MethodPost, "/api/v1/auth/refresh", "", map[string]string{"refresh_token": loggedIn["refresh_token"].(string)})
+			assert.Equal(t, http.StatusUnauthorized, code)
+		})
+	}
+}
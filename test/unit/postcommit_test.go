@@ -0,0 +1,138 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/deeplyprofound/password-sync/server/postcommit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pushStore stands in for the committed tables of a push
+type pushStore struct {
+	mu    gosync.Mutex
+	items map[string]int64
+}
+
+func (s *pushStore) commit(gencounts map[string]int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, gen := range gencounts {
+		s.items[id] = gen
+	}
+}
+
+func TestPostCommitFailureLeavesDataDurable(t *testing.T) {
+	store := &pushStore{items: map[string]int64{}}
+	queue := postcommit.NewQueue(2, 8)
+
+	store.commit(map[string]int64{"item-1": 1, "item-2": 2})
+	failedBefore := metrics.Value(postcommit.MetricFailed)
+
+	pending := queue.Dispatch("alice/default",
+		postcommit.Stage{Name: "test_durable_digest", Run: func(ctx context.Context) error {
+			return errors.New("digest store unavailable")
+		}},
+		postcommit.Stage{Name: "test_durable_events", Run: func(ctx context.Context) error {
+			panic("hub gone")
+		}},
+	)
+	assert.True(t, pending, "post-commit work is deferred past the response")
+
+	// The worker survives the panic and keeps serving the zone
+	var ran bool
+	queue.Dispatch("alice/default", postcommit.Stage{Name: "test_durable_next", Run: func(ctx context.Context) error {
+		ran = true
+		return nil
+	}})
+	queue.Close()
+
+	assert.True(t, ran)
+	assert.Equal(t, failedBefore+2, metrics.Value(postcommit.MetricFailed))
+	assert.Equal(t, int64(1), metrics.Value("stage_test_durable_digest_failed"))
+	assert.Equal(t, int64(1), metrics.Value("stage_test_durable_events_failed"))
+	assert.Equal(t, int64(1), metrics.Value("stage_test_durable_next_count"))
+	assert.Equal(t, map[string]int64{"item-1": 1, "item-2": 2}, store.items)
+}
+
+func TestPostCommitRunsZoneWorkInOrder(t *testing.T) {
+	queue := postcommit.NewQueue(4, 64)
+
+	var mu gosync.Mutex
+	var order []int
+	for i := 0; i < 50; i++ {
+		i := i
+		require.True(t, queue.Submit("alice/default", postcommit.Stage{Name: "test_order", Run: func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, i)
+			return nil
+		}}))
+	}
+	queue.Close()
+
+	require.Len(t, order, 50)
+	for i, got := range order {
+		assert.Equal(t, i, got)
+	}
+	assert.False(t, queue.Submit("alice/default"), "a closed queue takes no work")
+}
+
+func TestPostCommitStageTimeout(t *testing.T) {
+	start := time.Now()
+	postcommit.Run(
+		postcommit.Stage{Name: "test_timeout_slow", Timeout: 20 * time.Millisecond, Run: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+		postcommit.Stage{Name: "test_timeout_next", Timeout: time.Second, Run: func(ctx context.Context) error {
+			deadline, ok := ctx.Deadline()
+			assert.True(t, ok)
+			assert.Greater(t, time.Until(deadline), 500*time.Millisecond, "each stage gets its own budget")
+			return nil
+		}},
+	)
+
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	assert.Equal(t, int64(1), metrics.Value("stage_test_timeout_slow_failed"))
+	assert.Equal(t, int64(0), metrics.Value("stage_test_timeout_next_failed"))
+	assert.Equal(t, int64(1), metrics.Value("stage_test_timeout_next_count"))
+}
+
+func TestPostCommitFullQueueRunsInline(t *testing.T) {
+	queue := postcommit.NewQueue(1, 1)
+	defer queue.Close()
+
+	gate := make(chan struct{})
+	started := make(chan struct{})
+	blocker := postcommit.Stage{Name: "test_full_blocker", Run: func(ctx context.Context) error {
+		close(started)
+		<-gate
+		return nil
+	}}
+	require.True(t, queue.Submit("alice/default", blocker))
+	<-started
+	require.True(t, queue.Submit("alice/default", postcommit.Stage{Name: "test_full_queued", Run: func(ctx context.Context) error { return nil }}))
+
+	var ran bool
+	pending := queue.Dispatch("alice/default", postcommit.Stage{Name: "test_full_inline", Run: func(ctx context.Context) error {
+		ran = true
+		return nil
+	}})
+	assert.False(t, pending)
+	assert.True(t, ran, "work that can't be queued runs before Dispatch returns")
+	close(gate)
+
+	var nilQueue *postcommit.Queue
+	ran = false
+	assert.False(t, nilQueue.Dispatch("alice/default", postcommit.Stage{Name: "test_full_inline", Run: func(ctx context.Context) error {
+		ran = true
+		return nil
+	}}))
+	assert.True(t, ran)
+}
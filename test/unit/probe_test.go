@@ -0,0 +1,125 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/server/api/handlers"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// itemRow is one row of a layer table
+type itemRow struct {
+	userID    string
+	zone      string
+	itemUUID  uuid.UUID
+	layer     string
+	genCount  int64
+	tombstone bool
+}
+
+// probeRows answers a probe the way ProbeItems does
+func probeRows(rows []itemRow, probe storage.ItemProbe) storage.ItemStates {
+	states := storage.ItemStates{}
+	for _, row := range rows {
+		if probe.Matches(row.userID, row.zone, row.itemUUID) {
+			states.Add(row.itemUUID, storage.ItemState{Layer: row.layer, GenCount: row.genCount, Tombstone: row.tombstone})
+		}
+	}
+	return states
+}
+
+func TestProbeReportsItemStates(t *testing.T) {
+	live, deleted, lost, shared := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	rows := []itemRow{
+		{activityAlice, "default", live, mapping.LayerSyncRecord, 12, false},
+		{activityAlice, "default", deleted, mapping.LayerCredentialMetadata, 30, true},
+		{activityAlice, "work", lost, mapping.LayerSyncRecord, 4, false},
+		// Same UUID under two layers: the latest write wins
+		{activityAlice, "default", shared, mapping.LayerCryptoKey, 5, false},
+		{activityAlice, "default", shared, mapping.LayerSyncRecord, 9, true},
+	}
+
+	ids := []uuid.UUID{deleted, live, lost, shared}
+	items := handlers.NewProbeItems(ids, probeRows(rows, storage.ItemProbe{UserID: activityAlice, Zone: "default", ItemUUIDs: ids}))
+	require.Len(t, items, 4)
+
+	assert.Equal(t, handlers.ProbeItem{ItemUUID: deleted.String(), State: "tombstoned", Layer: "credential_metadata", GenCount: 30}, items[0], "request order")
+	assert.Equal(t, handlers.ProbeItem{ItemUUID: live.String(), State: "live", Layer: "sync_record", GenCount: 12}, items[1])
+	assert.Equal(t, handlers.ProbeItem{ItemUUID: lost.String(), State: "unknown"}, items[2], "items of another zone are unknown")
+	assert.Equal(t, handlers.ProbeItem{ItemUUID: shared.String(), State: "tombstoned", Layer: "sync_record", GenCount: 9}, items[3])
+
+	data, err := json.Marshal(items[2])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"item_uuid":"`+lost.String()+`","state":"unknown"}`, string(data))
+}
+
+func TestProbeDoesNotLeakOtherUsersItems(t *testing.T) {
+	bobs := uuid.New()
+	rows := []itemRow{
+		{activityBob, "default", bobs, mapping.LayerSyncRecord, 7, false},
+	}
+
+	ids := []uuid.UUID{bobs}
+	items := handlers.NewProbeItems(ids, probeRows(rows, storage.ItemProbe{UserID: activityAlice, Zone: "default", ItemUUIDs: ids}))
+	assert.Equal(t, []handlers.ProbeItem{{ItemUUID: bobs.String(), State: "unknown"}}, items,
+		"a UUID only another user holds looks like one nobody holds")
+
+	// Bob himself sees it
+	items = handlers.NewProbeItems(ids, probeRows(rows, storage.ItemProbe{UserID: activityBob, Zone: "default", ItemUUIDs: ids}))
+	assert.Equal(t, "live", items[0].State)
+}
+
+func TestProbeRejectsBadRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	// No store: these must be answered before anything is read
+	syncHandler := handlers.NewSyncHandler(nil, nil)
+	router := gin.New()
+	router.POST("/anonymous/probe", syncHandler.ProbeSync)
+	router.POST("/sync/probe", func(c *gin.Context) {
+		middleware.SetClaims(c, &auth.Claims{UserID: activityAlice})
+		c.Next()
+	}, syncHandler.ProbeSync)
+
+	tooMany := make([]string, handlers.MaxProbeItems+1)
+	for i := range tooMany {
+		tooMany[i] = uuid.NewString()
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		body   interface{}
+		status int
+		code   string
+	}{
+		{"unauthenticated", "/anonymous/probe", gin.H{"item_uuids": []string{}}, http.StatusUnauthorized, ""},
+		{"missing list", "/sync/probe", gin.H{"zone": "default"}, http.StatusBadRequest, ""},
+		{"invalid uuid", "/sync/probe", gin.H{"item_uuids": []string{uuid.NewString(), "nope"}}, http.StatusBadRequest, ""},
+		{"too many", "/sync/probe", gin.H{"item_uuids": tooMany}, http.StatusRequestEntityTooLarge, "payload_too_large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var payload bytes.Buffer
+			require.NoError(t, json.NewEncoder(&payload).Encode(tt.body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, &payload))
+			assert.Equal(t, tt.status, w.Code)
+			if tt.code != "" {
+				var body map[string]any
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+				assert.Equal(t, tt.code, body["code"])
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package unit
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const profileUserID = "0b7c5a1e-2f3d-4c5b-9a8e-7d6c5b4a3f2e"
+
+// profileSource stands in for the users table
+type profileSource struct {
+	profiles map[string]auth.Profile
+	loads    int
+}
+
+func (s *profileSource) GetAuthProfile(userID string) (*auth.Profile, error) {
+	s.loads++
+	profile, ok := s.profiles[userID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return &profile, nil
+}
+
+func (s *profileSource) update(fn func(p *auth.Profile)) {
+	profile := s.profiles[profileUserID]
+	fn(&profile)
+	s.profiles[profileUserID] = profile
+}
+
+func newProfileSource() *profileSource {
+	return &profileSource{profiles: map[string]auth.Profile{
+		profileUserID: {UserID: profileUserID, Email: "a@example.com", Tier: "free", Active: true},
+	}}
+}
+
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time          { return c.now }
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func newAuthRouter(t *testing.T, profiles *auth.ProfileCache) func(tokenVersion int) int {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/protected", middleware.AuthMiddleware(profiles), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	return func(tokenVersion int) int {
+		token, err := auth.GenerateAccessToken(profileUserID, "a@example.com", "", tokenVersion)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+}
+
+func TestProfileCacheInMemory(t *testing.T) {
+	const ttl = 30 * time.Second
+
+	t.Run("deactivated user is rejected once the TTL expires", func(t *testing.T) {
+		source := newProfileSource()
+		clock := &fakeClock{now: time.Now()}
+		cache := auth.NewProfileCache(source, auth.ProfileCacheOptions{TTL: ttl, Now: clock.Now})
+		request := newAuthRouter(t, cache)
+
+		require.Equal(t, http.StatusOK, request(0))
+		source.update(func(p *auth.Profile) { p.Active = false })
+
+		// Stale but within the bound
+		clock.Advance(ttl - time.Second)
+		assert.Equal(t, http.StatusOK, request(0))
+		assert.Equal(t, 1, source.loads)
+
+		clock.Advance(time.Second)
+		assert.Equal(t, http.StatusUnauthorized, request(0))
+		assert.Equal(t, 2, source.loads)
+	})
+
+	t.Run("invalidation rejects a deactivated user immediately", func(t *testing.T) {
+		source := newProfileSource()
+		cache := auth.NewProfileCache(source, auth.ProfileCacheOptions{TTL: time.Hour})
+		request := newAuthRouter(t, cache)
+
+		require.Equal(t, http.StatusOK, request(0))
+		source.update(func(p *auth.Profile) { p.Active = false })
+		cache.Invalidate(context.Background(), profileUserID)
+
+		assert.Equal(t, http.StatusUnauthorized, request(0))
+	})
+
+	t.Run("token version bump revokes older tokens", func(t *testing.T) {
+		source := newProfileSource()
+		cache := auth.NewProfileCache(source, auth.ProfileCacheOptions{TTL: time.Hour})
+		request := newAuthRouter(t, cache)
+
+		require.Equal(t, http.StatusOK, request(0))
+		source.update(func(p *auth.Profile) { p.TokenVersion = 1 })
+		cache.Invalidate(context.Background(), profileUserID)
+
+		assert.Equal(t, http.StatusUnauthorized, request(0))
+		assert.Equal(t, http.StatusOK, request(1))
+	})
+
+	t.Run("hits are served without reloading", func(t *testing.T) {
+		source := newProfileSource()
+		cache := auth.NewProfileCache(source, auth.ProfileCacheOptions{TTL: time.Hour})
+		hits := metrics.Value(auth.MetricProfileCacheHit)
+		misses := metrics.Value(auth.MetricProfileCacheMiss)
+
+		for i := 0; i < 3; i++ {
+			_, err := cache.Get(context.Background(), profileUserID)
+			require.NoError(t, err)
+		}
+
+		assert.Equal(t, 1, source.loads)
+		assert.Equal(t, hits+2, metrics.Value(auth.MetricProfileCacheHit))
+		assert.Equal(t, misses+1, metrics.Value(auth.MetricProfileCacheMiss))
+	})
+
+	t.Run("unknown user is rejected", func(t *testing.T) {
+		source := &profileSource{profiles: map[string]auth.Profile{}}
+		request := newAuthRouter(t, auth.NewProfileCache(source, auth.ProfileCacheOptions{}))
+		assert.Equal(t, http.StatusUnauthorized, request(0))
+	})
+}
+
+func TestProfileCacheRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	const ttl = 30 * time.Second
+	source := newProfileSource()
+	cache := auth.NewProfileCache(source, auth.ProfileCacheOptions{TTL: ttl, Redis: client})
+	request := newAuthRouter(t, cache)
+
+	require.Equal(t, http.StatusOK, request(0))
+	assert.True(t, server.Exists("auth:profile:"+profileUserID))
+
+	source.update(func(p *auth.Profile) { p.Active = false })
+	assert.Equal(t, http.StatusOK, request(0), "cached within the TTL")
+
+	server.FastForward(ttl)
+	assert.Equal(t, http.StatusUnauthorized, request(0))
+
+	// Reactivate: a second instance sharing Redis sees the invalidation at once
+	source.update(func(p *auth.Profile) { p.Active = true })
+	other := auth.NewProfileCache(source, auth.ProfileCacheOptions{TTL: ttl, Redis: client})
+	other.Invalidate(context.Background(), profileUserID)
+	assert.Equal(t, http.StatusOK, request(0))
+
+	t.Run("falls back to memory when Redis is down", func(t *testing.T) {
+		server.Close()
+		loads := source.loads
+
+		_, err := cache.Get(context.Background(), profileUserID)
+		require.NoError(t, err)
+		_, err = cache.Get(context.Background(), profileUserID)
+		require.NoError(t, err)
+
+		assert.Equal(t, loads+1, source.loads)
+	})
+}
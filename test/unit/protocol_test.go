@@ -0,0 +1,185 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocolValue(t *testing.T) {
+	for body, want := range map[string]models.Protocol{
+		`"ssh"`: models.ProtocolSSH,
+		`443`:   models.ProtocolHTTPS,
+		`993`:   models.ProtocolIMAP,
+		`null`:  models.ProtocolUnspecified,
+		`0`:     models.ProtocolUnspecified,
+	} {
+		var value mapping.ProtocolValue
+		require.NoError(t, json.Unmarshal([]byte(body), &value), body)
+		protocol, ok := value.Protocol()
+		assert.True(t, ok, body)
+		assert.Equal(t, want, protocol, body)
+	}
+
+	for _, body := range []string{`"gopher"`, `"HTTPS"`, `8443`, `-1`} {
+		var value mapping.ProtocolValue
+		require.NoError(t, json.Unmarshal([]byte(body), &value), body)
+		_, ok := value.Protocol()
+		assert.False(t, ok, body)
+	}
+	var value mapping.ProtocolValue
+	assert.Error(t, json.Unmarshal([]byte(`true`), &value))
+
+	encoded, err := json.Marshal(mapping.WireProtocol(models.ProtocolSMTP, mapping.SyncSchemaVersion))
+	require.NoError(t, err)
+	assert.Equal(t, `"smtp"`, string(encoded))
+	encoded, err = json.Marshal(mapping.WireProtocol(models.ProtocolSMTP, mapping.LegacySyncSchemaVersion))
+	require.NoError(t, err)
+	assert.Equal(t, `587`, string(encoded), "devices before sync schema 2 read a number")
+	assert.Equal(t, 587, models.ProtocolSMTP.DefaultPort())
+}
+
+// Pushed protocols come back by name to a device reading sync schema 2,
+// and as the port they stood for to older ones. The port defaults to the
+// protocol's, and an unknown protocol fails its item only.
+func TestProtocolPushPullRoundTrip(t *testing.T) {
+	stores := map[string]storage.Store{"sqlite": newSQLiteStore(t), "memory": storage.NewMemoryStore()}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			handler := api.NewServerWithAuth(store).Handler()
+			do := func(path, token string, body interface{}) map[string]interface{} {
+				t.Helper()
+				encoded, err := json.Marshal(body)
+				require.NoError(t, err)
+				req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(encoded))
+				req.Header.Set("Content-Type", "application/json")
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, req)
+				require.Less(t, w.Code, 300, w.Body.String())
+				var resp map[string]interface{}
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+				return resp
+			}
+
+			registered := do("/api/v1/auth/register", "", map[string]string{
+				"email": "alice@example.com", "password": "correct horse battery",
+			})
+			token, _ := registered["access_token"].(string)
+			require.NotEmpty(t, token)
+
+			keyID := uuid.NewString()
+			ssh, legacy, unset, bad := uuid.NewString(), uuid.NewString(), uuid.NewString(), uuid.NewString()
+			cred := func(id string, protocol interface{}, port int) map[string]interface{} {
+				return map[string]interface{}{
+					"item_uuid": id, "server": "example.com", "account": id,
+					"protocol": protocol, "port": port, "password_key_uuid": keyID,
+				}
+			}
+			pushed := do("/api/v1/sync/push", token, map[string]interface{}{
+				"zone": "default",
+				"keys": []map[string]interface{}{{
+					"item_uuid": keyID, "key_class": 1, "key_type": 2, "label": "password key",
+					"data": "a2V5", "usage_flags": "e30=",
+				}},
+				"credential_metadata": []map[string]interface{}{
+					cred(ssh, "ssh", 0),
+					cred(legacy, 443, 8443),
+					cred(unset, nil, 0),
+					cred(bad, "gopher", 0),
+				},
+			})
+			assert.Equal(t, float64(1), pushed["failed_count"])
+			for _, item := range pushed["results"].([]interface{}) {
+				result := item.(map[string]interface{})
+				if result["item_uuid"] == bad {
+					assert.Equal(t, "failed", result["status"])
+					assert.Equal(t, "protocol", result["field"])
+				}
+			}
+
+			pull := func(token string) map[string][2]interface{} {
+				pulled := do("/api/v1/sync/pull", token, map[string]interface{}{"zone": "default"})
+				got := map[string][2]interface{}{}
+				for _, item := range pulled["credential_metadata"].([]interface{}) {
+					cred := item.(map[string]interface{})
+					got[cred["item_uuid"].(string)] = [2]interface{}{cred["protocol"], cred["port"]}
+				}
+				return got
+			}
+			assert.Equal(t, map[string][2]interface{}{
+				ssh:    {float64(22), float64(22)},
+				legacy: {float64(443), float64(8443)},
+				unset:  {float64(443), float64(443)},
+			}, pull(token), "clients that don't read sync schema 2 keep getting numbers")
+
+			device := do("/api/v1/devices", token, map[string]interface{}{
+				"device_name": "laptop", "device_type": "desktop",
+				"capabilities": map[string]interface{}{"sync_schema": 2},
+			})
+			loggedIn := do("/api/v1/auth/login", "", map[string]string{
+				"email": "alice@example.com", "password": "correct horse battery", "device_id": device["id"].(string),
+			})
+			assert.Equal(t, map[string][2]interface{}{
+				ssh:    {"ssh", float64(22)},
+				legacy: {"https", float64(8443)},
+				unset:  {"https", float64(443)},
+			}, pull(loggedIn["access_token"].(string)))
+		})
+	}
+}
+
+// A SQLite file written before protocols were an enum has the ports stored
+// as protocols reinterpreted on the next start, once
+func TestSQLiteUpgradesLegacyProtocols(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "password-sync.db")
+	store, err := storage.NewSQLiteStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+	require.NoError(t, store.ApplySchema())
+	user := newSQLiteUser(t, store, "alice@example.com")
+	batch, credID := sqliteBatch("default")
+	_, err = store.CommitPush(ctx, user.ID, batch)
+	require.NoError(t, err)
+
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	defer db.Close()
+	setProtocol := func(protocol int) {
+		_, err := db.Exec(`UPDATE credential_metadata SET protocol = $1 WHERE item_uuid = $2`, protocol, credID.String())
+		require.NoError(t, err)
+	}
+	protocol := func() int {
+		var protocol int
+		require.NoError(t, db.QueryRow(`SELECT protocol FROM credential_metadata WHERE item_uuid = $1`, credID.String()).Scan(&protocol))
+		return protocol
+	}
+
+	setProtocol(22)
+	_, err = db.Exec(`PRAGMA user_version = 2`)
+	require.NoError(t, err)
+	require.NoError(t, store.ApplySchema())
+	assert.Equal(t, int(models.ProtocolSSH), protocol())
+
+	setProtocol(22)
+	require.NoError(t, store.ApplySchema())
+	assert.Equal(t, 22, protocol(), "already upgraded")
+}
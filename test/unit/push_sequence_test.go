@@ -0,0 +1,59 @@
+package unit
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPushSequenceOfflineFlush(t *testing.T) {
+	// A flush split into pushes 1, 2 and 3; push 2 failed and the device
+	// retries all three in whatever order its queue gives
+	last := int64(0)
+	require.NoError(t, sync.CheckPushSequence(last, 1))
+	last = 1
+
+	err := sync.CheckPushSequence(last, 3)
+	var sequenceErr *sync.PushSequenceError
+	require.True(t, errors.As(err, &sequenceErr), "3 must wait for 2")
+	assert.True(t, errors.Is(err, sync.ErrPushSequence))
+	assert.Equal(t, int64(2), sequenceErr.Expected)
+	assert.Equal(t, int64(3), sequenceErr.Received)
+	assert.False(t, sequenceErr.Duplicate())
+
+	err = sync.CheckPushSequence(last, 1)
+	require.True(t, errors.As(err, &sequenceErr))
+	assert.True(t, sequenceErr.Duplicate(), "1 was applied before and can be dropped")
+	assert.Equal(t, int64(2), sequenceErr.Expected)
+
+	require.NoError(t, sync.CheckPushSequence(last, 2))
+	last = 2
+	require.NoError(t, sync.CheckPushSequence(last, 3))
+}
+
+func TestCheckPushSequenceFirstPush(t *testing.T) {
+	err := sync.CheckPushSequence(0, 4)
+	var sequenceErr *sync.PushSequenceError
+	require.True(t, errors.As(err, &sequenceErr), "a device's numbering starts at 1")
+	assert.Equal(t, int64(1), sequenceErr.Expected)
+	assert.False(t, sequenceErr.Duplicate())
+}
+
+func TestNumberedPushNeedsDevice(t *testing.T) {
+	// The hold router's token carries no device claim
+	request := newHoldRouter(t, newProfileSource())
+
+	w := request(http.MethodPost, "/sync/push", map[string]interface{}{"zone": "default", "sequence": 1})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var body map[string]string
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "device_required", body["code"])
+
+	w = request(http.MethodPost, "/sync/push", map[string]interface{}{"zone": "default", "sequence": -1})
+	assert.Equal(t, http.StatusBadRequest, w.Code, "sequences start at 1")
+}
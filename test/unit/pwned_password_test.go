@@ -0,0 +1,73 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/breach"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A range is fetched once with padding, cached, and answered without its
+// padding entries; only a 5 character prefix is accepted
+func TestCheckPasswordRange(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	// A prefix of its own, so no other test's cached range answers
+	prefix := fmt.Sprintf("%05X", time.Now().UnixNano()&0xFFFFF)
+	var hits atomic.Int32
+	var padding atomic.Value
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		padding.Store(r.Header.Get("Add-Padding"))
+		if r.URL.Path != "/range/"+prefix {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, "0018A45C4D1DEF81644B54AB7F969B88D65:3\r\n00D4F6E8FA6EECAD2A3AA415EEC418D38EC:0\r\n011053FD0102E94D6AE2F8B83D76FAF94F6:12\r\n")
+	}))
+	defer upstream.Close()
+	t.Setenv("PWNED_PASSWORDS_API_URL", upstream.URL)
+
+	router := gin.New()
+	router.POST("/breach/password", breach.CheckPassword)
+	check := func(body string, status int) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/breach/password", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, status, w.Code, w.Body.String())
+		return w
+	}
+
+	for _, typed := range []string{strings.ToLower(prefix), prefix} {
+		w := check(`{"prefix":"`+typed+`"}`, http.StatusOK)
+		var resp breach.PasswordRangeResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, prefix, resp.Prefix)
+		assert.Equal(t, []breach.PasswordSuffix{
+			{Suffix: "0018A45C4D1DEF81644B54AB7F969B88D65", Count: 3},
+			{Suffix: "011053FD0102E94D6AE2F8B83D76FAF94F6", Count: 12},
+		}, resp.Suffixes)
+	}
+	assert.Equal(t, int32(1), hits.Load(), "the second check is answered from the cache")
+	assert.Equal(t, "true", padding.Load())
+
+	fullHash := "5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8"
+	for _, body := range []string{`{"prefix":"` + fullHash + `"}`, `{"prefix":"5BAA"}`, `{"prefix":"5BAG6"}`} {
+		w := check(body, http.StatusBadRequest)
+		assert.Contains(t, w.Body.String(), "invalid_prefix")
+		assert.NotContains(t, w.Body.String(), fullHash[5:], "a refused value is never echoed")
+	}
+	check(`{}`, http.StatusBadRequest)
+	assert.Equal(t, int32(1), hits.Load())
+}
@@ -0,0 +1,132 @@
+package unit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/metrics"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRateLimitedLogin serves a login that accepts only "right" as password,
+// behind the limiter. The returned function logs in from ip and returns
+// the response.
+func newRateLimitedLogin(t *testing.T, limiter *middleware.RateLimiter) func(ip, email, password string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/auth/login", middleware.RateLimit(limiter), func(c *gin.Context) {
+		var req struct {
+			Email    string `json:"email"`
+			Password string `json:"password"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Password != "right" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"email": req.Email})
+	})
+
+	return func(ip, email, password string) *httptest.ResponseRecorder {
+		body := `{"email":"` + email + `","password":"` + password + `"}`
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = ip + ":4711"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+}
+
+func TestRateLimitInMemory(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	limiter := middleware.NewRateLimiter(middleware.RateLimitOptions{
+		IPAttempts:    5,
+		EmailAttempts: 3,
+		Window:        time.Minute,
+		Now:           func() time.Time { return now },
+	})
+	login := newRateLimitedLogin(t, limiter)
+	limited := metrics.Value(middleware.MetricRateLimited)
+
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusUnauthorized, login("10.0.0.1", "alice@example.com", "wrong").Code)
+	}
+	w := login("10.0.0.1", "alice@example.com", "right")
+	require.Equal(t, http.StatusTooManyRequests, w.Code, "even the right password waits")
+	assert.Equal(t, "20", w.Header().Get("Retry-After"), "one attempt refills in a third of the window")
+	assert.Contains(t, w.Body.String(), `"rate_limited"`)
+	assert.Equal(t, limited+1, metrics.Value(middleware.MetricRateLimited))
+
+	// The email is counted whatever the case and address it comes from
+	assert.Equal(t, http.StatusTooManyRequests, login("10.0.0.2", " Alice@Example.com", "right").Code)
+	assert.Equal(t, http.StatusOK, login("10.0.0.1", "bob@example.com", "right").Code, "other emails are fine")
+
+	now = now.Add(20 * time.Second)
+	require.Equal(t, http.StatusOK, login("10.0.0.1", "alice@example.com", "right").Code)
+	assert.Equal(t, http.StatusUnauthorized, login("10.0.0.1", "alice@example.com", "wrong").Code,
+		"a successful login clears the email's count")
+
+	t.Run("per IP address", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			require.Equal(t, http.StatusUnauthorized, login("10.0.0.9", fmt.Sprintf("user%d@example.com", i), "wrong").Code)
+		}
+		assert.Equal(t, http.StatusTooManyRequests, login("10.0.0.9", "zed@example.com", "right").Code)
+		assert.Equal(t, http.StatusOK, login("10.0.0.10", "zed@example.com", "right").Code)
+	})
+
+	t.Run("requests without an email count against the IP address", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			require.Equal(t, http.StatusUnauthorized, login("10.0.0.20", "", "wrong").Code)
+		}
+		assert.Equal(t, http.StatusTooManyRequests, login("10.0.0.20", "carol@example.com", "right").Code)
+	})
+}
+
+func TestRateLimitRedis(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	opts := middleware.RateLimitOptions{IPAttempts: 10, EmailAttempts: 2, Window: time.Minute, Redis: client}
+	login := newRateLimitedLogin(t, middleware.NewRateLimiter(opts))
+	// A second instance shares the counts
+	other := newRateLimitedLogin(t, middleware.NewRateLimiter(opts))
+
+	require.Equal(t, http.StatusUnauthorized, login("10.0.0.1", "alice@example.com", "wrong").Code)
+	require.Equal(t, http.StatusUnauthorized, other("10.0.0.2", "alice@example.com", "wrong").Code)
+	w := login("10.0.0.3", "alice@example.com", "right")
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	for _, key := range server.Keys() {
+		assert.NotContains(t, key, "alice", "emails are hashed")
+	}
+
+	server.FastForward(time.Minute)
+	require.Equal(t, http.StatusOK, other("10.0.0.3", "alice@example.com", "right").Code)
+	require.Equal(t, http.StatusUnauthorized, login("10.0.0.1", "alice@example.com", "wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, login("10.0.0.1", "alice@example.com", "wrong").Code, "the count started over")
+
+	t.Run("falls back to memory when Redis is down", func(t *testing.T) {
+		server.Close()
+		redisErrors := metrics.Value(middleware.MetricRateLimitRedisError)
+
+		require.Equal(t, http.StatusUnauthorized, login("10.0.0.4", "bob@example.com", "wrong").Code)
+		require.Equal(t, http.StatusUnauthorized, login("10.0.0.4", "bob@example.com", "wrong").Code)
+		assert.Equal(t, http.StatusTooManyRequests, login("10.0.0.4", "bob@example.com", "right").Code)
+		assert.Greater(t, metrics.Value(middleware.MetricRateLimitRedisError), redisErrors)
+	})
+}
@@ -0,0 +1,69 @@
+package unit
+
+import (
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRegions(t *testing.T) {
+	regions, err := storage.ParseRegions(" eu=postgres://eu-db/sync?sslmode=disable , us-east=host=us-db dbname=sync ,")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"eu":      "postgres://eu-db/sync?sslmode=disable",
+		"us-east": "host=us-db dbname=sync",
+	}, regions, "only the first '=' separates the name")
+
+	regions, err = storage.ParseRegions("")
+	require.NoError(t, err)
+	assert.Empty(t, regions)
+
+	for _, value := range []string{
+		"eu",                          // no connection string
+		"eu=",                         // empty connection string
+		"EU=postgres://eu-db",         // uppercase
+		"default=postgres://other-db", // the primary
+		"eu=postgres://a,eu=postgres://b",
+	} {
+		_, err := storage.ParseRegions(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestUsersLiveInDefaultRegionWithoutRegions(t *testing.T) {
+	// Without other regions nothing is looked up: no database needed
+	pgStore := &storage.PostgresStore{}
+
+	assert.Equal(t, []string{storage.DefaultRegion}, pgStore.Regions())
+	assert.True(t, pgStore.HasRegion(storage.DefaultRegion))
+	assert.False(t, pgStore.HasRegion("eu"))
+
+	region, err := pgStore.UserRegion(activityAlice)
+	require.NoError(t, err)
+	assert.Equal(t, storage.DefaultRegion, region)
+}
+
+func TestCompareTableDigests(t *testing.T) {
+	source := []storage.TableDigest{
+		{Table: "users", Rows: 1, Digest: "a"},
+		{Table: "sync_records", Rows: 40, Digest: "b"},
+		{Table: "audit_events", Rows: 0, Digest: ""},
+	}
+	assert.NoError(t, storage.CompareTableDigests(source, source))
+
+	target := []storage.TableDigest{
+		{Table: "users", Rows: 1, Digest: "a"},
+		{Table: "sync_records", Rows: 39, Digest: "c"},
+	}
+	err := storage.CompareTableDigests(source, target)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "sync_records: 39 rows copied, source has 40")
+	assert.Contains(t, err.Error(), "audit_events: not copied")
+	assert.NotContains(t, err.Error(), "users")
+
+	target[1] = storage.TableDigest{Table: "sync_records", Rows: 40, Digest: "c"}
+	target = append(target, source[2])
+	assert.ErrorContains(t, storage.CompareTableDigests(source, target), "sync_records: copied rows differ")
+}
@@ -0,0 +1,280 @@
+package unit
+
+import (
+	"context"
+	"errors"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// engineStore stands in for the sync_state table
+type engineStore struct {
+	mu     gosync.Mutex
+	states map[string]sync.EngineState
+	loads  map[string]int
+	saves  int
+	gate   chan struct{} // When set, loads block until it is closed
+	failOn string        // Key whose saves fail
+}
+
+func newEngineStore() *engineStore {
+	return &engineStore{states: map[string]sync.EngineState{}, loads: map[string]int{}}
+}
+
+func (s *engineStore) LoadEngineState(userID, zone string) (*sync.EngineState, error) {
+	if s.gate != nil {
+		<-s.gate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := userID + "/" + zone
+	s.loads[key]++
+	state := s.states[key]
+	return &state, nil
+}
+
+func (s *engineStore) SaveEngineState(userID, zone string, state *sync.EngineState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := userID + "/" + zone
+	if key == s.failOn {
+		return errors.New("save failed")
+	}
+	s.saves++
+	s.states[key] = *state
+	return nil
+}
+
+func (s *engineStore) state(key string) sync.EngineState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.states[key]
+}
+
+func (s *engineStore) loadCount(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loads[key]
+}
+
+func TestRegistryGetOrLoad(t *testing.T) {
+	store := newEngineStore()
+	store.states["alice/default"] = sync.EngineState{GenCount: 41}
+	registry := sync.NewRegistry(store, 10)
+
+	engine, err := registry.GetOrLoad("alice", "default")
+	require.NoError(t, err)
+	assert.Equal(t, int64(41), engine.GetCurrentGenCount())
+
+	again, err := registry.GetOrLoad("alice", "default")
+	require.NoError(t, err)
+	assert.Same(t, engine, again)
+	assert.Equal(t, 1, store.loadCount("alice/default"))
+
+	other, err := registry.GetOrLoad("alice", "work")
+	require.NoError(t, err)
+	assert.NotSame(t, engine, other, "zones get separate engines")
+	assert.Equal(t, 2, registry.Len())
+}
+
+func TestRegistryConcurrentLoadsShareOne(t *testing.T) {
+	store := newEngineStore()
+	store.gate = make(chan struct{})
+	registry := sync.NewRegistry(store, 10)
+
+	const workers = 50
+	engines := make([]*sync.SyncEngine, workers)
+	var wg gosync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			engine, err := registry.GetOrLoad("alice", "default")
+			assert.NoError(t, err)
+			engines[i] = engine
+		}(i)
+	}
+
+	time.Sleep(20 * time.Millisecond) // Let the goroutines pile up on the load
+	close(store.gate)
+	wg.Wait()
+
+	assert.Equal(t, 1, store.loadCount("alice/default"))
+	for _, engine := range engines {
+		assert.Same(t, engines[0], engine)
+	}
+}
+
+func TestRegistryConcurrentPushesReserveDisjointGenCounts(t *testing.T) {
+	store := newEngineStore()
+	registry := sync.NewRegistry(store, 10)
+
+	const workers, perPush = 50, 20
+	var mu gosync.Mutex
+	seen := map[int64]bool{}
+	var wg gosync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			engine, err := registry.GetOrLoad("alice", "default")
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			last := engine.ReserveGenCounts(perPush)
+			engine.UpdateManifestDigest([]sync.ManifestLeaf{{Layer: sync.LeafSyncRecord, ItemUUID: "leaf", GenCount: last}})
+			assert.NoError(t, registry.Persist("alice", "default", engine))
+
+			mu.Lock()
+			defer mu.Unlock()
+			for gen := last - perPush + 1; gen <= last; gen++ {
+				assert.False(t, seen[gen], "gencount %d handed out twice", gen)
+				seen[gen] = true
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, seen, workers*perPush)
+	assert.Equal(t, int64(workers*perPush), store.state("alice/default").GenCount)
+}
+
+func TestRegistryEvictionPersistsDirtyState(t *testing.T) {
+	store := newEngineStore()
+	registry := sync.NewRegistry(store, 2)
+
+	alice, err := registry.GetOrLoad("alice", "default")
+	require.NoError(t, err)
+	alice.ReserveGenCounts(5) // Dirty, never persisted
+
+	_, err = registry.GetOrLoad("bob", "default")
+	require.NoError(t, err)
+	assert.Equal(t, 0, store.saves, "clean engines and unevicted ones are not saved")
+
+	_, err = registry.GetOrLoad("carol", "default")
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, registry.Len())
+	assert.Equal(t, int64(5), store.state("alice/default").GenCount)
+	assert.Equal(t, 1, store.saves, "only the dirty evicted engine is saved")
+
+	reloaded, err := registry.GetOrLoad("alice", "default")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), reloaded.GetCurrentGenCount())
+}
+
+func TestRegistryPersistSkipsCleanEngines(t *testing.T) {
+	store := newEngineStore()
+	registry := sync.NewRegistry(store, 10)
+
+	engine, err := registry.GetOrLoad("alice", "default")
+	require.NoError(t, err)
+	require.NoError(t, registry.Persist("alice", "default", engine))
+	assert.Equal(t, 0, store.saves)
+
+	engine.IncrementGenCount()
+	require.NoError(t, registry.Persist("alice", "default", engine))
+	require.NoError(t, registry.Flush())
+	assert.Equal(t, 1, store.saves)
+
+	store.failOn = "alice/default"
+	engine.IncrementGenCount()
+	assert.Error(t, registry.Persist("alice", "default", engine))
+	assert.Error(t, registry.Flush(), "a failed save leaves the engine dirty")
+}
+
+func TestRegistryInvalidate(t *testing.T) {
+	store := newEngineStore()
+	registry := sync.NewRegistry(store, 10)
+
+	engine, err := registry.GetOrLoad("alice", "default")
+	require.NoError(t, err)
+
+	// Another instance advances the state
+	store.states["alice/default"] = sync.EngineState{GenCount: 99}
+	registry.Invalidate("alice", "default")
+	assert.Equal(t, 0, registry.Len())
+
+	reloaded, err := registry.GetOrLoad("alice", "default")
+	require.NoError(t, err)
+	assert.NotSame(t, engine, reloaded)
+	assert.Equal(t, int64(99), reloaded.GetCurrentGenCount())
+}
+
+func TestRegistrySetStrategy(t *testing.T) {
+	registry := sync.NewRegistry(newEngineStore(), 10)
+	held, err := registry.GetOrLoad("alice", "default")
+	require.NoError(t, err)
+	assert.Equal(t, sync.LastWriteWins, held.Strategy())
+
+	registry.SetStrategy(sync.ManualResolve)
+	assert.Equal(t, sync.ManualResolve, held.Strategy())
+	loaded, err := registry.GetOrLoad("alice", "work")
+	require.NoError(t, err)
+	assert.Equal(t, sync.ManualResolve, loaded.Strategy())
+	_, err = loaded.ResolveConflict(&models.SyncRecord{GenCount: 2}, &models.SyncRecord{GenCount: 1})
+	assert.ErrorIs(t, err, sync.ErrManualResolve)
+}
+
+func TestRegistryRedisInvalidation(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := newEngineStore()
+	instanceA := sync.NewRegistry(store, 10)
+	instanceB := sync.NewRegistry(store, 10)
+	require.NoError(t, instanceA.UseRedis(ctx, redis.NewClient(&redis.Options{Addr: mr.Addr()})))
+	require.NoError(t, instanceB.UseRedis(ctx, redis.NewClient(&redis.Options{Addr: mr.Addr()})))
+
+	engineA, err := instanceA.GetOrLoad("alice", "default")
+	require.NoError(t, err)
+	_, err = instanceB.GetOrLoad("alice", "default")
+	require.NoError(t, err)
+
+	engineA.ReserveGenCounts(3)
+	require.NoError(t, instanceA.Persist("alice", "default", engineA))
+
+	assert.Eventually(t, func() bool { return instanceB.Len() == 0 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, instanceA.Len(), "an instance ignores its own invalidations")
+
+	engineB, err := instanceB.GetOrLoad("alice", "default")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), engineB.GetCurrentGenCount())
+}
+
+func TestRegistryPersistsLastWriter(t *testing.T) {
+	store := newEngineStore()
+	registry := sync.NewRegistry(store, 10)
+
+	engine, err := registry.GetOrLoad("alice", "default")
+	require.NoError(t, err)
+	engine.ReserveGenCounts(1)
+	engine.RecordWriter("device-1")
+	require.NoError(t, registry.Persist("alice", "default", engine))
+	assert.Equal(t, "device-1", store.state("alice/default").LastWriter)
+
+	// A later push without a device claim clears it instead of keeping
+	// the previous device
+	engine.ReserveGenCounts(1)
+	engine.RecordWriter("")
+	require.NoError(t, registry.Persist("alice", "default", engine))
+	assert.Empty(t, store.state("alice/default").LastWriter)
+
+	store.states["alice/default"] = sync.EngineState{GenCount: 9, LastWriter: "device-2"}
+	registry.Invalidate("alice", "default")
+	reloaded, err := registry.GetOrLoad("alice", "default")
+	require.NoError(t, err)
+	state, dirty := reloaded.Snapshot()
+	assert.False(t, dirty)
+	assert.Equal(t, "device-2", state.LastWriter)
+}
@@ -0,0 +1,274 @@
+package unit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/deeplyprofound/password-sync/server/api/handlers"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/gin-gonic/gin"
+	gorilla "github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func seqs(events []*websocket.SyncEvent) []int64 {
+	out := make([]int64, 0, len(events))
+	for _, event := range events {
+		out = append(out, event.Seq)
+	}
+	return out
+}
+
+func TestMemoryEventLog(t *testing.T) {
+	ctx := context.Background()
+	log := websocket.NewMemoryEventLog(3)
+
+	events, err := log.Since(ctx, "alice", 0)
+	require.NoError(t, err)
+	assert.Empty(t, events, "nothing happened yet")
+
+	for i := int64(1); i <= 5; i++ {
+		event := changed("alice", "default", i*10)
+		require.NoError(t, log.Append(ctx, event))
+		assert.Equal(t, i, event.Seq)
+	}
+	bob := changed("bob", "default", 1)
+	require.NoError(t, log.Append(ctx, bob))
+	assert.Equal(t, int64(1), bob.Seq, "sequences are per user")
+
+	events, err = log.Since(ctx, "alice", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{3, 4, 5}, seqs(events))
+	assert.Equal(t, int64(30), events[0].GenCount)
+
+	events, err = log.Since(ctx, "alice", 5)
+	require.NoError(t, err)
+	assert.Empty(t, events, "up to date")
+
+	_, err = log.Since(ctx, "alice", 1)
+	assert.ErrorIs(t, err, websocket.ErrSequenceTrimmed, "seq 2 fell out of the log")
+	_, err = log.Since(ctx, "alice", 9)
+	assert.ErrorIs(t, err, websocket.ErrSequenceTrimmed, "a sequence this log never issued")
+	_, err = log.Since(ctx, "carol", 4)
+	assert.ErrorIs(t, err, websocket.ErrSequenceTrimmed)
+}
+
+func TestRedisEventLogSharedAcrossInstances(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	newLog := func() *websocket.RedisEventLog {
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return websocket.NewRedisEventLog(client, 10)
+	}
+	instanceA, instanceB := newLog(), newLog()
+
+	// Both instances append concurrently; every sequence is issued once
+	var wg gosync.WaitGroup
+	var mu gosync.Mutex
+	issued := map[int64]bool{}
+	for _, log := range []*websocket.RedisEventLog{instanceA, instanceB} {
+		wg.Add(1)
+		go func(log *websocket.RedisEventLog) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				event := changed("alice", "default", int64(i))
+				require.NoError(t, log.Append(ctx, event))
+				mu.Lock()
+				issued[event.Seq] = true
+				mu.Unlock()
+			}
+		}(log)
+	}
+	wg.Wait()
+	assert.Len(t, issued, 50)
+	for seq := int64(1); seq <= 50; seq++ {
+		assert.True(t, issued[seq], "seq %d", seq)
+	}
+
+	events, err := instanceB.Since(ctx, "alice", 45)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{46, 47, 48, 49, 50}, seqs(events))
+	assert.Equal(t, "alice", events[0].UserID)
+
+	events, err = instanceA.Since(ctx, "alice", 50)
+	require.NoError(t, err)
+	assert.Empty(t, events)
+
+	_, err = instanceA.Since(ctx, "alice", 39)
+	assert.ErrorIs(t, err, websocket.ErrSequenceTrimmed, "only the last 10 are kept")
+	_, err = instanceA.Since(ctx, "alice", 51)
+	assert.ErrorIs(t, err, websocket.ErrSequenceTrimmed)
+
+	// Identical events are kept apart
+	same := &websocket.SyncEvent{Type: "credentials_changed", UserID: "bob", Zone: "default", GenCount: 7, Timestamp: 1}
+	for i := 0; i < 2; i++ {
+		copied := *same
+		require.NoError(t, instanceA.Append(ctx, &copied))
+	}
+	events, err = instanceB.Since(ctx, "bob", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{1, 2}, seqs(events))
+}
+
+// liveServer serves /sync/live through the real handler for user alice
+func liveServer(t *testing.T, hub *websocket.Hub) string {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/sync/live", func(c *gin.Context) {
+		middleware.SetClaims(c, &auth.Claims{UserID: "alice"})
+	}, handlers.NewWebSocketHandler(hub, middleware.NewOriginPolicy(nil, false)).HandleWebSocket)
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/sync/live"
+}
+
+func dialLive(t *testing.T, url string) *gorilla.Conn {
+	t.Helper()
+	conn, _, err := gorilla.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readEvent(t *testing.T, conn *gorilla.Conn) *websocket.SyncEvent {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	var event websocket.SyncEvent
+	require.NoError(t, json.Unmarshal(message, &event))
+	return &event
+}
+
+func assertNoMessage(t *testing.T, conn *gorilla.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, message, err := conn.ReadMessage()
+	require.Error(t, err, "unexpected message %s", message)
+}
+
+func TestWebSocketResumeAcrossBurst(t *testing.T) {
+	logs := map[string]func() websocket.EventLog{
+		"memory": func() websocket.EventLog { return websocket.NewMemoryEventLog(100) },
+		"redis": func() websocket.EventLog {
+			client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+			t.Cleanup(func() { client.Close() })
+			return websocket.NewRedisEventLog(client, 100)
+		},
+	}
+	for name, newLog := range logs {
+		t.Run(name, func(t *testing.T) {
+			hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond})
+			hub.SetEventLog(newLog())
+			url := liveServer(t, hub)
+
+			conn := dialLive(t, url)
+			time.Sleep(20 * time.Millisecond) // Registered
+			require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", 1)))
+			first := readEvent(t, conn)
+			assert.Equal(t, int64(1), first.Seq)
+
+			// Kill the connection, then miss a burst of events, some of
+			// them in another zone
+			conn.Close()
+			time.Sleep(20 * time.Millisecond)
+			for i := int64(2); i <= 21; i++ {
+				zone := "default"
+				if i%5 == 0 {
+					zone = "work"
+				}
+				require.NoError(t, hub.BroadcastSyncEvent(changed("alice", zone, i)))
+			}
+			time.Sleep(20 * time.Millisecond)
+
+			resumed := dialLive(t, fmt.Sprintf("%s?last_seq=%d", url, first.Seq))
+			var replayed []int64
+			for i := int64(2); i <= 21; i++ {
+				if i%5 == 0 {
+					continue
+				}
+				event := readEvent(t, resumed)
+				assert.Equal(t, "default", event.Zone)
+				assert.Equal(t, event.Seq, event.GenCount)
+				replayed = append(replayed, event.Seq)
+			}
+			assert.Equal(t, []int64{2, 3, 4, 6, 7, 8, 9, 11, 12, 13, 14, 16, 17, 18, 19, 21}, replayed)
+
+			// Then live, without repeats
+			require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", 22)))
+			assert.Equal(t, int64(22), readEvent(t, resumed).Seq)
+			assertNoMessage(t, resumed)
+		})
+	}
+}
+
+func TestWebSocketResumeDuringBurst(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond})
+	hub.SetEventLog(websocket.NewMemoryEventLog(1000))
+	url := liveServer(t, hub)
+
+	// Events keep coming while the client reconnects: whatever is both
+	// replayed and queued live arrives once
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := int64(1); i <= 200; i++ {
+			hub.BroadcastSyncEvent(&websocket.SyncEvent{Type: fmt.Sprintf("changed_%d", i), UserID: "alice", Zone: "default", GenCount: i})
+			time.Sleep(200 * time.Microsecond)
+		}
+	}()
+	time.Sleep(5 * time.Millisecond)
+	conn := dialLive(t, url+"?last_seq=0")
+	<-done
+
+	seen := map[int64]bool{}
+	for len(seen) < 200 {
+		event := readEvent(t, conn)
+		require.False(t, seen[event.Seq], "seq %d delivered twice", event.Seq)
+		seen[event.Seq] = true
+	}
+	assertNoMessage(t, conn)
+}
+
+func TestWebSocketResumeTrimmed(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{FlushInterval: 5 * time.Millisecond})
+	hub.SetEventLog(websocket.NewMemoryEventLog(5))
+	url := liveServer(t, hub)
+
+	for i := int64(1); i <= 10; i++ {
+		require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", i)))
+	}
+
+	conn := dialLive(t, url+"?last_seq=2")
+	event := readEvent(t, conn)
+	assert.Equal(t, websocket.EventResyncRequired, event.Type)
+	assert.Zero(t, event.Seq)
+
+	// Still live afterwards
+	require.NoError(t, hub.BroadcastSyncEvent(changed("alice", "default", 11)))
+	assert.Equal(t, int64(11), readEvent(t, conn).Seq)
+}
+
+func TestWebSocketResumeRejectsBadSequence(t *testing.T) {
+	hub := startHub(t, websocket.HubOptions{})
+	url := liveServer(t, hub)
+
+	resp, err := http.Get("http" + strings.TrimPrefix(url, "ws") + "?last_seq=-1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
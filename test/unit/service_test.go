@@ -0,0 +1,2166 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/limits"
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/mail"
+	"github.com/deeplyprofound/password-sync/server/service"
+	authservice "github.com/deeplyprofound/password-sync/server/service/auth"
+	"github.com/deeplyprofound/password-sync/server/service/device"
+	syncservice "github.com/deeplyprofound/password-sync/server/service/sync"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memStore is an in-memory stand-in for the PostgresStore behind the
+// device, auth and sync services
+type memStore struct {
+	clock     *fakeClock
+	newID     func() string // IDs of new users, devices and refresh tokens
+	users     map[string]*storage.User
+	tokens    map[string]*storage.RefreshToken
+	devices   map[string]*storage.Device
+	states    map[string]*storage.SyncState
+	sequences map[string]int64
+	leaves    map[string][]string
+	wipes     []*storage.BulkWipe
+	trashed   map[string][]string // Item UUIDs by wipe ID
+	commits   []*storage.PushBatch
+	conflicts []*storage.SyncConflict // Manual conflicts, in queue order
+	audit     []*storage.AuditEvent
+	approval  string                    // The account's device approval setting
+	rejectIDs map[string]bool           // Item UUIDs CommitPush refuses, like a violated constraint
+	failures  map[string]int            // Consecutive wrong passwords by user ID
+	locks     map[string]time.Time      // Login lockouts by user ID
+	resets    map[string]*memResetToken // Password reset tokens by hex hash
+	prints    map[string]string         // Device fingerprints by device ID
+
+	scan     *storage.IntegrityScan // What ScanIntegrity returns
+	scanErr  error
+	scanOpts storage.IntegrityScanOptions
+}
+
+func newMemStore(clock *fakeClock) *memStore {
+	return &memStore{
+		clock:     clock,
+		newID:     func() string { return uuid.New().String() },
+		users:     map[string]*storage.User{},
+		tokens:    map[string]*storage.RefreshToken{},
+		devices:   map[string]*storage.Device{},
+		states:    map[string]*storage.SyncState{},
+		sequences: map[string]int64{},
+		leaves:    map[string][]string{},
+		trashed:   map[string][]string{},
+		failures:  map[string]int{},
+		locks:     map[string]time.Time{},
+		resets:    map[string]*memResetToken{},
+		prints:    map[string]string{},
+	}
+}
+
+type memResetToken struct {
+	userID    string
+	expiresAt time.Time
+	used      bool
+}
+
+func (s *memStore) RecordAuditEvents(events []*storage.AuditEvent) error {
+	for _, event := range events {
+		if event.CreatedAt.IsZero() {
+			event.CreatedAt = s.clock.Now()
+		}
+	}
+	s.audit = append(s.audit, events...)
+	return nil
+}
+
+func (s *memStore) AuditEventTimes(ctx context.Context, userID, action string, since time.Time) ([]time.Time, error) {
+	var times []time.Time
+	for _, event := range s.audit {
+		if event.UserID == userID && event.Action == action && event.CreatedAt.After(since) {
+			times = append(times, event.CreatedAt)
+		}
+	}
+	return times, nil
+}
+
+func (s *memStore) actions() []string {
+	var actions []string
+	for _, event := range s.audit {
+		actions = append(actions, event.Action)
+	}
+	return actions
+}
+
+// Devices
+
+func (s *memStore) CreateDevice(userID, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte) (*storage.Device, error) {
+	if capabilities == nil {
+		capabilities = []byte("{}")
+	}
+	d := &storage.Device{
+		ID:            s.newID(),
+		UserID:        userID,
+		DeviceName:    deviceName,
+		DeviceType:    deviceType,
+		PublicKey:     publicKey,
+		CreatedAt:     s.clock.Now(),
+		IsActive:      true,
+		MaxEncVersion: maxEncVersion,
+		TrustLevel:    int(peer.InitialTrustLevel(s.approval)),
+		Capabilities:  capabilities,
+	}
+	s.devices[d.ID] = d
+	return d, nil
+}
+
+func (s *memStore) UpsertDevice(userID, fingerprint, deviceName, deviceType string, publicKey []byte, maxEncVersion int, capabilities []byte) (*storage.Device, bool, error) {
+	for id, print := range s.prints {
+		d := s.devices[id]
+		if print != fingerprint || d.UserID != userID || !d.IsActive {
+			continue
+		}
+		d.DeviceName, d.DeviceType = deviceName, deviceType
+		if publicKey != nil {
+			if d.PublicKey != nil && !bytes.Equal(d.PublicKey, publicKey) {
+				d.TrustLevel = int(peer.InitialTrustLevel(s.approval))
+			}
+			d.PublicKey = publicKey
+		}
+		if maxEncVersion > 0 {
+			d.MaxEncVersion = maxEncVersion
+		}
+		if capabilities != nil {
+			d.Capabilities = capabilities
+		}
+		return d, false, nil
+	}
+
+	d, err := s.CreateDevice(userID, deviceName, deviceType, publicKey, maxEncVersion, capabilities)
+	if err != nil {
+		return nil, false, err
+	}
+	s.prints[d.ID] = fingerprint
+	return d, true, nil
+}
+
+func (s *memStore) GetDevicesByUserID(userID string) ([]*storage.Device, error) {
+	var result []*storage.Device
+	for _, d := range s.devices {
+		if d.UserID == userID && d.IsActive {
+			result = append(result, d)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].DeviceName < result[j].DeviceName })
+	return result, nil
+}
+
+func (s *memStore) HasActiveDevice(userID, fingerprint string) (bool, error) {
+	for id, print := range s.prints {
+		if d := s.devices[id]; print == fingerprint && d.UserID == userID && d.IsActive {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetAccountUsage counts the credentials whose latest committed metadata is
+// live, and the active devices
+func (s *memStore) GetAccountUsage(_ context.Context, userID string) (*storage.AccountUsage, error) {
+	live := map[string]bool{}
+	for _, batch := range s.commits {
+		for _, m := range batch.Metadata {
+			if m.UserID.String() == userID {
+				live[m.Zone+"/"+m.ItemUUID.String()] = !m.Tombstone
+			}
+		}
+	}
+	usage := &storage.AccountUsage{}
+	for _, isLive := range live {
+		if isLive {
+			usage.Credentials++
+		}
+	}
+	devices, _ := s.GetDevicesByUserID(userID)
+	usage.Devices = int64(len(devices))
+	return usage, nil
+}
+
+func (s *memStore) RevokeDevice(userID, deviceID string) error {
+	revoked, _ := s.RevokeDevices(userID, []string{deviceID})
+	if len(revoked) == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *memStore) RevokeDevices(userID string, deviceIDs []string) ([]string, error) {
+	var revoked []string
+	for _, id := range deviceIDs {
+		if d, ok := s.devices[id]; ok && d.UserID == userID && d.IsActive {
+			d.IsActive = false
+			d.TrustLevel = int(peer.TrustLevelRevoked)
+			revoked = append(revoked, id)
+		}
+	}
+	return revoked, nil
+}
+
+func (s *memStore) GetDevice(_ context.Context, userID, deviceID string) (*storage.Device, error) {
+	if d, ok := s.devices[deviceID]; ok && d.UserID == userID {
+		copied := *d
+		return &copied, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *memStore) SetDeviceTrustLevel(userID, deviceID string, from, to int) error {
+	d, ok := s.devices[deviceID]
+	if !ok || d.UserID != userID || !d.IsActive || d.TrustLevel != from {
+		return sql.ErrNoRows
+	}
+	d.TrustLevel = to
+	return nil
+}
+
+func (s *memStore) FindStaleDevices(userID string, olderThan time.Time, exceptDeviceID string) ([]*storage.StaleDevice, error) {
+	devices, _ := s.GetDevicesByUserID(userID)
+	var stale []*storage.StaleDevice
+	for _, d := range devices {
+		lastActive := d.CreatedAt
+		if d.LastSync != nil {
+			lastActive = *d.LastSync
+		}
+		if d.ID != exceptDeviceID && lastActive.Before(olderThan) {
+			stale = append(stale, &storage.StaleDevice{Device: *d, LastActive: lastActive})
+		}
+	}
+	return stale, nil
+}
+
+func (s *memStore) UpdateDeviceLastSync(_ context.Context, deviceID string) error {
+	if d, ok := s.devices[deviceID]; ok {
+		now := s.clock.Now()
+		d.LastSync = &now
+	}
+	return nil
+}
+
+func (s *memStore) SetDeviceMaxEncVersion(userID, deviceID string, version int) error {
+	if d, ok := s.devices[deviceID]; ok && d.UserID == userID {
+		d.MaxEncVersion = version
+	}
+	return nil
+}
+
+func (s *memStore) RenameDevice(userID, deviceID, name string) error {
+	d, ok := s.devices[deviceID]
+	if !ok || d.UserID != userID || !d.IsActive {
+		return sql.ErrNoRows
+	}
+	d.DeviceName = name
+	return nil
+}
+
+func (s *memStore) SetDeviceCapabilities(userID, deviceID string, capabilities []byte, maxEncVersion int) error {
+	d, ok := s.devices[deviceID]
+	if !ok || d.UserID != userID || !d.IsActive {
+		return sql.ErrNoRows
+	}
+	d.Capabilities = capabilities
+	if maxEncVersion > 0 {
+		d.MaxEncVersion = maxEncVersion
+	}
+	return nil
+}
+
+func (s *memStore) GetDeviceEncVersions(_ context.Context, userID string) ([]int, error) {
+	devices, _ := s.GetDevicesByUserID(userID)
+	var versions []int
+	for _, d := range devices {
+		versions = append(versions, d.MaxEncVersion)
+	}
+	return versions, nil
+}
+
+// Accounts
+
+func (s *memStore) HasRegion(region string) bool {
+	return region == storage.DefaultRegion
+}
+
+func (s *memStore) GetUserByEmail(email string) (*storage.User, error) {
+	for _, user := range s.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *memStore) GetUserByID(id string) (*storage.User, error) {
+	if user, ok := s.users[id]; ok {
+		return user, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *memStore) DeleteUserCascade(_ context.Context, id string) error {
+	user, ok := s.users[id]
+	if !ok || user.LegalHold {
+		return sql.ErrNoRows
+	}
+	delete(s.users, id)
+	for deviceID, d := range s.devices {
+		if d.UserID == id {
+			delete(s.devices, deviceID)
+		}
+	}
+	for token, rt := range s.tokens {
+		if rt.UserID == id {
+			delete(s.tokens, token)
+		}
+	}
+	return nil
+}
+
+func (s *memStore) CreateUser(email string, passwordHash, salt []byte, region string) (*storage.User, error) {
+	if existing, _ := s.GetUserByEmail(email); existing != nil {
+		return nil, storage.ErrEmailTaken
+	}
+	user := &storage.User{
+		ID:           s.newID(),
+		Email:        email,
+		PasswordHash: passwordHash,
+		Salt:         salt,
+		IsActive:     true,
+		HashVersion:  auth.CurrentHashVersion,
+	}
+	s.users[user.ID] = user
+	return user, nil
+}
+
+func (s *memStore) CreateUserWithZone(email string, passwordHash, salt []byte, region string, bootstrap *sync.ZoneBootstrap) (*storage.User, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *memStore) CreateRefreshToken(userID string, deviceID *string, expiresAt time.Time) (*storage.RefreshToken, error) {
+	token := &storage.RefreshToken{Token: s.newID(), UserID: userID, DeviceID: deviceID, ExpiresAt: expiresAt}
+	s.tokens[token.Token] = token
+	return token, nil
+}
+
+func (s *memStore) GetRefreshToken(token string) (*storage.RefreshToken, error) {
+	if t, ok := s.tokens[token]; ok {
+		copied := *t
+		return &copied, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *memStore) RevokeRefreshToken(token string) error {
+	s.tokens[token].Revoked = true
+	return nil
+}
+
+func (s *memStore) RevokeRefreshTokensByUser(userID string) (int64, error) {
+	var revoked int64
+	for _, token := range s.tokens {
+		if token.UserID == userID && !token.Revoked {
+			token.Revoked = true
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+func (s *memStore) TouchUser(userID string, at time.Time) (string, error) {
+	return storage.InactivityActive, nil
+}
+
+func (s *memStore) UpgradePasswordHash(userID string, hash []byte, version int) error {
+	user := s.users[userID]
+	user.PasswordHash, user.HashVersion = hash, version
+	return nil
+}
+
+func (s *memStore) UpdateUserPassword(userID string, hash, salt []byte, version int) (int64, error) {
+	user, ok := s.users[userID]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	user.PasswordHash, user.Salt, user.HashVersion = hash, salt, version
+	user.TokenVersion++
+	delete(s.failures, userID)
+	delete(s.locks, userID)
+	return s.RevokeRefreshTokensByUser(userID)
+}
+
+func (s *memStore) IncrementFailedLogin(userID string, threshold int, lockUntil time.Time) (*time.Time, error) {
+	if _, ok := s.users[userID]; !ok {
+		return nil, sql.ErrNoRows
+	}
+	s.failures[userID]++
+	if s.failures[userID] >= threshold {
+		s.failures[userID] = 0
+		s.locks[userID] = lockUntil
+	}
+	if until, ok := s.locks[userID]; ok {
+		return &until, nil
+	}
+	return nil, nil
+}
+
+func (s *memStore) ResetFailedLogin(userID string) error {
+	delete(s.failures, userID)
+	delete(s.locks, userID)
+	return nil
+}
+
+func (s *memStore) CreatePasswordResetToken(userID string, tokenHash []byte, expiresAt time.Time) error {
+	for hash, token := range s.resets {
+		if token.userID == userID {
+			delete(s.resets, hash)
+		}
+	}
+	s.resets[hex.EncodeToString(tokenHash)] = &memResetToken{userID: userID, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *memStore) ConsumePasswordResetToken(tokenHash []byte, at time.Time) (string, error) {
+	token, ok := s.resets[hex.EncodeToString(tokenHash)]
+	if !ok || token.used || !token.expiresAt.After(at) {
+		return "", sql.ErrNoRows
+	}
+	token.used = true
+	return token.userID, nil
+}
+
+func (s *memStore) IsLocked(userID string, at time.Time) (bool, time.Time, error) {
+	until, ok := s.locks[userID]
+	if !ok || !until.After(at) {
+		return false, time.Time{}, nil
+	}
+	return true, until, nil
+}
+
+func (s *memStore) GetUserSettings(_ context.Context, userID string) (*storage.UserSettings, error) {
+	return &storage.UserSettings{EncVersionPolicy: sync.EncVersionPolicyReject, DeviceApproval: s.approval}, nil
+}
+
+// Sync state and items
+
+func (s *memStore) GetSyncStateContext(ctx context.Context, userID, zone string) (*storage.SyncState, error) {
+	if state, ok := s.states[userID+"/"+zone]; ok {
+		return state, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (s *memStore) ListSyncStates(userID string) ([]*storage.SyncState, error) {
+	var states []*storage.SyncState
+	for _, state := range s.states {
+		if state.UserID == userID {
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
+
+// liveItems is the latest write of each item of the zone that is not a
+// tombstone, by item UUID
+func (s *memStore) liveItems(zone string) (map[uuid.UUID]*models.CryptoKey, map[uuid.UUID]*models.CredentialMetadata, map[uuid.UUID]*models.SyncRecord) {
+	keys := map[uuid.UUID]*models.CryptoKey{}
+	creds := map[uuid.UUID]*models.CredentialMetadata{}
+	records := map[uuid.UUID]*models.SyncRecord{}
+	for _, batch := range s.commits {
+		if batch.Zone != zone {
+			continue
+		}
+		for _, key := range batch.Keys {
+			keys[key.ItemUUID] = key
+		}
+		for _, cred := range batch.Metadata {
+			creds[cred.ItemUUID] = cred
+		}
+		for _, record := range batch.Records {
+			records[record.ItemUUID] = record
+		}
+	}
+	maps.DeleteFunc(keys, func(_ uuid.UUID, key *models.CryptoKey) bool { return key.Tombstone })
+	maps.DeleteFunc(creds, func(_ uuid.UUID, cred *models.CredentialMetadata) bool { return cred.Tombstone })
+	maps.DeleteFunc(records, func(_ uuid.UUID, record *models.SyncRecord) bool { return record.Tombstone })
+	return keys, creds, records
+}
+
+func (s *memStore) GetZonesByUser(ctx context.Context, userID string) ([]*storage.ZoneSummary, error) {
+	states, _ := s.ListSyncStates(userID)
+	sort.Slice(states, func(i, j int) bool { return states[i].Zone < states[j].Zone })
+	zones := make([]*storage.ZoneSummary, len(states))
+	for i, state := range states {
+		keys, creds, records := s.liveItems(state.Zone)
+		zones[i] = &storage.ZoneSummary{
+			SyncState: *state,
+			Keys:      int64(len(keys)),
+			Metadata:  int64(len(creds)),
+			Records:   int64(len(records)),
+		}
+	}
+	return zones, nil
+}
+
+// DeleteCredential tombstones the credential, its record and the keys no
+// other live item references by committing them as a push would
+func (s *memStore) DeleteCredential(ctx context.Context, userID string, req *storage.CredentialDeleteRequest) (*storage.WipeResult, error) {
+	keys, creds, records := s.liveItems(req.Zone)
+	cred, ok := creds[req.ItemUUID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	shared := func(keyID uuid.UUID) bool {
+		for _, other := range creds {
+			if other.ItemUUID != req.ItemUUID && (other.PasswordKeyUUID == keyID || (other.MetadataKeyUUID != nil && *other.MetadataKeyUUID == keyID)) {
+				return true
+			}
+		}
+		for _, record := range records {
+			if record.ItemUUID != req.ItemUUID && record.ParentKeyUUID != nil && *record.ParentKeyUUID == keyID {
+				return true
+			}
+		}
+		return false
+	}
+
+	batch := &storage.PushBatch{Zone: req.Zone, DeviceID: req.DeviceID}
+	for _, keyID := range []*uuid.UUID{&cred.PasswordKeyUUID, cred.MetadataKeyUUID} {
+		if key, ok := keys[derefUUID(keyID)]; ok && !shared(key.ItemUUID) {
+			tombstone := *key
+			tombstone.Tombstone = true
+			batch.Keys = append(batch.Keys, &tombstone)
+		}
+	}
+	deletedCred := *cred
+	deletedCred.Tombstone = true
+	batch.Metadata = append(batch.Metadata, &deletedCred)
+	if record, ok := records[req.ItemUUID]; ok {
+		deletedRecord := *record
+		deletedRecord.Tombstone = true
+		batch.Records = append(batch.Records, &deletedRecord)
+		zoneKey := userID + "/" + req.Zone
+		s.leaves[zoneKey] = slices.DeleteFunc(s.leaves[zoneKey], func(id string) bool { return id == record.ItemUUID.String() })
+	}
+
+	total := int64(len(batch.Keys) + len(batch.Metadata) + len(batch.Records))
+	result := &storage.WipeResult{GenCount: s.nextGenCounts(userID, req.Zone, total).Last}
+	next := result.GenCount - total
+	for _, key := range batch.Keys {
+		next++
+		key.GenCount = next
+		result.Items = append(result.Items, &storage.WipedItem{Table: "crypto_keys", ItemUUID: key.ItemUUID, GenCount: next})
+	}
+	for _, cred := range batch.Metadata {
+		next++
+		cred.GenCount = next
+		result.Items = append(result.Items, &storage.WipedItem{Table: "credential_metadata", ItemUUID: cred.ItemUUID, GenCount: next})
+	}
+	for _, record := range batch.Records {
+		next++
+		record.GenCount = next
+		result.Items = append(result.Items, &storage.WipedItem{Table: "sync_records", ItemUUID: record.ItemUUID, GenCount: next})
+	}
+	batch.GenCount = result.GenCount
+	s.commits = append(s.commits, batch)
+	s.saveWipeState(userID, req.Zone, result.GenCount)
+	return result, nil
+}
+
+func (s *memStore) QueueConflicts(ctx context.Context, userID string, conflicts []*storage.SyncConflict) error {
+	for _, conflict := range conflicts {
+		conflict.UserID, conflict.ID, conflict.CreatedAt = userID, s.newID(), s.clock.Now()
+		for i, pending := range s.conflicts {
+			if pending.UserID == userID && pending.Zone == conflict.Zone && pending.ItemUUID == conflict.ItemUUID && pending.ResolvedAt == nil {
+				conflict.ID, conflict.CreatedAt = pending.ID, pending.CreatedAt
+				s.conflicts = slices.Delete(s.conflicts, i, i+1)
+				break
+			}
+		}
+		queued := *conflict
+		s.conflicts = append(s.conflicts, &queued)
+	}
+	return nil
+}
+
+func (s *memStore) ListConflicts(ctx context.Context, userID, zone string) ([]*storage.SyncConflict, error) {
+	var pending []*storage.SyncConflict
+	for _, conflict := range s.conflicts {
+		if conflict.UserID == userID && conflict.Zone == zone && conflict.ResolvedAt == nil {
+			listed := *conflict
+			pending = append(pending, &listed)
+		}
+	}
+	return pending, nil
+}
+
+// ResolveConflict commits the kept version under a new gencount
+func (s *memStore) ResolveConflict(ctx context.Context, userID string, req *storage.ConflictResolveRequest) (*storage.ConflictResolution, error) {
+	var conflict *storage.SyncConflict
+	for _, c := range s.conflicts {
+		if c.ID == req.ID && c.UserID == userID && c.Zone == req.Zone && c.ResolvedAt == nil {
+			conflict = c
+		}
+	}
+	if conflict == nil {
+		return nil, sql.ErrNoRows
+	}
+
+	kept := *conflict.Pushed
+	if req.Resolution == sync.ResolutionServerWins {
+		stored, _ := s.GetSyncRecordsPage(ctx, userID, storage.PullRange{
+			Zone: req.Zone, IncludeTombstoned: true, ItemUUIDs: []uuid.UUID{conflict.ItemUUID},
+		})
+		if len(stored) > 0 {
+			kept = *stored[0]
+		}
+	}
+	kept.GenCount = s.nextGenCounts(userID, req.Zone, 1).Last
+	s.commits = append(s.commits, &storage.PushBatch{Zone: req.Zone, GenCount: kept.GenCount, DeviceID: req.DeviceID, Records: []*models.SyncRecord{&kept}})
+	s.saveWipeState(userID, req.Zone, kept.GenCount)
+
+	now, resolution := s.clock.Now(), req.Resolution
+	conflict.ResolvedAt, conflict.Resolution = &now, &resolution
+	resolved := *conflict
+	return &storage.ConflictResolution{Conflict: &resolved, GenCount: kept.GenCount}, nil
+}
+
+func derefUUID(id *uuid.UUID) uuid.UUID {
+	if id == nil {
+		return uuid.Nil
+	}
+	return *id
+}
+
+func (s *memStore) CommitPush(ctx context.Context, userID string, batch *storage.PushBatch) ([]*storage.PushItemError, error) {
+	if batch.Sequence > 0 {
+		key := userID + "/" + batch.DeviceID
+		if err := sync.CheckPushSequence(s.sequences[key], batch.Sequence); err != nil {
+			return nil, err
+		}
+		s.sequences[key] = batch.Sequence
+	}
+	batch.Number(s.nextGenCounts(userID, batch.Zone, batch.Len()))
+
+	// Refused items are left out of what the store keeps
+	var rejected []*storage.PushItemError
+	written := *batch
+	written.Keys, written.Metadata, written.Records = nil, nil, nil
+	for i, key := range batch.Keys {
+		if s.rejectIDs[key.ItemUUID.String()] {
+			rejected = append(rejected, &storage.PushItemError{Layer: "crypto_key", Index: i, Err: errors.New("constraint violated")})
+			continue
+		}
+		written.Keys = append(written.Keys, key)
+	}
+	for i, cred := range batch.Metadata {
+		if s.rejectIDs[cred.ItemUUID.String()] {
+			rejected = append(rejected, &storage.PushItemError{Layer: "credential_metadata", Index: i, Err: errors.New("constraint violated")})
+			continue
+		}
+		written.Metadata = append(written.Metadata, cred)
+	}
+	for i, record := range batch.Records {
+		if s.rejectIDs[record.ItemUUID.String()] {
+			rejected = append(rejected, &storage.PushItemError{Layer: "sync_record", Index: i, Err: errors.New("constraint violated")})
+			continue
+		}
+		written.Records = append(written.Records, record)
+	}
+	batch = &written
+	s.commits = append(s.commits, batch)
+	zoneKey := userID + "/" + batch.Zone
+	for _, record := range batch.Records {
+		s.leaves[zoneKey] = append(s.leaves[zoneKey], record.ItemUUID.String())
+	}
+
+	state := s.state(userID, batch.Zone)
+	state.GenCount = max(state.GenCount, batch.GenCount)
+	state.LastWriterDeviceID = stringOrNil(batch.DeviceID)
+	state.UpdatedAt = s.clock.Now()
+	return rejected, nil
+}
+
+// CommitImport refuses the whole import for any item in rejectIDs, and
+// otherwise commits each batch like a push
+func (s *memStore) CommitImport(ctx context.Context, userID string, batches []*storage.PushBatch) error {
+	for _, batch := range batches {
+		for i, record := range batch.Records {
+			if s.rejectIDs[record.ItemUUID.String()] {
+				return &storage.ImportItemError{Zone: batch.Zone, PushItemError: &storage.PushItemError{
+					Layer: "sync_record", Index: i, Err: errors.New("constraint violated"),
+				}}
+			}
+		}
+	}
+	for _, batch := range batches {
+		if _, err := s.CommitPush(ctx, userID, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// state returns the zone's sync state, creating it on first use
+func (s *memStore) state(userID, zone string) *storage.SyncState {
+	key := userID + "/" + zone
+	if _, ok := s.states[key]; !ok {
+		s.states[key] = &storage.SyncState{UserID: userID, Zone: zone}
+	}
+	return s.states[key]
+}
+
+// nextGenCounts reserves n of the zone's gencounts like the SQL stores
+func (s *memStore) nextGenCounts(userID, zone string, n int64) storage.GenCountRange {
+	if _, ok := s.states[userID+"/"+zone]; !ok && n == 0 {
+		return storage.GenCountRange{First: 1}
+	}
+	state := s.state(userID, zone)
+	state.GenCount += n
+	return storage.GenCountRange{First: state.GenCount - n + 1, Last: state.GenCount}
+}
+
+// LoadEngineState and SaveEngineState make the store the engine registry's
+// sync_state, as the PostgresStore is
+func (s *memStore) LoadEngineState(userID, zone string) (*sync.EngineState, error) {
+	state, ok := s.states[userID+"/"+zone]
+	if !ok {
+		return &sync.EngineState{}, nil
+	}
+	engineState := &sync.EngineState{GenCount: state.GenCount, Digest: state.Digest}
+	if state.LastWriterDeviceID != nil {
+		engineState.LastWriter = *state.LastWriterDeviceID
+	}
+	return engineState, nil
+}
+
+func (s *memStore) SaveEngineState(userID, zone string, engineState *sync.EngineState) error {
+	state := s.state(userID, zone)
+	state.GenCount, state.Digest = engineState.GenCount, engineState.Digest
+	state.LastWriterDeviceID = stringOrNil(engineState.LastWriter)
+	state.UpdatedAt = s.clock.Now()
+	return nil
+}
+
+func stringOrNil(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func (s *memStore) LiveLeafIDs(ctx context.Context, userID, zone string) ([]string, error) {
+	return s.leaves[userID+"/"+zone], nil
+}
+
+func (s *memStore) ManifestLeaves(ctx context.Context, userID, zone string) ([]sync.ManifestLeaf, error) {
+	return memStoreLeaves(s.leaves[userID+"/"+zone]), nil
+}
+
+func (s *memStore) ComputeManifest(ctx context.Context, userID, zone string) (*storage.ManifestState, error) {
+	leafIDs := s.leaves[userID+"/"+zone]
+	return &storage.ManifestState{UserID: userID, Zone: zone, LeafCount: len(leafIDs), Digest: recordDigest(leafIDs)}, nil
+}
+
+func (s *memStore) ProbeItems(ctx context.Context, probe storage.ItemProbe) (storage.ItemStates, error) {
+	states := storage.ItemStates{}
+	for _, batch := range s.commits {
+		for _, k := range batch.Keys {
+			if probe.Matches(k.UserID.String(), k.Zone, k.ItemUUID) {
+				states.Add(k.ItemUUID, storage.ItemState{Layer: "crypto_key", GenCount: k.GenCount, Tombstone: k.Tombstone})
+			}
+		}
+		for _, m := range batch.Metadata {
+			if probe.Matches(m.UserID.String(), m.Zone, m.ItemUUID) {
+				states.Add(m.ItemUUID, storage.ItemState{Layer: "credential_metadata", GenCount: m.GenCount, Tombstone: m.Tombstone})
+			}
+		}
+		for _, rec := range batch.Records {
+			if probe.Matches(rec.UserID.String(), rec.Zone, rec.ItemUUID) {
+				states.Add(rec.ItemUUID, storage.ItemState{Layer: "sync_record", GenCount: rec.GenCount, Tombstone: rec.Tombstone})
+			}
+		}
+	}
+	return states, nil
+}
+
+func (s *memStore) CountPullWindow(ctx context.Context, userID string, r storage.PullRange) (*storage.PullCounts, error) {
+	r.Offset, r.Limit = 0, 0
+	keys, _ := s.GetCryptoKeysPage(ctx, userID, r)
+	metadata, _ := s.GetCredentialMetadataPage(ctx, userID, r)
+	records, _ := s.GetSyncRecordsPage(ctx, userID, r)
+	return &storage.PullCounts{Keys: len(keys), Metadata: len(metadata), Records: len(records)}, nil
+}
+
+func (s *memStore) GetCryptoKeysPage(ctx context.Context, userID string, r storage.PullRange) ([]*models.CryptoKey, error) {
+	var keys []*models.CryptoKey
+	for _, batch := range s.commits {
+		keys = append(keys, batch.Keys...)
+	}
+	return pullPage(keys, userID, r, func(k *models.CryptoKey) (uuid.UUID, string, string, int64, bool) {
+		return k.ItemUUID, k.UserID.String(), k.Zone, k.GenCount, k.Tombstone
+	}), nil
+}
+
+func (s *memStore) GetCredentialMetadataPage(ctx context.Context, userID string, r storage.PullRange) ([]*models.CredentialMetadata, error) {
+	var metadata []*models.CredentialMetadata
+	for _, batch := range s.commits {
+		metadata = append(metadata, batch.Metadata...)
+	}
+	return pullPage(metadata, userID, r, func(m *models.CredentialMetadata) (uuid.UUID, string, string, int64, bool) {
+		return m.ItemUUID, m.UserID.String(), m.Zone, m.GenCount, m.Tombstone
+	}), nil
+}
+
+func (s *memStore) GetSyncRecordsPage(ctx context.Context, userID string, r storage.PullRange) ([]*models.SyncRecord, error) {
+	var records []*models.SyncRecord
+	for _, batch := range s.commits {
+		records = append(records, batch.Records...)
+	}
+	return pullPage(records, userID, r, func(rec *models.SyncRecord) (uuid.UUID, string, string, int64, bool) {
+		return rec.ItemUUID, rec.UserID.String(), rec.Zone, rec.GenCount, rec.Tombstone
+	}), nil
+}
+
+// pullPage pages the latest version of each of the user's pushed items in
+// r's range, in gencount order, as the pull queries do. describe returns an
+// item's UUID, owner, zone, gencount and tombstone flag.
+func pullPage[T any](pushed []T, userID string, r storage.PullRange, describe func(T) (uuid.UUID, string, string, int64, bool)) []T {
+	latest := map[uuid.UUID]T{}
+	for _, item := range pushed {
+		id, owner, zone, _, _ := describe(item)
+		if owner == userID && zone == r.Zone && r.Selects(id) {
+			latest[id] = item
+		}
+	}
+
+	var page []T
+	for _, item := range latest {
+		_, _, _, genCount, tombstone := describe(item)
+		if r.Includes(genCount, tombstone) {
+			page = append(page, item)
+		}
+	}
+	sort.Slice(page, func(i, j int) bool {
+		_, _, _, a, _ := describe(page[i])
+		_, _, _, b, _ := describe(page[j])
+		return a < b
+	})
+
+	page = page[min(r.Offset, len(page)):]
+	if r.Limit > 0 {
+		page = page[:min(r.Limit, len(page))]
+	}
+	return page
+}
+
+func (s *memStore) WipeZone(ctx context.Context, userID string, req *storage.WipeRequest) (*storage.WipeResult, error) {
+	zoneKey := userID + "/" + req.Zone
+	live := s.leaves[zoneKey]
+	if len(live) == 0 {
+		return &storage.WipeResult{GenCount: s.nextGenCounts(userID, req.Zone, 0).Last}, nil
+	}
+	result := &storage.WipeResult{GenCount: s.nextGenCounts(userID, req.Zone, int64(len(live))).Last}
+	for i, id := range live {
+		result.Items = append(result.Items, &storage.WipedItem{
+			Table:    "sync_records",
+			ItemUUID: uuid.MustParse(id),
+			GenCount: result.GenCount - int64(len(live)) + int64(i) + 1,
+		})
+	}
+	result.Wipe = &storage.BulkWipe{
+		ID:           uuid.New().String(),
+		UserID:       userID,
+		Zone:         req.Zone,
+		Items:        len(live),
+		GenCount:     result.GenCount,
+		CreatedAt:    s.clock.Now(),
+		RecoverUntil: req.RecoverUntil,
+	}
+	s.wipes = append(s.wipes, result.Wipe)
+	s.trashed[result.Wipe.ID] = live
+	delete(s.leaves, zoneKey)
+	s.saveWipeState(userID, req.Zone, result.GenCount)
+	return result, nil
+}
+
+func (s *memStore) UndoWipe(ctx context.Context, userID string, req *storage.WipeRequest, now time.Time) (*storage.WipeResult, error) {
+	for i := len(s.wipes) - 1; i >= 0; i-- {
+		wipe := s.wipes[i]
+		if _, pending := s.trashed[wipe.ID]; wipe.UserID != userID || wipe.Zone != req.Zone || !pending {
+			continue
+		}
+		if !now.Before(wipe.RecoverUntil) {
+			return nil, sync.ErrWipeExpired
+		}
+		wipe.UndoneAt = &now
+		items := s.trashed[wipe.ID]
+		delete(s.trashed, wipe.ID)
+		result := &storage.WipeResult{Wipe: wipe, GenCount: s.nextGenCounts(userID, req.Zone, int64(len(items))).Last}
+		for _, id := range items {
+			result.Items = append(result.Items, &storage.WipedItem{Table: "sync_records", ItemUUID: uuid.MustParse(id)})
+		}
+		s.leaves[userID+"/"+req.Zone] = items
+		s.saveWipeState(userID, req.Zone, result.GenCount)
+		return result, nil
+	}
+	return nil, sync.ErrNoWipe
+}
+
+func (s *memStore) FindExpiredWipes(now time.Time, userID string) ([]*storage.BulkWipe, error) {
+	var expired []*storage.BulkWipe
+	for _, wipe := range s.wipes {
+		if _, pending := s.trashed[wipe.ID]; pending && !now.Before(wipe.RecoverUntil) && (userID == "" || wipe.UserID == userID) {
+			expired = append(expired, wipe)
+		}
+	}
+	return expired, nil
+}
+
+func (s *memStore) ExpireWipe(userID, wipeID string) (int64, error) {
+	items := s.trashed[wipeID]
+	delete(s.trashed, wipeID)
+	return int64(len(items)), nil
+}
+
+func (s *memStore) ScanIntegrity(ctx context.Context, userID, zone string, opts storage.IntegrityScanOptions) (*storage.IntegrityScan, error) {
+	s.scanOpts = opts
+	if s.scanErr != nil {
+		return nil, s.scanErr
+	}
+	return s.scan, nil
+}
+
+// ReadSnapshot reads a copy of the user's states and pushes taken before fn
+// runs, so pushes made meanwhile stay invisible as in the repeatable-read
+// transaction
+func (s *memStore) ReadSnapshot(ctx context.Context, userID string, fn func(storage.SnapshotReader) error) error {
+	frozen := &memStore{states: map[string]*storage.SyncState{}, commits: append([]*storage.PushBatch(nil), s.commits...)}
+	for key, state := range s.states {
+		copied := *state
+		frozen.states[key] = &copied
+	}
+	return fn(memSnapshot{store: frozen, userID: userID})
+}
+
+type memSnapshot struct {
+	store  *memStore
+	userID string
+}
+
+func (m memSnapshot) ListSyncStates(ctx context.Context) ([]*storage.SyncState, error) {
+	states, _ := m.store.ListSyncStates(m.userID)
+	sort.Slice(states, func(i, j int) bool { return states[i].Zone < states[j].Zone })
+	return states, nil
+}
+
+func (m memSnapshot) StreamCryptoKeys(ctx context.Context, r storage.PullRange, fn func(*models.CryptoKey) error) error {
+	keys, _ := m.store.GetCryptoKeysPage(ctx, m.userID, r)
+	return streamAll(keys, fn)
+}
+
+func (m memSnapshot) StreamCredentialMetadata(ctx context.Context, r storage.PullRange, fn func(*models.CredentialMetadata) error) error {
+	metadata, _ := m.store.GetCredentialMetadataPage(ctx, m.userID, r)
+	return streamAll(metadata, fn)
+}
+
+func (m memSnapshot) StreamSyncRecords(ctx context.Context, r storage.PullRange, fn func(*models.SyncRecord) error) error {
+	records, _ := m.store.GetSyncRecordsPage(ctx, m.userID, r)
+	return streamAll(records, fn)
+}
+
+func streamAll[T any](items []T, fn func(T) error) error {
+	for _, item := range items {
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveWipeState moves the zone's gencount and digest along like the
+// Postgres store does
+func (s *memStore) saveWipeState(userID, zone string, genCount int64) {
+	state := s.state(userID, zone)
+	state.GenCount = max(state.GenCount, genCount)
+	state.Digest = recordDigest(s.leaves[userID+"/"+zone])
+}
+
+// recordDigest is the digest memStore keeps, whose leaves are the live sync
+// records' UUIDs
+func recordDigest(itemUUIDs []string) []byte {
+	return sync.ManifestDigest(memStoreLeaves(itemUUIDs))
+}
+
+// memStoreLeaves are the leaves memStore keeps: sync records, gencount 0
+func memStoreLeaves(itemUUIDs []string) []sync.ManifestLeaf {
+	leaves := make([]sync.ManifestLeaf, len(itemUUIDs))
+	for i, id := range itemUUIDs {
+		leaves[i] = sync.ManifestLeaf{Layer: sync.LeafSyncRecord, ItemUUID: id}
+	}
+	return leaves
+}
+
+// recordingHub stands in for the WebSocket hub
+type recordingHub struct {
+	events       []*websocket.SyncEvent
+	disconnected []string
+}
+
+func (h *recordingHub) BroadcastSyncEvent(event *websocket.SyncEvent) error {
+	h.events = append(h.events, event)
+	return nil
+}
+
+func (h *recordingHub) DisconnectUserDevice(userID, deviceID string, reason websocket.CloseReason) int {
+	h.disconnected = append(h.disconnected, deviceID)
+	return 1
+}
+
+// assertServiceError checks the kind and code of a service failure
+func assertServiceError(t *testing.T, err error, kind service.Kind, code string) *service.Error {
+	t.Helper()
+	var serviceErr *service.Error
+	require.ErrorAs(t, err, &serviceErr)
+	assert.Equal(t, kind, serviceErr.Kind)
+	assert.Equal(t, code, serviceErr.Code)
+	return serviceErr
+}
+
+func TestDeviceServiceRevoke(t *testing.T) {
+	store := newMemStore(&fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)})
+	hub := &recordingHub{}
+	devices := device.NewService(store)
+	devices.SetHub(hub)
+	caller := service.Caller{UserID: activityAlice, IP: "203.0.113.7"}
+	ctx := context.Background()
+
+	laptop, err := devices.Register(ctx, caller, device.RegisterInput{Name: "laptop", Type: "desktop"})
+	require.NoError(t, err)
+	phone, err := devices.Register(ctx, caller, device.RegisterInput{Name: "phone", Type: "mobile"})
+	require.NoError(t, err)
+
+	require.NoError(t, devices.Revoke(ctx, caller, laptop.ID))
+	assert.Equal(t, []string{laptop.ID}, hub.disconnected)
+	listed, err := devices.List(ctx, caller)
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	assert.Equal(t, phone.ID, listed[0].ID)
+
+	assertServiceError(t, devices.Revoke(ctx, caller, laptop.ID), service.KindNotFound, "")
+	assertServiceError(t, devices.Revoke(ctx, caller, "laptop"), service.KindInvalid, "")
+
+	// Someone else's device is reported, not revoked
+	result, err := devices.RevokeMany(ctx, service.Caller{UserID: activityBob}, []string{phone.ID})
+	require.NoError(t, err)
+	assert.Empty(t, result.Revoked)
+	assert.Equal(t, []string{phone.ID}, result.NotFound)
+
+	tooMany := make([]string, device.MaxBulkDevices+1)
+	_, err = devices.RevokeMany(ctx, caller, tooMany)
+	serviceErr := assertServiceError(t, err, service.KindInvalid, "too_many_devices")
+	assert.Equal(t, device.MaxBulkDevices, serviceErr.Fields["max"])
+
+	assert.Equal(t, []string{service.AuditActionDeviceAdd, service.AuditActionDeviceAdd, service.AuditActionDeviceRevoke}, store.actions())
+	assert.Equal(t, "203.0.113.7", store.audit[0].IPAddress)
+	assert.Nil(t, store.audit[0].ActorID, "callers acting on their own account are not actors")
+}
+
+func TestDeviceServiceRegisterFingerprint(t *testing.T) {
+	store := newMemStore(&fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)})
+	devices := device.NewService(store)
+	caller := service.Caller{UserID: activityAlice, Tier: limits.TierPremium} // More devices than the free tier allows
+	ctx := context.Background()
+
+	first, err := devices.Register(ctx, caller, device.RegisterInput{
+		Name: "MacBook Pro", Type: "desktop", PublicKey: []byte("key-1"), Fingerprint: "mbp-1",
+		Capabilities: []byte(`{"version":1,"msgpack":true}`),
+	})
+	require.NoError(t, err)
+	assert.True(t, first.Created)
+
+	// Every startup registers again
+	again, err := devices.Register(ctx, caller, device.RegisterInput{Name: "Alice's MacBook Pro", Type: "desktop", Fingerprint: "mbp-1"})
+	require.NoError(t, err)
+	assert.False(t, again.Created)
+	assert.Equal(t, first.ID, again.ID)
+	assert.Equal(t, "Alice's MacBook Pro", again.DeviceName)
+	assert.Equal(t, []byte("key-1"), again.PublicKey, "kept when not sent")
+	assert.JSONEq(t, `{"version":1,"msgpack":true}`, string(again.Capabilities))
+
+	// Without a fingerprint, or with another one or under another account, it's a new device
+	plain, err := devices.Register(ctx, caller, device.RegisterInput{Name: "MacBook Pro", Type: "desktop"})
+	require.NoError(t, err)
+	assert.True(t, plain.Created)
+	other, err := devices.Register(ctx, caller, device.RegisterInput{Name: "iPhone", Type: "mobile", Fingerprint: "iphone-1"})
+	require.NoError(t, err)
+	assert.True(t, other.Created)
+	bobs, err := devices.Register(ctx, service.Caller{UserID: activityBob}, device.RegisterInput{Name: "MacBook Pro", Type: "desktop", Fingerprint: "mbp-1"})
+	require.NoError(t, err)
+	assert.True(t, bobs.Created)
+	list, err := devices.List(ctx, caller)
+	require.NoError(t, err)
+	assert.Len(t, list, 3)
+
+	// A revoked device isn't brought back
+	require.NoError(t, devices.Revoke(ctx, caller, first.ID))
+	fresh, err := devices.Register(ctx, caller, device.RegisterInput{Name: "MacBook Pro", Type: "desktop", Fingerprint: "mbp-1"})
+	require.NoError(t, err)
+	assert.True(t, fresh.Created)
+	assert.NotEqual(t, first.ID, fresh.ID)
+
+	_, err = devices.Register(ctx, caller, device.RegisterInput{Name: "x", Type: "desktop", Fingerprint: strings.Repeat("f", device.MaxFingerprintLength+1)})
+	assertServiceError(t, err, service.KindInvalid, "")
+}
+
+// A free account registers up to its device limit; registering a device
+// again by fingerprint, or after revoking one, still works
+func TestDeviceServiceRegisterLimit(t *testing.T) {
+	store := newMemStore(&fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)})
+	devices := device.NewService(store)
+	devices.SetTierPolicy(limits.Policy{limits.TierFree: {Devices: 2}, limits.TierPremium: {}})
+	caller := service.Caller{UserID: activityAlice, Tier: limits.TierFree}
+	ctx := context.Background()
+
+	laptop, err := devices.Register(ctx, caller, device.RegisterInput{Name: "MacBook Pro", Type: "desktop", Fingerprint: "mbp-1"})
+	require.NoError(t, err)
+	_, err = devices.Register(ctx, caller, device.RegisterInput{Name: "iPhone", Type: "mobile"})
+	require.NoError(t, err)
+
+	_, err = devices.Register(ctx, caller, device.RegisterInput{Name: "iPad", Type: "mobile", Fingerprint: "ipad-1"})
+	var serviceErr *service.Error
+	require.ErrorAs(t, err, &serviceErr)
+	assert.Equal(t, service.KindForbidden, serviceErr.Kind)
+	assert.Equal(t, "quota_exceeded", serviceErr.Code)
+	assert.Equal(t, limits.ResourceDevices, serviceErr.Fields["resource"])
+	assert.Equal(t, int64(2), serviceErr.Fields["limit"])
+	assert.Equal(t, int64(2), serviceErr.Fields["used"])
+
+	again, err := devices.Register(ctx, caller, device.RegisterInput{Name: "MacBook Pro", Type: "desktop", Fingerprint: "mbp-1"})
+	require.NoError(t, err, "registering again adds nothing")
+	assert.False(t, again.Created)
+
+	premium := caller
+	premium.Tier = limits.TierPremium
+	_, err = devices.Register(ctx, premium, device.RegisterInput{Name: "iPad", Type: "mobile", Fingerprint: "ipad-1"})
+	require.NoError(t, err)
+
+	require.NoError(t, devices.Revoke(ctx, premium, laptop.ID))
+	_, err = devices.Register(ctx, caller, device.RegisterInput{Name: "Work laptop", Type: "desktop"})
+	require.Error(t, err, "still at the limit after a downgrade")
+}
+
+func TestDeviceServiceRename(t *testing.T) {
+	store := newMemStore(&fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)})
+	devices := device.NewService(store)
+	caller := service.Caller{UserID: activityAlice}
+	ctx := context.Background()
+
+	desktop, err := devices.Register(ctx, caller, device.RegisterInput{Name: "Test Desktop", Type: "desktop"})
+	require.NoError(t, err)
+	phone, err := devices.Register(ctx, caller, device.RegisterInput{Name: "phone", Type: "mobile"})
+	require.NoError(t, err)
+
+	// From another device of the account
+	renamed, err := devices.Rename(ctx, service.Caller{UserID: activityAlice, DeviceID: phone.ID}, desktop.ID, "  Office PC ")
+	require.NoError(t, err)
+	assert.Equal(t, "Office PC", renamed.DeviceName)
+	assert.Equal(t, "Office PC", store.devices[desktop.ID].DeviceName)
+
+	_, err = devices.Rename(ctx, caller, desktop.ID, " ")
+	assertServiceError(t, err, service.KindInvalid, "")
+	_, err = devices.Rename(ctx, caller, desktop.ID, strings.Repeat("x", device.MaxDeviceNameLength+1))
+	assertServiceError(t, err, service.KindInvalid, "")
+	_, err = devices.Rename(ctx, caller, "desktop", "Office PC")
+	assertServiceError(t, err, service.KindInvalid, "")
+
+	// Someone else's device, or a revoked one, is not found
+	_, err = devices.Rename(ctx, service.Caller{UserID: activityBob}, desktop.ID, "mine now")
+	assertServiceError(t, err, service.KindNotFound, "")
+	require.NoError(t, devices.Revoke(ctx, caller, phone.ID))
+	_, err = devices.Rename(ctx, caller, phone.ID, "lost phone")
+	assertServiceError(t, err, service.KindNotFound, "")
+
+	assert.Equal(t, "Office PC", store.devices[desktop.ID].DeviceName)
+	assert.Contains(t, store.actions(), service.AuditActionDeviceRename)
+}
+
+func TestDeviceServiceCleanup(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}
+	store := newMemStore(clock)
+	hub := &recordingHub{}
+	devices := device.NewService(store)
+	devices.SetHub(hub)
+	devices.SetClock(clock)
+	ctx := context.Background()
+
+	old, _ := devices.Register(ctx, service.Caller{UserID: activityAlice}, device.RegisterInput{Name: "old", Type: "desktop"})
+	current, _ := devices.Register(ctx, service.Caller{UserID: activityAlice}, device.RegisterInput{Name: "current", Type: "desktop"})
+	clock.Advance(60 * 24 * time.Hour)
+	caller := service.Caller{UserID: activityAlice, DeviceID: current.ID}
+
+	// The calling device is never cleaned up, however idle
+	preview, err := devices.Cleanup(ctx, caller, device.CleanupInput{InactiveDays: 30, DryRun: true})
+	require.NoError(t, err)
+	require.Len(t, preview, 1)
+	assert.Equal(t, old.ID, preview[0].ID)
+	assert.Empty(t, hub.disconnected, "a dry run revokes nothing")
+
+	cleaned, err := devices.Cleanup(ctx, caller, device.CleanupInput{InactiveDays: 30})
+	require.NoError(t, err)
+	require.Len(t, cleaned, 1)
+	assert.Equal(t, []string{old.ID}, hub.disconnected)
+
+	cleaned, err = devices.Cleanup(ctx, caller, device.CleanupInput{InactiveDays: 30})
+	require.NoError(t, err)
+	assert.NotNil(t, cleaned)
+	assert.Empty(t, cleaned)
+}
+
+func TestAuthServiceLogin(t *testing.T) {
+	store := newMemStore(&fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)})
+	accounts := authservice.NewService(store)
+	ctx := context.Background()
+	caller := service.Caller{IP: "203.0.113.7"}
+
+	_, err := accounts.Register(ctx, caller, authservice.RegisterInput{Email: "a@example.com", Password: "hunter22", Region: "mars"})
+	assertServiceError(t, err, service.KindInvalid, "unknown_region")
+
+	registered, err := accounts.Register(ctx, caller, authservice.RegisterInput{Email: "a@example.com", Password: "hunter22"})
+	require.NoError(t, err)
+	assert.Equal(t, storage.DefaultRegion, registered.Region)
+	assert.NotEmpty(t, registered.AccessToken)
+	assert.Nil(t, registered.Zone)
+
+	_, err = accounts.Register(ctx, caller, authservice.RegisterInput{Email: "a@example.com", Password: "hunter22"})
+	assertServiceError(t, err, service.KindConflict, "email_exists")
+
+	_, err = accounts.Login(ctx, caller, authservice.LoginInput{Email: "a@example.com", Password: "hunter23"})
+	assertServiceError(t, err, service.KindUnauthorized, "")
+	_, err = accounts.Login(ctx, caller, authservice.LoginInput{Email: "b@example.com", Password: "hunter22"})
+	assertServiceError(t, err, service.KindUnauthorized, "")
+
+	login, err := accounts.Login(ctx, caller, authservice.LoginInput{Email: "a@example.com", Password: "hunter22"})
+	require.NoError(t, err)
+	assert.Equal(t, registered.User.ID, login.User.ID)
+
+	registered.User.IsActive = false
+	_, err = accounts.Login(ctx, caller, authservice.LoginInput{Email: "a@example.com", Password: "hunter22"})
+	assertServiceError(t, err, service.KindForbidden, "")
+
+	assert.Equal(t, []string{
+		service.AuditActionRegister,
+		service.AuditActionLoginFailed,
+		service.AuditActionLogin,
+	}, store.actions())
+}
+
+func TestAuthServiceUpgradesDeprecatedHash(t *testing.T) {
+	store := newMemStore(&fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)})
+	accounts := authservice.NewService(store)
+	ctx := context.Background()
+
+	salt, err := auth.GenerateSalt()
+	require.NoError(t, err)
+	legacy := auth.HashPasswordVersion("hunter22", salt, auth.HashVersionPBKDF2)
+	user, err := store.CreateUser("a@example.com", legacy, salt, storage.DefaultRegion)
+	require.NoError(t, err)
+	user.HashVersion = auth.HashVersionPBKDF2
+
+	_, err = accounts.Login(ctx, service.Caller{}, authservice.LoginInput{Email: "a@example.com", Password: "hunter22"})
+	require.NoError(t, err)
+	assert.Equal(t, auth.CurrentHashVersion, user.HashVersion)
+	assert.True(t, auth.VerifyPassword("hunter22", salt, user.PasswordHash, user.HashVersion))
+	assert.Contains(t, store.actions(), service.AuditActionPasswordRehash)
+}
+
+func TestAuthServiceLoginLockout(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}
+	store := newMemStore(clock)
+	accounts := authservice.NewService(store)
+	accounts.SetClock(clock)
+	accounts.SetLockout(authservice.LockoutPolicy{Attempts: 3, Duration: 10 * time.Minute})
+	ctx := context.Background()
+	right := authservice.LoginInput{Email: "a@example.com", Password: "hunter22"}
+	wrong := authservice.LoginInput{Email: "a@example.com", Password: "hunter23"}
+
+	registered, err := accounts.Register(ctx, service.Caller{}, authservice.RegisterInput{Email: right.Email, Password: right.Password})
+	require.NoError(t, err)
+
+	// A successful login starts the count over
+	for i := 0; i < 2; i++ {
+		_, err = accounts.Login(ctx, service.Caller{}, wrong)
+		assertServiceError(t, err, service.KindUnauthorized, "")
+	}
+	_, err = accounts.Login(ctx, service.Caller{}, right)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = accounts.Login(ctx, service.Caller{}, wrong)
+		assertServiceError(t, err, service.KindUnauthorized, "")
+	}
+
+	_, err = accounts.Login(ctx, service.Caller{}, wrong)
+	assertServiceError(t, err, service.KindLocked, "account_locked")
+	assert.Equal(t, int64(10*time.Minute/time.Millisecond), err.(*service.Error).Fields["retry_after_ms"])
+	assert.Contains(t, store.actions(), service.AuditActionAccountLocked)
+
+	clock.Advance(5 * time.Minute)
+	_, err = accounts.Login(ctx, service.Caller{}, right)
+	assertServiceError(t, err, service.KindLocked, "account_locked")
+	assert.Equal(t, int64(5*time.Minute/time.Millisecond), err.(*service.Error).Fields["retry_after_ms"])
+
+	clock.Advance(5 * time.Minute)
+	_, err = accounts.Login(ctx, service.Caller{}, right)
+	require.NoError(t, err, "the lockout expired")
+
+	t.Run("a password change lifts it", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			_, err = accounts.Login(ctx, service.Caller{}, wrong)
+		}
+		assertServiceError(t, err, service.KindLocked, "account_locked")
+
+		caller := service.Caller{UserID: registered.User.ID}
+		_, err = accounts.ChangePassword(ctx, caller, authservice.ChangePasswordInput{CurrentPassword: "hunter22", NewPassword: "correct horse"})
+		require.NoError(t, err)
+		_, err = accounts.Login(ctx, service.Caller{}, authservice.LoginInput{Email: right.Email, Password: "correct horse"})
+		require.NoError(t, err)
+	})
+}
+
+// sentMail records the emails a service sends
+type sentMail struct {
+	messages []mail.Message
+}
+
+func (m *sentMail) Send(_ context.Context, msg mail.Message) error {
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+var resetTokenPattern = regexp.MustCompile(`(?m)^[A-Za-z0-9_-]{43}$`)
+
+func TestAuthServicePasswordReset(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}
+	store := newMemStore(clock)
+	accounts := authservice.NewService(store)
+	accounts.SetClock(clock)
+	outbox := &sentMail{}
+	accounts.SetMailer(outbox)
+	ctx := context.Background()
+
+	registered, err := accounts.Register(ctx, service.Caller{}, authservice.RegisterInput{Email: "a@example.com", Password: "hunter22"})
+	require.NoError(t, err)
+
+	// Unknown emails succeed the same, without an email
+	require.NoError(t, accounts.RequestPasswordReset(ctx, service.Caller{}, "b@example.com"))
+	assert.Empty(t, outbox.messages)
+
+	require.NoError(t, accounts.RequestPasswordReset(ctx, service.Caller{}, "a@example.com"))
+	require.Len(t, outbox.messages, 1)
+	assert.Equal(t, "a@example.com", outbox.messages[0].To)
+	first := resetTokenPattern.FindString(outbox.messages[0].Body)
+	require.NotEmpty(t, first)
+
+	// A new request replaces the token
+	require.NoError(t, accounts.RequestPasswordReset(ctx, service.Caller{}, "a@example.com"))
+	require.Len(t, outbox.messages, 2)
+	token := resetTokenPattern.FindString(outbox.messages[1].Body)
+	_, err = accounts.ResetPassword(ctx, service.Caller{}, authservice.ResetPasswordInput{Token: first, NewPassword: "correct horse"})
+	assertServiceError(t, err, service.KindInvalid, "invalid_reset_token")
+
+	result, err := accounts.ResetPassword(ctx, service.Caller{}, authservice.ResetPasswordInput{Token: token, NewPassword: "correct horse"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), result.Revoked, "the registration's refresh token")
+	assert.Equal(t, []string{authservice.MasterKeyWarning}, result.Warnings)
+	_, err = accounts.Refresh(ctx, service.Caller{}, registered.RefreshToken)
+	assertServiceError(t, err, service.KindUnauthorized, "")
+
+	_, err = accounts.Login(ctx, service.Caller{}, authservice.LoginInput{Email: "a@example.com", Password: "hunter22"})
+	assertServiceError(t, err, service.KindUnauthorized, "")
+	_, err = accounts.Login(ctx, service.Caller{}, authservice.LoginInput{Email: "a@example.com", Password: "correct horse"})
+	require.NoError(t, err)
+
+	// Tokens work once, and not after they expire
+	_, err = accounts.ResetPassword(ctx, service.Caller{}, authservice.ResetPasswordInput{Token: token, NewPassword: "battery staple"})
+	assertServiceError(t, err, service.KindInvalid, "invalid_reset_token")
+	require.NoError(t, accounts.RequestPasswordReset(ctx, service.Caller{}, "a@example.com"))
+	clock.Advance(authservice.PasswordResetTTL)
+	_, err = accounts.ResetPassword(ctx, service.Caller{}, authservice.ResetPasswordInput{
+		Token: resetTokenPattern.FindString(outbox.messages[2].Body), NewPassword: "battery staple",
+	})
+	assertServiceError(t, err, service.KindInvalid, "invalid_reset_token")
+
+	assert.Subset(t, store.actions(), []string{service.AuditActionResetRequest, service.AuditActionPasswordReset})
+}
+
+func TestAuthServiceRefresh(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}
+	store := newMemStore(clock)
+	accounts := authservice.NewService(store)
+	accounts.SetClock(clock)
+	ctx := context.Background()
+
+	registered, err := accounts.Register(ctx, service.Caller{}, authservice.RegisterInput{Email: "a@example.com", Password: "hunter22"})
+	require.NoError(t, err)
+
+	rotated, err := accounts.Refresh(ctx, service.Caller{}, registered.RefreshToken)
+	require.NoError(t, err)
+	assert.NotEqual(t, registered.RefreshToken, rotated.RefreshToken)
+
+	// The old token was revoked by the rotation
+	_, err = accounts.Refresh(ctx, service.Caller{}, registered.RefreshToken)
+	assertServiceError(t, err, service.KindUnauthorized, "")
+
+	clock.Advance(authservice.RefreshTokenTTL + time.Second)
+	_, err = accounts.Refresh(ctx, service.Caller{}, rotated.RefreshToken)
+	assertServiceError(t, err, service.KindUnauthorized, "")
+}
+
+func TestAuthServiceLogout(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}
+	store := newMemStore(clock)
+	accounts := authservice.NewService(store)
+	accounts.SetClock(clock)
+	ctx := context.Background()
+
+	registered, err := accounts.Register(ctx, service.Caller{}, authservice.RegisterInput{Email: "a@example.com", Password: "hunter22"})
+	require.NoError(t, err)
+	phone, err := accounts.Login(ctx, service.Caller{}, authservice.LoginInput{Email: "a@example.com", Password: "hunter22"})
+	require.NoError(t, err)
+	laptop, err := accounts.Login(ctx, service.Caller{}, authservice.LoginInput{Email: "a@example.com", Password: "hunter22"})
+	require.NoError(t, err)
+
+	err = accounts.Logout(ctx, service.Caller{}, authservice.LogoutInput{RefreshToken: "unknown"})
+	assertServiceError(t, err, service.KindUnauthorized, "")
+
+	// Only the given token is revoked, and logging out again is fine
+	require.NoError(t, accounts.Logout(ctx, service.Caller{}, authservice.LogoutInput{RefreshToken: phone.RefreshToken}))
+	require.NoError(t, accounts.Logout(ctx, service.Caller{}, authservice.LogoutInput{RefreshToken: phone.RefreshToken}))
+	_, err = accounts.Refresh(ctx, service.Caller{}, phone.RefreshToken)
+	assertServiceError(t, err, service.KindUnauthorized, "")
+	assert.Equal(t, service.AuditActionLogout, store.audit[len(store.audit)-1].Action)
+
+	// A revoked token can't sign out the other devices
+	err = accounts.Logout(ctx, service.Caller{}, authservice.LogoutInput{RefreshToken: phone.RefreshToken, AllDevices: true})
+	assertServiceError(t, err, service.KindUnauthorized, "")
+
+	require.NoError(t, accounts.Logout(ctx, service.Caller{}, authservice.LogoutInput{RefreshToken: laptop.RefreshToken, AllDevices: true}))
+	for _, token := range []string{registered.RefreshToken, laptop.RefreshToken} {
+		_, err = accounts.Refresh(ctx, service.Caller{}, token)
+		assertServiceError(t, err, service.KindUnauthorized, "")
+	}
+	event := store.audit[len(store.audit)-1]
+	assert.Equal(t, service.AuditActionLogout, event.Action)
+	assert.JSONEq(t, `{"all_devices":true,"revoked":2}`, string(event.Details))
+
+	// Nothing is left to revoke after a password change
+	revoked, err := accounts.RevokeSessions(ctx, service.Caller{}, registered.User.ID)
+	require.NoError(t, err)
+	assert.Zero(t, revoked)
+}
+
+func TestAuthServiceChangePassword(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)}
+	store := newMemStore(clock)
+	accounts := authservice.NewService(store)
+	accounts.SetClock(clock)
+	ctx := context.Background()
+
+	registered, err := accounts.Register(ctx, service.Caller{}, authservice.RegisterInput{Email: "a@example.com", Password: "hunter22"})
+	require.NoError(t, err)
+	other, err := accounts.Login(ctx, service.Caller{}, authservice.LoginInput{Email: "a@example.com", Password: "hunter22"})
+	require.NoError(t, err)
+	laptop, err := store.CreateDevice(registered.User.ID, "laptop", "desktop", nil, 0, nil)
+	require.NoError(t, err)
+	caller := service.Caller{UserID: registered.User.ID, DeviceID: laptop.ID}
+	salt := registered.User.Salt
+
+	_, err = accounts.ChangePassword(ctx, caller, authservice.ChangePasswordInput{CurrentPassword: "hunter23", NewPassword: "correct horse"})
+	assertServiceError(t, err, service.KindForbidden, "invalid_current_password")
+
+	tokens, err := accounts.ChangePassword(ctx, caller, authservice.ChangePasswordInput{CurrentPassword: "hunter22", NewPassword: "correct horse"})
+	require.NoError(t, err)
+	assert.NotEqual(t, salt, store.users[registered.User.ID].Salt, "a new salt with the new password")
+	event := store.audit[len(store.audit)-1]
+	assert.Equal(t, service.AuditActionPasswordChange, event.Action)
+	assert.JSONEq(t, `{"revoked":2}`, string(event.Details))
+
+	// Every earlier session is signed out; the new one carries the device
+	for _, token := range []string{registered.RefreshToken, other.RefreshToken} {
+		_, err = accounts.Refresh(ctx, service.Caller{}, token)
+		assertServiceError(t, err, service.KindUnauthorized, "")
+	}
+	assert.Equal(t, caller.DeviceID, *store.tokens[tokens.RefreshToken].DeviceID)
+	_, err = accounts.Refresh(ctx, service.Caller{}, tokens.RefreshToken)
+	require.NoError(t, err)
+
+	_, err = accounts.Login(ctx, service.Caller{}, authservice.LoginInput{Email: "a@example.com", Password: "hunter22"})
+	assertServiceError(t, err, service.KindUnauthorized, "")
+	_, err = accounts.Login(ctx, service.Caller{}, authservice.LoginInput{Email: "a@example.com", Password: "correct horse"})
+	require.NoError(t, err)
+}
+
+func newSyncService(t *testing.T) (*syncservice.Service, *memStore, *recordingHub) {
+	store := newMemStore(&fakeClock{now: time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)})
+	hub := &recordingHub{}
+	svc := syncservice.NewService(store, sync.NewRegistry(store, 10))
+	svc.SetHub(hub)
+	return svc, store, hub
+}
+
+func syncRecord(tombstone bool) mapping.SyncRecordDTO {
+	return mapping.SyncRecordDTO{
+		ItemUUID:   uuid.New().String(),
+		WrappedKey: []byte("wrapped"),
+		EncItem:    []byte("sealed"),
+		Tombstone:  tombstone,
+	}
+}
+
+func TestSyncServicePush(t *testing.T) {
+	svc, store, hub := newSyncService(t)
+	userID := uuid.New().String()
+	laptop, _ := store.CreateDevice(userID, "laptop", "desktop", nil, 0, nil)
+	caller := service.Caller{UserID: userID, DeviceID: laptop.ID}
+
+	// Without a post-commit queue the digest and events run before Push
+	// returns
+	result, err := svc.Push(context.Background(), caller, syncservice.PushInput{
+		Zone:    "work",
+		Records: []mapping.SyncRecordDTO{syncRecord(false), syncRecord(false)},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), result.GenCount)
+	assert.Equal(t, 2, result.Synced)
+	assert.False(t, result.EventsPending)
+
+	require.Len(t, store.commits, 1)
+	assert.Equal(t, laptop.ID, store.commits[0].DeviceID)
+	require.Len(t, hub.events, 1)
+	assert.Equal(t, "credentials_changed", hub.events[0].Type)
+	assert.Equal(t, "work", hub.events[0].Zone)
+	assert.Equal(t, laptop.ID, *hub.events[0].DeviceID)
+	assert.Equal(t, []string{service.AuditActionSyncPush, service.AuditActionItemPush, service.AuditActionItemPush}, store.actions())
+	assert.NotNil(t, store.devices[laptop.ID].LastSync, "the pushing device counts as synced")
+
+	// Each item gets a result; invalid and refused ones are left out
+	// while the rest are written
+	good, incomplete, refused := syncRecord(false), syncRecord(false), syncRecord(false)
+	incomplete.EncItem = nil
+	store.rejectIDs = map[string]bool{refused.ItemUUID: true}
+	result, err = svc.Push(context.Background(), caller, syncservice.PushInput{
+		Records: []mapping.SyncRecordDTO{good, incomplete, refused},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Synced)
+	assert.Equal(t, 2, result.FailedCount)
+	require.Len(t, result.Results, 3)
+	assert.Equal(t, syncservice.PushItemResult{
+		Layer: mapping.LayerSyncRecord, Index: 0, ItemUUID: good.ItemUUID,
+		Status: syncservice.PushItemSynced, GenCount: result.GenCount - 1,
+	}, result.Results[0])
+	assert.Equal(t, []string{"invalid_item", "enc_item"}, []string{result.Results[1].Code, result.Results[1].Field})
+	assert.Equal(t, 2, result.Results[2].Index)
+	assert.Equal(t, syncservice.PushItemFailed, result.Results[2].Status)
+	assert.Equal(t, "item_rejected", result.Results[2].Code)
+
+	require.Len(t, store.commits, 2)
+	require.Len(t, store.commits[1].Records, 1)
+	assert.Equal(t, good.ItemUUID, store.commits[1].Records[0].ItemUUID.String())
+	pushEvent := store.audit[len(store.audit)-2]
+	assert.Equal(t, service.AuditActionSyncPush, pushEvent.Action)
+	assert.JSONEq(t, fmt.Sprintf(`{"synced":1,"failed":2,"gencount":%d}`, result.GenCount), string(pushEvent.Details))
+}
+
+func TestSyncServicePushConflicts(t *testing.T) {
+	svc, store, _ := newSyncService(t)
+	caller := service.Caller{UserID: uuid.New().String()}
+	ctx := context.Background()
+
+	item, other := syncRecord(false), syncRecord(false)
+	_, err := svc.Push(ctx, caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{item, other}})
+	require.NoError(t, err)
+
+	// Edits of the latest version, and records sent without one, never
+	// conflict
+	edit := item
+	edit.GenCount = 1
+	result, err := svc.Push(ctx, caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{edit, syncRecord(false)}})
+	require.NoError(t, err)
+	assert.Empty(t, result.Conflicts)
+	assert.Equal(t, int64(3), result.Results[0].GenCount)
+
+	// Made from gencount 1 while the zone holds 3: the push is the later
+	// write and replaces it, saying so
+	stale := item
+	stale.GenCount = 1
+	result, err = svc.Push(ctx, caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{stale}})
+	require.NoError(t, err)
+	assert.Equal(t, []syncservice.PushConflict{{
+		ItemUUID: item.ItemUUID, Resolution: sync.ResolutionClientWins, Outcome: sync.OutcomeOrdered, WinningGenCount: result.GenCount,
+	}}, result.Conflicts)
+	assert.Equal(t, 1, result.Synced)
+
+	// Asked to keep the highest gencount, the stored record stays and the
+	// rest of the push lines up around it
+	fresh := syncRecord(false)
+	current := other
+	current.GenCount = 2
+	commits := len(store.commits)
+	result, err = svc.Push(ctx, caller, syncservice.PushInput{
+		Records:          []mapping.SyncRecordDTO{stale, current, fresh},
+		ConflictStrategy: sync.StrategyHighestGenCountWins,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []syncservice.PushConflict{{
+		ItemUUID: item.ItemUUID, Resolution: sync.ResolutionServerWins, Outcome: sync.OutcomeOrdered, WinningGenCount: 5,
+	}}, result.Conflicts)
+	assert.Equal(t, []string{syncservice.PushItemFailed, "conflict"}, []string{result.Results[0].Status, result.Results[0].Code})
+	assert.Equal(t, []int64{0, 6, 7}, []int64{result.Results[0].GenCount, result.Results[1].GenCount, result.Results[2].GenCount})
+	assert.Equal(t, 2, result.Synced)
+	assert.Equal(t, 1, result.FailedCount)
+	require.Len(t, store.commits, commits+1)
+	assert.Len(t, store.commits[commits].Records, 2)
+
+	// An edit made before another device deleted the item: under
+	// delete_wins the delete stays and the edit fails, saying why
+	svc.SetTombstonePolicy(sync.DeleteWins)
+	deleted := other
+	deleted.GenCount, deleted.Tombstone = 6, true
+	result, err = svc.Push(ctx, caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{deleted}})
+	require.NoError(t, err)
+	result, err = svc.Push(ctx, caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{current}})
+	require.NoError(t, err)
+	assert.Equal(t, []syncservice.PushConflict{{
+		ItemUUID: other.ItemUUID, Resolution: sync.ResolutionServerWins, Outcome: sync.OutcomeDeleteWins, WinningGenCount: 8,
+	}}, result.Conflicts)
+	assert.Contains(t, result.Results[0].Error, "deleted the item")
+	svc.SetTombstonePolicy(sync.EditWins)
+	commits = len(store.commits)
+
+	// Manual resolution leaves it to the device: nothing is written and the
+	// conflicting record is queued
+	svc.SetConflictStrategy(sync.ManualResolve)
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{stale, syncRecord(false)}})
+	serviceErr := assertServiceError(t, err, service.KindConflict, "push_conflict")
+	require.Len(t, store.conflicts, 1)
+	assert.Equal(t, []map[string]interface{}{{
+		"conflict_id": store.conflicts[0].ID, "item_uuid": item.ItemUUID, "gencount": int64(1), "stored_gencount": int64(5),
+	}}, serviceErr.Fields["conflicts"])
+	assert.Len(t, store.commits, commits)
+
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{stale}, ConflictStrategy: "coin_toss"})
+	assertServiceError(t, err, service.KindInvalid, "invalid_conflict_strategy")
+}
+
+func TestSyncServiceResolveConflict(t *testing.T) {
+	svc, store, hub := newSyncService(t)
+	svc.SetConflictStrategy(sync.ManualResolve)
+	caller := service.Caller{UserID: uuid.New().String()}
+	ctx := context.Background()
+
+	item := syncRecord(false)
+	_, err := svc.Push(ctx, caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{item}})
+	require.NoError(t, err)
+	edit := item
+	edit.GenCount = 1
+	edit.EncItem = []byte("edited on this device")
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{edit}})
+	require.NoError(t, err)
+
+	// Another device edits version 1 too, twice; the item keeps one
+	// conflict, holding the later push
+	stale := item
+	stale.GenCount = 1
+	stale.EncItem = []byte("first edit elsewhere")
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{stale}})
+	assertServiceError(t, err, service.KindConflict, "push_conflict")
+	stale.EncItem = []byte("second edit elsewhere")
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{stale}})
+	assertServiceError(t, err, service.KindConflict, "push_conflict")
+
+	manifest, err := svc.Manifest(ctx, caller, "default")
+	require.NoError(t, err)
+	assert.Equal(t, []string{item.ItemUUID}, manifest.PendingConflicts)
+
+	conflicts, err := svc.Conflicts(ctx, caller, "default")
+	require.NoError(t, err)
+	require.Len(t, conflicts, 1)
+	conflict := conflicts[0]
+	assert.Equal(t, item.ItemUUID, conflict.ItemUUID.String())
+	assert.Equal(t, []byte("second edit elsewhere"), conflict.Pushed.EncItem)
+	require.NotNil(t, conflict.Stored)
+	assert.Equal(t, []byte("edited on this device"), conflict.Stored.EncItem)
+	assert.Equal(t, int64(2), conflict.Stored.GenCount)
+
+	_, err = svc.ResolveConflict(ctx, caller, syncservice.ResolveConflictInput{ConflictID: conflict.ID, Resolution: "both"})
+	assertServiceError(t, err, service.KindInvalid, "invalid_resolution")
+	_, err = svc.ResolveConflict(ctx, caller, syncservice.ResolveConflictInput{ConflictID: uuid.New().String(), Resolution: sync.ResolutionClientWins})
+	assertServiceError(t, err, service.KindNotFound, "")
+
+	// The pushed version wins under a new gencount, and devices are told
+	result, err := svc.ResolveConflict(ctx, caller, syncservice.ResolveConflictInput{ConflictID: conflict.ID, Resolution: sync.ResolutionClientWins})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), result.GenCount)
+	records, err := store.GetSyncRecordsPage(ctx, caller.UserID, storage.PullRange{Zone: "default", Since: 2})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, []byte("second edit elsewhere"), records[0].EncItem)
+	assert.Equal(t, int64(3), store.state(caller.UserID, "default").GenCount)
+	assert.Contains(t, store.actions(), service.AuditActionSyncResolve)
+	require.NotEmpty(t, hub.events)
+	assert.Equal(t, int64(3), hub.events[len(hub.events)-1].GenCount)
+
+	conflicts, err = svc.Conflicts(ctx, caller, "default")
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+	manifest, err = svc.Manifest(ctx, caller, "default")
+	require.NoError(t, err)
+	assert.Empty(t, manifest.PendingConflicts)
+	_, err = svc.ResolveConflict(ctx, caller, syncservice.ResolveConflictInput{ConflictID: conflict.ID, Resolution: sync.ResolutionServerWins})
+	assertServiceError(t, err, service.KindNotFound, "")
+}
+
+func TestSyncServiceZones(t *testing.T) {
+	svc, _, _ := newSyncService(t)
+	caller := service.Caller{UserID: uuid.New().String()}
+	ctx := context.Background()
+
+	zones, err := svc.Zones(ctx, caller)
+	require.NoError(t, err)
+	assert.Empty(t, zones)
+
+	deleted := syncRecord(false)
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{Zone: "work", Records: []mapping.SyncRecordDTO{syncRecord(false), deleted}})
+	require.NoError(t, err)
+	deleted.Tombstone = true
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{Zone: "work", Records: []mapping.SyncRecordDTO{deleted}})
+	require.NoError(t, err)
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{
+		Keys:    []mapping.CryptoKeyDTO{snapshotKey()},
+		Records: []mapping.SyncRecordDTO{syncRecord(false), syncRecord(false)},
+	})
+	require.NoError(t, err)
+
+	// Every zone, by name, counting live items only
+	zones, err = svc.Zones(ctx, caller)
+	require.NoError(t, err)
+	require.Len(t, zones, 2)
+	assert.Equal(t, []string{"default", "work"}, []string{zones[0].Zone, zones[1].Zone})
+	assert.Equal(t, []int64{1, 0, 2}, []int64{zones[0].Keys, zones[0].Metadata, zones[0].Records})
+	assert.Equal(t, []int64{0, 0, 1}, []int64{zones[1].Keys, zones[1].Metadata, zones[1].Records})
+	assert.Equal(t, int64(3), zones[1].GenCount)
+}
+
+func TestSyncServicePushMalformedIDs(t *testing.T) {
+	svc, store, _ := newSyncService(t)
+	caller := service.Caller{UserID: uuid.New().String()}
+	empty, bad := "", "not-a-uuid"
+
+	// A malformed ID refuses the whole push, naming the item, rather than
+	// being written as the zero UUID
+	record := syncRecord(false)
+	record.ItemUUID = bad
+	_, err := svc.Push(context.Background(), caller, syncservice.PushInput{
+		Records: []mapping.SyncRecordDTO{syncRecord(false), record},
+	})
+	serviceErr := assertServiceError(t, err, service.KindInvalid, "invalid_item")
+	assert.Equal(t, map[string]interface{}{"layer": mapping.LayerSyncRecord, "index": 1, "field": "item_uuid"}, serviceErr.Fields)
+
+	cred := mapping.CredentialMetadataDTO{
+		ItemUUID:        uuid.New().String(),
+		Server:          "example.com",
+		Account:         "alice",
+		PasswordKeyUUID: bad,
+	}
+	_, err = svc.Push(context.Background(), caller, syncservice.PushInput{Metadata: []mapping.CredentialMetadataDTO{cred}})
+	serviceErr = assertServiceError(t, err, service.KindInvalid, "invalid_item")
+	assert.Equal(t, map[string]interface{}{"layer": mapping.LayerCredentialMetadata, "index": 0, "field": "password_key_uuid"}, serviceErr.Fields)
+
+	record = syncRecord(false)
+	record.ParentKeyUUID = &bad
+	_, err = svc.Push(context.Background(), caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{record}})
+	serviceErr = assertServiceError(t, err, service.KindInvalid, "invalid_item")
+	assert.Equal(t, "parent_key_uuid", serviceErr.Fields["field"])
+	assert.Empty(t, store.commits)
+
+	// An empty parent_key_uuid is no parent
+	record.ParentKeyUUID = &empty
+	result, err := svc.Push(context.Background(), caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{record}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Synced)
+	require.Len(t, store.commits, 1)
+	assert.Nil(t, store.commits[0].Records[0].ParentKeyUUID)
+}
+
+// A push bringing more credentials to life than the tier allows is refused
+// whole; edits and deletes of stored ones are not
+func TestSyncServicePushCredentialLimit(t *testing.T) {
+	svc, store, _ := newSyncService(t)
+	svc.SetTierPolicy(limits.Policy{limits.TierFree: {Credentials: 2}, limits.TierPremium: {}})
+	caller := service.Caller{UserID: uuid.New().String(), Tier: limits.TierFree}
+	ctx := context.Background()
+	credential := func() mapping.CredentialMetadataDTO {
+		return mapping.CredentialMetadataDTO{
+			ItemUUID: uuid.New().String(), Server: "example.com", Account: "alice", PasswordKeyUUID: uuid.New().String(),
+		}
+	}
+
+	first, second := credential(), credential()
+	_, err := svc.Push(ctx, caller, syncservice.PushInput{Metadata: []mapping.CredentialMetadataDTO{first, second}})
+	require.NoError(t, err)
+
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{
+		Metadata: []mapping.CredentialMetadataDTO{credential()},
+		Records:  []mapping.SyncRecordDTO{syncRecord(false)},
+	})
+	serviceErr := assertServiceError(t, err, service.KindForbidden, "quota_exceeded")
+	assert.Equal(t, map[string]interface{}{
+		"tier": limits.TierFree, "resource": limits.ResourceCredentials,
+		"limit": int64(2), "used": int64(2), "adding": int64(1),
+	}, serviceErr.Fields)
+	require.Len(t, store.commits, 1, "nothing of the push is written")
+
+	// Another zone counts against the same limit
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{Zone: "work", Metadata: []mapping.CredentialMetadataDTO{credential()}})
+	assertServiceError(t, err, service.KindForbidden, "quota_exceeded")
+
+	first.Account = "alice@example.com"
+	second.Tombstone = true
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{Metadata: []mapping.CredentialMetadataDTO{first, second}})
+	require.NoError(t, err, "an edit and a delete add nothing")
+
+	// The delete made room, which undeleting takes up again
+	second.Tombstone = false
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{Metadata: []mapping.CredentialMetadataDTO{second}})
+	require.NoError(t, err)
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{Metadata: []mapping.CredentialMetadataDTO{credential()}})
+	assertServiceError(t, err, service.KindForbidden, "quota_exceeded")
+
+	caller.Tier = limits.TierPremium
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{Metadata: []mapping.CredentialMetadataDTO{credential(), credential()}})
+	require.NoError(t, err)
+}
+
+func TestSyncServiceLegalHold(t *testing.T) {
+	svc, store, _ := newSyncService(t)
+	caller := service.Caller{UserID: uuid.New().String(), LegalHold: true}
+
+	_, err := svc.Push(context.Background(), caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{syncRecord(true)}})
+	assertServiceError(t, err, service.KindLocked, "legal_hold")
+	_, err = svc.DeleteAll(context.Background(), caller, "default")
+	assertServiceError(t, err, service.KindLocked, "legal_hold")
+	assert.Empty(t, store.commits)
+
+	// Updates are still allowed
+	_, err = svc.Push(context.Background(), caller, syncservice.PushInput{Records: []mapping.SyncRecordDTO{syncRecord(false)}})
+	require.NoError(t, err)
+}
+
+func TestSyncServicePushSequence(t *testing.T) {
+	svc, store, _ := newSyncService(t)
+	userID := uuid.New().String()
+	laptop, _ := store.CreateDevice(userID, "laptop", "desktop", nil, 0, nil)
+	push := func(caller service.Caller, sequence int64) error {
+		_, err := svc.Push(context.Background(), caller, syncservice.PushInput{
+			Records:  []mapping.SyncRecordDTO{syncRecord(false)},
+			Sequence: sequence,
+		})
+		return err
+	}
+
+	assertServiceError(t, push(service.Caller{UserID: userID}, 1), service.KindInvalid, "device_required")
+
+	caller := service.Caller{UserID: userID, DeviceID: laptop.ID}
+	serviceErr := assertServiceError(t, push(caller, 2), service.KindConflict, "push_sequence_mismatch")
+	assert.Equal(t, int64(1), serviceErr.Fields["expected_sequence"])
+	assert.Equal(t, false, serviceErr.Fields["duplicate"])
+
+	require.NoError(t, push(caller, 1))
+	serviceErr = assertServiceError(t, push(caller, 1), service.KindConflict, "push_sequence_mismatch")
+	assert.Equal(t, true, serviceErr.Fields["duplicate"])
+}
+
+func TestSyncServiceManifest(t *testing.T) {
+	svc, store, _ := newSyncService(t)
+	userID := uuid.New().String()
+	store.CreateDevice(userID, "laptop", "desktop", nil, 2, nil)
+	caller := service.Caller{UserID: userID}
+
+	manifest, err := svc.Manifest(context.Background(), caller, "work")
+	require.NoError(t, err)
+	assert.Nil(t, manifest.State, "a zone never written has no state")
+	assert.Equal(t, "work", manifest.Zone)
+
+	store.states[userID+"/work"] = &storage.SyncState{UserID: userID, Zone: "work", GenCount: 7}
+	manifest, err = svc.Manifest(context.Background(), caller, "work")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), manifest.State.GenCount)
+	require.NotNil(t, manifest.MinSupportedEncVersion)
+	assert.Equal(t, 2, *manifest.MinSupportedEncVersion)
+
+	// Only devices that compute digest version 2 get the stored digest;
+	// others get the version 1 digest of the live sync records
+	store.leaves[userID+"/work"] = []string{"record-a"}
+	store.states[userID+"/work"].Digest = []byte("stored")
+	manifest, err = svc.Manifest(context.Background(), caller, "work")
+	require.NoError(t, err)
+	assert.Equal(t, sync.LegacyDigestVersion, manifest.DigestVersion)
+	assert.Equal(t, sync.LegacyManifestDigest([]string{"record-a"}), manifest.State.Digest)
+	assert.Equal(t, []byte("stored"), store.states[userID+"/work"].Digest, "the stored state is left alone")
+
+	phone, _ := store.CreateDevice(userID, "phone", "mobile", nil, 2, []byte(`{"version":1,"digest_version":2}`))
+	manifest, err = svc.Manifest(context.Background(), service.Caller{UserID: userID, DeviceID: phone.ID}, "work")
+	require.NoError(t, err)
+	assert.Equal(t, sync.DigestVersion, manifest.DigestVersion)
+	assert.Equal(t, []byte("stored"), manifest.State.Digest)
+}
+
+func TestSyncServiceWipeAndUndo(t *testing.T) {
+	svc, store, hub := newSyncService(t)
+	svc.SetClock(store.clock)
+	svc.SetRecoveryWindow(24 * time.Hour)
+	userID := uuid.New().String()
+	laptop, _ := store.CreateDevice(userID, "laptop", "desktop", nil, 0, nil)
+	caller := service.Caller{UserID: userID, DeviceID: laptop.ID}
+	ctx := context.Background()
+
+	_, err := svc.UndoWipe(ctx, caller, "work")
+	assertServiceError(t, err, service.KindNotFound, "no_wipe")
+
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{
+		Zone:    "work",
+		Records: []mapping.SyncRecordDTO{syncRecord(false), syncRecord(false)},
+	})
+	require.NoError(t, err)
+	hub.events = nil
+
+	wiped, err := svc.DeleteAll(ctx, caller, "work")
+	require.NoError(t, err)
+	assert.Equal(t, 2, wiped.Deleted)
+	assert.Equal(t, []int{0, 0, 2}, []int{wiped.Keys, wiped.Metadata, wiped.Records})
+	assert.Equal(t, int64(4), wiped.GenCount, "trashed items get new gencounts")
+	require.NotNil(t, wiped.RecoverUntil)
+	assert.Equal(t, store.clock.Now().Add(24*time.Hour), *wiped.RecoverUntil)
+	require.Len(t, hub.events, 1)
+	assert.Equal(t, "zone_wiped", hub.events[0].Type)
+	assert.Equal(t, int64(4), hub.events[0].GenCount)
+
+	store.clock.Advance(time.Hour)
+	undone, err := svc.UndoWipe(ctx, caller, "work")
+	require.NoError(t, err)
+	assert.Equal(t, 2, undone.Restored)
+	assert.Equal(t, int64(6), undone.GenCount, "restored items are pulled again")
+	require.Len(t, hub.events, 2)
+	assert.Equal(t, "zone_wipe_undone", hub.events[1].Type)
+	assert.Len(t, store.leaves[userID+"/work"], 2)
+
+	_, err = svc.UndoWipe(ctx, caller, "work")
+	assertServiceError(t, err, service.KindNotFound, "no_wipe")
+
+	actions := store.actions()
+	assert.Contains(t, actions, service.AuditActionSyncDeleteAll)
+	assert.Contains(t, actions, service.AuditActionSyncUndoWipe)
+
+	t.Run("after the recovery window", func(t *testing.T) {
+		_, err := svc.DeleteAll(ctx, caller, "work")
+		require.NoError(t, err)
+		store.clock.Advance(24 * time.Hour)
+
+		_, err = svc.UndoWipe(ctx, caller, "work")
+		assertServiceError(t, err, service.KindGone, "wipe_expired")
+
+		job := jobs.NewBulkWipeExpiryJob(store)
+		job.SetClock(store.clock)
+		report, err := job.Run(ctx, jobs.RunOptions{DryRun: true})
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), report.TotalAffected)
+
+		report, err = job.Run(ctx, jobs.RunOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), report.TotalAffected)
+		report, err = job.Run(ctx, jobs.RunOptions{})
+		require.NoError(t, err)
+		assert.Zero(t, report.TotalAffected)
+
+		// Expired wipes are no longer offered for undo
+		_, err = svc.UndoWipe(ctx, caller, "work")
+		assertServiceError(t, err, service.KindNotFound, "no_wipe")
+	})
+
+	t.Run("empty zone", func(t *testing.T) {
+		result, err := svc.DeleteAll(ctx, caller, "empty")
+		require.NoError(t, err)
+		assert.Zero(t, result.Deleted)
+		assert.Nil(t, result.RecoverUntil, "nothing to undo")
+	})
+}
+
+func TestSyncServiceDeleteCredential(t *testing.T) {
+	svc, store, hub := newSyncService(t)
+	caller := service.Caller{UserID: uuid.New().String()}
+	ctx := context.Background()
+
+	// A has a key of its own and one it shares with B
+	ownKey, sharedKey := snapshotKey(), snapshotKey()
+	credential := func(passwordKey string, metadataKey *string) mapping.CredentialMetadataDTO {
+		return mapping.CredentialMetadataDTO{
+			ItemUUID: uuid.New().String(), Server: "example.com", Account: "alice",
+			PasswordKeyUUID: passwordKey, MetadataKeyUUID: metadataKey,
+		}
+	}
+	a, b := credential(ownKey.ItemUUID, &sharedKey.ItemUUID), credential(sharedKey.ItemUUID, nil)
+	recordA, recordB := syncRecord(false), syncRecord(false)
+	recordA.ItemUUID, recordB.ItemUUID = a.ItemUUID, b.ItemUUID
+	pushed, err := svc.Push(ctx, caller, syncservice.PushInput{
+		Keys:     []mapping.CryptoKeyDTO{ownKey, sharedKey},
+		Metadata: []mapping.CredentialMetadataDTO{a, b},
+		Records:  []mapping.SyncRecordDTO{recordA, recordB},
+	})
+	require.NoError(t, err)
+	hub.events = nil
+
+	_, err = svc.DeleteCredential(ctx, caller, "default", "not-a-uuid")
+	assertServiceError(t, err, service.KindInvalid, "")
+	_, err = svc.DeleteCredential(ctx, service.Caller{UserID: caller.UserID, LegalHold: true}, "default", a.ItemUUID)
+	assertServiceError(t, err, service.KindLocked, "legal_hold")
+
+	deleted, err := svc.DeleteCredential(ctx, caller, "default", a.ItemUUID)
+	require.NoError(t, err)
+	assert.Equal(t, syncservice.DeletedItems{Keys: 1, Metadata: 1, Records: 1}, deleted.DeletedItems)
+	assert.Equal(t, pushed.GenCount+3, deleted.GenCount, "a gencount per item")
+
+	batch := store.commits[len(store.commits)-1]
+	require.Len(t, batch.Keys, 1)
+	assert.Equal(t, ownKey.ItemUUID, batch.Keys[0].ItemUUID.String(), "the shared key stays")
+	assert.Equal(t, store.states[caller.UserID+"/default"].Digest, recordDigest([]string{recordB.ItemUUID}))
+
+	require.Len(t, hub.events, 1)
+	assert.Equal(t, "credential_deleted", hub.events[0].Type)
+	assert.Equal(t, a.ItemUUID, hub.events[0].ItemUUID)
+	assert.Equal(t, deleted.GenCount, hub.events[0].GenCount)
+	assert.Contains(t, store.actions(), service.AuditActionSyncDeleteItem)
+
+	_, err = svc.DeleteCredential(ctx, caller, "default", a.ItemUUID)
+	assertServiceError(t, err, service.KindNotFound, "")
+	_, err = svc.DeleteCredential(ctx, caller, "work", b.ItemUUID)
+	assertServiceError(t, err, service.KindNotFound, "")
+
+	// B was the last user of the shared key
+	deleted, err = svc.DeleteCredential(ctx, caller, "default", b.ItemUUID)
+	require.NoError(t, err)
+	assert.Equal(t, syncservice.DeletedItems{Keys: 1, Metadata: 1, Records: 1}, deleted.DeletedItems)
+}
+
+func TestSyncServiceIntegrity(t *testing.T) {
+	svc, store, _ := newSyncService(t)
+	svc.SetClock(store.clock)
+	userID := uuid.New().String()
+	laptop, _ := store.CreateDevice(userID, "laptop", "desktop", nil, 2, nil)
+	caller := service.Caller{UserID: userID, DeviceID: laptop.ID}
+	ctx := context.Background()
+
+	credential, key, otherKey := uuid.New().String(), uuid.New().String(), uuid.New().String()
+	store.scan = &storage.IntegrityScan{
+		GenCount:     9,
+		StoredDigest: []byte("stale"),
+		Computed:     &storage.ManifestState{LeafCount: 1, Digest: recordDigest([]string{uuid.New().String()})},
+		Violations: []storage.ReferenceViolation{
+			{Layer: "credential_metadata", ItemUUID: credential, Field: "password_key_uuid", KeyUUID: key, Violation: storage.ReferenceMissing},
+			{Layer: "credential_metadata", ItemUUID: credential, Field: "metadata_key_uuid", KeyUUID: otherKey, Violation: storage.ReferenceMissing},
+			{Layer: "sync_record", ItemUUID: uuid.New().String(), Field: "parent_key_uuid", KeyUUID: key, Violation: storage.ReferenceTombstoned},
+		},
+		OrphanedKeys: storage.ItemSample{Total: 3, ItemUUIDs: []string{"k1", "k2"}},
+		Unsupported:  storage.ItemSample{Total: 1, ItemUUIDs: []string{"r1"}},
+	}
+
+	report, err := svc.Integrity(ctx, caller, "default")
+	require.NoError(t, err)
+	assert.Equal(t, 2, store.scanOpts.MinEncVersion, "records are checked against the laptop")
+	assert.Equal(t, 2, *report.MinEncVersion)
+	assert.False(t, report.Healthy())
+	assert.Equal(t, 1, report.RunsLeft)
+
+	var checks []string
+	for _, finding := range report.Findings {
+		checks = append(checks, finding.Check)
+	}
+	assert.Equal(t, []string{
+		sync.FindingMissingKey, sync.FindingMissingParent, sync.FindingDigestMismatch,
+		sync.FindingUnsupportedRecord, sync.FindingOrphanedKey,
+	}, checks)
+
+	missing := report.Findings[0]
+	assert.Equal(t, sync.IntegrityError, missing.Severity)
+	assert.Equal(t, int64(1), missing.Count, "a credential missing both keys counts once")
+	assert.Equal(t, []string{credential}, missing.ItemUUIDs)
+	assert.Equal(t, []string{key, otherKey}, missing.KeyUUIDs)
+	assert.Equal(t, sync.RepairPushKeys, missing.Repair)
+
+	orphaned := report.Findings[4]
+	assert.Equal(t, sync.IntegrityInfo, orphaned.Severity)
+	assert.Equal(t, int64(3), orphaned.Count)
+	assert.True(t, orphaned.Truncated)
+
+	t.Run("rate limited", func(t *testing.T) {
+		store.clock.Advance(time.Hour)
+		_, err := svc.Integrity(ctx, caller, "default")
+		require.NoError(t, err)
+
+		store.clock.Advance(time.Hour)
+		_, err = svc.Integrity(ctx, caller, "work")
+		serviceErr := assertServiceError(t, err, service.KindRateLimited, "rate_limited")
+		assert.Equal(t, (22 * time.Hour).Milliseconds(), serviceErr.Fields["retry_after_ms"])
+
+		store.clock.Advance(22 * time.Hour)
+		_, err = svc.Integrity(ctx, caller, "default")
+		assert.NoError(t, err)
+	})
+
+	t.Run("healthy zone", func(t *testing.T) {
+		svc.SetIntegrityLimits(syncservice.IntegrityLimits{RunsPerDay: 10})
+		digest := recordDigest([]string{uuid.New().String(), uuid.New().String()})
+		store.scan = &storage.IntegrityScan{GenCount: 2, StoredDigest: digest, Computed: &storage.ManifestState{LeafCount: 2, Digest: digest}}
+
+		report, err := svc.Integrity(ctx, caller, "default")
+		require.NoError(t, err)
+		assert.True(t, report.Healthy())
+		assert.Empty(t, report.Findings)
+		assert.Equal(t, 2, report.LeafCount)
+	})
+
+	t.Run("statement timeout", func(t *testing.T) {
+		store.scanErr = sync.ErrIntegrityTimeout
+		_, err := svc.Integrity(ctx, caller, "default")
+		assertServiceError(t, err, service.KindUnavailable, "integrity_timeout")
+	})
+}
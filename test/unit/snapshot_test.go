@@ -0,0 +1,338 @@
+package unit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/api/handlers"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/service"
+	syncservice "github.com/deeplyprofound/password-sync/server/service/sync"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// snapshotPage collects a snapshot page as "<zone>/<layer>/<item>" entries
+type snapshotPage struct {
+	header *syncservice.SnapshotHeader
+	items  []string
+	onItem func() // Runs after each item, e.g. to push meanwhile
+}
+
+func (p *snapshotPage) Begin(header *syncservice.SnapshotHeader) error {
+	p.header = header
+	return nil
+}
+
+func (p *snapshotPage) Key(key *models.CryptoKey) error {
+	return p.add(key.Zone + "/key/" + key.ItemUUID.String())
+}
+
+func (p *snapshotPage) Metadata(cred *models.CredentialMetadata) error {
+	return p.add(cred.Zone + "/credential_metadata/" + cred.ItemUUID.String())
+}
+
+func (p *snapshotPage) Record(record *models.SyncRecord) error {
+	return p.add(record.Zone + "/sync_record/" + record.ItemUUID.String())
+}
+
+func (p *snapshotPage) add(item string) error {
+	p.items = append(p.items, item)
+	if p.onItem != nil {
+		p.onItem()
+	}
+	return nil
+}
+
+var allSnapshotLayers = mapping.PullLayers{Keys: true, Metadata: true, Records: true}
+
+func snapshotKey() mapping.CryptoKeyDTO {
+	return mapping.CryptoKeyDTO{
+		ItemUUID: uuid.New().String(),
+		KeyClass: 1,
+		KeyType:  2,
+		Data:     []byte("key"),
+		Flags:    []byte(`{"encrypt":true}`),
+	}
+}
+
+// snapshotAccount pushes a key, a record and a tombstone to "default" and
+// two records to "work", returning the live items in snapshot order
+func snapshotAccount(t *testing.T, svc *syncservice.Service, caller service.Caller) []string {
+	t.Helper()
+	ctx := context.Background()
+	key, record := snapshotKey(), syncRecord(false)
+	_, err := svc.Push(ctx, caller, syncservice.PushInput{
+		Keys:    []mapping.CryptoKeyDTO{key},
+		Records: []mapping.SyncRecordDTO{record, syncRecord(true)},
+	})
+	require.NoError(t, err)
+	first, second := syncRecord(false), syncRecord(false)
+	_, err = svc.Push(ctx, caller, syncservice.PushInput{Zone: "work", Records: []mapping.SyncRecordDTO{first, second}})
+	require.NoError(t, err)
+
+	return []string{
+		"default/key/" + key.ItemUUID,
+		"default/sync_record/" + record.ItemUUID,
+		"work/sync_record/" + first.ItemUUID,
+		"work/sync_record/" + second.ItemUUID,
+	}
+}
+
+func TestAccountSnapshot(t *testing.T) {
+	svc, store, _ := newSyncService(t)
+	userID := uuid.New().String()
+	laptop, _ := store.CreateDevice(userID, "laptop", "desktop", nil, 0, nil)
+	caller := service.Caller{UserID: userID, DeviceID: laptop.ID}
+	live := snapshotAccount(t, svc, caller)
+	ctx := context.Background()
+
+	t.Run("manifests only", func(t *testing.T) {
+		page := &snapshotPage{}
+		result, err := svc.Snapshot(ctx, caller, syncservice.SnapshotInput{}, page)
+		require.NoError(t, err)
+		assert.False(t, result.HasMore)
+		assert.Empty(t, page.items)
+		assert.Equal(t, map[string]int64{"default": 3, "work": 2}, page.header.GenCounts)
+		require.Len(t, page.header.Zones, 2)
+		assert.Equal(t, "default", page.header.Zones[0].Zone)
+		assert.Equal(t, "work", page.header.Zones[1].Zone)
+	})
+
+	t.Run("live items, keys first", func(t *testing.T) {
+		page := &snapshotPage{}
+		result, err := svc.Snapshot(ctx, caller, syncservice.SnapshotInput{Layers: allSnapshotLayers}, page)
+		require.NoError(t, err)
+		assert.Equal(t, live, page.items, "no tombstones")
+		assert.Equal(t, 4, result.Items)
+		assert.False(t, result.HasMore)
+		assert.Empty(t, result.Checkpoint)
+		assert.Contains(t, store.actions(), service.AuditActionSyncSnapshot)
+	})
+
+	t.Run("one layer", func(t *testing.T) {
+		page := &snapshotPage{}
+		_, err := svc.Snapshot(ctx, caller, syncservice.SnapshotInput{Layers: mapping.PullLayers{Keys: true}}, page)
+		require.NoError(t, err)
+		assert.Equal(t, live[:1], page.items)
+		assert.Equal(t, mapping.PullLayers{Keys: true}, page.header.Included)
+	})
+
+	t.Run("pages add up to the whole", func(t *testing.T) {
+		var items []string
+		in := syncservice.SnapshotInput{Layers: allSnapshotLayers, Limit: 1}
+		for pages := 0; ; pages++ {
+			require.Less(t, pages, 10)
+			page := &snapshotPage{}
+			result, err := svc.Snapshot(ctx, caller, in, page)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]int64{"default": 3, "work": 2}, page.header.GenCounts)
+			if pages > 0 {
+				assert.Nil(t, page.header.Zones, "manifests come with the first page")
+			}
+			items = append(items, page.items...)
+			if !result.HasMore {
+				break
+			}
+			in = syncservice.SnapshotInput{Checkpoint: result.Checkpoint, Limit: 1}
+		}
+		assert.Equal(t, live, items)
+	})
+
+	t.Run("checkpoints are not interchangeable with pull tokens", func(t *testing.T) {
+		pull, err := svc.Pull(ctx, caller, syncservice.PullInput{Zone: "work", Limit: 1})
+		require.NoError(t, err)
+		require.NotEmpty(t, pull.Checkpoint)
+		_, err = svc.Snapshot(ctx, caller, syncservice.SnapshotInput{Checkpoint: pull.Checkpoint}, &snapshotPage{})
+		assertServiceError(t, err, service.KindInvalid, "invalid_checkpoint")
+	})
+}
+
+func TestAccountSnapshotConsistency(t *testing.T) {
+	svc, store, _ := newSyncService(t)
+	userID := uuid.New().String()
+	laptop, _ := store.CreateDevice(userID, "laptop", "desktop", nil, 0, nil)
+	phone, _ := store.CreateDevice(userID, "phone", "mobile", nil, 0, nil)
+	fromLaptop := service.Caller{UserID: userID, DeviceID: laptop.ID}
+	fromPhone := service.Caller{UserID: userID, DeviceID: phone.ID}
+	live := snapshotAccount(t, svc, fromLaptop)
+	ctx := context.Background()
+
+	t.Run("pushes during a page are not in it", func(t *testing.T) {
+		page := &snapshotPage{}
+		var pushed []string
+		page.onItem = func() {
+			record := syncRecord(false)
+			_, err := svc.Push(ctx, fromPhone, syncservice.PushInput{Zone: "work", Records: []mapping.SyncRecordDTO{record, syncRecord(false)}})
+			require.NoError(t, err)
+			pushed = append(pushed, "work/sync_record/"+record.ItemUUID)
+		}
+		_, err := svc.Snapshot(ctx, fromLaptop, syncservice.SnapshotInput{Layers: allSnapshotLayers}, page)
+		require.NoError(t, err)
+
+		assert.Len(t, pushed, len(live))
+		assert.Equal(t, live, page.items)
+		assert.Equal(t, map[string]int64{"default": 3, "work": 2}, page.header.GenCounts)
+
+		// The next snapshot has every item of every push, or none of it
+		after := &snapshotPage{}
+		_, err = svc.Snapshot(ctx, fromLaptop, syncservice.SnapshotInput{Layers: allSnapshotLayers}, after)
+		require.NoError(t, err)
+		assert.Len(t, after.items, len(live)+2*len(pushed))
+		for _, item := range pushed {
+			assert.Contains(t, after.items, item)
+		}
+	})
+
+	t.Run("a zone changed before it was delivered restarts the snapshot", func(t *testing.T) {
+		page := &snapshotPage{}
+		result, err := svc.Snapshot(ctx, fromLaptop, syncservice.SnapshotInput{Layers: allSnapshotLayers, Limit: 1}, page)
+		require.NoError(t, err)
+		require.True(t, result.HasMore)
+
+		_, err = svc.Push(ctx, fromPhone, syncservice.PushInput{Zone: "work", Records: []mapping.SyncRecordDTO{syncRecord(false)}})
+		require.NoError(t, err)
+		_, err = svc.Snapshot(ctx, fromLaptop, syncservice.SnapshotInput{Checkpoint: result.Checkpoint}, &snapshotPage{})
+		assertServiceError(t, err, service.KindConflict, "checkpoint_stale")
+	})
+
+	t.Run("a zone changed after it was delivered does not", func(t *testing.T) {
+		mid := &snapshotPage{}
+		result, err := svc.Snapshot(ctx, fromLaptop, syncservice.SnapshotInput{Layers: allSnapshotLayers, Limit: 3}, mid)
+		require.NoError(t, err)
+		require.True(t, result.HasMore)
+		require.Equal(t, "work", mid.items[2][:4], "the page ended in work")
+
+		_, err = svc.Push(ctx, fromPhone, syncservice.PushInput{Records: []mapping.SyncRecordDTO{syncRecord(false)}})
+		require.NoError(t, err)
+		last := &snapshotPage{}
+		_, err = svc.Snapshot(ctx, fromLaptop, syncservice.SnapshotInput{Checkpoint: result.Checkpoint, Limit: 3}, last)
+		require.NoError(t, err)
+		assert.Equal(t, mid.header.GenCounts, last.header.GenCounts, "the baseline is the first page's")
+	})
+}
+
+func TestSnapshotEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	svc, store, _ := newSyncService(t)
+	userID := uuid.New().String()
+	laptop, _ := store.CreateDevice(userID, "laptop", "desktop", nil, 0, nil)
+	live := snapshotAccount(t, svc, service.Caller{UserID: userID, DeviceID: laptop.ID})
+
+	router := gin.New()
+	router.GET("/sync/snapshot", func(c *gin.Context) {
+		middleware.SetClaims(c, &auth.Claims{UserID: userID, DeviceID: laptop.ID})
+	}, handlers.NewSyncHandlerWithService(svc).GetSnapshot)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sync/snapshot?"+query, nil))
+		return w
+	}
+
+	w := get("include_keys=true&include_records=true")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(w.Body.Bytes()))
+	for scanner.Scan() {
+		var line map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	require.Len(t, lines, len(live)+2)
+
+	header := lines[0]
+	assert.Equal(t, "snapshot", header["type"])
+	assert.Equal(t, map[string]interface{}{"default": 3.0, "work": 2.0}, header["gencounts"])
+	assert.Len(t, header["zones"], 2)
+	assert.Equal(t, map[string]interface{}{"keys": true, "credential_metadata": false, "sync_records": true}, header["included"])
+
+	assert.Equal(t, "key", lines[1]["type"])
+	assert.Equal(t, "default", lines[1]["zone"])
+	assert.Equal(t, "sync_record", lines[len(lines)-2]["type"])
+	assert.Equal(t, "work", lines[len(lines)-2]["zone"])
+	assert.Contains(t, lines[len(lines)-2]["item"], "enc_item")
+
+	end := lines[len(lines)-1]
+	assert.Equal(t, "end", end["type"])
+	assert.Equal(t, float64(len(live)), end["items"])
+	assert.Equal(t, false, end["has_more"])
+	assert.NotContains(t, end, "checkpoint")
+
+	// Errors before the first line are ordinary JSON errors
+	w = get("checkpoint=forged")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"invalid_checkpoint"`)
+	w = get("limit=5001")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestExportEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	svc, store, _ := newSyncService(t)
+	userID := uuid.New().String()
+	laptop, _ := store.CreateDevice(userID, "laptop", "desktop", nil, 0, nil)
+	live := snapshotAccount(t, svc, service.Caller{UserID: userID, DeviceID: laptop.ID})
+
+	router := gin.New()
+	router.GET("/sync/export", func(c *gin.Context) {
+		middleware.SetClaims(c, &auth.Claims{UserID: userID, DeviceID: laptop.ID})
+	}, handlers.NewSyncHandlerWithService(svc).ExportVault)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sync/export", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "attachment")
+
+	type exportZone struct {
+		Zone               string            `json:"zone"`
+		GenCount           int64             `json:"gencount"`
+		Digest             []byte            `json:"digest"`
+		CryptoKeys         []json.RawMessage `json:"crypto_keys"`
+		CredentialMetadata []json.RawMessage `json:"credential_metadata"`
+		SyncRecords        []json.RawMessage `json:"sync_records"`
+		Items              int               `json:"items"`
+	}
+	var doc struct {
+		Format     string       `json:"format"`
+		Version    int          `json:"version"`
+		ExportedAt string       `json:"exported_at"`
+		Zones      []exportZone `json:"zones"`
+		Items      int          `json:"items"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc), w.Body.String())
+	assert.Equal(t, handlers.ExportFormat, doc.Format)
+	assert.Equal(t, syncservice.ExportFormatVersion, doc.Version)
+	assert.NotEmpty(t, doc.ExportedAt)
+	assert.Equal(t, len(live), doc.Items)
+
+	require.Len(t, doc.Zones, 2)
+	personal, work := doc.Zones[0], doc.Zones[1]
+	assert.Equal(t, "default", personal.Zone)
+	assert.Equal(t, int64(3), personal.GenCount)
+	assert.Len(t, personal.CryptoKeys, 1)
+	assert.NotNil(t, personal.CredentialMetadata, "empty layers are empty arrays")
+	assert.Empty(t, personal.CredentialMetadata)
+	assert.Len(t, personal.SyncRecords, 1, "no tombstones")
+	assert.Equal(t, 2, personal.Items)
+	state, err := store.GetSyncStateContext(context.Background(), userID, "default")
+	require.NoError(t, err)
+	assert.Equal(t, state.Digest, personal.Digest)
+
+	assert.Equal(t, "work", work.Zone)
+	assert.Empty(t, work.CryptoKeys)
+	assert.Len(t, work.SyncRecords, 2)
+	assert.Contains(t, string(work.SyncRecords[0]), "enc_item")
+	assert.Contains(t, store.actions(), service.AuditActionSyncExport)
+}
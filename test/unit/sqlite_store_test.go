@@ -0,0 +1,475 @@
+package unit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/domain/peer"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSQLiteStore(t *testing.T) *storage.SQLiteStore {
+	t.Helper()
+	store, err := storage.NewSQLiteStore(filepath.Join(t.TempDir(), "password-sync.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	require.NoError(t, store.ApplySchema())
+	return store
+}
+
+func newSQLiteUser(t *testing.T, store *storage.SQLiteStore, email string) *storage.User {
+	t.Helper()
+	user, err := store.CreateUser(email, []byte("hash"), []byte("salt"), "")
+	require.NoError(t, err)
+	return user
+}
+
+func TestSQLiteSchemaIsIdempotent(t *testing.T) {
+	store := newSQLiteStore(t)
+	assert.NoError(t, store.ApplySchema())
+}
+
+func TestSQLiteUsers(t *testing.T) {
+	store := newSQLiteStore(t)
+	user := newSQLiteUser(t, store, "alice@example.com")
+
+	_, err := store.CreateUser("alice@example.com", []byte("hash"), []byte("salt"), "")
+	assert.ErrorIs(t, err, storage.ErrEmailTaken)
+	_, err = store.CreateUser("bob@example.com", []byte("hash"), []byte("salt"), "eu")
+	assert.ErrorIs(t, err, storage.ErrUnknownRegion)
+	assert.True(t, store.HasRegion(storage.DefaultRegion))
+	assert.False(t, store.HasRegion("eu"))
+
+	byEmail, err := store.GetUserByEmail("alice@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, byEmail.ID)
+
+	var changed []string
+	store.OnUserChanged(func(userID string) { changed = append(changed, userID) })
+	require.NoError(t, store.SetSubscriptionTier(user.ID, "pro"))
+	require.NoError(t, store.BumpTokenVersion(user.ID))
+	assert.Equal(t, []string{user.ID, user.ID}, changed)
+
+	profile, err := store.GetAuthProfile(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "pro", profile.Tier)
+	assert.Equal(t, user.TokenVersion+1, profile.TokenVersion)
+
+	assert.ErrorIs(t, store.SetUserActive(uuid.New().String(), false), sql.ErrNoRows)
+
+	require.NoError(t, store.SetLegalHold(user.ID, true))
+	assert.ErrorIs(t, store.DeleteUserCascade(context.Background(), user.ID), sql.ErrNoRows, "an account on hold is kept")
+	require.NoError(t, store.SetLegalHold(user.ID, false))
+	require.NoError(t, store.DeleteUserCascade(context.Background(), user.ID))
+	_, err = store.GetUserByID(user.ID)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestSQLiteUpsertDevice(t *testing.T) {
+	ctx := context.Background()
+	store := newSQLiteStore(t)
+	user := newSQLiteUser(t, store, "alice@example.com")
+
+	device, created, err := store.UpsertDevice(user.ID, "fp-1", "Laptop", "macos", []byte("key-1"), 2, nil)
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, int(peer.TrustLevelTrusted), device.TrustLevel)
+
+	again, created, err := store.UpsertDevice(user.ID, "fp-1", "Work laptop", "macos", nil, 0, nil)
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, device.ID, again.ID)
+	assert.Equal(t, []byte("key-1"), again.PublicKey, "no public key keeps the stored one")
+	assert.Equal(t, 2, again.MaxEncVersion)
+
+	stored, err := store.GetDevice(ctx, user.ID, device.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Work laptop", stored.DeviceName)
+
+	require.NoError(t, store.RenameDevice(user.ID, device.ID, "Home"))
+	assert.ErrorIs(t, store.RenameDevice(user.ID, uuid.New().String(), "Home"), sql.ErrNoRows)
+
+	deviceID := device.ID
+	token, err := store.CreateRefreshToken(user.ID, &deviceID, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	revoked, err := store.RevokeDevices(user.ID, []string{device.ID, uuid.New().String()})
+	require.NoError(t, err)
+	assert.Equal(t, []string{device.ID}, revoked)
+	stored, err = store.GetDevice(ctx, user.ID, device.ID)
+	require.NoError(t, err)
+	assert.False(t, stored.IsActive)
+	rt, err := store.GetRefreshToken(token.Token)
+	require.NoError(t, err)
+	assert.True(t, rt.Revoked)
+
+	// The fingerprint is free again once the device is revoked
+	_, created, err = store.UpsertDevice(user.ID, "fp-1", "Laptop", "macos", []byte("key-1"), 2, nil)
+	require.NoError(t, err)
+	assert.True(t, created)
+}
+
+func TestSQLiteStaleDevices(t *testing.T) {
+	ctx := context.Background()
+	store := newSQLiteStore(t)
+	user := newSQLiteUser(t, store, "alice@example.com")
+	device, err := store.CreateDevice(user.ID, "Phone", "ios", nil, 0, nil)
+	require.NoError(t, err)
+
+	stale, err := store.FindStaleDevices(user.ID, time.Now().Add(time.Hour), "")
+	require.NoError(t, err)
+	require.Len(t, stale, 1)
+	assert.WithinDuration(t, device.CreatedAt, stale[0].LastActive, time.Millisecond)
+
+	stale, err = store.FindStaleDevices(user.ID, time.Now().Add(time.Hour), device.ID)
+	require.NoError(t, err)
+	assert.Empty(t, stale)
+
+	require.NoError(t, store.UpdateUserSettings(ctx, user.ID, &storage.UserSettings{
+		EncVersionPolicy:         sync.EncVersionPolicyWarn,
+		DeviceAutoDeactivateDays: 30,
+		DeviceApproval:           peer.DeviceApprovalOff,
+	}))
+	candidates, err := store.FindAutoDeactivationCandidates(time.Now().AddDate(0, 0, 20), 7, "")
+	require.NoError(t, err)
+	assert.Empty(t, candidates, "idle 20 days, warned from 23")
+	candidates, err = store.FindAutoDeactivationCandidates(time.Now().AddDate(0, 0, 24), 7, user.ID)
+	require.NoError(t, err)
+	require.Len(t, candidates, 1)
+	assert.Equal(t, 30, candidates[0].AutoDeactivateDays)
+}
+
+// sqliteBatch is a push of a key, a credential and its sync record, which
+// the store numbers in that order
+func sqliteBatch(zone string) (*storage.PushBatch, uuid.UUID) {
+	keyID := uuid.New()
+	credID := uuid.New()
+	return &storage.PushBatch{
+		Zone: zone,
+		Keys: []*models.CryptoKey{{
+			ItemUUID: keyID, Zone: zone, AccGroup: "group", Data: []byte("key"), Flags: []byte("{}"),
+		}},
+		Metadata: []*models.CredentialMetadata{{
+			ItemUUID: credID, Zone: zone, Server: "Example.com", Account: "alice",
+			AccGroup: "group", PasswordKeyUUID: keyID,
+		}},
+		Records: []*models.SyncRecord{{
+			ItemUUID: credID, Zone: zone, ParentKeyUUID: &keyID, WrappedKey: []byte("wrapped"),
+			EncItem: []byte("item"), EncVersion: 1, ContextID: "ctx",
+		}},
+	}, credID
+}
+
+func TestSQLiteComputeManifestCoversEveryLayer(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "password-sync.db")
+	store, err := storage.NewSQLiteStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+	require.NoError(t, store.ApplySchema())
+	user := newSQLiteUser(t, store, "alice@example.com")
+
+	batch, credID := sqliteBatch("default")
+	_, err = store.CommitPush(ctx, user.ID, batch)
+	require.NoError(t, err)
+	keyID := batch.Keys[0].ItemUUID.String()
+
+	manifest, err := store.ComputeManifest(ctx, user.ID, "default")
+	require.NoError(t, err)
+	assert.Equal(t, 3, manifest.LeafCount)
+	assert.Equal(t, sync.ManifestDigest([]sync.ManifestLeaf{
+		{Layer: sync.LeafCryptoKey, ItemUUID: keyID, GenCount: 1},
+		{Layer: sync.LeafCredentialMetadata, ItemUUID: credID.String(), GenCount: 2},
+		{Layer: sync.LeafSyncRecord, ItemUUID: credID.String(), GenCount: 3},
+	}), manifest.Digest)
+
+	// Pushing the key again changes no record, but moves the digest
+	rekey := &storage.PushBatch{Zone: "default", Keys: batch.Keys}
+	_, err = store.CommitPush(ctx, user.ID, rekey)
+	require.NoError(t, err)
+	rekeyed, err := store.ComputeManifest(ctx, user.ID, "default")
+	require.NoError(t, err)
+	assert.NotEqual(t, manifest.Digest, rekeyed.Digest)
+
+	// A file written before digest version 2 has its digests rewritten on
+	// the next start, once
+	leafIDs, err := store.LiveLeafIDs(ctx, user.ID, "default")
+	require.NoError(t, err)
+	legacy := sync.LegacyManifestDigest(leafIDs)
+	require.NoError(t, store.UpsertSyncState(user.ID, "default", 4, legacy))
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(`PRAGMA user_version = 0`)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	require.NoError(t, store.ApplySchema())
+	state, err := store.GetSyncState(user.ID, "default")
+	require.NoError(t, err)
+	assert.Equal(t, rekeyed.Digest, state.Digest)
+
+	require.NoError(t, store.UpsertSyncState(user.ID, "default", 4, legacy))
+	require.NoError(t, store.ApplySchema())
+	state, err = store.GetSyncState(user.ID, "default")
+	require.NoError(t, err)
+	assert.Equal(t, legacy, state.Digest, "already upgraded")
+}
+
+func TestSQLitePushPullAndDelete(t *testing.T) {
+	ctx := context.Background()
+	store := newSQLiteStore(t)
+	user := newSQLiteUser(t, store, "alice@example.com")
+
+	batch, credID := sqliteBatch("default")
+	rejected, err := store.CommitPush(ctx, user.ID, batch)
+	require.NoError(t, err)
+	assert.Empty(t, rejected)
+
+	state, err := store.GetSyncState(user.ID, "default")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), state.GenCount)
+
+	counts, err := store.CountPullWindow(ctx, user.ID, storage.PullRange{Zone: "default"})
+	require.NoError(t, err)
+	assert.Equal(t, storage.PullCounts{Keys: 1, Metadata: 1, Records: 1}, *counts)
+
+	page, err := store.GetSyncRecordsPage(ctx, user.ID, storage.PullRange{Zone: "default", Since: 2})
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	assert.Equal(t, credID, page[0].ItemUUID)
+	page, err = store.GetSyncRecordsPage(ctx, user.ID, storage.PullRange{Zone: "default", Offset: 1})
+	require.NoError(t, err)
+	assert.Empty(t, page)
+
+	found, err := store.SearchCredentialMetadata(user.ID, "default", "EXAMPLE")
+	require.NoError(t, err)
+	assert.Len(t, found, 1)
+
+	states, err := store.ProbeItems(ctx, storage.ItemProbe{UserID: user.ID, Zone: "default", ItemUUIDs: []uuid.UUID{credID}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), states[credID].GenCount)
+
+	err = store.ReadSnapshot(ctx, user.ID, func(snapshot storage.SnapshotReader) error {
+		var keys int
+		err := snapshot.StreamCryptoKeys(ctx, storage.PullRange{Zone: "default"}, func(*models.CryptoKey) error {
+			keys++
+			return nil
+		})
+		assert.Equal(t, 1, keys)
+		return err
+	})
+	require.NoError(t, err)
+
+	result, err := store.DeleteCredential(ctx, user.ID, &storage.CredentialDeleteRequest{Zone: "default", ItemUUID: credID})
+	require.NoError(t, err)
+	assert.Len(t, result.Items, 3, "the unshared key, the metadata and the record")
+	assert.Equal(t, int64(6), result.GenCount)
+
+	leaves, err := store.LiveLeafIDs(ctx, user.ID, "default")
+	require.NoError(t, err)
+	assert.Empty(t, leaves)
+
+	_, err = store.DeleteCredential(ctx, user.ID, &storage.CredentialDeleteRequest{Zone: "default", ItemUUID: credID})
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+}
+
+func TestSQLitePushRejectsItemAlone(t *testing.T) {
+	ctx := context.Background()
+	store := newSQLiteStore(t)
+	user := newSQLiteUser(t, store, "alice@example.com")
+
+	batch, _ := sqliteBatch("default")
+	batch.Records[0].EncItem = nil // NOT NULL
+	rejected, err := store.CommitPush(ctx, user.ID, batch)
+	require.NoError(t, err)
+	require.Len(t, rejected, 1)
+	assert.Equal(t, "sync_record", rejected[0].Layer)
+
+	counts, err := store.CountPullWindow(ctx, user.ID, storage.PullRange{Zone: "default"})
+	require.NoError(t, err)
+	assert.Equal(t, storage.PullCounts{Keys: 1, Metadata: 1}, *counts)
+}
+
+func TestSQLitePushSequence(t *testing.T) {
+	ctx := context.Background()
+	store := newSQLiteStore(t)
+	user := newSQLiteUser(t, store, "alice@example.com")
+	device, err := store.CreateDevice(user.ID, "Phone", "ios", nil, 0, nil)
+	require.NoError(t, err)
+
+	batch, _ := sqliteBatch("default")
+	batch.DeviceID, batch.Sequence = device.ID, 1
+	_, err = store.CommitPush(ctx, user.ID, batch)
+	require.NoError(t, err)
+
+	_, err = store.CommitPush(ctx, user.ID, batch)
+	var sequenceErr *sync.PushSequenceError
+	require.True(t, errors.As(err, &sequenceErr))
+	assert.True(t, sequenceErr.Duplicate())
+
+	batch, _ = sqliteBatch("default")
+	batch.DeviceID, batch.Sequence = device.ID, 2
+	_, err = store.CommitPush(ctx, user.ID, batch)
+	require.NoError(t, err)
+}
+
+func TestSQLiteWipeAndUndo(t *testing.T) {
+	ctx := context.Background()
+	store := newSQLiteStore(t)
+	user := newSQLiteUser(t, store, "alice@example.com")
+	batch, _ := sqliteBatch("default")
+	_, err := store.CommitPush(ctx, user.ID, batch)
+	require.NoError(t, err)
+
+	now := time.Now()
+	wiped, err := store.WipeZone(ctx, user.ID, &storage.WipeRequest{Zone: "default", RecoverUntil: now.Add(time.Hour)})
+	require.NoError(t, err)
+	require.NotNil(t, wiped.Wipe)
+	assert.Equal(t, 3, wiped.Wipe.Items)
+	assert.Equal(t, int64(6), wiped.GenCount)
+
+	expired, err := store.FindExpiredWipes(now.Add(2*time.Hour), "")
+	require.NoError(t, err)
+	require.Len(t, expired, 1)
+	assert.Equal(t, wiped.Wipe.ID, expired[0].ID)
+
+	restored, err := store.UndoWipe(ctx, user.ID, &storage.WipeRequest{Zone: "default"}, now)
+	require.NoError(t, err)
+	assert.Len(t, restored.Items, 3)
+	assert.Equal(t, int64(9), restored.GenCount)
+
+	_, err = store.UndoWipe(ctx, user.ID, &storage.WipeRequest{Zone: "default"}, now)
+	assert.ErrorIs(t, err, sync.ErrNoWipe)
+
+	state, err := store.GetSyncState(user.ID, "default")
+	require.NoError(t, err)
+	assert.Equal(t, int64(9), state.GenCount)
+}
+
+func TestSQLiteInactivity(t *testing.T) {
+	store := newSQLiteStore(t)
+	user := newSQLiteUser(t, store, "alice@example.com")
+
+	accounts, err := store.FindInactiveAccounts(time.Now().Add(-time.Hour), "")
+	require.NoError(t, err)
+	assert.Empty(t, accounts)
+
+	accounts, err = store.FindInactiveAccounts(time.Now().Add(time.Hour), user.ID)
+	require.NoError(t, err)
+	require.Len(t, accounts, 1)
+	assert.WithinDuration(t, user.CreatedAt, accounts[0].LastActive, time.Millisecond)
+
+	moved, err := store.SetInactivityStage(user.ID, storage.InactivityActive, storage.InactivityDormant, time.Now())
+	require.NoError(t, err)
+	assert.True(t, moved)
+
+	previous, err := store.TouchUser(user.ID, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, storage.InactivityDormant, previous)
+}
+
+func TestSQLiteLockoutAndReset(t *testing.T) {
+	store := newSQLiteStore(t)
+	user := newSQLiteUser(t, store, "alice@example.com")
+
+	until := time.Now().Add(time.Minute)
+	_, err := store.IncrementFailedLogin(user.ID, 2, until)
+	require.NoError(t, err)
+	lockedUntil, err := store.IncrementFailedLogin(user.ID, 2, until)
+	require.NoError(t, err)
+	require.NotNil(t, lockedUntil)
+
+	locked, _, err := store.IsLocked(user.ID, time.Now())
+	require.NoError(t, err)
+	assert.True(t, locked)
+
+	require.NoError(t, store.CreatePasswordResetToken(user.ID, []byte("token"), time.Now().Add(time.Hour)))
+	userID, err := store.ConsumePasswordResetToken([]byte("token"), time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, userID)
+	_, err = store.ConsumePasswordResetToken([]byte("token"), time.Now())
+	assert.ErrorIs(t, err, sql.ErrNoRows, "a token works once")
+
+	_, err = store.UpdateUserPassword(user.ID, []byte("new"), []byte("salt"), 2)
+	require.NoError(t, err)
+	locked, _, err = store.IsLocked(user.ID, time.Now())
+	require.NoError(t, err)
+	assert.False(t, locked)
+}
+
+func TestSQLiteAuditLog(t *testing.T) {
+	ctx := context.Background()
+	store := newSQLiteStore(t)
+	user := newSQLiteUser(t, store, "alice@example.com")
+
+	zone := "default"
+	for _, action := range []string{"push", "pull", "push"} {
+		require.NoError(t, store.RecordAuditEvent(&storage.AuditEvent{UserID: user.ID, Action: action, Zone: &zone}))
+	}
+
+	since := time.Now().Add(-time.Minute)
+	times, err := store.AuditEventTimes(ctx, user.ID, "push", since)
+	require.NoError(t, err)
+	assert.Len(t, times, 2)
+
+	feed, err := store.ListZoneActivity(ctx, storage.ZoneActivityFilter{
+		UserID: user.ID, Zone: zone, Actions: []string{"push"}, Limit: 10,
+	})
+	require.NoError(t, err)
+	require.Len(t, feed, 2)
+	assert.Greater(t, feed[0].ID, feed[1].ID)
+
+	filter := storage.AuditEventFilter{UserID: user.ID, From: since, To: time.Now().Add(time.Minute), Limit: 2}
+	cursor, more, err := store.NextAuditCursor(filter)
+	require.NoError(t, err)
+	assert.True(t, more)
+	var streamed []int64
+	require.NoError(t, store.StreamAuditEvents(filter, func(event *storage.AuditEvent) error {
+		streamed = append(streamed, event.ID)
+		return nil
+	}))
+	assert.Equal(t, streamed[1], cursor)
+}
+
+func TestSQLiteMaintenance(t *testing.T) {
+	ctx := context.Background()
+	store := newSQLiteStore(t)
+	user := newSQLiteUser(t, store, "alice@example.com")
+	batch, credID := sqliteBatch("default")
+	_, err := store.CommitPush(ctx, user.ID, batch)
+	require.NoError(t, err)
+	_, err = store.DeleteCredential(ctx, user.ID, &storage.CredentialDeleteRequest{Zone: "default", ItemUUID: credID})
+	require.NoError(t, err)
+
+	summaries, err := store.FindPurgeableTombstones(time.Now().Add(time.Minute), "", 2)
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	assert.Equal(t, int64(3), summaries[0].Count)
+	assert.Len(t, summaries[0].SampleItemUUIDs, 2)
+
+	purged, err := store.PurgeTombstones(user.ID, "default", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), purged)
+
+	scan, err := store.ScanIntegrity(ctx, user.ID, "default", storage.IntegrityScanOptions{Limit: 10, Timeout: time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, 0, scan.Computed.LeafCount)
+	assert.Equal(t, scan.StoredDigest, scan.Computed.Digest)
+	assert.Empty(t, scan.Violations)
+
+	report := &storage.JobReport{JobName: "purge", StartedAt: time.Now(), FinishedAt: time.Now(), Details: []byte(`{}`)}
+	require.NoError(t, store.SaveJobReport(report))
+	reports, err := store.ListJobReports("purge", 5)
+	require.NoError(t, err)
+	require.Len(t, reports, 1)
+	assert.Equal(t, report.ID, reports[0].ID)
+}
@@ -1,11 +1,17 @@
 package unit
 
 import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/deeplyprofound/password-sync/pkg/models"
 	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSyncEngine(t *testing.T) {
@@ -22,58 +28,64 @@ func TestSyncEngine(t *testing.T) {
 	})
 
 	t.Run("update manifest digest", func(t *testing.T) {
-		leafIDs := []string{"uuid1", "uuid2", "uuid3"}
-		digest1 := engine.UpdateManifestDigest(leafIDs)
+		leaves := recordLeaves("uuid1", "uuid2", "uuid3")
+		digest1 := engine.UpdateManifestDigest(leaves)
 		assert.NotEmpty(t, digest1)
 
-		digest2 := engine.UpdateManifestDigest(leafIDs)
+		digest2 := engine.UpdateManifestDigest(leaves)
 		assert.Equal(t, digest1, digest2)
 
-		differentLeafIDs := []string{"uuid1", "uuid2", "uuid4"}
-		digest3 := engine.UpdateManifestDigest(differentLeafIDs)
+		differentLeaves := recordLeaves("uuid1", "uuid2", "uuid4")
+		digest3 := engine.UpdateManifestDigest(differentLeaves)
 		assert.NotEqual(t, digest1, digest3)
 	})
 
 	t.Run("detect conflicts", func(t *testing.T) {
+		itemID := uuid.New()
+		parent1 := uuid.New()
+		parent1Copy := parent1
+		parent2 := uuid.New()
+
 		local := &models.SyncRecord{
-			UUID:          "test-uuid",
+			ItemUUID:      itemID,
 			GenCount:      5,
-			ParentKeyUUID: "parent1",
+			ParentKeyUUID: &parent1,
 		}
 
 		remote1 := &models.SyncRecord{
-			UUID:          "test-uuid",
+			ItemUUID:      itemID,
 			GenCount:      5,
-			ParentKeyUUID: "parent1",
+			ParentKeyUUID: &parent1Copy,
 		}
 		assert.False(t, engine.DetectConflict(local, remote1))
 
 		remote2 := &models.SyncRecord{
-			UUID:          "test-uuid",
+			ItemUUID:      itemID,
 			GenCount:      5,
-			ParentKeyUUID: "parent2",
+			ParentKeyUUID: &parent2,
 		}
 		assert.True(t, engine.DetectConflict(local, remote2))
 
 		remote3 := &models.SyncRecord{
-			UUID:          "test-uuid",
+			ItemUUID:      itemID,
 			GenCount:      6,
-			ParentKeyUUID: "parent1",
+			ParentKeyUUID: &parent1,
 		}
 		assert.True(t, engine.DetectConflict(local, remote3))
 	})
 
 	t.Run("resolve conflicts with last write wins", func(t *testing.T) {
-		local := &models.SyncRecord{UUID: "test", GenCount: 5}
-		remote := &models.SyncRecord{UUID: "test", GenCount: 3}
+		itemID := uuid.New()
+		local := &models.SyncRecord{ItemUUID: itemID, GenCount: 5}
+		remote := &models.SyncRecord{ItemUUID: itemID, GenCount: 3}
 
 		resolved, err := engine.ResolveConflict(local, remote)
 		assert.NoError(t, err)
-		assert.Equal(t, local, resolved)
+		assert.Equal(t, &sync.ConflictResolution{Winner: local, Loser: remote, Outcome: sync.OutcomeOrdered}, resolved)
 
 		resolved, err = engine.ResolveConflict(remote, local)
 		assert.NoError(t, err)
-		assert.Equal(t, local, resolved)
+		assert.Equal(t, &sync.ConflictResolution{Winner: local, Loser: remote, Outcome: sync.OutcomeOrdered}, resolved)
 	})
 
 	t.Run("create sync operation", func(t *testing.T) {
@@ -113,8 +125,7 @@ func TestSyncEngine(t *testing.T) {
 	})
 
 	t.Run("build manifest", func(t *testing.T) {
-		leafIDs := []string{"uuid1", "uuid2", "uuid3"}
-		manifest, err := engine.BuildManifest(leafIDs, 10)
+		manifest, err := engine.BuildManifest(recordLeaves("uuid1", "uuid2", "uuid3"), 10)
 
 		assert.NoError(t, err)
 		assert.Equal(t, "test-zone", manifest.Zone)
@@ -123,3 +134,266 @@ func TestSyncEngine(t *testing.T) {
 		assert.NotEmpty(t, manifest.LeafIDs)
 	})
 }
+
+func recordLeaves(itemUUIDs ...string) []sync.ManifestLeaf {
+	leaves := make([]sync.ManifestLeaf, len(itemUUIDs))
+	for i, id := range itemUUIDs {
+		leaves[i] = sync.ManifestLeaf{Layer: sync.LeafSyncRecord, ItemUUID: id, GenCount: 1}
+	}
+	return leaves
+}
+
+func TestManifestDigestCoversEveryLayer(t *testing.T) {
+	record := sync.ManifestLeaf{Layer: sync.LeafSyncRecord, ItemUUID: uuid.New().String(), GenCount: 3}
+	key := sync.ManifestLeaf{Layer: sync.LeafCryptoKey, ItemUUID: uuid.New().String(), GenCount: 1}
+	cred := sync.ManifestLeaf{Layer: sync.LeafCredentialMetadata, ItemUUID: uuid.New().String(), GenCount: 2}
+	base := sync.ManifestDigest([]sync.ManifestLeaf{record, key, cred})
+
+	assert.Equal(t, "sync_record:"+record.ItemUUID+":3", record.String())
+	assert.Equal(t, base, sync.ManifestDigest([]sync.ManifestLeaf{cred, record, key}), "order doesn't matter")
+
+	// Same records, different keys: version 1 could not tell these apart
+	otherKey := key
+	otherKey.ItemUUID = uuid.New().String()
+	assert.NotEqual(t, base, sync.ManifestDigest([]sync.ManifestLeaf{record, otherKey, cred}))
+	rekeyed := key
+	rekeyed.GenCount = 4
+	assert.NotEqual(t, base, sync.ManifestDigest([]sync.ManifestLeaf{record, rekeyed, cred}), "a rewritten key moves the digest")
+	assert.Equal(t, sync.LegacyManifestDigest([]string{record.ItemUUID}), sync.LegacyManifestDigest([]string{record.ItemUUID}))
+
+	// The streaming hasher agrees when fed layer by layer in order
+	hasher := sync.NewManifestHasher()
+	for _, leaf := range []sync.ManifestLeaf{cred, key, record} {
+		hasher.Add(leaf)
+	}
+	assert.Equal(t, 3, hasher.Count())
+	assert.Equal(t, base, hasher.Sum())
+
+	assert.Equal(t, sync.LegacyManifestDigest(nil), sync.ManifestDigest(nil), "an empty zone hashes the same in both versions")
+}
+
+func TestResolvePush(t *testing.T) {
+	engine := sync.NewSyncEngine("default")
+	stored := &models.SyncRecord{ItemUUID: uuid.New(), GenCount: 9}
+	pushed := &models.SyncRecord{ItemUUID: stored.ItemUUID}
+
+	for name, want := range map[string]string{
+		sync.StrategyLastWriteWins:       sync.ResolutionClientWins,
+		sync.StrategyHighestGenCountWins: sync.ResolutionServerWins,
+	} {
+		strategy, err := sync.ParseConflictStrategy(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, strategy.String())
+
+		conflict, err := engine.ResolvePush(strategy, stored, pushed, 4)
+		require.NoError(t, err, name)
+		assert.Equal(t, &sync.PushConflict{
+			ItemUUID: stored.ItemUUID.String(), BaseGenCount: 4, StoredGenCount: 9, Resolution: want, Outcome: sync.OutcomeOrdered,
+		}, conflict, name)
+	}
+	assert.Equal(t, int64(0), pushed.GenCount, "the pushed record is left as it was")
+
+	// An edit pushed over a delete is settled by the tombstone policy, even
+	// where the strategy would keep the stored record
+	deleted := &models.SyncRecord{ItemUUID: stored.ItemUUID, GenCount: 9, Tombstone: true}
+	conflict, err := engine.ResolvePush(sync.HighestGenCountWins, deleted, pushed, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []string{sync.ResolutionClientWins, sync.OutcomeEditWins}, []string{conflict.Resolution, conflict.Outcome})
+	engine.SetTombstonePolicy(sync.DeleteWins)
+	conflict, err = engine.ResolvePush(sync.LastWriteWins, deleted, pushed, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []string{sync.ResolutionServerWins, sync.OutcomeDeleteWins}, []string{conflict.Resolution, conflict.Outcome})
+
+	_, err = engine.ResolvePush(sync.ManualResolve, stored, pushed, 4)
+	assert.ErrorIs(t, err, sync.ErrManualResolve)
+	_, err = sync.ParseConflictStrategy("coin_toss")
+	assert.Error(t, err)
+}
+
+func TestResolveConflictTombstones(t *testing.T) {
+	itemID := uuid.New()
+	edit := func(genCount int64) *models.SyncRecord {
+		return &models.SyncRecord{ItemUUID: itemID, GenCount: genCount}
+	}
+	deletion := func(genCount int64) *models.SyncRecord {
+		return &models.SyncRecord{ItemUUID: itemID, GenCount: genCount, Tombstone: true}
+	}
+
+	for _, tc := range []struct {
+		name          string
+		strategy      sync.ConflictResolutionStrategy
+		policy        sync.TombstonePolicy
+		local, remote *models.SyncRecord
+		localWins     bool
+		outcome       string
+	}{
+		{"delete/edit, edit wins", sync.LastWriteWins, sync.EditWins, deletion(7), edit(3), false, sync.OutcomeEditWins},
+		{"delete/edit, delete wins", sync.LastWriteWins, sync.DeleteWins, deletion(3), edit(7), true, sync.OutcomeDeleteWins},
+		{"edit/delete, edit wins", sync.HighestGenCountWins, sync.EditWins, edit(3), deletion(7), true, sync.OutcomeEditWins},
+		{"edit/delete, delete wins", sync.HighestGenCountWins, sync.DeleteWins, edit(7), deletion(3), false, sync.OutcomeDeleteWins},
+		{"delete/delete, later delete", sync.LastWriteWins, sync.EditWins, deletion(3), deletion(7), false, sync.OutcomeBothDeleted},
+		{"delete/delete, equal gencounts", sync.HighestGenCountWins, sync.DeleteWins, deletion(5), deletion(5), true, sync.OutcomeBothDeleted},
+		{"edit/edit ignores the policy", sync.LastWriteWins, sync.DeleteWins, edit(3), edit(7), false, sync.OutcomeOrdered},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			engine := sync.NewSyncEngine("default")
+			engine.SetTombstonePolicy(tc.policy)
+
+			resolved, err := engine.ResolveConflictWith(tc.strategy, tc.local, tc.remote)
+			require.NoError(t, err)
+			winner, loser := tc.remote, tc.local
+			if tc.localWins {
+				winner, loser = tc.local, tc.remote
+			}
+			assert.Same(t, winner, resolved.Winner)
+			assert.Same(t, loser, resolved.Loser)
+			assert.Equal(t, tc.outcome, resolved.Outcome)
+		})
+	}
+
+	t.Run("manual", func(t *testing.T) {
+		_, err := sync.NewSyncEngine("default").ResolveConflictWith(sync.ManualResolve, deletion(3), edit(7))
+		assert.ErrorIs(t, err, sync.ErrManualResolve)
+	})
+
+	t.Run("policy names", func(t *testing.T) {
+		assert.Equal(t, sync.EditWins, sync.NewSyncEngine("default").TombstonePolicy(), "edits win by default")
+		for _, policy := range []sync.TombstonePolicy{sync.EditWins, sync.DeleteWins} {
+			parsed, err := sync.ParseTombstonePolicy(policy.String())
+			require.NoError(t, err)
+			assert.Equal(t, policy, parsed)
+		}
+		_, err := sync.ParseTombstonePolicy("undelete")
+		assert.Error(t, err)
+	})
+}
+
+func TestParseManifestLeaf(t *testing.T) {
+	id := uuid.New()
+	leaf, err := sync.ParseManifestLeaf("crypto_key:" + strings.ToUpper(id.String()) + ":12")
+	require.NoError(t, err)
+	assert.Equal(t, sync.ManifestLeaf{Layer: sync.LeafCryptoKey, ItemUUID: id.String(), GenCount: 12}, leaf)
+	assert.Equal(t, "crypto_key:"+id.String()+":12", leaf.String(), "the UUID comes back as the digest spells it")
+
+	for _, tuple := range []string{
+		"",
+		id.String(),
+		"sync_record:" + id.String(),
+		"password:" + id.String() + ":1",
+		"sync_record:not-a-uuid:1",
+		"sync_record:" + id.String() + ":x",
+		"sync_record:" + id.String() + ":-1",
+		"sync_record:" + id.String() + ":1:2",
+	} {
+		_, err := sync.ParseManifestLeaf(tuple)
+		assert.Error(t, err, tuple)
+	}
+}
+
+func TestDiffLeaves(t *testing.T) {
+	engine := sync.NewSyncEngine("default")
+	same, stale, gone, fresh := uuid.New().String(), uuid.New().String(), uuid.New().String(), uuid.New().String()
+	device := []sync.ManifestLeaf{
+		{Layer: sync.LeafSyncRecord, ItemUUID: same, GenCount: 4},
+		{Layer: sync.LeafSyncRecord, ItemUUID: stale, GenCount: 2},
+		{Layer: sync.LeafCredentialMetadata, ItemUUID: stale, GenCount: 2},
+		{Layer: sync.LeafCryptoKey, ItemUUID: gone, GenCount: 1},
+	}
+	server := []sync.ManifestLeaf{
+		{Layer: sync.LeafSyncRecord, ItemUUID: same, GenCount: 4},
+		{Layer: sync.LeafSyncRecord, ItemUUID: stale, GenCount: 7},
+		{Layer: sync.LeafCredentialMetadata, ItemUUID: stale, GenCount: 7},
+		{Layer: sync.LeafSyncRecord, ItemUUID: fresh, GenCount: 8},
+		{Layer: sync.LeafCredentialMetadata, ItemUUID: fresh, GenCount: 8},
+	}
+
+	diff := engine.DiffLeaves(device, server)
+	assert.Equal(t, []string{fresh}, diff.Added, "one entry per item, whatever its layers")
+	assert.Equal(t, []string{gone}, diff.Removed)
+	assert.Equal(t, []string{stale}, diff.Modified, "items at the same gencount are left out")
+
+	diff = engine.DiffLeaves(server, server)
+	assert.Empty(t, diff.Added)
+	assert.Empty(t, diff.Removed)
+	assert.Empty(t, diff.Modified)
+}
+
+func TestLegacyManifestDigestIgnoresInputOrder(t *testing.T) {
+	ids := []string{uuid.New().String(), uuid.New().String(), uuid.New().String()}
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	reversed := []string{sorted[2], sorted[1], sorted[0]}
+
+	assert.Equal(t, sync.LegacyManifestDigest(sorted), sync.LegacyManifestDigest(reversed))
+	assert.Equal(t, sorted[2], reversed[0], "the caller's slice is left as it was")
+}
+
+// benchmarkLeaves is a zone of n live items, a third in each layer, in the
+// order ManifestHasher takes them
+func benchmarkLeaves(n int) []sync.ManifestLeaf {
+	leaves := make([]sync.ManifestLeaf, 0, n)
+	for i, layer := range sync.ManifestLeafLayers {
+		ids := make([]string, n/len(sync.ManifestLeafLayers))
+		if i == 0 {
+			ids = make([]string, n-2*len(ids))
+		}
+		for j := range ids {
+			ids[j] = uuid.New().String()
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			leaves = append(leaves, sync.ManifestLeaf{Layer: layer, ItemUUID: id, GenCount: 7})
+		}
+	}
+	return leaves
+}
+
+var benchmarkZoneSizes = []int{1_000, 10_000, 100_000}
+
+func BenchmarkManifestDigest(b *testing.B) {
+	for _, n := range benchmarkZoneSizes {
+		leaves := benchmarkLeaves(n)
+		shuffled := append([]sync.ManifestLeaf(nil), leaves...)
+		rand.New(rand.NewSource(1)).Shuffle(n, func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+
+		b.Run(fmt.Sprintf("sorted/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sync.ManifestDigest(leaves)
+			}
+		})
+		b.Run(fmt.Sprintf("shuffled/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sync.ManifestDigest(shuffled)
+			}
+		})
+		b.Run(fmt.Sprintf("hasher/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				hasher := sync.NewManifestHasher()
+				for _, leaf := range leaves {
+					hasher.Add(leaf)
+				}
+				hasher.Sum()
+			}
+		})
+	}
+}
+
+func BenchmarkLegacyManifestDigest(b *testing.B) {
+	for _, n := range benchmarkZoneSizes {
+		ids := make([]string, n)
+		for i := range ids {
+			ids[i] = uuid.New().String()
+		}
+		b.Run(fmt.Sprintf("shuffled/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sync.LegacyManifestDigest(ids)
+			}
+		})
+		sort.Strings(ids)
+		b.Run(fmt.Sprintf("sorted/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				sync.LegacyManifestDigest(ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	apperrors "github.com/deeplyprofound/password-sync/pkg/errors"
+	"github.com/deeplyprofound/password-sync/server/api"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowStore answers after delay, or gives up with the context like a
+// database/sql query does
+type slowStore struct {
+	delay time.Duration
+}
+
+func (s *slowStore) GetSyncStateContext(ctx context.Context, userID, zone string) (*storage.SyncState, error) {
+	select {
+	case <-time.After(s.delay):
+		return &storage.SyncState{UserID: userID, Zone: zone, GenCount: 42}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// manifestHandler is shaped like the sync handlers: the store error becomes
+// a 500 with the error text
+func manifestHandler(store *slowStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		state, err := store.GetSyncStateContext(c.Request.Context(), "alice", "default")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get sync state: " + err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"gencount": state.GenCount})
+	}
+}
+
+func timeoutRouter(timeout time.Duration, handler gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.ErrorEnvelope())
+	router.GET("/", middleware.Timeout(timeout), handler)
+	return router
+}
+
+func serveTimeout(router *gin.Engine) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	return w
+}
+
+func TestTimeoutSlowStoreIs504(t *testing.T) {
+	started := time.Now()
+	w := serveTimeout(timeoutRouter(50*time.Millisecond, manifestHandler(&slowStore{delay: 5 * time.Second})))
+	assert.Less(t, time.Since(started), time.Second, "the store call gave up at the deadline")
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/json")
+	var body apperrors.APIError
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "timeout", body.Code)
+	assert.Equal(t, "request timed out", body.Message, "the interrupted handler's error is not leaked")
+	assert.True(t, body.Retryable)
+}
+
+func TestTimeoutDiscardsPartialResponse(t *testing.T) {
+	w := serveTimeout(timeoutRouter(30*time.Millisecond, func(c *gin.Context) {
+		c.Header("Content-Type", "application/json")
+		c.Status(http.StatusOK)
+		c.Writer.WriteString(`{"keys": [`)
+		<-c.Request.Context().Done()
+		c.Writer.WriteString(`]}`)
+		c.Status(http.StatusInternalServerError)
+	}))
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.True(t, json.Valid(w.Body.Bytes()), "body %q", w.Body.String())
+	assert.NotContains(t, w.Body.String(), "keys")
+}
+
+// Headers the interrupted handler set are dropped with its body; those set
+// before it, and a handler's that finished in time, go out
+func TestTimeoutDiscardsHandlerHeaders(t *testing.T) {
+	handler := func(c *gin.Context) {
+		c.Header("Cache-Control", "max-age=3600")
+		c.Header("X-Next-Cursor", "abc")
+		c.SetCookie("session", "partial", 60, "/", "", true, true)
+		c.Writer.Header().Add("X-Server", "handler")
+		<-c.Request.Context().Done()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed"})
+	}
+	router := func(timeout time.Duration, handler gin.HandlerFunc) *gin.Engine {
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.Use(func(c *gin.Context) { c.Header("X-Server", "before") })
+		router.GET("/", middleware.Timeout(timeout), handler)
+		return router
+	}
+
+	w := serveTimeout(router(30*time.Millisecond, handler))
+	require.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Equal(t, []string{"before"}, w.Header().Values("X-Server"))
+	for _, key := range []string{"Cache-Control", "X-Next-Cursor", "Set-Cookie"} {
+		assert.Empty(t, w.Header().Get(key), key)
+	}
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+
+	w = serveTimeout(router(time.Second, func(c *gin.Context) {
+		c.Header("Cache-Control", "max-age=3600")
+		c.Writer.Header().Add("X-Server", "handler")
+		c.Header("Content-Type", "text/plain")
+		c.String(http.StatusOK, "done")
+	}))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "max-age=3600", w.Header().Get("Cache-Control"))
+	assert.Equal(t, []string{"before", "handler"}, w.Header().Values("X-Server"))
+	assert.Equal(t, "text/plain", w.Header().Get("Content-Type"))
+	assert.Equal(t, "done", w.Body.String())
+}
+
+func TestTimeoutLeavesFastAndSuccessfulResponses(t *testing.T) {
+	w := serveTimeout(timeoutRouter(time.Second, manifestHandler(&slowStore{})))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"gencount":42}`, w.Body.String())
+
+	// A handler that finished its work just as the deadline passed keeps its
+	// answer: the write may have committed
+	w = serveTimeout(timeoutRouter(20*time.Millisecond, func(c *gin.Context) {
+		time.Sleep(40 * time.Millisecond)
+		c.JSON(http.StatusOK, gin.H{"gencount": 7})
+	}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"gencount":7}`, w.Body.String())
+
+	// Client errors are not timeouts
+	w = serveTimeout(timeoutRouter(time.Second, func(c *gin.Context) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad zone"})
+	}))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestTimeoutDisabled(t *testing.T) {
+	w := serveTimeout(timeoutRouter(0, func(c *gin.Context) {
+		_, ok := c.Request.Context().Deadline()
+		assert.False(t, ok)
+		c.Status(http.StatusNoContent)
+	}))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestTimeoutStreamsAfterFlush(t *testing.T) {
+	w := serveTimeout(timeoutRouter(30*time.Millisecond, func(c *gin.Context) {
+		c.Status(http.StatusOK)
+		c.Writer.WriteString("line 1\n")
+		c.Writer.Flush()
+		<-c.Request.Context().Done()
+	}))
+	assert.Equal(t, http.StatusOK, w.Code, "a flushed stream can't be replaced")
+	assert.Equal(t, "line 1\n", w.Body.String())
+}
+
+// A client that hangs up cancels its request's context: pulls and pushes
+// give up on the store and answer 499, and the push left nothing behind
+func TestClientAbortCancelsPullAndPush(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := api.NewServerWithAuth(newSQLiteStore(t)).Handler()
+
+	serve := func(ctx context.Context, path, token string, body interface{}) *httptest.ResponseRecorder {
+		encoded, err := json.Marshal(body)
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(encoded)).WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(context.Background(), "/api/v1/auth/register", "", map[string]string{
+		"email": "alice@example.com", "password": "correct horse battery",
+	})
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var registered struct {
+		AccessToken string `json:"access_token"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &registered))
+	token := registered.AccessToken
+
+	aborted, cancel := context.WithCancel(context.Background())
+	cancel()
+	keyID := uuid.New().String()
+	w = serve(aborted, "/api/v1/sync/push", token, map[string]interface{}{
+		"zone": "default",
+		"keys": []map[string]interface{}{{
+			"item_uuid": keyID, "key_class": 1, "key_type": 2, "label": "password key",
+			"data": "a2V5", "usage_flags": "e30=",
+		}},
+	})
+	assert.Equal(t, 499, w.Code, w.Body.String())
+	w = serve(aborted, "/api/v1/sync/pull", token, map[string]interface{}{"zone": "default"})
+	assert.Equal(t, 499, w.Code, w.Body.String())
+
+	w = serve(context.Background(), "/api/v1/sync/pull", token, map[string]interface{}{"zone": "default"})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var pulled struct {
+		Keys []interface{} `json:"keys"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &pulled))
+	assert.Empty(t, pulled.Keys, "the aborted push rolled back")
+}
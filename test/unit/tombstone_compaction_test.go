@@ -0,0 +1,154 @@
+package unit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/deeplyprofound/password-sync/server/jobs"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// compactionStores are the stores the compaction tests run against
+func compactionStores(t *testing.T) map[string]storage.Store {
+	return map[string]storage.Store{
+		"sqlite": newSQLiteStore(t),
+		"memory": storage.NewMemoryStore(),
+	}
+}
+
+// liveDigest is sync.ManifestDigest over the zone's live items as a pull
+// returns them
+func liveDigest(t *testing.T, store storage.Store, userID, zone string) ([]byte, int) {
+	t.Helper()
+	ctx := context.Background()
+	r := storage.PullRange{Zone: zone}
+	var leaves []sync.ManifestLeaf
+	leaf := func(layer string, itemUUID uuid.UUID, genCount int64) {
+		leaves = append(leaves, sync.ManifestLeaf{Layer: layer, ItemUUID: itemUUID.String(), GenCount: genCount})
+	}
+
+	keys, err := store.GetCryptoKeysPage(ctx, userID, r)
+	require.NoError(t, err)
+	for _, key := range keys {
+		leaf(sync.LeafCryptoKey, key.ItemUUID, key.GenCount)
+	}
+	creds, err := store.GetCredentialMetadataPage(ctx, userID, r)
+	require.NoError(t, err)
+	for _, cred := range creds {
+		leaf(sync.LeafCredentialMetadata, cred.ItemUUID, cred.GenCount)
+	}
+	records, err := store.GetSyncRecordsPage(ctx, userID, r)
+	require.NoError(t, err)
+	for _, record := range records {
+		leaf(sync.LeafSyncRecord, record.ItemUUID, record.GenCount)
+	}
+	return sync.ManifestDigest(leaves), len(leaves)
+}
+
+// countTombstones counts the tombstoned items of a zone, in every layer
+func countTombstones(t *testing.T, store storage.Store, userID, zone string) int {
+	t.Helper()
+	ctx := context.Background()
+	counts, err := store.CountPullWindow(ctx, userID, storage.PullRange{Zone: zone, IncludeTombstoned: true})
+	require.NoError(t, err)
+	live, err := store.CountPullWindow(ctx, userID, storage.PullRange{Zone: zone})
+	require.NoError(t, err)
+	return counts.Keys + counts.Metadata + counts.Records - live.Keys - live.Metadata - live.Records
+}
+
+// pushAndDelete pushes two credentials to zone and deletes the first
+func pushAndDelete(t *testing.T, store storage.Store, userID, zone string) {
+	t.Helper()
+	ctx := context.Background()
+	deleted, credID := sqliteBatch(zone)
+	_, err := store.CommitPush(ctx, userID, deleted)
+	require.NoError(t, err)
+	kept, _ := sqliteBatch(zone)
+	_, err = store.CommitPush(ctx, userID, kept)
+	require.NoError(t, err)
+	_, err = store.DeleteCredential(ctx, userID, &storage.CredentialDeleteRequest{Zone: zone, ItemUUID: credID})
+	require.NoError(t, err)
+}
+
+// After a purge the stored digest is the digest of what is left, so a client
+// comparing manifests sees no divergence
+func TestPurgeTombstonesLeavesLiveDigest(t *testing.T) {
+	for name, store := range compactionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			user, err := store.CreateUser("alice@example.com", []byte("hash"), []byte("salt"), "")
+			require.NoError(t, err)
+			pushAndDelete(t, store, user.ID, "default")
+			require.Equal(t, 3, countTombstones(t, store, user.ID, "default"))
+
+			purged, err := store.PurgeTombstones(user.ID, "default", time.Now().Add(time.Minute))
+			require.NoError(t, err)
+			assert.Equal(t, int64(3), purged)
+			assert.Zero(t, countTombstones(t, store, user.ID, "default"))
+
+			want, leaves := liveDigest(t, store, user.ID, "default")
+			require.Equal(t, 3, leaves, "the kept credential's key, metadata and record")
+			state, err := store.GetSyncState(user.ID, "default")
+			require.NoError(t, err)
+			assert.Equal(t, want, state.Digest)
+
+			manifest, err := store.ComputeManifest(context.Background(), user.ID, "default")
+			require.NoError(t, err)
+			assert.Equal(t, want, manifest.Digest)
+			assert.Equal(t, leaves, manifest.LeafCount)
+		})
+	}
+}
+
+// The scheduled compaction purges old tombstones, but not a held account's
+// nor the items of a bulk wipe still in its recovery window
+func TestTombstoneCompactionSchedule(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("TOMBSTONE_RETENTION", "1ms")
+
+	for name, store := range compactionStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			alice, err := store.CreateUser("alice@example.com", []byte("hash"), []byte("salt"), "")
+			require.NoError(t, err)
+			held, err := store.CreateUser("held@example.com", []byte("hash"), []byte("salt"), "")
+			require.NoError(t, err)
+			require.NoError(t, store.SetLegalHold(held.ID, true))
+
+			pushAndDelete(t, store, alice.ID, "default")
+			pushAndDelete(t, store, held.ID, "default")
+			wiped, _ := sqliteBatch("trash")
+			_, err = store.CommitPush(ctx, alice.ID, wiped)
+			require.NoError(t, err)
+			_, err = store.WipeZone(ctx, alice.ID, &storage.WipeRequest{Zone: "trash", RecoverUntil: time.Now().Add(time.Hour)})
+			require.NoError(t, err)
+			require.Equal(t, 3, countTombstones(t, store, alice.ID, "trash"))
+
+			// Run as StartBackgroundJobs schedules it, only more often
+			server := api.NewServerWithAuth(store)
+			scheduleCtx, stop := context.WithCancel(ctx)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				server.Jobs.Every(scheduleCtx, jobs.TombstonePurgeJobName, 10*time.Millisecond, jobs.RunOptions{})
+			}()
+			assert.Eventually(t, func() bool {
+				return countTombstones(t, store, alice.ID, "default") == 0
+			}, 5*time.Second, 10*time.Millisecond)
+			stop()
+			<-done
+
+			assert.Equal(t, 3, countTombstones(t, store, held.ID, "default"), "held accounts are preserved")
+			assert.Equal(t, 3, countTombstones(t, store, alice.ID, "trash"), "a pending wipe can still be undone")
+			_, err = store.UndoWipe(ctx, alice.ID, &storage.WipeRequest{Zone: "trash"}, time.Now())
+			require.NoError(t, err)
+			assert.Zero(t, countTombstones(t, store, alice.ID, "trash"))
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/breach"
+	"github.com/deeplyprofound/password-sync/server/api/cve"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamClientsRequireKey(t *testing.T) {
+	_, err := breach.NewBreachClient(breach.ClientConfig{})
+	assert.ErrorContains(t, err, "HIBP_API_KEY")
+	_, err = cve.NewCVEClient(cve.ClientConfig{})
+	assert.ErrorContains(t, err, "NIST_API_KEY")
+}
+
+func TestBreachClientLookup(t *testing.T) {
+	var paths, keys []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		keys = append(keys, r.Header.Get("hibp-api-key"))
+		switch r.URL.Path {
+		case "/breachedaccount/found@example.com":
+			assert.Equal(t, "false", r.URL.Query().Get("truncateResponse"))
+			fmt.Fprint(w, `[{"Name":"Adobe","BreachDate":"2013-10-04","PwnCount":152445165,"DataClasses":["Email addresses","Passwords"],"IsVerified":true}]`)
+		case "/breachedaccount/limited@example.com":
+			w.Header().Set("Retry-After", "3")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/breachedaccount/a+b@example.com":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer upstream.Close()
+
+	client, err := breach.NewBreachClient(breach.ClientConfig{BaseURL: upstream.URL, APIKey: "test-key", HTTPClient: upstream.Client()})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	report, err := client.Lookup(ctx, " Found@Example.com ")
+	require.NoError(t, err)
+	assert.Equal(t, "found@example.com", report.Email)
+	assert.Equal(t, []string{"Adobe"}, report.Sources)
+	require.Len(t, report.LeakedData, 1)
+	assert.Equal(t, 152445165, report.LeakedData[0].PwnCount)
+	assert.Equal(t, []string{"Email addresses", "Passwords"}, report.LeakedData[0].DataTypes)
+
+	report, err = client.Lookup(ctx, "a+b@example.com")
+	require.NoError(t, err)
+	assert.Zero(t, report.TotalLeaks)
+	assert.NotNil(t, report.LeakedData)
+
+	_, err = client.Lookup(ctx, "limited@example.com")
+	var limited *breach.RateLimitedError
+	require.ErrorAs(t, err, &limited)
+	assert.Equal(t, 3*time.Second, limited.RetryAfter)
+
+	_, err = client.Lookup(ctx, "other@example.com")
+	assert.ErrorContains(t, err, "invalid HIBP API key")
+
+	assert.Equal(t, []string{"test-key", "test-key", "test-key", "test-key"}, keys)
+	assert.Equal(t, "/breachedaccount/a+b@example.com", paths[1])
+}
+
+// Without a client a lookup is refused as unavailable rather than sent
+// upstream with a shared key
+func TestLookupHIBPNotConfigured(t *testing.T) {
+	breach.SetBreachClient(nil)
+	_, err := breach.LookupHIBP(context.Background(), "alice@example.com")
+	assert.ErrorIs(t, err, breach.ErrNotConfigured)
+}
+
+func TestCVEClientSearch(t *testing.T) {
+	var queries []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+		if r.Header.Get("apiKey") != "nvd-key" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, "bad key")
+			return
+		}
+		fmt.Fprint(w, `{"resultsPerPage":1,"totalResults":1,"vulnerabilities":[{"cve":{"id":"CVE-2024-0001"}}]}`)
+	}))
+	defer upstream.Close()
+
+	client, err := cve.NewCVEClient(cve.ClientConfig{BaseURL: upstream.URL, APIKey: "nvd-key", HTTPClient: upstream.Client()})
+	require.NoError(t, err)
+	cve.SetClient(client)
+	defer cve.SetClient(nil)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/cve/search", cve.SearchCVEs)
+	router.GET("/cve/latest", cve.GetLatestCVEs)
+
+	req := httptest.NewRequest(http.MethodPost, "/cve/search", bytes.NewReader([]byte(`{"keyword":"open ssl","limit":5}`)))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var result map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, float64(1), result["totalResults"])
+	assert.Equal(t, []string{"keywordSearch=open+ssl&resultsPerPage=5&startIndex=0"}, queries)
+
+	// The NVD answers a bad key 403, as it does a rate limit: no retries here
+	noRetries := cve.NewLimiter(cve.LimiterConfig{MaxRetries: 0})
+	wrongKey, err := cve.NewCVEClient(cve.ClientConfig{BaseURL: upstream.URL, APIKey: "other", HTTPClient: upstream.Client(), Limiter: noRetries})
+	require.NoError(t, err)
+	var out map[string]interface{}
+	err = wrongKey.Get(context.Background(), nil, &out)
+	var status *cve.StatusError
+	require.ErrorAs(t, err, &status)
+	assert.Equal(t, http.StatusForbidden, status.StatusCode)
+	assert.Equal(t, "bad key", status.Body)
+
+	cve.SetClient(nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cve/latest", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
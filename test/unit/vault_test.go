@@ -0,0 +1,240 @@
+package unit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/domain/vault"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCred(server, account string) *models.CredentialMetadata {
+	return &models.CredentialMetadata{
+		ItemUUID: uuid.New(),
+		Server:   server,
+		Account:  account,
+	}
+}
+
+func TestVaultNormalization(t *testing.T) {
+	t.Run("normalize server", func(t *testing.T) {
+		cases := map[string]string{
+			"example.com":                       "example.com",
+			"Example.COM":                       "example.com",
+			"https://www.example.com/login?x=1": "example.com",
+			"http://example.com:80":             "example.com",
+			"example.com:443":                   "example.com",
+			"example.com:8443":                  "example.com:8443",
+			"user@mail.example.com":             "mail.example.com",
+			"login.example.com":                 "login.example.com",
+			"example.com.":                      "example.com",
+			"  example.com  ":                   "example.com",
+		}
+		for input, expected := range cases {
+			assert.Equal(t, expected, vault.NormalizeServer(input), input)
+		}
+	})
+
+	t.Run("normalize account", func(t *testing.T) {
+		assert.Equal(t, "alice@example.com", vault.NormalizeAccount(" Alice@Example.com "))
+	})
+}
+
+func TestVaultDuplicates(t *testing.T) {
+	t.Run("mixed-case accounts on one server are duplicates", func(t *testing.T) {
+		a := newCred("https://example.com", "Alice@Example.com")
+		b := newCred("example.com", "alice@example.com")
+
+		groups := vault.FindDuplicates([]*models.CredentialMetadata{a, b})
+		require.Len(t, groups, 1)
+		assert.Equal(t, "example.com", groups[0].Server)
+		assert.Equal(t, "alice@example.com", groups[0].Account)
+		assert.ElementsMatch(t, []string{a.ItemUUID.String(), b.ItemUUID.String()}, groups[0].ItemUUIDs)
+	})
+
+	t.Run("different accounts on one server are not collapsed", func(t *testing.T) {
+		creds := []*models.CredentialMetadata{
+			newCred("example.com", "alice"),
+			newCred("example.com", "bob"),
+		}
+		assert.Empty(t, vault.FindDuplicates(creds))
+	})
+
+	t.Run("servers differing only by subdomain are distinct", func(t *testing.T) {
+		creds := []*models.CredentialMetadata{
+			newCred("example.com", "alice"),
+			newCred("login.example.com", "alice"),
+		}
+		assert.Empty(t, vault.FindDuplicates(creds))
+
+		// www. is treated as the bare domain
+		creds = append(creds, newCred("www.example.com", "ALICE"))
+		groups := vault.FindDuplicates(creds)
+		require.Len(t, groups, 1)
+		assert.Equal(t, "example.com", groups[0].Server)
+	})
+
+	t.Run("tombstoned credentials are ignored", func(t *testing.T) {
+		a := newCred("example.com", "alice")
+		b := newCred("example.com", "alice")
+		b.Tombstone = true
+		assert.Empty(t, vault.FindDuplicates([]*models.CredentialMetadata{a, b}))
+	})
+}
+
+func TestVaultGroupByServer(t *testing.T) {
+	alice1 := newCred("example.com", "Alice")
+	alice2 := newCred("https://example.com/", "alice")
+	bob := newCred("example.com", "bob")
+	sub := newCred("login.example.com", "alice")
+
+	groups := vault.GroupByServer([]*models.CredentialMetadata{bob, sub, alice1, alice2})
+	require.Len(t, groups, 2)
+
+	assert.Equal(t, "example.com", groups[0].Server)
+	require.Len(t, groups[0].Accounts, 2)
+	assert.Equal(t, "Alice", groups[0].Accounts[0].Account)
+	assert.ElementsMatch(t, []string{alice1.ItemUUID.String(), alice2.ItemUUID.String()}, groups[0].Accounts[0].ItemUUIDs)
+	assert.Equal(t, "bob", groups[0].Accounts[1].Account)
+
+	assert.Equal(t, "login.example.com", groups[1].Server)
+	require.Len(t, groups[1].Accounts, 1)
+	assert.Equal(t, []string{sub.ItemUUID.String()}, groups[1].Accounts[0].ItemUUIDs)
+}
+
+func TestVaultBreachDomainMatching(t *testing.T) {
+	cases := []struct {
+		server, domain string
+		match          bool
+	}{
+		{"adobe.com", "adobe.com", true},
+		{"https://www.adobe.com/login", "adobe.com", true},
+		{"account.adobe.com", "adobe.com", true},
+		{"a.b.adobe.com", "adobe.com", true},
+		{"adobe.com:8443", "adobe.com", true},
+		{"http://admin.adobe.com:8080/x", "adobe.com", true},
+		{"Adobe.COM.", "adobe.com", true},
+		{"adobe.com", "www.adobe.com", true},
+		{"adobe.com", "Adobe.com:443", true},
+		{"notadobe.com", "adobe.com", false},
+		{"adobe.com.evil.net", "adobe.com", false},
+		{"adobe.co", "adobe.com", false},
+		{"adobe.com", "account.adobe.com", false},
+		{"adobe.com", "", false},
+		{"", "adobe.com", false},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.match, vault.MatchesDomain(tc.server, tc.domain), "%q on %q", tc.server, tc.domain)
+	}
+}
+
+func TestVaultHealthReport(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	fresh := newCred("https://login.adobe.com:8443", "alice")
+	fresh.Zone, fresh.UpdatedAt = "default", now.Add(-time.Hour)
+	old := newCred("example.com", "alice")
+	old.Zone, old.UpdatedAt = "work", now.Add(-400*24*time.Hour)
+	dupe := newCred("https://example.com", "Alice")
+	dupe.Zone, dupe.UpdatedAt = "default", now.Add(-24*time.Hour)
+	gone := newCred("adobe.com", "bob")
+	gone.Tombstone = true
+
+	breaches := []vault.Breach{
+		{Name: "Adobe", Domain: "adobe.com", Date: "2013-10-04"},
+		{Name: "AdobeAgain", Domain: "adobe.com"},
+		{Name: "Collection1"}, // A combo list names no site
+	}
+	report := vault.BuildHealthReport([]*models.CredentialMetadata{fresh, old, dupe, gone}, breaches, now.Add(-365*24*time.Hour), nil)
+
+	assert.Equal(t, 3, report.Credentials, "tombstones don't count")
+	require.Len(t, report.Breached, 1)
+	assert.Equal(t, fresh.ItemUUID.String(), report.Breached[0].ItemUUID)
+	assert.Equal(t, []string{"Adobe", "AdobeAgain"}, report.Breached[0].Breaches)
+	require.Len(t, report.Stale, 1)
+	assert.Equal(t, old.ItemUUID.String(), report.Stale[0].ItemUUID)
+	assert.Equal(t, "work", report.Stale[0].Zone)
+	require.Len(t, report.Duplicates, 1, "duplicates span zones")
+	assert.ElementsMatch(t, []string{old.ItemUUID.String(), dupe.ItemUUID.String()}, report.Duplicates[0].ItemUUIDs)
+}
+
+// A mixed vault is checked by protocol: web logins against breached
+// domains, server logins against their host's CVEs, the rest skipped with
+// the reason
+func TestVaultHealthReportMatchesByProtocol(t *testing.T) {
+	cred := func(server string, protocol models.Protocol) *models.CredentialMetadata {
+		c := newCred(server, "alice")
+		c.Protocol = protocol
+		return c
+	}
+	web := cred("https://adobe.com", models.ProtocolHTTPS)
+	plain := cred("http://www.adobe.com", models.ProtocolHTTP)
+	ssh := cred("git.adobe.com", models.ProtocolSSH)
+	sftp := cred("files.adobe.com:2222", models.ProtocolFTP)
+	sameHost := cred("git.adobe.com", models.ProtocolLDAP)
+	byIP := cred("10.0.0.5", models.ProtocolSSH)
+	mail := cred("mail.adobe.com", models.ProtocolIMAP)
+	unknown := cred("adobe.com", models.Protocol(99))
+	creds := []*models.CredentialMetadata{web, plain, ssh, sftp, sameHost, byIP, mail, unknown}
+	breaches := []vault.Breach{{Name: "Adobe", Domain: "adobe.com"}}
+	staleBefore := time.Now().Add(-time.Hour)
+
+	var looked []string
+	lookup := func(host string) (*vault.CVESummary, string) {
+		looked = append(looked, host)
+		if host == "10.0.0.5" {
+			return nil, vault.SkipNoProduct
+		}
+		return &vault.CVESummary{Product: "adobe", TotalCVEs: 3, HighestLevel: "HIGH", Match: "cpe"}, ""
+	}
+	report := vault.BuildHealthReport(creds, breaches, staleBefore, lookup)
+
+	assert.Equal(t, 8, report.Credentials)
+	assert.Equal(t, map[string]int{vault.MatchHIBPDomain: 2, vault.MatchCVE: 3, vault.MatchNone: 3}, report.MatchMethods)
+	assert.ElementsMatch(t, []string{"git.adobe.com", "files.adobe.com", "10.0.0.5"}, looked, "one lookup per host")
+
+	var breached []string
+	for _, item := range report.Breached {
+		assert.Equal(t, vault.MatchHIBPDomain, item.MatchMethod)
+		breached = append(breached, item.ItemUUID)
+	}
+	assert.ElementsMatch(t, []string{web.ItemUUID.String(), plain.ItemUUID.String()}, breached,
+		"only web logins are matched against breached domains")
+
+	servers := map[string]vault.ServerCredential{}
+	for _, item := range report.Servers {
+		assert.Equal(t, vault.MatchCVE, item.MatchMethod)
+		require.NotNil(t, item.CVEs)
+		servers[item.ItemUUID] = item
+	}
+	require.Len(t, servers, 3)
+	assert.Equal(t, "ssh", servers[ssh.ItemUUID.String()].Protocol)
+	assert.Equal(t, "ftp", servers[sftp.ItemUUID.String()].Protocol)
+	assert.Equal(t, "ldap", servers[sameHost.ItemUUID.String()].Protocol)
+
+	skipped := map[string]string{}
+	for _, item := range report.Skipped {
+		assert.Equal(t, vault.MatchNone, item.MatchMethod)
+		skipped[item.ItemUUID] = item.Reason
+	}
+	assert.Equal(t, map[string]string{
+		byIP.ItemUUID.String():    vault.SkipNoProduct,
+		mail.ItemUUID.String():    vault.SkipMailProtocol,
+		unknown.ItemUUID.String(): vault.SkipUnknownProtocol,
+	}, skipped)
+
+	t.Run("without CVE summaries", func(t *testing.T) {
+		report := vault.BuildHealthReport(creds, breaches, staleBefore, nil)
+		assert.Empty(t, report.Servers)
+		assert.Equal(t, 6, report.MatchMethods[vault.MatchNone])
+		reasons := map[string]string{}
+		for _, item := range report.Skipped {
+			reasons[item.ItemUUID] = item.Reason
+		}
+		assert.Equal(t, vault.SkipCVEsOff, reasons[ssh.ItemUUID.String()])
+		assert.Equal(t, vault.SkipCVEsOff, reasons[byIP.ItemUUID.String()])
+		assert.Len(t, report.Breached, 2)
+	})
+}
@@ -0,0 +1,78 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/server/api/handlers"
+	"github.com/deeplyprofound/password-sync/server/api/mapping"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/api/websocket"
+	"github.com/deeplyprofound/password-sync/server/features"
+	"github.com/deeplyprofound/password-sync/server/version"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setBuild overrides the link-time variables for one test
+func setBuild(t *testing.T, v, commit, date string) {
+	oldVersion, oldCommit, oldDate := version.Version, version.Commit, version.BuildDate
+	version.Version, version.Commit, version.BuildDate = v, commit, date
+	t.Cleanup(func() {
+		version.Version, version.Commit, version.BuildDate = oldVersion, oldCommit, oldDate
+	})
+}
+
+func getVersion(t *testing.T) (*httptest.ResponseRecorder, map[string]interface{}) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(middleware.ServerHeader(version.ServerHeader()))
+	router.GET("/api/v1/version", handlers.Version(features.Resolve(false)))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/version", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	return recorder, body
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	setBuild(t, "1.4.0", "abc1234", "2026-03-01T12:00:00Z")
+
+	recorder, body := getVersion(t)
+	assert.Equal(t, "password-sync/1.4.0", recorder.Header().Get("Server"))
+	assert.Equal(t, "1.4.0", body["version"])
+	assert.Equal(t, "abc1234", body["commit"])
+	assert.Equal(t, "2026-03-01T12:00:00Z", body["build_date"])
+
+	assert.Equal(t, map[string]interface{}{
+		"sync_schema":     float64(mapping.SyncSchemaVersion),
+		"max_enc_version": float64(mapping.MaxEncVersion),
+		"event_schema":    float64(websocket.EventSchemaVersion),
+	}, body["protocols"])
+
+	feats, ok := body["features"].(map[string]interface{})
+	require.True(t, ok)
+	for _, name := range []string{"breach", "cve", "websocket_backplane", "redis"} {
+		assert.Contains(t, feats, name)
+	}
+	assert.Equal(t, false, feats["redis"])
+}
+
+func TestVersionWithoutLdflagsIsDev(t *testing.T) {
+	setBuild(t, "", "", "")
+
+	assert.Equal(t, version.Info{Version: "dev", Commit: "dev", BuildDate: "dev"}, version.Get())
+	assert.Equal(t, "password-sync/dev", version.ServerHeader())
+
+	recorder, body := getVersion(t)
+	assert.Equal(t, "password-sync/dev", recorder.Header().Get("Server"))
+	for _, field := range []string{"version", "commit", "build_date"} {
+		assert.Equal(t, "dev", body[field], field)
+	}
+}
@@ -0,0 +1,295 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/handlers"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	authservice "github.com/deeplyprofound/password-sync/server/service/auth"
+	"github.com/deeplyprofound/password-sync/server/service/device"
+	syncservice "github.com/deeplyprofound/password-sync/server/service/sync"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The wire format tests pin the JSON the clients depend on. A change to a
+// response shape fails them until the golden files under testdata/wire are
+// regenerated with `make golden`, so the drift shows up in review.
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files under testdata/wire")
+
+const (
+	wireUser   = "5d2c9a4e-1f3b-4c6d-8e7f-0a1b2c3d4e5f"
+	wireKey    = "3a4b5c6d-7e8f-4a0b-9c1d-2e3f4a5b6c7d"
+	wireItem   = "6f1c2a3e-5b7d-4e9f-8a1b-2c3d4e5f6a7b"
+	wireSecond = "0d9e8f7a-6b5c-4d3e-9f2a-1b0c9d8e7f6a"
+)
+
+// wireAPI serves the sync, auth and device routes from an in-memory store
+// with a fixed clock and fixed IDs
+type wireAPI struct {
+	store  *memStore
+	hub    *recordingHub
+	router *gin.Engine
+	device string // The calling device's ID
+}
+
+func newWireAPI(t *testing.T) *wireAPI {
+	gin.SetMode(gin.TestMode)
+	clock := &fakeClock{now: time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)}
+	store := newMemStore(clock)
+	var ids int
+	store.newID = func() string {
+		ids++
+		return fmt.Sprintf("00000000-0000-4000-8000-%012d", ids)
+	}
+
+	hub := &recordingHub{}
+	syncSvc := syncservice.NewService(store, sync.NewRegistry(store, 10))
+	syncSvc.SetHub(hub)
+	syncSvc.SetClock(clock)
+	accounts := authservice.NewService(store)
+	accounts.SetClock(clock)
+	devices := device.NewService(store)
+	devices.SetClock(clock)
+	syncHandler := handlers.NewSyncHandlerWithService(syncSvc)
+	syncHandler.SetClock(clock)
+	authHandler := handlers.NewAuthServiceWithService(accounts)
+	deviceHandler := handlers.NewDeviceHandlerWithService(devices)
+
+	laptop, err := store.CreateDevice(wireUser, "laptop", "desktop", nil, 2, nil)
+	require.NoError(t, err)
+	_, err = store.CreateDevice(wireUser, "phone", "mobile", nil, 0, nil)
+	require.NoError(t, err)
+
+	router := gin.New()
+	router.Use(middleware.ErrorEnvelope())
+	api := router.Group("/api/v1")
+	api.POST("/auth/register", authHandler.Register)
+	api.POST("/auth/login", authHandler.Login)
+	api.POST("/auth/refresh", authHandler.RefreshToken)
+	api.POST("/auth/logout", authHandler.Logout)
+
+	// Stands in for the JWT middleware: every request is the laptop's
+	protected := api.Group("/", func(c *gin.Context) {
+		middleware.SetClaims(c, &auth.Claims{UserID: wireUser, DeviceID: laptop.ID})
+		c.Next()
+	})
+	protected.GET("/sync/manifest", syncHandler.GetManifest)
+	protected.POST("/sync/pull", syncHandler.PullSync)
+	protected.POST("/sync/push", syncHandler.PushSync)
+	protected.GET("/sync/zones", syncHandler.ListZones)
+	protected.DELETE("/sync/zones/:zone", syncHandler.DeleteZone)
+	protected.GET("/devices", deviceHandler.ListDevices)
+	protected.POST("/auth/change-password", authHandler.ChangePassword)
+
+	return &wireAPI{store: store, hub: hub, router: router, device: laptop.ID}
+}
+
+func (a *wireAPI) do(t *testing.T, method, path, body string, status int) []byte {
+	t.Helper()
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	a.router.ServeHTTP(w, req)
+	require.Equal(t, status, w.Code, w.Body.String())
+	return w.Body.Bytes()
+}
+
+// push sends the desktop client's recorded push
+func (a *wireAPI) push(t *testing.T) []byte {
+	body, err := os.ReadFile("testdata/wire/requests/desktop_push.json")
+	require.NoError(t, err)
+	return a.do(t, http.MethodPost, "/api/v1/sync/push", string(body), http.StatusOK)
+}
+
+// assertGolden compares a JSON body with testdata/wire/<name>.json, or
+// rewrites the file under -update. Access tokens carry the real time, so
+// they are replaced by a placeholder first.
+func assertGolden(t *testing.T, name string, body []byte) {
+	t.Helper()
+	var decoded interface{}
+	require.NoError(t, json.Unmarshal(body, &decoded), string(body))
+	if fields, ok := decoded.(map[string]interface{}); ok {
+		if token, ok := fields["access_token"].(string); ok {
+			require.NotEmpty(t, token)
+			fields["access_token"] = "<access_token>"
+		}
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	require.NoError(t, encoder.Encode(decoded))
+	got := buf.Bytes()
+
+	path := filepath.Join("testdata", "wire", name+".json")
+	if *updateGolden {
+		require.NoError(t, os.WriteFile(path, got, 0o644))
+		return
+	}
+	want, err := os.ReadFile(path)
+	require.NoError(t, err, "run `make golden` to create %s", path)
+	assert.Equal(t, string(want), string(got), "%s changed; if that is intended, run `make golden` and review the diff", path)
+}
+
+func TestWireFormatManifest(t *testing.T) {
+	api := newWireAPI(t)
+	assertGolden(t, "manifest_empty", api.do(t, http.MethodGet, "/api/v1/sync/manifest", "", http.StatusOK))
+
+	api.push(t)
+	assertGolden(t, "manifest", api.do(t, http.MethodGet, "/api/v1/sync/manifest", "", http.StatusOK))
+}
+
+func TestWireFormatPush(t *testing.T) {
+	api := newWireAPI(t)
+	assertGolden(t, "push", api.push(t))
+
+	// The frames a connected client receives
+	frames, err := json.Marshal(api.hub.events)
+	require.NoError(t, err)
+	assertGolden(t, "sync_events", frames)
+}
+
+func TestWireFormatZones(t *testing.T) {
+	api := newWireAPI(t)
+	api.push(t)
+	assertGolden(t, "zones", api.do(t, http.MethodGet, "/api/v1/sync/zones", "", http.StatusOK))
+
+	assertGolden(t, "zone_delete", api.do(t, http.MethodDelete, "/api/v1/sync/zones/default", "", http.StatusOK))
+	api.do(t, http.MethodDelete, "/api/v1/sync/zones/"+strings.Repeat("z", 101), "", http.StatusBadRequest)
+}
+
+func TestWireFormatPull(t *testing.T) {
+	api := newWireAPI(t)
+	api.push(t)
+
+	assertGolden(t, "pull", api.do(t, http.MethodPost, "/api/v1/sync/pull",
+		`{"zone":"default","last_gencount":0}`, http.StatusOK))
+
+	// A skipped layer is absent; an included one with nothing new is null
+	assertGolden(t, "pull_layers", api.do(t, http.MethodPost, "/api/v1/sync/pull",
+		`{"zone":"default","last_gencount":3,"include_keys":false}`, http.StatusOK))
+}
+
+func TestWireFormatAuth(t *testing.T) {
+	api := newWireAPI(t)
+	credentials := `{"email":"alice@example.com","password":"correct horse battery"}`
+
+	assertGolden(t, "register", api.do(t, http.MethodPost, "/api/v1/auth/register", credentials, http.StatusCreated))
+	login := api.do(t, http.MethodPost, "/api/v1/auth/login", credentials, http.StatusOK)
+	assertGolden(t, "login", login)
+
+	var tokens handlers.LoginResponse
+	require.NoError(t, json.Unmarshal(login, &tokens))
+	assertGolden(t, "refresh", api.do(t, http.MethodPost, "/api/v1/auth/refresh",
+		`{"refresh_token":"`+tokens.RefreshToken+`"}`, http.StatusOK))
+
+	// A logged out token can no longer refresh
+	var session handlers.LoginResponse
+	require.NoError(t, json.Unmarshal(api.do(t, http.MethodPost, "/api/v1/auth/login", credentials, http.StatusOK), &session))
+	body := `{"refresh_token":"` + session.RefreshToken + `"}`
+	assert.Empty(t, api.do(t, http.MethodPost, "/api/v1/auth/logout", body, http.StatusNoContent))
+	api.do(t, http.MethodPost, "/api/v1/auth/refresh", body, http.StatusUnauthorized)
+
+	// A new password follows the registration rules
+	api.do(t, http.MethodPost, "/api/v1/auth/change-password",
+		`{"current_password":"correct horse battery","new_password":"short"}`, http.StatusBadRequest)
+
+	// Errors carry the envelope's code and retry fields
+	assertGolden(t, "login_failed", api.do(t, http.MethodPost, "/api/v1/auth/login",
+		`{"email":"alice@example.com","password":"wrong horse"}`, http.StatusUnauthorized))
+}
+
+func TestWireFormatDevices(t *testing.T) {
+	api := newWireAPI(t)
+	api.push(t)
+	assertGolden(t, "devices", api.do(t, http.MethodGet, "/api/v1/devices", "", http.StatusOK))
+}
+
+// bindFixture binds a recorded client request the way the handler does
+func bindFixture(t *testing.T, name string, obj interface{}) {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", "wire", "requests", name+".json"))
+	require.NoError(t, err)
+	require.NoError(t, binding.JSON.BindBody(body, obj))
+}
+
+func TestWireFormatClientRequests(t *testing.T) {
+	t.Run("mobile register and login", func(t *testing.T) {
+		var register handlers.RegisterRequest
+		bindFixture(t, "mobile_register", &register)
+		assert.Equal(t, "alice@example.com", register.Email)
+		assert.Nil(t, register.Bootstrap)
+		assert.Empty(t, register.Region)
+
+		var login handlers.LoginRequest
+		bindFixture(t, "mobile_login", &login)
+		assert.Equal(t, "correct horse battery", login.Password)
+		assert.Empty(t, login.DeviceID)
+		assert.Zero(t, login.MaxEncVersion)
+	})
+
+	t.Run("mobile pull includes every layer", func(t *testing.T) {
+		var pull handlers.PullSyncRequest
+		bindFixture(t, "mobile_pull", &pull)
+		assert.Equal(t, "default", pull.Zone)
+		assert.Nil(t, pull.IncludeKeys)
+		assert.Nil(t, pull.IncludeMetadata)
+		assert.Nil(t, pull.IncludeRecords)
+		assert.Zero(t, pull.Limit)
+	})
+
+	t.Run("mobile probe", func(t *testing.T) {
+		var probe handlers.ProbeSyncRequest
+		bindFixture(t, "mobile_probe", &probe)
+		assert.Equal(t, []string{wireItem, wireSecond}, probe.ItemUUIDs)
+	})
+
+	t.Run("mobile create zone", func(t *testing.T) {
+		var create handlers.CreateZoneRequest
+		bindFixture(t, "mobile_create_zone", &create)
+		assert.Equal(t, "standard", create.Template)
+		require.NotNil(t, create.MetadataKey)
+		assert.Equal(t, wireKey, create.MetadataKey.ItemUUID)
+		assert.Equal(t, []byte("key"), create.MetadataKey.Data)
+	})
+
+	t.Run("mobile legacy push carries no items", func(t *testing.T) {
+		// The vault service's old single-layer body has none of the
+		// triple-layer fields; it binds as an empty push of its zone
+		var push handlers.PushSyncRequest
+		bindFixture(t, "mobile_legacy_push", &push)
+		assert.Equal(t, "default", push.Zone)
+		assert.Empty(t, push.Keys)
+		assert.Empty(t, push.CredentialMetadata)
+		assert.Empty(t, push.SyncRecords)
+	})
+
+	t.Run("desktop triple-layer push", func(t *testing.T) {
+		var push handlers.PushSyncRequest
+		bindFixture(t, "desktop_push", &push)
+		assert.Equal(t, int64(1), push.Sequence)
+		require.Len(t, push.Keys, 1)
+		require.Len(t, push.CredentialMetadata, 1)
+		require.Len(t, push.SyncRecords, 1)
+		assert.Nil(t, push.CredentialMetadata[0].MetadataKeyUUID, "null stays unset")
+		require.NotNil(t, push.SyncRecords[0].ParentKeyUUID)
+		assert.Equal(t, wireKey, *push.SyncRecords[0].ParentKeyUUID)
+		assert.Equal(t, []byte("sealed"), push.SyncRecords[0].EncItem)
+	})
+}
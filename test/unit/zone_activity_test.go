@@ -0,0 +1,177 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/deeplyprofound/password-sync/server/api/handlers"
+	"github.com/deeplyprofound/password-sync/server/api/middleware"
+	"github.com/deeplyprofound/password-sync/server/domain/auth"
+	"github.com/deeplyprofound/password-sync/server/service"
+	"github.com/deeplyprofound/password-sync/server/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	activityAlice = "11111111-1111-4111-8111-111111111111"
+	activityBob   = "22222222-2222-4222-8222-222222222222"
+	activityAdmin = "33333333-3333-4333-8333-333333333333"
+)
+
+// auditLog is an in-memory audit_events table
+type auditLog struct {
+	events []*storage.AuditEvent
+}
+
+func (l *auditLog) record(userID string, actorID *string, device, action, zone, item string) {
+	event := &storage.AuditEvent{
+		ID:        int64(len(l.events) + 1),
+		UserID:    userID,
+		ActorID:   actorID,
+		Action:    action,
+		Zone:      &zone,
+		IPAddress: "203.0.113.7",
+		Details:   []byte(`{"layer":"sync_record"}`),
+		CreatedAt: time.Date(2026, 10, 1, 12, 0, len(l.events), 0, time.UTC),
+	}
+	if device != "" {
+		event.DeviceID = &device
+	}
+	if item != "" {
+		event.ItemUUID = &item
+	}
+	l.events = append(l.events, event)
+}
+
+// page answers a feed query the way ListZoneActivity does: newest first,
+// filtered, then capped
+func (l *auditLog) page(filter storage.ZoneActivityFilter) []*storage.AuditEvent {
+	var out []*storage.AuditEvent
+	for i := len(l.events) - 1; i >= 0 && len(out) < filter.Limit; i-- {
+		if filter.Includes(l.events[i]) {
+			out = append(out, l.events[i])
+		}
+	}
+	return out
+}
+
+func feedFilter(userID, zone string, beforeID int64, limit int) storage.ZoneActivityFilter {
+	return storage.ZoneActivityFilter{
+		UserID:   userID,
+		Zone:     zone,
+		Actions:  handlers.ZoneActivityActions,
+		BeforeID: beforeID,
+		Limit:    limit,
+	}
+}
+
+func TestZoneActivityFeedIsPerZone(t *testing.T) {
+	log := &auditLog{}
+	log.record(activityAlice, nil, "laptop", service.AuditActionItemPush, "default", "item-a1")
+	log.record(activityBob, nil, "phone", service.AuditActionItemPush, "default", "item-b1")
+	log.record(activityAlice, nil, "laptop", service.AuditActionSyncPull, "default", "")
+	log.record(activityAlice, nil, "tablet", service.AuditActionItemTombstone, "default", "item-a1")
+	log.record(activityAlice, nil, "tablet", service.AuditActionItemPush, "work", "item-a2")
+	log.record(activityBob, nil, "phone", service.AuditActionSyncDeleteAll, "default", "")
+	log.record(activityAlice, nil, "laptop", service.AuditActionZoneCreate, "family", "")
+
+	alice := log.page(feedFilter(activityAlice, "default", 0, 10))
+	require.Len(t, alice, 2, "pulls and other zones are not activity")
+	assert.Equal(t, service.AuditActionItemTombstone, alice[0].Action, "newest first")
+	assert.Equal(t, "tablet", *alice[0].DeviceID)
+	assert.Equal(t, service.AuditActionItemPush, alice[1].Action)
+
+	bob := log.page(feedFilter(activityBob, "default", 0, 10))
+	require.Len(t, bob, 2)
+	for _, event := range bob {
+		assert.Equal(t, activityBob, event.UserID, "a zone of the same name belongs to its owner")
+	}
+	assert.Equal(t, service.AuditActionSyncDeleteAll, bob[0].Action)
+
+	assert.Empty(t, log.page(feedFilter(activityAlice, "family", 0, 10)))
+}
+
+func TestZoneActivityFeedPages(t *testing.T) {
+	log := &auditLog{}
+	for i := 0; i < 7; i++ {
+		log.record(activityAlice, nil, "laptop", service.AuditActionItemPush, "default", "item")
+		log.record(activityBob, nil, "phone", service.AuditActionItemPush, "default", "item")
+	}
+
+	var seen []int64
+	beforeID := int64(0)
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 10)
+		page := log.page(feedFilter(activityAlice, "default", beforeID, 3))
+		for _, event := range page {
+			seen = append(seen, event.ID)
+		}
+		if len(page) < 3 {
+			break
+		}
+		beforeID = page[len(page)-1].ID
+	}
+	assert.Equal(t, []int64{13, 11, 9, 7, 5, 3, 1}, seen, "every row once, newest first")
+}
+
+func TestZoneActivityEntryHidesPrivateFields(t *testing.T) {
+	log := &auditLog{}
+	admin := activityAdmin
+	log.record(activityAlice, nil, "laptop", service.AuditActionItemPush, "default", "item-a1")
+	log.record(activityAlice, &admin, "", service.AuditActionItemTombstone, "default", "item-a1")
+
+	entry := handlers.NewZoneActivityEntry(log.events[0])
+	assert.Equal(t, activityAlice, entry.ActorID, "the owner acted")
+	assert.Equal(t, "item-a1", *entry.ItemUUID)
+	assert.Equal(t, "2026-10-01T12:00:00Z", entry.CreatedAt)
+
+	entry = handlers.NewZoneActivityEntry(log.events[1])
+	assert.Equal(t, activityAdmin, entry.ActorID)
+	assert.Nil(t, entry.DeviceID)
+
+	data, err := json.Marshal(entry)
+	require.NoError(t, err)
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(data, &fields))
+	assert.ElementsMatch(t, []string{"id", "actor_id", "device_id", "action", "item_uuid", "created_at"}, keysOf(fields))
+}
+
+func keysOf(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestZoneActivityRejectsBadQueries(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	// No store: these must be answered before anything is read
+	syncHandler := handlers.NewSyncHandler(nil, nil)
+	router := gin.New()
+	router.GET("/anonymous/:zone/activity", syncHandler.GetZoneActivity)
+	router.GET("/sync/zones/:zone/activity", func(c *gin.Context) {
+		middleware.SetClaims(c, &auth.Claims{UserID: activityAlice})
+		c.Next()
+	}, syncHandler.GetZoneActivity)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/anonymous/default/activity", http.StatusUnauthorized},
+		{"/sync/zones/default/activity?limit=0", http.StatusBadRequest},
+		{"/sync/zones/default/activity?limit=201", http.StatusBadRequest},
+		{"/sync/zones/default/activity?cursor=not-a-cursor", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		assert.Equal(t, tt.status, w.Code, tt.path)
+	}
+}
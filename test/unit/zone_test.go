@@ -0,0 +1,78 @@
+package unit
+
+import (
+	"testing"
+
+	"github.com/deeplyprofound/password-sync/pkg/models"
+	"github.com/deeplyprofound/password-sync/server/domain/sync"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func metadataKey() *models.CryptoKey {
+	return &models.CryptoKey{
+		ItemUUID: uuid.New(),
+		Data:     []byte("wrapped-metadata-key"),
+		Flags:    []byte(`{"encrypt":true,"decrypt":true}`),
+	}
+}
+
+func TestBootstrapZoneEmpty(t *testing.T) {
+	for _, template := range []string{"", sync.ZoneTemplateEmpty} {
+		bootstrap, err := sync.BootstrapZone(template, "default", nil)
+		require.NoError(t, err)
+
+		assert.Equal(t, sync.ZoneTemplateEmpty, bootstrap.Template)
+		assert.Nil(t, bootstrap.MetadataKey)
+		assert.Equal(t, "default", bootstrap.Manifest.Zone)
+		assert.Equal(t, int64(0), bootstrap.Manifest.GenCount)
+		assert.JSONEq(t, `[]`, string(bootstrap.Manifest.LeafIDs))
+
+		// Same digest a push computes for a zone with no live items
+		assert.Equal(t, sync.ManifestDigest(nil), bootstrap.Manifest.Digest)
+	}
+
+	_, err := sync.BootstrapZone(sync.ZoneTemplateEmpty, "default", metadataKey())
+	assert.ErrorIs(t, err, sync.ErrMetadataKeyForbidden)
+}
+
+func TestBootstrapZoneStandard(t *testing.T) {
+	key := metadataKey()
+	key.GenCount = 42
+	key.Zone = "elsewhere"
+
+	bootstrap, err := sync.BootstrapZone(sync.ZoneTemplateStandard, "work", key)
+	require.NoError(t, err)
+
+	assert.Equal(t, sync.ZoneTemplateStandard, bootstrap.Template)
+	assert.Equal(t, int64(1), bootstrap.Manifest.GenCount)
+	require.NotNil(t, bootstrap.MetadataKey)
+	assert.Equal(t, int64(1), bootstrap.MetadataKey.GenCount, "the key is the zone's first item")
+	assert.Equal(t, "work", bootstrap.MetadataKey.Zone)
+	leaf := sync.ManifestLeaf{Layer: sync.LeafCryptoKey, ItemUUID: key.ItemUUID.String(), GenCount: 1}
+	assert.Equal(t, sync.ManifestDigest([]sync.ManifestLeaf{leaf}), bootstrap.Manifest.Digest, "the digest covers the key")
+
+	_, err = sync.BootstrapZone(sync.ZoneTemplateStandard, "work", nil)
+	assert.ErrorIs(t, err, sync.ErrMetadataKeyRequired)
+
+	tombstoned := metadataKey()
+	tombstoned.Tombstone = true
+	_, err = sync.BootstrapZone(sync.ZoneTemplateStandard, "work", tombstoned)
+	assert.ErrorIs(t, err, sync.ErrMetadataKeyRequired)
+}
+
+func TestBootstrapZoneRejectsBadInput(t *testing.T) {
+	_, err := sync.BootstrapZone("premium", "default", nil)
+	assert.ErrorIs(t, err, sync.ErrUnknownZoneTemplate)
+
+	_, err = sync.BootstrapZone(sync.ZoneTemplateEmpty, "", nil)
+	assert.ErrorIs(t, err, sync.ErrInvalidZoneName)
+
+	long := make([]byte, 101)
+	for i := range long {
+		long[i] = 'z'
+	}
+	_, err = sync.BootstrapZone(sync.ZoneTemplateEmpty, string(long), nil)
+	assert.ErrorIs(t, err, sync.ErrInvalidZoneName)
+}